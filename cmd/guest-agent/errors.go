@@ -17,4 +17,14 @@ var (
 	ErrResolveGID    = errors.New("resolve gid")
 	ErrUserNotFound  = errors.New("user not found")
 	ErrGroupNotFound = errors.New("group not found")
+
+	// Swap setup errors
+	ErrSwapParam    = errors.New("invalid matchlock.swap param")
+	ErrSwapZram     = errors.New("configure zram")
+	ErrSwapFormat   = errors.New("format swap")
+	ErrSwapTooSmall = errors.New("swap area too small")
+	ErrSwapon       = errors.New("swapon")
+
+	// Filesystem freeze errors
+	ErrFreeze = errors.New("freeze filesystem")
 )
@@ -0,0 +1,82 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+const (
+	// FIFREEZE and FITHAW from linux/fs.h.
+	fiFreeze = 0xC0045877
+	fiThaw   = 0xC0045878
+
+	// freezeLimit bounds how long a filesystem stays frozen for a host
+	// that neither thaws it nor goes away.
+	freezeLimit = 2 * time.Minute
+)
+
+// FreezeRequest asks for the filesystem mounted at Path to be frozen.
+type FreezeRequest struct {
+	Path string `json:"path"`
+}
+
+// handleFreeze freezes the filesystem of the request, flushing it to its
+// disk and holding back writes so the host can copy the disk whole. It is
+// thawed once the host closes the connection, or after freezeLimit, so a
+// host that goes away never leaves the guest frozen. The reply, an
+// ExecResponse, is sent once frozen.
+func handleFreeze(fd int, data []byte) {
+	defer syscall.Close(fd)
+
+	var req FreezeRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		sendFreezeResult(fd, errx.Wrap(ErrFreeze, err))
+		return
+	}
+	f, err := os.Open(req.Path)
+	if err != nil {
+		sendFreezeResult(fd, errx.Wrap(ErrFreeze, err))
+		return
+	}
+	defer f.Close()
+	if err := fsIoctl(f, fiFreeze); err != nil {
+		sendFreezeResult(fd, errx.With(ErrFreeze, " %s: %w", req.Path, err))
+		return
+	}
+	defer fsIoctl(f, fiThaw)
+	sendFreezeResult(fd, nil)
+
+	closed := make(chan struct{})
+	go func() {
+		readFull(fd, make([]byte, 1))
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(freezeLimit):
+		syscall.Shutdown(fd, syscall.SHUT_RDWR)
+	}
+}
+
+func fsIoctl(f *os.File, req uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func sendFreezeResult(fd int, err error) {
+	var resp ExecResponse
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Error = err.Error()
+	}
+	data, _ := json.Marshal(resp)
+	sendMessage(fd, MsgTypeExecResult, data)
+}
@@ -45,6 +45,7 @@ const (
 	MsgTypeExit       uint8 = 10
 	MsgTypeExecStream uint8 = 11
 	MsgTypeExecPipe   uint8 = 12
+	MsgTypeFreeze     uint8 = 13
 )
 
 type sockaddrVM struct {
@@ -56,31 +57,38 @@ type sockaddrVM struct {
 }
 
 type ExecRequest struct {
-	Command    string            `json:"command"`
-	Args       []string          `json:"args"`
-	WorkingDir string            `json:"working_dir"`
-	Env        map[string]string `json:"env"`
-	Stdin      []byte            `json:"stdin"`
-	User       string            `json:"user,omitempty"`
+	Command          string            `json:"command"`
+	Args             []string          `json:"args"`
+	WorkingDir       string            `json:"working_dir"`
+	CreateWorkingDir bool              `json:"create_working_dir,omitempty"`
+	Env              map[string]string `json:"env"`
+	Stdin            []byte            `json:"stdin"`
+	User             string            `json:"user,omitempty"`
 }
 
 type ExecTTYRequest struct {
-	Command    string            `json:"command"`
-	Args       []string          `json:"args"`
-	WorkingDir string            `json:"working_dir"`
-	Env        map[string]string `json:"env"`
-	Rows       uint16            `json:"rows"`
-	Cols       uint16            `json:"cols"`
-	User       string            `json:"user,omitempty"`
+	Command          string            `json:"command"`
+	Args             []string          `json:"args"`
+	WorkingDir       string            `json:"working_dir"`
+	CreateWorkingDir bool              `json:"create_working_dir,omitempty"`
+	Env              map[string]string `json:"env"`
+	Rows             uint16            `json:"rows"`
+	Cols             uint16            `json:"cols"`
+	User             string            `json:"user,omitempty"`
 }
 
 type ExecResponse struct {
-	ExitCode int    `json:"exit_code"`
-	Stdout   []byte `json:"stdout"`
-	Stderr   []byte `json:"stderr"`
-	Error    string `json:"error"`
+	ExitCode  int    `json:"exit_code"`
+	Stdout    []byte `json:"stdout"`
+	Stderr    []byte `json:"stderr"`
+	Error     string `json:"error"`
+	ErrorCode string `json:"error_code,omitempty"`
 }
 
+// execErrorWorkingDir marks an ExecResponse whose command was not started
+// because its working directory is missing or could not be created.
+const execErrorWorkingDir = "working_dir"
+
 func main() {
 	// If re-execed as sandbox launcher, apply seccomp + drop caps + exec real command
 	if isSandboxLauncher() {
@@ -93,6 +101,9 @@ func main() {
 	// Mount /proc inside new PID namespace (children need it)
 	ensureProcMounted()
 
+	// Enable swap before any workload can allocate memory
+	setupSwap()
+
 	// Start ready listener first
 	go serveReady()
 
@@ -210,11 +221,62 @@ func handleExec(fd int) {
 		handleExecPipe(fd, data)
 	case MsgTypeExecTTY:
 		handleExecTTY(fd, data)
+	case MsgTypeFreeze:
+		handleFreeze(fd, data)
 	default:
 		syscall.Close(fd)
 	}
 }
 
+// newExecCommand builds the process for an exec request. When args is set it
+// is run directly as argv, with no shell interpretation of quotes, globs or
+// variables; otherwise command is run by sh -c.
+func newExecCommand(command string, args []string) *exec.Cmd {
+	if len(args) > 0 {
+		return exec.Command(args[0], args[1:]...)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// prepareWorkingDir checks that dir exists before a command is started in it,
+// so a missing directory is reported as such rather than as a failed chdir
+// buried in the command's output. With create, a missing dir is created and,
+// when user is set, chowned to that user.
+func prepareWorkingDir(dir, user string, create bool) error {
+	if dir == "" {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "chdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if !create || !os.IsNotExist(err) {
+		return err
+	}
+	uid, gid := -1, -1
+	if user != "" {
+		if uid, gid, _, err = resolveUser(user); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.Chown(dir, uid, gid)
+}
+
+// sendWorkingDirError reports a prepareWorkingDir failure on a pipe or TTY
+// exec connection and closes it. The ExecResult lets the host surface a typed
+// error; the exit code keeps older hosts that ignore it working.
+func sendWorkingDirError(fd int, err error) {
+	sendExecResponse(fd, &ExecResponse{ExitCode: 1, Error: err.Error(), ErrorCode: execErrorWorkingDir})
+	sendExitCode(fd, 1)
+	syscall.Close(fd)
+}
+
 func handleExecBatch(fd int, data []byte) {
 	var req ExecRequest
 	if err := json.Unmarshal(data, &req); err != nil {
@@ -225,13 +287,15 @@ func handleExecBatch(fd int, data []byte) {
 	wipeBytes(data)
 
 	var stdout, stderr bytes.Buffer
-	cmd := exec.Command("sh", "-c", req.Command)
+	cmd := newExecCommand(req.Command, req.Args)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	if req.WorkingDir != "" {
-		cmd.Dir = req.WorkingDir
+	if err := prepareWorkingDir(req.WorkingDir, req.User, req.CreateWorkingDir); err != nil {
+		sendExecResponse(fd, &ExecResponse{ExitCode: 1, Error: err.Error(), ErrorCode: execErrorWorkingDir})
+		return
 	}
+	cmd.Dir = req.WorkingDir
 
 	if len(req.Env) > 0 {
 		env := os.Environ()
@@ -284,7 +348,7 @@ func handleExecStreamBatch(fd int, data []byte) {
 
 	wipeBytes(data)
 
-	cmd := exec.Command("sh", "-c", req.Command)
+	cmd := newExecCommand(req.Command, req.Args)
 
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
@@ -297,9 +361,11 @@ func handleExecStreamBatch(fd int, data []byte) {
 		return
 	}
 
-	if req.WorkingDir != "" {
-		cmd.Dir = req.WorkingDir
+	if err := prepareWorkingDir(req.WorkingDir, req.User, req.CreateWorkingDir); err != nil {
+		sendExecResponse(fd, &ExecResponse{ExitCode: 1, Error: err.Error(), ErrorCode: execErrorWorkingDir})
+		return
 	}
+	cmd.Dir = req.WorkingDir
 
 	if len(req.Env) > 0 {
 		env := os.Environ()
@@ -384,7 +450,7 @@ func handleExecPipe(fd int, data []byte) {
 
 	wipeBytes(data)
 
-	cmd := exec.Command("sh", "-c", req.Command)
+	cmd := newExecCommand(req.Command, req.Args)
 
 	stdinPipe, err := cmd.StdinPipe()
 	if err != nil {
@@ -408,9 +474,11 @@ func handleExecPipe(fd int, data []byte) {
 		return
 	}
 
-	if req.WorkingDir != "" {
-		cmd.Dir = req.WorkingDir
+	if err := prepareWorkingDir(req.WorkingDir, req.User, req.CreateWorkingDir); err != nil {
+		sendWorkingDirError(fd, err)
+		return
 	}
+	cmd.Dir = req.WorkingDir
 
 	if len(req.Env) > 0 {
 		env := os.Environ()
@@ -540,11 +608,13 @@ func handleExecTTY(fd int, data []byte) {
 	// Wipe the raw request data from memory
 	wipeBytes(data)
 
-	cmd := exec.Command("sh", "-c", req.Command)
+	cmd := newExecCommand(req.Command, req.Args)
 
-	if req.WorkingDir != "" {
-		cmd.Dir = req.WorkingDir
+	if err := prepareWorkingDir(req.WorkingDir, req.User, req.CreateWorkingDir); err != nil {
+		sendWorkingDirError(fd, err)
+		return
 	}
+	cmd.Dir = req.WorkingDir
 
 	if len(req.Env) > 0 {
 		env := os.Environ()
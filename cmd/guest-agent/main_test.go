@@ -0,0 +1,33 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepareWorkingDir(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "a", "b")
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+
+	assert.NoError(t, prepareWorkingDir("", "", false))
+	assert.NoError(t, prepareWorkingDir(dir, "", false))
+
+	err := prepareWorkingDir(missing, "", false)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.NoDirExists(t, missing)
+
+	err = prepareWorkingDir(file, "", true)
+	assert.ErrorIs(t, err, syscall.ENOTDIR)
+
+	require.NoError(t, prepareWorkingDir(missing, "", true))
+	assert.DirExists(t, missing)
+}
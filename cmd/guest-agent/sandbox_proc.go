@@ -290,9 +290,12 @@ func applySandboxSysProcAttrBatch(cmd *exec.Cmd) {
 func wrapCommandForSandbox(cmd *exec.Cmd) {
 	origArgs := cmd.Args // e.g. ["sh", "-c", "python3 script.py"]
 
-	// Set the binary to re-exec ourselves
+	// Set the binary to re-exec ourselves. The launcher resolves the real
+	// binary inside the sandbox environment, so drop any lookup error from
+	// exec.Command (e.g. an argv[0] only found via the request's PATH).
 	cmd.Path = "/proc/self/exe"
 	cmd.Args = []string{"guest-agent"}
+	cmd.Err = nil
 
 	// Pass the original command via env vars
 	if cmd.Env == nil {
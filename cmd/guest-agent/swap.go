@@ -0,0 +1,126 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+const (
+	zramDevice = "/dev/zram0"
+	zramSysfs  = "/sys/block/zram0"
+
+	// swapFlagDiscard lets the kernel discard freed swap slots, returning
+	// zram memory and sparse disk blocks to the host.
+	swapFlagDiscard = 0x10000
+
+	// minSwapPages is the smallest swap area the kernel accepts.
+	minSwapPages = 10
+)
+
+// setupSwap enables the swap area named by matchlock.swap= on the kernel
+// command line: "zram:<MB>" for compressed RAM swap, or a block device path
+// for a disk the host attached for swap. Failures are logged, not fatal; the
+// sandbox then simply runs without swap.
+func setupSwap() {
+	data, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return
+	}
+	param, ok := swapParam(string(data))
+	if !ok {
+		return
+	}
+	if err := enableSwap(param); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: swap not enabled: %v\n", err)
+		return
+	}
+	fmt.Println("Swap enabled on", param)
+}
+
+// swapParam returns the value of matchlock.swap= in cmdline.
+func swapParam(cmdline string) (string, bool) {
+	for _, field := range strings.Fields(cmdline) {
+		if v, ok := strings.CutPrefix(field, "matchlock.swap="); ok && v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func enableSwap(param string) error {
+	device := param
+	if sizeMB, ok := strings.CutPrefix(param, "zram:"); ok {
+		mb, err := strconv.Atoi(sizeMB)
+		if err != nil || mb <= 0 {
+			return errx.With(ErrSwapParam, ": %q", param)
+		}
+		if err := os.WriteFile(zramSysfs+"/disksize", []byte(strconv.Itoa(mb<<20)), 0644); err != nil {
+			return errx.With(ErrSwapZram, ": %w (is CONFIG_ZRAM enabled in the guest kernel?)", err)
+		}
+		device = zramDevice
+	}
+
+	if err := formatSwap(device, os.Getpagesize()); err != nil {
+		return err
+	}
+	return swapon(device, swapFlagDiscard)
+}
+
+// formatSwap writes a version 1 swap header covering the whole device, as
+// mkswap does, so guest images need not ship swap tools.
+func formatSwap(device string, pageSize int) error {
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return errx.With(ErrSwapFormat, " %s: %w", device, err)
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errx.With(ErrSwapFormat, " %s: %w", device, err)
+	}
+	header, err := swapHeader(size, pageSize)
+	if err != nil {
+		return errx.With(ErrSwapFormat, " %s: %w", device, err)
+	}
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return errx.With(ErrSwapFormat, " %s: %w", device, err)
+	}
+	return f.Sync()
+}
+
+// swapHeader returns the first page of a swap area of size bytes: boot
+// block, then version, last page and bad page count at offset 1024, and the
+// SWAPSPACE2 magic in the last 10 bytes of the page.
+func swapHeader(size int64, pageSize int) ([]byte, error) {
+	pages := size / int64(pageSize)
+	if pages < minSwapPages {
+		return nil, errx.With(ErrSwapTooSmall, ": %d bytes", size)
+	}
+	header := make([]byte, pageSize)
+	binary.LittleEndian.PutUint32(header[1024:], 1)
+	binary.LittleEndian.PutUint32(header[1028:], uint32(pages-1))
+	copy(header[pageSize-10:], "SWAPSPACE2")
+	return header, nil
+}
+
+func swapon(device string, flags int) error {
+	path, err := syscall.BytePtrFromString(device)
+	if err != nil {
+		return errx.With(ErrSwapon, " %s: %w", device, err)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_SWAPON, uintptr(unsafe.Pointer(path)), uintptr(flags), 0); errno != 0 {
+		return errx.With(ErrSwapon, " %s: %w", device, errno)
+	}
+	return nil
+}
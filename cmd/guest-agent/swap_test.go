@@ -0,0 +1,52 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwapParam(t *testing.T) {
+	param, ok := swapParam("console=ttyS0 matchlock.workspace=/workspace matchlock.swap=zram:256")
+	require.True(t, ok)
+	assert.Equal(t, "zram:256", param)
+
+	param, ok = swapParam("matchlock.swap=/dev/vdc init=/init")
+	require.True(t, ok)
+	assert.Equal(t, "/dev/vdc", param)
+
+	_, ok = swapParam("console=ttyS0 matchlock.disk.vdb=/data")
+	assert.False(t, ok)
+}
+
+func TestSwapHeader(t *testing.T) {
+	header, err := swapHeader(1<<20, 4096)
+	require.NoError(t, err)
+	require.Len(t, header, 4096)
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(header[1024:]))
+	assert.Equal(t, uint32(255), binary.LittleEndian.Uint32(header[1028:]))
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(header[1032:]))
+	assert.Equal(t, "SWAPSPACE2", string(header[4086:]))
+
+	_, err = swapHeader(9*4096, 4096)
+	assert.ErrorIs(t, err, ErrSwapTooSmall)
+}
+
+func TestFormatSwap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "swap.img")
+	require.NoError(t, os.WriteFile(path, make([]byte, 64*4096), 0600))
+
+	require.NoError(t, formatSwap(path, 4096))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "SWAPSPACE2", string(data[4086:4096]))
+	assert.Equal(t, uint32(63), binary.LittleEndian.Uint32(data[1028:]))
+
+	assert.ErrorIs(t, enableSwap("zram:abc"), ErrSwapParam)
+}
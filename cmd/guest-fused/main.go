@@ -50,6 +50,10 @@ const (
 	OpSymlink
 	OpReadlink
 	OpLink
+	OpGetxattr
+	OpSetxattr
+	OpListxattr
+	OpRemovexattr
 )
 
 type VFSRequest struct {
@@ -62,6 +66,7 @@ type VFSRequest struct {
 	Data    []byte `cbor:"data,omitempty"`
 	Flags   uint32 `cbor:"flags,omitempty"`
 	Mode    uint32 `cbor:"mode,omitempty"`
+	Name    string `cbor:"name,omitempty"`
 }
 
 type VFSResponse struct {
@@ -78,6 +83,8 @@ type VFSStat struct {
 	Mode    uint32 `cbor:"mode"`
 	ModTime int64  `cbor:"mtime"`
 	IsDir   bool   `cbor:"is_dir"`
+	UID     uint32 `cbor:"uid,omitempty"`
+	GID     uint32 `cbor:"gid,omitempty"`
 }
 
 type VFSDirEntry struct {
@@ -155,6 +162,10 @@ var _ = (fs.NodeCreater)((*VFSRoot)(nil))
 var _ = (fs.NodeUnlinker)((*VFSRoot)(nil))
 var _ = (fs.NodeRmdirer)((*VFSRoot)(nil))
 var _ = (fs.NodeRenamer)((*VFSRoot)(nil))
+var _ = (fs.NodeGetxattrer)((*VFSRoot)(nil))
+var _ = (fs.NodeSetxattrer)((*VFSRoot)(nil))
+var _ = (fs.NodeListxattrer)((*VFSRoot)(nil))
+var _ = (fs.NodeRemovexattrer)((*VFSRoot)(nil))
 
 // VFSNode represents a file or directory in the VFS
 type VFSNode struct {
@@ -174,6 +185,10 @@ var _ = (fs.NodeUnlinker)((*VFSNode)(nil))
 var _ = (fs.NodeRmdirer)((*VFSNode)(nil))
 var _ = (fs.NodeRenamer)((*VFSNode)(nil))
 var _ = (fs.NodeSetattrer)((*VFSNode)(nil))
+var _ = (fs.NodeGetxattrer)((*VFSNode)(nil))
+var _ = (fs.NodeSetxattrer)((*VFSNode)(nil))
+var _ = (fs.NodeListxattrer)((*VFSNode)(nil))
+var _ = (fs.NodeRemovexattrer)((*VFSNode)(nil))
 
 func (r *VFSRoot) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
 	resp, err := r.client.Request(&VFSRequest{Op: OpGetattr, Path: r.basePath})
@@ -305,6 +320,22 @@ func (r *VFSRoot) Rename(ctx context.Context, name string, newParent fs.InodeEmb
 	return 0
 }
 
+func (r *VFSRoot) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	return getxattr(r.client, r.basePath, attr, dest)
+}
+
+func (r *VFSRoot) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return setxattr(r.client, r.basePath, attr, data, flags)
+}
+
+func (r *VFSRoot) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	return listxattr(r.client, r.basePath, dest)
+}
+
+func (r *VFSRoot) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return removexattr(r.client, r.basePath, attr)
+}
+
 // VFSNode implementations
 
 func (n *VFSNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
@@ -489,6 +520,78 @@ func (n *VFSNode) Rename(ctx context.Context, name string, newParent fs.InodeEmb
 	return 0
 }
 
+func (n *VFSNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	return getxattr(n.client, n.path, attr, dest)
+}
+
+func (n *VFSNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return setxattr(n.client, n.path, attr, data, flags)
+}
+
+func (n *VFSNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	return listxattr(n.client, n.path, dest)
+}
+
+func (n *VFSNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return removexattr(n.client, n.path, attr)
+}
+
+// Extended attributes, including POSIX ACLs, are kept by the host, which
+// also enforces the ACLs on its own files.
+
+func getxattr(client *VFSClient, path, attr string, dest []byte) (uint32, syscall.Errno) {
+	resp, err := client.Request(&VFSRequest{Op: OpGetxattr, Path: path, Name: attr})
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	if resp.Err != 0 {
+		return 0, syscall.Errno(-resp.Err)
+	}
+	return copyXattr(dest, resp.Data)
+}
+
+func setxattr(client *VFSClient, path, attr string, data []byte, flags uint32) syscall.Errno {
+	resp, err := client.Request(&VFSRequest{Op: OpSetxattr, Path: path, Name: attr, Data: data, Flags: flags})
+	if err != nil {
+		return syscall.EIO
+	}
+	if resp.Err != 0 {
+		return syscall.Errno(-resp.Err)
+	}
+	return 0
+}
+
+func listxattr(client *VFSClient, path string, dest []byte) (uint32, syscall.Errno) {
+	resp, err := client.Request(&VFSRequest{Op: OpListxattr, Path: path})
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	if resp.Err != 0 {
+		return 0, syscall.Errno(-resp.Err)
+	}
+	return copyXattr(dest, resp.Data)
+}
+
+func removexattr(client *VFSClient, path, attr string) syscall.Errno {
+	resp, err := client.Request(&VFSRequest{Op: OpRemovexattr, Path: path, Name: attr})
+	if err != nil {
+		return syscall.EIO
+	}
+	if resp.Err != 0 {
+		return syscall.Errno(-resp.Err)
+	}
+	return 0
+}
+
+// copyXattr copies value into dest, failing with ERANGE and the size needed
+// if it does not fit.
+func copyXattr(dest, value []byte) (uint32, syscall.Errno) {
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
 // VFSFileHandle handles read/write operations on open files
 type VFSFileHandle struct {
 	client *VFSClient
@@ -569,6 +672,8 @@ func fillAttr(attr *fuse.Attr, stat *VFSStat) {
 	attr.Atime = uint64(stat.ModTime)
 	attr.Blksize = 4096
 	attr.Blocks = (uint64(stat.Size) + 511) / 512
+	attr.Uid = stat.UID
+	attr.Gid = stat.GID
 	if stat.IsDir {
 		attr.Mode = syscall.S_IFDIR | (stat.Mode & 0777)
 		attr.Nlink = 2
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// isGitContext reports whether a build context names a git repository
+// rather than a local directory, following docker build's rules.
+func isGitContext(s string) bool {
+	switch {
+	case strings.HasPrefix(s, "git://"), strings.HasPrefix(s, "git@"), strings.HasPrefix(s, "ssh://"):
+		return true
+	case strings.HasPrefix(s, "github.com/"):
+		return true
+	case strings.HasPrefix(s, "https://"), strings.HasPrefix(s, "http://"):
+		url, _, _ := strings.Cut(s, "#")
+		return strings.HasSuffix(url, ".git")
+	}
+	return false
+}
+
+// parseGitContext splits a git build context of the form URL#REF:SUBDIR.
+// Both parts of the fragment are optional.
+func parseGitContext(s string) (url, ref, subdir string) {
+	url, fragment, _ := strings.Cut(s, "#")
+	ref, subdir, _ = strings.Cut(fragment, ":")
+	if strings.HasPrefix(url, "github.com/") {
+		url = "https://" + url
+	}
+	return url, ref, subdir
+}
+
+// remoteBuildContext fetches a git or stdin build context into a temporary
+// directory and returns it with a function removing it. Local directories
+// are returned as they are.
+func remoteBuildContext(ctx context.Context, arg string) (string, func(), error) {
+	if arg != "-" && !isGitContext(arg) {
+		return arg, func() {}, nil
+	}
+	dir, err := os.MkdirTemp("", "matchlock-build-context-*")
+	if err != nil {
+		return "", nil, errx.Wrap(ErrBuildContext, err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	if arg == "-" {
+		err = stdinBuildContext(os.Stdin, dir)
+	} else {
+		var subdir string
+		subdir, err = cloneBuildContext(ctx, arg, dir)
+		if err == nil && subdir != "" {
+			sub := filepath.Join(dir, filepath.FromSlash(subdir))
+			if !filepath.IsLocal(filepath.FromSlash(subdir)) {
+				err = errx.With(ErrBuildContext, ": subdirectory %q is outside the repository", subdir)
+			} else if info, statErr := os.Stat(sub); statErr != nil || !info.IsDir() {
+				err = errx.With(ErrBuildContext, ": %q is not a directory in %s", subdir, arg)
+			}
+			dir = sub
+		}
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// cloneBuildContext shallow-clones the git context into dir at its ref,
+// which may be a branch, tag or commit, and returns its subdirectory.
+func cloneBuildContext(ctx context.Context, spec, dir string) (string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", errx.With(ErrBuildContext, ": git is needed for %s", spec)
+	}
+	url, ref, subdir := parseGitContext(spec)
+	if ref == "" {
+		ref = "HEAD"
+	}
+	fmt.Fprintf(os.Stderr, "Cloning %s (%s)...\n", url, ref)
+
+	git := func(args ...string) error {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+		// Never wait on a credential prompt nobody will see.
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return errx.With(ErrBuildContext, ": git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+	// Fetching the ref directly, rather than clone --branch, also works for
+	// commit SHAs.
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"remote", "add", "origin", url},
+		{"fetch", "-q", "--depth", "1", "origin", ref},
+		{"checkout", "-q", "FETCH_HEAD"},
+		{"submodule", "update", "-q", "--init", "--recursive", "--depth", "1"},
+	} {
+		if err := git(args...); err != nil {
+			return "", err
+		}
+	}
+	// The build never needs the history, and BuildKit would otherwise send
+	// it along with the context.
+	os.RemoveAll(filepath.Join(dir, ".git"))
+	return subdir, nil
+}
+
+// stdinBuildContext unpacks a tar build context, optionally gzipped, from r
+// into dir. Anything other than a tarball is taken as a Dockerfile for an
+// empty context, as with `docker build - < Dockerfile`.
+func stdinBuildContext(r io.Reader, dir string) error {
+	sr := bufio.NewReader(r)
+	if magic, _ := sr.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(sr)
+		if err != nil {
+			return errx.Wrap(ErrBuildContext, err)
+		}
+		defer gz.Close()
+		sr = bufio.NewReader(gz)
+	}
+
+	if header, _ := sr.Peek(512); len(header) < 262 || string(header[257:262]) != "ustar" {
+		data, err := io.ReadAll(sr)
+		if err != nil {
+			return errx.Wrap(ErrBuildContext, err)
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			return errx.With(ErrBuildContext, ": nothing on stdin")
+		}
+		return os.WriteFile(filepath.Join(dir, "Dockerfile"), data, 0644)
+	}
+	return extractContextTar(tar.NewReader(sr), dir)
+}
+
+// extractContextTar writes the entries of tr under dir. Entries are never
+// written outside dir, including through symlinks the tarball creates.
+func extractContextTar(tr *tar.Reader, dir string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return errx.Wrap(ErrBuildContext, err)
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errx.Wrap(ErrBuildContext, err)
+		}
+		rel := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if rel == "." {
+			continue
+		}
+		if !filepath.IsLocal(rel) {
+			return errx.With(ErrBuildContext, ": %q is outside the context", hdr.Name)
+		}
+		target := filepath.Join(root, rel)
+		if err := contextParentDirs(root, rel); err != nil {
+			return errx.With(ErrBuildContext, ": %s: %w", hdr.Name, err)
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return errx.Wrap(ErrBuildContext, err)
+			}
+		case tar.TypeReg:
+			// A symlink left by an earlier entry must not be written through.
+			os.Remove(target)
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+			if err != nil {
+				return errx.Wrap(ErrBuildContext, err)
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return errx.Wrap(ErrBuildContext, err)
+			}
+		case tar.TypeSymlink:
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return errx.Wrap(ErrBuildContext, err)
+			}
+		}
+	}
+}
+
+// contextParentDirs creates the directories leading to rel under root,
+// refusing to pass through symlinks, which could point outside root.
+func contextParentDirs(root, rel string) error {
+	cur := root
+	for _, part := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(cur, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", part)
+		}
+	}
+	return nil
+}
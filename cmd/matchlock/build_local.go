@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/image"
+)
+
+// localBuild is a Dockerfile build on the host's own BuildKit.
+type localBuild struct {
+	context    string
+	dockerfile string
+	tag        string
+	progress   string
+	// opts are the buildctl build options, one shell line each.
+	opts string
+	// proxyEnv exports the proxy build args for a buildkitd started for
+	// the build.
+	proxyEnv string
+}
+
+// buildkitdSockets are where buildkitd listens by default: rootless, then
+// rootful.
+func buildkitdSockets() []string {
+	var socks []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		socks = append(socks, filepath.Join(dir, "buildkit", "buildkitd.sock"))
+	}
+	return append(socks, "/run/buildkit/buildkitd.sock")
+}
+
+// localBuildctl returns the shell command that runs buildctl against the
+// host's BuildKit: the buildkitd at $BUILDKIT_HOST or a default socket, or
+// else a rootless one that buildctl-daemonless.sh starts for the build. The
+// second result reports the latter.
+func localBuildctl() (string, bool, error) {
+	if host := os.Getenv("BUILDKIT_HOST"); host != "" {
+		buildctl, err := exec.LookPath("buildctl")
+		if err != nil {
+			return "", false, errx.With(ErrLocalBuildKit, ": BUILDKIT_HOST is set but buildctl is not installed")
+		}
+		return shellQuote(buildctl) + " --addr " + shellQuote(host), false, nil
+	}
+	if buildctl, err := exec.LookPath("buildctl"); err == nil {
+		for _, sock := range buildkitdSockets() {
+			if info, err := os.Stat(sock); err == nil && info.Mode()&os.ModeSocket != 0 {
+				return shellQuote(buildctl) + " --addr " + shellQuote("unix://"+sock), false, nil
+			}
+		}
+	}
+	if daemonless, err := exec.LookPath("buildctl-daemonless.sh"); err == nil {
+		return shellQuote(daemonless), true, nil
+	}
+	return "", false, errx.With(ErrLocalBuildKit, ": no buildkitd found; set BUILDKIT_HOST, start buildkitd, or install rootless BuildKit (buildctl-daemonless.sh), or use --builder vm")
+}
+
+// runLocalBuild builds b with the host's BuildKit and imports the result.
+func runLocalBuild(ctx context.Context, b localBuild) error {
+	buildctl, daemonless, err := localBuildctl()
+	if err != nil {
+		return err
+	}
+
+	buildOpts := &image.BuildOptions{}
+	builder, err := newImageBuilder(buildOpts)
+	if err != nil {
+		return err
+	}
+
+	outputDir, err := os.MkdirTemp("", "matchlock-build-output-*")
+	if err != nil {
+		return errx.Wrap(ErrCreateOutputDir, err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	// A buildkitd started for the build gets the registry mirrors and the
+	// proxy, as the one in the VM does; a running one has its own config.
+	env := ""
+	if daemonless {
+		env = b.proxyEnv
+		if toml := buildOpts.Registries.BuildkitdConfig(); toml != "" {
+			configPath := filepath.Join(outputDir, "buildkitd.toml")
+			if err := os.WriteFile(configPath, []byte(toml), 0644); err != nil {
+				return errx.Wrap(ErrWriteBuildScript, err)
+			}
+			env += fmt.Sprintf("export BUILDKITD_FLAGS=%s\n", shellQuote("--config="+configPath))
+		}
+	}
+
+	tarballPath := filepath.Join(outputDir, "image.tar")
+	script := fmt.Sprintf(`set -e
+%s%s build \
+  --progress %s \
+  --frontend dockerfile.v0 \
+  --local %s \
+  --local %s \
+%s  --output %s
+`, env, buildctl, b.progress, shellQuote("context="+b.context), shellQuote("dockerfile="+filepath.Dir(b.dockerfile)),
+		b.opts, shellQuote("type=docker,dest="+tarballPath))
+
+	fmt.Fprintf(os.Stderr, "Building image from %s with local BuildKit...\n", b.dockerfile)
+	cmd := exec.CommandContext(ctx, "sh", "-c", script)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errx.Wrap(ErrBuildKitBuild, err)
+	}
+
+	return importBuiltImage(ctx, builder, tarballPath, b.tag)
+}
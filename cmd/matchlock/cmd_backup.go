@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/backup"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Back up and restore the matchlock host state",
+	Long: `Back up the matchlock host state into a single archive, or restore it, so a
+host can be rebuilt or migrated with its sandbox inventory intact.
+
+An archive holds sandbox state (config, status, logs, metrics), subnet
+allocations, image and snapshot metadata, and ~/.config/matchlock. Sandbox and
+image disks are only included with --data. Without them, restored sandboxes
+can be re-created with 'matchlock run --from', and images are re-pulled.
+
+Sandboxes are not running after a restore. Back up while they are stopped to
+capture consistent disks.`,
+}
+
+var backupCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Write the host state to an archive",
+	Example: `  matchlock backup create -o host.tar.gz
+  matchlock backup create --data -o - | ssh new-host matchlock backup restore -`,
+	Args: cobra.NoArgs,
+	RunE: runBackupCreate,
+}
+
+var backupRestoreCmd = &cobra.Command{
+	Use:   "restore <archive>",
+	Short: "Restore the host state from an archive ('-' for stdin)",
+	Long: `Restore the host state from an archive created by 'matchlock backup create'.
+
+Files that already exist on this host are kept unless --force is set. Image
+metadata is only restored together with the image's disk.`,
+	Example: `  matchlock backup restore host.tar.gz
+  matchlock backup restore --force host.tar.gz`,
+	Args: cobra.ExactArgs(1),
+	RunE: runBackupRestore,
+}
+
+func init() {
+	adminOnly(backupRestoreCmd)
+	backupCreateCmd.Flags().StringP("output", "o", "", "Archive path, or - for stdout (default: matchlock-backup-<time>.tar.gz)")
+	backupCreateCmd.Flags().Bool("data", false, "Include sandbox and image disks")
+	viper.BindPFlag("backup.create.output", backupCreateCmd.Flags().Lookup("output"))
+	viper.BindPFlag("backup.create.data", backupCreateCmd.Flags().Lookup("data"))
+
+	backupRestoreCmd.Flags().Bool("force", false, "Overwrite existing files")
+	viper.BindPFlag("backup.restore.force", backupRestoreCmd.Flags().Lookup("force"))
+
+	backupCmd.AddCommand(backupCreateCmd)
+	backupCmd.AddCommand(backupRestoreCmd)
+	rootCmd.AddCommand(backupCmd)
+}
+
+func runBackupCreate(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	data, _ := cmd.Flags().GetBool("data")
+
+	if output == "" {
+		output = fmt.Sprintf("matchlock-backup-%s.tar.gz", time.Now().Format("20060102-150405"))
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return errx.Wrap(backup.ErrCreateBackup, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	manifest, err := backup.Create(w, backup.DefaultPaths(), backup.Options{Data: data})
+	if err != nil {
+		if output != "-" {
+			os.Remove(output)
+		}
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Backed up %d sandboxes, %d images (%d files) to %s\n",
+		len(manifest.Sandboxes), len(manifest.Images), manifest.Files, output)
+	return nil
+}
+
+func runBackupRestore(cmd *cobra.Command, args []string) error {
+	force, _ := cmd.Flags().GetBool("force")
+
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return errx.Wrap(backup.ErrRestoreBackup, err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	result, err := backup.Restore(r, backup.DefaultPaths(), backup.RestoreOptions{Overwrite: force})
+	if err != nil {
+		return err
+	}
+
+	if platform := runtime.GOOS + "/" + runtime.GOARCH; result.Manifest.Platform != platform {
+		fmt.Fprintf(os.Stderr, "Warning: archive was created on %s; its disks may not boot on %s\n", result.Manifest.Platform, platform)
+	}
+	for _, name := range result.Skipped {
+		fmt.Fprintf(os.Stderr, "Skipped %s\n", name)
+	}
+	fmt.Fprintf(os.Stderr, "Restored %d files (%d sandboxes, %d images in archive)\n",
+		result.Restored, len(result.Manifest.Sandboxes), len(result.Manifest.Images))
+	return nil
+}
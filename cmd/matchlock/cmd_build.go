@@ -1,21 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/sys/unix"
+	"golang.org/x/term"
 
 	"github.com/jingkaihe/matchlock/internal/errx"
 	"github.com/jingkaihe/matchlock/pkg/api"
 	"github.com/jingkaihe/matchlock/pkg/image"
 	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/vm"
 )
 
 var buildCmd = &cobra.Command{
@@ -23,13 +29,40 @@ var buildCmd = &cobra.Command{
 	Short: "Build image from a Dockerfile using BuildKit-in-VM",
 	Long: `Build an image from a Dockerfile using BuildKit-in-VM.
 
+With --builder local, the build runs on the host's own BuildKit instead of booting a
+VM: the buildkitd at $BUILDKIT_HOST or its default rootful or rootless socket, or else
+one that buildctl-daemonless.sh starts for the build. --build-cpus, --build-memory,
+--build-disk and --build-cache-size do not apply; buildkitd keeps its own cache.
+
 The argument is the build context directory. If a Dockerfile exists in the context directory,
 it is picked up automatically. Use -f/--file to specify an alternative Dockerfile.
+The context may also be a git repository (https://...git, git@..., github.com/...),
+optionally followed by #REF:SUBDIR, which is shallow-cloned; or "-" to read a tar
+(optionally gzipped) or a lone Dockerfile from stdin.
+
+An image built elsewhere on this host can be imported instead of built:
+docker-daemon:IMAGE reads it from the local Docker or Podman engine ($DOCKER_HOST,
+/var/run/docker.sock or the Podman socket), docker-archive:PATH from a
+"docker save" tarball, containerd:IMAGE from containerd's image store via ctr
+(namespace $CONTAINERD_NAMESPACE, default "default"), and
+containers-storage:IMAGE from Podman's store via podman. Such references also work directly with "matchlock run
+--image"; the imported copy is reused until the image changes.
 
 To pull a pre-built container image, use "matchlock pull" instead.`,
 	Example: `  matchlock build -t myapp:latest .
   matchlock build -t myapp:latest ./myapp
-  matchlock build -f Dockerfile.dev -t myapp:latest .`,
+  matchlock build -f Dockerfile.dev -t myapp:latest .
+  matchlock build --build-arg VERSION=1.2.3 --build-arg HTTPS_PROXY -t myapp:latest .
+  matchlock build --cache-to type=local,dest=./.buildcache --cache-from type=local,src=./.buildcache -t myapp:latest .
+  matchlock build --cache-from registry.example.com/myapp:buildcache -t myapp:latest .
+  matchlock build --target builder -t myapp:builder .
+  matchlock build -t myapp:latest https://github.com/org/repo.git#v1.2.3:docker
+  matchlock build -t myapp:latest - < context.tar.gz
+  matchlock build --progress plain -t myapp:latest . 2> build.log
+  BUILDKIT_HOST=tcp://buildkitd:1234 matchlock build --builder local -t myapp:latest .
+  matchlock build docker-daemon:myapp:dev
+  CONTAINERD_NAMESPACE=k8s.io matchlock build containerd:registry.k8s.io/pause:3.9
+  matchlock build -t myapp:latest docker-archive:./myapp.tar`,
 	Args: cobra.ExactArgs(1),
 	RunE: runBuild,
 }
@@ -37,11 +70,19 @@ To pull a pre-built container image, use "matchlock pull" instead.`,
 func init() {
 	buildCmd.Flags().StringP("tag", "t", "", "Tag the built image locally")
 	buildCmd.Flags().StringP("file", "f", "Dockerfile", "Path to Dockerfile")
+	buildCmd.Flags().String("builder", "vm", "Where BuildKit runs: vm, or local to use the host's buildkitd or rootless BuildKit")
 	buildCmd.Flags().Int("build-cpus", 0, "Number of CPUs for BuildKit VM (0 = all available)")
 	buildCmd.Flags().Int("build-memory", 0, "Memory in MB for BuildKit VM (0 = all available)")
 	buildCmd.Flags().Int("build-disk", 10240, "Disk size in MB for BuildKit VM")
 	buildCmd.Flags().Bool("no-cache", false, "Do not use BuildKit build cache")
+	buildCmd.Flags().Bool("pull", false, "Always pull FROM images from their registries instead of the local layer cache")
 	buildCmd.Flags().Int("build-cache-size", 10240, "BuildKit cache disk size in MB")
+	buildCmd.Flags().StringArray("cache-from", nil, "External cache source, e.g. type=local,src=DIR or a registry ref (repeatable)")
+	buildCmd.Flags().StringArray("cache-to", nil, "External cache destination, e.g. type=local,dest=DIR,mode=max or type=registry,ref=REF (repeatable)")
+	buildCmd.Flags().String("target", "", "Build the named stage of a multi-stage Dockerfile instead of the last one")
+	buildCmd.Flags().String("progress", "auto", "BuildKit progress output: auto, plain or tty (auto picks tty when stderr is a terminal)")
+	buildCmd.Flags().Bool("verify-signature", false, "Require cosign signatures on FROM images from a signer in the trust policy's images section")
+	buildCmd.Flags().StringArray("build-arg", nil, "Set a build-time variable as KEY=VALUE, or KEY to take its value from the environment (repeatable)")
 
 	rootCmd.AddCommand(buildCmd)
 }
@@ -50,12 +91,57 @@ func runBuild(cmd *cobra.Command, args []string) error {
 	dockerfile, _ := cmd.Flags().GetString("file")
 	tag, _ := cmd.Flags().GetString("tag")
 
-	// If -f was not explicitly set, resolve the default relative to the context directory.
-	if !cmd.Flags().Changed("file") {
-		dockerfile = filepath.Join(args[0], dockerfile)
+	if image.IsLocalImageRef(args[0]) {
+		return runLocalImageImport(cmd, args[0], tag)
+	}
+	if tag == "" {
+		return fmt.Errorf("-t/--tag is required when building from a Dockerfile")
+	}
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+	contextDir, cleanup, err := remoteBuildContext(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// If -f was not explicitly set, resolve the default relative to the
+	// context directory. As with docker build, a relative -f names a file
+	// inside a fetched git or stdin context.
+	fetched := contextDir != args[0]
+	if !cmd.Flags().Changed("file") || (fetched && !filepath.IsAbs(dockerfile)) {
+		dockerfile = filepath.Join(contextDir, dockerfile)
 	}
 
-	return runDockerfileBuild(cmd, args[0], dockerfile, tag)
+	return runDockerfileBuild(cmd, contextDir, dockerfile, tag)
+}
+
+// runLocalImageImport imports a docker-daemon: or docker-archive: image into
+// the local store, and under tag too if one is given.
+func runLocalImageImport(cmd *cobra.Command, imageRef, tag string) error {
+	force, _ := cmd.Flags().GetBool("pull")
+	builder := image.NewBuilder(&image.BuildOptions{ForcePull: force})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	fmt.Fprintf(os.Stderr, "Importing %s...\n", imageRef)
+	result, err := builder.Build(ctx, imageRef)
+	if err != nil {
+		return errx.Wrap(ErrImportImage, err)
+	}
+	if tag != "" {
+		if err := builder.SaveTag(tag, result); err != nil {
+			return errx.Wrap(ErrSaveTag, err)
+		}
+		fmt.Printf("Tagged: %s\n", tag)
+	}
+
+	fmt.Printf("Imported: %s\n", imageRef)
+	fmt.Printf("Rootfs: %s\n", result.RootfsPath)
+	fmt.Printf("Size: %.1f MB\n", float64(result.Size)/(1024*1024))
+	return nil
 }
 
 // buildCachePath returns the path to the persistent BuildKit cache ext4 image.
@@ -134,6 +220,245 @@ func growExt4Image(path string, targetBytes int64) error {
 	return nil
 }
 
+// guestLayerCacheDir is where the host's layer cache is mounted in the
+// BuildKit VM.
+const guestLayerCacheDir = "/workspace/layers"
+
+// layerCacheBuildOpts returns buildctl options that resolve the Dockerfile's
+// FROM images from the host's layer cache instead of their registries, and
+// mounts the cache read-only into the VM. With nil mounts BuildKit runs on
+// the host and reads the cache in place. Images that are not cached, or a
+// Dockerfile that cannot be parsed, simply fall back to a registry pull.
+func layerCacheBuildOpts(dockerfile string, mounts map[string]api.MountConfig) string {
+	f, err := os.Open(dockerfile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	bases, err := image.DockerfileBaseImages(f)
+	if err != nil {
+		return ""
+	}
+
+	cache := image.NewLayerCache("")
+	var opts strings.Builder
+	for _, ref := range bases {
+		digest, err := cache.Lookup(ref)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Using cached layers for %s\n", ref)
+		fmt.Fprintf(&opts, "  --opt context:%s=oci-layout://layers@%s \\\n", ref, digest)
+	}
+	if opts.Len() == 0 {
+		return ""
+	}
+
+	layoutDir := cache.Dir()
+	if mounts != nil {
+		mounts[guestLayerCacheDir] = api.MountConfig{Type: "real_fs", HostPath: layoutDir, Readonly: true}
+		layoutDir = guestLayerCacheDir
+	}
+	return fmt.Sprintf("  --oci-layout %s \\\n", shellQuote("layers="+layoutDir)) + opts.String()
+}
+
+// proxyBuildArgs are the build args the Dockerfile frontend predefines, so
+// they need no ARG instruction and stay out of the image history. They also
+// apply to buildkitd itself so FROM images are pulled through the proxy.
+var proxyBuildArgs = map[string]bool{
+	"HTTP_PROXY": true, "http_proxy": true,
+	"HTTPS_PROXY": true, "https_proxy": true,
+	"FTP_PROXY": true, "ftp_proxy": true,
+	"NO_PROXY": true, "no_proxy": true,
+	"ALL_PROXY": true, "all_proxy": true,
+}
+
+// buildArgOpts returns buildctl options for --build-arg values, and shell
+// exports of the proxy args for buildkitd. As with docker build, a bare KEY
+// takes its value from the environment and is dropped if it is unset.
+func buildArgOpts(args []string) (opts, env string, err error) {
+	var o, e strings.Builder
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if key == "" || strings.ContainsAny(key, " \t\n") {
+			return "", "", errx.With(ErrBuildArg, ": %q", arg)
+		}
+		if !ok {
+			if value, ok = os.LookupEnv(key); !ok {
+				continue
+			}
+		}
+		fmt.Fprintf(&o, "  --opt %s \\\n", shellQuote("build-arg:"+key+"="+value))
+		if proxyBuildArgs[key] {
+			fmt.Fprintf(&e, "export %s=%s\n", key, shellQuote(value))
+		}
+	}
+	return o.String(), e.String(), nil
+}
+
+// externalCacheOpts returns buildctl --import-cache and --export-cache
+// options for --cache-from and --cache-to, in docker buildx syntax. A bare
+// value is a registry ref. Host directories of type=local caches are
+// mounted into the VM, or used in place with nil mounts; other types are
+// passed through to BuildKit, which reaches them from wherever it runs.
+func externalCacheOpts(from, to []string, mounts map[string]api.MountConfig) (string, error) {
+	var opts strings.Builder
+	for i, spec := range from {
+		s, err := cacheSpec(spec, "src", fmt.Sprintf("/workspace/cache-from-%d", i), true, mounts)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&opts, "  --import-cache %s \\\n", shellQuote(s))
+	}
+	for i, spec := range to {
+		s, err := cacheSpec(spec, "dest", fmt.Sprintf("/workspace/cache-to-%d", i), false, mounts)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&opts, "  --export-cache %s \\\n", shellQuote(s))
+	}
+	return opts.String(), nil
+}
+
+// cacheSpec rewrites the host directory in pathKey of a type=local cache
+// spec to guestDir, where it is mounted, or to an absolute path with nil
+// mounts.
+func cacheSpec(spec, pathKey, guestDir string, readonly bool, mounts map[string]api.MountConfig) (string, error) {
+	if !strings.Contains(spec, "=") {
+		return "type=registry,ref=" + spec, nil
+	}
+	fields := strings.Split(spec, ",")
+	local := false
+	for _, f := range fields {
+		if f == "type=local" {
+			local = true
+		}
+	}
+	if !local {
+		return spec, nil
+	}
+
+	for i, f := range fields {
+		key, value, _ := strings.Cut(f, "=")
+		if key != pathKey {
+			continue
+		}
+		hostDir, err := filepath.Abs(value)
+		if err != nil {
+			return "", errx.With(ErrBuildCacheSpec, ": %q: %w", spec, err)
+		}
+		if readonly {
+			if info, err := os.Stat(hostDir); err != nil || !info.IsDir() {
+				return "", errx.With(ErrBuildCacheSpec, ": %q: %s is not a directory", spec, value)
+			}
+		} else if err := os.MkdirAll(hostDir, 0755); err != nil {
+			return "", errx.With(ErrBuildCacheSpec, ": %q: %w", spec, err)
+		}
+		if mounts == nil {
+			fields[i] = pathKey + "=" + hostDir
+			return strings.Join(fields, ","), nil
+		}
+		mounts[guestDir] = api.MountConfig{Type: "real_fs", HostPath: hostDir, Readonly: readonly}
+		fields[i] = pathKey + "=" + guestDir
+		return strings.Join(fields, ","), nil
+	}
+	return "", errx.With(ErrBuildCacheSpec, ": %q needs %s=DIR", spec, pathKey)
+}
+
+// shellQuote quotes s as a single sh word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// verifyBaseImages checks the signatures of the Dockerfile's FROM images
+// before BuildKit pulls them, and writes a copy of the Dockerfile into dir
+// with each of them pinned to the digest that was verified. It returns the
+// copy's path; BuildKit must build from it, or it would resolve the tags
+// again and could pull images re-pushed since the check. Images named
+// through build args cannot be resolved up front and are not checked.
+func verifyBaseImages(ctx context.Context, dockerfile, dir string, verifier *image.Builder) (string, error) {
+	content, err := os.ReadFile(dockerfile)
+	if err != nil {
+		return "", errx.Wrap(ErrResolveDockerfile, err)
+	}
+
+	bases, err := image.DockerfileBaseImages(bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	pins := map[string]string{}
+	for _, ref := range bases {
+		fmt.Fprintf(os.Stderr, "Verifying signature of %s...\n", ref)
+		if pins[ref], err = verifier.VerifySignature(ctx, ref); err != nil {
+			return "", err
+		}
+	}
+	pinned, err := image.PinDockerfileBaseImages(bytes.NewReader(content), pins)
+	if err != nil {
+		return "", err
+	}
+
+	// BuildKit looks for <Dockerfile>.dockerignore next to the Dockerfile.
+	path := filepath.Join(dir, filepath.Base(dockerfile))
+	if ignore, err := os.ReadFile(dockerfile + ".dockerignore"); err == nil {
+		if err := os.WriteFile(path+".dockerignore", ignore, 0644); err != nil {
+			return "", errx.Wrap(ErrPinDockerfile, err)
+		}
+	}
+	if err := os.WriteFile(path, pinned, 0644); err != nil {
+		return "", errx.Wrap(ErrPinDockerfile, err)
+	}
+	return path, nil
+}
+
+// runBuildScript runs the build script in sb, streaming its output to stderr
+// as it is produced. With tty, it runs on a pseudo-terminal sized like
+// stderr so buildctl can redraw its progress display in place.
+func runBuildScript(ctx context.Context, sb *sandbox.Sandbox, script string, tty bool) (int, error) {
+	if !tty {
+		result, err := sb.Exec(ctx, script, &api.ExecOptions{
+			WorkingDir: "/",
+			Stdout:     os.Stderr,
+			Stderr:     os.Stderr,
+		})
+		if err != nil {
+			return 1, err
+		}
+		return result.ExitCode, nil
+	}
+
+	interactiveMachine, ok := sb.Machine().(vm.InteractiveMachine)
+	if !ok {
+		return runBuildScript(ctx, sb, script, false)
+	}
+
+	fd := int(os.Stderr.Fd())
+	cols, rows, err := term.GetSize(fd)
+	if err != nil {
+		rows, cols = 24, 80
+	}
+	resizeCh := make(chan [2]uint16, 1)
+	winchCh := make(chan os.Signal, 1)
+	signal.Notify(winchCh, syscall.SIGWINCH)
+	go func() {
+		for range winchCh {
+			if c, r, err := term.GetSize(fd); err == nil {
+				select {
+				case resizeCh <- [2]uint16{uint16(r), uint16(c)}:
+				default:
+				}
+			}
+		}
+	}()
+	defer signal.Stop(winchCh)
+	defer close(resizeCh)
+
+	opts := sb.PrepareExecEnv()
+	opts.WorkingDir = "/"
+	return interactiveMachine.ExecInteractive(ctx, script, opts, uint16(rows), uint16(cols), strings.NewReader(""), os.Stderr, resizeCh)
+}
+
 // lockBuildCache acquires an exclusive file lock on the build cache.
 // Returns the lock file which must be closed to release the lock.
 func lockBuildCache(cachePath string) (*os.File, error) {
@@ -156,21 +481,44 @@ func lockBuildCache(cachePath string) (*os.File, error) {
 }
 
 func runDockerfileBuild(cmd *cobra.Command, contextDir, dockerfile, tag string) error {
-	if tag == "" {
-		return fmt.Errorf("-t/--tag is required when building from a Dockerfile")
-	}
-
+	buildkit, _ := cmd.Flags().GetString("builder")
 	cpus, _ := cmd.Flags().GetInt("build-cpus")
 	memory, _ := cmd.Flags().GetInt("build-memory")
 
 	disk, _ := cmd.Flags().GetInt("build-disk")
 	noCache, _ := cmd.Flags().GetBool("no-cache")
+	pull, _ := cmd.Flags().GetBool("pull")
 	buildCacheSize, _ := cmd.Flags().GetInt("build-cache-size")
+	buildArgs, _ := cmd.Flags().GetStringArray("build-arg")
+	cacheFrom, _ := cmd.Flags().GetStringArray("cache-from")
+	cacheTo, _ := cmd.Flags().GetStringArray("cache-to")
+	progress, _ := cmd.Flags().GetString("progress")
+	target, _ := cmd.Flags().GetString("target")
+	verifySignature, _ := cmd.Flags().GetBool("verify-signature")
+
+	switch progress {
+	case "auto":
+		progress = "plain"
+		if term.IsTerminal(int(os.Stderr.Fd())) {
+			progress = "tty"
+		}
+	case "plain", "tty":
+	default:
+		return errx.With(ErrBuildProgress, ": %q (use auto, plain or tty)", progress)
+	}
+	if buildkit != "vm" && buildkit != "local" {
+		return errx.With(ErrBuilder, ": %q (use vm or local)", buildkit)
+	}
+
+	buildArgOpt, proxyEnv, err := buildArgOpts(buildArgs)
+	if err != nil {
+		return err
+	}
 
 	if cpus == 0 {
 		cpus = runtime.NumCPU()
 	}
-	if memory == 0 {
+	if memory == 0 && buildkit == "vm" {
 		mem, err := totalMemoryMB()
 		if err != nil {
 			return errx.With(ErrAutoDetectMemory, ": %w (use --build-memory to set explicitly)", err)
@@ -199,16 +547,57 @@ func runDockerfileBuild(cmd *cobra.Command, contextDir, dockerfile, tag string)
 	ctx, cancel = contextWithSignal(ctx)
 	defer cancel()
 
+	signatures, err := imageSignaturePolicy(verifySignature)
+	if err != nil {
+		return err
+	}
+	if signatures != nil {
+		verifier, err := newImageBuilder(&image.BuildOptions{SignaturePolicy: signatures})
+		if err != nil {
+			return err
+		}
+		pinnedDir, err := os.MkdirTemp("", "matchlock-build-dockerfile-*")
+		if err != nil {
+			return errx.Wrap(ErrPinDockerfile, err)
+		}
+		defer os.RemoveAll(pinnedDir)
+		if absDockerfile, err = verifyBaseImages(ctx, absDockerfile, pinnedDir, verifier); err != nil {
+			return err
+		}
+	}
+
+	frontendOpts := frontendBuildOpts(filepath.Base(absDockerfile), target, noCache)
+	if buildkit == "local" {
+		layerCacheOpts := ""
+		if !pull {
+			layerCacheOpts = layerCacheBuildOpts(absDockerfile, nil)
+		}
+		cacheOpts, err := externalCacheOpts(cacheFrom, cacheTo, nil)
+		if err != nil {
+			return err
+		}
+		return runLocalBuild(ctx, localBuild{
+			context:    absContext,
+			dockerfile: absDockerfile,
+			tag:        tag,
+			progress:   progress,
+			opts:       frontendOpts + buildArgOpt + layerCacheOpts + cacheOpts,
+			proxyEnv:   proxyEnv,
+		})
+	}
+
 	buildkitImage := "moby/buildkit:rootless"
 	fmt.Fprintf(os.Stderr, "Preparing BuildKit image (%s)...\n", buildkitImage)
-	builder := image.NewBuilder(&image.BuildOptions{})
+	buildOpts := &image.BuildOptions{}
+	builder, err := newImageBuilder(buildOpts)
+	if err != nil {
+		return err
+	}
 	buildResult, err := builder.Build(ctx, buildkitImage)
 	if err != nil {
 		return errx.Wrap(ErrBuildBuildKitRootfs, err)
 	}
 
-	dockerfileName := filepath.Base(absDockerfile)
-	dockerfileInContext := filepath.Join(absContext, dockerfileName)
 	dockerfileDir := filepath.Dir(absDockerfile)
 
 	workspaceDir, err := os.MkdirTemp("", "matchlock-build-workspace-*")
@@ -217,6 +606,16 @@ func runDockerfileBuild(cmd *cobra.Command, contextDir, dockerfile, tag string)
 	}
 	defer os.RemoveAll(workspaceDir)
 
+	// BuildKit pulls FROM images itself, so it gets the registry mirrors
+	// too.
+	buildkitdConfigOpt := ""
+	if toml := buildOpts.Registries.BuildkitdConfig(); toml != "" {
+		if err := os.WriteFile(filepath.Join(workspaceDir, "buildkitd.toml"), []byte(toml), 0644); err != nil {
+			return errx.Wrap(ErrWriteBuildScript, err)
+		}
+		buildkitdConfigOpt = "  --config /workspace/buildkitd.toml \\\n"
+	}
+
 	outputDir, err := os.MkdirTemp("", "matchlock-build-output-*")
 	if err != nil {
 		return errx.Wrap(ErrCreateOutputDir, err)
@@ -230,11 +629,20 @@ func runDockerfileBuild(cmd *cobra.Command, contextDir, dockerfile, tag string)
 	}
 
 	guestDockerfileDir := "/workspace/context"
-	if _, err := os.Stat(dockerfileInContext); os.IsNotExist(err) {
+	if dockerfileDir != absContext {
 		mounts["/workspace/dockerfile"] = api.MountConfig{Type: "real_fs", HostPath: dockerfileDir, Readonly: true}
 		guestDockerfileDir = "/workspace/dockerfile"
 	}
 
+	layerCacheOpts := ""
+	if !pull {
+		layerCacheOpts = layerCacheBuildOpts(absDockerfile, mounts)
+	}
+	cacheOpts, err := externalCacheOpts(cacheFrom, cacheTo, mounts)
+	if err != nil {
+		return err
+	}
+
 	var extraDisks []api.DiskMount
 	if !noCache {
 		cachePath, err := buildCachePath()
@@ -290,32 +698,16 @@ func runDockerfileBuild(cmd *cobra.Command, contextDir, dockerfile, tag string)
 
 	fmt.Fprintf(os.Stderr, "Starting BuildKit daemon and building image from %s...\n", dockerfile)
 
-	execOpts := &api.ExecOptions{
-		WorkingDir: "/",
-		Stdout:     os.Stderr,
-		Stderr:     os.Stderr,
-	}
-
-	filenameOpt := ""
-	if dockerfileName != "Dockerfile" {
-		filenameOpt = fmt.Sprintf("  --opt filename=%s \\\n", dockerfileName)
-	}
-
-	noCacheOpt := ""
-	if noCache {
-		noCacheOpt = "  --no-cache \\\n"
-	}
-
 	buildScript := fmt.Sprintf(`#!/bin/sh
 set -e
 export HOME=/root
 export TMPDIR=/var/lib/buildkit/tmp
 mkdir -p $TMPDIR
-SOCK=/tmp/buildkit.sock
+%sSOCK=/tmp/buildkit.sock
 buildkitd --root /var/lib/buildkit \
   --addr unix://$SOCK \
   --oci-worker-snapshotter native \
-  >/tmp/buildkitd.log 2>&1 &
+%s  >/tmp/buildkitd.log 2>&1 &
 BKPID=$!
 for i in $(seq 1 30); do [ -S $SOCK ] && break; sleep 1; done
 if [ ! -S $SOCK ]; then
@@ -325,31 +717,52 @@ if [ ! -S $SOCK ]; then
 fi
 echo "BuildKit daemon ready" >&2
 buildctl --addr unix://$SOCK build \
+  --progress %s \
   --frontend dockerfile.v0 \
   --local context=/workspace/context \
   --local dockerfile=%s \
-%s%s  --output type=docker,dest=/workspace/output/image.tar
+%s%s%s%s  --output type=docker,dest=/workspace/output/image.tar
 RC=$?
 [ $RC -ne 0 ] && { echo "=== buildkitd log ===" >&2; cat /tmp/buildkitd.log >&2; }
 kill $BKPID 2>/dev/null
 exit $RC
-`, guestDockerfileDir, filenameOpt, noCacheOpt)
+`, proxyEnv, buildkitdConfigOpt, progress, guestDockerfileDir, frontendOpts, buildArgOpt, layerCacheOpts, cacheOpts)
 
 	if err := sb.WriteFile(ctx, "/workspace/buildkit-run.sh", []byte(buildScript), 0755); err != nil {
 		return errx.Wrap(ErrWriteBuildScript, err)
 	}
 
-	result, execErr := sb.Exec(ctx, "/workspace/buildkit-run.sh", execOpts)
+	exitCode, execErr := runBuildScript(ctx, sb, "/workspace/buildkit-run.sh", progress == "tty")
 	if execErr != nil {
 		return errx.Wrap(ErrBuildKitBuild, execErr)
 	}
-	if result.ExitCode != 0 {
-		return fmt.Errorf("BuildKit build failed (exit %d)", result.ExitCode)
+	if exitCode != 0 {
+		return fmt.Errorf("BuildKit build failed (exit %d)", exitCode)
 	}
 
+	return importBuiltImage(ctx, builder, filepath.Join(outputDir, "image.tar"), tag)
+}
+
+// frontendBuildOpts returns the buildctl options for the Dockerfile
+// frontend and the build cache.
+func frontendBuildOpts(dockerfileName, target string, noCache bool) string {
+	opts := ""
+	if dockerfileName != "Dockerfile" {
+		opts = fmt.Sprintf("  --opt %s \\\n", shellQuote("filename="+dockerfileName))
+	}
+	if target != "" {
+		opts += fmt.Sprintf("  --opt %s \\\n", shellQuote("target="+target))
+	}
+	if noCache {
+		opts += "  --no-cache \\\n"
+	}
+	return opts
+}
+
+// importBuiltImage imports the docker tarball BuildKit wrote as tag.
+func importBuiltImage(ctx context.Context, builder *image.Builder, tarballPath, tag string) error {
 	fmt.Fprintf(os.Stderr, "Importing built image as %s...\n", tag)
 
-	tarballPath := filepath.Join(outputDir, "image.tar")
 	importFile, err := os.Open(tarballPath)
 	if err != nil {
 		return errx.Wrap(ErrOpenImageTarball, err)
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/pkg/caches"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage shared cache mounts",
+	Long: `Shared caches hold package caches (pip, npm, Go modules, model hubs) on
+the host for every sandbox that mounts them with 'matchlock run --cache
+NAME:guest', so parallel sandboxes download each package once.
+
+Caches are kept in ~/.cache/matchlock/caches, with each file's contents
+stored once however many caches hold it.`,
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List shared caches",
+	Args:    cobra.NoArgs,
+	RunE:    runCacheList,
+}
+
+var cacheRemoveCmd = &cobra.Command{
+	Use:     "rm <name>...",
+	Aliases: []string{"remove"},
+	Short:   "Remove shared caches",
+	Long: `Remove shared caches. Sandboxes mounting a cache lose its files, so stop
+them first. Run 'matchlock cache prune' afterwards to free the space.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runCacheRemove,
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Free stored contents no cache holds anymore",
+	Args:  cobra.NoArgs,
+	RunE:  runCachePrune,
+}
+
+func init() {
+	adminOnly(cachePruneCmd)
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cacheRemoveCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
+
+func runCacheList(cmd *cobra.Command, args []string) error {
+	list, err := caches.NewStore("").List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tFILES\tSIZE")
+	for _, c := range list {
+		fmt.Fprintf(w, "%s\t%d\t%.1f MB\n", c.Name, c.Files, float64(c.Size)/(1024*1024))
+	}
+	return w.Flush()
+}
+
+func runCacheRemove(cmd *cobra.Command, args []string) error {
+	store := caches.NewStore("")
+	for _, name := range args {
+		if err := store.Remove(name); err != nil {
+			return err
+		}
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func runCachePrune(cmd *cobra.Command, args []string) error {
+	removed, freed, err := caches.NewStore("").Prune()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reclaimed %.1f MB from %d files\n", float64(freed)/(1024*1024), removed)
+	return nil
+}
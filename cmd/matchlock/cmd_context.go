@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/contexts"
+	"github.com/jingkaihe/matchlock/pkg/image"
+	"github.com/jingkaihe/matchlock/pkg/secrets"
+)
+
+var contextCmd = &cobra.Command{
+	Use:   "context",
+	Short: "Manage named CLI contexts",
+	Long: `A context bundles the endpoint of a shared image conversion service
+('matchlock image serve'), the token presented to it, the namespace its
+conversions are kept under and the role the token has there, so the same
+binary can be used against the local host and shared services.
+
+The built-in "local" context has no endpoint and the admin role. Other
+contexts have the user role unless set otherwise; commands marked (admin)
+are refused in them. $MATCHLOCK_CONTEXT selects a context for one command.
+
+Contexts are kept in ~/.config/matchlock/contexts.json. Tokens may be secret
+references (keychain:NAME, op://..., aws-sm:..., aws-ssm:...), resolved
+when used, so they need not be stored there.`,
+}
+
+var contextListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List contexts",
+	Args:    cobra.NoArgs,
+	RunE:    runContextList,
+}
+
+var contextUseCmd = &cobra.Command{
+	Use:   "use <name>",
+	Short: "Make a context current",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runContextUse,
+}
+
+var contextSetCmd = &cobra.Command{
+	Use:   "set <name>",
+	Short: "Add or change a context",
+	Long:  `Add a context, or change the fields of an existing one given as flags.`,
+	Example: `  matchlock context set prod --endpoint http://10.0.0.5:7050 \
+    --token keychain:matchlock-prod --namespace team-a
+  matchlock context set ops --endpoint http://10.0.0.5:7050 \
+    --token op://infra/matchlock/admin-token --role admin`,
+	Args: cobra.ExactArgs(1),
+	RunE: runContextSet,
+}
+
+var contextRemoveCmd = &cobra.Command{
+	Use:     "rm <name>",
+	Aliases: []string{"remove"},
+	Short:   "Remove a context",
+	Args:    cobra.ExactArgs(1),
+	RunE:    runContextRemove,
+}
+
+var contextShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the current context",
+	Args:  cobra.NoArgs,
+	RunE:  runContextShow,
+}
+
+func init() {
+	contextSetCmd.Flags().String("endpoint", "", "URL of the image conversion service")
+	contextSetCmd.Flags().String("token", "", "Bearer token, or a secret reference to it")
+	contextSetCmd.Flags().String("namespace", "", "Namespace of the conversions submitted")
+	contextSetCmd.Flags().String("role", "", "Role of the token: admin or user (default: user)")
+
+	contextCmd.AddCommand(contextListCmd)
+	contextCmd.AddCommand(contextUseCmd)
+	contextCmd.AddCommand(contextSetCmd)
+	contextCmd.AddCommand(contextRemoveCmd)
+	contextCmd.AddCommand(contextShowCmd)
+	rootCmd.AddCommand(contextCmd)
+}
+
+// roleAnnotation marks the role a command needs.
+const roleAnnotation = "matchlock.role"
+
+// adminOnly marks cmd as an admin operation, refused in user contexts, and
+// says so in its help.
+func adminOnly(cmd *cobra.Command) {
+	if cmd.Annotations == nil {
+		cmd.Annotations = map[string]string{}
+	}
+	cmd.Annotations[roleAnnotation] = contexts.RoleAdmin
+	cmd.Short += " (admin)"
+}
+
+// checkRole refuses an admin command when the current context is not an
+// admin one.
+func checkRole(cmd *cobra.Command, args []string) error {
+	if cmd.Annotations[roleAnnotation] != contexts.RoleAdmin {
+		return nil
+	}
+	name, c, err := currentContext()
+	if err != nil {
+		return err
+	}
+	if !c.Admin() {
+		return errx.With(contexts.ErrDenied, " %q: '%s' needs an admin context (see 'matchlock context use')", name, cmd.CommandPath())
+	}
+	return nil
+}
+
+func currentContext() (string, contexts.Context, error) {
+	f, err := contexts.Load(contexts.DefaultPath())
+	if err != nil {
+		return "", contexts.Context{}, err
+	}
+	return f.Active()
+}
+
+// serviceClient returns a client of the image service of the current
+// context, with its token resolved.
+func serviceClient(ctx context.Context) (*image.ServiceClient, error) {
+	name, c, err := currentContext()
+	if err != nil {
+		return nil, err
+	}
+	if c.Endpoint == "" {
+		return nil, errx.With(ErrNoEndpoint, ": context %q (see 'matchlock context set --endpoint')", name)
+	}
+	token, err := secrets.NewResolver().Resolve(ctx, c.Token)
+	if err != nil {
+		return nil, errx.With(ErrContextToken, " of context %q: %w", name, err)
+	}
+	return image.NewServiceClient(c.Endpoint, token, c.Namespace), nil
+}
+
+// updateContexts loads the contexts file, applies fn and saves it.
+func updateContexts(fn func(f *contexts.File) error) error {
+	path := contexts.DefaultPath()
+	f, err := contexts.Load(path)
+	if err != nil {
+		return err
+	}
+	if err := fn(f); err != nil {
+		return err
+	}
+	return f.Save(path)
+}
+
+func runContextList(cmd *cobra.Command, args []string) error {
+	f, err := contexts.Load(contexts.DefaultPath())
+	if err != nil {
+		return err
+	}
+	current := f.ActiveName()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CURRENT\tNAME\tENDPOINT\tNAMESPACE\tROLE")
+	for _, name := range f.Names() {
+		c, err := f.Get(name)
+		if err != nil {
+			return err
+		}
+		mark := ""
+		if name == current {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", mark, name, orDash(c.Endpoint), orDash(c.Namespace), c.Role)
+	}
+	return w.Flush()
+}
+
+func runContextUse(cmd *cobra.Command, args []string) error {
+	if err := updateContexts(func(f *contexts.File) error { return f.Use(args[0]) }); err != nil {
+		return err
+	}
+	fmt.Printf("Using context %q\n", args[0])
+	return nil
+}
+
+func runContextSet(cmd *cobra.Command, args []string) error {
+	return updateContexts(func(f *contexts.File) error {
+		c := f.Contexts[args[0]]
+		for flag, field := range map[string]*string{
+			"endpoint":  &c.Endpoint,
+			"token":     &c.Token,
+			"namespace": &c.Namespace,
+			"role":      &c.Role,
+		} {
+			if cmd.Flags().Changed(flag) {
+				*field, _ = cmd.Flags().GetString(flag)
+			}
+		}
+		if c.Token != "" && !secrets.IsReference(c.Token) {
+			fmt.Fprintln(os.Stderr, "Warning: the token is stored in plain text; consider a secret reference such as keychain:NAME")
+		}
+		return f.Set(args[0], c)
+	})
+}
+
+func runContextRemove(cmd *cobra.Command, args []string) error {
+	return updateContexts(func(f *contexts.File) error { return f.Remove(args[0]) })
+}
+
+func runContextShow(cmd *cobra.Command, args []string) error {
+	name, c, err := currentContext()
+	if err != nil {
+		return err
+	}
+	token := "none"
+	switch {
+	case secrets.IsReference(c.Token):
+		token = c.Token
+	case c.Token != "":
+		token = "(stored)"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", name)
+	fmt.Fprintf(w, "Endpoint:\t%s\n", orDash(c.Endpoint))
+	fmt.Fprintf(w, "Token:\t%s\n", token)
+	fmt.Fprintf(w, "Namespace:\t%s\n", orDash(c.Namespace))
+	fmt.Fprintf(w, "Role:\t%s\n", c.Role)
+	if !c.Admin() {
+		fmt.Fprintln(w, "Refused:\tcommands marked (admin)")
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/state"
+	"github.com/jingkaihe/matchlock/pkg/transfer"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+var cpCmd = &cobra.Command{
+	Use:   "cp <src> <dst>",
+	Short: "Copy files between the host and a running sandbox",
+	Long: `Copy a directory tree, or a single file, between the host and a running
+sandbox. Exactly one of src and dst is a sandbox path, written ID:PATH.
+
+The contents of a src directory are copied into dst, and a src file is copied
+into dst under its own name; dst is created if needed. The tree is streamed
+as one tar, so large inputs and outputs move without being held in memory.
+Sandbox paths must be under the workspace or another VFS mount.
+
+The sandbox must have been started with --rm=false to remain running.`,
+	Example: `  matchlock cp ./inputs vm-abc123:/workspace/inputs
+  matchlock cp vm-abc123:/workspace/out ./results
+  matchlock cp vm-abc123:/workspace/report.json .`,
+	Args: cobra.ExactArgs(2),
+	RunE: runCp,
+}
+
+func init() {
+	rootCmd.AddCommand(cpCmd)
+}
+
+// splitSandboxPath splits an ID:PATH argument. Host paths containing a
+// colon are told apart by a slash before it.
+func splitSandboxPath(arg string) (id, path string, ok bool) {
+	id, path, ok = strings.Cut(arg, ":")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return "", "", false
+	}
+	return id, path, true
+}
+
+func runCp(cmd *cobra.Command, args []string) error {
+	srcID, srcPath, srcInSandbox := splitSandboxPath(args[0])
+	dstID, dstPath, dstInSandbox := splitSandboxPath(args[1])
+	if srcInSandbox == dstInSandbox {
+		return errx.With(ErrCopyArgs, ": exactly one of src and dst must be ID:PATH")
+	}
+
+	vmID := srcID
+	if dstInSandbox {
+		vmID = dstID
+	}
+	mgr := state.NewManager()
+	vmState, err := mgr.Get(vmID)
+	if err != nil {
+		return errx.With(ErrVMNotFound, " %s: %w", vmID, err)
+	}
+	if vmState.Status != "running" {
+		return fmt.Errorf("VM %s is not running (status: %s)", vmID, vmState.Status)
+	}
+	execSocketPath := mgr.ExecSocketPath(vmID)
+	if _, err := os.Stat(execSocketPath); err != nil {
+		return fmt.Errorf("exec socket not found for %s (was it started with --rm=false?)", vmID)
+	}
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	if dstInSandbox {
+		return copyIn(ctx, mgr, vmID, args[0], dstPath)
+	}
+	return copyOut(ctx, mgr, vmID, srcPath, args[1])
+}
+
+// copyIn streams a tar of the host path src to dir in the sandbox, over
+// its transfer socket or, where that cannot be reached, its exec relay.
+func copyIn(ctx context.Context, mgr *state.Manager, vmID, src, dir string) error {
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return errx.Wrap(ErrCopyFailed, err)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		p := vfs.NewRealFSProvider(filepath.Dir(abs))
+		w.CloseWithError(vfs.WriteTar(p, "/"+filepath.Base(abs), w))
+	}()
+	defer r.Close()
+
+	err = transfer.CopyIn(ctx, mgr.TransferSocketPath(vmID), dir, r)
+	if errors.Is(err, transfer.ErrConnect) {
+		err = sandbox.CopyInViaRelay(ctx, mgr.ExecSocketPath(vmID), dir, r)
+	}
+	if err != nil {
+		return errx.Wrap(ErrCopyFailed, err)
+	}
+	return nil
+}
+
+// copyOut streams a tar of path in the sandbox into the host directory dir,
+// over the same channel as copyIn.
+func copyOut(ctx context.Context, mgr *state.Manager, vmID, path, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errx.Wrap(ErrCopyFailed, err)
+	}
+
+	r, w := io.Pipe()
+	extracted := make(chan error, 1)
+	go func() {
+		err := vfs.ExtractTar(vfs.NewRealFSProvider(dir), "/", r)
+		r.CloseWithError(err)
+		extracted <- err
+	}()
+
+	err := transfer.CopyOut(ctx, mgr.TransferSocketPath(vmID), path, w)
+	if errors.Is(err, transfer.ErrConnect) {
+		err = sandbox.CopyOutViaRelay(ctx, mgr.ExecSocketPath(vmID), path, w)
+	}
+	w.CloseWithError(err)
+	if extractErr := <-extracted; err == nil {
+		err = extractErr
+	}
+	if err != nil {
+		return errx.Wrap(ErrCopyFailed, err)
+	}
+	return nil
+}
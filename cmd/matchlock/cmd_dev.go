@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/delta"
+	"github.com/jingkaihe/matchlock/pkg/image"
+	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/secrets"
+	"github.com/jingkaihe/matchlock/pkg/state"
+	"github.com/jingkaihe/matchlock/pkg/watch"
+)
+
+var devCmd = &cobra.Command{
+	Use:   "dev [flags] -- <command>",
+	Short: "Re-run a command in a warm sandbox whenever host files change",
+	Long: `Re-run a command in a warm sandbox whenever host files change.
+
+The --watch directory is copied into the sandbox workspace, then the command
+runs. Whenever files under the directory change, only the changed files are
+synced and the command runs again in the same sandbox. If a change lands while
+the command is still running, the run is cancelled and restarted.
+
+The sandbox gets its own copy of the files: edits made inside the guest are not
+written back to the host. Use 'matchlock run -v' for a live two-way mount.`,
+	Example: `  matchlock dev --image golang:1.25-alpine --watch ./src -- go test ./...
+  matchlock dev --image node:22-alpine --ignore node_modules -- npm test`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runDev,
+}
+
+func init() {
+	devCmd.Flags().String("image", "", "Container image (required)")
+	devCmd.Flags().String("watch", ".", "Host directory to sync and watch for changes")
+	devCmd.Flags().StringSlice("ignore", watch.DefaultIgnore, "File or directory name patterns to skip (can be repeated)")
+	devCmd.Flags().Duration("interval", watch.DefaultInterval, "How often to scan for changes")
+	devCmd.Flags().Duration("debounce", watch.DefaultDebounce, "Quiet period after a change before re-running")
+	devCmd.Flags().String("workspace", api.DefaultWorkspace, "Guest mount point for VFS")
+	devCmd.Flags().StringSlice("allow-host", nil, "Allowed hosts (can be repeated)")
+	devCmd.Flags().StringSlice("secret", nil, "Secret (NAME=VALUE@host1,host2 or NAME@host1,host2)")
+	devCmd.Flags().String("size", "", "Resource preset (small, medium, large, or one from ~/.config/matchlock/presets.json)")
+	devCmd.Flags().Int("cpus", api.DefaultCPUs, "Number of CPUs")
+	devCmd.Flags().Int("memory", api.DefaultMemoryMB, "Memory in MB")
+	devCmd.Flags().Int("disk-size", 0, "Minimum disk size in MB (default: fit the image plus --rootfs-free-space)")
+	devCmd.Flags().Int("rootfs-free-space", api.DefaultRootfsFreeSpaceMB, "Free space in MB to leave on the root disk beyond the image contents")
+	devCmd.Flags().Bool("pull", false, "Always pull image from registry (ignore cache)")
+	devCmd.Flags().Bool("privileged", false, "Skip in-guest security restrictions (seccomp, cap drop, no_new_privs)")
+	devCmd.Flags().Duration("graceful-shutdown", api.DefaultGracefulShutdownPeriod, "Graceful shutdown timeout before force-stopping the VM")
+	devCmd.MarkFlagRequired("image")
+
+	rootCmd.AddCommand(devCmd)
+}
+
+func runDev(cmd *cobra.Command, args []string) error {
+	imageName, _ := cmd.Flags().GetString("image")
+	watchDir, _ := cmd.Flags().GetString("watch")
+	ignore, _ := cmd.Flags().GetStringSlice("ignore")
+	interval, _ := cmd.Flags().GetDuration("interval")
+	debounce, _ := cmd.Flags().GetDuration("debounce")
+	workspace, _ := cmd.Flags().GetString("workspace")
+	allowHosts, _ := cmd.Flags().GetStringSlice("allow-host")
+	secretSpecs, _ := cmd.Flags().GetStringSlice("secret")
+	cpus, _ := cmd.Flags().GetInt("cpus")
+	memory, _ := cmd.Flags().GetInt("memory")
+	diskSize, _ := cmd.Flags().GetInt("disk-size")
+	freeSpace, _ := cmd.Flags().GetInt("rootfs-free-space")
+	pull, _ := cmd.Flags().GetBool("pull")
+	privileged, _ := cmd.Flags().GetBool("privileged")
+	gracefulShutdown, _ := cmd.Flags().GetDuration("graceful-shutdown")
+
+	resources := &api.Resources{
+		CPUs:              cpus,
+		MemoryMB:          memory,
+		DiskSizeMB:        diskSize,
+		RootfsFreeSpaceMB: freeSpace,
+	}
+	if err := applySize(cmd, resources); err != nil {
+		return err
+	}
+
+	command := api.ShellQuoteArgs(args)
+
+	root, err := filepath.Abs(watchDir)
+	if err != nil {
+		return errx.Wrap(ErrWatchDir, err)
+	}
+	watcher, err := watch.New(root, watch.Options{
+		Ignore:   ignore,
+		Interval: interval,
+		Debounce: debounce,
+	})
+	if err != nil {
+		return errx.Wrap(ErrWatchDir, err)
+	}
+
+	var parsedSecrets map[string]api.Secret
+	if len(secretSpecs) > 0 {
+		parsedSecrets = make(map[string]api.Secret)
+		for _, s := range secretSpecs {
+			name, secret, err := api.ParseSecret(s)
+			if err != nil {
+				return errx.With(ErrInvalidSecret, " %q: %w", s, err)
+			}
+			parsedSecrets[name] = secret
+		}
+	}
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	if err := secrets.NewResolver().ResolveAll(ctx, parsedSecrets); err != nil {
+		return errx.Wrap(ErrInvalidSecret, err)
+	}
+
+	signatures, err := imageSignaturePolicy(false)
+	if err != nil {
+		return err
+	}
+	builder, err := newImageBuilder(&image.BuildOptions{
+		ForcePull:       pull,
+		SignaturePolicy: signatures,
+	})
+	if err != nil {
+		return err
+	}
+
+	buildResult, err := builder.Build(ctx, imageName)
+	if err != nil {
+		return errx.Wrap(ErrBuildingRootfs, err)
+	}
+
+	var imageCfg *api.ImageConfig
+	if buildResult.OCI != nil {
+		imageCfg = &api.ImageConfig{
+			User: buildResult.OCI.User,
+			Env:  buildResult.OCI.Env,
+		}
+	}
+
+	config := &api.Config{
+		Image:       imageName,
+		ImageDigest: buildResult.Digest,
+		Privileged:  privileged,
+		Resources:   resources,
+		Network: &api.NetworkConfig{
+			AllowedHosts:    allowHosts,
+			BlockPrivateIPs: true,
+			Secrets:         parsedSecrets,
+		},
+		VFS:      &api.VFSConfig{Workspace: workspace},
+		ImageCfg: imageCfg,
+	}
+
+	sb, err := sandbox.New(ctx, config, &sandbox.Options{RootfsPath: buildResult.RootfsPath})
+	if err != nil {
+		return errx.Wrap(ErrCreateSandbox, err)
+	}
+	stateMgr := state.NewManager()
+	defer func() {
+		c, cancel := context.WithTimeout(context.Background(), gracefulShutdown)
+		sb.Close(c)
+		cancel()
+		stateMgr.Remove(sb.ID())
+	}()
+
+	if err := sb.Start(ctx); err != nil {
+		return errx.Wrap(ErrStartSandbox, err)
+	}
+
+	execRelay := sandbox.NewExecRelay(sb)
+	if err := execRelay.Start(stateMgr.ExecSocketPath(sb.ID())); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to start exec relay: %v\n", err)
+	}
+	defer execRelay.Stop()
+
+	synced, err := syncChanges(ctx, sb, root, workspace, watch.Diff(watch.Snapshot{}, watcher.Snapshot()))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "[dev] sandbox %s ready, synced %d paths from %s\n", sb.ID(), synced, root)
+
+	changesCh := make(chan watch.Changes)
+	watchErr := make(chan error, 1)
+	go func() {
+		for {
+			changes, err := watcher.Wait(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					watchErr <- err
+				}
+				return
+			}
+			select {
+			case changesCh <- changes:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		runCtx, runCancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			runDevCommand(runCtx, sb, command, workspace)
+		}()
+
+		var changes watch.Changes
+		select {
+		case <-done:
+			select {
+			case changes = <-changesCh:
+			case err := <-watchErr:
+				runCancel()
+				return errx.Wrap(ErrWatchDir, err)
+			case <-ctx.Done():
+				runCancel()
+				return nil
+			}
+		case changes = <-changesCh:
+			runCancel()
+			<-done
+			fmt.Fprintln(os.Stderr, "[dev] change detected, restarting")
+		case err := <-watchErr:
+			runCancel()
+			<-done
+			return errx.Wrap(ErrWatchDir, err)
+		case <-ctx.Done():
+			runCancel()
+			<-done
+			return nil
+		}
+		runCancel()
+
+		synced, err := syncChanges(ctx, sb, root, workspace, changes)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "[dev] synced %d changed paths\n", synced)
+	}
+}
+
+// runDevCommand executes one iteration of the dev loop and reports how it
+// finished. Cancellation is reported as an interruption rather than an error.
+func runDevCommand(ctx context.Context, sb *sandbox.Sandbox, command, workspace string) {
+	fmt.Fprintf(os.Stderr, "[dev] running: %s\n", command)
+	start := time.Now()
+	result, err := sb.Exec(ctx, command, &api.ExecOptions{
+		WorkingDir: workspace,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+	})
+	elapsed := time.Since(start).Round(time.Millisecond)
+	switch {
+	case ctx.Err() != nil:
+		fmt.Fprintf(os.Stderr, "[dev] interrupted after %s\n", elapsed)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "[dev] %v\n", errx.Wrap(ErrExecCommand, err))
+	default:
+		fmt.Fprintf(os.Stderr, "[dev] exit %d in %s, waiting for changes\n", result.ExitCode, elapsed)
+	}
+}
+
+// syncChanges mirrors a batch of host changes into the sandbox workspace and
+// returns how many paths were applied. Removals are applied first so that
+// paths switching between file and directory end up with the new type. Files
+// whose content matches the sandbox copy (e.g. touched or re-saved without
+// edits) are detected via their delta signature and skipped.
+func syncChanges(ctx context.Context, sb *sandbox.Sandbox, root, workspace string, changes watch.Changes) (int, error) {
+	guestPath := func(rel string) string {
+		return path.Join(workspace, rel)
+	}
+
+	synced := 0
+	for _, rel := range changes.Removed {
+		if err := sb.RemoveAll(ctx, guestPath(rel)); err != nil {
+			return synced, errx.With(ErrSyncFile, " remove %s: %w", rel, err)
+		}
+		synced++
+	}
+	for _, rel := range changes.Dirs {
+		if err := sb.MkdirAll(ctx, guestPath(rel), 0755); err != nil {
+			return synced, errx.With(ErrSyncFile, " mkdir %s: %w", rel, err)
+		}
+		synced++
+	}
+	for _, rel := range changes.Modified {
+		hostPath := filepath.Join(root, filepath.FromSlash(rel))
+		info, err := os.Stat(hostPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Deleted after the scan; the next batch reports the removal.
+				continue
+			}
+			return synced, errx.With(ErrSyncFile, " %s: %w", rel, err)
+		}
+		content, err := os.ReadFile(hostPath)
+		if err != nil {
+			return synced, errx.With(ErrSyncFile, " %s: %w", rel, err)
+		}
+		if sig, err := sb.FileSignature(ctx, guestPath(rel), delta.DefaultBlockSize); err == nil {
+			if delta.Unchanged(sig, delta.Diff(sig, content)) {
+				continue
+			}
+		}
+		if err := sb.WriteFile(ctx, guestPath(rel), content, uint32(info.Mode().Perm())); err != nil {
+			return synced, errx.With(ErrSyncFile, " %s: %w", rel, err)
+		}
+		synced++
+	}
+	return synced, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/state"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+	"github.com/jingkaihe/matchlock/pkg/workspaces"
+)
+
+var diffExportCmd = &cobra.Command{
+	Use:   "diff-export <id>",
+	Short: "Export the files a sandbox changed in its overlay mounts as a tarball",
+	Long: `Export the files a stopped sandbox created or modified in its overlay mounts
+as a tarball, so its output can be reviewed and applied without ever mounting
+a host directory read-write.
+
+Entries are named relative to the workspace. The first entry, ` + vfs.ChangeManifestName + `,
+lists the created, modified and deleted paths; remove the deleted paths
+before extracting the rest.
+
+Only overlay mounts record changes. Run the sandbox with --overlay and
+--rm=false so its state outlives it.`,
+	Example: `  matchlock run --image alpine:latest --overlay .:/workspace --rm=false sh -c 'echo hi > out.txt'
+  matchlock diff-export vm-abc12345 -o changes.tar`,
+	Args: cobra.ExactArgs(1),
+	RunE: runDiffExport,
+}
+
+func init() {
+	diffExportCmd.Flags().StringP("output", "o", "-", "Tarball path, or - for stdout")
+	viper.BindPFlag("diff-export.output", diffExportCmd.Flags().Lookup("output"))
+
+	rootCmd.AddCommand(diffExportCmd)
+}
+
+func runDiffExport(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	id := args[0]
+
+	mgr := state.NewManager()
+	s, err := mgr.Get(id)
+	if err != nil {
+		return err
+	}
+	if s.Status == "running" {
+		return errx.With(ErrSandboxRunning, ": %s (stop it with 'matchlock kill %s' first)", id, id)
+	}
+	if len(s.Overlays) == 0 {
+		return errx.With(ErrNoOverlays, ": %s", id)
+	}
+
+	var config api.Config
+	if err := mgr.LoadConfig(id, &config); err != nil {
+		return err
+	}
+	layers := changeLayers(&config, s.Overlays)
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return errx.Wrap(ErrDiffExport, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	manifest, err := vfs.WriteChanges(w, layers)
+	if err != nil {
+		if output != "-" {
+			os.Remove(output)
+		}
+		return errx.Wrap(ErrDiffExport, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d created, %d modified and %d deleted paths to %s\n",
+		len(manifest.Created), len(manifest.Modified), len(manifest.Deleted), output)
+	return nil
+}
+
+// changeLayers pairs the upper layer of each overlay mount with its host
+// directory, naming the layers by their path within the workspace.
+func changeLayers(config *api.Config, overlays map[string]string) []vfs.ChangeLayer {
+	workspace := config.GetWorkspace()
+	guestPaths := make([]string, 0, len(overlays))
+	for guestPath := range overlays {
+		guestPaths = append(guestPaths, guestPath)
+	}
+	sort.Strings(guestPaths)
+
+	layers := make([]vfs.ChangeLayer, 0, len(guestPaths))
+	for _, guestPath := range guestPaths {
+		rel, err := filepath.Rel(workspace, guestPath)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = guestPath
+		}
+		layer := vfs.ChangeLayer{
+			Path:  rel,
+			Upper: vfs.NewRealFSProvider(overlays[guestPath]),
+		}
+		if config.VFS != nil {
+			if m, ok := config.VFS.Mounts[guestPath]; ok && m.HostPath != "" {
+				lower := vfs.NewRealFSProvider(m.HostPath)
+				if m.Unconfined {
+					lower = vfs.NewUnconfinedRealFSProvider(m.HostPath)
+				}
+				layer.Lower = vfs.NewReadonlyProvider(lower)
+			} else if config.VFS.WorkspaceFrom != "" && guestPath == filepath.Clean(workspace) {
+				// The stored config names the snapshot the workspace
+				// overlay was seeded from rather than its directory.
+				dir := workspaces.NewStore("").FilesDir(config.VFS.WorkspaceFrom)
+				layer.Lower = vfs.NewReadonlyProvider(vfs.NewRealFSProvider(dir))
+			}
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
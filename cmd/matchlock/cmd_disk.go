@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/pkg/disks"
+)
+
+var diskCmd = &cobra.Command{
+	Use:   "disk",
+	Short: "Manage persistent data disks",
+	Long: `Data disks are ext4 images attached to sandboxes as block devices with
+'matchlock run --disk name=NAME,size=10G', for datasets and build outputs
+that need native disk speed and outlive any one sandbox.
+
+Disks are kept in ~/.cache/matchlock/disks.`,
+}
+
+var diskListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List data disks",
+	Args:    cobra.NoArgs,
+	RunE:    runDiskList,
+}
+
+var diskRemoveCmd = &cobra.Command{
+	Use:     "rm <name>...",
+	Aliases: []string{"remove"},
+	Short:   "Remove data disks",
+	Long:    `Remove data disks and their data. A disk attached to a running sandbox is not removed.`,
+	Args:    cobra.MinimumNArgs(1),
+	RunE:    runDiskRemove,
+}
+
+func init() {
+	diskCmd.AddCommand(diskListCmd)
+	diskCmd.AddCommand(diskRemoveCmd)
+	rootCmd.AddCommand(diskCmd)
+}
+
+func runDiskList(cmd *cobra.Command, args []string) error {
+	list, err := disks.NewStore("").List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tUSED\tIN USE")
+	for _, d := range list {
+		inUse := "no"
+		if d.InUse {
+			inUse = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%.1f MB\t%.1f MB\t%s\n", d.Name, float64(d.Size)/(1024*1024), float64(d.Used)/(1024*1024), inUse)
+	}
+	return w.Flush()
+}
+
+func runDiskRemove(cmd *cobra.Command, args []string) error {
+	store := disks.NewStore("")
+	for _, name := range args {
+		if err := store.Remove(name); err != nil {
+			return err
+		}
+		fmt.Println(name)
+	}
+	return nil
+}
@@ -30,6 +30,7 @@ func init() {
 	execCmd.Flags().BoolP("tty", "t", false, "Allocate a pseudo-TTY")
 	execCmd.Flags().BoolP("interactive", "i", false, "Keep STDIN open")
 	execCmd.Flags().StringP("workdir", "w", "", "Working directory inside the sandbox (default: workspace path)")
+	execCmd.Flags().Bool("mkdir-workdir", false, "Create the working directory if it does not exist")
 	execCmd.Flags().StringP("user", "u", "", "Run as user (uid, uid:gid, or username)")
 
 	rootCmd.AddCommand(execCmd)
@@ -42,6 +43,7 @@ func runExec(cmd *cobra.Command, args []string) error {
 	tty, _ := cmd.Flags().GetBool("tty")
 	interactive, _ := cmd.Flags().GetBool("interactive")
 	workdir, _ := cmd.Flags().GetString("workdir")
+	mkdirWorkdir, _ := cmd.Flags().GetBool("mkdir-workdir")
 	user, _ := cmd.Flags().GetString("user")
 	interactiveMode := tty && interactive
 
@@ -69,14 +71,14 @@ func runExec(cmd *cobra.Command, args []string) error {
 	defer cancel()
 
 	if interactiveMode {
-		return runExecInteractive(ctx, execSocketPath, command, workdir, user)
+		return runExecInteractive(ctx, execSocketPath, command, workdir, mkdirWorkdir, user)
 	}
 
 	if interactive {
-		return runExecPipe(ctx, execSocketPath, command, workdir, user)
+		return runExecPipe(ctx, execSocketPath, command, workdir, mkdirWorkdir, user)
 	}
 
-	result, err := sandbox.ExecViaRelay(ctx, execSocketPath, command, workdir, user)
+	result, err := sandbox.ExecViaRelay(ctx, execSocketPath, command, workdir, mkdirWorkdir, user)
 	if err != nil {
 		return errx.Wrap(ErrExecFailed, err)
 	}
@@ -87,8 +89,8 @@ func runExec(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func runExecPipe(ctx context.Context, execSocketPath, command, workdir, user string) error {
-	exitCode, err := sandbox.ExecPipeViaRelay(ctx, execSocketPath, command, workdir, user, os.Stdin, os.Stdout, os.Stderr)
+func runExecPipe(ctx context.Context, execSocketPath, command, workdir string, mkdirWorkdir bool, user string) error {
+	exitCode, err := sandbox.ExecPipeViaRelay(ctx, execSocketPath, command, workdir, mkdirWorkdir, user, os.Stdin, os.Stdout, os.Stderr)
 	if err != nil {
 		return errx.Wrap(ErrPipeExecFailed, err)
 	}
@@ -96,7 +98,7 @@ func runExecPipe(ctx context.Context, execSocketPath, command, workdir, user str
 	return nil
 }
 
-func runExecInteractive(ctx context.Context, execSocketPath, command, workdir, user string) error {
+func runExecInteractive(ctx context.Context, execSocketPath, command, workdir string, mkdirWorkdir bool, user string) error {
 	if !term.IsTerminal(int(os.Stdin.Fd())) {
 		return fmt.Errorf("-it requires a TTY")
 	}
@@ -112,7 +114,7 @@ func runExecInteractive(ctx context.Context, execSocketPath, command, workdir, u
 	}
 	defer term.Restore(int(os.Stdin.Fd()), oldState)
 
-	exitCode, err := sandbox.ExecInteractiveViaRelay(ctx, execSocketPath, command, workdir, user, uint16(rows), uint16(cols), os.Stdin, os.Stdout)
+	exitCode, err := sandbox.ExecInteractiveViaRelay(ctx, execSocketPath, command, workdir, mkdirWorkdir, user, uint16(rows), uint16(cols), os.Stdin, os.Stdout)
 	if err != nil {
 		term.Restore(int(os.Stdin.Fd()), oldState)
 		return errx.Wrap(ErrInteractiveExec, err)
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/state"
+)
+
+var freezeNetworkCmd = &cobra.Command{
+	Use:   "freeze-network [--all | <id>]",
+	Short: "Cut off all network egress of running sandboxes",
+	Long: `Emergency stop for misbehaving agents: instantly block all network egress
+of one sandbox, or of every running sandbox with --all, including DNS and
+connections that are already open.
+
+The VMs keep running so their state can be inspected with 'matchlock exec'
+or 'matchlock watch'. The freeze lasts until the sandbox is removed; it
+survives 'matchlock restart'. On macOS, sandboxes started without any
+network policy (--allow-host, --secret, ...) cannot be frozen; kill them
+instead.`,
+	Example: `  matchlock freeze-network vm-abc123
+  matchlock freeze-network --all`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runFreezeNetwork,
+}
+
+func init() {
+	freezeNetworkCmd.Flags().Bool("all", false, "Freeze every running sandbox")
+	viper.BindPFlag("freeze-network.all", freezeNetworkCmd.Flags().Lookup("all"))
+
+	rootCmd.AddCommand(freezeNetworkCmd)
+}
+
+func runFreezeNetwork(cmd *cobra.Command, args []string) error {
+	all, _ := cmd.Flags().GetBool("all")
+	mgr := state.NewManager()
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	if all {
+		if len(args) > 0 {
+			return fmt.Errorf("cannot combine --all with a VM ID")
+		}
+		states, err := mgr.List()
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, s := range states {
+			if s.Status != "running" {
+				continue
+			}
+			if err := freezeNetwork(ctx, mgr, s.ID); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to freeze %s: %v\n", s.ID, err)
+				failed++
+			} else {
+				fmt.Printf("Froze network of %s\n", s.ID)
+			}
+		}
+		if failed > 0 {
+			return errx.With(ErrFreezeFailed, " for %d sandbox(es)", failed)
+		}
+		return nil
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("VM ID required (or use --all)")
+	}
+
+	vmID := args[0]
+	vmState, err := mgr.Get(vmID)
+	if err != nil {
+		return errx.With(ErrVMNotFound, " %s: %w", vmID, err)
+	}
+	if vmState.Status != "running" {
+		return fmt.Errorf("VM %s is not running (status: %s)", vmID, vmState.Status)
+	}
+	if err := freezeNetwork(ctx, mgr, vmID); err != nil {
+		return errx.Wrap(ErrFreezeFailed, err)
+	}
+	fmt.Printf("Froze network of %s\n", vmID)
+	return nil
+}
+
+func freezeNetwork(ctx context.Context, mgr *state.Manager, vmID string) error {
+	execSocketPath := mgr.ExecSocketPath(vmID)
+	if _, err := os.Stat(execSocketPath); err != nil {
+		return fmt.Errorf("exec socket not found for %s", vmID)
+	}
+	return sandbox.FreezeNetworkViaRelay(ctx, execSocketPath)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/pkg/guestinfo"
+)
+
+var guestInfoCmd = &cobra.Command{
+	Use:   "guest-info",
+	Short: "Report what the installed guest assets support",
+	Long: `Print a JSON description of the installed guest kernel, initramfs,
+guest-agent and guest-fused: paths, digests, build revisions, the kernel
+version and the features it was built with, and the RPC methods this build
+serves.
+
+The output carries a schema_version that is bumped on incompatible changes,
+so integrators can gate features on what the guest actually supports.`,
+	Example: `  matchlock guest-info
+  matchlock guest-info | jq -r '.kernel.features[]' | grep -qx ZRAM`,
+	Args: cobra.NoArgs,
+	RunE: runGuestInfo,
+}
+
+func init() {
+	rootCmd.AddCommand(guestInfoCmd)
+}
+
+func runGuestInfo(cmd *cobra.Command, args []string) error {
+	info, err := guestinfo.Collect()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
@@ -35,7 +35,7 @@ func runList(cmd *cobra.Command, args []string) error {
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "ID\tSTATUS\tIMAGE\tCREATED\tPID")
+	fmt.Fprintln(w, "ID\tSTATUS\tEXIT\tIMAGE\tCREATED\tFINISHED\tPID")
 
 	for _, s := range states {
 		if running && s.Status != "running" {
@@ -46,8 +46,22 @@ func runList(cmd *cobra.Command, args []string) error {
 		if s.PID > 0 {
 			pid = fmt.Sprintf("%d", s.PID)
 		}
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.ID, s.Status, s.Image, created, pid)
+		exit, finished := formatExit(s.Exit)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Status, exit, s.Image, created, finished, pid)
 	}
 	w.Flush()
 	return nil
 }
+
+// formatExit renders the primary command's exit code (flagging OOM kills)
+// and finish time, or "-" for sandboxes whose command has not finished.
+func formatExit(exit *state.ExitStatus) (string, string) {
+	if exit == nil {
+		return "-", "-"
+	}
+	code := fmt.Sprintf("%d", exit.ExitCode)
+	if exit.OOMKilled {
+		code += " (OOM)"
+	}
+	return code, exit.FinishedAt.Local().Format("2006-01-02 15:04")
+}
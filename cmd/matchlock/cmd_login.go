@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/image"
+)
+
+var loginCmd = &cobra.Command{
+	Use:   "login [registry]",
+	Short: "Log in to a container registry",
+	Long: `Store credentials for a registry (default docker.io) in matchlock's auth
+file (default ~/.config/matchlock/auth.json, or $MATCHLOCK_AUTH_CONFIG).
+They are checked against the registry first, and are tried before
+~/.docker/config.json when pulling.
+
+With --credential-helper, secrets are kept in a docker credential helper
+(docker-credential-<name>, e.g. osxkeychain, secretservice or pass) rather
+than in the file; the choice sticks for later logins.`,
+	Example: `  matchlock login ghcr.io -u octocat
+  echo "$GITHUB_TOKEN" | matchlock login ghcr.io -u octocat --password-stdin
+  matchlock login --credential-helper osxkeychain registry.corp:5000`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runLogin,
+}
+
+var logoutCmd = &cobra.Command{
+	Use:   "logout [registry]",
+	Short: "Remove stored credentials for a container registry",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runLogout,
+}
+
+func init() {
+	loginCmd.Flags().StringP("username", "u", "", "Registry username")
+	loginCmd.Flags().Bool("password-stdin", false, "Read the password or token from stdin")
+	loginCmd.Flags().String("credential-helper", "", "Keep secrets in docker-credential-<name> instead of the auth file")
+
+	rootCmd.AddCommand(loginCmd)
+	rootCmd.AddCommand(logoutCmd)
+}
+
+func loginRegistry(args []string) string {
+	if len(args) == 0 {
+		return name.DefaultRegistry
+	}
+	return args[0]
+}
+
+func runLogin(cmd *cobra.Command, args []string) error {
+	registry := loginRegistry(args)
+	username, _ := cmd.Flags().GetString("username")
+	passwordStdin, _ := cmd.Flags().GetBool("password-stdin")
+	helper, _ := cmd.Flags().GetString("credential-helper")
+
+	store, err := image.LoadDefaultAuthStore()
+	if err != nil {
+		return err
+	}
+	if cmd.Flags().Changed("credential-helper") {
+		store.SetCredsStore(helper)
+	}
+
+	var password string
+	if passwordStdin {
+		if username == "" {
+			return errx.With(ErrRegistryLogin, ": --password-stdin needs --username")
+		}
+		if password, err = readPasswordStdin(); err != nil {
+			return err
+		}
+	} else {
+		if username, password, err = promptCredentials(registry, username); err != nil {
+			return err
+		}
+	}
+	creds := image.Credentials{Username: username, Password: password}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := image.CheckLogin(ctx, registry, creds); err != nil {
+		return err
+	}
+	if err := store.Login(registry, creds); err != nil {
+		return err
+	}
+	fmt.Println("Login succeeded")
+	return nil
+}
+
+func runLogout(cmd *cobra.Command, args []string) error {
+	registry := loginRegistry(args)
+	store, err := image.LoadDefaultAuthStore()
+	if err != nil {
+		return err
+	}
+	removed, err := store.Logout(registry)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		fmt.Printf("Not logged in to %s\n", registry)
+		return nil
+	}
+	fmt.Printf("Removed credentials for %s\n", registry)
+	return nil
+}
+
+// readPasswordStdin reads a password or token from stdin, without the
+// trailing newline.
+func readPasswordStdin() (string, error) {
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", errx.Wrap(ErrRegistryLogin, err)
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return "", errx.With(ErrRegistryLogin, ": empty password on stdin")
+	}
+	return password, nil
+}
+
+// promptCredentials asks for the username, unless given, and password on
+// the terminal.
+func promptCredentials(registry, username string) (string, string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", "", errx.With(ErrRegistryLogin, ": stdin is not a terminal; use --username and --password-stdin")
+	}
+	if username == "" {
+		fmt.Fprintf(os.Stderr, "Username for %s: ", registry)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return "", "", errx.Wrap(ErrRegistryLogin, err)
+		}
+		username = strings.TrimSpace(line)
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", "", errx.Wrap(ErrRegistryLogin, err)
+	}
+	return username, string(password), nil
+}
+
+// imageKeychain returns the keychain images are pulled with: stored logins,
+// then the Docker keychain. A username given with --registry-username and
+// a password from stdin take precedence for imageRef's registry, for CI
+// jobs that should not store credentials.
+func imageKeychain(cmd *cobra.Command, imageRef string) (authn.Keychain, error) {
+	store, err := image.LoadDefaultAuthStore()
+	if err != nil {
+		return nil, err
+	}
+	keychain := image.Keychain(store)
+	if cmd == nil {
+		return keychain, nil
+	}
+
+	username, _ := cmd.Flags().GetString("registry-username")
+	passwordStdin, _ := cmd.Flags().GetBool("registry-password-stdin")
+	if username == "" && !passwordStdin {
+		return keychain, nil
+	}
+	if username == "" || !passwordStdin {
+		return nil, errx.With(ErrRegistryLogin, ": --registry-username and --registry-password-stdin go together")
+	}
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return nil, errx.Wrap(image.ErrParseReference, err)
+	}
+	password, err := readPasswordStdin()
+	if err != nil {
+		return nil, err
+	}
+	creds, err := image.CredentialsKeychain(ref.Context().RegistryStr(), image.Credentials{Username: username, Password: password})
+	if err != nil {
+		return nil, err
+	}
+	return authn.NewMultiKeychain(creds, keychain), nil
+}
+
+// addRegistryAuthFlags adds the per-invocation registry credential flags
+// that imageKeychain reads.
+func addRegistryAuthFlags(cmd *cobra.Command) {
+	cmd.Flags().String("registry-username", "", "Registry username for pulling the image, instead of stored credentials")
+	cmd.Flags().Bool("registry-password-stdin", false, "Read the registry password or token for --registry-username from stdin")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/state"
+)
+
+var mountCmd = &cobra.Command{
+	Use:   "mount <id> <host:guest[:ro]>",
+	Short: "Mount a host directory into a running sandbox",
+	Long: `Attach a host directory to the workspace of a running sandbox without
+restarting it, so long-lived agent sessions can be given new inputs as they
+go. Guest paths are relative to the workspace, as with 'matchlock run -v'.
+
+With --overlay the guest's writes go to an upper layer kept in the sandbox
+state dir, leaving the host directory untouched. Mounts added this way are
+served over FUSE; git mounts and virtio-fs shares can only be set up when
+the sandbox starts. The sandbox must have been started with --rm=false to
+remain running.`,
+	Example: `  matchlock mount vm-abc123 ./data:data
+  matchlock mount vm-abc123 ~/datasets:/workspace/datasets:ro
+  matchlock mount --overlay vm-abc123 ./repo:repo`,
+	Args: cobra.ExactArgs(2),
+	RunE: runMount,
+}
+
+var unmountCmd = &cobra.Command{
+	Use:   "unmount <id> <guest>",
+	Short: "Unmount a volume from a running sandbox",
+	Long: `Detach a volume mounted in the workspace of a running sandbox, whether it
+was mounted at start or with 'matchlock mount'. Files the guest has open on
+it stay usable until closed. The workspace root, git mounts and virtio-fs
+shares cannot be unmounted.`,
+	Example: `  matchlock unmount vm-abc123 data
+  matchlock unmount vm-abc123 /workspace/datasets`,
+	Args: cobra.ExactArgs(2),
+	RunE: runUnmount,
+}
+
+func init() {
+	mountCmd.Flags().Bool("overlay", false, "Mount as an overlay: guest writes go to an upper layer, not the host directory")
+	mountCmd.Flags().StringSlice("exclude", nil, "Glob of paths to hide from the guest, on top of the host directory's .matchlockignore (can be repeated)")
+	mountCmd.Flags().String("mount-case", "", "Case handling for a case-insensitive host volume: reject-collisions or fold")
+	mountCmd.Flags().Bool("mount-unconfined", false, "Follow symlinks out of the host directory (refused by default)")
+	mountCmd.Flags().String("mount-idmap", "", "Show files owned by the host user as owned by guest UID:GID (or UID:GID=HOST_UID:HOST_GID)")
+
+	rootCmd.AddCommand(mountCmd)
+	rootCmd.AddCommand(unmountCmd)
+}
+
+func runMount(cmd *cobra.Command, args []string) error {
+	vmID, spec := args[0], args[1]
+	overlay, _ := cmd.Flags().GetBool("overlay")
+	exclude, _ := cmd.Flags().GetStringSlice("exclude")
+	mountCase, _ := cmd.Flags().GetString("mount-case")
+	mountIDMap, _ := cmd.Flags().GetString("mount-idmap")
+	unconfined, _ := cmd.Flags().GetBool("mount-unconfined")
+
+	mgr := state.NewManager()
+	execSocketPath, workspace, err := runningMountTarget(mgr, vmID)
+	if err != nil {
+		return err
+	}
+
+	hostPath, guestPath, readonly, err := api.ParseVolumeMount(spec, workspace)
+	if err != nil {
+		return errx.With(ErrInvalidVolume, " %q: %w", spec, err)
+	}
+	mount := api.MountConfig{Type: "real_fs", HostPath: hostPath, Readonly: readonly, Exclude: exclude, Case: mountCase, Unconfined: unconfined}
+	if mountIDMap != "" {
+		if mount.IDMap, err = api.ParseMountIDMap(mountIDMap); err != nil {
+			return errx.With(ErrInvalidVolume, ": %w", err)
+		}
+	}
+	if overlay {
+		if readonly {
+			return errx.With(ErrInvalidVolume, " %q: an overlay cannot be read-only", spec)
+		}
+		mount.Type = "overlay"
+	}
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+	if err := sandbox.AddMountViaRelay(ctx, execSocketPath, guestPath, mount); err != nil {
+		return errx.Wrap(ErrMountFailed, err)
+	}
+	fmt.Printf("Mounted %s at %s in %s\n", hostPath, guestPath, vmID)
+	return nil
+}
+
+func runUnmount(cmd *cobra.Command, args []string) error {
+	vmID, guestPath := args[0], args[1]
+
+	mgr := state.NewManager()
+	execSocketPath, workspace, err := runningMountTarget(mgr, vmID)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(guestPath) {
+		guestPath = filepath.Join(workspace, guestPath)
+	}
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+	if err := sandbox.RemoveMountViaRelay(ctx, execSocketPath, guestPath); err != nil {
+		return errx.Wrap(ErrMountFailed, err)
+	}
+	fmt.Printf("Unmounted %s from %s\n", guestPath, vmID)
+	return nil
+}
+
+// runningMountTarget returns the exec relay socket and workspace of the
+// running sandbox vmID.
+func runningMountTarget(mgr *state.Manager, vmID string) (socketPath, workspace string, err error) {
+	vmState, err := mgr.Get(vmID)
+	if err != nil {
+		return "", "", errx.With(ErrVMNotFound, " %s: %w", vmID, err)
+	}
+	if vmState.Status != "running" {
+		return "", "", fmt.Errorf("VM %s is not running (status: %s)", vmID, vmState.Status)
+	}
+	socketPath = mgr.ExecSocketPath(vmID)
+	if _, err := os.Stat(socketPath); err != nil {
+		return "", "", fmt.Errorf("exec socket not found for %s (was it started with --rm=false?)", vmID)
+	}
+	var config api.Config
+	if err := mgr.LoadConfig(vmID, &config); err != nil {
+		return "", "", err
+	}
+	return socketPath, config.GetWorkspace(), nil
+}
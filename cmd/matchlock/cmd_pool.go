@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/pool"
+)
+
+var poolCmd = &cobra.Command{
+	Use:   "pool",
+	Short: "Keep sandboxes booted ahead of use",
+}
+
+var poolServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run a daemon handing out pre-booted sandboxes",
+	Long: `Run a daemon that keeps sandboxes booted ahead of use and hands them to
+SDK clients on this host, so a launch takes as long as handing a sandbox
+over rather than as booting a VM.
+
+Clients attach with the SDK's Config.PoolSocket and LaunchFromPool. A
+sandbox is handed to the first create whose parameters match its own, and a
+replacement is booted in the background. The daemon keeps --size sandboxes
+of every set of parameters it has been asked for; the first create of one
+waits for a boot. A sandbox's timeout runs from when it is handed over.
+
+The socket is only accessible to the user running the daemon.`,
+	Example: `  matchlock pool serve --size 4`,
+	Args:    cobra.NoArgs,
+	RunE:    runPoolServe,
+}
+
+var poolAttachCmd = &cobra.Command{
+	Use:    "attach",
+	Short:  "Relay stdin and stdout to a pool daemon",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	RunE:   runPoolAttach,
+}
+
+func init() {
+	poolServeCmd.Flags().String("socket", pool.DefaultSocketPath(), "Unix socket to listen on")
+	poolServeCmd.Flags().Int("size", 2, "Sandboxes kept booted per set of create parameters")
+	poolAttachCmd.Flags().String("socket", pool.DefaultSocketPath(), "Unix socket of the daemon")
+
+	poolCmd.AddCommand(poolServeCmd)
+	poolCmd.AddCommand(poolAttachCmd)
+	rootCmd.AddCommand(poolCmd)
+}
+
+func runPoolServe(cmd *cobra.Command, args []string) error {
+	socket, _ := cmd.Flags().GetString("socket")
+	size, _ := cmd.Flags().GetInt("size")
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	binary, err := os.Executable()
+	if err != nil {
+		return errx.Wrap(ErrPoolServe, err)
+	}
+	server := pool.NewServer(binary, size)
+	if err := server.Start(socket); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Sandbox pool listening on %s\n", socket)
+
+	<-ctx.Done()
+	server.Close()
+	return nil
+}
+
+// runPoolAttach relays the JSON-RPC stream of an SDK client to the daemon,
+// standing in for 'matchlock rpc'.
+func runPoolAttach(cmd *cobra.Command, args []string) error {
+	socket, _ := cmd.Flags().GetString("socket")
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return errx.Wrap(ErrPoolAttach, err)
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+	io.Copy(os.Stdout, conn)
+	return nil
+}
@@ -15,6 +15,7 @@ var pruneCmd = &cobra.Command{
 }
 
 func init() {
+	adminOnly(pruneCmd)
 	rootCmd.AddCommand(pruneCmd)
 }
 
@@ -17,7 +17,12 @@ var pullCmd = &cobra.Command{
 	Long:  `Pull a container image from a registry and build a rootfs for use with matchlock run.`,
 	Example: `  matchlock pull alpine:latest
   matchlock pull -t myapp:latest alpine:latest
-  matchlock pull --force alpine:latest`,
+  matchlock pull --force alpine:latest
+  matchlock pull --platform linux/arm64 alpine:latest
+  matchlock pull --rootfs-format erofs pytorch/pytorch:latest
+  matchlock pull --verify-signature ghcr.io/acme/agent:latest
+  SOURCE_DATE_EPOCH=0 matchlock pull --reproducible alpine:3.20
+  echo "$CI_TOKEN" | matchlock pull --registry-username ci --registry-password-stdin registry.corp/app:1`,
 	Args: cobra.ExactArgs(1),
 	RunE: runPull,
 }
@@ -25,6 +30,12 @@ var pullCmd = &cobra.Command{
 func init() {
 	pullCmd.Flags().Bool("force", false, "Always pull image from registry (ignore cache)")
 	pullCmd.Flags().StringP("tag", "t", "", "Tag the image locally")
+	pullCmd.Flags().Int("layer-concurrency", image.DefaultLayerConcurrency, "Number of image layers downloaded at once")
+	pullCmd.Flags().String("rootfs-format", "ext4", "Filesystem to convert the image to: ext4, or erofs/squashfs (compressed, read-only, booted with a per-sandbox overlay; Linux only)")
+	pullCmd.Flags().Bool("verify-signature", false, "Require a cosign signature from a signer in the trust policy's images section")
+	pullCmd.Flags().Bool("reproducible", false, "Convert the image to the same rootfs bytes every time (given the same conversion tools): UUIDs derive from the digest, and timestamps from SOURCE_DATE_EPOCH or the image's creation time")
+	addRegistryAuthFlags(pullCmd)
+	pullCmd.Flags().String("platform", "", "Platform to pull from multi-platform images, e.g. linux/arm64 or linux/arm/v7 (default: linux on the host architecture)")
 
 	rootCmd.AddCommand(pullCmd)
 }
@@ -32,11 +43,41 @@ func init() {
 func runPull(cmd *cobra.Command, args []string) error {
 	force, _ := cmd.Flags().GetBool("force")
 	tag, _ := cmd.Flags().GetString("tag")
+	platformFlag, _ := cmd.Flags().GetString("platform")
+	layerConcurrency, _ := cmd.Flags().GetInt("layer-concurrency")
+	rootfsFormatFlag, _ := cmd.Flags().GetString("rootfs-format")
+	verifySignature, _ := cmd.Flags().GetBool("verify-signature")
+	reproducible, _ := cmd.Flags().GetBool("reproducible")
 
+	platform, err := image.ParsePlatform(platformFlag)
+	if err != nil {
+		return err
+	}
+	rootfsFormat, err := image.ParseRootfsFormat(rootfsFormatFlag)
+	if err != nil {
+		return err
+	}
+	signatures, err := imageSignaturePolicy(verifySignature)
+	if err != nil {
+		return err
+	}
 	imageRef := args[0]
-	builder := image.NewBuilder(&image.BuildOptions{
-		ForcePull: force,
+	keychain, err := imageKeychain(cmd, imageRef)
+	if err != nil {
+		return err
+	}
+	builder, err := newImageBuilder(&image.BuildOptions{
+		Keychain:         keychain,
+		ForcePull:        force,
+		Platform:         platform,
+		LayerConcurrency: layerConcurrency,
+		RootfsFormat:     rootfsFormat,
+		SignaturePolicy:  signatures,
+		Reproducible:     reproducible,
 	})
+	if err != nil {
+		return err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
@@ -54,6 +95,10 @@ func runPull(cmd *cobra.Command, args []string) error {
 		fmt.Printf("Tagged: %s\n", tag)
 	}
 
+	if !result.Cached {
+		collectImageGarbage(imageRef)
+	}
+
 	fmt.Printf("Digest: %s\n", result.Digest)
 	fmt.Printf("Size: %.1f MB\n", float64(result.Size)/(1024*1024))
 	return nil
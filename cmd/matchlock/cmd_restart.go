@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/state"
+)
+
+var restartCmd = &cobra.Command{
+	Use:   "restart [flags] <id>",
+	Short: "Reboot a running sandbox",
+	Long: `Shut the guest down cleanly and boot it again with the same configuration,
+mounts and network identity. The sandbox keeps its ID, IP address, CA and
+network policy.
+
+The root disk is preserved by default; --fresh-disk discards changes and boots
+from a new copy of the image. The sandbox must have been started with
+--rm=false to remain running.`,
+	Example: `  matchlock restart vm-abc123
+  matchlock restart --fresh-disk vm-abc123`,
+	Args: cobra.ExactArgs(1),
+	RunE: runRestart,
+}
+
+func init() {
+	restartCmd.Flags().Bool("fresh-disk", false, "Boot from a fresh copy of the image instead of the current disk")
+
+	rootCmd.AddCommand(restartCmd)
+}
+
+func runRestart(cmd *cobra.Command, args []string) error {
+	vmID := args[0]
+	freshDisk, _ := cmd.Flags().GetBool("fresh-disk")
+
+	mgr := state.NewManager()
+	vmState, err := mgr.Get(vmID)
+	if err != nil {
+		return errx.With(ErrVMNotFound, " %s: %w", vmID, err)
+	}
+	if vmState.Status != "running" {
+		return fmt.Errorf("VM %s is not running (status: %s)", vmID, vmState.Status)
+	}
+
+	execSocketPath := mgr.ExecSocketPath(vmID)
+	if _, err := os.Stat(execSocketPath); err != nil {
+		return fmt.Errorf("exec socket not found for %s (was it started with --rm=false?)", vmID)
+	}
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	if err := sandbox.RestartViaRelay(ctx, execSocketPath, &sandbox.RestartOptions{FreshDisk: freshDisk}); err != nil {
+		return errx.Wrap(ErrRestartFailed, err)
+	}
+	fmt.Printf("Restarted %s\n", vmID)
+	return nil
+}
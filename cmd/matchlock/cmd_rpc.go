@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
 
@@ -11,6 +12,8 @@ import (
 	"github.com/jingkaihe/matchlock/pkg/image"
 	"github.com/jingkaihe/matchlock/pkg/rpc"
 	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/secrets"
+	"github.com/jingkaihe/matchlock/pkg/state"
 )
 
 var rpcCmd = &cobra.Command{
@@ -32,14 +35,39 @@ func runRPC(cmd *cobra.Command, args []string) error {
 			return nil, fmt.Errorf("image is required")
 		}
 
-		builder := image.NewBuilder(&image.BuildOptions{})
+		if config.Network != nil {
+			if err := secrets.NewResolver().ResolveAll(ctx, config.Network.Secrets); err != nil {
+				return nil, err
+			}
+		}
+
+		signatures, err := imageSignaturePolicy(false)
+		if err != nil {
+			return nil, err
+		}
+		builder, err := newImageBuilder(&image.BuildOptions{SignaturePolicy: signatures})
+		if err != nil {
+			return nil, err
+		}
 
 		result, err := builder.Build(ctx, config.Image)
 		if err != nil {
 			return nil, errx.Wrap(ErrBuildRootfs, err)
 		}
+		config.ImageDigest = result.Digest
 
-		return sandbox.New(ctx, config, &sandbox.Options{RootfsPath: result.RootfsPath})
+		sb, err := sandbox.New(ctx, config, &sandbox.Options{RootfsPath: result.RootfsPath})
+		if err != nil {
+			return nil, err
+		}
+
+		// Serve the exec relay so that `matchlock exec`, `watch` and
+		// `freeze-network` reach SDK sandboxes as well.
+		execSocketPath := state.NewManager().ExecSocketPath(sb.ID())
+		if err := sandbox.NewExecRelay(sb).Start(execSocketPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to start exec relay: %v\n", err)
+		}
+		return sb, nil
 	}
 
 	return rpc.RunRPC(ctx, factory)
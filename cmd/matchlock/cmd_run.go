@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"syscall"
 	"time"
 
@@ -14,9 +17,13 @@ import (
 
 	"github.com/jingkaihe/matchlock/internal/errx"
 	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/caches"
+	"github.com/jingkaihe/matchlock/pkg/disks"
 	"github.com/jingkaihe/matchlock/pkg/image"
 	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/secrets"
 	"github.com/jingkaihe/matchlock/pkg/state"
+	"github.com/jingkaihe/matchlock/pkg/transfer"
 	"github.com/jingkaihe/matchlock/pkg/vm"
 )
 
@@ -27,19 +34,276 @@ var runCmd = &cobra.Command{
 
 Secrets (--secret):
   Secrets are injected via MITM proxy - the real value never enters the VM.
-  The VM sees a placeholder, which is replaced with the real value in HTTP headers.
+  The VM sees a placeholder, which is replaced with the real value in HTTP
+  headers and query strings.
 
   Formats:
-    NAME=VALUE@host1,host2     Inline secret value for specified hosts
-    NAME@host1,host2           Read secret from $NAME environment variable
+    NAME=VALUE@host1,host2       Inline secret value for specified hosts
+    NAME@host1,host2             Read secret from $NAME environment variable
+    NAME:body,query@host         Choose where to replace (header, query, body)
+    NAME:POST@host/v1/messages   Only for POST requests under /v1/messages;
+                                 the placeholder is blocked elsewhere on host
+    NAME=aws-sm:prod/key@host    Fetch from AWS Secrets Manager (#field picks a JSON key)
+    NAME=aws-ssm:/prod/key@host  Fetch from AWS SSM Parameter Store
+    NAME=op://vault/item/field@host  Read from 1Password via the op CLI
+    NAME=keychain:service@host   Read from macOS Keychain / Linux secret service
+                                 (keychain:service/account to pick an account)
+
+  References are resolved on the host at launch. AWS uses the default AWS
+  credential chain; 1Password and keychain lookups may prompt to unlock.
+
+  Body replacement understands JSON, form-encoded and text bodies, escaping
+  the value to match, and updates Content-Length.
+
+  --secret-header NAME="Header-Name: template" sends the header on every
+  request to the secret's hosts (within its methods and paths), with {value}
+  replaced by the real value, so the guest need not know how the API expects
+  it, e.g. --secret-header 'DD_API_KEY=DD-API-KEY: {value}'. It replaces any
+  such header the guest sent.
+
+  --secret-ttl NAME=DURATION expires a secret, including OAuth2 and Google
+  Cloud ones, that long after launch. From then on the proxy refuses
+  requests it would have been injected into and reports them as blocked
+  network events with rule secret_expired, so a forgotten sandbox does not
+  keep working with a credential that should have been rotated.
 
   Note: When using sudo, env vars are not preserved. Use 'sudo -E' or pass inline.
 
+Environment Discovery (--secret-from-env):
+  --secret-from-env 'ANTHROPIC_*,OPENAI_*' turns every matching host
+  environment variable into a secret, exported to the guest as a placeholder
+  under the same name. Each is bound to the hosts mapped to its name in
+  ~/.config/matchlock/secret-hosts.yaml (or --secret-env-hosts), over
+  built-in entries for common model APIs and GitHub:
+    hosts:
+      ANTHROPIC_*: [api.anthropic.com]
+      INTERNAL_API_TOKEN: [api.internal.example.com/v1]
+  A matching variable without mapped hosts is an error. --secret-file and
+  --secret entries override discovered ones by name.
+
+Secret Profiles (--secret-profile):
+  --secret-profile anthropic,github-readonly adds named bundles of secrets
+  from ~/.config/matchlock/secret-profiles.yaml (or $MATCHLOCK_SECRET_PROFILES),
+  so a team can share least-privilege sets instead of repeating flags. Each
+  profile holds entries in the --secret-file format below:
+    profiles:
+      github-readonly:
+        GH_TOKEN:
+          env: GITHUB_READONLY_TOKEN
+          hosts: [api.github.com]
+          methods: [GET]
+  Later profiles override earlier ones by secret name, and --secret-file and
+  --secret entries override them all.
+
+Secret Files (--secret-file):
+  Define many secrets in one YAML or JSON file instead of repeating --secret.
+  Each entry takes value (inline or a store reference as above; default
+  $NAME, or the variable named by env), hosts, in, methods, paths, or an
+  oauth2 block (token_url, client_id, client_secret, refresh_token, scopes),
+  or a gcp block (key_file, scopes, audience):
+    secrets:
+      ANTHROPIC_API_KEY:
+        value: aws-sm:prod/anthropic
+        hosts: [api.anthropic.com]
+        methods: [POST]
+        paths: [/v1/messages]
+  The same file can be loaded with sdk.LoadSecretFile.
+
+OAuth2 (--oauth2-secret NAME=TOKEN_URL@host1,host2):
+  The proxy mints access tokens from TOKEN_URL on the host, caches them until
+  they expire and sends "Authorization: Bearer" on requests to the hosts,
+  refreshing and retrying once when upstream answers 401. Credentials come
+  from $NAME_CLIENT_ID and optionally $NAME_CLIENT_SECRET, $NAME_REFRESH_TOKEN
+  (refresh_token grant instead of client_credentials) and $NAME_SCOPES; the
+  secret and refresh token may be store references as above. Methods and
+  paths scope it as for --secret.
+
+Google Cloud (--gcp-secret NAME=KEY_FILE@host1,host2):
+  The proxy reads a service account key file on the host and injects
+  short-lived access tokens, signed and refreshed like OAuth2 tokens above,
+  into requests to the hosts (default *.googleapis.com). KEY_FILE defaults
+  to $GOOGLE_APPLICATION_CREDENTIALS and the scope to cloud-platform;
+  $NAME_SCOPES overrides it, and $NAME_AUDIENCE mints ID tokens for that
+  audience instead, e.g. for Cloud Run or IAP. The key never enters the VM.
+
+GitHub App (--github-app-secret NAME=APP_ID:INSTALLATION_ID:KEY_FILE@hosts):
+  The proxy signs a JWT with the app's private key on the host, exchanges it
+  for an installation access token and injects that, refreshed before it
+  expires, into requests to the hosts (default api.github.com and
+  uploads.github.com). Secret files can narrow the token to repositories
+  and permissions and point api_url at GitHub Enterprise Server.
+
 Volume Mounts (-v):
   Guest paths are relative to workspace (or use full workspace paths):
   ./mycode:code                    Mounts to <workspace>/code
   ./data:/workspace/data           Same as above (explicit)
   /host/path:subdir:ro             Read-only mount to <workspace>/subdir
+  A .matchlockignore at the root of a mounted host directory lists globs of
+  paths hidden from the guest, one per line (e.g. node_modules, .git, venv);
+  --exclude adds more. Hidden paths cannot be created by the guest either.
+  Host directories on case-insensitive volumes (macOS's default APFS) merge
+  names the Linux guest keeps apart, such as Makefile and makefile; a warning
+  is printed for them. --mount-case reject-collisions fails creating such a
+  name, and --mount-case fold makes the guest resolve names ignoring case.
+  Mounted files show as owned by root. --mount-idmap 1000:1000 shows the
+  files of the user running matchlock as owned by guest uid/gid 1000 (and
+  any others as nobody), for tools such as git that check ownership; use
+  UID:GID=HOST_UID:HOST_GID to map another host user.
+  Paths are resolved within each mounted host directory: a symlink in it
+  leading out of it, such as one to /etc/passwd, is refused rather than
+  followed on the host. --mount-unconfined follows such symlinks.
+
+Shared Caches (--cache):
+  --cache pip:.cache/pip mounts the package cache named pip at
+  <workspace>/.cache/pip. Every sandbox mounting the same name shares it,
+  including ones running at the same time, so point the tool at it (e.g.
+  PIP_CACHE_DIR, npm_config_cache, GOMODCACHE, HF_HOME) and each package is
+  downloaded once. Files are stored once by content in
+  ~/.cache/matchlock/caches; a file written by two sandboxes at once ends up
+  as one of the versions, whole. Manage caches with 'matchlock cache'.
+
+Encrypted Workspace (--encrypt-workspace):
+  Keep the workspace's file data in a host file encrypted with a random key
+  held only in matchlock's memory, for agent runs whose intermediate data
+  must never reach the host disk in plaintext. The file is unlinked as soon
+  as it is created and the key is dropped when the sandbox closes, so
+  nothing readable outlives the run. Mounts under the workspace are not
+  affected, and the workspace cannot also be a volume or snapshot.
+
+Filesystem Performance (--vfs-slow-op):
+  Every filesystem operation the guest makes on its mounts is counted per
+  mount and kind, with bytes moved and a latency histogram, and shown under
+  vfs_metrics by 'matchlock get' while the sandbox runs and after it stops.
+  --vfs-slow-op 50ms also logs each operation taking 50ms or longer, as a
+  JSON line with its mount, path and duration, to vfs_slow.log in the
+  sandbox state dir (~/.matchlock/vms/<id>), to find the mount making a
+  workload filesystem-bound.
+
+Workspace Snapshots (--workspace-from):
+  Start with the files of a workspace saved by 'matchlock workspace snapshot'.
+  The snapshot is mounted read-only under an overlay, so the sandbox's
+  writes never change it and many sandboxes can start from one snapshot.
+
+Host Services (--allow-host-port):
+  The guest can reach services listening on the host loopback interface via
+  host.matchlock.internal. Only the listed ports are reachable, and every
+  connection is reported as a network event.
+
+Network Shaping (--net-shape):
+  Emulate a slow link on the sandbox data path, e.g.
+  --net-shape latency=100ms,jitter=20ms,bw=5mbit
+  Latency (± jitter) is added once per request/response turn; bandwidth caps
+  each direction (bit/kbit/mbit/gbit or bytes with bps/kbps/mbps/gbps).
+
+Connection Limits (--max-connections, --max-connections-per-minute):
+  Cap how many TCP connections the guest may hold open at once and how many
+  it may open in any one-minute window. Connections over either limit are
+  refused and recorded as blocked network events.
+
+Egress Budget (--max-egress-bytes, --egress-budget-action):
+  Cap the total bytes the guest may send through the proxy. Once spent,
+  further traffic is blocked (the default) or, with --egress-budget-action
+  kill, the sandbox is stopped. Usage is reported by 'matchlock get'.
+
+Secret Leaks (--secret-leak-action):
+  A request carrying a secret's placeholder to a host the secret is not
+  bound to is always blocked and reported as a high-severity network event
+  with rule secret_leak, since it suggests an agent trying to exfiltrate its
+  credentials. With --secret-leak-action kill the sandbox is also stopped.
+
+Certificate Pinning (--cert-pin):
+  Require an allowed host's upstream certificate chain to contain a pinned
+  public key before any request (and any injected secret) is forwarded, e.g.
+  --cert-pin api.anthropic.com=sha256/<base64 SPKI digest>
+  Compute a pin with:
+  openssl s_client -connect HOST:443 </dev/null | openssl x509 -pubkey -noout |
+    openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+
+Upstream TLS (--upstream-tls):
+  Customize how the proxy verifies an intercepted host's server certificate:
+  --upstream-tls 'lab.internal=ca=/etc/ssl/lab-ca.pem,min-version=1.2'
+  ca (repeatable) replaces the system roots for that host. For self-signed
+  lab endpoints, insecure-skip-verify disables verification entirely; this is
+  warned about at startup and flagged on every network event.
+
+Request Signing (--sign-request):
+  Have the proxy sign the body of every request to a host with an HMAC keyed
+  by a secret, so the signing key never enters the guest:
+  --secret HOOK_KEY@hooks.example.com \
+  --sign-request 'hooks.example.com=secret=HOOK_KEY,header=X-Hub-Signature-256,prefix=sha256='
+  algorithm is hmac-sha256 (default), hmac-sha512 or hmac-sha1, and encoding
+  hex (default) or base64. Bodies are signed after secret substitution;
+  bodies over 8 MiB are refused.
+
+Interception Exclusions (--no-intercept-host):
+  Allow a host but relay its TLS traffic without decrypting it, for clients
+  that pin certificates or hosts that must never be inspected. Secrets are
+  never injected into such hosts, and a connection that carries a secret
+  placeholder in the clear (in plain HTTP or the TLS ClientHello) is blocked
+  rather than forwarded. Only the ClientHello of a TLS connection can be
+  checked: a placeholder in the headers or body of an HTTPS request to such
+  a host is encrypted, cannot be seen and is sent as is.
+
+Upstream Proxy (--upstream-proxy, --proxy-pac):
+  Chain all sandbox egress through a corporate HTTP proxy, e.g.
+  --upstream-proxy http://proxy.corp:3128, or --upstream-proxy system to use
+  the macOS system proxy settings (HTTPS_PROXY/NO_PROXY elsewhere).
+  --proxy-pac URL reads the proxy from a PAC file; the script is not run, so
+  it must be a FindProxyForURL that only returns "PROXY host:port" or
+  "DIRECT", and per-host rules are refused. The guest still resolves
+  names itself, so --dns-servers may need to point at an internal resolver.
+
+Swap (--swap, --swap-type):
+  Give the guest swap so memory spikes (linkers, test suites) page out instead
+  of being OOM-killed. zram (default) compresses pages in guest RAM and may be
+  up to 2x --memory; file swaps to a sparse disk image that is attached only
+  to this VM and deleted when the sandbox is closed.
+
+Data Disks (--disk):
+  --disk name=data,size=10G attaches the persistent ext4 disk named data as a
+  block device mounted at /mnt/data (mount=PATH picks another path, outside
+  the workspace). The disk is created on first use in
+  ~/.cache/matchlock/disks, grown when a larger size is asked for, and kept
+  across sandboxes, so large datasets and build outputs get native disk speed
+  instead of going through the workspace. from=IMAGE seeds a new disk from
+  an ext4 image. A disk is attached read-write to one sandbox at a time; ro
+  attaches it read-only, and many sandboxes can share it so. Manage disks
+  with 'matchlock disk'.
+
+Raw TLS Services:
+  Connections on ports other than 80/443 are matched against --allow-host by
+  their TLS server name (SNI) when the destination IP itself is not allowed,
+  so databases and SMTPS endpoints can be allowlisted by hostname. Such
+  connections are dialed by name from the host.
+
+Redaction (--redact):
+  Mask secret values, their placeholders and OAuth2 credentials as
+  [REDACTED:NAME] in command output, network events, violation reports and
+  the VM log before they leave the sandbox. Output is masked a line at a
+  time; interactive (-it) sessions are not redacted.
+
+Cloning (--from):
+  Start from the stored config of an existing or stopped sandbox (image,
+  resources, network policy, secrets, mounts, image config) instead of
+  repeating its flags. Flags set on the command line override it; --secret
+  and --volume add to or replace entries by name and guest path. Secrets are
+  reused as resolved when the original sandbox was created.
+
+Templates (--env, --label):
+  The command and --env values may reference the sandbox with Go templates,
+  rendered once it has been created: {{.SandboxID}}, {{.WorkspacePath}} and
+  {{.Label "KEY"}} for a --label. A missing label is an error.
+    matchlock run --image alpine --label task=review \
+      -e AGENT_ID='{{.SandboxID}}' -- sh -c 'run-agent --task {{.Label "task"}}'
+
+Size Presets (--size):
+  Size the sandbox from a named preset instead of --cpus, --memory,
+  --disk-size and --timeout; any of those set explicitly still win.
+  Built-in: small (1 CPU, 512 MB, 5 GB, 5m), medium (2 CPUs, 2 GB, 10 GB, 30m)
+  and large (4 CPUs, 8 GB, 20 GB, 1h). Operators can redefine them or add
+  more in ~/.config/matchlock/presets.json (or $MATCHLOCK_PRESETS):
+    {"sizes": {"large": {"cpus": 8, "memory_mb": 16384, "disk_size_mb": 40960, "timeout_seconds": 7200}}}
+  The preset name is recorded with the sandbox (see 'matchlock get').
 
 Wildcard Patterns for --allow-host:
   *                      Allow all hosts
@@ -49,50 +313,135 @@ Wildcard Patterns for --allow-host:
   matchlock run --image python:3.12-alpine python3 -c 'print(42)'
   matchlock run --image alpine:latest --rm=false   # keep VM alive after exit
   matchlock exec <vm-id> echo hello                # exec into running VM
+  matchlock run --from <vm-id> --cpus 4 make test  # clone a sandbox's config
 
   # With secrets (MITM replaces placeholder in HTTP requests)
   export ANTHROPIC_API_KEY=sk-xxx
   matchlock run --image python:3.12-alpine \
     --secret ANTHROPIC_API_KEY@api.anthropic.com \
-    python call_api.py`,
+    python call_api.py
+
+  # Reach a model server running on the host (e.g. Ollama on :11434)
+  matchlock run --image alpine:latest --allow-host-port 11434 \
+    wget -qO- http://host.matchlock.internal:11434/api/tags`,
 	Args: cobra.ArbitraryArgs,
 	RunE: runRun,
 }
 
 func init() {
-	runCmd.Flags().String("image", "", "Container image (required)")
+	runCmd.Flags().String("image", "", "Container image (required unless --from is set)")
+	runCmd.Flags().String("from", "", "Reuse the config of an existing or stopped sandbox; set flags override it")
 	runCmd.Flags().String("workspace", api.DefaultWorkspace, "Guest mount point for VFS")
+	runCmd.Flags().Duration("vfs-slow-op", 0, "Log guest filesystem operations taking at least this long (e.g. 50ms) to vfs_slow.log in the sandbox state dir")
+	runCmd.Flags().Bool("encrypt-workspace", false, "Keep workspace files in an encrypted host file whose key never leaves memory")
+	runCmd.Flags().String("workspace-from", "", "Seed the workspace with a snapshot saved by 'matchlock workspace snapshot'")
 	runCmd.Flags().StringSlice("allow-host", nil, "Allowed hosts (can be repeated)")
+	runCmd.Flags().IntSlice("allow-host-port", nil, "Host loopback ports reachable via host.matchlock.internal (can be repeated)")
 	runCmd.Flags().StringSliceP("volume", "v", nil, "Volume mount (host:guest or host:guest:ro)")
-	runCmd.Flags().StringSlice("secret", nil, "Secret (NAME=VALUE@host1,host2 or NAME@host1,host2)")
+	runCmd.Flags().StringSlice("overlay", nil, "Overlay mount (host:guest): the guest writes to an upper layer kept in the sandbox state dir, leaving the host directory untouched")
+	runCmd.Flags().StringSlice("s3", nil, "S3 mount (s3://bucket[/prefix]:guest or ...:guest:ro); AWS credentials stay on the host")
+	runCmd.Flags().StringSlice("git", nil, "Git mount (guest=url or guest=url#ref), cloned on the host with its git credentials")
+	runCmd.Flags().StringSlice("deny-read", nil, "Glob of paths the guest may not read in --volume, --overlay and --git mounts (e.g. '**/.env'; can be repeated)")
+	runCmd.Flags().StringSlice("deny-write", nil, "Glob of paths the guest may not write in --volume, --overlay and --git mounts (e.g. '**/*.pem'; can be repeated)")
+	runCmd.Flags().StringSlice("exclude", nil, "Glob of paths to hide from the guest in --volume and --overlay mounts, on top of each host directory's .matchlockignore (e.g. 'node_modules'; can be repeated)")
+	runCmd.Flags().String("mount-idmap", "", "Show files of --volume and --overlay mounts owned by the host user as owned by guest UID:GID (or UID:GID=HOST_UID:HOST_GID)")
+	runCmd.Flags().Bool("mount-unconfined", false, "Follow symlinks out of the host directories of --volume and --overlay mounts (refused by default)")
+	runCmd.Flags().String("mount-case", "", "Case handling for --volume and --overlay mounts of case-insensitive host volumes: reject-collisions or fold")
+	runCmd.Flags().StringSlice("memory-mount", nil, "In-memory mount (guest or guest:SIZE_MB); writes past SIZE_MB fail with ENOSPC")
+	runCmd.Flags().StringSlice("cache", nil, "Shared cache mount (NAME:guest), kept on the host and shared by every sandbox mounting NAME (can be repeated)")
+	runCmd.Flags().String("git-push-branch", "", "Push commits made in --git mounts to this branch when the sandbox closes")
+	runCmd.Flags().String("volume-backend", api.MountBackendFUSE, "How --volume mounts reach the guest: fuse or virtiofs (falls back to fuse where unsupported)")
+	runCmd.Flags().StringSlice("secret", nil, "Secret (NAME[:in,...]=VALUE@host1,host2 or NAME[:in,...]@host1,host2)")
+	runCmd.Flags().StringSlice("secret-from-env", nil, "Turn host environment variables matching these patterns into secrets (e.g. 'ANTHROPIC_*,OPENAI_*')")
+	runCmd.Flags().String("secret-env-hosts", "", "Host map for --secret-from-env (default: ~/.config/matchlock/secret-hosts.yaml)")
+	runCmd.Flags().StringSlice("secret-profile", nil, "Named secret bundles from ~/.config/matchlock/secret-profiles.yaml (can be repeated)")
+	runCmd.Flags().StringSlice("secret-file", nil, "YAML or JSON file defining secrets (can be repeated; --secret, --oauth2-secret, --gcp-secret and --github-app-secret override by name)")
+	runCmd.Flags().StringArray("secret-header", nil, "Header to send with a secret's value (NAME=Header-Name: template with {value}; can be repeated)")
+	runCmd.Flags().StringArray("secret-ttl", nil, "Stop injecting a secret after a duration (NAME=DURATION, e.g. API_KEY=8h; can be repeated)")
+	runCmd.Flags().StringArray("oauth2-secret", nil, "OAuth2 client whose tokens the proxy injects (NAME=TOKEN_URL@host1,host2; credentials from $NAME_CLIENT_ID etc.)")
+	runCmd.Flags().StringArray("gcp-secret", nil, "Google Cloud service account whose tokens the proxy injects (NAME=KEY_FILE@host1,host2; hosts default to *.googleapis.com)")
+	runCmd.Flags().StringArray("github-app-secret", nil, "GitHub App whose installation tokens the proxy injects (NAME=APP_ID:INSTALLATION_ID:KEY_FILE@host1,host2; hosts default to api.github.com)")
 	runCmd.Flags().StringSlice("dns-servers", nil, "DNS servers (default: 8.8.8.8,8.8.4.4)")
+	runCmd.Flags().String("net-shape", "", "Emulate network conditions (e.g. latency=100ms,jitter=20ms,bw=5mbit)")
+	runCmd.Flags().StringSlice("cert-pin", nil, "Pin a host's certificate public key (HOST=sha256/BASE64, can be repeated)")
+	runCmd.Flags().StringArray("sign-request", nil, "HMAC-sign request bodies to a host (HOST=secret=NAME,header=HEADER[,algorithm=hmac-sha256,encoding=hex,prefix=P]; can be repeated)")
+	runCmd.Flags().StringArray("upstream-tls", nil, "Upstream TLS options for a host (HOST=ca=PATH,min-version=1.2,insecure-skip-verify; can be repeated)")
+	runCmd.Flags().StringSlice("no-intercept-host", nil, "Allowed host whose TLS traffic is relayed without interception (can be repeated)")
+	runCmd.Flags().String("upstream-proxy", "", "Chain egress through an HTTP proxy (http://HOST:PORT, or 'system' for the host's proxy settings)")
+	runCmd.Flags().String("proxy-pac", "", "Chain egress through the proxy named in a PAC file (http(s) or file URL)")
+	runCmd.Flags().Int("max-connections", 0, "Maximum simultaneous outbound connections (0 = unlimited)")
+	runCmd.Flags().Int("max-connections-per-minute", 0, "Maximum new outbound connections per minute (0 = unlimited)")
+	runCmd.Flags().Int64("max-egress-bytes", 0, "Maximum total bytes the guest may send out (0 = unlimited)")
+	runCmd.Flags().String("egress-budget-action", "", "What to do when the egress budget is spent: block (default) or kill")
+	runCmd.Flags().String("secret-leak-action", "", "What to do when a secret placeholder is sent to a host it is not bound to: block (default) or kill")
+	runCmd.Flags().String("size", "", "Resource preset (small, medium, large, or one from ~/.config/matchlock/presets.json)")
 	runCmd.Flags().Int("cpus", api.DefaultCPUs, "Number of CPUs")
 	runCmd.Flags().Int("memory", api.DefaultMemoryMB, "Memory in MB")
 	runCmd.Flags().Int("timeout", api.DefaultTimeoutSeconds, "Timeout in seconds")
-	runCmd.Flags().Int("disk-size", api.DefaultDiskSizeMB, "Disk size in MB")
+	runCmd.Flags().Int("disk-size", 0, "Minimum disk size in MB (default: fit the image plus --rootfs-free-space)")
+	runCmd.Flags().Int("rootfs-free-space", api.DefaultRootfsFreeSpaceMB, "Free space in MB to leave on the root disk beyond the image contents")
+	runCmd.Flags().Int("swap", 0, "Guest swap in MB (0 = none)")
+	runCmd.Flags().String("swap-type", "", "Swap type: zram (compressed RAM, default) or file (sparse disk image)")
+	runCmd.Flags().StringArray("disk", nil, "Persistent data disk (name=NAME[,size=10G][,from=IMAGE][,mount=PATH][,ro]); can be repeated")
 	runCmd.Flags().BoolP("tty", "t", false, "Allocate a pseudo-TTY")
 	runCmd.Flags().BoolP("interactive", "i", false, "Keep STDIN open")
 	runCmd.Flags().Bool("pull", false, "Always pull image from registry (ignore cache)")
+	runCmd.Flags().Bool("verify-signature", false, "Require a cosign signature on registry images from a signer in the trust policy's images section")
+	addRegistryAuthFlags(runCmd)
+	runCmd.Flags().String("rootfs-format", "ext4", "Filesystem registry images are converted to: ext4, or erofs/squashfs (compressed, read-only, shared with a per-sandbox overlay; Linux only)")
+	runCmd.Flags().String("platform", "", "Image platform to pull, e.g. linux/arm64/v8 (default: linux on the host architecture)")
 	runCmd.Flags().Bool("rm", true, "Remove sandbox after command exits (set --rm=false to keep running)")
+	runCmd.Flags().Bool("redact", false, "Mask secret values and placeholders in command output, network events and VM logs")
 	runCmd.Flags().Bool("privileged", false, "Skip in-guest security restrictions (seccomp, cap drop, no_new_privs)")
 	runCmd.Flags().StringP("workdir", "w", "", "Working directory inside the sandbox (default: workspace path)")
+	runCmd.Flags().Bool("mkdir-workdir", false, "Create the working directory if it does not exist")
 	runCmd.Flags().StringP("user", "u", "", "Run as user (uid, uid:gid, or username; overrides image USER)")
 	runCmd.Flags().String("entrypoint", "", "Override image ENTRYPOINT")
+	runCmd.Flags().StringArrayP("env", "e", nil, "Environment variable for commands in the sandbox (KEY=VALUE, can be repeated)")
+	runCmd.Flags().StringArray("label", nil, "Label the sandbox (KEY=VALUE, can be repeated; see {{.Label \"KEY\"}})")
 	runCmd.Flags().Duration("graceful-shutdown", api.DefaultGracefulShutdownPeriod, "Graceful shutdown timeout before force-stopping the VM ")
-	runCmd.MarkFlagRequired("image")
 
 	viper.BindPFlag("run.image", runCmd.Flags().Lookup("image"))
 	viper.BindPFlag("run.workspace", runCmd.Flags().Lookup("workspace"))
+	viper.BindPFlag("run.vfs-slow-op", runCmd.Flags().Lookup("vfs-slow-op"))
+	viper.BindPFlag("run.encrypt-workspace", runCmd.Flags().Lookup("encrypt-workspace"))
+	viper.BindPFlag("run.workspace-from", runCmd.Flags().Lookup("workspace-from"))
 	viper.BindPFlag("run.allow-host", runCmd.Flags().Lookup("allow-host"))
+	viper.BindPFlag("run.allow-host-port", runCmd.Flags().Lookup("allow-host-port"))
 	viper.BindPFlag("run.volume", runCmd.Flags().Lookup("volume"))
+	viper.BindPFlag("run.overlay", runCmd.Flags().Lookup("overlay"))
+	viper.BindPFlag("run.s3", runCmd.Flags().Lookup("s3"))
+	viper.BindPFlag("run.git", runCmd.Flags().Lookup("git"))
+	viper.BindPFlag("run.memory-mount", runCmd.Flags().Lookup("memory-mount"))
+	viper.BindPFlag("run.cache", runCmd.Flags().Lookup("cache"))
+	viper.BindPFlag("run.deny-read", runCmd.Flags().Lookup("deny-read"))
+	viper.BindPFlag("run.deny-write", runCmd.Flags().Lookup("deny-write"))
+	viper.BindPFlag("run.exclude", runCmd.Flags().Lookup("exclude"))
+	viper.BindPFlag("run.mount-case", runCmd.Flags().Lookup("mount-case"))
+	viper.BindPFlag("run.mount-idmap", runCmd.Flags().Lookup("mount-idmap"))
+	viper.BindPFlag("run.mount-unconfined", runCmd.Flags().Lookup("mount-unconfined"))
+	viper.BindPFlag("run.git-push-branch", runCmd.Flags().Lookup("git-push-branch"))
+	viper.BindPFlag("run.volume-backend", runCmd.Flags().Lookup("volume-backend"))
 	viper.BindPFlag("run.secret", runCmd.Flags().Lookup("secret"))
+	viper.BindPFlag("run.secret-file", runCmd.Flags().Lookup("secret-file"))
+	viper.BindPFlag("run.secret-from-env", runCmd.Flags().Lookup("secret-from-env"))
+	viper.BindPFlag("run.secret-env-hosts", runCmd.Flags().Lookup("secret-env-hosts"))
+	viper.BindPFlag("run.secret-profile", runCmd.Flags().Lookup("secret-profile"))
+	viper.BindPFlag("run.secret-header", runCmd.Flags().Lookup("secret-header"))
+	viper.BindPFlag("run.secret-ttl", runCmd.Flags().Lookup("secret-ttl"))
 	viper.BindPFlag("run.cpus", runCmd.Flags().Lookup("cpus"))
 	viper.BindPFlag("run.memory", runCmd.Flags().Lookup("memory"))
 	viper.BindPFlag("run.timeout", runCmd.Flags().Lookup("timeout"))
 	viper.BindPFlag("run.disk-size", runCmd.Flags().Lookup("disk-size"))
+	viper.BindPFlag("run.rootfs-free-space", runCmd.Flags().Lookup("rootfs-free-space"))
+	viper.BindPFlag("run.swap", runCmd.Flags().Lookup("swap"))
+	viper.BindPFlag("run.disk", runCmd.Flags().Lookup("disk"))
 	viper.BindPFlag("run.tty", runCmd.Flags().Lookup("tty"))
 	viper.BindPFlag("run.interactive", runCmd.Flags().Lookup("interactive"))
 	viper.BindPFlag("run.pull", runCmd.Flags().Lookup("pull"))
+	viper.BindPFlag("run.platform", runCmd.Flags().Lookup("platform"))
+	viper.BindPFlag("run.rootfs-format", runCmd.Flags().Lookup("rootfs-format"))
+	viper.BindPFlag("run.verify-signature", runCmd.Flags().Lookup("verify-signature"))
 	viper.BindPFlag("run.rm", runCmd.Flags().Lookup("rm"))
 
 	rootCmd.AddCommand(runCmd)
@@ -101,28 +450,88 @@ func init() {
 func runRun(cmd *cobra.Command, args []string) error {
 	// Image & lifecycle
 	imageName, _ := cmd.Flags().GetString("image")
+	from, _ := cmd.Flags().GetString("from")
 	pull, _ := cmd.Flags().GetBool("pull")
+	platformFlag, _ := cmd.Flags().GetString("platform")
+	rootfsFormatFlag, _ := cmd.Flags().GetString("rootfs-format")
+	verifySignature, _ := cmd.Flags().GetBool("verify-signature")
 	rm, _ := cmd.Flags().GetBool("rm")
 	privileged, _ := cmd.Flags().GetBool("privileged")
+	redactOutput, _ := cmd.Flags().GetBool("redact")
 
 	// Resources
 	cpus, _ := cmd.Flags().GetInt("cpus")
 	memory, _ := cmd.Flags().GetInt("memory")
 	diskSize, _ := cmd.Flags().GetInt("disk-size")
+	freeSpace, _ := cmd.Flags().GetInt("rootfs-free-space")
+	swap, _ := cmd.Flags().GetInt("swap")
+	swapType, _ := cmd.Flags().GetString("swap-type")
+	diskSpecs, _ := cmd.Flags().GetStringArray("disk")
 	timeout, _ := cmd.Flags().GetInt("timeout")
+	resources := &api.Resources{
+		CPUs:              cpus,
+		MemoryMB:          memory,
+		DiskSizeMB:        diskSize,
+		RootfsFreeSpaceMB: freeSpace,
+		SwapMB:            swap,
+		SwapType:          swapType,
+		TimeoutSeconds:    timeout,
+	}
+	if err := applySize(cmd, resources); err != nil {
+		return err
+	}
 
 	// Exec options
 	tty, _ := cmd.Flags().GetBool("tty")
 	interactive, _ := cmd.Flags().GetBool("interactive")
 	interactiveMode := tty && interactive
 	workspace, _ := cmd.Flags().GetString("workspace")
+	workspaceFrom, _ := cmd.Flags().GetString("workspace-from")
+	encryptWorkspace, _ := cmd.Flags().GetBool("encrypt-workspace")
+	vfsSlowOp, _ := cmd.Flags().GetDuration("vfs-slow-op")
 	workdir, _ := cmd.Flags().GetString("workdir")
+	mkdirWorkdir, _ := cmd.Flags().GetBool("mkdir-workdir")
 
 	// Network & security
 	allowHosts, _ := cmd.Flags().GetStringSlice("allow-host")
+	hostPorts, _ := cmd.Flags().GetIntSlice("allow-host-port")
 	volumes, _ := cmd.Flags().GetStringSlice("volume")
-	secrets, _ := cmd.Flags().GetStringSlice("secret")
+	volumeBackend, _ := cmd.Flags().GetString("volume-backend")
+	overlays, _ := cmd.Flags().GetStringSlice("overlay")
+	s3Mounts, _ := cmd.Flags().GetStringSlice("s3")
+	gitMounts, _ := cmd.Flags().GetStringSlice("git")
+	memoryMounts, _ := cmd.Flags().GetStringSlice("memory-mount")
+	cacheMounts, _ := cmd.Flags().GetStringSlice("cache")
+	denyRead, _ := cmd.Flags().GetStringSlice("deny-read")
+	denyWrite, _ := cmd.Flags().GetStringSlice("deny-write")
+	exclude, _ := cmd.Flags().GetStringSlice("exclude")
+	mountCase, _ := cmd.Flags().GetString("mount-case")
+	mountIDMap, _ := cmd.Flags().GetString("mount-idmap")
+	mountUnconfined, _ := cmd.Flags().GetBool("mount-unconfined")
+	gitPushBranch, _ := cmd.Flags().GetString("git-push-branch")
+	secretSpecs, _ := cmd.Flags().GetStringSlice("secret")
+	oauth2Specs, _ := cmd.Flags().GetStringArray("oauth2-secret")
+	gcpSpecs, _ := cmd.Flags().GetStringArray("gcp-secret")
+	githubAppSpecs, _ := cmd.Flags().GetStringArray("github-app-secret")
+	secretFiles, _ := cmd.Flags().GetStringSlice("secret-file")
+	secretEnvPatterns, _ := cmd.Flags().GetStringSlice("secret-from-env")
+	secretProfiles, _ := cmd.Flags().GetStringSlice("secret-profile")
+	secretEnvHosts, _ := cmd.Flags().GetString("secret-env-hosts")
+	secretHeaders, _ := cmd.Flags().GetStringArray("secret-header")
+	secretTTLs, _ := cmd.Flags().GetStringArray("secret-ttl")
 	dnsServers, _ := cmd.Flags().GetStringSlice("dns-servers")
+	netShape, _ := cmd.Flags().GetString("net-shape")
+	certPins, _ := cmd.Flags().GetStringSlice("cert-pin")
+	upstreamTLS, _ := cmd.Flags().GetStringArray("upstream-tls")
+	signRequests, _ := cmd.Flags().GetStringArray("sign-request")
+	noInterceptHosts, _ := cmd.Flags().GetStringSlice("no-intercept-host")
+	upstreamProxy, _ := cmd.Flags().GetString("upstream-proxy")
+	proxyPAC, _ := cmd.Flags().GetString("proxy-pac")
+	maxConns, _ := cmd.Flags().GetInt("max-connections")
+	maxConnsPerMinute, _ := cmd.Flags().GetInt("max-connections-per-minute")
+	maxEgressBytes, _ := cmd.Flags().GetInt64("max-egress-bytes")
+	egressBudgetAction, _ := cmd.Flags().GetString("egress-budget-action")
+	secretLeakAction, _ := cmd.Flags().GetString("secret-leak-action")
 
 	// Shutdown
 	gracefulShutdown, _ := cmd.Flags().GetDuration("graceful-shutdown")
@@ -130,13 +539,22 @@ func runRun(cmd *cobra.Command, args []string) error {
 	user, _ := cmd.Flags().GetString("user")
 	entrypoint, _ := cmd.Flags().GetString("entrypoint")
 
-	command := api.ShellQuoteArgs(args)
+	envSpecs, _ := cmd.Flags().GetStringArray("env")
+	env, err := api.ParseKeyValues(envSpecs)
+	if err != nil {
+		return err
+	}
+	labelSpecs, _ := cmd.Flags().GetStringArray("label")
+	labels, err := api.ParseKeyValues(labelSpecs)
+	if err != nil {
+		return err
+	}
 
 	var ctx context.Context
 	var cancel context.CancelFunc
 
-	if cmd.Flags().Changed("timeout") {
-		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	if cmd.Flags().Changed("timeout") || resources.Size != "" {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(resources.TimeoutSeconds)*time.Second)
 	} else {
 		ctx, cancel = context.WithCancel(context.Background())
 	}
@@ -144,9 +562,53 @@ func runRun(cmd *cobra.Command, args []string) error {
 	ctx, cancel = contextWithSignal(ctx)
 	defer cancel()
 
-	builder := image.NewBuilder(&image.BuildOptions{
-		ForcePull: pull,
+	var base *api.Config
+	if from != "" {
+		base = &api.Config{}
+		if err := state.NewManager().LoadConfig(from, base); err != nil {
+			return err
+		}
+		if imageName == "" {
+			imageName = base.Image
+		}
+		// Volume guest paths and the default workdir follow the clone's workspace.
+		if !cmd.Flags().Changed("workspace") && base.VFS != nil && base.VFS.Workspace != "" {
+			workspace = base.VFS.Workspace
+		}
+	}
+	if imageName == "" {
+		return ErrImageRequired
+	}
+
+	platform, err := image.ParsePlatform(platformFlag)
+	if err != nil {
+		return err
+	}
+	if platform.Architecture != runtime.GOARCH {
+		return errx.With(image.ErrInvalidPlatform, ": %s images cannot boot on a %s host", platform.String(), runtime.GOARCH)
+	}
+	rootfsFormat, err := image.ParseRootfsFormat(rootfsFormatFlag)
+	if err != nil {
+		return err
+	}
+	signatures, err := imageSignaturePolicy(verifySignature)
+	if err != nil {
+		return err
+	}
+	keychain, err := imageKeychain(cmd, imageName)
+	if err != nil {
+		return err
+	}
+	builder, err := newImageBuilder(&image.BuildOptions{
+		Keychain:        keychain,
+		ForcePull:       pull,
+		Platform:        platform,
+		RootfsFormat:    rootfsFormat,
+		SignaturePolicy: signatures,
 	})
+	if err != nil {
+		return err
+	}
 
 	buildResult, err := builder.Build(ctx, imageName)
 	if err != nil {
@@ -154,6 +616,7 @@ func runRun(cmd *cobra.Command, args []string) error {
 	}
 	if !buildResult.Cached {
 		fmt.Fprintf(os.Stderr, "Built rootfs from %s (%.1f MB)\n", imageName, float64(buildResult.Size)/(1024*1024))
+		collectImageGarbage(imageName)
 	}
 
 	var imageCfg *api.ImageConfig
@@ -167,6 +630,11 @@ func runRun(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	// A clone keeps the image config it ran with unless the image changes.
+	if base != nil && base.ImageCfg != nil && !cmd.Flags().Changed("image") {
+		imageCfg = base.ImageCfg
+	}
+
 	// CLI --user overrides image USER
 	if user != "" {
 		if imageCfg == nil {
@@ -190,20 +658,24 @@ func runRun(cmd *cobra.Command, args []string) error {
 	// Compose command from image ENTRYPOINT/CMD and user args.
 	// Always route through ComposeCommand so --entrypoint is applied even when
 	// user provides args (args replace CMD but ENTRYPOINT is always prepended).
+	argv := args
 	if imageCfg != nil {
 		composed := imageCfg.ComposeCommand(args)
 		if len(composed) > 0 {
-			command = api.ShellQuoteArgs(composed)
+			argv = composed
 		}
 	}
 
-	if rm && command == "" && !interactiveMode {
+	if rm && len(argv) == 0 && !interactiveMode {
 		return fmt.Errorf("command required (or use --rm=false to start without a command)")
 	}
 
 	sandboxOpts := &sandbox.Options{RootfsPath: buildResult.RootfsPath}
 
-	vfsConfig := &api.VFSConfig{Workspace: workspace}
+	vfsConfig := &api.VFSConfig{Workspace: workspace, WorkspaceFrom: workspaceFrom}
+	if vfsSlowOp > 0 {
+		vfsConfig.SlowOpMS = int(max(vfsSlowOp.Milliseconds(), 1))
+	}
 	if len(volumes) > 0 {
 		mounts := make(map[string]api.MountConfig)
 		for _, vol := range volumes {
@@ -215,40 +687,372 @@ func runRun(cmd *cobra.Command, args []string) error {
 				Type:     "real_fs",
 				HostPath: hostPath,
 				Readonly: readonly,
+				Backend:  volumeBackend,
 			}
 		}
+		if err := api.ValidateMountBackends(mounts); err != nil {
+			return errx.With(ErrInvalidVolume, ": %w", err)
+		}
 		vfsConfig.Mounts = mounts
 	}
+	for _, ov := range overlays {
+		hostPath, guestPath, readonly, err := api.ParseVolumeMount(ov, workspace)
+		if err != nil {
+			return errx.With(ErrInvalidVolume, " %q: %w", ov, err)
+		}
+		if readonly {
+			return errx.With(ErrInvalidVolume, " %q: overlay mounts are always writable", ov)
+		}
+		if vfsConfig.Mounts == nil {
+			vfsConfig.Mounts = make(map[string]api.MountConfig)
+		}
+		vfsConfig.Mounts[guestPath] = api.MountConfig{Type: "overlay", HostPath: hostPath}
+	}
+	for _, spec := range s3Mounts {
+		guestPath, mount, err := api.ParseS3Mount(spec, workspace)
+		if err != nil {
+			return errx.With(ErrInvalidVolume, " %q: %w", spec, err)
+		}
+		if vfsConfig.Mounts == nil {
+			vfsConfig.Mounts = make(map[string]api.MountConfig)
+		}
+		vfsConfig.Mounts[guestPath] = mount
+	}
+	for _, spec := range gitMounts {
+		guestPath, mount, err := api.ParseGitMount(spec, workspace)
+		if err != nil {
+			return errx.With(ErrInvalidVolume, " %q: %w", spec, err)
+		}
+		mount.Git.PushBranch = gitPushBranch
+		if vfsConfig.Mounts == nil {
+			vfsConfig.Mounts = make(map[string]api.MountConfig)
+		}
+		vfsConfig.Mounts[guestPath] = mount
+	}
+	if err := api.ValidateGitMounts(vfsConfig.Mounts); err != nil {
+		return errx.With(ErrInvalidVolume, ": %w", err)
+	}
+	if len(denyRead) > 0 || len(denyWrite) > 0 {
+		for guestPath, mount := range vfsConfig.Mounts {
+			switch mount.Type {
+			case "real_fs", "overlay", "git":
+				mount.Access = &api.MountAccess{DenyRead: denyRead, DenyWrite: denyWrite}
+				vfsConfig.Mounts[guestPath] = mount
+			}
+		}
+		if err := api.ValidateMountAccess(vfsConfig.Mounts); err != nil {
+			return errx.With(ErrInvalidVolume, ": %w", err)
+		}
+	}
+	if len(exclude) > 0 {
+		for guestPath, mount := range vfsConfig.Mounts {
+			switch mount.Type {
+			case "real_fs", "overlay":
+				mount.Exclude = exclude
+				vfsConfig.Mounts[guestPath] = mount
+			}
+		}
+		if err := api.ValidateMountExclude(vfsConfig.Mounts); err != nil {
+			return errx.With(ErrInvalidVolume, ": %w", err)
+		}
+	}
+	if mountCase != "" {
+		for guestPath, mount := range vfsConfig.Mounts {
+			switch mount.Type {
+			case "real_fs", "overlay":
+				mount.Case = mountCase
+				vfsConfig.Mounts[guestPath] = mount
+			}
+		}
+		if err := api.ValidateMountCase(vfsConfig.Mounts); err != nil {
+			return errx.With(ErrInvalidVolume, ": %w", err)
+		}
+	}
+	if mountIDMap != "" {
+		idmap, err := api.ParseMountIDMap(mountIDMap)
+		if err != nil {
+			return errx.With(ErrInvalidVolume, ": %w", err)
+		}
+		for guestPath, mount := range vfsConfig.Mounts {
+			switch mount.Type {
+			case "real_fs", "overlay":
+				mount.IDMap = idmap
+				vfsConfig.Mounts[guestPath] = mount
+			}
+		}
+		if err := api.ValidateMountIDMap(vfsConfig.Mounts); err != nil {
+			return errx.With(ErrInvalidVolume, ": %w", err)
+		}
+	}
+	if mountUnconfined {
+		for guestPath, mount := range vfsConfig.Mounts {
+			switch mount.Type {
+			case "real_fs", "overlay":
+				if mount.Backend != api.MountBackendVirtioFS {
+					mount.Unconfined = true
+					vfsConfig.Mounts[guestPath] = mount
+				}
+			}
+		}
+	}
+	for _, spec := range memoryMounts {
+		guestPath, mount, err := api.ParseMemoryMount(spec, workspace)
+		if err != nil {
+			return errx.With(ErrInvalidVolume, " %q: %w", spec, err)
+		}
+		if vfsConfig.Mounts == nil {
+			vfsConfig.Mounts = make(map[string]api.MountConfig)
+		}
+		vfsConfig.Mounts[guestPath] = mount
+	}
+	for _, spec := range cacheMounts {
+		guestPath, mount, err := api.ParseCacheMount(spec, workspace)
+		if err != nil {
+			return errx.With(ErrInvalidVolume, " %q: %w", spec, err)
+		}
+		if err := caches.ValidateName(mount.Cache.Name); err != nil {
+			return errx.With(ErrInvalidVolume, " %q: %w", spec, err)
+		}
+		if vfsConfig.Mounts == nil {
+			vfsConfig.Mounts = make(map[string]api.MountConfig)
+		}
+		vfsConfig.Mounts[guestPath] = mount
+	}
+	if encryptWorkspace {
+		cleanWorkspace := filepath.Clean(workspace)
+		if m, ok := vfsConfig.Mounts[cleanWorkspace]; ok {
+			return errx.With(ErrInvalidVolume, ": --encrypt-workspace: workspace %s already has a %s mount", cleanWorkspace, m.Type)
+		}
+		if workspaceFrom != "" {
+			return errx.With(ErrInvalidVolume, ": --encrypt-workspace cannot be combined with --workspace-from")
+		}
+		if vfsConfig.Mounts == nil {
+			vfsConfig.Mounts = make(map[string]api.MountConfig)
+		}
+		vfsConfig.Mounts[cleanWorkspace] = api.MountConfig{Type: "encrypted"}
+	}
+
+	for _, p := range hostPorts {
+		if p < 1 || p > 65535 {
+			return errx.With(ErrInvalidHostPort, " %d", p)
+		}
+	}
+
+	if maxConns < 0 {
+		return errx.With(ErrInvalidConnLimit, " --max-connections %d", maxConns)
+	}
+	if maxConnsPerMinute < 0 {
+		return errx.With(ErrInvalidConnLimit, " --max-connections-per-minute %d", maxConnsPerMinute)
+	}
+	egressBudget := &api.NetworkConfig{MaxEgressBytes: maxEgressBytes, EgressBudgetAction: egressBudgetAction}
+	if err := egressBudget.ValidateEgressBudget(); err != nil {
+		return err
+	}
+
+	var parsedPins map[string][]string
+	for _, spec := range certPins {
+		host, pin, err := api.ParseCertPin(spec)
+		if err != nil {
+			return err
+		}
+		if parsedPins == nil {
+			parsedPins = make(map[string][]string)
+		}
+		parsedPins[host] = append(parsedPins[host], pin)
+	}
+
+	var parsedUpstreamTLS map[string]api.UpstreamTLS
+	for _, spec := range upstreamTLS {
+		host, opts, err := api.ParseUpstreamTLS(spec)
+		if err != nil {
+			return err
+		}
+		if parsedUpstreamTLS == nil {
+			parsedUpstreamTLS = make(map[string]api.UpstreamTLS)
+		}
+		parsedUpstreamTLS[host] = opts
+	}
+
+	var parsedSigning map[string]api.RequestSigning
+	for _, spec := range signRequests {
+		host, rs, err := api.ParseRequestSigning(spec)
+		if err != nil {
+			return err
+		}
+		if parsedSigning == nil {
+			parsedSigning = make(map[string]api.RequestSigning)
+		}
+		parsedSigning[host] = rs
+	}
+
+	if err := api.ValidateUpstreamProxy(upstreamProxy); err != nil {
+		return err
+	}
+	if err := api.ValidateProxyAutoConfigURL(proxyPAC); err != nil {
+		return err
+	}
+
+	var shape *api.NetworkShape
+	if netShape != "" {
+		shape, err = api.ParseNetworkShape(netShape)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := resources.ValidateSwap(); err != nil {
+		return err
+	}
+
+	var dataDisks []api.DataDisk
+	for _, spec := range diskSpecs {
+		d, err := disks.ParseSpec(spec)
+		if err != nil {
+			return err
+		}
+		dataDisks = append(dataDisks, d)
+	}
 
 	var parsedSecrets map[string]api.Secret
-	if len(secrets) > 0 {
+	if len(secretEnvPatterns) > 0 || len(secretProfiles) > 0 || len(secretFiles) > 0 || len(secretSpecs) > 0 || len(oauth2Specs) > 0 || len(gcpSpecs) > 0 || len(githubAppSpecs) > 0 || len(secretHeaders) > 0 || len(secretTTLs) > 0 {
 		parsedSecrets = make(map[string]api.Secret)
-		for _, s := range secrets {
+		if len(secretEnvPatterns) > 0 {
+			hostMapPath := secretEnvHosts
+			if hostMapPath == "" {
+				hostMapPath = api.DefaultSecretHostMapPath()
+			} else if _, err := os.Stat(hostMapPath); err != nil {
+				return errx.Wrap(ErrInvalidSecret, err)
+			}
+			hostMap, err := api.LoadSecretHostMap(hostMapPath)
+			if err != nil {
+				return errx.Wrap(ErrInvalidSecret, err)
+			}
+			discovered, err := api.DiscoverEnvSecrets(secretEnvPatterns, hostMap, os.Environ())
+			if err != nil {
+				return errx.Wrap(ErrInvalidSecret, err)
+			}
+			for name, secret := range discovered {
+				parsedSecrets[name] = secret
+			}
+		}
+		if len(secretProfiles) > 0 {
+			profileSecrets, err := api.LoadSecretProfiles(api.DefaultSecretProfilesPath(), secretProfiles)
+			if err != nil {
+				return errx.Wrap(ErrInvalidSecret, err)
+			}
+			for name, secret := range profileSecrets {
+				parsedSecrets[name] = secret
+			}
+		}
+		for _, f := range secretFiles {
+			fileSecrets, err := api.LoadSecretFile(f)
+			if err != nil {
+				return errx.With(ErrInvalidSecret, " file %s: %w", f, err)
+			}
+			for name, secret := range fileSecrets {
+				parsedSecrets[name] = secret
+			}
+		}
+		for _, s := range secretSpecs {
 			name, secret, err := api.ParseSecret(s)
 			if err != nil {
 				return errx.With(ErrInvalidSecret, " %q: %w", s, err)
 			}
 			parsedSecrets[name] = secret
 		}
+		for _, s := range oauth2Specs {
+			name, secret, err := api.ParseOAuth2Secret(s)
+			if err != nil {
+				return errx.With(ErrInvalidSecret, " %q: %w", s, err)
+			}
+			parsedSecrets[name] = secret
+		}
+		for _, s := range gcpSpecs {
+			name, secret, err := api.ParseGCPSecret(s)
+			if err != nil {
+				return errx.With(ErrInvalidSecret, " %q: %w", s, err)
+			}
+			parsedSecrets[name] = secret
+		}
+		for _, s := range githubAppSpecs {
+			name, secret, err := api.ParseGitHubAppSecret(s)
+			if err != nil {
+				return errx.With(ErrInvalidSecret, " %q: %w", s, err)
+			}
+			parsedSecrets[name] = secret
+		}
+		for _, s := range secretHeaders {
+			name, header, err := api.ParseSecretHeader(s)
+			if err != nil {
+				return errx.Wrap(ErrInvalidSecret, err)
+			}
+			secret, ok := parsedSecrets[name]
+			if !ok {
+				return errx.With(ErrInvalidSecret, ": --secret-header for undefined secret %s", name)
+			}
+			if secret.MintsTokens() {
+				return errx.With(ErrInvalidSecret, ": %s mints its own tokens; they are always sent as Authorization: Bearer", name)
+			}
+			secret.Header = header
+			parsedSecrets[name] = secret
+		}
+		for _, s := range secretTTLs {
+			name, ttl, err := api.ParseSecretTTL(s)
+			if err != nil {
+				return errx.Wrap(ErrInvalidSecret, err)
+			}
+			secret, ok := parsedSecrets[name]
+			if !ok {
+				return errx.With(ErrInvalidSecret, ": --secret-ttl for undefined secret %s", name)
+			}
+			expiresAt := time.Now().Add(ttl)
+			secret.ExpiresAt = &expiresAt
+			parsedSecrets[name] = secret
+		}
+		if err := secrets.NewResolver().ResolveAll(ctx, parsedSecrets); err != nil {
+			return errx.Wrap(ErrInvalidSecret, err)
+		}
 	}
 
 	config := &api.Config{
-		Image:      imageName,
-		Privileged: privileged,
-		Resources: &api.Resources{
-			CPUs:           cpus,
-			MemoryMB:       memory,
-			DiskSizeMB:     diskSize,
-			TimeoutSeconds: timeout,
-		},
+		Image:       imageName,
+		ImageDigest: buildResult.Digest,
+		Privileged:  privileged,
+		Redact:      redactOutput,
+		Resources:   resources,
 		Network: &api.NetworkConfig{
-			AllowedHosts:    allowHosts,
-			BlockPrivateIPs: true,
-			Secrets:         parsedSecrets,
-			DNSServers:      dnsServers,
+			AllowedHosts:            allowHosts,
+			BlockPrivateIPs:         true,
+			Secrets:                 parsedSecrets,
+			DNSServers:              dnsServers,
+			HostPorts:               hostPorts,
+			Shape:                   shape,
+			MaxConnections:          maxConns,
+			MaxConnectionsPerMinute: maxConnsPerMinute,
+			MaxEgressBytes:          maxEgressBytes,
+			EgressBudgetAction:      egressBudgetAction,
+			SecretLeakAction:        secretLeakAction,
+			CertPins:                parsedPins,
+			UpstreamTLS:             parsedUpstreamTLS,
+			NoInterceptHosts:        noInterceptHosts,
+			UpstreamProxy:           upstreamProxy,
+			ProxyAutoConfigURL:      proxyPAC,
+			RequestSigning:          parsedSigning,
 		},
-		VFS:      vfsConfig,
-		ImageCfg: imageCfg,
+		VFS:       vfsConfig,
+		DataDisks: dataDisks,
+		Env:       env,
+		Labels:    labels,
+		ImageCfg:  imageCfg,
+	}
+	if base != nil {
+		config = overrideConfig(cmd.Flags().Changed, base, config)
+	}
+	if err := config.ValidateDataDisks(); err != nil {
+		return err
+	}
+	if err := config.Network.ValidateSecrets(); err != nil {
+		return errx.Wrap(ErrInvalidSecret, err)
 	}
 
 	sb, err := sandbox.New(ctx, config, sandboxOpts)
@@ -256,6 +1060,14 @@ func runRun(cmd *cobra.Command, args []string) error {
 		return errx.Wrap(ErrCreateSandbox, err)
 	}
 
+	// Templates such as {{.SandboxID}} can only be rendered once the sandbox exists.
+	argv, err = api.ExpandTemplates(argv, sb.TemplateData())
+	if err != nil {
+		sb.Close(ctx)
+		return err
+	}
+	command := api.ShellQuoteArgs(argv)
+
 	if err := sb.Start(ctx); err != nil {
 		sb.Close(ctx)
 		return errx.Wrap(ErrStartSandbox, err)
@@ -270,6 +1082,13 @@ func runRun(cmd *cobra.Command, args []string) error {
 	}
 	defer execRelay.Stop()
 
+	// Serve bulk file transfers so `matchlock cp` moves large trees fast.
+	transferServer := transfer.NewServer(sb)
+	if err := transferServer.Start(stateMgr.TransferSocketPath(sb.ID())); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to start transfer server: %v\n", err)
+	}
+	defer transferServer.Stop()
+
 	if !rm {
 		fmt.Fprintf(os.Stderr, "Sandbox %s is running\n", sb.ID())
 		fmt.Fprintf(os.Stderr, "  Connect: matchlock exec %s -it bash\n", sb.ID())
@@ -281,7 +1100,8 @@ func runRun(cmd *cobra.Command, args []string) error {
 	}
 
 	if interactiveMode {
-		exitCode := runInteractive(ctx, sb, command, workdir)
+		exitCode := runInteractive(ctx, sb, command, workdir, mkdirWorkdir)
+		sb.RecordExit(ctx, exitCode)
 		if rm {
 			c, cancel := closeCtx()
 			sb.Close(c)
@@ -293,8 +1113,9 @@ func runRun(cmd *cobra.Command, args []string) error {
 
 	if command != "" {
 		opts := &api.ExecOptions{
-			Stdout: os.Stdout,
-			Stderr: os.Stderr,
+			Stdout:           os.Stdout,
+			Stderr:           os.Stderr,
+			CreateWorkingDir: mkdirWorkdir,
 		}
 		if interactive {
 			opts.Stdin = os.Stdin
@@ -312,6 +1133,7 @@ func runRun(cmd *cobra.Command, args []string) error {
 			}
 			return errx.Wrap(ErrExecCommand, err)
 		}
+		sb.RecordExit(ctx, result.ExitCode)
 
 		if rm {
 			c, cancel := closeCtx()
@@ -333,7 +1155,7 @@ func runRun(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func runInteractive(ctx context.Context, sb *sandbox.Sandbox, command, workdir string) int {
+func runInteractive(ctx context.Context, sb *sandbox.Sandbox, command, workdir string, mkdirWorkdir bool) int {
 	if !term.IsTerminal(int(os.Stdin.Fd())) {
 		fmt.Fprintln(os.Stderr, "Error: -it requires a TTY")
 		return 1
@@ -377,8 +1199,9 @@ func runInteractive(ctx context.Context, sb *sandbox.Sandbox, command, workdir s
 	if workdir != "" {
 		opts.WorkingDir = workdir
 	}
+	opts.CreateWorkingDir = mkdirWorkdir
 
-	exitCode, err := interactiveMachine.ExecInteractive(ctx, command, opts, uint16(rows), uint16(cols), os.Stdin, os.Stdout, resizeCh)
+	exitCode, err := interactiveMachine.ExecInteractive(ctx, command, opts, uint16(rows), uint16(cols), os.Stdin, sb.Mirror().Tee(os.Stdout, sandbox.StreamStdout), resizeCh)
 	if err != nil {
 		term.Restore(int(os.Stdin.Fd()), oldState)
 		fmt.Fprintf(os.Stderr, "\nError: %v\n", err)
@@ -387,3 +1210,145 @@ func runInteractive(ctx context.Context, sb *sandbox.Sandbox, command, workdir s
 
 	return exitCode
 }
+
+// overrideConfig returns base, the stored config of the sandbox named by
+// --from, with the values of the flags set on the command line taken from
+// config. Secrets, volumes, env and labels are merged by name, guest path
+// and key; the image config and workspace have already been resolved
+// against base.
+func overrideConfig(changed func(name string) bool, base, config *api.Config) *api.Config {
+	if base.Resources == nil {
+		base.Resources = &api.Resources{}
+	}
+	if base.Network == nil {
+		base.Network = &api.NetworkConfig{BlockPrivateIPs: true}
+	}
+	if base.VFS == nil {
+		base.VFS = &api.VFSConfig{}
+	}
+	res, network, vfs := base.Resources, base.Network, base.VFS
+
+	base.Image = config.Image
+	base.ImageDigest = config.ImageDigest
+	base.ImageCfg = config.ImageCfg
+	if changed("privileged") {
+		base.Privileged = config.Privileged
+	}
+	if changed("redact") {
+		base.Redact = config.Redact
+	}
+
+	if changed("size") {
+		*res = *config.Resources
+	}
+	if changed("cpus") {
+		res.CPUs = config.Resources.CPUs
+	}
+	if changed("memory") {
+		res.MemoryMB = config.Resources.MemoryMB
+	}
+	if changed("disk-size") {
+		res.DiskSizeMB = config.Resources.DiskSizeMB
+	}
+	if changed("rootfs-free-space") {
+		res.RootfsFreeSpaceMB = config.Resources.RootfsFreeSpaceMB
+	}
+	if changed("swap") {
+		res.SwapMB = config.Resources.SwapMB
+	}
+	if changed("swap-type") {
+		res.SwapType = config.Resources.SwapType
+	}
+	if changed("timeout") {
+		res.TimeoutSeconds = config.Resources.TimeoutSeconds
+	}
+
+	if changed("allow-host") {
+		network.AllowedHosts = config.Network.AllowedHosts
+	}
+	if changed("allow-host-port") {
+		network.HostPorts = config.Network.HostPorts
+	}
+	if changed("dns-servers") {
+		network.DNSServers = config.Network.DNSServers
+	}
+	if changed("net-shape") {
+		network.Shape = config.Network.Shape
+	}
+	if changed("max-connections") {
+		network.MaxConnections = config.Network.MaxConnections
+	}
+	if changed("max-connections-per-minute") {
+		network.MaxConnectionsPerMinute = config.Network.MaxConnectionsPerMinute
+	}
+	if changed("max-egress-bytes") {
+		network.MaxEgressBytes = config.Network.MaxEgressBytes
+	}
+	if changed("egress-budget-action") {
+		network.EgressBudgetAction = config.Network.EgressBudgetAction
+	}
+	if changed("secret-leak-action") {
+		network.SecretLeakAction = config.Network.SecretLeakAction
+	}
+	if changed("cert-pin") {
+		network.CertPins = config.Network.CertPins
+	}
+	if changed("upstream-tls") {
+		network.UpstreamTLS = config.Network.UpstreamTLS
+	}
+	if changed("sign-request") {
+		network.RequestSigning = config.Network.RequestSigning
+	}
+	if changed("no-intercept-host") {
+		network.NoInterceptHosts = config.Network.NoInterceptHosts
+	}
+	if changed("upstream-proxy") {
+		network.UpstreamProxy = config.Network.UpstreamProxy
+	}
+	if changed("proxy-pac") {
+		network.ProxyAutoConfigURL = config.Network.ProxyAutoConfigURL
+	}
+	for name, secret := range config.Network.Secrets {
+		if network.Secrets == nil {
+			network.Secrets = make(map[string]api.Secret)
+		}
+		network.Secrets[name] = secret
+	}
+
+	for k, v := range config.Env {
+		if base.Env == nil {
+			base.Env = make(map[string]string)
+		}
+		base.Env[k] = v
+	}
+	for k, v := range config.Labels {
+		if base.Labels == nil {
+			base.Labels = make(map[string]string)
+		}
+		base.Labels[k] = v
+	}
+
+	for _, d := range config.DataDisks {
+		i := slices.IndexFunc(base.DataDisks, func(b api.DataDisk) bool { return b.Name == d.Name })
+		if i < 0 {
+			base.DataDisks = append(base.DataDisks, d)
+		} else {
+			base.DataDisks[i] = d
+		}
+	}
+
+	vfs.Workspace = config.VFS.Workspace
+	if changed("workspace-from") {
+		vfs.WorkspaceFrom = config.VFS.WorkspaceFrom
+	}
+	if changed("vfs-slow-op") {
+		vfs.SlowOpMS = config.VFS.SlowOpMS
+	}
+	for guestPath, mount := range config.VFS.Mounts {
+		if vfs.Mounts == nil {
+			vfs.Mounts = make(map[string]api.MountConfig)
+		}
+		vfs.Mounts[guestPath] = mount
+	}
+	return base
+}
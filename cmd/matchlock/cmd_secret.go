@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/secrets"
+	"github.com/jingkaihe/matchlock/pkg/state"
+)
+
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Manage the secrets of running sandboxes",
+}
+
+var secretUpdateCmd = &cobra.Command{
+	Use:   "update <id> NAME[=VALUE]...",
+	Short: "Rotate secret values without restarting a sandbox",
+	Long: `Replace the real value behind one or more secrets of a running sandbox.
+The guest keeps the same placeholder, so long-lived agent sessions keep
+working across key rotations; requests made from now on carry the new value.
+
+NAME alone reads the value from $NAME. A value may also reference a secret
+store (aws-sm:, aws-ssm:, op://, keychain:), which is resolved on the host.
+Passing literal values on the command line exposes them in the process list
+and shell history; prefer the other forms.
+
+Only secrets the sandbox was started with can be updated, and OAuth2 and
+GitHub App secrets cannot be rotated this way. The sandbox must have been started with
+--rm=false to remain running.`,
+	Example: `  API_KEY=sk-new matchlock secret update vm-abc123 API_KEY
+  matchlock secret update vm-abc123 OPENAI_API_KEY=aws-sm:prod/keys#openai`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: runSecretUpdate,
+}
+
+func init() {
+	secretCmd.AddCommand(secretUpdateCmd)
+	rootCmd.AddCommand(secretCmd)
+}
+
+func runSecretUpdate(cmd *cobra.Command, args []string) error {
+	vmID := args[0]
+
+	mgr := state.NewManager()
+	vmState, err := mgr.Get(vmID)
+	if err != nil {
+		return errx.With(ErrVMNotFound, " %s: %w", vmID, err)
+	}
+	if vmState.Status != "running" {
+		return fmt.Errorf("VM %s is not running (status: %s)", vmID, vmState.Status)
+	}
+
+	execSocketPath := mgr.ExecSocketPath(vmID)
+	if _, err := os.Stat(execSocketPath); err != nil {
+		return fmt.Errorf("exec socket not found for %s (was it started with --rm=false?)", vmID)
+	}
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	// Resolve every value before touching the sandbox, so a bad argument
+	// does not leave it half rotated.
+	resolver := secrets.NewResolver()
+	type update struct{ name, value string }
+	var updates []update
+	for _, arg := range args[1:] {
+		name, value, inline := strings.Cut(arg, "=")
+		if name == "" {
+			return errx.With(ErrInvalidSecret, ": secret name cannot be empty in %q", arg)
+		}
+		if !inline {
+			value = os.Getenv(name)
+			if value == "" {
+				return errx.With(ErrInvalidSecret, ": environment variable $%s is not set (or pass %s=VALUE)", name, name)
+			}
+		}
+		resolved, err := resolver.Resolve(ctx, value)
+		if err != nil {
+			return errx.With(ErrInvalidSecret, " %s: %w", name, err)
+		}
+		updates = append(updates, update{name, resolved})
+	}
+
+	for _, u := range updates {
+		if err := sandbox.UpdateSecretViaRelay(ctx, execSocketPath, u.name, u.value); err != nil {
+			return errx.Wrap(ErrUpdateSecretFailed, err)
+		}
+		fmt.Printf("Updated %s on %s\n", u.name, vmID)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/state"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch <id>",
+	Short: "Follow a sandbox's output read-only",
+	Long: `Attach a read-only mirror of a running sandbox's command output and
+interactive sessions, so a human can supervise an agent live.
+
+The watcher sends no input and cannot signal, resize or slow the commands it
+watches; a watcher that falls behind misses output instead. Output starts
+from the moment of attaching and is shown as the sandbox's own client sees
+it, redacted when the sandbox was started with --redact. Press Ctrl-C to
+detach. The sandbox must have been started with --rm=false or still be
+running its command.`,
+	Example: `  matchlock watch vm-abc123`,
+	Args:    cobra.ExactArgs(1),
+	RunE:    runWatch,
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+}
+
+func runWatch(cmd *cobra.Command, args []string) error {
+	vmID := args[0]
+
+	mgr := state.NewManager()
+	vmState, err := mgr.Get(vmID)
+	if err != nil {
+		return errx.With(ErrVMNotFound, " %s: %w", vmID, err)
+	}
+	if vmState.Status != "running" {
+		return fmt.Errorf("VM %s is not running (status: %s)", vmID, vmState.Status)
+	}
+
+	execSocketPath := mgr.ExecSocketPath(vmID)
+	if _, err := os.Stat(execSocketPath); err != nil {
+		return fmt.Errorf("exec socket not found for %s", vmID)
+	}
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	if err := sandbox.WatchViaRelay(ctx, execSocketPath, os.Stdout, os.Stderr); err != nil {
+		return errx.Wrap(ErrWatchFailed, err)
+	}
+	return nil
+}
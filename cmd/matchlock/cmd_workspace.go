@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/state"
+	"github.com/jingkaihe/matchlock/pkg/workspaces"
+)
+
+var workspaceCmd = &cobra.Command{
+	Use:   "workspace",
+	Short: "Save and manage workspace snapshots",
+	Long: `Workspace snapshots save the files in a sandbox's workspace, and nothing
+else, under a name on the host. Start a new sandbox from one with
+'matchlock run --workspace-from NAME' to resume where an agent left off
+without checkpointing the VM.
+
+Snapshots are kept in ~/.matchlock/workspaces.`,
+}
+
+var workspaceSnapshotCmd = &cobra.Command{
+	Use:   "snapshot <id> <name>",
+	Short: "Save the workspace of a running sandbox as a named snapshot",
+	Long: `Save the files in the workspace of a running sandbox, including mounts
+nested in it, as a named snapshot. Names use letters, digits, '.', '_' and
+'-'; an existing snapshot is never overwritten.
+
+The sandbox must have been started with --rm=false to remain running.`,
+	Example: `  matchlock workspace snapshot vm-abc12345 agent-run-1
+  matchlock run --image alpine:latest --workspace-from agent-run-1 cat /workspace/notes.md`,
+	Args: cobra.ExactArgs(2),
+	RunE: runWorkspaceSnapshot,
+}
+
+var workspaceListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List workspace snapshots",
+	Args:    cobra.NoArgs,
+	RunE:    runWorkspaceList,
+}
+
+var workspaceRemoveCmd = &cobra.Command{
+	Use:     "rm <name>...",
+	Aliases: []string{"remove"},
+	Short:   "Remove workspace snapshots",
+	Long: `Remove workspace snapshots. Sandboxes started from a snapshot read its
+files as the lower layer of their workspace, so stop them first.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runWorkspaceRemove,
+}
+
+func init() {
+	workspaceCmd.AddCommand(workspaceSnapshotCmd)
+	workspaceCmd.AddCommand(workspaceListCmd)
+	workspaceCmd.AddCommand(workspaceRemoveCmd)
+	rootCmd.AddCommand(workspaceCmd)
+}
+
+func runWorkspaceSnapshot(cmd *cobra.Command, args []string) error {
+	vmID, name := args[0], args[1]
+	if err := workspaces.ValidateName(name); err != nil {
+		return err
+	}
+
+	mgr := state.NewManager()
+	vmState, err := mgr.Get(vmID)
+	if err != nil {
+		return errx.With(ErrVMNotFound, " %s: %w", vmID, err)
+	}
+	if vmState.Status != "running" {
+		return fmt.Errorf("VM %s is not running (status: %s)", vmID, vmState.Status)
+	}
+	execSocketPath := mgr.ExecSocketPath(vmID)
+	if _, err := os.Stat(execSocketPath); err != nil {
+		return fmt.Errorf("exec socket not found for %s (was it started with --rm=false?)", vmID)
+	}
+	var config api.Config
+	if err := mgr.LoadConfig(vmID, &config); err != nil {
+		return err
+	}
+	workspace := config.GetWorkspace()
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(sandbox.CopyOutViaRelay(ctx, execSocketPath, workspace, w))
+	}()
+	snap, err := workspaces.NewStore("").Save(name, workspaces.Snapshot{SandboxID: vmID, Workspace: workspace}, r)
+	r.Close()
+	if err != nil {
+		return errx.Wrap(ErrWorkspaceSnapshot, err)
+	}
+
+	fmt.Printf("Saved workspace %s of %s as %s\n", workspace, vmID, snap.Name)
+	return nil
+}
+
+func runWorkspaceList(cmd *cobra.Command, args []string) error {
+	snaps, err := workspaces.NewStore("").List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSANDBOX\tWORKSPACE\tCREATED")
+	for _, s := range snaps {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.SandboxID, s.Workspace, s.CreatedAt.Local().Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
+
+func runWorkspaceRemove(cmd *cobra.Command, args []string) error {
+	store := workspaces.NewStore("")
+	for _, name := range args {
+		if err := store.Remove(name); err != nil {
+			return err
+		}
+		fmt.Println(name)
+	}
+	return nil
+}
@@ -25,6 +25,13 @@ var (
 	ErrBuildKitBuild       = errors.New("BuildKit build")
 	ErrOpenImageTarball    = errors.New("open built image tarball")
 	ErrImportImage         = errors.New("import built image")
+	ErrBuildArg            = errors.New("invalid build arg")
+	ErrBuildCacheSpec      = errors.New("invalid build cache spec")
+	ErrBuildProgress       = errors.New("invalid progress mode")
+	ErrBuildContext        = errors.New("build context")
+	ErrBuilder             = errors.New("invalid builder")
+	ErrLocalBuildKit       = errors.New("local BuildKit")
+	ErrPinDockerfile       = errors.New("pin Dockerfile base images")
 )
 
 // Exec errors
@@ -34,6 +41,17 @@ var (
 	ErrPipeExecFailed  = errors.New("pipe exec failed")
 	ErrSetRawMode      = errors.New("setting raw mode")
 	ErrInteractiveExec = errors.New("interactive exec failed")
+	ErrRestartFailed   = errors.New("restart failed")
+	ErrWatchFailed     = errors.New("watch failed")
+	ErrFreezeFailed    = errors.New("freeze network failed")
+	ErrCopyFailed      = errors.New("copy failed")
+	ErrCopyArgs        = errors.New("invalid copy arguments")
+
+	ErrWorkspaceSnapshot = errors.New("workspace snapshot failed")
+
+	ErrUpdateSecretFailed = errors.New("update secret failed")
+
+	ErrMountFailed = errors.New("mount failed")
 )
 
 // Pull errors
@@ -41,6 +59,37 @@ var (
 	ErrSaveTag = errors.New("saving tag")
 )
 
+// Image errors
+var (
+	ErrPrefetchFailed = errors.New("prefetch failed")
+	ErrImageServe     = errors.New("image conversion service")
+	ErrImageConvert   = errors.New("image conversion failed")
+	ErrImageFilter    = errors.New("invalid image filter")
+)
+
+// Pool errors
+var (
+	ErrPoolServe  = errors.New("sandbox pool")
+	ErrPoolAttach = errors.New("attach to sandbox pool")
+)
+
+// Context errors
+var (
+	ErrNoEndpoint   = errors.New("no image service endpoint")
+	ErrContextToken = errors.New("resolve token")
+)
+
+// Trust errors
+var (
+	ErrTrustKey    = errors.New("asset signing key")
+	ErrTrustVerify = errors.New("asset verification failed")
+)
+
+// Login errors
+var (
+	ErrRegistryLogin = errors.New("registry login")
+)
+
 // RPC errors
 var (
 	ErrBuildRootfs = errors.New("failed to build rootfs")
@@ -48,12 +97,21 @@ var (
 
 // Run errors
 var (
-	ErrBuildingRootfs = errors.New("building rootfs")
-	ErrInvalidVolume  = errors.New("invalid volume mount")
-	ErrInvalidSecret  = errors.New("invalid secret")
-	ErrCreateSandbox  = errors.New("creating sandbox")
-	ErrStartSandbox   = errors.New("starting sandbox")
-	ErrExecCommand    = errors.New("executing command")
+	ErrBuildingRootfs   = errors.New("building rootfs")
+	ErrImageRequired    = errors.New("--image is required unless --from is set")
+	ErrInvalidVolume    = errors.New("invalid volume mount")
+	ErrInvalidSecret    = errors.New("invalid secret")
+	ErrInvalidHostPort  = errors.New("invalid host port")
+	ErrInvalidConnLimit = errors.New("invalid connection limit")
+	ErrCreateSandbox    = errors.New("creating sandbox")
+	ErrStartSandbox     = errors.New("starting sandbox")
+	ErrExecCommand      = errors.New("executing command")
+)
+
+// Dev errors
+var (
+	ErrWatchDir = errors.New("watch directory")
+	ErrSyncFile = errors.New("sync file")
 )
 
 // Setup errors (Linux)
@@ -76,3 +134,10 @@ var (
 	ErrSysctlMemsize = errors.New("sysctl hw.memsize")
 	ErrSysinfo       = errors.New("sysinfo")
 )
+
+// Diff export errors
+var (
+	ErrDiffExport     = errors.New("export changes")
+	ErrNoOverlays     = errors.New("sandbox has no overlay mounts")
+	ErrSandboxRunning = errors.New("sandbox is still running")
+)
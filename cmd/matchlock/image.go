@@ -2,19 +2,31 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 
+	"github.com/jingkaihe/matchlock/internal/errx"
 	"github.com/jingkaihe/matchlock/pkg/image"
+	"github.com/jingkaihe/matchlock/pkg/secrets"
+	"github.com/jingkaihe/matchlock/pkg/state"
+	"github.com/jingkaihe/matchlock/pkg/trust"
 )
 
 var imageCmd = &cobra.Command{
-	Use:   "image",
-	Short: "Manage images",
+	Use:     "image",
+	Aliases: []string{"images"},
+	Short:   "Manage images",
 }
 
 var imageLsCmd = &cobra.Command{
@@ -32,6 +44,19 @@ var imageRmCmd = &cobra.Command{
 	RunE:    runImageRm,
 }
 
+var imageInspectCmd = &cobra.Command{
+	Use:   "inspect <tag>...",
+	Short: "Show the OCI config and metadata of cached images",
+	Long: `Print cached images as JSON: digest, platform, layer count, rootfs size
+and the OCI config (user, working directory, entrypoint, cmd and env) the
+guest is started with. An image cached for several platforms is listed once
+per platform.`,
+	Example: `  matchlock image inspect alpine:latest
+  matchlock image inspect myapp:latest | jq '.[0].config.entrypoint'`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runImageInspect,
+}
+
 var imageImportCmd = &cobra.Command{
 	Use:   "import <tag>",
 	Short: "Import an image from a Docker/OCI tarball via stdin",
@@ -44,10 +69,142 @@ The tarball format is the same as "docker save" output.`,
 	RunE: runImageImport,
 }
 
+var imageExportCmd = &cobra.Command{
+	Use:   "export <tag> <dest>",
+	Short: "Export a local image as an OCI image layout",
+	Long: `Export a local image, such as one built from a Dockerfile or imported,
+as an OCI image layout directory, or as an OCI archive if dest ends in .tar.
+The result can be copied to a registry with skopeo or crane.`,
+	Example: `  matchlock image export myapp:latest ./myapp-oci
+  matchlock image export myapp:latest myapp.tar
+  skopeo copy oci:./myapp-oci docker://registry.example.com/myapp:latest`,
+	Args: cobra.ExactArgs(2),
+	RunE: runImageExport,
+}
+
+var imagePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Evict images pulled from registries from the cache",
+	Long: `Evict images pulled from registries, least recently used first. Images
+used by existing sandboxes, including stopped ones, are kept. Locally built
+and imported images cannot be pulled again and are never pruned.
+
+Without a policy every unused image is evicted. Filters:
+
+  until=<duration|timestamp>   Images created before, e.g. until=168h
+
+The same --max-size and --max-age limits can be enforced automatically
+after every pull by setting MATCHLOCK_IMAGE_GC_MAX_SIZE and
+MATCHLOCK_IMAGE_GC_MAX_AGE.`,
+	Example: `  matchlock image prune
+  matchlock images prune --filter until=168h
+  matchlock image prune --max-size 20GB --max-age 720h`,
+	Args: cobra.NoArgs,
+	RunE: runImagePrune,
+}
+
+var imagePrefetchCmd = &cobra.Command{
+	Use:   "prefetch [flags] [image...]",
+	Short: "Pull and convert images ahead of use",
+	Long: `Pull and convert a list of images into the local cache so sandboxes
+started later do not wait on a registry.
+
+Images come from a YAML manifest, the command line, or both. Higher
+priority images are fetched first:
+
+  concurrency: 4
+  images:
+    - image: python:3.12-slim
+      priority: 10
+    - alpine:latest`,
+	Example: `  matchlock image prefetch -f images.yaml
+  matchlock image prefetch --concurrency 4 alpine:latest python:3.12-slim`,
+	RunE: runImagePrefetch,
+}
+
+var imageServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run an image conversion service",
+	Long: `Run an HTTP service that converts OCI image references into rootfs
+artifacts, independent of sandbox creation. Fleets can centralise conversion
+on a few well-provisioned hosts and download the resulting ext4 images.
+
+  POST   /v1/conversions              {"image":"alpine:latest"}
+  GET    /v1/conversions              List conversions
+  GET    /v1/conversions/{id}         State, queue position, digest, OCI config
+  GET    /v1/conversions/{id}/rootfs  Download the ext4 artifact
+  DELETE /v1/conversions/{id}         Forget a finished conversion (admin)
+
+With --token or --admin-token every request must present one as a bearer
+token. User tokens see and submit the conversions of the namespace their
+requests name (see 'matchlock context'); the admin token sees all and may
+delete them. Either may be a secret reference such as keychain:NAME.
+Without tokens the API is unauthenticated; only listen on trusted networks.`,
+	Example: `  matchlock image serve
+  matchlock image serve --listen 10.0.0.5:7050 --concurrency 4 \
+    --token keychain:matchlock-users --admin-token keychain:matchlock-admin`,
+	Args: cobra.NoArgs,
+	RunE: runImageServe,
+}
+
+var imageConvertCmd = &cobra.Command{
+	Use:   "convert <image>",
+	Short: "Convert an image on the current context's image service",
+	Long: `Submit an image to the conversion service of the current context (see
+'matchlock context') and wait for it to be converted. With --output the
+ext4 artifact is downloaded to a file.`,
+	Example: `  matchlock image convert python:3.12-slim
+  matchlock image convert -o rootfs.ext4 alpine:latest`,
+	Args: cobra.ExactArgs(1),
+	RunE: runImageConvert,
+}
+
+var imageConversionsCmd = &cobra.Command{
+	Use:   "conversions",
+	Short: "List conversions on the current context's image service",
+	Args:  cobra.NoArgs,
+	RunE:  runImageConversions,
+}
+
+var imageConversionsRmCmd = &cobra.Command{
+	Use:     "rm <id>...",
+	Aliases: []string{"remove"},
+	Short:   "Forget finished conversions on the image service",
+	Args:    cobra.MinimumNArgs(1),
+	RunE:    runImageConversionsRm,
+}
+
 func init() {
+	imageServeCmd.Flags().String("listen", "127.0.0.1:7050", "Address to listen on")
+	imageServeCmd.Flags().Int("concurrency", image.DefaultPrefetchConcurrency, "Conversions to run at once")
+	imageServeCmd.Flags().Int("queue-size", image.DefaultServiceQueueSize, "Maximum queued conversions")
+	imageServeCmd.Flags().Int("history", image.DefaultServiceHistory, "Finished conversions to keep")
+	imageServeCmd.Flags().String("token", "", "Bearer token of users, or a secret reference to it")
+	imageServeCmd.Flags().String("admin-token", "", "Bearer token of admins, or a secret reference to it")
+
+	imageConvertCmd.Flags().StringP("output", "o", "", "Download the artifact to this file")
+
+	imagePruneCmd.Flags().StringArray("filter", nil, "Only evict images matching a filter, e.g. until=168h (repeatable)")
+	imagePruneCmd.Flags().String("max-size", "", "Evict least recently used images until the cache fits, e.g. 20GB")
+	imagePruneCmd.Flags().Duration("max-age", 0, "Evict images not used for this long, e.g. 720h")
+
+	imagePrefetchCmd.Flags().StringP("file", "f", "", "Path to a prefetch manifest")
+	imagePrefetchCmd.Flags().Int("concurrency", 0, fmt.Sprintf("Images to pull at once (default: manifest value or %d)", image.DefaultPrefetchConcurrency))
+
 	imageCmd.AddCommand(imageLsCmd)
 	imageCmd.AddCommand(imageRmCmd)
+	imageCmd.AddCommand(imageInspectCmd)
 	imageCmd.AddCommand(imageImportCmd)
+	imageCmd.AddCommand(imageExportCmd)
+	imageCmd.AddCommand(imagePruneCmd)
+	imageCmd.AddCommand(imagePrefetchCmd)
+	imageCmd.AddCommand(imageServeCmd)
+	imageCmd.AddCommand(imageConvertCmd)
+	imageConversionsCmd.AddCommand(imageConversionsRmCmd)
+	imageCmd.AddCommand(imageConversionsCmd)
+	adminOnly(imagePruneCmd)
+	adminOnly(imageServeCmd)
+	adminOnly(imageConversionsRmCmd)
 	rootCmd.AddCommand(imageCmd)
 }
 
@@ -80,9 +237,13 @@ func runImageLs(cmd *cobra.Command, args []string) error {
 	}
 
 	for _, img := range registryImages {
+		source := "registry"
+		if img.Meta.Platform != "" {
+			source += " (" + img.Meta.Platform + ")"
+		}
 		fmt.Fprintf(w, "%s\t%s\t%.1f MB\t%s\n",
 			img.Tag,
-			"registry",
+			source,
 			float64(img.Meta.Size)/(1024*1024),
 			img.Meta.CreatedAt.Format(time.DateTime),
 		)
@@ -106,6 +267,50 @@ func runImageRm(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// imageInspect is the JSON form of an image printed by image inspect.
+type imageInspect struct {
+	Tag       string           `json:"tag"`
+	Source    string           `json:"source"`
+	Digest    string           `json:"digest,omitempty"`
+	Platform  string           `json:"platform,omitempty"`
+	Layers    int              `json:"layers,omitempty"`
+	Size      int64            `json:"size"`
+	Rootfs    string           `json:"rootfs"`
+	CreatedAt time.Time        `json:"created_at"`
+	Config    *image.OCIConfig `json:"config,omitempty"`
+}
+
+func runImageInspect(cmd *cobra.Command, args []string) error {
+	out := []imageInspect{}
+	for _, tag := range args {
+		images, err := image.InspectImage(tag, "")
+		if err != nil {
+			return err
+		}
+		for _, img := range images {
+			source := img.Meta.Source
+			if source == "" {
+				source = "local"
+			}
+			out = append(out, imageInspect{
+				Tag:       img.Tag,
+				Source:    source,
+				Digest:    img.Meta.Digest,
+				Platform:  img.Meta.Platform,
+				Layers:    img.Meta.Layers,
+				Size:      img.Meta.Size,
+				Rootfs:    img.RootfsPath,
+				CreatedAt: img.Meta.CreatedAt,
+				Config:    img.Meta.OCI,
+			})
+		}
+	}
+
+	output, _ := json.MarshalIndent(out, "", "  ")
+	fmt.Println(string(output))
+	return nil
+}
+
 func runImageImport(cmd *cobra.Command, args []string) error {
 	tag := args[0]
 
@@ -125,3 +330,348 @@ func runImageImport(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Size: %.1f MB\n", float64(result.Size)/(1024*1024))
 	return nil
 }
+
+func runImageExport(cmd *cobra.Command, args []string) error {
+	tag, dest := args[0], args[1]
+
+	builder := image.NewBuilder(&image.BuildOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	fmt.Fprintf(os.Stderr, "Exporting %s...\n", tag)
+	digest, err := builder.Export(ctx, tag, dest)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported: %s\n", dest)
+	fmt.Printf("Digest: %s\n", digest)
+	return nil
+}
+
+func runImagePrune(cmd *cobra.Command, args []string) error {
+	filters, _ := cmd.Flags().GetStringArray("filter")
+	maxSize, _ := cmd.Flags().GetString("max-size")
+	maxAge, _ := cmd.Flags().GetDuration("max-age")
+
+	policy, err := parseGCPolicy(maxSize, maxAge, filters)
+	if err != nil {
+		return err
+	}
+	inUse, err := sandboxImages()
+	if err != nil {
+		return err
+	}
+
+	evicted, err := image.GarbageCollect("", policy, inUse)
+	var freed int64
+	for _, e := range evicted {
+		fmt.Printf("Removed %s\n", e.Tag)
+		freed += e.Meta.Size
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reclaimed %.1f MB from %d images\n", float64(freed)/(1024*1024), len(evicted))
+	return nil
+}
+
+// parseGCPolicy builds an image GC policy from prune flags.
+func parseGCPolicy(maxSize string, maxAge time.Duration, filters []string) (image.GCPolicy, error) {
+	policy := image.GCPolicy{MaxAge: maxAge}
+	if maxSize != "" {
+		size, err := image.ParseSize(maxSize)
+		if err != nil {
+			return policy, err
+		}
+		policy.MaxSize = size
+	}
+	for _, f := range filters {
+		key, value, _ := strings.Cut(f, "=")
+		if key != "until" {
+			return policy, errx.With(ErrImageFilter, ": %q (supported: until)", f)
+		}
+		until, err := parseUntil(value)
+		if err != nil {
+			return policy, errx.With(ErrImageFilter, ": %q: %w", f, err)
+		}
+		policy.Until = until
+	}
+	return policy, nil
+}
+
+// parseUntil accepts a duration before now, an RFC 3339 timestamp or a
+// Unix timestamp, like docker's until filter.
+func parseUntil(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("want a duration or timestamp")
+}
+
+// imageSignaturePolicy returns the image signers of the trust policy when
+// verify is set or the policy requires signatures, and nil otherwise.
+func imageSignaturePolicy(verify bool) (*trust.ImagePolicy, error) {
+	policy, err := trust.LoadDefaultPolicy()
+	if err != nil {
+		return nil, err
+	}
+	if !verify && !policy.Images.RequireSignatures {
+		return nil, nil
+	}
+	if !policy.Images.HasSigners() {
+		return nil, errx.With(image.ErrSignature, ": no image keys or identities in %s", trust.DefaultPolicyPath())
+	}
+	return &policy.Images, nil
+}
+
+// newImageBuilder returns a Builder for opts that pulls through the
+// registry mirrors and rewrites of the registries file, authenticating
+// with stored logins unless opts has a keychain.
+func newImageBuilder(opts *image.BuildOptions) (*image.Builder, error) {
+	registries, err := image.LoadDefaultRegistryConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts.Registries = registries
+	if opts.Keychain == nil {
+		if opts.Keychain, err = imageKeychain(nil, ""); err != nil {
+			return nil, err
+		}
+	}
+	return image.NewBuilder(opts), nil
+}
+
+// sandboxImages returns the images of every sandbox that has not been
+// removed. A stopped sandbox may be restarted, so its image stays in use.
+func sandboxImages() ([]string, error) {
+	vms, err := state.NewManager().List()
+	if err != nil {
+		return nil, err
+	}
+	images := make([]string, 0, len(vms))
+	for _, vm := range vms {
+		images = append(images, vm.Image)
+	}
+	return images, nil
+}
+
+// collectImageGarbage enforces the cache limits configured with
+// MATCHLOCK_IMAGE_GC_MAX_SIZE and MATCHLOCK_IMAGE_GC_MAX_AGE after ref was
+// pulled. Failures only warn since the pull itself succeeded.
+func collectImageGarbage(ref string) {
+	maxSize := viper.GetString("image.gc.max-size")
+	maxAge := viper.GetDuration("image.gc.max-age")
+	if maxSize == "" && maxAge <= 0 {
+		return
+	}
+	policy, err := parseGCPolicy(maxSize, maxAge, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: image cache limits: %v\n", err)
+		return
+	}
+	inUse, err := sandboxImages()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: image cache limits: %v\n", err)
+		return
+	}
+	evicted, err := image.GarbageCollect("", policy, append(inUse, ref))
+	for _, e := range evicted {
+		fmt.Fprintf(os.Stderr, "Evicted %s from the image cache\n", e.Tag)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: image cache limits: %v\n", err)
+	}
+}
+
+func runImagePrefetch(cmd *cobra.Command, args []string) error {
+	file, _ := cmd.Flags().GetString("file")
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+
+	manifest := &image.PrefetchManifest{}
+	if file != "" {
+		m, err := image.LoadPrefetchManifest(file)
+		if err != nil {
+			return err
+		}
+		manifest = m
+	}
+	for _, ref := range args {
+		manifest.Images = append(manifest.Images, image.PrefetchImage{Image: ref})
+	}
+	if cmd.Flags().Changed("concurrency") {
+		manifest.Concurrency = concurrency
+	}
+	if err := image.ValidatePrefetch(manifest.Images, manifest.Concurrency); err != nil {
+		return err
+	}
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	builder, err := newImageBuilder(&image.BuildOptions{})
+	if err != nil {
+		return err
+	}
+	results := builder.Prefetch(ctx, manifest.Images, manifest.Concurrency, func(r image.PrefetchResult) {
+		switch {
+		case r.Error != "":
+			fmt.Fprintf(os.Stderr, "%s: %s\n", r.Image, r.Error)
+		case r.Cached:
+			fmt.Printf("%s: cached (%s)\n", r.Image, r.Digest)
+		default:
+			fmt.Printf("%s: pulled %s in %s\n", r.Image, r.Digest, time.Duration(r.DurationMS)*time.Millisecond)
+		}
+	})
+
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errx.With(ErrPrefetchFailed, ": %d of %d images", failed, len(results))
+	}
+	return nil
+}
+
+func runImageServe(cmd *cobra.Command, args []string) error {
+	listen, _ := cmd.Flags().GetString("listen")
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+	queueSize, _ := cmd.Flags().GetInt("queue-size")
+	history, _ := cmd.Flags().GetInt("history")
+
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	resolver := secrets.NewResolver()
+	var tokens [2]string
+	for i, flag := range []string{"token", "admin-token"} {
+		ref, _ := cmd.Flags().GetString(flag)
+		token, err := resolver.Resolve(ctx, ref)
+		if err != nil {
+			return errx.With(ErrImageServe, ": --%s: %w", flag, err)
+		}
+		tokens[i] = token
+	}
+
+	builder, err := newImageBuilder(&image.BuildOptions{})
+	if err != nil {
+		return err
+	}
+	svc := image.NewService(builder, image.ServiceOptions{
+		Concurrency: concurrency,
+		QueueSize:   queueSize,
+		History:     history,
+		UserToken:   tokens[0],
+		AdminToken:  tokens[1],
+	})
+	go svc.Run(ctx)
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return errx.Wrap(ErrImageServe, err)
+	}
+	server := &http.Server{Handler: svc.Handler()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "Image conversion service listening on %s\n", ln.Addr())
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return errx.Wrap(ErrImageServe, err)
+	}
+	return nil
+}
+
+func runImageConvert(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	client, err := serviceClient(ctx)
+	if err != nil {
+		return err
+	}
+	conv, err := client.Submit(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	for conv.State == image.ConversionQueued || conv.State == image.ConversionConverting {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+		if conv, err = client.Get(ctx, conv.ID); err != nil {
+			return err
+		}
+	}
+	if conv.State == image.ConversionFailed {
+		return errx.With(ErrImageConvert, " %s: %s", args[0], conv.Error)
+	}
+	fmt.Fprintf(os.Stderr, "Converted %s (%s, %s)\n", conv.Image, conv.ID, conv.Digest)
+
+	if output == "" {
+		return nil
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return errx.Wrap(ErrImageConvert, err)
+	}
+	if _, err := client.Download(ctx, conv.ID, f); err != nil {
+		f.Close()
+		os.Remove(output)
+		return err
+	}
+	return f.Close()
+}
+
+func runImageConversions(cmd *cobra.Command, args []string) error {
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	client, err := serviceClient(ctx)
+	if err != nil {
+		return err
+	}
+	list, err := client.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tIMAGE\tNAMESPACE\tSTATE\tDIGEST\tCREATED")
+	for _, c := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", c.ID, c.Image, orDash(c.Namespace), c.State, orDash(c.Digest), c.CreatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func runImageConversionsRm(cmd *cobra.Command, args []string) error {
+	ctx, cancel := contextWithSignal(context.Background())
+	defer cancel()
+
+	client, err := serviceClient(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range args {
+		if err := client.Delete(ctx, id); err != nil {
+			return err
+		}
+		fmt.Println(id)
+	}
+	return nil
+}
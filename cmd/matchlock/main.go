@@ -19,6 +19,8 @@ var rootCmd = &cobra.Command{
 
 	SilenceUsage:  true,
 	SilenceErrors: true,
+
+	PersistentPreRunE: checkRole,
 }
 
 func init() {
@@ -41,6 +41,7 @@ This command requires root privileges.`,
 }
 
 func init() {
+	adminOnly(setupLinuxCmd)
 	setupLinuxCmd.Flags().String("user", "", "Username to configure (default: current user or SUDO_USER)")
 	setupLinuxCmd.Flags().String("binary", "", "Path to matchlock binary (default: auto-detect)")
 	setupLinuxCmd.Flags().String("install-dir", "/usr/local/bin", "Directory to install Firecracker")
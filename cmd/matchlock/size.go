@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/preset"
+)
+
+// applySize sizes res from the preset named by --size. Resource flags set
+// explicitly on the command line win over the preset.
+func applySize(cmd *cobra.Command, res *api.Resources) error {
+	name, _ := cmd.Flags().GetString("size")
+	if name == "" {
+		return nil
+	}
+	presets, err := preset.LoadDefault()
+	if err != nil {
+		return err
+	}
+	size, err := presets.Lookup(name)
+	if err != nil {
+		return err
+	}
+
+	changed := cmd.Flags().Changed
+	res.Size = name
+	if !changed("cpus") && size.CPUs > 0 {
+		res.CPUs = size.CPUs
+	}
+	if !changed("memory") && size.MemoryMB > 0 {
+		res.MemoryMB = size.MemoryMB
+	}
+	if !changed("disk-size") && size.DiskSizeMB > 0 {
+		res.DiskSizeMB = size.DiskSizeMB
+	}
+	if !changed("timeout") && size.TimeoutSeconds > 0 {
+		res.TimeoutSeconds = size.TimeoutSeconds
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/trust"
+)
+
+var trustCmd = &cobra.Command{
+	Use:   "trust",
+	Short: "Sign and verify guest kernel and agent assets",
+	Long: `Sign and verify the kernel, initramfs, guest-agent and guest-fused assets
+every sandbox boots from. Assets are checked before each launch against the
+trust policy (default ~/.config/matchlock/trust.json, or
+$MATCHLOCK_TRUST_POLICY):
+
+  {
+    "keys": ["<base64 ed25519 public key>"],
+    "require_signatures": true,
+    "pins": {"kernel": "sha256:..."}
+  }
+
+Signatures live next to each asset as <asset>.sig.`,
+}
+
+var trustKeygenCmd = &cobra.Command{
+	Use:     "keygen",
+	Short:   "Generate an asset signing key pair",
+	Example: `  matchlock trust keygen --out signing.key`,
+	Args:    cobra.NoArgs,
+	RunE:    runTrustKeygen,
+}
+
+var trustSignCmd = &cobra.Command{
+	Use:     "sign --key <file> <asset>...",
+	Short:   "Sign assets, writing <asset>.sig next to each",
+	Example: `  matchlock trust sign --key signing.key bin/guest-agent bin/guest-fused`,
+	Args:    cobra.MinimumNArgs(1),
+	RunE:    runTrustSign,
+}
+
+var trustVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify the assets sandboxes would boot from",
+	Long: `Resolve the kernel, initramfs and guest binaries the way sandbox launch
+does and check each against the trust policy. Digests are printed so they
+can be copied into the policy as pins.`,
+	Args: cobra.NoArgs,
+	RunE: runTrustVerify,
+}
+
+func init() {
+	trustKeygenCmd.Flags().String("out", "", "Write the private key to this file (required)")
+	trustKeygenCmd.MarkFlagRequired("out")
+	trustSignCmd.Flags().String("key", "", "Private key file (default: $MATCHLOCK_SIGNING_KEY)")
+
+	trustCmd.AddCommand(trustKeygenCmd)
+	trustCmd.AddCommand(trustSignCmd)
+	trustCmd.AddCommand(trustVerifyCmd)
+	rootCmd.AddCommand(trustCmd)
+}
+
+func runTrustKeygen(cmd *cobra.Command, args []string) error {
+	out, _ := cmd.Flags().GetString("out")
+
+	pub, priv, err := trust.GenerateKey()
+	if err != nil {
+		return errx.Wrap(ErrTrustKey, err)
+	}
+	if err := os.WriteFile(out, []byte(priv+"\n"), 0600); err != nil {
+		return errx.Wrap(ErrTrustKey, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Private key written to %s\n", out)
+	fmt.Println(pub)
+	return nil
+}
+
+func runTrustSign(cmd *cobra.Command, args []string) error {
+	keyFile, _ := cmd.Flags().GetString("key")
+
+	encoded := os.Getenv("MATCHLOCK_SIGNING_KEY")
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return errx.Wrap(ErrTrustKey, err)
+		}
+		encoded = string(data)
+	}
+	if strings.TrimSpace(encoded) == "" {
+		return errx.With(ErrTrustKey, ": pass --key or set MATCHLOCK_SIGNING_KEY")
+	}
+	key, err := trust.ParsePrivateKey(encoded)
+	if err != nil {
+		return errx.Wrap(ErrTrustKey, err)
+	}
+
+	for _, path := range args {
+		if err := trust.Sign(key, path); err != nil {
+			return err
+		}
+		fmt.Printf("Signed %s\n", path)
+	}
+	return nil
+}
+
+func runTrustVerify(cmd *cobra.Command, args []string) error {
+	policy, err := trust.LoadDefaultPolicy()
+	if err != nil {
+		return err
+	}
+
+	assets := []struct{ name, path string }{
+		{trust.AssetKernel, sandbox.DefaultKernelPath()},
+		{trust.AssetInitramfs, sandbox.DefaultInitramfsPath()},
+		{trust.AssetGuestAgent, sandbox.DefaultGuestAgentPath()},
+		{trust.AssetGuestFused, sandbox.DefaultGuestFusedPath()},
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ASSET\tPATH\tDIGEST\tSTATUS")
+	failed := 0
+	for _, a := range assets {
+		if a.path == "" {
+			continue
+		}
+		digest, err := trust.Digest(a.path)
+		if err != nil {
+			digest = "-"
+		}
+		status := "ok"
+		if err := policy.Verify(a.name, a.path); err != nil {
+			status = err.Error()
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", a.name, a.path, digest, status)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return errx.With(ErrTrustVerify, ": %d asset(s) failed", failed)
+	}
+	return nil
+}
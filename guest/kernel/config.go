@@ -0,0 +1,36 @@
+// Package kernelconfig embeds the guest kernel build configurations so the
+// host can report which features the kernels it downloads were built with.
+package kernelconfig
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//go:embed x86_64.config arm64.config
+var configs embed.FS
+
+// Enabled returns the options built into the kernel for arch ("x86_64" or
+// "arm64"), without their CONFIG_ prefix, sorted.
+func Enabled(arch string) ([]string, error) {
+	data, err := configs.ReadFile(arch + ".config")
+	if err != nil {
+		return nil, fmt.Errorf("no kernel config for %s", arch)
+	}
+
+	var enabled []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		option, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || value != "y" || !strings.HasPrefix(option, "CONFIG_") {
+			continue
+		}
+		enabled = append(enabled, strings.TrimPrefix(option, "CONFIG_"))
+	}
+	sort.Strings(enabled)
+	return enabled, scanner.Err()
+}
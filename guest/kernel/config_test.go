@@ -0,0 +1,22 @@
+package kernelconfig
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnabled(t *testing.T) {
+	for _, arch := range []string{"x86_64", "arm64"} {
+		enabled, err := Enabled(arch)
+		require.NoError(t, err)
+		assert.Contains(t, enabled, "VIRTIO_VSOCKETS")
+		assert.Contains(t, enabled, "FUSE_FS")
+		assert.True(t, sort.StringsAreSorted(enabled))
+	}
+
+	_, err := Enabled("riscv64")
+	assert.Error(t, err)
+}
@@ -0,0 +1,55 @@
+// Package storename holds what matchlock's stores of named entries (shared
+// caches, data disks and workspace snapshots) and its configuration files
+// have in common: where they live by default and which names they accept.
+package storename
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+var nameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Validate checks that name can be used for an entry: letters, digits, '.',
+// '_' and '-', starting with a letter or digit. It fails with invalid, the
+// store's own sentinel.
+func Validate(invalid error, name string) error {
+	if !nameRe.MatchString(name) {
+		return errx.With(invalid, " %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// Dir returns dir, or the path elem under the home directory if dir is
+// empty.
+func Dir(dir string, elem ...string) string {
+	if dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(append([]string{home}, elem...)...)
+}
+
+// UserHome returns the home directory of the user matchlock runs for. Under
+// sudo that is the invoking user's, so their configuration is used rather
+// than root's.
+func UserHome() string {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" && os.Getuid() == 0 {
+		if u, err := user.Lookup(sudoUser); err == nil && u.HomeDir != "" {
+			return u.HomeDir
+		}
+		return filepath.Join("/home", sudoUser)
+	}
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+// ConfigPath returns the path of the configuration file name in
+// ~/.config/matchlock of UserHome.
+func ConfigPath(name string) string {
+	return filepath.Join(UserHome(), ".config", "matchlock", name)
+}
@@ -0,0 +1,35 @@
+package storename
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errInvalid = errors.New("invalid name")
+
+func TestValidate(t *testing.T) {
+	for _, name := range []string{"go-build", "v1.2_cache", strings.Repeat("a", 128)} {
+		assert.NoError(t, Validate(errInvalid, name), name)
+	}
+	for _, name := range []string{"", ".hidden", "../x", "a/b", "sp ace", strings.Repeat("a", 129)} {
+		assert.ErrorIs(t, Validate(errInvalid, name), errInvalid, name)
+	}
+}
+
+func TestDir(t *testing.T) {
+	assert.Equal(t, "/srv/disks", Dir("/srv/disks", ".cache", "matchlock", "disks"))
+	home, _ := os.UserHomeDir()
+	assert.Equal(t, filepath.Join(home, ".cache", "matchlock", "disks"), Dir("", ".cache", "matchlock", "disks"))
+}
+
+func TestConfigPath(t *testing.T) {
+	t.Setenv("SUDO_USER", "")
+	home, _ := os.UserHomeDir()
+	assert.Equal(t, home, UserHome())
+	assert.Equal(t, filepath.Join(home, ".config", "matchlock", "trust.json"), ConfigPath("trust.json"))
+}
@@ -0,0 +1,5 @@
+package warm
+
+import "errors"
+
+var ErrClosed = errors.New("pool is closed")
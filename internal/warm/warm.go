@@ -0,0 +1,161 @@
+// Package warm keeps items that are slow to make, such as booted sandboxes,
+// made ahead of use. It holds what the SDK pool and the pool daemon have in
+// common: a few items per template, replaced in the background as they are
+// taken.
+package warm
+
+import "sync"
+
+// Pool keeps up to size items of each template it is asked for. Templates
+// are told apart by key; the newItem func given with a key's first use makes
+// its items from then on.
+type Pool[T any] struct {
+	size int
+	// alive reports whether an idle item can still be handed over, and
+	// discard disposes of one that cannot.
+	alive   func(T) bool
+	discard func(T)
+
+	mu      sync.Mutex
+	made    *sync.Cond // signalled as each make finishes
+	sets    map[string]*set[T]
+	closed  bool
+	booting sync.WaitGroup
+}
+
+// set is the items of a template.
+type set[T any] struct {
+	newItem func() (T, error)
+	idle    []T // oldest first
+	booting int
+	err     error // of the last make that failed
+}
+
+// New returns a pool keeping size items of each template, at least one.
+func New[T any](size int, alive func(T) bool, discard func(T)) *Pool[T] {
+	p := &Pool[T]{
+		size:    max(size, 1),
+		alive:   alive,
+		discard: discard,
+		sets:    make(map[string]*set[T]),
+	}
+	p.made = sync.NewCond(&p.mu)
+	return p
+}
+
+// Warm starts making items of the template key.
+func (p *Pool[T]) Warm(key string, newItem func() (T, error)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.fill(p.set(key, newItem))
+	return nil
+}
+
+// Take hands over an idle item of the template key and starts making a
+// replacement. If none is idle it waits for one being made, starting as
+// many as the pool keeps, rather than making one of its own; it fails with
+// the error of the make it waited for if that fails.
+func (p *Pool[T]) Take(key string, newItem func() (T, error)) (T, error) {
+	var item T
+	var stopped []T
+	defer func() {
+		for _, s := range stopped {
+			p.discard(s)
+		}
+	}()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return item, ErrClosed
+	}
+	s := p.set(key, newItem)
+	waited := false
+	for {
+		for len(s.idle) > 0 {
+			item, s.idle = s.idle[0], s.idle[1:]
+			if p.alive(item) {
+				p.fill(s)
+				return item, nil
+			}
+			stopped = append(stopped, item)
+		}
+		if waited && s.booting == 0 {
+			var zero T
+			return zero, s.err
+		}
+		p.fill(s)
+		p.made.Wait()
+		waited = true
+		if p.closed {
+			var zero T
+			return zero, ErrClosed
+		}
+	}
+}
+
+// Idle returns how many items of the template key are idle.
+func (p *Pool[T]) Idle(key string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.sets[key]; ok {
+		return len(s.idle)
+	}
+	return 0
+}
+
+// Close stops making items, waits for those being made and returns every
+// idle item, for the caller to dispose of.
+func (p *Pool[T]) Close() []T {
+	p.mu.Lock()
+	p.closed = true
+	p.made.Broadcast()
+	p.mu.Unlock()
+	p.booting.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var idle []T
+	for _, s := range p.sets {
+		idle = append(idle, s.idle...)
+		s.idle = nil
+	}
+	return idle
+}
+
+// set returns the set of the template key, adding it if new. The caller
+// holds p.mu.
+func (p *Pool[T]) set(key string, newItem func() (T, error)) *set[T] {
+	s, ok := p.sets[key]
+	if !ok {
+		s = &set[T]{newItem: newItem}
+		p.sets[key] = s
+	}
+	return s
+}
+
+// fill starts making items of s until it has p.size, counting those being
+// made. A make that fails is not retried until s is next filled. The
+// caller holds p.mu.
+func (p *Pool[T]) fill(s *set[T]) {
+	for !p.closed && len(s.idle)+s.booting < p.size {
+		s.booting++
+		p.booting.Add(1)
+		go func() {
+			defer p.booting.Done()
+			item, err := s.newItem()
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			s.booting--
+			if err != nil {
+				s.err = err
+			} else {
+				s.idle = append(s.idle, item)
+			}
+			p.made.Broadcast()
+		}()
+	}
+}
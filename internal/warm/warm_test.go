@@ -0,0 +1,66 @@
+package warm
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func counter(made *atomic.Int32) func() (int32, error) {
+	return func() (int32, error) {
+		time.Sleep(10 * time.Millisecond)
+		return made.Add(1), nil
+	}
+}
+
+func TestTakeWaitsForItemBeingMade(t *testing.T) {
+	var made atomic.Int32
+	p := New(2, func(int32) bool { return true }, func(int32) {})
+	defer p.Close()
+
+	item, err := p.Take("a", counter(&made))
+	require.NoError(t, err)
+	assert.NotZero(t, item)
+
+	require.Eventually(t, func() bool { return p.Idle("a") == 2 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, int32(3), made.Load(), "a cold take is handed one of the pool's items, not one more")
+}
+
+func TestTakeSkipsStoppedItems(t *testing.T) {
+	var made atomic.Int32
+	var discarded []int32
+	p := New(1, func(i int32) bool { return i != 1 }, func(i int32) { discarded = append(discarded, i) })
+	defer p.Close()
+
+	require.NoError(t, p.Warm("a", counter(&made)))
+	require.Eventually(t, func() bool { return p.Idle("a") == 1 }, 5*time.Second, time.Millisecond)
+
+	item, err := p.Take("a", counter(&made))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), item)
+	assert.Equal(t, []int32{1}, discarded)
+}
+
+func TestTakeFailsWithMakeError(t *testing.T) {
+	boom := errors.New("boom")
+	p := New(2, func(int) bool { return true }, func(int) {})
+	defer p.Close()
+
+	_, err := p.Take("a", func() (int, error) { return 0, boom })
+	assert.ErrorIs(t, err, boom)
+}
+
+func TestClose(t *testing.T) {
+	var made atomic.Int32
+	p := New(2, func(int32) bool { return true }, func(int32) {})
+	require.NoError(t, p.Warm("a", counter(&made)))
+
+	assert.Len(t, p.Close(), 2, "items being made are waited for")
+	_, err := p.Take("a", counter(&made))
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, p.Warm("a", counter(&made)), ErrClosed)
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// CertPinPrefix marks a pin as the base64 SHA-256 digest of a certificate's
+// DER-encoded SubjectPublicKeyInfo, the format used by HPKP and curl's
+// --pinnedpubkey.
+const CertPinPrefix = "sha256/"
+
+// ValidateCertPin checks that pin has the form "sha256/<base64 digest>".
+func ValidateCertPin(pin string) error {
+	digest, ok := strings.CutPrefix(pin, CertPinPrefix)
+	if !ok {
+		return errx.With(ErrInvalidCertPin, " %q: must start with %q", pin, CertPinPrefix)
+	}
+	raw, err := base64.StdEncoding.DecodeString(digest)
+	if err != nil || len(raw) != 32 {
+		return errx.With(ErrInvalidCertPin, " %q: expected base64 of a 32-byte SHA-256 digest", pin)
+	}
+	return nil
+}
+
+// ParseCertPin parses a pin spec in the format "HOST=sha256/BASE64", where
+// HOST may use the same wildcards as the allowlist.
+func ParseCertPin(spec string) (string, string, error) {
+	host, pin, ok := strings.Cut(spec, "=")
+	host = strings.TrimSpace(host)
+	if !ok || host == "" {
+		return "", "", errx.With(ErrInvalidCertPin, " %q: expected HOST=sha256/BASE64", spec)
+	}
+	pin = strings.TrimSpace(pin)
+	if err := ValidateCertPin(pin); err != nil {
+		return "", "", err
+	}
+	return host, pin, nil
+}
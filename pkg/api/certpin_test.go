@@ -0,0 +1,45 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPin(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	return CertPinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestValidateCertPin(t *testing.T) {
+	require.NoError(t, ValidateCertPin(testPin("key")))
+
+	for _, pin := range []string{
+		"",
+		"sha1/AAAA",
+		"sha256/not-base64!",
+		"sha256/" + base64.StdEncoding.EncodeToString([]byte("short")),
+	} {
+		assert.ErrorIs(t, ValidateCertPin(pin), ErrInvalidCertPin, pin)
+	}
+}
+
+func TestParseCertPin(t *testing.T) {
+	pin := testPin("key")
+	host, got, err := ParseCertPin("*.example.com=" + pin)
+	require.NoError(t, err)
+	assert.Equal(t, "*.example.com", host)
+	assert.Equal(t, pin, got)
+
+	_, _, err = ParseCertPin(pin)
+	require.ErrorIs(t, err, ErrInvalidCertPin)
+
+	_, _, err = ParseCertPin("=" + pin)
+	require.ErrorIs(t, err, ErrInvalidCertPin)
+
+	_, _, err = ParseCertPin("api.example.com=sha256/AAAA")
+	require.ErrorIs(t, err, ErrInvalidCertPin)
+}
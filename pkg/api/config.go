@@ -13,7 +13,7 @@ const DefaultWorkspace = "/workspace"
 const (
 	DefaultCPUs                   = 1
 	DefaultMemoryMB               = 512
-	DefaultDiskSizeMB             = 5120
+	DefaultRootfsFreeSpaceMB      = 4096
 	DefaultTimeoutSeconds         = 300
 	DefaultGracefulShutdownPeriod = 0
 )
@@ -27,14 +27,18 @@ type ImageConfig struct {
 }
 
 type Config struct {
-	Image      string            `json:"image,omitempty"`
-	Privileged bool              `json:"privileged,omitempty"`
-	Resources  *Resources        `json:"resources,omitempty"`
-	Network    *NetworkConfig    `json:"network,omitempty"`
-	VFS        *VFSConfig        `json:"vfs,omitempty"`
-	Env        map[string]string `json:"env,omitempty"`
-	ExtraDisks []DiskMount       `json:"extra_disks,omitempty"`
-	ImageCfg   *ImageConfig      `json:"image_config,omitempty"`
+	Image       string            `json:"image,omitempty"`
+	ImageDigest string            `json:"image_digest,omitempty"`
+	Privileged  bool              `json:"privileged,omitempty"`
+	Resources   *Resources        `json:"resources,omitempty"`
+	Network     *NetworkConfig    `json:"network,omitempty"`
+	VFS         *VFSConfig        `json:"vfs,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	ExtraDisks  []DiskMount       `json:"extra_disks,omitempty"`
+	DataDisks   []DataDisk        `json:"data_disks,omitempty"`
+	ImageCfg    *ImageConfig      `json:"image_config,omitempty"`
+	Redact      bool              `json:"redact,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
 }
 
 // DiskMount describes a persistent ext4 disk image to attach as a block device.
@@ -55,23 +59,66 @@ func ValidateGuestMount(path string) error {
 	return nil
 }
 
+// Resources sizes the VM. The root disk fits the image with
+// RootfsFreeSpaceMB to spare (DefaultRootfsFreeSpaceMB if zero), and is at
+// least DiskSizeMB. SwapMB adds guest swap of type SwapType (see SwapZram
+// and SwapFile) so memory spikes page out instead of being OOM-killed.
+// Size names the preset (e.g. "large") the VM was sized from, if any.
 type Resources struct {
-	CPUs           int           `json:"cpus,omitempty"`
-	MemoryMB       int           `json:"memory_mb,omitempty"`
-	DiskSizeMB     int           `json:"disk_size_mb,omitempty"`
-	TimeoutSeconds int           `json:"timeout_seconds,omitempty"`
-	Timeout        time.Duration `json:"-"`
+	Size              string        `json:"size,omitempty"`
+	CPUs              int           `json:"cpus,omitempty"`
+	MemoryMB          int           `json:"memory_mb,omitempty"`
+	DiskSizeMB        int           `json:"disk_size_mb,omitempty"`
+	RootfsFreeSpaceMB int           `json:"rootfs_free_space_mb,omitempty"`
+	SwapMB            int           `json:"swap_mb,omitempty"`
+	SwapType          string        `json:"swap_type,omitempty"`
+	TimeoutSeconds    int           `json:"timeout_seconds,omitempty"`
+	Timeout           time.Duration `json:"-"`
 }
 
+// HostAlias is the hostname the guest uses to reach services on the host.
+const HostAlias = "host.matchlock.internal"
+
 // DefaultDNSServers are used when no custom DNS servers are configured.
 var DefaultDNSServers = []string{"8.8.8.8", "8.8.4.4"}
 
+// NetworkConfig controls guest network access. MaxConnections and
+// MaxConnectionsPerMinute cap open and newly opened guest TCP connections
+// respectively; zero means unlimited. MaxEgressBytes caps the bytes the guest
+// may send through the proxy, after which EgressBudgetAction applies (see
+// EgressActionBlock). CertPins maps host patterns to the
+// SPKI pins (see CertPinPrefix) an intercepted upstream must present, and
+// UpstreamTLS maps host patterns to options for verifying those upstreams.
+// UpstreamProxy (see ValidateUpstreamProxy) and ProxyAutoConfigURL chain the
+// sandbox's egress through a corporate HTTP proxy. NoInterceptHosts are
+// allowed host patterns whose TLS traffic is relayed without interception;
+// secrets are never injected into them and any placeholder sent to them in
+// the clear is blocked; SecretLeakAction (see LeakActionBlock) decides what
+// else happens when a placeholder is sent to a host its secret is not bound
+// to. RequestSigning maps host patterns to the HMAC the
+// proxy adds to their requests. SecretProfiles name bundles of secrets in
+// the host's profiles file (see ApplySecretProfiles) that are added to
+// Secrets when the sandbox is created.
 type NetworkConfig struct {
-	AllowedHosts    []string          `json:"allowed_hosts,omitempty"`
-	BlockPrivateIPs bool              `json:"block_private_ips,omitempty"`
-	Secrets         map[string]Secret `json:"secrets,omitempty"`
-	PolicyScript    string            `json:"policy_script,omitempty"`
-	DNSServers      []string          `json:"dns_servers,omitempty"`
+	AllowedHosts            []string                  `json:"allowed_hosts,omitempty"`
+	BlockPrivateIPs         bool                      `json:"block_private_ips,omitempty"`
+	Secrets                 map[string]Secret         `json:"secrets,omitempty"`
+	PolicyScript            string                    `json:"policy_script,omitempty"`
+	DNSServers              []string                  `json:"dns_servers,omitempty"`
+	HostPorts               []int                     `json:"host_ports,omitempty"`
+	Shape                   *NetworkShape             `json:"shape,omitempty"`
+	MaxConnections          int                       `json:"max_connections,omitempty"`
+	MaxConnectionsPerMinute int                       `json:"max_connections_per_minute,omitempty"`
+	MaxEgressBytes          int64                     `json:"max_egress_bytes,omitempty"`
+	EgressBudgetAction      string                    `json:"egress_budget_action,omitempty"`
+	CertPins                map[string][]string       `json:"cert_pins,omitempty"`
+	UpstreamTLS             map[string]UpstreamTLS    `json:"upstream_tls,omitempty"`
+	UpstreamProxy           string                    `json:"upstream_proxy,omitempty"`
+	ProxyAutoConfigURL      string                    `json:"proxy_auto_config_url,omitempty"`
+	NoInterceptHosts        []string                  `json:"no_intercept_hosts,omitempty"`
+	RequestSigning          map[string]RequestSigning `json:"request_signing,omitempty"`
+	SecretLeakAction        string                    `json:"secret_leak_action,omitempty"`
+	SecretProfiles          []string                  `json:"secret_profiles,omitempty"`
 }
 
 // GetDNSServers returns the configured DNS servers or defaults.
@@ -82,16 +129,72 @@ func (n *NetworkConfig) GetDNSServers() []string {
 	return DefaultDNSServers
 }
 
+// NeedsInterception reports whether the network config requires the
+// policy-enforcing proxy instead of plain NAT.
+func (n *NetworkConfig) NeedsInterception() bool {
+	if n == nil {
+		return false
+	}
+	return len(n.AllowedHosts) > 0 || len(n.Secrets) > 0 || len(n.HostPorts) > 0 || !n.Shape.IsZero() ||
+		n.MaxConnections > 0 || n.MaxConnectionsPerMinute > 0 || n.MaxEgressBytes > 0 || len(n.CertPins) > 0 ||
+		n.UpstreamProxy != "" || n.ProxyAutoConfigURL != "" || len(n.RequestSigning) > 0
+}
+
+// Secret is a value substituted for its placeholder in requests to Hosts. In
+// lists where the placeholder is replaced (see SecretInHeader); by default
+// that is headers and the query string, never the body. Paths and Methods
+// further restrict substitution to requests whose URL path starts with one
+// of the prefixes and whose method is listed; a placeholder sent anywhere
+// else is blocked. Header, e.g. "Authorization: Bearer {value}", is sent on
+// every such request whether or not the guest used the placeholder. After
+// ExpiresAt the secret is no longer injected, and requests that would have
+// used it are refused.
 type Secret struct {
-	Value       string   `json:"value"`
-	Placeholder string   `json:"placeholder,omitempty"`
-	Hosts       []string `json:"hosts"`
+	Value       string     `json:"value"`
+	Placeholder string     `json:"placeholder,omitempty"`
+	Hosts       []string   `json:"hosts"`
+	In          []string   `json:"in,omitempty"`
+	Paths       []string   `json:"paths,omitempty"`
+	Methods     []string   `json:"methods,omitempty"`
+	Header      string     `json:"header,omitempty"`
+	OAuth2      *OAuth2    `json:"oauth2,omitempty"`
+	GitHubApp   *GitHubApp `json:"github_app,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// OAuth2 turns a secret into an OAuth 2.0 client: instead of substituting a
+// value, the proxy mints access tokens from TokenURL, caches them until they
+// expire, and sends them as "Authorization: Bearer" on requests to the
+// secret's hosts. The guest never sees the credentials or the tokens.
+type OAuth2 struct {
+	TokenURL     string `json:"token_url"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	// RefreshToken selects the refresh_token grant; without it the
+	// client_credentials grant is used.
+	RefreshToken string   `json:"refresh_token,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+	// ServiceAccount is a Google Cloud service account key (JSON). It
+	// replaces the client credentials with a JWT bearer assertion signed by
+	// the key; TokenURL and ClientID default to the key's token_uri and
+	// client_email, and Scopes to cloud-platform.
+	ServiceAccount string `json:"service_account,omitempty"`
+	// Audience makes a service account mint ID tokens for this audience,
+	// e.g. a Cloud Run URL, instead of access tokens.
+	Audience string `json:"audience,omitempty"`
 }
 
 type VFSConfig struct {
 	Workspace    string                 `json:"workspace,omitempty"`
 	DirectMounts map[string]DirectMount `json:"direct_mounts,omitempty"`
 	Mounts       map[string]MountConfig `json:"mounts,omitempty"`
+	// WorkspaceFrom seeds the workspace with a saved workspace snapshot,
+	// mounted as the read-only lower layer of an overlay.
+	WorkspaceFrom string `json:"workspace_from,omitempty"`
+	// SlowOpMS, when set, logs every filesystem operation of the guest
+	// taking at least this many milliseconds to vfs_slow.log in the
+	// sandbox state directory.
+	SlowOpMS int `json:"slow_op_ms,omitempty"`
 }
 
 // GetWorkspace returns the configured workspace path or the default
@@ -113,6 +216,93 @@ type MountConfig struct {
 	Readonly bool         `json:"readonly,omitempty"`
 	Upper    *MountConfig `json:"upper,omitempty"`
 	Lower    *MountConfig `json:"lower,omitempty"`
+	// Backend is how a real_fs mount reaches the guest: MountBackendFUSE
+	// (the default) or MountBackendVirtioFS.
+	Backend string `json:"backend,omitempty"`
+	// S3 names the bucket of an "s3" mount.
+	S3 *S3Mount `json:"s3,omitempty"`
+	// Git names the repository of a "git" mount.
+	Git *GitMount `json:"git,omitempty"`
+	// Cache names the shared package cache of a "cache" mount.
+	Cache *CacheMount `json:"cache,omitempty"`
+	// SizeMB caps the file data a "memory" mount holds (0 = unbounded).
+	// Writes past it fail with ENOSPC.
+	SizeMB int `json:"size_mb,omitempty"`
+	// Access restricts the paths in the mount the guest may read and write.
+	Access *MountAccess `json:"access,omitempty"`
+	// Exclude hides the paths of a real_fs or overlay mount's host
+	// directory that match these globs (MountAccess syntax), such as
+	// "node_modules" or ".git", on top of any listed in the directory's
+	// .matchlockignore file.
+	Exclude []string `json:"exclude,omitempty"`
+	// Case is how names that differ only in case are handled:
+	// MountCaseRejectCollisions or MountCaseFold. Unset, names are passed
+	// to the host as they are.
+	Case string `json:"case,omitempty"`
+	// IDMap shows the files of a real_fs or overlay mount's host directory
+	// as owned by a guest user rather than root.
+	IDMap *MountIDMap `json:"idmap,omitempty"`
+	// Unconfined lets a real_fs or overlay mount follow symlinks out of
+	// its host directory. By default every path is resolved within it, and
+	// a symlink leading out of it, such as one to /etc/passwd, is refused.
+	Unconfined bool `json:"unconfined,omitempty"`
+}
+
+// MountIDMap maps the owner of a mount's host files to a guest owner, for
+// tools that check ownership, such as git's safe.directory check. Files
+// owned by the host user and group show as UID and GID; files owned by
+// anyone else show as 65534 (nobody). The host user and group default to
+// the ones running matchlock. Only what the guest sees changes: its writes
+// still land on the host as the user running matchlock.
+type MountIDMap struct {
+	UID     uint32  `json:"uid"`
+	GID     uint32  `json:"gid"`
+	HostUID *uint32 `json:"host_uid,omitempty"`
+	HostGID *uint32 `json:"host_gid,omitempty"`
+}
+
+// MountAccess restricts what the guest may do with the paths in a mount, by
+// glob patterns matched against the path relative to the mount root. "**"
+// matches any number of directories, and a pattern without "/" matches a
+// name at any depth (".env" is "**/.env"). A pattern matching a directory
+// covers everything under it. A path may be read (or written) if an allow
+// pattern covers it, when there are any, and no deny pattern does.
+// Denied paths stay visible in listings; opening them fails with EACCES.
+type MountAccess struct {
+	AllowRead  []string `json:"allow_read,omitempty"`
+	DenyRead   []string `json:"deny_read,omitempty"`
+	AllowWrite []string `json:"allow_write,omitempty"`
+	DenyWrite  []string `json:"deny_write,omitempty"`
+}
+
+// GitMount is a repository cloned on the host, with the host's git
+// credentials, when the sandbox is created. The checkout is exposed at the
+// mount's guest path; if PushBranch is set, the commits the guest made on
+// top of Ref are pushed to that branch when the sandbox is closed.
+type GitMount struct {
+	URL        string `json:"url"`
+	Ref        string `json:"ref,omitempty"`   // Branch or tag to check out (default: the remote HEAD)
+	Depth      int    `json:"depth,omitempty"` // Shallow clone depth (0 = full history)
+	PushBranch string `json:"push_branch,omitempty"`
+}
+
+// CacheMount exposes a package cache shared by every sandbox that mounts
+// the same Name, kept on the host in ~/.cache/matchlock/caches. Files are
+// stored once by content, and sandboxes writing one concurrently each
+// replace it whole when they close it, so parallel sandboxes can fill and
+// use a pip, npm, Go module or model cache without downloading twice.
+type CacheMount struct {
+	Name string `json:"name"`
+}
+
+// S3Mount exposes the objects under Prefix in an S3 bucket (or an
+// S3-compatible store at Endpoint). Credentials come from the host's default
+// AWS credential chain and never enter the VM.
+type S3Mount struct {
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"` // e.g. a MinIO URL; uses path-style addressing
 }
 
 // GetWorkspace returns the workspace path from config, or default if not set
@@ -128,7 +318,6 @@ func DefaultConfig() *Config {
 		Resources: &Resources{
 			CPUs:           DefaultCPUs,
 			MemoryMB:       DefaultMemoryMB,
-			DiskSizeMB:     DefaultDiskSizeMB,
 			TimeoutSeconds: DefaultTimeoutSeconds,
 		},
 		Network: &NetworkConfig{
@@ -151,10 +340,16 @@ func (c *Config) Merge(other *Config) *Config {
 	if other.Image != "" {
 		result.Image = other.Image
 	}
+	if other.ImageDigest != "" {
+		result.ImageDigest = other.ImageDigest
+	}
 	if other.Resources != nil {
 		if result.Resources == nil {
 			result.Resources = &Resources{}
 		}
+		if other.Resources.Size != "" {
+			result.Resources.Size = other.Resources.Size
+		}
 		if other.Resources.CPUs > 0 {
 			result.Resources.CPUs = other.Resources.CPUs
 		}
@@ -164,6 +359,15 @@ func (c *Config) Merge(other *Config) *Config {
 		if other.Resources.DiskSizeMB > 0 {
 			result.Resources.DiskSizeMB = other.Resources.DiskSizeMB
 		}
+		if other.Resources.RootfsFreeSpaceMB > 0 {
+			result.Resources.RootfsFreeSpaceMB = other.Resources.RootfsFreeSpaceMB
+		}
+		if other.Resources.SwapMB > 0 {
+			result.Resources.SwapMB = other.Resources.SwapMB
+		}
+		if other.Resources.SwapType != "" {
+			result.Resources.SwapType = other.Resources.SwapType
+		}
 		if other.Resources.TimeoutSeconds > 0 {
 			result.Resources.TimeoutSeconds = other.Resources.TimeoutSeconds
 		}
@@ -177,12 +381,21 @@ func (c *Config) Merge(other *Config) *Config {
 	if other.Privileged {
 		result.Privileged = true
 	}
+	if other.Redact {
+		result.Redact = true
+	}
 	if other.Env != nil {
 		result.Env = other.Env
 	}
+	if other.Labels != nil {
+		result.Labels = other.Labels
+	}
 	if len(other.ExtraDisks) > 0 {
 		result.ExtraDisks = other.ExtraDisks
 	}
+	if len(other.DataDisks) > 0 {
+		result.DataDisks = other.DataDisks
+	}
 	if other.ImageCfg != nil {
 		result.ImageCfg = other.ImageCfg
 	}
@@ -78,3 +78,18 @@ func TestComposeCommand_RepeatedCallsConsistent(t *testing.T) {
 		assert.Equal(t, []string{"python3", "app.py"}, got)
 	}
 }
+
+func TestNetworkConfig_NeedsInterception(t *testing.T) {
+	var nilCfg *NetworkConfig
+	assert.False(t, nilCfg.NeedsInterception())
+	assert.False(t, (&NetworkConfig{BlockPrivateIPs: true}).NeedsInterception())
+	assert.True(t, (&NetworkConfig{AllowedHosts: []string{"example.com"}}).NeedsInterception())
+	assert.True(t, (&NetworkConfig{Secrets: map[string]Secret{"K": {Value: "v"}}}).NeedsInterception())
+	assert.True(t, (&NetworkConfig{HostPorts: []int{11434}}).NeedsInterception())
+	assert.True(t, (&NetworkConfig{MaxConnections: 10}).NeedsInterception())
+	assert.True(t, (&NetworkConfig{MaxConnectionsPerMinute: 60}).NeedsInterception())
+	assert.True(t, (&NetworkConfig{MaxEgressBytes: 1 << 20}).NeedsInterception())
+	assert.True(t, (&NetworkConfig{CertPins: map[string][]string{"example.com": {"sha256/x"}}}).NeedsInterception())
+	assert.True(t, (&NetworkConfig{UpstreamProxy: UpstreamProxySystem}).NeedsInterception())
+	assert.True(t, (&NetworkConfig{ProxyAutoConfigURL: "http://wpad/proxy.pac"}).NeedsInterception())
+}
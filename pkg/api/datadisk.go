@@ -0,0 +1,68 @@
+package api
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// DataDisk is a named ext4 disk kept on the host and attached to the
+// sandbox as a virtio-blk device, for workloads that need block device
+// performance rather than the VFS. The first sandbox attaching a disk
+// creates it SizeMB large (DefaultDataDiskSizeMB if zero), from a copy of
+// the ext4 image at From if set; later ones attach the same disk, grown if
+// they ask for more. A disk is kept until removed with 'matchlock disk rm',
+// and is attached by one sandbox at a time unless read-only.
+type DataDisk struct {
+	Name       string `json:"name"`
+	SizeMB     int64  `json:"size_mb,omitempty"`
+	From       string `json:"from,omitempty"`
+	GuestMount string `json:"guest_mount,omitempty"` // default /mnt/<name>
+	ReadOnly   bool   `json:"readonly,omitempty"`
+}
+
+// DefaultDataDiskSizeMB is the size of a data disk created without one.
+// Disk images are sparse, so space is only taken as it is written.
+const DefaultDataDiskSizeMB = 10 << 10
+
+// GetGuestMount returns where the disk is mounted in the guest.
+func (d DataDisk) GetGuestMount() string {
+	if d.GuestMount != "" {
+		return d.GuestMount
+	}
+	return "/mnt/" + d.Name
+}
+
+// ValidateDataDisks checks that each data disk is named once and mounted at
+// its own guest path outside the workspace, which the VFS is mounted over.
+func (c *Config) ValidateDataDisks() error {
+	workspace := filepath.Clean(c.GetWorkspace())
+	names := make(map[string]bool)
+	mounts := make(map[string]string)
+	for _, d := range c.DataDisks {
+		if d.Name == "" {
+			return errx.With(ErrInvalidDataDisk, ": missing name")
+		}
+		if names[d.Name] {
+			return errx.With(ErrInvalidDataDisk, ": %s attached twice", d.Name)
+		}
+		names[d.Name] = true
+		if d.SizeMB < 0 {
+			return errx.With(ErrInvalidDataDisk, ": %s: size %d MB is negative", d.Name, d.SizeMB)
+		}
+		mount := d.GetGuestMount()
+		if err := ValidateGuestMount(mount); err != nil {
+			return errx.With(ErrInvalidDataDisk, ": %s: %w", d.Name, err)
+		}
+		mount = filepath.Clean(mount)
+		if mount == workspace || strings.HasPrefix(mount, workspace+"/") || strings.HasPrefix(workspace, mount+"/") {
+			return errx.With(ErrInvalidDataDisk, ": %s: guest mount %s overlaps the workspace %s", d.Name, mount, workspace)
+		}
+		if other, ok := mounts[mount]; ok {
+			return errx.With(ErrInvalidDataDisk, ": %s and %s are both mounted at %s", other, d.Name, mount)
+		}
+		mounts[mount] = d.Name
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataDiskGetGuestMount(t *testing.T) {
+	assert.Equal(t, "/mnt/data", DataDisk{Name: "data"}.GetGuestMount())
+	assert.Equal(t, "/data", DataDisk{Name: "data", GuestMount: "/data"}.GetGuestMount())
+}
+
+func TestConfigValidateDataDisks(t *testing.T) {
+	tests := []struct {
+		name  string
+		disks []DataDisk
+		ok    bool
+	}{
+		{"none", nil, true},
+		{"default mounts", []DataDisk{{Name: "data", SizeMB: 1024}, {Name: "models", ReadOnly: true}}, true},
+		{"missing name", []DataDisk{{SizeMB: 1024}}, false},
+		{"attached twice", []DataDisk{{Name: "data"}, {Name: "data", ReadOnly: true}}, false},
+		{"negative size", []DataDisk{{Name: "data", SizeMB: -1}}, false},
+		{"relative mount", []DataDisk{{Name: "data", GuestMount: "data"}}, false},
+		{"in workspace", []DataDisk{{Name: "data", GuestMount: "/workspace/data"}}, false},
+		{"over workspace", []DataDisk{{Name: "data", GuestMount: "/"}}, false},
+		{"same mount", []DataDisk{{Name: "a", GuestMount: "/data"}, {Name: "b", GuestMount: "/data/"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&Config{DataDisks: tt.disks}).ValidateDataDisks()
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidDataDisk)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package api
+
+import "github.com/jingkaihe/matchlock/internal/errx"
+
+// Actions for NetworkConfig.EgressBudgetAction, taken once the guest has
+// sent MaxEgressBytes.
+const (
+	// EgressActionBlock refuses new connections and cuts off open ones. The
+	// sandbox keeps running. This is the default action.
+	EgressActionBlock = "block"
+	// EgressActionKill stops the sandbox.
+	EgressActionKill = "kill"
+)
+
+// Actions for NetworkConfig.SecretLeakAction, taken when the guest sends a
+// secret placeholder to a host the secret is not bound to.
+const (
+	// LeakActionBlock refuses the request. This is the default action.
+	LeakActionBlock = "block"
+	// LeakActionKill refuses the request and stops the sandbox, since a
+	// leak attempt suggests the agent inside has been compromised.
+	LeakActionKill = "kill"
+)
+
+// LeakAction returns the effective secret leak action.
+func (n *NetworkConfig) LeakAction() string {
+	if n == nil || n.SecretLeakAction == "" {
+		return LeakActionBlock
+	}
+	return n.SecretLeakAction
+}
+
+// EgressUsage reports how much of its egress byte budget a sandbox has used.
+type EgressUsage struct {
+	UsedBytes  int64 `json:"used_bytes"`
+	LimitBytes int64 `json:"limit_bytes"`
+	Exhausted  bool  `json:"exhausted"`
+}
+
+// EgressAction returns the effective budget action.
+func (n *NetworkConfig) EgressAction() string {
+	if n == nil || n.EgressBudgetAction == "" {
+		return EgressActionBlock
+	}
+	return n.EgressBudgetAction
+}
+
+// ValidateEgressBudget checks MaxEgressBytes and EgressBudgetAction.
+func (n *NetworkConfig) ValidateEgressBudget() error {
+	if n == nil {
+		return nil
+	}
+	if n.MaxEgressBytes < 0 {
+		return errx.With(ErrInvalidEgressBudget, ": %d bytes is negative", n.MaxEgressBytes)
+	}
+	switch n.EgressBudgetAction {
+	case "", EgressActionBlock, EgressActionKill:
+	default:
+		return errx.With(ErrInvalidEgressBudget, ": unknown action %q (want %q or %q)", n.EgressBudgetAction, EgressActionBlock, EgressActionKill)
+	}
+	if n.EgressBudgetAction != "" && n.MaxEgressBytes == 0 {
+		return errx.With(ErrInvalidEgressBudget, ": action %q needs a budget", n.EgressBudgetAction)
+	}
+	return nil
+}
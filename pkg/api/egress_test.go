@@ -0,0 +1,51 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkConfigEgressAction(t *testing.T) {
+	var none *NetworkConfig
+	assert.Equal(t, EgressActionBlock, none.EgressAction())
+	assert.Equal(t, EgressActionBlock, (&NetworkConfig{MaxEgressBytes: 1}).EgressAction())
+	assert.Equal(t, EgressActionKill, (&NetworkConfig{MaxEgressBytes: 1, EgressBudgetAction: EgressActionKill}).EgressAction())
+}
+
+func TestNetworkConfigValidateEgressBudget(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *NetworkConfig
+		ok   bool
+	}{
+		{"nil", nil, true},
+		{"disabled", &NetworkConfig{}, true},
+		{"block", &NetworkConfig{MaxEgressBytes: 1 << 20}, true},
+		{"kill", &NetworkConfig{MaxEgressBytes: 1 << 20, EgressBudgetAction: EgressActionKill}, true},
+		{"negative", &NetworkConfig{MaxEgressBytes: -1}, false},
+		{"unknown action", &NetworkConfig{MaxEgressBytes: 1, EgressBudgetAction: "pause"}, false},
+		{"action without budget", &NetworkConfig{EgressBudgetAction: EgressActionKill}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.ValidateEgressBudget()
+			if tt.ok {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrInvalidEgressBudget)
+		})
+	}
+}
+
+func TestNetworkConfigLeakAction(t *testing.T) {
+	var n *NetworkConfig
+	assert.Equal(t, LeakActionBlock, n.LeakAction())
+	assert.Equal(t, LeakActionBlock, (&NetworkConfig{}).LeakAction())
+	assert.Equal(t, LeakActionKill, (&NetworkConfig{SecretLeakAction: LeakActionKill}).LeakAction())
+
+	assert.NoError(t, (&NetworkConfig{SecretLeakAction: LeakActionKill}).ValidateSecrets())
+	assert.ErrorIs(t, (&NetworkConfig{SecretLeakAction: "ignore"}).ValidateSecrets(), ErrInvalidSecretLeakAction)
+}
@@ -6,6 +6,8 @@ var (
 	ErrBlocked        = errors.New("request blocked by policy")
 	ErrHostNotAllowed = errors.New("host not in allowlist")
 	ErrSecretLeak     = errors.New("secret placeholder sent to unauthorized host")
+	ErrSecretScope    = errors.New("secret placeholder sent outside its allowed paths or methods")
+	ErrScrubResponse  = errors.New("scrub secrets from response")
 	ErrVMNotRunning   = errors.New("VM is not running")
 	ErrVMNotFound     = errors.New("VM not found")
 	ErrTimeout        = errors.New("operation timed out")
@@ -17,4 +19,63 @@ var (
 	ErrUnknownMountOption  = errors.New("unknown option")
 	ErrGuestPathNotAbs     = errors.New("guest path must be absolute")
 	ErrGuestPathOutside    = errors.New("guest path must be within workspace")
+	ErrMountBackend        = errors.New("invalid mount backend")
+	ErrInvalidS3Mount      = errors.New("invalid s3 mount")
+	ErrInvalidGitMount     = errors.New("invalid git mount")
+	ErrInvalidMemoryMount  = errors.New("invalid memory mount")
+	ErrInvalidCacheMount   = errors.New("invalid cache mount")
+	ErrInvalidMountAccess  = errors.New("invalid mount access rules")
+	ErrMountCase           = errors.New("invalid mount case mode")
+	ErrInvalidMountExclude = errors.New("invalid mount exclude patterns")
+	ErrInvalidGlob         = errors.New("invalid pattern")
+	ErrInvalidMountIDMap   = errors.New("invalid mount idmap")
+	ErrInvalidOwner        = errors.New("invalid owner")
+	ErrMountUnconfined     = errors.New("invalid unconfined mount")
+
+	ErrInvalidNetShape = errors.New("invalid network shape")
+
+	ErrInvalidCertPin  = errors.New("invalid certificate pin")
+	ErrCertPinMismatch = errors.New("upstream certificate does not match pinned key")
+
+	ErrInvalidUpstreamTLS = errors.New("invalid upstream TLS options")
+	ErrUpstreamRootCA     = errors.New("load upstream root CA")
+
+	ErrInvalidUpstreamProxy = errors.New("invalid upstream proxy")
+
+	ErrWorkingDir = errors.New("invalid working directory")
+
+	ErrInvalidSwap = errors.New("invalid swap config")
+
+	ErrInvalidDataDisk = errors.New("invalid data disk")
+
+	ErrInvalidEgressBudget = errors.New("invalid egress budget")
+
+	ErrInvalidKeyValue = errors.New("expected format KEY=VALUE")
+	ErrTemplate        = errors.New("invalid template")
+
+	ErrInvalidSecretLocation   = errors.New("invalid secret location")
+	ErrInvalidSecretScope      = errors.New("invalid secret scope")
+	ErrInvalidSecretHeader     = errors.New("invalid secret header")
+	ErrInvalidSecretTTL        = errors.New("invalid secret TTL")
+	ErrInvalidOAuth2           = errors.New("invalid OAuth2 secret")
+	ErrOAuth2Token             = errors.New("acquire OAuth2 access token")
+	ErrInvalidGitHubApp        = errors.New("invalid GitHub App secret")
+	ErrGitHubAppToken          = errors.New("acquire GitHub App installation token")
+	ErrServiceAccountKey       = errors.New("invalid service account key")
+	ErrReadSecretFile          = errors.New("read secret file")
+	ErrInvalidSecretFile       = errors.New("invalid secret file")
+	ErrInvalidSecretHostMap    = errors.New("invalid secret host map")
+	ErrUnknownSecretProfile    = errors.New("unknown secret profile")
+	ErrDiscoverSecrets         = errors.New("discover secrets from environment")
+	ErrUnknownSecret           = errors.New("unknown secret")
+	ErrRotateSecret            = errors.New("cannot rotate secret")
+	ErrSecretExpired           = errors.New("secret expired")
+	ErrInvalidRequestSigning   = errors.New("invalid request signing")
+	ErrSignRequest             = errors.New("sign request")
+	ErrInvalidSecretLeakAction = errors.New("invalid secret leak action")
+
+	ErrHostPortNotAllowed = errors.New("host port not allowed")
+	ErrConnLimit          = errors.New("concurrent connection limit reached")
+	ErrConnRateLimit      = errors.New("connection rate limit reached")
+	ErrEgressBudget       = errors.New("egress byte budget exhausted")
 )
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// DefaultGCPHost is where service account tokens are sent unless a secret
+// names its own hosts.
+const DefaultGCPHost = "*.googleapis.com"
+
+// DefaultGCPTokenURL is used for keys that do not carry a token_uri.
+const DefaultGCPTokenURL = "https://oauth2.googleapis.com/token"
+
+// DefaultGCPScopes are requested for access tokens when none are configured.
+var DefaultGCPScopes = []string{"https://www.googleapis.com/auth/cloud-platform"}
+
+// ServiceAccountKey is the part of a Google Cloud service account key file
+// needed to mint tokens.
+type ServiceAccountKey struct {
+	Type         string `json:"type"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+
+	// Signer is the parsed PrivateKey.
+	Signer *rsa.PrivateKey `json:"-"`
+}
+
+// ParseServiceAccountKey parses and checks a service account key file.
+func ParseServiceAccountKey(data string) (*ServiceAccountKey, error) {
+	var key ServiceAccountKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return nil, errx.Wrap(ErrServiceAccountKey, err)
+	}
+	if key.Type != "service_account" {
+		return nil, errx.With(ErrServiceAccountKey, ": type is %q, want service_account", key.Type)
+	}
+	if key.ClientEmail == "" {
+		return nil, errx.With(ErrServiceAccountKey, ": no client_email")
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errx.With(ErrServiceAccountKey, ": private_key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errx.With(ErrServiceAccountKey, ": private_key: %w", err)
+	}
+	signer, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errx.With(ErrServiceAccountKey, ": private_key is not an RSA key")
+	}
+	key.Signer = signer
+	if key.TokenURI == "" {
+		key.TokenURI = DefaultGCPTokenURL
+	}
+	return &key, nil
+}
+
+// ParseGCPSecret parses a Google Cloud service account secret in the format
+// "NAME=KEY_FILE@host1,host2". Without KEY_FILE the key is read from
+// $GOOGLE_APPLICATION_CREDENTIALS, and without hosts tokens go to
+// DefaultGCPHost. Methods and host paths scope it as in ParseSecret.
+// $NAME_SCOPES (space separated) overrides the scopes, and $NAME_AUDIENCE
+// mints ID tokens for that audience instead of access tokens.
+func ParseGCPSecret(s string) (string, Secret, error) {
+	nameKey, hosts := s, DefaultGCPHost
+	if atIdx := strings.LastIndex(s, "@"); atIdx != -1 {
+		nameKey, hosts = s[:atIdx], s[atIdx+1:]
+	}
+	if !strings.Contains(nameKey, "=") {
+		path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		if path == "" {
+			return "", Secret{}, fmt.Errorf("no key file given and $GOOGLE_APPLICATION_CREDENTIALS is not set (format: NAME=KEY_FILE@host1,host2)")
+		}
+		nameKey += "=" + path
+	}
+	name, secret, err := ParseSecret(nameKey + "@" + hosts)
+	if err != nil {
+		return "", Secret{}, err
+	}
+
+	key, err := os.ReadFile(secret.Value)
+	if err != nil {
+		return "", Secret{}, errx.Wrap(ErrServiceAccountKey, err)
+	}
+	secret.OAuth2 = &OAuth2{
+		ServiceAccount: string(key),
+		Scopes:         strings.Fields(os.Getenv(name + "_SCOPES")),
+		Audience:       os.Getenv(name + "_AUDIENCE"),
+	}
+	secret.Value = ""
+	if err := validateOAuth2(secret); err != nil {
+		return "", Secret{}, err
+	}
+	return name, secret, nil
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testServiceAccountKey(t *testing.T) string {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	key, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"private_key_id": "kid-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "agent@project.iam.gserviceaccount.com",
+	})
+	require.NoError(t, err)
+	return string(key)
+}
+
+func TestParseServiceAccountKey(t *testing.T) {
+	key, err := ParseServiceAccountKey(testServiceAccountKey(t))
+	require.NoError(t, err)
+	assert.Equal(t, "agent@project.iam.gserviceaccount.com", key.ClientEmail)
+	assert.Equal(t, DefaultGCPTokenURL, key.TokenURI)
+	assert.NotNil(t, key.Signer)
+
+	for _, bad := range []string{
+		`not json`,
+		`{"type":"authorized_user","client_email":"a@b","private_key":"x"}`,
+		`{"type":"service_account","private_key":"x"}`,
+		`{"type":"service_account","client_email":"a@b","private_key":"not pem"}`,
+	} {
+		_, err := ParseServiceAccountKey(bad)
+		assert.ErrorIs(t, err, ErrServiceAccountKey, bad)
+	}
+}
+
+func TestParseGCPSecret(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "sa.json")
+	require.NoError(t, os.WriteFile(keyFile, []byte(testServiceAccountKey(t)), 0600))
+
+	name, secret, err := ParseGCPSecret("VERTEX=" + keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "VERTEX", name)
+	assert.Equal(t, []string{DefaultGCPHost}, secret.Hosts)
+	assert.Empty(t, secret.Value)
+	require.NotNil(t, secret.OAuth2)
+	assert.NotEmpty(t, secret.OAuth2.ServiceAccount)
+	assert.Empty(t, secret.OAuth2.Audience)
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", keyFile)
+	t.Setenv("RUN_AUDIENCE", "https://svc.a.run.app")
+	name, secret, err = ParseGCPSecret("RUN:POST@svc.a.run.app")
+	require.NoError(t, err)
+	assert.Equal(t, "RUN", name)
+	assert.Equal(t, []string{"svc.a.run.app"}, secret.Hosts)
+	assert.Equal(t, []string{"POST"}, secret.Methods)
+	assert.Equal(t, "https://svc.a.run.app", secret.OAuth2.Audience)
+
+	_, _, err = ParseGCPSecret("VERTEX=" + filepath.Join(t.TempDir(), "missing.json"))
+	assert.ErrorIs(t, err, ErrServiceAccountKey)
+
+	require.NoError(t, os.WriteFile(keyFile, []byte(`{"type":"authorized_user"}`), 0600))
+	_, _, err = ParseGCPSecret("VERTEX=" + keyFile)
+	assert.ErrorIs(t, err, ErrInvalidOAuth2)
+}
+
+func TestValidateOAuth2_ServiceAccount(t *testing.T) {
+	key := testServiceAccountKey(t)
+	secret := Secret{OAuth2: &OAuth2{ServiceAccount: key, Audience: "https://svc.a.run.app"}}
+	assert.NoError(t, validateOAuth2(secret))
+
+	secret.OAuth2.RefreshToken = "r"
+	assert.ErrorIs(t, validateOAuth2(secret), ErrInvalidOAuth2)
+
+	secret = Secret{OAuth2: &OAuth2{TokenURL: "https://login.example.com/token", ClientID: "c", Audience: "x"}}
+	assert.ErrorIs(t, validateOAuth2(secret), ErrInvalidOAuth2, "audience needs a service account")
+}
+
+func TestParseSecretFileGCP(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "sa.json")
+	require.NoError(t, os.WriteFile(keyFile, []byte(testServiceAccountKey(t)), 0600))
+
+	secrets, err := ParseSecretFile([]byte(`
+secrets:
+  VERTEX:
+    gcp:
+      key_file: ` + keyFile + `
+      scopes: [https://www.googleapis.com/auth/cloud-platform.read-only]
+`))
+	require.NoError(t, err)
+	secret := secrets["VERTEX"]
+	assert.Equal(t, []string{DefaultGCPHost}, secret.Hosts)
+	require.NotNil(t, secret.OAuth2)
+	assert.NotEmpty(t, secret.OAuth2.ServiceAccount)
+	assert.Equal(t, []string{"https://www.googleapis.com/auth/cloud-platform.read-only"}, secret.OAuth2.Scopes)
+
+	_, err = ParseSecretFile([]byte("secrets:\n  VERTEX:\n    gcp: {}\n"))
+	assert.ErrorIs(t, err, ErrInvalidSecretFile)
+}
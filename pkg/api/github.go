@@ -0,0 +1,138 @@
+package api
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// DefaultGitHubAppHosts are where installation tokens are sent unless a
+// secret names its own hosts.
+var DefaultGitHubAppHosts = []string{"api.github.com", "uploads.github.com"}
+
+// DefaultGitHubAPIURL is the API that mints installation tokens unless
+// GitHubApp.APIURL points at GitHub Enterprise Server.
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// GitHubApp turns a secret into a GitHub App installation: the proxy signs
+// a JWT with PrivateKey, exchanges it for an installation access token,
+// caches the token until shortly before it expires (after an hour), and
+// sends it as "Authorization: Bearer" on requests to the secret's hosts.
+// Repositories and Permissions narrow the token below what the
+// installation was granted. The guest never sees the key or the tokens.
+type GitHubApp struct {
+	AppID          int64             `json:"app_id"`
+	InstallationID int64             `json:"installation_id"`
+	PrivateKey     string            `json:"private_key"`
+	APIURL         string            `json:"api_url,omitempty"`
+	Repositories   []string          `json:"repositories,omitempty"`
+	Permissions    map[string]string `json:"permissions,omitempty"`
+}
+
+// MintsTokens reports whether the proxy mints the secret's tokens itself
+// rather than substituting a static value. Such secrets are always sent in
+// the Authorization header and cannot be rotated.
+func (s Secret) MintsTokens() bool {
+	return s.OAuth2 != nil || s.GitHubApp != nil
+}
+
+// ParseGitHubAppPrivateKey parses the PEM private key GitHub issues for an
+// app.
+func ParseGitHubAppPrivateKey(key string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, errx.With(ErrInvalidGitHubApp, ": private key is not PEM encoded")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errx.With(ErrInvalidGitHubApp, ": private key: %w", err)
+	}
+	k, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errx.With(ErrInvalidGitHubApp, ": private key is not an RSA key")
+	}
+	return k, nil
+}
+
+// ParseGitHubAppSecret parses a GitHub App secret in the format
+// "NAME=APP_ID:INSTALLATION_ID:KEY_FILE@host1,host2". Without hosts, tokens
+// go to DefaultGitHubAppHosts. Methods and host paths scope it as in
+// ParseSecret.
+func ParseGitHubAppSecret(s string) (string, Secret, error) {
+	spec, hosts := s, strings.Join(DefaultGitHubAppHosts, ",")
+	if atIdx := strings.LastIndex(s, "@"); atIdx != -1 {
+		spec, hosts = s[:atIdx], s[atIdx+1:]
+	}
+	if !strings.Contains(spec, "=") {
+		return "", Secret{}, fmt.Errorf("missing app (format: NAME=APP_ID:INSTALLATION_ID:KEY_FILE@host1,host2)")
+	}
+	name, secret, err := ParseSecret(spec + "@" + hosts)
+	if err != nil {
+		return "", Secret{}, err
+	}
+
+	parts := strings.SplitN(secret.Value, ":", 3)
+	if len(parts) != 3 {
+		return "", Secret{}, errx.With(ErrInvalidGitHubApp, ": %q is not APP_ID:INSTALLATION_ID:KEY_FILE", secret.Value)
+	}
+	appID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", Secret{}, errx.With(ErrInvalidGitHubApp, ": app ID %q", parts[0])
+	}
+	installationID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", Secret{}, errx.With(ErrInvalidGitHubApp, ": installation ID %q", parts[1])
+	}
+	key, err := os.ReadFile(parts[2])
+	if err != nil {
+		return "", Secret{}, errx.Wrap(ErrInvalidGitHubApp, err)
+	}
+	if _, err := ParseGitHubAppPrivateKey(string(key)); err != nil {
+		return "", Secret{}, err
+	}
+
+	secret.Value = ""
+	secret.GitHubApp = &GitHubApp{AppID: appID, InstallationID: installationID, PrivateKey: string(key)}
+	if err := validateGitHubApp(secret); err != nil {
+		return "", Secret{}, err
+	}
+	return name, secret, nil
+}
+
+// validateGitHubApp checks the app of a secret. The private key may still
+// be a secret store reference, so it is only parsed when tokens are minted.
+func validateGitHubApp(secret Secret) error {
+	g := secret.GitHubApp
+	if g == nil {
+		return nil
+	}
+	if secret.OAuth2 != nil {
+		return errx.With(ErrInvalidGitHubApp, ": a secret cannot be both an OAuth2 client and a GitHub App")
+	}
+	if g.AppID <= 0 || g.InstallationID <= 0 {
+		return errx.With(ErrInvalidGitHubApp, ": app ID and installation ID are required")
+	}
+	if g.PrivateKey == "" {
+		return errx.With(ErrInvalidGitHubApp, ": private key is required")
+	}
+	if g.APIURL != "" {
+		u, err := url.Parse(g.APIURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errx.With(ErrInvalidGitHubApp, ": API URL %q must be an http(s) URL", g.APIURL)
+		}
+	}
+	if len(secret.In) > 0 || secret.Header != "" {
+		return errx.With(ErrInvalidGitHubApp, ": tokens are always sent in the Authorization header")
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testGitHubAppKey(t *testing.T) string {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}))
+}
+
+func TestParseGitHubAppSecret(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "app.pem")
+	require.NoError(t, os.WriteFile(keyFile, []byte(testGitHubAppKey(t)), 0600))
+
+	name, secret, err := ParseGitHubAppSecret("GH=7:42:" + keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "GH", name)
+	assert.Empty(t, secret.Value)
+	assert.Equal(t, DefaultGitHubAppHosts, secret.Hosts)
+	require.NotNil(t, secret.GitHubApp)
+	assert.Equal(t, int64(7), secret.GitHubApp.AppID)
+	assert.Equal(t, int64(42), secret.GitHubApp.InstallationID)
+	assert.True(t, secret.MintsTokens())
+
+	_, secret, err = ParseGitHubAppSecret("GH:GET=7:42:" + keyFile + "@ghe.example.com/api/v3")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ghe.example.com"}, secret.Hosts)
+	assert.Equal(t, []string{"/api/v3"}, secret.Paths)
+	assert.Equal(t, []string{"GET"}, secret.Methods)
+}
+
+func TestParseGitHubAppSecretErrors(t *testing.T) {
+	notKey := filepath.Join(t.TempDir(), "not.pem")
+	require.NoError(t, os.WriteFile(notKey, []byte("nope"), 0600))
+
+	for _, s := range []string{
+		"GH@api.github.com",
+		"GH=7:" + notKey,
+		"GH=app:42:" + notKey,
+		"GH=7:42:/does/not/exist",
+		"GH=7:42:" + notKey,
+	} {
+		_, _, err := ParseGitHubAppSecret(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestValidateSecrets_GitHubApp(t *testing.T) {
+	key := testGitHubAppKey(t)
+	for name, secret := range map[string]Secret{
+		"no installation": {Hosts: []string{"api.github.com"}, GitHubApp: &GitHubApp{AppID: 7, PrivateKey: key}},
+		"no key":          {Hosts: []string{"api.github.com"}, GitHubApp: &GitHubApp{AppID: 7, InstallationID: 42}},
+		"header":          {Hosts: []string{"api.github.com"}, Header: "X-Token: {value}", GitHubApp: &GitHubApp{AppID: 7, InstallationID: 42, PrivateKey: key}},
+		"bad api url":     {Hosts: []string{"api.github.com"}, GitHubApp: &GitHubApp{AppID: 7, InstallationID: 42, PrivateKey: key, APIURL: "ftp://x"}},
+		"also oauth2":     {Hosts: []string{"api.github.com"}, OAuth2: &OAuth2{TokenURL: "https://x/token", ClientID: "c"}, GitHubApp: &GitHubApp{AppID: 7, InstallationID: 42, PrivateKey: key}},
+	} {
+		n := &NetworkConfig{Secrets: map[string]Secret{"GH": secret}}
+		assert.ErrorIs(t, n.ValidateSecrets(), ErrInvalidGitHubApp, name)
+	}
+}
+
+func TestParseSecretFile_GitHubApp(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "app.pem")
+	require.NoError(t, os.WriteFile(keyFile, []byte(testGitHubAppKey(t)), 0600))
+
+	secrets, err := ParseSecretFile([]byte(`
+secrets:
+  GH:
+    github_app:
+      app_id: 7
+      installation_id: 42
+      key_file: ` + keyFile + `
+      repositories: [matchlock]
+      permissions:
+        contents: read
+`))
+	require.NoError(t, err)
+	gh := secrets["GH"]
+	assert.Equal(t, DefaultGitHubAppHosts, gh.Hosts)
+	require.NotNil(t, gh.GitHubApp)
+	assert.Equal(t, []string{"matchlock"}, gh.GitHubApp.Repositories)
+	assert.Equal(t, map[string]string{"contents": "read"}, gh.GitHubApp.Permissions)
+	assert.NotEmpty(t, gh.GitHubApp.PrivateKey)
+
+	_, err = ParseSecretFile([]byte(`
+secrets:
+  GH:
+    oauth2: {token_url: "https://x/token", client_id: c}
+    github_app: {app_id: 7, installation_id: 42, private_key: "aws-sm:app"}
+`))
+	assert.ErrorIs(t, err, ErrInvalidSecretFile)
+}
@@ -2,8 +2,11 @@ package api
 
 import (
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jingkaihe/matchlock/internal/errx"
 )
@@ -59,6 +62,35 @@ func ParseVolumeMount(vol string, workspace string) (hostPath, guestPath string,
 	return hostPath, guestPath, readonly, nil
 }
 
+// Modes for MountConfig.Case, for host directories on case-insensitive
+// volumes such as macOS's default APFS mounted into a case-sensitive guest.
+const (
+	// MountCaseRejectCollisions fails creating a name that differs only in
+	// case from an existing one, which the host would merge into it.
+	MountCaseRejectCollisions = "reject-collisions"
+	// MountCaseFold resolves names ignoring case, emulating a
+	// case-insensitive filesystem whatever the host volume is.
+	MountCaseFold = "fold"
+)
+
+// ValidateMountCase checks that every mount's case mode is known and set
+// only on mounts served through the VFS, which applies it.
+func ValidateMountCase(mounts map[string]MountConfig) error {
+	for guestPath, m := range mounts {
+		switch m.Case {
+		case "":
+			continue
+		case MountCaseRejectCollisions, MountCaseFold:
+		default:
+			return errx.With(ErrMountCase, ": %s: unknown mode %q (want %q or %q)", guestPath, m.Case, MountCaseRejectCollisions, MountCaseFold)
+		}
+		if m.Backend == MountBackendVirtioFS {
+			return errx.With(ErrMountCase, ": %s: not applied on %s mounts", guestPath, MountBackendVirtioFS)
+		}
+	}
+	return nil
+}
+
 // ValidateGuestPathWithinWorkspace checks that guestPath is absolute and inside workspace.
 func ValidateGuestPathWithinWorkspace(guestPath string, workspace string) error {
 	cleanGuestPath := filepath.Clean(guestPath)
@@ -73,6 +105,399 @@ func ValidateGuestPathWithinWorkspace(guestPath string, workspace string) error
 	return nil
 }
 
+// Backends for MountConfig.Backend.
+const (
+	// MountBackendFUSE serves the mount through the guest's FUSE daemon.
+	MountBackendFUSE = "fuse"
+	// MountBackendVirtioFS shares the host directory with the guest kernel
+	// over virtio-fs, bypassing the FUSE daemon. Backends without virtio-fs
+	// fall back to MountBackendFUSE.
+	MountBackendVirtioFS = "virtiofs"
+)
+
+// ValidateMountBackends checks that every mount's backend is known and that
+// virtio-fs is only asked of real_fs mounts, the only ones with a host
+// directory to share.
+func ValidateMountBackends(mounts map[string]MountConfig) error {
+	for guestPath, m := range mounts {
+		switch m.Backend {
+		case "", MountBackendFUSE:
+		case MountBackendVirtioFS:
+			if m.Type != "real_fs" || m.HostPath == "" {
+				return errx.With(ErrMountBackend, ": %s: %s needs a real_fs mount, not %q", guestPath, m.Backend, m.Type)
+			}
+		default:
+			return errx.With(ErrMountBackend, ": %s: unknown backend %q (want %q or %q)", guestPath, m.Backend, MountBackendFUSE, MountBackendVirtioFS)
+		}
+	}
+	return nil
+}
+
+// S3URLScheme prefixes the bucket of an s3 mount spec.
+const S3URLScheme = "s3://"
+
+// ParseS3Mount parses an s3 mount spec in format "s3://bucket[/prefix]:guest"
+// or "s3://bucket[/prefix]:guest:ro". Guest paths resolve as in
+// ParseVolumeMount.
+func ParseS3Mount(spec string, workspace string) (guestPath string, mount MountConfig, err error) {
+	rest, ok := strings.CutPrefix(spec, S3URLScheme)
+	if !ok {
+		return "", MountConfig{}, errx.With(ErrInvalidS3Mount, ": %q must start with %s", spec, S3URLScheme)
+	}
+	parts := strings.Split(rest, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", MountConfig{}, errx.With(ErrInvalidS3Mount, ": %q (want s3://bucket[/prefix]:guest[:ro])", spec)
+	}
+
+	bucket, prefix, _ := strings.Cut(parts[0], "/")
+	mount = MountConfig{Type: "s3", S3: &S3Mount{Bucket: bucket, Prefix: strings.Trim(prefix, "/")}}
+	if len(parts) == 3 {
+		if parts[2] != "ro" && parts[2] != "readonly" {
+			return "", MountConfig{}, errx.With(ErrUnknownMountOption, " %q (use 'ro' for readonly)", parts[2])
+		}
+		mount.Readonly = true
+	}
+
+	guestPath = parts[1]
+	cleanWorkspace := filepath.Clean(workspace)
+	if !filepath.IsAbs(guestPath) {
+		guestPath = filepath.Join(cleanWorkspace, guestPath)
+	} else {
+		guestPath = filepath.Clean(guestPath)
+	}
+	if err := ValidateGuestPathWithinWorkspace(guestPath, cleanWorkspace); err != nil {
+		return "", MountConfig{}, err
+	}
+	if err := ValidateS3Mounts(map[string]MountConfig{guestPath: mount}); err != nil {
+		return "", MountConfig{}, err
+	}
+	return guestPath, mount, nil
+}
+
+// ValidateS3Mounts checks that every s3 mount names a bucket.
+func ValidateS3Mounts(mounts map[string]MountConfig) error {
+	for guestPath, m := range mounts {
+		if m.Type != "s3" {
+			continue
+		}
+		if m.S3 == nil || m.S3.Bucket == "" {
+			return errx.With(ErrInvalidS3Mount, ": %s: bucket is required", guestPath)
+		}
+		if strings.ContainsAny(m.S3.Bucket, "/:") {
+			return errx.With(ErrInvalidS3Mount, ": %s: bucket %q", guestPath, m.S3.Bucket)
+		}
+	}
+	return nil
+}
+
+// ParseGitMount parses a git mount spec in format "guest=url" or
+// "guest=url#ref". Guest paths resolve as in ParseVolumeMount.
+func ParseGitMount(spec string, workspace string) (guestPath string, mount MountConfig, err error) {
+	guestPath, repo, ok := strings.Cut(spec, "=")
+	if !ok || guestPath == "" || repo == "" {
+		return "", MountConfig{}, errx.With(ErrInvalidGitMount, ": %q (want guest=url[#ref])", spec)
+	}
+	url, ref, _ := strings.Cut(repo, "#")
+	mount = MountConfig{Type: "git", Git: &GitMount{URL: url, Ref: ref}}
+
+	cleanWorkspace := filepath.Clean(workspace)
+	if !filepath.IsAbs(guestPath) {
+		guestPath = filepath.Join(cleanWorkspace, guestPath)
+	} else {
+		guestPath = filepath.Clean(guestPath)
+	}
+	if err := ValidateGuestPathWithinWorkspace(guestPath, cleanWorkspace); err != nil {
+		return "", MountConfig{}, err
+	}
+	if err := ValidateGitMounts(map[string]MountConfig{guestPath: mount}); err != nil {
+		return "", MountConfig{}, err
+	}
+	return guestPath, mount, nil
+}
+
+// ValidateGitMounts checks that every git mount names a repository, and that
+// refs and push branches cannot be mistaken for git options.
+func ValidateGitMounts(mounts map[string]MountConfig) error {
+	for guestPath, m := range mounts {
+		if m.Type != "git" {
+			continue
+		}
+		if m.Git == nil || m.Git.URL == "" {
+			return errx.With(ErrInvalidGitMount, ": %s: url is required", guestPath)
+		}
+		if strings.HasPrefix(m.Git.URL, "-") {
+			return errx.With(ErrInvalidGitMount, ": %s: url %q", guestPath, m.Git.URL)
+		}
+		if m.Git.Depth < 0 {
+			return errx.With(ErrInvalidGitMount, ": %s: depth %d", guestPath, m.Git.Depth)
+		}
+		for _, name := range []string{m.Git.Ref, m.Git.PushBranch} {
+			if strings.HasPrefix(name, "-") || strings.ContainsAny(name, " ~^:?*[\\") || strings.Contains(name, "..") {
+				return errx.With(ErrInvalidGitMount, ": %s: invalid ref %q", guestPath, name)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseCacheMount parses a cache mount spec in format "NAME:guest". Guest
+// paths resolve as in ParseVolumeMount.
+func ParseCacheMount(spec string, workspace string) (guestPath string, mount MountConfig, err error) {
+	name, guestPath, ok := strings.Cut(spec, ":")
+	if !ok || name == "" || guestPath == "" {
+		return "", MountConfig{}, errx.With(ErrInvalidCacheMount, ": %q (want NAME:guest)", spec)
+	}
+	mount = MountConfig{Type: "cache", Cache: &CacheMount{Name: name}}
+
+	cleanWorkspace := filepath.Clean(workspace)
+	if !filepath.IsAbs(guestPath) {
+		guestPath = filepath.Join(cleanWorkspace, guestPath)
+	} else {
+		guestPath = filepath.Clean(guestPath)
+	}
+	if err := ValidateGuestPathWithinWorkspace(guestPath, cleanWorkspace); err != nil {
+		return "", MountConfig{}, err
+	}
+	return guestPath, mount, nil
+}
+
+// ValidateCacheMounts checks that every cache mount names its cache and
+// that cache names are only set on cache mounts, which are served through
+// the VFS.
+func ValidateCacheMounts(mounts map[string]MountConfig) error {
+	for guestPath, m := range mounts {
+		if m.Type != "cache" {
+			if m.Cache != nil {
+				return errx.With(ErrInvalidCacheMount, ": %s: cache needs a cache mount, not %q", guestPath, m.Type)
+			}
+			continue
+		}
+		if m.Cache == nil || m.Cache.Name == "" {
+			return errx.With(ErrInvalidCacheMount, ": %s: name is required", guestPath)
+		}
+		if m.Backend == MountBackendVirtioFS {
+			return errx.With(ErrInvalidCacheMount, ": %s: not served over %s", guestPath, MountBackendVirtioFS)
+		}
+	}
+	return nil
+}
+
+// MountUsage reports how much of its size limit a mount holds.
+type MountUsage struct {
+	Path       string `json:"path"`
+	UsedBytes  int64  `json:"used_bytes"`
+	LimitBytes int64  `json:"limit_bytes,omitempty"` // 0 = unbounded
+}
+
+// VFSLatencyBounds are the upper bounds of the latency buckets of
+// VFSOpMetrics.
+var VFSLatencyBounds = []time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// MountMetrics counts the filesystem operations the guest made on a mount.
+type MountMetrics struct {
+	Path string         `json:"path"`
+	Ops  []VFSOpMetrics `json:"ops"`
+}
+
+// VFSOpMetrics counts the operations of one kind (read, write, lookup...)
+// on a mount. Latency[i] counts those that took at most VFSLatencyBounds[i],
+// and its last entry those that took longer.
+type VFSOpMetrics struct {
+	Op      string  `json:"op"`
+	Count   int64   `json:"count"`
+	Errors  int64   `json:"errors,omitempty"`
+	Bytes   int64   `json:"bytes,omitempty"`
+	TotalUS int64   `json:"total_us"`
+	MaxUS   int64   `json:"max_us"`
+	Latency []int64 `json:"latency"`
+}
+
+// SlowVFSOp is an entry of the slow-operation log, vfs_slow.log.
+type SlowVFSOp struct {
+	Time       time.Time `json:"time"`
+	Mount      string    `json:"mount"`
+	Op         string    `json:"op"`
+	Path       string    `json:"path"`
+	DurationUS int64     `json:"duration_us"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	Errno      int32     `json:"errno,omitempty"`
+}
+
+// ParseMemoryMount parses a memory mount spec in format "guest" or
+// "guest:SIZE_MB". Guest paths resolve as in ParseVolumeMount.
+func ParseMemoryMount(spec string, workspace string) (guestPath string, mount MountConfig, err error) {
+	guestPath, size, hasSize := strings.Cut(spec, ":")
+	if guestPath == "" {
+		return "", MountConfig{}, errx.With(ErrInvalidMemoryMount, ": %q (want guest[:SIZE_MB])", spec)
+	}
+	mount = MountConfig{Type: "memory"}
+	if hasSize {
+		mount.SizeMB, err = strconv.Atoi(size)
+		if err != nil || mount.SizeMB <= 0 {
+			return "", MountConfig{}, errx.With(ErrInvalidMemoryMount, ": %q: size must be a positive number of MB", spec)
+		}
+	}
+
+	cleanWorkspace := filepath.Clean(workspace)
+	if !filepath.IsAbs(guestPath) {
+		guestPath = filepath.Join(cleanWorkspace, guestPath)
+	} else {
+		guestPath = filepath.Clean(guestPath)
+	}
+	if err := ValidateGuestPathWithinWorkspace(guestPath, cleanWorkspace); err != nil {
+		return "", MountConfig{}, err
+	}
+	return guestPath, mount, nil
+}
+
+// ValidateMemoryMounts checks that size limits are only set, and are
+// non-negative, on memory mounts.
+func ValidateMemoryMounts(mounts map[string]MountConfig) error {
+	for guestPath, m := range mounts {
+		if m.SizeMB < 0 {
+			return errx.With(ErrInvalidMemoryMount, ": %s: size_mb %d", guestPath, m.SizeMB)
+		}
+		if m.SizeMB > 0 && m.Type != "memory" {
+			return errx.With(ErrInvalidMemoryMount, ": %s: size_mb needs a memory mount, not %q", guestPath, m.Type)
+		}
+	}
+	return nil
+}
+
+// ValidateMountAccess checks that access patterns are well formed and only
+// set on mounts served through the VFS, which enforces them; a virtio-fs
+// share bypasses it.
+func ValidateMountAccess(mounts map[string]MountConfig) error {
+	for guestPath, m := range mounts {
+		if m.Access == nil {
+			continue
+		}
+		if m.Backend == MountBackendVirtioFS {
+			return errx.With(ErrInvalidMountAccess, ": %s: not enforced on %s mounts", guestPath, MountBackendVirtioFS)
+		}
+		for _, patterns := range [][]string{m.Access.AllowRead, m.Access.DenyRead, m.Access.AllowWrite, m.Access.DenyWrite} {
+			if err := validateGlobs(patterns); err != nil {
+				return errx.With(ErrInvalidMountAccess, ": %s: %w", guestPath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateMountExclude checks that exclude patterns are well formed and only
+// set on the host directories of real_fs and overlay mounts served through
+// the VFS, which hides them.
+func ValidateMountExclude(mounts map[string]MountConfig) error {
+	for guestPath, m := range mounts {
+		if len(m.Exclude) == 0 {
+			continue
+		}
+		if (m.Type != "real_fs" && m.Type != "overlay") || m.HostPath == "" {
+			return errx.With(ErrInvalidMountExclude, ": %s: needs a real_fs or overlay mount of a host directory, not %q", guestPath, m.Type)
+		}
+		if m.Backend == MountBackendVirtioFS {
+			return errx.With(ErrInvalidMountExclude, ": %s: not applied on %s mounts", guestPath, MountBackendVirtioFS)
+		}
+		if err := validateGlobs(m.Exclude); err != nil {
+			return errx.With(ErrInvalidMountExclude, ": %s: %w", guestPath, err)
+		}
+	}
+	return nil
+}
+
+// ParseMountIDMap parses an idmap spec "UID:GID", mapping the user running
+// matchlock, or "UID:GID=HOST_UID:HOST_GID".
+func ParseMountIDMap(spec string) (*MountIDMap, error) {
+	guest, host, hasHost := strings.Cut(spec, "=")
+	uid, gid, err := parseOwner(guest)
+	if err != nil {
+		return nil, errx.With(ErrInvalidMountIDMap, " %q: %w", spec, err)
+	}
+	idmap := &MountIDMap{UID: uid, GID: gid}
+	if hasHost {
+		hostUID, hostGID, err := parseOwner(host)
+		if err != nil {
+			return nil, errx.With(ErrInvalidMountIDMap, " %q: %w", spec, err)
+		}
+		idmap.HostUID, idmap.HostGID = &hostUID, &hostGID
+	}
+	return idmap, nil
+}
+
+// parseOwner parses "UID:GID".
+func parseOwner(s string) (uid, gid uint32, err error) {
+	u, g, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, errx.With(ErrInvalidOwner, ": %q is not UID:GID", s)
+	}
+	uid64, err := strconv.ParseUint(u, 10, 32)
+	if err != nil {
+		return 0, 0, errx.With(ErrInvalidOwner, ": uid %q: %w", u, err)
+	}
+	gid64, err := strconv.ParseUint(g, 10, 32)
+	if err != nil {
+		return 0, 0, errx.With(ErrInvalidOwner, ": gid %q: %w", g, err)
+	}
+	return uint32(uid64), uint32(gid64), nil
+}
+
+// ValidateMountIDMap checks that idmaps are set only on real_fs and overlay
+// mounts of a host directory served through the VFS, which applies them.
+func ValidateMountIDMap(mounts map[string]MountConfig) error {
+	for guestPath, m := range mounts {
+		if m.IDMap == nil {
+			continue
+		}
+		if (m.Type != "real_fs" && m.Type != "overlay") || m.HostPath == "" {
+			return errx.With(ErrInvalidMountIDMap, ": %s: needs a real_fs or overlay mount of a host directory, not %q", guestPath, m.Type)
+		}
+		if m.Backend == MountBackendVirtioFS {
+			return errx.With(ErrInvalidMountIDMap, ": %s: not applied on %s mounts", guestPath, MountBackendVirtioFS)
+		}
+	}
+	return nil
+}
+
+// ValidateMountUnconfined checks that only real_fs and overlay mounts of a
+// host directory served through the VFS, which confines them, are marked
+// unconfined. A virtio-fs share hands symlinks to the guest to resolve in
+// its own filesystem.
+func ValidateMountUnconfined(mounts map[string]MountConfig) error {
+	for guestPath, m := range mounts {
+		if !m.Unconfined {
+			continue
+		}
+		if (m.Type != "real_fs" && m.Type != "overlay") || m.HostPath == "" {
+			return errx.With(ErrMountUnconfined, ": %s: needs a real_fs or overlay mount of a host directory, not %q", guestPath, m.Type)
+		}
+		if m.Backend == MountBackendVirtioFS {
+			return errx.With(ErrMountUnconfined, ": %s: not applied on %s mounts", guestPath, MountBackendVirtioFS)
+		}
+	}
+	return nil
+}
+
+// validateGlobs checks that each pattern is a non-empty MatchGlob pattern.
+func validateGlobs(patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.Trim(pattern, "/") == "" {
+			return errx.With(ErrInvalidGlob, ": empty")
+		}
+		for _, segment := range strings.Split(strings.Trim(pattern, "/"), "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return errx.With(ErrInvalidGlob, " %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
 // ValidateVFSMountsWithinWorkspace checks that all VFS mount paths are valid
 // guest paths under the configured workspace.
 func ValidateVFSMountsWithinWorkspace(mounts map[string]MountConfig, workspace string) error {
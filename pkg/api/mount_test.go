@@ -97,3 +97,201 @@ func TestValidateVFSMountsWithinWorkspaceRejectsRelative(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "must be absolute")
 }
+
+func TestValidateMountBackends(t *testing.T) {
+	require.NoError(t, ValidateMountBackends(map[string]MountConfig{
+		"/workspace":     {Type: "memory"},
+		"/workspace/src": {Type: "real_fs", HostPath: "/src", Backend: MountBackendVirtioFS},
+		"/workspace/out": {Type: "real_fs", HostPath: "/out", Backend: MountBackendFUSE},
+	}))
+
+	err := ValidateMountBackends(map[string]MountConfig{
+		"/workspace/tmp": {Type: "memory", Backend: MountBackendVirtioFS},
+	})
+	require.ErrorIs(t, err, ErrMountBackend)
+
+	err = ValidateMountBackends(map[string]MountConfig{
+		"/workspace/src": {Type: "real_fs", HostPath: "/src", Backend: "9p"},
+	})
+	require.ErrorIs(t, err, ErrMountBackend)
+}
+
+func TestParseS3Mount(t *testing.T) {
+	guestPath, mount, err := ParseS3Mount("s3://datasets/raw/2024/:data:ro", "/workspace")
+	require.NoError(t, err)
+	assert.Equal(t, "/workspace/data", guestPath)
+	assert.Equal(t, MountConfig{Type: "s3", Readonly: true, S3: &S3Mount{Bucket: "datasets", Prefix: "raw/2024"}}, mount)
+
+	_, mount, err = ParseS3Mount("s3://datasets:/workspace/out", "/workspace")
+	require.NoError(t, err)
+	assert.Equal(t, &S3Mount{Bucket: "datasets"}, mount.S3)
+	assert.False(t, mount.Readonly)
+
+	_, _, err = ParseS3Mount("datasets:/workspace/out", "/workspace")
+	require.ErrorIs(t, err, ErrInvalidS3Mount)
+	_, _, err = ParseS3Mount("s3://:/workspace/out", "/workspace")
+	require.ErrorIs(t, err, ErrInvalidS3Mount)
+	_, _, err = ParseS3Mount("s3://datasets:/etc", "/workspace")
+	require.ErrorIs(t, err, ErrGuestPathOutside)
+}
+
+func TestParseGitMount(t *testing.T) {
+	guestPath, mount, err := ParseGitMount("repo=git@github.com:acme/app.git#release/1.2", "/workspace")
+	require.NoError(t, err)
+	assert.Equal(t, "/workspace/repo", guestPath)
+	assert.Equal(t, &GitMount{URL: "git@github.com:acme/app.git", Ref: "release/1.2"}, mount.Git)
+
+	_, _, err = ParseGitMount("https://github.com/acme/app.git", "/workspace")
+	require.ErrorIs(t, err, ErrInvalidGitMount)
+	_, _, err = ParseGitMount("repo=--upload-pack=evil", "/workspace")
+	require.ErrorIs(t, err, ErrInvalidGitMount)
+
+	err = ValidateGitMounts(map[string]MountConfig{
+		"/workspace/repo": {Type: "git", Git: &GitMount{URL: "https://example.com/r.git", PushBranch: "bad..branch"}},
+	})
+	require.ErrorIs(t, err, ErrInvalidGitMount)
+}
+
+func TestParseMemoryMount(t *testing.T) {
+	guestPath, mount, err := ParseMemoryMount("scratch:256", "/workspace")
+	require.NoError(t, err)
+	assert.Equal(t, "/workspace/scratch", guestPath)
+	assert.Equal(t, MountConfig{Type: "memory", SizeMB: 256}, mount)
+
+	_, mount, err = ParseMemoryMount("/workspace/tmp", "/workspace")
+	require.NoError(t, err)
+	assert.Zero(t, mount.SizeMB)
+
+	_, _, err = ParseMemoryMount("scratch:0", "/workspace")
+	require.ErrorIs(t, err, ErrInvalidMemoryMount)
+	_, _, err = ParseMemoryMount("scratch:1g", "/workspace")
+	require.ErrorIs(t, err, ErrInvalidMemoryMount)
+	_, _, err = ParseMemoryMount("/tmp:64", "/workspace")
+	require.ErrorIs(t, err, ErrGuestPathOutside)
+
+	err = ValidateMemoryMounts(map[string]MountConfig{
+		"/workspace/src": {Type: "real_fs", HostPath: "/src", SizeMB: 64},
+	})
+	require.ErrorIs(t, err, ErrInvalidMemoryMount)
+}
+
+func TestParseCacheMount(t *testing.T) {
+	guestPath, mount, err := ParseCacheMount("pip:.cache/pip", "/workspace")
+	require.NoError(t, err)
+	assert.Equal(t, "/workspace/.cache/pip", guestPath)
+	assert.Equal(t, MountConfig{Type: "cache", Cache: &CacheMount{Name: "pip"}}, mount)
+
+	_, _, err = ParseCacheMount("pip", "/workspace")
+	require.ErrorIs(t, err, ErrInvalidCacheMount)
+	_, _, err = ParseCacheMount(":/workspace/pip", "/workspace")
+	require.ErrorIs(t, err, ErrInvalidCacheMount)
+	_, _, err = ParseCacheMount("pip:/root/.cache/pip", "/workspace")
+	require.ErrorIs(t, err, ErrGuestPathOutside)
+
+	err = ValidateCacheMounts(map[string]MountConfig{"/workspace/pip": {Type: "cache"}})
+	require.ErrorIs(t, err, ErrInvalidCacheMount)
+	err = ValidateCacheMounts(map[string]MountConfig{
+		"/workspace/pip": {Type: "real_fs", HostPath: "/pip", Cache: &CacheMount{Name: "pip"}},
+	})
+	require.ErrorIs(t, err, ErrInvalidCacheMount)
+}
+
+func TestValidateMountAccess(t *testing.T) {
+	access := &MountAccess{DenyRead: []string{"**/.env"}, DenyWrite: []string{"**/*.pem"}}
+	require.NoError(t, ValidateMountAccess(map[string]MountConfig{
+		"/workspace/repo": {Type: "real_fs", HostPath: "/repo", Access: access},
+	}))
+
+	err := ValidateMountAccess(map[string]MountConfig{
+		"/workspace/repo": {Type: "real_fs", HostPath: "/repo", Backend: MountBackendVirtioFS, Access: access},
+	})
+	require.ErrorIs(t, err, ErrInvalidMountAccess)
+
+	err = ValidateMountAccess(map[string]MountConfig{
+		"/workspace/repo": {Type: "real_fs", HostPath: "/repo", Access: &MountAccess{DenyRead: []string{"[.env"}}},
+	})
+	require.ErrorIs(t, err, ErrInvalidMountAccess)
+}
+
+func TestValidateMountCase(t *testing.T) {
+	require.NoError(t, ValidateMountCase(map[string]MountConfig{
+		"/workspace/repo": {Type: "real_fs", HostPath: "/repo", Case: MountCaseRejectCollisions},
+		"/workspace/lib":  {Type: "overlay", HostPath: "/lib", Case: MountCaseFold},
+	}))
+
+	err := ValidateMountCase(map[string]MountConfig{
+		"/workspace/repo": {Type: "real_fs", HostPath: "/repo", Case: "insensitive"},
+	})
+	require.ErrorIs(t, err, ErrMountCase)
+
+	err = ValidateMountCase(map[string]MountConfig{
+		"/workspace/repo": {Type: "real_fs", HostPath: "/repo", Backend: MountBackendVirtioFS, Case: MountCaseFold},
+	})
+	require.ErrorIs(t, err, ErrMountCase)
+}
+
+func TestValidateMountExclude(t *testing.T) {
+	require.NoError(t, ValidateMountExclude(map[string]MountConfig{
+		"/workspace/repo": {Type: "real_fs", HostPath: "/repo", Exclude: []string{"node_modules", ".git", "**/__pycache__"}},
+		"/workspace/lib":  {Type: "overlay", HostPath: "/lib", Exclude: []string{"venv/"}},
+	}))
+
+	for _, m := range []MountConfig{
+		{Type: "memory", Exclude: []string{"tmp"}},
+		{Type: "real_fs", HostPath: "/repo", Backend: MountBackendVirtioFS, Exclude: []string{".git"}},
+		{Type: "real_fs", HostPath: "/repo", Exclude: []string{"/"}},
+		{Type: "real_fs", HostPath: "/repo", Exclude: []string{"[abc"}},
+	} {
+		err := ValidateMountExclude(map[string]MountConfig{"/workspace/repo": m})
+		require.ErrorIs(t, err, ErrInvalidMountExclude)
+	}
+}
+
+func TestParseMountIDMap(t *testing.T) {
+	idmap, err := ParseMountIDMap("1000:1000")
+	require.NoError(t, err)
+	require.Equal(t, &MountIDMap{UID: 1000, GID: 1000}, idmap)
+
+	idmap, err = ParseMountIDMap("0:0=501:20")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), idmap.UID)
+	require.Equal(t, uint32(501), *idmap.HostUID)
+	require.Equal(t, uint32(20), *idmap.HostGID)
+
+	for _, spec := range []string{"", "1000", "a:b", "1000:-1", "1000:1000=501", "4294967296:0"} {
+		_, err := ParseMountIDMap(spec)
+		require.ErrorIs(t, err, ErrInvalidMountIDMap, spec)
+	}
+}
+
+func TestValidateMountIDMap(t *testing.T) {
+	idmap := &MountIDMap{UID: 1000, GID: 1000}
+	require.NoError(t, ValidateMountIDMap(map[string]MountConfig{
+		"/workspace/repo": {Type: "real_fs", HostPath: "/repo", IDMap: idmap},
+		"/workspace/lib":  {Type: "overlay", HostPath: "/lib", IDMap: idmap},
+		"/workspace/tmp":  {Type: "memory"},
+	}))
+
+	for _, m := range []MountConfig{
+		{Type: "memory", IDMap: idmap},
+		{Type: "real_fs", HostPath: "/repo", Backend: MountBackendVirtioFS, IDMap: idmap},
+	} {
+		err := ValidateMountIDMap(map[string]MountConfig{"/workspace/repo": m})
+		require.ErrorIs(t, err, ErrInvalidMountIDMap)
+	}
+}
+
+func TestValidateMountUnconfined(t *testing.T) {
+	require.NoError(t, ValidateMountUnconfined(map[string]MountConfig{
+		"/workspace/repo": {Type: "real_fs", HostPath: "/repo", Unconfined: true},
+		"/workspace/lib":  {Type: "overlay", HostPath: "/lib", Unconfined: true},
+	}))
+
+	for _, m := range []MountConfig{
+		{Type: "memory", Unconfined: true},
+		{Type: "real_fs", HostPath: "/repo", Backend: MountBackendVirtioFS, Unconfined: true},
+	} {
+		err := ValidateMountUnconfined(map[string]MountConfig{"/workspace/repo": m})
+		require.ErrorIs(t, err, ErrMountUnconfined)
+	}
+}
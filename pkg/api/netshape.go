@@ -0,0 +1,110 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// NetworkShape emulates a constrained link on the sandbox data path.
+// Latency (plus up to ±Jitter) is added once per request/response turn,
+// and throughput in each direction is capped at BandwidthBps bits per second.
+// A non-zero JitterSeed makes the jitter sequence of each connection
+// reproducible; otherwise it is randomly seeded.
+type NetworkShape struct {
+	LatencyMS    int    `json:"latency_ms,omitempty"`
+	JitterMS     int    `json:"jitter_ms,omitempty"`
+	JitterSeed   uint64 `json:"jitter_seed,omitempty"`
+	BandwidthBps int64  `json:"bandwidth_bps,omitempty"`
+}
+
+// Latency returns the configured base latency.
+func (s *NetworkShape) Latency() time.Duration {
+	return time.Duration(s.LatencyMS) * time.Millisecond
+}
+
+// Jitter returns the configured latency jitter.
+func (s *NetworkShape) Jitter() time.Duration {
+	return time.Duration(s.JitterMS) * time.Millisecond
+}
+
+// IsZero reports whether the shape has no effect.
+func (s *NetworkShape) IsZero() bool {
+	return s == nil || (s.LatencyMS <= 0 && s.BandwidthBps <= 0)
+}
+
+var bandwidthUnits = []struct {
+	suffix string
+	bps    int64
+}{
+	// Longest suffixes first so "kbit" is not matched as "bit".
+	{"gbit", 1000 * 1000 * 1000},
+	{"mbit", 1000 * 1000},
+	{"kbit", 1000},
+	{"gbps", 8 * 1000 * 1000 * 1000},
+	{"mbps", 8 * 1000 * 1000},
+	{"kbps", 8 * 1000},
+	{"bit", 1},
+	{"bps", 8},
+}
+
+// ParseNetworkShape parses a shaping spec such as
+// "latency=100ms,jitter=20ms,bw=5mbit". Bandwidth units follow tc
+// conventions: bit/kbit/mbit/gbit are bits per second and bps/kbps/mbps/gbps
+// are bytes per second.
+func ParseNetworkShape(spec string) (*NetworkShape, error) {
+	shape := &NetworkShape{}
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, errx.With(ErrInvalidNetShape, ": %q is not key=value", field)
+		}
+		switch strings.ToLower(key) {
+		case "latency", "delay":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, errx.With(ErrInvalidNetShape, ": latency %q", value)
+			}
+			shape.LatencyMS = int(d.Milliseconds())
+		case "jitter":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, errx.With(ErrInvalidNetShape, ": jitter %q", value)
+			}
+			shape.JitterMS = int(d.Milliseconds())
+		case "bw", "bandwidth", "rate":
+			bps, err := parseBandwidth(value)
+			if err != nil {
+				return nil, err
+			}
+			shape.BandwidthBps = bps
+		default:
+			return nil, errx.With(ErrInvalidNetShape, ": unknown key %q (use latency, jitter, bw)", key)
+		}
+	}
+	if shape.JitterMS > 0 && shape.LatencyMS == 0 {
+		return nil, errx.With(ErrInvalidNetShape, ": jitter requires latency")
+	}
+	return shape, nil
+}
+
+func parseBandwidth(value string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(value))
+	for _, unit := range bandwidthUnits {
+		if !strings.HasSuffix(v, unit.suffix) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSuffix(v, unit.suffix), 64)
+		if err != nil || n <= 0 {
+			break
+		}
+		return int64(n * float64(unit.bps)), nil
+	}
+	return 0, errx.With(ErrInvalidNetShape, ": bandwidth %q (e.g. 5mbit, 512kbit, 1mbps)", value)
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNetworkShape(t *testing.T) {
+	shape, err := ParseNetworkShape("latency=100ms,jitter=20ms,bw=5mbit")
+	require.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond, shape.Latency())
+	assert.Equal(t, 20*time.Millisecond, shape.Jitter())
+	assert.Equal(t, int64(5_000_000), shape.BandwidthBps)
+}
+
+func TestParseNetworkShape_BandwidthUnits(t *testing.T) {
+	tests := []struct {
+		spec string
+		bps  int64
+	}{
+		{"bw=512kbit", 512_000},
+		{"bw=1gbit", 1_000_000_000},
+		{"bw=100bit", 100},
+		{"bw=1mbps", 8_000_000},
+		{"bw=2kbps", 16_000},
+		{"bw=1.5mbit", 1_500_000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			shape, err := ParseNetworkShape(tt.spec)
+			require.NoError(t, err)
+			assert.Equal(t, tt.bps, shape.BandwidthBps)
+		})
+	}
+}
+
+func TestParseNetworkShape_Invalid(t *testing.T) {
+	for _, spec := range []string{
+		"latency",
+		"latency=fast",
+		"jitter=10ms",
+		"bw=5",
+		"bw=-1mbit",
+		"loss=1%",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			_, err := ParseNetworkShape(spec)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, ErrInvalidNetShape))
+		})
+	}
+}
+
+func TestNetworkShape_IsZero(t *testing.T) {
+	var nilShape *NetworkShape
+	assert.True(t, nilShape.IsZero())
+	assert.True(t, (&NetworkShape{}).IsZero())
+	assert.False(t, (&NetworkShape{LatencyMS: 10}).IsZero())
+	assert.False(t, (&NetworkShape{BandwidthBps: 1000}).IsZero())
+}
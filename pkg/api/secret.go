@@ -2,12 +2,266 @@ package api
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"path"
 	"strings"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// Where a secret's placeholder is substituted. Query and form-encoded body
+// values are URL-escaped and JSON body values are JSON-escaped; text bodies
+// get the raw value. Other bodies are left alone.
+const (
+	SecretInHeader = "header"
+	SecretInQuery  = "query"
+	SecretInBody   = "body"
 )
 
+// DefaultSecretLocations applies to secrets that do not set In.
+var DefaultSecretLocations = []string{SecretInHeader, SecretInQuery}
+
+// InjectsInto reports whether the placeholder is substituted in location.
+func (s Secret) InjectsInto(location string) bool {
+	in := s.In
+	if len(in) == 0 {
+		in = DefaultSecretLocations
+	}
+	for _, l := range in {
+		if l == location {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsRequest reports whether a request with the given method and URL path
+// is within the secret's Paths and Methods scope. Paths match whole segments
+// of the cleaned path, so "/v1/messages" allows "/v1/messages/batches" but
+// not "/v1/messages-admin" or "/v1/messages/../account".
+func (s Secret) AllowsRequest(method, urlPath string) bool {
+	if len(s.Methods) > 0 {
+		allowed := false
+		for _, m := range s.Methods {
+			if strings.EqualFold(m, method) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	if len(s.Paths) == 0 {
+		return true
+	}
+	if urlPath == "" {
+		urlPath = "/"
+	}
+	cleaned := path.Clean(urlPath)
+	for _, prefix := range s.Paths {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix == "" || cleaned == prefix || strings.HasPrefix(cleaned, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// SecretValueToken marks where the real value goes in a Secret.Header
+// template.
+const SecretValueToken = "{value}"
+
+// InjectedHeader returns the header name and value that Header asks to be
+// sent, with the real value filled in. ok is false without a Header.
+func (s Secret) InjectedHeader() (name, value string, ok bool) {
+	name, template, ok := strings.Cut(s.Header, ":")
+	if !ok {
+		return "", "", false
+	}
+	return strings.TrimSpace(name), strings.ReplaceAll(strings.TrimSpace(template), SecretValueToken, s.Value), true
+}
+
+// ParseSecretHeader parses NAME=HEADER, as taken by --secret-header, into the
+// secret name and its header template, e.g.
+// "API_KEY=X-Api-Key: {value}".
+func ParseSecretHeader(s string) (string, string, error) {
+	name, header, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return "", "", errx.With(ErrInvalidSecretHeader, ": expected NAME=Header-Name: template, got %q", s)
+	}
+	if err := validateSecretHeader(header); err != nil {
+		return "", "", err
+	}
+	return name, header, nil
+}
+
+// Expired reports whether the secret's ExpiresAt has passed at now.
+func (s Secret) Expired(now time.Time) bool {
+	return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+// ParseSecretTTL parses NAME=DURATION, as taken by --secret-ttl, e.g.
+// "API_KEY=8h".
+func ParseSecretTTL(s string) (string, time.Duration, error) {
+	name, d, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return "", 0, errx.With(ErrInvalidSecretTTL, ": expected NAME=DURATION, got %q", s)
+	}
+	ttl, err := time.ParseDuration(d)
+	if err != nil {
+		return "", 0, errx.With(ErrInvalidSecretTTL, ": %w", err)
+	}
+	if ttl <= 0 {
+		return "", 0, errx.With(ErrInvalidSecretTTL, ": %s must be positive", d)
+	}
+	return name, ttl, nil
+}
+
+func validateSecretHeader(header string) error {
+	if header == "" {
+		return nil
+	}
+	name, template, ok := strings.Cut(header, ":")
+	name = strings.TrimSpace(name)
+	if !ok || !isHeaderToken(name) {
+		return errx.With(ErrInvalidSecretHeader, ": %q must look like \"Header-Name: template\"", header)
+	}
+	if !strings.Contains(template, SecretValueToken) {
+		return errx.With(ErrInvalidSecretHeader, ": template for %s must contain %s", name, SecretValueToken)
+	}
+	if strings.ContainsAny(template, "\r\n") {
+		return errx.With(ErrInvalidSecretHeader, ": template for %s contains a line break", name)
+	}
+	return nil
+}
+
+// isHeaderToken reports whether s is a valid HTTP header field name.
+func isHeaderToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateSecrets checks that every secret names only known locations and a
+// well-formed scope, that request signing refers to defined secrets, and
+// that the leak action is known.
+func (n *NetworkConfig) ValidateSecrets() error {
+	if n == nil {
+		return nil
+	}
+	for name, secret := range n.Secrets {
+		if err := validateSecretLocations(secret.In); err != nil {
+			return errx.With(err, " for secret %s", name)
+		}
+		if err := validateSecretScope(secret.Paths, secret.Methods); err != nil {
+			return errx.With(err, " for secret %s", name)
+		}
+		if err := validateSecretHeader(secret.Header); err != nil {
+			return errx.With(err, " for secret %s", name)
+		}
+		if err := validateOAuth2(secret); err != nil {
+			return errx.With(err, " for secret %s", name)
+		}
+		if err := validateGitHubApp(secret); err != nil {
+			return errx.With(err, " for secret %s", name)
+		}
+	}
+	switch n.SecretLeakAction {
+	case "", LeakActionBlock, LeakActionKill:
+	default:
+		return errx.With(ErrInvalidSecretLeakAction, ": %q (want %q or %q)", n.SecretLeakAction, LeakActionBlock, LeakActionKill)
+	}
+	return n.validateRequestSigning()
+}
+
+func validateOAuth2(secret Secret) error {
+	o := secret.OAuth2
+	if o == nil {
+		return nil
+	}
+	if o.ServiceAccount != "" {
+		if o.ClientSecret != "" || o.RefreshToken != "" {
+			return errx.With(ErrInvalidOAuth2, ": a service account takes no client secret or refresh token")
+		}
+		if _, err := ParseServiceAccountKey(o.ServiceAccount); err != nil {
+			return errx.Wrap(ErrInvalidOAuth2, err)
+		}
+	} else if o.Audience != "" {
+		return errx.With(ErrInvalidOAuth2, ": audience requires a service account")
+	}
+	if o.TokenURL != "" || o.ServiceAccount == "" {
+		u, err := url.Parse(o.TokenURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errx.With(ErrInvalidOAuth2, ": token URL %q must be an http(s) URL", o.TokenURL)
+		}
+	}
+	if o.ClientID == "" && o.ServiceAccount == "" {
+		return errx.With(ErrInvalidOAuth2, ": client ID is required")
+	}
+	if len(secret.In) > 0 || secret.Header != "" {
+		return errx.With(ErrInvalidOAuth2, ": tokens are always sent in the Authorization header")
+	}
+	return nil
+}
+
+func validateSecretScope(paths, methods []string) error {
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return errx.With(ErrInvalidSecretScope, ": path %q must start with /", p)
+		}
+	}
+	for _, m := range methods {
+		if !isHTTPMethod(m) {
+			return errx.With(ErrInvalidSecretScope, ": method %q", m)
+		}
+	}
+	return nil
+}
+
+// isHTTPMethod reports whether s looks like an HTTP method token. Methods
+// are upper case, which also tells them apart from locations in ParseSecret.
+func isHTTPMethod(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func validateSecretLocations(in []string) error {
+	for _, l := range in {
+		switch l {
+		case SecretInHeader, SecretInQuery, SecretInBody:
+		default:
+			return errx.With(ErrInvalidSecretLocation, " %q (want %s, %s or %s)", l, SecretInHeader, SecretInQuery, SecretInBody)
+		}
+	}
+	return nil
+}
+
 // ParseSecret parses a secret string in the format "NAME=VALUE@host1,host2" or "NAME@host1,host2".
 // When no inline value is provided, the value is read from the environment variable $NAME.
+// The name may be followed by the locations to inject into and the HTTP
+// methods allowed, e.g. "NAME:body,POST=VALUE@host"; see SecretInHeader.
+// A host may carry a path prefix the secret is restricted to, e.g.
+// "NAME@api.example.com/v1/messages".
 func ParseSecret(s string) (string, Secret, error) {
 	atIdx := strings.LastIndex(s, "@")
 	if atIdx == -1 {
@@ -18,24 +272,32 @@ func ParseSecret(s string) (string, Secret, error) {
 	if hostsStr == "" {
 		return "", Secret{}, fmt.Errorf("no hosts specified after @")
 	}
-	hosts := strings.Split(hostsStr, ",")
-	for i := range hosts {
-		hosts[i] = strings.TrimSpace(hosts[i])
-	}
+	hosts, paths := splitSecretHosts(strings.Split(hostsStr, ","))
 
 	nameValue := s[:atIdx]
-	eqIdx := strings.Index(nameValue, "=")
+	name, value, inline := strings.Cut(nameValue, "=")
+
+	var in, methods []string
+	if n, options, ok := strings.Cut(name, ":"); ok {
+		for _, o := range strings.Split(options, ",") {
+			o = strings.TrimSpace(o)
+			if isHTTPMethod(o) {
+				methods = append(methods, o)
+			} else {
+				in = append(in, o)
+			}
+		}
+		if err := validateSecretLocations(in); err != nil {
+			return "", Secret{}, err
+		}
+		name = n
+	}
 
-	var name, value string
-	if eqIdx == -1 {
-		name = nameValue
+	if !inline {
 		value = os.Getenv(name)
 		if value == "" {
 			return "", Secret{}, fmt.Errorf("environment variable $%s is not set (hint: use 'sudo -E' to preserve env vars, or pass inline: %s=VALUE@%s)", name, name, hostsStr)
 		}
-	} else {
-		name = nameValue[:eqIdx]
-		value = nameValue[eqIdx+1:]
 	}
 
 	if name == "" {
@@ -43,7 +305,56 @@ func ParseSecret(s string) (string, Secret, error) {
 	}
 
 	return name, Secret{
-		Value: value,
-		Hosts: hosts,
+		Value:   value,
+		Hosts:   hosts,
+		In:      in,
+		Paths:   paths,
+		Methods: methods,
 	}, nil
 }
+
+// splitSecretHosts separates the path prefixes hosts may carry, as in
+// "api.example.com/v1/messages", from the host names.
+func splitSecretHosts(hosts []string) ([]string, []string) {
+	var paths []string
+	for i := range hosts {
+		host, p, hasPath := strings.Cut(strings.TrimSpace(hosts[i]), "/")
+		hosts[i] = host
+		if hasPath {
+			paths = append(paths, "/"+p)
+		}
+	}
+	return hosts, paths
+}
+
+// ParseOAuth2Secret parses an OAuth2 secret in the format
+// "NAME=TOKEN_URL@host1,host2". Methods and host paths scope it as in
+// ParseSecret. The client credentials are read from the environment so they
+// stay out of the command line: $NAME_CLIENT_ID, and optionally
+// $NAME_CLIENT_SECRET, $NAME_REFRESH_TOKEN and $NAME_SCOPES (space
+// separated).
+func ParseOAuth2Secret(s string) (string, Secret, error) {
+	if atIdx := strings.LastIndex(s, "@"); atIdx != -1 && !strings.Contains(s[:atIdx], "=") {
+		return "", Secret{}, fmt.Errorf("missing token URL (format: NAME=TOKEN_URL@host1,host2)")
+	}
+	name, secret, err := ParseSecret(s)
+	if err != nil {
+		return "", Secret{}, err
+	}
+
+	secret.OAuth2 = &OAuth2{
+		TokenURL:     secret.Value,
+		ClientID:     os.Getenv(name + "_CLIENT_ID"),
+		ClientSecret: os.Getenv(name + "_CLIENT_SECRET"),
+		RefreshToken: os.Getenv(name + "_REFRESH_TOKEN"),
+		Scopes:       strings.Fields(os.Getenv(name + "_SCOPES")),
+	}
+	secret.Value = ""
+	if secret.OAuth2.ClientID == "" {
+		return "", Secret{}, fmt.Errorf("environment variable $%s_CLIENT_ID is not set", name)
+	}
+	if err := validateOAuth2(secret); err != nil {
+		return "", Secret{}, err
+	}
+	return name, secret, nil
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -80,3 +81,199 @@ func TestParseSecretHostTrimSpaces(t *testing.T) {
 	assert.Equal(t, "host1.com", secret.Hosts[0])
 	assert.Equal(t, "host2.com", secret.Hosts[1])
 }
+
+func TestParseSecretLocations(t *testing.T) {
+	name, secret, err := ParseSecret("MY_KEY:body, query=sk-1:2@api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "MY_KEY", name)
+	assert.Equal(t, "sk-1:2", secret.Value)
+	assert.Equal(t, []string{SecretInBody, SecretInQuery}, secret.In)
+}
+
+func TestParseSecretLocationsFromEnv(t *testing.T) {
+	t.Setenv("TEST_SECRET_LOC", "env-value")
+	name, secret, err := ParseSecret("TEST_SECRET_LOC:body@api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "TEST_SECRET_LOC", name)
+	assert.Equal(t, "env-value", secret.Value)
+	assert.Equal(t, []string{SecretInBody}, secret.In)
+}
+
+func TestParseSecretUnknownLocation(t *testing.T) {
+	_, _, err := ParseSecret("MY_KEY:cookie=v@api.example.com")
+	assert.ErrorIs(t, err, ErrInvalidSecretLocation)
+}
+
+func TestSecretInjectsInto(t *testing.T) {
+	def := Secret{}
+	assert.True(t, def.InjectsInto(SecretInHeader))
+	assert.True(t, def.InjectsInto(SecretInQuery))
+	assert.False(t, def.InjectsInto(SecretInBody))
+
+	body := Secret{In: []string{SecretInBody}}
+	assert.True(t, body.InjectsInto(SecretInBody))
+	assert.False(t, body.InjectsInto(SecretInHeader))
+}
+
+func TestValidateSecrets(t *testing.T) {
+	var nilCfg *NetworkConfig
+	assert.NoError(t, nilCfg.ValidateSecrets())
+
+	ok := &NetworkConfig{Secrets: map[string]Secret{"K": {In: []string{SecretInHeader, SecretInBody}}}}
+	assert.NoError(t, ok.ValidateSecrets())
+
+	bad := &NetworkConfig{Secrets: map[string]Secret{"K": {In: []string{"path"}}}}
+	err := bad.ValidateSecrets()
+	assert.ErrorIs(t, err, ErrInvalidSecretLocation)
+	assert.Contains(t, err.Error(), "secret K")
+}
+
+func TestParseSecretScope(t *testing.T) {
+	name, secret, err := ParseSecret("ANTHROPIC_API_KEY:header,POST=sk-ant@api.anthropic.com/v1/messages,api.anthropic.com/v1/complete")
+	require.NoError(t, err)
+	assert.Equal(t, "ANTHROPIC_API_KEY", name)
+	assert.Equal(t, []string{"api.anthropic.com", "api.anthropic.com"}, secret.Hosts)
+	assert.Equal(t, []string{"/v1/messages", "/v1/complete"}, secret.Paths)
+	assert.Equal(t, []string{"POST"}, secret.Methods)
+	assert.Equal(t, []string{SecretInHeader}, secret.In)
+
+	_, secret, err = ParseSecret("K:GET,HEAD=v@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"GET", "HEAD"}, secret.Methods)
+	assert.Empty(t, secret.In)
+	assert.Empty(t, secret.Paths)
+}
+
+func TestSecretAllowsRequest(t *testing.T) {
+	unscoped := Secret{}
+	assert.True(t, unscoped.AllowsRequest("DELETE", "/anything"))
+
+	s := Secret{Paths: []string{"/v1/messages"}, Methods: []string{"POST"}}
+	assert.True(t, s.AllowsRequest("POST", "/v1/messages"))
+	assert.True(t, s.AllowsRequest("post", "/v1/messages/batches"))
+	assert.False(t, s.AllowsRequest("GET", "/v1/messages"))
+	assert.False(t, s.AllowsRequest("POST", "/v1/organizations"))
+	assert.False(t, s.AllowsRequest("POST", "/v1/messages-admin"))
+	assert.False(t, s.AllowsRequest("POST", "/v1/messages/../organizations"))
+	assert.False(t, s.AllowsRequest("POST", ""))
+
+	root := Secret{Paths: []string{"/"}}
+	assert.True(t, root.AllowsRequest("GET", ""))
+}
+
+func TestValidateSecretScope(t *testing.T) {
+	ok := &NetworkConfig{Secrets: map[string]Secret{"K": {Paths: []string{"/v1"}, Methods: []string{"POST"}}}}
+	assert.NoError(t, ok.ValidateSecrets())
+
+	for _, s := range []Secret{
+		{Paths: []string{"v1/messages"}},
+		{Methods: []string{"post"}},
+		{Methods: []string{""}},
+	} {
+		bad := &NetworkConfig{Secrets: map[string]Secret{"K": s}}
+		assert.ErrorIs(t, bad.ValidateSecrets(), ErrInvalidSecretScope)
+	}
+}
+
+func TestParseOAuth2Secret(t *testing.T) {
+	t.Setenv("GRAPH_CLIENT_ID", "client")
+	t.Setenv("GRAPH_CLIENT_SECRET", "s3cret")
+	t.Setenv("GRAPH_SCOPES", "read  write")
+
+	name, secret, err := ParseOAuth2Secret("GRAPH:GET=https://login.example.com/oauth2/token@graph.example.com/v1")
+	require.NoError(t, err)
+	assert.Equal(t, "GRAPH", name)
+	assert.Empty(t, secret.Value)
+	assert.Equal(t, []string{"graph.example.com"}, secret.Hosts)
+	assert.Equal(t, []string{"/v1"}, secret.Paths)
+	assert.Equal(t, []string{"GET"}, secret.Methods)
+	require.NotNil(t, secret.OAuth2)
+	assert.Equal(t, OAuth2{
+		TokenURL:     "https://login.example.com/oauth2/token",
+		ClientID:     "client",
+		ClientSecret: "s3cret",
+		Scopes:       []string{"read", "write"},
+	}, *secret.OAuth2)
+
+	_, _, err = ParseOAuth2Secret("GRAPH@graph.example.com")
+	assert.ErrorContains(t, err, "token URL")
+
+	_, _, err = ParseOAuth2Secret("GRAPH=not-a-url@graph.example.com")
+	assert.ErrorIs(t, err, ErrInvalidOAuth2)
+
+	_, _, err = ParseOAuth2Secret("GRAPH:body=https://login.example.com/token@graph.example.com")
+	assert.ErrorIs(t, err, ErrInvalidOAuth2)
+
+	t.Setenv("GRAPH_CLIENT_ID", "")
+	_, _, err = ParseOAuth2Secret("GRAPH=https://login.example.com/token@graph.example.com")
+	assert.ErrorContains(t, err, "GRAPH_CLIENT_ID")
+}
+
+func TestValidateOAuth2Secret(t *testing.T) {
+	ok := &NetworkConfig{Secrets: map[string]Secret{"K": {OAuth2: &OAuth2{TokenURL: "https://auth.example.com/token", ClientID: "c"}}}}
+	assert.NoError(t, ok.ValidateSecrets())
+
+	for _, o := range []OAuth2{
+		{TokenURL: "ftp://auth.example.com/token", ClientID: "c"},
+		{TokenURL: "https://auth.example.com/token"},
+	} {
+		bad := &NetworkConfig{Secrets: map[string]Secret{"K": {OAuth2: &o}}}
+		assert.ErrorIs(t, bad.ValidateSecrets(), ErrInvalidOAuth2)
+	}
+}
+
+func TestParseSecretHeader(t *testing.T) {
+	name, header, err := ParseSecretHeader("DD_API_KEY=DD-API-KEY: {value}")
+	require.NoError(t, err)
+	assert.Equal(t, "DD_API_KEY", name)
+
+	h, v, ok := Secret{Value: "abc", Header: header}.InjectedHeader()
+	require.True(t, ok)
+	assert.Equal(t, "DD-API-KEY", h)
+	assert.Equal(t, "abc", v)
+
+	_, v, _ = Secret{Value: "abc", Header: "Authorization: Bearer {value}"}.InjectedHeader()
+	assert.Equal(t, "Bearer abc", v)
+
+	_, _, ok = Secret{Value: "abc"}.InjectedHeader()
+	assert.False(t, ok)
+
+	for _, bad := range []string{
+		"DD-API-KEY: {value}",
+		"K=DD-API-KEY",
+		"K=Bad Header: {value}",
+		"K=X-Key: static",
+		"K=X-Key: {value}\r\nX-Evil: 1",
+	} {
+		_, _, err := ParseSecretHeader(bad)
+		assert.ErrorIs(t, err, ErrInvalidSecretHeader, bad)
+	}
+
+	oauth := &NetworkConfig{Secrets: map[string]Secret{"K": {
+		Header: "X-Key: {value}",
+		OAuth2: &OAuth2{TokenURL: "https://auth.example.com/token", ClientID: "c"},
+	}}}
+	assert.ErrorIs(t, oauth.ValidateSecrets(), ErrInvalidOAuth2)
+}
+
+func TestParseSecretTTL(t *testing.T) {
+	name, ttl, err := ParseSecretTTL("API_KEY=8h")
+	require.NoError(t, err)
+	assert.Equal(t, "API_KEY", name)
+	assert.Equal(t, 8*time.Hour, ttl)
+
+	for _, bad := range []string{"API_KEY", "=8h", "API_KEY=soon", "API_KEY=0s", "API_KEY=-1h"} {
+		_, _, err := ParseSecretTTL(bad)
+		assert.ErrorIs(t, err, ErrInvalidSecretTTL, bad)
+	}
+}
+
+func TestSecretExpired(t *testing.T) {
+	now := time.Now()
+	assert.False(t, Secret{}.Expired(now))
+
+	expiresAt := now.Add(time.Minute)
+	s := Secret{ExpiresAt: &expiresAt}
+	assert.False(t, s.Expired(now))
+	assert.True(t, s.Expired(expiresAt))
+}
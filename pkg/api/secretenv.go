@@ -0,0 +1,143 @@
+package api
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/storename"
+)
+
+// SecretHostMap maps environment variable names, or glob patterns such as
+// "OPENAI_*", to the hosts a secret discovered from a matching variable is
+// bound to. Hosts may carry path prefixes as in ParseSecret.
+type SecretHostMap map[string][]string
+
+// DefaultSecretHostMap binds the variables of well-known model and code
+// hosting APIs. Entries in a host map file replace these by pattern.
+var DefaultSecretHostMap = SecretHostMap{
+	"ANTHROPIC_*":  {"api.anthropic.com"},
+	"OPENAI_*":     {"api.openai.com"},
+	"GEMINI_*":     {"generativelanguage.googleapis.com"},
+	"MISTRAL_*":    {"api.mistral.ai"},
+	"GROQ_*":       {"api.groq.com"},
+	"OPENROUTER_*": {"openrouter.ai"},
+	"GITHUB_TOKEN": {"api.github.com"},
+	"GH_TOKEN":     {"api.github.com"},
+}
+
+// secretHostMapFile is the layout of a host map file:
+//
+//	hosts:
+//	  ANTHROPIC_*: [api.anthropic.com]
+//	  INTERNAL_API_TOKEN: [api.internal.example.com/v1]
+type secretHostMapFile struct {
+	Hosts SecretHostMap `yaml:"hosts"`
+}
+
+// DefaultSecretHostMapPath returns $MATCHLOCK_SECRET_HOSTS, or
+// ~/.config/matchlock/secret-hosts.yaml.
+func DefaultSecretHostMapPath() string {
+	if p := os.Getenv("MATCHLOCK_SECRET_HOSTS"); p != "" {
+		return p
+	}
+	return storename.ConfigPath("secret-hosts.yaml")
+}
+
+// LoadSecretHostMap reads a host map file over DefaultSecretHostMap. A
+// missing file yields the defaults.
+func LoadSecretHostMap(p string) (SecretHostMap, error) {
+	m := make(SecretHostMap, len(DefaultSecretHostMap))
+	for pattern, hosts := range DefaultSecretHostMap {
+		m[pattern] = hosts
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, errx.Wrap(ErrReadSecretFile, err)
+	}
+	var f secretHostMapFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, errx.With(ErrInvalidSecretHostMap, " %s: %w", p, err)
+	}
+	for pattern, hosts := range f.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, errx.With(ErrInvalidSecretHostMap, " %s: bad pattern %q", p, pattern)
+		}
+		if len(hosts) == 0 {
+			return nil, errx.With(ErrInvalidSecretHostMap, " %s: no hosts for %s", p, pattern)
+		}
+		m[pattern] = hosts
+	}
+	return m, nil
+}
+
+// Hosts returns the hosts mapped to the variable name: those of an exact
+// entry, or else of the longest matching pattern.
+func (m SecretHostMap) Hosts(name string) []string {
+	if hosts, ok := m[name]; ok {
+		return hosts
+	}
+	best := ""
+	for pattern := range m {
+		if ok, _ := path.Match(pattern, name); ok && (len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best)) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return m[best]
+}
+
+// DiscoverEnvSecrets turns every non-empty variable in environ ("NAME=VALUE"
+// entries, as from os.Environ) whose name matches one of patterns into a
+// secret bound to the hosts m maps it to. A matching variable without hosts
+// is an error rather than a secret allowed everywhere.
+func DiscoverEnvSecrets(patterns []string, m SecretHostMap, environ []string) (map[string]Secret, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, errx.With(ErrDiscoverSecrets, ": bad pattern %q", pattern)
+		}
+	}
+
+	secrets := make(map[string]Secret)
+	var unmapped []string
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || name == "" || value == "" || !matchesAny(patterns, name) {
+			continue
+		}
+		hosts := m.Hosts(name)
+		if len(hosts) == 0 {
+			unmapped = append(unmapped, name)
+			continue
+		}
+		hosts, paths := splitSecretHosts(append([]string(nil), hosts...))
+		secrets[name] = Secret{Value: value, Hosts: hosts, Paths: paths}
+	}
+	if len(unmapped) > 0 {
+		sort.Strings(unmapped)
+		return nil, errx.With(ErrDiscoverSecrets, ": no hosts mapped for %s", strings.Join(unmapped, ", "))
+	}
+	if len(secrets) == 0 {
+		return nil, errx.With(ErrDiscoverSecrets, ": no environment variable matches %s", strings.Join(patterns, ","))
+	}
+	return secrets, nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
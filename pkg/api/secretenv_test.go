@@ -0,0 +1,62 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverEnvSecrets(t *testing.T) {
+	m := SecretHostMap{
+		"ANTHROPIC_*":        {"api.anthropic.com"},
+		"ANTHROPIC_ADMIN_*":  {"admin.anthropic.com"},
+		"INTERNAL_API_TOKEN": {"api.internal.example.com/v1"},
+	}
+	environ := []string{
+		"ANTHROPIC_API_KEY=sk-ant",
+		"ANTHROPIC_ADMIN_KEY=sk-admin",
+		"INTERNAL_API_TOKEN=tok",
+		"ANTHROPIC_EMPTY=",
+		"PATH=/usr/bin",
+	}
+
+	secrets, err := DiscoverEnvSecrets([]string{"ANTHROPIC_*", "INTERNAL_*"}, m, environ)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Secret{
+		"ANTHROPIC_API_KEY":   {Value: "sk-ant", Hosts: []string{"api.anthropic.com"}},
+		"ANTHROPIC_ADMIN_KEY": {Value: "sk-admin", Hosts: []string{"admin.anthropic.com"}},
+		"INTERNAL_API_TOKEN":  {Value: "tok", Hosts: []string{"api.internal.example.com"}, Paths: []string{"/v1"}},
+	}, secrets)
+
+	_, err = DiscoverEnvSecrets([]string{"*"}, m, environ)
+	require.ErrorIs(t, err, ErrDiscoverSecrets)
+	assert.Contains(t, err.Error(), "PATH", "unmapped variables are named")
+
+	_, err = DiscoverEnvSecrets([]string{"OPENAI_*"}, m, environ)
+	assert.ErrorIs(t, err, ErrDiscoverSecrets)
+
+	_, err = DiscoverEnvSecrets([]string{"["}, m, environ)
+	assert.ErrorIs(t, err, ErrDiscoverSecrets)
+}
+
+func TestLoadSecretHostMap(t *testing.T) {
+	m, err := LoadSecretHostMap(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultSecretHostMap, m)
+
+	p := filepath.Join(t.TempDir(), "secret-hosts.yaml")
+	require.NoError(t, os.WriteFile(p, []byte("hosts:\n  OPENAI_*: [proxy.example.com]\n  CUSTOM_TOKEN: [api.custom.dev]\n"), 0600))
+	m, err = LoadSecretHostMap(p)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"proxy.example.com"}, m.Hosts("OPENAI_API_KEY"))
+	assert.Equal(t, []string{"api.custom.dev"}, m.Hosts("CUSTOM_TOKEN"))
+	assert.Equal(t, []string{"api.anthropic.com"}, m.Hosts("ANTHROPIC_API_KEY"))
+	assert.Nil(t, m.Hosts("UNRELATED"))
+
+	require.NoError(t, os.WriteFile(p, []byte("hosts:\n  OPENAI_*: []\n"), 0600))
+	_, err = LoadSecretHostMap(p)
+	assert.ErrorIs(t, err, ErrInvalidSecretHostMap)
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// secretFile is the layout of a file given to --secret-file. YAML is a
+// superset of JSON, so either can be used:
+//
+//	secrets:
+//	  ANTHROPIC_API_KEY:
+//	    value: aws-sm:prod/anthropic   # or env: VAR; default $ANTHROPIC_API_KEY
+//	    hosts: [api.anthropic.com]
+//	    methods: [POST]
+//	    paths: [/v1/messages]
+//	  DATADOG_API_KEY:
+//	    hosts: [api.datadoghq.com]
+//	    header: "DD-API-KEY: {value}"    # sent without the guest's help
+//	    ttl: 24h                         # refused once expired
+//	  GITHUB:
+//	    hosts: [api.github.com]
+//	    oauth2:
+//	      token_url: https://github.com/login/oauth/access_token
+//	      client_id: Iv1.abc
+//	      client_secret: keychain:github-app
+//	  VERTEX:                            # hosts default to *.googleapis.com
+//	    gcp:
+//	      key_file: /etc/matchlock/vertex-sa.json
+type secretFile struct {
+	Secrets map[string]secretFileEntry `yaml:"secrets"`
+}
+
+type secretFileEntry struct {
+	Value     string               `yaml:"value"`
+	Env       string               `yaml:"env"`
+	Hosts     []string             `yaml:"hosts"`
+	In        []string             `yaml:"in"`
+	Paths     []string             `yaml:"paths"`
+	Methods   []string             `yaml:"methods"`
+	Header    string               `yaml:"header"`
+	OAuth2    *secretFileOAuth2    `yaml:"oauth2"`
+	GCP       *secretFileGCP       `yaml:"gcp"`
+	GitHubApp *secretFileGitHubApp `yaml:"github_app"`
+	TTL       string               `yaml:"ttl"`
+}
+
+type secretFileGitHubApp struct {
+	AppID          int64             `yaml:"app_id"`
+	InstallationID int64             `yaml:"installation_id"`
+	KeyFile        string            `yaml:"key_file"`
+	PrivateKey     string            `yaml:"private_key"`
+	APIURL         string            `yaml:"api_url"`
+	Repositories   []string          `yaml:"repositories"`
+	Permissions    map[string]string `yaml:"permissions"`
+}
+
+type secretFileGCP struct {
+	KeyFile  string   `yaml:"key_file"`
+	Scopes   []string `yaml:"scopes"`
+	Audience string   `yaml:"audience"`
+}
+
+type secretFileOAuth2 struct {
+	TokenURL     string   `yaml:"token_url"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RefreshToken string   `yaml:"refresh_token"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+// LoadSecretFile reads the secrets defined in a YAML or JSON file. Values
+// are taken as written, so store references such as "aws-sm:..." or
+// "op://..." still need resolving. A secret without a value (and not an
+// OAuth2 client, GCP service account or GitHub App) is read from the
+// environment variable named by env, or from $NAME. Hosts may carry path prefixes as in ParseSecret.
+func LoadSecretFile(path string) (map[string]Secret, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errx.Wrap(ErrReadSecretFile, err)
+	}
+	return ParseSecretFile(data)
+}
+
+// ParseSecretFile parses the contents of a secret file; see LoadSecretFile.
+func ParseSecretFile(data []byte) (map[string]Secret, error) {
+	var file secretFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, errx.Wrap(ErrInvalidSecretFile, err)
+	}
+	return parseSecretEntries(file.Secrets)
+}
+
+// parseSecretEntries turns the entries of a secret file or profile into
+// secrets, reading values from the environment where needed.
+func parseSecretEntries(entries map[string]secretFileEntry) (map[string]Secret, error) {
+	secrets := make(map[string]Secret, len(entries))
+	for name, e := range entries {
+		if name == "" {
+			return nil, errx.With(ErrInvalidSecretFile, ": secret name cannot be empty")
+		}
+		if kinds := countSet(e.OAuth2 != nil, e.GCP != nil, e.GitHubApp != nil); kinds > 1 {
+			return nil, errx.With(ErrInvalidSecretFile, ": secret %s sets more than one of oauth2, gcp and github_app", name)
+		}
+		if len(e.Hosts) == 0 && e.GCP != nil {
+			e.Hosts = []string{DefaultGCPHost}
+		}
+		if len(e.Hosts) == 0 && e.GitHubApp != nil {
+			e.Hosts = DefaultGitHubAppHosts
+		}
+		if len(e.Hosts) == 0 {
+			return nil, errx.With(ErrInvalidSecretFile, ": no hosts for secret %s", name)
+		}
+		hosts, paths := splitSecretHosts(append([]string(nil), e.Hosts...))
+		secret := Secret{
+			Value:   e.Value,
+			Hosts:   hosts,
+			In:      e.In,
+			Paths:   append(paths, e.Paths...),
+			Methods: e.Methods,
+			Header:  e.Header,
+		}
+
+		if o := e.OAuth2; o != nil {
+			secret.OAuth2 = &OAuth2{
+				TokenURL:     o.TokenURL,
+				ClientID:     o.ClientID,
+				ClientSecret: o.ClientSecret,
+				RefreshToken: o.RefreshToken,
+				Scopes:       o.Scopes,
+			}
+		} else if g := e.GCP; g != nil {
+			if g.KeyFile == "" {
+				return nil, errx.With(ErrInvalidSecretFile, ": secret %s has no gcp key_file", name)
+			}
+			key, err := os.ReadFile(g.KeyFile)
+			if err != nil {
+				return nil, errx.With(ErrServiceAccountKey, " for secret %s: %w", name, err)
+			}
+			secret.OAuth2 = &OAuth2{
+				ServiceAccount: string(key),
+				Scopes:         g.Scopes,
+				Audience:       g.Audience,
+			}
+		} else if g := e.GitHubApp; g != nil {
+			key := g.PrivateKey
+			if g.KeyFile != "" {
+				data, err := os.ReadFile(g.KeyFile)
+				if err != nil {
+					return nil, errx.With(ErrInvalidGitHubApp, " for secret %s: %w", name, err)
+				}
+				key = string(data)
+			}
+			secret.GitHubApp = &GitHubApp{
+				AppID:          g.AppID,
+				InstallationID: g.InstallationID,
+				PrivateKey:     key,
+				APIURL:         g.APIURL,
+				Repositories:   g.Repositories,
+				Permissions:    g.Permissions,
+			}
+		} else if secret.Value == "" {
+			env := e.Env
+			if env == "" {
+				env = name
+			}
+			secret.Value = os.Getenv(env)
+			if secret.Value == "" {
+				return nil, errx.With(ErrInvalidSecretFile, ": secret %s has no value and $%s is not set", name, env)
+			}
+		}
+
+		if e.TTL != "" {
+			_, ttl, err := ParseSecretTTL(name + "=" + e.TTL)
+			if err != nil {
+				return nil, errx.With(err, " for secret %s", name)
+			}
+			expiresAt := time.Now().Add(ttl)
+			secret.ExpiresAt = &expiresAt
+		}
+
+		if err := validateSecretLocations(secret.In); err != nil {
+			return nil, errx.With(err, " for secret %s", name)
+		}
+		if err := validateSecretScope(secret.Paths, secret.Methods); err != nil {
+			return nil, errx.With(err, " for secret %s", name)
+		}
+		if err := validateSecretHeader(secret.Header); err != nil {
+			return nil, errx.With(err, " for secret %s", name)
+		}
+		if err := validateOAuth2(secret); err != nil {
+			return nil, errx.With(err, " for secret %s", name)
+		}
+		if err := validateGitHubApp(secret); err != nil {
+			return nil, errx.With(err, " for secret %s", name)
+		}
+		secrets[name] = secret
+	}
+	return secrets, nil
+}
+
+func countSet(set ...bool) int {
+	n := 0
+	for _, s := range set {
+		if s {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSecretFileYAML(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "sk-env")
+	t.Setenv("GH_TOKEN", "ghp-env")
+
+	secrets, err := ParseSecretFile([]byte(`
+secrets:
+  ANTHROPIC_API_KEY:
+    hosts: [api.anthropic.com/v1/messages]
+    methods: [POST]
+  GITHUB_TOKEN:
+    env: GH_TOKEN
+    hosts: [api.github.com]
+  STRIPE_KEY:
+    value: aws-sm:prod/stripe#key
+    hosts: [api.stripe.com]
+    in: [body]
+  CRM:
+    hosts: [crm.example.com]
+    oauth2:
+      token_url: https://auth.example.com/token
+      client_id: matchlock
+      client_secret: keychain:crm
+      scopes: [read, write]
+`))
+	require.NoError(t, err)
+	require.Len(t, secrets, 4)
+
+	assert.Equal(t, Secret{
+		Value:   "sk-env",
+		Hosts:   []string{"api.anthropic.com"},
+		Paths:   []string{"/v1/messages"},
+		Methods: []string{"POST"},
+	}, secrets["ANTHROPIC_API_KEY"])
+	assert.Equal(t, "ghp-env", secrets["GITHUB_TOKEN"].Value)
+	assert.Equal(t, "aws-sm:prod/stripe#key", secrets["STRIPE_KEY"].Value)
+	assert.Equal(t, []string{SecretInBody}, secrets["STRIPE_KEY"].In)
+	assert.Equal(t, &OAuth2{
+		TokenURL:     "https://auth.example.com/token",
+		ClientID:     "matchlock",
+		ClientSecret: "keychain:crm",
+		Scopes:       []string{"read", "write"},
+	}, secrets["CRM"].OAuth2)
+	assert.Empty(t, secrets["CRM"].Value)
+}
+
+func TestLoadSecretFileJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"secrets": {"KEY": {"value": "v", "hosts": ["example.com"]}}}`), 0600))
+
+	secrets, err := LoadSecretFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Secret{"KEY": {Value: "v", Hosts: []string{"example.com"}}}, secrets)
+
+	_, err = LoadSecretFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.ErrorIs(t, err, ErrReadSecretFile)
+}
+
+func TestParseSecretFileTTL(t *testing.T) {
+	secrets, err := ParseSecretFile([]byte("secrets: {KEY: {value: v, hosts: [a.com], ttl: 1h}}"))
+	require.NoError(t, err)
+	require.NotNil(t, secrets["KEY"].ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *secrets["KEY"].ExpiresAt, time.Minute)
+}
+
+func TestParseSecretFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"syntax", "secrets: [", ErrInvalidSecretFile},
+		{"no hosts", "secrets: {KEY: {value: v}}", ErrInvalidSecretFile},
+		{"unset env", "secrets: {MATCHLOCK_TEST_UNSET: {hosts: [a.com]}}", ErrInvalidSecretFile},
+		{"location", "secrets: {KEY: {value: v, hosts: [a.com], in: [cookie]}}", ErrInvalidSecretLocation},
+		{"method", "secrets: {KEY: {value: v, hosts: [a.com], methods: [post]}}", ErrInvalidSecretScope},
+		{"oauth2", "secrets: {KEY: {hosts: [a.com], oauth2: {token_url: https://a.com/token}}}", ErrInvalidOAuth2},
+		{"ttl", "secrets: {KEY: {value: v, hosts: [a.com], ttl: soon}}", ErrInvalidSecretTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSecretFile([]byte(tt.data))
+			require.ErrorIs(t, err, tt.want)
+		})
+	}
+}
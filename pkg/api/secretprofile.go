@@ -0,0 +1,95 @@
+package api
+
+import (
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/storename"
+)
+
+// secretProfilesFile is the layout of the secret profiles file. Each profile
+// is a named set of secrets in the format of a secret file (see
+// LoadSecretFile), so a team can share least-privilege bundles:
+//
+//	profiles:
+//	  anthropic:
+//	    ANTHROPIC_API_KEY:
+//	      value: aws-sm:prod/anthropic
+//	      hosts: [api.anthropic.com]
+//	      methods: [POST]
+//	      paths: [/v1/messages]
+//	  github-readonly:
+//	    GH_TOKEN:
+//	      env: GITHUB_READONLY_TOKEN
+//	      hosts: [api.github.com]
+//	      methods: [GET]
+type secretProfilesFile struct {
+	Profiles map[string]map[string]secretFileEntry `yaml:"profiles"`
+}
+
+// DefaultSecretProfilesPath returns $MATCHLOCK_SECRET_PROFILES, or
+// ~/.config/matchlock/secret-profiles.yaml.
+func DefaultSecretProfilesPath() string {
+	if p := os.Getenv("MATCHLOCK_SECRET_PROFILES"); p != "" {
+		return p
+	}
+	return storename.ConfigPath("secret-profiles.yaml")
+}
+
+// LoadSecretProfiles reads the named profiles from the profiles file at p
+// and returns their secrets. A secret defined by several profiles takes its
+// definition from the last one named. Only the named profiles are parsed, so
+// others may refer to environment variables that are not set.
+func LoadSecretProfiles(p string, names []string) (map[string]Secret, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errx.With(ErrUnknownSecretProfile, " %s: %s does not exist", names[0], p)
+		}
+		return nil, errx.Wrap(ErrReadSecretFile, err)
+	}
+	var file secretProfilesFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, errx.With(ErrInvalidSecretFile, " %s: %w", p, err)
+	}
+
+	secrets := make(map[string]Secret)
+	for _, name := range names {
+		entries, ok := file.Profiles[name]
+		if !ok {
+			return nil, errx.With(ErrUnknownSecretProfile, " %s in %s", name, p)
+		}
+		profile, err := parseSecretEntries(entries)
+		if err != nil {
+			return nil, errx.With(err, " in profile %s", name)
+		}
+		for n, s := range profile {
+			secrets[n] = s
+		}
+	}
+	return secrets, nil
+}
+
+// ApplySecretProfiles adds the secrets of n.SecretProfiles, read from the
+// profiles file at p, to n.Secrets. Secrets already in n.Secrets take
+// precedence over those of a profile with the same name.
+func (n *NetworkConfig) ApplySecretProfiles(p string) error {
+	if n == nil || len(n.SecretProfiles) == 0 {
+		return nil
+	}
+	secrets, err := LoadSecretProfiles(p, n.SecretProfiles)
+	if err != nil {
+		return err
+	}
+	if n.Secrets == nil {
+		n.Secrets = make(map[string]Secret, len(secrets))
+	}
+	for name, secret := range secrets {
+		if _, ok := n.Secrets[name]; !ok {
+			n.Secrets[name] = secret
+		}
+	}
+	return nil
+}
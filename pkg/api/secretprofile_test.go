@@ -0,0 +1,84 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecretProfiles = `
+profiles:
+  anthropic:
+    ANTHROPIC_API_KEY:
+      value: aws-sm:prod/anthropic
+      hosts: [api.anthropic.com/v1/messages]
+      methods: [POST]
+  github-readonly:
+    GH_TOKEN:
+      env: PROFILE_TEST_GH_READONLY
+      hosts: [api.github.com]
+      methods: [GET]
+  github-write:
+    GH_TOKEN:
+      value: ghp_write
+      hosts: [api.github.com]
+  broken:
+    MISSING:
+      hosts: [example.com]
+`
+
+func writeSecretProfiles(t *testing.T) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "secret-profiles.yaml")
+	require.NoError(t, os.WriteFile(p, []byte(testSecretProfiles), 0600))
+	return p
+}
+
+func TestLoadSecretProfiles(t *testing.T) {
+	t.Setenv("PROFILE_TEST_GH_READONLY", "ghp_read")
+	p := writeSecretProfiles(t)
+
+	secrets, err := LoadSecretProfiles(p, []string{"anthropic", "github-readonly"})
+	require.NoError(t, err)
+	require.Len(t, secrets, 2)
+	assert.Equal(t, "aws-sm:prod/anthropic", secrets["ANTHROPIC_API_KEY"].Value)
+	assert.Equal(t, []string{"api.anthropic.com"}, secrets["ANTHROPIC_API_KEY"].Hosts)
+	assert.Equal(t, []string{"/v1/messages"}, secrets["ANTHROPIC_API_KEY"].Paths)
+	assert.Equal(t, "ghp_read", secrets["GH_TOKEN"].Value)
+	assert.Equal(t, []string{"GET"}, secrets["GH_TOKEN"].Methods)
+
+	secrets, err = LoadSecretProfiles(p, []string{"github-readonly", "github-write"})
+	require.NoError(t, err)
+	assert.Equal(t, "ghp_write", secrets["GH_TOKEN"].Value, "later profile wins")
+}
+
+func TestLoadSecretProfilesErrors(t *testing.T) {
+	p := writeSecretProfiles(t)
+
+	_, err := LoadSecretProfiles(p, []string{"nope"})
+	assert.ErrorIs(t, err, ErrUnknownSecretProfile)
+
+	_, err = LoadSecretProfiles(filepath.Join(t.TempDir(), "missing.yaml"), []string{"anthropic"})
+	assert.ErrorIs(t, err, ErrUnknownSecretProfile)
+
+	_, err = LoadSecretProfiles(p, []string{"broken"})
+	assert.ErrorIs(t, err, ErrInvalidSecretFile)
+	assert.Contains(t, err.Error(), "profile broken")
+}
+
+func TestApplySecretProfiles(t *testing.T) {
+	p := writeSecretProfiles(t)
+	n := &NetworkConfig{
+		Secrets:        map[string]Secret{"GH_TOKEN": {Value: "explicit", Hosts: []string{"api.github.com"}}},
+		SecretProfiles: []string{"anthropic", "github-write"},
+	}
+	require.NoError(t, n.ApplySecretProfiles(p))
+	assert.Equal(t, "explicit", n.Secrets["GH_TOKEN"].Value)
+	assert.Contains(t, n.Secrets, "ANTHROPIC_API_KEY")
+
+	var none *NetworkConfig
+	assert.NoError(t, none.ApplySecretProfiles(p))
+}
@@ -0,0 +1,21 @@
+package api
+
+import "time"
+
+// SecretUsage records where and when a secret was injected into requests
+// over the lifetime of a sandbox, as evidence for key rotation and
+// least-privilege reviews. A secret that was never injected has zero
+// Injections and no LastUsed.
+type SecretUsage struct {
+	Name       string `json:"name"`
+	Injections int64  `json:"injections"`
+	// Hosts and Paths list the distinct hosts and URL paths (without query)
+	// the secret was injected into, in order of first use. Paths are capped
+	// at MaxSecretUsagePaths.
+	Hosts    []string   `json:"hosts,omitempty"`
+	Paths    []string   `json:"paths,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// MaxSecretUsagePaths bounds the distinct paths recorded per secret.
+const MaxSecretUsagePaths = 100
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// HMAC algorithms for RequestSigning.
+const (
+	SignHMACSHA1   = "hmac-sha1"
+	SignHMACSHA256 = "hmac-sha256"
+	SignHMACSHA512 = "hmac-sha512"
+)
+
+// Encodings of a RequestSigning signature.
+const (
+	SignEncodingHex    = "hex"
+	SignEncodingBase64 = "base64"
+)
+
+// RequestSigning makes the proxy sign the body of every request to a host
+// with an HMAC keyed by the value of Secret, and send it in Header as
+// Prefix followed by the encoded signature, e.g. "X-Hub-Signature-256:
+// sha256=<hex>". The key never enters the guest. Algorithm defaults to
+// SignHMACSHA256 and Encoding to SignEncodingHex.
+type RequestSigning struct {
+	Secret    string `json:"secret"`
+	Header    string `json:"header"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+}
+
+// ParseRequestSigning parses a spec such as
+// "hooks.example.com=secret=HOOK_KEY,header=X-Signature,algorithm=hmac-sha512"
+// into a host pattern and its signing options. Other options are encoding
+// (hex or base64) and prefix, which may itself contain "=", e.g.
+// "prefix=sha256=".
+func ParseRequestSigning(spec string) (string, RequestSigning, error) {
+	var rs RequestSigning
+	host, fields, ok := strings.Cut(spec, "=")
+	host = strings.TrimSpace(host)
+	if !ok || host == "" {
+		return "", rs, errx.With(ErrInvalidRequestSigning, ": %q is not HOST=OPTIONS", spec)
+	}
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "secret":
+			rs.Secret = value
+		case "header":
+			rs.Header = value
+		case "algorithm", "alg":
+			rs.Algorithm = strings.ToLower(value)
+		case "encoding":
+			rs.Encoding = strings.ToLower(value)
+		case "prefix":
+			rs.Prefix = value
+		default:
+			return "", rs, errx.With(ErrInvalidRequestSigning, ": unknown option %q (use secret, header, algorithm, encoding, prefix)", key)
+		}
+	}
+	if err := rs.validate(); err != nil {
+		return "", rs, err
+	}
+	return host, rs, nil
+}
+
+func (rs RequestSigning) validate() error {
+	if rs.Secret == "" {
+		return errx.With(ErrInvalidRequestSigning, ": secret is required")
+	}
+	if !isHeaderToken(rs.Header) {
+		return errx.With(ErrInvalidRequestSigning, ": header %q is not a valid header name", rs.Header)
+	}
+	switch rs.Algorithm {
+	case "", SignHMACSHA1, SignHMACSHA256, SignHMACSHA512:
+	default:
+		return errx.With(ErrInvalidRequestSigning, ": algorithm %q (use %s, %s or %s)", rs.Algorithm, SignHMACSHA256, SignHMACSHA512, SignHMACSHA1)
+	}
+	switch rs.Encoding {
+	case "", SignEncodingHex, SignEncodingBase64:
+	default:
+		return errx.With(ErrInvalidRequestSigning, ": encoding %q (use hex or base64)", rs.Encoding)
+	}
+	if strings.ContainsAny(rs.Prefix, "\r\n") {
+		return errx.With(ErrInvalidRequestSigning, ": prefix contains a line break")
+	}
+	return nil
+}
+
+// validateRequestSigning checks the signing options of every host and that
+// their keys are static secrets of the same config.
+func (n *NetworkConfig) validateRequestSigning() error {
+	for host, rs := range n.RequestSigning {
+		if err := rs.validate(); err != nil {
+			return errx.With(err, " for host %s", host)
+		}
+		secret, ok := n.Secrets[rs.Secret]
+		if !ok {
+			return errx.With(ErrInvalidRequestSigning, ": host %s is signed with undefined secret %s", host, rs.Secret)
+		}
+		if secret.MintsTokens() {
+			return errx.With(ErrInvalidRequestSigning, ": host %s is signed with token secret %s, which has no static key", host, rs.Secret)
+		}
+	}
+	return nil
+}
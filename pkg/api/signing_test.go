@@ -0,0 +1,50 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequestSigning(t *testing.T) {
+	host, rs, err := ParseRequestSigning("hooks.example.com=secret=HOOK_KEY,header=X-Hub-Signature-256,prefix=sha256=")
+	require.NoError(t, err)
+	assert.Equal(t, "hooks.example.com", host)
+	assert.Equal(t, RequestSigning{Secret: "HOOK_KEY", Header: "X-Hub-Signature-256", Prefix: "sha256="}, rs)
+
+	_, rs, err = ParseRequestSigning("*.internal=secret=K,header=X-Sig,alg=HMAC-SHA512,encoding=base64")
+	require.NoError(t, err)
+	assert.Equal(t, SignHMACSHA512, rs.Algorithm)
+	assert.Equal(t, SignEncodingBase64, rs.Encoding)
+
+	for _, bad := range []string{
+		"hooks.example.com",
+		"=secret=K,header=X-Sig",
+		"hooks.example.com=header=X-Sig",
+		"hooks.example.com=secret=K",
+		"hooks.example.com=secret=K,header=Bad Header",
+		"hooks.example.com=secret=K,header=X-Sig,algorithm=md5",
+		"hooks.example.com=secret=K,header=X-Sig,encoding=base32",
+		"hooks.example.com=secret=K,header=X-Sig,key=v",
+	} {
+		_, _, err := ParseRequestSigning(bad)
+		assert.ErrorIs(t, err, ErrInvalidRequestSigning, bad)
+	}
+}
+
+func TestValidateSecrets_RequestSigning(t *testing.T) {
+	n := &NetworkConfig{
+		Secrets:        map[string]Secret{"HOOK_KEY": {Value: "k", Hosts: []string{"hooks.example.com"}}},
+		RequestSigning: map[string]RequestSigning{"hooks.example.com": {Secret: "HOOK_KEY", Header: "X-Sig"}},
+	}
+	assert.NoError(t, n.ValidateSecrets())
+	assert.True(t, (&NetworkConfig{RequestSigning: n.RequestSigning}).NeedsInterception())
+
+	n.RequestSigning["other.example.com"] = RequestSigning{Secret: "MISSING", Header: "X-Sig"}
+	assert.ErrorIs(t, n.ValidateSecrets(), ErrInvalidRequestSigning)
+
+	n.RequestSigning = map[string]RequestSigning{"hooks.example.com": {Secret: "TOKEN", Header: "X-Sig"}}
+	n.Secrets["TOKEN"] = Secret{Hosts: []string{"a.com"}, OAuth2: &OAuth2{TokenURL: "https://a.com/token", ClientID: "c"}}
+	assert.ErrorIs(t, n.ValidateSecrets(), ErrInvalidRequestSigning)
+}
@@ -0,0 +1,58 @@
+package api
+
+import "github.com/jingkaihe/matchlock/internal/errx"
+
+// Swap types for Resources.SwapType.
+const (
+	// SwapZram compresses swapped-out pages into guest RAM. It needs no disk
+	// and vanishes with the VM. This is the default type.
+	SwapZram = "zram"
+	// SwapFile swaps to a sparse disk image in the sandbox's state directory.
+	// The image is attached as a separate block device, never written into
+	// the rootfs, and deleted when the sandbox is closed.
+	SwapFile = "file"
+)
+
+// MaxZramRatio caps zram swap at this multiple of guest memory. Compressed
+// pages still live in RAM, so a larger device only trades an OOM kill for
+// thrashing.
+const MaxZramRatio = 2
+
+// SwapKind returns the effective swap type, or "" when swap is disabled.
+func (r *Resources) SwapKind() string {
+	if r == nil || r.SwapMB <= 0 {
+		return ""
+	}
+	if r.SwapType == "" {
+		return SwapZram
+	}
+	return r.SwapType
+}
+
+// ValidateSwap checks SwapMB and SwapType.
+func (r *Resources) ValidateSwap() error {
+	if r == nil {
+		return nil
+	}
+	if r.SwapMB < 0 {
+		return errx.With(ErrInvalidSwap, ": size %d MB is negative", r.SwapMB)
+	}
+	switch r.SwapType {
+	case "", SwapZram, SwapFile:
+	default:
+		return errx.With(ErrInvalidSwap, ": unknown type %q (want %q or %q)", r.SwapType, SwapZram, SwapFile)
+	}
+	if r.SwapType != "" && r.SwapMB == 0 {
+		return errx.With(ErrInvalidSwap, ": type %q needs a size", r.SwapType)
+	}
+	if r.SwapKind() == SwapZram {
+		memoryMB := r.MemoryMB
+		if memoryMB <= 0 {
+			memoryMB = DefaultMemoryMB
+		}
+		if r.SwapMB > memoryMB*MaxZramRatio {
+			return errx.With(ErrInvalidSwap, ": zram size %d MB exceeds %dx memory (%d MB)", r.SwapMB, MaxZramRatio, memoryMB)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResourcesSwapKind(t *testing.T) {
+	var none *Resources
+	assert.Empty(t, none.SwapKind())
+	assert.Empty(t, (&Resources{SwapType: SwapFile}).SwapKind())
+	assert.Equal(t, SwapZram, (&Resources{SwapMB: 256}).SwapKind())
+	assert.Equal(t, SwapFile, (&Resources{SwapMB: 256, SwapType: SwapFile}).SwapKind())
+}
+
+func TestResourcesValidateSwap(t *testing.T) {
+	tests := []struct {
+		name string
+		res  *Resources
+		ok   bool
+	}{
+		{"nil", nil, true},
+		{"disabled", &Resources{MemoryMB: 512}, true},
+		{"zram", &Resources{MemoryMB: 512, SwapMB: 1024}, true},
+		{"zram default memory", &Resources{SwapMB: DefaultMemoryMB * MaxZramRatio}, true},
+		{"zram too large", &Resources{MemoryMB: 512, SwapMB: 1025}, false},
+		{"file larger than memory", &Resources{MemoryMB: 512, SwapMB: 8192, SwapType: SwapFile}, true},
+		{"negative", &Resources{SwapMB: -1}, false},
+		{"unknown type", &Resources{SwapMB: 256, SwapType: "partition"}, false},
+		{"type without size", &Resources{SwapType: SwapFile}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.res.ValidateSwap()
+			if tt.ok {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrInvalidSwap)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"strings"
+	"text/template"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// TemplateData is what templates in startup commands and env values are
+// rendered with, e.g. "{{.SandboxID}}", "{{.WorkspacePath}}" or
+// `{{.Label "task"}}`.
+type TemplateData struct {
+	SandboxID     string
+	WorkspacePath string
+	Labels        map[string]string
+}
+
+// Label returns the value of a sandbox label. A missing label is an error
+// so that a typo does not silently render as an empty string.
+func (d *TemplateData) Label(key string) (string, error) {
+	v, ok := d.Labels[key]
+	if !ok {
+		return "", errx.With(ErrTemplate, ": no label %q", key)
+	}
+	return v, nil
+}
+
+// ExpandTemplate renders s with data. Strings without "{{" are returned
+// unchanged.
+func ExpandTemplate(s string, data *TemplateData) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	tmpl, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", errx.With(ErrTemplate, " %q: %w", s, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", errx.With(ErrTemplate, " %q: %w", s, err)
+	}
+	return b.String(), nil
+}
+
+// ExpandTemplates renders each of args with data.
+func ExpandTemplates(args []string, data *TemplateData) ([]string, error) {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		v, err := ExpandTemplate(arg, data)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// ParseKeyValues parses KEY=VALUE pairs, as given to --env and --label. A
+// later pair overrides an earlier one with the same key.
+func ParseKeyValues(specs []string) (map[string]string, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	result := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok || key == "" {
+			return nil, errx.With(ErrInvalidKeyValue, ": %q", spec)
+		}
+		result[key] = value
+	}
+	return result, nil
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	data := &TemplateData{
+		SandboxID:     "vm-abc12345",
+		WorkspacePath: "/workspace",
+		Labels:        map[string]string{"task": "fix-login"},
+	}
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"{{.SandboxID}}", "vm-abc12345"},
+		{"{{.WorkspacePath}}/out", "/workspace/out"},
+		{`agent --task {{.Label "task"}}`, "agent --task fix-login"},
+	}
+	for _, tt := range tests {
+		got, err := ExpandTemplate(tt.in, data)
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, got)
+	}
+}
+
+func TestExpandTemplateErrors(t *testing.T) {
+	data := &TemplateData{SandboxID: "vm-abc12345"}
+
+	for _, in := range []string{`{{.Label "missing"}}`, "{{.Nope}}", "{{.SandboxID"} {
+		_, err := ExpandTemplate(in, data)
+		assert.ErrorIs(t, err, ErrTemplate, in)
+	}
+}
+
+func TestExpandTemplates(t *testing.T) {
+	got, err := ExpandTemplates([]string{"echo", "{{.SandboxID}}"}, &TemplateData{SandboxID: "vm-1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"echo", "vm-1"}, got)
+}
+
+func TestParseKeyValues(t *testing.T) {
+	got, err := ParseKeyValues([]string{"A=1", "B=x=y", "A=2", "EMPTY="})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"A": "2", "B": "x=y", "EMPTY": ""}, got)
+
+	got, err = ParseKeyValues(nil)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	for _, bad := range []string{"NOVALUE", "=value"} {
+		_, err := ParseKeyValues([]string{bad})
+		assert.ErrorIs(t, err, ErrInvalidKeyValue, bad)
+	}
+}
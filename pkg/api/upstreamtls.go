@@ -0,0 +1,76 @@
+package api
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// UpstreamTLS customizes how the proxy verifies the TLS server of an
+// intercepted host. RootCAFiles are PEM files on the host that replace the
+// system roots for that host. InsecureSkipVerify disables verification
+// entirely and is meant only for lab endpoints with self-signed certificates;
+// certificate pins, if any, are still enforced.
+type UpstreamTLS struct {
+	RootCAFiles        []string `json:"root_ca_files,omitempty"`
+	MinVersion         string   `json:"min_version,omitempty"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts a version such as "1.2" to its crypto/tls
+// constant. An empty string yields 0, leaving Go's default minimum in place.
+func ParseTLSVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(v), "tls")]
+	if !ok {
+		return 0, errx.With(ErrInvalidUpstreamTLS, ": TLS version %q (use 1.0, 1.1, 1.2 or 1.3)", v)
+	}
+	return version, nil
+}
+
+// ParseUpstreamTLS parses a spec such as
+// "internal.example.com=ca=/etc/ssl/lab-ca.pem,min-version=1.2" or
+// "10.0.0.5=insecure-skip-verify". The host may use allowlist wildcards and
+// ca may be repeated.
+func ParseUpstreamTLS(spec string) (string, UpstreamTLS, error) {
+	var opts UpstreamTLS
+	host, fields, ok := strings.Cut(spec, "=")
+	host = strings.TrimSpace(host)
+	if !ok || host == "" {
+		return "", opts, errx.With(ErrInvalidUpstreamTLS, ": %q is not HOST=OPTIONS", spec)
+	}
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "ca", "root-ca":
+			if value == "" {
+				return "", opts, errx.With(ErrInvalidUpstreamTLS, ": ca requires a file path")
+			}
+			opts.RootCAFiles = append(opts.RootCAFiles, value)
+		case "min-version", "min":
+			if _, err := ParseTLSVersion(value); err != nil {
+				return "", opts, err
+			}
+			opts.MinVersion = value
+		case "insecure-skip-verify", "insecure":
+			opts.InsecureSkipVerify = true
+		default:
+			return "", opts, errx.With(ErrInvalidUpstreamTLS, ": unknown option %q (use ca, min-version, insecure-skip-verify)", key)
+		}
+	}
+	return host, opts, nil
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	v, err := ParseTLSVersion("1.2")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), v)
+
+	v, err = ParseTLSVersion("TLS1.3")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), v)
+
+	v, err = ParseTLSVersion("")
+	require.NoError(t, err)
+	assert.Zero(t, v)
+
+	_, err = ParseTLSVersion("1.4")
+	require.ErrorIs(t, err, ErrInvalidUpstreamTLS)
+}
+
+func TestParseUpstreamTLS(t *testing.T) {
+	host, opts, err := ParseUpstreamTLS("*.lab.internal=ca=/etc/a.pem,ca=/etc/b.pem,min-version=1.3")
+	require.NoError(t, err)
+	assert.Equal(t, "*.lab.internal", host)
+	assert.Equal(t, UpstreamTLS{
+		RootCAFiles: []string{"/etc/a.pem", "/etc/b.pem"},
+		MinVersion:  "1.3",
+	}, opts)
+
+	host, opts, err = ParseUpstreamTLS("10.0.0.5=insecure-skip-verify")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.5", host)
+	assert.True(t, opts.InsecureSkipVerify)
+}
+
+func TestParseUpstreamTLS_Invalid(t *testing.T) {
+	for _, spec := range []string{
+		"lab.internal",
+		"=insecure",
+		"lab.internal=ca=",
+		"lab.internal=min-version=1.9",
+		"lab.internal=verify=false",
+	} {
+		_, _, err := ParseUpstreamTLS(spec)
+		assert.ErrorIs(t, err, ErrInvalidUpstreamTLS, spec)
+	}
+}
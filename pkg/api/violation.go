@@ -0,0 +1,62 @@
+package api
+
+import (
+	"errors"
+	"time"
+)
+
+// ViolationRule identifies the network rule that denied a guest flow.
+type ViolationRule string
+
+const (
+	RuleAllowlist     ViolationRule = "allowlist"
+	RuleHostPort      ViolationRule = "host_port"
+	RuleSecretLeak    ViolationRule = "secret_leak"
+	RuleSecretExpired ViolationRule = "secret_expired"
+	RuleCertPin       ViolationRule = "cert_pin"
+	RuleUpstreamTLS   ViolationRule = "upstream_tls"
+	RuleConnLimit     ViolationRule = "connection_limit"
+	RuleConnRateLimit ViolationRule = "connection_rate_limit"
+	RuleEgressBudget  ViolationRule = "egress_budget"
+	RulePolicy        ViolationRule = "policy"
+)
+
+var violationRules = []struct {
+	err  error
+	rule ViolationRule
+}{
+	{ErrHostNotAllowed, RuleAllowlist},
+	{ErrHostPortNotAllowed, RuleHostPort},
+	{ErrSecretLeak, RuleSecretLeak},
+	{ErrSecretScope, RuleSecretLeak},
+	{ErrSecretExpired, RuleSecretExpired},
+	{ErrCertPinMismatch, RuleCertPin},
+	{ErrInvalidUpstreamTLS, RuleUpstreamTLS},
+	{ErrUpstreamRootCA, RuleUpstreamTLS},
+	{ErrConnLimit, RuleConnLimit},
+	{ErrConnRateLimit, RuleConnRateLimit},
+	{ErrEgressBudget, RuleEgressBudget},
+}
+
+// ViolationRuleOf classifies a denial error. Errors not derived from one of
+// the network sentinel errors are reported as RulePolicy.
+func ViolationRuleOf(err error) ViolationRule {
+	for _, vr := range violationRules {
+		if errors.Is(err, vr.err) {
+			return vr.rule
+		}
+	}
+	return RulePolicy
+}
+
+// NetworkViolation aggregates the denials of one rule for one destination
+// host. Orchestrators can use it to decide, for example, whether to ask the
+// user to extend the allowlist.
+type NetworkViolation struct {
+	Host      string        `json:"host"`
+	Rule      ViolationRule `json:"rule"`
+	Reason    string        `json:"reason"`
+	Count     int64         `json:"count"`
+	FirstSeen time.Time     `json:"first_seen"`
+	LastSeen  time.Time     `json:"last_seen"`
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViolationRuleOf(t *testing.T) {
+	assert.Equal(t, RuleAllowlist, ViolationRuleOf(ErrHostNotAllowed))
+	assert.Equal(t, RuleSecretLeak, ViolationRuleOf(ErrSecretLeak))
+	assert.Equal(t, RuleSecretExpired, ViolationRuleOf(errx.With(ErrSecretExpired, ": %s", "API_KEY")))
+	assert.Equal(t, RuleCertPin, ViolationRuleOf(ErrCertPinMismatch))
+	assert.Equal(t, RuleHostPort, ViolationRuleOf(ErrHostPortNotAllowed))
+	assert.Equal(t, RuleConnLimit, ViolationRuleOf(errx.With(ErrConnLimit, " (%d open)", 5)))
+	assert.Equal(t, RuleConnRateLimit, ViolationRuleOf(errx.With(ErrConnRateLimit, " (%d per minute)", 60)))
+	assert.Equal(t, RuleEgressBudget, ViolationRuleOf(errx.With(ErrEgressBudget, " (%d bytes)", 1024)))
+	assert.Equal(t, RuleUpstreamTLS, ViolationRuleOf(errx.With(ErrUpstreamRootCA, " %s: %w", "ca.pem", errors.New("missing"))))
+	assert.Equal(t, RulePolicy, ViolationRuleOf(errors.New("custom hook denial")))
+}
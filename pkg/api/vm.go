@@ -13,6 +13,13 @@ type ExecOptions struct {
 	Stdout     io.Writer
 	Stderr     io.Writer
 	User       string // "uid", "uid:gid", or username — resolved in guest
+	// RawArgv, when set, is executed directly as argv without a shell, so
+	// quotes, globs and variables are passed through literally. The command
+	// string is then only descriptive; ShellQuoteArgs(RawArgv) is a good value.
+	RawArgv []string
+	// CreateWorkingDir creates WorkingDir in the guest, owned by User, if it
+	// does not exist. Otherwise a missing WorkingDir fails with ErrWorkingDir.
+	CreateWorkingDir bool
 }
 
 type ExecResult struct {
@@ -29,6 +36,9 @@ type FileInfo struct {
 	Mode    uint32    `json:"mode"`
 	ModTime time.Time `json:"mod_time"`
 	IsDir   bool      `json:"is_dir"`
+	// UID and GID are the owner the guest sees.
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
 }
 
 type VM interface {
@@ -53,15 +63,34 @@ type Event struct {
 }
 
 type NetworkEvent struct {
-	Method        string `json:"method"`
-	URL           string `json:"url"`
+	Method        string        `json:"method"`
+	URL           string        `json:"url"`
+	Host          string        `json:"host"`
+	StatusCode    int           `json:"status_code"`
+	RequestBytes  int64         `json:"request_bytes"`
+	ResponseBytes int64         `json:"response_bytes"`
+	DurationMS    int64         `json:"duration_ms"`
+	Blocked       bool          `json:"blocked"`
+	BlockReason   string        `json:"block_reason,omitempty"`
+	Error         string        `json:"error,omitempty"`
+	Rule          ViolationRule `json:"rule,omitempty"`
+	InsecureTLS   bool          `json:"insecure_tls,omitempty"`
+	Severity      string        `json:"severity,omitempty"`
+}
+
+// SeverityHigh marks network events that signal a likely compromise, such
+// as a secret placeholder sent to a host the secret is not bound to.
+const SeverityHigh = "high"
+
+// HostMetrics aggregates network activity towards a single destination host
+// over the lifetime of a sandbox.
+type HostMetrics struct {
 	Host          string `json:"host"`
-	StatusCode    int    `json:"status_code"`
-	RequestBytes  int64  `json:"request_bytes"`
-	ResponseBytes int64  `json:"response_bytes"`
-	DurationMS    int64  `json:"duration_ms"`
-	Blocked       bool   `json:"blocked"`
-	BlockReason   string `json:"block_reason,omitempty"`
+	Requests      int64  `json:"requests"`
+	Blocked       int64  `json:"blocked"`
+	Errors        int64  `json:"errors"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
 }
 
 type FileEvent struct {
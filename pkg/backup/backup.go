@@ -0,0 +1,395 @@
+// Package backup archives and restores the matchlock host state, so a host
+// can be rebuilt or migrated with its sandbox inventory intact.
+//
+// An archive is a gzipped tar whose first entry is manifest.json. The other
+// entries live under one directory per section:
+//
+//	state/   sandbox state and subnet allocations (~/.matchlock)
+//	images/  image and snapshot metadata (~/.cache/matchlock/images)
+//	config/  presets and trust policy (~/.config/matchlock)
+//
+// Disk images (*.ext4) are only archived with Options.Data. Without them
+// restored sandboxes keep their config, logs and exit status, and can be
+// re-created with run --from. Images whose disk is missing are not restored.
+// Runtime files (pids, sockets, swap) are never archived.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/image"
+	"github.com/jingkaihe/matchlock/pkg/version"
+)
+
+// FormatVersion is the archive layout version written to the manifest.
+const FormatVersion = 1
+
+const manifestName = "manifest.json"
+
+// Paths are the host directories a backup covers.
+type Paths struct {
+	StateDir  string
+	ImageDir  string
+	ConfigDir string
+}
+
+// DefaultPaths returns the directories matchlock uses for the current user.
+func DefaultPaths() Paths {
+	home, _ := os.UserHomeDir()
+	return Paths{
+		StateDir:  filepath.Join(home, ".matchlock"),
+		ImageDir:  filepath.Join(home, ".cache", "matchlock", "images"),
+		ConfigDir: filepath.Join(home, ".config", "matchlock"),
+	}
+}
+
+// Manifest describes the contents of an archive.
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Matchlock string    `json:"matchlock_version"`
+	Platform  string    `json:"platform"`
+	Data      bool      `json:"data"`
+	Sandboxes []string  `json:"sandboxes,omitempty"`
+	Images    []string  `json:"images,omitempty"`
+	Files     int       `json:"files"`
+}
+
+// Options control what Create archives.
+type Options struct {
+	// Data includes sandbox and image disks.
+	Data bool
+}
+
+// RestoreOptions control how Restore writes files.
+type RestoreOptions struct {
+	// Overwrite replaces existing files instead of skipping them.
+	Overwrite bool
+}
+
+// Result reports what Restore did.
+type Result struct {
+	Manifest Manifest
+	Restored int
+	// Skipped lists the archive paths left alone because they already exist
+	// or belong to an image whose disk is missing.
+	Skipped []string
+}
+
+// section maps an archive directory to a host directory, and decides which
+// files below it, by slash-separated relative path, are archived.
+type section struct {
+	name    string
+	dir     string
+	include func(rel string, data bool) bool
+}
+
+func sections(p Paths) []section {
+	return []section{
+		{name: "state", dir: p.StateDir, include: includeState},
+		{name: "images", dir: p.ImageDir, include: includeImage},
+		{name: "config", dir: p.ConfigDir, include: func(string, bool) bool { return true }},
+	}
+}
+
+func includeState(rel string, data bool) bool {
+	parts := strings.Split(rel, "/")
+	switch parts[0] {
+	case "subnets":
+		return len(parts) == 2
+	case "vms":
+		if len(parts) < 3 {
+			return false
+		}
+		name := parts[len(parts)-1]
+		switch {
+		case len(parts) == 3 && (name == "pid" || name == "swap.img"):
+			return false
+		case strings.HasSuffix(name, ".tmp"):
+			return false
+		case strings.HasSuffix(name, ".ext4"):
+			return data
+		}
+		return true
+	}
+	return false
+}
+
+// includeImage keeps the metadata and, with data, the disk of registry
+// cached images (<ref>/) and local images and snapshots (local/<tag>/).
+func includeImage(rel string, data bool) bool {
+	parts := strings.Split(rel, "/")
+	if len(parts) != 2 && !(len(parts) == 3 && parts[0] == "local") {
+		return false
+	}
+	name := parts[len(parts)-1]
+	return name == "metadata.json" || (data && strings.HasSuffix(name, ".ext4"))
+}
+
+type entry struct {
+	name string // archive path
+	path string // host path
+}
+
+// Create writes an archive of the host state at p to w.
+func Create(w io.Writer, p Paths, opts Options) (*Manifest, error) {
+	manifest := &Manifest{
+		Version:   FormatVersion,
+		CreatedAt: time.Now().UTC(),
+		Matchlock: version.Version,
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Data:      opts.Data,
+	}
+
+	var entries []entry
+	for _, s := range sections(p) {
+		found, err := collect(s, opts.Data)
+		if err != nil {
+			return nil, errx.Wrap(ErrCreateBackup, err)
+		}
+		entries = append(entries, found...)
+	}
+	manifest.Files = len(entries)
+
+	sandboxes := make(map[string]bool)
+	for _, e := range entries {
+		parts := strings.Split(e.name, "/")
+		if parts[0] == "state" && parts[1] == "vms" {
+			sandboxes[parts[2]] = true
+		}
+		if parts[0] == "images" && path.Base(e.name) == "metadata.json" {
+			manifest.Images = append(manifest.Images, imageTag(e))
+		}
+	}
+	for id := range sandboxes {
+		manifest.Sandboxes = append(manifest.Sandboxes, id)
+	}
+	sort.Strings(manifest.Sandboxes)
+	sort.Strings(manifest.Images)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, errx.Wrap(ErrCreateBackup, err)
+	}
+	hdr := &tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(manifestJSON)),
+		ModTime: manifest.CreatedAt,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, errx.Wrap(ErrCreateBackup, err)
+	}
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return nil, errx.Wrap(ErrCreateBackup, err)
+	}
+
+	for _, e := range entries {
+		if err := addFile(tw, e); err != nil {
+			return nil, errx.With(ErrCreateBackup, " %s: %w", e.path, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, errx.Wrap(ErrCreateBackup, err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, errx.Wrap(ErrCreateBackup, err)
+	}
+	return manifest, nil
+}
+
+// collect lists the regular files of s. Within a directory, metadata.json
+// sorts after the disks so Restore sees an image's disk before its metadata.
+func collect(s section, data bool) ([]entry, error) {
+	var entries []entry
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == s.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if s.include(rel, data) {
+			entries = append(entries, entry{name: s.name + "/" + rel, path: p})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		di, dj := path.Dir(entries[i].name), path.Dir(entries[j].name)
+		if di != dj {
+			return di < dj
+		}
+		mi, mj := path.Base(entries[i].name) == "metadata.json", path.Base(entries[j].name) == "metadata.json"
+		if mi != mj {
+			return mj
+		}
+		return entries[i].name < entries[j].name
+	})
+	return entries, nil
+}
+
+func imageTag(e entry) string {
+	data, err := os.ReadFile(e.path)
+	if err == nil {
+		var meta image.ImageMeta
+		if json.Unmarshal(data, &meta) == nil && meta.Tag != "" {
+			return meta.Tag
+		}
+	}
+	return path.Base(path.Dir(e.name))
+}
+
+func addFile(tw *tar.Writer, e entry) error {
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    e.name,
+		Mode:    int64(fi.Mode().Perm()),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// Logs of running sandboxes may grow meanwhile; archive what was there.
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
+
+// Restore unpacks an archive read from r into the host directories at p.
+// Existing files are skipped unless opts.Overwrite is set.
+func Restore(r io.Reader, p Paths, opts RestoreOptions) (*Result, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errx.Wrap(ErrInvalidArchive, err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, errx.Wrap(ErrInvalidArchive, err)
+	}
+	if hdr.Name != manifestName {
+		return nil, errx.With(ErrInvalidArchive, ": first entry is %q, want %s", hdr.Name, manifestName)
+	}
+	result := &Result{}
+	if err := json.NewDecoder(tr).Decode(&result.Manifest); err != nil {
+		return nil, errx.With(ErrInvalidArchive, ": manifest: %w", err)
+	}
+	if result.Manifest.Version != FormatVersion {
+		return nil, errx.With(ErrInvalidArchive, ": unsupported format version %d", result.Manifest.Version)
+	}
+
+	dirs := make(map[string]section)
+	for _, s := range sections(p) {
+		dirs[s.name] = s
+	}
+
+	images := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, errx.Wrap(ErrInvalidArchive, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return result, errx.With(ErrInvalidArchive, ": %q is not a regular file", hdr.Name)
+		}
+
+		name, rel, ok := strings.Cut(hdr.Name, "/")
+		s, known := dirs[name]
+		if !ok || !known || !fs.ValidPath(rel) || !s.include(rel, true) {
+			return result, errx.With(ErrInvalidArchive, ": unexpected entry %q", hdr.Name)
+		}
+		dest := filepath.Join(s.dir, filepath.FromSlash(rel))
+
+		if name == "images" && path.Base(rel) == "metadata.json" && !hasDisk(filepath.Dir(dest)) {
+			result.Skipped = append(result.Skipped, hdr.Name)
+			continue
+		}
+		if _, err := os.Lstat(dest); err == nil && !opts.Overwrite {
+			result.Skipped = append(result.Skipped, hdr.Name)
+			continue
+		}
+
+		if err := writeFile(dest, tr, fs.FileMode(hdr.Mode).Perm()); err != nil {
+			return result, errx.With(ErrRestoreBackup, " %s: %w", dest, err)
+		}
+		result.Restored++
+		images = images || name == "images"
+	}
+	// The image indexes do not know what was restored around them.
+	if images {
+		if err := image.Reindex(p.ImageDir); err != nil {
+			return result, errx.Wrap(ErrRestoreBackup, err)
+		}
+	}
+	return result, nil
+}
+
+func hasDisk(dir string) bool {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.ext4"))
+	return len(matches) > 0
+}
+
+// writeFile writes r to dest through a temporary file, so an interrupted
+// restore never leaves a truncated file behind.
+func writeFile(dest string, r io.Reader, perm fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	tmp := dest + ".restore"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
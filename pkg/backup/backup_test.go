@@ -0,0 +1,189 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/image"
+)
+
+func testPaths(t *testing.T) Paths {
+	t.Helper()
+	root := t.TempDir()
+	return Paths{
+		StateDir:  filepath.Join(root, "state"),
+		ImageDir:  filepath.Join(root, "images"),
+		ConfigDir: filepath.Join(root, "config"),
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+}
+
+func populate(t *testing.T, p Paths) {
+	t.Helper()
+	vm := filepath.Join(p.StateDir, "vms", "vm-abc")
+	writeTestFile(t, filepath.Join(vm, "config.json"), `{"image":"alpine:latest"}`)
+	writeTestFile(t, filepath.Join(vm, "status"), "stopped")
+	writeTestFile(t, filepath.Join(vm, "pid"), "1234")
+	writeTestFile(t, filepath.Join(vm, "swap.img"), "swap")
+	writeTestFile(t, filepath.Join(vm, "rootfs.ext4"), "vm disk")
+	writeTestFile(t, filepath.Join(vm, "logs", "vm.log"), "booted")
+	writeTestFile(t, filepath.Join(p.StateDir, "subnets", "vm-abc.json"), `{"octet":100}`)
+
+	snap := filepath.Join(p.ImageDir, "local", "fixture_abc")
+	writeTestFile(t, filepath.Join(snap, "rootfs.ext4"), "snapshot disk")
+	writeTestFile(t, filepath.Join(snap, "metadata.json"), `{"tag":"fixture:abc","source":"snapshot"}`)
+	writeTestFile(t, filepath.Join(p.ImageDir, "alpine_latest", "metadata.json"), `{"tag":"alpine:latest"}`)
+	writeTestFile(t, filepath.Join(p.ImageDir, "alpine_latest", "abc123.ext4"), "image disk")
+
+	writeTestFile(t, filepath.Join(p.ConfigDir, "presets.json"), `{"sizes":{}}`)
+}
+
+func TestCreateAndRestore(t *testing.T) {
+	src := testPaths(t)
+	populate(t, src)
+
+	var buf bytes.Buffer
+	manifest, err := Create(&buf, src, Options{Data: true})
+	require.NoError(t, err)
+	assert.Equal(t, FormatVersion, manifest.Version)
+	assert.True(t, manifest.Data)
+	assert.Equal(t, []string{"vm-abc"}, manifest.Sandboxes)
+	assert.Equal(t, []string{"alpine:latest", "fixture:abc"}, manifest.Images)
+	assert.Equal(t, 10, manifest.Files)
+
+	dst := testPaths(t)
+	result, err := Restore(&buf, dst, RestoreOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 10, result.Restored)
+	assert.Empty(t, result.Skipped)
+	assert.Equal(t, []string{"vm-abc"}, result.Manifest.Sandboxes)
+
+	for _, rel := range []string{
+		"state/vms/vm-abc/config.json",
+		"state/vms/vm-abc/rootfs.ext4",
+		"state/vms/vm-abc/logs/vm.log",
+		"state/subnets/vm-abc.json",
+		"images/local/fixture_abc/rootfs.ext4",
+		"images/local/fixture_abc/metadata.json",
+		"images/alpine_latest/abc123.ext4",
+		"config/presets.json",
+	} {
+		want, err := os.ReadFile(filepath.Join(filepath.Dir(src.StateDir), rel))
+		require.NoError(t, err)
+		got, err := os.ReadFile(filepath.Join(filepath.Dir(dst.StateDir), rel))
+		require.NoError(t, err, rel)
+		assert.Equal(t, want, got, rel)
+	}
+	for _, rel := range []string{"pid", "swap.img"} {
+		assert.NoFileExists(t, filepath.Join(dst.StateDir, "vms", "vm-abc", rel))
+	}
+}
+
+func TestRestoreReindexesImages(t *testing.T) {
+	src := testPaths(t)
+	populate(t, src)
+	var buf bytes.Buffer
+	_, err := Create(&buf, src, Options{Data: true})
+	require.NoError(t, err)
+
+	dst := testPaths(t)
+	require.NoError(t, os.MkdirAll(dst.ImageDir, 0755))
+	images, err := image.ListRegistryCache(dst.ImageDir)
+	require.NoError(t, err)
+	require.Empty(t, images, "the destination is indexed before the restore")
+
+	_, err = Restore(&buf, dst, RestoreOptions{})
+	require.NoError(t, err)
+	images, err = image.ListRegistryCache(dst.ImageDir)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, "alpine:latest", images[0].Tag)
+	local, err := image.NewStore(filepath.Join(dst.ImageDir, "local")).List()
+	require.NoError(t, err)
+	require.Len(t, local, 1)
+	assert.Equal(t, "fixture:abc", local[0].Tag)
+}
+
+func TestCreateWithoutData(t *testing.T) {
+	src := testPaths(t)
+	populate(t, src)
+
+	var buf bytes.Buffer
+	manifest, err := Create(&buf, src, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, 7, manifest.Files)
+
+	dst := testPaths(t)
+	result, err := Restore(&buf, dst, RestoreOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 5, result.Restored)
+	assert.ElementsMatch(t, []string{
+		"images/alpine_latest/metadata.json",
+		"images/local/fixture_abc/metadata.json",
+	}, result.Skipped, "image metadata is not restored without the disk")
+
+	assert.FileExists(t, filepath.Join(dst.StateDir, "vms", "vm-abc", "config.json"))
+	assert.NoFileExists(t, filepath.Join(dst.StateDir, "vms", "vm-abc", "rootfs.ext4"))
+}
+
+func TestRestoreKeepsExistingFiles(t *testing.T) {
+	src := testPaths(t)
+	populate(t, src)
+
+	var buf bytes.Buffer
+	_, err := Create(&buf, src, Options{})
+	require.NoError(t, err)
+	archive := buf.Bytes()
+
+	dst := testPaths(t)
+	presets := filepath.Join(dst.ConfigDir, "presets.json")
+	writeTestFile(t, presets, "mine")
+
+	result, err := Restore(bytes.NewReader(archive), dst, RestoreOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, result.Skipped, "config/presets.json")
+	got, _ := os.ReadFile(presets)
+	assert.Equal(t, "mine", string(got))
+
+	_, err = Restore(bytes.NewReader(archive), dst, RestoreOptions{Overwrite: true})
+	require.NoError(t, err)
+	got, _ = os.ReadFile(presets)
+	assert.Equal(t, `{"sizes":{}}`, string(got))
+}
+
+func TestRestoreRejectsUnexpectedEntries(t *testing.T) {
+	for _, name := range []string{"state/../../etc/passwd", "other/file", "state/vms/vm-abc/pid"} {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		manifest := []byte(`{"version":1}`)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: manifestName, Mode: 0644, Size: int64(len(manifest))}))
+		_, err := tw.Write(manifest)
+		require.NoError(t, err)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 1}))
+		_, err = tw.Write([]byte("x"))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		require.NoError(t, gz.Close())
+
+		_, err = Restore(&buf, testPaths(t), RestoreOptions{})
+		assert.ErrorIs(t, err, ErrInvalidArchive, name)
+	}
+}
+
+func TestRestoreRejectsMissingManifest(t *testing.T) {
+	_, err := Restore(bytes.NewReader([]byte("not an archive")), testPaths(t), RestoreOptions{})
+	assert.ErrorIs(t, err, ErrInvalidArchive)
+}
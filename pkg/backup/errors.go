@@ -0,0 +1,9 @@
+package backup
+
+import "errors"
+
+var (
+	ErrCreateBackup   = errors.New("create backup")
+	ErrRestoreBackup  = errors.New("restore backup")
+	ErrInvalidArchive = errors.New("invalid backup archive")
+)
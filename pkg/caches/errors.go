@@ -0,0 +1,13 @@
+package caches
+
+import "errors"
+
+var (
+	ErrInvalidName = errors.New("invalid cache name")
+	ErrNotFound    = errors.New("cache not found")
+	ErrPrepare     = errors.New("prepare cache")
+	ErrRead        = errors.New("read caches")
+	ErrRemove      = errors.New("remove cache")
+	ErrPrune       = errors.New("prune caches")
+	ErrCommit      = errors.New("store cache file")
+)
@@ -0,0 +1,271 @@
+package caches
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+// writeFlags are the open flags that make an Open a write.
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+// Provider serves a named cache to a sandbox. Reads and directory changes
+// go to the cache's tree, confined to it as a real_fs mount is; writes are
+// staged and committed when the file is closed.
+type Provider struct {
+	store *Store
+	dir   string
+	tree  *vfs.RealFSProvider
+}
+
+// Provider returns the named cache, which Prepare must have created.
+func (s *Store) Provider(name string) *Provider {
+	dir := s.TreeDir(name)
+	return &Provider{store: s, dir: dir, tree: vfs.NewRealFSProvider(dir)}
+}
+
+func (p *Provider) Readonly() bool { return false }
+
+func (p *Provider) Stat(path string) (vfs.FileInfo, error)      { return p.tree.Stat(path) }
+func (p *Provider) ReadDir(path string) ([]vfs.DirEntry, error) { return p.tree.ReadDir(path) }
+func (p *Provider) Mkdir(path string, mode os.FileMode) error   { return p.tree.Mkdir(path, mode) }
+func (p *Provider) Remove(path string) error                    { return p.tree.Remove(path) }
+func (p *Provider) RemoveAll(path string) error                 { return p.tree.RemoveAll(path) }
+func (p *Provider) Rename(oldPath, newPath string) error        { return p.tree.Rename(oldPath, newPath) }
+func (p *Provider) Symlink(target, link string) error           { return p.tree.Symlink(target, link) }
+func (p *Provider) Readlink(path string) (string, error)        { return p.tree.Readlink(path) }
+
+func (p *Provider) Open(path string, flags int, mode os.FileMode) (vfs.Handle, error) {
+	if flags&writeFlags == 0 {
+		return p.tree.Open(path, flags, mode)
+	}
+	return p.openWrite(path, flags, mode)
+}
+
+func (p *Provider) Create(path string, mode os.FileMode) (vfs.Handle, error) {
+	return p.openWrite(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode)
+}
+
+// Chmod changes the permissions of a file by committing its contents again
+// under the new ones, as stored contents are shared by every file holding
+// them.
+func (p *Provider) Chmod(path string, mode os.FileMode) error {
+	info, err := p.tree.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return p.tree.Chmod(path, mode)
+	}
+	if info.Mode().Perm() == mode.Perm() {
+		return nil
+	}
+	h, err := p.openWrite(path, os.O_RDWR, mode)
+	if err != nil {
+		return err
+	}
+	h.perm = mode.Perm()
+	return h.Close()
+}
+
+// openWrite stages a write of path in a temporary file, holding the
+// current contents unless they are truncated.
+func (p *Provider) openWrite(path string, flags int, mode os.FileMode) (*writeHandle, error) {
+	info, err := p.tree.Stat(path)
+	exists := err == nil
+	switch {
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	case exists && info.IsDir():
+		return nil, syscall.EISDIR
+	case exists && flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0:
+		return nil, syscall.EEXIST
+	case !exists && flags&os.O_CREATE == 0:
+		return nil, syscall.ENOENT
+	}
+	perm := mode.Perm()
+	if exists {
+		perm = info.Mode().Perm()
+	} else if parent, err := p.tree.Stat(filepath.Dir(filepath.Clean("/" + path))); err != nil {
+		return nil, err
+	} else if !parent.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+
+	f, err := os.CreateTemp(filepath.Join(p.store.dir, tmpDir), "write-*")
+	if err != nil {
+		return nil, err
+	}
+	h := &writeHandle{file: f, p: p, path: path, perm: perm}
+	if exists && flags&os.O_TRUNC == 0 {
+		src, err := p.tree.Open(path, os.O_RDONLY, 0)
+		if err == nil {
+			_, err = vfs.CopySparse(f, src)
+			src.Close()
+		}
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			h.abort()
+			return nil, err
+		}
+	}
+	h.append = flags&os.O_APPEND != 0
+	return h, nil
+}
+
+// commit stores the contents of the closed temporary file tmp, with perm,
+// and links them at path in the tree.
+func (p *Provider) commit(tmp, path string, perm os.FileMode) error {
+	sum, err := fileSHA256(tmp)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s-%o", sum, perm)
+
+	unlock, err := p.store.lock(unix.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	objects, err := os.Open(filepath.Join(p.store.dir, objectsDir))
+	if err != nil {
+		return err
+	}
+	defer objects.Close()
+
+	// The contents are stored once: a file already holding them is reused.
+	src, srcName := int(objects.Fd()), key
+	if err := unix.Linkat(unix.AT_FDCWD, tmp, src, key, 0); err != nil && !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+
+	// The parent is resolved within the tree, and linked into and renamed
+	// in by descriptor, so a symlink swapped in cannot lead the file out.
+	root, err := os.OpenRoot(p.dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	clean := filepath.Clean("/" + path)
+	parentRel := "."
+	if dir := filepath.Dir(clean); dir != "/" {
+		parentRel = dir[1:]
+	}
+	parent, err := root.Open(parentRel)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	stage, err := stageName()
+	if err != nil {
+		return err
+	}
+	dst := int(parent.Fd())
+	err = unix.Linkat(src, srcName, dst, stage, 0)
+	if errors.Is(err, unix.EMLINK) {
+		// Contents common enough to reach the link limit, such as an
+		// empty file, get a copy of their own.
+		err = unix.Linkat(unix.AT_FDCWD, tmp, dst, stage, 0)
+	}
+	if err != nil {
+		return err
+	}
+	err = unix.Renameat(dst, stage, dst, filepath.Base(clean))
+	// Renaming a link over another link to the same file leaves both, so
+	// the staged name is removed whether or not the rename moved it.
+	unix.Unlinkat(dst, stage, 0)
+	return err
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stageName returns a name to link a committed file at before it is renamed
+// over its path.
+func stageName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return ".matchlock-stage-" + hex.EncodeToString(b), nil
+}
+
+// writeHandle is an open write of a cache file, committed on Close.
+type writeHandle struct {
+	file   *os.File
+	p      *Provider
+	path   string
+	perm   os.FileMode
+	append bool
+}
+
+func (h *writeHandle) Read(b []byte) (int, error)                { return h.file.Read(b) }
+func (h *writeHandle) ReadAt(b []byte, off int64) (int, error)   { return h.file.ReadAt(b, off) }
+func (h *writeHandle) WriteAt(b []byte, off int64) (int, error)  { return h.file.WriteAt(b, off) }
+func (h *writeHandle) Seek(off int64, whence int) (int64, error) { return h.file.Seek(off, whence) }
+func (h *writeHandle) Truncate(size int64) error                 { return h.file.Truncate(size) }
+func (h *writeHandle) Sync() error                               { return nil }
+
+func (h *writeHandle) Write(b []byte) (int, error) {
+	if h.append {
+		if _, err := h.file.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+	}
+	return h.file.Write(b)
+}
+
+func (h *writeHandle) Stat() (vfs.FileInfo, error) {
+	info, err := h.file.Stat()
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	return vfs.NewFileInfo(filepath.Base(h.path), info.Size(), h.perm, info.ModTime(), false), nil
+}
+
+func (h *writeHandle) Close() error {
+	defer os.Remove(h.file.Name())
+	err := h.file.Chmod(h.perm)
+	if closeErr := h.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = h.p.commit(h.file.Name(), h.path, h.perm)
+	}
+	if err != nil {
+		return errx.With(ErrCommit, " %s: %w", h.path, err)
+	}
+	return nil
+}
+
+// abort drops the write without committing it.
+func (h *writeHandle) abort() {
+	h.file.Close()
+	os.Remove(h.file.Name())
+}
@@ -0,0 +1,202 @@
+// Package caches keeps package caches (pip, npm, Go modules, model hubs)
+// on the host, shared by every sandbox that mounts them, so a fleet of
+// sandboxes running in parallel downloads each package once.
+//
+// A store holds the contents of the files of all its caches once each,
+// named by their SHA-256 and permissions, and one directory tree per named
+// cache whose files are hard links to them:
+//
+//	~/.cache/matchlock/caches/objects/<sha256>-<perm>
+//	~/.cache/matchlock/caches/trees/<name>/...
+//	~/.cache/matchlock/caches/tmp/
+//	~/.cache/matchlock/caches/lock
+//
+// Files are never written in place. A write goes to a file in tmp/, and
+// closing it links the contents into objects/ and then renames a link to
+// them over the file's path, so concurrent sandboxes see each version of a
+// file whole or not at all, and the last one closed wins. Pruning objects no
+// tree links to anymore takes the store lock exclusively; writes take it
+// shared.
+package caches
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/storename"
+)
+
+const (
+	objectsDir = "objects"
+	treesDir   = "trees"
+	tmpDir     = "tmp"
+	lockFile   = "lock"
+
+	// staleTemp is the age past which Prune removes files in tmp/, left by
+	// writes that were never closed.
+	staleTemp = 24 * time.Hour
+)
+
+// Cache describes a named cache in a store.
+type Cache struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"` // apparent size of its files
+}
+
+// Store is a directory of shared caches.
+type Store struct {
+	dir string
+}
+
+// NewStore returns a store rooted at dir, defaulting to
+// ~/.cache/matchlock/caches.
+func NewStore(dir string) *Store {
+	return &Store{dir: storename.Dir(dir, ".cache", "matchlock", "caches")}
+}
+
+// ValidateName checks that name can be used for a cache.
+func ValidateName(name string) error {
+	return storename.Validate(ErrInvalidName, name)
+}
+
+// TreeDir returns the directory holding the files of the named cache.
+func (s *Store) TreeDir(name string) string {
+	return filepath.Join(s.dir, treesDir, name)
+}
+
+// Prepare creates the store and the named cache if they do not exist yet
+// and returns the cache's tree directory.
+func (s *Store) Prepare(name string) (string, error) {
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+	for _, dir := range []string{filepath.Join(s.dir, objectsDir), filepath.Join(s.dir, tmpDir), s.TreeDir(name)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", errx.Wrap(ErrPrepare, err)
+		}
+	}
+	return s.TreeDir(name), nil
+}
+
+// List returns the caches in the store by name.
+func (s *Store) List() ([]Cache, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, treesDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errx.Wrap(ErrRead, err)
+	}
+	var caches []Cache
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		c := Cache{Name: e.Name()}
+		filepath.WalkDir(s.TreeDir(e.Name()), func(_ string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				c.Files++
+				c.Size += info.Size()
+			}
+			return nil
+		})
+		caches = append(caches, c)
+	}
+	sort.Slice(caches, func(i, j int) bool { return caches[i].Name < caches[j].Name })
+	return caches, nil
+}
+
+// Remove deletes the named cache. The space its files held is freed by the
+// next Prune, once no other cache shares them.
+func (s *Store) Remove(name string) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+	dir := s.TreeDir(name)
+	if _, err := os.Stat(dir); err != nil {
+		return errx.With(ErrNotFound, " %q", name)
+	}
+	unlock, err := s.lock(unix.LOCK_EX)
+	if err != nil {
+		return errx.Wrap(ErrRemove, err)
+	}
+	defer unlock()
+	if err := os.RemoveAll(dir); err != nil {
+		return errx.Wrap(ErrRemove, err)
+	}
+	return nil
+}
+
+// Prune removes the stored contents no cache links to anymore, and the
+// leftovers of writes that were never finished, returning the number of
+// files removed and the bytes freed.
+func (s *Store) Prune() (removed int, freed int64, err error) {
+	unlock, err := s.lock(unix.LOCK_EX)
+	if err != nil {
+		return 0, 0, errx.Wrap(ErrPrune, err)
+	}
+	defer unlock()
+
+	objects, err := os.ReadDir(filepath.Join(s.dir, objectsDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, errx.Wrap(ErrPrune, err)
+	}
+	for _, e := range objects {
+		path := filepath.Join(s.dir, objectsDir, e.Name())
+		info, err := os.Lstat(path)
+		if err != nil {
+			continue
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && uint64(st.Nlink) == 1 {
+			if os.Remove(path) == nil {
+				removed++
+				freed += info.Size()
+			}
+		}
+	}
+
+	temps, err := os.ReadDir(filepath.Join(s.dir, tmpDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return removed, freed, errx.Wrap(ErrPrune, err)
+	}
+	for _, e := range temps {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTemp {
+			continue
+		}
+		if os.Remove(filepath.Join(s.dir, tmpDir, e.Name())) == nil {
+			removed++
+			freed += info.Size()
+		}
+	}
+	return removed, freed, nil
+}
+
+// lock takes the store lock, shared or exclusive, across matchlock
+// processes.
+func (s *Store) lock(how int) (func(), error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,183 @@
+package caches
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+func newCache(t *testing.T, s *Store, name string) *Provider {
+	t.Helper()
+	_, err := s.Prepare(name)
+	require.NoError(t, err)
+	return s.Provider(name)
+}
+
+func writeFile(t *testing.T, p vfs.Provider, path, data string) {
+	t.Helper()
+	h, err := p.Create(path, 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+}
+
+func readFile(t *testing.T, p vfs.Provider, path string) string {
+	t.Helper()
+	h, err := p.Open(path, os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer h.Close()
+	data, err := io.ReadAll(h)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestProviderStoresContentsOnce(t *testing.T) {
+	s := NewStore(t.TempDir())
+	pip, npm := newCache(t, s, "pip"), newCache(t, s, "npm")
+
+	require.NoError(t, pip.Mkdir("/wheels", 0755))
+	writeFile(t, pip, "/wheels/six.whl", "wheel bytes")
+	writeFile(t, npm, "/six.tgz", "wheel bytes")
+	assert.Equal(t, "wheel bytes", readFile(t, pip, "/wheels/six.whl"))
+
+	a, err := os.Stat(filepath.Join(s.TreeDir("pip"), "wheels", "six.whl"))
+	require.NoError(t, err)
+	b, err := os.Stat(filepath.Join(s.TreeDir("npm"), "six.tgz"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(a, b), "identical contents should be stored once")
+
+	caches, err := s.List()
+	require.NoError(t, err)
+	assert.Equal(t, []Cache{{Name: "npm", Files: 1, Size: 11}, {Name: "pip", Files: 1, Size: 11}}, caches)
+}
+
+func TestProviderWritesDoNotChangeSharedContents(t *testing.T) {
+	s := NewStore(t.TempDir())
+	p := newCache(t, s, "pip")
+	writeFile(t, p, "/a", "same")
+	writeFile(t, p, "/b", "same")
+
+	// An open reader keeps the version it opened.
+	r, err := p.Open("/a", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer r.Close()
+
+	h, err := p.Open("/a", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("+more"))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	assert.Equal(t, "same+more", readFile(t, p, "/a"))
+	assert.Equal(t, "same", readFile(t, p, "/b"))
+	old, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "same", string(old))
+
+	require.NoError(t, p.Chmod("/b", 0444))
+	info, err := p.Stat("/b")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0444), info.Mode().Perm())
+	assert.Equal(t, "same", readFile(t, p, "/b"))
+	writeFile(t, p, "/c", "same")
+	info, err = p.Stat("/c")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+}
+
+func TestProviderConcurrentWritersLeaveOneWholeVersion(t *testing.T) {
+	s := NewStore(t.TempDir())
+	_, err := s.Prepare("gomod")
+	require.NoError(t, err)
+
+	// Each writer is a separate sandbox's view of the same cache.
+	const writers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := s.Provider("gomod")
+			for j := 0; j < 20; j++ {
+				h, err := p.Create("/go.sum", 0644)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for k := 0; k < 64; k++ {
+					fmt.Fprintf(h, "writer %d line %d\n", i, k)
+				}
+				if err := h.Close(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got := readFile(t, s.Provider("gomod"), "/go.sum")
+	var writer int
+	_, err = fmt.Sscanf(got, "writer %d", &writer)
+	require.NoError(t, err)
+	var want string
+	for k := 0; k < 64; k++ {
+		want += fmt.Sprintf("writer %d line %d\n", writer, k)
+	}
+	assert.Equal(t, want, got)
+
+	entries, err := os.ReadDir(s.TreeDir("gomod"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "no staged links should be left behind")
+}
+
+func TestProviderConfinesWritesToTree(t *testing.T) {
+	s := NewStore(t.TempDir())
+	p := newCache(t, s, "pip")
+	outside := t.TempDir()
+	require.NoError(t, p.Symlink(outside, "/out"))
+
+	_, err := p.Create("/out/planted", 0644)
+	require.Error(t, err)
+	entries, err := os.ReadDir(outside)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestStoreRemoveAndPrune(t *testing.T) {
+	s := NewStore(t.TempDir())
+	pip, npm := newCache(t, s, "pip"), newCache(t, s, "npm")
+	writeFile(t, pip, "/shared", "shared")
+	writeFile(t, pip, "/pip-only", "pip only")
+	writeFile(t, npm, "/shared", "shared")
+
+	removed, _, err := s.Prune()
+	require.NoError(t, err)
+	assert.Zero(t, removed, "contents still in use must be kept")
+
+	require.NoError(t, s.Remove("pip"))
+	require.ErrorIs(t, s.Remove("pip"), ErrNotFound)
+	removed, freed, err := s.Prune()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, int64(len("pip only")), freed)
+	assert.Equal(t, "shared", readFile(t, npm, "/shared"))
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"pip", "go-mod", "hf.models_v2"} {
+		require.NoError(t, ValidateName(name))
+	}
+	for _, name := range []string{"", ".", "..", "a/b", "-x"} {
+		require.ErrorIs(t, ValidateName(name), ErrInvalidName, name)
+	}
+}
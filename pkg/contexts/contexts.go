@@ -0,0 +1,199 @@
+// Package contexts keeps named CLI contexts, so one matchlock binary can be
+// pointed at the local host or at a shared image conversion service
+// (matchlock image serve) without repeating flags. A context bundles the
+// service endpoint, the token presented to it, the namespace its
+// conversions are kept under and the role the token has there:
+//
+//	{
+//	  "current": "prod",
+//	  "contexts": {
+//	    "prod": {
+//	      "endpoint": "http://10.0.0.5:7050",
+//	      "token": "keychain:matchlock-prod",
+//	      "namespace": "team-a",
+//	      "role": "user"
+//	    }
+//	  }
+//	}
+//
+// The built-in "local" context, current until another is used, has no
+// endpoint and the admin role.
+package contexts
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/storename"
+)
+
+// Local is the name of the built-in context.
+const Local = "local"
+
+// Roles a context can have. A service enforces them; the CLI only refuses
+// admin operations early in a user context.
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// Context is a named set of CLI defaults.
+type Context struct {
+	// Endpoint is the URL of the image conversion service.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Token is presented to the service as a bearer token. It may be a
+	// secret reference such as keychain:NAME or op://..., resolved when
+	// used, so the token itself need not be stored here.
+	Token string `json:"token,omitempty"`
+	// Namespace keeps the conversions submitted in this context apart from
+	// other namespaces' on the service.
+	Namespace string `json:"namespace,omitempty"`
+	// Role is RoleAdmin or RoleUser (the default).
+	Role string `json:"role,omitempty"`
+}
+
+// Admin reports whether c may run admin operations.
+func (c Context) Admin() bool {
+	return c.Role == RoleAdmin
+}
+
+// File is the contents of a contexts file.
+type File struct {
+	Current  string             `json:"current,omitempty"`
+	Contexts map[string]Context `json:"contexts,omitempty"`
+}
+
+// DefaultPath returns ~/.config/matchlock/contexts.json.
+func DefaultPath() string {
+	return storename.ConfigPath("contexts.json")
+}
+
+// Load reads a contexts file. A missing file yields no contexts.
+func Load(path string) (*File, error) {
+	f := &File{Contexts: make(map[string]Context)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, errx.Wrap(ErrRead, err)
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, errx.With(ErrParse, " %s: %w", path, err)
+	}
+	if f.Contexts == nil {
+		f.Contexts = make(map[string]Context)
+	}
+	return f, nil
+}
+
+// Save writes f to path, readable by the user only as it may hold tokens.
+func (f *File) Save(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return errx.Wrap(ErrWrite, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errx.Wrap(ErrWrite, err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return errx.Wrap(ErrWrite, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errx.Wrap(ErrWrite, err)
+	}
+	return nil
+}
+
+// Names returns the context names, Local included, in sorted order.
+func (f *File) Names() []string {
+	names := []string{Local}
+	for name := range f.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the named context.
+func (f *File) Get(name string) (Context, error) {
+	if name == Local {
+		return Context{Role: RoleAdmin}, nil
+	}
+	c, ok := f.Contexts[name]
+	if !ok {
+		return Context{}, errx.With(ErrNotFound, " %q", name)
+	}
+	if c.Role == "" {
+		c.Role = RoleUser
+	}
+	return c, nil
+}
+
+// Set adds or replaces the named context.
+func (f *File) Set(name string, c Context) error {
+	if name == Local {
+		return errx.With(ErrReserved, " %q", name)
+	}
+	if err := storename.Validate(ErrInvalidName, name); err != nil {
+		return err
+	}
+	switch c.Role {
+	case "", RoleUser, RoleAdmin:
+	default:
+		return errx.With(ErrInvalidRole, " %q: use %s or %s", c.Role, RoleAdmin, RoleUser)
+	}
+	f.Contexts[name] = c
+	return nil
+}
+
+// Use makes the named context current.
+func (f *File) Use(name string) error {
+	if _, err := f.Get(name); err != nil {
+		return err
+	}
+	f.Current = name
+	if name == Local {
+		f.Current = ""
+	}
+	return nil
+}
+
+// Remove deletes the named context; Local is current again if it was.
+func (f *File) Remove(name string) error {
+	if name == Local {
+		return errx.With(ErrReserved, " %q", name)
+	}
+	if _, ok := f.Contexts[name]; !ok {
+		return errx.With(ErrNotFound, " %q", name)
+	}
+	delete(f.Contexts, name)
+	if f.Current == name {
+		f.Current = ""
+	}
+	return nil
+}
+
+// ActiveName returns the name of the context in use: $MATCHLOCK_CONTEXT,
+// or the file's current context, or Local.
+func (f *File) ActiveName() string {
+	if name := os.Getenv("MATCHLOCK_CONTEXT"); name != "" {
+		return name
+	}
+	if f.Current != "" {
+		return f.Current
+	}
+	return Local
+}
+
+// Active returns the context in use and its name.
+func (f *File) Active() (string, Context, error) {
+	name := f.ActiveName()
+	c, err := f.Get(name)
+	return name, c, err
+}
@@ -0,0 +1,59 @@
+package contexts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextsRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config", "contexts.json")
+	f, err := Load(path)
+	require.NoError(t, err)
+	name, c, err := f.Active()
+	require.NoError(t, err)
+	assert.Equal(t, Local, name)
+	assert.True(t, c.Admin(), "the local context is admin")
+
+	require.NoError(t, f.Set("prod", Context{Endpoint: "http://10.0.0.5:7050", Token: "keychain:prod", Namespace: "team-a"}))
+	require.NoError(t, f.Use("prod"))
+	require.NoError(t, f.Save(path))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	f, err = Load(path)
+	require.NoError(t, err)
+	name, c, err = f.Active()
+	require.NoError(t, err)
+	assert.Equal(t, "prod", name)
+	assert.Equal(t, "team-a", c.Namespace)
+	assert.Equal(t, RoleUser, c.Role, "contexts are user contexts unless made admin")
+	assert.Equal(t, []string{Local, "prod"}, f.Names())
+
+	t.Setenv("MATCHLOCK_CONTEXT", Local)
+	name, _, err = f.Active()
+	require.NoError(t, err)
+	assert.Equal(t, Local, name)
+
+	require.NoError(t, f.Remove("prod"))
+	assert.Empty(t, f.Current)
+}
+
+func TestContextsRejectBadInput(t *testing.T) {
+	f, err := Load(filepath.Join(t.TempDir(), "contexts.json"))
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, f.Set(Local, Context{}), ErrReserved)
+	assert.ErrorIs(t, f.Set("../x", Context{}), ErrInvalidName)
+	assert.ErrorIs(t, f.Set("prod", Context{Role: "root"}), ErrInvalidRole)
+	assert.ErrorIs(t, f.Use("missing"), ErrNotFound)
+	assert.ErrorIs(t, f.Remove(Local), ErrReserved)
+
+	t.Setenv("MATCHLOCK_CONTEXT", "missing")
+	_, _, err = f.Active()
+	assert.ErrorIs(t, err, ErrNotFound)
+}
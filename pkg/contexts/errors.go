@@ -0,0 +1,14 @@
+package contexts
+
+import "errors"
+
+var (
+	ErrRead        = errors.New("read contexts")
+	ErrParse       = errors.New("parse contexts")
+	ErrWrite       = errors.New("write contexts")
+	ErrInvalidName = errors.New("invalid context name")
+	ErrInvalidRole = errors.New("invalid context role")
+	ErrNotFound    = errors.New("context not found")
+	ErrReserved    = errors.New("context is built in")
+	ErrDenied      = errors.New("operation not allowed in context")
+)
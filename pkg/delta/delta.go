@@ -0,0 +1,211 @@
+// Package delta implements rsync-style delta encoding. The receiver publishes
+// a Signature of the file it already has (a rolling weak checksum and a strong
+// hash per fixed-size block); the sender scans its new version for blocks the
+// receiver already holds and transmits only the bytes in between.
+package delta
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// DefaultBlockSize balances signature size against delta granularity for
+// source-code sized files.
+const DefaultBlockSize = 2048
+
+// BlockSignature identifies one block of the receiver's file.
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// Signature describes the receiver's current copy of a file. The last block
+// may be shorter than BlockSize.
+type Signature struct {
+	BlockSize int              `json:"block_size"`
+	Size      int64            `json:"size"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+// Op is one instruction for rebuilding the new file. A literal op carries
+// Data; otherwise the op copies Count consecutive blocks of the old file
+// starting at Block.
+type Op struct {
+	Block int    `json:"block"`
+	Count int    `json:"count,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// Sign computes the signature of data split into blockSize blocks.
+func Sign(data []byte, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		return nil, errx.With(ErrBlockSize, ": %d", blockSize)
+	}
+	sig := &Signature{BlockSize: blockSize, Size: int64(len(data))}
+	for off := 0; off < len(data); off += blockSize {
+		end := min(off+blockSize, len(data))
+		block := data[off:end]
+		sig.Blocks = append(sig.Blocks, BlockSignature{
+			Weak:   weakSum(block),
+			Strong: strongSum(block),
+		})
+	}
+	return sig, nil
+}
+
+// Diff returns the ops that turn the file described by sig into data.
+func Diff(sig *Signature, data []byte) []Op {
+	bs := sig.BlockSize
+	var ops []Op
+	emitLiteral := func(lit []byte) {
+		if len(lit) > 0 {
+			ops = append(ops, Op{Data: lit})
+		}
+	}
+	emitCopy := func(block int) {
+		if n := len(ops); n > 0 && ops[n-1].Data == nil && ops[n-1].Block+ops[n-1].Count == block {
+			ops[n-1].Count++
+			return
+		}
+		ops = append(ops, Op{Block: block, Count: 1})
+	}
+
+	// Only full-size blocks take part in the rolling search; a short final
+	// block can only match at the very end of the new data.
+	index := make(map[uint32][]int)
+	lastPartial := -1
+	for i, b := range sig.Blocks {
+		if int64((i+1)*bs) <= sig.Size {
+			index[b.Weak] = append(index[b.Weak], i)
+		} else {
+			lastPartial = i
+		}
+	}
+
+	litStart := 0
+	if len(index) > 0 && len(data) >= bs {
+		r := newRolling(data[:bs])
+		for i := 0; i+bs <= len(data); {
+			if match := findBlock(sig, index[r.sum()], data[i:i+bs]); match >= 0 {
+				emitLiteral(data[litStart:i])
+				emitCopy(match)
+				i += bs
+				litStart = i
+				if i+bs <= len(data) {
+					r = newRolling(data[i : i+bs])
+				}
+				continue
+			}
+			if i+bs >= len(data) {
+				break
+			}
+			r.roll(data[i], data[i+bs])
+			i++
+		}
+	}
+
+	if lastPartial >= 0 {
+		tailLen := int(sig.Size) - lastPartial*bs
+		if tail := len(data) - tailLen; tail >= litStart {
+			b := sig.Blocks[lastPartial]
+			if weakSum(data[tail:]) == b.Weak && strongSum(data[tail:]) == b.Strong {
+				emitLiteral(data[litStart:tail])
+				emitCopy(lastPartial)
+				return ops
+			}
+		}
+	}
+
+	emitLiteral(data[litStart:])
+	return ops
+}
+
+// Unchanged reports whether ops rebuild exactly the file described by sig.
+func Unchanged(sig *Signature, ops []Op) bool {
+	if len(sig.Blocks) == 0 {
+		return len(ops) == 0
+	}
+	return len(ops) == 1 && ops[0].Data == nil && ops[0].Block == 0 && ops[0].Count == len(sig.Blocks)
+}
+
+// Apply rebuilds the new file from the old contents and a list of ops.
+func Apply(old []byte, blockSize int, ops []Op) ([]byte, error) {
+	if blockSize <= 0 {
+		return nil, errx.With(ErrBlockSize, ": %d", blockSize)
+	}
+	numBlocks := (len(old) + blockSize - 1) / blockSize
+
+	var out []byte
+	for _, op := range ops {
+		if len(op.Data) > 0 {
+			out = append(out, op.Data...)
+			continue
+		}
+		if op.Count <= 0 {
+			return nil, ErrEmptyOp
+		}
+		if op.Block < 0 || op.Block+op.Count > numBlocks {
+			return nil, errx.With(ErrBlockRange, ": blocks %d..%d of %d", op.Block, op.Block+op.Count-1, numBlocks)
+		}
+		start := op.Block * blockSize
+		end := min((op.Block+op.Count)*blockSize, len(old))
+		out = append(out, old[start:end]...)
+	}
+	return out, nil
+}
+
+// Checksum returns the hex SHA-256 of data, used to verify a rebuilt file.
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func findBlock(sig *Signature, candidates []int, block []byte) int {
+	if len(candidates) == 0 {
+		return -1
+	}
+	strong := strongSum(block)
+	for _, idx := range candidates {
+		if sig.Blocks[idx].Strong == strong {
+			return idx
+		}
+	}
+	return -1
+}
+
+func strongSum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
+
+// rolling is the rsync weak checksum: a and b are sums modulo 2^16 that can
+// be updated in O(1) when the window slides by one byte.
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRolling(window []byte) rolling {
+	r := rolling{n: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	return r
+}
+
+func (r *rolling) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+func (r *rolling) sum() uint32 {
+	return (r.a & 0xffff) | (r.b&0xffff)<<16
+}
+
+func weakSum(block []byte) uint32 {
+	r := newRolling(block)
+	return r.sum()
+}
@@ -0,0 +1,133 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomBytes(n int, seed uint64) []byte {
+	r := rand.New(rand.NewPCG(seed, seed))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(r.IntN(256))
+	}
+	return b
+}
+
+func literalBytes(ops []Op) int {
+	n := 0
+	for _, op := range ops {
+		n += len(op.Data)
+	}
+	return n
+}
+
+func roundTrip(t *testing.T, old, updated []byte, blockSize int) []Op {
+	t.Helper()
+	sig, err := Sign(old, blockSize)
+	require.NoError(t, err)
+	ops := Diff(sig, updated)
+	got, err := Apply(old, blockSize, ops)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(updated, got), "rebuilt file differs")
+	return ops
+}
+
+func TestSignRejectsBadBlockSize(t *testing.T) {
+	_, err := Sign([]byte("x"), 0)
+	require.ErrorIs(t, err, ErrBlockSize)
+}
+
+func TestSign(t *testing.T) {
+	sig, err := Sign(randomBytes(10, 1), 4)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), sig.Size)
+	assert.Len(t, sig.Blocks, 3)
+}
+
+func TestDiffUnchanged(t *testing.T) {
+	data := randomBytes(10_000, 1)
+	ops := roundTrip(t, data, data, 512)
+
+	sig, _ := Sign(data, 512)
+	assert.True(t, Unchanged(sig, ops))
+	assert.Zero(t, literalBytes(ops))
+}
+
+func TestDiffEmptyFiles(t *testing.T) {
+	ops := roundTrip(t, nil, nil, 64)
+	assert.Empty(t, ops)
+
+	sig, _ := Sign(nil, 64)
+	assert.True(t, Unchanged(sig, ops))
+
+	roundTrip(t, nil, []byte("new"), 64)
+	roundTrip(t, []byte("old"), nil, 64)
+}
+
+func TestDiffInsertInMiddle(t *testing.T) {
+	old := randomBytes(20_000, 2)
+	updated := append(append(append([]byte{}, old[:7001]...), []byte("inserted line\n")...), old[7001:]...)
+
+	ops := roundTrip(t, old, updated, 512)
+	// Only the block around the insertion point should be resent.
+	assert.Less(t, literalBytes(ops), 2*512)
+
+	sig, _ := Sign(old, 512)
+	assert.False(t, Unchanged(sig, ops))
+}
+
+func TestDiffAppendAndTruncate(t *testing.T) {
+	old := randomBytes(5_000, 3)
+
+	ops := roundTrip(t, old, append(append([]byte{}, old...), "tail"...), 512)
+	assert.Equal(t, 5_000%512+len("tail"), literalBytes(ops))
+
+	ops = roundTrip(t, old, old[:4_096], 512)
+	assert.Zero(t, literalBytes(ops))
+}
+
+func TestDiffMatchesShortLastBlock(t *testing.T) {
+	old := randomBytes(1_000, 4)
+	updated := append([]byte("prefix"), old...)
+
+	ops := roundTrip(t, old, updated, 256)
+	assert.Equal(t, len("prefix"), literalBytes(ops))
+}
+
+func TestDiffCoalescesCopies(t *testing.T) {
+	old := randomBytes(4_096, 5)
+	ops := roundTrip(t, old, old, 256)
+	require.Len(t, ops, 1)
+	assert.Equal(t, Op{Block: 0, Count: 16}, ops[0])
+}
+
+func TestApplyRejectsBadOps(t *testing.T) {
+	old := randomBytes(100, 6)
+
+	_, err := Apply(old, 50, []Op{{Block: 1, Count: 2}})
+	require.ErrorIs(t, err, ErrBlockRange)
+
+	_, err = Apply(old, 50, []Op{{Block: 0}})
+	require.ErrorIs(t, err, ErrEmptyOp)
+
+	_, err = Apply(old, 0, nil)
+	require.ErrorIs(t, err, ErrBlockSize)
+}
+
+func TestRollingMatchesFreshSum(t *testing.T) {
+	data := randomBytes(300, 7)
+	r := newRolling(data[:64])
+	for i := 0; i+64 < len(data); i++ {
+		r.roll(data[i], data[i+64])
+		require.Equal(t, weakSum(data[i+1:i+65]), r.sum(), "offset %d", i+1)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", Checksum(nil))
+}
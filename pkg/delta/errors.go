@@ -0,0 +1,9 @@
+package delta
+
+import "errors"
+
+var (
+	ErrBlockSize  = errors.New("invalid block size")
+	ErrBlockRange = errors.New("block out of range")
+	ErrEmptyOp    = errors.New("empty delta op")
+)
@@ -0,0 +1,16 @@
+package disks
+
+import "errors"
+
+var (
+	ErrInvalidName = errors.New("invalid disk name")
+	ErrInvalidSpec = errors.New("invalid disk spec")
+	ErrNotFound    = errors.New("disk not found")
+	ErrInUse       = errors.New("disk is attached to another sandbox")
+	ErrCreate      = errors.New("create disk")
+	ErrNotExt4     = errors.New("not an ext4 image")
+	ErrGrow        = errors.New("grow disk")
+	ErrAttach      = errors.New("attach disk")
+	ErrRead        = errors.New("read disks")
+	ErrRemove      = errors.New("remove disk")
+)
@@ -0,0 +1,304 @@
+// Package disks keeps named data disks: ext4 images on the host that
+// sandboxes attach as virtio-blk devices, for workloads that need block
+// device performance rather than the VFS. A disk outlives the sandboxes
+// attaching it until it is removed:
+//
+//	~/.cache/matchlock/disks/<name>.ext4
+//	~/.cache/matchlock/disks/<name>.lock
+//
+// A sandbox holds the lock of each disk it attaches, exclusively or, for a
+// read-only disk, shared, so a disk one sandbox writes is mounted by no
+// other: ext4 is not a cluster filesystem.
+package disks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/storename"
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/image"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+const (
+	imageExt = ".ext4"
+	lockExt  = ".lock"
+)
+
+// Disk describes a disk in a store.
+type Disk struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`   // size of the device
+	Used  int64  `json:"used"`   // host space its image takes
+	InUse bool   `json:"in_use"` // attached to a running sandbox
+}
+
+// Store is a directory of data disks.
+type Store struct {
+	dir string
+}
+
+// NewStore returns a store rooted at dir, defaulting to
+// ~/.cache/matchlock/disks.
+func NewStore(dir string) *Store {
+	return &Store{dir: storename.Dir(dir, ".cache", "matchlock", "disks")}
+}
+
+// ValidateName checks that name can be used for a disk.
+func ValidateName(name string) error {
+	return storename.Validate(ErrInvalidName, name)
+}
+
+// ParseSpec parses a --disk spec: name=NAME[,size=SIZE][,from=IMAGE]
+// [,mount=PATH][,ro], with SIZE such as 512M or 10G.
+func ParseSpec(spec string) (api.DataDisk, error) {
+	var d api.DataDisk
+	for _, field := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "name":
+			d.Name = value
+		case "size":
+			size, err := image.ParseSize(value)
+			if err != nil || size < 1<<20 {
+				return api.DataDisk{}, errx.With(ErrInvalidSpec, " %q: size %q must be at least 1M", spec, value)
+			}
+			d.SizeMB = size >> 20
+		case "from":
+			from, err := filepath.Abs(value)
+			if err != nil || value == "" {
+				return api.DataDisk{}, errx.With(ErrInvalidSpec, " %q: from %q", spec, value)
+			}
+			d.From = from
+		case "mount":
+			d.GuestMount = value
+		case "ro":
+			d.ReadOnly = true
+		default:
+			return api.DataDisk{}, errx.With(ErrInvalidSpec, " %q: unknown option %q (want name, size, from, mount or ro)", spec, key)
+		}
+	}
+	if err := ValidateName(d.Name); err != nil {
+		return api.DataDisk{}, errx.With(ErrInvalidSpec, " %q: %w", spec, err)
+	}
+	return d, nil
+}
+
+// Path returns the image of the named disk.
+func (s *Store) Path(name string) string {
+	return filepath.Join(s.dir, name+imageExt)
+}
+
+// Attach locks the disk d for a sandbox, creating or growing it first as
+// d asks, and returns its image and a function releasing it. It fails with
+// ErrInUse if another sandbox holds the disk in a way d conflicts with.
+func (s *Store) Attach(d api.DataDisk) (path string, release func(), err error) {
+	if err := ValidateName(d.Name); err != nil {
+		return "", nil, err
+	}
+	how := unix.LOCK_EX
+	if d.ReadOnly {
+		how = unix.LOCK_SH
+	}
+	unlock, err := s.lock(d.Name, how)
+	if err != nil {
+		return "", nil, err
+	}
+
+	path = s.Path(d.Name)
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && d.ReadOnly:
+		// A read-only disk is shared and may not be created by two
+		// sandboxes at once.
+		err = errx.With(ErrNotFound, " %q: a read-only disk must exist", d.Name)
+	case errors.Is(err, fs.ErrNotExist):
+		err = create(path, d)
+	case err == nil && !d.ReadOnly && d.SizeMB<<20 > info.Size():
+		err = grow(path, d.SizeMB<<20)
+	}
+	if err != nil {
+		unlock()
+		return "", nil, err
+	}
+	return path, unlock, nil
+}
+
+// create makes the image of d at path, under a temporary name so a failed
+// create leaves nothing behind.
+func create(path string, d api.DataDisk) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errx.Wrap(ErrCreate, err)
+	}
+	tmp := path + ".tmp"
+	defer os.Remove(tmp)
+	size := d.SizeMB << 20
+	if d.From != "" {
+		n, err := copyImage(tmp, d.From)
+		if err != nil {
+			return errx.With(ErrCreate, " %s from %s: %w", d.Name, d.From, err)
+		}
+		if size > n {
+			if err := grow(tmp, size); err != nil {
+				return err
+			}
+		}
+		return rename(tmp, path)
+	}
+
+	if size == 0 {
+		size = api.DefaultDataDiskSizeMB << 20
+	}
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errx.Wrap(ErrCreate, err)
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		return errx.Wrap(ErrCreate, err)
+	}
+	cmd := exec.Command("mke2fs", "-t", "ext4", "-F", "-q", "-L", label(d.Name), tmp)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errx.With(ErrCreate, " %s: mke2fs: %w: %s", d.Name, err, out)
+	}
+	return rename(tmp, path)
+}
+
+func rename(tmp, path string) error {
+	if err := os.Rename(tmp, path); err != nil {
+		return errx.Wrap(ErrCreate, err)
+	}
+	return nil
+}
+
+// label returns the filesystem label of a disk, which ext4 caps at 16 bytes.
+func label(name string) string {
+	if len(name) > 16 {
+		return name[:16]
+	}
+	return name
+}
+
+// copyImage copies the ext4 image at src to dst, keeping its holes, and
+// returns its size.
+func copyImage(dst, src string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	sb := make([]byte, 2)
+	if _, err := in.ReadAt(sb, 1024+0x38); err != nil || binary.LittleEndian.Uint16(sb) != 0xef53 {
+		return 0, ErrNotExt4
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	return vfs.CopySparse(out, in)
+}
+
+// grow extends the image at path to size bytes and its filesystem with it.
+func grow(path string, size int64) error {
+	if err := os.Truncate(path, size); err != nil {
+		return errx.Wrap(ErrGrow, err)
+	}
+	// resize2fs refuses a filesystem that was not checked since it was
+	// last mounted.
+	if e2fsck, err := exec.LookPath("e2fsck"); err == nil {
+		exec.Command(e2fsck, "-fy", path).Run()
+	}
+	out, err := exec.Command("resize2fs", "-f", path).CombinedOutput()
+	if err != nil {
+		return errx.With(ErrGrow, ": resize2fs: %w: %s", err, out)
+	}
+	return nil
+}
+
+// List returns the disks in the store by name.
+func (s *Store) List() ([]Disk, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errx.Wrap(ErrRead, err)
+	}
+	var disks []Disk
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), imageExt)
+		if !ok || ValidateName(name) != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		d := Disk{Name: name, Size: info.Size(), Used: info.Size()}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			d.Used = int64(st.Blocks) * 512
+		}
+		if unlock, err := s.lock(name, unix.LOCK_EX); err == nil {
+			unlock()
+		} else {
+			d.InUse = true
+		}
+		disks = append(disks, d)
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i].Name < disks[j].Name })
+	return disks, nil
+}
+
+// Remove deletes the named disk, which no sandbox may have attached.
+func (s *Store) Remove(name string) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+	path := s.Path(name)
+	if _, err := os.Stat(path); err != nil {
+		return errx.With(ErrNotFound, " %q", name)
+	}
+	unlock, err := s.lock(name, unix.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(path); err != nil {
+		return errx.Wrap(ErrRemove, err)
+	}
+	os.Remove(filepath.Join(s.dir, name+lockExt))
+	return nil
+}
+
+// lock takes the lock of the named disk, shared or exclusive, across
+// matchlock processes, failing with ErrInUse rather than waiting for it.
+func (s *Store) lock(name string, how int) (func(), error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, errx.Wrap(ErrAttach, err)
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, name+lockExt), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errx.Wrap(ErrAttach, err)
+	}
+	if err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, errx.With(ErrInUse, " %q", name)
+		}
+		return nil, errx.Wrap(ErrAttach, err)
+	}
+	return func() { f.Close() }, nil
+}
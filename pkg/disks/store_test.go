@@ -0,0 +1,118 @@
+package disks
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+func requireE2fsprogs(t *testing.T) {
+	t.Helper()
+	for _, tool := range []string{"mke2fs", "resize2fs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	d, err := ParseSpec("name=data,size=10G,from=base.img,mount=/data,ro")
+	require.NoError(t, err)
+	wd, _ := os.Getwd()
+	assert.Equal(t, api.DataDisk{Name: "data", SizeMB: 10 << 10, From: filepath.Join(wd, "base.img"), GuestMount: "/data", ReadOnly: true}, d)
+
+	for _, spec := range []string{"size=1G", "name=../x", "name=data,size=10", "name=data,color=red"} {
+		_, err := ParseSpec(spec)
+		assert.ErrorIs(t, err, ErrInvalidSpec, spec)
+	}
+}
+
+func TestAttachCreatesAndLocksDisk(t *testing.T) {
+	requireE2fsprogs(t)
+	s := NewStore(t.TempDir())
+
+	path, release, err := s.Attach(api.DataDisk{Name: "data", SizeMB: 16})
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(16<<20), info.Size())
+
+	_, _, err = s.Attach(api.DataDisk{Name: "data"})
+	assert.ErrorIs(t, err, ErrInUse)
+	_, _, err = s.Attach(api.DataDisk{Name: "data", ReadOnly: true})
+	assert.ErrorIs(t, err, ErrInUse, "a disk being written is not shared")
+	assert.ErrorIs(t, s.Remove("data"), ErrInUse)
+
+	list, err := s.List()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.True(t, list[0].InUse)
+
+	release()
+	_, releaseGrown, err := s.Attach(api.DataDisk{Name: "data", SizeMB: 32})
+	require.NoError(t, err)
+	releaseGrown()
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(32<<20), info.Size())
+
+	require.NoError(t, s.Remove("data"))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAttachReadOnlyDisks(t *testing.T) {
+	requireE2fsprogs(t)
+	s := NewStore(t.TempDir())
+
+	_, _, err := s.Attach(api.DataDisk{Name: "models", ReadOnly: true})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, release, err := s.Attach(api.DataDisk{Name: "models", SizeMB: 8})
+	require.NoError(t, err)
+	release()
+
+	_, release1, err := s.Attach(api.DataDisk{Name: "models", ReadOnly: true})
+	require.NoError(t, err)
+	defer release1()
+	_, release2, err := s.Attach(api.DataDisk{Name: "models", ReadOnly: true})
+	require.NoError(t, err, "read-only disks are shared")
+	defer release2()
+	_, _, err = s.Attach(api.DataDisk{Name: "models"})
+	assert.ErrorIs(t, err, ErrInUse)
+}
+
+func TestAttachCopiesFromImage(t *testing.T) {
+	requireE2fsprogs(t)
+	s := NewStore(t.TempDir())
+
+	notExt4 := filepath.Join(t.TempDir(), "blank.img")
+	require.NoError(t, os.WriteFile(notExt4, make([]byte, 4096), 0644))
+	_, _, err := s.Attach(api.DataDisk{Name: "bad", From: notExt4})
+	assert.ErrorIs(t, err, ErrNotExt4)
+	_, err = os.Stat(s.Path("bad"))
+	assert.True(t, os.IsNotExist(err), "a failed create leaves no disk")
+
+	src := filepath.Join(t.TempDir(), "base.img")
+	require.NoError(t, os.WriteFile(src, nil, 0644))
+	require.NoError(t, os.Truncate(src, 8<<20))
+	out, err := exec.Command("mke2fs", "-t", "ext4", "-F", "-q", "-L", "seed", src).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	path, release, err := s.Attach(api.DataDisk{Name: "seeded", SizeMB: 16, From: src})
+	require.NoError(t, err)
+	defer release()
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(16<<20), info.Size())
+	out, err = exec.Command("e2label", path).CombinedOutput()
+	if err == nil {
+		assert.Equal(t, "seed\n", string(out), "the image's filesystem is kept")
+	}
+}
@@ -0,0 +1,124 @@
+// Package guestinfo reports what the guest assets installed on this host
+// support, so integrators can gate features on the guest rather than on the
+// matchlock CLI version alone. Nothing is booted; the information comes from
+// the assets on disk and the ABI this build speaks.
+package guestinfo
+
+import (
+	"debug/buildinfo"
+	"os"
+
+	kernelconfig "github.com/jingkaihe/matchlock/guest/kernel"
+	"github.com/jingkaihe/matchlock/pkg/kernel"
+	"github.com/jingkaihe/matchlock/pkg/rpc"
+	"github.com/jingkaihe/matchlock/pkg/sandbox"
+	"github.com/jingkaihe/matchlock/pkg/trust"
+	"github.com/jingkaihe/matchlock/pkg/version"
+)
+
+// SchemaVersion is bumped whenever Info changes incompatibly. Fields may be
+// added without a bump.
+const SchemaVersion = 1
+
+// Info describes the installed guest assets.
+type Info struct {
+	SchemaVersion int         `json:"schema_version"`
+	Matchlock     VersionInfo `json:"matchlock"`
+	Arch          string      `json:"arch"`
+	Kernel        KernelInfo  `json:"kernel"`
+	Initramfs     *Asset      `json:"initramfs,omitempty"`
+	GuestAgent    Asset       `json:"guest_agent"`
+	GuestFused    Asset       `json:"guest_fused"`
+	RPC           RPCInfo     `json:"rpc"`
+}
+
+// VersionInfo identifies the host matchlock build.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+}
+
+// KernelInfo describes the guest kernel.
+type KernelInfo struct {
+	Asset
+	// Version is empty for a custom kernel set via MATCHLOCK_KERNEL.
+	Version string `json:"version,omitempty"`
+	// Features are the options built into the kernel (CONFIG_ prefix
+	// stripped). They are only known for the kernels matchlock publishes.
+	Features []string `json:"features,omitempty"`
+}
+
+// Asset describes one file the guest boots from.
+type Asset struct {
+	Path      string `json:"path"`
+	Installed bool   `json:"installed"`
+	Digest    string `json:"digest,omitempty"`
+	// Build metadata read from Go binaries.
+	GoVersion string `json:"go_version,omitempty"`
+	Revision  string `json:"revision,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// RPCInfo lists the JSON-RPC surface of this build.
+type RPCInfo struct {
+	Methods       []string `json:"methods"`
+	Notifications []string `json:"notifications"`
+}
+
+// Collect inspects the installed guest assets without downloading or
+// booting anything.
+func Collect() (*Info, error) {
+	arch := kernel.CurrentArch()
+	info := &Info{
+		SchemaVersion: SchemaVersion,
+		Matchlock:     VersionInfo{Version: version.Version, GitCommit: version.GitCommit},
+		Arch:          string(arch),
+		GuestAgent:    inspect(sandbox.DefaultGuestAgentPath()),
+		GuestFused:    inspect(sandbox.DefaultGuestFusedPath()),
+		RPC:           RPCInfo{Methods: rpc.Methods, Notifications: rpc.Notifications},
+	}
+
+	if custom := os.Getenv("MATCHLOCK_KERNEL"); custom != "" {
+		info.Kernel = KernelInfo{Asset: inspect(custom)}
+	} else {
+		features, err := kernelconfig.Enabled(string(arch))
+		if err != nil {
+			return nil, err
+		}
+		info.Kernel = KernelInfo{
+			Asset:    inspect(kernel.NewManager().KernelPath(arch, kernel.Version)),
+			Version:  kernel.Version,
+			Features: features,
+		}
+	}
+
+	if path := sandbox.DefaultInitramfsPath(); path != "" {
+		initramfs := inspect(path)
+		info.Initramfs = &initramfs
+	}
+	return info, nil
+}
+
+func inspect(path string) Asset {
+	a := Asset{Path: path}
+	if _, err := os.Stat(path); err != nil {
+		return a
+	}
+	a.Installed = true
+	a.Digest, _ = trust.Digest(path)
+
+	bi, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return a
+	}
+	a.GoVersion = bi.GoVersion
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			a.Revision = s.Value
+		case "vcs.modified":
+			a.Modified = s.Value == "true"
+		}
+	}
+	return a
+}
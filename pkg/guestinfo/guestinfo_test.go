@@ -0,0 +1,46 @@
+package guestinfo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/rpc"
+)
+
+func TestInspect(t *testing.T) {
+	missing := inspect(filepath.Join(t.TempDir(), "guest-agent"))
+	assert.False(t, missing.Installed)
+	assert.Empty(t, missing.Digest)
+
+	// The test binary is itself a Go binary with build info.
+	self, err := os.Executable()
+	require.NoError(t, err)
+	a := inspect(self)
+	assert.True(t, a.Installed)
+	assert.Contains(t, a.Digest, "sha256:")
+	assert.NotEmpty(t, a.GoVersion)
+}
+
+func TestCollect(t *testing.T) {
+	kernelPath := filepath.Join(t.TempDir(), "kernel")
+	require.NoError(t, os.WriteFile(kernelPath, []byte("vmlinux"), 0644))
+
+	t.Setenv("MATCHLOCK_KERNEL", kernelPath)
+	info, err := Collect()
+	require.NoError(t, err)
+	assert.Equal(t, SchemaVersion, info.SchemaVersion)
+	assert.True(t, info.Kernel.Installed)
+	assert.Empty(t, info.Kernel.Version)
+	assert.Empty(t, info.Kernel.Features)
+	assert.Equal(t, rpc.Methods, info.RPC.Methods)
+
+	t.Setenv("MATCHLOCK_KERNEL", "")
+	info, err = Collect()
+	require.NoError(t, err)
+	assert.NotEmpty(t, info.Kernel.Version)
+	assert.Contains(t, info.Kernel.Features, "VIRTIO_VSOCKETS")
+}
@@ -0,0 +1,285 @@
+package image
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// Whiteout names, as defined by the OCI image spec. A ".wh.<name>" entry
+// deletes <name> from the layers below; ".wh..wh..opq" in a directory hides
+// everything the layers below put in it. Other ".wh..wh." names are aufs
+// bookkeeping and carry no content.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutMeta   = ".wh..wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// extractImage unpacks the layers of img into destDir and returns the
+// owner, mode and type of each entry, keyed by absolute path in the image.
+//
+// Layers are applied bottom first, the way container runtimes unpack them
+// into a snapshot: an entry replaces whatever lower layers left at its path,
+// except that directories merge, and whiteouts remove what lower layers
+// added. Hardlinks therefore resolve against the merged tree, whichever
+// layer their target came from.
+func (b *Builder) extractImage(img v1.Image, destDir string) (map[string]fileMeta, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, errx.With(ErrExtract, ": layers: %w", err)
+	}
+	meta := make(map[string]fileMeta)
+	for _, layer := range layers {
+		if err := applyLayer(layer, destDir, meta); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// applyLayer unpacks one layer on top of the tree at root.
+func applyLayer(layer v1.Layer, root string, meta map[string]fileMeta) error {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return errx.With(ErrExtract, ": read layer: %w", err)
+	}
+	defer rc.Close()
+
+	// Whiteouts only apply to lower layers, and may come before or after
+	// the entries this layer adds under the same path, so they wait until
+	// the whole layer is unpacked.
+	var whiteouts, opaque []string
+	added := make(map[string]bool)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errx.With(ErrExtract, ": read tar: %w", err)
+		}
+
+		rel := strings.TrimPrefix(filepath.Clean(hdr.Name), "/")
+		if rel == "" || rel == "." || !filepath.IsLocal(rel) || estargzMetadata[rel] {
+			continue
+		}
+		dir, base := filepath.Split(rel)
+		switch {
+		case base == whiteoutOpaque:
+			opaque = append(opaque, filepath.Clean(dir))
+			continue
+		case strings.Contains(string(filepath.Separator)+rel, string(filepath.Separator)+whiteoutMeta):
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			if name := strings.TrimPrefix(base, whiteoutPrefix); name != "" {
+				whiteouts = append(whiteouts, filepath.Join(dir, name))
+			}
+			continue
+		}
+
+		ok, err := applyEntry(tr, hdr, root, rel, meta)
+		if err != nil {
+			return err
+		}
+		if ok {
+			added[rel] = true
+		}
+	}
+	// The tar ends before the stream does; reading the rest surfaces
+	// decompression and digest errors.
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		return errx.With(ErrExtract, ": read tar: %w", err)
+	}
+
+	return applyWhiteouts(root, whiteouts, opaque, added, meta)
+}
+
+// applyEntry writes a tar entry to rel under root, replacing what was there
+// unless both are directories. It reports whether the entry was written;
+// types that cannot appear in a rootfs are skipped.
+func applyEntry(tr *tar.Reader, hdr *tar.Header, root, rel string, meta map[string]fileMeta) (bool, error) {
+	target := filepath.Join(root, rel)
+	switch hdr.Typeflag {
+	case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeLink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+	default:
+		return false, nil
+	}
+
+	if err := ensureRealDir(root, filepath.Dir(target)); err != nil {
+		return false, errx.With(ErrExtract, ": mkdir parent %s: %w", rel, err)
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		if err := ensureRealDir(root, target); err != nil {
+			return false, errx.With(ErrExtract, ": mkdir %s: %w", rel, err)
+		}
+	} else if err := removePath(root, rel, meta); err != nil {
+		return false, errx.With(ErrExtract, ": remove existing %s: %w", rel, err)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		f, err := safeCreate(root, target, os.FileMode(hdr.Mode)&0777)
+		if err != nil {
+			return false, errx.With(ErrExtract, ": create %s: %w", rel, err)
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return false, errx.With(ErrExtract, ": write %s: %w", rel, err)
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return false, errx.With(ErrExtract, ": symlink %s: %w", rel, err)
+		}
+	case tar.TypeLink:
+		linkRel := strings.TrimPrefix(filepath.Clean(hdr.Linkname), "/")
+		if !filepath.IsLocal(linkRel) || !realParents(root, linkRel) {
+			return false, errx.With(ErrExtract, ": hardlink %s: target %q is outside the rootfs", rel, hdr.Linkname)
+		}
+		if err := os.Link(filepath.Join(root, linkRel), target); err != nil {
+			return false, errx.With(ErrExtract, ": hardlink %s: %w", rel, err)
+		}
+		// Don't record metadata for hardlinks — they share the target's
+		// inode, so set_inode_field would overwrite the original file's
+		// permissions.
+		return true, nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		f, err := safeCreate(root, target, 0600)
+		if err != nil {
+			return false, errx.With(ErrExtract, ": create %s: %w", rel, err)
+		}
+		f.Close()
+	}
+
+	fm := fileMeta{
+		uid:    hdr.Uid,
+		gid:    hdr.Gid,
+		mode:   os.FileMode(hdr.Mode) & 0o7777,
+		xattrs: tarXattrs(hdr),
+		mtime:  hdr.ModTime,
+	}
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock || hdr.Typeflag == tar.TypeFifo {
+		fm.typeflag = hdr.Typeflag
+		fm.devmajor, fm.devminor = hdr.Devmajor, hdr.Devminor
+	}
+	meta["/"+filepath.ToSlash(rel)] = fm
+	return true, nil
+}
+
+// applyWhiteouts removes the whited out paths of a layer, and empties its
+// opaque directories of what lower layers put there. added holds the paths
+// the layer itself wrote, which are kept: a path whited out and recreated in
+// the same layer is treated as an opaque directory.
+func applyWhiteouts(root string, whiteouts, opaque []string, added map[string]bool, meta map[string]fileMeta) error {
+	if len(whiteouts) == 0 && len(opaque) == 0 {
+		return nil
+	}
+	keep := make(map[string]bool, len(added))
+	for p := range added {
+		for ; p != "." && !keep[p]; p = filepath.Dir(p) {
+			keep[p] = true
+		}
+	}
+
+	for _, p := range whiteouts {
+		if keep[p] {
+			opaque = append(opaque, p)
+			continue
+		}
+		if err := removePath(root, p, meta); err != nil {
+			return errx.With(ErrExtract, ": whiteout %s: %w", p, err)
+		}
+	}
+	for _, dir := range opaque {
+		if err := clearDir(root, dir, keep, meta); err != nil {
+			return errx.With(ErrExtract, ": opaque %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// clearDir removes everything under dir that is not in keep.
+func clearDir(root, dir string, keep map[string]bool, meta map[string]fileMeta) error {
+	if dir != "." && !realParents(root, dir) {
+		return nil
+	}
+	fi, err := os.Lstat(filepath.Join(root, dir))
+	if err != nil || !fi.IsDir() {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Join(root, dir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		rel := filepath.Join(dir, e.Name())
+		if !keep[rel] {
+			if err := removePath(root, rel, meta); err != nil {
+				return err
+			}
+			continue
+		}
+		if e.IsDir() {
+			if err := clearDir(root, rel, keep, meta); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removePath removes rel under root along with the metadata of everything
+// it held. Paths reached through a symlink are not in the tree at all, and
+// are left alone rather than followed out of root.
+func removePath(root, rel string, meta map[string]fileMeta) error {
+	if !realParents(root, rel) {
+		return nil
+	}
+	target := filepath.Join(root, rel)
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	key := "/" + filepath.ToSlash(rel)
+	delete(meta, key)
+	if fi.IsDir() {
+		for p := range meta {
+			if strings.HasPrefix(p, key+"/") {
+				delete(meta, p)
+			}
+		}
+	}
+	return nil
+}
+
+// realParents reports whether every parent of rel under root is a real
+// directory rather than a symlink, so that rel names a path inside root.
+func realParents(root, rel string) bool {
+	cur := root
+	parts := strings.Split(filepath.Dir(rel), string(filepath.Separator))
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
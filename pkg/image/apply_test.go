@@ -0,0 +1,226 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLayer is the entries of a tar layer. Regular files hold
+// fileContent(name, uid), so tests can tell which layer a file came from.
+type testLayer []tar.Header
+
+func dirEntry(name string) tar.Header {
+	return tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0755}
+}
+
+func symlinkEntry(name, target string) tar.Header {
+	return tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0777}
+}
+
+func hardlinkEntry(name, target string) tar.Header {
+	return tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target}
+}
+
+func whiteoutEntry(name string) tar.Header {
+	d, base := filepath.Split(name)
+	return tar.Header{Name: d + whiteoutPrefix + base, Typeflag: tar.TypeReg, Mode: 0644}
+}
+
+func opaqueEntry(name string) tar.Header {
+	return tar.Header{Name: name + "/" + whiteoutOpaque, Typeflag: tar.TypeReg, Mode: 0644}
+}
+
+// fileEntry returns a regular file written by layer gen.
+func fileEntry(name string, gen int) tar.Header {
+	return tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Uid: gen}
+}
+
+func fileContent(name string, gen int) string { return fmt.Sprintf("%s@%d", name, gen) }
+
+// applyLayers builds an image of layers, bottom first, extracts it and
+// returns the extracted tree and its metadata.
+func applyLayers(t *testing.T, layers ...testLayer) (string, map[string]fileMeta) {
+	t.Helper()
+	var v1Layers []v1.Layer
+	for _, l := range layers {
+		contents := map[string][]byte{}
+		for _, h := range l {
+			if h.Typeflag == tar.TypeReg {
+				contents[h.Name] = []byte(fileContent(h.Name, h.Uid))
+			}
+		}
+		v1Layers = append(v1Layers, buildTarLayer(t, l, contents))
+	}
+	dest := t.TempDir()
+	meta, err := (&Builder{}).extractImage(buildMultiLayerImage(t, v1Layers...), dest)
+	require.NoError(t, err)
+	return dest, meta
+}
+
+// tree describes every entry under root: "dir", "-> target" for symlinks,
+// or the content of regular files.
+func tree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	out := map[string]string{}
+	require.NoError(t, lstatWalkErr(root, func(path string, info os.FileInfo) error {
+		rel, _ := filepath.Rel(root, path)
+		switch {
+		case rel == ".":
+		case info.IsDir():
+			out[rel] = "dir"
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			out[rel] = "-> " + target
+			return err
+		default:
+			data, err := os.ReadFile(path)
+			out[rel] = string(data)
+			return err
+		}
+		return nil
+	}))
+	return out
+}
+
+func metaPaths(meta map[string]fileMeta) []string {
+	var paths []string
+	for p := range meta {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func TestApplyWhiteout(t *testing.T) {
+	root, meta := applyLayers(t,
+		testLayer{dirEntry("etc"), fileEntry("etc/keep", 1), fileEntry("etc/gone", 1), dirEntry("var"), dirEntry("var/cache"), fileEntry("var/cache/a", 1)},
+		testLayer{whiteoutEntry("etc/gone"), whiteoutEntry("var/cache"), whiteoutEntry("missing")},
+	)
+	assert.Equal(t, map[string]string{
+		"etc":      "dir",
+		"etc/keep": fileContent("etc/keep", 1),
+		"var":      "dir",
+	}, tree(t, root))
+	assert.ElementsMatch(t, []string{"/etc", "/etc/keep", "/var"}, metaPaths(meta))
+}
+
+func TestApplyOpaqueDir(t *testing.T) {
+	lower := testLayer{dirEntry("app"), fileEntry("app/old", 1), dirEntry("app/sub"), fileEntry("app/sub/old", 1), fileEntry("other", 1)}
+	want := map[string]string{
+		"app":         "dir",
+		"app/new":     fileContent("app/new", 2),
+		"app/sub":     "dir",
+		"app/sub/new": fileContent("app/sub/new", 2),
+		"other":       fileContent("other", 1),
+	}
+	// The opaque marker may come before or after the entries its layer
+	// adds to the directory; they survive either way.
+	for name, upper := range map[string]testLayer{
+		"marker first": {dirEntry("app"), opaqueEntry("app"), fileEntry("app/new", 2), dirEntry("app/sub"), fileEntry("app/sub/new", 2)},
+		"marker last":  {dirEntry("app"), fileEntry("app/new", 2), dirEntry("app/sub"), fileEntry("app/sub/new", 2), opaqueEntry("app")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			root, meta := applyLayers(t, lower, upper)
+			assert.Equal(t, want, tree(t, root))
+			assert.NotContains(t, meta, "/app/old")
+			assert.NotContains(t, meta, "/app/sub/old")
+		})
+	}
+}
+
+func TestApplyDeletedAndRecreated(t *testing.T) {
+	t.Run("across layers", func(t *testing.T) {
+		root, meta := applyLayers(t,
+			testLayer{dirEntry("data"), fileEntry("data/old", 1)},
+			testLayer{whiteoutEntry("data")},
+			testLayer{fileEntry("data", 3)},
+		)
+		assert.Equal(t, map[string]string{"data": fileContent("data", 3)}, tree(t, root))
+		assert.ElementsMatch(t, []string{"/data"}, metaPaths(meta))
+		assert.Equal(t, 3, meta["/data"].uid)
+	})
+	t.Run("within a layer", func(t *testing.T) {
+		root, _ := applyLayers(t,
+			testLayer{dirEntry("data"), fileEntry("data/old", 1)},
+			testLayer{dirEntry("data"), fileEntry("data/new", 2), whiteoutEntry("data")},
+		)
+		assert.Equal(t, map[string]string{"data": "dir", "data/new": fileContent("data/new", 2)}, tree(t, root))
+	})
+}
+
+func TestApplyReplacesAcrossTypes(t *testing.T) {
+	root, meta := applyLayers(t,
+		testLayer{dirEntry("doc"), fileEntry("doc/readme", 1), fileEntry("conf", 1), symlinkEntry("lib", "usr/lib")},
+		testLayer{symlinkEntry("doc", "/usr/share/doc"), dirEntry("conf"), fileEntry("conf/a", 2), dirEntry("lib"), fileEntry("lib/x", 2)},
+	)
+	assert.Equal(t, map[string]string{
+		"doc":    "-> /usr/share/doc",
+		"conf":   "dir",
+		"conf/a": fileContent("conf/a", 2),
+		"lib":    "dir",
+		"lib/x":  fileContent("lib/x", 2),
+	}, tree(t, root))
+	assert.NotContains(t, meta, "/doc/readme", "a non-directory replaces a directory and all it held")
+}
+
+func TestApplyHardlinkFarm(t *testing.T) {
+	base := testLayer{dirEntry("bin"), fileEntry("bin/busybox", 1)}
+	for _, applet := range []string{"sh", "ls", "cat", "vi"} {
+		base = append(base, hardlinkEntry("bin/"+applet, "bin/busybox"))
+	}
+	root, meta := applyLayers(t,
+		base,
+		// An upper layer links to a file from a lower one, and replaces the
+		// original, which the existing links keep.
+		testLayer{hardlinkEntry("bin/sleep", "bin/busybox"), fileEntry("bin/busybox", 2)},
+	)
+
+	got := tree(t, root)
+	assert.Equal(t, fileContent("bin/busybox", 2), got["bin/busybox"])
+	for _, applet := range []string{"sh", "ls", "cat", "vi", "sleep"} {
+		assert.Equal(t, fileContent("bin/busybox", 1), got["bin/"+applet], applet)
+		assert.NotContains(t, meta, "/bin/"+applet)
+	}
+	sh, err := os.Stat(filepath.Join(root, "bin/sh"))
+	require.NoError(t, err)
+	sleep, err := os.Stat(filepath.Join(root, "bin/sleep"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(sh, sleep))
+}
+
+func TestApplyStaysInRoot(t *testing.T) {
+	outside := t.TempDir()
+	sentinel := filepath.Join(outside, "sentinel")
+	require.NoError(t, os.WriteFile(sentinel, []byte("host"), 0644))
+
+	root, _ := applyLayers(t,
+		testLayer{symlinkEntry("escape", outside)},
+		testLayer{whiteoutEntry("escape/sentinel"), dirEntry("opq"), symlinkEntry("opq/escape", outside), opaqueEntry("opq/escape")},
+	)
+	assert.FileExists(t, sentinel, "whiteouts are not followed through symlinks")
+	assert.Equal(t, "-> "+outside, tree(t, root)["escape"])
+
+	for _, target := range []string{"../../etc/passwd", "escape/sentinel"} {
+		l := buildTarLayer(t, []tar.Header{symlinkEntry("escape", outside), hardlinkEntry("stolen", target)}, nil)
+		_, err := (&Builder{}).extractImage(buildMultiLayerImage(t, l), t.TempDir())
+		require.ErrorIs(t, err, ErrExtract, target)
+		assert.Contains(t, err.Error(), "outside the rootfs")
+	}
+}
+
+func TestApplySkipsAufsMetadata(t *testing.T) {
+	root, meta := applyLayers(t, testLayer{
+		dirEntry(".wh..wh.plnk"),
+		fileEntry(".wh..wh.plnk/1234.5678", 1),
+		fileEntry(".wh..wh.aufs", 1),
+		fileEntry("kept", 1),
+	})
+	assert.Equal(t, map[string]string{"kept": fileContent("kept", 1)}, tree(t, root))
+	assert.ElementsMatch(t, []string{"/kept"}, metaPaths(meta))
+}
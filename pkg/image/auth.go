@@ -0,0 +1,294 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/storename"
+)
+
+// Credentials authenticate to a registry. Password may also be a token.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// AuthStore keeps registry credentials from `matchlock login`, so pulls do
+// not depend on ~/.docker/config.json. Credentials live in the auth file
+// itself, or with CredsStore set, in a docker-credential-<CredsStore>
+// helper such as osxkeychain, secretservice or pass:
+//
+//	{
+//	  "auths": {"ghcr.io": {"auth": "<base64 user:password>"}},
+//	  "creds_store": "osxkeychain"
+//	}
+type AuthStore struct {
+	path string
+	file authFile
+}
+
+type authFile struct {
+	Auths      map[string]authEntry `json:"auths,omitempty"`
+	CredsStore string               `json:"creds_store,omitempty"`
+}
+
+// authEntry is a registry's credentials, empty when a helper holds them.
+type authEntry struct {
+	Auth string `json:"auth,omitempty"`
+}
+
+// DefaultAuthPath returns $MATCHLOCK_AUTH_CONFIG, or
+// ~/.config/matchlock/auth.json.
+func DefaultAuthPath() string {
+	if p := os.Getenv("MATCHLOCK_AUTH_CONFIG"); p != "" {
+		return p
+	}
+	return storename.ConfigPath("auth.json")
+}
+
+// LoadDefaultAuthStore loads the auth file at DefaultAuthPath.
+func LoadDefaultAuthStore() (*AuthStore, error) {
+	return LoadAuthStore(DefaultAuthPath())
+}
+
+// LoadAuthStore reads an auth file. A missing file yields an empty store.
+func LoadAuthStore(path string) (*AuthStore, error) {
+	s := &AuthStore{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, errx.Wrap(ErrRegistryAuth, err)
+	}
+	if err := json.Unmarshal(data, &s.file); err != nil {
+		return nil, errx.With(ErrRegistryAuth, " %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// CredsStore returns the credential helper the store keeps secrets in, or
+// "" if they are kept in the auth file.
+func (s *AuthStore) CredsStore() string {
+	return s.file.CredsStore
+}
+
+// SetCredsStore keeps credentials stored from now on in the
+// docker-credential-<helper> helper, or in the auth file if helper is "".
+func (s *AuthStore) SetCredsStore(helper string) {
+	s.file.CredsStore = helper
+}
+
+// Registries lists the registries the store has credentials for.
+func (s *AuthStore) Registries() []string {
+	regs := make([]string, 0, len(s.file.Auths))
+	for reg := range s.file.Auths {
+		regs = append(regs, reg)
+	}
+	sort.Strings(regs)
+	return regs
+}
+
+// Login stores creds for registry and saves the auth file.
+func (s *AuthStore) Login(registry string, creds Credentials) error {
+	key, err := authKey(registry)
+	if err != nil {
+		return err
+	}
+	entry := authEntry{}
+	if s.file.CredsStore != "" {
+		req, _ := json.Marshal(map[string]string{"ServerURL": key, "Username": creds.Username, "Secret": creds.Password})
+		if _, err := runCredentialHelper(s.file.CredsStore, "store", req); err != nil {
+			return err
+		}
+	} else {
+		entry.Auth = base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+	}
+	if s.file.Auths == nil {
+		s.file.Auths = map[string]authEntry{}
+	}
+	s.file.Auths[key] = entry
+	return s.save()
+}
+
+// Logout forgets the credentials for registry and saves the auth file. It
+// reports whether there were any.
+func (s *AuthStore) Logout(registry string) (bool, error) {
+	key, err := authKey(registry)
+	if err != nil {
+		return false, err
+	}
+	entry, ok := s.file.Auths[key]
+	if !ok {
+		return false, nil
+	}
+	if entry.Auth == "" && s.file.CredsStore != "" {
+		if _, err := runCredentialHelper(s.file.CredsStore, "erase", []byte(key)); err != nil {
+			return false, err
+		}
+	}
+	delete(s.file.Auths, key)
+	return true, s.save()
+}
+
+// Get returns the stored credentials for registry.
+func (s *AuthStore) Get(registry string) (Credentials, bool, error) {
+	key, err := authKey(registry)
+	if err != nil {
+		return Credentials{}, false, err
+	}
+	entry, ok := s.file.Auths[key]
+	if !ok {
+		return Credentials{}, false, nil
+	}
+	if entry.Auth == "" {
+		if s.file.CredsStore == "" {
+			return Credentials{}, false, nil
+		}
+		out, err := runCredentialHelper(s.file.CredsStore, "get", []byte(key))
+		if err != nil {
+			return Credentials{}, false, err
+		}
+		var resp struct{ Username, Secret string }
+		if err := json.Unmarshal(out, &resp); err != nil {
+			return Credentials{}, false, errx.With(ErrRegistryAuth, ": docker-credential-%s get: %w", s.file.CredsStore, err)
+		}
+		return Credentials{Username: resp.Username, Password: resp.Secret}, true, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return Credentials{}, false, errx.With(ErrRegistryAuth, ": %s in %s: %w", key, s.path, err)
+	}
+	user, pass, _ := strings.Cut(string(raw), ":")
+	return Credentials{Username: user, Password: pass}, true, nil
+}
+
+// Resolve implements authn.Keychain. Registries without stored credentials
+// are anonymous, so a multi-keychain falls through to the next keychain.
+func (s *AuthStore) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	creds, ok, err := s.Get(target.RegistryStr())
+	if err != nil || !ok {
+		return authn.Anonymous, err
+	}
+	return authn.FromConfig(authn.AuthConfig{Username: creds.Username, Password: creds.Password}), nil
+}
+
+func (s *AuthStore) save() error {
+	data, err := json.MarshalIndent(s.file, "", "  ")
+	if err != nil {
+		return errx.Wrap(ErrRegistryAuth, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return errx.Wrap(ErrRegistryAuth, err)
+	}
+	if err := os.WriteFile(s.path, data, 0600); err != nil {
+		return errx.Wrap(ErrRegistryAuth, err)
+	}
+	return nil
+}
+
+// Keychain resolves credentials from store, then from the Docker
+// keychain (~/.docker/config.json and its helpers).
+func Keychain(store *AuthStore) authn.Keychain {
+	if store == nil {
+		return authn.DefaultKeychain
+	}
+	return authn.NewMultiKeychain(store, authn.DefaultKeychain)
+}
+
+// CredentialsKeychain returns a keychain that authenticates to registry
+// with creds, for credentials given for a single invocation.
+func CredentialsKeychain(registry string, creds Credentials) (authn.Keychain, error) {
+	key, err := authKey(registry)
+	if err != nil {
+		return nil, err
+	}
+	return staticKeychain{registry: key, creds: creds}, nil
+}
+
+type staticKeychain struct {
+	registry string
+	creds    Credentials
+}
+
+func (k staticKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if target.RegistryStr() != k.registry {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{Username: k.creds.Username, Password: k.creds.Password}), nil
+}
+
+// CheckLogin authenticates to registry with creds, failing if the registry
+// rejects them.
+func CheckLogin(ctx context.Context, registry string, creds Credentials) error {
+	reg, err := name.NewRegistry(registry)
+	if err != nil {
+		return errx.Wrap(ErrParseReference, err)
+	}
+	auth := authn.FromConfig(authn.AuthConfig{Username: creds.Username, Password: creds.Password})
+	rt, err := transport.NewWithContext(ctx, reg, auth, http.DefaultTransport, []string{reg.Scope(transport.PullScope)})
+	if err != nil {
+		return errx.With(ErrRegistryAuth, ": %s: %w", reg, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reg.Scheme()+"://"+reg.RegistryStr()+"/v2/", nil)
+	if err != nil {
+		return errx.Wrap(ErrRegistryAuth, err)
+	}
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return errx.With(ErrRegistryAuth, ": %s: %w", reg, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errx.With(ErrRegistryAuth, ": %s: %s", reg, resp.Status)
+	}
+	return nil
+}
+
+// authKey names registry the way references resolve it, so that
+// "docker.io" and "index.docker.io" share credentials.
+func authKey(registry string) (string, error) {
+	registry = strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	registry = strings.TrimSuffix(strings.TrimSuffix(registry, "/v1/"), "/")
+	reg, err := name.NewRegistry(registry)
+	if err != nil {
+		return "", errx.Wrap(ErrParseReference, err)
+	}
+	return reg.RegistryStr(), nil
+}
+
+// runCredentialHelper runs a docker credential helper action with input on
+// stdin and returns its output.
+func runCredentialHelper(helper, action string, input []byte) ([]byte, error) {
+	bin := "docker-credential-" + helper
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return nil, errx.With(ErrToolNotFound, ": %s", bin)
+	}
+	cmd := exec.Command(path, action)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = strings.TrimSpace(string(out))
+		}
+		return nil, errx.With(ErrRegistryAuth, ": %s %s: %v: %s", bin, action, err, msg)
+	}
+	return out, nil
+}
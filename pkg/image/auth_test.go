@@ -0,0 +1,143 @@
+package image
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// privateRegistry serves an in-memory registry that requires basic auth
+// as user/pass, and returns its host.
+func privateRegistry(t *testing.T) string {
+	t.Helper()
+	reg := registry.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestAuthStoreFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "matchlock", "auth.json")
+	s, err := LoadAuthStore(path)
+	require.NoError(t, err)
+	require.NoError(t, s.Login("docker.io", Credentials{Username: "me", Password: "p:w"}))
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	s, err = LoadAuthStore(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{name.DefaultRegistry}, s.Registries())
+	creds, ok, err := s.Get("https://index.docker.io/v1/")
+	require.NoError(t, err)
+	require.True(t, ok, "docker.io and index.docker.io share credentials")
+	assert.Equal(t, Credentials{Username: "me", Password: "p:w"}, creds)
+
+	_, ok, err = s.Get("ghcr.io")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	removed, err := s.Logout("docker.io")
+	require.NoError(t, err)
+	assert.True(t, removed)
+	removed, err = s.Logout("docker.io")
+	require.NoError(t, err)
+	assert.False(t, removed)
+
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0600))
+	_, err = LoadAuthStore(path)
+	require.ErrorIs(t, err, ErrRegistryAuth)
+}
+
+func TestAuthStoreCredentialHelper(t *testing.T) {
+	secrets := filepath.Join(t.TempDir(), "secrets")
+	fakeTool(t, "docker-credential-fake", `case "$1" in
+store) cat > `+secrets+` ;;
+get) read url; [ -f `+secrets+` ] || { echo "credentials not found" >&2; exit 1; }; sed 's/"ServerURL":"[^"]*",//' `+secrets+` ;;
+erase) rm `+secrets+` ;;
+esac`)
+
+	path := filepath.Join(t.TempDir(), "auth.json")
+	s, err := LoadAuthStore(path)
+	require.NoError(t, err)
+	s.SetCredsStore("fake")
+	require.NoError(t, s.Login("ghcr.io", Credentials{Username: "octocat", Password: "token"}))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "token", "secrets stay in the helper")
+
+	s, err = LoadAuthStore(path)
+	require.NoError(t, err)
+	assert.Equal(t, "fake", s.CredsStore())
+	creds, ok, err := s.Get("ghcr.io")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, Credentials{Username: "octocat", Password: "token"}, creds)
+
+	_, err = s.Logout("ghcr.io")
+	require.NoError(t, err)
+	assert.NoFileExists(t, secrets)
+
+	s.SetCredsStore("missing")
+	err = s.Login("ghcr.io", Credentials{Username: "octocat", Password: "token"})
+	require.ErrorIs(t, err, ErrToolNotFound)
+}
+
+func TestFetchWithStoredLogin(t *testing.T) {
+	host := privateRegistry(t)
+	ref, err := name.ParseReference(host + "/test/image:latest")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, platformImage(t, DefaultPlatform()),
+		remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"})))
+
+	fetch := func(keychain authn.Keychain) error {
+		b := NewBuilder(&BuildOptions{CacheDir: t.TempDir(), Keychain: keychain})
+		_, _, _, err := fetchFromSources(ref, nil, DefaultPlatform(), b.remoteOptions(context.Background())...)
+		return err
+	}
+
+	s, err := LoadAuthStore(filepath.Join(t.TempDir(), "auth.json"))
+	require.NoError(t, err)
+	require.ErrorIs(t, fetch(Keychain(s)), ErrPullImage, "anonymous")
+
+	require.NoError(t, s.Login(host, Credentials{Username: "user", Password: "pass"}))
+	require.NoError(t, fetch(Keychain(s)))
+
+	ci, err := CredentialsKeychain(host, Credentials{Username: "user", Password: "pass"})
+	require.NoError(t, err)
+	require.NoError(t, fetch(ci))
+
+	other, err := CredentialsKeychain("ghcr.io", Credentials{Username: "user", Password: "pass"})
+	require.NoError(t, err)
+	require.ErrorIs(t, fetch(other), ErrPullImage, "credentials for another registry are not sent")
+}
+
+func TestCheckLogin(t *testing.T) {
+	host := privateRegistry(t)
+	ctx := context.Background()
+	require.NoError(t, CheckLogin(ctx, host, Credentials{Username: "user", Password: "pass"}))
+
+	err := CheckLogin(ctx, host, Credentials{Username: "user", Password: "wrong"})
+	require.ErrorIs(t, err, ErrRegistryAuth)
+	assert.Contains(t, err.Error(), "401")
+}
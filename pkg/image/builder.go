@@ -4,31 +4,65 @@ import (
 	"archive/tar"
 	"context"
 	"encoding/json"
-
-	"io"
+	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 
 	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/trust"
 )
 
 type Builder struct {
 	cacheDir  string
 	forcePull bool
-	store     *Store
+	platform  v1.Platform
+	// layerConcurrency bounds parallel layer downloads per image.
+	layerConcurrency int
+	format           RootfsFormat
+	signatures       *trust.ImagePolicy
+	registries       *RegistryConfig
+	keychain         authn.Keychain
+	store            *Store
+	index            *imageIndex
+	layers           *LayerCache
+	snapshots        *SnapshotCache
+	reproducible     bool
 }
 
 type BuildOptions struct {
-	CacheDir  string
-	ForcePull bool
+	CacheDir      string
+	LayerCacheDir string
+	ForcePull     bool
+	// Platform selects the image from multi-platform manifest lists; the
+	// zero value means DefaultPlatform.
+	Platform v1.Platform
+	// LayerConcurrency is the number of layers of an image downloaded at
+	// once; zero means DefaultLayerConcurrency.
+	LayerConcurrency int
+	// RootfsFormat is the filesystem registry images are converted to; the
+	// zero value means FormatExt4.
+	RootfsFormat RootfsFormat
+	// SignaturePolicy, when set, rejects registry images without a
+	// signature from one of its signers before they are extracted.
+	SignaturePolicy *trust.ImagePolicy
+	// Registries redirects pulls to mirrors or rewritten registries; nil
+	// pulls images from where they are named.
+	Registries *RegistryConfig
+	// Keychain authenticates pulls; nil means the Docker keychain.
+	Keychain authn.Keychain
+	// Reproducible converts the same image to byte-identical rootfs files:
+	// UUIDs derive from the image digest, and timestamps the image does not
+	// record come from SOURCE_DATE_EPOCH or its creation time.
+	Reproducible bool
 }
 
 func NewBuilder(opts *BuildOptions) *Builder {
@@ -37,10 +71,32 @@ func NewBuilder(opts *BuildOptions) *Builder {
 		home, _ := os.UserHomeDir()
 		cacheDir = filepath.Join(home, ".cache", "matchlock", "images")
 	}
+	platform := opts.Platform
+	format := opts.RootfsFormat
+	if format == "" {
+		format = FormatExt4
+	}
+	if platform.OS == "" {
+		platform = DefaultPlatform()
+	}
+	keychain := opts.Keychain
+	if keychain == nil {
+		keychain = authn.DefaultKeychain
+	}
 	return &Builder{
-		cacheDir:  cacheDir,
-		forcePull: opts.ForcePull,
-		store:     NewStore(""),
+		cacheDir:         cacheDir,
+		forcePull:        opts.ForcePull,
+		platform:         platform,
+		layerConcurrency: opts.LayerConcurrency,
+		format:           format,
+		signatures:       opts.SignaturePolicy,
+		registries:       opts.Registries,
+		keychain:         keychain,
+		store:            NewStore(""),
+		index:            registryIndex(cacheDir),
+		layers:           NewLayerCache(opts.LayerCacheDir),
+		snapshots:        NewSnapshotCache(filepath.Join(cacheDir, snapshotsDir)),
+		reproducible:     opts.Reproducible,
 	}
 }
 
@@ -53,51 +109,56 @@ type BuildResult struct {
 }
 
 func (b *Builder) Build(ctx context.Context, imageRef string) (*BuildResult, error) {
-	if !b.forcePull {
+	if IsLocalImageRef(imageRef) {
+		return b.buildLocal(ctx, imageRef)
+	}
+	// Locally built and imported images are for the host, so they only
+	// satisfy the default platform.
+	hostPlatform := b.platform.Equals(DefaultPlatform())
+	if !b.forcePull && hostPlatform {
 		if result, err := b.store.Get(imageRef); err == nil {
 			return result, nil
 		}
 	}
 
+	// A locally built curated image takes precedence over the published one.
+	imageRef, err := resolveCurated(imageRef)
+	if err != nil {
+		return nil, err
+	}
 	ref, err := name.ParseReference(imageRef)
 	if err != nil {
 		return nil, errx.Wrap(ErrParseReference, err)
 	}
 
-	cacheDir := filepath.Join(b.cacheDir, sanitizeRef(imageRef))
-	if !b.forcePull {
-		if entries, err := os.ReadDir(cacheDir); err == nil {
-			for _, e := range entries {
-				if filepath.Ext(e.Name()) == ".ext4" {
-					rootfsPath := filepath.Join(cacheDir, e.Name())
-					fi, _ := os.Stat(rootfsPath)
-					result := &BuildResult{
-						RootfsPath: rootfsPath,
-						Digest:     strings.TrimSuffix(e.Name(), ".ext4"),
-						Size:       fi.Size(),
-						Cached:     true,
-					}
-					if metaBytes, err := os.ReadFile(filepath.Join(cacheDir, "metadata.json")); err == nil {
-						var meta ImageMeta
-						if json.Unmarshal(metaBytes, &meta) == nil {
-							result.OCI = meta.OCI
-						}
-					}
-					return result, nil
-				}
+	cacheKey := registryCacheKey(imageRef, b.platform)
+	cacheDir := filepath.Join(b.cacheDir, cacheKey)
+	cached, err := b.index.entry(cacheKey)
+	if err != nil {
+		return nil, err
+	}
+	// A reference may have been re-pushed since it was cached, so with
+	// signature checks it is always resolved against the registry.
+	if !b.forcePull && b.signatures == nil && b.reusable(cached) {
+		if name, ok := cached.Rootfs[b.format]; ok {
+			rootfsPath := filepath.Join(cacheDir, name)
+			if fi, err := os.Stat(rootfsPath); err == nil {
+				b.index.touch(cacheKey)
+				return &BuildResult{
+					RootfsPath: rootfsPath,
+					Digest:     cached.Meta.Digest,
+					Size:       fi.Size(),
+					Cached:     true,
+					OCI:        cached.Meta.OCI,
+				}, nil
 			}
 		}
 	}
 
-	remoteOpts := []remote.Option{
-		remote.WithAuthFromKeychain(authn.DefaultKeychain),
-		remote.WithContext(ctx),
-	}
-	remoteOpts = append(remoteOpts, b.platformOptions()...)
-
-	img, err := remote.Image(ref, remoteOpts...)
+	remoteOpts := b.remoteOptions(ctx)
+	img, resolved, source, err := fetchFromSources(ref, b.registries, b.platform, remoteOpts...)
 	if err != nil {
-		return nil, errx.Wrap(ErrPullImage, err)
+		return nil, err
 	}
 
 	digest, err := img.Digest()
@@ -105,13 +166,30 @@ func (b *Builder) Build(ctx context.Context, imageRef string) (*BuildResult, err
 		return nil, errx.Wrap(ErrImageDigest, err)
 	}
 
-	rootfsPath := filepath.Join(cacheDir, digest.Hex[:12]+".ext4")
+	// A pinned reference may name the manifest list or the platform image;
+	// anything else means the registry served content other than what was
+	// asked for.
+	if pinned, ok := ref.(name.Digest); ok {
+		if want := pinned.DigestStr(); want != resolved.String() && want != digest.String() {
+			return nil, errx.With(ErrDigestMismatch, ": %s resolved to %s", ref, resolved)
+		}
+	}
+
+	if b.signatures != nil {
+		if err := verifySignature(ctx, source, []v1.Hash{resolved, digest}, b.signatures, remoteOpts...); err != nil {
+			return nil, err
+		}
+	}
+
+	rootfsName := digest.Hex[:12] + "." + string(b.format)
+	rootfsPath := filepath.Join(cacheDir, rootfsName)
 
 	if err := os.MkdirAll(filepath.Dir(rootfsPath), 0755); err != nil {
 		return nil, errx.Wrap(ErrCreateDir, err)
 	}
 
-	if fi, err := os.Stat(rootfsPath); err == nil && fi.Size() > 0 {
+	if fi, err := os.Stat(rootfsPath); err == nil && fi.Size() > 0 && cached != nil && cached.Rootfs[b.format] == rootfsName && b.reusable(cached) {
+		b.index.touch(cacheKey)
 		ociConfig := extractOCIConfig(img)
 		return &BuildResult{
 			RootfsPath: rootfsPath,
@@ -122,20 +200,46 @@ func (b *Builder) Build(ctx context.Context, imageRef string) (*BuildResult, err
 		}, nil
 	}
 
-	extractDir, err := os.MkdirTemp("", "matchlock-extract-*")
+	// Extraction starts from the longest layer prefix extracted before, so
+	// when a tag moves only the layers it gained are fetched and applied.
+	chain, err := layerChain(img)
 	if err != nil {
-		return nil, errx.Wrap(ErrCreateTemp, err)
+		return nil, err
+	}
+	extractDir, base, fileMetas, err := b.snapshots.checkout(chain)
+	if err != nil {
+		return nil, err
 	}
 	defer os.RemoveAll(extractDir)
+	layerDir, err := os.MkdirTemp("", "matchlock-layers-*")
+	if err != nil {
+		return nil, errx.Wrap(ErrCreateTemp, err)
+	}
+	defer os.RemoveAll(layerDir)
 
-	fileMetas, err := b.extractImage(img, extractDir)
+	// Layers download in parallel while extraction works through those
+	// already fetched, bottom first, so large images are not fetched and
+	// then unpacked one layer after the other.
+	fetched, stopFetch, err := b.fetchLayers(ctx, img, layerDir, b.layerConcurrency, base)
 	if err != nil {
+		return nil, err
+	}
+	defer stopFetch()
+
+	if err := b.snapshots.apply(fetched, chain, base, extractDir, fileMetas); err != nil {
 		return nil, errx.Wrap(ErrExtract, err)
 	}
 
-	if err := b.createExt4(extractDir, rootfsPath, fileMetas); err != nil {
+	// Record the image in the layer cache so later Dockerfile builds reuse
+	// its layers. The cache is best effort, and holds one image per
+	// reference, so only host images go there.
+	if hostPlatform {
+		b.layers.Add(imageRef, fetched)
+	}
+
+	if err := b.createRootfs(ctx, extractDir, rootfsPath, fileMetas, b.rootfsStamp(img, digest)); err != nil {
 		os.Remove(rootfsPath)
-		return nil, errx.Wrap(ErrCreateExt4, err)
+		return nil, errx.Wrap(ErrCreateRootfs, err)
 	}
 
 	ociConfig := extractOCIConfig(img)
@@ -148,11 +252,27 @@ func (b *Builder) Build(ctx context.Context, imageRef string) (*BuildResult, err
 		Size:      fi.Size(),
 		CreatedAt: time.Now(),
 		Source:    "registry",
+		Platform:  b.platform.String(),
+		Layers:    layerCount(img),
 		OCI:       ociConfig,
+		// Reproducible builds do not reuse rootfs files converted otherwise.
+		Reproducible: b.reproducible,
+	}
+	if len(chain) > 0 {
+		imageMeta.Snapshot = chain[len(chain)-1].Hex
 	}
 	if metaBytes, err := json.MarshalIndent(imageMeta, "", "  "); err == nil {
 		os.WriteFile(filepath.Join(cacheDir, "metadata.json"), metaBytes, 0644)
 	}
+	if err := b.index.update(func(state *indexState) error {
+		state.Images[cacheKey] = recordConversion(cacheDir, state.Images[cacheKey], b.format, rootfsName, imageMeta)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	// Snapshots only the image this tag pointed to before was built from
+	// are not needed any more.
+	pruneSnapshots(b.cacheDir)
 
 	return &BuildResult{
 		RootfsPath: rootfsPath,
@@ -162,10 +282,105 @@ func (b *Builder) Build(ctx context.Context, imageRef string) (*BuildResult, err
 	}, nil
 }
 
+// reusable reports whether the cached image satisfies the builder:
+// reproducible builds only reuse rootfs files converted that way.
+func (b *Builder) reusable(cached *indexEntry) bool {
+	return cached != nil && (!b.reproducible || cached.Meta.Reproducible)
+}
+
+// recordConversion returns the index entry for the registry cache entry in
+// dir once the rootfs file name of format has been converted from the image
+// described by meta. When the reference now names another image, the
+// rootfs files of the old one are removed.
+func recordConversion(dir string, e *indexEntry, format RootfsFormat, name string, meta ImageMeta) *indexEntry {
+	if e == nil || e.Meta.Digest != meta.Digest {
+		if e != nil {
+			for _, old := range e.Rootfs {
+				if old != name {
+					os.Remove(filepath.Join(dir, old))
+				}
+			}
+		}
+		e = &indexEntry{Rootfs: make(map[RootfsFormat]string)}
+	}
+	e.Rootfs[format] = name
+	e.Meta = meta
+	e.Meta.Size = 0
+	for _, n := range e.Rootfs {
+		if fi, err := os.Stat(filepath.Join(dir, n)); err == nil {
+			e.Meta.Size += fi.Size()
+		}
+	}
+	e.LastUsed = time.Now()
+	return e
+}
+
+func (b *Builder) remoteOptions(ctx context.Context) []remote.Option {
+	return []remote.Option{
+		remote.WithAuthFromKeychain(b.keychain),
+		remote.WithContext(ctx),
+	}
+}
+
 type fileMeta struct {
 	uid  int
 	gid  int
 	mode os.FileMode
+	// typeflag is the tar type of device nodes and FIFOs. Creating those
+	// needs privileges, so extraction leaves an empty file in their place.
+	typeflag byte
+	devmajor int64
+	devminor int64
+	// xattrs holds extended attributes such as security.capability.
+	xattrs map[string]string
+	// mtime is the modification time recorded in the layer, which the
+	// rootfs keeps so that it does not depend on when it was converted.
+	mtime time.Time
+}
+
+// isDevice reports whether the entry is a device node or FIFO.
+func (fm fileMeta) isDevice() bool {
+	switch fm.typeflag {
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return true
+	}
+	return false
+}
+
+// typeBits returns the st_mode file type bits of the entry, given the
+// extracted file's info.
+func (fm fileMeta) typeBits(info os.FileInfo) uint32 {
+	switch {
+	case fm.typeflag == tar.TypeChar:
+		return 0o020000
+	case fm.typeflag == tar.TypeBlock:
+		return 0o060000
+	case fm.typeflag == tar.TypeFifo:
+		return 0o010000
+	case info.IsDir():
+		return 0o040000
+	case info.Mode()&os.ModeSymlink != 0:
+		return 0o120000
+	}
+	return 0o100000
+}
+
+// xattrPAXPrefix prefixes extended attributes in PAX records, as written by
+// Docker and BuildKit.
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// tarXattrs returns the extended attributes recorded in hdr.
+func tarXattrs(hdr *tar.Header) map[string]string {
+	var xattrs map[string]string
+	for k, v := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(k, xattrPAXPrefix); ok {
+			if xattrs == nil {
+				xattrs = make(map[string]string)
+			}
+			xattrs[name] = v
+		}
+	}
+	return xattrs
 }
 
 // ensureRealDir ensures that every component of path under root is a real
@@ -224,85 +439,6 @@ func safeCreate(root, target string, mode os.FileMode) (*os.File, error) {
 	return os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
 }
 
-func (b *Builder) extractImage(img v1.Image, destDir string) (map[string]fileMeta, error) {
-	reader := mutate.Extract(img)
-	defer reader.Close()
-
-	meta := make(map[string]fileMeta)
-	tr := tar.NewReader(reader)
-
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, errx.With(ErrExtract, ": read tar: %w", err)
-		}
-
-		clean := filepath.Clean(hdr.Name)
-		if strings.Contains(clean, "..") {
-			continue
-		}
-		target := filepath.Join(destDir, clean)
-
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if err := ensureRealDir(destDir, target); err != nil {
-				return nil, errx.With(ErrExtract, ": mkdir %s: %w", clean, err)
-			}
-		case tar.TypeReg:
-			f, err := safeCreate(destDir, target, os.FileMode(hdr.Mode)&0777)
-			if err != nil {
-				return nil, errx.With(ErrExtract, ": create %s: %w", clean, err)
-			}
-			if _, err := io.Copy(f, tr); err != nil {
-				f.Close()
-				return nil, errx.With(ErrExtract, ": write %s: %w", clean, err)
-			}
-			f.Close()
-		case tar.TypeSymlink:
-			if err := ensureRealDir(destDir, filepath.Dir(target)); err != nil {
-				return nil, errx.With(ErrExtract, ": mkdir parent %s: %w", clean, err)
-			}
-			if err := os.RemoveAll(target); err != nil {
-				return nil, errx.With(ErrExtract, ": remove existing %s: %w", clean, err)
-			}
-			if err := os.Symlink(hdr.Linkname, target); err != nil {
-				return nil, errx.With(ErrExtract, ": symlink %s: %w", clean, err)
-			}
-		case tar.TypeLink:
-			linkTarget := filepath.Join(destDir, filepath.Clean(hdr.Linkname))
-			if err := ensureRealDir(destDir, filepath.Dir(target)); err != nil {
-				return nil, errx.With(ErrExtract, ": mkdir parent %s: %w", clean, err)
-			}
-			if err := os.RemoveAll(target); err != nil {
-				return nil, errx.With(ErrExtract, ": remove existing %s: %w", clean, err)
-			}
-			if err := os.Link(linkTarget, target); err != nil {
-				return nil, errx.With(ErrExtract, ": hardlink %s: %w", clean, err)
-			}
-		default:
-			continue
-		}
-
-		// Don't record metadata for hardlinks — they share the target's inode,
-		// so set_inode_field would overwrite the original file's permissions.
-		if hdr.Typeflag == tar.TypeLink {
-			continue
-		}
-
-		relPath := "/" + clean
-		meta[relPath] = fileMeta{
-			uid:  hdr.Uid,
-			gid:  hdr.Gid,
-			mode: os.FileMode(hdr.Mode) & 0o7777,
-		}
-	}
-
-	return meta, nil
-}
-
 func (b *Builder) SaveTag(tag string, result *BuildResult) error {
 	meta := ImageMeta{
 		Digest: result.Digest,
@@ -315,6 +451,16 @@ func (b *Builder) Store() *Store {
 	return b.store
 }
 
+// layerCount returns the number of layers in img, or 0 if the manifest
+// cannot be read.
+func layerCount(img v1.Image) int {
+	layers, err := img.Layers()
+	if err != nil {
+		return 0
+	}
+	return len(layers)
+}
+
 func extractOCIConfig(img v1.Image) *OCIConfig {
 	cf, err := img.ConfigFile()
 	if err != nil || cf == nil {
@@ -396,6 +542,138 @@ func hasDebugfsUnsafeChars(path string) bool {
 	return strings.ContainsAny(path, "\n\r\x00")
 }
 
+// debugfsEntry writes the debugfs commands that copy the extracted entry at
+// hostPath to ext4Path, then apply the owner, mode and extended attributes
+// recorded for it in meta.
+func debugfsEntry(cmds *strings.Builder, hostPath, ext4Path string, info os.FileInfo, meta map[string]fileMeta) {
+	fm, ok := meta[ext4Path]
+	switch {
+	case info.IsDir():
+		fmt.Fprintf(cmds, "mkdir %s\n", ext4Path)
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(hostPath)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(cmds, "symlink %s %s\n", ext4Path, target)
+	case ok && fm.isDevice():
+		// mknod takes a name in the current directory, not a path.
+		dir, base := path.Split(ext4Path)
+		fmt.Fprintf(cmds, "cd %s\n", dir)
+		switch fm.typeflag {
+		case tar.TypeChar:
+			fmt.Fprintf(cmds, "mknod %s c %d %d\n", base, fm.devmajor, fm.devminor)
+		case tar.TypeBlock:
+			fmt.Fprintf(cmds, "mknod %s b %d %d\n", base, fm.devmajor, fm.devminor)
+		case tar.TypeFifo:
+			fmt.Fprintf(cmds, "mknod %s p\n", base)
+		}
+		cmds.WriteString("cd /\n")
+	case info.Mode().IsRegular():
+		fmt.Fprintf(cmds, "write %s %s\n", hostPath, ext4Path)
+	default:
+		return
+	}
+	if !ok {
+		return
+	}
+
+	fmt.Fprintf(cmds, "set_inode_field %s uid %d\n", ext4Path, fm.uid)
+	fmt.Fprintf(cmds, "set_inode_field %s gid %d\n", ext4Path, fm.gid)
+	fmt.Fprintf(cmds, "set_inode_field %s mode 0%o\n", ext4Path, fm.typeBits(info)|uint32(fm.mode))
+	if !fm.mtime.IsZero() {
+		fmt.Fprintf(cmds, "set_inode_field %s mtime @%d\n", ext4Path, fm.mtime.Unix())
+	}
+
+	names := make([]string, 0, len(fm.xattrs))
+	for name := range fm.xattrs {
+		if name != "" && !strings.ContainsAny(name, " \t\n\r\"\\\x00") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Values such as file capabilities are binary, so every byte is
+		// escaped.
+		var value strings.Builder
+		for _, c := range []byte(fm.xattrs[name]) {
+			fmt.Fprintf(&value, "\\x%02x", c)
+		}
+		fmt.Fprintf(cmds, "ea_set %s %s \"%s\"\n", ext4Path, name, value.String())
+	}
+}
+
+// ext4BlockSize is the block size mke2fs picks for all but tiny images.
+const ext4BlockSize = 4096
+
+// ext4Geometry returns the size, in bytes and rounded to whole MiB, of an
+// ext4 image that holds the tree at sourceDir, and the number of inodes it
+// should have. It is computed from what the tree needs in blocks and inodes
+// plus the filesystem's own overhead, so that large images are not short of
+// space and small ones carry little beyond their contents. Sandboxes grow
+// their copy of the image to add free space.
+func ext4Geometry(sourceDir string) (size, inodes int64) {
+	blocksFor := func(n int64) int64 { return (n + ext4BlockSize - 1) / ext4BlockSize }
+	var blocks int64
+	lstatWalk(sourceDir, func(path string, info os.FileInfo) {
+		inodes++
+		switch {
+		case info.IsDir():
+			// Entries take 8 bytes plus the name, 4-byte aligned, after
+			// "." and "..". The host's own directory size depends on its
+			// filesystem, which would make the image differ between hosts.
+			dirBytes := int64(24)
+			entries, _ := os.ReadDir(path)
+			for _, e := range entries {
+				dirBytes += (8 + int64(len(e.Name())) + 3) &^ 3
+			}
+			blocks += blocksFor(dirBytes)
+		case info.Mode()&os.ModeSymlink != 0:
+			// Targets shorter than 60 bytes are kept in the inode.
+			if info.Size() >= 60 {
+				blocks++
+			}
+		default:
+			blocks += blocksFor(info.Size())
+		}
+	})
+
+	// Leave inodes for what sandboxes add, and never fewer than mke2fs's
+	// default of one per 16 KiB, which resize2fs keeps as images grow.
+	inodes += inodes/10 + 1024
+	data := blocks * ext4BlockSize
+	inodes = max(inodes, data/16384)
+
+	size = data + inodes*256
+	// Blocks reserved for root, the journal, and bitmaps, group
+	// descriptors and lost+found.
+	size += size/20 + ext4JournalSize(size) + 16<<20
+	return (size + 1<<20 - 1) &^ (1<<20 - 1), inodes
+}
+
+// ext4JournalSize returns the size of the journal mke2fs creates for a
+// filesystem of size bytes.
+func ext4JournalSize(size int64) int64 {
+	const mb = 1 << 20
+	switch {
+	case size < 128*mb:
+		return 4 * mb
+	case size < 1024*mb:
+		return 16 * mb
+	case size < 2048*mb:
+		return 32 * mb
+	case size < 16384*mb:
+		return 64 * mb
+	case size < 32768*mb:
+		return 128 * mb
+	case size < 65536*mb:
+		return 256 * mb
+	case size < 131072*mb:
+		return 512 * mb
+	}
+	return 1024 * mb
+}
+
 func sanitizeRef(ref string) string {
 	ref = strings.ReplaceAll(ref, "/", "_")
 	ref = strings.ReplaceAll(ref, ":", "_")
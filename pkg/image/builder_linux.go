@@ -7,20 +7,15 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
-	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/uuid"
 	"github.com/jingkaihe/matchlock/internal/errx"
 )
 
-// platformOptions returns remote options for linux (uses default platform detection)
-func (b *Builder) platformOptions() []remote.Option {
-	return nil
-}
-
 // createExt4 creates an ext4 filesystem using debugfs (no root required)
-func (b *Builder) createExt4(sourceDir, destPath string, meta map[string]fileMeta) error {
+func (b *Builder) createExt4(sourceDir, destPath string, meta map[string]fileMeta, stamp *rootfsStamp) error {
 	mke2fsPath, err := exec.LookPath("mke2fs")
 	if err != nil {
 		mke2fsPath, err = exec.LookPath("mkfs.ext4")
@@ -34,23 +29,19 @@ func (b *Builder) createExt4(sourceDir, destPath string, meta map[string]fileMet
 		return errx.With(ErrToolNotFound, ": debugfs; install e2fsprogs")
 	}
 
-	var totalSize int64
-	lstatWalk(sourceDir, func(path string, info os.FileInfo) {
-		totalSize += info.Size()
-	})
-
-	sizeMB := (totalSize / (1024 * 1024)) + 64
+	size, inodes := ext4Geometry(sourceDir)
 
 	tmpPath := destPath + "." + uuid.New().String() + ".tmp"
 
-	cmd := exec.Command("dd", "if=/dev/zero", "of="+tmpPath, "bs=1M", fmt.Sprintf("count=%d", sizeMB), "conv=sparse")
+	cmd := exec.Command("dd", "if=/dev/zero", "of="+tmpPath, "bs=1M", fmt.Sprintf("count=%d", size>>20), "conv=sparse")
 	cmd.Stderr = nil
 	if out, err := cmd.CombinedOutput(); err != nil {
 		os.Remove(tmpPath)
 		return errx.With(ErrCreateExt4, ": create sparse file: %w: %s", err, out)
 	}
 
-	cmd = exec.Command(mke2fsPath, "-t", "ext4", "-F", "-q", tmpPath)
+	cmd = exec.Command(mke2fsPath, append(append([]string{"-t", "ext4", "-F", "-q", "-N", strconv.FormatInt(inodes, 10)}, stamp.mke2fsArgs()...), tmpPath)...)
+	cmd.Env = stamp.e2fsEnv()
 	if out, err := cmd.CombinedOutput(); err != nil {
 		os.Remove(tmpPath)
 		return errx.With(ErrCreateExt4, ": mke2fs: %w: %s", err, out)
@@ -70,30 +61,7 @@ func (b *Builder) createExt4(sourceDir, destPath string, meta map[string]fileMet
 			return nil
 		}
 
-		if info.IsDir() {
-			debugfsCommands.WriteString(fmt.Sprintf("mkdir %s\n", ext4Path))
-		} else if info.Mode().IsRegular() {
-			debugfsCommands.WriteString(fmt.Sprintf("write %s %s\n", path, ext4Path))
-		} else if info.Mode()&os.ModeSymlink != 0 {
-			target, err := os.Readlink(path)
-			if err == nil {
-				debugfsCommands.WriteString(fmt.Sprintf("symlink %s %s\n", ext4Path, target))
-			}
-		}
-
-		if fm, ok := meta[ext4Path]; ok {
-			debugfsCommands.WriteString(fmt.Sprintf("set_inode_field %s uid %d\n", ext4Path, fm.uid))
-			debugfsCommands.WriteString(fmt.Sprintf("set_inode_field %s gid %d\n", ext4Path, fm.gid))
-			var typeBits uint32
-			if info.IsDir() {
-				typeBits = 0o040000
-			} else if info.Mode()&os.ModeSymlink != 0 {
-				typeBits = 0o120000
-			} else {
-				typeBits = 0o100000
-			}
-			debugfsCommands.WriteString(fmt.Sprintf("set_inode_field %s mode 0%o\n", ext4Path, typeBits|uint32(fm.mode)))
-		}
+		debugfsEntry(&debugfsCommands, path, ext4Path, info, meta)
 		return nil
 	})
 	if err != nil {
@@ -103,6 +71,7 @@ func (b *Builder) createExt4(sourceDir, destPath string, meta map[string]fileMet
 
 	cmd = exec.Command(debugfsPath, "-w", "-f", "/dev/stdin", tmpPath)
 	cmd.Stdin = strings.NewReader(debugfsCommands.String())
+	cmd.Env = stamp.e2fsEnv()
 	if out, err := cmd.CombinedOutput(); err != nil {
 		os.Remove(tmpPath)
 		return errx.With(ErrCreateExt4, ": debugfs: %w: %s", err, out)
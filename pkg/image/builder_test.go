@@ -3,11 +3,15 @@ package image
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"sort"
 	"testing"
+	"time"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
@@ -594,3 +598,147 @@ func TestLstatWalkErr_PropagatesError(t *testing.T) {
 	})
 	assert.Equal(t, errSentinel, err)
 }
+
+func TestExtractImage_DevicesAndXattrs(t *testing.T) {
+	capability := "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+	img := buildTarImage(t, []tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 0755, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": capability,
+		}},
+		{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Name: "dev/loop0", Typeflag: tar.TypeBlock, Mode: 0660, Gid: 6, Devmajor: 7},
+		{Name: "run/initctl", Typeflag: tar.TypeFifo, Mode: 0600},
+	}, map[string][]byte{
+		"bin/ping": []byte("ping"),
+	})
+
+	dest := t.TempDir()
+	meta, err := (&Builder{}).extractImage(img, dest)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"security.capability": capability}, meta["/bin/ping"].xattrs)
+	assert.Equal(t, fileMeta{mode: 0666, typeflag: tar.TypeChar, devmajor: 1, devminor: 3, mtime: time.Unix(0, 0)}, meta["/dev/null"])
+	assert.Equal(t, fileMeta{mode: 0660, gid: 6, typeflag: tar.TypeBlock, devmajor: 7, mtime: time.Unix(0, 0)}, meta["/dev/loop0"])
+	assert.True(t, meta["/run/initctl"].isDevice())
+	for _, p := range []string{"dev/null", "dev/loop0", "run/initctl"} {
+		fi, err := os.Lstat(filepath.Join(dest, p))
+		require.NoError(t, err, p)
+		assert.True(t, fi.Mode().IsRegular(), "%s is a placeholder", p)
+	}
+}
+
+func TestCreateExt4PreservesMetadata(t *testing.T) {
+	for _, tool := range []string{"mke2fs", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	img := buildTarImage(t, []tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 0o4755, Uid: 0, Gid: 0, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00",
+		}},
+		{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Name: "run/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "run/initctl", Typeflag: tar.TypeFifo, Mode: 0600, Uid: 5},
+	}, map[string][]byte{
+		"bin/ping": []byte("ping"),
+	})
+
+	b := &Builder{}
+	src := t.TempDir()
+	meta, err := b.extractImage(img, src)
+	require.NoError(t, err)
+	rootfs := filepath.Join(t.TempDir(), "rootfs.ext4")
+	require.NoError(t, b.createExt4(src, rootfs, meta, nil))
+
+	debugfs := func(request string) string {
+		out, err := exec.Command("debugfs", "-R", request, rootfs).CombinedOutput()
+		require.NoError(t, err, string(out))
+		return string(out)
+	}
+	assert.Contains(t, debugfs("stat /bin/ping"), "Mode:  04755")
+	assert.Contains(t, debugfs("ea_list /bin/ping"), "security.capability (8) = 01 00 00 02 00 20 00 00")
+	null := debugfs("stat /dev/null")
+	assert.Contains(t, null, "Type: character special")
+	assert.Contains(t, null, "Mode:  0666")
+	assert.Contains(t, null, "Device major/minor number: 01:03")
+	initctl := debugfs("stat /run/initctl")
+	assert.Contains(t, initctl, "Type: FIFO")
+	assert.Contains(t, initctl, "User:     5")
+}
+
+func TestCreateExt4Reproducible(t *testing.T) {
+	for _, tool := range []string{"mke2fs", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	built := time.Unix(1700000000, 0)
+	img := buildTarImage(t, []tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: built},
+		{Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0644, ModTime: built},
+		{Name: "etc/issue", Typeflag: tar.TypeLink, Linkname: "etc/os-release", ModTime: built},
+	}, map[string][]byte{
+		"etc/os-release": []byte("ID=test\n"),
+	})
+
+	b := &Builder{}
+	stamp := &rootfsStamp{uuid: "6f1c2a4e-0b57-5d1e-9c3a-2f8e7d6b5a49", epoch: time.Unix(1600000000, 0)}
+	create := func(stamp *rootfsStamp) string {
+		src := t.TempDir()
+		meta, err := b.extractImage(img, src)
+		require.NoError(t, err)
+		rootfs := filepath.Join(t.TempDir(), "rootfs.ext4")
+		require.NoError(t, b.createExt4(src, rootfs, meta, stamp))
+		return rootfs
+	}
+	sum := func(path string) string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+
+	first := create(stamp)
+	assert.Equal(t, sum(first), sum(create(stamp)), "the same image converts to the same bytes")
+	assert.NotEqual(t, sum(create(nil)), sum(create(nil)), "filesystem UUIDs are random by default")
+
+	out, err := exec.Command("debugfs", "-R", "stat /etc/os-release", first).CombinedOutput()
+	require.NoError(t, err, string(out))
+	assert.Contains(t, string(out), "mtime: 0x6553f100", "the layer's mtime is kept")
+}
+
+func TestCreateExt4FitsContents(t *testing.T) {
+	for _, tool := range []string{"mke2fs", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	// Many small files run out of inodes long before blocks.
+	src := t.TempDir()
+	for d := 0; d < 20; d++ {
+		dir := filepath.Join(src, fmt.Sprintf("pkg%02d", d))
+		require.NoError(t, os.Mkdir(dir, 0755))
+		for f := 0; f < 1000; f++ {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("module_%04d.py", f)), []byte("x = 1\n"), 0644))
+		}
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(src, "blob"), bytes.Repeat([]byte("matchlock"), 8<<20), 0644))
+
+	rootfs := filepath.Join(t.TempDir(), "rootfs.ext4")
+	require.NoError(t, (&Builder{}).createExt4(src, rootfs, nil, nil))
+
+	out, err := exec.Command("debugfs", "-R", "ls -l /pkg19", rootfs).CombinedOutput()
+	require.NoError(t, err, string(out))
+	assert.Contains(t, string(out), "module_0999.py", "every file was written")
+	out, err = exec.Command("debugfs", "-R", "stat /blob", rootfs).CombinedOutput()
+	require.NoError(t, err, string(out))
+	assert.Contains(t, string(out), "Size: 75497472")
+
+	fi, err := os.Stat(rootfs)
+	require.NoError(t, err)
+	assert.Less(t, fi.Size(), int64(200<<20), "the image is sized to its contents")
+}
@@ -0,0 +1,58 @@
+package image
+
+import (
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// curatedImage is an image published by matchlock under a short name. It
+// is always pulled by digest, so a compromised or re-pushed tag cannot
+// change what a short name resolves to.
+type curatedImage struct {
+	// Repository is where the image is published.
+	Repository string
+	// Tag is the release the digest was published as.
+	Tag string
+	// Digest is the manifest list digest printed by the publishing
+	// workflow. Empty until a release of this build has been published.
+	Digest string
+	// Source is the Dockerfile context to build the image from locally.
+	Source string
+}
+
+// curatedImages are the images matchlock publishes, by short name. The
+// agent base is built from images/agent-base by
+// .github/workflows/agent-base.yml.
+var curatedImages = map[string]curatedImage{
+	"matchlock/agent-base": {
+		Repository: "ghcr.io/jingkaihe/matchlock/agent-base",
+		Tag:        "1",
+		Source:     "images/agent-base",
+	},
+}
+
+// CuratedImageNames lists the short names of the images matchlock
+// publishes.
+func CuratedImageNames() []string {
+	names := make([]string, 0, len(curatedImages))
+	for name := range curatedImages {
+		names = append(names, name)
+	}
+	return names
+}
+
+// resolveCurated returns the pinned reference a curated short name, with no
+// tag, "latest" or the curated tag, stands for. Any other reference is
+// returned unchanged.
+func resolveCurated(imageRef string) (string, error) {
+	repo, tag, _ := strings.Cut(imageRef, ":")
+	img, ok := curatedImages[repo]
+	if !ok || (tag != "" && tag != "latest" && tag != img.Tag) {
+		return imageRef, nil
+	}
+	if img.Digest == "" {
+		return "", errx.With(ErrCuratedImage, ": %s has not been published for this release; build it with: matchlock build -t %s %s", repo, repo, img.Source)
+	}
+	return img.Repository + ":" + img.Tag + "@" + img.Digest, nil
+}
@@ -0,0 +1,77 @@
+package image
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withCurated(t *testing.T, name string, img curatedImage) {
+	t.Helper()
+	saved := curatedImages
+	curatedImages = map[string]curatedImage{name: img}
+	t.Cleanup(func() { curatedImages = saved })
+}
+
+func TestResolveCurated(t *testing.T) {
+	withCurated(t, "matchlock/agent-base", curatedImage{
+		Repository: "ghcr.io/jingkaihe/matchlock/agent-base",
+		Tag:        "1",
+		Digest:     "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	})
+	pinned := "ghcr.io/jingkaihe/matchlock/agent-base:1@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	for ref, want := range map[string]string{
+		"matchlock/agent-base":        pinned,
+		"matchlock/agent-base:latest": pinned,
+		"matchlock/agent-base:1":      pinned,
+		"matchlock/agent-base:2":      "matchlock/agent-base:2",
+		"alpine:latest":               "alpine:latest",
+	} {
+		got, err := resolveCurated(ref)
+		require.NoError(t, err, ref)
+		assert.Equal(t, want, got, ref)
+	}
+}
+
+func TestResolveCuratedUnpublished(t *testing.T) {
+	withCurated(t, "matchlock/agent-base", curatedImage{
+		Repository: "ghcr.io/jingkaihe/matchlock/agent-base",
+		Tag:        "1",
+		Source:     "images/agent-base",
+	})
+	_, err := resolveCurated("matchlock/agent-base")
+	require.ErrorIs(t, err, ErrCuratedImage)
+	assert.Contains(t, err.Error(), "matchlock build -t matchlock/agent-base images/agent-base")
+}
+
+func TestBuildCuratedImageIsPinned(t *testing.T) {
+	fakeTool(t, "sqfstar", `cat > "$3"`)
+	published := rootfsImage(t, "1")
+	ref := pushImage(t, nil, published)
+	digest, err := published.Digest()
+	require.NoError(t, err)
+	withCurated(t, "matchlock/agent-base", curatedImage{
+		Repository: ref.Context().String(),
+		Tag:        ref.Identifier(),
+		Digest:     digest.String(),
+	})
+
+	// The tag is re-pushed after the digest was pinned.
+	require.NoError(t, remote.Write(ref, rootfsImage(t, "evil")))
+
+	result, err := NewBuilder(&BuildOptions{
+		CacheDir:      t.TempDir(),
+		LayerCacheDir: filepath.Join(t.TempDir(), "layers"),
+		ForcePull:     true,
+		RootfsFormat:  FormatSquashfs,
+	}).Build(context.Background(), "matchlock/agent-base")
+	require.NoError(t, err)
+	assert.Equal(t, digest.String(), result.Digest)
+	_, files := readTar(t, result.RootfsPath)
+	assert.Equal(t, "1", files["etc/release"])
+}
@@ -0,0 +1,155 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// DockerSocketPath returns the unix socket of the local container engine:
+// that of $DOCKER_HOST or $CONTAINER_HOST if set, or else the first of the
+// usual Docker and Podman sockets that exists.
+func DockerSocketPath() (string, error) {
+	for _, env := range []string{"DOCKER_HOST", "CONTAINER_HOST"} {
+		host := os.Getenv(env)
+		if host == "" {
+			continue
+		}
+		path, ok := strings.CutPrefix(host, "unix://")
+		if !ok {
+			return "", errx.With(ErrDockerDaemon, ": $%s=%s is not a unix socket", env, host)
+		}
+		return path, nil
+	}
+
+	home, _ := os.UserHomeDir()
+	candidates := []string{
+		"/var/run/docker.sock",
+		filepath.Join(home, ".docker", "run", "docker.sock"),
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, "docker.sock"), filepath.Join(dir, "podman", "podman.sock"))
+	}
+	candidates = append(candidates, "/run/podman/podman.sock")
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			return c, nil
+		}
+	}
+	return "", errx.With(ErrDockerDaemon, ": no Docker or Podman socket found (set DOCKER_HOST=unix:///path/to/socket)")
+}
+
+// dockerClient talks to the Docker Engine API, which Podman also serves, on
+// a unix socket.
+type dockerClient struct {
+	http *http.Client
+}
+
+func newDockerClient(socket string) *dockerClient {
+	return &dockerClient{http: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}}
+}
+
+func (c *dockerClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "docker", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errx.Wrap(ErrDockerDaemon, err)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, errx.Wrap(ErrDockerDaemon, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var msg struct {
+			Message string `json:"message"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		if json.Unmarshal(body, &msg) == nil && msg.Message != "" {
+			return nil, errx.With(ErrDockerDaemon, ": %s", msg.Message)
+		}
+		return nil, errx.With(ErrDockerDaemon, ": GET %s returned %d", path, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// imageID returns the ID of the named image in the engine.
+func (c *dockerClient) imageID(ctx context.Context, name string) (string, error) {
+	resp, err := c.get(ctx, "/images/"+name+"/json", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var inspect struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return "", errx.With(ErrDockerDaemon, ": decode image %s: %w", name, err)
+	}
+	return inspect.ID, nil
+}
+
+// save streams the named image as a `docker save` tarball.
+func (c *dockerClient) save(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := c.get(ctx, "/images/get", url.Values{"names": {name}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// daemonImage returns the named image of the local Docker or Podman engine.
+func daemonImage(ctx context.Context, name string) (*localImage, error) {
+	socket, err := DockerSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	client := newDockerClient(socket)
+	id, err := client.imageID(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &localImage{
+		id:     id,
+		source: "docker-daemon",
+		open:   func(ctx context.Context) (io.ReadCloser, error) { return client.save(ctx, name) },
+	}, nil
+}
+
+// archiveImage returns the image in a `docker save` tarball.
+func archiveImage(path string) (*localImage, error) {
+	img, err := tarball.ImageFromPath(path, nil)
+	if err != nil {
+		return nil, errx.With(ErrTarball, ": load image: %w", err)
+	}
+	id, err := img.ConfigName()
+	if err != nil {
+		return nil, errx.Wrap(ErrImageDigest, err)
+	}
+	return &localImage{
+		id:     id.String(),
+		source: "docker-archive",
+		open: func(context.Context) (io.ReadCloser, error) {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, errx.With(ErrTarball, ": %w", err)
+			}
+			return f, nil
+		},
+	}, nil
+}
@@ -0,0 +1,123 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDockerEngine serves the image in tarPath as "myapp:dev" on a unix
+// socket and points DOCKER_HOST at it. It returns the number of saves.
+func fakeDockerEngine(t *testing.T, tarPath *string) *atomic.Int32 {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "dock")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	var saves atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images/myapp:dev/json", func(w http.ResponseWriter, r *http.Request) {
+		img, err := tarball.ImageFromPath(*tarPath, nil)
+		require.NoError(t, err)
+		id, err := img.ConfigName()
+		require.NoError(t, err)
+		fmt.Fprintf(w, `{"Id":%q}`, id.String())
+	})
+	mux.HandleFunc("/images/get", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "myapp:dev", r.URL.Query().Get("names"))
+		saves.Add(1)
+		http.ServeFile(w, r, *tarPath)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"No such image: nope:latest"}`)
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	t.Setenv("DOCKER_HOST", "unix://"+socket)
+	return &saves
+}
+
+func TestBuildDockerDaemon(t *testing.T) {
+	tarPath := buildTestTarball(t, map[string]string{"app.txt": "v1"})
+	saves := fakeDockerEngine(t, &tarPath)
+
+	builder := NewBuilder(&BuildOptions{CacheDir: t.TempDir()})
+	builder.store = NewStore(t.TempDir())
+
+	first, err := builder.Build(context.Background(), "docker-daemon:myapp:dev")
+	require.NoError(t, err)
+	assert.FileExists(t, first.RootfsPath)
+	assert.Equal(t, int32(1), saves.Load())
+
+	_, err = builder.Build(context.Background(), "docker-daemon:myapp:dev")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), saves.Load(), "unchanged image is reused")
+
+	tarPath = buildTestTarball(t, map[string]string{"app.txt": "v2"})
+	second, err := builder.Build(context.Background(), "docker-daemon:myapp:dev")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), saves.Load(), "rebuilt image is imported again")
+	assert.NotEqual(t, first.Digest, second.Digest)
+
+	images, err := builder.store.List()
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, "docker-daemon", images[0].Meta.Source)
+}
+
+func TestBuildDockerDaemonUnknownImage(t *testing.T) {
+	tarPath := buildTestTarball(t, map[string]string{"app.txt": "v1"})
+	fakeDockerEngine(t, &tarPath)
+
+	builder := NewBuilder(&BuildOptions{CacheDir: t.TempDir()})
+	builder.store = NewStore(t.TempDir())
+
+	_, err := builder.Build(context.Background(), "docker-daemon:nope:latest")
+	require.ErrorIs(t, err, ErrDockerDaemon)
+	assert.Contains(t, err.Error(), "No such image")
+}
+
+func TestBuildDockerArchive(t *testing.T) {
+	tarPath := buildTestTarball(t, map[string]string{"app.txt": "v1"})
+
+	builder := NewBuilder(&BuildOptions{CacheDir: t.TempDir()})
+	builder.store = NewStore(t.TempDir())
+
+	result, err := builder.Build(context.Background(), "docker-archive:"+tarPath)
+	require.NoError(t, err)
+	assert.FileExists(t, result.RootfsPath)
+
+	images, err := builder.store.List()
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, "docker-archive", images[0].Meta.Source)
+
+	_, err = builder.Build(context.Background(), "docker-archive:"+filepath.Join(t.TempDir(), "missing.tar"))
+	assert.ErrorIs(t, err, ErrTarball)
+}
+
+func TestDockerSocketPath(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "unix:///tmp/custom.sock")
+	p, err := DockerSocketPath()
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp/custom.sock", p)
+
+	t.Setenv("DOCKER_HOST", "tcp://10.0.0.1:2375")
+	_, err = DockerSocketPath()
+	assert.ErrorIs(t, err, ErrDockerDaemon)
+}
@@ -3,17 +3,43 @@ package image
 import "errors"
 
 var (
-	ErrParseReference = errors.New("parse image reference")
-	ErrPullImage      = errors.New("pull image")
-	ErrImageDigest    = errors.New("get image digest")
-	ErrCreateDir      = errors.New("create directory")
-	ErrCreateTemp     = errors.New("create temp")
-	ErrExtract        = errors.New("extract image")
-	ErrCreateExt4     = errors.New("create ext4")
-	ErrToolNotFound   = errors.New("tool not found")
-	ErrTarball        = errors.New("tarball")
-	ErrStoreSave      = errors.New("save to store")
-	ErrStoreRead      = errors.New("read from store")
-	ErrMetadata       = errors.New("metadata")
-	ErrImageNotFound  = errors.New("image not found")
+	ErrParseReference   = errors.New("parse image reference")
+	ErrPullImage        = errors.New("pull image")
+	ErrImageDigest      = errors.New("get image digest")
+	ErrCreateDir        = errors.New("create directory")
+	ErrCreateTemp       = errors.New("create temp")
+	ErrExtract          = errors.New("extract image")
+	ErrCreateExt4       = errors.New("create ext4")
+	ErrCreateImageFS    = errors.New("create compressed filesystem")
+	ErrReadExt4         = errors.New("read ext4")
+	ErrToolNotFound     = errors.New("tool not found")
+	ErrTarball          = errors.New("tarball")
+	ErrStoreSave        = errors.New("save to store")
+	ErrStoreRead        = errors.New("read from store")
+	ErrMetadata         = errors.New("metadata")
+	ErrImageNotFound    = errors.New("image not found")
+	ErrLayerCache       = errors.New("layer cache")
+	ErrPrefetchManifest = errors.New("prefetch manifest")
+	ErrQueueFull        = errors.New("conversion queue is full")
+	ErrConversionBusy   = errors.New("conversion has not finished")
+	ErrService          = errors.New("image service")
+	ErrServiceDenied    = errors.New("image service denied the request")
+	ErrDockerDaemon     = errors.New("docker daemon")
+	ErrLocalImage       = errors.New("read local image")
+	ErrExport           = errors.New("export image")
+	ErrInvalidPlatform  = errors.New("invalid platform")
+	ErrPlatformNotFound = errors.New("platform not found")
+	ErrRootfsFormat     = errors.New("rootfs format")
+	ErrCreateRootfs     = errors.New("create rootfs")
+	ErrImageGC          = errors.New("image garbage collection")
+	ErrInvalidSize      = errors.New("invalid size")
+	ErrSignature        = errors.New("image signature verification failed")
+	ErrNoSignature      = errors.New("no signature")
+	ErrReadSignature    = errors.New("read signatures")
+	ErrNoTrustedKey     = errors.New("no signature by a trusted key")
+	ErrKeylessSignature = errors.New("no keyless signature by a trusted identity")
+	ErrDigestMismatch   = errors.New("image digest mismatch")
+	ErrRegistryConfig   = errors.New("registry config")
+	ErrRegistryAuth     = errors.New("registry auth")
+	ErrCuratedImage     = errors.New("curated image")
 )
@@ -0,0 +1,272 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// ociRefNameAnnotation names an image within an OCI layout.
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// Export writes the stored image tag, such as the result of a Dockerfile
+// build or an import, as an OCI image layout: a directory at dest, or an
+// OCI archive (the layout in a tarball) if dest ends in ".tar". The rootfs
+// becomes a single layer and the stored OCI config the image config. It
+// returns the manifest digest.
+func (b *Builder) Export(ctx context.Context, tag, dest string) (string, error) {
+	result, err := b.store.Get(tag)
+	if err != nil {
+		return "", err
+	}
+
+	workDir, err := os.MkdirTemp("", "matchlock-export-*")
+	if err != nil {
+		return "", errx.Wrap(ErrCreateTemp, err)
+	}
+	defer os.RemoveAll(workDir)
+
+	img, err := imageFromRootfs(ctx, result.RootfsPath, result.OCI, workDir)
+	if err != nil {
+		return "", errx.Wrap(ErrExport, err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", errx.Wrap(ErrImageDigest, err)
+	}
+
+	layoutDir := dest
+	archive := strings.HasSuffix(dest, ".tar")
+	if archive {
+		layoutDir = filepath.Join(workDir, "layout")
+	}
+	p, err := layout.Write(layoutDir, empty.Index)
+	if err != nil {
+		return "", errx.Wrap(ErrExport, err)
+	}
+	if err := p.AppendImage(img, layout.WithAnnotations(map[string]string{ociRefNameAnnotation: tag})); err != nil {
+		return "", errx.Wrap(ErrExport, err)
+	}
+	if archive {
+		if err := tarDir(layoutDir, dest, nil, time.Time{}); err != nil {
+			return "", errx.Wrap(ErrExport, err)
+		}
+	}
+	return digest.String(), nil
+}
+
+// imageFromRootfs builds a single-layer OCI image from an ext4 rootfs,
+// using workDir for scratch space.
+func imageFromRootfs(ctx context.Context, rootfsPath string, oci *OCIConfig, workDir string) (v1.Image, error) {
+	debugfsPath, err := exec.LookPath("debugfs")
+	if err != nil {
+		return nil, errx.With(ErrToolNotFound, ": debugfs; install e2fsprogs")
+	}
+
+	rootDir := filepath.Join(workDir, "rootfs")
+	if err := os.Mkdir(rootDir, 0755); err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, debugfsPath, "-R", "rdump / "+rootDir, rootfsPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, errx.With(ErrReadExt4, ": debugfs rdump: %w: %s", err, out)
+	}
+	// rdump cannot restore ownership without root and drops setuid bits,
+	// so both are read from the inodes.
+	metas, err := ext4FileMetas(ctx, debugfsPath, rootfsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	layerPath := filepath.Join(workDir, "layer.tar")
+	if err := tarDir(rootDir, layerPath, metas, time.Time{}); err != nil {
+		return nil, err
+	}
+	layer, err := tarball.LayerFromFile(layerPath, tarball.WithMediaType(types.OCILayer))
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := mutate.AppendLayers(mutate.MediaType(empty.Image, types.OCIManifestSchema1), layer)
+	if err != nil {
+		return nil, err
+	}
+	img = mutate.ConfigMediaType(img, types.OCIConfigJSON)
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+	cfg.OS = "linux"
+	cfg.Architecture = runtime.GOARCH
+	if oci != nil {
+		cfg.Config.User = oci.User
+		cfg.Config.WorkingDir = oci.WorkingDir
+		cfg.Config.Entrypoint = oci.Entrypoint
+		cfg.Config.Cmd = oci.Cmd
+		cfg.Config.Env = nil
+		for k, v := range oci.Env {
+			cfg.Config.Env = append(cfg.Config.Env, k+"="+v)
+		}
+		sort.Strings(cfg.Config.Env)
+	}
+	return mutate.ConfigFile(img, cfg)
+}
+
+// ext4FileMetas lists the owner and permission bits of every file in an
+// ext4 image, keyed by absolute path, one directory level per debugfs run.
+func ext4FileMetas(ctx context.Context, debugfsPath, rootfsPath string) (map[string]fileMeta, error) {
+	metas := make(map[string]fileMeta)
+	level := []string{"/"}
+	for len(level) > 0 {
+		var script strings.Builder
+		for _, dir := range level {
+			fmt.Fprintf(&script, "ls -p \"%s\"\n", dir)
+		}
+		cmd := exec.CommandContext(ctx, debugfsPath, "-f", "/dev/stdin", rootfsPath)
+		cmd.Stdin = strings.NewReader(script.String())
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, errx.With(ErrReadExt4, ": debugfs ls: %w", err)
+		}
+
+		var next []string
+		dir := ""
+		scanner := bufio.NewScanner(strings.NewReader(string(out)))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if cmdDir, ok := strings.CutPrefix(line, "debugfs: ls -p "); ok {
+				dir = strings.Trim(cmdDir, "\"")
+				continue
+			}
+			// /inode/mode/uid/gid/name/size/
+			parts := strings.Split(line, "/")
+			if len(parts) != 8 || dir == "" {
+				continue
+			}
+			name := parts[5]
+			if name == "." || name == ".." || (dir == "/" && name == "lost+found") {
+				continue
+			}
+			mode, err1 := strconv.ParseUint(parts[2], 8, 32)
+			uid, err2 := strconv.Atoi(parts[3])
+			gid, err3 := strconv.Atoi(parts[4])
+			if err1 != nil || err2 != nil || err3 != nil {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			metas[path] = fileMeta{uid: uid, gid: gid, mode: os.FileMode(mode & 0o7777)}
+			if mode&0o170000 == 0o040000 && !strings.Contains(path, "\"") && !hasDebugfsUnsafeChars(path) {
+				next = append(next, path)
+			}
+		}
+		level = next
+	}
+	return metas, nil
+}
+
+// tarDir writes the tree under dir to a tarball at dest, in lexical order.
+// When metas is not nil, owners, permission bits and mtimes come from it,
+// keyed by absolute path within dir, and lost+found is left out. Entries
+// without a recorded mtime get epoch unless it is zero.
+func tarDir(dir, dest string, metas map[string]fileMeta, epoch time.Time) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(f)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if metas != nil && rel == "lost+found" {
+			return filepath.SkipDir
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.Uid, hdr.Gid = 0, 0
+		if !epoch.IsZero() {
+			hdr.ModTime = epoch
+		}
+		if fm, ok := metas["/"+filepath.ToSlash(rel)]; ok {
+			hdr.Uid, hdr.Gid = fm.uid, fm.gid
+			hdr.Mode = int64(fm.mode)
+			if !fm.mtime.IsZero() {
+				hdr.ModTime = fm.mtime
+			}
+			if fm.isDevice() {
+				hdr.Typeflag, hdr.Size = fm.typeflag, 0
+				hdr.Devmajor, hdr.Devminor = fm.devmajor, fm.devminor
+			}
+			for name, value := range fm.xattrs {
+				if hdr.PAXRecords == nil {
+					hdr.PAXRecords = make(map[string]string)
+				}
+				hdr.PAXRecords[xattrPAXPrefix+name] = value
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		f.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
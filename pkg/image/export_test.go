@@ -0,0 +1,117 @@
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// layerFiles reads the contents and headers of the regular files in the
+// single layer of img.
+func layerFiles(t *testing.T, img v1.Image) map[string]*tar.Header {
+	t.Helper()
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	rc, err := layers[0].Uncompressed()
+	require.NoError(t, err)
+	defer rc.Close()
+
+	files := make(map[string]*tar.Header)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		files[hdr.Name] = hdr
+	}
+	return files
+}
+
+func exportTestImage(t *testing.T) *Builder {
+	t.Helper()
+	tarPath := buildTestTarball(t, map[string]string{
+		"app/main.sh": "echo hi",
+		"etc/motd":    "welcome",
+	})
+	builder := NewBuilder(&BuildOptions{CacheDir: t.TempDir()})
+	builder.store = NewStore(t.TempDir())
+	f, err := os.Open(tarPath)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = builder.Import(context.Background(), f, "myapp:v1")
+	require.NoError(t, err)
+	return builder
+}
+
+func TestExportLayoutDirectory(t *testing.T) {
+	builder := exportTestImage(t)
+	dest := filepath.Join(t.TempDir(), "oci")
+
+	digest, err := builder.Export(context.Background(), "myapp:v1", dest)
+	require.NoError(t, err)
+
+	idx, err := layout.ImageIndexFromPath(dest)
+	require.NoError(t, err)
+	manifest, err := idx.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Manifests, 1)
+	assert.Equal(t, digest, manifest.Manifests[0].Digest.String())
+	assert.Equal(t, "myapp:v1", manifest.Manifests[0].Annotations[ociRefNameAnnotation])
+
+	img, err := idx.Image(manifest.Manifests[0].Digest)
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	assert.Equal(t, "linux", cfg.OS)
+
+	files := layerFiles(t, img)
+	require.Contains(t, files, "app/main.sh")
+	require.Contains(t, files, "etc/motd")
+	assert.Contains(t, files, "app/")
+	assert.NotContains(t, files, "lost+found/")
+	assert.Equal(t, int64(7), files["app/main.sh"].Size)
+	assert.Equal(t, int64(0o644), files["etc/motd"].Mode)
+}
+
+func TestExportArchive(t *testing.T) {
+	builder := exportTestImage(t)
+	dest := filepath.Join(t.TempDir(), "myapp.tar")
+
+	_, err := builder.Export(context.Background(), "myapp:v1", dest)
+	require.NoError(t, err)
+
+	f, err := os.Open(dest)
+	require.NoError(t, err)
+	defer f.Close()
+	names := map[string]bool{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names[hdr.Name] = true
+	}
+	assert.True(t, names["oci-layout"])
+	assert.True(t, names["index.json"])
+}
+
+func TestExportUnknownTag(t *testing.T) {
+	builder := NewBuilder(&BuildOptions{CacheDir: t.TempDir()})
+	builder.store = NewStore(t.TempDir())
+
+	_, err := builder.Export(context.Background(), "nope:latest", t.TempDir())
+	assert.ErrorIs(t, err, ErrImageNotFound)
+}
@@ -0,0 +1,175 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// DefaultLayerConcurrency is the number of layers of one image downloaded at
+// once when BuildOptions does not say otherwise.
+const DefaultLayerConcurrency = 4
+
+// estargzMetadata are the entries eStargz adds to the root of a layer for
+// lazy-pulling snapshotters. They are not part of the image's filesystem.
+var estargzMetadata = map[string]bool{
+	"stargz.index.json":     true,
+	".prefetch.landmark":    true,
+	".no.prefetch.landmark": true,
+}
+
+// fetchedImage is an image whose layers are downloaded in the background.
+// Reading a layer waits only for that layer, so extraction of the lower
+// layers overlaps with the download of the ones above.
+type fetchedImage struct {
+	v1.Image
+	layers []v1.Layer
+}
+
+func (i *fetchedImage) Layers() ([]v1.Layer, error) {
+	return i.layers, nil
+}
+
+// fetchedLayer is a compressed layer being downloaded to path. Layers already
+// in the layer cache are read from there instead.
+type fetchedLayer struct {
+	v1.Layer
+	path  string
+	ready chan struct{}
+	err   error
+}
+
+func (l *fetchedLayer) Compressed() (io.ReadCloser, error) {
+	<-l.ready
+	if l.err != nil {
+		return nil, l.err
+	}
+	return os.Open(l.path)
+}
+
+// fetchLayers starts downloading the layers of img into dir, at most
+// concurrency at a time. Layers are scheduled bottom first, the order in
+// which extraction applies them. gzip, zstd, eStargz and zstd:chunked layers
+// are all read as plain compressed tarballs. Layers below from are already
+// applied from a snapshot, so they are not downloaded; reading them only
+// finds them in the layer cache. The returned function cancels outstanding
+// downloads and waits for them; call it before removing dir.
+func (b *Builder) fetchLayers(ctx context.Context, img v1.Image, dir string, concurrency, from int) (v1.Image, func(), error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, nil, errx.Wrap(ErrPullImage, err)
+	}
+	if concurrency <= 0 {
+		concurrency = DefaultLayerConcurrency
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	fetched := make([]*fetchedLayer, len(layers))
+	wrapped := make([]v1.Layer, len(layers))
+	jobs := make(chan *fetchedLayer, len(layers))
+	for i, layer := range layers {
+		fl := &fetchedLayer{Layer: layer, ready: make(chan struct{})}
+		fetched[i] = fl
+		if wrapped[i], err = partial.CompressedToLayer(fl); err != nil {
+			cancel()
+			return nil, nil, errx.Wrap(ErrPullImage, err)
+		}
+	}
+	for i, fl := range fetched {
+		if i < from {
+			fl.path, fl.err = b.cachedLayer(fl.Layer)
+			close(fl.ready)
+			continue
+		}
+		jobs <- fl
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(fetched)-from; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fl := range jobs {
+				fl.path, fl.err = b.fetchLayer(ctx, fl.Layer, dir)
+				close(fl.ready)
+			}
+		}()
+	}
+	stop := func() {
+		cancel()
+		wg.Wait()
+	}
+	return &fetchedImage{Image: img, layers: wrapped}, stop, nil
+}
+
+// fetchLayer returns the path of the compressed layer, downloading and
+// verifying it unless the layer cache already has it.
+func (b *Builder) fetchLayer(ctx context.Context, layer v1.Layer, dir string) (string, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return "", errx.Wrap(ErrPullImage, err)
+	}
+	if path, ok := b.layers.blob(digest); ok {
+		return path, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return "", errx.With(ErrPullImage, ": layer %s: %w", digest, err)
+	}
+	defer rc.Close()
+
+	path := filepath.Join(dir, digest.Hex)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", errx.Wrap(ErrCreateTemp, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), ctxReader{ctx, rc}); err != nil {
+		return "", errx.With(ErrPullImage, ": layer %s: %w", digest, err)
+	}
+	if digest.Algorithm == "sha256" && hex.EncodeToString(h.Sum(nil)) != digest.Hex {
+		return "", errx.With(ErrPullImage, ": layer %s: digest mismatch", digest)
+	}
+	return path, f.Close()
+}
+
+// cachedLayer returns the path of the compressed layer in the layer cache.
+func (b *Builder) cachedLayer(layer v1.Layer) (string, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return "", errx.Wrap(ErrPullImage, err)
+	}
+	if path, ok := b.layers.blob(digest); ok {
+		return path, nil
+	}
+	return "", errx.With(ErrPullImage, ": layer %s was not fetched", digest)
+}
+
+// ctxReader stops a download once its context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
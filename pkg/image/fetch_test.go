@@ -0,0 +1,121 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/compression"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tarLayer(t *testing.T, files map[string]string, opts ...tarball.LayerOption) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	data := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, opts...)
+	require.NoError(t, err)
+	return layer
+}
+
+func TestFetchLayersExtractsInOrder(t *testing.T) {
+	img, err := mutate.AppendLayers(empty.Image,
+		tarLayer(t, map[string]string{"etc/os-release": "base", "bin/sh": "shell"}),
+		tarLayer(t, map[string]string{"etc/os-release": "zstd"}, tarball.WithCompression(compression.ZStd)),
+		tarLayer(t, map[string]string{"app/main.py": "print()", "stargz.index.json": "{}", ".prefetch.landmark": "x"}),
+	)
+	require.NoError(t, err)
+	ref := pushImage(t, nil, img)
+	remoteImg, err := remote.Image(ref)
+	require.NoError(t, err)
+
+	b := NewBuilder(&BuildOptions{CacheDir: t.TempDir(), LayerCacheDir: filepath.Join(t.TempDir(), "layers"), LayerConcurrency: 2})
+	fetched, stop, err := b.fetchLayers(context.Background(), remoteImg, t.TempDir(), 2, 0)
+	require.NoError(t, err)
+	defer stop()
+
+	dest := t.TempDir()
+	metas, err := b.extractImage(fetched, dest)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(dest, "etc/os-release"))
+	require.NoError(t, err)
+	assert.Equal(t, "zstd", string(content), "upper layer wins")
+	assert.FileExists(t, filepath.Join(dest, "bin/sh"))
+	assert.FileExists(t, filepath.Join(dest, "app/main.py"))
+	assert.NoFileExists(t, filepath.Join(dest, "stargz.index.json"))
+	assert.NoFileExists(t, filepath.Join(dest, ".prefetch.landmark"))
+	assert.NotContains(t, metas, "/stargz.index.json")
+
+	require.NoError(t, b.layers.Add(ref.String(), fetched))
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	for _, l := range layers {
+		d, err := l.Digest()
+		require.NoError(t, err)
+		_, ok := b.layers.blob(d)
+		assert.True(t, ok, "layer %s cached", d)
+	}
+}
+
+func TestFetchLayersReusesLayerCache(t *testing.T) {
+	layer := tarLayer(t, map[string]string{"hello": "world"})
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	require.NoError(t, err)
+
+	b := NewBuilder(&BuildOptions{CacheDir: t.TempDir(), LayerCacheDir: filepath.Join(t.TempDir(), "layers")})
+	require.NoError(t, b.layers.Add("example.com/hello:latest", img))
+
+	fetched, stop, err := b.fetchLayers(context.Background(), img, t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	defer stop()
+
+	layers, err := fetched.Layers()
+	require.NoError(t, err)
+	rc, err := layers[0].Compressed()
+	require.NoError(t, err)
+	f, ok := rc.(*os.File)
+	require.True(t, ok)
+	d, err := layer.Digest()
+	require.NoError(t, err)
+	cached, _ := b.layers.blob(d)
+	assert.Equal(t, cached, f.Name())
+	rc.Close()
+}
+
+func TestFetchLayersCancelled(t *testing.T) {
+	img, err := mutate.AppendLayers(empty.Image, tarLayer(t, map[string]string{"a": "b"}))
+	require.NoError(t, err)
+	ref := pushImage(t, nil, img)
+	remoteImg, err := remote.Image(ref)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := NewBuilder(&BuildOptions{CacheDir: t.TempDir(), LayerCacheDir: filepath.Join(t.TempDir(), "layers")})
+	fetched, stop, err := b.fetchLayers(ctx, remoteImg, t.TempDir(), 1, 0)
+	require.NoError(t, err)
+	defer stop()
+
+	_, err = b.extractImage(fetched, t.TempDir())
+	assert.ErrorIs(t, err, context.Canceled)
+}
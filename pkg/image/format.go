@@ -0,0 +1,265 @@
+package image
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/uuid"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// RootfsFormat is the filesystem of a built rootfs image.
+type RootfsFormat string
+
+const (
+	// FormatExt4 images are copied per sandbox and written in place.
+	FormatExt4 RootfsFormat = "ext4"
+	// FormatErofs and FormatSquashfs images are compressed and read-only.
+	// Sandboxes share them and write to an overlay upper disk instead.
+	FormatErofs    RootfsFormat = "erofs"
+	FormatSquashfs RootfsFormat = "squashfs"
+)
+
+// Magic numbers identifying rootfs formats.
+const (
+	ext4Magic     = 0xEF53     // le16 at 1024+56
+	erofsMagic    = 0xE0F5E1E2 // le32 at 1024
+	squashfsMagic = "hsqs"     // at 0
+)
+
+// upperDiskParam is the kernel cmdline parameter naming the overlay upper
+// disk of a read-only rootfs, e.g. matchlock.upper=/dev/vdb; see
+// vm.KernelDiskParams.
+const upperDiskParam = "matchlock.upper"
+
+// OverlayDir is where a read-only rootfs image keeps the mount points its
+// stage-0 init uses: OverlayDir/upper for the upper disk and
+// OverlayDir/root for the merged root. The upper disk holds the guest's
+// changes in /root and overlayfs state in /work.
+const OverlayDir = "/.matchlock"
+
+// overlayInit is baked into read-only images as /init. It overlays the
+// upper disk on the image and hands over to the matchlock init on the upper
+// disk, which shadows this script in the merged root.
+const overlayInit = `#!/bin/sh
+# Matchlock stage-0 init for read-only rootfs images - runs as PID 1
+export PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
+
+mount -t proc proc /proc
+mount -t devtmpfs dev /dev 2>/dev/null || true
+
+UPPER=
+for param in $(cat /proc/cmdline); do
+    case "$param" in
+        ` + upperDiskParam + `=*) UPPER="${param#*=}" ;;
+    esac
+done
+if [ -z "$UPPER" ]; then
+    echo "FATAL: ` + upperDiskParam + `= not found in kernel cmdline" >&2
+    exit 1
+fi
+
+mount -t ext4 "$UPPER" ` + OverlayDir + `/upper || exit 1
+mount -t overlay overlay -o lowerdir=/,upperdir=` + OverlayDir + `/upper/root,workdir=` + OverlayDir + `/upper/work ` + OverlayDir + `/root || exit 1
+
+umount /dev 2>/dev/null
+umount /proc
+exec chroot ` + OverlayDir + `/root /init
+`
+
+// ParseRootfsFormat parses a --rootfs-format value. An empty string yields
+// FormatExt4.
+func ParseRootfsFormat(s string) (RootfsFormat, error) {
+	switch f := RootfsFormat(strings.ToLower(s)); f {
+	case "":
+		return FormatExt4, nil
+	case FormatExt4, FormatErofs, FormatSquashfs:
+		return f, nil
+	default:
+		return "", errx.With(ErrRootfsFormat, ": %q (use ext4, erofs or squashfs)", s)
+	}
+}
+
+// ReadOnly reports whether images of the format are booted read-only with
+// an overlay upper disk.
+func (f RootfsFormat) ReadOnly() bool {
+	return f == FormatErofs || f == FormatSquashfs
+}
+
+// DetectRootfsFormat identifies the format of the rootfs image at path from
+// its superblock.
+func DetectRootfsFormat(path string) (RootfsFormat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errx.Wrap(ErrRootfsFormat, err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1024+64)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return "", errx.With(ErrRootfsFormat, ": %s: %w", path, err)
+	}
+	switch {
+	case string(buf[:4]) == squashfsMagic:
+		return FormatSquashfs, nil
+	case binary.LittleEndian.Uint32(buf[1024:]) == erofsMagic:
+		return FormatErofs, nil
+	case binary.LittleEndian.Uint16(buf[1024+56:]) == ext4Magic:
+		return FormatExt4, nil
+	}
+	return "", errx.With(ErrRootfsFormat, ": %s is not an ext4, erofs or squashfs image", path)
+}
+
+// isRootfsFile reports whether name is a cached rootfs image of any format.
+func isRootfsFile(name string) bool {
+	switch strings.TrimPrefix(filepath.Ext(name), ".") {
+	case string(FormatExt4), string(FormatErofs), string(FormatSquashfs):
+		return true
+	}
+	return false
+}
+
+// rootfsStamp pins what would otherwise differ between two conversions of
+// the same image, so that reproducible builds produce identical files.
+type rootfsStamp struct {
+	// uuid is the filesystem UUID, and the directory hash seed of ext4.
+	uuid string
+	// epoch is when the filesystem claims to be created, and the mtime of
+	// entries the image records none for, such as those matchlock adds.
+	epoch time.Time
+}
+
+// rootfsStamp returns the stamp for converting img, or nil unless builds
+// are reproducible. The epoch is SOURCE_DATE_EPOCH when set, and otherwise
+// when the image was created.
+func (b *Builder) rootfsStamp(img v1.Image, digest v1.Hash) *rootfsStamp {
+	if !b.reproducible {
+		return nil
+	}
+	var epoch time.Time
+	if s, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
+		if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+			epoch = time.Unix(sec, 0)
+		}
+	} else if cfg, err := img.ConfigFile(); err == nil {
+		epoch = cfg.Created.Time
+	}
+	// e2fsprogs takes a fake time of zero to mean the current time.
+	if epoch.Unix() < 1 {
+		epoch = time.Unix(1, 0)
+	}
+	return &rootfsStamp{
+		uuid:  uuid.NewSHA1(uuid.NameSpaceURL, []byte(digest.String())).String(),
+		epoch: epoch.UTC(),
+	}
+}
+
+// mke2fsArgs returns the mke2fs options that pin the UUID and hash seed.
+func (s *rootfsStamp) mke2fsArgs() []string {
+	if s == nil {
+		return nil
+	}
+	return []string{"-U", s.uuid, "-E", "hash_seed=" + s.uuid}
+}
+
+// e2fsEnv returns the environment under which e2fsprogs stamps the epoch
+// rather than the current time, or nil to inherit the current one.
+func (s *rootfsStamp) e2fsEnv() []string {
+	if s == nil {
+		return nil
+	}
+	return append(os.Environ(), "E2FSPROGS_FAKE_TIME="+strconv.FormatInt(s.epoch.Unix(), 10))
+}
+
+// createRootfs builds a rootfs image of the builder's format from sourceDir.
+func (b *Builder) createRootfs(ctx context.Context, sourceDir, destPath string, meta map[string]fileMeta, stamp *rootfsStamp) error {
+	if !b.format.ReadOnly() {
+		return b.createExt4(sourceDir, destPath, meta, stamp)
+	}
+	return createReadOnlyRootfs(ctx, b.format, sourceDir, destPath, meta, stamp)
+}
+
+// createReadOnlyRootfs builds a compressed erofs or squashfs image. The tree
+// goes through a tarball so owners come from meta rather than the
+// unprivileged extraction, and gains the stage-0 init and the mount points
+// it and the matchlock init need, since the image cannot be changed later.
+func createReadOnlyRootfs(ctx context.Context, format RootfsFormat, sourceDir, destPath string, meta map[string]fileMeta, stamp *rootfsStamp) error {
+	var tool string
+	var args []string
+	var epoch time.Time
+	switch format {
+	case FormatErofs:
+		tool, args = "mkfs.erofs", []string{"-zlz4hc", "--tar=f"}
+		if stamp != nil {
+			// -T alone would also replace the mtime of every file.
+			args = append(args, "-U", stamp.uuid, "--mkfs-time", "-T", strconv.FormatInt(stamp.epoch.Unix(), 10))
+		}
+	case FormatSquashfs:
+		tool, args = "sqfstar", []string{"-quiet", "-no-progress"}
+		if stamp != nil {
+			args = append(args, "-mkfs-time", strconv.FormatInt(stamp.epoch.Unix(), 10))
+		}
+	}
+	args = append(args, destPath)
+	if stamp != nil {
+		epoch = stamp.epoch
+	}
+	toolPath, err := exec.LookPath(tool)
+	if err != nil {
+		pkg := map[RootfsFormat]string{FormatErofs: "erofs-utils", FormatSquashfs: "squashfs-tools 4.6+"}[format]
+		return errx.With(ErrToolNotFound, ": %s; install %s", tool, pkg)
+	}
+
+	for _, dir := range []string{OverlayDir, OverlayDir + "/upper", OverlayDir + "/root", "/proc", "/sys", "/dev", "/run", "/tmp", "/workspace", "/opt", "/opt/matchlock"} {
+		if err := ensureRealDir(sourceDir, filepath.Join(sourceDir, dir)); err != nil {
+			return err
+		}
+		if _, ok := meta[dir]; !ok {
+			meta[dir] = fileMeta{mode: 0755}
+		}
+	}
+	initPath := filepath.Join(sourceDir, "init")
+	os.RemoveAll(initPath)
+	if err := os.WriteFile(initPath, []byte(overlayInit), 0755); err != nil {
+		return err
+	}
+	meta["/init"] = fileMeta{mode: 0755}
+
+	tarFile, err := os.CreateTemp("", "matchlock-rootfs-*.tar")
+	if err != nil {
+		return errx.Wrap(ErrCreateTemp, err)
+	}
+	tarFile.Close()
+	defer os.Remove(tarFile.Name())
+	if err := tarDir(sourceDir, tarFile.Name(), meta, epoch); err != nil {
+		return err
+	}
+
+	os.Remove(destPath)
+	var cmd *exec.Cmd
+	if format == FormatErofs {
+		cmd = exec.CommandContext(ctx, toolPath, append(args, tarFile.Name())...)
+	} else {
+		cmd = exec.CommandContext(ctx, toolPath, args...)
+		in, err := os.Open(tarFile.Name())
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		cmd.Stdin = in
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(destPath)
+		return errx.With(ErrCreateImageFS, ": %s: %w: %s", tool, err, out)
+	}
+	return nil
+}
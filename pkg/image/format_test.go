@@ -0,0 +1,232 @@
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRootfsFormat(t *testing.T) {
+	for in, want := range map[string]RootfsFormat{
+		"":         FormatExt4,
+		"ext4":     FormatExt4,
+		"EROFS":    FormatErofs,
+		"squashfs": FormatSquashfs,
+	} {
+		got, err := ParseRootfsFormat(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	_, err := ParseRootfsFormat("btrfs")
+	require.ErrorIs(t, err, ErrRootfsFormat)
+	assert.False(t, FormatExt4.ReadOnly())
+	assert.True(t, FormatErofs.ReadOnly())
+	assert.True(t, FormatSquashfs.ReadOnly())
+}
+
+func TestDetectRootfsFormat(t *testing.T) {
+	write := func(t *testing.T, patch func([]byte)) string {
+		buf := make([]byte, 4096)
+		patch(buf)
+		path := filepath.Join(t.TempDir(), "rootfs")
+		require.NoError(t, os.WriteFile(path, buf, 0644))
+		return path
+	}
+
+	tests := map[RootfsFormat]func([]byte){
+		FormatExt4:     func(b []byte) { binary.LittleEndian.PutUint16(b[1024+56:], ext4Magic) },
+		FormatErofs:    func(b []byte) { binary.LittleEndian.PutUint32(b[1024:], erofsMagic) },
+		FormatSquashfs: func(b []byte) { copy(b, squashfsMagic) },
+	}
+	for want, patch := range tests {
+		got, err := DetectRootfsFormat(write(t, patch))
+		require.NoError(t, err, want)
+		assert.Equal(t, want, got)
+	}
+
+	_, err := DetectRootfsFormat(write(t, func([]byte) {}))
+	require.ErrorIs(t, err, ErrRootfsFormat)
+	_, err = DetectRootfsFormat(filepath.Join(t.TempDir(), "missing"))
+	require.ErrorIs(t, err, ErrRootfsFormat)
+}
+
+func TestDetectRootfsFormatExt4(t *testing.T) {
+	if _, err := exec.LookPath("mke2fs"); err != nil {
+		t.Skip("mke2fs not available")
+	}
+	path := filepath.Join(t.TempDir(), "rootfs.ext4")
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	require.NoError(t, os.Truncate(path, 8<<20))
+	require.NoError(t, exec.Command("mke2fs", "-t", "ext4", "-F", "-q", path).Run())
+
+	got, err := DetectRootfsFormat(path)
+	require.NoError(t, err)
+	assert.Equal(t, FormatExt4, got)
+}
+
+// readTar returns the headers and regular file contents of a tarball.
+func readTar(t *testing.T, path string) (map[string]*tar.Header, map[string]string) {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	hdrs := map[string]*tar.Header{}
+	files := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		hdrs[hdr.Name] = hdr
+		if hdr.Typeflag == tar.TypeReg {
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			files[hdr.Name] = string(data)
+		}
+	}
+	return hdrs, files
+}
+
+func TestCreateReadOnlyRootfs(t *testing.T) {
+	tools := map[RootfsFormat]struct{ tool, script string }{
+		// The fake tools emit the tarball they are given, so the test can
+		// check what would have gone into the image.
+		FormatErofs:    {"mkfs.erofs", `[ "$2" = "--tar=f" ] || exit 1; cp "$4" "$3"`},
+		FormatSquashfs: {"sqfstar", `cat > "$3"`},
+	}
+	for format, tc := range tools {
+		t.Run(string(format), func(t *testing.T) {
+			fakeTool(t, tc.tool, tc.script)
+
+			src := t.TempDir()
+			require.NoError(t, os.MkdirAll(filepath.Join(src, "etc"), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(src, "etc/passwd"), []byte("root:x:0:0::/root:/bin/sh\n"), 0644))
+			require.NoError(t, os.WriteFile(filepath.Join(src, "init"), []byte("old"), 0755))
+			require.NoError(t, os.MkdirAll(filepath.Join(src, "bin"), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(src, "bin/ping"), []byte("ping"), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(src, "null"), nil, 0600))
+			meta := map[string]fileMeta{
+				"/etc/passwd": {uid: 0, gid: 42, mode: 0640},
+				"/bin/ping":   {mode: 0755, xattrs: map[string]string{"security.capability": "\x01\x00\x00\x02"}},
+				"/null":       {mode: 0666, typeflag: tar.TypeChar, devmajor: 1, devminor: 3},
+			}
+
+			dest := filepath.Join(t.TempDir(), "rootfs."+string(format))
+			require.NoError(t, createReadOnlyRootfs(context.Background(), format, src, dest, meta, nil))
+
+			hdrs, files := readTar(t, dest)
+			assert.Equal(t, overlayInit, files["init"])
+			assert.Equal(t, int64(0755), hdrs["init"].Mode)
+			assert.Equal(t, 42, hdrs["etc/passwd"].Gid)
+			assert.Equal(t, int64(0640), hdrs["etc/passwd"].Mode)
+			assert.Equal(t, "\x01\x00\x00\x02", hdrs["bin/ping"].PAXRecords["SCHILY.xattr.security.capability"])
+			assert.Equal(t, "ping", files["bin/ping"])
+			assert.Equal(t, byte(tar.TypeChar), hdrs["null"].Typeflag)
+			assert.Equal(t, [2]int64{1, 3}, [2]int64{hdrs["null"].Devmajor, hdrs["null"].Devminor})
+			for _, dir := range []string{".matchlock/upper/", ".matchlock/root/", "proc/", "dev/", "opt/matchlock/"} {
+				require.Contains(t, hdrs, dir)
+				assert.Equal(t, byte(tar.TypeDir), hdrs[dir].Typeflag, dir)
+			}
+		})
+	}
+}
+
+func TestCreateReadOnlyRootfsReproducible(t *testing.T) {
+	fakeTool(t, "sqfstar", `eval "dest=\${$#}"; echo "$@" > "$dest.args"; cat > "$dest"`)
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "etc/passwd"), []byte("root:x:0:0::/root:/bin/sh\n"), 0644))
+	built := time.Unix(1700000000, 0)
+	meta := map[string]fileMeta{
+		"/etc":        {mode: 0755, mtime: built},
+		"/etc/passwd": {mode: 0644, mtime: built},
+	}
+
+	dest := filepath.Join(t.TempDir(), "rootfs.squashfs")
+	stamp := &rootfsStamp{uuid: "6f1c2a4e-0b57-5d1e-9c3a-2f8e7d6b5a49", epoch: time.Unix(1600000000, 0)}
+	require.NoError(t, createReadOnlyRootfs(context.Background(), FormatSquashfs, src, dest, meta, stamp))
+
+	args, err := os.ReadFile(dest + ".args")
+	require.NoError(t, err)
+	assert.Contains(t, string(args), "-mkfs-time 1600000000")
+	hdrs, _ := readTar(t, dest)
+	assert.Equal(t, built.Unix(), hdrs["etc/passwd"].ModTime.Unix(), "the layer's mtime is kept")
+	for _, name := range []string{"init", "proc/", ".matchlock/upper/"} {
+		assert.Equal(t, stamp.epoch.Unix(), hdrs[name].ModTime.Unix(), "%s is added at the epoch", name)
+	}
+}
+
+func TestRootfsStamp(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cfg, err := empty.Image.ConfigFile()
+	require.NoError(t, err)
+	cfg.Created = v1.Time{Time: created}
+	img, err := mutate.ConfigFile(empty.Image, cfg)
+	require.NoError(t, err)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	assert.Nil(t, (&Builder{}).rootfsStamp(img, digest), "builds are not reproducible by default")
+
+	b := &Builder{reproducible: true}
+	stamp := b.rootfsStamp(img, digest)
+	require.NotNil(t, stamp)
+	assert.True(t, created.Equal(stamp.epoch), "the image's creation time")
+	assert.Equal(t, stamp.uuid, b.rootfsStamp(img, digest).uuid)
+	other, err := rootfsImage(t, "v2").Digest()
+	require.NoError(t, err)
+	assert.NotEqual(t, stamp.uuid, b.rootfsStamp(img, other).uuid)
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+	assert.Equal(t, int64(1600000000), b.rootfsStamp(img, digest).epoch.Unix())
+	t.Setenv("SOURCE_DATE_EPOCH", "0")
+	assert.Equal(t, int64(1), b.rootfsStamp(img, digest).epoch.Unix(), "e2fsprogs cannot fake the Unix epoch itself")
+}
+
+func TestCreateReadOnlyRootfsToolMissing(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	err := createReadOnlyRootfs(context.Background(), FormatErofs, t.TempDir(), filepath.Join(t.TempDir(), "rootfs.erofs"), map[string]fileMeta{}, nil)
+	require.ErrorIs(t, err, ErrToolNotFound)
+	assert.Contains(t, err.Error(), "erofs-utils")
+}
+
+func TestCreateReadOnlyRootfsToolFails(t *testing.T) {
+	fakeTool(t, "sqfstar", `cat > "$3"; echo "no space left" >&2; exit 1`)
+	dest := filepath.Join(t.TempDir(), "rootfs.squashfs")
+	err := createReadOnlyRootfs(context.Background(), FormatSquashfs, t.TempDir(), dest, map[string]fileMeta{}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no space left")
+	assert.NoFileExists(t, dest)
+}
+
+func TestListRegistryCacheReadOnlyFormat(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	imgDir := filepath.Join(cacheDir, "alpine_latest@linux_amd64")
+	os.MkdirAll(imgDir, 0755)
+	os.WriteFile(filepath.Join(imgDir, "abc123def456.erofs"), []byte("rootfs"), 0644)
+	old := time.Now().Add(-2 * gcGracePeriod)
+	require.NoError(t, os.Chtimes(filepath.Join(imgDir, "abc123def456.erofs"), old, old))
+
+	images, err := ListRegistryCache(cacheDir)
+	require.NoError(t, err, "ListRegistryCache")
+	require.Len(t, images, 1)
+	assert.Equal(t, "abc123def456", images[0].Meta.Digest)
+	assert.Equal(t, filepath.Join(imgDir, "abc123def456.erofs"), images[0].RootfsPath)
+}
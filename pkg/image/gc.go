@@ -0,0 +1,203 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// lastUsedFile was touched in a registry cache entry whenever a build was
+// served from it, before the index recorded when images were last used.
+// Its mtime carries over when the index is built.
+const lastUsedFile = "last-used"
+
+// gcGracePeriod protects entries the index does not know yet, which are
+// added once a conversion finishes, from a collection running alongside
+// the pull that is still writing them.
+const gcGracePeriod = 10 * time.Minute
+
+// GCPolicy bounds the registry image cache. Zero fields are not enforced.
+type GCPolicy struct {
+	// MaxSize is the total size in bytes the cache may keep. Least recently
+	// used images are evicted until it fits.
+	MaxSize int64
+	// MaxAge evicts images that have not been used for longer than this.
+	MaxAge time.Duration
+	// Until evicts images created before this time.
+	Until time.Time
+}
+
+// IsZero reports whether the policy enforces nothing.
+func (p GCPolicy) IsZero() bool {
+	return p.MaxSize <= 0 && p.MaxAge <= 0 && p.Until.IsZero()
+}
+
+// CacheEntry is one image in the registry cache, for every rootfs format it
+// was converted to.
+type CacheEntry struct {
+	ImageInfo
+	Dir      string
+	LastUsed time.Time
+}
+
+// GarbageCollect evicts images from the registry cache under cacheDir that
+// violate policy, least recently used first, and returns them. An empty
+// policy evicts every image. Images referenced by inUse, such as those of
+// existing sandboxes, are never evicted but count towards MaxSize. Locally
+// built and imported images cannot be pulled again and are left alone.
+func GarbageCollect(cacheDir string, policy GCPolicy, inUse []string) ([]CacheEntry, error) {
+	entries, err := ListCacheEntries(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	var candidates []CacheEntry
+	for _, e := range entries {
+		total += e.Meta.Size
+		if !e.usedBy(inUse) {
+			candidates = append(candidates, e)
+		}
+	}
+
+	now := time.Now()
+	var evicted []CacheEntry
+	err = registryIndex(cacheDir).update(func(state *indexState) error {
+		for _, e := range candidates {
+			expired := policy.IsZero() ||
+				(policy.MaxAge > 0 && now.Sub(e.LastUsed) > policy.MaxAge) ||
+				(!policy.Until.IsZero() && e.Meta.CreatedAt.Before(policy.Until)) ||
+				(policy.MaxSize > 0 && total > policy.MaxSize)
+			if !expired {
+				continue
+			}
+			if err := os.RemoveAll(e.Dir); err != nil {
+				return errx.With(ErrImageGC, ": remove %s: %w", e.Tag, err)
+			}
+			delete(state.Images, filepath.Base(e.Dir))
+			total -= e.Meta.Size
+			evicted = append(evicted, e)
+		}
+		return removeUnindexed(cacheDir, state)
+	})
+	if err != nil {
+		return evicted, err
+	}
+	if err := pruneSnapshots(cacheDir); err != nil {
+		return evicted, err
+	}
+	return evicted, nil
+}
+
+// removeUnindexed removes the registry cache entries under cacheDir that
+// the index does not know, left by conversions that were interrupted
+// between writing the rootfs and recording it.
+func removeUnindexed(cacheDir string, state *indexState) error {
+	dirs, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || d.Name() == "local" || d.Name() == snapshotsDir || state.Images[d.Name()] != nil {
+			continue
+		}
+		dir := filepath.Join(cacheDir, d.Name())
+		if e := scanCacheEntry(dir); e == nil || time.Since(e.Meta.CreatedAt) < gcGracePeriod {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return errx.With(ErrImageGC, ": remove %s: %w", d.Name(), err)
+		}
+	}
+	return nil
+}
+
+// ListCacheEntries lists the images in the registry cache under cacheDir,
+// least recently used first. Conversions still being written are skipped.
+func ListCacheEntries(cacheDir string) ([]CacheEntry, error) {
+	if cacheDir == "" {
+		home, _ := os.UserHomeDir()
+		cacheDir = filepath.Join(home, ".cache", "matchlock", "images")
+	}
+
+	state, err := registryIndex(cacheDir).load()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]CacheEntry, 0, len(state.Images))
+	for key, e := range state.Images {
+		dir := filepath.Join(cacheDir, key)
+		entries = append(entries, CacheEntry{
+			ImageInfo: ImageInfo{Tag: e.Meta.Tag, RootfsPath: e.rootfsPath(dir), Meta: e.Meta},
+			Dir:       dir,
+			LastUsed:  e.LastUsed,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].LastUsed.Equal(entries[j].LastUsed) {
+			return entries[i].LastUsed.Before(entries[j].LastUsed)
+		}
+		return entries[i].Dir < entries[j].Dir
+	})
+	return entries, nil
+}
+
+// usedBy reports whether any of refs names the entry's image.
+func (e CacheEntry) usedBy(refs []string) bool {
+	base := filepath.Base(e.Dir)
+	tag := cacheRefKey(e.Tag)
+	for _, ref := range refs {
+		if ref == "" {
+			continue
+		}
+		name := sanitizeRef(ref)
+		if base == name || strings.HasPrefix(base, name+"@") || cacheRefKey(ref) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheRefKey normalises ref so that e.g. alpine and
+// docker.io/library/alpine:latest compare equal.
+func cacheRefKey(ref string) string {
+	if key, err := normalizeRef(ref); err == nil {
+		return key
+	}
+	return ref
+}
+
+// ParseSize parses a size such as 512M, 20GB or 1.5GiB into bytes. Units are
+// powers of 1024; a bare number is bytes.
+func ParseSize(s string) (int64, error) {
+	num := strings.TrimSpace(s)
+	upper := strings.ToUpper(num)
+	shift := 0
+	for i, unit := range []string{"K", "M", "G", "T"} {
+		for _, suffix := range []string{unit + "IB", unit + "B", unit} {
+			if strings.HasSuffix(upper, suffix) {
+				num = strings.TrimSpace(num[:len(num)-len(suffix)])
+				shift = 10 * (i + 1)
+				break
+			}
+		}
+		if shift != 0 {
+			break
+		}
+	}
+	if shift == 0 {
+		num = strings.TrimSuffix(strings.TrimSuffix(num, "B"), "b")
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, errx.With(ErrInvalidSize, ": %q", s)
+	}
+	return int64(f * float64(int64(1)<<shift)), nil
+}
@@ -0,0 +1,174 @@
+package image
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cacheImage writes a registry cache entry for tag with a rootfs of size
+// bytes, created and last used at the given times.
+func cacheImage(t *testing.T, cacheDir, tag string, size int, created, used time.Time) string {
+	t.Helper()
+	dir := filepath.Join(cacheDir, registryCacheKey(tag, DefaultPlatform()))
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "abc123def456.ext4"), make([]byte, size), 0644))
+	meta, err := json.Marshal(ImageMeta{Tag: tag, CreatedAt: created, Source: "registry"})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "metadata.json"), meta, 0644))
+	marker := filepath.Join(dir, lastUsedFile)
+	require.NoError(t, os.WriteFile(marker, nil, 0644))
+	require.NoError(t, os.Chtimes(marker, used, used))
+	return dir
+}
+
+func evictedTags(entries []CacheEntry) []string {
+	var tags []string
+	for _, e := range entries {
+		tags = append(tags, e.Tag)
+	}
+	return tags
+}
+
+func TestGarbageCollectMaxSizeLRU(t *testing.T) {
+	cacheDir := t.TempDir()
+	now := time.Now()
+	cacheImage(t, cacheDir, "alpine:latest", 100, now.Add(-time.Hour), now.Add(-3*time.Minute))
+	cacheImage(t, cacheDir, "python:3.12", 100, now.Add(-2*time.Hour), now.Add(-time.Minute))
+	cacheImage(t, cacheDir, "busybox:latest", 100, now.Add(-time.Minute), now.Add(-2*time.Minute))
+
+	evicted, err := GarbageCollect(cacheDir, GCPolicy{MaxSize: 150}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alpine:latest", "busybox:latest"}, evictedTags(evicted))
+
+	left, err := ListCacheEntries(cacheDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"python:3.12"}, evictedTags(left))
+}
+
+func TestGarbageCollectKeepsImagesInUse(t *testing.T) {
+	cacheDir := t.TempDir()
+	now := time.Now()
+	cacheImage(t, cacheDir, "alpine:latest", 100, now, now.Add(-48*time.Hour))
+	cacheImage(t, cacheDir, "python:3.12", 100, now, now.Add(-48*time.Hour))
+
+	// A sandbox started from "alpine" uses the image cached as alpine:latest.
+	evicted, err := GarbageCollect(cacheDir, GCPolicy{MaxSize: 10}, []string{"alpine"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"python:3.12"}, evictedTags(evicted))
+
+	left, err := ListCacheEntries(cacheDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alpine:latest"}, evictedTags(left))
+}
+
+func TestGarbageCollectMaxAgeAndUntil(t *testing.T) {
+	cacheDir := t.TempDir()
+	now := time.Now()
+	cacheImage(t, cacheDir, "stale:1", 10, now.Add(-40*24*time.Hour), now.Add(-30*24*time.Hour))
+	cacheImage(t, cacheDir, "old:1", 10, now.Add(-10*24*time.Hour), now)
+	cacheImage(t, cacheDir, "fresh:1", 10, now.Add(-time.Hour), now)
+
+	evicted, err := GarbageCollect(cacheDir, GCPolicy{MaxAge: 7 * 24 * time.Hour}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"stale:1"}, evictedTags(evicted))
+
+	evicted, err = GarbageCollect(cacheDir, GCPolicy{Until: now.Add(-168 * time.Hour)}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old:1"}, evictedTags(evicted))
+}
+
+func TestGarbageCollectEmptyPolicyEvictsUnused(t *testing.T) {
+	cacheDir := t.TempDir()
+	now := time.Now()
+	cacheImage(t, cacheDir, "alpine:latest", 10, now, now)
+	cacheImage(t, cacheDir, "python:3.12", 10, now, now)
+	require.NoError(t, os.MkdirAll(filepath.Join(cacheDir, "local", "myapp_latest"), 0755))
+
+	evicted, err := GarbageCollect(cacheDir, GCPolicy{}, []string{"python:3.12"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alpine:latest"}, evictedTags(evicted))
+	assert.DirExists(t, filepath.Join(cacheDir, "local", "myapp_latest"), "local store is never collected")
+}
+
+func TestGarbageCollectSkipsConversionInProgress(t *testing.T) {
+	cacheDir := t.TempDir()
+	dir := filepath.Join(cacheDir, "alpine_latest@linux_amd64")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "abc123def456.erofs"), []byte("partial"), 0644))
+
+	evicted, err := GarbageCollect(cacheDir, GCPolicy{}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, evicted)
+	assert.DirExists(t, dir)
+}
+
+func TestGarbageCollectUsesIndexedLastUse(t *testing.T) {
+	cacheDir := t.TempDir()
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	cacheImage(t, cacheDir, "alpine:latest", 10, old, old)
+	cacheImage(t, cacheDir, "python:3.12", 10, old, old)
+
+	// Once indexed, use is recorded there rather than by the marker file.
+	registryIndex(cacheDir).touch(registryCacheKey("alpine:latest", DefaultPlatform()))
+	entries, err := ListCacheEntries(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.WithinDuration(t, now, entries[1].LastUsed, time.Minute)
+
+	evicted, err := GarbageCollect(cacheDir, GCPolicy{MaxAge: 24 * time.Hour}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"python:3.12"}, evictedTags(evicted))
+	left, err := ListCacheEntries(cacheDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alpine:latest"}, evictedTags(left))
+}
+
+func TestGarbageCollectRemovesUnindexedEntries(t *testing.T) {
+	cacheDir := t.TempDir()
+	now := time.Now()
+	cacheImage(t, cacheDir, "alpine:latest", 10, now, now)
+	_, err := ListCacheEntries(cacheDir)
+	require.NoError(t, err)
+
+	// A conversion finished writing its rootfs but was killed before it
+	// was indexed.
+	orphan := filepath.Join(cacheDir, registryCacheKey("busybox:latest", DefaultPlatform()))
+	require.NoError(t, os.MkdirAll(orphan, 0755))
+	rootfs := filepath.Join(orphan, "abc123def456.ext4")
+	require.NoError(t, os.WriteFile(rootfs, []byte("rootfs"), 0644))
+	old := now.Add(-2 * gcGracePeriod)
+	require.NoError(t, os.Chtimes(rootfs, old, old))
+
+	_, err = GarbageCollect(cacheDir, GCPolicy{MaxAge: 24 * time.Hour}, nil)
+	require.NoError(t, err)
+	assert.NoDirExists(t, orphan)
+	assert.DirExists(t, filepath.Join(cacheDir, registryCacheKey("alpine:latest", DefaultPlatform())))
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"1024":   1024,
+		"512B":   512,
+		"4k":     4 << 10,
+		"512M":   512 << 20,
+		"20GB":   20 << 30,
+		"1.5GiB": 3 << 29,
+		"1T":     1 << 40,
+	} {
+		got, err := ParseSize(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	for _, in := range []string{"", "GB", "-1G", "ten"} {
+		_, err := ParseSize(in)
+		require.ErrorIs(t, err, ErrInvalidSize, in)
+	}
+}
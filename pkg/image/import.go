@@ -11,7 +11,15 @@ import (
 	"github.com/jingkaihe/matchlock/internal/errx"
 )
 
+// Import stores the image in a `docker save` tarball read from reader under
+// tag.
 func (b *Builder) Import(ctx context.Context, reader io.Reader, tag string) (*BuildResult, error) {
+	return b.importTarball(ctx, reader, tag, ImageMeta{Source: "import"})
+}
+
+// importTarball is Import with the metadata to record: meta.Digest, when
+// set, is kept instead of the image digest.
+func (b *Builder) importTarball(ctx context.Context, reader io.Reader, tag string, meta ImageMeta) (*BuildResult, error) {
 	tmpTar, err := os.CreateTemp("", "matchlock-import-*.tar")
 	if err != nil {
 		return nil, errx.With(ErrCreateTemp, ": tarball: %w", err)
@@ -52,18 +60,18 @@ func (b *Builder) Import(ctx context.Context, reader io.Reader, tag string) (*Bu
 	rootfsTmp.Close()
 	rootfsPath := rootfsTmp.Name()
 
-	if err := b.createExt4(extractDir, rootfsPath, fileMetas); err != nil {
+	if err := b.createExt4(extractDir, rootfsPath, fileMetas, b.rootfsStamp(img, digest)); err != nil {
 		os.Remove(rootfsPath)
 		return nil, errx.Wrap(ErrCreateExt4, err)
 	}
 
 	ociConfig := extractOCIConfig(img)
 
-	meta := ImageMeta{
-		Digest: digest.String(),
-		Source: "import",
-		OCI:    ociConfig,
+	if meta.Digest == "" {
+		meta.Digest = digest.String()
 	}
+	meta.Layers = layerCount(img)
+	meta.OCI = ociConfig
 	if err := b.store.Save(tag, rootfsPath, meta); err != nil {
 		os.Remove(rootfsPath)
 		return nil, errx.Wrap(ErrStoreSave, err)
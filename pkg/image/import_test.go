@@ -133,6 +133,7 @@ func TestImportStoresMetadata(t *testing.T) {
 	require.NoError(t, err, "store.List")
 	require.Len(t, images, 1)
 	assert.Equal(t, "import", images[0].Meta.Source)
+	assert.Equal(t, 1, images[0].Meta.Layers)
 }
 
 func TestImportOverwritesExisting(t *testing.T) {
@@ -0,0 +1,361 @@
+package image
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// indexFile records the images of a cache directory, so that listing,
+// garbage collection and tag lookups read one file rather than every image
+// directory. The metadata.json in each image directory stays the record
+// the index is rebuilt from when it is missing or unreadable, as it is
+// after an upgrade or a restore.
+const indexFile = "index.json"
+
+// indexVersion is bumped when the index format changes, which rebuilds it.
+const indexVersion = 1
+
+// imageIndex is the index of the local store or the registry cache under
+// dir. Writers hold an flock on index.json.lock and replace the file
+// atomically, so readers never see it half written.
+type imageIndex struct {
+	dir string
+	// scan rebuilds the index from the image directories.
+	scan func(dir string) *indexState
+}
+
+// indexState is the content of index.json.
+type indexState struct {
+	Version int `json:"version"`
+	// Images are keyed by their directory, relative to the index's.
+	Images map[string]*indexEntry `json:"images"`
+	// Snapshots maps each layer snapshot of the registry cache to the
+	// snapshot it was applied on top of.
+	Snapshots map[string]string `json:"snapshots,omitempty"`
+}
+
+// indexEntry is one image: a tag in the local store, or a reference and
+// platform in the registry cache.
+type indexEntry struct {
+	// Rootfs names the image's rootfs file, within its directory, for each
+	// format it was converted to.
+	Rootfs   map[RootfsFormat]string `json:"rootfs"`
+	LastUsed time.Time               `json:"last_used"`
+	Meta     ImageMeta               `json:"meta"`
+}
+
+// rootfsPath returns the path of a rootfs of the entry in dir, preferring
+// ext4, or "" if it has none.
+func (e *indexEntry) rootfsPath(dir string) string {
+	if name, ok := e.Rootfs[FormatExt4]; ok {
+		return filepath.Join(dir, name)
+	}
+	formats := make([]string, 0, len(e.Rootfs))
+	for format := range e.Rootfs {
+		formats = append(formats, string(format))
+	}
+	if len(formats) == 0 {
+		return ""
+	}
+	sort.Strings(formats)
+	return filepath.Join(dir, e.Rootfs[RootfsFormat(formats[0])])
+}
+
+func newIndexState() *indexState {
+	return &indexState{Version: indexVersion, Images: make(map[string]*indexEntry)}
+}
+
+// storeIndex returns the index of the local store at dir.
+func storeIndex(dir string) *imageIndex {
+	return &imageIndex{dir: dir, scan: scanStore}
+}
+
+// registryIndex returns the index of the registry cache at cacheDir.
+func registryIndex(cacheDir string) *imageIndex {
+	return &imageIndex{dir: cacheDir, scan: scanRegistryCache}
+}
+
+func (x *imageIndex) path() string {
+	return filepath.Join(x.dir, indexFile)
+}
+
+// read returns the index on disk, or false if it has to be rebuilt.
+func (x *imageIndex) read() (*indexState, bool) {
+	data, err := os.ReadFile(x.path())
+	if err != nil {
+		return nil, false
+	}
+	var state indexState
+	if json.Unmarshal(data, &state) != nil || state.Version != indexVersion {
+		return nil, false
+	}
+	if state.Images == nil {
+		state.Images = make(map[string]*indexEntry)
+	}
+	return &state, true
+}
+
+// load returns the index, rebuilding it from the image directories first
+// if needed. A cache that does not exist has no images.
+func (x *imageIndex) load() (*indexState, error) {
+	if state, ok := x.read(); ok {
+		return state, nil
+	}
+	if _, err := os.Stat(x.dir); err != nil {
+		if os.IsNotExist(err) {
+			return newIndexState(), nil
+		}
+		return nil, errx.With(ErrStoreRead, ": %w", err)
+	}
+	var state *indexState
+	if err := x.update(func(s *indexState) error {
+		state = s
+		return nil
+	}); err != nil {
+		// A read-only cache can still be listed.
+		return x.scan(x.dir), nil
+	}
+	return state, nil
+}
+
+// entry returns the image in directory key, or nil.
+func (x *imageIndex) entry(key string) (*indexEntry, error) {
+	state, err := x.load()
+	if err != nil {
+		return nil, err
+	}
+	return state.Images[key], nil
+}
+
+// update applies fn to the index and writes it back, unless fn fails.
+func (x *imageIndex) update(fn func(*indexState) error) error {
+	if err := os.MkdirAll(x.dir, 0755); err != nil {
+		return errx.Wrap(ErrCreateDir, err)
+	}
+	lock, err := os.OpenFile(x.path()+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errx.With(ErrMetadata, ": index lock: %w", err)
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return errx.With(ErrMetadata, ": index lock: %w", err)
+	}
+
+	state, ok := x.read()
+	if !ok {
+		state = x.scan(x.dir)
+	}
+	if err := fn(state); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errx.With(ErrMetadata, ": marshal index: %w", err)
+	}
+	tmp, err := os.CreateTemp(x.dir, indexFile+".*.tmp")
+	if err != nil {
+		return errx.Wrap(ErrCreateTemp, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errx.With(ErrMetadata, ": write index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errx.With(ErrMetadata, ": write index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), x.path()); err != nil {
+		return errx.With(ErrMetadata, ": write index: %w", err)
+	}
+	return nil
+}
+
+// put records the image in directory key.
+func (x *imageIndex) put(key string, e *indexEntry) error {
+	return x.update(func(s *indexState) error {
+		s.Images[key] = e
+		return nil
+	})
+}
+
+// touch records that the image in directory key was just used.
+func (x *imageIndex) touch(key string) {
+	x.update(func(s *indexState) error {
+		if e := s.Images[key]; e != nil {
+			e.LastUsed = time.Now()
+		}
+		return nil
+	})
+}
+
+// Reindex rebuilds the indexes of the image cache at cacheDir, and of its
+// local store, from the image directories, for when they were changed
+// behind matchlock's back, such as by restoring a backup.
+func Reindex(cacheDir string) error {
+	if cacheDir == "" {
+		home, _ := os.UserHomeDir()
+		cacheDir = filepath.Join(home, ".cache", "matchlock", "images")
+	}
+	for _, x := range []*imageIndex{registryIndex(cacheDir), storeIndex(filepath.Join(cacheDir, "local"))} {
+		if _, err := os.Stat(x.dir); os.IsNotExist(err) {
+			continue
+		}
+		if err := x.update(func(s *indexState) error {
+			*s = *x.scan(x.dir)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readImageMeta reads the metadata.json in dir.
+func readImageMeta(dir string) (ImageMeta, bool) {
+	var meta ImageMeta
+	data, err := os.ReadFile(filepath.Join(dir, "metadata.json"))
+	if err != nil || json.Unmarshal(data, &meta) != nil {
+		return ImageMeta{}, false
+	}
+	return meta, true
+}
+
+// scanStore indexes the local store at dir: one directory per tag.
+func scanStore(dir string) *indexState {
+	state := newIndexState()
+	dirs, _ := os.ReadDir(dir)
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		meta, ok := readImageMeta(filepath.Join(dir, d.Name()))
+		if !ok {
+			continue
+		}
+		state.Images[d.Name()] = &indexEntry{
+			Rootfs:   map[RootfsFormat]string{FormatExt4: "rootfs.ext4"},
+			LastUsed: meta.CreatedAt,
+			Meta:     meta,
+		}
+	}
+	return state
+}
+
+// scanRegistryCache indexes the registry cache at cacheDir: one directory
+// per reference and platform, and the layer snapshots.
+func scanRegistryCache(cacheDir string) *indexState {
+	state := newIndexState()
+	dirs, _ := os.ReadDir(cacheDir)
+	for _, d := range dirs {
+		if !d.IsDir() || d.Name() == "local" {
+			continue
+		}
+		if d.Name() == snapshotsDir {
+			state.Snapshots = scanSnapshots(filepath.Join(cacheDir, snapshotsDir))
+			continue
+		}
+		if e := scanCacheEntry(filepath.Join(cacheDir, d.Name())); e != nil {
+			state.Images[d.Name()] = e
+		}
+	}
+	return state
+}
+
+// scanCacheEntry indexes the registry cache entry in dir. Entries without
+// metadata.json, written by matchlock before it kept metadata, get what the
+// rootfs files tell; recent ones are conversions still being written and
+// are left out.
+func scanCacheEntry(dir string) *indexEntry {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	meta, hasMeta := readImageMeta(dir)
+
+	current := make(map[RootfsFormat]os.FileInfo)
+	for _, f := range files {
+		fi, err := f.Info()
+		if err != nil || !isRootfsFile(f.Name()) {
+			continue
+		}
+		// A tag that moved may have left the rootfs of an older digest
+		// behind: the current one is named after the recorded digest, or
+		// else is the newest.
+		format := rootfsFileFormat(f.Name())
+		if prev, ok := current[format]; ok && (isRootfsOf(prev.Name(), meta.Digest) ||
+			(!isRootfsOf(fi.Name(), meta.Digest) && prev.ModTime().After(fi.ModTime()))) {
+			continue
+		}
+		current[format] = fi
+	}
+	if len(current) == 0 {
+		return nil
+	}
+
+	e := &indexEntry{Rootfs: make(map[RootfsFormat]string, len(current))}
+	var created time.Time
+	var size int64
+	for format, fi := range current {
+		e.Rootfs[format] = fi.Name()
+		size += fi.Size()
+		if fi.ModTime().After(created) {
+			created = fi.ModTime()
+		}
+	}
+
+	if hasMeta {
+		e.Meta = meta
+	} else {
+		if time.Since(created) < gcGracePeriod {
+			return nil
+		}
+		name := e.rootfsPath(dir)
+		e.Meta = ImageMeta{
+			Tag:       filepath.Base(dir),
+			Digest:    strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)),
+			CreatedAt: created,
+			Source:    "registry",
+		}
+	}
+	e.Meta.Size = size
+	e.LastUsed = e.Meta.CreatedAt
+	if fi, err := os.Stat(filepath.Join(dir, lastUsedFile)); err == nil && fi.ModTime().After(e.LastUsed) {
+		e.LastUsed = fi.ModTime()
+	}
+	return e
+}
+
+// rootfsFileFormat returns the format of the rootfs file name.
+func rootfsFileFormat(name string) RootfsFormat {
+	return RootfsFormat(strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
+// isRootfsOf reports whether the rootfs file name, which is named after
+// the start of the image digest, was converted from digest.
+func isRootfsOf(name, digest string) bool {
+	hex := strings.TrimSuffix(name, filepath.Ext(name))
+	return digest != "" && strings.HasPrefix(strings.TrimPrefix(digest, "sha256:"), hex)
+}
+
+// scanSnapshots reads the parent of each layer snapshot in dir.
+func scanSnapshots(dir string) map[string]string {
+	parents := make(map[string]string)
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), "tmp-") {
+			continue
+		}
+		parent, _ := os.ReadFile(filepath.Join(dir, e.Name(), "parent"))
+		parents[e.Name()] = strings.TrimSpace(string(parent))
+	}
+	return parents
+}
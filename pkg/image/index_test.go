@@ -0,0 +1,112 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexBuiltFromImageDirectories(t *testing.T) {
+	cacheDir := t.TempDir()
+	now := time.Now()
+	used := now.Add(-time.Hour).Truncate(time.Second)
+	dir := cacheImage(t, cacheDir, "alpine:latest", 10, now.Add(-2*time.Hour), used)
+	// The rootfs of the image the tag named before it moved.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "000000000000.ext4"), make([]byte, 10), 0644))
+	meta, err := json.Marshal(ImageMeta{Tag: "alpine:latest", Digest: "sha256:abc123def456", Source: "registry"})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "metadata.json"), meta, 0644))
+	snapshots := NewSnapshotCache(filepath.Join(cacheDir, snapshotsDir))
+	require.NoError(t, os.MkdirAll(filepath.Join(snapshots.dir, "child"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(snapshots.dir, "child", "parent"), []byte("base"), 0644))
+
+	images, err := ListRegistryCache(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, filepath.Join(dir, "abc123def456.ext4"), images[0].RootfsPath, "the rootfs of the recorded digest")
+	assert.Equal(t, int64(10), images[0].Meta.Size)
+	require.FileExists(t, filepath.Join(cacheDir, indexFile))
+
+	state, ok := registryIndex(cacheDir).read()
+	require.True(t, ok)
+	assert.Equal(t, "base", state.Snapshots["child"])
+	entry := state.Images[filepath.Base(dir)]
+	require.NotNil(t, entry)
+	assert.True(t, used.Equal(entry.LastUsed), "last use carries over from the marker file")
+
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, indexFile), []byte("{"), 0644))
+	images, err = ListRegistryCache(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, images, 1, "a damaged index is rebuilt")
+
+	// Later lookups read the index, not the directories.
+	require.NoError(t, os.Remove(filepath.Join(dir, "metadata.json")))
+	images, err = ListRegistryCache(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, "sha256:abc123def456", images[0].Meta.Digest)
+}
+
+func TestStoreIndex(t *testing.T) {
+	store := NewStore(t.TempDir())
+	rootfsFile := filepath.Join(t.TempDir(), "test.ext4")
+	require.NoError(t, os.WriteFile(rootfsFile, []byte("data"), 0644))
+	require.NoError(t, store.Save("myapp:latest", rootfsFile, ImageMeta{Digest: "sha256:aaa"}))
+
+	state, ok := store.index.read()
+	require.True(t, ok)
+	require.Contains(t, state.Images, "myapp_latest")
+	saved := state.Images["myapp_latest"].LastUsed
+
+	time.Sleep(10 * time.Millisecond)
+	_, err := store.Get("myapp:latest")
+	require.NoError(t, err)
+	state, _ = store.index.read()
+	assert.True(t, state.Images["myapp_latest"].LastUsed.After(saved), "Get records use")
+
+	require.NoError(t, store.Remove("myapp:latest"))
+	state, _ = store.index.read()
+	assert.Empty(t, state.Images)
+}
+
+func TestBuildAfterTagMove(t *testing.T) {
+	fakeTool(t, "sqfstar", `cat > "$3"`)
+	ref := pushImage(t, nil, rootfsImage(t, "1"))
+	cacheDir := t.TempDir()
+	build := func(forcePull bool) *BuildResult {
+		result, err := NewBuilder(&BuildOptions{
+			CacheDir:      cacheDir,
+			LayerCacheDir: filepath.Join(t.TempDir(), "layers"),
+			ForcePull:     forcePull,
+			RootfsFormat:  FormatSquashfs,
+		}).Build(context.Background(), ref.String())
+		require.NoError(t, err)
+		return result
+	}
+	first := build(false)
+
+	moved := rootfsImage(t, "2")
+	require.NoError(t, remote.Write(ref, moved))
+	digest, err := moved.Digest()
+	require.NoError(t, err)
+	build(true)
+	assert.NoFileExists(t, first.RootfsPath, "the old image's rootfs is replaced")
+
+	result := build(false)
+	assert.True(t, result.Cached)
+	assert.Equal(t, digest.String(), result.Digest, "cache hits serve the image the tag names now")
+	_, files := readTar(t, result.RootfsPath)
+	assert.Equal(t, "2", files["etc/release"])
+
+	images, err := ListRegistryCache(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, digest.String(), images[0].Meta.Digest)
+}
@@ -0,0 +1,273 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"golang.org/x/sys/unix"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// refNameAnnotation is the standard OCI annotation used to record which
+// reference an index entry was pulled as.
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// LayerCache is a content-addressed OCI image layout holding the manifests,
+// configs and compressed layers of every image pulled from a registry. It is
+// shared read-only with BuildKit VMs so that FROM images already present on
+// the host are not pulled again.
+type LayerCache struct {
+	dir string
+}
+
+// NewLayerCache returns a layer cache rooted at dir, defaulting to
+// ~/.cache/matchlock/layers.
+func NewLayerCache(dir string) *LayerCache {
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".cache", "matchlock", "layers")
+	}
+	return &LayerCache{dir: dir}
+}
+
+// Dir returns the root of the OCI layout.
+func (c *LayerCache) Dir() string {
+	return c.dir
+}
+
+// Add writes img into the layout under ref, replacing any image previously
+// recorded for the same reference. Blobs already present are not rewritten.
+func (c *LayerCache) Add(ref string, img v1.Image) error {
+	key, err := normalizeRef(ref)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	p, err := c.open()
+	if err != nil {
+		return err
+	}
+	if err := p.ReplaceImage(img, match.Annotation(refNameAnnotation, key), layout.WithAnnotations(map[string]string{
+		refNameAnnotation: key,
+	})); err != nil {
+		return errx.Wrap(ErrLayerCache, err)
+	}
+	return nil
+}
+
+// Image returns the cached image recorded under ref.
+func (c *LayerCache) Image(ref string) (v1.Image, error) {
+	digest, err := c.Lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	p, err := layout.FromPath(c.dir)
+	if err != nil {
+		return nil, errx.Wrap(ErrLayerCache, err)
+	}
+	img, err := p.Image(digest)
+	if err != nil {
+		return nil, errx.Wrap(ErrLayerCache, err)
+	}
+	return img, nil
+}
+
+// Lookup returns the manifest digest recorded under ref.
+func (c *LayerCache) Lookup(ref string) (v1.Hash, error) {
+	key, err := normalizeRef(ref)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	p, err := layout.FromPath(c.dir)
+	if err != nil {
+		return v1.Hash{}, errx.With(ErrImageNotFound, ": %s", ref)
+	}
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return v1.Hash{}, errx.Wrap(ErrLayerCache, err)
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return v1.Hash{}, errx.Wrap(ErrLayerCache, err)
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.Annotations[refNameAnnotation] == key {
+			return desc.Digest, nil
+		}
+	}
+	return v1.Hash{}, errx.With(ErrImageNotFound, ": %s", ref)
+}
+
+// blob returns the path of the blob with digest h if the cache holds it.
+func (c *LayerCache) blob(h v1.Hash) (string, bool) {
+	path := filepath.Join(c.dir, "blobs", h.Algorithm, h.Hex)
+	if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+		return "", false
+	}
+	return path, true
+}
+
+// open returns the layout, creating it if needed.
+func (c *LayerCache) open() (layout.Path, error) {
+	if p, err := layout.FromPath(c.dir); err == nil {
+		return p, nil
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return "", errx.Wrap(ErrCreateDir, err)
+	}
+	p, err := layout.Write(c.dir, empty.Index)
+	if err != nil {
+		return "", errx.Wrap(ErrLayerCache, err)
+	}
+	// BuildKit's client-side content store creates ingest/ when it opens a
+	// layout, which fails on a read-only mount unless it already exists.
+	if err := os.MkdirAll(filepath.Join(c.dir, "ingest"), 0755); err != nil {
+		return "", errx.Wrap(ErrCreateDir, err)
+	}
+	return p, nil
+}
+
+// lock serialises writers of index.json across matchlock processes.
+func (c *LayerCache) lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(c.dir), 0755); err != nil {
+		return nil, errx.Wrap(ErrCreateDir, err)
+	}
+	f, err := os.OpenFile(c.dir+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errx.Wrap(ErrLayerCache, err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, errx.Wrap(ErrLayerCache, err)
+	}
+	return func() { f.Close() }, nil
+}
+
+func normalizeRef(ref string) (string, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return "", errx.Wrap(ErrParseReference, err)
+	}
+	return r.Name(), nil
+}
+
+// DockerfileBaseImages returns the external images referenced by FROM
+// instructions in a Dockerfile, in order and without duplicates. Stages
+// that build on an earlier stage, "scratch", and references that depend on
+// build arguments are skipped since they cannot be resolved up front.
+func DockerfileBaseImages(r io.Reader) ([]string, error) {
+	var (
+		images []string
+		seen   = map[string]bool{}
+		stages = map[string]bool{}
+	)
+	err := dockerfileInstructions(r, func(lines, fields []string) {
+		i, external := fromImage(fields, stages)
+		if external && !seen[fields[i]] {
+			seen[fields[i]] = true
+			images = append(images, fields[i])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// PinDockerfileBaseImages returns the Dockerfile read from r with each
+// external FROM image that has an entry in pins replaced by it. A pinned
+// FROM instruction that spanned several lines is joined onto one; every
+// other line is kept as it was.
+func PinDockerfileBaseImages(r io.Reader, pins map[string]string) ([]byte, error) {
+	var (
+		out    bytes.Buffer
+		stages = map[string]bool{}
+	)
+	err := dockerfileInstructions(r, func(lines, fields []string) {
+		if i, external := fromImage(fields, stages); external && pins[fields[i]] != "" {
+			fields[i] = pins[fields[i]]
+			lines = []string{strings.Join(fields, " ")}
+		}
+		for _, line := range lines {
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// dockerfileInstructions calls fn with each instruction of a Dockerfile, as
+// the physical lines it spans and as the fields of those lines joined.
+// Comments are passed with no fields.
+func dockerfileInstructions(r io.Reader, fn func(lines, fields []string)) error {
+	var (
+		lines []string
+		line  strings.Builder
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		text := strings.TrimSpace(scanner.Text())
+		if line.Len() == 0 && strings.HasPrefix(text, "#") {
+			fn(lines, nil)
+			lines = nil
+			continue
+		}
+		if strings.HasSuffix(text, "\\") {
+			line.WriteString(strings.TrimSuffix(text, "\\"))
+			line.WriteString(" ")
+			continue
+		}
+		line.WriteString(text)
+		fn(lines, strings.Fields(line.String()))
+		lines = nil
+		line.Reset()
+	}
+	if len(lines) > 0 {
+		fn(lines, nil)
+	}
+	return scanner.Err()
+}
+
+// fromImage returns the index in fields of the image a FROM instruction
+// builds on, or -1 for any other instruction, and records the stage it
+// names in stages. external reports whether the image is pulled, rather
+// than being an earlier stage, "scratch" or a build argument.
+func fromImage(fields []string, stages map[string]bool) (int, bool) {
+	if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+		return -1, false
+	}
+	i := 1
+	for i < len(fields) && strings.HasPrefix(fields[i], "--") {
+		i++
+	}
+	if i == len(fields) {
+		return -1, false
+	}
+	ref := fields[i]
+	external := !stages[strings.ToLower(ref)] && !strings.EqualFold(ref, "scratch") && !strings.Contains(ref, "$")
+	if len(fields) >= i+3 && strings.EqualFold(fields[i+1], "AS") {
+		stages[strings.ToLower(fields[i+2])] = true
+	}
+	return i, external
+}
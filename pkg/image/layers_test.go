@@ -0,0 +1,114 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayerCacheAddAndLookup(t *testing.T) {
+	cache := NewLayerCache(filepath.Join(t.TempDir(), "layers"))
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+	require.NoError(t, cache.Add("alpine:3.19", img))
+
+	want, err := img.Digest()
+	require.NoError(t, err)
+
+	got, err := cache.Lookup("docker.io/library/alpine:3.19")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	cached, err := cache.Image("alpine:3.19")
+	require.NoError(t, err)
+	layers, err := cached.Layers()
+	require.NoError(t, err)
+	assert.Len(t, layers, 2)
+
+	assert.DirExists(t, filepath.Join(cache.Dir(), "ingest"))
+}
+
+func TestLayerCacheAddReplacesRef(t *testing.T) {
+	cache := NewLayerCache(filepath.Join(t.TempDir(), "layers"))
+
+	first, err := random.Image(512, 1)
+	require.NoError(t, err)
+	second, err := random.Image(512, 1)
+	require.NoError(t, err)
+
+	require.NoError(t, cache.Add("alpine:latest", first))
+	require.NoError(t, cache.Add("alpine:latest", second))
+
+	want, err := second.Digest()
+	require.NoError(t, err)
+	got, err := cache.Lookup("alpine")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	index, err := os.ReadFile(filepath.Join(cache.Dir(), "index.json"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(index), refNameAnnotation))
+}
+
+func TestLayerCacheLookupMissing(t *testing.T) {
+	cache := NewLayerCache(filepath.Join(t.TempDir(), "layers"))
+
+	_, err := cache.Lookup("alpine:3.19")
+	assert.ErrorIs(t, err, ErrImageNotFound)
+
+	img, err := random.Image(512, 1)
+	require.NoError(t, err)
+	require.NoError(t, cache.Add("alpine:3.19", img))
+
+	_, err = cache.Lookup("alpine:3.20")
+	assert.ErrorIs(t, err, ErrImageNotFound)
+}
+
+func TestDockerfileBaseImages(t *testing.T) {
+	dockerfile := `# syntax=docker/dockerfile:1
+ARG GO_VERSION=1.22
+FROM golang:${GO_VERSION} AS build
+RUN go build ./...
+
+FROM --platform=linux/amd64 alpine:3.19 AS base
+FROM base AS final
+COPY --from=build /out /out
+
+FROM scratch
+from \
+  ghcr.io/example/tool@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+FROM alpine:3.19
+`
+	images, err := DockerfileBaseImages(strings.NewReader(dockerfile))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"alpine:3.19",
+		"ghcr.io/example/tool@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}, images)
+}
+
+func TestPinDockerfileBaseImages(t *testing.T) {
+	dockerfile := `# alpine:3.19 stays in comments
+FROM --platform=linux/amd64 alpine:3.19 AS alpine
+FROM alpine
+RUN echo alpine:3.19
+FROM \
+  alpine:3.19
+`
+	pinned, err := PinDockerfileBaseImages(strings.NewReader(dockerfile), map[string]string{
+		"alpine:3.19": "alpine:3.19@sha256:abc",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `# alpine:3.19 stays in comments
+FROM --platform=linux/amd64 alpine:3.19@sha256:abc AS alpine
+FROM alpine
+RUN echo alpine:3.19
+FROM alpine:3.19@sha256:abc
+`, string(pinned))
+}
@@ -0,0 +1,193 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// Image references with these prefixes are read from the host instead of a
+// registry:
+//
+//	docker-daemon:myapp:dev           the local Docker or Podman engine
+//	docker-archive:/path/image.tar    a `docker save` tarball
+//	containerd:myapp:dev              containerd's image store, via ctr
+//	containers-storage:myapp:dev      Podman's containers-storage, via podman
+const (
+	DockerDaemonPrefix      = "docker-daemon:"
+	DockerArchivePrefix     = "docker-archive:"
+	ContainerdPrefix        = "containerd:"
+	ContainersStoragePrefix = "containers-storage:"
+)
+
+var localImagePrefixes = []string{DockerDaemonPrefix, DockerArchivePrefix, ContainerdPrefix, ContainersStoragePrefix}
+
+// IsLocalImageRef reports whether ref names an image on the host rather than
+// in a registry.
+func IsLocalImageRef(ref string) bool {
+	for _, prefix := range localImagePrefixes {
+		if strings.HasPrefix(ref, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// localImage is an image found on the host. id changes whenever the image
+// does, and open streams it as a `docker save` tarball.
+type localImage struct {
+	id     string
+	source string
+	open   func(ctx context.Context) (io.ReadCloser, error)
+}
+
+// ContainerdNamespace is the containerd namespace images are read from:
+// $CONTAINERD_NAMESPACE, as for ctr, or "default". Kubernetes nodes keep
+// their images in "k8s.io".
+func ContainerdNamespace() string {
+	if ns := os.Getenv("CONTAINERD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	return "default"
+}
+
+// containerdImage returns the named image of containerd's image store.
+func containerdImage(ctx context.Context, name string) (*localImage, error) {
+	ns := ContainerdNamespace()
+	out, err := runTool(ctx, "ctr", "-n", ns, "images", "ls", "name=="+name)
+	if err != nil {
+		return nil, err
+	}
+	// REF TYPE DIGEST SIZE PLATFORMS LABELS, after a header line.
+	var id string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[0] == name {
+			id = fields[2]
+		}
+	}
+	if id == "" {
+		return nil, errx.With(ErrImageNotFound, ": %s in containerd namespace %s", name, ns)
+	}
+	return &localImage{
+		id:     id,
+		source: "containerd",
+		open: func(ctx context.Context) (io.ReadCloser, error) {
+			return streamTool(ctx, "ctr", "-n", ns, "images", "export", "-", name)
+		},
+	}, nil
+}
+
+// containersStorageImage returns the named image of Podman's
+// containers-storage.
+func containersStorageImage(ctx context.Context, name string) (*localImage, error) {
+	out, err := runTool(ctx, "podman", "image", "inspect", "--format", "{{.Id}}", name)
+	if err != nil {
+		return nil, errx.With(ErrImageNotFound, ": %s in containers-storage: %w", name, err)
+	}
+	return &localImage{
+		id:     strings.TrimSpace(out),
+		source: "containers-storage",
+		open: func(ctx context.Context) (io.ReadCloser, error) {
+			return streamTool(ctx, "podman", "image", "save", "--format", "docker-archive", name)
+		},
+	}, nil
+}
+
+// findLocalImage resolves a reference with one of the local prefixes.
+func findLocalImage(ctx context.Context, imageRef string) (*localImage, error) {
+	for _, prefix := range localImagePrefixes {
+		name, ok := strings.CutPrefix(imageRef, prefix)
+		if !ok {
+			continue
+		}
+		if name == "" {
+			return nil, errx.With(ErrParseReference, ": %s names no image", imageRef)
+		}
+		switch prefix {
+		case DockerDaemonPrefix:
+			return daemonImage(ctx, name)
+		case DockerArchivePrefix:
+			return archiveImage(name)
+		case ContainerdPrefix:
+			return containerdImage(ctx, name)
+		default:
+			return containersStorageImage(ctx, name)
+		}
+	}
+	return nil, errx.With(ErrParseReference, ": %s is not a local image", imageRef)
+}
+
+// buildLocal stores an image read from the host under its reference. The
+// stored copy is reused while the image ID is unchanged, so rebuilding the
+// image and running it again picks up the new version.
+func (b *Builder) buildLocal(ctx context.Context, imageRef string) (*BuildResult, error) {
+	img, err := findLocalImage(ctx, imageRef)
+	if err != nil {
+		return nil, err
+	}
+	if cached, err := b.store.Get(imageRef); err == nil && !b.forcePull && cached.Digest == img.id {
+		return cached, nil
+	}
+	rc, err := img.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return b.importTarball(ctx, rc, imageRef, ImageMeta{Digest: img.id, Source: img.source})
+}
+
+// runTool runs a container runtime CLI and returns its output.
+func runTool(ctx context.Context, tool string, args ...string) (string, error) {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return "", errx.With(ErrToolNotFound, ": %s not in PATH", tool)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errx.With(ErrLocalImage, ": %s %s: %w: %s", tool, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// toolStream is the output of a running tool. Close waits for it and
+// reports its failure.
+type toolStream struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (s *toolStream) Close() error {
+	s.ReadCloser.Close()
+	if err := s.cmd.Wait(); err != nil {
+		return errx.With(ErrLocalImage, ": %s: %w: %s", s.cmd.Path, err, strings.TrimSpace(s.stderr.String()))
+	}
+	return nil
+}
+
+// streamTool starts a container runtime CLI and returns its standard output.
+func streamTool(ctx context.Context, tool string, args ...string) (io.ReadCloser, error) {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return nil, errx.With(ErrToolNotFound, ": %s not in PATH", tool)
+	}
+	s := &toolStream{cmd: exec.CommandContext(ctx, path, args...), stderr: &bytes.Buffer{}}
+	s.cmd.Stderr = s.stderr
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return nil, errx.Wrap(ErrLocalImage, err)
+	}
+	if err := s.cmd.Start(); err != nil {
+		return nil, errx.Wrap(ErrLocalImage, err)
+	}
+	s.ReadCloser = stdout
+	return s, nil
+}
@@ -0,0 +1,84 @@
+package image
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTool installs an executable shell script named tool at the front of
+// PATH.
+func fakeTool(t *testing.T, tool, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, tool), []byte("#!/bin/sh\n"+script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestBuildContainerd(t *testing.T) {
+	tarPath := buildTestTarball(t, map[string]string{"app.txt": "v1"})
+	t.Setenv("CONTAINERD_NAMESPACE", "k8s.io")
+	fakeTool(t, "ctr", `
+[ "$1 $2" = "-n k8s.io" ] || { echo "wrong namespace $2" >&2; exit 1; }
+case "$3 $4" in
+"images ls")
+	echo "REF TYPE DIGEST SIZE PLATFORMS LABELS"
+	if [ "$5" = "name==myapp:dev" ]; then
+		echo "myapp:dev application/vnd.oci.image.manifest.v1+json sha256:abc 1.0 MiB linux/amd64 -"
+	fi
+	;;
+"images export") cat `+tarPath+` ;;
+esac
+`)
+
+	builder := NewBuilder(&BuildOptions{CacheDir: t.TempDir()})
+	builder.store = NewStore(t.TempDir())
+
+	result, err := builder.Build(context.Background(), "containerd:myapp:dev")
+	require.NoError(t, err)
+	assert.FileExists(t, result.RootfsPath)
+	assert.Equal(t, "sha256:abc", result.Digest)
+
+	images, err := builder.store.List()
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, "containerd", images[0].Meta.Source)
+
+	_, err = builder.Build(context.Background(), "containerd:nope:latest")
+	assert.ErrorIs(t, err, ErrImageNotFound)
+}
+
+func TestBuildContainersStorage(t *testing.T) {
+	tarPath := buildTestTarball(t, map[string]string{"app.txt": "v1"})
+	fakeTool(t, "podman", `
+case "$2" in
+inspect) [ "$5" = "myapp:dev" ] || { echo "image not known" >&2; exit 125; }; echo 0123abcd ;;
+save) cat `+tarPath+` ;;
+esac
+`)
+
+	builder := NewBuilder(&BuildOptions{CacheDir: t.TempDir()})
+	builder.store = NewStore(t.TempDir())
+
+	result, err := builder.Build(context.Background(), "containers-storage:myapp:dev")
+	require.NoError(t, err)
+	assert.FileExists(t, result.RootfsPath)
+	assert.Equal(t, "0123abcd", result.Digest)
+
+	_, err = builder.Build(context.Background(), "containers-storage:nope:latest")
+	require.ErrorIs(t, err, ErrImageNotFound)
+	assert.Contains(t, err.Error(), "image not known")
+}
+
+func TestIsLocalImageRef(t *testing.T) {
+	assert.True(t, IsLocalImageRef("docker-daemon:myapp:dev"))
+	assert.True(t, IsLocalImageRef("docker-archive:/tmp/app.tar"))
+	assert.True(t, IsLocalImageRef("containerd:myapp:dev"))
+	assert.True(t, IsLocalImageRef("containers-storage:myapp:dev"))
+	assert.False(t, IsLocalImageRef("alpine:latest"))
+	assert.False(t, IsLocalImageRef("ghcr.io/docker-daemon/app:1"))
+}
@@ -0,0 +1,136 @@
+package image
+
+import (
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// DefaultPlatform is the platform images are pulled for unless another is
+// requested: Linux on the host's architecture, which is what the guest runs.
+func DefaultPlatform() v1.Platform {
+	return v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
+
+// ParsePlatform parses a platform such as "linux/arm64" or "linux/arm/v7".
+// An empty string yields DefaultPlatform.
+func ParsePlatform(s string) (v1.Platform, error) {
+	if s == "" {
+		return DefaultPlatform(), nil
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return v1.Platform{}, errx.With(ErrInvalidPlatform, ": %q is not OS/ARCH[/VARIANT]", s)
+	}
+	if parts[0] != "linux" {
+		return v1.Platform{}, errx.With(ErrInvalidPlatform, ": %q: only linux images can run in a sandbox", s)
+	}
+	p := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// platformKey is the platform as used in cache directory names.
+func platformKey(p v1.Platform) string {
+	key := p.OS + "_" + p.Architecture
+	if p.Variant != "" {
+		key += "_" + p.Variant
+	}
+	return key
+}
+
+// registryCacheKey names the cache directory of ref pulled for platform, so
+// the same tag pulled for several architectures does not collide.
+func registryCacheKey(ref string, platform v1.Platform) string {
+	return sanitizeRef(ref) + "@" + platformKey(platform)
+}
+
+// platformMatches reports whether an image for have satisfies want. A want
+// without a variant accepts any variant.
+func platformMatches(have, want v1.Platform) bool {
+	return have.OS == want.OS && have.Architecture == want.Architecture &&
+		(want.Variant == "" || have.Variant == want.Variant)
+}
+
+// fetchImage resolves ref to the image for platform, walking (nested)
+// manifest lists. A single-platform image is only returned if it was built
+// for platform. The digest ref itself resolved to, the manifest list's for
+// a multi-platform image, is returned alongside.
+func fetchImage(ref name.Reference, platform v1.Platform, opts ...remote.Option) (v1.Image, v1.Hash, error) {
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return nil, v1.Hash{}, errx.Wrap(ErrPullImage, err)
+	}
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, v1.Hash{}, errx.Wrap(ErrPullImage, err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, v1.Hash{}, errx.Wrap(ErrPullImage, err)
+		}
+		have := v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant}
+		if have.Architecture != "" && !platformMatches(have, platform) {
+			return nil, v1.Hash{}, errx.With(ErrPlatformNotFound, ": %s is a single-platform %s image, not %s", ref, have.String(), platform.String())
+		}
+		return img, desc.Digest, nil
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, v1.Hash{}, errx.Wrap(ErrPullImage, err)
+	}
+	var available []string
+	img, err := findInIndex(idx, platform, &available)
+	if err != nil {
+		return nil, v1.Hash{}, err
+	}
+	if img == nil {
+		sort.Strings(available)
+		return nil, v1.Hash{}, errx.With(ErrPlatformNotFound, ": %s has no %s image (available: %s)", ref, platform.String(), strings.Join(available, ", "))
+	}
+	return img, desc.Digest, nil
+}
+
+// findInIndex returns the first image in idx for platform, or nil, recording
+// the platforms it passes over in available.
+func findInIndex(idx v1.ImageIndex, platform v1.Platform, available *[]string) (v1.Image, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, errx.Wrap(ErrPullImage, err)
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.MediaType.IsIndex() {
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, errx.Wrap(ErrPullImage, err)
+			}
+			if img, err := findInIndex(child, platform, available); img != nil || err != nil {
+				return img, err
+			}
+			continue
+		}
+		// Attestation manifests are listed as unknown/unknown.
+		if desc.Platform == nil || desc.Platform.OS == "unknown" {
+			continue
+		}
+		if platformMatches(*desc.Platform, platform) {
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				return nil, errx.Wrap(ErrPullImage, err)
+			}
+			return img, nil
+		}
+		*available = append(*available, desc.Platform.String())
+	}
+	return nil, nil
+}
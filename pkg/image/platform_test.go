@@ -0,0 +1,256 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatform(t *testing.T) {
+	p, err := ParsePlatform("")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultPlatform(), p)
+
+	p, err = ParsePlatform("linux/arm/v7")
+	require.NoError(t, err)
+	assert.Equal(t, v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, p)
+
+	for _, bad := range []string{"linux", "linux/", "/amd64", "linux/arm/v7/x", "windows/amd64"} {
+		_, err := ParsePlatform(bad)
+		assert.ErrorIs(t, err, ErrInvalidPlatform, bad)
+	}
+}
+
+func TestRegistryCacheKeyPerPlatform(t *testing.T) {
+	amd64 := registryCacheKey("alpine:latest", v1.Platform{OS: "linux", Architecture: "amd64"})
+	arm64 := registryCacheKey("alpine:latest", v1.Platform{OS: "linux", Architecture: "arm64"})
+	armv7 := registryCacheKey("alpine:latest", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	assert.Equal(t, "alpine_latest@linux_amd64", amd64)
+	assert.Equal(t, "alpine_latest@linux_arm_v7", armv7)
+	assert.NotEqual(t, amd64, arm64)
+}
+
+// pushImage serves an in-memory registry and pushes idx or img to it,
+// returning the reference.
+func pushImage(t *testing.T, idx v1.ImageIndex, img v1.Image) name.Reference {
+	t.Helper()
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+	ref, err := name.ParseReference(strings.TrimPrefix(srv.URL, "http://") + "/test/image:latest")
+	require.NoError(t, err)
+	if idx != nil {
+		require.NoError(t, remote.WriteIndex(ref, idx))
+	} else {
+		require.NoError(t, remote.Write(ref, img))
+	}
+	return ref
+}
+
+func platformImage(t *testing.T, p v1.Platform) v1.Image {
+	t.Helper()
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg = cfg.DeepCopy()
+	cfg.OS, cfg.Architecture, cfg.Variant = p.OS, p.Architecture, p.Variant
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+	return img
+}
+
+func platformIndex(t *testing.T, platforms ...v1.Platform) (v1.ImageIndex, map[string]v1.Hash) {
+	t.Helper()
+	var idx v1.ImageIndex = empty.Index
+	digests := make(map[string]v1.Hash)
+	for _, p := range platforms {
+		p := p
+		img := platformImage(t, p)
+		d, err := img.Digest()
+		require.NoError(t, err)
+		digests[p.String()] = d
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &p},
+		})
+	}
+	return idx, digests
+}
+
+func TestFetchImageSelectsPlatform(t *testing.T) {
+	amd64 := v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	armv7 := v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	inner, digests := platformIndex(t, arm64, armv7)
+	outer, outerDigests := platformIndex(t, amd64)
+	digests[amd64.String()] = outerDigests[amd64.String()]
+	outer = mutate.AppendManifests(outer, mutate.IndexAddendum{Add: inner})
+	ref := pushImage(t, outer, nil)
+
+	for _, tc := range []struct {
+		want v1.Platform
+		key  string
+	}{
+		{amd64, amd64.String()},
+		{v1.Platform{OS: "linux", Architecture: "arm64"}, arm64.String()},
+		{armv7, armv7.String()},
+	} {
+		img, _, err := fetchImage(ref, tc.want)
+		require.NoError(t, err, tc.want.String())
+		d, err := img.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, digests[tc.key], d, tc.want.String())
+	}
+}
+
+func TestFetchImageMissingPlatform(t *testing.T) {
+	idx, _ := platformIndex(t,
+		v1.Platform{OS: "linux", Architecture: "amd64"},
+		v1.Platform{OS: "unknown", Architecture: "unknown"},
+		v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"},
+	)
+	ref := pushImage(t, idx, nil)
+
+	_, _, err := fetchImage(ref, v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrPlatformNotFound))
+	assert.Contains(t, err.Error(), "linux/arm/v7")
+	assert.Contains(t, err.Error(), "available: linux/amd64, linux/arm/v6")
+	assert.NotContains(t, err.Error(), "unknown")
+}
+
+func TestFetchImageSinglePlatform(t *testing.T) {
+	ref := pushImage(t, nil, platformImage(t, v1.Platform{OS: "linux", Architecture: "arm64"}))
+
+	img, resolved, err := fetchImage(ref, v1.Platform{OS: "linux", Architecture: "arm64"})
+	require.NoError(t, err)
+	d, err := img.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, d, resolved, "a single-platform image resolves to itself")
+
+	_, _, err = fetchImage(ref, v1.Platform{OS: "linux", Architecture: "amd64"})
+	assert.ErrorIs(t, err, ErrPlatformNotFound)
+}
+
+func TestRemoveRegistryCacheAllPlatforms(t *testing.T) {
+	cacheDir := t.TempDir()
+	var dirs []string
+	for _, key := range []string{"alpine_latest", "alpine_latest@linux_amd64", "alpine_latest@linux_arm64"} {
+		dir := filepath.Join(cacheDir, key)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		dirs = append(dirs, dir)
+	}
+	other := filepath.Join(cacheDir, "alpine_3.19@linux_amd64")
+	require.NoError(t, os.MkdirAll(other, 0755))
+
+	require.NoError(t, RemoveRegistryCache("alpine:latest", cacheDir))
+	for _, dir := range dirs {
+		assert.NoDirExists(t, dir)
+	}
+	assert.DirExists(t, other)
+}
+
+// rootfsImage returns a host-platform image that converts to a rootfs.
+func rootfsImage(t *testing.T, content string) v1.Image {
+	t.Helper()
+	img, err := mutate.AppendLayers(empty.Image, tarLayer(t, map[string]string{"etc/release": content}))
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg = cfg.DeepCopy()
+	p := DefaultPlatform()
+	cfg.OS, cfg.Architecture, cfg.Variant = p.OS, p.Architecture, p.Variant
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+	return img
+}
+
+func TestBuildDigestPinned(t *testing.T) {
+	fakeTool(t, "sqfstar", `cat > "$3"`)
+	img := rootfsImage(t, "v1")
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: DefaultPlatform().OS, Architecture: DefaultPlatform().Architecture, Variant: DefaultPlatform().Variant}},
+	})
+	ref := pushImage(t, idx, nil)
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+	idxDigest, err := idx.Digest()
+	require.NoError(t, err)
+
+	newBuilder := func() *Builder {
+		return NewBuilder(&BuildOptions{
+			CacheDir:      t.TempDir(),
+			LayerCacheDir: filepath.Join(t.TempDir(), "layers"),
+			RootfsFormat:  FormatSquashfs,
+		})
+	}
+
+	// Either the manifest list or the platform image may be pinned; the
+	// result records the image that was converted.
+	for _, pinned := range []v1.Hash{idxDigest, imgDigest} {
+		b := newBuilder()
+		pinnedRef := ref.Context().Digest(pinned.String()).String()
+		result, err := b.Build(context.Background(), pinnedRef)
+		require.NoError(t, err, pinned.String())
+		assert.Equal(t, imgDigest.String(), result.Digest)
+
+		cached, err := b.Build(context.Background(), pinnedRef)
+		require.NoError(t, err)
+		assert.True(t, cached.Cached)
+		assert.Equal(t, imgDigest.String(), cached.Digest, "cache hits report the full digest")
+	}
+
+	other, err := rootfsImage(t, "v2").Digest()
+	require.NoError(t, err)
+	_, err = newBuilder().Build(context.Background(), ref.Context().Digest(other.String()).String())
+	require.ErrorIs(t, err, ErrPullImage, "unknown digest")
+}
+
+func TestBuildDigestPinnedFailsClosed(t *testing.T) {
+	fakeTool(t, "sqfstar", `cat > "$3"`)
+	// The registry answers every manifest request with what "latest" points
+	// at, as a compromised mirror might.
+	reg := registry.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i := strings.Index(r.URL.Path, "/manifests/sha256:"); i >= 0 {
+			r.URL.Path = r.URL.Path[:i] + "/manifests/latest"
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	ref, err := name.ParseReference(strings.TrimPrefix(srv.URL, "http://") + "/test/image:latest")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, rootfsImage(t, "tampered")))
+	want, err := rootfsImage(t, "trusted").Digest()
+	require.NoError(t, err)
+
+	cacheDir := t.TempDir()
+	b := NewBuilder(&BuildOptions{
+		CacheDir:      cacheDir,
+		LayerCacheDir: filepath.Join(t.TempDir(), "layers"),
+		RootfsFormat:  FormatSquashfs,
+	})
+	_, err = b.Build(context.Background(), ref.Context().Digest(want.String()).String())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), want.String())
+
+	images, err := ListRegistryCache(cacheDir)
+	require.NoError(t, err)
+	assert.Empty(t, images, "nothing is converted from the wrong content")
+}
@@ -0,0 +1,187 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"gopkg.in/yaml.v3"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// DefaultPrefetchConcurrency is the number of images pulled at once when a
+// prefetch does not say otherwise. Pulls are network and disk bound, so a
+// small number keeps them from starving sandboxes started meanwhile.
+const DefaultPrefetchConcurrency = 2
+
+// PrefetchImage is an image to warm ahead of use. Images with a higher
+// priority are scheduled first; ties keep their manifest order.
+type PrefetchImage struct {
+	Image    string `yaml:"image" json:"image"`
+	Priority int    `yaml:"priority,omitempty" json:"priority,omitempty"`
+}
+
+// UnmarshalYAML accepts either a bare reference or an {image, priority} map.
+func (p *PrefetchImage) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*p = PrefetchImage{Image: node.Value}
+		return nil
+	}
+	type plain PrefetchImage
+	return node.Decode((*plain)(p))
+}
+
+// UnmarshalJSON accepts either a bare reference or an {image, priority} object.
+func (p *PrefetchImage) UnmarshalJSON(data []byte) error {
+	var ref string
+	if err := json.Unmarshal(data, &ref); err == nil {
+		*p = PrefetchImage{Image: ref}
+		return nil
+	}
+	type plain PrefetchImage
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// PrefetchManifest lists the images a platform expects its sandboxes to use:
+//
+//	concurrency: 4
+//	images:
+//	  - image: python:3.12-slim
+//	    priority: 10
+//	  - alpine:latest
+type PrefetchManifest struct {
+	Concurrency int             `yaml:"concurrency,omitempty" json:"concurrency,omitempty"`
+	Images      []PrefetchImage `yaml:"images" json:"images"`
+}
+
+// PrefetchResult reports the outcome of warming one image.
+type PrefetchResult struct {
+	Image      string `json:"image"`
+	Digest     string `json:"digest,omitempty"`
+	Cached     bool   `json:"cached"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// LoadPrefetchManifest reads and validates a prefetch manifest file.
+func LoadPrefetchManifest(path string) (*PrefetchManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errx.Wrap(ErrPrefetchManifest, err)
+	}
+	defer f.Close()
+	return ParsePrefetchManifest(f)
+}
+
+// ParsePrefetchManifest decodes and validates a YAML (or JSON) prefetch
+// manifest.
+func ParsePrefetchManifest(r io.Reader) (*PrefetchManifest, error) {
+	var m PrefetchManifest
+	if err := yaml.NewDecoder(r).Decode(&m); err != nil && err != io.EOF {
+		return nil, errx.Wrap(ErrPrefetchManifest, err)
+	}
+	if err := ValidatePrefetch(m.Images, m.Concurrency); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ValidatePrefetch checks that there is at least one image, every reference
+// parses, and the concurrency is not negative (zero means the default).
+func ValidatePrefetch(images []PrefetchImage, concurrency int) error {
+	if len(images) == 0 {
+		return errx.With(ErrPrefetchManifest, ": no images listed")
+	}
+	if concurrency < 0 {
+		return errx.With(ErrPrefetchManifest, ": concurrency must not be negative, got %d", concurrency)
+	}
+	for _, img := range images {
+		if _, err := name.ParseReference(img.Image); err != nil {
+			return errx.With(ErrPrefetchManifest, ": image %q: %w", img.Image, err)
+		}
+	}
+	return nil
+}
+
+// Prefetch pulls and converts images so later sandboxes start from the local
+// cache. At most concurrency images are processed at once. onResult, if not
+// nil, is called as each image finishes; it may be called concurrently.
+// Results are returned in scheduling order.
+func (b *Builder) Prefetch(ctx context.Context, images []PrefetchImage, concurrency int, onResult func(PrefetchResult)) []PrefetchResult {
+	return prefetch(ctx, b.Build, images, concurrency, onResult)
+}
+
+func prefetch(ctx context.Context, build func(context.Context, string) (*BuildResult, error), images []PrefetchImage, concurrency int, onResult func(PrefetchResult)) []PrefetchResult {
+	refs := prefetchOrder(images)
+	if concurrency <= 0 {
+		concurrency = DefaultPrefetchConcurrency
+	}
+
+	results := make([]PrefetchResult, len(refs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(refs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = prefetchOne(ctx, build, refs[i])
+				if onResult != nil {
+					onResult(results[i])
+				}
+			}
+		}()
+	}
+	for i := range refs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+func prefetchOne(ctx context.Context, build func(context.Context, string) (*BuildResult, error), ref string) PrefetchResult {
+	start := time.Now()
+	result := PrefetchResult{Image: ref}
+	if err := ctx.Err(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	built, err := build(ctx, ref)
+	result.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Digest = built.Digest
+	result.Cached = built.Cached
+	return result
+}
+
+// prefetchOrder returns the unique references in images, highest priority
+// first.
+func prefetchOrder(images []PrefetchImage) []string {
+	sorted := make([]PrefetchImage, len(images))
+	copy(sorted, images)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+
+	seen := make(map[string]bool, len(sorted))
+	refs := make([]string, 0, len(sorted))
+	for _, img := range sorted {
+		if seen[img.Image] {
+			continue
+		}
+		seen[img.Image] = true
+		refs = append(refs, img.Image)
+	}
+	return refs
+}
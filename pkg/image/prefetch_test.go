@@ -0,0 +1,132 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrefetchManifest(t *testing.T) {
+	m, err := ParsePrefetchManifest(strings.NewReader(`
+concurrency: 3
+images:
+  - alpine:latest
+  - image: python:3.12-slim
+    priority: 10
+`))
+	require.NoError(t, err)
+	assert.Equal(t, 3, m.Concurrency)
+	assert.Equal(t, []PrefetchImage{
+		{Image: "alpine:latest"},
+		{Image: "python:3.12-slim", Priority: 10},
+	}, m.Images)
+}
+
+func TestParsePrefetchManifestInvalid(t *testing.T) {
+	for name, manifest := range map[string]string{
+		"empty":       ``,
+		"no images":   `concurrency: 2`,
+		"negative":    "concurrency: -1\nimages: [alpine]",
+		"bad ref":     `images: ["UPPER/case:latest"]`,
+		"not a list":  `images: alpine`,
+		"wrong field": `images: [{image: [1, 2]}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParsePrefetchManifest(strings.NewReader(manifest))
+			assert.ErrorIs(t, err, ErrPrefetchManifest)
+		})
+	}
+}
+
+func TestPrefetchImageUnmarshalJSON(t *testing.T) {
+	var m PrefetchManifest
+	require.NoError(t, json.Unmarshal([]byte(`{"images":["alpine",{"image":"busybox","priority":2}]}`), &m))
+	assert.Equal(t, []PrefetchImage{{Image: "alpine"}, {Image: "busybox", Priority: 2}}, m.Images)
+}
+
+func TestPrefetchOrdersByPriorityAndDedupes(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		built []string
+	)
+	build := func(ctx context.Context, ref string) (*BuildResult, error) {
+		mu.Lock()
+		built = append(built, ref)
+		mu.Unlock()
+		return &BuildResult{Digest: "sha256:" + ref, Cached: ref == "alpine"}, nil
+	}
+
+	results := prefetch(context.Background(), build, []PrefetchImage{
+		{Image: "alpine"},
+		{Image: "python", Priority: 5},
+		{Image: "alpine"},
+		{Image: "node", Priority: 5},
+	}, 1, nil)
+
+	assert.Equal(t, []string{"python", "node", "alpine"}, built)
+	require.Len(t, results, 3)
+	assert.Equal(t, "python", results[0].Image)
+	assert.Equal(t, "sha256:python", results[0].Digest)
+	assert.False(t, results[0].Cached)
+	assert.True(t, results[2].Cached)
+}
+
+func TestPrefetchLimitsConcurrency(t *testing.T) {
+	var running, peak atomic.Int32
+	build := func(ctx context.Context, ref string) (*BuildResult, error) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		running.Add(-1)
+		return &BuildResult{}, nil
+	}
+
+	images := []PrefetchImage{{Image: "a"}, {Image: "b"}, {Image: "c"}, {Image: "d"}, {Image: "e"}}
+	var reported atomic.Int32
+	prefetch(context.Background(), build, images, 2, func(PrefetchResult) { reported.Add(1) })
+
+	assert.LessOrEqual(t, peak.Load(), int32(2))
+	assert.Equal(t, int32(5), reported.Load())
+}
+
+func TestPrefetchReportsErrors(t *testing.T) {
+	build := func(ctx context.Context, ref string) (*BuildResult, error) {
+		if ref == "broken" {
+			return nil, errors.New("pull failed")
+		}
+		return &BuildResult{Digest: "sha256:ok"}, nil
+	}
+
+	results := prefetch(context.Background(), build, []PrefetchImage{{Image: "broken"}, {Image: "ok"}}, 0, nil)
+	require.Len(t, results, 2)
+	assert.Equal(t, "pull failed", results[0].Error)
+	assert.Empty(t, results[1].Error)
+}
+
+func TestPrefetchCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	build := func(ctx context.Context, ref string) (*BuildResult, error) {
+		called = true
+		return &BuildResult{}, nil
+	}
+
+	results := prefetch(ctx, build, []PrefetchImage{{Image: "alpine"}}, 1, nil)
+	assert.False(t, called)
+	assert.Equal(t, context.Canceled.Error(), results[0].Error)
+}
@@ -0,0 +1,274 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/storename"
+)
+
+// RegistryConfig redirects image pulls for networks where public registries
+// are slow or unreachable. It is read from a registries file:
+//
+//	{
+//	  "mirrors": {"docker.io": ["mirror.corp/dockerhub"]},
+//	  "rewrites": {"ghcr.io": "registry.corp:5000/ghcr"},
+//	  "insecure": ["registry.corp:5000"]
+//	}
+//
+// Mirrors are tried in order before the registry itself. Rewrites replace
+// the registry outright, so it is never contacted, as air-gapped networks
+// need. Targets are a host with an optional path prefix that repositories
+// are placed under. Insecure registries are reached over plain HTTP.
+type RegistryConfig struct {
+	Mirrors  map[string][]string `json:"mirrors,omitempty"`
+	Rewrites map[string]string   `json:"rewrites,omitempty"`
+	Insecure []string            `json:"insecure,omitempty"`
+}
+
+// DefaultRegistryConfigPath returns $MATCHLOCK_REGISTRIES, or
+// ~/.config/matchlock/registries.json.
+func DefaultRegistryConfigPath() string {
+	if p := os.Getenv("MATCHLOCK_REGISTRIES"); p != "" {
+		return p
+	}
+	return storename.ConfigPath("registries.json")
+}
+
+// LoadDefaultRegistryConfig loads the registries file at
+// DefaultRegistryConfigPath.
+func LoadDefaultRegistryConfig() (*RegistryConfig, error) {
+	return LoadRegistryConfig(DefaultRegistryConfigPath())
+}
+
+// LoadRegistryConfig reads a registries file. A missing file yields an
+// empty config, under which images are pulled from where they are named.
+func LoadRegistryConfig(path string) (*RegistryConfig, error) {
+	c := &RegistryConfig{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, errx.Wrap(ErrRegistryConfig, err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errx.With(ErrRegistryConfig, " %s: %w", path, err)
+	}
+	if err := c.normalize(); err != nil {
+		return nil, errx.With(err, " in %s", path)
+	}
+	return c, nil
+}
+
+// normalize validates the config and keys it by canonical registry name, so
+// "docker.io" matches references that resolve to index.docker.io.
+func (c *RegistryConfig) normalize() error {
+	mirrors := make(map[string][]string, len(c.Mirrors))
+	for host, targets := range c.Mirrors {
+		key, err := registryKey(host)
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			if err := validateTarget(target); err != nil {
+				return err
+			}
+		}
+		mirrors[key] = append(mirrors[key], targets...)
+	}
+	rewrites := make(map[string]string, len(c.Rewrites))
+	for host, target := range c.Rewrites {
+		key, err := registryKey(host)
+		if err != nil {
+			return err
+		}
+		if err := validateTarget(target); err != nil {
+			return err
+		}
+		rewrites[key] = target
+	}
+	insecure := make([]string, 0, len(c.Insecure))
+	for _, host := range c.Insecure {
+		key, err := registryKey(host)
+		if err != nil {
+			return err
+		}
+		insecure = append(insecure, key)
+	}
+	c.Mirrors, c.Rewrites, c.Insecure = mirrors, rewrites, insecure
+	return nil
+}
+
+func registryKey(host string) (string, error) {
+	reg, err := name.NewRegistry(host)
+	if err != nil {
+		return "", errx.With(ErrRegistryConfig, ": registry %q: %w", host, err)
+	}
+	return reg.RegistryStr(), nil
+}
+
+func validateTarget(target string) error {
+	host, prefix, _ := strings.Cut(target, "/")
+	if _, err := registryKey(host); err != nil {
+		return err
+	}
+	if prefix != "" {
+		if _, err := name.NewRepository(host + "/" + prefix); err != nil {
+			return errx.With(ErrRegistryConfig, ": target %q: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// Sources returns the references ref is pulled from, in the order they are
+// tried: its mirrors then ref itself, or only its rewrite.
+func (c *RegistryConfig) Sources(ref name.Reference) ([]name.Reference, error) {
+	if c == nil {
+		return []name.Reference{ref}, nil
+	}
+	host := ref.Context().RegistryStr()
+	if target, ok := c.Rewrites[host]; ok {
+		r, err := c.retarget(ref, target)
+		if err != nil {
+			return nil, err
+		}
+		return []name.Reference{r}, nil
+	}
+
+	var sources []name.Reference
+	for _, target := range c.Mirrors[host] {
+		r, err := c.retarget(ref, target)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, r)
+	}
+	if slices.Contains(c.Insecure, host) {
+		r, err := c.retarget(ref, host)
+		if err != nil {
+			return nil, err
+		}
+		ref = r
+	}
+	return append(sources, ref), nil
+}
+
+// retarget moves ref's repository to target, keeping its tag or digest.
+func (c *RegistryConfig) retarget(ref name.Reference, target string) (name.Reference, error) {
+	host, _, _ := strings.Cut(target, "/")
+	var opts []name.Option
+	if key, err := registryKey(host); err == nil && slices.Contains(c.Insecure, key) {
+		opts = append(opts, name.Insecure)
+	}
+	s := strings.TrimSuffix(target, "/") + "/" + ref.Context().RepositoryStr()
+	if _, ok := ref.(name.Digest); ok {
+		s += "@" + ref.Identifier()
+	} else {
+		s += ":" + ref.Identifier()
+	}
+	r, err := name.ParseReference(s, opts...)
+	if err != nil {
+		return nil, errx.With(ErrRegistryConfig, ": %s via %s: %w", ref, target, err)
+	}
+	return r, nil
+}
+
+// BuildkitdConfig renders the config as a buildkitd.toml, so images that
+// BuildKit pulls for Dockerfile builds take the same route. BuildKit has no
+// rewrites; they become mirrors, which it prefers over the registry.
+func (c *RegistryConfig) BuildkitdConfig() string {
+	if c == nil {
+		return ""
+	}
+	type section struct {
+		mirrors []string
+		http    bool
+	}
+	sections := map[string]*section{}
+	get := func(host string) *section {
+		host = buildkitHost(host)
+		if sections[host] == nil {
+			sections[host] = &section{}
+		}
+		return sections[host]
+	}
+	for host, targets := range c.Mirrors {
+		get(host).mirrors = targets
+	}
+	for host, target := range c.Rewrites {
+		get(host).mirrors = []string{target}
+	}
+	for _, host := range c.Insecure {
+		get(host).http = true
+	}
+
+	hosts := make([]string, 0, len(sections))
+	for host := range sections {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var b strings.Builder
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "[registry.%s]\n", tomlString(host))
+		if s := sections[host]; len(s.mirrors) > 0 {
+			quoted := make([]string, len(s.mirrors))
+			for i, m := range s.mirrors {
+				quoted[i] = tomlString(m)
+			}
+			fmt.Fprintf(&b, "  mirrors = [%s]\n", strings.Join(quoted, ", "))
+		}
+		if sections[host].http {
+			b.WriteString("  http = true\n")
+		}
+	}
+	return b.String()
+}
+
+// buildkitHost names Docker Hub the way buildkitd.toml does.
+func buildkitHost(host string) string {
+	if host == name.DefaultRegistry {
+		return "docker.io"
+	}
+	return host
+}
+
+func tomlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// fetchFromSources resolves ref like fetchImage, trying each of its sources
+// in turn, and returns the one the image came from. If all fail, the error
+// is that of the last source with the others' appended.
+func fetchFromSources(ref name.Reference, registries *RegistryConfig, platform v1.Platform, opts ...remote.Option) (v1.Image, v1.Hash, name.Reference, error) {
+	sources, err := registries.Sources(ref)
+	if err != nil {
+		return nil, v1.Hash{}, nil, err
+	}
+	var failed []string
+	for i, src := range sources {
+		img, resolved, err := fetchImage(src, platform, opts...)
+		if err == nil {
+			return img, resolved, src, nil
+		}
+		if i == len(sources)-1 {
+			if len(failed) > 0 {
+				err = errx.With(err, " (mirrors: %s)", strings.Join(failed, "; "))
+			}
+			return nil, v1.Hash{}, nil, err
+		}
+		failed = append(failed, err.Error())
+	}
+	return nil, v1.Hash{}, nil, nil
+}
@@ -0,0 +1,149 @@
+package image
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRegistryConfig(t *testing.T, content string) (*RegistryConfig, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "registries.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return LoadRegistryConfig(path)
+}
+
+func sourceNames(t *testing.T, c *RegistryConfig, ref string) []string {
+	t.Helper()
+	r, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	sources, err := c.Sources(r)
+	require.NoError(t, err)
+	var names []string
+	for _, s := range sources {
+		names = append(names, s.Context().Scheme()+"://"+s.Name())
+	}
+	return names
+}
+
+func TestLoadRegistryConfig(t *testing.T) {
+	c, err := LoadRegistryConfig(filepath.Join(t.TempDir(), "missing.json"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://index.docker.io/library/alpine:latest"}, sourceNames(t, c, "alpine"))
+
+	for content, want := range map[string]error{
+		`not json`:                                     ErrRegistryConfig,
+		`{"mirrors":{"docker.io":["Bad Host"]}}`:       ErrRegistryConfig,
+		`{"rewrites":{"ghcr.io":"mirror.corp/UPPER"}}`: ErrRegistryConfig,
+		`{"insecure":["bad host"]}`:                    ErrRegistryConfig,
+	} {
+		_, err := writeRegistryConfig(t, content)
+		assert.ErrorIs(t, err, want, content)
+	}
+}
+
+func TestRegistrySources(t *testing.T) {
+	c, err := writeRegistryConfig(t, `{
+		"mirrors": {"docker.io": ["mirror.corp/dockerhub", "mirror2.corp"]},
+		"rewrites": {"ghcr.io": "registry.corp:5000/ghcr"},
+		"insecure": ["registry.corp:5000", "quay.example"]
+	}`)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"https://mirror.corp/dockerhub/library/alpine:3.19",
+		"https://mirror2.corp/library/alpine:3.19",
+		"https://index.docker.io/library/alpine:3.19",
+	}, sourceNames(t, c, "alpine:3.19"))
+
+	// Rewritten registries are never contacted; digests survive the move.
+	digest := "sha256:41157f177893a0c890606ffcbfb1d9d97341adcda731936ceabd2bcf79a86830"
+	assert.Equal(t, []string{"http://registry.corp:5000/ghcr/acme/app@" + digest},
+		sourceNames(t, c, "ghcr.io/acme/app@"+digest))
+
+	assert.Equal(t, []string{"http://quay.example/org/tool:latest"}, sourceNames(t, c, "quay.example/org/tool"))
+	assert.Equal(t, []string{"https://gcr.io/distroless/static:nonroot"}, sourceNames(t, c, "gcr.io/distroless/static:nonroot"))
+}
+
+func TestBuildkitdConfig(t *testing.T) {
+	c, err := writeRegistryConfig(t, `{
+		"mirrors": {"docker.io": ["mirror.corp/dockerhub"]},
+		"rewrites": {"ghcr.io": "registry.corp:5000/ghcr"},
+		"insecure": ["registry.corp:5000"]
+	}`)
+	require.NoError(t, err)
+
+	assert.Equal(t, `[registry."docker.io"]
+  mirrors = ["mirror.corp/dockerhub"]
+[registry."ghcr.io"]
+  mirrors = ["registry.corp:5000/ghcr"]
+[registry."registry.corp:5000"]
+  http = true
+`, c.BuildkitdConfig())
+
+	empty, err := LoadRegistryConfig(filepath.Join(t.TempDir(), "missing.json"))
+	require.NoError(t, err)
+	assert.Empty(t, empty.BuildkitdConfig())
+}
+
+func TestBuildThroughMirror(t *testing.T) {
+	fakeTool(t, "sqfstar", `cat > "$3"`)
+	mirror := pushImage(t, nil, rootfsImage(t, "mirrored"))
+	down := httptest.NewServer(registry.New())
+	down.Close()
+
+	newBuilder := func(config string) *Builder {
+		c, err := writeRegistryConfig(t, config)
+		require.NoError(t, err)
+		return NewBuilder(&BuildOptions{
+			CacheDir:      t.TempDir(),
+			LayerCacheDir: filepath.Join(t.TempDir(), "layers"),
+			RootfsFormat:  FormatSquashfs,
+			Registries:    c,
+		})
+	}
+	mirrorHost := mirror.Context().RegistryStr()
+	downHost := strings.TrimPrefix(down.URL, "http://")
+
+	// An unreachable mirror falls through to the next one.
+	b := newBuilder(`{"mirrors":{"ghcr.io":["` + downHost + `","` + mirrorHost + `"]}}`)
+	result, err := b.Build(context.Background(), "ghcr.io/test/image:latest")
+	require.NoError(t, err)
+	want, err := rootfsImage(t, "mirrored").Digest()
+	require.NoError(t, err)
+	assert.Equal(t, want.String(), result.Digest)
+
+	// A rewrite to an unreachable registry fails without trying ghcr.io.
+	b = newBuilder(`{"rewrites":{"ghcr.io":"` + downHost + `"}}`)
+	_, err = b.Build(context.Background(), "ghcr.io/test/image:latest")
+	require.ErrorIs(t, err, ErrPullImage)
+	assert.Contains(t, err.Error(), downHost)
+	assert.NotContains(t, err.Error(), "ghcr.io")
+}
+
+func TestFetchFromSourcesReportsMirrorErrors(t *testing.T) {
+	upstream := pushImage(t, nil, platformImage(t, DefaultPlatform()))
+	down := httptest.NewServer(registry.New())
+	down.Close()
+	downHost := strings.TrimPrefix(down.URL, "http://")
+
+	c, err := writeRegistryConfig(t, `{"mirrors":{"`+upstream.Context().RegistryStr()+`":["`+downHost+`"]}}`)
+	require.NoError(t, err)
+	missing, err := name.ParseReference(upstream.Context().Tag("missing").String())
+	require.NoError(t, err)
+
+	_, _, _, err = fetchFromSources(missing, c, DefaultPlatform(), remote.WithContext(context.Background()))
+	require.ErrorIs(t, err, ErrPullImage)
+	assert.Contains(t, err.Error(), "MANIFEST_UNKNOWN")
+	assert.Contains(t, err.Error(), "mirrors: ")
+	assert.Contains(t, err.Error(), downHost)
+}
@@ -0,0 +1,483 @@
+package image
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/uuid"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/storename"
+)
+
+// Conversion states, in lifecycle order.
+const (
+	ConversionQueued     = "queued"
+	ConversionConverting = "converting"
+	ConversionDone       = "done"
+	ConversionFailed     = "failed"
+)
+
+// Conversion tracks one OCI reference being turned into a rootfs artifact by
+// a Service.
+type Conversion struct {
+	ID            string     `json:"id"`
+	Image         string     `json:"image"`
+	Namespace     string     `json:"namespace,omitempty"`
+	State         string     `json:"state"`
+	QueuePosition int        `json:"queue_position,omitempty"`
+	Digest        string     `json:"digest,omitempty"`
+	Size          int64      `json:"size,omitempty"`
+	Cached        bool       `json:"cached,omitempty"`
+	OCI           *OCIConfig `json:"oci,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+
+	rootfsPath string
+}
+
+// ServiceOptions configures a conversion Service.
+type ServiceOptions struct {
+	// Concurrency is the number of conversions run at once. Zero means
+	// DefaultPrefetchConcurrency.
+	Concurrency int
+	// QueueSize bounds the conversions waiting for a worker. Zero means
+	// DefaultServiceQueueSize.
+	QueueSize int
+	// History bounds the finished conversions kept; the oldest are
+	// forgotten first. Zero means DefaultServiceHistory.
+	History int
+	// UserToken and AdminToken, if either is set, must be presented as a
+	// bearer token on every request. Users see and submit conversions of
+	// their own namespace; admins see all namespaces and may delete
+	// conversions. Without tokens every caller is an admin.
+	UserToken  string
+	AdminToken string
+}
+
+// Defaults of ServiceOptions.
+const (
+	DefaultServiceQueueSize = 64
+	DefaultServiceHistory   = 256
+)
+
+// Service converts OCI references into rootfs artifacts independently of
+// sandbox creation, so a few well-provisioned hosts can convert images for a
+// fleet. Conversions are queued, run with bounded concurrency, and their
+// artifacts can be downloaded over HTTP (see Handler).
+type Service struct {
+	build       func(context.Context, string) (*BuildResult, error)
+	concurrency int
+	history     int
+	userToken   string
+	adminToken  string
+	queue       chan *Conversion
+
+	mu          sync.Mutex
+	conversions map[string]*Conversion
+	byImage     map[string]*Conversion
+	pending     []*Conversion
+	finished    []*Conversion // oldest first, bounded by history
+}
+
+// NewService returns a conversion service backed by b. Call Run to start
+// processing the queue.
+func NewService(b *Builder, opts ServiceOptions) *Service {
+	return newService(b.Build, opts)
+}
+
+func newService(build func(context.Context, string) (*BuildResult, error), opts ServiceOptions) *Service {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultPrefetchConcurrency
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultServiceQueueSize
+	}
+	if opts.History <= 0 {
+		opts.History = DefaultServiceHistory
+	}
+	return &Service{
+		build:       build,
+		concurrency: opts.Concurrency,
+		history:     opts.History,
+		userToken:   opts.UserToken,
+		adminToken:  opts.AdminToken,
+		queue:       make(chan *Conversion, opts.QueueSize),
+		conversions: make(map[string]*Conversion),
+		byImage:     make(map[string]*Conversion),
+	}
+}
+
+// Run processes queued conversions until ctx is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for w := 0; w < s.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case c := <-s.queue:
+					s.convert(ctx, c)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Submit queues a conversion of ref in namespace. A reference that is
+// already queued or converting in the namespace is not converted again; its existing conversion is returned
+// instead. So is a digest reference already converted, but a converted tag
+// is converted anew, as it may since have moved; the builder's cache makes
+// that cheap when it has not. Failed conversions are retried.
+func (s *Service) Submit(namespace, ref string) (Conversion, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return Conversion{}, errx.Wrap(ErrParseReference, err)
+	}
+	_, pinned := parsed.(name.Digest)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := imageKey(namespace, ref)
+	if c, ok := s.byImage[key]; ok {
+		inFlight := c.State == ConversionQueued || c.State == ConversionConverting
+		if inFlight || (c.State == ConversionDone && pinned) {
+			return s.snapshot(c), nil
+		}
+	}
+
+	c := &Conversion{
+		ID:        "conv-" + uuid.New().String()[:8],
+		Image:     ref,
+		Namespace: namespace,
+		State:     ConversionQueued,
+		CreatedAt: time.Now().UTC(),
+	}
+	select {
+	case s.queue <- c:
+	default:
+		return Conversion{}, ErrQueueFull
+	}
+	s.conversions[c.ID] = c
+	s.byImage[key] = c
+	s.pending = append(s.pending, c)
+	return s.snapshot(c), nil
+}
+
+// Get returns the conversion with the given ID.
+func (s *Service) Get(id string) (Conversion, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.conversions[id]
+	if !ok {
+		return Conversion{}, false
+	}
+	return s.snapshot(c), true
+}
+
+// imageKey is the key of ref in namespace in s.byImage.
+func imageKey(namespace, ref string) string {
+	return namespace + "\x00" + ref
+}
+
+// AllNamespaces lists the conversions of every namespace.
+const AllNamespaces = "*"
+
+// List returns the conversions of namespace, or of all namespaces for
+// AllNamespaces, oldest first.
+func (s *Service) List(namespace string) []Conversion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Conversion, 0, len(s.conversions))
+	for _, c := range s.conversions {
+		if namespace == AllNamespaces || c.Namespace == namespace {
+			list = append(list, s.snapshot(c))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Delete forgets the finished conversion with the given ID, so its
+// reference is converted anew when next submitted.
+func (s *Service) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.conversions[id]
+	if !ok {
+		return errx.With(ErrImageNotFound, ": conversion %s", id)
+	}
+	if c.FinishedAt == nil {
+		return errx.With(ErrConversionBusy, ": %s is %s", id, c.State)
+	}
+	s.forget(c)
+	if i := slices.Index(s.finished, c); i >= 0 {
+		s.finished = slices.Delete(s.finished, i, i+1)
+	}
+	return nil
+}
+
+func (s *Service) convert(ctx context.Context, c *Conversion) {
+	s.mu.Lock()
+	for i, p := range s.pending {
+		if p == c {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+	now := time.Now().UTC()
+	c.State = ConversionConverting
+	c.StartedAt = &now
+	s.mu.Unlock()
+
+	result, err := s.build(ctx, c.Image)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now().UTC()
+	c.FinishedAt = &finished
+	s.retire(c)
+	if err != nil {
+		c.State = ConversionFailed
+		c.Error = err.Error()
+		return
+	}
+	c.State = ConversionDone
+	c.Digest = result.Digest
+	c.Size = result.Size
+	c.Cached = result.Cached
+	c.OCI = result.OCI
+	c.rootfsPath = result.RootfsPath
+}
+
+// retire records c as finished, forgetting the oldest finished conversion
+// once more than s.history are kept. Callers must hold s.mu.
+func (s *Service) retire(c *Conversion) {
+	s.finished = append(s.finished, c)
+	if len(s.finished) <= s.history {
+		return
+	}
+	s.forget(s.finished[0])
+	s.finished = s.finished[1:]
+}
+
+// forget drops c from the service's indexes. Callers must hold s.mu.
+func (s *Service) forget(c *Conversion) {
+	delete(s.conversions, c.ID)
+	if key := imageKey(c.Namespace, c.Image); s.byImage[key] == c {
+		delete(s.byImage, key)
+	}
+}
+
+// snapshot copies c for callers, filling in its queue position. Callers must
+// hold s.mu.
+func (s *Service) snapshot(c *Conversion) Conversion {
+	out := *c
+	if c.State == ConversionQueued {
+		for i, p := range s.pending {
+			if p == c {
+				out.QueuePosition = i + 1
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Handler serves the conversion API:
+//
+//	POST   /v1/conversions              {"image":"alpine:latest"} → Conversion
+//	GET    /v1/conversions              → []Conversion
+//	GET    /v1/conversions/{id}         → Conversion
+//	DELETE /v1/conversions/{id}         forget a finished conversion (admin)
+//	GET    /v1/conversions/{id}/rootfs  → ext4 artifact (supports Range)
+//
+// Requests name their namespace in the X-Matchlock-Namespace header; an
+// admin naming none sees every namespace. Without tokens the API is
+// unauthenticated; expose it only on trusted networks.
+func (s *Service) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/conversions", s.handleSubmit)
+	mux.HandleFunc("GET /v1/conversions", s.handleList)
+	mux.HandleFunc("GET /v1/conversions/{id}", s.handleGet)
+	mux.HandleFunc("DELETE /v1/conversions/{id}", s.handleDelete)
+	mux.HandleFunc("GET /v1/conversions/{id}/rootfs", s.handleRootfs)
+	return s.authenticate(mux)
+}
+
+// NamespaceHeader names the namespace of a request to the service.
+const NamespaceHeader = "X-Matchlock-Namespace"
+
+// caller is who made a request, as established by authenticate.
+type caller struct {
+	admin     bool
+	namespace string
+}
+
+type callerKey struct{}
+
+func callerOf(r *http.Request) caller {
+	c, _ := r.Context().Value(callerKey{}).(caller)
+	return c
+}
+
+// sees reports whether the caller may see conversions of namespace.
+func (c caller) sees(namespace string) bool {
+	return (c.admin && c.namespace == "") || c.namespace == namespace
+}
+
+// authenticate establishes the caller of each request from its bearer
+// token and namespace header.
+func (s *Service) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c caller
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch {
+		case s.userToken == "" && s.adminToken == "":
+			c.admin = true
+		case s.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1:
+			c.admin = true
+		case s.userToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.userToken)) == 1:
+		default:
+			writeJSONError(w, http.StatusUnauthorized, "a valid bearer token is required")
+			return
+		}
+		c.namespace = r.Header.Get(NamespaceHeader)
+		if c.namespace != "" {
+			if err := storename.Validate(ErrService, c.namespace); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid namespace "+strconv.Quote(c.namespace))
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, c)))
+	})
+}
+
+func (s *Service) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Image string `json:"image"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Image == "" {
+		writeJSONError(w, http.StatusBadRequest, "image is required")
+		return
+	}
+
+	c, err := s.Submit(callerOf(r).namespace, req.Image)
+	switch {
+	case errors.Is(err, ErrQueueFull):
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+	case err != nil:
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeJSON(w, http.StatusAccepted, c)
+	}
+}
+
+func (s *Service) handleList(w http.ResponseWriter, r *http.Request) {
+	who := callerOf(r)
+	namespace := who.namespace
+	if who.admin && namespace == "" {
+		namespace = AllNamespaces
+	}
+	writeJSON(w, http.StatusOK, s.List(namespace))
+}
+
+func (s *Service) handleGet(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.Get(r.PathValue("id"))
+	if !ok || !callerOf(r).sees(c.Namespace) {
+		writeJSONError(w, http.StatusNotFound, "conversion not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (s *Service) handleDelete(w http.ResponseWriter, r *http.Request) {
+	who := callerOf(r)
+	if !who.admin {
+		writeJSONError(w, http.StatusForbidden, "deleting conversions requires the admin token")
+		return
+	}
+	c, ok := s.Get(r.PathValue("id"))
+	if !ok || !who.sees(c.Namespace) {
+		writeJSONError(w, http.StatusNotFound, "conversion not found")
+		return
+	}
+	if err := s.Delete(c.ID); err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) handleRootfs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	c, ok := s.conversions[r.PathValue("id")]
+	var state, path, digest string
+	if ok {
+		ok = callerOf(r).sees(c.Namespace)
+		state, path, digest = c.State, c.rootfsPath, c.Digest
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "conversion not found")
+		return
+	}
+	if state != ConversionDone {
+		writeJSONError(w, http.StatusConflict, "conversion is "+state)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		writeJSONError(w, http.StatusGone, "artifact no longer available")
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Matchlock-Digest", digest)
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,123 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// ServiceClient calls the API of a conversion Service.
+type ServiceClient struct {
+	endpoint  string
+	token     string
+	namespace string
+	http      *http.Client
+}
+
+// NewServiceClient returns a client of the service at endpoint, presenting
+// token, if any, as a bearer token and making its requests in namespace.
+func NewServiceClient(endpoint, token, namespace string) *ServiceClient {
+	return &ServiceClient{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		token:     token,
+		namespace: namespace,
+		http:      http.DefaultClient,
+	}
+}
+
+// Submit queues a conversion of ref.
+func (c *ServiceClient) Submit(ctx context.Context, ref string) (Conversion, error) {
+	body, _ := json.Marshal(map[string]string{"image": ref})
+	var conv Conversion
+	err := c.call(ctx, http.MethodPost, "/v1/conversions", bytes.NewReader(body), &conv)
+	return conv, err
+}
+
+// Get returns the conversion with the given ID.
+func (c *ServiceClient) Get(ctx context.Context, id string) (Conversion, error) {
+	var conv Conversion
+	err := c.call(ctx, http.MethodGet, "/v1/conversions/"+id, nil, &conv)
+	return conv, err
+}
+
+// List returns the conversions the caller may see, oldest first.
+func (c *ServiceClient) List(ctx context.Context) ([]Conversion, error) {
+	var list []Conversion
+	err := c.call(ctx, http.MethodGet, "/v1/conversions", nil, &list)
+	return list, err
+}
+
+// Delete forgets a finished conversion; it takes the admin token.
+func (c *ServiceClient) Delete(ctx context.Context, id string) error {
+	return c.call(ctx, http.MethodDelete, "/v1/conversions/"+id, nil, nil)
+}
+
+// Download writes the rootfs artifact of a finished conversion to w.
+func (c *ServiceClient) Download(ctx context.Context, id string, w io.Writer) (int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/v1/conversions/"+id+"/rootfs", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, errx.Wrap(ErrService, err)
+	}
+	return n, nil
+}
+
+// call makes a request, decoding a JSON response into out unless it is nil.
+func (c *ServiceClient) call(ctx context.Context, method, path string, body io.Reader, out interface{}) error {
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errx.Wrap(ErrService, err)
+	}
+	return nil
+}
+
+// do makes a request, turning an error status into an error carrying the
+// service's message.
+func (c *ServiceClient) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, body)
+	if err != nil {
+		return nil, errx.Wrap(ErrService, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.namespace != "" {
+		req.Header.Set(NamespaceHeader, c.namespace)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, errx.Wrap(ErrService, err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var msg struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&msg)
+	kind := ErrService
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		kind = ErrServiceDenied
+	}
+	return nil, errx.With(kind, ": %s: %s", resp.Status, msg.Error)
+}
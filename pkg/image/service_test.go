@@ -0,0 +1,236 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitForState(t *testing.T, s *Service, id, state string) Conversion {
+	t.Helper()
+	var c Conversion
+	require.Eventually(t, func() bool {
+		c, _ = s.Get(id)
+		return c.State == state
+	}, 2*time.Second, 5*time.Millisecond)
+	return c
+}
+
+func TestServiceConvertsAndServesRootfs(t *testing.T) {
+	rootfs := filepath.Join(t.TempDir(), "rootfs.ext4")
+	require.NoError(t, os.WriteFile(rootfs, []byte("ext4-bytes"), 0644))
+
+	s := newService(func(ctx context.Context, ref string) (*BuildResult, error) {
+		return &BuildResult{RootfsPath: rootfs, Digest: "sha256:abc", Size: 10, OCI: &OCIConfig{User: "nobody"}}, nil
+	}, ServiceOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/v1/conversions", "application/json", strings.NewReader(`{"image":"alpine:latest"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var submitted Conversion
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&submitted))
+	assert.Equal(t, "alpine:latest", submitted.Image)
+
+	done := waitForState(t, s, submitted.ID, ConversionDone)
+	assert.Equal(t, "sha256:abc", done.Digest)
+	assert.Equal(t, "nobody", done.OCI.User)
+	require.NotNil(t, done.FinishedAt)
+
+	resp, err = http.Get(srv.URL + "/v1/conversions/" + submitted.ID + "/rootfs")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "sha256:abc", resp.Header.Get("X-Matchlock-Digest"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "ext4-bytes", string(body))
+}
+
+func TestServiceQueueAndDedupe(t *testing.T) {
+	release := make(chan struct{})
+	s := newService(func(ctx context.Context, ref string) (*BuildResult, error) {
+		<-release
+		return &BuildResult{Digest: "sha256:" + ref}, nil
+	}, ServiceOptions{Concurrency: 1, QueueSize: 2})
+
+	a, err := s.Submit("", "alpine")
+	require.NoError(t, err)
+	b, err := s.Submit("", "busybox")
+	require.NoError(t, err)
+	assert.Equal(t, 1, a.QueuePosition)
+	assert.Equal(t, 2, b.QueuePosition)
+
+	again, err := s.Submit("", "alpine")
+	require.NoError(t, err)
+	assert.Equal(t, a.ID, again.ID)
+
+	_, err = s.Submit("", "python")
+	assert.ErrorIs(t, err, ErrQueueFull)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	waitForState(t, s, a.ID, ConversionConverting)
+	queued, _ := s.Get(b.ID)
+	assert.Equal(t, 1, queued.QueuePosition)
+
+	close(release)
+	waitForState(t, s, b.ID, ConversionDone)
+	assert.Len(t, s.List(AllNamespaces), 2)
+}
+
+func TestServiceRetriesFailedConversion(t *testing.T) {
+	fail := true
+	s := newService(func(ctx context.Context, ref string) (*BuildResult, error) {
+		if fail {
+			return nil, errors.New("registry unavailable")
+		}
+		return &BuildResult{}, nil
+	}, ServiceOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	first, err := s.Submit("", "alpine")
+	require.NoError(t, err)
+	failed := waitForState(t, s, first.ID, ConversionFailed)
+	assert.Equal(t, "registry unavailable", failed.Error)
+
+	fail = false
+	second, err := s.Submit("", "alpine")
+	require.NoError(t, err)
+	assert.NotEqual(t, first.ID, second.ID)
+	waitForState(t, s, second.ID, ConversionDone)
+}
+
+func TestServiceHandlerErrors(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := newService(func(ctx context.Context, ref string) (*BuildResult, error) {
+		<-release
+		return &BuildResult{}, nil
+	}, ServiceOptions{})
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	for _, body := range []string{`{}`, `not json`, `{"image":"UPPER/case"}`} {
+		resp, err := http.Post(srv.URL+"/v1/conversions", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+
+	resp, err := http.Get(srv.URL + "/v1/conversions/conv-missing")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	c, err := s.Submit("", "alpine")
+	require.NoError(t, err)
+	resp, err = http.Get(srv.URL + "/v1/conversions/" + c.ID + "/rootfs")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestServiceReconvertsTagsAndForgetsOldConversions(t *testing.T) {
+	var builds []string
+	s := newService(func(ctx context.Context, ref string) (*BuildResult, error) {
+		builds = append(builds, ref)
+		return &BuildResult{}, nil
+	}, ServiceOptions{Concurrency: 1, History: 2})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	pinned := "alpine@sha256:" + strings.Repeat("a", 64)
+	first, err := s.Submit("", pinned)
+	require.NoError(t, err)
+	waitForState(t, s, first.ID, ConversionDone)
+	again, err := s.Submit("", pinned)
+	require.NoError(t, err)
+	assert.Equal(t, first.ID, again.ID, "a converted digest is not converted again")
+
+	tagged, err := s.Submit("", "alpine:latest")
+	require.NoError(t, err)
+	waitForState(t, s, tagged.ID, ConversionDone)
+	moved, err := s.Submit("", "alpine:latest")
+	require.NoError(t, err)
+	assert.NotEqual(t, tagged.ID, moved.ID, "a converted tag is converted anew")
+	waitForState(t, s, moved.ID, ConversionDone)
+	assert.Len(t, builds, 3)
+
+	list := s.List(AllNamespaces)
+	require.Len(t, list, 2, "only the latest finished conversions are kept")
+	assert.Equal(t, []string{tagged.ID, moved.ID}, []string{list[0].ID, list[1].ID})
+	_, ok := s.Get(first.ID)
+	assert.False(t, ok)
+}
+
+func TestServiceRolesAndNamespaces(t *testing.T) {
+	rootfs := filepath.Join(t.TempDir(), "rootfs.ext4")
+	require.NoError(t, os.WriteFile(rootfs, []byte("ext4-bytes"), 0644))
+	s := newService(func(ctx context.Context, ref string) (*BuildResult, error) {
+		return &BuildResult{RootfsPath: rootfs}, nil
+	}, ServiceOptions{UserToken: "user-secret", AdminToken: "admin-secret"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	_, err := NewServiceClient(srv.URL, "", "").List(ctx)
+	assert.ErrorIs(t, err, ErrServiceDenied, "a token is required")
+	_, err = NewServiceClient(srv.URL, "wrong", "").List(ctx)
+	assert.ErrorIs(t, err, ErrServiceDenied)
+
+	teamA := NewServiceClient(srv.URL, "user-secret", "team-a")
+	teamB := NewServiceClient(srv.URL, "user-secret", "team-b")
+	admin := NewServiceClient(srv.URL+"/", "admin-secret", "")
+
+	conv, err := teamA.Submit(ctx, "alpine:latest")
+	require.NoError(t, err)
+	assert.Equal(t, "team-a", conv.Namespace)
+	waitForState(t, s, conv.ID, ConversionDone)
+
+	var out bytes.Buffer
+	_, err = teamA.Download(ctx, conv.ID, &out)
+	require.NoError(t, err)
+	assert.Equal(t, "ext4-bytes", out.String())
+
+	list, err := teamB.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, list, "namespaces are kept apart")
+	_, err = teamB.Get(ctx, conv.ID)
+	assert.ErrorIs(t, err, ErrService)
+	list, err = admin.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list, 1, "admins see every namespace")
+
+	assert.ErrorIs(t, teamA.Delete(ctx, conv.ID), ErrServiceDenied, "deleting takes the admin token")
+	require.NoError(t, admin.Delete(ctx, conv.ID))
+	_, ok := s.Get(conv.ID)
+	assert.False(t, ok)
+
+	_, err = NewServiceClient(srv.URL, "user-secret", "../etc").List(ctx)
+	assert.ErrorIs(t, err, ErrService)
+}
@@ -0,0 +1,201 @@
+package image
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/trust"
+)
+
+// cosignSignatureAnnotation carries the base64 signature of the payload in
+// each layer of a cosign signature image.
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// maxSignaturePayload bounds how much of a signature payload is read.
+const maxSignaturePayload = 1 << 20
+
+// simpleSigningPayload is the part of a cosign "simple signing" payload
+// that binds a signature to an image.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// VerifySignature checks that imageRef is signed as the builder's signature
+// policy requires, without converting it, and returns imageRef pinned to
+// the digest it resolved to. Dockerfile builds use it for FROM images,
+// which BuildKit pulls itself: building from the pinned reference keeps a
+// tag re-pushed after the check from swapping in an unverified image.
+// Without a policy imageRef is returned as it is.
+func (b *Builder) VerifySignature(ctx context.Context, imageRef string) (string, error) {
+	if b.signatures == nil {
+		return imageRef, nil
+	}
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return "", errx.Wrap(ErrParseReference, err)
+	}
+	opts := b.remoteOptions(ctx)
+	img, resolved, source, err := fetchFromSources(ref, b.registries, b.platform, opts...)
+	if err != nil {
+		return "", err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", errx.Wrap(ErrImageDigest, err)
+	}
+	if err := verifySignature(ctx, source, []v1.Hash{resolved, digest}, b.signatures, opts...); err != nil {
+		return "", err
+	}
+	if _, ok := ref.(name.Digest); ok {
+		return imageRef, nil
+	}
+	return imageRef + "@" + resolved.String(), nil
+}
+
+// verifySignature checks that one of digests, the manifest list and the
+// platform image ref resolved to, carries a signature from a signer policy
+// trusts. cosign signs whichever was named when signing, so either will do.
+// Key signatures are read from the registry's "sha256-<hex>.sig" tags;
+// keyless signatures need the cosign CLI to check Fulcio and Rekor.
+func verifySignature(ctx context.Context, ref name.Reference, digests []v1.Hash, policy *trust.ImagePolicy, opts ...remote.Option) error {
+	keys, err := policy.PublicKeys()
+	if err != nil {
+		return err
+	}
+	if len(digests) == 2 && digests[0] == digests[1] {
+		digests = digests[:1]
+	}
+
+	var reasons []string
+	for _, digest := range digests {
+		if len(keys) > 0 {
+			err := verifyKeySignature(ref.Context(), digest, keys, opts...)
+			if err == nil {
+				return nil
+			}
+			reasons = append(reasons, err.Error())
+		}
+		if len(policy.Identities) > 0 {
+			err := verifyKeyless(ctx, ref.Context().Digest(digest.String()).String(), policy.Identities)
+			if err == nil {
+				return nil
+			}
+			if errors.Is(err, ErrToolNotFound) {
+				return err
+			}
+			reasons = append(reasons, err.Error())
+		}
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, "no keys or identities are trusted")
+	}
+	return errx.With(ErrSignature, ": %s: %s", ref, strings.Join(reasons, "; "))
+}
+
+// verifyKeySignature looks for a cosign signature of digest by one of keys.
+func verifyKeySignature(repo name.Repository, digest v1.Hash, keys []crypto.PublicKey, opts ...remote.Option) error {
+	tag := repo.Tag(fmt.Sprintf("%s-%s.sig", digest.Algorithm, digest.Hex))
+	sigImg, err := remote.Image(tag, opts...)
+	if err != nil {
+		return errx.With(ErrNoSignature, " for %s", digest)
+	}
+	manifest, err := sigImg.Manifest()
+	if err != nil {
+		return errx.With(ErrReadSignature, " of %s: %w", digest, err)
+	}
+
+	for _, desc := range manifest.Layers {
+		sig, err := base64.StdEncoding.DecodeString(desc.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(sig) == 0 {
+			continue
+		}
+		layer, err := sigImg.LayerByDigest(desc.Digest)
+		if err != nil {
+			continue
+		}
+		payload, err := readPayload(layer)
+		if err != nil || !verifyBlob(keys, payload, sig) {
+			continue
+		}
+		var p simpleSigningPayload
+		if json.Unmarshal(payload, &p) == nil && p.Critical.Image.DockerManifestDigest == digest.String() {
+			return nil
+		}
+	}
+	return errx.With(ErrNoTrustedKey, ": %s", digest)
+}
+
+func readPayload(layer v1.Layer) ([]byte, error) {
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, maxSignaturePayload))
+}
+
+// verifyBlob reports whether sig is a signature of payload by one of keys,
+// using the schemes cosign signs with.
+func verifyBlob(keys []crypto.PublicKey, payload, sig []byte) bool {
+	sum := sha256.Sum256(payload)
+	for _, key := range keys {
+		switch k := key.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(k, sum[:], sig) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil {
+				return true
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, payload, sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyKeyless runs cosign verify against ref for each identity in turn.
+func verifyKeyless(ctx context.Context, ref string, identities []trust.ImageIdentity) error {
+	cosign, err := exec.LookPath("cosign")
+	if err != nil {
+		return errx.With(ErrToolNotFound, ": cosign; keyless image verification needs the sigstore cosign CLI")
+	}
+	var reasons []string
+	for _, id := range identities {
+		args := []string{"verify", "--certificate-oidc-issuer", id.Issuer}
+		if id.Subject != "" {
+			args = append(args, "--certificate-identity", id.Subject)
+		} else {
+			args = append(args, "--certificate-identity-regexp", id.SubjectRegexp)
+		}
+		out, err := exec.CommandContext(ctx, cosign, append(args, ref)...).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, fmt.Sprintf("cosign verify: %v: %s", err, strings.TrimSpace(string(out))))
+	}
+	return errx.With(ErrKeylessSignature, ": %s", strings.Join(reasons, "; "))
+}
@@ -0,0 +1,154 @@
+package image
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/trust"
+)
+
+// cosignKey returns a new cosign-style ECDSA key and the PEM of its public
+// half.
+func cosignKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// signImage pushes a cosign signature of digest, claiming claimed, to the
+// "sha256-<hex>.sig" tag of ref's repository.
+func signImage(t *testing.T, ref name.Reference, key *ecdsa.PrivateKey, digest, claimed v1.Hash) {
+	t.Helper()
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":%q},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`,
+		ref.Context().String(), claimed.String()))
+	sum := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	require.NoError(t, err)
+
+	sigImg, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(payload, types.MediaType("application/vnd.dev.cosign.simplesigning.v1+json")),
+		Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	require.NoError(t, err)
+	tag := ref.Context().Tag(fmt.Sprintf("%s-%s.sig", digest.Algorithm, digest.Hex))
+	require.NoError(t, remote.Write(tag, sigImg))
+}
+
+func TestVerifySignatureKey(t *testing.T) {
+	idx, digests := platformIndex(t, DefaultPlatform())
+	ref := pushImage(t, idx, nil)
+	idxDigest, err := idx.Digest()
+	require.NoError(t, err)
+	imgDigest := digests[DefaultPlatform().String()]
+
+	key, pub := cosignKey(t)
+	_, other := cosignKey(t)
+	ctx := context.Background()
+	trusting := func(key string) *Builder {
+		return NewBuilder(&BuildOptions{CacheDir: t.TempDir(), SignaturePolicy: &trust.ImagePolicy{Keys: []string{key}}})
+	}
+
+	_, err = trusting(pub).VerifySignature(ctx, ref.String())
+	require.ErrorIs(t, err, ErrSignature, "unsigned")
+
+	// Signing the manifest list covers every platform in it.
+	signImage(t, ref, key, idxDigest, idxDigest)
+	pinned, err := trusting(pub).VerifySignature(ctx, ref.String())
+	require.NoError(t, err)
+	assert.Equal(t, ref.String()+"@"+idxDigest.String(), pinned, "pinned to the verified digest")
+
+	_, err = trusting(other).VerifySignature(ctx, ref.String())
+	require.ErrorIs(t, err, ErrSignature, "untrusted key")
+	pinned, err = NewBuilder(&BuildOptions{CacheDir: t.TempDir()}).VerifySignature(ctx, ref.String())
+	require.NoError(t, err, "no policy")
+	assert.Equal(t, ref.String(), pinned)
+
+	// A signature is only good for the digest its payload names.
+	signImage(t, ref, key, imgDigest, idxDigest)
+	err = verifySignature(ctx, ref, []v1.Hash{imgDigest}, &trust.ImagePolicy{Keys: []string{pub}})
+	require.ErrorIs(t, err, ErrSignature, "payload for another digest")
+}
+
+func TestVerifySignatureKeyFile(t *testing.T) {
+	img := platformImage(t, DefaultPlatform())
+	ref := pushImage(t, nil, img)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	key, pub := cosignKey(t)
+	signImage(t, ref, key, digest, digest)
+	keyPath := filepath.Join(t.TempDir(), "cosign.pub")
+	require.NoError(t, os.WriteFile(keyPath, []byte(pub), 0644))
+
+	b := NewBuilder(&BuildOptions{CacheDir: t.TempDir(), SignaturePolicy: &trust.ImagePolicy{Keys: []string{keyPath}}})
+	_, err = b.VerifySignature(context.Background(), ref.String())
+	require.NoError(t, err)
+}
+
+func TestVerifySignatureKeyless(t *testing.T) {
+	img := platformImage(t, DefaultPlatform())
+	ref := pushImage(t, nil, img)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	argsFile := filepath.Join(t.TempDir(), "args")
+	fakeTool(t, "cosign", `echo "$@" > `+argsFile+`
+case "$*" in *--certificate-identity-regexp*) exit 0 ;; esac
+echo "no matching signatures" >&2; exit 1`)
+
+	policy := &trust.ImagePolicy{Identities: []trust.ImageIdentity{{Issuer: "https://issuer", Subject: "ci@example.com"}}}
+	err = verifySignature(context.Background(), ref, []v1.Hash{digest}, policy)
+	require.ErrorIs(t, err, ErrSignature)
+	assert.Contains(t, err.Error(), "no matching signatures")
+
+	policy.Identities = append(policy.Identities, trust.ImageIdentity{Issuer: "https://issuer", SubjectRegexp: "^ci@"})
+	require.NoError(t, verifySignature(context.Background(), ref, []v1.Hash{digest}, policy))
+	args, err := os.ReadFile(argsFile)
+	require.NoError(t, err)
+	assert.Equal(t, "verify --certificate-oidc-issuer https://issuer --certificate-identity-regexp ^ci@ "+ref.Context().Digest(digest.String()).String()+"\n", string(args))
+
+	t.Setenv("PATH", t.TempDir())
+	err = verifySignature(context.Background(), ref, []v1.Hash{digest}, policy)
+	require.ErrorIs(t, err, ErrToolNotFound)
+}
+
+func TestBuildRejectsUnsignedImage(t *testing.T) {
+	ref := pushImage(t, nil, platformImage(t, DefaultPlatform()))
+	_, pub := cosignKey(t)
+	cacheDir := t.TempDir()
+
+	b := NewBuilder(&BuildOptions{
+		CacheDir:        cacheDir,
+		LayerCacheDir:   filepath.Join(t.TempDir(), "layers"),
+		SignaturePolicy: &trust.ImagePolicy{Keys: []string{pub}},
+	})
+	_, err := b.Build(context.Background(), ref.String())
+	require.ErrorIs(t, err, ErrSignature)
+
+	entries, err := os.ReadDir(filepath.Join(cacheDir, registryCacheKey(ref.String(), DefaultPlatform())))
+	if err == nil {
+		assert.Empty(t, entries, "nothing is extracted from an unsigned image")
+	}
+}
@@ -0,0 +1,310 @@
+package image
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// snapshotsDir is where the registry cache keeps layer snapshots. Registry
+// entries always carry an "@platform" suffix, so it cannot clash with one.
+const snapshotsDir = "snapshots"
+
+// snapshotTempGrace protects extractions in progress, which may take a
+// while for large images, from a prune running alongside them.
+const snapshotTempGrace = 24 * time.Hour
+
+// SnapshotCache keeps the extracted tree of every layer prefix of the
+// images pulled from registries, keyed by layerChain. When a tag moves,
+// only the layers above the longest prefix its old and new image share are
+// fetched and applied before the rootfs is assembled again.
+//
+// Snapshots share files with each other, and with the trees checked out
+// from them, through hardlinks. That is safe because layer application and
+// rootfs creation replace files rather than write to them.
+type SnapshotCache struct {
+	dir string
+	// index records the parent of each snapshot, in the registry cache's
+	// index.
+	index *imageIndex
+}
+
+// NewSnapshotCache returns a snapshot cache rooted at dir, within the
+// registry cache.
+func NewSnapshotCache(dir string) *SnapshotCache {
+	return &SnapshotCache{dir: dir, index: registryIndex(filepath.Dir(dir))}
+}
+
+// snapshotFile is the recorded metadata of one entry of a snapshot.
+// Extended attribute values are binary, so they are kept as bytes.
+type snapshotFile struct {
+	UID      int               `json:"uid"`
+	GID      int               `json:"gid"`
+	Mode     os.FileMode       `json:"mode"`
+	Typeflag byte              `json:"typeflag,omitempty"`
+	Devmajor int64             `json:"devmajor,omitempty"`
+	Devminor int64             `json:"devminor,omitempty"`
+	Xattrs   map[string][]byte `json:"xattrs,omitempty"`
+	MTime    time.Time         `json:"mtime"`
+}
+
+// layerChain returns a key for each prefix of the layers of img, bottom
+// first. Keys are derived from the layer digests in the manifest the way
+// OCI chain IDs are from diff IDs, so that they name content which has
+// been verified when it is downloaded.
+func layerChain(img v1.Image) ([]v1.Hash, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, errx.Wrap(ErrPullImage, err)
+	}
+	chain := make([]v1.Hash, len(layers))
+	for i, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, errx.Wrap(ErrImageDigest, err)
+		}
+		if i == 0 {
+			chain[i] = digest
+			continue
+		}
+		if chain[i], _, err = v1.SHA256(strings.NewReader(chain[i-1].String() + " " + digest.String())); err != nil {
+			return nil, errx.Wrap(ErrImageDigest, err)
+		}
+	}
+	return chain, nil
+}
+
+func (c *SnapshotCache) path(key v1.Hash) string {
+	return filepath.Join(c.dir, key.Hex)
+}
+
+// checkout creates an extraction directory on the cache's filesystem, so
+// that snapshots can be linked into it, holding the longest prefix of chain
+// that has a snapshot. It returns the directory, the number of layers
+// already applied to it and their metadata.
+func (c *SnapshotCache) checkout(chain []v1.Hash) (string, int, map[string]fileMeta, error) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return "", 0, nil, errx.Wrap(ErrCreateDir, err)
+	}
+	dir, err := os.MkdirTemp(c.dir, "tmp-")
+	if err != nil {
+		return "", 0, nil, errx.Wrap(ErrCreateTemp, err)
+	}
+	for base := len(chain); base > 0; base-- {
+		snapshot := c.path(chain[base-1])
+		data, err := os.ReadFile(filepath.Join(snapshot, "metadata.json"))
+		if err != nil {
+			continue
+		}
+		var files map[string]snapshotFile
+		if err := json.Unmarshal(data, &files); err != nil {
+			continue
+		}
+		now := time.Now()
+		os.Chtimes(snapshot, now, now)
+		if err := cloneTree(filepath.Join(snapshot, "rootfs"), dir); err != nil {
+			// The snapshot was pruned or damaged; start over from scratch.
+			os.RemoveAll(dir)
+			if err := os.Mkdir(dir, 0700); err != nil {
+				return "", 0, nil, errx.Wrap(ErrCreateTemp, err)
+			}
+			break
+		}
+		meta := make(map[string]fileMeta, len(files))
+		for p, f := range files {
+			fm := fileMeta{uid: f.UID, gid: f.GID, mode: f.Mode, typeflag: f.Typeflag, devmajor: f.Devmajor, devminor: f.Devminor, mtime: f.MTime}
+			for name, value := range f.Xattrs {
+				if fm.xattrs == nil {
+					fm.xattrs = make(map[string]string, len(f.Xattrs))
+				}
+				fm.xattrs[name] = string(value)
+			}
+			meta[p] = fm
+		}
+		return dir, base, meta, nil
+	}
+	return dir, 0, make(map[string]fileMeta), nil
+}
+
+// apply applies the layers of img from base up to the tree at dir, and
+// records a snapshot after each of them.
+func (c *SnapshotCache) apply(img v1.Image, chain []v1.Hash, base int, dir string, meta map[string]fileMeta) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return errx.With(ErrExtract, ": layers: %w", err)
+	}
+	for i := base; i < len(layers); i++ {
+		if err := applyLayer(layers[i], dir, meta); err != nil {
+			return err
+		}
+		var parent v1.Hash
+		if i > 0 {
+			parent = chain[i-1]
+		}
+		// A snapshot that cannot be written only costs a later pull time.
+		c.commit(chain[i], parent, dir, meta)
+	}
+	return nil
+}
+
+// commit records the tree at src, with its metadata, as the snapshot key
+// on top of parent.
+func (c *SnapshotCache) commit(key, parent v1.Hash, src string, meta map[string]fileMeta) error {
+	if _, err := os.Stat(c.path(key)); err == nil {
+		return nil
+	}
+	tmp, err := os.MkdirTemp(c.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := cloneTree(src, filepath.Join(tmp, "rootfs")); err != nil {
+		return err
+	}
+	files := make(map[string]snapshotFile, len(meta))
+	for p, fm := range meta {
+		f := snapshotFile{UID: fm.uid, GID: fm.gid, Mode: fm.mode, Typeflag: fm.typeflag, Devmajor: fm.devmajor, Devminor: fm.devminor, MTime: fm.mtime}
+		for name, value := range fm.xattrs {
+			if f.Xattrs == nil {
+				f.Xattrs = make(map[string][]byte, len(fm.xattrs))
+			}
+			f.Xattrs[name] = []byte(value)
+		}
+		files[p] = f
+	}
+	data, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "metadata.json"), data, 0644); err != nil {
+		return err
+	}
+	if parent.Hex != "" {
+		if err := os.WriteFile(filepath.Join(tmp, "parent"), []byte(parent.Hex), 0644); err != nil {
+			return err
+		}
+	}
+	// Another pull may have committed the same snapshot meanwhile.
+	if err := os.Rename(tmp, c.path(key)); err != nil && !os.IsExist(err) {
+		if _, statErr := os.Stat(c.path(key)); statErr != nil {
+			return err
+		}
+	}
+	return c.index.update(func(state *indexState) error {
+		if state.Snapshots == nil {
+			state.Snapshots = make(map[string]string)
+		}
+		state.Snapshots[key.Hex] = parent.Hex
+		return nil
+	})
+}
+
+// prune removes the snapshots that are not an ancestor of any of keep,
+// leaving those used recently alone.
+func (c *SnapshotCache) prune(keep []string) error {
+	state, err := c.index.load()
+	if err != nil {
+		return err
+	}
+	needed := make(map[string]bool)
+	for _, key := range keep {
+		for key != "" && !needed[key] {
+			needed[key] = true
+			parent, ok := state.Snapshots[key]
+			if !ok {
+				data, _ := os.ReadFile(filepath.Join(c.dir, key, "parent"))
+				parent = strings.TrimSpace(string(data))
+			}
+			key = parent
+		}
+	}
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errx.With(ErrImageGC, ": snapshots: %w", err)
+	}
+	var removed []string
+	for _, e := range entries {
+		if needed[e.Name()] {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		grace := gcGracePeriod
+		if strings.HasPrefix(e.Name(), "tmp-") {
+			grace = snapshotTempGrace
+		}
+		if time.Since(fi.ModTime()) < grace {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(c.dir, e.Name())); err != nil {
+			return errx.With(ErrImageGC, ": snapshot %s: %w", e.Name(), err)
+		}
+		removed = append(removed, e.Name())
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	return c.index.update(func(state *indexState) error {
+		for _, key := range removed {
+			delete(state.Snapshots, key)
+		}
+		return nil
+	})
+}
+
+// pruneSnapshots removes the layer snapshots under cacheDir that no image
+// in the registry cache was assembled from.
+func pruneSnapshots(cacheDir string) error {
+	if cacheDir == "" {
+		home, _ := os.UserHomeDir()
+		cacheDir = filepath.Join(home, ".cache", "matchlock", "images")
+	}
+	entries, err := ListCacheEntries(cacheDir)
+	if err != nil {
+		return err
+	}
+	var keep []string
+	for _, e := range entries {
+		if e.Meta.Snapshot != "" {
+			keep = append(keep, e.Meta.Snapshot)
+		}
+	}
+	return NewSnapshotCache(filepath.Join(cacheDir, snapshotsDir)).prune(keep)
+}
+
+// cloneTree recreates the tree at src in dst, hardlinking its files.
+func cloneTree(src, dst string) error {
+	return lstatWalkErr(src, func(path string, info os.FileInfo) error {
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0755)
+		case info.Mode()&os.ModeSymlink != 0:
+			// Not every platform can hardlink a symlink itself.
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return os.Link(path, target)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func snapshotKey(t *testing.T, s string) v1.Hash {
+	t.Helper()
+	h, _, err := v1.SHA256(strings.NewReader(s))
+	require.NoError(t, err)
+	return h
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "usr/bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "usr/bin/ping"), []byte("ping"), 0755))
+	require.NoError(t, os.Symlink("usr/bin", filepath.Join(src, "bin")))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "null"), nil, 0600))
+	meta := map[string]fileMeta{
+		"/usr":          {mode: 0755},
+		"/usr/bin":      {mode: 0755},
+		"/usr/bin/ping": {uid: 1, gid: 2, mode: 0o4755, xattrs: map[string]string{"security.capability": "\x01\x00\x00\x02\xff"}},
+		"/bin":          {mode: 0777},
+		"/null":         {mode: 0666, typeflag: tar.TypeChar, devmajor: 1, devminor: 3},
+	}
+
+	c := NewSnapshotCache(filepath.Join(t.TempDir(), snapshotsDir))
+	key := snapshotKey(t, "base")
+	_, base, _, err := c.checkout([]v1.Hash{key})
+	require.NoError(t, err)
+	assert.Equal(t, 0, base, "nothing to start from yet")
+	require.NoError(t, c.commit(key, v1.Hash{}, src, meta))
+
+	dir, base, got, err := c.checkout([]v1.Hash{key, snapshotKey(t, "upper")})
+	require.NoError(t, err)
+	assert.Equal(t, 1, base)
+	assert.Equal(t, meta, got, "binary xattrs and device numbers survive")
+	assert.Equal(t, tree(t, src), tree(t, dir))
+
+	checkedOut, err := os.Stat(filepath.Join(dir, "usr/bin/ping"))
+	require.NoError(t, err)
+	original, err := os.Stat(filepath.Join(src, "usr/bin/ping"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(original, checkedOut), "files are linked, not copied")
+}
+
+func TestSnapshotPrune(t *testing.T) {
+	c := NewSnapshotCache(filepath.Join(t.TempDir(), snapshotsDir))
+	src := t.TempDir()
+	base, kept, dropped, fresh := snapshotKey(t, "base"), snapshotKey(t, "kept"), snapshotKey(t, "dropped"), snapshotKey(t, "fresh")
+	require.NoError(t, os.MkdirAll(c.dir, 0755))
+	require.NoError(t, c.commit(base, v1.Hash{}, src, nil))
+	require.NoError(t, c.commit(kept, base, src, nil))
+	require.NoError(t, c.commit(dropped, base, src, nil))
+	old := time.Now().Add(-2 * gcGracePeriod)
+	for _, key := range []v1.Hash{base, kept, dropped} {
+		require.NoError(t, os.Chtimes(c.path(key), old, old))
+	}
+	require.NoError(t, c.commit(fresh, base, src, nil))
+
+	require.NoError(t, c.prune([]string{kept.Hex}))
+	assert.DirExists(t, c.path(kept))
+	assert.DirExists(t, c.path(base), "ancestors of kept snapshots stay")
+	assert.DirExists(t, c.path(fresh), "snapshots of a pull in progress stay")
+	assert.NoDirExists(t, c.path(dropped))
+}
+
+func TestBuildReappliesOnlyNewLayers(t *testing.T) {
+	fakeTool(t, "sqfstar", `cat > "$3"`)
+	// The layer cache only holds host images, so for another platform every
+	// layer that is applied has to be downloaded.
+	platform := v1.Platform{OS: "linux", Architecture: "s390x"}
+	image := func(layers ...v1.Layer) v1.Image {
+		img, err := mutate.AppendLayers(empty.Image, layers...)
+		require.NoError(t, err)
+		cfg, err := img.ConfigFile()
+		require.NoError(t, err)
+		cfg = cfg.DeepCopy()
+		cfg.OS, cfg.Architecture = platform.OS, platform.Architecture
+		img, err = mutate.ConfigFile(img, cfg)
+		require.NoError(t, err)
+		return img
+	}
+
+	var mu sync.Mutex
+	pulls := map[string]int{}
+	reg := registry.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i := strings.Index(r.URL.Path, "/blobs/sha256:"); i >= 0 && r.Method == http.MethodGet {
+			mu.Lock()
+			pulls[r.URL.Path[i+len("/blobs/"):]]++
+			mu.Unlock()
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	ref, err := name.ParseReference(strings.TrimPrefix(srv.URL, "http://") + "/test/image:latest")
+	require.NoError(t, err)
+
+	base := tarLayer(t, map[string]string{"etc/base": "base"})
+	baseDigest, err := base.Digest()
+	require.NoError(t, err)
+	update := tarLayer(t, map[string]string{"app/version": "2"})
+	updateDigest, err := update.Digest()
+	require.NoError(t, err)
+
+	cacheDir := t.TempDir()
+	build := func() *BuildResult {
+		result, err := NewBuilder(&BuildOptions{
+			CacheDir:      cacheDir,
+			LayerCacheDir: filepath.Join(t.TempDir(), "layers"),
+			ForcePull:     true,
+			Platform:      platform,
+			RootfsFormat:  FormatSquashfs,
+		}).Build(context.Background(), ref.String())
+		require.NoError(t, err)
+		return result
+	}
+
+	require.NoError(t, remote.Write(ref, image(base, tarLayer(t, map[string]string{"app/version": "1"}))))
+	build()
+	require.Equal(t, 1, pulls[baseDigest.String()])
+
+	// The tag moves to an image on the same base.
+	require.NoError(t, remote.Write(ref, image(base, update)))
+	result := build()
+	assert.Equal(t, 1, pulls[baseDigest.String()], "the shared base is neither fetched nor applied again")
+	assert.Equal(t, 1, pulls[updateDigest.String()])
+
+	_, files := readTar(t, result.RootfsPath)
+	assert.Equal(t, "base", files["etc/base"])
+	assert.Equal(t, "2", files["app/version"])
+
+	images, err := ListRegistryCache(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, images, 1, "snapshots are not listed as images")
+	assert.NotEmpty(t, images[0].Meta.Snapshot)
+	assert.DirExists(t, filepath.Join(cacheDir, snapshotsDir, images[0].Meta.Snapshot))
+}
@@ -22,12 +22,19 @@ type OCIConfig struct {
 }
 
 type ImageMeta struct {
-	Tag       string     `json:"tag"`
-	Digest    string     `json:"digest,omitempty"`
-	Size      int64      `json:"size"`
-	CreatedAt time.Time  `json:"created_at"`
-	Source    string     `json:"source,omitempty"`
-	OCI       *OCIConfig `json:"oci,omitempty"`
+	Tag       string    `json:"tag"`
+	Digest    string    `json:"digest,omitempty"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Source    string    `json:"source,omitempty"`
+	Platform  string    `json:"platform,omitempty"`
+	Layers    int       `json:"layers,omitempty"`
+	// Snapshot names the layer snapshot a registry image was assembled
+	// from, which image pruning keeps.
+	Snapshot string `json:"snapshot,omitempty"`
+	// Reproducible records a rootfs converted with BuildOptions.Reproducible.
+	Reproducible bool       `json:"reproducible,omitempty"`
+	OCI          *OCIConfig `json:"oci,omitempty"`
 }
 
 type ImageInfo struct {
@@ -38,6 +45,7 @@ type ImageInfo struct {
 
 type Store struct {
 	baseDir string
+	index   *imageIndex
 }
 
 func NewStore(baseDir string) *Store {
@@ -45,7 +53,7 @@ func NewStore(baseDir string) *Store {
 		home, _ := os.UserHomeDir()
 		baseDir = filepath.Join(home, ".cache", "matchlock", "images", "local")
 	}
-	return &Store{baseDir: baseDir}
+	return &Store{baseDir: baseDir, index: storeIndex(baseDir)}
 }
 
 func (s *Store) Save(tag string, rootfsPath string, meta ImageMeta) error {
@@ -96,69 +104,51 @@ func (s *Store) Save(tag string, rootfsPath string, meta ImageMeta) error {
 		return errx.With(ErrMetadata, ": write: %w", err)
 	}
 
-	return nil
+	return s.index.put(sanitizeRef(tag), &indexEntry{
+		Rootfs:   map[RootfsFormat]string{FormatExt4: "rootfs.ext4"},
+		LastUsed: time.Now(),
+		Meta:     meta,
+	})
 }
 
 func (s *Store) Get(tag string) (*BuildResult, error) {
-	dir := filepath.Join(s.baseDir, sanitizeRef(tag))
-
-	metaPath := filepath.Join(dir, "metadata.json")
-	metaBytes, err := os.ReadFile(metaPath)
+	key := sanitizeRef(tag)
+	e, err := s.index.entry(key)
 	if err != nil {
-		return nil, errx.With(ErrImageNotFound, ": %q in local store", tag)
+		return nil, err
 	}
-
-	var meta ImageMeta
-	if err := json.Unmarshal(metaBytes, &meta); err != nil {
-		return nil, errx.With(ErrMetadata, ": read: %w", err)
+	if e == nil {
+		return nil, errx.With(ErrImageNotFound, ": %q in local store", tag)
 	}
 
-	rootfsPath := filepath.Join(dir, "rootfs.ext4")
-	if _, err := os.Stat(rootfsPath); err != nil {
+	rootfsPath := filepath.Join(s.baseDir, key, "rootfs.ext4")
+	fi, err := os.Stat(rootfsPath)
+	if err != nil {
 		return nil, errx.With(ErrImageNotFound, ": rootfs for %q", tag)
 	}
+	s.index.touch(key)
 
-	fi, _ := os.Stat(rootfsPath)
 	return &BuildResult{
 		RootfsPath: rootfsPath,
-		Digest:     meta.Digest,
+		Digest:     e.Meta.Digest,
 		Size:       fi.Size(),
 		Cached:     true,
-		OCI:        meta.OCI,
+		OCI:        e.Meta.OCI,
 	}, nil
 }
 
 func (s *Store) List() ([]ImageInfo, error) {
-	entries, err := os.ReadDir(s.baseDir)
+	state, err := s.index.load()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, errx.With(ErrStoreRead, ": store dir: %w", err)
+		return nil, err
 	}
 
 	var images []ImageInfo
-	for _, e := range entries {
-		if !e.IsDir() {
-			continue
-		}
-
-		metaPath := filepath.Join(s.baseDir, e.Name(), "metadata.json")
-		metaBytes, err := os.ReadFile(metaPath)
-		if err != nil {
-			continue
-		}
-
-		var meta ImageMeta
-		if err := json.Unmarshal(metaBytes, &meta); err != nil {
-			continue
-		}
-
-		rootfsPath := filepath.Join(s.baseDir, e.Name(), "rootfs.ext4")
+	for key, e := range state.Images {
 		images = append(images, ImageInfo{
-			Tag:        meta.Tag,
-			RootfsPath: rootfsPath,
-			Meta:       meta,
+			Tag:        e.Meta.Tag,
+			RootfsPath: e.rootfsPath(filepath.Join(s.baseDir, key)),
+			Meta:       e.Meta,
 		})
 	}
 
@@ -170,103 +160,116 @@ func (s *Store) List() ([]ImageInfo, error) {
 }
 
 func (s *Store) Remove(tag string) error {
-	dir := filepath.Join(s.baseDir, sanitizeRef(tag))
+	key := sanitizeRef(tag)
+	dir := filepath.Join(s.baseDir, key)
 	if _, err := os.Stat(dir); err != nil {
 		return errx.With(ErrImageNotFound, ": %q", tag)
 	}
-	return os.RemoveAll(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return s.index.update(func(state *indexState) error {
+		delete(state.Images, key)
+		return nil
+	})
 }
 
-// RemoveRegistryCache removes a registry-cached image by tag.
+// RemoveRegistryCache removes a registry-cached image by tag, for every
+// platform it was pulled for.
 func RemoveRegistryCache(tag string, cacheDir string) error {
 	if cacheDir == "" {
 		home, _ := os.UserHomeDir()
 		cacheDir = filepath.Join(home, ".cache", "matchlock", "images")
 	}
 
-	dir := filepath.Join(cacheDir, sanitizeRef(tag))
-	if dir == filepath.Clean(cacheDir) || dir == filepath.Join(cacheDir, "local") {
+	name := sanitizeRef(tag)
+	dir := filepath.Join(cacheDir, name)
+	if dir == filepath.Clean(cacheDir) || dir == filepath.Join(cacheDir, "local") || dir == filepath.Join(cacheDir, snapshotsDir) {
 		return errx.With(ErrImageNotFound, ": %q", tag)
 	}
-	if _, err := os.Stat(dir); err != nil {
+	// Caches from before per-platform keys have no "@platform" suffix.
+	// Directories are matched as well as index entries, so that broken
+	// and half-written entries can be removed too.
+	removed := 0
+	err := registryIndex(cacheDir).update(func(state *indexState) error {
+		entries, _ := os.ReadDir(cacheDir)
+		for _, e := range entries {
+			key := e.Name()
+			if !e.IsDir() || (key != name && !strings.HasPrefix(key, name+"@")) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(cacheDir, key)); err != nil {
+				return err
+			}
+			delete(state.Images, key)
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
 		return errx.With(ErrImageNotFound, ": %q", tag)
 	}
-	return os.RemoveAll(dir)
+	return pruneSnapshots(cacheDir)
 }
 
-// ListRegistryCache lists images cached from registry pulls (non-local store).
-func ListRegistryCache(cacheDir string) ([]ImageInfo, error) {
+// InspectImage returns the cached images stored under tag: the local
+// store's, then the registry cache's for each platform it was pulled for.
+func InspectImage(tag string, cacheDir string) ([]ImageInfo, error) {
 	if cacheDir == "" {
 		home, _ := os.UserHomeDir()
 		cacheDir = filepath.Join(home, ".cache", "matchlock", "images")
 	}
 
-	entries, err := os.ReadDir(cacheDir)
+	local, err := NewStore(filepath.Join(cacheDir, "local")).List()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, errx.With(ErrStoreRead, ": cache dir: %w", err)
+		return nil, err
+	}
+	registry, err := ListRegistryCache(cacheDir)
+	if err != nil {
+		return nil, err
 	}
 
 	var images []ImageInfo
-	for _, e := range entries {
-		if !e.IsDir() || e.Name() == "local" {
-			continue
+	for _, img := range append(local, registry...) {
+		if img.Tag == tag {
+			images = append(images, img)
 		}
+	}
+	if len(images) == 0 {
+		return nil, errx.With(ErrImageNotFound, ": %q", tag)
+	}
+	return images, nil
+}
 
-		subDir := filepath.Join(cacheDir, e.Name())
-
-		if metaBytes, err := os.ReadFile(filepath.Join(subDir, "metadata.json")); err == nil {
-			var meta ImageMeta
-			if err := json.Unmarshal(metaBytes, &meta); err == nil {
-				rootfsPath := ""
-				subEntries, _ := os.ReadDir(subDir)
-				for _, se := range subEntries {
-					if filepath.Ext(se.Name()) == ".ext4" {
-						rootfsPath = filepath.Join(subDir, se.Name())
-						break
-					}
-				}
-				images = append(images, ImageInfo{
-					Tag:        meta.Tag,
-					RootfsPath: rootfsPath,
-					Meta:       meta,
-				})
-				continue
-			}
-		}
+// ListRegistryCache lists images cached from registry pulls (non-local store).
+func ListRegistryCache(cacheDir string) ([]ImageInfo, error) {
+	if cacheDir == "" {
+		home, _ := os.UserHomeDir()
+		cacheDir = filepath.Join(home, ".cache", "matchlock", "images")
+	}
 
-		subEntries, err := os.ReadDir(subDir)
-		if err != nil {
-			continue
-		}
+	state, err := registryIndex(cacheDir).load()
+	if err != nil {
+		return nil, err
+	}
 
-		for _, se := range subEntries {
-			if filepath.Ext(se.Name()) == ".ext4" {
-				rootfsPath := filepath.Join(subDir, se.Name())
-				fi, _ := os.Stat(rootfsPath)
-				tag := e.Name()
-				var size int64
-				var modTime time.Time
-				if fi != nil {
-					size = fi.Size()
-					modTime = fi.ModTime()
-				}
-				images = append(images, ImageInfo{
-					Tag:        tag,
-					RootfsPath: rootfsPath,
-					Meta: ImageMeta{
-						Tag:       tag,
-						Digest:    strings.TrimSuffix(se.Name(), ".ext4"),
-						Size:      size,
-						CreatedAt: modTime,
-						Source:    "registry",
-					},
-				})
-			}
-		}
+	keys := make([]string, 0, len(state.Images))
+	for key := range state.Images {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
+	images := make([]ImageInfo, 0, len(keys))
+	for _, key := range keys {
+		e := state.Images[key]
+		images = append(images, ImageInfo{
+			Tag:        e.Meta.Tag,
+			RootfsPath: e.rootfsPath(filepath.Join(cacheDir, key)),
+			Meta:       e.Meta,
+		})
+	}
 	return images, nil
 }
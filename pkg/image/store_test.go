@@ -177,9 +177,45 @@ func TestListRegistryCacheFallbackNoMetadata(t *testing.T) {
 	imgDir := filepath.Join(cacheDir, "alpine_latest")
 	os.MkdirAll(imgDir, 0755)
 	os.WriteFile(filepath.Join(imgDir, "abc123def456.ext4"), []byte("rootfs"), 0644)
+	// Recent entries without metadata are conversions still in progress.
+	old := time.Now().Add(-2 * gcGracePeriod)
+	require.NoError(t, os.Chtimes(filepath.Join(imgDir, "abc123def456.ext4"), old, old))
 
 	images, err := ListRegistryCache(cacheDir)
 	require.NoError(t, err, "ListRegistryCache")
 	require.Len(t, images, 1)
 	assert.Equal(t, "alpine_latest", images[0].Tag, "raw dir name")
 }
+
+func TestInspectImage(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	rootfsFile := filepath.Join(t.TempDir(), "test.ext4")
+	require.NoError(t, os.WriteFile(rootfsFile, []byte("data"), 0644))
+	require.NoError(t, NewStore(filepath.Join(cacheDir, "local")).Save("alpine:latest", rootfsFile, ImageMeta{
+		Digest: "sha256:aaa",
+		OCI:    &OCIConfig{Entrypoint: []string{"/bin/sh"}},
+	}))
+
+	for dir, platform := range map[string]string{"alpine_latest@linux_amd64": "linux/amd64", "alpine_latest@linux_arm64": "linux/arm64"} {
+		imgDir := filepath.Join(cacheDir, dir)
+		require.NoError(t, os.MkdirAll(imgDir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(imgDir, "bbb.ext4"), []byte("rootfs"), 0644))
+		meta := `{"tag":"alpine:latest","digest":"sha256:bbb","size":6,"source":"registry","platform":"` + platform + `","layers":3,"oci":{"cmd":["sh"]}}`
+		require.NoError(t, os.WriteFile(filepath.Join(imgDir, "metadata.json"), []byte(meta), 0644))
+	}
+
+	images, err := InspectImage("alpine:latest", cacheDir)
+	require.NoError(t, err)
+	require.Len(t, images, 3)
+	assert.Equal(t, []string{"/bin/sh"}, images[0].Meta.OCI.Entrypoint, "local store first")
+	for _, img := range images[1:] {
+		assert.Equal(t, 3, img.Meta.Layers)
+		assert.Equal(t, []string{"sh"}, img.Meta.OCI.Cmd)
+		assert.Equal(t, "bbb.ext4", filepath.Base(img.RootfsPath))
+	}
+	assert.ElementsMatch(t, []string{"linux/amd64", "linux/arm64"}, []string{images[1].Meta.Platform, images[2].Meta.Platform})
+
+	_, err = InspectImage("ubuntu:latest", cacheDir)
+	require.ErrorIs(t, err, ErrImageNotFound)
+}
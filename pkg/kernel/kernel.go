@@ -24,6 +24,8 @@ const (
 	Version = "6.1.137"
 
 	DefaultRegistry = "ghcr.io/jingkaihe/matchlock"
+
+	signatureSuffix = ".sig"
 )
 
 type Architecture string
@@ -211,7 +213,11 @@ func extractKernelFromTar(data []byte, destPath, kernelFilename string) error {
 	return extractFromTarReader(tar.NewReader(bytes.NewReader(data)), destPath, kernelFilename)
 }
 
+// extractFromTarReader writes the kernel to destPath. A detached signature
+// shipped alongside it (kernelFilename + ".sig") is written next to destPath
+// so the kernel can be verified before each use.
 func extractFromTarReader(tr *tar.Reader, destPath, kernelFilename string) error {
+	found := false
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -221,29 +227,44 @@ func extractFromTarReader(tr *tar.Reader, destPath, kernelFilename string) error
 			return err
 		}
 
-		if filepath.Base(hdr.Name) == kernelFilename {
-			tmpPath := destPath + ".tmp"
-			f, err := os.Create(tmpPath)
-			if err != nil {
-				return errx.Wrap(ErrCreateFile, err)
-			}
-
-			_, err = io.Copy(f, tr)
-			f.Close()
-			if err != nil {
-				os.Remove(tmpPath)
+		switch filepath.Base(hdr.Name) {
+		case kernelFilename:
+			if err := writeAtomic(tr, destPath); err != nil {
 				return err
 			}
-
-			if err := os.Rename(tmpPath, destPath); err != nil {
-				os.Remove(tmpPath)
+			found = true
+		case kernelFilename + signatureSuffix:
+			if err := writeAtomic(tr, destPath+signatureSuffix); err != nil {
 				return err
 			}
-			return nil
 		}
 	}
 
-	return errx.With(ErrKernelNotFound, ": %s", kernelFilename)
+	if !found {
+		return errx.With(ErrKernelNotFound, ": %s", kernelFilename)
+	}
+	return nil
+}
+
+func writeAtomic(r io.Reader, destPath string) error {
+	tmpPath := destPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return errx.Wrap(ErrCreateFile, err)
+	}
+
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
 }
 
 func (m *Manager) ListCachedVersions() ([]string, error) {
@@ -1,6 +1,8 @@
 package kernel
 
 import (
+	"archive/tar"
+	"bytes"
 	"os"
 	"path/filepath"
 	"testing"
@@ -90,3 +92,31 @@ func TestParseVersion(t *testing.T) {
 		assert.Equal(t, tt.expected, ParseVersion(tt.ref))
 	}
 }
+
+func TestExtractKernelWithSignature(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"kernel.sig": "c2lnbmF0dXJl\n",
+		"kernel":     "vmlinux",
+		"README":     "ignored",
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	dest := filepath.Join(t.TempDir(), "kernel")
+	require.NoError(t, extractKernelFromTar(buf.Bytes(), dest, "kernel"))
+
+	data, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, "vmlinux", string(data))
+	sig, err := os.ReadFile(dest + ".sig")
+	require.NoError(t, err)
+	assert.Equal(t, "c2lnbmF0dXJl\n", string(sig))
+
+	err = extractKernelFromTar(buf.Bytes(), dest, "kernel-arm64")
+	assert.ErrorIs(t, err, ErrKernelNotFound)
+}
@@ -0,0 +1,97 @@
+package net
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// EgressBudget caps the total payload bytes the guest may send over proxied
+// connections. A nil *EgressBudget imposes no limit.
+type EgressBudget struct {
+	limit       int64
+	used        atomic.Int64
+	once        sync.Once
+	onExhausted func()
+}
+
+// NewEgressBudget returns a budget of limit bytes, or nil when limit is not
+// positive. onExhausted, if non-nil, is called once in its own goroutine
+// when the budget runs out.
+func NewEgressBudget(limit int64, onExhausted func()) *EgressBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &EgressBudget{limit: limit, onExhausted: onExhausted}
+}
+
+// Check returns an error wrapping api.ErrEgressBudget once the budget is
+// used up.
+func (b *EgressBudget) Check() error {
+	if b == nil || b.used.Load() < b.limit {
+		return nil
+	}
+	return errx.With(api.ErrEgressBudget, " (%d bytes)", b.limit)
+}
+
+// Usage returns the budget's consumption, or nil for an unlimited budget.
+func (b *EgressBudget) Usage() *api.EgressUsage {
+	if b == nil {
+		return nil
+	}
+	used := b.used.Load()
+	return &api.EgressUsage{
+		UsedBytes:  used,
+		LimitBytes: b.limit,
+		Exhausted:  used >= b.limit,
+	}
+}
+
+func (b *EgressBudget) consume(n int) {
+	if b.used.Add(int64(n)) < b.limit {
+		return
+	}
+	b.once.Do(func() {
+		if b.onExhausted != nil {
+			go b.onExhausted()
+		}
+	})
+}
+
+// budgetConn charges everything read from the guest side of conn to b.
+// Once the budget is exhausted reads fail, cutting the connection off, and
+// blocked is called once with the error. A nil budget returns conn
+// unchanged.
+func budgetConn(conn net.Conn, b *EgressBudget, blocked func(error)) net.Conn {
+	if b == nil {
+		return conn
+	}
+	return &budgetedConn{Conn: conn, budget: b, blocked: blocked}
+}
+
+type budgetedConn struct {
+	net.Conn
+	budget  *EgressBudget
+	blocked func(error)
+	once    sync.Once
+}
+
+func (c *budgetedConn) Read(p []byte) (int, error) {
+	remaining := c.budget.limit - c.budget.used.Load()
+	if remaining <= 0 {
+		err := c.budget.Check()
+		c.once.Do(func() { c.blocked(err) })
+		return 0, err
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.budget.consume(n)
+	}
+	return n, err
+}
@@ -0,0 +1,69 @@
+package net
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+func TestEgressBudgetNil(t *testing.T) {
+	b := NewEgressBudget(0, nil)
+	assert.Nil(t, b)
+	assert.NoError(t, b.Check())
+	assert.Nil(t, b.Usage())
+
+	client, server := net.Pipe()
+	defer client.Close()
+	assert.Same(t, server, budgetConn(server, b, nil))
+}
+
+func TestBudgetConnCutsOffGuest(t *testing.T) {
+	exhausted := make(chan struct{})
+	b := NewEgressBudget(10, func() { close(exhausted) })
+
+	guest, proxy := net.Pipe()
+	defer guest.Close()
+	var blocked []error
+	conn := budgetConn(proxy, b, func(err error) { blocked = append(blocked, err) })
+
+	go guest.Write([]byte("0123456789abcdef"))
+
+	buf := make([]byte, 64)
+	n, err := io.ReadFull(conn, buf[:10])
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(buf[:n]))
+	<-exhausted
+
+	_, err = conn.Read(buf)
+	require.ErrorIs(t, err, api.ErrEgressBudget)
+	_, err = conn.Read(buf)
+	require.ErrorIs(t, err, api.ErrEgressBudget)
+	require.Len(t, blocked, 1)
+	assert.ErrorIs(t, blocked[0], api.ErrEgressBudget)
+
+	assert.ErrorIs(t, b.Check(), api.ErrEgressBudget)
+	assert.Equal(t, &api.EgressUsage{UsedBytes: 10, LimitBytes: 10, Exhausted: true}, b.Usage())
+}
+
+func TestEgressBudgetSharedAcrossConns(t *testing.T) {
+	b := NewEgressBudget(8, nil)
+
+	for i := 0; i < 2; i++ {
+		guest, proxy := net.Pipe()
+		conn := budgetConn(proxy, b, func(error) {})
+		go guest.Write([]byte("abcd"))
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		guest.Close()
+		conn.Close()
+	}
+
+	assert.ErrorIs(t, b.Check(), api.ErrEgressBudget)
+	assert.Equal(t, int64(8), b.Usage().UsedBytes)
+}
@@ -15,11 +15,13 @@ const (
 )
 
 // pooledConn wraps a net.Conn with its associated buffered reader so
-// the reader's internal buffer is preserved across reuse.
+// the reader's internal buffer is preserved across reuse. proxied marks
+// connections to an upstream proxy rather than to the host itself.
 type pooledConn struct {
-	conn   net.Conn
-	reader *bufio.Reader
-	idleAt time.Time
+	conn    net.Conn
+	reader  *bufio.Reader
+	idleAt  time.Time
+	proxied bool
 }
 
 // upstreamConnPool is a simple per-host connection pool for HTTP upstream
@@ -8,4 +8,8 @@ var (
 	ErrListen        = errors.New("listen failed")
 	ErrSyscall       = errors.New("syscall conn failed")
 	ErrOriginalDst   = errors.New("getsockopt SO_ORIGINAL_DST failed")
+
+	ErrUpstreamProxy   = errors.New("upstream proxy")
+	ErrProxyAutoConfig = errors.New("fetch proxy auto-config")
+	ErrPACUnsupported  = errors.New("PAC script is not a single unconditional return")
 )
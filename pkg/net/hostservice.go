@@ -0,0 +1,62 @@
+package net
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/policy"
+)
+
+// proxyHostService forwards a guest connection addressed to the gateway
+// (resolved in the guest as api.HostAlias) to a service listening on the
+// host loopback interface. Only ports permitted by the policy are reachable,
+// and every connection is reported as a network event for auditing.
+func proxyHostService(guestConn net.Conn, port int, pol *policy.Engine, events chan api.Event, metrics *NetworkMetrics) {
+	defer guestConn.Close()
+
+	host := net.JoinHostPort(api.HostAlias, strconv.Itoa(port))
+	if !pol.IsHostPortAllowed(port) {
+		emitNetworkEvent(events, metrics, blockedEvent(host, api.ErrHostPortNotAllowed))
+		return
+	}
+
+	start := time.Now()
+	realConn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 30*time.Second)
+	if err != nil {
+		emitNetworkEvent(events, metrics, &api.NetworkEvent{
+			URL:        "tcp://" + host,
+			Host:       host,
+			DurationMS: time.Since(start).Milliseconds(),
+			Error:      err.Error(),
+		})
+		return
+	}
+	defer realConn.Close()
+
+	var sent, received int64
+	done := make(chan struct{}, 2)
+	go func() {
+		sent, _ = io.Copy(realConn, guestConn)
+		done <- struct{}{}
+	}()
+	go func() {
+		received, _ = io.Copy(guestConn, realConn)
+		done <- struct{}{}
+	}()
+
+	<-done
+	guestConn.SetDeadline(time.Now())
+	realConn.SetDeadline(time.Now())
+	<-done
+
+	emitNetworkEvent(events, metrics, &api.NetworkEvent{
+		URL:           "tcp://" + host,
+		Host:          host,
+		RequestBytes:  sent,
+		ResponseBytes: received,
+		DurationMS:    time.Since(start).Milliseconds(),
+	})
+}
@@ -0,0 +1,127 @@
+package net
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHostService_Allowed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		n, _ := conn.Read(buf)
+		conn.Write(buf[:n])
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	pol := policy.NewEngine(&api.NetworkConfig{HostPorts: []int{port}})
+	events := make(chan api.Event, 10)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		proxyHostService(server, port, pol, events, nil)
+		close(done)
+	}()
+
+	msg := []byte("hello host")
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = client.Write(msg)
+	require.NoError(t, err)
+
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	assert.Equal(t, string(msg), string(buf))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "proxyHostService should exit after the host service closes")
+	}
+
+	select {
+	case ev := <-events:
+		require.NotNil(t, ev.Network)
+		assert.False(t, ev.Network.Blocked)
+		assert.Equal(t, api.HostAlias+":"+strconv.Itoa(port), ev.Network.Host)
+		assert.Equal(t, int64(len(msg)), ev.Network.ResponseBytes)
+	default:
+		assert.Fail(t, "expected an audit event to be emitted")
+	}
+}
+
+func TestProxyHostService_PortNotAllowed(t *testing.T) {
+	pol := policy.NewEngine(&api.NetworkConfig{HostPorts: []int{11434}})
+	events := make(chan api.Event, 10)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		proxyHostService(server, 22, pol, events, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "proxyHostService should return quickly for a disallowed port")
+	}
+
+	select {
+	case ev := <-events:
+		assert.True(t, ev.Network.Blocked)
+		assert.Equal(t, api.HostAlias+":22", ev.Network.Host)
+	default:
+		assert.Fail(t, "expected a blocked event to be emitted")
+	}
+}
+
+func TestProxyHostService_DialFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	pol := policy.NewEngine(&api.NetworkConfig{HostPorts: []int{port}})
+	events := make(chan api.Event, 10)
+	metrics := NewNetworkMetrics()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	proxyHostService(server, port, pol, events, metrics)
+
+	select {
+	case ev := <-events:
+		require.NotNil(t, ev.Network)
+		assert.False(t, ev.Network.Blocked)
+		assert.Equal(t, api.HostAlias+":"+strconv.Itoa(port), ev.Network.Host)
+		assert.Contains(t, ev.Network.Error, "connection refused")
+	default:
+		assert.Fail(t, "expected an audit event for the failed dial")
+	}
+
+	snap := metrics.Snapshot()
+	require.Len(t, snap, 1)
+	assert.Equal(t, int64(1), snap[0].Errors)
+}
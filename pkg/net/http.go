@@ -19,14 +19,18 @@ type HTTPInterceptor struct {
 	events   chan api.Event
 	caPool   *CAPool
 	connPool *upstreamConnPool
+	metrics  *NetworkMetrics
+	upstream *UpstreamProxy
 }
 
-func NewHTTPInterceptor(pol *policy.Engine, events chan api.Event, caPool *CAPool) *HTTPInterceptor {
+func NewHTTPInterceptor(pol *policy.Engine, events chan api.Event, caPool *CAPool, metrics *NetworkMetrics, upstream *UpstreamProxy) *HTTPInterceptor {
 	return &HTTPInterceptor{
 		policy:   pol,
 		events:   events,
 		caPool:   caPool,
 		connPool: newUpstreamConnPool(),
+		metrics:  metrics,
+		upstream: upstream,
 	}
 }
 
@@ -49,14 +53,19 @@ func (i *HTTPInterceptor) HandleHTTP(guestConn net.Conn, dstIP string, dstPort i
 		}
 
 		if !i.policy.IsHostAllowed(host) {
-			i.emitBlockedEvent(req, host, "host not in allowlist")
+			i.emitBlockedEvent(req, host, api.ErrHostNotAllowed)
 			writeHTTPError(guestConn, http.StatusForbidden, "Blocked by policy")
 			return
 		}
 
-		modifiedReq, err := i.policy.OnRequest(req, host)
+		modifiedReq := req
+		if i.policy.Intercepts(host) {
+			modifiedReq, err = i.policy.OnRequest(req, host)
+		} else {
+			err = i.policy.CheckUnintercepted(req)
+		}
 		if err != nil {
-			i.emitBlockedEvent(req, host, err.Error())
+			i.emitBlockedEvent(req, host, err)
 			writeHTTPError(guestConn, http.StatusForbidden, "Blocked by policy")
 			return
 		}
@@ -66,26 +75,38 @@ func (i *HTTPInterceptor) HandleHTTP(guestConn net.Conn, dstIP string, dstPort i
 		// Try to reuse an existing upstream connection from the pool.
 		pc := i.connPool.get(targetHost)
 		if pc == nil {
-			realConn, err := net.DialTimeout("tcp", targetHost, 30*time.Second)
+			realConn, proxied, err := i.upstream.dialHTTP(targetHost, 30*time.Second)
 			if err != nil {
+				i.metrics.RecordError(host)
 				writeHTTPError(guestConn, http.StatusBadGateway, "Failed to connect")
 				return
 			}
 			pc = &pooledConn{
-				conn:   realConn,
-				reader: bufio.NewReader(realConn),
+				conn:    realConn,
+				reader:  bufio.NewReader(realConn),
+				proxied: proxied,
 			}
 		}
 
-		if err := modifiedReq.Write(pc.conn); err != nil {
+		if err := i.writeUpstreamRequest(pc, modifiedReq, targetHost); err != nil {
 			pc.conn.Close()
+			i.metrics.RecordError(host)
 			writeHTTPError(guestConn, http.StatusBadGateway, "Failed to write request")
 			return
 		}
 
 		resp, err := http.ReadResponse(pc.reader, modifiedReq)
+		if err == nil {
+			modifiedReq, resp, err = i.retryUnauthorized(modifiedReq, resp, host, func(r *http.Request) (*http.Response, error) {
+				if err := i.writeUpstreamRequest(pc, r, targetHost); err != nil {
+					return nil, err
+				}
+				return http.ReadResponse(pc.reader, r)
+			})
+		}
 		if err != nil {
 			pc.conn.Close()
+			i.metrics.RecordError(host)
 			return
 		}
 
@@ -97,7 +118,7 @@ func (i *HTTPInterceptor) HandleHTTP(guestConn net.Conn, dstIP string, dstPort i
 		}
 
 		if isStreamingResponse(modifiedResp) {
-			i.emitEvent(modifiedReq, modifiedResp, host, time.Since(start))
+			i.emitEvent(modifiedReq, modifiedResp, host, time.Since(start), false)
 			err := writeResponseHeadersAndStreamBody(guestConn, modifiedResp)
 			resp.Body.Close()
 			pc.conn.Close()
@@ -108,7 +129,7 @@ func (i *HTTPInterceptor) HandleHTTP(guestConn net.Conn, dstIP string, dstPort i
 		}
 
 		duration := time.Since(start)
-		i.emitEvent(modifiedReq, modifiedResp, host, duration)
+		i.emitEvent(modifiedReq, modifiedResp, host, duration, false)
 
 		if err := writeResponse(guestConn, modifiedResp); err != nil {
 			resp.Body.Close()
@@ -134,6 +155,15 @@ func (i *HTTPInterceptor) HandleHTTP(guestConn net.Conn, dstIP string, dstPort i
 func (i *HTTPInterceptor) HandleHTTPS(guestConn net.Conn, dstIP string, dstPort int) {
 	defer guestConn.Close()
 
+	if i.policy.HasNoInterceptHosts() {
+		sni, conn := sniffSNI(guestConn, sniffTimeout)
+		guestConn = conn
+		if sni != "" && !i.policy.Intercepts(sni) {
+			i.relayUnintercepted(guestConn, sni, dstPort)
+			return
+		}
+	}
+
 	tlsConn := tls.Server(guestConn, &tls.Config{
 		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			return i.caPool.GetCertificate(hello.ServerName)
@@ -152,17 +182,34 @@ func (i *HTTPInterceptor) HandleHTTPS(guestConn net.Conn, dstIP string, dstPort
 	}
 
 	if !i.policy.IsHostAllowed(serverName) {
-		i.emitBlockedEvent(nil, serverName, "host not in allowlist")
+		i.emitBlockedEvent(nil, serverName, api.ErrHostNotAllowed)
 		return
 	}
 
-	realConn, err := tls.Dial("tcp", net.JoinHostPort(serverName, fmt.Sprintf("%d", dstPort)), &tls.Config{
-		ServerName: serverName,
-	})
+	upstreamCfg, err := upstreamTLSConfig(i.policy.UpstreamTLS(serverName), serverName)
+	if err != nil {
+		i.emitBlockedEvent(nil, serverName, err)
+		return
+	}
+	insecure := upstreamCfg.InsecureSkipVerify
+
+	rawConn, err := i.upstream.Dial(net.JoinHostPort(serverName, fmt.Sprintf("%d", dstPort)), 0)
 	if err != nil {
+		i.metrics.RecordError(serverName)
 		return
 	}
+	realConn := tls.Client(rawConn, upstreamCfg)
 	defer realConn.Close()
+	if err := realConn.Handshake(); err != nil {
+		i.metrics.RecordError(serverName)
+		return
+	}
+
+	// Verify pins before any request, and thus any injected secret, is sent.
+	if err := i.policy.VerifyCertPin(serverName, realConn.ConnectionState().PeerCertificates); err != nil {
+		i.emitBlockedEvent(nil, serverName, err)
+		return
+	}
 
 	guestReader := bufio.NewReader(tlsConn)
 	serverReader := bufio.NewReader(realConn)
@@ -177,17 +224,27 @@ func (i *HTTPInterceptor) HandleHTTPS(guestConn net.Conn, dstIP string, dstPort
 
 		modifiedReq, err := i.policy.OnRequest(req, serverName)
 		if err != nil {
-			i.emitBlockedEvent(req, serverName, err.Error())
+			i.emitBlockedEvent(req, serverName, err)
 			writeHTTPError(tlsConn, http.StatusForbidden, "Blocked by policy")
 			return
 		}
 
 		if err := modifiedReq.Write(realConn); err != nil {
+			i.metrics.RecordError(serverName)
 			return
 		}
 
 		resp, err := http.ReadResponse(serverReader, modifiedReq)
+		if err == nil {
+			modifiedReq, resp, err = i.retryUnauthorized(modifiedReq, resp, serverName, func(r *http.Request) (*http.Response, error) {
+				if err := r.Write(realConn); err != nil {
+					return nil, err
+				}
+				return http.ReadResponse(serverReader, r)
+			})
+		}
 		if err != nil {
+			i.metrics.RecordError(serverName)
 			return
 		}
 
@@ -198,7 +255,7 @@ func (i *HTTPInterceptor) HandleHTTPS(guestConn net.Conn, dstIP string, dstPort
 		}
 
 		if isStreamingResponse(modifiedResp) {
-			i.emitEvent(modifiedReq, modifiedResp, serverName, time.Since(start))
+			i.emitEvent(modifiedReq, modifiedResp, serverName, time.Since(start), insecure)
 			if err := writeResponseHeadersAndStreamBody(tlsConn, modifiedResp); err != nil {
 				resp.Body.Close()
 				return
@@ -208,7 +265,7 @@ func (i *HTTPInterceptor) HandleHTTPS(guestConn net.Conn, dstIP string, dstPort
 		}
 
 		duration := time.Since(start)
-		i.emitEvent(modifiedReq, modifiedResp, serverName, duration)
+		i.emitEvent(modifiedReq, modifiedResp, serverName, duration, insecure)
 
 		if err := writeResponse(tlsConn, modifiedResp); err != nil {
 			resp.Body.Close()
@@ -223,11 +280,48 @@ func (i *HTTPInterceptor) HandleHTTPS(guestConn net.Conn, dstIP string, dstPort
 	}
 }
 
-func (i *HTTPInterceptor) emitEvent(req *http.Request, resp *http.Response, host string, duration time.Duration) {
-	if i.events == nil {
-		return
+// retryUnauthorized resends req once through send when upstream answered 401
+// and the request carried OAuth2 access tokens, which are refreshed first.
+// Otherwise, or if the connection cannot carry another request, req and resp
+// are returned unchanged.
+func (i *HTTPInterceptor) retryUnauthorized(req *http.Request, resp *http.Response, host string, send func(*http.Request) (*http.Response, error)) (*http.Request, *http.Response, error) {
+	if resp.StatusCode != http.StatusUnauthorized || resp.Close || req.Close {
+		return req, resp, nil
+	}
+	retry := i.policy.RetryUnauthorized(req, host)
+	if retry == nil {
+		return req, resp, nil
 	}
 
+	// Drain the rejected response so the connection is ready for the retry.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	retryResp, err := send(retry)
+	if err != nil {
+		return nil, nil, err
+	}
+	return retry, retryResp, nil
+}
+
+// writeUpstreamRequest sends req on an upstream connection. Requests relayed
+// through an upstream proxy are written in absolute form with the proxy's
+// credentials.
+func (i *HTTPInterceptor) writeUpstreamRequest(pc *pooledConn, req *http.Request, targetHost string) error {
+	if !pc.proxied {
+		return req.Write(pc.conn)
+	}
+	req.URL.Scheme = "http"
+	if req.URL.Host == "" {
+		req.URL.Host = targetHost
+	}
+	i.upstream.authorize(req)
+	return req.WriteProxy(pc.conn)
+}
+
+// emitEvent records a completed request. insecure marks upstreams reached
+// with TLS verification disabled so they stand out in the audit log.
+func (i *HTTPInterceptor) emitEvent(req *http.Request, resp *http.Response, host string, duration time.Duration, insecure bool) {
 	var reqBytes, respBytes int64
 	if req.ContentLength > 0 {
 		reqBytes = req.ContentLength
@@ -241,49 +335,26 @@ func (i *HTTPInterceptor) emitEvent(req *http.Request, resp *http.Response, host
 		scheme = "https"
 	}
 
-	select {
-	case i.events <- api.Event{
-		Type:      "network",
-		Timestamp: time.Now().Unix(),
-		Network: &api.NetworkEvent{
-			Method:        req.Method,
-			URL:           fmt.Sprintf("%s://%s%s", scheme, host, req.URL.Path),
-			Host:          host,
-			StatusCode:    resp.StatusCode,
-			RequestBytes:  reqBytes,
-			ResponseBytes: respBytes,
-			DurationMS:    duration.Milliseconds(),
-			Blocked:       false,
-		},
-	}:
-	default:
-	}
+	emitNetworkEvent(i.events, i.metrics, &api.NetworkEvent{
+		Method:        req.Method,
+		URL:           fmt.Sprintf("%s://%s%s", scheme, host, req.URL.Path),
+		Host:          host,
+		StatusCode:    resp.StatusCode,
+		RequestBytes:  reqBytes,
+		ResponseBytes: respBytes,
+		DurationMS:    duration.Milliseconds(),
+		Blocked:       false,
+		InsecureTLS:   insecure,
+	})
 }
 
-func (i *HTTPInterceptor) emitBlockedEvent(req *http.Request, host, reason string) {
-	if i.events == nil {
-		return
-	}
-
-	event := api.Event{
-		Type:      "network",
-		Timestamp: time.Now().Unix(),
-		Network: &api.NetworkEvent{
-			Host:        host,
-			Blocked:     true,
-			BlockReason: reason,
-		},
-	}
-
+func (i *HTTPInterceptor) emitBlockedEvent(req *http.Request, host string, err error) {
+	ev := blockedEvent(host, err)
 	if req != nil {
-		event.Network.Method = req.Method
-		event.Network.URL = req.URL.String()
-	}
-
-	select {
-	case i.events <- event:
-	default:
+		ev.Method = req.Method
+		ev.URL = req.URL.String()
 	}
+	emitNetworkEvent(i.events, i.metrics, ev)
 }
 
 func writeHTTPError(conn net.Conn, status int, message string) {
@@ -0,0 +1,67 @@
+package net
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/policy"
+)
+
+func TestHandleHTTP_OAuth2RefreshOn401(t *testing.T) {
+	var minted atomic.Int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"access_token":"tok-%d","token_type":"bearer"}`, minted.Add(1))
+	}))
+	defer tokenSrv.Close()
+
+	// The API has revoked tok-1 before it expired.
+	apiSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "token revoked")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "ok %s", body)
+	}))
+	defer apiSrv.Close()
+	u, err := url.Parse(apiSrv.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	pol := policy.NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_TOKEN": {
+				Hosts:  []string{"127.0.0.1"},
+				OAuth2: &api.OAuth2{TokenURL: tokenSrv.URL, ClientID: "client"},
+			},
+		},
+	})
+	interceptor := NewHTTPInterceptor(pol, make(chan api.Event, 10), nil, nil, nil)
+
+	guest, host := net.Pipe()
+	go interceptor.HandleHTTP(host, "127.0.0.1", port)
+	defer guest.Close()
+
+	go io.WriteString(guest, "POST /v1/items HTTP/1.1\r\nHost: 127.0.0.1\r\nContent-Type: text/plain\r\nContent-Length: 4\r\n\r\nitem")
+	resp, err := http.ReadResponse(bufio.NewReader(guest), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok item", string(body))
+	assert.Equal(t, int32(2), minted.Load())
+}
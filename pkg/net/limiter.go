@@ -0,0 +1,107 @@
+package net
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// limitWindow is the period over which ConnLimiter counts new connections.
+const limitWindow = time.Minute
+
+// ConnLimiter caps how many guest connections may be open at once and how
+// many may be opened per minute. A nil *ConnLimiter imposes no limits.
+type ConnLimiter struct {
+	maxConcurrent int
+	perMinute     int
+	now           func() time.Time
+
+	mu     sync.Mutex
+	active int
+	recent []time.Time // accepted connection times within limitWindow, oldest first
+}
+
+// NewConnLimiter returns a limiter for the given caps, where zero means
+// unlimited. It returns nil when neither cap is set.
+func NewConnLimiter(maxConcurrent, perMinute int) *ConnLimiter {
+	if maxConcurrent <= 0 && perMinute <= 0 {
+		return nil
+	}
+	return &ConnLimiter{
+		maxConcurrent: maxConcurrent,
+		perMinute:     perMinute,
+		now:           time.Now,
+	}
+}
+
+// Acquire admits a new connection. On success it returns a func that frees
+// the connection's concurrency slot; it must be called exactly once when the
+// connection closes. The per-minute budget is not refunded on release.
+func (l *ConnLimiter) Acquire() (func(), error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	cutoff := now.Add(-limitWindow)
+	expired := 0
+	for expired < len(l.recent) && !l.recent[expired].After(cutoff) {
+		expired++
+	}
+	l.recent = l.recent[expired:]
+
+	if l.maxConcurrent > 0 && l.active >= l.maxConcurrent {
+		return nil, errx.With(api.ErrConnLimit, " (%d open)", l.maxConcurrent)
+	}
+	if l.perMinute > 0 && len(l.recent) >= l.perMinute {
+		return nil, errx.With(api.ErrConnRateLimit, " (%d per minute)", l.perMinute)
+	}
+
+	l.active++
+	l.recent = append(l.recent, now)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.active--
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// Active returns the number of connections currently holding a slot.
+func (l *ConnLimiter) Active() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// limitConn ties a connection's limiter slot to its lifetime. A nil release
+// returns conn unchanged.
+func limitConn(conn net.Conn, release func()) net.Conn {
+	if release == nil {
+		return conn
+	}
+	return &limitedConn{Conn: conn, release: release}
+}
+
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
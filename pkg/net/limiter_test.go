@@ -0,0 +1,90 @@
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConnLimiter_Unlimited(t *testing.T) {
+	l := NewConnLimiter(0, 0)
+	require.Nil(t, l)
+
+	release, err := l.Acquire()
+	require.NoError(t, err)
+	assert.Nil(t, release)
+	assert.Equal(t, 0, l.Active())
+}
+
+func TestConnLimiter_Concurrent(t *testing.T) {
+	l := NewConnLimiter(2, 0)
+
+	r1, err := l.Acquire()
+	require.NoError(t, err)
+	_, err = l.Acquire()
+	require.NoError(t, err)
+
+	_, err = l.Acquire()
+	require.ErrorIs(t, err, api.ErrConnLimit)
+	assert.Equal(t, 2, l.Active())
+
+	r1()
+	r1() // releasing twice must not free a second slot
+	assert.Equal(t, 1, l.Active())
+
+	_, err = l.Acquire()
+	require.NoError(t, err)
+	_, err = l.Acquire()
+	require.ErrorIs(t, err, api.ErrConnLimit)
+}
+
+func TestConnLimiter_PerMinute(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewConnLimiter(0, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		release, err := l.Acquire()
+		require.NoError(t, err)
+		release()
+	}
+
+	// Closed connections still count toward the per-minute budget.
+	_, err := l.Acquire()
+	require.ErrorIs(t, err, api.ErrConnRateLimit)
+
+	now = now.Add(30 * time.Second)
+	_, err = l.Acquire()
+	require.ErrorIs(t, err, api.ErrConnRateLimit)
+
+	now = now.Add(31 * time.Second)
+	_, err = l.Acquire()
+	require.NoError(t, err)
+}
+
+func TestLimitConn_ReleasesOnClose(t *testing.T) {
+	l := NewConnLimiter(1, 0)
+	client, server := net.Pipe()
+	defer client.Close()
+
+	release, err := l.Acquire()
+	require.NoError(t, err)
+	conn := limitConn(server, release)
+	assert.Equal(t, 1, l.Active())
+
+	require.NoError(t, conn.Close())
+	conn.Close()
+	assert.Equal(t, 0, l.Active())
+}
+
+func TestLimitConn_NoLimiter(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	assert.Same(t, server, limitConn(server, nil))
+}
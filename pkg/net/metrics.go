@@ -0,0 +1,195 @@
+package net
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// NetworkMetrics aggregates per-host traffic counters and policy violations
+// for a sandbox. All methods are safe for concurrent use and on a nil
+// receiver.
+type NetworkMetrics struct {
+	mu         sync.Mutex
+	hosts      map[string]*api.HostMetrics
+	violations map[violationKey]*api.NetworkViolation
+	now        func() time.Time
+	onAlert    func(api.NetworkEvent)
+}
+
+type violationKey struct {
+	host string
+	rule api.ViolationRule
+}
+
+func NewNetworkMetrics() *NetworkMetrics {
+	return &NetworkMetrics{
+		hosts:      make(map[string]*api.HostMetrics),
+		violations: make(map[violationKey]*api.NetworkViolation),
+		now:        time.Now,
+	}
+}
+
+// Record folds a network event into the counters of its destination host.
+// Responses with a status of 400 or above count as errors.
+func (m *NetworkMetrics) Record(ev *api.NetworkEvent) {
+	if m == nil || ev == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hm := m.host(ev.Host)
+	if ev.Blocked {
+		hm.Blocked++
+		m.recordViolation(hm.Host, ev)
+		if ev.Severity == api.SeverityHigh && m.onAlert != nil {
+			go m.onAlert(*ev)
+		}
+		return
+	}
+	hm.Requests++
+	hm.BytesSent += ev.RequestBytes
+	hm.BytesReceived += ev.ResponseBytes
+	if ev.StatusCode >= 400 || ev.Error != "" {
+		hm.Errors++
+	}
+}
+
+// OnAlert registers fn to be called, in its own goroutine, for every
+// recorded event of api.SeverityHigh.
+func (m *NetworkMetrics) OnAlert(fn func(api.NetworkEvent)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onAlert = fn
+}
+
+// RecordError counts a request to host that failed before a response was
+// received (for example, the upstream connection could not be established).
+func (m *NetworkMetrics) RecordError(host string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hm := m.host(host)
+	hm.Requests++
+	hm.Errors++
+}
+
+// Snapshot returns a copy of the current counters sorted by host.
+func (m *NetworkMetrics) Snapshot() []api.HostMetrics {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]api.HostMetrics, 0, len(m.hosts))
+	for _, hm := range m.hosts {
+		result = append(result, *hm)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Host < result[j].Host })
+	return result
+}
+
+// Violations returns the denials recorded so far, one entry per host and
+// rule, ordered by host and then rule.
+func (m *NetworkMetrics) Violations() []api.NetworkViolation {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]api.NetworkViolation, 0, len(m.violations))
+	for _, v := range m.violations {
+		result = append(result, *v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Host != result[j].Host {
+			return result[i].Host < result[j].Host
+		}
+		return result[i].Rule < result[j].Rule
+	})
+	return result
+}
+
+func (m *NetworkMetrics) recordViolation(host string, ev *api.NetworkEvent) {
+	rule := ev.Rule
+	if rule == "" {
+		rule = api.RulePolicy
+	}
+	now := m.now()
+	key := violationKey{host: host, rule: rule}
+	v, ok := m.violations[key]
+	if !ok {
+		v = &api.NetworkViolation{Host: host, Rule: rule, FirstSeen: now}
+		m.violations[key] = v
+	}
+	v.Reason = ev.BlockReason
+	v.Count++
+	v.LastSeen = now
+}
+
+func (m *NetworkMetrics) host(host string) *api.HostMetrics {
+	key := metricsHostKey(host)
+	hm, ok := m.hosts[key]
+	if !ok {
+		hm = &api.HostMetrics{Host: key}
+		m.hosts[key] = hm
+	}
+	return hm
+}
+
+// metricsHostKey strips default HTTP(S) ports so that "example.com" and
+// "example.com:443" aggregate together while other ports stay distinct.
+func metricsHostKey(host string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	if port == "80" || port == "443" {
+		return h
+	}
+	return host
+}
+
+// blockedEvent describes a guest flow to host that was denied by err.
+func blockedEvent(host string, err error) *api.NetworkEvent {
+	ev := &api.NetworkEvent{
+		Host:        host,
+		Blocked:     true,
+		BlockReason: err.Error(),
+		Rule:        api.ViolationRuleOf(err),
+	}
+	if errors.Is(err, api.ErrSecretLeak) {
+		ev.Severity = api.SeverityHigh
+	}
+	return ev
+}
+
+// emitNetworkEvent records ev in metrics and publishes it on events without
+// blocking; events are dropped when the channel is full.
+func emitNetworkEvent(events chan api.Event, metrics *NetworkMetrics, ev *api.NetworkEvent) {
+	metrics.Record(ev)
+	if events == nil {
+		return
+	}
+	select {
+	case events <- api.Event{
+		Type:      "network",
+		Timestamp: time.Now().Unix(),
+		Network:   ev,
+	}:
+	default:
+	}
+}
@@ -0,0 +1,114 @@
+package net
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkMetrics_Record(t *testing.T) {
+	m := NewNetworkMetrics()
+
+	m.Record(&api.NetworkEvent{Host: "api.example.com", StatusCode: 200, RequestBytes: 10, ResponseBytes: 100})
+	m.Record(&api.NetworkEvent{Host: "api.example.com:443", StatusCode: 503, RequestBytes: 5, ResponseBytes: 20})
+	m.Record(&api.NetworkEvent{Host: "evil.com", Blocked: true})
+	m.RecordError("db.internal:5432")
+
+	snap := m.Snapshot()
+	require.Len(t, snap, 3)
+
+	assert.Equal(t, api.HostMetrics{
+		Host:          "api.example.com",
+		Requests:      2,
+		Errors:        1,
+		BytesSent:     15,
+		BytesReceived: 120,
+	}, snap[0])
+	assert.Equal(t, api.HostMetrics{Host: "db.internal:5432", Requests: 1, Errors: 1}, snap[1])
+	assert.Equal(t, api.HostMetrics{Host: "evil.com", Blocked: 1}, snap[2])
+}
+
+func TestNetworkMetrics_NilSafe(t *testing.T) {
+	var m *NetworkMetrics
+	m.Record(&api.NetworkEvent{Host: "example.com"})
+	m.RecordError("example.com")
+	m.OnAlert(func(api.NetworkEvent) {})
+	assert.Nil(t, m.Snapshot())
+	assert.Nil(t, m.Violations())
+}
+
+func TestNetworkMetrics_Violations(t *testing.T) {
+	m := NewNetworkMetrics()
+	now := time.Unix(1000, 0).UTC()
+	m.now = func() time.Time { return now }
+
+	m.Record(blockedEvent("evil.com:443", api.ErrHostNotAllowed))
+	now = now.Add(time.Minute)
+	m.Record(blockedEvent("evil.com", api.ErrHostNotAllowed))
+	m.Record(blockedEvent("api.example.com", api.ErrSecretLeak))
+	m.Record(blockedEvent("10.0.0.1:5432", errx.With(api.ErrConnLimit, " (%d open)", 5)))
+	m.Record(&api.NetworkEvent{Host: "legacy.example.com", Blocked: true, BlockReason: "blocked"})
+	m.Record(&api.NetworkEvent{Host: "api.example.com", StatusCode: 200})
+
+	v := m.Violations()
+	require.Len(t, v, 4)
+	assert.Equal(t, api.NetworkViolation{
+		Host:      "10.0.0.1:5432",
+		Rule:      api.RuleConnLimit,
+		Reason:    "concurrent connection limit reached (5 open)",
+		Count:     1,
+		FirstSeen: now,
+		LastSeen:  now,
+	}, v[0])
+	assert.Equal(t, api.RuleSecretLeak, v[1].Rule)
+	assert.Equal(t, "evil.com", v[2].Host)
+	assert.Equal(t, api.RuleAllowlist, v[2].Rule)
+	assert.Equal(t, int64(2), v[2].Count)
+	assert.Equal(t, now.Add(-time.Minute), v[2].FirstSeen)
+	assert.Equal(t, now, v[2].LastSeen)
+	assert.Equal(t, api.RulePolicy, v[3].Rule)
+}
+
+func TestEmitNetworkEvent_RecordsWhenChannelFull(t *testing.T) {
+	m := NewNetworkMetrics()
+	events := make(chan api.Event)
+
+	emitNetworkEvent(events, m, &api.NetworkEvent{Host: "example.com", StatusCode: 200})
+
+	snap := m.Snapshot()
+	require.Len(t, snap, 1)
+	assert.Equal(t, int64(1), snap[0].Requests)
+}
+
+func TestNetworkMetrics_OnAlert(t *testing.T) {
+	m := NewNetworkMetrics()
+	alerts := make(chan api.NetworkEvent, 2)
+	m.OnAlert(func(ev api.NetworkEvent) { alerts <- ev })
+
+	m.Record(blockedEvent("example.com", api.ErrHostNotAllowed))
+	m.Record(blockedEvent("evil.example.com", api.ErrSecretLeak))
+
+	select {
+	case ev := <-alerts:
+		assert.Equal(t, "evil.example.com", ev.Host)
+		assert.Equal(t, api.SeverityHigh, ev.Severity)
+		assert.Equal(t, api.RuleSecretLeak, ev.Rule)
+	case <-time.After(time.Second):
+		t.Fatal("no alert for a secret leak")
+	}
+	select {
+	case ev := <-alerts:
+		t.Fatalf("unexpected alert for %s", ev.Host)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBlockedEvent_Severity(t *testing.T) {
+	assert.Equal(t, api.SeverityHigh, blockedEvent("a.com", errx.With(api.ErrSecretLeak, ": x")).Severity)
+	assert.Empty(t, blockedEvent("a.com", api.ErrSecretScope).Severity, "scope violations are on a bound host")
+	assert.Empty(t, blockedEvent("a.com", api.ErrHostNotAllowed).Severity)
+}
@@ -439,3 +439,80 @@ func (n *NFTablesNAT) Cleanup() error {
 
 	return n.conn.Flush()
 }
+
+// NFTablesFreeze drops every packet arriving from a TAP interface before
+// NAT and connection tracking see it, cutting off all of a guest's egress,
+// including flows that are already established and those redirected to the
+// transparent proxy.
+type NFTablesFreeze struct {
+	tapInterface string
+	conn         *nftables.Conn
+}
+
+func NewNFTablesFreeze(tapInterface string) *NFTablesFreeze {
+	return &NFTablesFreeze{tapInterface: tapInterface}
+}
+
+func (f *NFTablesFreeze) tableName() string {
+	return "matchlock_freeze_" + f.tapInterface
+}
+
+func (f *NFTablesFreeze) Setup() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return errx.Wrap(ErrNFTablesConn, err)
+	}
+	f.conn = conn
+
+	table := conn.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   f.tableName(),
+	})
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityRaw,
+	})
+	conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     ifname(f.tapInterface),
+			},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		},
+	})
+
+	if err := conn.Flush(); err != nil {
+		return errx.Wrap(ErrNFTablesApply, err)
+	}
+	return nil
+}
+
+func (f *NFTablesFreeze) Cleanup() error {
+	if f.conn == nil {
+		conn, err := nftables.New()
+		if err != nil {
+			return err
+		}
+		f.conn = conn
+	}
+
+	tables, err := f.conn.ListTables()
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if t.Name == f.tableName() && t.Family == nftables.TableFamilyINet {
+			f.conn.DelTable(t)
+			break
+		}
+	}
+	return f.conn.Flush()
+}
@@ -0,0 +1,95 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// relayUnintercepted forwards a TLS connection to a host excluded from
+// interception without decrypting it. The guest's ClientHello is still
+// scanned for secret placeholders so that one sent in the clear (e.g. as
+// the server name or an ALPN protocol) never reaches a host where it will
+// not be substituted. The requests that follow are encrypted, so a
+// placeholder in their headers or bodies cannot be seen and is relayed.
+func (i *HTTPInterceptor) relayUnintercepted(guestConn net.Conn, serverName string, dstPort int) {
+	route := &passthroughRoute{
+		conn:    guestConn,
+		host:    net.JoinHostPort(serverName, strconv.Itoa(dstPort)),
+		sni:     serverName,
+		allowed: i.policy.IsHostAllowed(serverName),
+	}
+	route.addr = route.host
+	if !route.allowed {
+		i.emitBlockedEvent(nil, route.host, api.ErrHostNotAllowed)
+		return
+	}
+
+	start := time.Now()
+	realConn, err := i.upstream.Dial(route.addr, 30*time.Second)
+	if err != nil {
+		i.metrics.RecordError(route.host)
+		return
+	}
+	defer realConn.Close()
+
+	var placeholders [][]byte
+	for _, p := range i.policy.GetPlaceholders() {
+		placeholders = append(placeholders, []byte(p))
+	}
+
+	var sent, received int64
+	var leaked error
+	done := make(chan struct{}, 2)
+	go func() {
+		sent, leaked = relayClientHello(realConn, guestConn, placeholders)
+		if leaked == nil {
+			n, _ := io.Copy(realConn, guestConn)
+			sent += n
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		received, _ = io.Copy(guestConn, realConn)
+		done <- struct{}{}
+	}()
+
+	<-done
+	guestConn.SetDeadline(time.Now())
+	realConn.SetDeadline(time.Now())
+	<-done
+
+	if leaked != nil {
+		i.emitBlockedEvent(nil, route.host, leaked)
+		return
+	}
+	recordPassthrough(i.events, i.metrics, route, sent, received, time.Since(start))
+}
+
+// relayClientHello forwards the first TLS record from src, the ClientHello,
+// to dst, stopping with api.ErrSecretLeak instead if it contains any of the
+// placeholders. The ClientHello is the last part of a connection sent in the
+// clear; everything after it is encrypted and cannot be scanned.
+func relayClientHello(dst io.Writer, src io.Reader, placeholders [][]byte) (int64, error) {
+	header := make([]byte, 5)
+	n, _ := io.ReadFull(src, header)
+	record := header[:n]
+	if n == len(header) {
+		record = make([]byte, len(header)+int(binary.BigEndian.Uint16(header[3:])))
+		copy(record, header)
+		n, _ = io.ReadFull(src, record[len(header):])
+		record = record[:len(header)+n]
+	}
+	for _, p := range placeholders {
+		if bytes.Contains(record, p) {
+			return 0, api.ErrSecretLeak
+		}
+	}
+	w, _ := dst.Write(record)
+	return int64(w), nil
+}
@@ -0,0 +1,122 @@
+package net
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/policy"
+)
+
+func TestRelayClientHello(t *testing.T) {
+	placeholder := []byte("SANDBOX_SECRET_0123456789abcdef")
+	record := func(payload string) string {
+		return "\x16\x03\x01" + string([]byte{0, byte(len(payload))}) + payload
+	}
+
+	var dst bytes.Buffer
+	hello := record("harmless hello")
+	src := iotest.OneByteReader(strings.NewReader(hello + "encrypted " + string(placeholder)))
+	n, err := relayClientHello(&dst, src, [][]byte{placeholder})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(hello)), n)
+	assert.Equal(t, hello, dst.String(), "only the first record is scanned and forwarded")
+
+	dst.Reset()
+	_, err = relayClientHello(&dst, strings.NewReader(record("alpn="+string(placeholder))), [][]byte{placeholder})
+	require.ErrorIs(t, err, api.ErrSecretLeak)
+	assert.Zero(t, dst.Len())
+}
+
+func startNoInterceptUpstream(t *testing.T) (*httptest.Server, int) {
+	t.Helper()
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	upstream.Config.ErrorLog = log.New(io.Discard, "", 0)
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	return upstream, upstream.Listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestHandleHTTPS_NoIntercept(t *testing.T) {
+	upstream, port := startNoInterceptUpstream(t)
+	caPool, err := NewCAPool()
+	require.NoError(t, err)
+	pol := policy.NewEngine(&api.NetworkConfig{
+		AllowedHosts:     []string{"localhost"},
+		NoInterceptHosts: []string{"localhost"},
+	})
+	events := make(chan api.Event, 10)
+	interceptor := NewHTTPInterceptor(pol, events, caPool, nil, nil)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go interceptor.HandleHTTPS(server, "127.0.0.1", port)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	guest := tls.Client(client, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	require.NoError(t, guest.Handshake())
+
+	// The guest sees the upstream's own certificate, not one minted by the
+	// interception CA.
+	peer := guest.ConnectionState().PeerCertificates[0]
+	assert.Equal(t, upstream.Certificate().Raw, peer.Raw)
+	guest.Close()
+
+	select {
+	case ev := <-events:
+		require.NotNil(t, ev.Network)
+		assert.False(t, ev.Network.Blocked)
+		assert.Equal(t, net.JoinHostPort("localhost", strconv.Itoa(port)), ev.Network.Host)
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "expected a network event")
+	}
+}
+
+func TestHandleHTTPS_NoInterceptBlocksPlaceholder(t *testing.T) {
+	_, port := startNoInterceptUpstream(t)
+	pol := policy.NewEngine(&api.NetworkConfig{
+		AllowedHosts:     []string{"localhost"},
+		NoInterceptHosts: []string{"localhost"},
+		Secrets:          map[string]api.Secret{"API_KEY": {Value: "real-secret", Hosts: []string{"api.example.com"}}},
+	})
+	events := make(chan api.Event, 10)
+	interceptor := NewHTTPInterceptor(pol, events, nil, nil, nil)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go interceptor.HandleHTTPS(server, "127.0.0.1", port)
+
+	// ALPN travels in the clear in the ClientHello, so it could smuggle a
+	// placeholder past a relay that does not decrypt the connection.
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	guest := tls.Client(client, &tls.Config{
+		ServerName:         "localhost",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{pol.GetPlaceholder("API_KEY")},
+	})
+	require.Error(t, guest.Handshake())
+
+	select {
+	case ev := <-events:
+		require.NotNil(t, ev.Network)
+		assert.True(t, ev.Network.Blocked)
+		assert.Equal(t, api.RuleSecretLeak, ev.Network.Rule)
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "expected a blocked event")
+	}
+}
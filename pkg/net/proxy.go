@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -33,6 +34,12 @@ type TransparentProxy struct {
 	httpsPort       int
 	passthroughPort int
 	bindAddr        string
+	gatewayIP       string
+	shape           *api.NetworkShape
+	metrics         *NetworkMetrics
+	limiter         *ConnLimiter
+	budget          *EgressBudget
+	upstream        *UpstreamProxy
 
 	mu     sync.Mutex
 	closed bool
@@ -40,10 +47,16 @@ type TransparentProxy struct {
 }
 
 type ProxyConfig struct {
-	BindAddr        string // Address to bind (e.g., "192.168.100.1")
-	HTTPPort        int    // Port for HTTP interception (e.g., 8080)
-	HTTPSPort       int    // Port for HTTPS interception (e.g., 8443)
-	PassthroughPort int    // Port for policy-gated TCP passthrough (non-80/443). 0 = OS-assigned, negative = disabled
+	BindAddr        string            // Address to bind (e.g., "192.168.100.1")
+	HTTPPort        int               // Port for HTTP interception (e.g., 8080)
+	HTTPSPort       int               // Port for HTTPS interception (e.g., 8443)
+	PassthroughPort int               // Port for policy-gated TCP passthrough (non-80/443). 0 = OS-assigned, negative = disabled
+	GatewayIP       string            // Guest-facing gateway IP; connections to it are routed to host services
+	Shape           *api.NetworkShape // Optional latency/bandwidth emulation for guest connections
+	Metrics         *NetworkMetrics   // Optional per-host traffic counters
+	Limiter         *ConnLimiter      // Optional cap on concurrent and per-minute guest connections
+	Budget          *EgressBudget     // Optional cap on total bytes sent by the guest
+	Upstream        *UpstreamProxy    // Optional HTTP proxy that all egress is chained through
 	Policy          *policy.Engine
 	Events          chan api.Event
 	CAPool          *CAPool
@@ -86,13 +99,19 @@ func NewTransparentProxy(cfg *ProxyConfig) (*TransparentProxy, error) {
 		httpListener:        httpLn,
 		httpsListener:       httpsLn,
 		passthroughListener: passthroughLn,
-		interceptor:         NewHTTPInterceptor(cfg.Policy, cfg.Events, cfg.CAPool),
+		interceptor:         NewHTTPInterceptor(cfg.Policy, cfg.Events, cfg.CAPool, cfg.Metrics, cfg.Upstream),
 		policy:              cfg.Policy,
 		events:              cfg.Events,
 		httpPort:            actualHTTPPort,
 		httpsPort:           actualHTTPSPort,
 		passthroughPort:     actualPassthroughPort,
 		bindAddr:            cfg.BindAddr,
+		gatewayIP:           cfg.GatewayIP,
+		shape:               cfg.Shape,
+		metrics:             cfg.Metrics,
+		limiter:             cfg.Limiter,
+		budget:              cfg.Budget,
+		upstream:            cfg.Upstream,
 	}
 
 	return tp, nil
@@ -138,7 +157,30 @@ func (tp *TransparentProxy) acceptLoop(ln net.Listener, handler func(net.Conn, s
 			continue
 		}
 
-		go handler(conn, origDst.IP.String(), origDst.Port)
+		dst := net.JoinHostPort(origDst.IP.String(), strconv.Itoa(origDst.Port))
+		release, err := tp.limiter.Acquire()
+		if err != nil {
+			conn.Close()
+			tp.emitBlockedEvent(dst, err)
+			continue
+		}
+		guestConn := shapeConn(limitConn(conn, release), tp.shape)
+
+		// Connections to the gateway itself target host-local services
+		// (api.HostAlias) regardless of which listener caught them.
+		if tp.gatewayIP != "" && origDst.IP.String() == tp.gatewayIP {
+			go proxyHostService(guestConn, origDst.Port, tp.policy, tp.events, tp.metrics)
+			continue
+		}
+
+		if err := tp.budget.Check(); err != nil {
+			guestConn.Close()
+			tp.emitBlockedEvent(dst, err)
+			continue
+		}
+		guestConn = budgetConn(guestConn, tp.budget, func(err error) { tp.emitBlockedEvent(dst, err) })
+
+		go handler(guestConn, origDst.IP.String(), origDst.Port)
 	}
 }
 
@@ -153,27 +195,31 @@ func (tp *TransparentProxy) handleHTTPS(conn net.Conn, dstIP string, dstPort int
 }
 
 func (tp *TransparentProxy) handlePassthrough(conn net.Conn, dstIP string, dstPort int) {
+	route := routePassthrough(conn, tp.policy, dstIP, dstPort)
+	conn = route.conn
 	defer conn.Close()
 
-	host := net.JoinHostPort(dstIP, fmt.Sprintf("%d", dstPort))
-	if !tp.policy.IsHostAllowed(dstIP) {
-		tp.emitBlockedEvent(host, "host not in allowlist")
+	if !route.allowed {
+		tp.emitBlockedEvent(route.host, api.ErrHostNotAllowed)
 		return
 	}
 
-	realConn, err := net.DialTimeout("tcp", host, 30*time.Second)
+	start := time.Now()
+	realConn, err := tp.upstream.Dial(route.addr, 30*time.Second)
 	if err != nil {
+		tp.metrics.RecordError(route.host)
 		return
 	}
 	defer realConn.Close()
 
+	var sent, received int64
 	done := make(chan struct{}, 2)
 	go func() {
-		io.Copy(realConn, conn)
+		sent, _ = io.Copy(realConn, conn)
 		done <- struct{}{}
 	}()
 	go func() {
-		io.Copy(conn, realConn)
+		received, _ = io.Copy(conn, realConn)
 		done <- struct{}{}
 	}()
 
@@ -181,23 +227,12 @@ func (tp *TransparentProxy) handlePassthrough(conn net.Conn, dstIP string, dstPo
 	conn.SetDeadline(time.Now())
 	realConn.SetDeadline(time.Now())
 	<-done
+
+	recordPassthrough(tp.events, tp.metrics, route, sent, received, time.Since(start))
 }
 
-func (tp *TransparentProxy) emitBlockedEvent(host, reason string) {
-	if tp.events == nil {
-		return
-	}
-	select {
-	case tp.events <- api.Event{
-		Type: "network",
-		Network: &api.NetworkEvent{
-			Host:        host,
-			Blocked:     true,
-			BlockReason: reason,
-		},
-	}:
-	default:
-	}
+func (tp *TransparentProxy) emitBlockedEvent(host string, err error) {
+	emitNetworkEvent(tp.events, tp.metrics, blockedEvent(host, err))
 }
 
 func (tp *TransparentProxy) Close() error {
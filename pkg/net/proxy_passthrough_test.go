@@ -210,3 +210,88 @@ func mustAtoi(s string) int {
 	}
 	return n
 }
+
+func TestHandlePassthrough_SNIBlocked(t *testing.T) {
+	tp := &TransparentProxy{
+		policy: policy.NewEngine(&api.NetworkConfig{
+			AllowedHosts: []string{"allowed.example.com"},
+		}),
+		events: make(chan api.Event, 10),
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	startTLSClient(client, "smtp.evil.com")
+
+	done := make(chan struct{})
+	go func() {
+		tp.handlePassthrough(server, "93.184.216.34", 465)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "handlePassthrough should have returned for blocked SNI")
+	}
+
+	select {
+	case ev := <-tp.events:
+		assert.True(t, ev.Network.Blocked)
+		assert.Equal(t, "smtp.evil.com:465", ev.Network.Host)
+	default:
+		assert.Fail(t, "expected a blocked event to be emitted")
+	}
+}
+
+func TestHandlePassthrough_SNIAllowed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	firstByte := make(chan byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err == nil {
+			firstByte <- b[0]
+		}
+	}()
+
+	tp := &TransparentProxy{
+		policy: policy.NewEngine(&api.NetworkConfig{
+			AllowedHosts: []string{"localhost"},
+		}),
+		events: make(chan api.Event, 10),
+	}
+
+	client, server := net.Pipe()
+	startTLSClient(client, "localhost")
+
+	_, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	done := make(chan struct{})
+	go func() {
+		// The original destination is not allowlisted; only the SNI is.
+		tp.handlePassthrough(server, "93.184.216.34", mustAtoi(portStr))
+		close(done)
+	}()
+
+	select {
+	case b := <-firstByte:
+		assert.Equal(t, byte(0x16), b, "upstream should receive the replayed ClientHello")
+	case <-time.After(3 * time.Second):
+		require.Fail(t, "upstream did not receive the ClientHello")
+	}
+
+	client.Close()
+	<-done
+
+	ev := <-tp.events
+	assert.False(t, ev.Network.Blocked)
+	assert.Equal(t, "localhost:"+portStr, ev.Network.Host)
+	assert.Equal(t, "tls://localhost:"+portStr, ev.Network.URL)
+}
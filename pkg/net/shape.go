@@ -0,0 +1,125 @@
+package net
+
+import (
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// shapeChunkSize bounds how much data is paced at once so that bandwidth
+// limits are applied smoothly rather than in large bursts.
+const shapeChunkSize = 16 * 1024
+
+// shapedConn wraps the guest side of a proxied connection to emulate a slow
+// link. Latency is charged once per request/response turn: the first write
+// back to the guest after it has sent data is delayed by latency ± jitter.
+// Bandwidth is enforced independently in each direction.
+type shapedConn struct {
+	net.Conn
+	shape       *api.NetworkShape
+	pendingTurn atomic.Bool
+	readPacer   pacer
+	writePacer  pacer
+
+	jitterMu sync.Mutex
+	jitter   *rand.Rand
+}
+
+// shapeConn returns conn wrapped with the given shape, or conn itself when
+// shaping is disabled.
+func shapeConn(conn net.Conn, shape *api.NetworkShape) net.Conn {
+	if shape.IsZero() {
+		return conn
+	}
+	return &shapedConn{
+		Conn:       conn,
+		shape:      shape,
+		readPacer:  pacer{bps: shape.BandwidthBps},
+		writePacer: pacer{bps: shape.BandwidthBps},
+		jitter:     newJitterRand(shape.JitterSeed),
+	}
+}
+
+// newJitterRand returns the source of a connection's jitter, seeded with seed
+// or, when seed is zero, randomly.
+func newJitterRand(seed uint64) *rand.Rand {
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	return rand.New(rand.NewPCG(seed, seed))
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if len(p) > shapeChunkSize {
+		p = p[:shapeChunkSize]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.pendingTurn.Store(true)
+		c.readPacer.wait(n)
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	if c.pendingTurn.Swap(false) {
+		time.Sleep(c.turnDelay())
+	}
+
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > shapeChunkSize {
+			chunk = chunk[:shapeChunkSize]
+		}
+		c.writePacer.wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *shapedConn) turnDelay() time.Duration {
+	d := c.shape.Latency()
+	if jitter := c.shape.Jitter(); jitter > 0 {
+		c.jitterMu.Lock()
+		d += time.Duration(c.jitter.Int64N(int64(2*jitter)+1)) - jitter
+		c.jitterMu.Unlock()
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// pacer spaces out transfers so the average rate does not exceed bps bits
+// per second.
+type pacer struct {
+	mu   sync.Mutex
+	bps  int64
+	next time.Time
+}
+
+func (p *pacer) wait(n int) {
+	if p.bps <= 0 {
+		return
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	p.next = p.next.Add(time.Duration(int64(n) * 8 * int64(time.Second) / p.bps))
+	until := p.next
+	p.mu.Unlock()
+
+	time.Sleep(time.Until(until))
+}
@@ -0,0 +1,88 @@
+package net
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShapeConn_Disabled(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	assert.Same(t, server, shapeConn(server, nil))
+	assert.Same(t, server, shapeConn(server, &api.NetworkShape{}))
+}
+
+func TestShapeConn_LatencyPerTurn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	shaped := shapeConn(server, &api.NetworkShape{LatencyMS: 100})
+
+	go func() {
+		buf := make([]byte, 4)
+		io.ReadFull(shaped, buf)
+		shaped.Write([]byte("pong"))
+		shaped.Write([]byte("more"))
+	}()
+
+	start := time.Now()
+	_, err := client.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	elapsed := time.Since(start)
+
+	assert.Equal(t, "pongmore", string(buf))
+	assert.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	assert.Less(t, elapsed, 190*time.Millisecond, "latency should be charged once per turn")
+}
+
+func TestShapedConn_TurnDelayJitter(t *testing.T) {
+	shape := &api.NetworkShape{LatencyMS: 50, JitterMS: 20, JitterSeed: 42}
+	a := shapeConn(nil, shape).(*shapedConn)
+	b := shapeConn(nil, shape).(*shapedConn)
+
+	var spread bool
+	for range 1000 {
+		d := a.turnDelay()
+		require.GreaterOrEqual(t, d, 30*time.Millisecond)
+		require.LessOrEqual(t, d, 70*time.Millisecond)
+		assert.Equal(t, d, b.turnDelay(), "same seed should give the same jitter")
+		spread = spread || d != 50*time.Millisecond
+	}
+	assert.True(t, spread, "jitter should vary the delay")
+
+	clamped := shapeConn(nil, &api.NetworkShape{LatencyMS: 5, JitterMS: 20, JitterSeed: 42}).(*shapedConn)
+	for range 1000 {
+		require.GreaterOrEqual(t, clamped.turnDelay(), time.Duration(0))
+	}
+}
+
+func TestShapeConn_Bandwidth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// 800 kbit/s = 100 KB/s, so 20 KB takes ~200ms.
+	shaped := shapeConn(server, &api.NetworkShape{BandwidthBps: 800_000})
+	payload := make([]byte, 20*1000)
+
+	go shaped.Write(payload)
+
+	start := time.Now()
+	_, err := io.ReadFull(client, make([]byte, len(payload)))
+	require.NoError(t, err)
+
+	assert.GreaterOrEqual(t, time.Since(start), 180*time.Millisecond)
+}
@@ -0,0 +1,120 @@
+package net
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/policy"
+)
+
+// sniffTimeout bounds how long a passthrough flow to a non-allowlisted IP
+// waits for the client's first bytes. TLS clients send their ClientHello
+// immediately; server-first protocols (SMTP, SSH) send nothing and are
+// blocked once this expires.
+const sniffTimeout = time.Second
+
+// errHelloCaptured aborts the sniffing handshake once the ClientHello has
+// been parsed; no TLS response is ever sent to the guest.
+var errHelloCaptured = errors.New("client hello captured")
+
+// sniffSNI reads the start of a guest connection and, if it is a TLS
+// ClientHello, returns the requested server name. The returned conn replays
+// every byte consumed while sniffing, so it must be used in place of conn.
+func sniffSNI(conn net.Conn, timeout time.Duration) (string, net.Conn) {
+	var buf bytes.Buffer
+	rec := &recordingConn{Conn: conn, r: io.TeeReader(conn, &buf)}
+
+	var serverName string
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	tls.Server(rec, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloCaptured
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+
+	if buf.Len() == 0 {
+		return serverName, conn
+	}
+	return serverName, &replayConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+}
+
+// recordingConn feeds the sniffing TLS server. Writes are discarded so alerts
+// generated by the aborted handshake never reach the guest.
+type recordingConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *recordingConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *recordingConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// replayConn returns previously sniffed bytes before reading from the
+// underlying connection again.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// passthroughRoute describes where a non-HTTP guest flow is sent.
+type passthroughRoute struct {
+	conn    net.Conn // guest conn, replaying any sniffed bytes
+	host    string   // host:port used for policy events and metrics
+	addr    string   // upstream address to dial
+	sni     string   // TLS server name, if the flow was judged on it
+	allowed bool
+}
+
+// routePassthrough applies policy to a non-HTTP flow. Flows to an allowed
+// destination IP pass unchanged. Otherwise the client's TLS ClientHello, if
+// any, is inspected and the flow is allowed when its SNI matches the
+// allowlist. Such flows are dialed by server name rather than by the
+// original IP, so a forged SNI cannot be used to reach an arbitrary server.
+func routePassthrough(conn net.Conn, pol *policy.Engine, dstIP string, dstPort int) *passthroughRoute {
+	port := strconv.Itoa(dstPort)
+	addr := net.JoinHostPort(dstIP, port)
+	if pol.IsHostAllowed(dstIP) {
+		return &passthroughRoute{conn: conn, host: addr, addr: addr, allowed: true}
+	}
+
+	sni, conn := sniffSNI(conn, sniffTimeout)
+	if sni == "" {
+		return &passthroughRoute{conn: conn, host: addr, addr: addr}
+	}
+
+	host := net.JoinHostPort(sni, port)
+	return &passthroughRoute{
+		conn:    conn,
+		host:    host,
+		addr:    host,
+		sni:     sni,
+		allowed: pol.IsHostAllowed(sni),
+	}
+}
+
+// recordPassthrough accounts for a finished passthrough flow. Flows admitted
+// by SNI are also reported as network events, since the server name is the
+// only record of where they went.
+func recordPassthrough(events chan api.Event, metrics *NetworkMetrics, route *passthroughRoute, sent, received int64, elapsed time.Duration) {
+	ev := &api.NetworkEvent{
+		Host:          route.host,
+		RequestBytes:  sent,
+		ResponseBytes: received,
+		DurationMS:    elapsed.Milliseconds(),
+	}
+	if route.sni == "" {
+		metrics.Record(ev)
+		return
+	}
+	ev.URL = "tls://" + route.host
+	emitNetworkEvent(events, metrics, ev)
+}
@@ -0,0 +1,106 @@
+package net
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTLSClient begins a TLS handshake for serverName on conn. The
+// handshake never completes because nothing answers the ClientHello.
+func startTLSClient(conn net.Conn, serverName string) {
+	go tls.Client(conn, &tls.Config{ServerName: serverName}).Handshake()
+}
+
+func TestSniffSNI_ClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	startTLSClient(client, "db.example.com")
+
+	sni, conn := sniffSNI(server, 2*time.Second)
+	assert.Equal(t, "db.example.com", sni)
+
+	// The sniffed ClientHello is replayed to whoever reads next.
+	header := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := io.ReadFull(conn, header)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x16), header[0], "expected TLS handshake record")
+}
+
+func TestSniffSNI_NonTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	msg := []byte("EHLO client.example.com\r\n")
+	go client.Write(msg)
+
+	sni, conn := sniffSNI(server, 2*time.Second)
+	assert.Empty(t, sni)
+
+	buf := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, string(msg), string(buf))
+}
+
+func TestSniffSNI_SilentClient(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	start := time.Now()
+	sni, conn := sniffSNI(server, 50*time.Millisecond)
+	assert.Empty(t, sni)
+	assert.Same(t, server, conn)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRoutePassthrough(t *testing.T) {
+	pol := policy.NewEngine(&api.NetworkConfig{
+		AllowedHosts: []string{"10.20.30.40", "*.db.example.com"},
+	})
+
+	t.Run("allowed IP", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		route := routePassthrough(server, pol, "10.20.30.40", 5432)
+		assert.True(t, route.allowed)
+		assert.Equal(t, "10.20.30.40:5432", route.addr)
+		assert.Empty(t, route.sni)
+	})
+
+	t.Run("allowed SNI dials by name", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		startTLSClient(client, "eu.db.example.com")
+
+		route := routePassthrough(server, pol, "93.184.216.34", 5432)
+		assert.True(t, route.allowed)
+		assert.Equal(t, "eu.db.example.com", route.sni)
+		assert.Equal(t, "eu.db.example.com:5432", route.host)
+		assert.Equal(t, "eu.db.example.com:5432", route.addr)
+	})
+
+	t.Run("disallowed SNI", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		startTLSClient(client, "smtp.evil.com")
+
+		route := routePassthrough(server, pol, "93.184.216.34", 465)
+		assert.False(t, route.allowed)
+		assert.Equal(t, "smtp.evil.com:465", route.host)
+	})
+}
@@ -1,4 +1,4 @@
-//go:build darwin
+//go:build darwin || linux
 
 package net
 
@@ -9,7 +9,8 @@ import (
 
 // setSocketBufferSizes increases the SO_SNDBUF and SO_RCVBUF on the socket pair
 // FD. Larger buffers prevent frame drops when the VM sends bursts of packets
-// faster than the gVisor stack can consume them.
+// faster than the gVisor stack can consume them. TAP devices are not sockets;
+// the calls fail harmlessly and the device's own queue applies.
 func setSocketBufferSizes(f *os.File) {
 	fd := int(f.Fd())
 	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, socketBufSize)
@@ -1,4 +1,4 @@
-//go:build darwin
+//go:build darwin || linux
 
 package net
 
@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/jingkaihe/matchlock/pkg/api"
 	"github.com/jingkaihe/matchlock/pkg/policy"
@@ -45,7 +47,13 @@ type NetworkStack struct {
 	interceptor *HTTPInterceptor
 	events      chan api.Event
 	linkEP      *socketPairEndpoint
+	gatewayIP   string
 	dnsServers  []string
+	shape       *api.NetworkShape
+	metrics     *NetworkMetrics
+	limiter     *ConnLimiter
+	budget      *EgressBudget
+	upstream    *UpstreamProxy
 	dnsIndex    atomic.Uint64
 	mu          sync.Mutex
 	closed      bool
@@ -61,6 +69,11 @@ type Config struct {
 	Events     chan api.Event
 	CAPool     *CAPool
 	DNSServers []string
+	Shape      *api.NetworkShape
+	Metrics    *NetworkMetrics
+	Limiter    *ConnLimiter
+	Budget     *EgressBudget
+	Upstream   *UpstreamProxy
 }
 
 // writeBufPool provides reusable buffers for serializing outbound packets
@@ -72,7 +85,8 @@ var writeBufPool = sync.Pool{
 	},
 }
 
-// socketPairEndpoint implements stack.LinkEndpoint for Unix socket pairs
+// socketPairEndpoint implements stack.LinkEndpoint for Unix socket pairs and
+// TAP devices, both of which carry one Ethernet frame per read or write.
 type socketPairEndpoint struct {
 	file     *os.File
 	mtu      uint32
@@ -80,6 +94,7 @@ type socketPairEndpoint struct {
 	// dispatcher is read atomically in the hot path; only written on Attach.
 	dispatcher    atomic.Pointer[stack.NetworkDispatcher]
 	closed        atomic.Bool
+	frozen        atomic.Bool // drop every frame from the guest
 	closeCh       chan struct{}
 	mu            sync.Mutex // protects onCloseAction and linkAddr
 	onCloseAction func()
@@ -200,7 +215,7 @@ func (e *socketPairEndpoint) readLoop() {
 			continue
 		}
 
-		if n < header.EthernetMinimumSize {
+		if n < header.EthernetMinimumSize || e.frozen.Load() {
 			continue
 		}
 
@@ -310,10 +325,20 @@ func NewNetworkStack(cfg *Config) (*NetworkStack, error) {
 		policy:     cfg.Policy,
 		events:     cfg.Events,
 		linkEP:     linkEP,
+		gatewayIP:  cfg.GatewayIP,
 		dnsServers: cfg.DNSServers,
+		shape:      cfg.Shape,
+		metrics:    cfg.Metrics,
+		limiter:    cfg.Limiter,
+		budget:     cfg.Budget,
+		upstream:   cfg.Upstream,
 	}
 
-	ns.interceptor = NewHTTPInterceptor(cfg.Policy, cfg.Events, cfg.CAPool)
+	// Without a CA pool traffic is only routed, not inspected: HTTP and
+	// HTTPS are relayed like any other TCP connection.
+	if cfg.CAPool != nil {
+		ns.interceptor = NewHTTPInterceptor(cfg.Policy, cfg.Events, cfg.CAPool, cfg.Metrics, cfg.Upstream)
+	}
 
 	tcpForwarder := tcp.NewForwarder(s, tcpReceiveWindowSize, 65535, ns.handleTCPConnection)
 	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
@@ -327,45 +352,65 @@ func NewNetworkStack(cfg *Config) (*NetworkStack, error) {
 func (ns *NetworkStack) handleTCPConnection(r *tcp.ForwarderRequest) {
 	id := r.ID()
 	dstPort := id.LocalPort
+	dstIP := id.LocalAddress.String()
+	dst := net.JoinHostPort(dstIP, strconv.Itoa(int(dstPort)))
+
+	release, err := ns.limiter.Acquire()
+	if err != nil {
+		r.Complete(true)
+		ns.emitBlockedEvent(dst, err)
+		return
+	}
 
 	var wq waiter.Queue
 	ep, tcpipErr := r.CreateEndpoint(&wq)
 	if tcpipErr != nil {
 		r.Complete(true)
+		if release != nil {
+			release()
+		}
 		return
 	}
 
 	r.Complete(false)
-	guestConn := gonet.NewTCPConn(&wq, ep)
+	guestConn := shapeConn(limitConn(gonet.NewTCPConn(&wq, ep), release), ns.shape)
 
-	dstIP := id.LocalAddress.String()
+	if dstIP == ns.gatewayIP {
+		go proxyHostService(guestConn, int(dstPort), ns.policy, ns.events, ns.metrics)
+		return
+	}
+
+	if err := ns.budget.Check(); err != nil {
+		guestConn.Close()
+		ns.emitBlockedEvent(dst, err)
+		return
+	}
+	guestConn = budgetConn(guestConn, ns.budget, func(err error) { ns.emitBlockedEvent(dst, err) })
 
-	switch dstPort {
-	case 80:
+	switch {
+	case ns.interceptor != nil && dstPort == 80:
 		go ns.interceptor.HandleHTTP(guestConn, dstIP, int(dstPort))
-	case 443:
+	case ns.interceptor != nil && dstPort == 443:
 		go ns.interceptor.HandleHTTPS(guestConn, dstIP, int(dstPort))
 	default:
-		host := fmt.Sprintf("%s:%d", dstIP, dstPort)
-		if !ns.policy.IsHostAllowed(host) {
-			ns.emitBlockedEvent(host, "host not in allowlist")
-			guestConn.Close()
-			return
-		}
 		go ns.handlePassthrough(guestConn, dstIP, int(dstPort))
 	}
 }
 
 func (ns *NetworkStack) handlePassthrough(guestConn net.Conn, dstIP string, dstPort int) {
+	route := routePassthrough(guestConn, ns.policy, dstIP, dstPort)
+	guestConn = route.conn
 	defer guestConn.Close()
 
-	if !ns.policy.IsHostAllowed(dstIP) {
-		ns.emitBlockedEvent(net.JoinHostPort(dstIP, fmt.Sprintf("%d", dstPort)), "host not in allowlist")
+	if !route.allowed {
+		ns.emitBlockedEvent(route.host, api.ErrHostNotAllowed)
 		return
 	}
 
-	realConn, err := net.Dial("tcp", net.JoinHostPort(dstIP, fmt.Sprintf("%d", dstPort)))
+	start := time.Now()
+	realConn, err := ns.upstream.Dial(route.addr, 0)
 	if err != nil {
+		ns.metrics.RecordError(route.host)
 		return
 	}
 	defer realConn.Close()
@@ -373,19 +418,24 @@ func (ns *NetworkStack) handlePassthrough(guestConn net.Conn, dstIP string, dstP
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	var sent, received atomic.Int64
 	go func() {
-		copyWithCancel(ctx, realConn, guestConn)
+		copyWithCancel(ctx, realConn, guestConn, &sent)
 		cancel()
 	}()
 	go func() {
-		copyWithCancel(ctx, guestConn, realConn)
+		copyWithCancel(ctx, guestConn, realConn, &received)
 		cancel()
 	}()
 
 	<-ctx.Done()
+
+	recordPassthrough(ns.events, ns.metrics, route, sent.Load(), received.Load(), time.Since(start))
 }
 
-func copyWithCancel(ctx context.Context, dst, src net.Conn) {
+// copyWithCancel relays src to dst until either side fails or ctx is
+// cancelled. If counter is non-nil, relayed bytes are added to it as they flow.
+func copyWithCancel(ctx context.Context, dst, src net.Conn, counter *atomic.Int64) {
 	buf := make([]byte, 32*1024)
 	for {
 		select {
@@ -397,6 +447,9 @@ func copyWithCancel(ctx context.Context, dst, src net.Conn) {
 		n, err := src.Read(buf)
 		if n > 0 {
 			dst.Write(buf[:n])
+			if counter != nil {
+				counter.Add(int64(n))
+			}
 		}
 		if err != nil {
 			return
@@ -454,20 +507,8 @@ func (ns *NetworkStack) handleDNS(r *udp.ForwarderRequest) {
 	guestConn.Write(resp[:respN])
 }
 
-func (ns *NetworkStack) emitBlockedEvent(host, reason string) {
-	if ns.events != nil {
-		select {
-		case ns.events <- api.Event{
-			Type: "network",
-			Network: &api.NetworkEvent{
-				Host:        host,
-				Blocked:     true,
-				BlockReason: reason,
-			},
-		}:
-		default:
-		}
-	}
+func (ns *NetworkStack) emitBlockedEvent(host string, err error) {
+	emitNetworkEvent(ns.events, ns.metrics, blockedEvent(host, err))
 }
 
 func (ns *NetworkStack) Close() error {
@@ -484,6 +525,13 @@ func (ns *NetworkStack) Close() error {
 	return nil
 }
 
+// Freeze drops every frame the guest sends from now on, cutting off all of
+// its egress, including DNS and connections already open, while the VM
+// keeps running.
+func (ns *NetworkStack) Freeze() {
+	ns.linkEP.frozen.Store(true)
+}
+
 func (ns *NetworkStack) Stack() *stack.Stack {
 	return ns.stack
 }
@@ -1,4 +1,4 @@
-//go:build darwin
+//go:build darwin || linux
 
 package net
 
@@ -287,7 +287,7 @@ func benchCopyRelay(b *testing.B, chunkSize int) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go copyWithCancel(ctx, serverW, clientR)
+	go copyWithCancel(ctx, serverW, clientR, nil)
 
 	payload := make([]byte, chunkSize)
 	readBuf := make([]byte, chunkSize)
@@ -0,0 +1,93 @@
+package net
+
+import (
+	"bufio"
+	"strings"
+)
+
+// parseScutilProxy extracts proxy settings from the output of
+// `scutil --proxy`, which prints the macOS system proxy dictionary:
+//
+//	<dictionary> {
+//	  ExceptionsList : <array> {
+//	    0 : *.local
+//	  }
+//	  HTTPSEnable : 1
+//	  HTTPSPort : 3128
+//	  HTTPSProxy : proxy.corp
+//	}
+//
+// The HTTPS proxy is preferred over the HTTP one, since most intercepted
+// traffic is TLS and is tunnelled with CONNECT.
+func parseScutilProxy(out string) proxySettings {
+	values := make(map[string]string)
+	var settings proxySettings
+	inExceptions := false
+
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if inExceptions {
+			if line == "}" {
+				inExceptions = false
+				continue
+			}
+			if _, pattern, ok := strings.Cut(line, " : "); ok {
+				settings.Bypass = append(settings.Bypass, strings.TrimSpace(pattern))
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, " : ")
+		if !ok {
+			continue
+		}
+		if key == "ExceptionsList" {
+			inExceptions = true
+			continue
+		}
+		values[key] = strings.TrimSpace(value)
+	}
+
+	settings.BypassSimpleHosts = values["ExcludeSimpleHostnames"] == "1"
+	if values["ProxyAutoConfigEnable"] == "1" {
+		settings.PACURL = values["ProxyAutoConfigURLString"]
+	}
+	for _, scheme := range []string{"HTTPS", "HTTP"} {
+		host := values[scheme+"Proxy"]
+		if values[scheme+"Enable"] != "1" || host == "" {
+			continue
+		}
+		settings.ProxyURL = "http://" + host
+		if port := values[scheme+"Port"]; port != "" {
+			settings.ProxyURL += ":" + port
+		}
+		break
+	}
+	return settings
+}
+
+// envProxySettings reads the conventional proxy environment variables using
+// getenv, preferring HTTPS_PROXY over HTTP_PROXY and upper case over lower.
+func envProxySettings(getenv func(string) string) proxySettings {
+	lookup := func(name string) string {
+		if v := getenv(strings.ToUpper(name)); v != "" {
+			return v
+		}
+		return getenv(name)
+	}
+
+	var settings proxySettings
+	settings.ProxyURL = lookup("https_proxy")
+	if settings.ProxyURL == "" {
+		settings.ProxyURL = lookup("http_proxy")
+	}
+	if settings.ProxyURL != "" && !strings.Contains(settings.ProxyURL, "://") {
+		settings.ProxyURL = "http://" + settings.ProxyURL
+	}
+	for _, pattern := range strings.Split(lookup("no_proxy"), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			settings.Bypass = append(settings.Bypass, pattern)
+		}
+	}
+	return settings
+}
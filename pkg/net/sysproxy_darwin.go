@@ -0,0 +1,19 @@
+//go:build darwin
+
+package net
+
+import (
+	"os/exec"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// systemProxySettings reads the macOS system proxy configuration, the same
+// settings shown under System Settings > Network > Proxies.
+func systemProxySettings() (proxySettings, error) {
+	out, err := exec.Command("scutil", "--proxy").Output()
+	if err != nil {
+		return proxySettings{}, errx.With(ErrUpstreamProxy, " read system proxy settings: %w", err)
+	}
+	return parseScutilProxy(string(out)), nil
+}
@@ -0,0 +1,11 @@
+//go:build !darwin
+
+package net
+
+import "os"
+
+// systemProxySettings reads the proxy environment variables; only macOS has
+// a system-wide proxy configuration.
+func systemProxySettings() (proxySettings, error) {
+	return envProxySettings(os.Getenv), nil
+}
@@ -0,0 +1,343 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// pacFetchTimeout bounds how long fetching a PAC script may take.
+const pacFetchTimeout = 10 * time.Second
+
+// UpstreamProxy chains the sandbox's outbound connections through an HTTP
+// proxy. TLS and passthrough flows are tunnelled with CONNECT, while plain
+// HTTP requests are forwarded in absolute form. Hosts matching Bypass are
+// dialed directly. A nil *UpstreamProxy dials everything directly.
+type UpstreamProxy struct {
+	Addr               string   // proxy host:port
+	Bypass             []string // host, *.domain, .domain or CIDR patterns
+	BypassSimpleHosts  bool     // dial dotless hostnames directly
+	proxyAuthorization string
+}
+
+// proxySettings is the host's proxy configuration before resolution.
+type proxySettings struct {
+	ProxyURL          string
+	PACURL            string
+	Bypass            []string
+	BypassSimpleHosts bool
+}
+
+// ResolveUpstreamProxy returns the upstream proxy selected by cfg, or nil
+// when none is configured or the selected settings say to connect directly.
+// An explicit ProxyAutoConfigURL takes precedence over UpstreamProxy.
+//
+// PAC scripts are not executed, so only a script whose FindProxyForURL is a
+// single unconditional return is accepted (see pacProxyURL). This covers the
+// usual corporate PAC that sends all traffic to one proxy; scripts that
+// choose per host, including those sending some hosts DIRECT, are refused
+// and should be replaced with an explicit proxy URL and bypass list.
+func ResolveUpstreamProxy(cfg *api.NetworkConfig) (*UpstreamProxy, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if err := api.ValidateUpstreamProxy(cfg.UpstreamProxy); err != nil {
+		return nil, err
+	}
+	if err := api.ValidateProxyAutoConfigURL(cfg.ProxyAutoConfigURL); err != nil {
+		return nil, err
+	}
+
+	var settings proxySettings
+	switch {
+	case cfg.ProxyAutoConfigURL != "":
+		settings.PACURL = cfg.ProxyAutoConfigURL
+	case cfg.UpstreamProxy == api.UpstreamProxySystem:
+		s, err := systemProxySettings()
+		if err != nil {
+			return nil, err
+		}
+		settings = s
+	case cfg.UpstreamProxy != "":
+		settings.ProxyURL = cfg.UpstreamProxy
+	default:
+		return nil, nil
+	}
+
+	// As on macOS, automatic configuration overrides manual proxies.
+	if settings.PACURL != "" {
+		script, err := fetchPAC(settings.PACURL)
+		if err != nil {
+			return nil, err
+		}
+		if settings.ProxyURL, err = pacProxyURL(script); err != nil {
+			return nil, errx.With(ErrProxyAutoConfig, " %s: %w", settings.PACURL, err)
+		}
+	}
+	if settings.ProxyURL == "" {
+		return nil, nil
+	}
+	return newUpstreamProxy(settings)
+}
+
+func newUpstreamProxy(s proxySettings) (*UpstreamProxy, error) {
+	u, err := url.Parse(s.ProxyURL)
+	if err != nil || u.Hostname() == "" {
+		return nil, errx.With(ErrUpstreamProxy, ": invalid proxy URL %q", s.ProxyURL)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	p := &UpstreamProxy{
+		Addr:              net.JoinHostPort(u.Hostname(), port),
+		Bypass:            s.Bypass,
+		BypassSimpleHosts: s.BypassSimpleHosts,
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		creds := u.User.Username() + ":" + password
+		p.proxyAuthorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(creds))
+	}
+	return p, nil
+}
+
+// proxies reports whether connections to addr (host:port) go through the
+// proxy rather than directly.
+func (p *UpstreamProxy) proxies(addr string) bool {
+	if p == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	if p.BypassSimpleHosts && !strings.Contains(host, ".") && net.ParseIP(host) == nil {
+		return false
+	}
+	for _, pattern := range p.Bypass {
+		if bypassMatches(strings.ToLower(strings.TrimSpace(pattern)), host) {
+			return false
+		}
+	}
+	return true
+}
+
+// bypassMatches reports whether host matches a bypass pattern. Patterns are
+// exact hosts, "*.domain" or ".domain" suffixes, or IP networks, including
+// the abbreviated "169.254/16" form macOS uses.
+func bypassMatches(pattern, host string) bool {
+	switch {
+	case pattern == "":
+		return false
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		return strings.HasSuffix(host, pattern) || host == pattern[1:]
+	case strings.Contains(pattern, "/"):
+		ip := net.ParseIP(host)
+		_, network, err := net.ParseCIDR(expandCIDR(pattern))
+		return ip != nil && err == nil && network.Contains(ip)
+	}
+	return host == pattern
+}
+
+// expandCIDR pads an abbreviated IPv4 network such as "169.254/16" to four
+// octets.
+func expandCIDR(cidr string) string {
+	prefix, bits, _ := strings.Cut(cidr, "/")
+	if strings.Contains(prefix, ":") {
+		return cidr
+	}
+	for strings.Count(prefix, ".") < 3 {
+		prefix += ".0"
+	}
+	return prefix + "/" + bits
+}
+
+// Dial connects to addr (host:port), tunnelling through the proxy with
+// CONNECT unless addr is bypassed. A zero timeout means no timeout.
+func (p *UpstreamProxy) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if !p.proxies(addr) {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+
+	conn, err := net.DialTimeout("tcp", p.Addr, timeout)
+	if err != nil {
+		return nil, errx.With(ErrUpstreamProxy, " dial %s: %w", p.Addr, err)
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	p.authorize(req)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errx.With(ErrUpstreamProxy, " CONNECT %s: %w", addr, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errx.With(ErrUpstreamProxy, " CONNECT %s: %w", addr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errx.With(ErrUpstreamProxy, " CONNECT %s: %s", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		// The server spoke first and its bytes arrived with the CONNECT
+		// response; keep reading through br so they are not lost.
+		return &replayConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// dialHTTP returns a connection for plain HTTP requests to addr and whether
+// requests on it must be written in proxy (absolute URL) form.
+func (p *UpstreamProxy) dialHTTP(addr string, timeout time.Duration) (net.Conn, bool, error) {
+	if !p.proxies(addr) {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		return conn, false, err
+	}
+	conn, err := net.DialTimeout("tcp", p.Addr, timeout)
+	if err != nil {
+		return nil, false, errx.With(ErrUpstreamProxy, " dial %s: %w", p.Addr, err)
+	}
+	return conn, true, nil
+}
+
+// authorize adds the proxy credentials, if any, to req.
+func (p *UpstreamProxy) authorize(req *http.Request) {
+	if p != nil && p.proxyAuthorization != "" {
+		req.Header.Set("Proxy-Authorization", p.proxyAuthorization)
+	}
+}
+
+// fetchPAC downloads a PAC script from an http(s) or file URL.
+func fetchPAC(pacURL string) (string, error) {
+	u, err := url.Parse(pacURL)
+	if err != nil {
+		return "", errx.With(ErrProxyAutoConfig, " %s: %w", pacURL, err)
+	}
+	if u.Scheme == "file" {
+		data, err := os.ReadFile(u.Path)
+		if err != nil {
+			return "", errx.With(ErrProxyAutoConfig, " %s: %w", pacURL, err)
+		}
+		return string(data), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pacFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pacURL, nil)
+	if err != nil {
+		return "", errx.With(ErrProxyAutoConfig, " %s: %w", pacURL, err)
+	}
+	// The PAC file is usually served from inside the corporate network and
+	// must not itself be fetched through a proxy.
+	client := &http.Client{Transport: &http.Transport{Proxy: nil}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errx.With(ErrProxyAutoConfig, " %s: %w", pacURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errx.With(ErrProxyAutoConfig, " %s: %s", pacURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", errx.With(ErrProxyAutoConfig, " %s: %w", pacURL, err)
+	}
+	return string(data), nil
+}
+
+// pacFunction matches a PAC script, comments removed, whose FindProxyForURL
+// only returns a string literal.
+var pacFunction = regexp.MustCompile(`^\s*function\s+FindProxyForURL\s*\(\s*\w+\s*,\s*\w+\s*\)\s*\{\s*return\s*(?:"([^"\\]*)"|'([^'\\]*)')\s*;?\s*\}\s*;?\s*$`)
+
+// pacProxyDirective matches a PROXY directive naming host:port.
+var pacProxyDirective = regexp.MustCompile(`^(?i:PROXY)\s+([A-Za-z0-9.\-\[\]:]+)$`)
+
+// pacProxyURL returns the proxy a PAC script sends every host to, as an
+// http:// URL, or "" if it sends every host DIRECT. The script must be a
+// FindProxyForURL that does nothing but return one string: anything that
+// chooses per host cannot be honoured without running it. Only the first
+// directive is used; later ones are fallbacks.
+func pacProxyURL(script string) (string, error) {
+	m := pacFunction.FindStringSubmatch(stripJSComments(script))
+	if m == nil {
+		return "", ErrPACUnsupported
+	}
+	first, _, _ := strings.Cut(m[1]+m[2], ";")
+	first = strings.TrimSpace(first)
+	if strings.EqualFold(first, "DIRECT") {
+		return "", nil
+	}
+	d := pacProxyDirective.FindStringSubmatch(first)
+	if d == nil {
+		return "", errx.With(ErrPACUnsupported, ": directive %q", first)
+	}
+	return fmt.Sprintf("http://%s", d[1]), nil
+}
+
+// stripJSComments removes // and /* */ comments from JavaScript source,
+// leaving string literals, which may contain either, untouched.
+func stripJSComments(src string) string {
+	var b strings.Builder
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; {
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			end := min(j+1, len(src))
+			b.WriteString(src[i:end])
+			i = end - 1
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			b.WriteByte('\n')
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return b.String()
+			}
+			i += end + 3
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
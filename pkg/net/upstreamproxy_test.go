@@ -0,0 +1,273 @@
+package net
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/policy"
+)
+
+const scutilOutput = `<dictionary> {
+  ExceptionsList : <array> {
+    0 : *.local
+    1 : 169.254/16
+    2 : .corp.example.com
+  }
+  ExcludeSimpleHostnames : 1
+  FTPPassive : 1
+  HTTPEnable : 1
+  HTTPPort : 8080
+  HTTPProxy : http-proxy.corp
+  HTTPSEnable : 1
+  HTTPSPort : 3128
+  HTTPSProxy : proxy.corp
+}
+`
+
+func TestParseScutilProxy(t *testing.T) {
+	settings := parseScutilProxy(scutilOutput)
+	assert.Equal(t, "http://proxy.corp:3128", settings.ProxyURL)
+	assert.Empty(t, settings.PACURL)
+	assert.Equal(t, []string{"*.local", "169.254/16", ".corp.example.com"}, settings.Bypass)
+	assert.True(t, settings.BypassSimpleHosts)
+}
+
+func TestParseScutilProxy_PAC(t *testing.T) {
+	settings := parseScutilProxy(`<dictionary> {
+  HTTPEnable : 0
+  ProxyAutoConfigEnable : 1
+  ProxyAutoConfigURLString : http://wpad.corp/wpad.dat
+}
+`)
+	assert.Empty(t, settings.ProxyURL)
+	assert.Equal(t, "http://wpad.corp/wpad.dat", settings.PACURL)
+}
+
+func TestParseScutilProxy_Direct(t *testing.T) {
+	assert.Equal(t, proxySettings{}, parseScutilProxy("<dictionary> {\n  HTTPEnable : 0\n}\n"))
+}
+
+func TestEnvProxySettings(t *testing.T) {
+	env := map[string]string{
+		"http_proxy":  "http://fallback:80",
+		"HTTPS_PROXY": "proxy.corp:3128",
+		"no_proxy":    "localhost, .internal",
+	}
+	settings := envProxySettings(func(k string) string { return env[k] })
+	assert.Equal(t, "http://proxy.corp:3128", settings.ProxyURL)
+	assert.Equal(t, []string{"localhost", ".internal"}, settings.Bypass)
+}
+
+func TestPACProxyURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"proxy", `function FindProxyForURL(url, host) { return "PROXY proxy.corp:8080; DIRECT"; }`, "http://proxy.corp:8080"},
+		{"direct", `function FindProxyForURL(url, host) { return 'DIRECT'; }`, ""},
+		{"commented out proxy", `// Old proxy, kept for reference:
+// function FindProxyForURL(url, host) { return "PROXY old.corp:3128"; }
+/* return "PROXY evil.example:1"; */
+function FindProxyForURL(url, host) {
+  // return "PROXY proxy.corp:8080";
+  return "DIRECT";
+}`, ""},
+		{"comment markers in string", `function FindProxyForURL(url, host) { return "PROXY proxy.corp:8080; /* x */ DIRECT"; }`, "http://proxy.corp:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pacProxyURL(tt.script)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPACProxyURL_Unsupported(t *testing.T) {
+	scripts := map[string]string{
+		"direct branch": `function FindProxyForURL(url, host) {
+  if (isPlainHostName(host)) return "DIRECT";
+  return "PROXY proxy.corp:8080";
+}`,
+		"proxy branch": `function FindProxyForURL(url, host) {
+  if (dnsDomainIs(host, ".corp")) { return "PROXY proxy.corp:8080"; }
+  return "DIRECT";
+}`,
+		"computed":    `function FindProxyForURL(url, host) { return "PROXY " + host + ":8080"; }`,
+		"socks":       `function FindProxyForURL(url, host) { return "SOCKS proxy.corp:1080"; }`,
+		"no function": `return "PROXY proxy.corp:8080";`,
+	}
+	for name, script := range scripts {
+		t.Run(name, func(t *testing.T) {
+			_, err := pacProxyURL(script)
+			require.ErrorIs(t, err, ErrPACUnsupported)
+		})
+	}
+}
+
+func TestUpstreamProxy_Bypass(t *testing.T) {
+	p := &UpstreamProxy{
+		Addr:              "proxy.corp:3128",
+		Bypass:            []string{"*.local", "169.254/16", ".corp.example.com", "exact.org"},
+		BypassSimpleHosts: true,
+	}
+	tests := []struct {
+		addr    string
+		proxied bool
+	}{
+		{"api.openai.com:443", true},
+		{"printer.local:631", false},
+		{"169.254.169.254:80", false},
+		{"10.0.0.1:5432", true},
+		{"git.corp.example.com:443", false},
+		{"corp.example.com:443", false},
+		{"exact.org:443", false},
+		{"sub.exact.org:443", true},
+		{"intranet:80", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.proxied, p.proxies(tt.addr), tt.addr)
+	}
+
+	var none *UpstreamProxy
+	assert.False(t, none.proxies("api.openai.com:443"))
+}
+
+// startConnectProxy runs a minimal HTTP proxy that answers CONNECT by
+// echoing the tunnel and answers other requests with their request URI. The
+// Proxy-Authorization header of every request is sent on auth.
+func startConnectProxy(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	auth := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				auth <- req.Header.Get("Proxy-Authorization")
+				if req.Method == http.MethodConnect {
+					io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+					io.Copy(conn, br)
+					return
+				}
+				body := req.RequestURI
+				resp := &http.Response{
+					StatusCode:    http.StatusOK,
+					ProtoMajor:    1,
+					ProtoMinor:    1,
+					ContentLength: int64(len(body)),
+					Body:          io.NopCloser(strings.NewReader(body)),
+					Close:         true,
+				}
+				resp.Write(conn)
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), auth
+}
+
+func TestUpstreamProxy_DialConnect(t *testing.T) {
+	addr, auth := startConnectProxy(t)
+	p, err := newUpstreamProxy(proxySettings{ProxyURL: "http://user:secret@" + addr})
+	require.NoError(t, err)
+
+	conn, err := p.Dial("db.example.com:5432", 0)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "Basic dXNlcjpzZWNyZXQ=", <-auth)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestUpstreamProxy_DialRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+	}()
+
+	p := &UpstreamProxy{Addr: ln.Addr().String()}
+	_, err = p.Dial("example.com:443", 0)
+	require.ErrorIs(t, err, ErrUpstreamProxy)
+	assert.Contains(t, err.Error(), "407")
+}
+
+func TestHandleHTTP_ViaUpstreamProxy(t *testing.T) {
+	addr, _ := startConnectProxy(t)
+	upstream := &UpstreamProxy{Addr: addr}
+	pol := policy.NewEngine(&api.NetworkConfig{AllowedHosts: []string{"example.com"}})
+	interceptor := NewHTTPInterceptor(pol, make(chan api.Event, 10), nil, nil, upstream)
+
+	guest, host := net.Pipe()
+	go interceptor.HandleHTTP(host, "93.184.216.34", 80)
+	defer guest.Close()
+
+	go io.WriteString(guest, "GET /index.html?q=1 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(guest), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/index.html?q=1", string(body))
+}
+
+func TestResolveUpstreamProxy(t *testing.T) {
+	p, err := ResolveUpstreamProxy(&api.NetworkConfig{AllowedHosts: []string{"*"}})
+	require.NoError(t, err)
+	assert.Nil(t, p)
+
+	p, err = ResolveUpstreamProxy(&api.NetworkConfig{UpstreamProxy: "http://proxy.corp"})
+	require.NoError(t, err)
+	assert.Equal(t, "proxy.corp:80", p.Addr)
+
+	pac := filepath.Join(t.TempDir(), "proxy.pac")
+	require.NoError(t, os.WriteFile(pac, []byte(`function FindProxyForURL(u, h) { return "PROXY pac-proxy.corp:8080"; }`), 0644))
+	p, err = ResolveUpstreamProxy(&api.NetworkConfig{ProxyAutoConfigURL: "file://" + pac})
+	require.NoError(t, err)
+	assert.Equal(t, "pac-proxy.corp:8080", p.Addr)
+
+	_, err = ResolveUpstreamProxy(&api.NetworkConfig{ProxyAutoConfigURL: "file:///nonexistent/proxy.pac"})
+	require.ErrorIs(t, err, ErrProxyAutoConfig)
+
+	require.NoError(t, os.WriteFile(pac, []byte(`function FindProxyForURL(u, h) { if (isPlainHostName(h)) return "DIRECT"; return "PROXY pac-proxy.corp:8080"; }`), 0644))
+	_, err = ResolveUpstreamProxy(&api.NetworkConfig{ProxyAutoConfigURL: "file://" + pac})
+	require.ErrorIs(t, err, ErrProxyAutoConfig)
+	require.ErrorIs(t, err, ErrPACUnsupported)
+
+	_, err = ResolveUpstreamProxy(&api.NetworkConfig{UpstreamProxy: "socks5://proxy.corp:1080"})
+	require.ErrorIs(t, err, api.ErrInvalidUpstreamProxy)
+}
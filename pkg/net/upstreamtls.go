@@ -0,0 +1,42 @@
+package net
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// upstreamTLSConfig returns the client config used to dial an intercepted
+// HTTPS host, applying its api.UpstreamTLS options if any.
+func upstreamTLSConfig(opts *api.UpstreamTLS, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName}
+	if opts == nil {
+		return cfg, nil
+	}
+
+	version, err := api.ParseTLSVersion(opts.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MinVersion = version
+
+	if len(opts.RootCAFiles) > 0 {
+		pool := x509.NewCertPool()
+		for _, path := range opts.RootCAFiles {
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return nil, errx.With(api.ErrUpstreamRootCA, " %s: %w", path, err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errx.With(api.ErrUpstreamRootCA, " %s: no PEM certificates found", path)
+			}
+		}
+		cfg.RootCAs = pool
+	}
+
+	cfg.InsecureSkipVerify = opts.InsecureSkipVerify
+	return cfg, nil
+}
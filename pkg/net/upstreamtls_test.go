@@ -0,0 +1,163 @@
+package net
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamTLSConfig_Defaults(t *testing.T) {
+	cfg, err := upstreamTLSConfig(nil, "api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "api.example.com", cfg.ServerName)
+	assert.Nil(t, cfg.RootCAs)
+	assert.False(t, cfg.InsecureSkipVerify)
+}
+
+func TestUpstreamTLSConfig_Options(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.NotFoundHandler())
+	defer upstream.Close()
+	caFile := writeCertPEM(t, upstream)
+
+	cfg, err := upstreamTLSConfig(&api.UpstreamTLS{
+		RootCAFiles:        []string{caFile},
+		MinVersion:         "1.3",
+		InsecureSkipVerify: true,
+	}, "lab.internal")
+	require.NoError(t, err)
+	assert.NotNil(t, cfg.RootCAs)
+	assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+	assert.True(t, cfg.InsecureSkipVerify)
+}
+
+func TestUpstreamTLSConfig_BadRootCA(t *testing.T) {
+	_, err := upstreamTLSConfig(&api.UpstreamTLS{RootCAFiles: []string{filepath.Join(t.TempDir(), "missing.pem")}}, "lab.internal")
+	require.ErrorIs(t, err, api.ErrUpstreamRootCA)
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(empty, []byte("not a cert"), 0644))
+	_, err = upstreamTLSConfig(&api.UpstreamTLS{RootCAFiles: []string{empty}}, "lab.internal")
+	require.ErrorIs(t, err, api.ErrUpstreamRootCA)
+}
+
+func TestHandleHTTPS_UpstreamTLS(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	upstream.Config.ErrorLog = log.New(io.Discard, "", 0)
+	upstream.StartTLS()
+	defer upstream.Close()
+	addr := upstream.Listener.Addr().(*net.TCPAddr)
+	caFile := writeCertPEM(t, upstream)
+
+	tests := []struct {
+		name        string
+		upstreamTLS map[string]api.UpstreamTLS
+		certPins    map[string][]string
+		wantOK      bool
+		wantEvent   api.NetworkEvent
+	}{
+		{
+			name:   "self-signed upstream rejected by default",
+			wantOK: false,
+		},
+		{
+			name:        "custom root CA",
+			upstreamTLS: map[string]api.UpstreamTLS{"127.0.0.1": {RootCAFiles: []string{caFile}}},
+			wantOK:      true,
+			wantEvent:   api.NetworkEvent{Host: "127.0.0.1", StatusCode: http.StatusOK},
+		},
+		{
+			name:        "insecure skip verify is flagged",
+			upstreamTLS: map[string]api.UpstreamTLS{"127.0.0.1": {InsecureSkipVerify: true}},
+			wantOK:      true,
+			wantEvent:   api.NetworkEvent{Host: "127.0.0.1", StatusCode: http.StatusOK, InsecureTLS: true},
+		},
+		{
+			name:        "pin mismatch blocks before forwarding",
+			upstreamTLS: map[string]api.UpstreamTLS{"127.0.0.1": {InsecureSkipVerify: true}},
+			certPins:    map[string][]string{"127.0.0.1": {api.CertPinPrefix + "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}},
+			wantOK:      false,
+			wantEvent:   api.NetworkEvent{Host: "127.0.0.1", Blocked: true, BlockReason: api.ErrCertPinMismatch.Error()},
+		},
+		{
+			name:        "pin match",
+			upstreamTLS: map[string]api.UpstreamTLS{"127.0.0.1": {RootCAFiles: []string{caFile}}},
+			certPins:    map[string][]string{"127.0.0.1": {policy.SPKIPin(upstream.Certificate())}},
+			wantOK:      true,
+			wantEvent:   api.NetworkEvent{Host: "127.0.0.1", StatusCode: http.StatusOK},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caPool, err := NewCAPool()
+			require.NoError(t, err)
+			pol := policy.NewEngine(&api.NetworkConfig{
+				AllowedHosts: []string{"127.0.0.1"},
+				UpstreamTLS:  tt.upstreamTLS,
+				CertPins:     tt.certPins,
+			})
+			events := make(chan api.Event, 10)
+			interceptor := NewHTTPInterceptor(pol, events, caPool, nil, nil)
+
+			client, server := net.Pipe()
+			defer client.Close()
+			go interceptor.HandleHTTPS(server, addr.IP.String(), addr.Port)
+
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			guest := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+			require.NoError(t, guest.Handshake())
+			// net.Pipe is unbuffered: write concurrently so a proxy that
+			// closes without reading cannot deadlock the test.
+			go guest.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n"))
+
+			resp, err := http.ReadResponse(bufio.NewReader(guest), nil)
+			if !tt.wantOK {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+
+			if tt.wantEvent.Host == "" {
+				assert.Empty(t, events)
+				return
+			}
+			select {
+			case ev := <-events:
+				require.NotNil(t, ev.Network)
+				assert.Equal(t, tt.wantEvent.Host, ev.Network.Host)
+				assert.Equal(t, tt.wantEvent.StatusCode, ev.Network.StatusCode)
+				assert.Equal(t, tt.wantEvent.Blocked, ev.Network.Blocked)
+				assert.Equal(t, tt.wantEvent.BlockReason, ev.Network.BlockReason)
+				assert.Equal(t, tt.wantEvent.InsecureTLS, ev.Network.InsecureTLS)
+			case <-time.After(2 * time.Second):
+				require.Fail(t, "expected a network event")
+			}
+		})
+	}
+}
+
+func writeCertPEM(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	return path
+}
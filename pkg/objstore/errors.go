@@ -0,0 +1,8 @@
+package objstore
+
+import "errors"
+
+var (
+	ErrAWSConfig = errors.New("load AWS config")
+	ErrS3        = errors.New("s3 request")
+)
@@ -0,0 +1,194 @@
+// Package objstore implements vfs.ObjectStore for object storage services,
+// so buckets can be mounted into a sandbox while their credentials stay on
+// the host.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+type s3API interface {
+	ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	HeadObject(ctx context.Context, in *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// S3Store is a vfs.ObjectStore over one S3 bucket. The client is created on
+// first use from the default AWS credential chain, so a sandbox with an s3
+// mount starts even when credentials are only needed later.
+type S3Store struct {
+	mount api.S3Mount
+
+	once    sync.Once
+	initErr error
+	client  s3API
+}
+
+var _ vfs.ObjectStore = (*S3Store)(nil)
+
+// NewS3Store returns a store for the bucket of mount.
+func NewS3Store(mount api.S3Mount) *S3Store {
+	return &S3Store{mount: mount}
+}
+
+func (s *S3Store) init(ctx context.Context) error {
+	s.once.Do(func() {
+		if s.client != nil {
+			return
+		}
+		var opts []func(*config.LoadOptions) error
+		if s.mount.Region != "" {
+			opts = append(opts, config.WithRegion(s.mount.Region))
+		}
+		cfg, err := config.LoadDefaultConfig(ctx, opts...)
+		if err != nil {
+			s.initErr = errx.Wrap(ErrAWSConfig, err)
+			return
+		}
+		s.client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+			if s.mount.Endpoint != "" {
+				o.BaseEndpoint = aws.String(s.mount.Endpoint)
+				o.UsePathStyle = true
+			}
+		})
+	})
+	return s.initErr
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string, limit int) ([]vfs.ObjectInfo, []string, error) {
+	if err := s.init(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	in := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.mount.Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	if limit > 0 {
+		in.MaxKeys = aws.Int32(int32(limit))
+	}
+
+	var (
+		objects  []vfs.ObjectInfo
+		prefixes []string
+	)
+	paginator := s3.NewListObjectsV2Paginator(s.client, in)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, s.wrap(prefix, err)
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, vfs.ObjectInfo{
+				Key:     aws.ToString(obj.Key),
+				Size:    aws.ToInt64(obj.Size),
+				ModTime: aws.ToTime(obj.LastModified),
+			})
+		}
+		for _, p := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.ToString(p.Prefix))
+		}
+		if limit > 0 && len(objects)+len(prefixes) >= limit {
+			break
+		}
+	}
+	return objects, prefixes, nil
+}
+
+func (s *S3Store) Head(ctx context.Context, key string) (vfs.ObjectInfo, error) {
+	if err := s.init(ctx); err != nil {
+		return vfs.ObjectInfo{}, err
+	}
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.mount.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return vfs.ObjectInfo{}, s.wrap(key, err)
+	}
+	return vfs.ObjectInfo{
+		Key:     key,
+		Size:    aws.ToInt64(out.ContentLength),
+		ModTime: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string, w io.Writer) error {
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.mount.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return s.wrap(key, err)
+	}
+	defer out.Body.Close()
+	if _, err := io.Copy(w, out.Body); err != nil {
+		return s.wrap(key, err)
+	}
+	return nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error {
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.mount.Bucket),
+		Key:           aws.String(key),
+		Body:          r,
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		return s.wrap(key, err)
+	}
+	return nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.mount.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return s.wrap(key, err)
+	}
+	return nil
+}
+
+// wrap tags err with the object it concerns and marks missing objects with
+// fs.ErrNotExist, as vfs.ObjectStore requires.
+func (s *S3Store) wrap(key string, err error) error {
+	var (
+		noKey    *types.NoSuchKey
+		notFound *types.NotFound
+		apiErr   smithy.APIError
+	)
+	if errors.As(err, &noKey) || errors.As(err, &notFound) ||
+		(errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound") {
+		return errx.With(ErrS3, " s3://%s/%s: %w: %w", s.mount.Bucket, key, fs.ErrNotExist, err)
+	}
+	return errx.With(ErrS3, " s3://%s/%s: %w", s.mount.Bucket, key, err)
+}
@@ -0,0 +1,100 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+type fakeS3 struct {
+	s3API
+	objects map[string]string
+}
+
+func (f *fakeS3) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	out := &s3.ListObjectsV2Output{}
+	seen := map[string]bool{}
+	for key, data := range f.objects {
+		rest, ok := strings.CutPrefix(key, aws.ToString(in.Prefix))
+		if !ok {
+			continue
+		}
+		if dir, _, nested := strings.Cut(rest, "/"); nested {
+			if p := aws.ToString(in.Prefix) + dir + "/"; !seen[p] {
+				seen[p] = true
+				out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(p)})
+			}
+			continue
+		}
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(key), Size: aws.Int64(int64(len(data)))})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	data, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+func (f *fakeS3) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(data))}, nil
+}
+
+func (f *fakeS3) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(in.Key)] = string(data)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestS3StoreThroughProvider(t *testing.T) {
+	client := &fakeS3{objects: map[string]string{"raw/a.csv": "1,2\n", "raw/2024/b.csv": "3,4\n"}}
+	store := &S3Store{mount: api.S3Mount{Bucket: "datasets"}, client: client}
+	p := vfs.NewObjectStoreProvider(store, "raw")
+
+	entries, err := p.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "2024", entries[0].Name())
+	assert.Equal(t, "a.csv", entries[1].Name())
+
+	_, err = p.Stat("/missing.csv")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	h, err := p.Create("/out.csv", 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("5,6\n"))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+	assert.Equal(t, "5,6\n", client.objects["raw/out.csv"])
+}
+
+func TestS3StoreNotFound(t *testing.T) {
+	store := &S3Store{mount: api.S3Mount{Bucket: "datasets"}, client: &fakeS3{objects: map[string]string{}}}
+
+	_, err := store.Head(context.Background(), "nope")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.ErrorIs(t, err, ErrS3)
+	err = store.Get(context.Background(), "nope", io.Discard)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
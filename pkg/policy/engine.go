@@ -1,41 +1,120 @@
 package policy
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/jingkaihe/matchlock/internal/errx"
 	"github.com/jingkaihe/matchlock/pkg/api"
 )
 
 type Engine struct {
 	config       *api.NetworkConfig
 	placeholders map[string]string
+	tokens       map[string]tokenSource
+	usage        *secretUsage
+
+	// secrets is the live copy of config.Secrets. UpdateSecret swaps in a
+	// new map rather than modifying it, so readers need not hold mu after
+	// currentSecrets returns.
+	mu      sync.Mutex
+	secrets map[string]api.Secret
+	retired map[string][]string
 }
 
 func NewEngine(config *api.NetworkConfig) *Engine {
 	e := &Engine{
 		config:       config,
 		placeholders: make(map[string]string),
+		tokens:       make(map[string]tokenSource),
+		secrets:      make(map[string]api.Secret, len(config.Secrets)),
+		retired:      make(map[string][]string),
 	}
 
+	names := make([]string, 0, len(config.Secrets))
 	for name, secret := range config.Secrets {
+		names = append(names, name)
 		if secret.Placeholder == "" {
-			placeholder := generatePlaceholder()
-			config.Secrets[name] = api.Secret{
-				Value:       secret.Value,
-				Placeholder: placeholder,
-				Hosts:       secret.Hosts,
-			}
+			secret.Placeholder = generatePlaceholder()
+			config.Secrets[name] = secret
 		}
 		e.placeholders[name] = config.Secrets[name].Placeholder
+		e.secrets[name] = config.Secrets[name]
+		if secret.OAuth2 != nil {
+			e.tokens[name] = newOAuth2Source(*secret.OAuth2)
+		}
+		if secret.GitHubApp != nil {
+			e.tokens[name] = newGitHubAppSource(*secret.GitHubApp)
+		}
 	}
+	e.usage = newSecretUsage(names)
 
 	return e
 }
 
+// SecretUsage reports, per configured secret sorted by name, how often and
+// where it has been injected so far.
+func (e *Engine) SecretUsage() []api.SecretUsage {
+	if e == nil {
+		return nil
+	}
+	return e.usage.snapshot()
+}
+
+// UpdateSecret rotates the real value of a secret. The placeholder stays the
+// same, so the guest keeps working; requests processed from now on get the
+// new value. The old value is still scrubbed from responses. OAuth2 and
+// GitHub App secrets have no static value and cannot be rotated this way.
+func (e *Engine) UpdateSecret(name, value string) error {
+	if value == "" {
+		return errx.With(api.ErrRotateSecret, ": empty value for %s", name)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	secret, ok := e.secrets[name]
+	if !ok {
+		return errx.With(api.ErrUnknownSecret, ": %s", name)
+	}
+	if secret.MintsTokens() {
+		return errx.With(api.ErrRotateSecret, ": %s mints its own tokens", name)
+	}
+	if secret.Value == value {
+		return nil
+	}
+
+	secrets := make(map[string]api.Secret, len(e.secrets))
+	for n, s := range e.secrets {
+		secrets[n] = s
+	}
+	e.retired[name] = append(e.retired[name], secret.Value)
+	secret.Value = value
+	secrets[name] = secret
+	e.secrets = secrets
+	return nil
+}
+
+func (e *Engine) currentSecrets() map[string]api.Secret {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.secrets
+}
+
 func generatePlaceholder() string {
 	b := make([]byte, 16)
 	rand.Read(b)
@@ -76,32 +155,251 @@ func (e *Engine) IsHostAllowed(host string) bool {
 	return false
 }
 
+// Intercepts reports whether the proxy may decrypt and rewrite traffic to
+// host. Hosts matching NoInterceptHosts are relayed untouched, so secrets are
+// never injected into them.
+func (e *Engine) Intercepts(host string) bool {
+	host = strings.Split(host, ":")[0]
+
+	for _, pattern := range e.config.NoInterceptHosts {
+		if matchGlob(pattern, host) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasNoInterceptHosts reports whether any host is excluded from interception.
+func (e *Engine) HasNoInterceptHosts() bool {
+	return len(e.config.NoInterceptHosts) > 0
+}
+
+// CheckUnintercepted guards a request to a host that is not intercepted:
+// since no secret is ever substituted there, any placeholder in its URL,
+// headers or (for secrets injected into bodies) body is treated as a leak.
+func (e *Engine) CheckUnintercepted(req *http.Request) error {
+	secrets := e.currentSecrets()
+	body := e.bufferBodyIfNeeded(req, secrets)
+	for _, secret := range secrets {
+		if e.requestContainsPlaceholder(req, body, secret) {
+			return api.ErrSecretLeak
+		}
+	}
+	return nil
+}
+
+// IsHostPortAllowed reports whether the guest may reach the given port on the
+// host loopback interface via api.HostAlias.
+func (e *Engine) IsHostPortAllowed(port int) bool {
+	for _, p := range e.config.HostPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// CertPins returns the SPKI pins that apply to host. Pins from every matching
+// pattern are combined.
+func (e *Engine) CertPins(host string) []string {
+	host = strings.Split(host, ":")[0]
+
+	var pins []string
+	for pattern, p := range e.config.CertPins {
+		if matchGlob(pattern, host) {
+			pins = append(pins, p...)
+		}
+	}
+	return pins
+}
+
+// VerifyCertPin checks an upstream certificate chain against the pins for
+// host. It passes when host has no pins or when any certificate in the chain
+// carries a pinned public key, so intermediates and roots may be pinned too.
+func (e *Engine) VerifyCertPin(host string, chain []*x509.Certificate) error {
+	pins := e.CertPins(host)
+	if len(pins) == 0 {
+		return nil
+	}
+	for _, cert := range chain {
+		pin := SPKIPin(cert)
+		for _, p := range pins {
+			if p == pin {
+				return nil
+			}
+		}
+	}
+	return api.ErrCertPinMismatch
+}
+
+// UpstreamTLS returns the upstream TLS options for host, or nil if none are
+// configured. An exact host entry wins over patterns; among matching
+// patterns the longest, i.e. most specific, is used.
+func (e *Engine) UpstreamTLS(host string) *api.UpstreamTLS {
+	host = strings.Split(host, ":")[0]
+
+	if opts, ok := e.config.UpstreamTLS[host]; ok {
+		return &opts
+	}
+	best := ""
+	for pattern := range e.config.UpstreamTLS {
+		if matchGlob(pattern, host) && (len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best)) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	opts := e.config.UpstreamTLS[best]
+	return &opts
+}
+
+// SPKIPin returns the pin of cert's public key in api.CertPinPrefix form.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return api.CertPinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
 func (e *Engine) OnRequest(req *http.Request, host string) (*http.Request, error) {
 	host = strings.Split(host, ":")[0]
 
-	for name, secret := range e.config.Secrets {
-		if !e.isSecretAllowedForHost(name, host) {
-			if e.requestContainsPlaceholder(req, secret.Placeholder) {
+	secrets := e.currentSecrets()
+	body := e.bufferBodyIfNeeded(req, secrets)
+	bodyChanged := false
+	now := time.Now()
+	for name, secret := range secrets {
+		if !secretAllowedForHost(secret, host) {
+			if e.requestContainsPlaceholder(req, body, secret) {
 				return nil, api.ErrSecretLeak
 			}
 			continue
 		}
-		e.replaceInRequest(req, secret.Placeholder, secret.Value)
+		if !secret.AllowsRequest(req.Method, requestPath(req)) {
+			if e.requestContainsPlaceholder(req, body, secret) {
+				return nil, api.ErrSecretScope
+			}
+			continue
+		}
+		// An expired secret refuses every request it would have been
+		// injected into, rather than letting it reach upstream without.
+		if secret.Expired(now) {
+			if secret.MintsTokens() || secret.Header != "" || e.requestContainsPlaceholder(req, body, secret) {
+				return nil, errx.With(api.ErrSecretExpired, ": %s expired at %s", name, secret.ExpiresAt.Format(time.RFC3339))
+			}
+			continue
+		}
+		if secret.MintsTokens() {
+			if err := e.setBearerToken(req, name); err != nil {
+				return nil, err
+			}
+			e.usage.record(name, host, requestPath(req))
+			continue
+		}
+		injected := e.replaceInRequest(req, secret)
+		if header, value, ok := secret.InjectedHeader(); ok {
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			req.Header.Set(header, value)
+			injected = true
+		}
+		if body != nil && secret.InjectsInto(api.SecretInBody) {
+			if replaced, ok := replaceInBody(req.Header.Get("Content-Type"), body, secret.Placeholder, secret.Value); ok {
+				body = replaced
+				bodyChanged = true
+				injected = true
+			}
+		}
+		if injected {
+			e.usage.record(name, host, requestPath(req))
+		}
+	}
+	if bodyChanged {
+		setBody(req, body)
+	}
+	if err := e.signRequest(req, host, secrets, body, now); err != nil {
+		return nil, err
+	}
+	// A response in an encoding OnResponse cannot scan could carry secret
+	// values back to the guest, so only scannable ones are asked for.
+	if req.Header.Get("Accept-Encoding") != "" && e.scrubber() != nil {
+		req.Header.Set("Accept-Encoding", scannableEncodings)
 	}
 
 	return req, nil
 }
 
-func (e *Engine) OnResponse(resp *http.Response, req *http.Request, host string) (*http.Response, error) {
-	return resp, nil
+// RetryUnauthorized is called when upstream rejects req, which OnRequest has
+// already processed, with 401 Unauthorized. The minted tokens injected into
+// req are discarded and, if req can be replayed, a copy carrying fresh tokens
+// is returned. It returns nil when req used no OAuth2 or GitHub App secret.
+func (e *Engine) RetryUnauthorized(req *http.Request, host string) *http.Request {
+	host = strings.Split(host, ":")[0]
+
+	var names []string
+	for name, secret := range e.currentSecrets() {
+		if secret.MintsTokens() && !secret.Expired(time.Now()) && secretAllowedForHost(secret, host) && secret.AllowsRequest(req.Method, requestPath(req)) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	sent, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	for _, name := range names {
+		e.tokens[name].Invalidate(sent)
+	}
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return nil
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil
+		}
+		retry.Body = body
+	}
+	for _, name := range names {
+		if err := e.setBearerToken(retry, name); err != nil {
+			return nil
+		}
+		e.usage.record(name, host, requestPath(retry))
+	}
+	return retry
 }
 
-func (e *Engine) isSecretAllowedForHost(secretName, host string) bool {
-	secret, ok := e.config.Secrets[secretName]
-	if !ok {
-		return false
+// setBearerToken sends the current token of the named OAuth2 or GitHub App
+// secret in the Authorization header, replacing whatever the guest sent.
+func (e *Engine) setBearerToken(req *http.Request, name string) error {
+	token, err := e.tokens[name].Token(req.Context())
+	if err != nil {
+		return errx.With(err, " for secret %s", name)
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
 	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
 
+// OnResponse replaces real secret values that upstream echoes back in the
+// response headers or body with their placeholders, so they never reach the
+// guest. A response whose body cannot be scanned fails; see scrubResponse.
+func (e *Engine) OnResponse(resp *http.Response, req *http.Request, host string) (*http.Response, error) {
+	s := e.scrubber()
+	if s == nil {
+		return resp, nil
+	}
+	if err := s.scrubResponse(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func secretAllowedForHost(secret api.Secret, host string) bool {
 	if len(secret.Hosts) == 0 {
 		return true
 	}
@@ -115,7 +413,19 @@ func (e *Engine) isSecretAllowedForHost(secretName, host string) bool {
 	return false
 }
 
-func (e *Engine) requestContainsPlaceholder(req *http.Request, placeholder string) bool {
+func requestPath(req *http.Request) string {
+	if req.URL == nil {
+		return ""
+	}
+	return req.URL.Path
+}
+
+func (e *Engine) requestContainsPlaceholder(req *http.Request, body []byte, secret api.Secret) bool {
+	placeholder := secret.Placeholder
+	if body != nil && secret.InjectsInto(api.SecretInBody) && bytes.Contains(body, []byte(placeholder)) {
+		return true
+	}
+
 	for _, values := range req.Header {
 		for _, v := range values {
 			if strings.Contains(v, placeholder) {
@@ -133,25 +443,125 @@ func (e *Engine) requestContainsPlaceholder(req *http.Request, placeholder strin
 	return false
 }
 
-// replaceInRequest substitutes the placeholder with the real secret in headers
-// and URL query params only. We intentionally skip the request body because the
-// body is processed by the remote server's application layer, which may log or
-// echo it back in responses — leaking the real secret into the VM.
-func (e *Engine) replaceInRequest(req *http.Request, placeholder, value string) {
-	for key, values := range req.Header {
-		for i, v := range values {
-			if strings.Contains(v, placeholder) {
-				req.Header[key][i] = strings.ReplaceAll(v, placeholder, value)
+// replaceInRequest substitutes the placeholder with the real secret in the
+// headers and query string, as far as the secret's locations allow. Bodies
+// are only rewritten for secrets that opt in (see replaceInBody) because the
+// remote application may log or echo a body back in its response, leaking the
+// real secret into the VM. It reports whether anything was replaced.
+func (e *Engine) replaceInRequest(req *http.Request, secret api.Secret) bool {
+	placeholder, value := secret.Placeholder, secret.Value
+	replaced := false
+
+	if secret.InjectsInto(api.SecretInHeader) {
+		for key, values := range req.Header {
+			for i, v := range values {
+				if strings.Contains(v, placeholder) {
+					req.Header[key][i] = strings.ReplaceAll(v, placeholder, value)
+					replaced = true
+				}
 			}
 		}
 	}
 
-	if req.URL != nil {
+	if req.URL != nil && secret.InjectsInto(api.SecretInQuery) {
 		if strings.Contains(req.URL.RawQuery, placeholder) {
-			req.URL.RawQuery = strings.ReplaceAll(req.URL.RawQuery, placeholder, value)
+			req.URL.RawQuery = strings.ReplaceAll(req.URL.RawQuery, placeholder, url.QueryEscape(value))
+			replaced = true
+		}
+	}
+	return replaced
+}
+
+// maxSecretBodySize caps how much of a request body is buffered to look for
+// placeholders. Larger bodies are forwarded untouched.
+const maxSecretBodySize = 8 << 20
+
+// bufferBodyIfNeeded reads the request body into memory when a secret may be
+// injected into it, and returns nil otherwise. Compressed and oversized
+// bodies are not buffered. The request keeps an equivalent, unread body.
+func (e *Engine) bufferBodyIfNeeded(req *http.Request, secrets map[string]api.Secret) []byte {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	// Requests carrying minted tokens are buffered too so they can be
+	// replayed with a fresh token after a 401.
+	needed := false
+	for _, secret := range secrets {
+		if secret.InjectsInto(api.SecretInBody) || secret.MintsTokens() {
+			needed = true
+			break
+		}
+	}
+	if !needed {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSecretBodySize+1))
+	if err != nil || len(body) > maxSecretBodySize {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil
+	}
+	req.Body.Close()
+	setBody(req, body)
+	return body
+}
+
+// setBody replaces the request body and re-computes its length so the
+// upstream request is framed with the substituted size.
+func setBody(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+	if req.Header != nil {
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		req.Header.Del("Transfer-Encoding")
+	}
+}
+
+// replaceInBody substitutes the placeholder in a body of the given content
+// type, escaping the value to fit the encoding. It reports false, leaving the
+// body alone, for content types it does not understand.
+func replaceInBody(contentType string, body []byte, placeholder, value string) ([]byte, bool) {
+	if !bytes.Contains(body, []byte(placeholder)) {
+		return body, false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return body, false
+	}
+
+	var escaped string
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(value); err != nil {
+			return body, false
 		}
+		// Drop the surrounding quotes and trailing newline: the placeholder
+		// already sits inside a JSON string.
+		escaped = strings.TrimSuffix(buf.String(), "\n")
+		escaped = escaped[1 : len(escaped)-1]
+	case mediaType == "application/x-www-form-urlencoded":
+		escaped = url.QueryEscape(value)
+	case strings.HasPrefix(mediaType, "text/"):
+		escaped = value
+	default:
+		return body, false
 	}
 
+	return bytes.ReplaceAll(body, []byte(placeholder), []byte(escaped)), true
 }
 
 func matchGlob(pattern, str string) bool {
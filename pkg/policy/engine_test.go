@@ -1,11 +1,20 @@
 package policy
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
 	"io"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jingkaihe/matchlock/pkg/api"
 	"github.com/stretchr/testify/assert"
@@ -290,3 +299,387 @@ func TestIsPrivateIP(t *testing.T) {
 		})
 	}
 }
+
+func TestEngine_IsHostPortAllowed(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		HostPorts: []int{11434, 8000},
+	})
+
+	assert.True(t, engine.IsHostPortAllowed(11434))
+	assert.True(t, engine.IsHostPortAllowed(8000))
+	assert.False(t, engine.IsHostPortAllowed(22))
+}
+
+func TestEngine_IsHostPortAllowed_NoneConfigured(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{})
+
+	assert.False(t, engine.IsHostPortAllowed(11434))
+}
+
+func testCert(t *testing.T) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestEngine_VerifyCertPin(t *testing.T) {
+	leaf, other := testCert(t), testCert(t)
+	engine := NewEngine(&api.NetworkConfig{
+		CertPins: map[string][]string{
+			"api.example.com": {SPKIPin(leaf)},
+		},
+	})
+
+	require.NoError(t, engine.VerifyCertPin("api.example.com", []*x509.Certificate{leaf}))
+	require.NoError(t, engine.VerifyCertPin("api.example.com:443", []*x509.Certificate{other, leaf}))
+	require.ErrorIs(t, engine.VerifyCertPin("api.example.com", []*x509.Certificate{other}), api.ErrCertPinMismatch)
+	require.ErrorIs(t, engine.VerifyCertPin("api.example.com", nil), api.ErrCertPinMismatch)
+
+	// Hosts without pins are not restricted.
+	require.NoError(t, engine.VerifyCertPin("other.example.com", []*x509.Certificate{other}))
+}
+
+func TestEngine_CertPins_Wildcard(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		CertPins: map[string][]string{
+			"*.example.com":   {"sha256/a"},
+			"api.example.com": {"sha256/b"},
+		},
+	})
+
+	assert.ElementsMatch(t, []string{"sha256/a", "sha256/b"}, engine.CertPins("api.example.com"))
+	assert.Equal(t, []string{"sha256/a"}, engine.CertPins("cdn.example.com"))
+	assert.Empty(t, engine.CertPins("example.org"))
+}
+
+func TestEngine_UpstreamTLS(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		UpstreamTLS: map[string]api.UpstreamTLS{
+			"*":                  {MinVersion: "1.2"},
+			"*.lab.internal":     {RootCAFiles: []string{"/etc/lab.pem"}},
+			"dev.lab.internal":   {InsecureSkipVerify: true},
+			"*.dev.lab.internal": {MinVersion: "1.3"},
+		},
+	})
+
+	require.NotNil(t, engine.UpstreamTLS("dev.lab.internal:443"))
+	assert.True(t, engine.UpstreamTLS("dev.lab.internal:443").InsecureSkipVerify)
+	assert.Equal(t, "1.3", engine.UpstreamTLS("a.dev.lab.internal").MinVersion)
+	assert.Equal(t, []string{"/etc/lab.pem"}, engine.UpstreamTLS("ci.lab.internal").RootCAFiles)
+	assert.Equal(t, "1.2", engine.UpstreamTLS("example.com").MinVersion)
+
+	assert.Nil(t, NewEngine(&api.NetworkConfig{}).UpstreamTLS("example.com"))
+}
+
+func TestEngine_Intercepts(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		NoInterceptHosts: []string{"*.apple.com", "bank.example.com"},
+	})
+
+	assert.True(t, engine.HasNoInterceptHosts())
+	assert.False(t, engine.Intercepts("updates.apple.com"))
+	assert.False(t, engine.Intercepts("bank.example.com:443"))
+	assert.True(t, engine.Intercepts("api.example.com"))
+	assert.False(t, NewEngine(&api.NetworkConfig{}).HasNoInterceptHosts())
+}
+
+func TestEngine_CheckUnintercepted(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {Value: "real-secret", Hosts: []string{"bank.example.com"}},
+		},
+		NoInterceptHosts: []string{"bank.example.com"},
+	})
+	placeholder := engine.GetPlaceholder("API_KEY")
+
+	clean := &http.Request{Header: http.Header{}, URL: &url.URL{Path: "/"}}
+	require.NoError(t, engine.CheckUnintercepted(clean))
+
+	// Even a host the secret is scoped to never receives a placeholder once
+	// it is excluded from interception, since nothing would substitute it.
+	leak := &http.Request{
+		Header: http.Header{"Authorization": []string{"Bearer " + placeholder}},
+		URL:    &url.URL{Path: "/"},
+	}
+	require.ErrorIs(t, engine.CheckUnintercepted(leak), api.ErrSecretLeak)
+}
+
+func TestEngine_OnRequest_BodyReplacementJSON(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {
+				Value: `real"secret<>`,
+				Hosts: []string{"api.example.com"},
+				In:    []string{api.SecretInBody},
+			},
+		},
+	})
+
+	placeholder := engine.GetPlaceholder("API_KEY")
+	body := `{"key":"` + placeholder + `"}`
+	req := httptest.NewRequest("POST", "http://api.example.com/v1", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("X-Key", placeholder)
+
+	result, err := engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+
+	got, err := io.ReadAll(result.Body)
+	require.NoError(t, err)
+	var decoded struct {
+		Key string `json:"key"`
+	}
+	require.NoError(t, json.Unmarshal(got, &decoded))
+	assert.Equal(t, `real"secret<>`, decoded.Key)
+	assert.Equal(t, int64(len(got)), result.ContentLength)
+	assert.Equal(t, strconv.Itoa(len(got)), result.Header.Get("Content-Length"))
+	assert.Equal(t, placeholder, result.Header.Get("X-Key"), "header is not a configured location")
+}
+
+func TestEngine_OnRequest_BodyReplacementForm(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {
+				Value: "a&b=c d",
+				Hosts: []string{"api.example.com"},
+				In:    []string{api.SecretInBody},
+			},
+		},
+	})
+
+	placeholder := engine.GetPlaceholder("API_KEY")
+	req := httptest.NewRequest("POST", "http://api.example.com/token", strings.NewReader("grant=x&key="+placeholder))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	result, err := engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	require.NoError(t, result.ParseForm())
+	assert.Equal(t, "a&b=c d", result.PostForm.Get("key"))
+	assert.Equal(t, "x", result.PostForm.Get("grant"))
+}
+
+func TestEngine_OnRequest_BodyUnknownContentType(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {
+				Value: "real-secret",
+				Hosts: []string{"api.example.com"},
+				In:    []string{api.SecretInBody},
+			},
+		},
+	})
+
+	placeholder := engine.GetPlaceholder("API_KEY")
+	req := httptest.NewRequest("POST", "http://api.example.com/upload", strings.NewReader(placeholder))
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	result, err := engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	got, _ := io.ReadAll(result.Body)
+	assert.Equal(t, placeholder, string(got))
+}
+
+func TestEngine_OnRequest_BodyLeakBlocked(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {
+				Value: "real-secret",
+				Hosts: []string{"api.example.com"},
+				In:    []string{api.SecretInBody},
+			},
+		},
+	})
+
+	placeholder := engine.GetPlaceholder("API_KEY")
+	req := httptest.NewRequest("POST", "http://evil.com/", strings.NewReader(`{"key":"`+placeholder+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	_, err := engine.OnRequest(req, "evil.com")
+	assert.ErrorIs(t, err, api.ErrSecretLeak)
+}
+
+func TestEngine_OnRequest_QueryValueEscaped(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {
+				Value: "a&b=c",
+				Hosts: []string{"api.example.com"},
+				In:    []string{api.SecretInQuery},
+			},
+		},
+	})
+
+	placeholder := engine.GetPlaceholder("API_KEY")
+	req := httptest.NewRequest("GET", "http://api.example.com/v1?key="+placeholder+"&x=1", nil)
+	req.Header.Set("Authorization", "Bearer "+placeholder)
+
+	result, err := engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "a&b=c", result.URL.Query().Get("key"))
+	assert.Equal(t, "1", result.URL.Query().Get("x"))
+	assert.Equal(t, "Bearer "+placeholder, result.Header.Get("Authorization"))
+}
+
+func TestEngine_OnRequest_LargeBodyNotBuffered(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {
+				Value: "real-secret",
+				Hosts: []string{"api.example.com"},
+				In:    []string{api.SecretInBody},
+			},
+		},
+	})
+
+	placeholder := engine.GetPlaceholder("API_KEY")
+	body := placeholder + strings.Repeat("x", maxSecretBodySize)
+	req := httptest.NewRequest("POST", "http://api.example.com/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/plain")
+
+	result, err := engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	got, err := io.ReadAll(result.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(got))
+}
+
+func TestEngine_OnRequest_SecretScope(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {
+				Value:   "real-secret",
+				Hosts:   []string{"api.anthropic.com"},
+				Paths:   []string{"/v1/messages"},
+				Methods: []string{"POST"},
+			},
+		},
+	})
+	placeholder := engine.GetPlaceholder("API_KEY")
+
+	newReq := func(method, path string) *http.Request {
+		return &http.Request{
+			Method: method,
+			Header: http.Header{"X-Api-Key": []string{placeholder}},
+			URL:    &url.URL{Path: path},
+		}
+	}
+
+	result, err := engine.OnRequest(newReq("POST", "/v1/messages"), "api.anthropic.com")
+	require.NoError(t, err)
+	assert.Equal(t, "real-secret", result.Header.Get("X-Api-Key"))
+
+	_, err = engine.OnRequest(newReq("GET", "/v1/messages"), "api.anthropic.com")
+	assert.ErrorIs(t, err, api.ErrSecretScope)
+	assert.Equal(t, api.RuleSecretLeak, api.ViolationRuleOf(err))
+
+	_, err = engine.OnRequest(newReq("POST", "/v1/organizations/keys"), "api.anthropic.com")
+	assert.ErrorIs(t, err, api.ErrSecretScope)
+
+	// Requests outside the scope that don't carry the placeholder pass.
+	plain := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{Path: "/v1/models"}}
+	_, err = engine.OnRequest(plain, "api.anthropic.com")
+	assert.NoError(t, err)
+}
+
+func TestEngine_UpdateSecret(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {Value: "sk-old-value-123", Hosts: []string{"api.example.com"}},
+			"TOKEN":   {Hosts: []string{"auth.example.com"}, OAuth2: &api.OAuth2{TokenURL: "https://auth.example.com/token", ClientID: "c"}},
+		},
+	})
+	placeholder := engine.GetPlaceholder("API_KEY")
+
+	require.NoError(t, engine.UpdateSecret("API_KEY", "sk-new-value-456"))
+	assert.Equal(t, placeholder, engine.GetPlaceholder("API_KEY"), "placeholder is kept")
+
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: http.Header{"X-Api-Key": {placeholder}}}
+	result, err := engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "sk-new-value-456", result.Header.Get("X-Api-Key"))
+
+	resp := &http.Response{
+		Header:        http.Header{},
+		Body:          io.NopCloser(strings.NewReader("old=sk-old-value-123 new=sk-new-value-456")),
+		ContentLength: 41,
+	}
+	resp, err = engine.OnResponse(resp, req, "api.example.com")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "old="+placeholder+" new="+placeholder, string(body), "retired values are still scrubbed")
+
+	assert.ErrorIs(t, engine.UpdateSecret("MISSING", "x"), api.ErrUnknownSecret)
+	assert.ErrorIs(t, engine.UpdateSecret("TOKEN", "x"), api.ErrRotateSecret)
+	assert.ErrorIs(t, engine.UpdateSecret("API_KEY", ""), api.ErrRotateSecret)
+}
+
+func TestEngine_OnRequest_SecretHeader(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {
+				Value:   "sk-real",
+				Hosts:   []string{"api.example.com"},
+				Methods: []string{"GET"},
+				Header:  "Authorization: Bearer {value}",
+			},
+		},
+	})
+
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: "/v1/items"}, Header: http.Header{"Authorization": {"Bearer guest-junk"}}}
+	result, err := engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer sk-real", result.Header.Get("Authorization"), "header is set without the placeholder")
+	assert.Equal(t, int64(1), engine.SecretUsage()[0].Injections)
+
+	req = &http.Request{Method: "POST", URL: &url.URL{Path: "/v1/items"}, Header: http.Header{}}
+	result, err = engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	assert.Empty(t, result.Header.Get("Authorization"), "outside the secret's scope")
+
+	req = &http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: http.Header{}}
+	result, err = engine.OnRequest(req, "other.example.com")
+	require.NoError(t, err)
+	assert.Empty(t, result.Header.Get("Authorization"), "other hosts")
+}
+
+func TestEngine_OnRequest_SecretExpired(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"OLD_KEY":    {Value: "sk-old", Hosts: []string{"api.example.com"}, ExpiresAt: &past},
+			"NEW_KEY":    {Value: "sk-new", Hosts: []string{"api.example.com"}, ExpiresAt: &future},
+			"HEADER_KEY": {Value: "dd-key", Hosts: []string{"dd.example.com"}, Header: "DD-API-KEY: {value}", ExpiresAt: &past},
+		},
+	})
+
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: http.Header{"X-Key": {engine.GetPlaceholder("NEW_KEY")}}}
+	result, err := engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err, "other requests to the host are unaffected")
+	assert.Equal(t, "sk-new", result.Header.Get("X-Key"))
+
+	req = &http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: http.Header{"X-Key": {engine.GetPlaceholder("OLD_KEY")}}}
+	_, err = engine.OnRequest(req, "api.example.com")
+	require.ErrorIs(t, err, api.ErrSecretExpired)
+	assert.Contains(t, err.Error(), "OLD_KEY")
+	assert.Equal(t, api.RuleSecretExpired, api.ViolationRuleOf(err))
+
+	// Header templates would inject without the guest's help, so every
+	// request in scope is refused.
+	req = &http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: http.Header{}}
+	_, err = engine.OnRequest(req, "dd.example.com")
+	assert.ErrorIs(t, err, api.ErrSecretExpired)
+
+	for _, u := range engine.SecretUsage() {
+		if u.Name != "NEW_KEY" {
+			assert.Zero(t, u.Injections, u.Name)
+		}
+	}
+}
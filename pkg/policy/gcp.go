@@ -0,0 +1,84 @@
+package policy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// jwtBearerGrant exchanges a signed assertion for a token (RFC 7523), which
+// is how Google service accounts authenticate.
+const jwtBearerGrant = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// serviceAccountTokenLifetime is the longest lifetime Google accepts for an
+// assertion, and how long its ID tokens are valid.
+const serviceAccountTokenLifetime = time.Hour
+
+// serviceAccountAssertion signs the JWT a service account exchanges at
+// tokenURL: scoped for an access token, or with a target_audience for an ID
+// token when cfg.Audience is set.
+func serviceAccountAssertion(key *api.ServiceAccountKey, cfg api.OAuth2, tokenURL string, now time.Time) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if key.PrivateKeyID != "" {
+		header["kid"] = key.PrivateKeyID
+	}
+	claims := map[string]any{
+		"iss": key.ClientEmail,
+		"aud": tokenURL,
+		"iat": now.Unix(),
+		"exp": now.Add(serviceAccountTokenLifetime).Unix(),
+	}
+	if cfg.Audience != "" {
+		claims["target_audience"] = cfg.Audience
+	} else {
+		scopes := cfg.Scopes
+		if len(scopes) == 0 {
+			scopes = api.DefaultGCPScopes
+		}
+		claims["scope"] = strings.Join(scopes, " ")
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key.Signer, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// idTokenExpiry reads the exp claim of an ID token. The token is not
+// verified; it only decides when to fetch the next one.
+func idTokenExpiry(token string) time.Time {
+	fallback := time.Now().Add(serviceAccountTokenLifetime)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fallback
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fallback
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return fallback
+	}
+	return time.Unix(claims.Exp, 0)
+}
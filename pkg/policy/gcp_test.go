@@ -0,0 +1,126 @@
+package policy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+func serviceAccountKey(t *testing.T, tokenURI string) (string, *rsa.PrivateKey) {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	key, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"private_key_id": "kid-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "agent@project.iam.gserviceaccount.com",
+		"token_uri":      tokenURI,
+	})
+	require.NoError(t, err)
+	return string(key), priv
+}
+
+// verifyAssertion checks the signature of a JWT bearer assertion and
+// returns its claims.
+func verifyAssertion(t *testing.T, assertion string, pub *rsa.PublicKey) map[string]any {
+	t.Helper()
+	parts := strings.Split(assertion, ".")
+	require.Len(t, parts, 3)
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	require.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig))
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	var claims map[string]any
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	return claims
+}
+
+func gcpEngine(o *api.OAuth2) *Engine {
+	return NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"GCP": {Hosts: []string{"*.googleapis.com"}, OAuth2: o},
+		},
+	})
+}
+
+func TestEngine_OnRequest_ServiceAccountAccessToken(t *testing.T) {
+	var claims map[string]any
+	var pub *rsa.PublicKey
+	srv, calls := tokenServer(t, 3600, func(r *http.Request) {
+		assert.Equal(t, jwtBearerGrant, r.PostForm.Get("grant_type"))
+		assert.Empty(t, r.PostForm.Get("client_id"))
+		claims = verifyAssertion(t, r.PostForm.Get("assertion"), pub)
+	})
+	key, priv := serviceAccountKey(t, srv.URL)
+	pub = &priv.PublicKey
+	engine := gcpEngine(&api.OAuth2{ServiceAccount: key})
+
+	for range 2 {
+		req := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{Path: "/v1/projects"}}
+		result, err := engine.OnRequest(req, "aiplatform.googleapis.com")
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer tok-1", result.Header.Get("Authorization"))
+	}
+	assert.Equal(t, int32(1), calls.Load(), "token is cached")
+
+	assert.Equal(t, "agent@project.iam.gserviceaccount.com", claims["iss"])
+	assert.Equal(t, srv.URL, claims["aud"])
+	assert.Equal(t, "https://www.googleapis.com/auth/cloud-platform", claims["scope"])
+	assert.NotContains(t, claims, "target_audience")
+}
+
+func TestEngine_OnRequest_ServiceAccountIDToken(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	idToken := "eyJhbGciOiJSUzI1NiJ9." +
+		base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"aud":"https://svc.a.run.app","exp":%d}`, exp))) +
+		".sig"
+
+	var pub *rsa.PublicKey
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		claims := verifyAssertion(t, r.PostForm.Get("assertion"), pub)
+		assert.Equal(t, "https://svc.a.run.app", claims["target_audience"])
+		assert.NotContains(t, claims, "scope")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id_token":%q}`, idToken)
+	}))
+	defer srv.Close()
+	key, priv := serviceAccountKey(t, srv.URL)
+	pub = &priv.PublicKey
+	engine := gcpEngine(&api.OAuth2{ServiceAccount: key, Audience: "https://svc.a.run.app"})
+
+	req := &http.Request{Method: "POST", Header: http.Header{}, URL: &url.URL{Path: "/"}}
+	result, err := engine.OnRequest(req, "run.googleapis.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer "+idToken, result.Header.Get("Authorization"))
+
+	assert.Equal(t, time.Unix(exp, 0), engine.tokens["GCP"].(*oauth2Source).expiry)
+}
+
+func TestIDTokenExpiryFallback(t *testing.T) {
+	got := idTokenExpiry("opaque")
+	assert.WithinDuration(t, time.Now().Add(serviceAccountTokenLifetime), got, time.Minute)
+}
@@ -0,0 +1,168 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// githubAppJWTLifetime stays under the ten minutes GitHub accepts for an
+// app JWT.
+const githubAppJWTLifetime = 9 * time.Minute
+
+// githubAppSource mints installation access tokens for one GitHub App
+// secret and caches them like oauth2Source.
+type githubAppSource struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	cfg    api.GitHubApp
+	token  string
+	expiry time.Time
+}
+
+func newGitHubAppSource(cfg api.GitHubApp) *githubAppSource {
+	return &githubAppSource{
+		client: &http.Client{Timeout: oauth2FetchTimeout},
+		cfg:    cfg,
+	}
+}
+
+// Token returns a valid installation token, minting a new one when the
+// cached token is missing or about to expire.
+func (s *githubAppSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expiry) > oauth2ExpiryMargin {
+		return s.token, nil
+	}
+	return s.fetch(ctx)
+}
+
+// Invalidate drops the cached token if it is still token.
+func (s *githubAppSource) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// Current returns the cached token without fetching, or "" if none.
+func (s *githubAppSource) Current() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+type githubAccessTokenRequest struct {
+	Repositories []string          `json:"repositories,omitempty"`
+	Permissions  map[string]string `json:"permissions,omitempty"`
+}
+
+type githubAccessTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Message   string    `json:"message"`
+}
+
+func (s *githubAppSource) fetch(ctx context.Context) (string, error) {
+	key, err := api.ParseGitHubAppPrivateKey(s.cfg.PrivateKey)
+	if err != nil {
+		return "", errx.Wrap(api.ErrGitHubAppToken, err)
+	}
+	jwt, err := githubAppJWT(key, s.cfg.AppID, time.Now())
+	if err != nil {
+		return "", errx.Wrap(api.ErrGitHubAppToken, err)
+	}
+	payload, err := json.Marshal(githubAccessTokenRequest{Repositories: s.cfg.Repositories, Permissions: s.cfg.Permissions})
+	if err != nil {
+		return "", errx.Wrap(api.ErrGitHubAppToken, err)
+	}
+
+	apiURL := strings.TrimSuffix(s.cfg.APIURL, "/")
+	if apiURL == "" {
+		apiURL = api.DefaultGitHubAPIURL
+	}
+	tokenURL := fmt.Sprintf("%s/app/installations/%d/access_tokens", apiURL, s.cfg.InstallationID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, bytes.NewReader(payload))
+	if err != nil {
+		return "", errx.Wrap(api.ErrGitHubAppToken, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", errx.Wrap(api.ErrGitHubAppToken, err)
+	}
+	defer resp.Body.Close()
+
+	var tok githubAccessTokenResponse
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", errx.Wrap(api.ErrGitHubAppToken, err)
+	}
+	jsonErr := json.Unmarshal(body, &tok)
+	if resp.StatusCode != http.StatusCreated {
+		if tok.Message != "" {
+			return "", errx.With(api.ErrGitHubAppToken, ": %s returned %d: %s", tokenURL, resp.StatusCode, tok.Message)
+		}
+		return "", errx.With(api.ErrGitHubAppToken, ": %s returned %d", tokenURL, resp.StatusCode)
+	}
+	if jsonErr != nil {
+		return "", errx.With(api.ErrGitHubAppToken, ": decode token response: %w", jsonErr)
+	}
+	if tok.Token == "" {
+		return "", errx.With(api.ErrGitHubAppToken, ": token response has no token")
+	}
+
+	s.token = tok.Token
+	s.expiry = tok.ExpiresAt
+	if s.expiry.IsZero() {
+		s.expiry = time.Now().Add(time.Hour)
+	}
+	return s.token, nil
+}
+
+// githubAppJWT signs the JWT an app authenticates with. iat is backdated a
+// minute to allow for clock drift, as GitHub recommends.
+func githubAppJWT(key *rsa.PrivateKey, appID int64, now time.Time) (string, error) {
+	headerJSON, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(map[string]any{
+		"iss": strconv.FormatInt(appID, 10),
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(githubAppJWTLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,139 @@
+package policy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// githubAppServer serves installation tokens tok-1, tok-2, ... that expire
+// in an hour, checking the app JWT against pub.
+func githubAppServer(t *testing.T, pub *rsa.PublicKey, check func(body githubAccessTokenRequest)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/app/installations/42/access_tokens", r.URL.Path)
+		assert.Equal(t, "application/vnd.github+json", r.Header.Get("Accept"))
+		jwt, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		require.True(t, ok)
+		claims := verifyAssertion(t, jwt, pub)
+		assert.Equal(t, "7", claims["iss"])
+
+		var body githubAccessTokenRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if check != nil {
+			check(body)
+		}
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":"ghs_tok-%d","expires_at":%q}`, n, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func githubAppKey(t *testing.T) (string, *rsa.PrivateKey) {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der := x509.MarshalPKCS1PrivateKey(priv)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der})), priv
+}
+
+func TestEngine_OnRequest_GitHubAppToken(t *testing.T) {
+	key, priv := githubAppKey(t)
+	srv, calls := githubAppServer(t, &priv.PublicKey, func(body githubAccessTokenRequest) {
+		assert.Equal(t, []string{"matchlock"}, body.Repositories)
+		assert.Equal(t, map[string]string{"contents": "read"}, body.Permissions)
+	})
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"GH": {Hosts: []string{"api.github.com"}, GitHubApp: &api.GitHubApp{
+				AppID:          7,
+				InstallationID: 42,
+				PrivateKey:     key,
+				APIURL:         srv.URL,
+				Repositories:   []string{"matchlock"},
+				Permissions:    map[string]string{"contents": "read"},
+			}},
+		},
+	})
+
+	for range 2 {
+		req := &http.Request{Method: "GET", Header: http.Header{"Authorization": {"Bearer guest"}}, URL: &url.URL{Path: "/repos/o/r"}}
+		result, err := engine.OnRequest(req, "api.github.com")
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer ghs_tok-1", result.Header.Get("Authorization"))
+	}
+	assert.Equal(t, int32(1), calls.Load(), "token is cached")
+
+	req := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{Path: "/"}}
+	result, err := engine.OnRequest(req, "example.com")
+	require.NoError(t, err)
+	assert.Empty(t, result.Header.Get("Authorization"), "token only goes to the secret's hosts")
+}
+
+func TestEngine_RetryUnauthorized_GitHubApp(t *testing.T) {
+	key, priv := githubAppKey(t)
+	srv, calls := githubAppServer(t, &priv.PublicKey, nil)
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"GH": {Hosts: []string{"api.github.com"}, GitHubApp: &api.GitHubApp{AppID: 7, InstallationID: 42, PrivateKey: key, APIURL: srv.URL}},
+		},
+	})
+
+	req := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{Path: "/user"}}
+	result, err := engine.OnRequest(req, "api.github.com")
+	require.NoError(t, err)
+
+	retry := engine.RetryUnauthorized(result, "api.github.com")
+	require.NotNil(t, retry)
+	assert.Equal(t, "Bearer ghs_tok-2", retry.Header.Get("Authorization"))
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestEngine_OnRequest_GitHubAppTokenError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"Not Found"}`)
+	}))
+	defer srv.Close()
+	key, _ := githubAppKey(t)
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"GH": {Hosts: []string{"api.github.com"}, GitHubApp: &api.GitHubApp{AppID: 7, InstallationID: 42, PrivateKey: key, APIURL: srv.URL}},
+		},
+	})
+
+	req := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{Path: "/"}}
+	_, err := engine.OnRequest(req, "api.github.com")
+	require.ErrorIs(t, err, api.ErrGitHubAppToken)
+	assert.Contains(t, err.Error(), "Not Found")
+}
+
+func TestEngine_UpdateSecret_GitHubApp(t *testing.T) {
+	key, _ := githubAppKey(t)
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"GH": {Hosts: []string{"api.github.com"}, GitHubApp: &api.GitHubApp{AppID: 7, InstallationID: 42, PrivateKey: key}},
+		},
+	})
+	assert.ErrorIs(t, engine.UpdateSecret("GH", "new"), api.ErrRotateSecret)
+}
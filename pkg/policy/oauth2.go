@@ -0,0 +1,183 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// oauth2ExpiryMargin refreshes access tokens this long before they expire so
+// a token does not lapse while a request is in flight.
+const oauth2ExpiryMargin = 30 * time.Second
+
+// oauth2FetchTimeout bounds a single token endpoint round trip.
+const oauth2FetchTimeout = 30 * time.Second
+
+// tokenSource mints the tokens of a secret that has no static value.
+type tokenSource interface {
+	// Token returns a valid token, fetching a new one when the cached
+	// token is missing or about to expire.
+	Token(ctx context.Context) (string, error)
+	// Invalidate drops the cached token if it is still token.
+	Invalidate(token string)
+	// Current returns the cached token without fetching, or "" if none.
+	Current() string
+}
+
+// oauth2Source mints access tokens for one OAuth2 secret and caches them
+// until shortly before they expire or upstream rejects them.
+type oauth2Source struct {
+	client *http.Client
+
+	mu           sync.Mutex
+	cfg          api.OAuth2
+	token        string
+	expiry       time.Time
+	refreshToken string
+}
+
+func newOAuth2Source(cfg api.OAuth2) *oauth2Source {
+	return &oauth2Source{
+		client:       &http.Client{Timeout: oauth2FetchTimeout},
+		cfg:          cfg,
+		refreshToken: cfg.RefreshToken,
+	}
+}
+
+// Token returns a valid access token, fetching a new one when the cached
+// token is missing or about to expire.
+func (s *oauth2Source) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && (s.expiry.IsZero() || time.Until(s.expiry) > oauth2ExpiryMargin) {
+		return s.token, nil
+	}
+	return s.fetch(ctx)
+}
+
+// Invalidate drops the cached token if it is still token, so the next call
+// to Token fetches a new one. A token refreshed meanwhile is kept.
+func (s *oauth2Source) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// Current returns the cached access token without fetching, or "" if none.
+func (s *oauth2Source) Current() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+type oauth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+	ErrorDesc    string `json:"error_description"`
+}
+
+func (s *oauth2Source) fetch(ctx context.Context) (string, error) {
+	tokenURL := s.cfg.TokenURL
+	form := url.Values{}
+	switch {
+	case s.cfg.ServiceAccount != "":
+		key, err := api.ParseServiceAccountKey(s.cfg.ServiceAccount)
+		if err != nil {
+			return "", errx.Wrap(api.ErrOAuth2Token, err)
+		}
+		if tokenURL == "" {
+			tokenURL = key.TokenURI
+		}
+		assertion, err := serviceAccountAssertion(key, s.cfg, tokenURL, time.Now())
+		if err != nil {
+			return "", errx.Wrap(api.ErrOAuth2Token, err)
+		}
+		form.Set("grant_type", jwtBearerGrant)
+		form.Set("assertion", assertion)
+	case s.refreshToken != "":
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", s.refreshToken)
+	default:
+		form.Set("grant_type", "client_credentials")
+	}
+	if s.cfg.ServiceAccount == "" {
+		if len(s.cfg.Scopes) > 0 {
+			form.Set("scope", strings.Join(s.cfg.Scopes, " "))
+		}
+		if s.cfg.ClientSecret == "" {
+			form.Set("client_id", s.cfg.ClientID)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errx.Wrap(api.ErrOAuth2Token, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if s.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(s.cfg.ClientID), url.QueryEscape(s.cfg.ClientSecret))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", errx.Wrap(api.ErrOAuth2Token, err)
+	}
+	defer resp.Body.Close()
+
+	var tok oauth2TokenResponse
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", errx.Wrap(api.ErrOAuth2Token, err)
+	}
+	jsonErr := json.Unmarshal(body, &tok)
+	if resp.StatusCode != http.StatusOK {
+		if tok.Error != "" {
+			return "", errx.With(api.ErrOAuth2Token, ": token endpoint returned %d: %s %s", resp.StatusCode, tok.Error, tok.ErrorDesc)
+		}
+		return "", errx.With(api.ErrOAuth2Token, ": token endpoint returned %d", resp.StatusCode)
+	}
+	if jsonErr != nil {
+		return "", errx.With(api.ErrOAuth2Token, ": decode token response: %w", jsonErr)
+	}
+	if s.cfg.Audience != "" {
+		if tok.IDToken == "" {
+			return "", errx.With(api.ErrOAuth2Token, ": token response has no id_token")
+		}
+		s.token = tok.IDToken
+		s.expiry = idTokenExpiry(tok.IDToken)
+		return s.token, nil
+	}
+	if tok.AccessToken == "" {
+		return "", errx.With(api.ErrOAuth2Token, ": token response has no access_token")
+	}
+	if tok.TokenType != "" && !strings.EqualFold(tok.TokenType, "bearer") {
+		return "", errx.With(api.ErrOAuth2Token, ": unsupported token type %q", tok.TokenType)
+	}
+
+	s.token = tok.AccessToken
+	s.expiry = time.Time{}
+	if tok.ExpiresIn > 0 {
+		s.expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	// Servers that rotate refresh tokens invalidate the old one.
+	if tok.RefreshToken != "" {
+		s.refreshToken = tok.RefreshToken
+	}
+	return s.token, nil
+}
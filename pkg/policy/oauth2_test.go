@@ -0,0 +1,158 @@
+package policy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// tokenServer issues "tok-1", "tok-2", ... and hands each form it receives
+// to check.
+func tokenServer(t *testing.T, expiresIn int, check func(r *http.Request)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if check != nil {
+			check(r)
+		}
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"tok-%d","token_type":"Bearer","expires_in":%d,"refresh_token":"refresh-%d"}`, n, expiresIn, n+1)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func oauth2Engine(o *api.OAuth2) *Engine {
+	return NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_TOKEN": {Hosts: []string{"api.example.com"}, OAuth2: o},
+		},
+	})
+}
+
+func TestEngine_OnRequest_OAuth2ClientCredentials(t *testing.T) {
+	srv, calls := tokenServer(t, 3600, func(r *http.Request) {
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "read write", r.PostForm.Get("scope"))
+		id, secret, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "client", id)
+		assert.Equal(t, "s3cret", secret)
+	})
+	engine := oauth2Engine(&api.OAuth2{TokenURL: srv.URL, ClientID: "client", ClientSecret: "s3cret", Scopes: []string{"read", "write"}})
+
+	for range 2 {
+		req := &http.Request{
+			Method: "GET",
+			Header: http.Header{"Authorization": []string{"Bearer " + engine.GetPlaceholder("API_TOKEN")}},
+			URL:    &url.URL{Path: "/v1/items"},
+		}
+		result, err := engine.OnRequest(req, "api.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer tok-1", result.Header.Get("Authorization"))
+	}
+	assert.Equal(t, int32(1), calls.Load(), "token is cached")
+
+	// Other hosts get no token, and the placeholder is still a leak there.
+	req := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{Path: "/"}}
+	result, err := engine.OnRequest(req, "other.example.com")
+	require.NoError(t, err)
+	assert.Empty(t, result.Header.Get("Authorization"))
+
+	req.Header.Set("Authorization", "Bearer "+engine.GetPlaceholder("API_TOKEN"))
+	_, err = engine.OnRequest(req, "other.example.com")
+	assert.ErrorIs(t, err, api.ErrSecretLeak)
+}
+
+func TestEngine_OnRequest_OAuth2Expiry(t *testing.T) {
+	// Tokens expiring within the refresh margin are never reused.
+	srv, calls := tokenServer(t, 5, nil)
+	engine := oauth2Engine(&api.OAuth2{TokenURL: srv.URL, ClientID: "client"})
+
+	for i := 1; i <= 2; i++ {
+		req := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{Path: "/"}}
+		result, err := engine.OnRequest(req, "api.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("Bearer tok-%d", i), result.Header.Get("Authorization"))
+	}
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestEngine_RetryUnauthorized(t *testing.T) {
+	var refreshTokens []string
+	srv, _ := tokenServer(t, 3600, func(r *http.Request) {
+		assert.Equal(t, "refresh_token", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "client", r.PostForm.Get("client_id"))
+		refreshTokens = append(refreshTokens, r.PostForm.Get("refresh_token"))
+	})
+	engine := oauth2Engine(&api.OAuth2{TokenURL: srv.URL, ClientID: "client", RefreshToken: "refresh-1"})
+
+	req := &http.Request{
+		Method: "POST",
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+		URL:    &url.URL{Path: "/v1/items"},
+		Body:   io.NopCloser(strings.NewReader(`{"name":"x"}`)),
+	}
+	sent, err := engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer tok-1", sent.Header.Get("Authorization"))
+	io.ReadAll(sent.Body)
+
+	retry := engine.RetryUnauthorized(sent, "api.example.com")
+	require.NotNil(t, retry)
+	assert.Equal(t, "Bearer tok-2", retry.Header.Get("Authorization"))
+	body, err := io.ReadAll(retry.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"x"}`, string(body))
+
+	// The rotated refresh token is used for the second grant.
+	assert.Equal(t, []string{"refresh-1", "refresh-2"}, refreshTokens)
+
+	plain := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{Path: "/"}}
+	assert.Nil(t, engine.RetryUnauthorized(plain, "other.example.com"))
+}
+
+func TestEngine_OnRequest_OAuth2TokenError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"invalid_grant","error_description":"refresh token revoked"}`)
+	}))
+	defer srv.Close()
+	engine := oauth2Engine(&api.OAuth2{TokenURL: srv.URL, ClientID: "client", RefreshToken: "old"})
+
+	req := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{Path: "/"}}
+	_, err := engine.OnRequest(req, "api.example.com")
+	require.ErrorIs(t, err, api.ErrOAuth2Token)
+	assert.Contains(t, err.Error(), "invalid_grant")
+	assert.Contains(t, err.Error(), "API_TOKEN")
+}
+
+func TestEngine_OnRequest_OAuth2Expired(t *testing.T) {
+	srv, calls := tokenServer(t, 3600, nil)
+	past := time.Now().Add(-time.Second)
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_TOKEN": {Hosts: []string{"api.example.com"}, OAuth2: &api.OAuth2{TokenURL: srv.URL, ClientID: "client"}, ExpiresAt: &past},
+		},
+	})
+
+	req := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{Path: "/"}}
+	_, err := engine.OnRequest(req, "api.example.com")
+	assert.ErrorIs(t, err, api.ErrSecretExpired)
+	assert.Nil(t, engine.RetryUnauthorized(req, "api.example.com"))
+	assert.Zero(t, calls.Load(), "no token is minted for an expired secret")
+}
@@ -0,0 +1,186 @@
+package policy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// minScrubLength is the shortest secret value scrubbed from responses.
+// Shorter values are too likely to occur by chance, and replacing them
+// would corrupt unrelated response data.
+const minScrubLength = 8
+
+// scrubPair maps a real secret value back to its placeholder.
+type scrubPair struct {
+	value       []byte
+	placeholder []byte
+}
+
+// responseScrubber replaces real secret values with their placeholders.
+type responseScrubber struct {
+	pairs []scrubPair
+}
+
+// scrubber returns a scrubber for the static secret values, including those
+// rotated out, and the OAuth2 and GitHub App tokens minted so far, or nil if there is
+// nothing to scrub.
+func (e *Engine) scrubber() *responseScrubber {
+	var pairs []scrubPair
+	add := func(value, placeholder string) {
+		if len(value) >= minScrubLength && placeholder != "" {
+			pairs = append(pairs, scrubPair{value: []byte(value), placeholder: []byte(placeholder)})
+		}
+	}
+	e.mu.Lock()
+	secrets, retired := e.secrets, e.retired
+	for name, secret := range secrets {
+		add(secret.Value, secret.Placeholder)
+		for _, old := range retired[name] {
+			add(old, secret.Placeholder)
+		}
+	}
+	e.mu.Unlock()
+	for name, secret := range secrets {
+		if src := e.tokens[name]; src != nil {
+			add(src.Current(), secret.Placeholder)
+		}
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	// Longest first, so a value containing another is replaced as a whole.
+	sort.Slice(pairs, func(i, j int) bool {
+		return len(pairs[i].value) > len(pairs[j].value)
+	})
+	return &responseScrubber{pairs: pairs}
+}
+
+func (s *responseScrubber) replace(data []byte) []byte {
+	for _, p := range s.pairs {
+		if bytes.Contains(data, p.value) {
+			data = bytes.ReplaceAll(data, p.value, p.placeholder)
+		}
+	}
+	return data
+}
+
+// partialSuffix returns the length of the longest suffix of data that is a
+// proper prefix of a secret value, i.e. that may be completed by the next
+// chunk of a stream.
+func (s *responseScrubber) partialSuffix(data []byte) int {
+	longest := 0
+	for _, p := range s.pairs {
+		for k := min(len(p.value)-1, len(data)); k > longest; k-- {
+			if bytes.HasSuffix(data, p.value[:k]) {
+				longest = k
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// scannableEncodings is what intercepted requests accept from upstream
+// while secrets may be echoed back: encodings scrubResponse can scan.
+const scannableEncodings = "gzip, identity"
+
+// scrubResponse scrubs resp in place. Bodies with a known length up to
+// maxSecretBodySize are rewritten whole with an updated length; others are
+// scrubbed as they stream and sent without a length. Gzip bodies are
+// decompressed to be scanned. Bodies in other encodings, which upstream
+// should not send as requests accept only scannableEncodings, cannot be
+// scanned and fail the response rather than reach the guest.
+func (s *responseScrubber) scrubResponse(resp *http.Response) error {
+	for key, values := range resp.Header {
+		for i, v := range values {
+			resp.Header[key][i] = string(s.replace([]byte(v)))
+		}
+	}
+
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return errx.Wrap(api.ErrScrubResponse, err)
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{zr, resp.Body}
+		resp.Header.Del("Content-Encoding")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	default:
+		return errx.With(api.ErrScrubResponse, ": cannot scan content encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	if resp.ContentLength >= 0 && resp.ContentLength <= maxSecretBodySize {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return errx.Wrap(api.ErrScrubResponse, err)
+		}
+		body = s.replace(body)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+
+	resp.Body = &scrubReader{src: resp.Body, s: s, buf: make([]byte, 32*1024)}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	if !resp.ProtoAtLeast(1, 1) {
+		resp.Close = true
+	}
+	return nil
+}
+
+// scrubReader scrubs a body as it is read. It holds back only a trailing
+// partial match of a secret value, so streamed responses such as server-sent
+// events are not delayed.
+type scrubReader struct {
+	src  io.ReadCloser
+	s    *responseScrubber
+	buf  []byte
+	held []byte
+	out  []byte
+	err  error
+}
+
+func (r *scrubReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.src.Read(r.buf)
+		data := r.s.replace(append(r.held, r.buf[:n]...))
+		hold := 0
+		if err == nil {
+			hold = r.s.partialSuffix(data)
+		}
+		r.out = data[:len(data)-hold]
+		r.held = append([]byte(nil), data[len(data)-hold:]...)
+		r.err = err
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *scrubReader) Close() error {
+	return r.src.Close()
+}
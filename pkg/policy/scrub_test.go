@@ -0,0 +1,141 @@
+package policy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const scrubSecret = "sk-real-secret-value"
+
+func newScrubEngine() *Engine {
+	return NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {Value: scrubSecret, Hosts: []string{"api.example.com"}},
+			"PIN":     {Value: "1234"},
+		},
+	})
+}
+
+func newScrubResponse(body io.Reader, length int64) *http.Response {
+	return &http.Response{
+		StatusCode:    200,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(body),
+		ContentLength: length,
+	}
+}
+
+func TestEngine_OnResponse_ScrubsSecrets(t *testing.T) {
+	engine := newScrubEngine()
+	placeholder := engine.GetPlaceholder("API_KEY")
+
+	body := `{"error":"invalid key ` + scrubSecret + `","pin":"1234"}`
+	resp := newScrubResponse(strings.NewReader(body), int64(len(body)))
+	resp.Header.Set("X-Debug-Auth", "Bearer "+scrubSecret)
+	resp.Header.Set("Content-Length", "999")
+
+	result, err := engine.OnResponse(resp, nil, "other.example.com")
+	require.NoError(t, err)
+
+	assert.Equal(t, "Bearer "+placeholder, result.Header.Get("X-Debug-Auth"))
+	got, err := io.ReadAll(result.Body)
+	require.NoError(t, err)
+	want := `{"error":"invalid key ` + placeholder + `","pin":"1234"}`
+	assert.Equal(t, want, string(got), "short secret values are not scrubbed")
+	assert.Equal(t, int64(len(want)), result.ContentLength)
+	assert.Equal(t, strconv.Itoa(len(want)), result.Header.Get("Content-Length"))
+}
+
+func TestEngine_OnResponse_ScrubsStreamedBody(t *testing.T) {
+	engine := newScrubEngine()
+	placeholder := engine.GetPlaceholder("API_KEY")
+
+	body := "data: " + scrubSecret + "\n\ndata: sk-real-secret\n\n"
+	resp := newScrubResponse(iotest.OneByteReader(strings.NewReader(body)), -1)
+	resp.Header.Set("Content-Type", "text/event-stream")
+
+	result, err := engine.OnResponse(resp, nil, "api.example.com")
+	require.NoError(t, err)
+
+	got, err := io.ReadAll(result.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: "+placeholder+"\n\ndata: sk-real-secret\n\n", string(got))
+	assert.Equal(t, int64(-1), result.ContentLength)
+}
+
+func TestEngine_OnResponse_ScrubsGzipBody(t *testing.T) {
+	engine := newScrubEngine()
+	placeholder := engine.GetPlaceholder("API_KEY")
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte("token=" + scrubSecret))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	resp := newScrubResponse(&buf, int64(buf.Len()))
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Set("Content-Length", "1")
+
+	result, err := engine.OnResponse(resp, nil, "api.example.com")
+	require.NoError(t, err)
+
+	got, err := io.ReadAll(result.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "token="+placeholder, string(got))
+	assert.Empty(t, result.Header.Get("Content-Encoding"))
+	assert.Empty(t, result.Header.Get("Content-Length"))
+	assert.Equal(t, int64(-1), result.ContentLength)
+}
+
+// brotliStored encodes data as a brotli stream of one uncompressed
+// meta-block, which any brotli decoder reads back.
+func brotliStored(data []byte) []byte {
+	// WBITS 0 (16-bit window), ISLAST 0, MNIBBLES 4 (00), MLEN-1 in 16
+	// bits, ISUNCOMPRESSED 1: 21 bits, padded to 3 bytes.
+	bits := uint32(len(data)-1)<<4 | 1<<20
+	out := []byte{byte(bits), byte(bits >> 8), byte(bits >> 16)}
+	out = append(out, data...)
+	// A last, empty meta-block: ISLAST 1, ISLASTEMPTY 1.
+	return append(out, 0x03)
+}
+
+func TestEngine_BrotliEchoNeverReachesGuest(t *testing.T) {
+	engine := newScrubEngine()
+
+	req, err := http.NewRequest("POST", "https://api.example.com/echo", strings.NewReader("{}"))
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "br")
+	req, err = engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "gzip, identity", req.Header.Get("Accept-Encoding"), "only scannable encodings are asked for")
+
+	// An upstream that ignores Accept-Encoding and echoes the secret in br.
+	body := brotliStored([]byte(`{"echo":"` + scrubSecret + `"}`))
+	resp := newScrubResponse(bytes.NewReader(body), int64(len(body)))
+	resp.Header.Set("Content-Encoding", "br")
+	_, err = engine.OnResponse(resp, req, "api.example.com")
+	assert.ErrorIs(t, err, api.ErrScrubResponse)
+}
+
+func TestEngine_OnRequest_KeepsEncodingWithoutSecrets(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{})
+	req, err := http.NewRequest("GET", "https://api.example.com/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "br")
+	req, err = engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "br", req.Header.Get("Accept-Encoding"))
+}
@@ -0,0 +1,91 @@
+package policy
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+var signingHashes = map[string]func() hash.Hash{
+	api.SignHMACSHA1:   sha1.New,
+	api.SignHMACSHA256: sha256.New,
+	api.SignHMACSHA512: sha512.New,
+}
+
+// requestSigning returns the signing options for host, chosen like
+// UpstreamTLS: an exact entry wins over the longest matching pattern.
+func (e *Engine) requestSigning(host string) (api.RequestSigning, bool) {
+	if rs, ok := e.config.RequestSigning[host]; ok {
+		return rs, true
+	}
+	best := ""
+	for pattern := range e.config.RequestSigning {
+		if matchGlob(pattern, host) && (len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best)) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return api.RequestSigning{}, false
+	}
+	return e.config.RequestSigning[best], true
+}
+
+// signRequest adds the HMAC of req's final body to requests to signed
+// hosts. body is the body OnRequest already buffered, if any; otherwise it
+// is read here, and bodies too large to buffer are refused rather than sent
+// unsigned.
+func (e *Engine) signRequest(req *http.Request, host string, secrets map[string]api.Secret, body []byte, now time.Time) error {
+	rs, ok := e.requestSigning(host)
+	if !ok {
+		return nil
+	}
+	secret, ok := secrets[rs.Secret]
+	if !ok {
+		return errx.With(api.ErrSignRequest, ": unknown secret %s", rs.Secret)
+	}
+	if secret.Expired(now) {
+		return errx.With(api.ErrSecretExpired, ": %s expired at %s", rs.Secret, secret.ExpiresAt.Format(time.RFC3339))
+	}
+
+	if body == nil && req.Body != nil && req.Body != http.NoBody {
+		b, err := io.ReadAll(io.LimitReader(req.Body, maxSecretBodySize+1))
+		req.Body.Close()
+		if err != nil {
+			return errx.Wrap(api.ErrSignRequest, err)
+		}
+		if len(b) > maxSecretBodySize {
+			return errx.With(api.ErrSignRequest, ": body exceeds %d bytes", maxSecretBodySize)
+		}
+		setBody(req, b)
+		body = b
+	}
+
+	newHash := signingHashes[rs.Algorithm]
+	if newHash == nil {
+		newHash = sha256.New
+	}
+	mac := hmac.New(newHash, []byte(secret.Value))
+	mac.Write(body)
+	sum := mac.Sum(nil)
+
+	sig := hex.EncodeToString(sum)
+	if rs.Encoding == api.SignEncodingBase64 {
+		sig = base64.StdEncoding.EncodeToString(sum)
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set(rs.Header, rs.Prefix+sig)
+	e.usage.record(rs.Secret, host, requestPath(req))
+	return nil
+}
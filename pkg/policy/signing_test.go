@@ -0,0 +1,92 @@
+package policy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+func hmacHex(key, body string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestEngine_OnRequest_SignsBody(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"HOOK_KEY": {Value: "hook-secret", Hosts: []string{"hooks.example.com"}},
+			"API_KEY":  {Value: "sk-real", Hosts: []string{"*.example.com"}, In: []string{api.SecretInBody}},
+		},
+		RequestSigning: map[string]api.RequestSigning{
+			"hooks.example.com": {Secret: "HOOK_KEY", Header: "X-Hub-Signature-256", Prefix: "sha256="},
+		},
+	})
+
+	// The signature covers the body as sent, after substitution.
+	req := &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/events"},
+		Header: http.Header{"Content-Type": {"application/json"}, "X-Hub-Signature-256": {"guest-junk"}},
+		Body:   io.NopCloser(strings.NewReader(`{"key":"` + engine.GetPlaceholder("API_KEY") + `"}`)),
+	}
+	result, err := engine.OnRequest(req, "hooks.example.com")
+	require.NoError(t, err)
+	body, err := io.ReadAll(result.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"key":"sk-real"}`, string(body))
+	assert.Equal(t, "sha256="+hmacHex("hook-secret", string(body)), result.Header.Get("X-Hub-Signature-256"))
+
+	// Bodyless requests are signed over the empty body; other hosts are not.
+	req = &http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: http.Header{}}
+	result, err = engine.OnRequest(req, "hooks.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "sha256="+hmacHex("hook-secret", ""), result.Header.Get("X-Hub-Signature-256"))
+
+	req = &http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: http.Header{}}
+	result, err = engine.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	assert.Empty(t, result.Header.Get("X-Hub-Signature-256"))
+}
+
+func TestEngine_OnRequest_SignsBase64SHA512(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{"KEY": {Value: "k", Hosts: []string{"*.internal"}}},
+		RequestSigning: map[string]api.RequestSigning{
+			"*.internal": {Secret: "KEY", Header: "X-Signature", Algorithm: api.SignHMACSHA512, Encoding: api.SignEncodingBase64},
+		},
+	})
+
+	req := &http.Request{Method: "PUT", URL: &url.URL{Path: "/"}, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("payload"))}
+	result, err := engine.OnRequest(req, "billing.internal")
+	require.NoError(t, err)
+
+	mac := hmac.New(sha512.New, []byte("k"))
+	mac.Write([]byte("payload"))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(mac.Sum(nil)), result.Header.Get("X-Signature"))
+	body, _ := io.ReadAll(result.Body)
+	assert.Equal(t, "payload", string(body), "the body is forwarded intact")
+}
+
+func TestEngine_OnRequest_SignRefusesLargeBody(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets:        map[string]api.Secret{"KEY": {Value: "k", Hosts: []string{"hooks.example.com"}}},
+		RequestSigning: map[string]api.RequestSigning{"hooks.example.com": {Secret: "KEY", Header: "X-Signature"}},
+	})
+
+	req := &http.Request{Method: "POST", URL: &url.URL{Path: "/"}, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(strings.Repeat("x", maxSecretBodySize+1)))}
+	_, err := engine.OnRequest(req, "hooks.example.com")
+	assert.ErrorIs(t, err, api.ErrSignRequest)
+}
@@ -0,0 +1,69 @@
+package policy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// secretUsage tracks the injections of each secret for SecretUsage.
+type secretUsage struct {
+	mu      sync.Mutex
+	secrets map[string]*api.SecretUsage
+	hosts   map[string]map[string]bool
+	paths   map[string]map[string]bool
+	now     func() time.Time
+}
+
+func newSecretUsage(names []string) *secretUsage {
+	u := &secretUsage{
+		secrets: make(map[string]*api.SecretUsage, len(names)),
+		hosts:   make(map[string]map[string]bool, len(names)),
+		paths:   make(map[string]map[string]bool, len(names)),
+		now:     time.Now,
+	}
+	for _, name := range names {
+		u.secrets[name] = &api.SecretUsage{Name: name}
+		u.hosts[name] = make(map[string]bool)
+		u.paths[name] = make(map[string]bool)
+	}
+	return u
+}
+
+func (u *secretUsage) record(name, host, path string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	s, ok := u.secrets[name]
+	if !ok {
+		return
+	}
+	s.Injections++
+	now := u.now().UTC()
+	s.LastUsed = &now
+	if !u.hosts[name][host] {
+		u.hosts[name][host] = true
+		s.Hosts = append(s.Hosts, host)
+	}
+	if path != "" && !u.paths[name][path] && len(s.Paths) < api.MaxSecretUsagePaths {
+		u.paths[name][path] = true
+		s.Paths = append(s.Paths, path)
+	}
+}
+
+func (u *secretUsage) snapshot() []api.SecretUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	out := make([]api.SecretUsage, 0, len(u.secrets))
+	for _, s := range u.secrets {
+		c := *s
+		c.Hosts = append([]string(nil), s.Hosts...)
+		c.Paths = append([]string(nil), s.Paths...)
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
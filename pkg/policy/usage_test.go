@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+func TestEngine_SecretUsage(t *testing.T) {
+	engine := NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{
+			"API_KEY": {Value: "real-secret", Hosts: []string{"*.example.com"}},
+			"UNUSED":  {Value: "other-secret", Hosts: []string{"api.example.com"}},
+		},
+	})
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	engine.usage.now = func() time.Time { return now }
+
+	send := func(host, path string, withPlaceholder bool) {
+		req := &http.Request{Header: http.Header{}, URL: &url.URL{Path: path}}
+		if withPlaceholder {
+			req.Header.Set("Authorization", "Bearer "+engine.GetPlaceholder("API_KEY"))
+		}
+		_, err := engine.OnRequest(req, host+":443")
+		require.NoError(t, err)
+	}
+	send("api.example.com", "/v1/messages", true)
+	send("api.example.com", "/v1/messages", true)
+	send("uploads.example.com", "/v1/files", true)
+	send("api.example.com", "/v1/models", false)
+
+	assert.Equal(t, []api.SecretUsage{
+		{
+			Name:       "API_KEY",
+			Injections: 3,
+			Hosts:      []string{"api.example.com", "uploads.example.com"},
+			Paths:      []string{"/v1/messages", "/v1/files"},
+			LastUsed:   &now,
+		},
+		{Name: "UNUSED"},
+	}, engine.SecretUsage())
+}
+
+func TestSecretUsagePathsCapped(t *testing.T) {
+	u := newSecretUsage([]string{"KEY"})
+	for i := 0; i < api.MaxSecretUsagePaths+10; i++ {
+		u.record("KEY", "example.com", "/"+string(rune('a'+i%26))+string(rune('a'+i/26)))
+	}
+	u.record("OTHER", "example.com", "/")
+
+	usage := u.snapshot()
+	require.Len(t, usage, 1)
+	assert.Equal(t, int64(api.MaxSecretUsagePaths+10), usage[0].Injections)
+	assert.Len(t, usage[0].Paths, api.MaxSecretUsagePaths)
+}
@@ -0,0 +1,9 @@
+package pool
+
+import "errors"
+
+var (
+	ErrListen   = errors.New("listen on pool socket")
+	ErrBoot     = errors.New("boot pooled sandbox")
+	ErrTemplate = errors.New("read pool template")
+)
@@ -0,0 +1,311 @@
+// Package pool serves sandboxes booted ahead of use to the processes of a
+// host, as 'matchlock pool serve'.
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/warm"
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/preset"
+	"github.com/jingkaihe/matchlock/pkg/rpc"
+)
+
+// closeGrace bounds how long a sandbox given back is waited for before its
+// process is killed.
+const closeGrace = 10 * time.Second
+
+// DefaultSocketPath is where 'matchlock pool serve' listens by default.
+func DefaultSocketPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".matchlock", "pool.sock")
+}
+
+// Server keeps sandboxes booted ahead of use and hands them to the clients
+// of a unix socket. A client speaks the JSON-RPC protocol of 'matchlock
+// rpc' over its connection. Its first request must be create, which is
+// answered at once by a sandbox booted with the same parameters; the
+// connection is then relayed to that sandbox's process until either side
+// closes it, and a replacement is booted in the background.
+//
+// Sandboxes are pooled per template, the parameters of their create. A
+// template is first warmed by its first create, which waits for a boot.
+// The timeout of a sandbox runs from when it is handed over: the server
+// closes it once that has passed.
+type Server struct {
+	binary string
+	// boot creates a sandbox of the create params; a test replaces it.
+	boot func(params json.RawMessage) (*sandbox, error)
+	warm *warm.Pool[*sandbox]
+
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	serving  sync.WaitGroup
+}
+
+// NewServer returns a server keeping size booted sandboxes of each
+// template, each run by 'binary rpc'.
+func NewServer(binary string, size int) *Server {
+	s := &Server{
+		binary: binary,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	s.boot = s.bootProcess
+	s.warm = warm.New(size, (*sandbox).alive, (*sandbox).close)
+	return s
+}
+
+// Start listens on socketPath, which only the current user may connect
+// to, and serves clients until Close.
+func (s *Server) Start(socketPath string) error {
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return errx.With(ErrListen, " %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return errx.With(ErrListen, " %s: %w", socketPath, err)
+	}
+	s.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = struct{}{}
+			s.serving.Add(1)
+			s.mu.Unlock()
+			go func() {
+				defer s.serving.Done()
+				s.serve(conn)
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+		}
+	}()
+	return nil
+}
+
+// Close stops serving, closes the sandboxes handed over and waits for
+// them, and closes the ones not handed over.
+func (s *Server) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.serving.Wait()
+
+	for _, sb := range s.warm.Close() {
+		sb.close()
+	}
+}
+
+// serve hands a sandbox to the client of conn and relays between them.
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	var req rpc.Request
+	if err := json.Unmarshal(line, &req); err != nil || req.Method != "create" {
+		writeResponse(conn, req.ID, nil, &rpc.Error{Code: rpc.ErrCodeInvalidRequest, Message: "the first request to a pool must be create"})
+		return
+	}
+
+	key, err := templateKey(req.Params)
+	if err != nil {
+		writeResponse(conn, req.ID, nil, &rpc.Error{Code: rpc.ErrCodeInvalidParams, Message: err.Error()})
+		return
+	}
+	sb, err := s.warm.Take(key, func() (*sandbox, error) { return s.boot(req.Params) })
+	if err != nil {
+		writeResponse(conn, req.ID, nil, &rpc.Error{Code: rpc.ErrCodeVMFailed, Message: err.Error()})
+		return
+	}
+	defer sb.close()
+	if err := writeResponse(conn, req.ID, sb.created, nil); err != nil {
+		return
+	}
+	if timeout := launchTimeout(req.Params); timeout > 0 {
+		expiry := time.AfterFunc(timeout, func() { conn.Close() })
+		defer expiry.Stop()
+	}
+
+	go func() {
+		io.Copy(conn, sb.stdout)
+		conn.Close()
+	}()
+	io.Copy(sb.stdin, r)
+}
+
+// templateKey identifies the template of the create params by their
+// compacted encoding.
+func templateKey(params json.RawMessage) (string, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, params); err != nil {
+		return "", errx.Wrap(ErrTemplate, err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// launchTimeout is the timeout of a sandbox of the create params, resolved
+// as create resolves it.
+func launchTimeout(params json.RawMessage) time.Duration {
+	var config api.Config
+	json.Unmarshal(params, &config)
+	if config.Resources != nil && config.Resources.Size != "" {
+		if presets, err := preset.LoadDefault(); err == nil {
+			presets.Apply(config.Resources)
+		}
+	}
+	resources := api.DefaultConfig().Merge(&config).Resources
+	return time.Duration(resources.TimeoutSeconds) * time.Second
+}
+
+func writeResponse(w io.Writer, id *uint64, result json.RawMessage, rpcErr *rpc.Error) error {
+	resp := rpc.Response{JSONRPC: "2.0", Error: rpcErr, ID: id}
+	if result != nil {
+		resp.Result = result
+	}
+	data, _ := json.Marshal(resp)
+	_, err := fmt.Fprintln(w, string(data))
+	return err
+}
+
+// sandbox is a process serving the JSON-RPC protocol of 'matchlock rpc'
+// whose sandbox has been created.
+type sandbox struct {
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	out     io.Closer       // of stdout, if it needs closing
+	created json.RawMessage // the result of its create
+	exited  chan struct{}   // closed once the process exits
+	kill    func()
+}
+
+func (sb *sandbox) alive() bool {
+	select {
+	case <-sb.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// close asks the sandbox to close, as a client going away does not, and
+// waits for its process, killing it after closeGrace.
+func (sb *sandbox) close() {
+	// A newline first ends any request the client left half written.
+	fmt.Fprintf(sb.stdin, "\n{\"jsonrpc\":\"2.0\",\"method\":\"close\",\"params\":{\"timeout_seconds\":%d}}\n", int(closeGrace.Seconds()))
+	sb.stdin.Close()
+	select {
+	case <-sb.exited:
+	case <-time.After(closeGrace):
+		sb.kill()
+		<-sb.exited
+	}
+	if sb.out != nil {
+		sb.out.Close()
+	}
+}
+
+// create creates the sandbox of params, keeping the result for the client
+// it is handed to.
+func (sb *sandbox) create(params json.RawMessage) error {
+	id := uint64(0)
+	data, _ := json.Marshal(rpc.Request{JSONRPC: "2.0", Method: "create", Params: params, ID: &id})
+	if _, err := fmt.Fprintln(sb.stdin, string(data)); err != nil {
+		return errx.Wrap(ErrBoot, err)
+	}
+	for {
+		line, err := sb.stdout.ReadBytes('\n')
+		if err != nil {
+			return errx.Wrap(ErrBoot, err)
+		}
+		var resp struct {
+			Result json.RawMessage `json:"result"`
+			Error  *rpc.Error      `json:"error"`
+			ID     *uint64         `json:"id"`
+		}
+		// Events sent while booting are notifications, without an ID.
+		if json.Unmarshal(line, &resp) != nil || resp.ID == nil {
+			continue
+		}
+		if resp.Error != nil {
+			return errx.With(ErrBoot, ": %s", resp.Error.Message)
+		}
+		sb.created = resp.Result
+		return nil
+	}
+}
+
+// bootProcess starts 'matchlock rpc' and creates a sandbox of params in it.
+func (s *Server) bootProcess(params json.RawMessage) (*sandbox, error) {
+	cmd := exec.Command(s.binary, "rpc")
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errx.Wrap(ErrBoot, err)
+	}
+	// The read end of stdout is kept from cmd, which would close it on
+	// exit before the relay has read all of it.
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		return nil, errx.Wrap(ErrBoot, err)
+	}
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		stdout.Close()
+		return nil, errx.Wrap(ErrBoot, err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	sb := &sandbox{
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		out:    stdout,
+		exited: exited,
+		kill:   func() { cmd.Process.Kill() },
+	}
+
+	if err := sb.create(params); err != nil {
+		sb.kill()
+		<-exited
+		stdout.Close()
+		return nil, err
+	}
+	return sb, nil
+}
@@ -0,0 +1,156 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/rpc"
+)
+
+type stubVM struct{}
+
+func (stubVM) ID() string                                                { return "vm-pooled" }
+func (stubVM) Config() *api.Config                                       { return api.DefaultConfig() }
+func (stubVM) Start(context.Context) error                               { return nil }
+func (stubVM) Stop(context.Context) error                                { return nil }
+func (stubVM) WriteFile(context.Context, string, []byte, uint32) error   { return nil }
+func (stubVM) ReadFile(context.Context, string) ([]byte, error)          { return nil, os.ErrNotExist }
+func (stubVM) ListFiles(context.Context, string) ([]api.FileInfo, error) { return nil, nil }
+func (stubVM) Events() <-chan api.Event                                  { return make(chan api.Event) }
+func (stubVM) Close(context.Context) error                               { return nil }
+
+func (stubVM) Exec(context.Context, string, *api.ExecOptions) (*api.ExecResult, error) {
+	return &api.ExecResult{Stdout: []byte("hi")}, nil
+}
+
+// newTestServer returns a server of in-process sandboxes listening on a
+// socket, the socket and the count of sandboxes booted.
+func newTestServer(t *testing.T, size int) (*Server, string, *atomic.Int32) {
+	t.Helper()
+	var boots atomic.Int32
+	s := NewServer("", size)
+	s.boot = func(params json.RawMessage) (*sandbox, error) {
+		boots.Add(1)
+		stdinR, stdinW, err := os.Pipe()
+		require.NoError(t, err)
+		stdoutR, stdoutW, err := os.Pipe()
+		require.NoError(t, err)
+		h := rpc.NewHandler(func(context.Context, *api.Config) (rpc.VM, error) {
+			return stubVM{}, nil
+		}, stdinR, stdoutW)
+		exited := make(chan struct{})
+		go func() {
+			h.Run(context.Background())
+			stdoutW.Close()
+			close(exited)
+		}()
+		sb := &sandbox{
+			stdin:  stdinW,
+			stdout: bufio.NewReader(stdoutR),
+			out:    stdoutR,
+			exited: exited,
+			kill:   func() { stdinW.Close() },
+		}
+		return sb, sb.create(params)
+	}
+	socket := filepath.Join(t.TempDir(), "pool.sock")
+	require.NoError(t, s.Start(socket))
+	t.Cleanup(s.Close)
+	return s, socket, &boots
+}
+
+type testConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, socket string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// call sends a request and returns its response.
+func (c *testConn) call(t *testing.T, id uint64, method string, params any) map[string]json.RawMessage {
+	t.Helper()
+	data, err := json.Marshal(params)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(c, `{"jsonrpc":"2.0","method":%q,"params":%s,"id":%d}`+"\n", method, data, id)
+	require.NoError(t, err)
+	for {
+		line, err := c.r.ReadBytes('\n')
+		require.NoError(t, err)
+		var resp map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(line, &resp))
+		if _, ok := resp["id"]; ok {
+			assert.JSONEq(t, fmt.Sprint(id), string(resp["id"]))
+			return resp
+		}
+	}
+}
+
+func idle(s *Server, params string) int {
+	key, _ := templateKey(json.RawMessage(params))
+	return s.warm.Idle(key)
+}
+
+func TestServerHandsOverBootedSandboxes(t *testing.T) {
+	s, socket, boots := newTestServer(t, 2)
+	params := map[string]any{"image": "alpine:latest"}
+
+	c := dial(t, socket)
+	resp := c.call(t, 7, "create", params)
+	assert.Contains(t, string(resp["result"]), "vm-pooled")
+	resp = c.call(t, 8, "exec", map[string]any{"command": "echo hi"})
+	assert.Contains(t, string(resp["result"]), "aGk=", "requests are relayed to the sandbox")
+	c.Close()
+
+	require.Eventually(t, func() bool { return idle(s, `{"image":"alpine:latest"}`) == 2 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, int32(3), boots.Load(), "a cold create is handed a sandbox the pool boots, not one more")
+
+	c = dial(t, socket)
+	c.call(t, 1, "create", params)
+	require.Eventually(t, func() bool { return boots.Load() == 4 }, 5*time.Second, time.Millisecond, "a replacement is booted")
+}
+
+func TestServerNeedsCreateFirst(t *testing.T) {
+	_, socket, boots := newTestServer(t, 1)
+	c := dial(t, socket)
+	resp := c.call(t, 1, "exec", map[string]any{"command": "true"})
+	assert.Contains(t, string(resp["error"]), "must be create")
+	assert.Zero(t, boots.Load())
+}
+
+func TestServerTimeoutRunsFromHandover(t *testing.T) {
+	s, socket, _ := newTestServer(t, 1)
+	params := map[string]any{"image": "alpine:latest", "resources": map[string]any{"timeout_seconds": 1}}
+	data, _ := json.Marshal(params)
+
+	c := dial(t, socket)
+	c.call(t, 1, "create", params)
+	require.Eventually(t, func() bool { return idle(s, string(data)) == 1 }, 5*time.Second, time.Millisecond)
+	c.Close()
+	time.Sleep(1500 * time.Millisecond)
+
+	c = dial(t, socket)
+	handedOver := time.Now()
+	c.call(t, 1, "create", params)
+	c.call(t, 2, "exec", map[string]any{"command": "true"})
+	_, err := c.r.ReadBytes('\n')
+	assert.Error(t, err, "the sandbox is closed once its timeout has passed")
+	assert.GreaterOrEqual(t, time.Since(handedOver), time.Second, "the timeout does not run while the sandbox is idle")
+}
@@ -0,0 +1,10 @@
+package preset
+
+import "errors"
+
+var (
+	ErrReadPresets   = errors.New("read size presets")
+	ErrParsePresets  = errors.New("parse size presets")
+	ErrInvalidPreset = errors.New("invalid size preset")
+	ErrUnknownSize   = errors.New("unknown size")
+)
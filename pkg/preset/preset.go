@@ -0,0 +1,134 @@
+// Package preset resolves named sandbox sizes such as "small", "medium" and
+// "large" to CPUs, memory, disk and timeout, so operators can standardize
+// sandbox shapes and meter them by name.
+//
+// The built-in sizes can be overridden, and new ones added, in a presets
+// file:
+//
+//	{
+//	  "sizes": {
+//	    "large": {"cpus": 8, "memory_mb": 16384, "disk_size_mb": 40960, "timeout_seconds": 7200},
+//	    "gpu-build": {"cpus": 16, "memory_mb": 32768}
+//	  }
+//	}
+//
+// Fields a size leaves out fall back to the usual defaults.
+package preset
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/storename"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// Size is the resource shape of a named preset. Zero fields are unset.
+type Size struct {
+	CPUs           int `json:"cpus,omitempty"`
+	MemoryMB       int `json:"memory_mb,omitempty"`
+	DiskSizeMB     int `json:"disk_size_mb,omitempty"`
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+// Builtin are the sizes available without a presets file.
+var Builtin = map[string]Size{
+	"small":  {CPUs: 1, MemoryMB: 512, DiskSizeMB: 5120, TimeoutSeconds: 300},
+	"medium": {CPUs: 2, MemoryMB: 2048, DiskSizeMB: 10240, TimeoutSeconds: 1800},
+	"large":  {CPUs: 4, MemoryMB: 8192, DiskSizeMB: 20480, TimeoutSeconds: 3600},
+}
+
+// Presets maps size names to their shapes.
+type Presets map[string]Size
+
+type file struct {
+	Sizes map[string]Size `json:"sizes"`
+}
+
+// DefaultPath returns $MATCHLOCK_PRESETS, or
+// ~/.config/matchlock/presets.json.
+func DefaultPath() string {
+	if p := os.Getenv("MATCHLOCK_PRESETS"); p != "" {
+		return p
+	}
+	return storename.ConfigPath("presets.json")
+}
+
+// LoadDefault loads the presets at DefaultPath.
+func LoadDefault() (Presets, error) {
+	return Load(DefaultPath())
+}
+
+// Load reads a presets file over the built-in sizes. A missing file yields
+// the built-in sizes; sizes in the file replace built-ins of the same name.
+func Load(path string) (Presets, error) {
+	presets := make(Presets, len(Builtin))
+	for name, size := range Builtin {
+		presets[name] = size
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return presets, nil
+		}
+		return nil, errx.Wrap(ErrReadPresets, err)
+	}
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, errx.With(ErrParsePresets, " %s: %w", path, err)
+	}
+	for name, size := range f.Sizes {
+		if size.CPUs < 0 || size.MemoryMB < 0 || size.DiskSizeMB < 0 || size.TimeoutSeconds < 0 {
+			return nil, errx.With(ErrInvalidPreset, " %q in %s: values must not be negative", name, path)
+		}
+		presets[name] = size
+	}
+	return presets, nil
+}
+
+// Names returns the preset names in sorted order.
+func (p Presets) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the named size.
+func (p Presets) Lookup(name string) (Size, error) {
+	size, ok := p[name]
+	if !ok {
+		return Size{}, errx.With(ErrUnknownSize, " %q (available: %v)", name, p.Names())
+	}
+	return size, nil
+}
+
+// Apply sizes r from the preset named r.Size. Fields already set on r take
+// precedence over the preset. Resources without a size are left unchanged.
+func (p Presets) Apply(r *api.Resources) error {
+	if r == nil || r.Size == "" {
+		return nil
+	}
+	size, err := p.Lookup(r.Size)
+	if err != nil {
+		return err
+	}
+	if r.CPUs == 0 {
+		r.CPUs = size.CPUs
+	}
+	if r.MemoryMB == 0 {
+		r.MemoryMB = size.MemoryMB
+	}
+	if r.DiskSizeMB == 0 {
+		r.DiskSizeMB = size.DiskSizeMB
+	}
+	if r.TimeoutSeconds == 0 {
+		r.TimeoutSeconds = size.TimeoutSeconds
+	}
+	return nil
+}
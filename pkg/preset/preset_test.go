@@ -0,0 +1,66 @@
+package preset
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+func TestLoadMissingFileUsesBuiltin(t *testing.T) {
+	presets, err := Load(filepath.Join(t.TempDir(), "presets.json"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"large", "medium", "small"}, presets.Names())
+	assert.Equal(t, Builtin["large"], presets["large"])
+}
+
+func TestLoadOverridesAndAddsSizes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presets.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"sizes": {
+		"large": {"cpus": 8, "memory_mb": 16384},
+		"ci": {"cpus": 2, "memory_mb": 4096, "timeout_seconds": 900}
+	}}`), 0644))
+
+	presets, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, Size{CPUs: 8, MemoryMB: 16384}, presets["large"])
+	assert.Equal(t, Size{CPUs: 2, MemoryMB: 4096, TimeoutSeconds: 900}, presets["ci"])
+	assert.Equal(t, Builtin["small"], presets["small"])
+}
+
+func TestLoadRejectsBadFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	bad := filepath.Join(dir, "bad.json")
+	require.NoError(t, os.WriteFile(bad, []byte(`{"sizes": `), 0644))
+	_, err := Load(bad)
+	assert.ErrorIs(t, err, ErrParsePresets)
+
+	negative := filepath.Join(dir, "negative.json")
+	require.NoError(t, os.WriteFile(negative, []byte(`{"sizes": {"tiny": {"memory_mb": -1}}}`), 0644))
+	_, err = Load(negative)
+	assert.ErrorIs(t, err, ErrInvalidPreset)
+}
+
+func TestApply(t *testing.T) {
+	presets := Presets{"ci": {CPUs: 2, MemoryMB: 4096, TimeoutSeconds: 900}}
+
+	res := &api.Resources{Size: "ci", MemoryMB: 1024}
+	require.NoError(t, presets.Apply(res))
+	assert.Equal(t, 2, res.CPUs)
+	assert.Equal(t, 1024, res.MemoryMB, "explicit values win")
+	assert.Equal(t, 0, res.DiskSizeMB, "unset in the preset")
+	assert.Equal(t, 900, res.TimeoutSeconds)
+
+	unsized := &api.Resources{CPUs: 1}
+	require.NoError(t, presets.Apply(unsized))
+	assert.Equal(t, &api.Resources{CPUs: 1}, unsized)
+
+	err := presets.Apply(&api.Resources{Size: "huge"})
+	require.ErrorIs(t, err, ErrUnknownSize)
+	assert.Contains(t, err.Error(), "ci")
+}
@@ -0,0 +1,169 @@
+// Package redact masks secret values and their placeholders in text that
+// leaves a sandbox: exec output, network events and VM logs.
+package redact
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MinLength is the shortest value that is masked. Shorter values would
+// garble unrelated output far more often than they would hide a secret.
+const MinLength = 4
+
+// Redactor replaces known secret values with "[REDACTED:NAME]". A nil
+// Redactor leaves everything unchanged.
+type Redactor struct {
+	mu       sync.RWMutex
+	values   map[string][]string
+	replacer *strings.Replacer
+}
+
+// New returns a Redactor for values, which maps each secret name to the
+// strings that reveal it (its value, placeholder, credentials...). It
+// returns nil when there is nothing to mask.
+func New(values map[string][]string) *Redactor {
+	copied := make(map[string][]string, len(values))
+	for name, vs := range values {
+		copied[name] = append([]string(nil), vs...)
+	}
+	replacer := newReplacer(copied)
+	if replacer == nil {
+		return nil
+	}
+	return &Redactor{values: copied, replacer: replacer}
+}
+
+// Add masks more strings revealing the named secret from now on, such as a
+// rotated value. Strings masked before stay masked.
+func (r *Redactor) Add(name string, values ...string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[name] = append(r.values[name], values...)
+	if replacer := newReplacer(r.values); replacer != nil {
+		r.replacer = replacer
+	}
+}
+
+func newReplacer(values map[string][]string) *strings.Replacer {
+	type pair struct{ value, mask string }
+	var pairs []pair
+	seen := make(map[string]bool)
+	for name, vs := range values {
+		for _, v := range vs {
+			if len(v) < MinLength || seen[v] {
+				continue
+			}
+			seen[v] = true
+			pairs = append(pairs, pair{v, "[REDACTED:" + name + "]"})
+		}
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	// The replacer prefers earlier pairs at the same position, so a value
+	// that contains another is masked whole.
+	sort.Slice(pairs, func(i, j int) bool {
+		if len(pairs[i].value) != len(pairs[j].value) {
+			return len(pairs[i].value) > len(pairs[j].value)
+		}
+		return pairs[i].value < pairs[j].value
+	})
+	oldnew := make([]string, 0, 2*len(pairs))
+	for _, p := range pairs {
+		oldnew = append(oldnew, p.value, p.mask)
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+func (r *Redactor) current() *strings.Replacer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.replacer
+}
+
+// String returns s with secrets masked.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	return r.current().Replace(s)
+}
+
+// Bytes returns b with secrets masked. b is returned as is when nothing
+// matches.
+func (r *Redactor) Bytes(b []byte) []byte {
+	if r == nil || len(b) == 0 {
+		return b
+	}
+	s := string(b)
+	if out := r.current().Replace(s); out != s {
+		return []byte(out)
+	}
+	return b
+}
+
+// maxPending bounds how much of an unterminated line Writer holds back.
+const maxPending = 64 << 10
+
+// Writer masks secrets in a stream. Output is passed on a line at a time so
+// a value split across writes is still caught; a line longer than 64 KiB is
+// flushed as is.
+type Writer struct {
+	r *Redactor
+
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter returns a Writer masking secrets written to w. With a nil
+// Redactor, writes pass straight through.
+func (r *Redactor) NewWriter(w io.Writer) *Writer {
+	return &Writer{r: r, w: w}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.r == nil {
+		return w.w.Write(p)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	n := bytes.LastIndexByte(w.buf, '\n') + 1
+	if n == 0 {
+		if len(w.buf) < maxPending {
+			return len(p), nil
+		}
+		n = len(w.buf)
+	}
+	if _, err := w.w.Write(w.r.Bytes(w.buf[:n])); err != nil {
+		return 0, err
+	}
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+	return len(p), nil
+}
+
+// Flush writes out a buffered partial line.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.w.Write(w.r.Bytes(w.buf))
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Close flushes the Writer. The underlying writer is not closed.
+func (w *Writer) Close() error {
+	return w.Flush()
+}
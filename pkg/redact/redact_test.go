@@ -0,0 +1,71 @@
+package redact
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactorString(t *testing.T) {
+	r := New(map[string][]string{
+		"API_KEY": {"sk-live-123", "SANDBOX_SECRET_abc"},
+		"PIN":     {"42"},
+		"LONG":    {"sk-live-123-extended"},
+	})
+	require.NotNil(t, r)
+
+	assert.Equal(t, "key=[REDACTED:API_KEY] ph=[REDACTED:API_KEY]", r.String("key=sk-live-123 ph=SANDBOX_SECRET_abc"))
+	assert.Equal(t, "[REDACTED:LONG]", r.String("sk-live-123-extended"), "longest value wins")
+	assert.Equal(t, "answer 42", r.String("answer 42"), "short values are not masked")
+}
+
+func TestRedactorAdd(t *testing.T) {
+	r := New(map[string][]string{"API_KEY": {"sk-old-123"}})
+	require.NotNil(t, r)
+
+	r.Add("API_KEY", "sk-new-456")
+	assert.Equal(t, "[REDACTED:API_KEY] [REDACTED:API_KEY]", r.String("sk-old-123 sk-new-456"))
+}
+
+func TestRedactorNil(t *testing.T) {
+	r := New(map[string][]string{"EMPTY": {""}})
+	assert.Nil(t, r)
+	assert.Equal(t, "sk-live-123", r.String("sk-live-123"))
+	assert.Equal(t, []byte("x"), r.Bytes([]byte("x")))
+	r.Add("EMPTY", "sk-live-123")
+
+	var buf bytes.Buffer
+	w := r.NewWriter(&buf)
+	w.Write([]byte("partial"))
+	assert.Equal(t, "partial", buf.String())
+}
+
+func TestWriterSplitAcrossWrites(t *testing.T) {
+	r := New(map[string][]string{"API_KEY": {"sk-live-123"}})
+	var buf bytes.Buffer
+	w := r.NewWriter(&buf)
+
+	for _, chunk := range []string{"token: sk-li", "ve-12", "3\nnext ", "sk-live-123"} {
+		n, err := w.Write([]byte(chunk))
+		require.NoError(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+	assert.Equal(t, "token: [REDACTED:API_KEY]\n", buf.String(), "partial line is held back")
+
+	require.NoError(t, w.Close())
+	assert.Equal(t, "token: [REDACTED:API_KEY]\nnext [REDACTED:API_KEY]", buf.String())
+}
+
+func TestWriterLongLine(t *testing.T) {
+	r := New(map[string][]string{"API_KEY": {"sk-live-123"}})
+	var buf bytes.Buffer
+	w := r.NewWriter(&buf)
+
+	long := strings.Repeat("x", maxPending)
+	_, err := w.Write([]byte(long))
+	require.NoError(t, err)
+	assert.Equal(t, maxPending, buf.Len(), "overlong lines are not held back forever")
+}
@@ -0,0 +1,8 @@
+package rpc
+
+import "errors"
+
+var (
+	ErrStreamChecksum = errors.New("streamed file checksum mismatch")
+	ErrStreamHole     = errors.New("stream hole out of range")
+)
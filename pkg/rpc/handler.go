@@ -3,17 +3,29 @@ package rpc
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/jingkaihe/matchlock/internal/errx"
 	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/delta"
+	"github.com/jingkaihe/matchlock/pkg/image"
+	"github.com/jingkaihe/matchlock/pkg/preset"
 	"github.com/jingkaihe/matchlock/pkg/state"
+	"github.com/jingkaihe/matchlock/pkg/transfer"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+	"github.com/jingkaihe/matchlock/pkg/workspaces"
 )
 
 type Request struct {
@@ -45,8 +57,61 @@ const (
 	ErrCodeExecFailed     = -32001
 	ErrCodeFileFailed     = -32002
 	ErrCodeCancelled      = -32003
+	ErrCodeWorkingDir     = -32004
 )
 
+// Methods lists the JSON-RPC methods the handler serves, so integrators can
+// discover capabilities without probing.
+var Methods = []string{
+	"create",
+	"exec",
+	"exec_stream",
+	"write_file",
+	"read_file",
+	"read_file_stream",
+	"write_file_stream",
+	"write_file_stream.data",
+	"list_files",
+	"list_dir",
+	"stat",
+	"remove",
+	"chmod",
+	"chown",
+	"rename",
+	"file_signature",
+	"patch_file",
+	"mkdir",
+	"copy_in",
+	"copy_in.data",
+	"copy_out",
+	"network_metrics",
+	"network_violations",
+	"secret_usage",
+	"mount_usage",
+	"vfs_metrics",
+	"mount",
+	"unmount",
+	"update_secret",
+	"freeze_network",
+	"watch_files",
+	"snapshot",
+	"snapshot_exists",
+	"snapshot_workspace",
+	"prefetch",
+	"cancel",
+	"close",
+}
+
+// Notifications lists the notification methods the handler sends.
+var Notifications = []string{
+	"event",
+	"prefetch.progress",
+	"exec_stream.stdout",
+	"exec_stream.stderr",
+	"copy_out.data",
+	"read_file_stream.data",
+}
+
 type VM interface {
 	ID() string
 	Config() *api.Config
@@ -60,8 +125,119 @@ type VM interface {
 	Close(ctx context.Context) error
 }
 
+// NetworkMetricsVM is implemented by VMs that track per-host network traffic.
+type NetworkMetricsVM interface {
+	NetworkMetrics() []api.HostMetrics
+}
+
+// EgressUsageVM is implemented by VMs that enforce an egress byte budget.
+type EgressUsageVM interface {
+	EgressUsage() *api.EgressUsage
+}
+
+// NetworkViolationsVM is implemented by VMs that record denied network flows.
+type NetworkViolationsVM interface {
+	NetworkViolations() []api.NetworkViolation
+}
+
+// SecretUsageVM is implemented by VMs that track where their secrets are
+// injected.
+type SecretUsageVM interface {
+	SecretUsage() []api.SecretUsage
+}
+
+// MountUsageVM is implemented by VMs that account for the space held by
+// their mounts.
+type MountUsageVM interface {
+	MountUsage() []api.MountUsage
+}
+
+// VFSMetricsVM is implemented by VMs that record the filesystem operations
+// their guest makes on each mount.
+type VFSMetricsVM interface {
+	VFSMetrics() []api.MountMetrics
+}
+
+// HotMountVM is implemented by VMs that can mount and unmount volumes while
+// they run.
+type HotMountVM interface {
+	AddMount(guestPath string, mount api.MountConfig) error
+	RemoveMount(guestPath string) error
+}
+
+// UpdateSecretVM is implemented by VMs whose secrets can be rotated while
+// they run.
+type UpdateSecretVM interface {
+	UpdateSecret(name, value string) error
+}
+
+// SnapshotVM is implemented by VMs that can save their root filesystem as a
+// reusable image in the local store.
+type SnapshotVM interface {
+	Snapshot(ctx context.Context, tag string) error
+}
+
+// WorkspaceSnapshotVM is implemented by VMs that can save their workspace
+// files as a named workspace snapshot.
+type WorkspaceSnapshotVM interface {
+	SnapshotWorkspace(name string) (*workspaces.Snapshot, error)
+}
+
+// FreezeNetworkVM is implemented by VMs whose network egress can be cut off
+// while they keep running.
+type FreezeNetworkVM interface {
+	FreezeNetwork() error
+}
+
+// FileWatchVM is implemented by VMs that can publish file changes as
+// "file" events.
+type FileWatchVM interface {
+	WatchFiles(path string) error
+}
+
+// FileSyncVM is implemented by VMs that support incremental file uploads:
+// clients fetch a file's block signature and send back only changed blocks.
+type FileSyncVM interface {
+	FileSignature(ctx context.Context, path string, blockSize int) (*delta.Signature, error)
+	PatchFile(ctx context.Context, path string, blockSize int, ops []delta.Op, mode uint32, checksum string) error
+	MkdirAll(ctx context.Context, path string, mode uint32) error
+}
+
+// FileManageVM is implemented by VMs whose files can be inspected, removed,
+// and rearranged without exec.
+type FileManageVM interface {
+	Stat(ctx context.Context, path string) (*api.FileInfo, error)
+	Remove(ctx context.Context, path string) error
+	RemoveAll(ctx context.Context, path string) error
+	Chmod(ctx context.Context, path string, mode uint32) error
+	// Chown changes the owner the guest sees; -1 leaves an id unchanged.
+	Chown(ctx context.Context, path string, uid, gid int) error
+	Rename(ctx context.Context, oldPath, newPath string) error
+}
+
+// FileStreamVM is implemented by VMs that read and write files as streams,
+// so large files are never held in memory whole.
+type FileStreamVM interface {
+	ReadFileTo(ctx context.Context, path string, w io.Writer) (int64, error)
+	WriteFileFrom(ctx context.Context, path string, r io.Reader, mode uint32) (int64, error)
+}
+
+// CopyVM is implemented by VMs that copy directory trees in and out as tar
+// streams.
+type CopyVM interface {
+	CopyIn(ctx context.Context, path string, r io.Reader) error
+	CopyOut(ctx context.Context, path string, w io.Writer) error
+}
+
+// copyChunkSize is the size of the tar stream chunks copy_out sends.
+const copyChunkSize = 256 * 1024
+
 type VMFactory func(ctx context.Context, config *api.Config) (VM, error)
 
+// PrefetchFunc pulls and converts images ahead of use, calling onResult as
+// each one finishes.
+type PrefetchFunc func(ctx context.Context, images []image.PrefetchImage, concurrency int, onResult func(image.PrefetchResult)) []image.PrefetchResult
+
 type Handler struct {
 	factory   VMFactory
 	vm        VM
@@ -74,15 +250,30 @@ type Handler struct {
 	wg        sync.WaitGroup // tracks in-flight requests
 	cancelsMu sync.Mutex
 	cancels   map[uint64]context.CancelFunc // per-request cancel funcs
+	prefetch  PrefetchFunc
+	uploadsMu sync.Mutex
+	uploads   map[uint64]*upload // copy_in and write_file_stream streams by request ID
+	transfer  *transfer.Server   // bulk file transfers of vm; guarded by vmMu
+}
+
+// upload is the stream of a copy_in or write_file_stream request, fed by
+// its .data notifications. sum is the SHA-256 the sender gave with eof, set
+// before the stream is closed.
+type upload struct {
+	r   *io.PipeReader
+	w   *io.PipeWriter
+	sum string
 }
 
 func NewHandler(factory VMFactory, stdin io.Reader, stdout io.Writer) *Handler {
 	return &Handler{
-		factory: factory,
-		events:  make(chan api.Event, 100),
-		stdin:   stdin,
-		stdout:  stdout,
-		cancels: make(map[uint64]context.CancelFunc),
+		factory:  factory,
+		events:   make(chan api.Event, 100),
+		stdin:    stdin,
+		stdout:   stdout,
+		cancels:  make(map[uint64]context.CancelFunc),
+		prefetch: image.NewBuilder(&image.BuildOptions{}).Prefetch,
+		uploads:  make(map[uint64]*upload),
 	}
 }
 
@@ -127,34 +318,57 @@ func (h *Handler) Run(ctx context.Context) error {
 			continue
 		}
 
+		// Upload chunks are fed to their copy_in or write_file_stream in
+		// order from this goroutine, which also holds back further requests
+		// while the upload catches up. The stream is opened here so that no
+		// chunk arrives before it.
+		if req.Method == "copy_in.data" || req.Method == "write_file_stream.data" {
+			h.handleUploadData(&req)
+			continue
+		}
+		if (req.Method == "copy_in" || req.Method == "write_file_stream") && req.ID != nil {
+			h.openUpload(*req.ID)
+		}
+
+		// Prefetches are not tracked by wg so that a create issued while
+		// images are warming does not wait for all of them.
+		if req.Method == "prefetch" {
+			go h.runRequest(ctx, req)
+			continue
+		}
+
 		h.wg.Add(1)
 		go func(r Request) {
 			defer h.wg.Done()
+			h.runRequest(ctx, r)
+		}(req)
+	}
 
-			reqCtx, cancel := context.WithCancel(ctx)
-			defer cancel()
+	h.wg.Wait()
+	return scanner.Err()
+}
 
-			if r.ID != nil {
-				h.cancelsMu.Lock()
-				h.cancels[*r.ID] = cancel
-				h.cancelsMu.Unlock()
+// runRequest handles r with a context that a "cancel" request can abort.
+func (h *Handler) runRequest(ctx context.Context, r Request) {
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-				defer func() {
-					h.cancelsMu.Lock()
-					delete(h.cancels, *r.ID)
-					h.cancelsMu.Unlock()
-				}()
-			}
+	if r.ID != nil {
+		h.cancelsMu.Lock()
+		h.cancels[*r.ID] = cancel
+		h.cancelsMu.Unlock()
 
-			resp := h.handleRequest(reqCtx, &r)
-			if resp != nil {
-				h.sendResponse(resp)
-			}
-		}(req)
+		defer func() {
+			h.cancelsMu.Lock()
+			delete(h.cancels, *r.ID)
+			h.cancelsMu.Unlock()
+		}()
 	}
 
-	h.wg.Wait()
-	return scanner.Err()
+	resp := h.handleRequest(reqCtx, &r)
+	if resp != nil {
+		h.sendResponse(resp)
+	}
 }
 
 func (h *Handler) handleRequest(ctx context.Context, req *Request) *Response {
@@ -169,8 +383,66 @@ func (h *Handler) handleRequest(ctx context.Context, req *Request) *Response {
 		return h.handleWriteFile(ctx, req)
 	case "read_file":
 		return h.handleReadFile(ctx, req)
-	case "list_files":
+	case "read_file_stream":
+		return h.handleReadFileStream(ctx, req)
+	case "write_file_stream":
+		return h.handleWriteFileStream(ctx, req)
+	case "write_file_stream.data":
+		h.handleUploadData(req)
+		return nil
+	case "list_files", "list_dir":
 		return h.handleListFiles(ctx, req)
+	case "stat":
+		return h.handleStat(ctx, req)
+	case "remove":
+		return h.handleRemove(ctx, req)
+	case "chmod":
+		return h.handleChmod(ctx, req)
+	case "chown":
+		return h.handleChown(ctx, req)
+	case "rename":
+		return h.handleRename(ctx, req)
+	case "file_signature":
+		return h.handleFileSignature(ctx, req)
+	case "patch_file":
+		return h.handlePatchFile(ctx, req)
+	case "mkdir":
+		return h.handleMkdir(ctx, req)
+	case "copy_in":
+		return h.handleCopyIn(ctx, req)
+	case "copy_in.data":
+		h.handleUploadData(req)
+		return nil
+	case "copy_out":
+		return h.handleCopyOut(ctx, req)
+	case "network_metrics":
+		return h.handleNetworkMetrics(ctx, req)
+	case "network_violations":
+		return h.handleNetworkViolations(ctx, req)
+	case "secret_usage":
+		return h.handleSecretUsage(ctx, req)
+	case "mount_usage":
+		return h.handleMountUsage(ctx, req)
+	case "vfs_metrics":
+		return h.handleVFSMetrics(ctx, req)
+	case "mount":
+		return h.handleMount(ctx, req)
+	case "unmount":
+		return h.handleUnmount(ctx, req)
+	case "update_secret":
+		return h.handleUpdateSecret(ctx, req)
+	case "freeze_network":
+		return h.handleFreezeNetwork(ctx, req)
+	case "watch_files":
+		return h.handleWatchFiles(ctx, req)
+	case "snapshot":
+		return h.handleSnapshot(ctx, req)
+	case "snapshot_exists":
+		return h.handleSnapshotExists(ctx, req)
+	case "snapshot_workspace":
+		return h.handleSnapshotWorkspace(ctx, req)
+	case "prefetch":
+		return h.handlePrefetch(ctx, req)
 	case "close":
 		return h.handleClose(ctx, req)
 	default:
@@ -208,6 +480,28 @@ func (h *Handler) handleCreate(ctx context.Context, req *Request) *Response {
 		}
 	}
 
+	if params.Resources != nil && params.Resources.Size != "" {
+		presets, err := preset.LoadDefault()
+		if err == nil {
+			err = presets.Apply(params.Resources)
+		}
+		if err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+	}
+
+	if err := params.Network.ApplySecretProfiles(api.DefaultSecretProfilesPath()); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
 	config := api.DefaultConfig().Merge(&params)
 	if config.VFS != nil && len(config.VFS.Mounts) > 0 {
 		if err := api.ValidateVFSMountsWithinWorkspace(config.VFS.Mounts, config.GetWorkspace()); err != nil {
@@ -217,6 +511,108 @@ func (h *Handler) handleCreate(ctx context.Context, req *Request) *Response {
 				ID:      req.ID,
 			}
 		}
+		if err := api.ValidateMountBackends(config.VFS.Mounts); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+		if err := api.ValidateS3Mounts(config.VFS.Mounts); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+		if err := api.ValidateGitMounts(config.VFS.Mounts); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+		if err := api.ValidateCacheMounts(config.VFS.Mounts); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+		if err := api.ValidateMemoryMounts(config.VFS.Mounts); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+		if err := api.ValidateMountAccess(config.VFS.Mounts); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+		if err := api.ValidateMountCase(config.VFS.Mounts); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+		if err := api.ValidateMountExclude(config.VFS.Mounts); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+		if err := api.ValidateMountIDMap(config.VFS.Mounts); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+		if err := api.ValidateMountUnconfined(config.VFS.Mounts); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+	}
+
+	if err := config.Resources.ValidateSwap(); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	if err := config.ValidateDataDisks(); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	if err := config.Network.ValidateSecrets(); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	if err := config.Network.ValidateEgressBudget(); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
 	}
 
 	vm, err := h.factory(ctx, config)
@@ -252,6 +648,19 @@ func (h *Handler) handleCreate(ctx context.Context, req *Request) *Response {
 		"id": vm.ID(),
 	}
 
+	// Clients on this host move large files over a socket of their own
+	// rather than as JSON-RPC notifications.
+	if target, ok := vm.(transfer.Target); ok {
+		socket := state.NewManager().TransferSocketPath(vm.ID())
+		srv := transfer.NewServer(target)
+		if err := srv.Start(socket); err == nil {
+			h.vmMu.Lock()
+			h.transfer = srv
+			h.vmMu.Unlock()
+			result["transfer_socket"] = socket
+		}
+	}
+
 	return &Response{
 		JSONRPC: "2.0",
 		Result:  result,
@@ -270,9 +679,11 @@ func (h *Handler) handleExec(ctx context.Context, req *Request) *Response {
 	}
 
 	var params struct {
-		Command    string `json:"command"`
-		WorkingDir string `json:"working_dir,omitempty"`
-		User       string `json:"user,omitempty"`
+		Command          string   `json:"command"`
+		Argv             []string `json:"argv,omitempty"`
+		WorkingDir       string   `json:"working_dir,omitempty"`
+		CreateWorkingDir bool     `json:"create_working_dir,omitempty"`
+		User             string   `json:"user,omitempty"`
 	}
 	if err := json.Unmarshal(req.Params, &params); err != nil {
 		return &Response{
@@ -283,19 +694,17 @@ func (h *Handler) handleExec(ctx context.Context, req *Request) *Response {
 	}
 
 	opts := &api.ExecOptions{
-		WorkingDir: params.WorkingDir,
-		User:       params.User,
+		WorkingDir:       params.WorkingDir,
+		CreateWorkingDir: params.CreateWorkingDir,
+		User:             params.User,
+		RawArgv:          params.Argv,
 	}
 
-	result, err := vm.Exec(ctx, params.Command, opts)
+	result, err := vm.Exec(ctx, execCommandLine(params.Command, params.Argv), opts)
 	if err != nil {
-		code := ErrCodeExecFailed
-		if ctx.Err() != nil {
-			code = ErrCodeCancelled
-		}
 		return &Response{
 			JSONRPC: "2.0",
-			Error:   &Error{Code: code, Message: err.Error()},
+			Error:   &Error{Code: execErrorCode(ctx, err), Message: err.Error()},
 			ID:      req.ID,
 		}
 	}
@@ -312,6 +721,26 @@ func (h *Handler) handleExec(ctx context.Context, req *Request) *Response {
 	}
 }
 
+// execErrorCode returns the RPC error code for a failed exec.
+func execErrorCode(ctx context.Context, err error) int {
+	switch {
+	case ctx.Err() != nil:
+		return ErrCodeCancelled
+	case errors.Is(err, api.ErrWorkingDir):
+		return ErrCodeWorkingDir
+	}
+	return ErrCodeExecFailed
+}
+
+// execCommandLine returns the descriptive command for an exec request. When
+// only argv is given, its shell-quoted form stands in for the command.
+func execCommandLine(command string, argv []string) string {
+	if command == "" && len(argv) > 0 {
+		return api.ShellQuoteArgs(argv)
+	}
+	return command
+}
+
 // handleExecStream executes a command and streams stdout/stderr as JSON-RPC
 // notifications before sending the final response with the exit code.
 //
@@ -334,9 +763,11 @@ func (h *Handler) handleExecStream(ctx context.Context, req *Request) *Response
 	}
 
 	var params struct {
-		Command    string `json:"command"`
-		WorkingDir string `json:"working_dir,omitempty"`
-		User       string `json:"user,omitempty"`
+		Command          string   `json:"command"`
+		Argv             []string `json:"argv,omitempty"`
+		WorkingDir       string   `json:"working_dir,omitempty"`
+		CreateWorkingDir bool     `json:"create_working_dir,omitempty"`
+		User             string   `json:"user,omitempty"`
 	}
 	if err := json.Unmarshal(req.Params, &params); err != nil {
 		return &Response{
@@ -351,21 +782,19 @@ func (h *Handler) handleExecStream(ctx context.Context, req *Request) *Response
 	stderrWriter := &streamWriter{handler: h, reqID: reqID, method: "exec_stream.stderr"}
 
 	opts := &api.ExecOptions{
-		WorkingDir: params.WorkingDir,
-		User:       params.User,
-		Stdout:     stdoutWriter,
-		Stderr:     stderrWriter,
+		WorkingDir:       params.WorkingDir,
+		CreateWorkingDir: params.CreateWorkingDir,
+		User:             params.User,
+		Stdout:           stdoutWriter,
+		Stderr:           stderrWriter,
+		RawArgv:          params.Argv,
 	}
 
-	result, err := vm.Exec(ctx, params.Command, opts)
+	result, err := vm.Exec(ctx, execCommandLine(params.Command, params.Argv), opts)
 	if err != nil {
-		code := ErrCodeExecFailed
-		if ctx.Err() != nil {
-			code = ErrCodeCancelled
-		}
 		return &Response{
 			JSONRPC: "2.0",
-			Error:   &Error{Code: code, Message: err.Error()},
+			Error:   &Error{Code: execErrorCode(ctx, err), Message: err.Error()},
 			ID:      req.ID,
 		}
 	}
@@ -403,6 +832,37 @@ func (w *streamWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// newChunkWriter returns a writer that sends what is written to it as method
+// notifications of reqID, buffered into chunks of at most copyChunkSize so
+// neither many small writes nor one large one make for odd-sized messages.
+func (h *Handler) newChunkWriter(reqID *uint64, method string) *bufio.Writer {
+	return bufio.NewWriterSize(&chunkWriter{handler: h, reqID: reqID, method: method}, copyChunkSize)
+}
+
+// chunkWriter splits writes larger than copyChunkSize. A chunk of only
+// zeros, as sparse files are full of, is sent as a hole: its length in
+// place of its data.
+type chunkWriter struct {
+	handler *Handler
+	reqID   *uint64
+	method  string
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), copyChunkSize)
+		if vfs.IsZero(p[:n]) {
+			c.handler.sendStreamHole(c.reqID, c.method, n)
+		} else {
+			c.handler.sendStreamData(c.reqID, c.method, p[:n])
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
 func (h *Handler) sendStreamData(reqID *uint64, method string, data []byte) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -419,6 +879,23 @@ func (h *Handler) sendStreamData(reqID *uint64, method string, data []byte) {
 	fmt.Fprintln(h.stdout, string(encoded))
 }
 
+// sendStreamHole sends n zero bytes of a stream as a hole notification.
+func (h *Handler) sendStreamHole(reqID *uint64, method string, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	notification := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params": map[string]interface{}{
+			"id":   reqID,
+			"hole": n,
+		},
+	}
+	encoded, _ := json.Marshal(notification)
+	fmt.Fprintln(h.stdout, string(encoded))
+}
+
 func (h *Handler) handleWriteFile(ctx context.Context, req *Request) *Response {
 	vm := h.getVM()
 	if vm == nil {
@@ -549,46 +1026,1295 @@ func (h *Handler) handleListFiles(ctx context.Context, req *Request) *Response {
 	}
 }
 
-func (h *Handler) handleClose(ctx context.Context, req *Request) *Response {
-	h.closed.Store(true)
-
-	var params struct {
-		TimeoutSeconds float64 `json:"timeout_seconds"`
-	}
-	if req.Params != nil {
-		json.Unmarshal(req.Params, &params)
+// getFileSyncVM returns the current VM as a FileSyncVM, or an error response
+// if there is no VM or it does not support incremental sync.
+func (h *Handler) getFileSyncVM(req *Request) (FileSyncVM, *Response) {
+	vm := h.getVM()
+	if vm == nil {
+		return nil, &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
 	}
-
-	ctx, cancel := context.WithTimeout(ctx, time.Duration(params.TimeoutSeconds*float64(time.Second)))
-	defer cancel()
-
-	h.vmMu.Lock()
-	vm := h.vm
-	h.vm = nil
-	h.vmMu.Unlock()
-
-	if vm != nil {
-		vm.Close(ctx)
+	fv, ok := vm.(FileSyncVM)
+	if !ok {
+		return nil, &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: "file sync is not supported by this VM"},
+			ID:      req.ID,
+		}
 	}
+	return fv, nil
+}
 
-	return &Response{
-		JSONRPC: "2.0",
-		Result:  map[string]interface{}{},
-		ID:      req.ID,
+func (h *Handler) handleFileSignature(ctx context.Context, req *Request) *Response {
+	fv, errResp := h.getFileSyncVM(req)
+	if errResp != nil {
+		return errResp
 	}
-}
 
-func (h *Handler) handleCancel(req *Request) *Response {
 	var params struct {
-		ID uint64 `json:"id"`
+		Path      string `json:"path"`
+		BlockSize int    `json:"block_size,omitempty"`
 	}
-	if req.Params != nil {
-		if err := json.Unmarshal(req.Params, &params); err != nil {
-			return &Response{
-				JSONRPC: "2.0",
-				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
-				ID:      req.ID,
-			}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+	if params.BlockSize == 0 {
+		params.BlockSize = delta.DefaultBlockSize
+	}
+
+	sig, err := fv.FileSignature(ctx, params.Path, params.BlockSize)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Response{
+			JSONRPC: "2.0",
+			Result:  map[string]interface{}{"exists": false},
+			ID:      req.ID,
+		}
+	}
+	if err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result: map[string]interface{}{
+			"exists":    true,
+			"signature": sig,
+		},
+		ID: req.ID,
+	}
+}
+
+func (h *Handler) handlePatchFile(ctx context.Context, req *Request) *Response {
+	fv, errResp := h.getFileSyncVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		Path      string     `json:"path"`
+		BlockSize int        `json:"block_size"`
+		Ops       []delta.Op `json:"ops"`
+		Mode      uint32     `json:"mode,omitempty"`
+		Checksum  string     `json:"checksum"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+	if params.Checksum == "" {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "checksum is required"},
+			ID:      req.ID,
+		}
+	}
+
+	mode := params.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+
+	if err := fv.PatchFile(ctx, params.Path, params.BlockSize, params.Ops, mode, params.Checksum); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{},
+		ID:      req.ID,
+	}
+}
+
+func (h *Handler) handleMkdir(ctx context.Context, req *Request) *Response {
+	fv, errResp := h.getFileSyncVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		Path string `json:"path"`
+		Mode uint32 `json:"mode,omitempty"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	if err := fv.MkdirAll(ctx, params.Path, params.Mode); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{},
+		ID:      req.ID,
+	}
+}
+
+// getFileManageVM returns the current VM as a FileManageVM, or an error
+// response if there is no VM or it cannot manage files.
+func (h *Handler) getFileManageVM(req *Request) (FileManageVM, *Response) {
+	vm := h.getVM()
+	if vm == nil {
+		return nil, &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+	fv, ok := vm.(FileManageVM)
+	if !ok {
+		return nil, &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: "file management is not supported by this VM"},
+			ID:      req.ID,
+		}
+	}
+	return fv, nil
+}
+
+// handleStat returns the metadata of a sandbox path. A missing path is not
+// an error; the result says it does not exist.
+func (h *Handler) handleStat(ctx context.Context, req *Request) *Response {
+	fv, errResp := h.getFileManageVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.Path == "" {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "path is required"},
+			ID:      req.ID,
+		}
+	}
+
+	info, err := fv.Stat(ctx, params.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Response{
+			JSONRPC: "2.0",
+			Result:  map[string]interface{}{"exists": false},
+			ID:      req.ID,
+		}
+	}
+	if err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result: map[string]interface{}{
+			"exists": true,
+			"info":   info,
+		},
+		ID: req.ID,
+	}
+}
+
+// handleRemove removes a file or empty directory, or with recursive set a
+// whole tree. Removing a missing path with recursive set succeeds.
+func (h *Handler) handleRemove(ctx context.Context, req *Request) *Response {
+	fv, errResp := h.getFileManageVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		Path      string `json:"path"`
+		Recursive bool   `json:"recursive,omitempty"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.Path == "" {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "path is required"},
+			ID:      req.ID,
+		}
+	}
+
+	var err error
+	if params.Recursive {
+		err = fv.RemoveAll(ctx, params.Path)
+	} else {
+		err = fv.Remove(ctx, params.Path)
+	}
+	if err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{},
+		ID:      req.ID,
+	}
+}
+
+func (h *Handler) handleChmod(ctx context.Context, req *Request) *Response {
+	fv, errResp := h.getFileManageVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		Path string  `json:"path"`
+		Mode *uint32 `json:"mode"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.Path == "" || params.Mode == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "path and mode are required"},
+			ID:      req.ID,
+		}
+	}
+
+	if err := fv.Chmod(ctx, params.Path, *params.Mode); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{},
+		ID:      req.ID,
+	}
+}
+
+// handleChown changes the owner of a sandbox path as the guest sees it. An
+// omitted uid or gid is left unchanged.
+func (h *Handler) handleChown(ctx context.Context, req *Request) *Response {
+	fv, errResp := h.getFileManageVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		Path string `json:"path"`
+		UID  *int   `json:"uid"`
+		GID  *int   `json:"gid"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.Path == "" || (params.UID == nil && params.GID == nil) {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "path and uid or gid are required"},
+			ID:      req.ID,
+		}
+	}
+	uid, gid := -1, -1
+	if params.UID != nil {
+		uid = *params.UID
+	}
+	if params.GID != nil {
+		gid = *params.GID
+	}
+
+	if err := fv.Chown(ctx, params.Path, uid, gid); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{},
+		ID:      req.ID,
+	}
+}
+
+func (h *Handler) handleRename(ctx context.Context, req *Request) *Response {
+	fv, errResp := h.getFileManageVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		OldPath string `json:"old_path"`
+		NewPath string `json:"new_path"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.OldPath == "" || params.NewPath == "" {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "old_path and new_path are required"},
+			ID:      req.ID,
+		}
+	}
+
+	if err := fv.Rename(ctx, params.OldPath, params.NewPath); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{},
+		ID:      req.ID,
+	}
+}
+
+// getCopyVM returns the current VM as a CopyVM, or an error response if
+// there is no VM or it cannot copy trees.
+func (h *Handler) getCopyVM(req *Request) (CopyVM, *Response) {
+	vm := h.getVM()
+	if vm == nil {
+		return nil, &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+	cv, ok := vm.(CopyVM)
+	if !ok {
+		return nil, &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: "copying is not supported by this VM"},
+			ID:      req.ID,
+		}
+	}
+	return cv, nil
+}
+
+func (h *Handler) openUpload(id uint64) {
+	r, w := io.Pipe()
+	h.uploadsMu.Lock()
+	h.uploads[id] = &upload{r: r, w: w}
+	h.uploadsMu.Unlock()
+}
+
+func (h *Handler) getUpload(id uint64) *upload {
+	h.uploadsMu.Lock()
+	defer h.uploadsMu.Unlock()
+	return h.uploads[id]
+}
+
+// closeUpload ends the upload stream of id. Chunks that arrive after it
+// are dropped.
+func (h *Handler) closeUpload(id uint64) {
+	h.uploadsMu.Lock()
+	u := h.uploads[id]
+	delete(h.uploads, id)
+	h.uploadsMu.Unlock()
+	if u != nil {
+		u.r.Close()
+	}
+}
+
+// handleUploadData feeds one chunk of a copy_in or write_file_stream
+// upload to its request. A write_file_stream eof carries the SHA-256 of the
+// whole stream.
+//
+//	{"jsonrpc":"2.0","method":"copy_in.data","params":{"id":<req_id>,"data":"<base64>"}}
+//	{"jsonrpc":"2.0","method":"copy_in.data","params":{"id":<req_id>,"eof":true}}
+//	{"jsonrpc":"2.0","method":"write_file_stream.data","params":{"id":<req_id>,"eof":true,"sha256":"<hex>"}}
+func (h *Handler) handleUploadData(req *Request) {
+	var params struct {
+		ID     uint64 `json:"id"`
+		Data   string `json:"data,omitempty"`
+		Hole   int    `json:"hole,omitempty"`
+		EOF    bool   `json:"eof,omitempty"`
+		SHA256 string `json:"sha256,omitempty"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return
+	}
+	u := h.getUpload(params.ID)
+	if u == nil {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(params.Data)
+	if err != nil {
+		u.w.CloseWithError(err)
+		return
+	}
+	if params.Hole < 0 || params.Hole > copyChunkSize {
+		u.w.CloseWithError(errx.With(ErrStreamHole, ": %d bytes", params.Hole))
+		return
+	}
+	if params.Hole > 0 {
+		data = make([]byte, params.Hole)
+	}
+	if len(data) > 0 {
+		// A failed copy has closed the stream; its chunks are dropped.
+		u.w.Write(data)
+	}
+	if params.EOF {
+		u.sum = params.SHA256
+		u.w.Close()
+	}
+}
+
+// handleCopyIn extracts a tar stream into a directory of the sandbox. The
+// stream follows the request as copy_in.data notifications carrying its
+// ID, ended by one with eof set; the response is sent once it is
+// extracted.
+func (h *Handler) handleCopyIn(ctx context.Context, req *Request) *Response {
+	if req.ID == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidRequest, Message: "copy_in requires an id"},
+		}
+	}
+	defer h.closeUpload(*req.ID)
+	u := h.getUpload(*req.ID)
+	if u == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidRequest, Message: "copy_in stream is not open"},
+			ID:      req.ID,
+		}
+	}
+
+	cv, errResp := h.getCopyVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	stop := context.AfterFunc(ctx, func() { u.r.CloseWithError(ctx.Err()) })
+	defer stop()
+
+	if err := cv.CopyIn(ctx, params.Path, u.r); err != nil {
+		code := ErrCodeFileFailed
+		if ctx.Err() != nil {
+			code = ErrCodeCancelled
+		}
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: code, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{},
+		ID:      req.ID,
+	}
+}
+
+// handleCopyOut streams a tar of a sandbox path as copy_out.data
+// notifications before the final response.
+//
+//	{"jsonrpc":"2.0","method":"copy_out.data","params":{"id":<req_id>,"data":"<base64>"}}
+func (h *Handler) handleCopyOut(ctx context.Context, req *Request) *Response {
+	cv, errResp := h.getCopyVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	w := h.newChunkWriter(req.ID, "copy_out.data")
+	err := cv.CopyOut(ctx, params.Path, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{},
+		ID:      req.ID,
+	}
+}
+
+func (h *Handler) getFileStreamVM(req *Request) (FileStreamVM, *Response) {
+	vm := h.getVM()
+	if vm == nil {
+		return nil, &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+	fv, ok := vm.(FileStreamVM)
+	if !ok {
+		return nil, &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeFileFailed, Message: "file streaming is not supported by this VM"},
+			ID:      req.ID,
+		}
+	}
+	return fv, nil
+}
+
+// handleReadFileStream streams a sandbox file as read_file_stream.data
+// notifications. The final response carries its size and SHA-256 so the
+// client can check what it received.
+//
+//	{"jsonrpc":"2.0","method":"read_file_stream.data","params":{"id":<req_id>,"data":"<base64>"}}
+func (h *Handler) handleReadFileStream(ctx context.Context, req *Request) *Response {
+	fv, errResp := h.getFileStreamVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	hash := sha256.New()
+	w := h.newChunkWriter(req.ID, "read_file_stream.data")
+	n, err := fv.ReadFileTo(ctx, params.Path, io.MultiWriter(w, hash))
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		code := ErrCodeFileFailed
+		if ctx.Err() != nil {
+			code = ErrCodeCancelled
+		}
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: code, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result: map[string]interface{}{
+			"size":   n,
+			"sha256": hex.EncodeToString(hash.Sum(nil)),
+		},
+		ID: req.ID,
+	}
+}
+
+// handleWriteFileStream writes a sandbox file from a stream that follows
+// the request as write_file_stream.data notifications, like copy_in. The
+// file is only replaced once the whole stream has arrived and matches the
+// SHA-256 sent with eof; a sender that fails part way ends the stream
+// without one.
+func (h *Handler) handleWriteFileStream(ctx context.Context, req *Request) *Response {
+	if req.ID == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidRequest, Message: "write_file_stream requires an id"},
+		}
+	}
+	defer h.closeUpload(*req.ID)
+	u := h.getUpload(*req.ID)
+	if u == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidRequest, Message: "write_file_stream stream is not open"},
+			ID:      req.ID,
+		}
+	}
+
+	fv, errResp := h.getFileStreamVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		Path string `json:"path"`
+		Mode uint32 `json:"mode,omitempty"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	stop := context.AfterFunc(ctx, func() { u.r.CloseWithError(ctx.Err()) })
+	defer stop()
+
+	r := &checksumReader{r: u.r, hash: sha256.New(), want: func() string { return u.sum }}
+	n, err := fv.WriteFileFrom(ctx, params.Path, r, params.Mode)
+	if err != nil {
+		code := ErrCodeFileFailed
+		if ctx.Err() != nil {
+			code = ErrCodeCancelled
+		}
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: code, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result: map[string]interface{}{
+			"size":   n,
+			"sha256": hex.EncodeToString(r.hash.Sum(nil)),
+		},
+		ID: req.ID,
+	}
+}
+
+// checksumReader hashes what is read through it and, at EOF, fails the read
+// unless the hash is the one want returns. A writer that stops at the first
+// error then never commits a corrupt or incomplete file.
+type checksumReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want func() string
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF {
+		if !strings.EqualFold(c.want(), hex.EncodeToString(c.hash.Sum(nil))) {
+			return n, ErrStreamChecksum
+		}
+	}
+	return n, err
+}
+
+func (h *Handler) handleNetworkMetrics(ctx context.Context, req *Request) *Response {
+	vm := h.getVM()
+	if vm == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+
+	hosts := []api.HostMetrics{}
+	if mv, ok := vm.(NetworkMetricsVM); ok {
+		if m := mv.NetworkMetrics(); m != nil {
+			hosts = m
+		}
+	}
+
+	result := map[string]interface{}{
+		"hosts": hosts,
+	}
+	if ev, ok := vm.(EgressUsageVM); ok {
+		if usage := ev.EgressUsage(); usage != nil {
+			result["egress"] = usage
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  result,
+		ID:      req.ID,
+	}
+}
+
+func (h *Handler) handleNetworkViolations(ctx context.Context, req *Request) *Response {
+	vm := h.getVM()
+	if vm == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+
+	violations := []api.NetworkViolation{}
+	if vv, ok := vm.(NetworkViolationsVM); ok {
+		if v := vv.NetworkViolations(); v != nil {
+			violations = v
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result: map[string]interface{}{
+			"violations": violations,
+		},
+		ID: req.ID,
+	}
+}
+
+func (h *Handler) handleSecretUsage(ctx context.Context, req *Request) *Response {
+	vm := h.getVM()
+	if vm == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+
+	usage := []api.SecretUsage{}
+	if sv, ok := vm.(SecretUsageVM); ok {
+		if u := sv.SecretUsage(); u != nil {
+			usage = u
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result: map[string]interface{}{
+			"secrets": usage,
+		},
+		ID: req.ID,
+	}
+}
+
+func (h *Handler) handleMountUsage(ctx context.Context, req *Request) *Response {
+	vm := h.getVM()
+	if vm == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+
+	usage := []api.MountUsage{}
+	if mv, ok := vm.(MountUsageVM); ok {
+		if u := mv.MountUsage(); u != nil {
+			usage = u
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result: map[string]interface{}{
+			"mounts": usage,
+		},
+		ID: req.ID,
+	}
+}
+
+func (h *Handler) handleVFSMetrics(ctx context.Context, req *Request) *Response {
+	vm := h.getVM()
+	if vm == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+
+	mounts := []api.MountMetrics{}
+	if mv, ok := vm.(VFSMetricsVM); ok {
+		if m := mv.VFSMetrics(); m != nil {
+			mounts = m
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result: map[string]interface{}{
+			"mounts": mounts,
+		},
+		ID: req.ID,
+	}
+}
+
+// getHotMountVM returns the current VM as a HotMountVM, or an error response
+// if there is no VM or it cannot change its mounts while running.
+func (h *Handler) getHotMountVM(req *Request) (HotMountVM, *Response) {
+	vm := h.getVM()
+	if vm == nil {
+		return nil, &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+	mv, ok := vm.(HotMountVM)
+	if !ok {
+		return nil, &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "mounting volumes while running is not supported by this VM"},
+			ID:      req.ID,
+		}
+	}
+	return mv, nil
+}
+
+// handleMount mounts a volume in the running sandbox's workspace.
+func (h *Handler) handleMount(ctx context.Context, req *Request) *Response {
+	mv, errResp := h.getHotMountVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		GuestPath string           `json:"guest_path"`
+		Mount     *api.MountConfig `json:"mount"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.GuestPath == "" || params.Mount == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "guest_path and mount are required"},
+			ID:      req.ID,
+		}
+	}
+
+	if err := mv.AddMount(params.GuestPath, *params.Mount); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{},
+		ID:      req.ID,
+	}
+}
+
+// handleUnmount unmounts a volume from the running sandbox.
+func (h *Handler) handleUnmount(ctx context.Context, req *Request) *Response {
+	mv, errResp := h.getHotMountVM(req)
+	if errResp != nil {
+		return errResp
+	}
+
+	var params struct {
+		GuestPath string `json:"guest_path"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.GuestPath == "" {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "guest_path is required"},
+			ID:      req.ID,
+		}
+	}
+
+	if err := mv.RemoveMount(params.GuestPath); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{},
+		ID:      req.ID,
+	}
+}
+
+// handleUpdateSecret rotates the real value behind a secret's placeholder.
+func (h *Handler) handleUpdateSecret(ctx context.Context, req *Request) *Response {
+	var params struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.Name == "" || params.Value == "" {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "name and value are required"},
+			ID:      req.ID,
+		}
+	}
+
+	vm := h.getVM()
+	if vm == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+
+	uv, ok := vm.(UpdateSecretVM)
+	if !ok {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "secret rotation is not supported by this VM"},
+			ID:      req.ID,
+		}
+	}
+
+	if err := uv.UpdateSecret(params.Name, params.Value); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{"updated": true},
+		ID:      req.ID,
+	}
+}
+
+// handleFreezeNetwork cuts off all of the VM's network egress for incident
+// response, leaving it running for inspection.
+func (h *Handler) handleFreezeNetwork(ctx context.Context, req *Request) *Response {
+	vm := h.getVM()
+	if vm == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+
+	fv, ok := vm.(FreezeNetworkVM)
+	if !ok {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "network freeze is not supported by this VM"},
+			ID:      req.ID,
+		}
+	}
+
+	if err := fv.FreezeNetwork(); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{"frozen": true},
+		ID:      req.ID,
+	}
+}
+
+// handleWatchFiles starts sending "file" events for changes under a path,
+// the workspace by default.
+func (h *Handler) handleWatchFiles(ctx context.Context, req *Request) *Response {
+	vm := h.getVM()
+	if vm == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+
+	var params struct {
+		Path string `json:"path"`
+	}
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+	}
+	if params.Path == "" {
+		params.Path = vm.Config().GetWorkspace()
+	}
+
+	wv, ok := vm.(FileWatchVM)
+	if !ok {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "file watching is not supported by this VM"},
+			ID:      req.ID,
+		}
+	}
+	if err := wv.WatchFiles(params.Path); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{"path": params.Path},
+		ID:      req.ID,
+	}
+}
+
+func (h *Handler) handleSnapshot(ctx context.Context, req *Request) *Response {
+	vm := h.getVM()
+	if vm == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+
+	var params struct {
+		Tag string `json:"tag"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.Tag == "" {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "tag is required"},
+			ID:      req.ID,
+		}
+	}
+
+	sv, ok := vm.(SnapshotVM)
+	if !ok {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "snapshots are not supported by this VM"},
+			ID:      req.ID,
+		}
+	}
+
+	if err := sv.Snapshot(ctx, params.Tag); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result: map[string]interface{}{
+			"tag": params.Tag,
+		},
+		ID: req.ID,
+	}
+}
+
+func (h *Handler) handleSnapshotWorkspace(ctx context.Context, req *Request) *Response {
+	vm := h.getVM()
+	if vm == nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "VM not created"},
+			ID:      req.ID,
+		}
+	}
+
+	var params struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.Name == "" {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "name is required"},
+			ID:      req.ID,
+		}
+	}
+	if err := workspaces.ValidateName(params.Name); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	wv, ok := vm.(WorkspaceSnapshotVM)
+	if !ok {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: "workspace snapshots are not supported by this VM"},
+			ID:      req.ID,
+		}
+	}
+
+	snap, err := wv.SnapshotWorkspace(params.Name)
+	if err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeVMFailed, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  snap,
+		ID:      req.ID,
+	}
+}
+
+// handleSnapshotExists reports whether a snapshot is present in the local
+// image store. It does not require a VM so clients can decide which image
+// to create from.
+func (h *Handler) handleSnapshotExists(ctx context.Context, req *Request) *Response {
+	var params struct {
+		Tag string `json:"tag"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.Tag == "" {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: "tag is required"},
+			ID:      req.ID,
+		}
+	}
+
+	_, err := image.NewStore("").Get(params.Tag)
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result: map[string]interface{}{
+			"exists": err == nil,
+		},
+		ID: req.ID,
+	}
+}
+
+// handlePrefetch pulls and converts images without needing a VM. Progress is
+// streamed as one notification per image:
+//
+//	{"jsonrpc":"2.0","method":"prefetch.progress","params":{"id":<req_id>,"image":"...","digest":"...","cached":false,"duration_ms":1234}}
+//
+// The final response lists every result in scheduling order. A failed image
+// is reported in its result rather than failing the request.
+func (h *Handler) handlePrefetch(ctx context.Context, req *Request) *Response {
+	var params struct {
+		Images      []image.PrefetchImage `json:"images"`
+		Concurrency int                   `json:"concurrency"`
+	}
+	if req.Params != nil {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
+		}
+	}
+
+	if err := image.ValidatePrefetch(params.Images, params.Concurrency); err != nil {
+		return &Response{
+			JSONRPC: "2.0",
+			Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+			ID:      req.ID,
+		}
+	}
+
+	results := h.prefetch(ctx, params.Images, params.Concurrency, func(result image.PrefetchResult) {
+		h.sendNotification("prefetch.progress", struct {
+			ID *uint64 `json:"id"`
+			image.PrefetchResult
+		}{req.ID, result})
+	})
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{"images": results},
+		ID:      req.ID,
+	}
+}
+
+func (h *Handler) handleClose(ctx context.Context, req *Request) *Response {
+	h.closed.Store(true)
+
+	var params struct {
+		TimeoutSeconds float64 `json:"timeout_seconds"`
+	}
+	if req.Params != nil {
+		json.Unmarshal(req.Params, &params)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(params.TimeoutSeconds*float64(time.Second)))
+	defer cancel()
+
+	h.vmMu.Lock()
+	vm := h.vm
+	h.vm = nil
+	srv := h.transfer
+	h.transfer = nil
+	h.vmMu.Unlock()
+
+	if srv != nil {
+		srv.Stop()
+	}
+	if vm != nil {
+		vm.Close(ctx)
+	}
+
+	return &Response{
+		JSONRPC: "2.0",
+		Result:  map[string]interface{}{},
+		ID:      req.ID,
+	}
+}
+
+func (h *Handler) handleCancel(req *Request) *Response {
+	var params struct {
+		ID uint64 `json:"id"`
+	}
+	if req.Params != nil {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				Error:   &Error{Code: ErrCodeInvalidParams, Message: err.Error()},
+				ID:      req.ID,
+			}
 		}
 	}
 
@@ -638,13 +2364,17 @@ func (h *Handler) sendError(id *uint64, code int, message string) {
 }
 
 func (h *Handler) sendEvent(event api.Event) {
+	h.sendNotification("event", event)
+}
+
+func (h *Handler) sendNotification(method string, params interface{}) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	notification := map[string]interface{}{
 		"jsonrpc": "2.0",
-		"method":  "event",
-		"params":  event,
+		"method":  method,
+		"params":  params,
 	}
 	data, _ := json.Marshal(notification)
 	fmt.Fprintln(h.stdout, string(data))
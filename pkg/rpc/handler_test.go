@@ -5,8 +5,15 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -15,7 +22,14 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/jingkaihe/matchlock/internal/errx"
 	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/delta"
+	"github.com/jingkaihe/matchlock/pkg/image"
+	"github.com/jingkaihe/matchlock/pkg/preset"
+	"github.com/jingkaihe/matchlock/pkg/transfer"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+	"github.com/jingkaihe/matchlock/pkg/workspaces"
 )
 
 type mockVM struct {
@@ -62,11 +76,14 @@ func newTestRPC(vm *mockVM) *testRPC {
 	})
 }
 
-func newTestRPCWithFactory(factory VMFactory) *testRPC {
+func newTestRPCWithFactory(factory VMFactory, opts ...func(*Handler)) *testRPC {
 	stdinR, stdinW := io.Pipe()
 	stdoutR, stdoutW := io.Pipe()
 
 	h := NewHandler(factory, stdinR, stdoutW)
+	for _, opt := range opts {
+		opt(h)
+	}
 
 	done := make(chan error, 1)
 	go func() { done <- h.Run(context.Background()) }()
@@ -222,6 +239,59 @@ func TestHandlerExecStream(t *testing.T) {
 	assert.Equal(t, int64(42), result.DurationMS)
 }
 
+func TestHandlerExecArgv(t *testing.T) {
+	var gotCommand string
+	var gotArgv []string
+	vm := &mockVM{
+		id: "vm-test",
+		execFunc: func(ctx context.Context, command string, opts *api.ExecOptions) (*api.ExecResult, error) {
+			gotCommand = command
+			gotArgv = opts.RawArgv
+			return &api.ExecResult{}, nil
+		},
+	}
+
+	rpc := newTestRPC(vm)
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("exec", 2, map[string]interface{}{"argv": []string{"ls", "-l", "my file"}})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.Equal(t, []string{"ls", "-l", "my file"}, gotArgv)
+	assert.Equal(t, "ls -l 'my file'", gotCommand)
+}
+
+func TestHandlerExecWorkingDir(t *testing.T) {
+	vm := &mockVM{
+		id: "vm-test",
+		execFunc: func(ctx context.Context, command string, opts *api.ExecOptions) (*api.ExecResult, error) {
+			if !opts.CreateWorkingDir {
+				return &api.ExecResult{ExitCode: 1}, errx.With(api.ErrWorkingDir, ": stat %s: no such file or directory", opts.WorkingDir)
+			}
+			return &api.ExecResult{}, nil
+		},
+	}
+
+	rpc := newTestRPC(vm)
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("exec", 2, map[string]interface{}{"command": "pwd", "working_dir": "/missing"})
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeWorkingDir, msg.Error.Code)
+	assert.Contains(t, msg.Error.Message, "/missing")
+
+	rpc.send("exec", 3, map[string]interface{}{"command": "pwd", "working_dir": "/missing", "create_working_dir": true})
+	msg = rpc.read()
+	assert.Nil(t, msg.Error)
+}
+
 func TestHandlerCreateRejectsMountOutsideWorkspace(t *testing.T) {
 	vm := &mockVM{id: "vm-test"}
 	factoryCalls := 0
@@ -250,3 +320,1298 @@ func TestHandlerCreateRejectsMountOutsideWorkspace(t *testing.T) {
 	require.Contains(t, msg.Error.Message, "must be within workspace")
 	require.Equal(t, 0, factoryCalls, "factory should not have been called")
 }
+
+type metricsMockVM struct {
+	mockVM
+	metrics []api.HostMetrics
+	egress  *api.EgressUsage
+}
+
+func (m *metricsMockVM) NetworkMetrics() []api.HostMetrics { return m.metrics }
+
+func (m *metricsMockVM) EgressUsage() *api.EgressUsage { return m.egress }
+
+func TestHandlerNetworkMetrics(t *testing.T) {
+	vm := &metricsMockVM{
+		mockVM: mockVM{id: "vm-test"},
+		metrics: []api.HostMetrics{
+			{Host: "api.example.com", Requests: 2, BytesSent: 10, BytesReceived: 200},
+		},
+		egress: &api.EgressUsage{UsedBytes: 10, LimitBytes: 1024},
+	}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("network_metrics", 2, nil)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+
+	var result struct {
+		Hosts  []api.HostMetrics `json:"hosts"`
+		Egress *api.EgressUsage  `json:"egress"`
+	}
+	require.NoError(t, json.Unmarshal(msg.Result, &result))
+	assert.Equal(t, vm.metrics, result.Hosts)
+	assert.Equal(t, vm.egress, result.Egress)
+}
+
+func TestHandlerCreateRejectsInvalidEgressBudget(t *testing.T) {
+	factoryCalls := 0
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		factoryCalls++
+		return &mockVM{id: "vm-test"}, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]interface{}{
+		"image":   "alpine:latest",
+		"network": map[string]interface{}{"egress_budget_action": "pause", "max_egress_bytes": 1024},
+	})
+
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	require.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+	require.Contains(t, msg.Error.Message, "invalid egress budget")
+	require.Equal(t, 0, factoryCalls)
+}
+
+func TestHandlerCreateRejectsUnknownSecretLocation(t *testing.T) {
+	factoryCalls := 0
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		factoryCalls++
+		return &mockVM{id: "vm-test"}, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]interface{}{
+		"image": "alpine:latest",
+		"network": map[string]interface{}{"secrets": map[string]interface{}{
+			"API_KEY": map[string]interface{}{"value": "v", "hosts": []string{"api.example.com"}, "in": []string{"cookie"}},
+		}},
+	})
+
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	require.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+	require.Contains(t, msg.Error.Message, "invalid secret location")
+	require.Equal(t, 0, factoryCalls)
+}
+
+func TestHandlerNetworkMetricsUnsupported(t *testing.T) {
+	rpc := newTestRPC(&mockVM{id: "vm-test"})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("network_metrics", 2, nil)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"hosts":[]}`, string(msg.Result))
+}
+
+type violationsMockVM struct {
+	mockVM
+	violations []api.NetworkViolation
+}
+
+func (m *violationsMockVM) NetworkViolations() []api.NetworkViolation { return m.violations }
+
+func TestHandlerNetworkViolations(t *testing.T) {
+	seen := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	vm := &violationsMockVM{
+		mockVM: mockVM{id: "vm-test"},
+		violations: []api.NetworkViolation{
+			{Host: "evil.com", Rule: api.RuleAllowlist, Reason: "host not in allowlist", Count: 3, FirstSeen: seen, LastSeen: seen},
+		},
+	}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("network_violations", 2, nil)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+
+	var result struct {
+		Violations []api.NetworkViolation `json:"violations"`
+	}
+	require.NoError(t, json.Unmarshal(msg.Result, &result))
+	assert.Equal(t, vm.violations, result.Violations)
+}
+
+func TestHandlerNetworkViolationsUnsupported(t *testing.T) {
+	rpc := newTestRPC(&mockVM{id: "vm-test"})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("network_violations", 2, nil)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"violations":[]}`, string(msg.Result))
+}
+
+type secretUsageMockVM struct {
+	mockVM
+}
+
+func (m *secretUsageMockVM) SecretUsage() []api.SecretUsage {
+	return []api.SecretUsage{{Name: "API_KEY", Injections: 2, Hosts: []string{"api.example.com"}}}
+}
+
+func TestHandlerSecretUsage(t *testing.T) {
+	vm := &secretUsageMockVM{mockVM: mockVM{id: "vm-test"}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("secret_usage", 2, nil)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"secrets":[{"name":"API_KEY","injections":2,"hosts":["api.example.com"]}]}`, string(msg.Result))
+}
+
+func TestHandlerSecretUsageUnsupported(t *testing.T) {
+	rpc := newTestRPC(&mockVM{id: "vm-test"})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("secret_usage", 2, nil)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"secrets":[]}`, string(msg.Result))
+}
+
+type mountUsageMockVM struct {
+	mockVM
+}
+
+func (m *mountUsageMockVM) MountUsage() []api.MountUsage {
+	return []api.MountUsage{{Path: "/workspace/scratch", UsedBytes: 4096, LimitBytes: 1 << 20}}
+}
+
+func TestHandlerMountUsage(t *testing.T) {
+	vm := &mountUsageMockVM{mockVM: mockVM{id: "vm-test"}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("mount_usage", 2, nil)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"mounts":[{"path":"/workspace/scratch","used_bytes":4096,"limit_bytes":1048576}]}`, string(msg.Result))
+}
+
+type vfsMetricsMockVM struct {
+	mockVM
+}
+
+func (m *vfsMetricsMockVM) VFSMetrics() []api.MountMetrics {
+	return []api.MountMetrics{{Path: "/workspace", Ops: []api.VFSOpMetrics{
+		{Op: "read", Count: 2, Bytes: 8192, TotalUS: 300, MaxUS: 200, Latency: []int64{0, 2, 0, 0, 0, 0}},
+	}}}
+}
+
+func TestHandlerVFSMetrics(t *testing.T) {
+	vm := &vfsMetricsMockVM{mockVM: mockVM{id: "vm-test"}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("vfs_metrics", 2, nil)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"mounts":[{"path":"/workspace","ops":[{"op":"read","count":2,"bytes":8192,"total_us":300,"max_us":200,"latency":[0,2,0,0,0,0]}]}]}`, string(msg.Result))
+}
+
+type updateSecretMockVM struct {
+	mockVM
+	secrets map[string]string
+}
+
+func (m *updateSecretMockVM) UpdateSecret(name, value string) error {
+	if _, ok := m.secrets[name]; !ok {
+		return api.ErrUnknownSecret
+	}
+	m.secrets[name] = value
+	return nil
+}
+
+func TestHandlerUpdateSecret(t *testing.T) {
+	vm := &updateSecretMockVM{mockVM: mockVM{id: "vm-test"}, secrets: map[string]string{"API_KEY": "old"}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("update_secret", 2, map[string]string{"name": "API_KEY", "value": "new"})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"updated":true}`, string(msg.Result))
+	assert.Equal(t, "new", vm.secrets["API_KEY"])
+
+	rpc.send("update_secret", 3, map[string]string{"name": "MISSING", "value": "new"})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeVMFailed, msg.Error.Code)
+
+	rpc.send("update_secret", 4, map[string]string{"name": "API_KEY"})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+}
+
+type hotMountMockVM struct {
+	mockVM
+	mounts map[string]api.MountConfig
+}
+
+func (m *hotMountMockVM) AddMount(guestPath string, mount api.MountConfig) error {
+	m.mounts[guestPath] = mount
+	return nil
+}
+
+func (m *hotMountMockVM) RemoveMount(guestPath string) error {
+	if _, ok := m.mounts[guestPath]; !ok {
+		return errors.New("not mounted")
+	}
+	delete(m.mounts, guestPath)
+	return nil
+}
+
+func TestHandlerMountUnmount(t *testing.T) {
+	vm := &hotMountMockVM{mockVM: mockVM{id: "vm-test"}, mounts: map[string]api.MountConfig{}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("mount", 2, map[string]interface{}{
+		"guest_path": "/workspace/data",
+		"mount":      map[string]interface{}{"type": "real_fs", "host_path": "/srv/data", "readonly": true},
+	})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.Equal(t, api.MountConfig{Type: "real_fs", HostPath: "/srv/data", Readonly: true}, vm.mounts["/workspace/data"])
+
+	rpc.send("mount", 3, map[string]interface{}{"guest_path": "/workspace/data"})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+
+	rpc.send("unmount", 4, map[string]string{"guest_path": "/workspace/data"})
+	msg = rpc.read()
+	require.Nil(t, msg.Error)
+	assert.Empty(t, vm.mounts)
+
+	rpc.send("unmount", 5, map[string]string{"guest_path": "/workspace/data"})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeVMFailed, msg.Error.Code)
+}
+
+type freezeMockVM struct {
+	mockVM
+	frozen bool
+}
+
+func (m *freezeMockVM) FreezeNetwork() error {
+	m.frozen = true
+	return nil
+}
+
+func TestHandlerFreezeNetwork(t *testing.T) {
+	vm := &freezeMockVM{mockVM: mockVM{id: "vm-test"}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("freeze_network", 2, nil)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"frozen":true}`, string(msg.Result))
+	assert.True(t, vm.frozen)
+}
+
+func TestHandlerFreezeNetworkUnsupported(t *testing.T) {
+	rpc := newTestRPC(&mockVM{id: "vm-test"})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("freeze_network", 2, nil)
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeVMFailed, msg.Error.Code)
+}
+
+type watchMockVM struct {
+	mockVM
+	paths []string
+}
+
+func (m *watchMockVM) WatchFiles(path string) error {
+	m.paths = append(m.paths, path)
+	return nil
+}
+
+func TestHandlerWatchFiles(t *testing.T) {
+	vm := &watchMockVM{mockVM: mockVM{id: "vm-test"}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("watch_files", 2, nil)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"path":"/workspace"}`, string(msg.Result))
+
+	rpc.send("watch_files", 3, map[string]string{"path": "/workspace/out"})
+	msg = rpc.read()
+	require.Nil(t, msg.Error)
+	assert.Equal(t, []string{"/workspace", "/workspace/out"}, vm.paths)
+}
+
+type snapshotMockVM struct {
+	mockVM
+	tags []string
+}
+
+func (m *snapshotMockVM) Snapshot(ctx context.Context, tag string) error {
+	m.tags = append(m.tags, tag)
+	return nil
+}
+
+func TestHandlerSnapshot(t *testing.T) {
+	vm := &snapshotMockVM{mockVM: mockVM{id: "vm-test"}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("snapshot", 2, map[string]string{"tag": "fixture:abc"})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"tag":"fixture:abc"}`, string(msg.Result))
+	assert.Equal(t, []string{"fixture:abc"}, vm.tags)
+}
+
+func TestHandlerSnapshotRequiresTag(t *testing.T) {
+	vm := &snapshotMockVM{mockVM: mockVM{id: "vm-test"}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("snapshot", 2, map[string]string{})
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+	assert.Empty(t, vm.tags)
+}
+
+func TestHandlerSnapshotUnsupported(t *testing.T) {
+	rpc := newTestRPC(&mockVM{id: "vm-test"})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("snapshot", 2, map[string]string{"tag": "fixture:abc"})
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeVMFailed, msg.Error.Code)
+}
+
+type workspaceSnapshotMockVM struct {
+	mockVM
+	names []string
+}
+
+func (m *workspaceSnapshotMockVM) SnapshotWorkspace(name string) (*workspaces.Snapshot, error) {
+	m.names = append(m.names, name)
+	return &workspaces.Snapshot{Name: name, SandboxID: m.id, Workspace: "/workspace"}, nil
+}
+
+func TestHandlerSnapshotWorkspace(t *testing.T) {
+	vm := &workspaceSnapshotMockVM{mockVM: mockVM{id: "vm-test"}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("snapshot_workspace", 2, map[string]string{"name": "../escape"})
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+
+	rpc.send("snapshot_workspace", 3, map[string]string{"name": "agent-run-1"})
+	msg = rpc.read()
+	require.Nil(t, msg.Error)
+	var snap workspaces.Snapshot
+	require.NoError(t, json.Unmarshal(msg.Result, &snap))
+	assert.Equal(t, "agent-run-1", snap.Name)
+	assert.Equal(t, "vm-test", snap.SandboxID)
+	assert.Equal(t, []string{"agent-run-1"}, vm.names)
+}
+
+func TestHandlerSnapshotExists(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	rootfs := t.TempDir() + "/rootfs.ext4"
+	require.NoError(t, os.WriteFile(rootfs, []byte("ext4"), 0644))
+	require.NoError(t, image.NewStore("").Save("fixture:present", rootfs, image.ImageMeta{Source: "snapshot"}))
+
+	rpc := newTestRPC(&mockVM{id: "vm-test"})
+	defer rpc.close()
+
+	rpc.send("snapshot_exists", 1, map[string]string{"tag": "fixture:present"})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"exists":true}`, string(msg.Result))
+
+	rpc.send("snapshot_exists", 2, map[string]string{"tag": "fixture:missing"})
+	msg = rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"exists":false}`, string(msg.Result))
+}
+
+type fileSyncMockVM struct {
+	mockVM
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  []string
+}
+
+func (m *fileSyncMockVM) FileSignature(ctx context.Context, path string, blockSize int) (*delta.Signature, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	content, ok := m.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return delta.Sign(content, blockSize)
+}
+
+func (m *fileSyncMockVM) PatchFile(ctx context.Context, path string, blockSize int, ops []delta.Op, mode uint32, checksum string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	content, err := delta.Apply(m.files[path], blockSize, ops)
+	if err != nil {
+		return err
+	}
+	if delta.Checksum(content) != checksum {
+		return fmt.Errorf("checksum mismatch")
+	}
+	m.files[path] = content
+	return nil
+}
+
+func (m *fileSyncMockVM) MkdirAll(ctx context.Context, path string, mode uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dirs = append(m.dirs, path)
+	return nil
+}
+
+func TestHandlerFileSignatureAndPatch(t *testing.T) {
+	old := []byte(strings.Repeat("line of source code\n", 200))
+	vm := &fileSyncMockVM{
+		mockVM: mockVM{id: "vm-test"},
+		files:  map[string][]byte{"/workspace/main.go": old},
+	}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("file_signature", 2, map[string]interface{}{"path": "/workspace/main.go", "block_size": 256})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+
+	var sigResult struct {
+		Exists    bool             `json:"exists"`
+		Signature *delta.Signature `json:"signature"`
+	}
+	require.NoError(t, json.Unmarshal(msg.Result, &sigResult))
+	require.True(t, sigResult.Exists)
+	require.Equal(t, 256, sigResult.Signature.BlockSize)
+
+	updated := append([]byte("// header\n"), old...)
+	ops := delta.Diff(sigResult.Signature, updated)
+
+	rpc.send("patch_file", 3, map[string]interface{}{
+		"path":       "/workspace/main.go",
+		"block_size": 256,
+		"ops":        ops,
+		"checksum":   delta.Checksum(updated),
+	})
+	msg = rpc.read()
+	require.Nil(t, msg.Error)
+	assert.Equal(t, string(updated), string(vm.files["/workspace/main.go"]))
+}
+
+func TestHandlerFileSignatureMissingFile(t *testing.T) {
+	vm := &fileSyncMockVM{mockVM: mockVM{id: "vm-test"}, files: map[string][]byte{}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("file_signature", 2, map[string]string{"path": "/workspace/missing"})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"exists":false}`, string(msg.Result))
+}
+
+func TestHandlerPatchFileChecksumMismatch(t *testing.T) {
+	vm := &fileSyncMockVM{
+		mockVM: mockVM{id: "vm-test"},
+		files:  map[string][]byte{"/workspace/a.txt": []byte("abc")},
+	}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("patch_file", 2, map[string]interface{}{
+		"path":       "/workspace/a.txt",
+		"block_size": 2,
+		"ops":        []delta.Op{{Data: []byte("xyz")}},
+		"checksum":   delta.Checksum([]byte("not xyz")),
+	})
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeFileFailed, msg.Error.Code)
+	assert.Equal(t, "abc", string(vm.files["/workspace/a.txt"]))
+}
+
+func TestHandlerMkdir(t *testing.T) {
+	vm := &fileSyncMockVM{mockVM: mockVM{id: "vm-test"}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("mkdir", 2, map[string]string{"path": "/workspace/a/b"})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.Equal(t, []string{"/workspace/a/b"}, vm.dirs)
+}
+
+func TestHandlerFileSyncUnsupported(t *testing.T) {
+	rpc := newTestRPC(&mockVM{id: "vm-test"})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("file_signature", 2, map[string]string{"path": "/workspace/a"})
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeFileFailed, msg.Error.Code)
+}
+
+type copyMockVM struct {
+	mockVM
+	mu     sync.Mutex
+	copied map[string][]byte
+}
+
+func (m *copyMockVM) CopyIn(ctx context.Context, path string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.copied[path] = data
+	return nil
+}
+
+func (m *copyMockVM) CopyOut(ctx context.Context, path string, w io.Writer) error {
+	m.mu.Lock()
+	data, ok := m.copied[path]
+	m.mu.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func TestHandlerCopyInAndOut(t *testing.T) {
+	vm := &copyMockVM{mockVM: mockVM{id: "vm-test"}, copied: map[string][]byte{}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	stream := []byte(strings.Repeat("tar bytes ", copyChunkSize/5))
+	rpc.send("copy_in", 2, map[string]string{"path": "/workspace/in"})
+	for _, chunk := range [][]byte{stream[:100], stream[100:]} {
+		data, _ := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  "copy_in.data",
+			"params":  map[string]interface{}{"id": 2, "data": base64.StdEncoding.EncodeToString(chunk)},
+		})
+		fmt.Fprintln(rpc.stdinW, string(data))
+	}
+	fmt.Fprintln(rpc.stdinW, `{"jsonrpc":"2.0","method":"copy_in.data","params":{"id":2,"eof":true}}`)
+
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.Equal(t, string(stream), string(vm.copied["/workspace/in"]))
+
+	rpc.send("copy_out", 3, map[string]string{"path": "/workspace/in"})
+	var out []byte
+	for {
+		msg := rpc.read()
+		if msg.ID != nil {
+			require.Nil(t, msg.Error)
+			break
+		}
+		require.Equal(t, "copy_out.data", msg.Method)
+		var p struct {
+			ID   uint64 `json:"id"`
+			Data string `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(msg.Params, &p))
+		assert.Equal(t, uint64(3), p.ID)
+		chunk, err := base64.StdEncoding.DecodeString(p.Data)
+		require.NoError(t, err)
+		out = append(out, chunk...)
+	}
+	assert.Equal(t, string(stream), string(out))
+
+	rpc.send("copy_out", 4, map[string]string{"path": "/workspace/missing"})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeFileFailed, msg.Error.Code)
+}
+
+type fileStreamMockVM struct {
+	mockVM
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (m *fileStreamMockVM) ReadFileTo(ctx context.Context, path string, w io.Writer) (int64, error) {
+	m.mu.Lock()
+	data, ok := m.files[path]
+	m.mu.Unlock()
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+func (m *fileStreamMockVM) WriteFileFrom(ctx context.Context, path string, r io.Reader, mode uint32) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[path] = data
+	return int64(len(data)), nil
+}
+
+// sendFileStreamChunks sends chunks as write_file_stream.data, with chunks
+// of only zeros sent as holes as the SDK does.
+func sendFileStreamChunks(rpc *testRPC, id int, chunks [][]byte, sum string) {
+	for _, chunk := range chunks {
+		params := map[string]interface{}{"id": id, "data": base64.StdEncoding.EncodeToString(chunk)}
+		if vfs.IsZero(chunk) {
+			params = map[string]interface{}{"id": id, "hole": len(chunk)}
+		}
+		data, _ := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  "write_file_stream.data",
+			"params":  params,
+		})
+		fmt.Fprintln(rpc.stdinW, string(data))
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "write_file_stream.data",
+		"params":  map[string]interface{}{"id": id, "eof": true, "sha256": sum},
+	})
+	fmt.Fprintln(rpc.stdinW, string(data))
+}
+
+func TestHandlerFileStream(t *testing.T) {
+	vm := &fileStreamMockVM{mockVM: mockVM{id: "vm-test"}, files: map[string][]byte{}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	content := []byte(strings.Repeat("artifact ", copyChunkSize/4))
+	sum := delta.Checksum(content)
+
+	rpc.send("write_file_stream", 2, map[string]interface{}{"path": "/workspace/big.bin", "mode": 0600})
+	sendFileStreamChunks(rpc, 2, [][]byte{content[:1000], content[1000:]}, sum)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, fmt.Sprintf(`{"size":%d,"sha256":%q}`, len(content), sum), string(msg.Result))
+	assert.Equal(t, content, vm.files["/workspace/big.bin"])
+
+	rpc.send("read_file_stream", 3, map[string]string{"path": "/workspace/big.bin"})
+	var out []byte
+	chunks := 0
+	for {
+		msg := rpc.read()
+		if msg.ID != nil {
+			require.Nil(t, msg.Error)
+			assert.JSONEq(t, fmt.Sprintf(`{"size":%d,"sha256":%q}`, len(content), sum), string(msg.Result))
+			break
+		}
+		require.Equal(t, "read_file_stream.data", msg.Method)
+		var p struct {
+			Data string `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(msg.Params, &p))
+		chunk, err := base64.StdEncoding.DecodeString(p.Data)
+		require.NoError(t, err)
+		out = append(out, chunk...)
+		chunks++
+	}
+	assert.Equal(t, content, out)
+	assert.Greater(t, chunks, 1)
+}
+
+func TestHandlerFileStreamSparse(t *testing.T) {
+	vm := &fileStreamMockVM{mockVM: mockVM{id: "vm-test"}, files: map[string][]byte{}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	hole := make([]byte, copyChunkSize)
+	content := append(append([]byte("SQLite format 3"), hole...), hole...)
+	sum := delta.Checksum(content)
+
+	rpc.send("write_file_stream", 2, map[string]interface{}{"path": "/workspace/db.sqlite"})
+	sendFileStreamChunks(rpc, 2, [][]byte{content[:15], hole, hole}, sum)
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	assert.Equal(t, content, vm.files["/workspace/db.sqlite"])
+
+	rpc.send("read_file_stream", 3, map[string]string{"path": "/workspace/db.sqlite"})
+	var out []byte
+	holes := 0
+	for {
+		msg := rpc.read()
+		if msg.ID != nil {
+			require.Nil(t, msg.Error)
+			break
+		}
+		var p struct {
+			Data string `json:"data"`
+			Hole int    `json:"hole"`
+		}
+		require.NoError(t, json.Unmarshal(msg.Params, &p))
+		if p.Hole > 0 {
+			holes++
+			out = append(out, make([]byte, p.Hole)...)
+			continue
+		}
+		chunk, err := base64.StdEncoding.DecodeString(p.Data)
+		require.NoError(t, err)
+		out = append(out, chunk...)
+	}
+	assert.Equal(t, content, out)
+	assert.Equal(t, 2, holes)
+}
+
+func TestHandlerWriteFileStreamChecksumMismatch(t *testing.T) {
+	vm := &fileStreamMockVM{mockVM: mockVM{id: "vm-test"}, files: map[string][]byte{}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("write_file_stream", 2, map[string]string{"path": "/workspace/out.bin"})
+	sendFileStreamChunks(rpc, 2, [][]byte{[]byte("truncated")}, delta.Checksum([]byte("truncated and more")))
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeFileFailed, msg.Error.Code)
+	assert.Contains(t, msg.Error.Message, "checksum")
+	assert.NotContains(t, vm.files, "/workspace/out.bin")
+}
+
+// fileManageMockVM manages the files of an in-memory VFS.
+type fileManageMockVM struct {
+	mockVM
+	fs *vfs.MemoryProvider
+}
+
+func (m *fileManageMockVM) Stat(ctx context.Context, path string) (*api.FileInfo, error) {
+	info, err := m.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FileInfo{Name: info.Name(), Size: info.Size(), Mode: uint32(info.Mode()), IsDir: info.IsDir()}, nil
+}
+
+func (m *fileManageMockVM) Remove(ctx context.Context, path string) error {
+	return m.fs.Remove(path)
+}
+
+func (m *fileManageMockVM) RemoveAll(ctx context.Context, path string) error {
+	return m.fs.RemoveAll(path)
+}
+
+func (m *fileManageMockVM) Chmod(ctx context.Context, path string, mode uint32) error {
+	return m.fs.Chmod(path, os.FileMode(mode))
+}
+
+func (m *fileManageMockVM) Chown(ctx context.Context, path string, uid, gid int) error {
+	return vfs.Chown(m.fs, path, uid, gid)
+}
+
+func (m *fileManageMockVM) Rename(ctx context.Context, oldPath, newPath string) error {
+	return m.fs.Rename(oldPath, newPath)
+}
+
+func TestHandlerFileManagement(t *testing.T) {
+	fs := vfs.NewMemoryProvider()
+	require.NoError(t, fs.MkdirAll("/out/logs", 0755))
+	require.NoError(t, fs.WriteFile("/out/report.txt", []byte("ok"), 0644))
+	require.NoError(t, fs.WriteFile("/out/logs/run.log", []byte("log"), 0644))
+	vm := &fileManageMockVM{mockVM: mockVM{id: "vm-test"}, fs: fs}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("chmod", 2, map[string]interface{}{"path": "/out/report.txt", "mode": 0600})
+	require.Nil(t, rpc.read().Error)
+
+	rpc.send("rename", 3, map[string]string{"old_path": "/out/report.txt", "new_path": "/out/final.txt"})
+	require.Nil(t, rpc.read().Error)
+
+	rpc.send("stat", 4, map[string]string{"path": "/out/final.txt"})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	var stat struct {
+		Exists bool         `json:"exists"`
+		Info   api.FileInfo `json:"info"`
+	}
+	require.NoError(t, json.Unmarshal(msg.Result, &stat))
+	assert.True(t, stat.Exists)
+	assert.Equal(t, int64(2), stat.Info.Size)
+	assert.Equal(t, uint32(0600), stat.Info.Mode&0777)
+
+	rpc.send("stat", 5, map[string]string{"path": "/out/report.txt"})
+	msg = rpc.read()
+	require.Nil(t, msg.Error)
+	assert.JSONEq(t, `{"exists":false}`, string(msg.Result))
+
+	rpc.send("remove", 6, map[string]string{"path": "/out/logs"})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error, "a non-empty directory needs recursive")
+	assert.Equal(t, ErrCodeFileFailed, msg.Error.Code)
+
+	rpc.send("remove", 7, map[string]interface{}{"path": "/out/logs", "recursive": true})
+	require.Nil(t, rpc.read().Error)
+	_, err := fs.Stat("/out/logs")
+	assert.True(t, os.IsNotExist(err))
+
+	rpc.send("chmod", 8, map[string]string{"path": "/out/final.txt"})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+
+	rpc.send("chown", 9, map[string]interface{}{"path": "/out/final.txt", "uid": 0})
+	require.Nil(t, rpc.read().Error)
+
+	rpc.send("chown", 10, map[string]interface{}{"path": "/out/final.txt", "gid": 1000})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error, "files without an idmap stay owned by root")
+	assert.Equal(t, ErrCodeFileFailed, msg.Error.Code)
+
+	rpc.send("chown", 11, map[string]string{"path": "/out/final.txt"})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+}
+
+func TestHandlerCopyInUnsupported(t *testing.T) {
+	rpc := newTestRPC(&mockVM{id: "vm-test"})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	rpc.read()
+
+	rpc.send("copy_in", 2, map[string]string{"path": "/workspace/in"})
+	fmt.Fprintln(rpc.stdinW, `{"jsonrpc":"2.0","method":"copy_in.data","params":{"id":2,"data":"aGVsbG8="}}`)
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeFileFailed, msg.Error.Code)
+
+	rpc.send("exec", 3, map[string]string{"command": "echo"})
+	msg = rpc.read()
+	require.Nil(t, msg.Error, "chunks of a failed copy do not block later requests")
+}
+
+func TestHandlerPrefetch(t *testing.T) {
+	var gotConcurrency int
+	rpc := newTestRPCWithFactory(nil, func(h *Handler) {
+		h.prefetch = func(ctx context.Context, images []image.PrefetchImage, concurrency int, onResult func(image.PrefetchResult)) []image.PrefetchResult {
+			gotConcurrency = concurrency
+			var results []image.PrefetchResult
+			for _, img := range images {
+				r := image.PrefetchResult{Image: img.Image, Digest: "sha256:" + img.Image}
+				onResult(r)
+				results = append(results, r)
+			}
+			return results
+		}
+	})
+	defer rpc.close()
+
+	rpc.send("prefetch", 1, map[string]interface{}{
+		"images":      []interface{}{"alpine", map[string]interface{}{"image": "python", "priority": 1}},
+		"concurrency": 3,
+	})
+
+	var progress []string
+	var final *rpcMsg
+	for final == nil {
+		msg := rpc.read()
+		if msg.ID != nil {
+			final = msg
+			break
+		}
+		require.Equal(t, "prefetch.progress", msg.Method)
+		var p struct {
+			ID    uint64 `json:"id"`
+			Image string `json:"image"`
+		}
+		require.NoError(t, json.Unmarshal(msg.Params, &p))
+		assert.Equal(t, uint64(1), p.ID)
+		progress = append(progress, p.Image)
+	}
+
+	require.Nil(t, final.Error)
+	assert.Equal(t, []string{"alpine", "python"}, progress)
+	assert.Equal(t, 3, gotConcurrency)
+	var result struct {
+		Images []image.PrefetchResult `json:"images"`
+	}
+	require.NoError(t, json.Unmarshal(final.Result, &result))
+	require.Len(t, result.Images, 2)
+	assert.Equal(t, "sha256:python", result.Images[1].Digest)
+}
+
+func TestHandlerPrefetchRejectsInvalidParams(t *testing.T) {
+	rpc := newTestRPCWithFactory(nil)
+	defer rpc.close()
+
+	rpc.send("prefetch", 1, map[string]interface{}{"images": []string{}})
+	msg := rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+
+	rpc.send("prefetch", 2, map[string]interface{}{"images": []string{"alpine"}, "concurrency": -1})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+}
+
+func TestHandlerCreateDoesNotWaitForPrefetch(t *testing.T) {
+	release := make(chan struct{})
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return &mockVM{id: "vm-test"}, nil
+	}, func(h *Handler) {
+		h.prefetch = func(ctx context.Context, images []image.PrefetchImage, concurrency int, onResult func(image.PrefetchResult)) []image.PrefetchResult {
+			<-release
+			return nil
+		}
+	})
+	defer rpc.close()
+
+	rpc.send("prefetch", 1, map[string]interface{}{"images": []string{"alpine"}})
+	rpc.send("create", 2, map[string]string{"image": "alpine:latest"})
+
+	msg := rpc.read()
+	require.NotNil(t, msg.ID)
+	assert.Equal(t, uint64(2), *msg.ID)
+	require.Nil(t, msg.Error)
+
+	close(release)
+	msg = rpc.read()
+	require.NotNil(t, msg.ID)
+	assert.Equal(t, uint64(1), *msg.ID)
+}
+
+func TestHandlerServesListedMethods(t *testing.T) {
+	h := NewHandler(nil, strings.NewReader(""), io.Discard)
+	id := uint64(1)
+	for _, method := range Methods {
+		// create needs a factory; cancel is dispatched before handleRequest.
+		if method == "create" || method == "cancel" {
+			continue
+		}
+		resp := h.handleRequest(context.Background(), &Request{JSONRPC: "2.0", Method: method, ID: &id})
+		if resp != nil && resp.Error != nil {
+			assert.NotEqual(t, ErrCodeMethodNotFound, resp.Error.Code, method)
+		}
+	}
+}
+
+// TestNotificationsListSentMethods keeps Notifications in step with the
+// methods the handler source sends: string literals passed to the
+// notification senders or set as a stream writer's method.
+func TestNotificationsListSentMethods(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "handler.go", nil, 0)
+	require.NoError(t, err)
+
+	senders := map[string]int{"sendNotification": 0, "sendStreamData": 1, "sendStreamHole": 1, "newChunkWriter": 1}
+	sent := map[string]bool{}
+	literal := func(e ast.Expr) {
+		if lit, ok := e.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			method, err := strconv.Unquote(lit.Value)
+			require.NoError(t, err)
+			sent[method] = true
+		}
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			if sel, ok := n.Fun.(*ast.SelectorExpr); ok {
+				if arg, ok := senders[sel.Sel.Name]; ok && arg < len(n.Args) {
+					literal(n.Args[arg])
+				}
+			}
+		case *ast.KeyValueExpr:
+			if key, ok := n.Key.(*ast.Ident); ok && key.Name == "method" {
+				literal(n.Value)
+			}
+		}
+		return true
+	})
+
+	var methods []string
+	for method := range sent {
+		methods = append(methods, method)
+	}
+	assert.ElementsMatch(t, methods, Notifications)
+}
+
+func TestHandlerCreateAppliesSizePreset(t *testing.T) {
+	t.Setenv("MATCHLOCK_PRESETS", filepath.Join(t.TempDir(), "presets.json"))
+
+	var got *api.Config
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		got = config
+		return &mockVM{id: "vm-test"}, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]interface{}{
+		"image":     "alpine:latest",
+		"resources": map[string]interface{}{"size": "medium", "cpus": 8},
+	})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	require.NotNil(t, got)
+	assert.Equal(t, "medium", got.Resources.Size)
+	assert.Equal(t, 8, got.Resources.CPUs)
+	assert.Equal(t, preset.Builtin["medium"].MemoryMB, got.Resources.MemoryMB)
+	assert.Equal(t, preset.Builtin["medium"].TimeoutSeconds, got.Resources.TimeoutSeconds)
+
+	rpc.send("create", 2, map[string]interface{}{
+		"image":     "alpine:latest",
+		"resources": map[string]interface{}{"size": "huge"},
+	})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error)
+	require.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+	require.Contains(t, msg.Error.Message, "unknown size")
+}
+
+func TestHandlerCreateAppliesSecretProfiles(t *testing.T) {
+	profiles := filepath.Join(t.TempDir(), "secret-profiles.yaml")
+	require.NoError(t, os.WriteFile(profiles, []byte(`
+profiles:
+  anthropic:
+    ANTHROPIC_API_KEY:
+      value: sk-profile
+      hosts: [api.anthropic.com]
+`), 0600))
+	t.Setenv("MATCHLOCK_SECRET_PROFILES", profiles)
+
+	var got *api.Config
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		got = config
+		return &mockVM{id: "vm-test"}, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]interface{}{
+		"image":   "alpine:latest",
+		"network": map[string]interface{}{"secret_profiles": []string{"anthropic"}},
+	})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	require.NotNil(t, got)
+	assert.Equal(t, "sk-profile", got.Network.Secrets["ANTHROPIC_API_KEY"].Value)
+
+	rpc.send("create", 2, map[string]interface{}{
+		"image":   "alpine:latest",
+		"network": map[string]interface{}{"secret_profiles": []string{"nope"}},
+	})
+	msg = rpc.read()
+	require.NotNil(t, msg.Error)
+	require.Equal(t, ErrCodeInvalidParams, msg.Error.Code)
+	require.Contains(t, msg.Error.Message, "unknown secret profile")
+}
+
+// transferMockVM copies trees in and out as the files it streams, so it
+// can be a transfer target.
+type transferMockVM struct {
+	fileStreamMockVM
+}
+
+func (m *transferMockVM) CopyIn(ctx context.Context, path string, r io.Reader) error {
+	_, err := m.WriteFileFrom(ctx, path, r, 0)
+	return err
+}
+
+func (m *transferMockVM) CopyOut(ctx context.Context, path string, w io.Writer) error {
+	_, err := m.ReadFileTo(ctx, path, w)
+	return err
+}
+
+func TestHandlerServesTransferSocket(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	require.NoError(t, os.MkdirAll(filepath.Join(home, ".matchlock", "vms", "vm-test"), 0700))
+	vm := &transferMockVM{fileStreamMockVM{mockVM: mockVM{id: "vm-test"}, files: map[string][]byte{}}}
+
+	rpc := newTestRPCWithFactory(func(ctx context.Context, config *api.Config) (VM, error) {
+		return vm, nil
+	})
+	defer rpc.close()
+
+	rpc.send("create", 1, map[string]string{"image": "alpine:latest"})
+	msg := rpc.read()
+	require.Nil(t, msg.Error)
+	var result struct {
+		TransferSocket string `json:"transfer_socket"`
+	}
+	require.NoError(t, json.Unmarshal(msg.Result, &result))
+	require.NotEmpty(t, result.TransferSocket)
+
+	data := []byte(strings.Repeat("bulk ", transfer.ChunkSize/2))
+	n, err := transfer.WriteFile(context.Background(), result.TransferSocket, "/workspace/big", strings.NewReader(string(data)), 0644)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, vm.files["/workspace/big"])
+
+	rpc.send("close", 2, nil)
+	rpc.read()
+	_, err = os.Stat(result.TransferSocket)
+	assert.True(t, os.IsNotExist(err), "the socket goes with the VM")
+}
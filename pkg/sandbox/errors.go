@@ -13,34 +13,76 @@ var (
 	ErrRelayListen     = errors.New("listen on relay socket")
 
 	// Rootfs errors
-	ErrGuestAgent   = errors.New("guest-agent not found")
-	ErrGuestFused   = errors.New("guest-fused not found")
-	ErrResizeRootfs = errors.New("resize rootfs")
-	ErrCreateTemp   = errors.New("create temp file")
-	ErrWriteTemp    = errors.New("write temp file")
-	ErrDebugfs      = errors.New("debugfs")
-	ErrStatRootfs   = errors.New("stat rootfs")
-	ErrTruncate     = errors.New("truncate rootfs")
-	ErrResize2fs    = errors.New("resize2fs")
+	ErrGuestAgent      = errors.New("guest-agent not found")
+	ErrGuestFused      = errors.New("guest-fused not found")
+	ErrResizeRootfs    = errors.New("resize rootfs")
+	ErrCreateUpperDisk = errors.New("create overlay upper disk")
+	ErrRootfsFormat    = errors.New("unsupported rootfs format")
+	ErrCreateTemp      = errors.New("create temp file")
+	ErrWriteTemp       = errors.New("write temp file")
+	ErrDebugfs         = errors.New("debugfs")
+	ErrStatRootfs      = errors.New("stat rootfs")
+	ErrTruncate        = errors.New("truncate rootfs")
+	ErrResize2fs       = errors.New("resize2fs")
+
+	// Asset trust errors
+	ErrTrustPolicy    = errors.New("load trust policy")
+	ErrUntrustedAsset = errors.New("untrusted guest asset")
 
 	// Sandbox lifecycle errors (shared between darwin and linux)
-	ErrRegisterState   = errors.New("register VM state")
-	ErrAllocateSubnet  = errors.New("allocate subnet")
-	ErrCreateCAPool    = errors.New("create CA pool")
-	ErrCopyRootfs      = errors.New("copy rootfs")
-	ErrPrepareRootfs   = errors.New("prepare rootfs")
-	ErrInjectCACert    = errors.New("inject CA cert into rootfs")
-	ErrInvalidDiskCfg  = errors.New("invalid extra disk config")
-	ErrCreateVM        = errors.New("create VM")
-	ErrCreateProxy     = errors.New("create transparent proxy")
-	ErrFirewallSetup   = errors.New("setup firewall rules")
-	ErrNetworkStack    = errors.New("create network stack")
-	ErrVFSListener     = errors.New("setup VFS listener")
-	ErrVFSServer       = errors.New("start VFS server")
-	ErrMachineClose    = errors.New("machine close")
-	ErrFirewallCleanup = errors.New("firewall cleanup")
-	ErrNATCleanup      = errors.New("NAT cleanup")
-	ErrNetworkFile     = errors.New("get network file")
+	ErrRegisterState        = errors.New("register VM state")
+	ErrExpandEnv            = errors.New("expand env templates")
+	ErrAllocateSubnet       = errors.New("allocate subnet")
+	ErrCreateCAPool         = errors.New("create CA pool")
+	ErrResolveUpstreamProxy = errors.New("resolve upstream proxy")
+	ErrCopyRootfs           = errors.New("copy rootfs")
+	ErrPrepareRootfs        = errors.New("prepare rootfs")
+	ErrInjectCACert         = errors.New("inject CA cert into rootfs")
+	ErrInvalidDiskCfg       = errors.New("invalid extra disk config")
+	ErrOverlayUpper         = errors.New("create overlay upper dir")
+	ErrWorkspaceFrom        = errors.New("seed workspace from snapshot")
+	ErrAddMount             = errors.New("add mount")
+	ErrRemoveMount          = errors.New("remove mount")
+	ErrGitClone             = errors.New("clone git mount")
+	ErrGitPush              = errors.New("push git mount")
+	ErrCacheMount           = errors.New("prepare cache mount")
+	ErrDataDisk             = errors.New("attach data disk")
+	ErrWatchPath            = errors.New("invalid watch path")
+	ErrSwapConfig           = errors.New("configure guest swap")
+	ErrCreateVM             = errors.New("create VM")
+	ErrCreateProxy          = errors.New("create transparent proxy")
+	ErrFirewallSetup        = errors.New("setup firewall rules")
+	ErrNetworkStack         = errors.New("create network stack")
+	ErrVFSListener          = errors.New("setup VFS listener")
+	ErrVFSServer            = errors.New("start VFS server")
+	ErrMachineClose         = errors.New("machine close")
+	ErrFirewallCleanup      = errors.New("firewall cleanup")
+	ErrNATCleanup           = errors.New("NAT cleanup")
+	ErrNetworkFile          = errors.New("get network file")
+
+	// Snapshot errors
+	ErrSnapshotTag       = errors.New("snapshot tag is required")
+	ErrSnapshotFreeze    = errors.New("freeze guest filesystem")
+	ErrSnapshotSave      = errors.New("save snapshot")
+	ErrSnapshotReadOnly  = errors.New("snapshots of read-only rootfs images are not supported")
+	ErrSnapshotWorkspace = errors.New("snapshot workspace")
+
+	// Restart errors
+	ErrRestartUnavailable = errors.New("sandbox cannot be restarted")
+	ErrRestart            = errors.New("restart sandbox")
+	ErrStartVM            = errors.New("start VM")
+
+	// Network freeze errors
+	ErrFreezeNetwork     = errors.New("freeze network")
+	ErrFreezeUnsupported = errors.New("network freeze requires a sandbox created with a network policy")
+
+	// Secret rotation errors
+	ErrUpdateSecret = errors.New("update secret")
+
+	// File sync errors
+	ErrPatchChecksum = errors.New("patched file checksum mismatch")
+	ErrCopyIn        = errors.New("copy into sandbox")
+	ErrCopyOut       = errors.New("copy out of sandbox")
 
 	// copyRootfs errors (linux only)
 	ErrOpenSource = errors.New("open source")
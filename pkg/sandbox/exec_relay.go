@@ -1,13 +1,16 @@
 package sandbox
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/jingkaihe/matchlock/internal/errx"
@@ -24,20 +27,52 @@ const (
 	relayMsgStdin           uint8 = 6
 	relayMsgExit            uint8 = 7
 	relayMsgExecPipe        uint8 = 8
+	relayMsgRestart         uint8 = 9
+	relayMsgWatch           uint8 = 10
+	relayMsgFreezeNetwork   uint8 = 11
+	relayMsgUpdateSecret    uint8 = 12
+	relayMsgCopyIn          uint8 = 13
+	relayMsgCopyOut         uint8 = 14
+	relayMsgAddMount        uint8 = 15
+	relayMsgRemoveMount     uint8 = 16
 )
 
+// relayCopyChunk is the size of the tar stream chunks CopyInViaRelay and
+// the relay's copy out send.
+const relayCopyChunk = 256 * 1024
+
 type relayExecRequest struct {
-	Command    string `json:"command"`
-	WorkingDir string `json:"working_dir,omitempty"`
-	User       string `json:"user,omitempty"`
+	Command          string `json:"command"`
+	WorkingDir       string `json:"working_dir,omitempty"`
+	CreateWorkingDir bool   `json:"create_working_dir,omitempty"`
+	User             string `json:"user,omitempty"`
 }
 
 type relayExecInteractiveRequest struct {
-	Command    string `json:"command"`
-	WorkingDir string `json:"working_dir,omitempty"`
-	User       string `json:"user,omitempty"`
-	Rows       uint16 `json:"rows"`
-	Cols       uint16 `json:"cols"`
+	Command          string `json:"command"`
+	WorkingDir       string `json:"working_dir,omitempty"`
+	CreateWorkingDir bool   `json:"create_working_dir,omitempty"`
+	User             string `json:"user,omitempty"`
+	Rows             uint16 `json:"rows"`
+	Cols             uint16 `json:"cols"`
+}
+
+type relayRestartRequest struct {
+	FreshDisk bool `json:"fresh_disk,omitempty"`
+}
+
+type relayUpdateSecretRequest struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type relayCopyRequest struct {
+	Path string `json:"path"`
+}
+
+type relayMountRequest struct {
+	GuestPath string           `json:"guest_path"`
+	Mount     *api.MountConfig `json:"mount,omitempty"`
 }
 
 type relayExecResult struct {
@@ -45,6 +80,8 @@ type relayExecResult struct {
 	Stdout   []byte `json:"stdout,omitempty"`
 	Stderr   []byte `json:"stderr,omitempty"`
 	Error    string `json:"error,omitempty"`
+	// WorkingDirError is set when Error is an api.ErrWorkingDir failure.
+	WorkingDirError bool `json:"working_dir_error,omitempty"`
 }
 
 // ExecRelay serves exec requests from external processes via a Unix socket.
@@ -111,6 +148,20 @@ func (r *ExecRelay) handleConn(conn net.Conn) {
 		r.handleExecInteractive(conn, data)
 	case relayMsgExecPipe:
 		r.handleExecPipe(conn, data)
+	case relayMsgRestart:
+		r.handleRestart(conn, data)
+	case relayMsgWatch:
+		r.handleWatch(conn)
+	case relayMsgFreezeNetwork:
+		r.handleFreezeNetwork(conn)
+	case relayMsgUpdateSecret:
+		r.handleUpdateSecret(conn, data)
+	case relayMsgCopyIn:
+		r.handleCopyIn(conn, data)
+	case relayMsgCopyOut:
+		r.handleCopyOut(conn, data)
+	case relayMsgAddMount, relayMsgRemoveMount:
+		r.handleMount(conn, msgType, data)
 	}
 }
 
@@ -125,6 +176,7 @@ func (r *ExecRelay) handleExec(conn net.Conn, data []byte) {
 	if req.WorkingDir != "" {
 		opts.WorkingDir = req.WorkingDir
 	}
+	opts.CreateWorkingDir = req.CreateWorkingDir
 	if req.User != "" {
 		opts.User = req.User
 	}
@@ -141,7 +193,11 @@ func (r *ExecRelay) handleExec(conn net.Conn, data []byte) {
 
 	result, err := r.sb.Exec(ctx, req.Command, opts)
 	if err != nil {
-		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		sendRelayResult(conn, &relayExecResult{
+			ExitCode:        1,
+			Error:           err.Error(),
+			WorkingDirError: errors.Is(err, api.ErrWorkingDir),
+		})
 		return
 	}
 
@@ -169,6 +225,7 @@ func (r *ExecRelay) handleExecInteractive(conn net.Conn, data []byte) {
 	if req.WorkingDir != "" {
 		opts.WorkingDir = req.WorkingDir
 	}
+	opts.CreateWorkingDir = req.CreateWorkingDir
 	if req.User != "" {
 		opts.User = req.User
 	}
@@ -195,9 +252,10 @@ func (r *ExecRelay) handleExecInteractive(conn net.Conn, data []byte) {
 	exitCode, err := interactiveMachine.ExecInteractive(
 		context.Background(), req.Command, opts,
 		req.Rows, req.Cols,
-		stdinReader, stdoutWriter, resizeCh,
+		stdinReader, r.sb.Mirror().Tee(stdoutWriter, StreamStdout), resizeCh,
 	)
 	if err != nil {
+		fmt.Fprintf(stdoutWriter, "matchlock: %v\r\n", err)
 		exitCode = 1
 	}
 
@@ -219,6 +277,7 @@ func (r *ExecRelay) handleExecPipe(conn net.Conn, data []byte) {
 	if req.WorkingDir != "" {
 		opts.WorkingDir = req.WorkingDir
 	}
+	opts.CreateWorkingDir = req.CreateWorkingDir
 	if req.User != "" {
 		opts.User = req.User
 	}
@@ -254,6 +313,7 @@ func (r *ExecRelay) handleExecPipe(conn net.Conn, data []byte) {
 
 	exitCode := 0
 	if err != nil {
+		fmt.Fprintf(opts.Stderr, "matchlock: %v\n", err)
 		exitCode = 1
 	} else {
 		exitCode = result.ExitCode
@@ -264,6 +324,154 @@ func (r *ExecRelay) handleExecPipe(conn net.Conn, data []byte) {
 	sendRelayMsg(conn, relayMsgExit, exitData)
 }
 
+func (r *ExecRelay) handleRestart(conn net.Conn, data []byte) {
+	var req relayRestartRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		return
+	}
+
+	if err := r.sb.Restart(context.Background(), &RestartOptions{FreshDisk: req.FreshDisk}); err != nil {
+		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		return
+	}
+	sendRelayResult(conn, &relayExecResult{})
+}
+
+func (r *ExecRelay) handleFreezeNetwork(conn net.Conn) {
+	if err := r.sb.FreezeNetwork(); err != nil {
+		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		return
+	}
+	sendRelayResult(conn, &relayExecResult{})
+}
+
+func (r *ExecRelay) handleMount(conn net.Conn, msgType uint8, data []byte) {
+	var req relayMountRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		return
+	}
+
+	var err error
+	if msgType == relayMsgAddMount {
+		if req.Mount == nil {
+			err = errx.With(ErrAddMount, ": mount config is required")
+		} else {
+			err = r.sb.AddMount(req.GuestPath, *req.Mount)
+		}
+	} else {
+		err = r.sb.RemoveMount(req.GuestPath)
+	}
+	if err != nil {
+		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		return
+	}
+	sendRelayResult(conn, &relayExecResult{})
+}
+
+func (r *ExecRelay) handleUpdateSecret(conn net.Conn, data []byte) {
+	var req relayUpdateSecretRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		return
+	}
+
+	if err := r.sb.UpdateSecret(req.Name, req.Value); err != nil {
+		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		return
+	}
+	sendRelayResult(conn, &relayExecResult{})
+}
+
+// handleCopyIn extracts the tar stream the client sends as stdin messages,
+// ended by an empty one, into the sandbox.
+func (r *ExecRelay) handleCopyIn(conn net.Conn, data []byte) {
+	var req relayCopyRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stdinReader, stdinWriter := io.Pipe()
+	go func() {
+		for {
+			msgType, msgData, err := readRelayMsg(conn)
+			if err != nil {
+				cancel()
+				stdinWriter.CloseWithError(err)
+				return
+			}
+			if msgType != relayMsgStdin {
+				continue
+			}
+			if len(msgData) == 0 {
+				stdinWriter.Close()
+				return
+			}
+			// Once the extraction has failed the rest of the stream is
+			// drained, so the client is not blocked before it reads the
+			// result.
+			stdinWriter.Write(msgData)
+		}
+	}()
+
+	err := r.sb.CopyIn(ctx, req.Path, stdinReader)
+	stdinReader.Close()
+	if err != nil {
+		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		return
+	}
+	sendRelayResult(conn, &relayExecResult{})
+}
+
+// handleCopyOut sends a tar stream of a sandbox path as stdout messages,
+// followed by the result.
+func (r *ExecRelay) handleCopyOut(conn net.Conn, data []byte) {
+	var req relayCopyRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		return
+	}
+
+	w := bufio.NewWriterSize(&relayWriter{conn: conn, msgType: relayMsgStdout}, relayCopyChunk)
+	err := r.sb.CopyOut(context.Background(), req.Path, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		sendRelayResult(conn, &relayExecResult{ExitCode: 1, Error: err.Error()})
+		return
+	}
+	sendRelayResult(conn, &relayExecResult{})
+}
+
+// handleWatch streams the sandbox's command output to a read-only watcher
+// until either side goes away. Nothing is read from the watcher but EOF.
+func (r *ExecRelay) handleWatch(conn net.Conn) {
+	output, cancel := r.sb.Mirror().Watch()
+	defer cancel()
+
+	go func() {
+		buf := make([]byte, 1)
+		conn.Read(buf) // blocks until EOF
+		cancel()
+	}()
+
+	for out := range output {
+		msgType := relayMsgStdout
+		if out.Stream == StreamStderr {
+			msgType = relayMsgStderr
+		}
+		if err := sendRelayMsg(conn, msgType, out.Data); err != nil {
+			return
+		}
+	}
+}
+
 // relayWriter forwards writes to the relay connection as messages.
 type relayWriter struct {
 	conn    net.Conn
@@ -320,7 +528,7 @@ func sendRelayResult(conn net.Conn, result *relayExecResult) {
 
 // ExecViaRelay connects to an exec relay socket and runs a command.
 // The context controls the lifetime — if cancelled, the connection is closed.
-func ExecViaRelay(ctx context.Context, socketPath, command, workingDir, user string) (*api.ExecResult, error) {
+func ExecViaRelay(ctx context.Context, socketPath, command, workingDir string, createWorkingDir bool, user string) (*api.ExecResult, error) {
 	conn, err := net.Dial("unix", socketPath)
 	if err != nil {
 		return nil, errx.Wrap(ErrRelayConnect, err)
@@ -338,7 +546,7 @@ func ExecViaRelay(ctx context.Context, socketPath, command, workingDir, user str
 		}
 	}()
 
-	req := relayExecRequest{Command: command, WorkingDir: workingDir, User: user}
+	req := relayExecRequest{Command: command, WorkingDir: workingDir, CreateWorkingDir: createWorkingDir, User: user}
 	reqData, _ := json.Marshal(req)
 	if err := sendRelayMsg(conn, relayMsgExec, reqData); err != nil {
 		if ctx.Err() != nil {
@@ -365,11 +573,15 @@ func ExecViaRelay(ctx context.Context, socketPath, command, workingDir, user str
 	}
 
 	if result.Error != "" {
+		err := fmt.Errorf("%s", result.Error)
+		if result.WorkingDirError {
+			err = errx.With(api.ErrWorkingDir, "%s", strings.TrimPrefix(result.Error, api.ErrWorkingDir.Error()))
+		}
 		return &api.ExecResult{
 			ExitCode: result.ExitCode,
 			Stdout:   result.Stdout,
 			Stderr:   result.Stderr,
-		}, fmt.Errorf("%s", result.Error)
+		}, err
 	}
 
 	return &api.ExecResult{
@@ -380,7 +592,7 @@ func ExecViaRelay(ctx context.Context, socketPath, command, workingDir, user str
 }
 
 // ExecInteractiveViaRelay connects to an exec relay socket and runs an interactive command.
-func ExecInteractiveViaRelay(ctx context.Context, socketPath, command, workingDir, user string, rows, cols uint16, stdin io.Reader, stdout io.Writer) (int, error) {
+func ExecInteractiveViaRelay(ctx context.Context, socketPath, command, workingDir string, createWorkingDir bool, user string, rows, cols uint16, stdin io.Reader, stdout io.Writer) (int, error) {
 	conn, err := net.Dial("unix", socketPath)
 	if err != nil {
 		return 1, errx.Wrap(ErrRelayConnect, err)
@@ -388,11 +600,12 @@ func ExecInteractiveViaRelay(ctx context.Context, socketPath, command, workingDi
 	defer conn.Close()
 
 	req := relayExecInteractiveRequest{
-		Command:    command,
-		WorkingDir: workingDir,
-		User:       user,
-		Rows:       rows,
-		Cols:       cols,
+		Command:          command,
+		WorkingDir:       workingDir,
+		CreateWorkingDir: createWorkingDir,
+		User:             user,
+		Rows:             rows,
+		Cols:             cols,
 	}
 	reqData, _ := json.Marshal(req)
 	if err := sendRelayMsg(conn, relayMsgExecInteractive, reqData); err != nil {
@@ -450,14 +663,14 @@ func ExecInteractiveViaRelay(ctx context.Context, socketPath, command, workingDi
 
 // ExecPipeViaRelay connects to an exec relay socket and runs a command with
 // bidirectional stdin/stdout/stderr piping (no PTY).
-func ExecPipeViaRelay(ctx context.Context, socketPath, command, workingDir, user string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+func ExecPipeViaRelay(ctx context.Context, socketPath, command, workingDir string, createWorkingDir bool, user string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
 	conn, err := net.Dial("unix", socketPath)
 	if err != nil {
 		return 1, errx.Wrap(ErrRelayConnect, err)
 	}
 	defer conn.Close()
 
-	req := relayExecRequest{Command: command, WorkingDir: workingDir, User: user}
+	req := relayExecRequest{Command: command, WorkingDir: workingDir, CreateWorkingDir: createWorkingDir, User: user}
 	reqData, _ := json.Marshal(req)
 	if err := sendRelayMsg(conn, relayMsgExecPipe, reqData); err != nil {
 		return 1, errx.Wrap(ErrRelaySend, err)
@@ -516,3 +729,249 @@ func ExecPipeViaRelay(ctx context.Context, socketPath, command, workingDir, user
 		return 1, ctx.Err()
 	}
 }
+
+// RestartViaRelay asks the process owning a sandbox to restart it through its
+// exec relay socket, and waits until the guest is back up.
+func RestartViaRelay(ctx context.Context, socketPath string, opts *RestartOptions) error {
+	if opts == nil {
+		opts = &RestartOptions{}
+	}
+	reqData, _ := json.Marshal(relayRestartRequest{FreshDisk: opts.FreshDisk})
+	return relayRequest(ctx, socketPath, relayMsgRestart, reqData, ErrRestart)
+}
+
+// FreezeNetworkViaRelay asks the process owning a sandbox to cut off all of
+// its network egress through its exec relay socket.
+func FreezeNetworkViaRelay(ctx context.Context, socketPath string) error {
+	return relayRequest(ctx, socketPath, relayMsgFreezeNetwork, nil, ErrFreezeNetwork)
+}
+
+// UpdateSecretViaRelay asks the process owning a sandbox to rotate the real
+// value of one of its secrets through its exec relay socket.
+func UpdateSecretViaRelay(ctx context.Context, socketPath, name, value string) error {
+	reqData, _ := json.Marshal(relayUpdateSecretRequest{Name: name, Value: value})
+	return relayRequest(ctx, socketPath, relayMsgUpdateSecret, reqData, ErrUpdateSecret)
+}
+
+// AddMountViaRelay asks the process owning a sandbox to mount a volume at
+// guestPath while it runs, through its exec relay socket.
+func AddMountViaRelay(ctx context.Context, socketPath, guestPath string, mount api.MountConfig) error {
+	reqData, _ := json.Marshal(relayMountRequest{GuestPath: guestPath, Mount: &mount})
+	return relayRequest(ctx, socketPath, relayMsgAddMount, reqData, ErrAddMount)
+}
+
+// RemoveMountViaRelay asks the process owning a sandbox to unmount the
+// volume at guestPath through its exec relay socket.
+func RemoveMountViaRelay(ctx context.Context, socketPath, guestPath string) error {
+	reqData, _ := json.Marshal(relayMountRequest{GuestPath: guestPath})
+	return relayRequest(ctx, socketPath, relayMsgRemoveMount, reqData, ErrRemoveMount)
+}
+
+// relayRequest sends a control message to an exec relay and waits for its
+// result. A failure reported by the relay is wrapped in failErr.
+func relayRequest(ctx context.Context, socketPath string, msgType uint8, reqData []byte, failErr error) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return errx.Wrap(ErrRelayConnect, err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := sendRelayMsg(conn, msgType, reqData); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errx.Wrap(ErrRelaySend, err)
+	}
+
+	respType, data, err := readRelayMsg(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errx.Wrap(ErrRelayRead, err)
+	}
+	if respType != relayMsgExecResult {
+		return errx.With(ErrRelayUnexpected, ": %d", respType)
+	}
+
+	var result relayExecResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return errx.Wrap(ErrRelayDecode, err)
+	}
+	if result.Error != "" {
+		return errx.With(failErr, ": %s", result.Error)
+	}
+	return nil
+}
+
+// WatchViaRelay attaches a read-only watcher to the sandbox behind an exec
+// relay socket and copies its command output to stdout and stderr. It
+// returns when the sandbox is closed or ctx is cancelled.
+func WatchViaRelay(ctx context.Context, socketPath string, stdout, stderr io.Writer) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return errx.Wrap(ErrRelayConnect, err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := sendRelayMsg(conn, relayMsgWatch, nil); err != nil {
+		return errx.Wrap(ErrRelaySend, err)
+	}
+
+	for {
+		msgType, data, err := readRelayMsg(conn)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return errx.Wrap(ErrRelayRead, err)
+		}
+		switch msgType {
+		case relayMsgStdout:
+			stdout.Write(data)
+		case relayMsgStderr:
+			stderr.Write(data)
+		}
+	}
+}
+
+// CopyInViaRelay sends the tar stream r through an exec relay socket to be
+// extracted into the directory path of the sandbox.
+func CopyInViaRelay(ctx context.Context, socketPath, path string, r io.Reader) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return errx.Wrap(ErrRelayConnect, err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reqData, _ := json.Marshal(relayCopyRequest{Path: path})
+	if err := sendRelayMsg(conn, relayMsgCopyIn, reqData); err != nil {
+		return errx.Wrap(ErrRelaySend, err)
+	}
+
+	if err := sendRelayStream(conn, r); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// A failure to read r aborts the copy when the connection closes.
+		if !errors.Is(err, ErrRelaySend) {
+			return err
+		}
+		// The relay stops reading once the copy is done or has failed,
+		// leaving its result to be read.
+	}
+	return readRelayCopyResult(ctx, conn, nil, ErrCopyIn)
+}
+
+// sendRelayStream sends r as stdin messages, ended by an empty one.
+func sendRelayStream(conn net.Conn, r io.Reader) error {
+	buf := make([]byte, relayCopyChunk)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if err := sendRelayMsg(conn, relayMsgStdin, buf[:n]); err != nil {
+				return errx.Wrap(ErrRelaySend, err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return errx.Wrap(ErrCopyIn, readErr)
+		}
+	}
+	if err := sendRelayMsg(conn, relayMsgStdin, nil); err != nil {
+		return errx.Wrap(ErrRelaySend, err)
+	}
+	return nil
+}
+
+// CopyOutViaRelay writes a tar stream of path in the sandbox behind an exec
+// relay socket to w.
+func CopyOutViaRelay(ctx context.Context, socketPath, path string, w io.Writer) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return errx.Wrap(ErrRelayConnect, err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reqData, _ := json.Marshal(relayCopyRequest{Path: path})
+	if err := sendRelayMsg(conn, relayMsgCopyOut, reqData); err != nil {
+		return errx.Wrap(ErrRelaySend, err)
+	}
+	return readRelayCopyResult(ctx, conn, w, ErrCopyOut)
+}
+
+// readRelayCopyResult copies stdout messages to w until the relay sends the
+// result of a copy. A failure reported by the relay is wrapped in failErr.
+func readRelayCopyResult(ctx context.Context, conn net.Conn, w io.Writer, failErr error) error {
+	for {
+		msgType, data, err := readRelayMsg(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errx.Wrap(ErrRelayRead, err)
+		}
+		switch msgType {
+		case relayMsgStdout:
+			if w == nil {
+				continue
+			}
+			if _, err := w.Write(data); err != nil {
+				return errx.Wrap(failErr, err)
+			}
+		case relayMsgExecResult:
+			var result relayExecResult
+			if err := json.Unmarshal(data, &result); err != nil {
+				return errx.Wrap(ErrRelayDecode, err)
+			}
+			if result.Error != "" {
+				return errx.With(failErr, ": %s", result.Error)
+			}
+			return nil
+		default:
+			return errx.With(ErrRelayUnexpected, ": %d", msgType)
+		}
+	}
+}
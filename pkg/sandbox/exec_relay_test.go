@@ -1,14 +1,23 @@
 package sandbox
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/policy"
+	"github.com/jingkaihe/matchlock/pkg/state"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
 	"github.com/jingkaihe/matchlock/pkg/vm"
 	"github.com/stretchr/testify/require"
 )
@@ -218,3 +227,177 @@ func TestExecRelayInteractiveDisconnectClosesStdin(t *testing.T) {
 		require.Fail(t, "timed out waiting for relay")
 	}
 }
+
+func TestRestartViaRelayReportsFailure(t *testing.T) {
+	sb := &Sandbox{config: &api.Config{}, machine: newFakeMachine()}
+	relay := NewExecRelay(sb)
+	socketPath := filepath.Join(t.TempDir(), "exec.sock")
+	require.NoError(t, relay.Start(socketPath))
+	defer relay.Stop()
+
+	err := RestartViaRelay(context.Background(), socketPath, &RestartOptions{FreshDisk: true})
+	require.ErrorIs(t, err, ErrRestart)
+	require.Contains(t, err.Error(), ErrRestartUnavailable.Error())
+}
+
+func TestWatchViaRelayStreamsMirror(t *testing.T) {
+	sb := &Sandbox{config: &api.Config{}, machine: newFakeInteractiveMachine(), mirror: NewMirror()}
+	relay := NewExecRelay(sb)
+	socketPath := filepath.Join(t.TempDir(), "exec.sock")
+	require.NoError(t, relay.Start(socketPath))
+	defer relay.Stop()
+
+	stdout, stderr := &syncBuffer{}, &syncBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- WatchViaRelay(context.Background(), socketPath, stdout, stderr)
+	}()
+
+	require.Eventually(t, func() bool {
+		sb.mirror.mu.Lock()
+		defer sb.mirror.mu.Unlock()
+		return len(sb.mirror.watchers) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	sb.mirror.Writer(StreamStdout).Write([]byte("hello"))
+	sb.mirror.Writer(StreamStderr).Write([]byte("oops"))
+	require.Eventually(t, func() bool {
+		return stdout.String() == "hello" && stderr.String() == "oops"
+	}, time.Second, 10*time.Millisecond)
+
+	sb.mirror.Close()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for watch to end")
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestFreezeNetworkViaRelayReportsFailure(t *testing.T) {
+	sb := &Sandbox{config: &api.Config{}, machine: newFakeMachine()}
+	relay := NewExecRelay(sb)
+	socketPath := filepath.Join(t.TempDir(), "exec.sock")
+	require.NoError(t, relay.Start(socketPath))
+	defer relay.Stop()
+
+	err := FreezeNetworkViaRelay(context.Background(), socketPath)
+	require.ErrorIs(t, err, ErrFreezeNetwork)
+	require.Contains(t, err.Error(), ErrFreezeUnsupported.Error())
+}
+
+func TestUpdateSecretViaRelay(t *testing.T) {
+	pol := policy.NewEngine(&api.NetworkConfig{
+		Secrets: map[string]api.Secret{"API_KEY": {Value: "sk-old", Hosts: []string{"api.example.com"}}},
+	})
+	sb := &Sandbox{config: &api.Config{}, machine: newFakeMachine(), policy: pol}
+	relay := NewExecRelay(sb)
+	socketPath := filepath.Join(t.TempDir(), "exec.sock")
+	require.NoError(t, relay.Start(socketPath))
+	defer relay.Stop()
+
+	require.NoError(t, UpdateSecretViaRelay(context.Background(), socketPath, "API_KEY", "sk-new"))
+
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: http.Header{"X-Api-Key": {pol.GetPlaceholder("API_KEY")}}}
+	_, err := pol.OnRequest(req, "api.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "sk-new", req.Header.Get("X-Api-Key"))
+
+	err = UpdateSecretViaRelay(context.Background(), socketPath, "MISSING", "value")
+	require.ErrorIs(t, err, ErrUpdateSecret)
+	require.Contains(t, err.Error(), api.ErrUnknownSecret.Error())
+}
+
+func TestCopyViaRelay(t *testing.T) {
+	workspace := vfs.NewMemoryProvider()
+	sb := &Sandbox{
+		config:  &api.Config{},
+		machine: newFakeMachine(),
+		vfsRoot: vfs.NewMountRouter(map[string]vfs.Provider{"/workspace": workspace}),
+	}
+	relay := NewExecRelay(sb)
+	socketPath := filepath.Join(t.TempDir(), "exec.sock")
+	require.NoError(t, relay.Start(socketPath))
+	defer relay.Stop()
+
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "data"), 0755))
+	big := bytes.Repeat([]byte("x"), 3*relayCopyChunk+17)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "data/big.bin"), big, 0644))
+
+	var in bytes.Buffer
+	require.NoError(t, vfs.WriteTar(vfs.NewRealFSProvider(src), "/", &in))
+	require.NoError(t, CopyInViaRelay(context.Background(), socketPath, "/workspace/in", &in))
+	got, err := workspace.ReadFile("/in/data/big.bin")
+	require.NoError(t, err)
+	require.Equal(t, big, got)
+
+	var out bytes.Buffer
+	require.NoError(t, CopyOutViaRelay(context.Background(), socketPath, "/workspace/in", &out))
+	dest := t.TempDir()
+	require.NoError(t, vfs.ExtractTar(vfs.NewRealFSProvider(dest), "/", &out))
+	got, err = os.ReadFile(filepath.Join(dest, "data/big.bin"))
+	require.NoError(t, err)
+	require.Equal(t, big, got)
+
+	err = CopyOutViaRelay(context.Background(), socketPath, "/workspace/missing", io.Discard)
+	require.ErrorIs(t, err, ErrCopyOut)
+
+	in.Reset()
+	require.NoError(t, vfs.WriteTar(vfs.NewRealFSProvider(src), "/", &in))
+	err = CopyInViaRelay(context.Background(), socketPath, "/elsewhere", &in)
+	require.ErrorIs(t, err, ErrCopyIn, "only VFS mounts can be written")
+}
+
+func TestMountViaRelay(t *testing.T) {
+	stateMgr := state.NewManagerWithDir(t.TempDir())
+	sb := &Sandbox{
+		id:       "vm-mount",
+		config:   &api.Config{},
+		machine:  newFakeMachine(),
+		stateMgr: stateMgr,
+		vfsRoot:  vfs.NewMountRouter(map[string]vfs.Provider{"/workspace": vfs.NewMemoryProvider()}),
+	}
+	relay := NewExecRelay(sb)
+	socketPath := filepath.Join(t.TempDir(), "exec.sock")
+	require.NoError(t, relay.Start(socketPath))
+	defer relay.Stop()
+
+	hostDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, "input.csv"), []byte("a,b"), 0644))
+	mount := api.MountConfig{Type: "real_fs", HostPath: hostDir, Readonly: true}
+	require.NoError(t, AddMountViaRelay(context.Background(), socketPath, "/workspace/data", mount))
+
+	got, err := readFile(sb.vfsRoot, "/workspace/data/input.csv")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a,b"), got)
+	require.Equal(t, mount, sb.config.VFS.Mounts["/workspace/data"])
+
+	err = AddMountViaRelay(context.Background(), socketPath, "/workspace/data", mount)
+	require.ErrorIs(t, err, ErrAddMount)
+
+	require.NoError(t, RemoveMountViaRelay(context.Background(), socketPath, "/workspace/data"))
+	_, err = readFile(sb.vfsRoot, "/workspace/data/input.csv")
+	require.Error(t, err)
+	require.NotContains(t, sb.config.VFS.Mounts, "/workspace/data")
+
+	err = RemoveMountViaRelay(context.Background(), socketPath, "/workspace/data")
+	require.ErrorIs(t, err, ErrRemoveMount)
+}
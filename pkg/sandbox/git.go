@@ -0,0 +1,156 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/state"
+)
+
+// Git mounts are cloned twice on the host: a bare mirror that only the host
+// touches, and a checkout of it that the guest sees. The guest can rewrite
+// anything in the checkout's .git, including hooks and config that git would
+// execute, so the host never runs git there beyond fetching from it; pushes
+// go out from the mirror.
+const (
+	gitMirrorDir   = "mirror.git"
+	gitCheckoutDir = "checkout"
+	gitBaseFile    = "base" // commit the checkout started from, in the mirror
+)
+
+// prepareGitMounts clones the repository of each git mount and points the
+// mount at the checkout.
+func prepareGitMounts(ctx context.Context, config *api.Config, stateMgr *state.Manager, id string) error {
+	if config.VFS == nil {
+		return nil
+	}
+	for path, mount := range config.VFS.Mounts {
+		if mount.Type != "git" || mount.Git == nil {
+			continue
+		}
+		dir := stateMgr.GitDir(id, path)
+		if err := cloneGitMount(ctx, *mount.Git, dir); err != nil {
+			return errx.With(ErrGitClone, " %s for %s: %w", mount.Git.URL, path, err)
+		}
+		mount.HostPath = filepath.Join(dir, gitCheckoutDir)
+		config.VFS.Mounts[path] = mount
+	}
+	return nil
+}
+
+func cloneGitMount(ctx context.Context, repo api.GitMount, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	mirror := filepath.Join(dir, gitMirrorDir)
+	checkout := filepath.Join(dir, gitCheckoutDir)
+
+	args := []string{"clone", "--bare"}
+	if repo.Depth > 0 {
+		args = append(args, "--depth", fmt.Sprint(repo.Depth))
+	}
+	if repo.Ref != "" {
+		args = append(args, "--branch", repo.Ref)
+	}
+	if _, err := runGit(ctx, "", append(args, "--", repo.URL, mirror)...); err != nil {
+		return err
+	}
+	base, err := runGit(ctx, mirror, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(mirror, gitBaseFile), []byte(base+"\n"), 0600); err != nil {
+		return err
+	}
+	// --no-hardlinks keeps the guest from altering the mirror's objects
+	// through shared inodes.
+	if _, err := runGit(ctx, "", "clone", "--no-hardlinks", "--", mirror, checkout); err != nil {
+		return err
+	}
+	// The mirror's path means nothing inside the guest.
+	if _, err := runGit(ctx, checkout, "remote", "remove", "origin"); err != nil {
+		return err
+	}
+	if repo.PushBranch == "" {
+		return nil
+	}
+	_, err = runGit(ctx, checkout, "checkout", "-q", "-B", repo.PushBranch)
+	return err
+}
+
+// pushGitMounts pushes the commits the guest made in each git mount with a
+// PushBranch. Mounts the guest made no commits in are left alone.
+func pushGitMounts(ctx context.Context, config *api.Config, stateMgr *state.Manager, id string) []error {
+	if config.VFS == nil {
+		return nil
+	}
+	var errs []error
+	for path, mount := range config.VFS.Mounts {
+		if mount.Type != "git" || mount.Git == nil || mount.Git.PushBranch == "" {
+			continue
+		}
+		pushed, err := pushGitMount(ctx, *mount.Git, stateMgr.GitDir(id, path))
+		if err != nil {
+			errs = append(errs, errx.With(ErrGitPush, " %s to %s: %w", path, mount.Git.PushBranch, err))
+			continue
+		}
+		if pushed != "" {
+			fmt.Fprintf(os.Stderr, "Pushed %s to %s %s (%s)\n", path, mount.Git.URL, mount.Git.PushBranch, pushed)
+		}
+	}
+	return errs
+}
+
+// pushGitMount fetches the checkout's HEAD into the mirror and pushes it to
+// the scratch branch, returning the pushed commit, or "" if HEAD has not moved.
+func pushGitMount(ctx context.Context, repo api.GitMount, dir string) (string, error) {
+	mirror := filepath.Join(dir, gitMirrorDir)
+	checkout := filepath.Join(dir, gitCheckoutDir)
+	ref := "refs/heads/" + repo.PushBranch
+
+	baseBytes, err := os.ReadFile(filepath.Join(mirror, gitBaseFile))
+	if err != nil {
+		return "", err
+	}
+	// Only upload-pack runs in the checkout, and only from git's own
+	// binary, not one the guest's config names.
+	if _, err := runGit(ctx, mirror, "fetch", "--no-tags", "--upload-pack=git-upload-pack", "--", checkout, "+HEAD:"+ref); err != nil {
+		return "", err
+	}
+	head, err := runGit(ctx, mirror, "rev-parse", ref)
+	if err != nil {
+		return "", err
+	}
+	if head == strings.TrimSpace(string(baseBytes)) {
+		return "", nil
+	}
+	if _, err := runGit(ctx, mirror, "push", "--force", "--", repo.URL, ref+":"+ref); err != nil {
+		return "", err
+	}
+	return head, nil
+}
+
+// runGit runs git in dir, never prompting for credentials, and returns its
+// trimmed stdout.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errx.With(err, ": %s", msg)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
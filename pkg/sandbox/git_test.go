@@ -0,0 +1,76 @@
+package sandbox
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/state"
+)
+
+func gitTestRepo(t *testing.T) string {
+	t.Helper()
+	ctx := context.Background()
+	origin := filepath.Join(t.TempDir(), "origin.git")
+	work := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "--bare", "-b", "main", origin},
+		{"-C", work, "init", "-q", "-b", "main"},
+		{"-C", work, "-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "--allow-empty", "-m", "init"},
+		{"-C", work, "push", "-q", origin, "main"},
+	} {
+		_, err := runGit(ctx, "", args...)
+		require.NoError(t, err, "git %v", args)
+	}
+	return origin
+}
+
+func TestGitMountCloneAndPush(t *testing.T) {
+	ctx := context.Background()
+	origin := gitTestRepo(t)
+	stateMgr := state.NewManagerWithDir(t.TempDir())
+	config := &api.Config{VFS: &api.VFSConfig{Mounts: map[string]api.MountConfig{
+		"/workspace/repo": {Type: "git", Git: &api.GitMount{URL: origin, PushBranch: "agent/scratch"}},
+	}}}
+
+	require.NoError(t, prepareGitMounts(ctx, config, stateMgr, "vm-git"))
+	checkout := config.VFS.Mounts["/workspace/repo"].HostPath
+	require.DirExists(t, filepath.Join(checkout, ".git"))
+
+	// Nothing committed yet: nothing is pushed.
+	require.Empty(t, pushGitMounts(ctx, config, stateMgr, "vm-git"))
+	_, err := runGit(ctx, origin, "rev-parse", "--verify", "refs/heads/agent/scratch")
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(checkout, "fix.txt"), []byte("fixed\n"), 0644))
+	for _, args := range [][]string{
+		{"add", "fix.txt"},
+		{"-c", "user.name=agent", "-c", "user.email=agent@example.com", "commit", "-q", "-m", "fix"},
+	} {
+		_, err := runGit(ctx, checkout, args...)
+		require.NoError(t, err)
+	}
+	want, err := runGit(ctx, checkout, "rev-parse", "HEAD")
+	require.NoError(t, err)
+
+	require.Empty(t, pushGitMounts(ctx, config, stateMgr, "vm-git"))
+	got, err := runGit(ctx, origin, "rev-parse", "refs/heads/agent/scratch")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	main, err := runGit(ctx, origin, "rev-parse", "refs/heads/main")
+	require.NoError(t, err)
+	assert.NotEqual(t, want, main, "the cloned branch is untouched")
+}
+
+func TestGitMountCloneFailure(t *testing.T) {
+	config := &api.Config{VFS: &api.VFSConfig{Mounts: map[string]api.MountConfig{
+		"/workspace/repo": {Type: "git", Git: &api.GitMount{URL: filepath.Join(t.TempDir(), "missing.git")}},
+	}}}
+	err := prepareGitMounts(context.Background(), config, state.NewManagerWithDir(t.TempDir()), "vm-git")
+	require.ErrorIs(t, err, ErrGitClone)
+}
@@ -0,0 +1,124 @@
+package sandbox
+
+import (
+	"io"
+	"sync"
+)
+
+// Stream identifies which output stream mirrored data came from.
+type Stream uint8
+
+const (
+	StreamStdout Stream = iota
+	StreamStderr
+)
+
+// Output is a chunk of command output delivered to watchers.
+type Output struct {
+	Stream Stream
+	Data   []byte
+}
+
+// watcherBuffer is how many chunks a watcher may fall behind before
+// further output is dropped for it.
+const watcherBuffer = 256
+
+// Mirror fans the output of a sandbox's commands and interactive sessions
+// out to read-only watchers. Writes never block or fail, so a slow or
+// disconnected watcher cannot stall the command being watched; it misses
+// output instead. A nil Mirror discards everything.
+type Mirror struct {
+	mu       sync.Mutex
+	watchers map[chan Output]struct{}
+	closed   bool
+}
+
+func NewMirror() *Mirror {
+	return &Mirror{watchers: make(map[chan Output]struct{})}
+}
+
+// Watch subscribes to output written from now on. The channel is closed
+// by the returned cancel func or when the mirror is closed.
+func (m *Mirror) Watch() (<-chan Output, func()) {
+	ch := make(chan Output, watcherBuffer)
+	if m == nil {
+		close(ch)
+		return ch, func() {}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	m.watchers[ch] = struct{}{}
+
+	return ch, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.watchers[ch]; ok {
+			delete(m.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (m *Mirror) publish(stream Stream, p []byte) {
+	if m == nil || len(p) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.watchers) == 0 {
+		return
+	}
+	out := Output{Stream: stream, Data: append([]byte(nil), p...)}
+	for ch := range m.watchers {
+		select {
+		case ch <- out:
+		default:
+		}
+	}
+}
+
+// Writer returns a writer that mirrors everything written to it on stream.
+func (m *Mirror) Writer(stream Stream) io.Writer {
+	return mirrorWriter{m: m, stream: stream}
+}
+
+// Tee returns a writer that writes to w and mirrors the data on stream.
+// A nil w yields nil, leaving output buffered by the caller.
+func (m *Mirror) Tee(w io.Writer, stream Stream) io.Writer {
+	if w == nil || m == nil {
+		return w
+	}
+	return io.MultiWriter(w, m.Writer(stream))
+}
+
+// Close ends all watches.
+func (m *Mirror) Close() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	for ch := range m.watchers {
+		close(ch)
+	}
+	m.watchers = nil
+}
+
+type mirrorWriter struct {
+	m      *Mirror
+	stream Stream
+}
+
+func (w mirrorWriter) Write(p []byte) (int, error) {
+	w.m.publish(w.stream, p)
+	return len(p), nil
+}
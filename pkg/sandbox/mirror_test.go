@@ -0,0 +1,68 @@
+package sandbox
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorFansOutToWatchers(t *testing.T) {
+	m := NewMirror()
+	m.Writer(StreamStdout).Write([]byte("before"))
+
+	a, cancelA := m.Watch()
+	b, cancelB := m.Watch()
+	defer cancelB()
+
+	m.Writer(StreamStdout).Write([]byte("out"))
+	m.Writer(StreamStderr).Write([]byte("err"))
+	cancelA()
+	m.Writer(StreamStdout).Write([]byte("after"))
+
+	var got []Output
+	for out := range a {
+		got = append(got, out)
+	}
+	require.Equal(t, []Output{{StreamStdout, []byte("out")}, {StreamStderr, []byte("err")}}, got)
+
+	require.Equal(t, Output{StreamStdout, []byte("out")}, <-b)
+	require.Equal(t, Output{StreamStderr, []byte("err")}, <-b)
+	require.Equal(t, Output{StreamStdout, []byte("after")}, <-b)
+}
+
+func TestMirrorDropsForSlowWatcher(t *testing.T) {
+	m := NewMirror()
+	output, cancel := m.Watch()
+	defer cancel()
+
+	w := m.Writer(StreamStdout)
+	for i := 0; i < watcherBuffer+10; i++ {
+		n, err := w.Write([]byte("x"))
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	}
+	require.Len(t, output, watcherBuffer)
+
+	m.Close()
+	count := 0
+	for range output {
+		count++
+	}
+	require.Equal(t, watcherBuffer, count)
+
+	closed, _ := m.Watch()
+	_, ok := <-closed
+	require.False(t, ok)
+}
+
+func TestNilMirror(t *testing.T) {
+	var m *Mirror
+	_, err := m.Writer(StreamStdout).Write([]byte("x"))
+	require.NoError(t, err)
+	require.Nil(t, m.Tee(nil, StreamStdout))
+	output, cancel := m.Watch()
+	defer cancel()
+	_, ok := <-output
+	require.False(t, ok)
+	m.Close()
+}
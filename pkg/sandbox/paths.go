@@ -9,7 +9,9 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/jingkaihe/matchlock/internal/errx"
 	"github.com/jingkaihe/matchlock/pkg/kernel"
+	"github.com/jingkaihe/matchlock/pkg/trust"
 )
 
 // DefaultKernelPath returns the path to the kernel image, downloading if needed.
@@ -38,6 +40,16 @@ func DefaultKernelPathWithVersion(version string) (string, error) {
 	return mgr.EnsureKernel(ctx, arch, version)
 }
 
+// verifyAsset checks a guest boot asset against the host trust policy before
+// it is used, so a tampered asset cache cannot compromise sandboxes.
+func verifyAsset(name, path string) error {
+	policy, err := trust.LoadDefaultPolicy()
+	if err != nil {
+		return errx.Wrap(ErrTrustPolicy, err)
+	}
+	return policy.Verify(name, path)
+}
+
 // DefaultInitramfsPath returns the default path to the initramfs image (optional, mainly for macOS).
 func DefaultInitramfsPath() string {
 	home, _ := os.UserHomeDir()
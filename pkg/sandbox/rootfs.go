@@ -1,6 +1,7 @@
 package sandbox
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
 	"os/exec"
@@ -8,6 +9,8 @@ import (
 	"strings"
 
 	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/trust"
 )
 
 const initScript = `#!/bin/sh
@@ -59,6 +62,13 @@ echo "$DNS_SERVERS" | tr ',' '\n' | while read -r ns; do
     [ -n "$ns" ] && echo "nameserver $ns"
 done > /etc/resolv.conf
 
+# Map host.matchlock.internal to the gateway from the kernel ip= param
+# (ip=<guest>::<gateway>:...) so the guest can reach allowed host services
+GATEWAY=$(cat /proc/cmdline | tr ' ' '\n' | grep '^ip=' | cut -d= -f2 | cut -s -d: -f3)
+if [ -n "$GATEWAY" ]; then
+    echo "$GATEWAY host.matchlock.internal" >> /etc/hosts
+fi
+
 # Network setup - bring up interface and get IP via DHCP
 ip link set eth0 up 2>/dev/null || ifconfig eth0 up 2>/dev/null
 
@@ -103,25 +113,36 @@ for i in $(seq 1 50); do
     sleep 0.1
 done
 
+# Mount virtio-fs shares over their FUSE mounts (matchlock.virtiofs.<tag>=/mount/path)
+for param in $(cat /proc/cmdline); do
+    case "$param" in
+        matchlock.virtiofs.*)
+            TAG=$(echo "$param" | sed 's/matchlock\.virtiofs\.//;s/=.*//')
+            MNTPATH=$(echo "$param" | cut -d= -f2)
+            if ! mount -t virtiofs "$TAG" "$MNTPATH"; then
+                echo "WARNING: failed to mount virtio-fs $TAG at $MNTPATH; using FUSE" >&2
+            fi
+            ;;
+    esac
+done
+
 # CA cert is injected directly into rootfs at /etc/ssl/certs/matchlock-ca.crt
 # No VFS-based injection needed
 
 exec /opt/matchlock/guest-agent
 `
 
+// upperGuestRoot is the directory of an overlay upper disk that holds the
+// guest's changes to a read-only rootfs image; see image.OverlayDir.
+const upperGuestRoot = "/root"
+
 // prepareRootfs injects matchlock components into an ext4 rootfs image using debugfs.
 // This includes the guest-agent binary, guest-fused binary, and init scripts.
 // DNS config is written at runtime by the init script to handle symlinked resolv.conf.
 // It also optionally resizes the rootfs if diskSizeMB > 0.
 func prepareRootfs(rootfsPath string, diskSizeMB int64) error {
-	guestAgentPath := DefaultGuestAgentPath()
-	guestFusedPath := DefaultGuestFusedPath()
-
-	if _, err := os.Stat(guestAgentPath); err != nil {
-		return errx.With(ErrGuestAgent, " at %s: %w", guestAgentPath, err)
-	}
-	if _, err := os.Stat(guestFusedPath); err != nil {
-		return errx.With(ErrGuestFused, " at %s: %w", guestFusedPath, err)
+	if err := checkGuestAssets(); err != nil {
+		return err
 	}
 
 	// Resize BEFORE injecting components so that the filesystem has free space.
@@ -133,6 +154,107 @@ func prepareRootfs(rootfsPath string, diskSizeMB int64) error {
 		}
 	}
 
+	return injectComponents(rootfsPath, "")
+}
+
+// rootDiskSizeMB returns the size of a sandbox's root disk for the image at
+// rootfsPath: enough to leave freeSpaceMB (DefaultRootfsFreeSpaceMB if zero)
+// free above what the image uses, and at least diskSizeMB. The upper disk
+// of a read-only image only holds changes, so it needs the free space alone.
+func rootDiskSizeMB(rootfsPath string, readOnly bool, diskSizeMB, freeSpaceMB int64) (int64, error) {
+	if freeSpaceMB <= 0 {
+		freeSpaceMB = api.DefaultRootfsFreeSpaceMB
+	}
+	if readOnly {
+		return max(diskSizeMB, freeSpaceMB), nil
+	}
+	used, err := ext4UsedBytes(rootfsPath)
+	if err != nil {
+		return 0, err
+	}
+	return max(diskSizeMB, (used+1<<20-1)>>20+freeSpaceMB), nil
+}
+
+// ext4UsedBytes returns the space in use in the ext4 image at path, as its
+// superblock records it.
+func ext4UsedBytes(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errx.Wrap(ErrStatRootfs, err)
+	}
+	defer f.Close()
+
+	sb := make([]byte, 1024)
+	if _, err := f.ReadAt(sb, 1024); err != nil {
+		return 0, errx.Wrap(ErrStatRootfs, err)
+	}
+	le := binary.LittleEndian
+	if le.Uint16(sb[0x38:]) != 0xef53 {
+		return 0, errx.With(ErrStatRootfs, ": %s is not an ext4 image", path)
+	}
+	blocks, free := uint64(le.Uint32(sb[0x04:])), uint64(le.Uint32(sb[0x0c:]))
+	// Filesystems with the 64bit feature keep the high halves separately.
+	if le.Uint32(sb[0x60:])&0x80 != 0 {
+		blocks |= uint64(le.Uint32(sb[0x150:])) << 32
+		free |= uint64(le.Uint32(sb[0x158:])) << 32
+	}
+	blockSize := uint64(1024) << le.Uint32(sb[0x18:])
+	return int64((blocks - free) * blockSize), nil
+}
+
+// createUpperDisk creates the writable ext4 disk overlaid on a read-only
+// (erofs or squashfs) rootfs image by the image's stage-0 init, holding the
+// matchlock components and every change the guest makes to its root.
+func createUpperDisk(path string, diskSizeMB int64) error {
+	if err := checkGuestAssets(); err != nil {
+		return err
+	}
+	if diskSizeMB <= 0 {
+		diskSizeMB = api.DefaultRootfsFreeSpaceMB
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return errx.Wrap(ErrCreateUpperDisk, err)
+	}
+	f.Close()
+	if err := os.Truncate(path, diskSizeMB*1024*1024); err != nil {
+		return errx.Wrap(ErrTruncate, err)
+	}
+	cmd := exec.Command("mke2fs", "-t", "ext4", "-F", "-q", path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errx.With(ErrCreateUpperDisk, ": mke2fs: %w: %s", err, out)
+	}
+	return injectComponents(path, upperGuestRoot)
+}
+
+// checkGuestAssets checks that the guest binaries exist and are trusted.
+func checkGuestAssets() error {
+	guestAgentPath := DefaultGuestAgentPath()
+	guestFusedPath := DefaultGuestFusedPath()
+
+	if _, err := os.Stat(guestAgentPath); err != nil {
+		return errx.With(ErrGuestAgent, " at %s: %w", guestAgentPath, err)
+	}
+	if _, err := os.Stat(guestFusedPath); err != nil {
+		return errx.With(ErrGuestFused, " at %s: %w", guestFusedPath, err)
+	}
+	if err := verifyAsset(trust.AssetGuestAgent, guestAgentPath); err != nil {
+		return errx.Wrap(ErrUntrustedAsset, err)
+	}
+	if err := verifyAsset(trust.AssetGuestFused, guestFusedPath); err != nil {
+		return errx.Wrap(ErrUntrustedAsset, err)
+	}
+	return nil
+}
+
+// injectComponents writes the guest binaries and init script into the ext4
+// image at rootfsPath, under root: "" for an ext4 rootfs, or upperGuestRoot
+// for an upper disk.
+func injectComponents(rootfsPath, root string) error {
+	guestAgentPath := DefaultGuestAgentPath()
+	guestFusedPath := DefaultGuestFusedPath()
+
 	// Write init script to temp file for debugfs injection
 	initTmp, err := os.CreateTemp("", "matchlock-init-*")
 	if err != nil {
@@ -152,7 +274,7 @@ func prepareRootfs(rootfsPath string, diskSizeMB int64) error {
 	var commands []string
 
 	// Create directories that may not exist (mkdir on existing dirs/symlinks is harmless)
-	for _, dir := range []string{
+	dirs := []string{
 		"/opt",
 		"/opt/matchlock",
 		"/sbin",
@@ -162,8 +284,16 @@ func prepareRootfs(rootfsPath string, diskSizeMB int64) error {
 		"/sys",
 		"/dev",
 		"/workspace",
-	} {
-		commands = append(commands, fmt.Sprintf("mkdir %s", dir))
+	}
+	if root != "" {
+		// An upper directory would hide a lower symlink such as /sbin ->
+		// usr/sbin, so only create what the image lacks: the read-only
+		// image already has every mount point.
+		commands = append(commands, "mkdir "+root, "mkdir /work")
+		dirs = []string{"/opt", "/opt/matchlock"}
+	}
+	for _, dir := range dirs {
+		commands = append(commands, fmt.Sprintf("mkdir %s%s", root, dir))
 	}
 
 	type injection struct {
@@ -174,19 +304,24 @@ func prepareRootfs(rootfsPath string, diskSizeMB int64) error {
 	injections := []injection{
 		{guestAgentPath, "/opt/matchlock/guest-agent"},
 		{guestFusedPath, "/opt/matchlock/guest-fused"},
-		// Write init to both real and usr-merged paths for cross-distro compat
-		{initTmp.Name(), "/sbin/matchlock-init"},
-		{initTmp.Name(), "/usr/sbin/matchlock-init"},
 		{initTmp.Name(), "/init"},
+	}
+	if root == "" {
+		// Write init to both real and usr-merged paths for cross-distro compat
+		injections = append(injections,
+			injection{initTmp.Name(), "/sbin/matchlock-init"},
+			injection{initTmp.Name(), "/usr/sbin/matchlock-init"},
+		)
 		// NOTE: We intentionally do NOT overwrite /sbin/init or /usr/sbin/init.
 		// Images with ENTRYPOINT ["/sbin/init"] (e.g. systemd) would re-execute
 		// The kernel cmdline uses init=/init to boot our script directly.
 	}
 
 	for _, inj := range injections {
-		commands = append(commands, fmt.Sprintf("rm %s", inj.guestPath))
-		commands = append(commands, fmt.Sprintf("write %s %s", inj.hostPath, inj.guestPath))
-		commands = append(commands, fmt.Sprintf("set_inode_field %s mode 0100755", inj.guestPath))
+		guestPath := root + inj.guestPath
+		commands = append(commands, fmt.Sprintf("rm %s", guestPath))
+		commands = append(commands, fmt.Sprintf("write %s %s", inj.hostPath, guestPath))
+		commands = append(commands, fmt.Sprintf("set_inode_field %s mode 0100755", guestPath))
 	}
 
 	cmdStr := strings.Join(commands, "\n")
@@ -1,12 +1,14 @@
 package sandbox
 
 import (
+	"bytes"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/jingkaihe/matchlock/pkg/api"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -110,3 +112,65 @@ func TestInjectConfigFileIntoRootfs_Overwrites(t *testing.T) {
 	got := debugfsCat(t, rootfs, "/etc/test.conf")
 	assert.Equal(t, "second", got)
 }
+
+func TestInjectComponentsUpperDisk(t *testing.T) {
+	if !hasDebugfs() || !hasMkfsExt4() {
+		t.Skip("debugfs or mkfs.ext4 not available")
+	}
+
+	assets := t.TempDir()
+	agent := filepath.Join(assets, "guest-agent")
+	fused := filepath.Join(assets, "guest-fused")
+	require.NoError(t, os.WriteFile(agent, []byte("agent"), 0755))
+	require.NoError(t, os.WriteFile(fused, []byte("fused"), 0755))
+	t.Setenv("MATCHLOCK_GUEST_AGENT", agent)
+	t.Setenv("MATCHLOCK_GUEST_FUSED", fused)
+
+	upper := createTestExt4(t, 10)
+	require.NoError(t, injectComponents(upper, upperGuestRoot))
+
+	assert.Equal(t, "agent", debugfsCat(t, upper, "/root/opt/matchlock/guest-agent"))
+	assert.Equal(t, "fused", debugfsCat(t, upper, "/root/opt/matchlock/guest-fused"))
+	assert.Equal(t, initScript, debugfsCat(t, upper, "/root/init"))
+	assert.Contains(t, debugfsStatMode(t, upper, "/root/init"), "0755")
+	assert.Contains(t, debugfsStatMode(t, upper, "/work"), "Mode:")
+
+	out, err := exec.Command("debugfs", "-R", "ls /root", upper).Output()
+	require.NoError(t, err)
+	assert.NotContains(t, string(out), "sbin", "upper must not shadow the image's /sbin")
+}
+
+func TestRootDiskSizeMB(t *testing.T) {
+	if !hasMkfsExt4() || !hasDebugfs() {
+		t.Skip("mkfs.ext4 or debugfs not available")
+	}
+	rootfs := createTestExt4(t, 64)
+	empty, err := ext4UsedBytes(rootfs)
+	require.NoError(t, err)
+
+	data := filepath.Join(t.TempDir(), "data")
+	// debugfs leaves runs of zeros as holes, so the data must not be zeros.
+	require.NoError(t, os.WriteFile(data, bytes.Repeat([]byte("matchlock"), 8<<20/9), 0644))
+	out, err := exec.Command("debugfs", "-w", "-R", "write "+data+" /data", rootfs).CombinedOutput()
+	require.NoError(t, err, string(out))
+	used, err := ext4UsedBytes(rootfs)
+	require.NoError(t, err)
+	assert.InDelta(t, 8<<20, used-empty, 64<<10, "the superblock counts the written blocks")
+
+	usedMB := (used + 1<<20 - 1) >> 20
+	size, err := rootDiskSizeMB(rootfs, false, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, usedMB+100, size, "the image plus the free space")
+	size, err = rootDiskSizeMB(rootfs, false, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, usedMB+api.DefaultRootfsFreeSpaceMB, size)
+	size, err = rootDiskSizeMB(rootfs, false, 20480, 100)
+	require.NoError(t, err)
+	assert.Equal(t, int64(20480), size, "an explicit disk size is a floor")
+
+	size, err = rootDiskSizeMB(data, true, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), size, "an upper disk only holds changes")
+	_, err = rootDiskSizeMB(data, false, 0, 100)
+	require.ErrorIs(t, err, ErrStatRootfs)
+}
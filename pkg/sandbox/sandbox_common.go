@@ -2,23 +2,41 @@ package sandbox
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
 	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/caches"
+	"github.com/jingkaihe/matchlock/pkg/delta"
+	"github.com/jingkaihe/matchlock/pkg/disks"
+	"github.com/jingkaihe/matchlock/pkg/image"
 	sandboxnet "github.com/jingkaihe/matchlock/pkg/net"
 	"github.com/jingkaihe/matchlock/pkg/policy"
+	"github.com/jingkaihe/matchlock/pkg/redact"
+	"github.com/jingkaihe/matchlock/pkg/state"
 	"github.com/jingkaihe/matchlock/pkg/vfs"
 	"github.com/jingkaihe/matchlock/pkg/vm"
+	"github.com/jingkaihe/matchlock/pkg/workspaces"
 )
 
 func buildVFSProviders(config *api.Config, workspace string) map[string]vfs.Provider {
 	vfsProviders := make(map[string]vfs.Provider)
 	if config.VFS != nil && config.VFS.Mounts != nil {
 		for path, mount := range config.VFS.Mounts {
-			provider := createProvider(mount)
-			if provider != nil {
+			if provider := mountProvider(path, mount); provider != nil {
 				vfsProviders[path] = provider
 			}
 		}
@@ -42,6 +60,668 @@ func buildVFSProviders(config *api.Config, workspace string) map[string]vfs.Prov
 	return vfsProviders
 }
 
+// mountProvider creates the provider serving mount at guestPath, with its
+// access rules and case handling applied, or nil if mount has nothing to
+// serve.
+func mountProvider(guestPath string, mount api.MountConfig) vfs.Provider {
+	provider := createProvider(mount)
+	if provider == nil {
+		return nil
+	}
+	if mount.Access != nil {
+		provider = vfs.NewAccessProvider(provider, vfs.AccessRules(*mount.Access))
+	}
+	// Names are resolved before the access rules see them, so a folded name
+	// cannot slip past a pattern.
+	provider = applyMountCase(guestPath, mount, provider)
+	if mount.IDMap != nil {
+		provider = vfs.NewIDMapProvider(provider, idMap(*mount.IDMap))
+	}
+	return provider
+}
+
+// idMap returns the vfs.IDMap of m, defaulting the host owner to the user
+// running matchlock.
+func idMap(m api.MountIDMap) vfs.IDMap {
+	ids := vfs.IDMap{
+		HostUID:  uint32(os.Getuid()),
+		HostGID:  uint32(os.Getgid()),
+		GuestUID: m.UID,
+		GuestGID: m.GID,
+	}
+	if m.HostUID != nil {
+		ids.HostUID = *m.HostUID
+	}
+	if m.HostGID != nil {
+		ids.HostGID = *m.HostGID
+	}
+	return ids
+}
+
+// hostDirProvider serves the host directory of a real_fs or overlay mount,
+// confined to it unless the mount is unconfined, hiding the paths covered
+// by the mount's exclude patterns and by the directory's .matchlockignore.
+func hostDirProvider(mount api.MountConfig) vfs.Provider {
+	dir := mount.HostPath
+	var p vfs.Provider = vfs.NewRealFSProvider(dir)
+	if mount.Unconfined {
+		p = vfs.NewUnconfinedRealFSProvider(dir)
+	}
+	ignored, err := vfs.ReadIgnoreFile(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring %s: %v\n", filepath.Join(dir, vfs.IgnoreFileName), err)
+	}
+	patterns := append(slices.Clone(mount.Exclude), ignored...)
+	if len(patterns) == 0 {
+		return p
+	}
+	return vfs.NewExcludeProvider(p, patterns)
+}
+
+// applyMountCase wraps provider in the case handling mount asks for. A host
+// directory on a case-insensitive volume with none gets a warning, as names
+// the guest keeps apart there are merged on the host.
+func applyMountCase(guestPath string, mount api.MountConfig, provider vfs.Provider) vfs.Provider {
+	var mode vfs.CaseMode
+	switch mount.Case {
+	case api.MountCaseRejectCollisions:
+		mode = vfs.CaseRejectCollisions
+	case api.MountCaseFold:
+		mode = vfs.CaseFold
+	default:
+		if mount.HostPath != "" && (mount.Type == "real_fs" || mount.Type == "overlay") && vfs.HostCaseInsensitive(mount.HostPath) {
+			fmt.Fprintf(os.Stderr, "Warning: %s is on a case-insensitive volume; names in %s that differ only in case will collide (set the mount's case to %s or %s)\n",
+				mount.HostPath, guestPath, api.MountCaseRejectCollisions, api.MountCaseFold)
+		}
+		return provider
+	}
+	return vfs.NewCaseProvider(provider, mode, func(name, existing string) {
+		fmt.Fprintf(os.Stderr, "Warning: refusing to create %s in %s: it differs only in case from %s\n", name, guestPath, existing)
+	})
+}
+
+// prepareWorkspaceFrom mounts the workspace snapshot named by
+// VFS.WorkspaceFrom as an overlay over the workspace, so the sandbox starts
+// with its files and leaves the snapshot untouched. It must run before
+// prepareOverlayUppers. A workspace with a mount of its own other than memory
+// cannot be seeded.
+func prepareWorkspaceFrom(config *api.Config, store *workspaces.Store) error {
+	if config.VFS == nil || config.VFS.WorkspaceFrom == "" {
+		return nil
+	}
+	name := config.VFS.WorkspaceFrom
+	if _, err := store.Get(name); err != nil {
+		return errx.Wrap(ErrWorkspaceFrom, err)
+	}
+	workspace := filepath.Clean(config.GetWorkspace())
+	for path, mount := range config.VFS.Mounts {
+		if filepath.Clean(path) == workspace && mount.Type != "memory" {
+			return errx.With(ErrWorkspaceFrom, ": workspace %s already has a %s mount", workspace, mount.Type)
+		}
+	}
+	if config.VFS.Mounts == nil {
+		config.VFS.Mounts = make(map[string]api.MountConfig)
+	}
+	config.VFS.Mounts[workspace] = api.MountConfig{Type: "overlay", HostPath: store.FilesDir(name)}
+	return nil
+}
+
+// prepareCacheMounts creates the shared cache of each cache mount in store
+// and points the mount's HostPath at its files.
+func prepareCacheMounts(config *api.Config, store *caches.Store) error {
+	if config.VFS == nil {
+		return nil
+	}
+	for path, mount := range config.VFS.Mounts {
+		if mount.Type != "cache" || mount.Cache == nil {
+			continue
+		}
+		dir, err := store.Prepare(mount.Cache.Name)
+		if err != nil {
+			return errx.With(ErrCacheMount, " for %s: %w", path, err)
+		}
+		mount.HostPath = dir
+		config.VFS.Mounts[path] = mount
+	}
+	return nil
+}
+
+// attachDataDisks attaches each data disk of config from store, creating
+// or growing its image as needed, and returns the disks for the VM and a
+// function releasing them once the VM is gone.
+func attachDataDisks(config *api.Config, store *disks.Store) ([]vm.DiskConfig, func(), error) {
+	if err := config.ValidateDataDisks(); err != nil {
+		return nil, nil, errx.Wrap(ErrDataDisk, err)
+	}
+	var devs []vm.DiskConfig
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, d := range config.DataDisks {
+		path, r, err := store.Attach(d)
+		if err != nil {
+			release()
+			return nil, nil, errx.With(ErrDataDisk, " %s: %w", d.Name, err)
+		}
+		releases = append(releases, r)
+		devs = append(devs, vm.DiskConfig{
+			HostPath:   path,
+			GuestMount: d.GetGuestMount(),
+			ReadOnly:   d.ReadOnly,
+		})
+	}
+	return devs, release, nil
+}
+
+// prepareEncryptedMounts keeps the encrypted backing file of each encrypted
+// mount without a host directory in the sandbox state dir.
+func prepareEncryptedMounts(config *api.Config, stateMgr *state.Manager, id string) {
+	if config.VFS == nil {
+		return
+	}
+	for path, mount := range config.VFS.Mounts {
+		if mount.Type == "encrypted" && mount.HostPath == "" {
+			mount.HostPath = stateMgr.Dir(id)
+			config.VFS.Mounts[path] = mount
+		}
+	}
+}
+
+// closeMounts destroys the data of the mounts that hold their own, such as
+// the key and backing file of an encrypted mount.
+func closeMounts(vfsRoot *vfs.MountRouter) {
+	for _, p := range vfsRoot.Mounts() {
+		if c, ok := p.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// prepareOverlayUppers gives each overlay mount of a host directory an upper
+// layer on the host, so the guest's writes survive the run while the host
+// directory stays untouched. Mounts with an explicit Upper keep it.
+func prepareOverlayUppers(config *api.Config, stateMgr *state.Manager, id string) error {
+	if config.VFS == nil {
+		return nil
+	}
+	for path, mount := range config.VFS.Mounts {
+		if mount.Type != "overlay" || mount.HostPath == "" || mount.Upper != nil {
+			continue
+		}
+		dir := stateMgr.OverlayDir(id, path)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return errx.With(ErrOverlayUpper, " for %s: %w", path, err)
+		}
+		mount.Upper = &api.MountConfig{Type: "real_fs", HostPath: dir}
+		config.VFS.Mounts[path] = mount
+	}
+	return nil
+}
+
+// addMount mounts mount at guestPath in the workspace of a running sandbox
+// and records it in config. Mounts that are set up before boot, git clones
+// and virtio-fs shares, cannot be added.
+func addMount(root *vfs.MountRouter, config *api.Config, stateMgr *state.Manager, id, guestPath string, mount api.MountConfig) error {
+	workspace := filepath.Clean(config.GetWorkspace())
+	guestPath = filepath.Clean(guestPath)
+	if err := api.ValidateGuestPathWithinWorkspace(guestPath, workspace); err != nil {
+		return errx.Wrap(ErrAddMount, err)
+	}
+	if guestPath == workspace {
+		return errx.With(ErrAddMount, ": %s is the workspace root", guestPath)
+	}
+	switch mount.Type {
+	case "memory", "s3", "cache", "encrypted":
+	case "real_fs", "overlay":
+		if mount.HostPath == "" {
+			return errx.With(ErrAddMount, ": %s mount needs a host path", mount.Type)
+		}
+		if _, err := os.Stat(mount.HostPath); err != nil {
+			return errx.Wrap(ErrAddMount, err)
+		}
+	default:
+		return errx.With(ErrAddMount, ": %q mounts cannot be added to a running sandbox", mount.Type)
+	}
+	if mount.Backend == api.MountBackendVirtioFS {
+		return errx.With(ErrAddMount, ": %s shares are set up at boot", api.MountBackendVirtioFS)
+	}
+	mounts := map[string]api.MountConfig{guestPath: mount}
+	for _, validate := range []func(map[string]api.MountConfig) error{
+		api.ValidateS3Mounts, api.ValidateCacheMounts, api.ValidateMemoryMounts, api.ValidateMountAccess, api.ValidateMountCase, api.ValidateMountExclude, api.ValidateMountIDMap, api.ValidateMountUnconfined,
+	} {
+		if err := validate(mounts); err != nil {
+			return errx.Wrap(ErrAddMount, err)
+		}
+	}
+	prepared := &api.Config{VFS: &api.VFSConfig{Mounts: mounts}}
+	if err := prepareOverlayUppers(prepared, stateMgr, id); err != nil {
+		return errx.Wrap(ErrAddMount, err)
+	}
+	if err := prepareCacheMounts(prepared, caches.NewStore("")); err != nil {
+		return errx.Wrap(ErrAddMount, err)
+	}
+	prepareEncryptedMounts(prepared, stateMgr, id)
+	mount = mounts[guestPath]
+
+	if err := root.AddMount(guestPath, mountProvider(guestPath, mount)); err != nil {
+		return errx.Wrap(ErrAddMount, err)
+	}
+	if config.VFS == nil {
+		config.VFS = &api.VFSConfig{}
+	}
+	if config.VFS.Mounts == nil {
+		config.VFS.Mounts = make(map[string]api.MountConfig)
+	}
+	config.VFS.Mounts[guestPath] = mount
+	stateMgr.SaveConfig(id, config)
+	return nil
+}
+
+// removeMount unmounts the mount at guestPath from a running sandbox and
+// drops it from config. The workspace root, git mounts, which are pushed
+// when the sandbox closes, and virtio-fs shares stay.
+func removeMount(root *vfs.MountRouter, config *api.Config, stateMgr *state.Manager, id, guestPath string) error {
+	guestPath = filepath.Clean(guestPath)
+	if guestPath == filepath.Clean(config.GetWorkspace()) {
+		return errx.With(ErrRemoveMount, ": %s is the workspace root", guestPath)
+	}
+	key, found := "", false
+	if config.VFS != nil {
+		for path, mount := range config.VFS.Mounts {
+			if filepath.Clean(path) != guestPath {
+				continue
+			}
+			if mount.Type == "git" {
+				return errx.With(ErrRemoveMount, ": %s is a git mount", guestPath)
+			}
+			if mount.Backend == api.MountBackendVirtioFS {
+				return errx.With(ErrRemoveMount, ": %s is shared with the guest kernel over %s", guestPath, api.MountBackendVirtioFS)
+			}
+			key, found = path, true
+		}
+	}
+	provider := root.Mounts()[guestPath]
+	if err := root.RemoveMount(guestPath); err != nil {
+		return errx.Wrap(ErrRemoveMount, err)
+	}
+	if c, ok := provider.(io.Closer); ok {
+		c.Close()
+	}
+	if found {
+		delete(config.VFS.Mounts, key)
+		stateMgr.SaveConfig(id, config)
+	}
+	return nil
+}
+
+// sharedDirs returns the virtio-fs shares for the mounts that ask for them.
+// The guest mounts each over the mount's FUSE view of the same directory, so
+// host-side file operations keep working through the VFS. A backend without
+// virtio-fs gets no shares, leaving those mounts on FUSE.
+func sharedDirs(config *api.Config, backend vm.Backend) []vm.SharedDir {
+	if config.VFS == nil {
+		return nil
+	}
+	var paths []string
+	for path, mount := range config.VFS.Mounts {
+		if mount.Backend == api.MountBackendVirtioFS {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	if sb, ok := backend.(vm.SharedDirBackend); !ok || !sb.SupportsSharedDirs() {
+		fmt.Fprintf(os.Stderr, "Warning: %s does not support virtio-fs; serving %s over FUSE\n", backend.Name(), strings.Join(paths, ", "))
+		return nil
+	}
+
+	sort.Strings(paths)
+	dirs := make([]vm.SharedDir, len(paths))
+	for i, path := range paths {
+		mount := config.VFS.Mounts[path]
+		dirs[i] = vm.SharedDir{
+			Tag:        fmt.Sprintf("share%d", i),
+			HostPath:   mount.HostPath,
+			GuestMount: filepath.Clean(path),
+			ReadOnly:   mount.Readonly,
+		}
+	}
+	return dirs
+}
+
+// metricsFlushInterval controls how often per-host network metrics are
+// persisted to the VM state directory while the sandbox runs.
+const metricsFlushInterval = 2 * time.Second
+
+// startMetricsFlusher periodically persists network metrics, egress budget,
+// secret usage, mount usage and VFS metrics for `matchlock get` and returns
+// a function that performs a final flush and stops the loop.
+func startMetricsFlusher(stateMgr *state.Manager, id string, metrics *sandboxnet.NetworkMetrics, budget *sandboxnet.EgressBudget, pol *policy.Engine, vfsRoot *vfs.MountRouter, vfsMetrics *vfs.Metrics) func() {
+	flush := func() {
+		if metrics != nil {
+			stateMgr.SaveNetworkMetrics(id, metrics.Snapshot())
+		}
+		if usage := mountUsage(vfsRoot); len(usage) > 0 {
+			stateMgr.SaveMountUsage(id, usage)
+		}
+		if ops := mountMetrics(vfsMetrics); len(ops) > 0 {
+			stateMgr.SaveVFSMetrics(id, ops)
+		}
+		if usage := budget.Usage(); usage != nil {
+			stateMgr.SaveEgressUsage(id, usage)
+		}
+		if usage := pol.SecretUsage(); len(usage) > 0 {
+			stateMgr.SaveSecretUsage(id, usage)
+		}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(metricsFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				flush()
+				return
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// mountUsage reports the usage of every mount whose provider accounts for
+// the space it holds, sorted by guest path.
+func mountUsage(vfsRoot *vfs.MountRouter) []api.MountUsage {
+	var usage []api.MountUsage
+	for path, p := range vfsRoot.Mounts() {
+		r, ok := p.(vfs.UsageReporter)
+		if !ok {
+			continue
+		}
+		used, limit := r.Usage()
+		usage = append(usage, api.MountUsage{Path: path, UsedBytes: used, LimitBytes: limit})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Path < usage[j].Path })
+	return usage
+}
+
+// newVFSMetrics returns the metrics the VFS server of sandbox id records
+// into. With a SlowOpMS threshold in config, slower operations are appended
+// to the sandbox's vfs_slow.log as JSON lines until the returned function
+// is called.
+func newVFSMetrics(config *api.Config, stateMgr *state.Manager, id string) (*vfs.Metrics, func()) {
+	m := vfs.NewMetrics(api.VFSLatencyBounds)
+	if config.VFS == nil || config.VFS.SlowOpMS <= 0 {
+		return m, func() {}
+	}
+	f, err := os.OpenFile(stateMgr.VFSSlowLogPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: slow VFS operations will not be logged: %v\n", err)
+		return m, func() {}
+	}
+	var mu sync.Mutex
+	enc := json.NewEncoder(f)
+	m.OnSlow(time.Duration(config.VFS.SlowOpMS)*time.Millisecond, func(op vfs.SlowOp) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(api.SlowVFSOp{
+			Time:       op.Time.UTC(),
+			Mount:      op.Mount,
+			Op:         op.Op.String(),
+			Path:       op.Path,
+			DurationUS: op.Duration.Microseconds(),
+			Bytes:      op.Bytes,
+			Errno:      -op.Errno,
+		})
+	})
+	return m, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		f.Close()
+	}
+}
+
+// mountMetrics returns the VFS operations recorded in m by mount and
+// operation, sorted by mount path and operation name.
+func mountMetrics(m *vfs.Metrics) []api.MountMetrics {
+	if m == nil {
+		return nil
+	}
+	var mounts []api.MountMetrics
+	for path, ops := range m.Snapshot() {
+		mm := api.MountMetrics{Path: path}
+		for op, st := range ops {
+			mm.Ops = append(mm.Ops, api.VFSOpMetrics{
+				Op:      op.String(),
+				Count:   st.Count,
+				Errors:  st.Errors,
+				Bytes:   st.Bytes,
+				TotalUS: st.Total.Microseconds(),
+				MaxUS:   st.Max.Microseconds(),
+				Latency: st.Latency,
+			})
+		}
+		sort.Slice(mm.Ops, func(i, j int) bool { return mm.Ops[i].Op < mm.Ops[j].Op })
+		mounts = append(mounts, mm)
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Path < mounts[j].Path })
+	return mounts
+}
+
+// snapshotWorkspace saves the workspace of sandbox id, as the guest sees it
+// through root and including any mounts nested in it, as the named workspace
+// snapshot.
+func snapshotWorkspace(root vfs.Provider, store *workspaces.Store, id, workspace, name string) (*workspaces.Snapshot, error) {
+	if err := workspaces.ValidateName(name); err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(vfs.WriteTar(root, workspace, w))
+	}()
+	snap, err := store.Save(name, workspaces.Snapshot{SandboxID: id, Workspace: workspace}, r)
+	r.Close()
+	if err != nil {
+		return nil, errx.Wrap(ErrSnapshotWorkspace, err)
+	}
+	return snap, nil
+}
+
+// newEgressBudget returns the egress byte budget configured for a sandbox, or
+// nil if there is none. Exhausting it is reported on stderr and, with
+// api.EgressActionKill, stops the machine returned by machine. It is looked
+// up when the budget runs out so a restarted sandbox stops its current VM.
+func newEgressBudget(network *api.NetworkConfig, id string, machine func() vm.Machine) *sandboxnet.EgressBudget {
+	if network == nil {
+		return nil
+	}
+	action := network.EgressAction()
+	return sandboxnet.NewEgressBudget(network.MaxEgressBytes, func() {
+		if action == api.EgressActionKill {
+			fmt.Fprintf(os.Stderr, "Egress budget of %d bytes exhausted, stopping sandbox %s\n", network.MaxEgressBytes, id)
+			machine().Stop(context.Background())
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Egress budget of %d bytes exhausted, blocking further network traffic from sandbox %s\n", network.MaxEgressBytes, id)
+	})
+}
+
+// watchSecretLeaks reports every attempt to send a secret placeholder to a
+// host the secret is not bound to on stderr and, with api.LeakActionKill,
+// stops the machine returned by machine on the first one.
+func watchSecretLeaks(network *api.NetworkConfig, id string, metrics *sandboxnet.NetworkMetrics, machine func() vm.Machine) {
+	kill := network.LeakAction() == api.LeakActionKill
+	var once sync.Once
+	metrics.OnAlert(func(ev api.NetworkEvent) {
+		fmt.Fprintf(os.Stderr, "WARNING: sandbox %s tried to send a secret placeholder to %s: %s\n", id, ev.Host, ev.BlockReason)
+		if kill {
+			once.Do(func() {
+				fmt.Fprintf(os.Stderr, "Stopping sandbox %s after a secret leak attempt\n", id)
+				machine().Stop(context.Background())
+			})
+		}
+	})
+}
+
+// RestartOptions configures Sandbox.Restart.
+type RestartOptions struct {
+	// FreshDisk boots from a new copy of the image, discarding changes made
+	// to the root filesystem. By default the disk is kept.
+	FreshDisk bool
+}
+
+// restartSyncTimeout bounds how long a restart waits for the guest to flush
+// its filesystems before shutting it down.
+const restartSyncTimeout = 10 * time.Second
+
+// syncGuest flushes the guest's filesystem buffers so the root disk is
+// consistent when the machine is shut down. Failures are ignored: the guest
+// may be wedged, which is often why it is being restarted.
+func syncGuest(ctx context.Context, machine vm.Machine) {
+	ctx, cancel := context.WithTimeout(ctx, restartSyncTimeout)
+	defer cancel()
+	machine.Exec(ctx, "sync", &api.ExecOptions{})
+}
+
+// warnInsecureUpstreams prints a warning for each upstream host pattern with
+// TLS verification disabled: the proxy then cannot tell a hijacked endpoint
+// from the real one, so secrets may be injected into the wrong hands.
+func warnInsecureUpstreams(network *api.NetworkConfig) {
+	if network == nil {
+		return
+	}
+	var hosts []string
+	for host, opts := range network.UpstreamTLS {
+		if opts.InsecureSkipVerify {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(os.Stderr, "WARNING: upstream TLS verification is DISABLED for %s; use only with trusted lab endpoints\n", host)
+	}
+}
+
+// allowNoInterceptHosts adds hosts excluded from interception to a
+// non-empty allowlist, since listing a host there implies it may be reached.
+// An empty allowlist already allows every host and is left empty.
+func allowNoInterceptHosts(network *api.NetworkConfig) {
+	if network == nil || len(network.AllowedHosts) == 0 {
+		return
+	}
+	for _, h := range network.NoInterceptHosts {
+		if !slices.Contains(network.AllowedHosts, h) {
+			network.AllowedHosts = append(network.AllowedHosts, h)
+		}
+	}
+}
+
+// prepareSwap validates the swap settings in res and returns what the VM
+// needs for them: for zram, its size; for file swap, a disk backed by a new
+// sparse image at path, which the state manager deletes on Unregister.
+func prepareSwap(res *api.Resources, path string) ([]vm.DiskConfig, int, error) {
+	if err := res.ValidateSwap(); err != nil {
+		return nil, 0, err
+	}
+	switch res.SwapKind() {
+	case api.SwapZram:
+		return nil, res.SwapMB, nil
+	case api.SwapFile:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+		if err := f.Truncate(int64(res.SwapMB) << 20); err != nil {
+			os.Remove(path)
+			return nil, 0, err
+		}
+		return []vm.DiskConfig{{HostPath: path, Swap: true}}, 0, nil
+	}
+	return nil, 0, nil
+}
+
+// snapshotRootfs saves the VM's rootfs into the local image store under
+// tag, so that later sandboxes can boot from it by using tag as their
+// image. The guest's root filesystem is frozen while its disk is copied, so
+// the copy is consistent rather than caught between writes.
+func snapshotRootfs(ctx context.Context, machine vm.Machine, config *api.Config, tag string) error {
+	if tag == "" {
+		return ErrSnapshotTag
+	}
+	// The guest's changes to a read-only rootfs live on its upper disk,
+	// which no image format here can merge back.
+	if format, err := image.DetectRootfsFormat(machine.RootfsPath()); err == nil && format.ReadOnly() {
+		return ErrSnapshotReadOnly
+	}
+
+	fm, ok := machine.(vm.FreezingMachine)
+	if !ok {
+		return errx.With(ErrSnapshotFreeze, ": not supported by this VM backend")
+	}
+	thaw, err := fm.FreezeFS(ctx, "/")
+	if err != nil {
+		return errx.Wrap(ErrSnapshotFreeze, err)
+	}
+	defer thaw()
+
+	meta := image.ImageMeta{Source: "snapshot"}
+	if ic := config.ImageCfg; ic != nil {
+		meta.OCI = &image.OCIConfig{
+			User:       ic.User,
+			WorkingDir: ic.WorkingDir,
+			Entrypoint: ic.Entrypoint,
+			Cmd:        ic.Cmd,
+			Env:        ic.Env,
+		}
+	}
+
+	if err := image.NewStore("").Save(tag, machine.RootfsPath(), meta); err != nil {
+		return errx.Wrap(ErrSnapshotSave, err)
+	}
+	return nil
+}
+
+// recordExit persists the outcome of the sandbox's primary command. A failed
+// command is flagged as OOM-killed when the guest kernel has killed any
+// process for lack of memory, since the primary command is the workload that
+// drives the sandbox's memory use.
+func recordExit(ctx context.Context, machine vm.Machine, stateMgr *state.Manager, id string, exitCode int) error {
+	exit := state.ExitStatus{
+		ExitCode:   exitCode,
+		FinishedAt: time.Now().UTC(),
+	}
+	if exitCode != 0 {
+		if result, err := machine.Exec(ctx, "cat /proc/vmstat", &api.ExecOptions{}); err == nil && result.ExitCode == 0 {
+			exit.OOMKilled = parseOOMKills(result.Stdout) > 0
+		}
+	}
+	return stateMgr.SaveExitStatus(id, exit)
+}
+
+// parseOOMKills returns the oom_kill counter from /proc/vmstat output.
+func parseOOMKills(vmstat []byte) int {
+	for _, line := range strings.Split(string(vmstat), "\n") {
+		name, value, ok := strings.Cut(line, " ")
+		if ok && name == "oom_kill" {
+			n, _ := strconv.Atoi(strings.TrimSpace(value))
+			return n
+		}
+	}
+	return 0
+}
+
 func prepareExecEnv(config *api.Config, caPool *sandboxnet.CAPool, pol *policy.Engine) *api.ExecOptions {
 	opts := &api.ExecOptions{
 		WorkingDir: config.GetWorkspace(),
@@ -59,6 +739,9 @@ func prepareExecEnv(config *api.Config, caPool *sandboxnet.CAPool, pol *policy.E
 			opts.User = ic.User
 		}
 	}
+	for k, v := range config.Env {
+		opts.Env[k] = v
+	}
 
 	if caPool != nil {
 		certPath := "/etc/ssl/certs/matchlock-ca.crt"
@@ -75,13 +758,35 @@ func prepareExecEnv(config *api.Config, caPool *sandboxnet.CAPool, pol *policy.E
 	return opts
 }
 
-func execCommand(ctx context.Context, machine vm.Machine, config *api.Config, caPool *sandboxnet.CAPool, pol *policy.Engine, command string, opts *api.ExecOptions) (*api.ExecResult, error) {
+func execCommand(ctx context.Context, machine vm.Machine, config *api.Config, caPool *sandboxnet.CAPool, pol *policy.Engine, red *redact.Redactor, mirror *Mirror, command string, opts *api.ExecOptions) (*api.ExecResult, error) {
 	if opts == nil {
 		opts = &api.ExecOptions{}
 	}
 	if opts.Env == nil {
 		opts.Env = make(map[string]string)
 	}
+	// Watchers see output as the caller does, after redaction.
+	streamed := opts.Stdout != nil
+	if mirror != nil {
+		o := *opts
+		opts = &o
+		opts.Stdout = mirror.Tee(opts.Stdout, StreamStdout)
+		opts.Stderr = mirror.Tee(opts.Stderr, StreamStderr)
+	}
+	if red != nil {
+		o := *opts
+		opts = &o
+		if opts.Stdout != nil {
+			w := red.NewWriter(opts.Stdout)
+			defer w.Flush()
+			opts.Stdout = w
+		}
+		if opts.Stderr != nil {
+			w := red.NewWriter(opts.Stderr)
+			defer w.Flush()
+			opts.Stderr = w
+		}
+	}
 
 	prepared := prepareExecEnv(config, caPool, pol)
 	if opts.WorkingDir == "" {
@@ -94,7 +799,184 @@ func execCommand(ctx context.Context, machine vm.Machine, config *api.Config, ca
 		opts.Env[k] = v
 	}
 
-	return machine.Exec(ctx, command, opts)
+	result, err := machine.Exec(ctx, command, opts)
+	if result != nil {
+		result.Stdout = red.Bytes(result.Stdout)
+		result.Stderr = red.Bytes(result.Stderr)
+		if !streamed {
+			mirror.publish(StreamStdout, result.Stdout)
+			mirror.publish(StreamStderr, result.Stderr)
+		}
+	}
+	return result, err
+}
+
+// templateData returns what startup templates of sandbox id render with.
+func templateData(id string, config *api.Config) *api.TemplateData {
+	return &api.TemplateData{
+		SandboxID:     id,
+		WorkspacePath: config.GetWorkspace(),
+		Labels:        config.Labels,
+	}
+}
+
+// expandEnv renders the templates in config.Env, such as
+// "{{.SandboxID}}", once the sandbox ID is known.
+func expandEnv(id string, config *api.Config) error {
+	if len(config.Env) == 0 {
+		return nil
+	}
+	data := templateData(id, config)
+	env := make(map[string]string, len(config.Env))
+	for k, v := range config.Env {
+		expanded, err := api.ExpandTemplate(v, data)
+		if err != nil {
+			return errx.With(err, " in %s", k)
+		}
+		env[k] = expanded
+	}
+	config.Env = env
+	return nil
+}
+
+// newRedactor returns a redactor for the secrets of config, or nil unless
+// config.Redact is set. Placeholders must already have been assigned by the
+// policy engine.
+func newRedactor(config *api.Config) *redact.Redactor {
+	if !config.Redact || config.Network == nil {
+		return nil
+	}
+	values := make(map[string][]string, len(config.Network.Secrets))
+	for name, secret := range config.Network.Secrets {
+		vs := []string{secret.Value, secret.Placeholder}
+		if o := secret.OAuth2; o != nil {
+			vs = append(vs, o.ClientSecret, o.RefreshToken)
+		}
+		values[name] = vs
+	}
+	return redact.New(values)
+}
+
+// updateSecret rotates a secret in the policy engine and keeps the new value
+// out of redacted output too.
+func updateSecret(pol *policy.Engine, red *redact.Redactor, name, value string) error {
+	if err := pol.UpdateSecret(name, value); err != nil {
+		return errx.Wrap(ErrUpdateSecret, err)
+	}
+	red.Add(name, value)
+	return nil
+}
+
+// logFilter returns a vm.VMConfig.LogFilter that redacts the VM log, or nil
+// when there is nothing to redact.
+func logFilter(red *redact.Redactor) func(io.Writer) io.WriteCloser {
+	if red == nil {
+		return nil
+	}
+	return func(w io.Writer) io.WriteCloser { return red.NewWriter(w) }
+}
+
+// fileWatcher publishes the changes made through the VFS under the watched
+// paths as "file" events. It closes the events channel itself, so a change
+// racing with Close is dropped instead of sent on a closed channel.
+type fileWatcher struct {
+	mu     sync.Mutex
+	events chan api.Event
+	paths  []string
+	closed bool
+}
+
+func newFileWatcher(events chan api.Event, vfsRoot *vfs.MountRouter) *fileWatcher {
+	w := &fileWatcher{events: events}
+	vfsRoot.OnChange(w.notify)
+	return w
+}
+
+// watch starts publishing changes at or below path.
+func (w *fileWatcher) watch(path string) error {
+	if !filepath.IsAbs(path) {
+		return errx.With(ErrWatchPath, ": %q is not absolute", path)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	path = filepath.Clean(path)
+	if !slices.Contains(w.paths, path) {
+		w.paths = append(w.paths, path)
+	}
+	return nil
+}
+
+func (w *fileWatcher) notify(c vfs.Change) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || !slices.ContainsFunc(w.paths, func(p string) bool { return isWithinPath(c.Path, p) }) {
+		return
+	}
+	// Like the network layer, drop events nobody is reading.
+	select {
+	case w.events <- api.Event{
+		Type:      "file",
+		Timestamp: time.Now().Unix(),
+		File:      &api.FileEvent{Op: c.Op, Path: c.Path, Size: c.Size},
+	}:
+	default:
+	}
+}
+
+func (w *fileWatcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.events)
+	}
+}
+
+func isWithinPath(path, dir string) bool {
+	return dir == "/" || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// redactEvents returns events with secrets masked, forwarded from in. The
+// returned channel is closed once in is. Without a redactor in is returned.
+func redactEvents(in chan api.Event, red *redact.Redactor) <-chan api.Event {
+	if red == nil {
+		return in
+	}
+	out := make(chan api.Event, cap(in))
+	go func() {
+		defer close(out)
+		for ev := range in {
+			if ev.Network != nil {
+				n := *ev.Network
+				n.URL = red.String(n.URL)
+				n.BlockReason = red.String(n.BlockReason)
+				n.Error = red.String(n.Error)
+				ev.Network = &n
+			}
+			if ev.Exec != nil {
+				e := *ev.Exec
+				e.Command = red.String(e.Command)
+				ev.Exec = &e
+			}
+			// Like the network layer, drop events nobody is reading.
+			select {
+			case out <- ev:
+			default:
+			}
+		}
+	}()
+	return out
+}
+
+// redactViolations masks secrets in the reasons of vs.
+func redactViolations(vs []api.NetworkViolation, red *redact.Redactor) []api.NetworkViolation {
+	if red == nil {
+		return vs
+	}
+	for i := range vs {
+		vs[i].Reason = red.String(vs[i].Reason)
+	}
+	return vs
 }
 
 func writeFile(vfsRoot *vfs.MountRouter, path string, content []byte, mode uint32) error {
@@ -110,6 +992,40 @@ func writeFile(vfsRoot *vfs.MountRouter, path string, content []byte, mode uint3
 	return err
 }
 
+// writeFileFrom writes r to a VFS file. The data goes to a temporary file
+// beside path that replaces it only once r has been read to its end, so an
+// upload that fails or is rejected part way leaves any old file in place.
+func writeFileFrom(vfsRoot *vfs.MountRouter, path string, r io.Reader, mode uint32) (int64, error) {
+	if mode == 0 {
+		mode = 0644
+	}
+	dir, name := filepath.Split(path)
+	tmp := filepath.Join(dir, "."+name+".matchlock-"+uuid.New().String()[:8])
+	h, err := vfsRoot.Create(tmp, os.FileMode(mode))
+	if err != nil {
+		return 0, err
+	}
+	n, err := vfs.CopySparse(h, r)
+	if closeErr := h.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = vfsRoot.Rename(tmp, path)
+	}
+	if err != nil {
+		vfsRoot.Remove(tmp)
+		return 0, err
+	}
+	return n, nil
+}
+
+func mkdirAll(vfsRoot *vfs.MountRouter, path string, mode uint32) error {
+	if mode == 0 {
+		mode = 0755
+	}
+	return vfs.MkdirAll(vfsRoot, path, os.FileMode(mode))
+}
+
 func readFile(vfsRoot *vfs.MountRouter, path string) ([]byte, error) {
 	h, err := vfsRoot.Open(path, os.O_RDONLY, 0)
 	if err != nil {
@@ -130,6 +1046,35 @@ func readFile(vfsRoot *vfs.MountRouter, path string) ([]byte, error) {
 	return content, nil
 }
 
+// fileSignature returns the delta signature of a VFS file so a client can
+// send only the blocks that changed.
+func fileSignature(vfsRoot *vfs.MountRouter, path string, blockSize int) (*delta.Signature, error) {
+	content, err := readFile(vfsRoot, path)
+	if err != nil {
+		return nil, err
+	}
+	return delta.Sign(content, blockSize)
+}
+
+// patchFile rebuilds a VFS file from its current contents and a delta. The
+// result is only written if it matches checksum, which guards against the
+// file having changed since the client fetched its signature. A missing file
+// is treated as empty so a delta of pure literals can create it.
+func patchFile(vfsRoot *vfs.MountRouter, path string, blockSize int, ops []delta.Op, mode uint32, checksum string) error {
+	old, err := readFile(vfsRoot, path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	content, err := delta.Apply(old, blockSize, ops)
+	if err != nil {
+		return err
+	}
+	if delta.Checksum(content) != checksum {
+		return ErrPatchChecksum
+	}
+	return writeFile(vfsRoot, path, content, mode)
+}
+
 func readFileTo(vfsRoot *vfs.MountRouter, path string, w io.Writer) (int64, error) {
 	h, err := vfsRoot.Open(path, os.O_RDONLY, 0)
 	if err != nil {
@@ -149,11 +1094,32 @@ func listFiles(vfsRoot *vfs.MountRouter, path string) ([]api.FileInfo, error) {
 	for i, e := range entries {
 		info, _ := e.Info()
 		result[i] = api.FileInfo{
-			Name:  e.Name(),
-			Size:  info.Size(),
-			Mode:  uint32(info.Mode()),
-			IsDir: e.IsDir(),
+			Name:    e.Name(),
+			Size:    info.Size(),
+			Mode:    uint32(info.Mode()),
+			ModTime: info.ModTime(),
+			IsDir:   e.IsDir(),
+		}
+		if vi, ok := info.(vfs.FileInfo); ok {
+			result[i].UID, result[i].GID = vi.Owner()
 		}
 	}
 	return result, nil
 }
+
+func statFile(vfsRoot *vfs.MountRouter, path string) (*api.FileInfo, error) {
+	info, err := vfsRoot.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	uid, gid := info.Owner()
+	return &api.FileInfo{
+		Name:    filepath.Base(path),
+		Size:    info.Size(),
+		Mode:    uint32(info.Mode()),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+		UID:     uid,
+		GID:     gid,
+	}, nil
+}
@@ -1,11 +1,23 @@
 package sandbox
 
 import (
+	"errors"
+	"io"
+	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"testing/iotest"
 
 	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/caches"
+	"github.com/jingkaihe/matchlock/pkg/delta"
+	"github.com/jingkaihe/matchlock/pkg/state"
 	"github.com/jingkaihe/matchlock/pkg/vfs"
+	"github.com/jingkaihe/matchlock/pkg/vm"
+	"github.com/jingkaihe/matchlock/pkg/workspaces"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -44,6 +56,88 @@ func TestBuildVFSProvidersKeepsExplicitWorkspaceMount(t *testing.T) {
 	require.Len(t, providers, 1)
 }
 
+func TestBuildVFSProvidersEnforcesMountAccess(t *testing.T) {
+	hostDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, ".env"), []byte("KEY=1"), 0644))
+	config := &api.Config{
+		VFS: &api.VFSConfig{
+			Mounts: map[string]api.MountConfig{
+				"/workspace": {Type: "real_fs", HostPath: hostDir, Access: &api.MountAccess{DenyRead: []string{".env"}}},
+			},
+		},
+	}
+
+	router := vfs.NewMountRouter(buildVFSProviders(config, "/workspace"))
+	_, err := readFile(router, "/workspace/.env")
+	require.ErrorIs(t, err, syscall.EACCES)
+}
+
+func TestBuildVFSProvidersFoldsCaseBeforeAccessRules(t *testing.T) {
+	hostDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, ".env"), []byte("KEY=1"), 0644))
+	config := &api.Config{
+		VFS: &api.VFSConfig{
+			Mounts: map[string]api.MountConfig{
+				"/workspace": {
+					Type:     "real_fs",
+					HostPath: hostDir,
+					Access:   &api.MountAccess{DenyRead: []string{".env"}},
+					Case:     api.MountCaseFold,
+				},
+			},
+		},
+	}
+
+	router := vfs.NewMountRouter(buildVFSProviders(config, "/workspace"))
+	_, err := readFile(router, "/workspace/.ENV")
+	require.ErrorIs(t, err, syscall.EACCES)
+}
+
+func TestBuildVFSProvidersHidesIgnoredPaths(t *testing.T) {
+	hostDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, vfs.IgnoreFileName), []byte("# deps\nnode_modules\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(hostDir, "node_modules", "left-pad"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, "build.log"), []byte("ok"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, "main.go"), []byte("package main"), 0644))
+	config := &api.Config{
+		VFS: &api.VFSConfig{
+			Mounts: map[string]api.MountConfig{
+				"/workspace": {Type: "real_fs", HostPath: hostDir, Exclude: []string{"*.log"}},
+			},
+		},
+	}
+
+	router := vfs.NewMountRouter(buildVFSProviders(config, "/workspace"))
+	_, err := router.Stat("/workspace/node_modules/left-pad")
+	require.ErrorIs(t, err, syscall.ENOENT)
+	_, err = readFile(router, "/workspace/build.log")
+	require.ErrorIs(t, err, syscall.ENOENT)
+	data, err := readFile(router, "/workspace/main.go")
+	require.NoError(t, err)
+	require.Equal(t, "package main", string(data))
+}
+
+func TestBuildVFSProvidersEncryptedWorkspace(t *testing.T) {
+	stateMgr := state.NewManagerWithDir(t.TempDir())
+	config := &api.Config{VFS: &api.VFSConfig{Mounts: map[string]api.MountConfig{
+		"/workspace": {Type: "encrypted"},
+	}}}
+	require.NoError(t, os.MkdirAll(stateMgr.Dir("vm-test"), 0700))
+	prepareEncryptedMounts(config, stateMgr, "vm-test")
+	require.Equal(t, stateMgr.Dir("vm-test"), config.VFS.Mounts["/workspace"].HostPath)
+
+	router := vfs.NewMountRouter(buildVFSProviders(config, "/workspace"))
+	require.IsType(t, &vfs.EncryptedProvider{}, router.Mounts()["/workspace"])
+	require.NoError(t, writeFile(router, "/workspace/notes.txt", []byte("draft"), 0644))
+	data, err := readFile(router, "/workspace/notes.txt")
+	require.NoError(t, err)
+	require.Equal(t, "draft", string(data))
+
+	closeMounts(router)
+	_, err = readFile(router, "/workspace/notes.txt")
+	require.ErrorIs(t, err, syscall.EIO)
+}
+
 func TestBuildVFSProvidersDoesNotDuplicateCanonicalWorkspaceMount(t *testing.T) {
 	workspace := "/workspace"
 	config := &api.Config{
@@ -65,3 +159,354 @@ func TestBuildVFSProvidersDoesNotDuplicateCanonicalWorkspaceMount(t *testing.T)
 
 	require.Equal(t, 1, workspaceMounts, "expected exactly one canonical workspace mount (providers=%d)", len(providers))
 }
+
+func TestMkdirAllCreatesParents(t *testing.T) {
+	router := vfs.NewMountRouter(map[string]vfs.Provider{
+		"/workspace": vfs.NewMemoryProvider(),
+	})
+
+	require.NoError(t, mkdirAll(router, "/workspace/a/b/c", 0755))
+	info, err := router.Stat("/workspace/a/b/c")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+
+	require.NoError(t, mkdirAll(router, "/workspace/a/b", 0755), "existing directory should be a no-op")
+
+	require.NoError(t, writeFile(router, "/workspace/a/file", []byte("x"), 0644))
+	require.Error(t, mkdirAll(router, "/workspace/a/file", 0755))
+}
+
+func TestPatchFile(t *testing.T) {
+	router := vfs.NewMountRouter(map[string]vfs.Provider{
+		"/workspace": vfs.NewMemoryProvider(),
+	})
+	old := []byte("package main\n\nfunc main() {}\n")
+	require.NoError(t, writeFile(router, "/workspace/main.go", old, 0644))
+
+	sig, err := fileSignature(router, "/workspace/main.go", 8)
+	require.NoError(t, err)
+
+	updated := []byte("package main\n\nimport \"fmt\"\n\nfunc main() {}\n")
+	ops := delta.Diff(sig, updated)
+	require.NoError(t, patchFile(router, "/workspace/main.go", 8, ops, 0644, delta.Checksum(updated)))
+
+	got, err := readFile(router, "/workspace/main.go")
+	require.NoError(t, err)
+	require.Equal(t, string(updated), string(got))
+
+	// A stale delta must not clobber the file.
+	err = patchFile(router, "/workspace/main.go", 8, ops, 0644, delta.Checksum([]byte("other")))
+	require.ErrorIs(t, err, ErrPatchChecksum)
+}
+
+func TestPatchFileCreatesMissingFile(t *testing.T) {
+	router := vfs.NewMountRouter(map[string]vfs.Provider{
+		"/workspace": vfs.NewMemoryProvider(),
+	})
+
+	content := []byte("hello")
+	ops := []delta.Op{{Data: content}}
+	require.NoError(t, patchFile(router, "/workspace/new.txt", 8, ops, 0644, delta.Checksum(content)))
+
+	got, err := readFile(router, "/workspace/new.txt")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(got))
+}
+
+func TestWriteFileFrom(t *testing.T) {
+	router := vfs.NewMountRouter(map[string]vfs.Provider{
+		"/workspace": vfs.NewMemoryProvider(),
+	})
+	require.NoError(t, writeFile(router, "/workspace/out.bin", []byte("old"), 0644))
+
+	// A stream that fails part way leaves the old file and no temporary.
+	failing := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("connection lost")))
+	_, err := writeFileFrom(router, "/workspace/out.bin", failing, 0644)
+	require.Error(t, err)
+	got, err := readFile(router, "/workspace/out.bin")
+	require.NoError(t, err)
+	require.Equal(t, "old", string(got))
+	entries, err := router.ReadDir("/workspace")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	n, err := writeFileFrom(router, "/workspace/out.bin", strings.NewReader("new contents"), 0600)
+	require.NoError(t, err)
+	require.Equal(t, int64(12), n)
+	got, err = readFile(router, "/workspace/out.bin")
+	require.NoError(t, err)
+	require.Equal(t, "new contents", string(got))
+}
+
+func TestParseOOMKills(t *testing.T) {
+	vmstat := []byte("nr_free_pages 12345\npgfault 99\noom_kill 2\nnr_unstable 0\n")
+	require.Equal(t, 2, parseOOMKills(vmstat))
+	require.Equal(t, 0, parseOOMKills([]byte("nr_free_pages 12345\n")))
+	require.Equal(t, 0, parseOOMKills(nil))
+}
+
+func TestAllowNoInterceptHosts(t *testing.T) {
+	network := &api.NetworkConfig{
+		AllowedHosts:     []string{"api.openai.com", "*.apple.com"},
+		NoInterceptHosts: []string{"*.apple.com", "bank.example.com"},
+	}
+	allowNoInterceptHosts(network)
+	require.Equal(t, []string{"api.openai.com", "*.apple.com", "bank.example.com"}, network.AllowedHosts)
+
+	// An empty allowlist already allows everything and must stay empty.
+	open := &api.NetworkConfig{NoInterceptHosts: []string{"bank.example.com"}}
+	allowNoInterceptHosts(open)
+	require.Empty(t, open.AllowedHosts)
+}
+
+func TestPrepareSwap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "swap.img")
+
+	disks, zramMB, err := prepareSwap(nil, path)
+	require.NoError(t, err)
+	require.Empty(t, disks)
+	require.Zero(t, zramMB)
+
+	disks, zramMB, err = prepareSwap(&api.Resources{MemoryMB: 512, SwapMB: 256}, path)
+	require.NoError(t, err)
+	require.Empty(t, disks)
+	require.Equal(t, 256, zramMB)
+	require.NoFileExists(t, path)
+
+	disks, zramMB, err = prepareSwap(&api.Resources{SwapMB: 64, SwapType: api.SwapFile}, path)
+	require.NoError(t, err)
+	require.Zero(t, zramMB)
+	require.Equal(t, []vm.DiskConfig{{HostPath: path, Swap: true}}, disks)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(64<<20), info.Size())
+
+	_, _, err = prepareSwap(&api.Resources{SwapMB: 64, SwapType: "partition"}, path)
+	require.ErrorIs(t, err, api.ErrInvalidSwap)
+}
+
+func TestNewRedactor(t *testing.T) {
+	config := &api.Config{
+		Network: &api.NetworkConfig{Secrets: map[string]api.Secret{
+			"API_KEY": {Value: "sk-live-123", Placeholder: "SANDBOX_SECRET_abc"},
+			"GH":      {OAuth2: &api.OAuth2{ClientID: "client", ClientSecret: "gh-secret", RefreshToken: "gh-refresh"}},
+		}},
+	}
+	require.Nil(t, newRedactor(config), "redaction is opt-in")
+
+	config.Redact = true
+	red := newRedactor(config)
+	require.NotNil(t, red)
+	require.Equal(t,
+		"[REDACTED:API_KEY] [REDACTED:API_KEY] [REDACTED:GH] [REDACTED:GH] client",
+		red.String("sk-live-123 SANDBOX_SECRET_abc gh-secret gh-refresh client"))
+}
+
+func TestRedactEvents(t *testing.T) {
+	red := newRedactor(&api.Config{
+		Redact:  true,
+		Network: &api.NetworkConfig{Secrets: map[string]api.Secret{"API_KEY": {Value: "sk-live-123", Placeholder: "SANDBOX_SECRET_abc"}}},
+	})
+	in := make(chan api.Event, 1)
+	out := redactEvents(in, red)
+
+	in <- api.Event{Type: "network", Network: &api.NetworkEvent{
+		URL:         "http://evil.example.com/?k=SANDBOX_SECRET_abc",
+		BlockReason: "secret leak",
+	}}
+	close(in)
+
+	ev, ok := <-out
+	require.True(t, ok)
+	require.Equal(t, "http://evil.example.com/?k=[REDACTED:API_KEY]", ev.Network.URL)
+	_, ok = <-out
+	require.False(t, ok, "closed with the input")
+
+	raw := make(chan api.Event)
+	require.Equal(t, (<-chan api.Event)(raw), redactEvents(raw, nil))
+}
+
+func TestExpandEnv(t *testing.T) {
+	config := &api.Config{
+		Env:    map[string]string{"AGENT_ID": "{{.SandboxID}}-{{.Label \"task\"}}", "PLAIN": "x"},
+		Labels: map[string]string{"task": "review"},
+	}
+	require.NoError(t, expandEnv("vm-abc", config))
+	require.Equal(t, map[string]string{"AGENT_ID": "vm-abc-review", "PLAIN": "x"}, config.Env)
+
+	config = &api.Config{Env: map[string]string{"BAD": "{{.Label \"missing\"}}"}}
+	err := expandEnv("vm-abc", config)
+	require.ErrorIs(t, err, api.ErrTemplate)
+	require.Equal(t, "{{.Label \"missing\"}}", config.Env["BAD"])
+}
+
+type sharedDirTestBackend struct {
+	vm.Backend
+	shared bool
+}
+
+func (b sharedDirTestBackend) Name() string             { return "test" }
+func (b sharedDirTestBackend) SupportsSharedDirs() bool { return b.shared }
+
+func TestSharedDirs(t *testing.T) {
+	config := &api.Config{
+		VFS: &api.VFSConfig{
+			Mounts: map[string]api.MountConfig{
+				"/workspace":         {Type: "memory"},
+				"/workspace/src/":    {Type: "real_fs", HostPath: "/src", Backend: api.MountBackendVirtioFS, Readonly: true},
+				"/workspace/modules": {Type: "real_fs", HostPath: "/modules", Backend: api.MountBackendVirtioFS},
+				"/workspace/out":     {Type: "real_fs", HostPath: "/out"},
+			},
+		},
+	}
+
+	dirs := sharedDirs(config, sharedDirTestBackend{shared: true})
+	require.Equal(t, []vm.SharedDir{
+		{Tag: "share0", HostPath: "/modules", GuestMount: "/workspace/modules"},
+		{Tag: "share1", HostPath: "/src", GuestMount: "/workspace/src", ReadOnly: true},
+	}, dirs)
+
+	require.Empty(t, sharedDirs(config, sharedDirTestBackend{}))
+}
+
+func TestPrepareOverlayUppers(t *testing.T) {
+	stateMgr := state.NewManagerWithDir(t.TempDir())
+	explicit := &api.MountConfig{Type: "memory"}
+	config := &api.Config{
+		VFS: &api.VFSConfig{
+			Mounts: map[string]api.MountConfig{
+				"/workspace/repo":  {Type: "overlay", HostPath: "/src/repo"},
+				"/workspace/other": {Type: "overlay", HostPath: "/src/other", Upper: explicit},
+				"/workspace/data":  {Type: "real_fs", HostPath: "/data"},
+			},
+		},
+	}
+
+	require.NoError(t, prepareOverlayUppers(config, stateMgr, "vm-test"))
+
+	upper := config.VFS.Mounts["/workspace/repo"].Upper
+	require.NotNil(t, upper)
+	require.Equal(t, "real_fs", upper.Type)
+	require.Equal(t, stateMgr.OverlayDir("vm-test", "/workspace/repo"), upper.HostPath)
+	require.DirExists(t, upper.HostPath)
+	require.Same(t, explicit, config.VFS.Mounts["/workspace/other"].Upper)
+	require.Nil(t, config.VFS.Mounts["/workspace/data"].Upper)
+}
+
+func TestPrepareCacheMounts(t *testing.T) {
+	store := caches.NewStore(t.TempDir())
+	config := &api.Config{VFS: &api.VFSConfig{Mounts: map[string]api.MountConfig{
+		"/workspace/.cache/pip": {Type: "cache", Cache: &api.CacheMount{Name: "pip"}},
+	}}}
+
+	require.NoError(t, prepareCacheMounts(config, store))
+	require.Equal(t, store.TreeDir("pip"), config.VFS.Mounts["/workspace/.cache/pip"].HostPath)
+	require.DirExists(t, store.TreeDir("pip"))
+
+	config.VFS.Mounts["/workspace/bad"] = api.MountConfig{Type: "cache", Cache: &api.CacheMount{Name: "../x"}}
+	require.ErrorIs(t, prepareCacheMounts(config, store), caches.ErrInvalidName)
+}
+
+func TestWorkspaceSnapshotRoundTrip(t *testing.T) {
+	store := workspaces.NewStore(t.TempDir())
+	router := vfs.NewMountRouter(map[string]vfs.Provider{"/workspace": vfs.NewMemoryProvider()})
+	require.NoError(t, writeFile(router, "/workspace/notes.md", []byte("step 3"), 0644))
+
+	snap, err := snapshotWorkspace(router, store, "vm-test", "/workspace", "resume")
+	require.NoError(t, err)
+	assert.Equal(t, "vm-test", snap.SandboxID)
+
+	config := &api.Config{VFS: &api.VFSConfig{WorkspaceFrom: "resume"}}
+	require.NoError(t, prepareWorkspaceFrom(config, store))
+	mount := config.VFS.Mounts["/workspace"]
+	assert.Equal(t, "overlay", mount.Type)
+	assert.Equal(t, store.FilesDir("resume"), mount.HostPath)
+
+	seeded := vfs.NewMountRouter(buildVFSProviders(config, "/workspace"))
+	data, err := readFile(seeded, "/workspace/notes.md")
+	require.NoError(t, err)
+	assert.Equal(t, "step 3", string(data))
+}
+
+func TestPrepareWorkspaceFromErrors(t *testing.T) {
+	store := workspaces.NewStore(t.TempDir())
+
+	config := &api.Config{VFS: &api.VFSConfig{WorkspaceFrom: "missing"}}
+	require.ErrorIs(t, prepareWorkspaceFrom(config, store), workspaces.ErrNotFound)
+
+	router := vfs.NewMountRouter(map[string]vfs.Provider{"/workspace": vfs.NewMemoryProvider()})
+	_, err := snapshotWorkspace(router, store, "vm-test", "/workspace", "snap")
+	require.NoError(t, err)
+
+	config = &api.Config{VFS: &api.VFSConfig{
+		WorkspaceFrom: "snap",
+		Mounts:        map[string]api.MountConfig{"/workspace": {Type: "real_fs", HostPath: "/src"}},
+	}}
+	require.ErrorIs(t, prepareWorkspaceFrom(config, store), ErrWorkspaceFrom)
+}
+
+func TestFileWatcher(t *testing.T) {
+	router := vfs.NewMountRouter(map[string]vfs.Provider{"/workspace": vfs.NewMemoryProvider()})
+	events := make(chan api.Event, 10)
+	w := newFileWatcher(events, router)
+
+	require.NoError(t, router.Mkdir("/workspace/tmp", 0755))
+	require.ErrorIs(t, w.watch("out"), ErrWatchPath)
+	require.NoError(t, w.watch("/workspace/out"))
+	require.NoError(t, router.Mkdir("/workspace/out", 0755))
+	require.NoError(t, writeFile(router, "/workspace/out/results.json", []byte("{}"), 0644))
+	require.NoError(t, writeFile(router, "/workspace/tmp/scratch", []byte("x"), 0644))
+
+	w.close()
+	w.close()
+	// Changes after close are dropped, not sent on the closed channel.
+	require.NoError(t, router.Remove("/workspace/out/results.json"))
+
+	var got []api.FileEvent
+	for ev := range events {
+		assert.Equal(t, "file", ev.Type)
+		got = append(got, *ev.File)
+	}
+	assert.Equal(t, []api.FileEvent{
+		{Op: vfs.ChangeCreate, Path: "/workspace/out"},
+		{Op: vfs.ChangeCreate, Path: "/workspace/out/results.json"},
+		{Op: vfs.ChangeModify, Path: "/workspace/out/results.json", Size: 2},
+	}, got)
+}
+
+func TestAddMountOverlayAndRejections(t *testing.T) {
+	stateMgr := state.NewManagerWithDir(t.TempDir())
+	config := &api.Config{}
+	root := vfs.NewMountRouter(map[string]vfs.Provider{"/workspace": vfs.NewMemoryProvider()})
+
+	hostDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, "seed.txt"), []byte("seed"), 0644))
+	require.NoError(t, addMount(root, config, stateMgr, "vm-1", "/workspace/src/", api.MountConfig{Type: "overlay", HostPath: hostDir}))
+
+	require.NoError(t, writeFile(root, "/workspace/src/seed.txt", []byte("changed"), 0644))
+	got, err := os.ReadFile(filepath.Join(hostDir, "seed.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "seed", string(got), "overlay writes go to the upper layer")
+	upper := config.VFS.Mounts["/workspace/src"].Upper
+	require.NotNil(t, upper)
+	assert.Equal(t, stateMgr.OverlayDir("vm-1", "/workspace/src"), upper.HostPath)
+
+	for name, tc := range map[string]struct {
+		path  string
+		mount api.MountConfig
+	}{
+		"workspace root":   {"/workspace", api.MountConfig{Type: "memory"}},
+		"outside":          {"/etc/data", api.MountConfig{Type: "memory"}},
+		"git":              {"/workspace/repo", api.MountConfig{Type: "git", Git: &api.GitMount{URL: "https://example.com/r.git"}}},
+		"virtiofs":         {"/workspace/fast", api.MountConfig{Type: "real_fs", HostPath: hostDir, Backend: api.MountBackendVirtioFS}},
+		"missing host dir": {"/workspace/gone", api.MountConfig{Type: "real_fs", HostPath: filepath.Join(hostDir, "gone")}},
+		"already mounted":  {"/workspace/src", api.MountConfig{Type: "memory"}},
+	} {
+		err := addMount(root, config, stateMgr, "vm-1", tc.path, tc.mount)
+		assert.ErrorIs(t, err, ErrAddMount, name)
+	}
+
+	require.ErrorIs(t, removeMount(root, config, stateMgr, "vm-1", "/workspace"), ErrRemoveMount)
+	require.NoError(t, removeMount(root, config, stateMgr, "vm-1", "/workspace/src"))
+	assert.Empty(t, config.VFS.Mounts)
+}
@@ -8,16 +8,26 @@ import (
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/jingkaihe/matchlock/internal/errx"
 	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/caches"
+	"github.com/jingkaihe/matchlock/pkg/delta"
+	"github.com/jingkaihe/matchlock/pkg/disks"
+	"github.com/jingkaihe/matchlock/pkg/image"
 	sandboxnet "github.com/jingkaihe/matchlock/pkg/net"
+	"github.com/jingkaihe/matchlock/pkg/objstore"
 	"github.com/jingkaihe/matchlock/pkg/policy"
+	"github.com/jingkaihe/matchlock/pkg/redact"
 	"github.com/jingkaihe/matchlock/pkg/state"
+	"github.com/jingkaihe/matchlock/pkg/trust"
 	"github.com/jingkaihe/matchlock/pkg/vfs"
 	"github.com/jingkaihe/matchlock/pkg/vm"
 	"github.com/jingkaihe/matchlock/pkg/vm/darwin"
+	"github.com/jingkaihe/matchlock/pkg/workspaces"
 )
 
 type Sandbox struct {
@@ -29,12 +39,36 @@ type Sandbox struct {
 	vfsRoot     *vfs.MountRouter
 	vfsServer   *vfs.VFSServer
 	vfsStopFunc func()
+	vfsMetrics  *vfs.Metrics
 	events      chan api.Event
+	files       *fileWatcher
+	redacted    <-chan api.Event // events as handed out by Events
+	redactor    *redact.Redactor
+	frozen      bool    // network frozen by FreezeNetwork; guarded by restartMu
+	mirror      *Mirror // command output for read-only watchers
+	metrics     *sandboxnet.NetworkMetrics
+	budget      *sandboxnet.EgressBudget
+	metricsStop func()
 	stateMgr    *state.Manager
 	caPool      *sandboxnet.CAPool
 	subnetInfo  *state.SubnetInfo
 	subnetAlloc *state.SubnetAllocator
 	workspace   string
+
+	// Kept so Restart can boot the guest again with the same identity.
+	backend      vm.Backend
+	vmConfig     *vm.VMConfig
+	netConfig    *sandboxnet.Config
+	sourceRootfs string
+	diskSizeMB   int64
+	releaseDisks func() // unlocks the data disks
+
+	// restartMu serializes Restart and Close; machineMu guards machine,
+	// which Restart replaces.
+	restartMu sync.Mutex
+	machineMu sync.RWMutex
+	// mountMu serializes AddMount and RemoveMount, which change config.
+	mountMu sync.Mutex
 }
 
 type Options struct {
@@ -50,6 +84,30 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 	if opts.RootfsPath == "" {
 		return nil, fmt.Errorf("RootfsPath is required")
 	}
+	format, err := image.DetectRootfsFormat(opts.RootfsPath)
+	if err != nil {
+		return nil, errx.Wrap(ErrRootfsFormat, err)
+	}
+	if format.ReadOnly() {
+		return nil, errx.With(ErrRootfsFormat, ": %s images are only supported on Linux; rebuild with --rootfs-format ext4", format)
+	}
+
+	kernelPath := opts.KernelPath
+	if kernelPath == "" {
+		kernelPath = DefaultKernelPath()
+	}
+	if err := verifyAsset(trust.AssetKernel, kernelPath); err != nil {
+		return nil, errx.Wrap(ErrUntrustedAsset, err)
+	}
+	initramfsPath := opts.InitramfsPath
+	if initramfsPath == "" {
+		initramfsPath = DefaultInitramfsPath()
+	}
+	if initramfsPath != "" {
+		if err := verifyAsset(trust.AssetInitramfs, initramfsPath); err != nil {
+			return nil, errx.Wrap(ErrUntrustedAsset, err)
+		}
+	}
 
 	id := "vm-" + uuid.New().String()[:8]
 	workspace := config.GetWorkspace()
@@ -58,6 +116,28 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 	if err := stateMgr.Register(id, config); err != nil {
 		return nil, errx.Wrap(ErrRegisterState, err)
 	}
+	// Templates are stored as given, so a clone renders them afresh.
+	if err := expandEnv(id, config); err != nil {
+		stateMgr.Unregister(id)
+		return nil, errx.Wrap(ErrExpandEnv, err)
+	}
+	if err := prepareWorkspaceFrom(config, workspaces.NewStore("")); err != nil {
+		stateMgr.Unregister(id)
+		return nil, err
+	}
+	if err := prepareOverlayUppers(config, stateMgr, id); err != nil {
+		stateMgr.Unregister(id)
+		return nil, err
+	}
+	if err := prepareGitMounts(ctx, config, stateMgr, id); err != nil {
+		stateMgr.Unregister(id)
+		return nil, err
+	}
+	if err := prepareCacheMounts(config, caches.NewStore("")); err != nil {
+		stateMgr.Unregister(id)
+		return nil, err
+	}
+	prepareEncryptedMounts(config, stateMgr, id)
 
 	subnetAlloc := state.NewSubnetAllocator()
 	subnetInfo, err := subnetAlloc.Allocate(id)
@@ -68,22 +148,22 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 
 	backend := darwin.NewDarwinBackend()
 
-	kernelPath := opts.KernelPath
-	if kernelPath == "" {
-		kernelPath = DefaultKernelPath()
-	}
-	initramfsPath := opts.InitramfsPath
-	if initramfsPath == "" {
-		initramfsPath = DefaultInitramfsPath()
-	}
 	rootfsPath := opts.RootfsPath
 
 	// Determine if we need network interception (calculated before VM creation)
-	needsInterception := config.Network != nil && (len(config.Network.AllowedHosts) > 0 || len(config.Network.Secrets) > 0)
+	needsInterception := config.Network.NeedsInterception()
 
 	// Create CAPool early so we can inject the cert into rootfs before the VM sees the disk
 	var caPool *sandboxnet.CAPool
+	var upstreamProxy *sandboxnet.UpstreamProxy
 	if needsInterception {
+		warnInsecureUpstreams(config.Network)
+		upstreamProxy, err = sandboxnet.ResolveUpstreamProxy(config.Network)
+		if err != nil {
+			subnetAlloc.Release(id)
+			stateMgr.Unregister(id)
+			return nil, errx.Wrap(ErrResolveUpstreamProxy, err)
+		}
 		caPool, err = sandboxnet.NewCAPool()
 		if err != nil {
 			subnetAlloc.Release(id)
@@ -100,9 +180,17 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 		stateMgr.Unregister(id)
 		return nil, errx.Wrap(ErrCopyRootfs, err)
 	}
-	var diskSizeMB int64
+	var diskSizeMB, freeSpaceMB int64
 	if config.Resources != nil {
 		diskSizeMB = int64(config.Resources.DiskSizeMB)
+		freeSpaceMB = int64(config.Resources.RootfsFreeSpaceMB)
+	}
+	diskSizeMB, err = rootDiskSizeMB(prebuiltRootfs, false, diskSizeMB, freeSpaceMB)
+	if err != nil {
+		os.Remove(prebuiltRootfs)
+		subnetAlloc.Release(id)
+		stateMgr.Unregister(id)
+		return nil, errx.Wrap(ErrPrepareRootfs, err)
 	}
 	if err := prepareRootfs(prebuiltRootfs, diskSizeMB); err != nil {
 		os.Remove(prebuiltRootfs)
@@ -134,6 +222,48 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 			ReadOnly:   d.ReadOnly,
 		})
 	}
+	dataDisks, releaseDisks, err := attachDataDisks(config, disks.NewStore(""))
+	if err != nil {
+		subnetAlloc.Release(id)
+		stateMgr.Unregister(id)
+		return nil, err
+	}
+	// The disks stay locked for as long as the sandbox lives; Close
+	// releases them.
+	created := false
+	defer func() {
+		if !created {
+			releaseDisks()
+		}
+	}()
+	extraDisks = append(extraDisks, dataDisks...)
+	swapDisks, zramSwapMB, err := prepareSwap(config.Resources, stateMgr.SwapPath(id))
+	if err != nil {
+		subnetAlloc.Release(id)
+		stateMgr.Unregister(id)
+		return nil, errx.Wrap(ErrSwapConfig, err)
+	}
+	extraDisks = append(extraDisks, swapDisks...)
+
+	if config.Network != nil && len(config.Network.Secrets) > 0 {
+		hostSet := make(map[string]bool)
+		for _, h := range config.Network.AllowedHosts {
+			hostSet[h] = true
+		}
+		for _, secret := range config.Network.Secrets {
+			for _, h := range secret.Hosts {
+				if !hostSet[h] {
+					config.Network.AllowedHosts = append(config.Network.AllowedHosts, h)
+					hostSet[h] = true
+				}
+			}
+		}
+	}
+
+	allowNoInterceptHosts(config.Network)
+
+	policyEngine := policy.NewEngine(config.Network)
+	redactor := newRedactor(config)
 
 	vmConfig := &vm.VMConfig{
 		ID:              id,
@@ -152,7 +282,10 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 		Privileged:      config.Privileged,
 		PrebuiltRootfs:  prebuiltRootfs,
 		ExtraDisks:      extraDisks,
+		SharedDirs:      sharedDirs(config, backend),
+		ZramSwapMB:      zramSwapMB,
 		DNSServers:      config.Network.GetDNSServers(),
+		LogFilter:       logFilter(redactor),
 	}
 
 	machine, err := backend.Create(ctx, vmConfig)
@@ -167,27 +300,17 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 
 	darwinMachine := machine.(*darwin.DarwinMachine)
 
-	if config.Network != nil && len(config.Network.Secrets) > 0 {
-		hostSet := make(map[string]bool)
-		for _, h := range config.Network.AllowedHosts {
-			hostSet[h] = true
-		}
-		for _, secret := range config.Network.Secrets {
-			for _, h := range secret.Hosts {
-				if !hostSet[h] {
-					config.Network.AllowedHosts = append(config.Network.AllowedHosts, h)
-					hostSet[h] = true
-				}
-			}
-		}
-	}
-
-	policyEngine := policy.NewEngine(config.Network)
 	events := make(chan api.Event, 100)
 
+	var sb *Sandbox
+	budget := newEgressBudget(config.Network, id, func() vm.Machine { return sb.Machine() })
+
 	var netStack *sandboxnet.NetworkStack
+	var netConfig *sandboxnet.Config
+	var metrics *sandboxnet.NetworkMetrics
 
 	if needsInterception {
+		metrics = sandboxnet.NewNetworkMetrics()
 		networkFile := darwinMachine.NetworkFile()
 		if networkFile == nil {
 			machine.Close(ctx)
@@ -196,7 +319,7 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 			return nil, ErrNetworkFile
 		}
 
-		netStack, err = sandboxnet.NewNetworkStack(&sandboxnet.Config{
+		netConfig = &sandboxnet.Config{
 			File:       networkFile,
 			GatewayIP:  subnetInfo.GatewayIP,
 			GuestIP:    subnetInfo.GuestIP,
@@ -205,7 +328,13 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 			Events:     events,
 			CAPool:     caPool,
 			DNSServers: config.Network.GetDNSServers(),
-		})
+			Shape:      config.Network.Shape,
+			Metrics:    metrics,
+			Limiter:    sandboxnet.NewConnLimiter(config.Network.MaxConnections, config.Network.MaxConnectionsPerMinute),
+			Budget:     budget,
+			Upstream:   upstreamProxy,
+		}
+		netStack, err = sandboxnet.NewNetworkStack(netConfig)
 		if err != nil {
 			machine.Close(ctx)
 			subnetAlloc.Release(id)
@@ -216,20 +345,76 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 
 	vfsProviders := buildVFSProviders(config, workspace)
 	vfsRoot := vfs.NewMountRouter(vfsProviders)
+	files := newFileWatcher(events, vfsRoot)
 
 	vfsServer := vfs.NewVFSServer(vfsRoot)
+	vfsMetrics, closeSlowLog := newVFSMetrics(config, stateMgr, id)
+	vfsServer.SetMetrics(vfsMetrics)
 
-	vfsListener, err := darwinMachine.SetupVFSListener()
+	vfsStopFunc, err := serveVFS(darwinMachine, vfsServer)
 	if err != nil {
 		if netStack != nil {
 			netStack.Close()
 		}
+		closeSlowLog()
 		machine.Close(ctx)
 		subnetAlloc.Release(id)
 		stateMgr.Unregister(id)
 		return nil, errx.Wrap(ErrVFSListener, err)
 	}
 
+	stopFlusher := startMetricsFlusher(stateMgr, id, metrics, budget, policyEngine, vfsRoot, vfsMetrics)
+	metricsStop := func() {
+		stopFlusher()
+		closeSlowLog()
+	}
+	if metrics != nil {
+		watchSecretLeaks(config.Network, id, metrics, func() vm.Machine { return sb.Machine() })
+	}
+
+	sb = &Sandbox{
+		id:          id,
+		config:      config,
+		machine:     machine,
+		netStack:    netStack,
+		policy:      policyEngine,
+		vfsRoot:     vfsRoot,
+		vfsServer:   vfsServer,
+		vfsStopFunc: vfsStopFunc,
+		vfsMetrics:  vfsMetrics,
+		events:      events,
+		files:       files,
+		redacted:    redactEvents(events, redactor),
+		redactor:    redactor,
+		mirror:      NewMirror(),
+		metrics:     metrics,
+		budget:      budget,
+		metricsStop: metricsStop,
+		stateMgr:    stateMgr,
+		caPool:      caPool,
+		subnetInfo:  subnetInfo,
+		subnetAlloc: subnetAlloc,
+		workspace:   workspace,
+
+		backend:      backend,
+		vmConfig:     vmConfig,
+		netConfig:    netConfig,
+		sourceRootfs: rootfsPath,
+		diskSizeMB:   diskSizeMB,
+		releaseDisks: releaseDisks,
+	}
+	created = true
+	return sb, nil
+}
+
+// serveVFS accepts guest-fused connections on the machine's VFS vsock port
+// and returns a function that stops accepting them.
+func serveVFS(machine *darwin.DarwinMachine, vfsServer *vfs.VFSServer) (func(), error) {
+	vfsListener, err := machine.SetupVFSListener()
+	if err != nil {
+		return nil, err
+	}
+
 	vfsStopCh := make(chan struct{})
 	vfsStopFunc := func() {
 		close(vfsStopCh)
@@ -253,38 +438,29 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 			}
 		}
 	}()
-
-	return &Sandbox{
-		id:          id,
-		config:      config,
-		machine:     machine,
-		netStack:    netStack,
-		policy:      policyEngine,
-		vfsRoot:     vfsRoot,
-		vfsServer:   vfsServer,
-		vfsStopFunc: vfsStopFunc,
-		events:      events,
-		stateMgr:    stateMgr,
-		caPool:      caPool,
-		subnetInfo:  subnetInfo,
-		subnetAlloc: subnetAlloc,
-		workspace:   workspace,
-	}, nil
+	return vfsStopFunc, nil
 }
 
-func (s *Sandbox) ID() string                 { return s.id }
-func (s *Sandbox) Config() *api.Config        { return s.config }
-func (s *Sandbox) Workspace() string          { return s.workspace }
-func (s *Sandbox) Machine() vm.Machine        { return s.machine }
-func (s *Sandbox) Policy() *policy.Engine     { return s.policy }
-func (s *Sandbox) CAPool() *sandboxnet.CAPool { return s.caPool }
+func (s *Sandbox) ID() string                      { return s.id }
+func (s *Sandbox) Config() *api.Config             { return s.config }
+func (s *Sandbox) Workspace() string               { return s.workspace }
+func (s *Sandbox) TemplateData() *api.TemplateData { return templateData(s.id, s.config) }
+func (s *Sandbox) Mirror() *Mirror                 { return s.mirror }
+func (s *Sandbox) Policy() *policy.Engine          { return s.policy }
+func (s *Sandbox) CAPool() *sandboxnet.CAPool      { return s.caPool }
+
+func (s *Sandbox) Machine() vm.Machine {
+	s.machineMu.RLock()
+	defer s.machineMu.RUnlock()
+	return s.machine
+}
 
 func (s *Sandbox) Start(ctx context.Context) error {
-	return s.machine.Start(ctx)
+	return s.Machine().Start(ctx)
 }
 
 func (s *Sandbox) Stop(ctx context.Context) error {
-	return s.machine.Stop(ctx)
+	return s.Machine().Stop(ctx)
 }
 
 func (s *Sandbox) PrepareExecEnv() *api.ExecOptions {
@@ -292,13 +468,29 @@ func (s *Sandbox) PrepareExecEnv() *api.ExecOptions {
 }
 
 func (s *Sandbox) Exec(ctx context.Context, command string, opts *api.ExecOptions) (*api.ExecResult, error) {
-	return execCommand(ctx, s.machine, s.config, s.caPool, s.policy, command, opts)
+	return execCommand(ctx, s.Machine(), s.config, s.caPool, s.policy, s.redactor, s.mirror, command, opts)
 }
 
 func (s *Sandbox) WriteFile(ctx context.Context, path string, content []byte, mode uint32) error {
 	return writeFile(s.vfsRoot, path, content, mode)
 }
 
+func (s *Sandbox) MkdirAll(ctx context.Context, path string, mode uint32) error {
+	return mkdirAll(s.vfsRoot, path, mode)
+}
+
+func (s *Sandbox) RemoveAll(ctx context.Context, path string) error {
+	return s.vfsRoot.RemoveAll(path)
+}
+
+func (s *Sandbox) FileSignature(ctx context.Context, path string, blockSize int) (*delta.Signature, error) {
+	return fileSignature(s.vfsRoot, path, blockSize)
+}
+
+func (s *Sandbox) PatchFile(ctx context.Context, path string, blockSize int, ops []delta.Op, mode uint32, checksum string) error {
+	return patchFile(s.vfsRoot, path, blockSize, ops, mode, checksum)
+}
+
 func (s *Sandbox) ReadFile(ctx context.Context, path string) ([]byte, error) {
 	return readFile(s.vfsRoot, path)
 }
@@ -307,15 +499,263 @@ func (s *Sandbox) ReadFileTo(ctx context.Context, path string, w io.Writer) (int
 	return readFileTo(s.vfsRoot, path, w)
 }
 
+// WriteFileFrom writes r to a file in the VFS, replacing the file only once
+// r has been read to its end.
+func (s *Sandbox) WriteFileFrom(ctx context.Context, path string, r io.Reader, mode uint32) (int64, error) {
+	return writeFileFrom(s.vfsRoot, path, r, mode)
+}
+
 func (s *Sandbox) ListFiles(ctx context.Context, path string) ([]api.FileInfo, error) {
 	return listFiles(s.vfsRoot, path)
 }
 
+// Stat returns the metadata of a file or directory in the VFS.
+func (s *Sandbox) Stat(ctx context.Context, path string) (*api.FileInfo, error) {
+	return statFile(s.vfsRoot, path)
+}
+
+// Remove removes a file or empty directory from the VFS.
+func (s *Sandbox) Remove(ctx context.Context, path string) error {
+	return s.vfsRoot.Remove(path)
+}
+
+// Chmod changes the permission bits of a file or directory in the VFS.
+func (s *Sandbox) Chmod(ctx context.Context, path string, mode uint32) error {
+	return s.vfsRoot.Chmod(path, os.FileMode(mode))
+}
+
+// Chown changes the owner of a file or directory as the guest sees it,
+// which a mount's idmap maps to an owner on the host.
+func (s *Sandbox) Chown(ctx context.Context, path string, uid, gid int) error {
+	return s.vfsRoot.Chown(path, uid, gid)
+}
+
+// Rename moves a file or directory within the VFS.
+func (s *Sandbox) Rename(ctx context.Context, oldPath, newPath string) error {
+	return s.vfsRoot.Rename(oldPath, newPath)
+}
+
+// CopyIn extracts the tar stream r into the directory path in the VFS.
+func (s *Sandbox) CopyIn(ctx context.Context, path string, r io.Reader) error {
+	return vfs.ExtractTar(s.vfsRoot, path, r)
+}
+
+// CopyOut writes the tree at path in the VFS to w as a tar stream.
+func (s *Sandbox) CopyOut(ctx context.Context, path string, w io.Writer) error {
+	return vfs.WriteTar(s.vfsRoot, path, w)
+}
+
+func (s *Sandbox) NetworkMetrics() []api.HostMetrics {
+	return s.metrics.Snapshot()
+}
+
+func (s *Sandbox) EgressUsage() *api.EgressUsage {
+	return s.budget.Usage()
+}
+
+func (s *Sandbox) SecretUsage() []api.SecretUsage {
+	return s.policy.SecretUsage()
+}
+
+func (s *Sandbox) WatchFiles(path string) error {
+	return s.files.watch(path)
+}
+
+func (s *Sandbox) MountUsage() []api.MountUsage {
+	return mountUsage(s.vfsRoot)
+}
+
+func (s *Sandbox) VFSMetrics() []api.MountMetrics {
+	return mountMetrics(s.vfsMetrics)
+}
+
+func (s *Sandbox) UpdateSecret(name, value string) error {
+	return updateSecret(s.policy, s.redactor, name, value)
+}
+
+// FreezeNetwork cuts off all of the guest's network egress, including
+// connections already open, while leaving the VM running for inspection.
+// The freeze lasts for the life of the sandbox, across restarts. Sandboxes
+// without a network policy use the Virtualization framework's NAT, which
+// cannot be cut off.
+func (s *Sandbox) FreezeNetwork() error {
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	if s.netConfig == nil {
+		return ErrFreezeUnsupported
+	}
+	if s.netStack != nil {
+		s.netStack.Freeze()
+	}
+	s.frozen = true
+	return nil
+}
+
+func (s *Sandbox) NetworkViolations() []api.NetworkViolation {
+	return redactViolations(s.metrics.Violations(), s.redactor)
+}
+
+// AddMount mounts a volume in the workspace of the running sandbox, without
+// a restart.
+func (s *Sandbox) AddMount(guestPath string, mount api.MountConfig) error {
+	s.mountMu.Lock()
+	defer s.mountMu.Unlock()
+	return addMount(s.vfsRoot, s.config, s.stateMgr, s.id, guestPath, mount)
+}
+
+// RemoveMount unmounts a volume from the running sandbox. Files the guest
+// still has open on it stay usable until closed.
+func (s *Sandbox) RemoveMount(guestPath string) error {
+	s.mountMu.Lock()
+	defer s.mountMu.Unlock()
+	return removeMount(s.vfsRoot, s.config, s.stateMgr, s.id, guestPath)
+}
+
+// SnapshotWorkspace saves the current workspace files as the named
+// workspace snapshot, for seeding later sandboxes with VFS.WorkspaceFrom.
+func (s *Sandbox) SnapshotWorkspace(name string) (*workspaces.Snapshot, error) {
+	return snapshotWorkspace(s.vfsRoot, workspaces.NewStore(""), s.id, s.config.GetWorkspace(), name)
+}
+
+func (s *Sandbox) Snapshot(ctx context.Context, tag string) error {
+	return snapshotRootfs(ctx, s.Machine(), s.config, tag)
+}
+
+func (s *Sandbox) RecordExit(ctx context.Context, exitCode int) error {
+	return recordExit(ctx, s.Machine(), s.stateMgr, s.id, exitCode)
+}
+
+// Restart shuts the guest down and boots it again with the same
+// configuration, mounts and network identity. The root disk is kept unless
+// opts.FreshDisk is set.
+func (s *Sandbox) Restart(ctx context.Context, opts *RestartOptions) error {
+	if opts == nil {
+		opts = &RestartOptions{}
+	}
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	if s.backend == nil {
+		return ErrRestartUnavailable
+	}
+
+	old := s.Machine()
+	syncGuest(ctx, old)
+
+	// The machine deletes its rootfs copy when it stops, so keep a link to
+	// it first and hand that to the next machine.
+	var rootfs string
+	if !opts.FreshDisk {
+		var err error
+		if rootfs, err = keepRootfs(old.RootfsPath()); err != nil {
+			return errx.Wrap(ErrCopyRootfs, err)
+		}
+	}
+
+	if s.vfsStopFunc != nil {
+		s.vfsStopFunc()
+		s.vfsStopFunc = nil
+	}
+	if s.netStack != nil {
+		s.netStack.Close()
+		s.netStack = nil
+	}
+	if err := old.Close(ctx); err != nil {
+		os.Remove(rootfs)
+		return errx.Wrap(ErrMachineClose, err)
+	}
+
+	if opts.FreshDisk {
+		var err error
+		if rootfs, err = s.freshRootfs(); err != nil {
+			return err
+		}
+	}
+
+	vmConfig := *s.vmConfig
+	vmConfig.PrebuiltRootfs = rootfs
+	machine, err := s.backend.Create(ctx, &vmConfig)
+	if err != nil {
+		os.Remove(rootfs)
+		return errx.Wrap(ErrCreateVM, err)
+	}
+	s.machineMu.Lock()
+	s.machine = machine
+	s.machineMu.Unlock()
+
+	darwinMachine := machine.(*darwin.DarwinMachine)
+	if s.netConfig != nil {
+		networkFile := darwinMachine.NetworkFile()
+		if networkFile == nil {
+			return ErrNetworkFile
+		}
+		s.netConfig.File = networkFile
+		netStack, err := sandboxnet.NewNetworkStack(s.netConfig)
+		if err != nil {
+			return errx.Wrap(ErrNetworkStack, err)
+		}
+		if s.frozen {
+			netStack.Freeze()
+		}
+		s.netStack = netStack
+	}
+
+	vfsStopFunc, err := serveVFS(darwinMachine, s.vfsServer)
+	if err != nil {
+		return errx.Wrap(ErrVFSListener, err)
+	}
+	s.vfsStopFunc = vfsStopFunc
+
+	if err := machine.Start(ctx); err != nil {
+		return errx.Wrap(ErrStartVM, err)
+	}
+	return nil
+}
+
+// keepRootfs hard-links path under a new temp name so it outlives the
+// machine that owns it, copying it when linking is not possible.
+func keepRootfs(path string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "matchlock-rootfs-*.ext4")
+	if err != nil {
+		return "", err
+	}
+	kept := f.Name()
+	f.Close()
+	os.Remove(kept)
+	if err := os.Link(path, kept); err == nil {
+		return kept, nil
+	}
+	return darwin.CopyRootfsToTemp(path)
+}
+
+// freshRootfs prepares a new copy of the image for the sandbox's next boot.
+func (s *Sandbox) freshRootfs() (string, error) {
+	rootfs, err := darwin.CopyRootfsToTemp(s.sourceRootfs)
+	if err != nil {
+		return "", errx.Wrap(ErrCopyRootfs, err)
+	}
+	if err := prepareRootfs(rootfs, s.diskSizeMB); err != nil {
+		os.Remove(rootfs)
+		return "", errx.Wrap(ErrPrepareRootfs, err)
+	}
+	if s.caPool != nil {
+		if err := injectConfigFileIntoRootfs(rootfs, "/etc/ssl/certs/matchlock-ca.crt", s.caPool.CACertPEM()); err != nil {
+			os.Remove(rootfs)
+			return "", errx.Wrap(ErrInjectCACert, err)
+		}
+	}
+	return rootfs, nil
+}
+
 func (s *Sandbox) Events() <-chan api.Event {
-	return s.events
+	return s.redacted
 }
 
 func (s *Sandbox) Close(ctx context.Context) error {
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
 	var errs []error
 
 	if s.vfsStopFunc != nil {
@@ -324,16 +764,23 @@ func (s *Sandbox) Close(ctx context.Context) error {
 	if s.netStack != nil {
 		s.netStack.Close()
 	}
+	if s.metricsStop != nil {
+		s.metricsStop()
+	}
 
 	if s.subnetAlloc != nil {
 		s.subnetAlloc.Release(s.id)
 	}
 
-	close(s.events)
+	s.files.close()
+	s.mirror.Close()
+	closeMounts(s.vfsRoot)
 	s.stateMgr.Unregister(s.id)
-	if err := s.machine.Close(ctx); err != nil {
+	if err := s.Machine().Close(ctx); err != nil {
 		errs = append(errs, errx.Wrap(ErrMachineClose, err))
 	}
+	s.releaseDisks()
+	errs = append(errs, pushGitMounts(ctx, s.config, s.stateMgr, s.id)...)
 
 	if len(errs) > 0 {
 		fmt.Fprintf(os.Stderr, "Warning: cleanup errors: %v\n", errs)
@@ -344,13 +791,45 @@ func (s *Sandbox) Close(ctx context.Context) error {
 func createProvider(mount api.MountConfig) vfs.Provider {
 	switch mount.Type {
 	case "memory":
+		if mount.SizeMB > 0 {
+			return vfs.NewMemoryProviderWithLimit(int64(mount.SizeMB) << 20)
+		}
 		return vfs.NewMemoryProvider()
+	case "encrypted":
+		// HostPath is where the unlinked backing file is created; see
+		// prepareEncryptedMounts.
+		return vfs.NewEncryptedProvider(mount.HostPath)
 	case "real_fs":
-		p := vfs.NewRealFSProvider(mount.HostPath)
+		p := hostDirProvider(mount)
 		if mount.Readonly {
 			return vfs.NewReadonlyProvider(p)
 		}
 		return p
+	case "git":
+		// HostPath is the host-side checkout; see prepareGitMounts.
+		if mount.HostPath == "" {
+			return nil
+		}
+		return vfs.NewRealFSProvider(mount.HostPath)
+	case "cache":
+		// The cache was created by prepareCacheMounts.
+		if mount.Cache == nil {
+			return nil
+		}
+		var p vfs.Provider = caches.NewStore("").Provider(mount.Cache.Name)
+		if mount.Readonly {
+			p = vfs.NewReadonlyProvider(p)
+		}
+		return p
+	case "s3":
+		if mount.S3 == nil {
+			return nil
+		}
+		var p vfs.Provider = vfs.NewObjectStoreProvider(objstore.NewS3Store(*mount.S3), mount.S3.Prefix)
+		if mount.Readonly {
+			p = vfs.NewReadonlyProvider(p)
+		}
+		return p
 	case "overlay":
 		var upper, lower vfs.Provider
 		if mount.Upper != nil {
@@ -360,6 +839,8 @@ func createProvider(mount api.MountConfig) vfs.Provider {
 		}
 		if mount.Lower != nil {
 			lower = createProvider(*mount.Lower)
+		} else if mount.HostPath != "" {
+			lower = vfs.NewReadonlyProvider(hostDirProvider(mount))
 		}
 		if upper != nil && lower != nil {
 			return vfs.NewOverlayProvider(upper, lower)
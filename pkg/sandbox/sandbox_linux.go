@@ -8,16 +8,25 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/jingkaihe/matchlock/internal/errx"
 	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/caches"
+	"github.com/jingkaihe/matchlock/pkg/delta"
+	"github.com/jingkaihe/matchlock/pkg/disks"
+	"github.com/jingkaihe/matchlock/pkg/image"
 	sandboxnet "github.com/jingkaihe/matchlock/pkg/net"
+	"github.com/jingkaihe/matchlock/pkg/objstore"
 	"github.com/jingkaihe/matchlock/pkg/policy"
+	"github.com/jingkaihe/matchlock/pkg/redact"
 	"github.com/jingkaihe/matchlock/pkg/state"
+	"github.com/jingkaihe/matchlock/pkg/trust"
 	"github.com/jingkaihe/matchlock/pkg/vfs"
 	"github.com/jingkaihe/matchlock/pkg/vm"
 	"github.com/jingkaihe/matchlock/pkg/vm/linux"
+	"github.com/jingkaihe/matchlock/pkg/workspaces"
 	"golang.org/x/sys/unix"
 )
 
@@ -33,20 +42,48 @@ type Sandbox struct {
 	config      *api.Config
 	machine     vm.Machine
 	proxy       *sandboxnet.TransparentProxy
+	netStack    *sandboxnet.NetworkStack
 	fwRules     FirewallRules
 	natRules    *sandboxnet.NFTablesNAT
+	freezeRules *sandboxnet.NFTablesFreeze
+	frozen      bool // network frozen by FreezeNetwork; guarded by restartMu
 	policy      *policy.Engine
 	vfsRoot     *vfs.MountRouter
 	vfsServer   *vfs.VFSServer
 	vfsStopFunc func()
+	vfsMetrics  *vfs.Metrics
 	events      chan api.Event
+	files       *fileWatcher
+	redacted    <-chan api.Event // events as handed out by Events
+	redactor    *redact.Redactor
+	mirror      *Mirror // command output for read-only watchers
+	metrics     *sandboxnet.NetworkMetrics
+	budget      *sandboxnet.EgressBudget
+	metricsStop func()
 	stateMgr    *state.Manager
 	tapName     string
 	caPool      *sandboxnet.CAPool
 	subnetInfo  *state.SubnetInfo
 	subnetAlloc *state.SubnetAllocator
 	workspace   string
-	rootfsPath  string
+	rootfsPath  string // writable root disk, or upper disk of a read-only rootfs
+	guestRoot   string // where the guest's / lives on rootfsPath
+
+	// Kept so Restart can boot the guest again with the same identity.
+	backend        vm.Backend
+	vmConfig       *vm.VMConfig
+	netConfig      *sandboxnet.Config
+	sourceRootfs   string
+	readOnlyRootfs bool
+	diskSizeMB     int64
+	releaseDisks   func() // unlocks the data disks
+
+	// restartMu serializes Restart and Close; machineMu guards machine,
+	// which Restart replaces.
+	restartMu sync.Mutex
+	machineMu sync.RWMutex
+	// mountMu serializes AddMount and RemoveMount, which change config.
+	mountMu sync.Mutex
 }
 
 // Options configures sandbox creation.
@@ -66,6 +103,14 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 		return nil, fmt.Errorf("RootfsPath is required")
 	}
 
+	kernelPath := opts.KernelPath
+	if kernelPath == "" {
+		kernelPath = DefaultKernelPath()
+	}
+	if err := verifyAsset(trust.AssetKernel, kernelPath); err != nil {
+		return nil, errx.Wrap(ErrUntrustedAsset, err)
+	}
+
 	id := "vm-" + uuid.New().String()[:8]
 	workspace := config.GetWorkspace()
 
@@ -73,37 +118,80 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 	if err := stateMgr.Register(id, config); err != nil {
 		return nil, errx.Wrap(ErrRegisterState, err)
 	}
+	// Templates are stored as given, so a clone renders them afresh.
+	if err := expandEnv(id, config); err != nil {
+		stateMgr.Unregister(id)
+		return nil, errx.Wrap(ErrExpandEnv, err)
+	}
+	if err := prepareWorkspaceFrom(config, workspaces.NewStore("")); err != nil {
+		stateMgr.Unregister(id)
+		return nil, err
+	}
+	if err := prepareOverlayUppers(config, stateMgr, id); err != nil {
+		stateMgr.Unregister(id)
+		return nil, err
+	}
+	if err := prepareGitMounts(ctx, config, stateMgr, id); err != nil {
+		stateMgr.Unregister(id)
+		return nil, err
+	}
+	if err := prepareCacheMounts(config, caches.NewStore("")); err != nil {
+		stateMgr.Unregister(id)
+		return nil, err
+	}
+	prepareEncryptedMounts(config, stateMgr, id)
 
-	// Create a copy of the rootfs for this VM (copy-on-write if supported)
-	vmRootfsPath := stateMgr.Dir(id) + "/rootfs.ext4"
-	if err := copyRootfs(opts.RootfsPath, vmRootfsPath); err != nil {
+	format, err := image.DetectRootfsFormat(opts.RootfsPath)
+	if err != nil {
 		stateMgr.Unregister(id)
-		return nil, errx.Wrap(ErrCopyRootfs, err)
+		return nil, errx.Wrap(ErrRootfsFormat, err)
+	}
+	readOnlyRootfs := format.ReadOnly()
+	guestRoot := ""
+	if readOnlyRootfs {
+		guestRoot = upperGuestRoot
 	}
 
-	// Inject matchlock components (guest-agent, guest-fused, init, DNS) and resize
-	var diskSizeMB int64
+	// Create the VM's writable root disk: a copy of the rootfs (copy-on-write
+	// if supported) with matchlock components (guest-agent, guest-fused,
+	// init, DNS) injected and resized, or the upper disk of a read-only one
+	vmRootfsPath := stateMgr.Dir(id) + "/rootfs.ext4"
+	var diskSizeMB, freeSpaceMB int64
 	if config.Resources != nil {
 		diskSizeMB = int64(config.Resources.DiskSizeMB)
+		freeSpaceMB = int64(config.Resources.RootfsFreeSpaceMB)
 	}
-	if err := prepareRootfs(vmRootfsPath, diskSizeMB); err != nil {
-		os.Remove(vmRootfsPath)
+	diskSizeMB, err = rootDiskSizeMB(opts.RootfsPath, readOnlyRootfs, diskSizeMB, freeSpaceMB)
+	if err != nil {
 		stateMgr.Unregister(id)
 		return nil, errx.Wrap(ErrPrepareRootfs, err)
 	}
+	if err := prepareRootDisk(opts.RootfsPath, vmRootfsPath, readOnlyRootfs, diskSizeMB); err != nil {
+		os.Remove(vmRootfsPath)
+		stateMgr.Unregister(id)
+		return nil, err
+	}
 
 	// Create CAPool early and inject cert into rootfs before VM creation
-	needsProxy := config.Network != nil && (len(config.Network.AllowedHosts) > 0 || len(config.Network.Secrets) > 0)
+	needsProxy := config.Network.NeedsInterception()
 	var caPool *sandboxnet.CAPool
+	var upstreamProxy *sandboxnet.UpstreamProxy
 	if needsProxy {
+		warnInsecureUpstreams(config.Network)
 		var err error
+		upstreamProxy, err = sandboxnet.ResolveUpstreamProxy(config.Network)
+		if err != nil {
+			os.Remove(vmRootfsPath)
+			stateMgr.Unregister(id)
+			return nil, errx.Wrap(ErrResolveUpstreamProxy, err)
+		}
 		caPool, err = sandboxnet.NewCAPool()
 		if err != nil {
 			os.Remove(vmRootfsPath)
 			stateMgr.Unregister(id)
 			return nil, errx.Wrap(ErrCreateCAPool, err)
 		}
-		if err := injectConfigFileIntoRootfs(vmRootfsPath, "/etc/ssl/certs/matchlock-ca.crt", caPool.CACertPEM()); err != nil {
+		if err := injectConfigFileIntoRootfs(vmRootfsPath, guestRoot+"/etc/ssl/certs/matchlock-ca.crt", caPool.CACertPEM()); err != nil {
 			os.Remove(vmRootfsPath)
 			stateMgr.Unregister(id)
 			return nil, errx.Wrap(ErrInjectCACert, err)
@@ -121,11 +209,6 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 
 	backend := linux.NewLinuxBackend()
 
-	kernelPath := opts.KernelPath
-	if kernelPath == "" {
-		kernelPath = DefaultKernelPath()
-	}
-
 	var extraDisks []vm.DiskConfig
 	for _, d := range config.ExtraDisks {
 		if err := api.ValidateGuestMount(d.GuestMount); err != nil {
@@ -139,34 +222,33 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 			ReadOnly:   d.ReadOnly,
 		})
 	}
-
-	vmConfig := &vm.VMConfig{
-		ID:         id,
-		KernelPath: kernelPath,
-		RootfsPath: vmRootfsPath,
-		CPUs:       config.Resources.CPUs,
-		MemoryMB:   config.Resources.MemoryMB,
-		SocketPath: stateMgr.SocketPath(id) + ".sock",
-		LogPath:    stateMgr.LogPath(id),
-		VsockCID:   3,
-		VsockPath:  stateMgr.Dir(id) + "/vsock.sock",
-		GatewayIP:  subnetInfo.GatewayIP,
-		GuestIP:    subnetInfo.GuestIP,
-		SubnetCIDR: subnetInfo.GatewayIP + "/24",
-		Workspace:  workspace,
-		Privileged: config.Privileged,
-		ExtraDisks: extraDisks,
-		DNSServers: config.Network.GetDNSServers(),
+	dataDisks, releaseDisks, err := attachDataDisks(config, disks.NewStore(""))
+	if err != nil {
+		subnetAlloc.Release(id)
+		stateMgr.Unregister(id)
+		return nil, err
 	}
-
-	machine, err := backend.Create(ctx, vmConfig)
+	// The disks stay locked for as long as the sandbox lives; Close
+	// releases them.
+	created := false
+	defer func() {
+		if !created {
+			releaseDisks()
+		}
+	}()
+	extraDisks = append(extraDisks, dataDisks...)
+	swapDisks, zramSwapMB, err := prepareSwap(config.Resources, stateMgr.SwapPath(id))
 	if err != nil {
 		subnetAlloc.Release(id)
 		stateMgr.Unregister(id)
-		return nil, errx.Wrap(ErrCreateVM, err)
+		return nil, errx.Wrap(ErrSwapConfig, err)
+	}
+	extraDisks = append(extraDisks, swapDisks...)
+	bootRootfs := vmRootfsPath
+	if readOnlyRootfs {
+		bootRootfs = opts.RootfsPath
+		extraDisks = append([]vm.DiskConfig{{HostPath: vmRootfsPath, Upper: true}}, extraDisks...)
 	}
-
-	linuxMachine := machine.(*linux.LinuxMachine)
 
 	// Auto-add secret hosts to allowed hosts if secrets are defined
 	if config.Network != nil && len(config.Network.Secrets) > 0 {
@@ -184,25 +266,102 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 		}
 	}
 
+	allowNoInterceptHosts(config.Network)
+
 	// Create policy engine
 	policyEngine := policy.NewEngine(config.Network)
+	redactor := newRedactor(config)
+
+	vmConfig := &vm.VMConfig{
+		ID:             id,
+		KernelPath:     kernelPath,
+		RootfsPath:     bootRootfs,
+		CPUs:           config.Resources.CPUs,
+		MemoryMB:       config.Resources.MemoryMB,
+		SocketPath:     stateMgr.SocketPath(id) + ".sock",
+		LogPath:        stateMgr.LogPath(id),
+		VsockCID:       3,
+		VsockPath:      stateMgr.Dir(id) + "/vsock.sock",
+		GatewayIP:      subnetInfo.GatewayIP,
+		GuestIP:        subnetInfo.GuestIP,
+		SubnetCIDR:     subnetInfo.GatewayIP + "/24",
+		Workspace:      workspace,
+		Privileged:     config.Privileged,
+		ExtraDisks:     extraDisks,
+		SharedDirs:     sharedDirs(config, backend),
+		ZramSwapMB:     zramSwapMB,
+		RootfsReadOnly: readOnlyRootfs,
+		DNSServers:     config.Network.GetDNSServers(),
+		LogFilter:      logFilter(redactor),
+	}
+
+	machine, err := backend.Create(ctx, vmConfig)
+	if err != nil {
+		subnetAlloc.Release(id)
+		stateMgr.Unregister(id)
+		return nil, errx.Wrap(ErrCreateVM, err)
+	}
+
+	linuxMachine := machine.(*linux.LinuxMachine)
 
 	// Create event channel
 	events := make(chan api.Event, 100)
 
+	var sb *Sandbox
+	budget := newEgressBudget(config.Network, id, func() vm.Machine { return sb.Machine() })
+
 	// Set up transparent proxy for HTTP/HTTPS interception
 	gatewayIP := subnetInfo.GatewayIP
 	const proxyBindAddr = "0.0.0.0"
 
 	var proxy *sandboxnet.TransparentProxy
+	var netStack *sandboxnet.NetworkStack
+	var netConfig *sandboxnet.Config
 	var fwRules FirewallRules
-
-	if needsProxy {
+	var metrics *sandboxnet.NetworkMetrics
+
+	if linuxMachine.UserNetwork() {
+		// Rootless fallback: the guest's frames arrive on a TAP FD and are
+		// handled by the userspace stack, as on macOS. The stack enforces
+		// policy itself, so no firewall or NAT rules are installed.
+		if needsProxy {
+			metrics = sandboxnet.NewNetworkMetrics()
+		}
+		netConfig = &sandboxnet.Config{
+			File:       linuxMachine.NetworkFile(),
+			GatewayIP:  gatewayIP,
+			GuestIP:    subnetInfo.GuestIP,
+			MTU:        1500,
+			Policy:     policyEngine,
+			Events:     events,
+			CAPool:     caPool,
+			DNSServers: config.Network.GetDNSServers(),
+			Shape:      config.Network.Shape,
+			Metrics:    metrics,
+			Limiter:    sandboxnet.NewConnLimiter(config.Network.MaxConnections, config.Network.MaxConnectionsPerMinute),
+			Budget:     budget,
+			Upstream:   upstreamProxy,
+		}
+		netStack, err = sandboxnet.NewNetworkStack(netConfig)
+		if err != nil {
+			machine.Close(ctx)
+			subnetAlloc.Release(id)
+			stateMgr.Unregister(id)
+			return nil, errx.Wrap(ErrNetworkStack, err)
+		}
+	} else if needsProxy {
+		metrics = sandboxnet.NewNetworkMetrics()
 		proxy, err = sandboxnet.NewTransparentProxy(&sandboxnet.ProxyConfig{
 			BindAddr:        proxyBindAddr,
 			HTTPPort:        0,
 			HTTPSPort:       0,
 			PassthroughPort: 0,
+			GatewayIP:       gatewayIP,
+			Shape:           config.Network.Shape,
+			Metrics:         metrics,
+			Limiter:         sandboxnet.NewConnLimiter(config.Network.MaxConnections, config.Network.MaxConnectionsPerMinute),
+			Budget:          budget,
+			Upstream:        upstreamProxy,
 			Policy:          policyEngine,
 			Events:          events,
 			CAPool:          caPool,
@@ -227,18 +386,24 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 	}
 
 	// Set up basic NAT for guest network access using nftables
-	natRules := sandboxnet.NewNFTablesNAT(linuxMachine.TapName())
-	if err := natRules.Setup(); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: failed to setup NAT: %v\n", err)
-		natRules = nil
+	var natRules *sandboxnet.NFTablesNAT
+	if !linuxMachine.UserNetwork() {
+		natRules = sandboxnet.NewNFTablesNAT(linuxMachine.TapName())
+		if err := natRules.Setup(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to setup NAT: %v\n", err)
+			natRules = nil
+		}
 	}
 
 	// Create VFS providers
 	vfsProviders := buildVFSProviders(config, workspace)
 	vfsRoot := vfs.NewMountRouter(vfsProviders)
+	files := newFileWatcher(events, vfsRoot)
 
 	// Create VFS server for guest FUSE daemon connections
 	vfsServer := vfs.NewVFSServer(vfsRoot)
+	vfsMetrics, closeSlowLog := newVFSMetrics(config, stateMgr, id)
+	vfsServer.SetMetrics(vfsMetrics)
 
 	// Start VFS server on the vsock UDS path for VFS port
 	vfsSocketPath := fmt.Sprintf("%s_%d", vmConfig.VsockPath, linux.VsockPortVFS)
@@ -247,27 +412,49 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 		if proxy != nil {
 			proxy.Close()
 		}
+		if netStack != nil {
+			netStack.Close()
+		}
 		if fwRules != nil {
 			fwRules.Cleanup()
 		}
+		closeSlowLog()
 		machine.Close(ctx)
 		subnetAlloc.Release(id)
 		stateMgr.Unregister(id)
 		return nil, errx.Wrap(ErrVFSServer, err)
 	}
 
-	return &Sandbox{
+	stopFlusher := startMetricsFlusher(stateMgr, id, metrics, budget, policyEngine, vfsRoot, vfsMetrics)
+	metricsStop := func() {
+		stopFlusher()
+		closeSlowLog()
+	}
+	if metrics != nil {
+		watchSecretLeaks(config.Network, id, metrics, func() vm.Machine { return sb.Machine() })
+	}
+
+	sb = &Sandbox{
 		id:          id,
 		config:      config,
 		machine:     machine,
 		proxy:       proxy,
+		netStack:    netStack,
 		fwRules:     fwRules,
 		natRules:    natRules,
 		policy:      policyEngine,
 		vfsRoot:     vfsRoot,
 		vfsServer:   vfsServer,
 		vfsStopFunc: vfsStopFunc,
+		vfsMetrics:  vfsMetrics,
 		events:      events,
+		files:       files,
+		redacted:    redactEvents(events, redactor),
+		redactor:    redactor,
+		mirror:      NewMirror(),
+		metrics:     metrics,
+		budget:      budget,
+		metricsStop: metricsStop,
 		stateMgr:    stateMgr,
 		tapName:     linuxMachine.TapName(),
 		caPool:      caPool,
@@ -275,7 +462,18 @@ func New(ctx context.Context, config *api.Config, opts *Options) (*Sandbox, erro
 		subnetAlloc: subnetAlloc,
 		workspace:   workspace,
 		rootfsPath:  vmRootfsPath,
-	}, nil
+		guestRoot:   guestRoot,
+
+		backend:        backend,
+		vmConfig:       vmConfig,
+		netConfig:      netConfig,
+		sourceRootfs:   opts.RootfsPath,
+		readOnlyRootfs: readOnlyRootfs,
+		diskSizeMB:     diskSizeMB,
+		releaseDisks:   releaseDisks,
+	}
+	created = true
+	return sb, nil
 }
 
 // ID returns the sandbox identifier.
@@ -287,8 +485,22 @@ func (s *Sandbox) Config() *api.Config { return s.config }
 // Workspace returns the VFS mount point path.
 func (s *Sandbox) Workspace() string { return s.workspace }
 
-// Machine returns the underlying VM machine for advanced operations.
-func (s *Sandbox) Machine() vm.Machine { return s.machine }
+// Mirror returns the output mirror that `matchlock watch` attaches to.
+// Interactive sessions driven outside Exec should tee their output into it.
+func (s *Sandbox) Mirror() *Mirror { return s.mirror }
+
+// TemplateData returns what startup command templates are rendered with.
+func (s *Sandbox) TemplateData() *api.TemplateData {
+	return templateData(s.id, s.config)
+}
+
+// Machine returns the underlying VM machine for advanced operations. It
+// changes when the sandbox is restarted.
+func (s *Sandbox) Machine() vm.Machine {
+	s.machineMu.RLock()
+	defer s.machineMu.RUnlock()
+	return s.machine
+}
 
 // Policy returns the policy engine.
 func (s *Sandbox) Policy() *policy.Engine { return s.policy }
@@ -297,12 +509,12 @@ func (s *Sandbox) CAPool() *sandboxnet.CAPool { return s.caPool }
 
 // Start starts the sandbox VM.
 func (s *Sandbox) Start(ctx context.Context) error {
-	return s.machine.Start(ctx)
+	return s.Machine().Start(ctx)
 }
 
 // Stop stops the sandbox VM.
 func (s *Sandbox) Stop(ctx context.Context) error {
-	return s.machine.Stop(ctx)
+	return s.Machine().Stop(ctx)
 }
 
 func (s *Sandbox) PrepareExecEnv() *api.ExecOptions {
@@ -310,13 +522,33 @@ func (s *Sandbox) PrepareExecEnv() *api.ExecOptions {
 }
 
 func (s *Sandbox) Exec(ctx context.Context, command string, opts *api.ExecOptions) (*api.ExecResult, error) {
-	return execCommand(ctx, s.machine, s.config, s.caPool, s.policy, command, opts)
+	return execCommand(ctx, s.Machine(), s.config, s.caPool, s.policy, s.redactor, s.mirror, command, opts)
 }
 
 func (s *Sandbox) WriteFile(ctx context.Context, path string, content []byte, mode uint32) error {
 	return writeFile(s.vfsRoot, path, content, mode)
 }
 
+// MkdirAll creates a directory in the VFS along with any missing parents.
+func (s *Sandbox) MkdirAll(ctx context.Context, path string, mode uint32) error {
+	return mkdirAll(s.vfsRoot, path, mode)
+}
+
+// RemoveAll removes a file or directory tree from the VFS.
+func (s *Sandbox) RemoveAll(ctx context.Context, path string) error {
+	return s.vfsRoot.RemoveAll(path)
+}
+
+// FileSignature returns the delta signature of a file in the VFS.
+func (s *Sandbox) FileSignature(ctx context.Context, path string, blockSize int) (*delta.Signature, error) {
+	return fileSignature(s.vfsRoot, path, blockSize)
+}
+
+// PatchFile applies a delta produced against FileSignature to a VFS file.
+func (s *Sandbox) PatchFile(ctx context.Context, path string, blockSize int, ops []delta.Op, mode uint32, checksum string) error {
+	return patchFile(s.vfsRoot, path, blockSize, ops, mode, checksum)
+}
+
 func (s *Sandbox) ReadFile(ctx context.Context, path string) ([]byte, error) {
 	return readFile(s.vfsRoot, path)
 }
@@ -325,17 +557,244 @@ func (s *Sandbox) ReadFileTo(ctx context.Context, path string, w io.Writer) (int
 	return readFileTo(s.vfsRoot, path, w)
 }
 
+// WriteFileFrom writes r to a file in the VFS, replacing the file only once
+// r has been read to its end.
+func (s *Sandbox) WriteFileFrom(ctx context.Context, path string, r io.Reader, mode uint32) (int64, error) {
+	return writeFileFrom(s.vfsRoot, path, r, mode)
+}
+
 func (s *Sandbox) ListFiles(ctx context.Context, path string) ([]api.FileInfo, error) {
 	return listFiles(s.vfsRoot, path)
 }
 
+// Stat returns the metadata of a file or directory in the VFS.
+func (s *Sandbox) Stat(ctx context.Context, path string) (*api.FileInfo, error) {
+	return statFile(s.vfsRoot, path)
+}
+
+// Remove removes a file or empty directory from the VFS.
+func (s *Sandbox) Remove(ctx context.Context, path string) error {
+	return s.vfsRoot.Remove(path)
+}
+
+// Chmod changes the permission bits of a file or directory in the VFS.
+func (s *Sandbox) Chmod(ctx context.Context, path string, mode uint32) error {
+	return s.vfsRoot.Chmod(path, os.FileMode(mode))
+}
+
+// Chown changes the owner of a file or directory as the guest sees it,
+// which a mount's idmap maps to an owner on the host.
+func (s *Sandbox) Chown(ctx context.Context, path string, uid, gid int) error {
+	return s.vfsRoot.Chown(path, uid, gid)
+}
+
+// Rename moves a file or directory within the VFS.
+func (s *Sandbox) Rename(ctx context.Context, oldPath, newPath string) error {
+	return s.vfsRoot.Rename(oldPath, newPath)
+}
+
+// CopyIn extracts the tar stream r into the directory path in the VFS.
+func (s *Sandbox) CopyIn(ctx context.Context, path string, r io.Reader) error {
+	return vfs.ExtractTar(s.vfsRoot, path, r)
+}
+
+// CopyOut writes the tree at path in the VFS to w as a tar stream.
+func (s *Sandbox) CopyOut(ctx context.Context, path string, w io.Writer) error {
+	return vfs.WriteTar(s.vfsRoot, path, w)
+}
+
+// NetworkMetrics returns per-host network counters accumulated so far.
+// It returns nil when network interception is disabled.
+func (s *Sandbox) NetworkMetrics() []api.HostMetrics {
+	return s.metrics.Snapshot()
+}
+
+// SecretUsage reports how often and where each secret has been injected.
+func (s *Sandbox) SecretUsage() []api.SecretUsage {
+	return s.policy.SecretUsage()
+}
+
+// UpdateSecret rotates the real value of a secret without restarting the
+// sandbox. The guest keeps using the same placeholder.
+func (s *Sandbox) UpdateSecret(name, value string) error {
+	return updateSecret(s.policy, s.redactor, name, value)
+}
+
+// FreezeNetwork cuts off all of the guest's network egress, including
+// connections already open, while leaving the VM running for inspection.
+// The freeze lasts for the life of the sandbox, across restarts.
+func (s *Sandbox) FreezeNetwork() error {
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	if s.frozen {
+		return nil
+	}
+	if s.netStack != nil {
+		s.netStack.Freeze()
+	} else {
+		linuxMachine, ok := s.Machine().(*linux.LinuxMachine)
+		if !ok {
+			return ErrFreezeUnsupported
+		}
+		freezeRules := sandboxnet.NewNFTablesFreeze(linuxMachine.TapName())
+		if err := freezeRules.Setup(); err != nil {
+			return errx.Wrap(ErrFreezeNetwork, err)
+		}
+		s.freezeRules = freezeRules
+	}
+	s.frozen = true
+	return nil
+}
+
+// EgressUsage returns the sandbox's egress byte budget consumption, or nil
+// when no budget is configured.
+func (s *Sandbox) EgressUsage() *api.EgressUsage {
+	return s.budget.Usage()
+}
+
+// VFSMetrics reports the filesystem operations the guest made on each
+// mount: counts, errors, bytes and latencies.
+func (s *Sandbox) VFSMetrics() []api.MountMetrics {
+	return mountMetrics(s.vfsMetrics)
+}
+
+// MountUsage reports the space held by each mount that accounts for it,
+// such as memory mounts, against its size limit.
+func (s *Sandbox) MountUsage() []api.MountUsage {
+	return mountUsage(s.vfsRoot)
+}
+
+// NetworkViolations returns the network denials recorded so far, one entry
+// per host and rule. It returns nil when network interception is disabled.
+func (s *Sandbox) NetworkViolations() []api.NetworkViolation {
+	return redactViolations(s.metrics.Violations(), s.redactor)
+}
+
+// AddMount mounts a volume in the workspace of the running sandbox, without
+// a restart.
+func (s *Sandbox) AddMount(guestPath string, mount api.MountConfig) error {
+	s.mountMu.Lock()
+	defer s.mountMu.Unlock()
+	return addMount(s.vfsRoot, s.config, s.stateMgr, s.id, guestPath, mount)
+}
+
+// RemoveMount unmounts a volume from the running sandbox. Files the guest
+// still has open on it stay usable until closed.
+func (s *Sandbox) RemoveMount(guestPath string) error {
+	s.mountMu.Lock()
+	defer s.mountMu.Unlock()
+	return removeMount(s.vfsRoot, s.config, s.stateMgr, s.id, guestPath)
+}
+
+// SnapshotWorkspace saves the current workspace files as the named
+// workspace snapshot, for seeding later sandboxes with VFS.WorkspaceFrom.
+func (s *Sandbox) SnapshotWorkspace(name string) (*workspaces.Snapshot, error) {
+	return snapshotWorkspace(s.vfsRoot, workspaces.NewStore(""), s.id, s.config.GetWorkspace(), name)
+}
+
+// Snapshot saves the current root filesystem into the local image store under
+// tag. Passing tag as the image of a new sandbox restores from the snapshot.
+func (s *Sandbox) Snapshot(ctx context.Context, tag string) error {
+	return snapshotRootfs(ctx, s.Machine(), s.config, tag)
+}
+
+// RecordExit records the exit code of the sandbox's primary command, whether
+// it was OOM-killed, and when it finished, for display by `matchlock list`.
+func (s *Sandbox) RecordExit(ctx context.Context, exitCode int) error {
+	return recordExit(ctx, s.Machine(), s.stateMgr, s.id, exitCode)
+}
+
+// Restart shuts the guest down and boots it again with the same
+// configuration, mounts and network identity. The root disk is kept unless
+// opts.FreshDisk is set. Host-side state (VFS, proxy, firewall rules, the
+// CA and metrics) is left in place.
+func (s *Sandbox) Restart(ctx context.Context, opts *RestartOptions) error {
+	if opts == nil {
+		opts = &RestartOptions{}
+	}
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	if s.backend == nil {
+		return ErrRestartUnavailable
+	}
+
+	old := s.Machine()
+	syncGuest(ctx, old)
+	if s.netStack != nil {
+		s.netStack.Close()
+		s.netStack = nil
+	}
+	if err := old.Close(ctx); err != nil {
+		return errx.Wrap(ErrMachineClose, err)
+	}
+	// Firecracker refuses to start while its API and vsock sockets exist.
+	os.Remove(s.vmConfig.SocketPath)
+	os.Remove(s.vmConfig.VsockPath)
+
+	if opts.FreshDisk {
+		if err := s.resetRootfs(); err != nil {
+			return err
+		}
+	}
+
+	machine, err := s.backend.Create(ctx, s.vmConfig)
+	if err != nil {
+		return errx.Wrap(ErrCreateVM, err)
+	}
+	s.machineMu.Lock()
+	s.machine = machine
+	s.machineMu.Unlock()
+
+	if s.netConfig != nil {
+		s.netConfig.File = machine.(*linux.LinuxMachine).NetworkFile()
+		netStack, err := sandboxnet.NewNetworkStack(s.netConfig)
+		if err != nil {
+			return errx.Wrap(ErrNetworkStack, err)
+		}
+		if s.frozen {
+			netStack.Freeze()
+		}
+		s.netStack = netStack
+	}
+
+	if err := machine.Start(ctx); err != nil {
+		return errx.Wrap(ErrStartVM, err)
+	}
+	return nil
+}
+
+// resetRootfs replaces the sandbox's root disk with a fresh copy of the image.
+func (s *Sandbox) resetRootfs() error {
+	if err := prepareRootDisk(s.sourceRootfs, s.rootfsPath, s.readOnlyRootfs, s.diskSizeMB); err != nil {
+		return err
+	}
+	if s.caPool != nil {
+		if err := injectConfigFileIntoRootfs(s.rootfsPath, s.guestRoot+"/etc/ssl/certs/matchlock-ca.crt", s.caPool.CACertPEM()); err != nil {
+			return errx.Wrap(ErrInjectCACert, err)
+		}
+	}
+	return nil
+}
+
+// WatchFiles publishes the changes made under path, such as a results file
+// appearing, as "file" events. Only changes made through the FUSE-served
+// VFS are seen, not those in virtio-fs shares.
+func (s *Sandbox) WatchFiles(path string) error {
+	return s.files.watch(path)
+}
+
 // Events returns a channel for receiving sandbox events.
 func (s *Sandbox) Events() <-chan api.Event {
-	return s.events
+	return s.redacted
 }
 
 // Close shuts down the sandbox and releases all resources.
 func (s *Sandbox) Close(ctx context.Context) error {
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
 	var errs []error
 
 	if s.vfsStopFunc != nil {
@@ -351,20 +810,35 @@ func (s *Sandbox) Close(ctx context.Context) error {
 			errs = append(errs, errx.Wrap(ErrNATCleanup, err))
 		}
 	}
+	if s.freezeRules != nil {
+		if err := s.freezeRules.Cleanup(); err != nil {
+			errs = append(errs, errx.Wrap(ErrFirewallCleanup, err))
+		}
+	}
 	if s.proxy != nil {
 		s.proxy.Close()
 	}
+	if s.netStack != nil {
+		s.netStack.Close()
+	}
+	if s.metricsStop != nil {
+		s.metricsStop()
+	}
 
 	// Release subnet allocation
 	if s.subnetAlloc != nil {
 		s.subnetAlloc.Release(s.id)
 	}
 
-	close(s.events)
+	s.files.close()
+	s.mirror.Close()
+	closeMounts(s.vfsRoot)
 	s.stateMgr.Unregister(s.id)
-	if err := s.machine.Close(ctx); err != nil {
+	if err := s.Machine().Close(ctx); err != nil {
 		errs = append(errs, errx.Wrap(ErrMachineClose, err))
 	}
+	s.releaseDisks()
+	errs = append(errs, pushGitMounts(ctx, s.config, s.stateMgr, s.id)...)
 
 	// Remove rootfs copy to save disk space
 	rootfsCopy := s.stateMgr.Dir(s.id) + "/rootfs.ext4"
@@ -379,13 +853,45 @@ func (s *Sandbox) Close(ctx context.Context) error {
 func createProvider(mount api.MountConfig) vfs.Provider {
 	switch mount.Type {
 	case "memory":
+		if mount.SizeMB > 0 {
+			return vfs.NewMemoryProviderWithLimit(int64(mount.SizeMB) << 20)
+		}
 		return vfs.NewMemoryProvider()
+	case "encrypted":
+		// HostPath is where the unlinked backing file is created; see
+		// prepareEncryptedMounts.
+		return vfs.NewEncryptedProvider(mount.HostPath)
 	case "real_fs":
-		p := vfs.NewRealFSProvider(mount.HostPath)
+		p := hostDirProvider(mount)
 		if mount.Readonly {
 			return vfs.NewReadonlyProvider(p)
 		}
 		return p
+	case "git":
+		// HostPath is the host-side checkout; see prepareGitMounts.
+		if mount.HostPath == "" {
+			return nil
+		}
+		return vfs.NewRealFSProvider(mount.HostPath)
+	case "cache":
+		// The cache was created by prepareCacheMounts.
+		if mount.Cache == nil {
+			return nil
+		}
+		var p vfs.Provider = caches.NewStore("").Provider(mount.Cache.Name)
+		if mount.Readonly {
+			p = vfs.NewReadonlyProvider(p)
+		}
+		return p
+	case "s3":
+		if mount.S3 == nil {
+			return nil
+		}
+		var p vfs.Provider = vfs.NewObjectStoreProvider(objstore.NewS3Store(*mount.S3), mount.S3.Prefix)
+		if mount.Readonly {
+			p = vfs.NewReadonlyProvider(p)
+		}
+		return p
 	case "overlay":
 		var upper, lower vfs.Provider
 		if mount.Upper != nil {
@@ -395,6 +901,8 @@ func createProvider(mount api.MountConfig) vfs.Provider {
 		}
 		if mount.Lower != nil {
 			lower = createProvider(*mount.Lower)
+		} else if mount.HostPath != "" {
+			lower = vfs.NewReadonlyProvider(hostDirProvider(mount))
 		}
 		if upper != nil && lower != nil {
 			return vfs.NewOverlayProvider(upper, lower)
@@ -405,6 +913,25 @@ func createProvider(mount api.MountConfig) vfs.Provider {
 	}
 }
 
+// prepareRootDisk readies a sandbox's writable root disk at dst: a copy of
+// the ext4 image at src with the matchlock components injected, or, for a
+// read-only image that sandboxes share, a fresh overlay upper disk.
+func prepareRootDisk(src, dst string, readOnly bool, diskSizeMB int64) error {
+	if readOnly {
+		if err := createUpperDisk(dst, diskSizeMB); err != nil {
+			return errx.Wrap(ErrPrepareRootfs, err)
+		}
+		return nil
+	}
+	if err := copyRootfs(src, dst); err != nil {
+		return errx.Wrap(ErrCopyRootfs, err)
+	}
+	if err := prepareRootfs(dst, diskSizeMB); err != nil {
+		return errx.Wrap(ErrPrepareRootfs, err)
+	}
+	return nil
+}
+
 func copyRootfs(src, dst string) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
@@ -425,9 +952,9 @@ func copyRootfs(src, dst string) error {
 		return nil
 	}
 
-	// Fall back to regular copy
+	// Fall back to a copy that keeps the image's holes
 	fmt.Fprintf(os.Stderr, "Note: copy-on-write not supported (%v), using regular copy\n", err)
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
+	if _, err := vfs.CopySparse(dstFile, srcFile); err != nil {
 		os.Remove(dst)
 		return errx.Wrap(ErrCopy, err)
 	}
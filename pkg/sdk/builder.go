@@ -1,5 +1,13 @@
 package sdk
 
+import (
+	"sort"
+	"time"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/state"
+)
+
 // SandboxBuilder provides a fluent API for configuring and creating sandboxes.
 //
 // Usage:
@@ -23,12 +31,151 @@ func New(image string) *SandboxBuilder {
 	}
 }
 
+// CloneConfig returns a builder pre-populated with the config of an existing
+// or stopped sandbox on this host, so it can be reproduced with overrides:
+//
+//	b, err := sdk.CloneConfig("vm-abc123")
+//	if err != nil { ... }
+//	vmID, err := client.Launch(b.WithMemory(4096))
+//
+// The stored config includes resolved secret values. Builder methods that
+// append (AllowHost, AddSecret, ...) add to the cloned values.
+func CloneConfig(id string) (*SandboxBuilder, error) {
+	var cfg api.Config
+	if err := state.NewManager().LoadConfig(id, &cfg); err != nil {
+		return nil, err
+	}
+	return FromConfig(&cfg), nil
+}
+
+// FromConfig creates a SandboxBuilder from a sandbox config, e.g. one
+// decoded from a sandbox's stored config.json.
+func FromConfig(cfg *api.Config) *SandboxBuilder {
+	opts := CreateOptions{
+		Image:      cfg.Image,
+		Privileged: cfg.Privileged,
+		Redact:     cfg.Redact,
+		Env:        cfg.Env,
+		Labels:     cfg.Labels,
+		DataDisks:  cfg.DataDisks,
+	}
+	if r := cfg.Resources; r != nil {
+		opts.Size = r.Size
+		opts.CPUs = r.CPUs
+		opts.MemoryMB = r.MemoryMB
+		opts.DiskSizeMB = r.DiskSizeMB
+		opts.RootfsFreeSpaceMB = r.RootfsFreeSpaceMB
+		opts.SwapMB = r.SwapMB
+		opts.SwapType = r.SwapType
+		opts.TimeoutSeconds = r.TimeoutSeconds
+	}
+	if n := cfg.Network; n != nil {
+		opts.AllowedHosts = n.AllowedHosts
+		opts.BlockPrivateIPs = n.BlockPrivateIPs
+		opts.DNSServers = n.DNSServers
+		opts.HostPorts = n.HostPorts
+		if n.Shape != nil {
+			opts.NetworkShape = &NetworkShape{
+				LatencyMS:    n.Shape.LatencyMS,
+				JitterMS:     n.Shape.JitterMS,
+				JitterSeed:   n.Shape.JitterSeed,
+				BandwidthBps: n.Shape.BandwidthBps,
+			}
+		}
+		opts.MaxConnections = n.MaxConnections
+		opts.MaxConnectionsPerMinute = n.MaxConnectionsPerMinute
+		opts.MaxEgressBytes = n.MaxEgressBytes
+		opts.EgressBudgetAction = n.EgressBudgetAction
+		opts.CertPins = n.CertPins
+		for host, t := range n.UpstreamTLS {
+			if opts.UpstreamTLS == nil {
+				opts.UpstreamTLS = make(map[string]UpstreamTLS)
+			}
+			opts.UpstreamTLS[host] = UpstreamTLS{
+				RootCAFiles:        t.RootCAFiles,
+				MinVersion:         t.MinVersion,
+				InsecureSkipVerify: t.InsecureSkipVerify,
+			}
+		}
+		opts.NoInterceptHosts = n.NoInterceptHosts
+		opts.RequestSigning = n.RequestSigning
+		opts.SecretLeakAction = n.SecretLeakAction
+		opts.SecretProfiles = n.SecretProfiles
+		opts.UpstreamProxy = n.UpstreamProxy
+		opts.ProxyAutoConfigURL = n.ProxyAutoConfigURL
+
+		opts.Secrets = secretsFromConfig(n.Secrets)
+	}
+	if v := cfg.VFS; v != nil {
+		opts.Workspace = v.Workspace
+		opts.VFSSlowOp = time.Duration(v.SlowOpMS) * time.Millisecond
+		for guestPath, m := range v.Mounts {
+			if opts.Mounts == nil {
+				opts.Mounts = make(map[string]MountConfig)
+			}
+			opts.Mounts[guestPath] = MountConfig{Type: m.Type, HostPath: m.HostPath, Readonly: m.Readonly, Backend: m.Backend, S3: m.S3, Git: m.Git, Cache: m.Cache}
+		}
+	}
+	if ic := cfg.ImageCfg; ic != nil {
+		opts.ImageConfig = &ImageConfig{
+			User:       ic.User,
+			WorkingDir: ic.WorkingDir,
+			Entrypoint: ic.Entrypoint,
+			Cmd:        ic.Cmd,
+			Env:        ic.Env,
+		}
+	}
+	return &SandboxBuilder{opts: opts}
+}
+
+// FromSnapshot boots the sandbox from a snapshot previously saved with
+// Client.Snapshot instead of the image passed to New.
+func (b *SandboxBuilder) FromSnapshot(tag string) *SandboxBuilder {
+	b.opts.Image = tag
+	return b
+}
+
 // WithPrivileged enables privileged mode, skipping in-guest security restrictions.
 func (b *SandboxBuilder) WithPrivileged() *SandboxBuilder {
 	b.opts.Privileged = true
 	return b
 }
 
+// WithSize sizes the sandbox from a named resource preset ("small",
+// "medium", "large" or one defined in the host's presets file). WithCPUs,
+// WithMemory, WithDiskSize and WithTimeout override individual values.
+func (b *SandboxBuilder) WithSize(name string) *SandboxBuilder {
+	b.opts.Size = name
+	return b
+}
+
+// WithRedaction masks secret values, their placeholders and OAuth2
+// credentials in exec output, events, violations and VM logs.
+func (b *SandboxBuilder) WithRedaction() *SandboxBuilder {
+	b.opts.Redact = true
+	return b
+}
+
+// WithEnv sets an environment variable for every command run in the
+// sandbox. The value may use templates such as "{{.SandboxID}}".
+func (b *SandboxBuilder) WithEnv(key, value string) *SandboxBuilder {
+	if b.opts.Env == nil {
+		b.opts.Env = make(map[string]string)
+	}
+	b.opts.Env[key] = value
+	return b
+}
+
+// WithLabel labels the sandbox. Labels are available to env templates as
+// {{.Label "KEY"}}.
+func (b *SandboxBuilder) WithLabel(key, value string) *SandboxBuilder {
+	if b.opts.Labels == nil {
+		b.opts.Labels = make(map[string]string)
+	}
+	b.opts.Labels[key] = value
+	return b
+}
+
 // WithCPUs sets the number of vCPUs.
 func (b *SandboxBuilder) WithCPUs(cpus int) *SandboxBuilder {
 	b.opts.CPUs = cpus
@@ -41,12 +188,35 @@ func (b *SandboxBuilder) WithMemory(mb int) *SandboxBuilder {
 	return b
 }
 
-// WithDiskSize sets disk size in megabytes.
+// WithDiskSize sets the minimum disk size in megabytes.
 func (b *SandboxBuilder) WithDiskSize(mb int) *SandboxBuilder {
 	b.opts.DiskSizeMB = mb
 	return b
 }
 
+// WithRootfsFreeSpace sets the free space in megabytes left on the root
+// disk beyond the image contents.
+func (b *SandboxBuilder) WithRootfsFreeSpace(mb int) *SandboxBuilder {
+	b.opts.RootfsFreeSpaceMB = mb
+	return b
+}
+
+// WithSwap adds zram swap of the given size in megabytes: pages are
+// compressed into guest RAM, so it may be at most twice the memory size.
+func (b *SandboxBuilder) WithSwap(mb int) *SandboxBuilder {
+	b.opts.SwapMB = mb
+	b.opts.SwapType = api.SwapZram
+	return b
+}
+
+// WithSwapFile adds disk-backed swap of the given size in megabytes. The
+// backing image is private to the sandbox and deleted when it is closed.
+func (b *SandboxBuilder) WithSwapFile(mb int) *SandboxBuilder {
+	b.opts.SwapMB = mb
+	b.opts.SwapType = api.SwapFile
+	return b
+}
+
 // WithTimeout sets the maximum execution time in seconds.
 func (b *SandboxBuilder) WithTimeout(seconds int) *SandboxBuilder {
 	b.opts.TimeoutSeconds = seconds
@@ -59,12 +229,188 @@ func (b *SandboxBuilder) WithWorkspace(path string) *SandboxBuilder {
 	return b
 }
 
+// WithVFSSlowOpLog logs the guest's filesystem operations that take at
+// least threshold to vfs_slow.log in the sandbox state directory.
+func (b *SandboxBuilder) WithVFSSlowOpLog(threshold time.Duration) *SandboxBuilder {
+	b.opts.VFSSlowOp = threshold
+	return b
+}
+
+// WithDataDisk attaches the persistent data disk d, creating it on first
+// use. A disk is attached read-write to one sandbox at a time; read-only
+// disks can be shared.
+func (b *SandboxBuilder) WithDataDisk(d api.DataDisk) *SandboxBuilder {
+	b.opts.DataDisks = append(b.opts.DataDisks, d)
+	return b
+}
+
+// WithWorkspaceFrom seeds the workspace with the files of a workspace
+// snapshot saved by Client.SnapshotWorkspace or 'matchlock workspace
+// snapshot'. The snapshot is left unchanged; writes go to the sandbox.
+func (b *SandboxBuilder) WithWorkspaceFrom(name string) *SandboxBuilder {
+	b.opts.WorkspaceFrom = name
+	return b
+}
+
 // AllowHost adds one or more hosts to the network allowlist (supports glob patterns).
 func (b *SandboxBuilder) AllowHost(hosts ...string) *SandboxBuilder {
 	b.opts.AllowedHosts = append(b.opts.AllowedHosts, hosts...)
 	return b
 }
 
+// AllowHostPort lets the guest reach services listening on the given host
+// loopback ports via host.matchlock.internal.
+func (b *SandboxBuilder) AllowHostPort(ports ...int) *SandboxBuilder {
+	b.opts.HostPorts = append(b.opts.HostPorts, ports...)
+	return b
+}
+
+// WithNetworkShape emulates a slow link: latency (± jitter) per
+// request/response turn and a bandwidth cap in bits per second. Zero values
+// leave the corresponding dimension unshaped.
+func (b *SandboxBuilder) WithNetworkShape(latency, jitter time.Duration, bandwidthBps int64) *SandboxBuilder {
+	b.opts.NetworkShape = &NetworkShape{
+		LatencyMS:    int(latency.Milliseconds()),
+		JitterMS:     int(jitter.Milliseconds()),
+		BandwidthBps: bandwidthBps,
+	}
+	return b
+}
+
+// PinCertificate requires the upstream certificate chain of host (supports
+// glob patterns) to contain a public key matching one of pins, given as
+// "sha256/<base64 SPKI digest>". Requests are refused on mismatch, before any
+// secret is injected.
+func (b *SandboxBuilder) PinCertificate(host string, pins ...string) *SandboxBuilder {
+	if b.opts.CertPins == nil {
+		b.opts.CertPins = make(map[string][]string)
+	}
+	b.opts.CertPins[host] = append(b.opts.CertPins[host], pins...)
+	return b
+}
+
+// KillOnSecretLeak stops the sandbox the first time the guest sends a secret
+// placeholder to a host the secret is not bound to. Such requests are always
+// blocked; this treats them as a sign of a compromised agent.
+func (b *SandboxBuilder) KillOnSecretLeak() *SandboxBuilder {
+	b.opts.SecretLeakAction = api.LeakActionKill
+	return b
+}
+
+// WithSecretProfile adds the secrets of named bundles from the host's secret
+// profiles file, as `matchlock run --secret-profile` does. Profiles are
+// resolved by matchlock, so their values never pass through the SDK.
+// Secrets added to the builder take precedence over profile secrets of the
+// same name.
+func (b *SandboxBuilder) WithSecretProfile(names ...string) *SandboxBuilder {
+	b.opts.SecretProfiles = append(b.opts.SecretProfiles, names...)
+	return b
+}
+
+// SignRequests makes the proxy sign the body of every request to host with
+// an HMAC keyed by the value of a previously added secret, e.g.
+// api.RequestSigning{Secret: "HOOK_KEY", Header: "X-Signature"}. The key
+// never enters the VM.
+func (b *SandboxBuilder) SignRequests(host string, signing api.RequestSigning) *SandboxBuilder {
+	if b.opts.RequestSigning == nil {
+		b.opts.RequestSigning = make(map[string]api.RequestSigning)
+	}
+	b.opts.RequestSigning[host] = signing
+	return b
+}
+
+// WithUpstreamTLS sets how the proxy verifies the TLS server of host
+// (supports glob patterns), replacing any options previously set for it.
+func (b *SandboxBuilder) WithUpstreamTLS(host string, opts UpstreamTLS) *SandboxBuilder {
+	if b.opts.UpstreamTLS == nil {
+		b.opts.UpstreamTLS = make(map[string]UpstreamTLS)
+	}
+	b.opts.UpstreamTLS[host] = opts
+	return b
+}
+
+// WithoutInterception allows hosts (supports glob patterns) whose TLS traffic
+// is relayed without interception. Secrets are never injected into them.
+func (b *SandboxBuilder) WithoutInterception(hosts ...string) *SandboxBuilder {
+	b.opts.NoInterceptHosts = append(b.opts.NoInterceptHosts, hosts...)
+	return b
+}
+
+// WithUpstreamProxy chains all sandbox egress through an HTTP proxy, given
+// as http://HOST:PORT or "system" for the host's proxy settings.
+func (b *SandboxBuilder) WithUpstreamProxy(proxy string) *SandboxBuilder {
+	b.opts.UpstreamProxy = proxy
+	return b
+}
+
+// WithProxyAutoConfig chains all sandbox egress through the proxy named in
+// the PAC file at pacURL.
+func (b *SandboxBuilder) WithProxyAutoConfig(pacURL string) *SandboxBuilder {
+	b.opts.ProxyAutoConfigURL = pacURL
+	return b
+}
+
+// WithConnectionLimits caps how many connections the guest may hold open at
+// once and how many it may open per minute. Zero leaves a limit unset.
+func (b *SandboxBuilder) WithConnectionLimits(maxConcurrent, perMinute int) *SandboxBuilder {
+	b.opts.MaxConnections = maxConcurrent
+	b.opts.MaxConnectionsPerMinute = perMinute
+	return b
+}
+
+// WithEgressBudget caps the total bytes the guest may send out. Once spent,
+// further traffic is blocked while the sandbox keeps running.
+func (b *SandboxBuilder) WithEgressBudget(maxBytes int64) *SandboxBuilder {
+	b.opts.MaxEgressBytes = maxBytes
+	b.opts.EgressBudgetAction = api.EgressActionBlock
+	return b
+}
+
+// WithEgressBudgetKill caps the total bytes the guest may send out and stops
+// the sandbox once they are spent.
+func (b *SandboxBuilder) WithEgressBudgetKill(maxBytes int64) *SandboxBuilder {
+	b.opts.MaxEgressBytes = maxBytes
+	b.opts.EgressBudgetAction = api.EgressActionKill
+	return b
+}
+
+// secretsFromConfig converts config secrets to SDK secrets, sorted by name.
+func secretsFromConfig(secrets map[string]api.Secret) []Secret {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []Secret
+	for _, name := range names {
+		s := secrets[name]
+		out = append(out, Secret{
+			Name:      name,
+			Value:     s.Value,
+			Hosts:     s.Hosts,
+			In:        s.In,
+			Paths:     s.Paths,
+			Methods:   s.Methods,
+			Header:    s.Header,
+			OAuth2:    s.OAuth2,
+			GitHubApp: s.GitHubApp,
+			ExpiresAt: s.ExpiresAt,
+		})
+	}
+	return out
+}
+
+// LoadSecretFile reads secrets from a YAML or JSON file in the format
+// taken by `matchlock run --secret-file`, for use with AddSecrets. Store
+// references such as "aws-sm:..." are resolved by matchlock on the host.
+func LoadSecretFile(path string) ([]Secret, error) {
+	secrets, err := api.LoadSecretFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return secretsFromConfig(secrets), nil
+}
+
 // BlockPrivateIPs blocks access to private IP ranges (10.x, 172.16.x, 192.168.x).
 func (b *SandboxBuilder) BlockPrivateIPs() *SandboxBuilder {
 	b.opts.BlockPrivateIPs = true
@@ -83,6 +429,114 @@ func (b *SandboxBuilder) AddSecret(name, value string, hosts ...string) *Sandbox
 	return b
 }
 
+// AddSecrets registers several secrets at once, e.g. those returned by
+// LoadSecretFile.
+func (b *SandboxBuilder) AddSecrets(secrets ...Secret) *SandboxBuilder {
+	b.opts.Secrets = append(b.opts.Secrets, secrets...)
+	return b
+}
+
+// AddSecretIn is like AddSecret but chooses where the placeholder is replaced,
+// e.g. []string{api.SecretInBody} for APIs that take keys in JSON or form
+// bodies. Bodies are rewritten according to their Content-Type.
+func (b *SandboxBuilder) AddSecretIn(name, value string, in []string, hosts ...string) *SandboxBuilder {
+	b.opts.Secrets = append(b.opts.Secrets, Secret{
+		Name:  name,
+		Value: value,
+		Hosts: hosts,
+		In:    in,
+	})
+	return b
+}
+
+// AddOAuth2Secret registers an OAuth 2.0 client. The proxy mints access
+// tokens from oauth2.TokenURL on the host, caches them until they expire and
+// sends them as "Authorization: Bearer" on requests to the specified hosts,
+// refreshing and retrying once when upstream answers 401 Unauthorized. The
+// credentials and tokens never enter the VM.
+func (b *SandboxBuilder) AddOAuth2Secret(name string, oauth2 api.OAuth2, hosts ...string) *SandboxBuilder {
+	b.opts.Secrets = append(b.opts.Secrets, Secret{
+		Name:   name,
+		Hosts:  hosts,
+		OAuth2: &oauth2,
+	})
+	return b
+}
+
+// WithSecretTTL expires a previously added secret ttl from now. Once it has
+// expired, requests it would have been injected into are refused and
+// reported as blocked network events.
+func (b *SandboxBuilder) WithSecretTTL(name string, ttl time.Duration) *SandboxBuilder {
+	expiresAt := time.Now().Add(ttl)
+	for i := range b.opts.Secrets {
+		if b.opts.Secrets[i].Name == name {
+			b.opts.Secrets[i].ExpiresAt = &expiresAt
+		}
+	}
+	return b
+}
+
+// AddGCPSecret registers a Google Cloud service account from its JSON key.
+// The proxy signs token requests with the key on the host and sends the
+// resulting access tokens, or ID tokens for audience if it is not empty, as
+// "Authorization: Bearer" on requests to the specified hosts, or to
+// *.googleapis.com if none are given. The key never enters the VM.
+func (b *SandboxBuilder) AddGCPSecret(name string, key []byte, audience string, hosts ...string) *SandboxBuilder {
+	if len(hosts) == 0 {
+		hosts = []string{api.DefaultGCPHost}
+	}
+	b.opts.Secrets = append(b.opts.Secrets, Secret{
+		Name:   name,
+		Hosts:  hosts,
+		OAuth2: &api.OAuth2{ServiceAccount: string(key), Audience: audience},
+	})
+	return b
+}
+
+// AddGitHubAppSecret registers a GitHub App installation. The proxy signs a
+// JWT with app.PrivateKey on the host, exchanges it for an installation
+// access token and sends that as "Authorization: Bearer" on requests to the
+// specified hosts, or to api.github.com and uploads.github.com if none are
+// given. The key and tokens never enter the VM.
+func (b *SandboxBuilder) AddGitHubAppSecret(name string, app api.GitHubApp, hosts ...string) *SandboxBuilder {
+	if len(hosts) == 0 {
+		hosts = append([]string(nil), api.DefaultGitHubAppHosts...)
+	}
+	b.opts.Secrets = append(b.opts.Secrets, Secret{
+		Name:      name,
+		Hosts:     hosts,
+		GitHubApp: &app,
+	})
+	return b
+}
+
+// ScopeSecret restricts a previously added secret to the given HTTP methods
+// and URL path prefixes, e.g. ScopeSecret("ANTHROPIC_API_KEY",
+// []string{"POST"}, "/v1/messages"). A placeholder sent to any other
+// endpoint on its hosts is blocked.
+func (b *SandboxBuilder) ScopeSecret(name string, methods []string, paths ...string) *SandboxBuilder {
+	for i := range b.opts.Secrets {
+		if b.opts.Secrets[i].Name == name {
+			b.opts.Secrets[i].Methods = methods
+			b.opts.Secrets[i].Paths = paths
+		}
+	}
+	return b
+}
+
+// WithSecretHeader makes the proxy send header on every request to a
+// previously added secret's hosts, with "{value}" replaced by the real value,
+// e.g. WithSecretHeader("DD_API_KEY", "DD-API-KEY: {value}"). The guest then
+// needs neither the placeholder nor the API's header conventions.
+func (b *SandboxBuilder) WithSecretHeader(name, header string) *SandboxBuilder {
+	for i := range b.opts.Secrets {
+		if b.opts.Secrets[i].Name == name {
+			b.opts.Secrets[i].Header = header
+		}
+	}
+	return b
+}
+
 // WithDNSServers overrides the default DNS servers (8.8.8.8, 8.8.4.4).
 func (b *SandboxBuilder) WithDNSServers(servers ...string) *SandboxBuilder {
 	b.opts.DNSServers = append(b.opts.DNSServers, servers...)
@@ -103,17 +557,71 @@ func (b *SandboxBuilder) MountHostDir(guestPath, hostPath string) *SandboxBuilde
 	return b.Mount(guestPath, MountConfig{Type: "real_fs", HostPath: hostPath})
 }
 
+// MountHostDirWithAccess mounts a host directory into the guest with the
+// paths it may read and write restricted by glob patterns, e.g. denying
+// reads of "**/.env" and writes of "**/*.pem".
+func (b *SandboxBuilder) MountHostDirWithAccess(guestPath, hostPath string, access api.MountAccess) *SandboxBuilder {
+	return b.Mount(guestPath, MountConfig{Type: "real_fs", HostPath: hostPath, Access: &access})
+}
+
 // MountHostDirReadonly mounts a host directory into the guest as read-only.
 func (b *SandboxBuilder) MountHostDirReadonly(guestPath, hostPath string) *SandboxBuilder {
 	return b.Mount(guestPath, MountConfig{Type: "real_fs", HostPath: hostPath, Readonly: true})
 }
 
+// MountHostDirVirtioFS mounts a host directory into the guest over
+// virtio-fs, which is much faster than FUSE for metadata-heavy workloads
+// such as package installs. Backends without virtio-fs fall back to FUSE.
+func (b *SandboxBuilder) MountHostDirVirtioFS(guestPath, hostPath string) *SandboxBuilder {
+	return b.Mount(guestPath, MountConfig{Type: "real_fs", HostPath: hostPath, Backend: api.MountBackendVirtioFS})
+}
+
+// MountS3 exposes the objects under prefix in an S3 bucket at the given guest
+// path. Requests are signed on the host with its default AWS credentials.
+func (b *SandboxBuilder) MountS3(guestPath, bucket, prefix string) *SandboxBuilder {
+	return b.Mount(guestPath, MountConfig{Type: "s3", S3: &api.S3Mount{Bucket: bucket, Prefix: prefix}})
+}
+
+// MountS3Readonly is MountS3 with writes refused.
+func (b *SandboxBuilder) MountS3Readonly(guestPath, bucket, prefix string) *SandboxBuilder {
+	return b.Mount(guestPath, MountConfig{Type: "s3", S3: &api.S3Mount{Bucket: bucket, Prefix: prefix}, Readonly: true})
+}
+
+// MountGit clones a repository on the host, with the host's git credentials,
+// and exposes the checkout at the given guest path. Set repo.PushBranch to
+// push the guest's commits to that branch when the sandbox closes.
+func (b *SandboxBuilder) MountGit(guestPath string, repo api.GitMount) *SandboxBuilder {
+	return b.Mount(guestPath, MountConfig{Type: "git", Git: &repo})
+}
+
+// MountCache mounts the shared cache called name at the given guest path.
+// Every sandbox mounting the same name shares its files, which are kept on
+// the host; see api.CacheMount.
+func (b *SandboxBuilder) MountCache(guestPath, name string) *SandboxBuilder {
+	return b.Mount(guestPath, MountConfig{Type: "cache", Cache: &api.CacheMount{Name: name}})
+}
+
 // MountMemory creates an in-memory filesystem at the given guest path.
 func (b *SandboxBuilder) MountMemory(guestPath string) *SandboxBuilder {
 	return b.Mount(guestPath, MountConfig{Type: "memory"})
 }
 
-// MountOverlay creates a copy-on-write overlay at the given guest path.
+// MountEncrypted creates a scratch filesystem at the given guest path whose
+// file data is kept in a host file encrypted with a key that never leaves
+// memory, and destroyed when the sandbox closes.
+func (b *SandboxBuilder) MountEncrypted(guestPath string) *SandboxBuilder {
+	return b.Mount(guestPath, MountConfig{Type: "encrypted"})
+}
+
+// MountMemoryLimited is MountMemory holding at most sizeMB of file data, so a
+// runaway write fails with ENOSPC instead of exhausting host memory.
+func (b *SandboxBuilder) MountMemoryLimited(guestPath string, sizeMB int) *SandboxBuilder {
+	return b.Mount(guestPath, MountConfig{Type: "memory", SizeMB: sizeMB})
+}
+
+// MountOverlay creates a copy-on-write overlay of hostPath at the given guest
+// path. The host directory is never modified; the guest's changes land in an
+// upper directory listed under Overlays in the sandbox state.
 func (b *SandboxBuilder) MountOverlay(guestPath, hostPath string) *SandboxBuilder {
 	return b.Mount(guestPath, MountConfig{Type: "overlay", HostPath: hostPath})
 }
@@ -1,10 +1,15 @@
 package sdk
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
 )
 
 func TestNew(t *testing.T) {
@@ -27,6 +32,24 @@ func TestBuilderResources(t *testing.T) {
 	require.Equal(t, 600, opts.TimeoutSeconds)
 }
 
+func TestBuilderSwap(t *testing.T) {
+	opts := New("alpine:latest").WithSwap(512).Options()
+	assert.Equal(t, 512, opts.SwapMB)
+	assert.Equal(t, "zram", opts.SwapType)
+
+	opts = New("alpine:latest").WithSwapFile(4096).Options()
+	assert.Equal(t, 4096, opts.SwapMB)
+	assert.Equal(t, "file", opts.SwapType)
+}
+
+func TestBuilderDataDisk(t *testing.T) {
+	opts := New("alpine:latest").
+		WithDataDisk(api.DataDisk{Name: "data", SizeMB: 10 << 10}).
+		WithDataDisk(api.DataDisk{Name: "models", ReadOnly: true}).
+		Options()
+	assert.Equal(t, []api.DataDisk{{Name: "data", SizeMB: 10 << 10}, {Name: "models", ReadOnly: true}}, opts.DataDisks)
+}
+
 func TestBuilderAllowHost(t *testing.T) {
 	opts := New("alpine:latest").
 		AllowHost("api.openai.com").
@@ -37,6 +60,88 @@ func TestBuilderAllowHost(t *testing.T) {
 	require.Equal(t, expected, opts.AllowedHosts)
 }
 
+func TestBuilderAllowHostPort(t *testing.T) {
+	opts := New("alpine:latest").
+		AllowHostPort(11434).
+		AllowHostPort(8000, 8001).
+		Options()
+
+	require.Equal(t, []int{11434, 8000, 8001}, opts.HostPorts)
+}
+
+func TestBuilderWithNetworkShape(t *testing.T) {
+	opts := New("alpine:latest").
+		WithNetworkShape(100*time.Millisecond, 20*time.Millisecond, 5_000_000).
+		Options()
+
+	require.NotNil(t, opts.NetworkShape)
+	assert.Equal(t, 100, opts.NetworkShape.LatencyMS)
+	assert.Equal(t, 20, opts.NetworkShape.JitterMS)
+	assert.Equal(t, int64(5_000_000), opts.NetworkShape.BandwidthBps)
+}
+
+func TestBuilderWithConnectionLimits(t *testing.T) {
+	opts := New("alpine:latest").
+		WithConnectionLimits(20, 300).
+		Options()
+
+	assert.Equal(t, 20, opts.MaxConnections)
+	assert.Equal(t, 300, opts.MaxConnectionsPerMinute)
+}
+
+func TestBuilderWithEgressBudget(t *testing.T) {
+	opts := New("alpine:latest").WithEgressBudget(1 << 20).Options()
+	assert.Equal(t, int64(1<<20), opts.MaxEgressBytes)
+	assert.Equal(t, "block", opts.EgressBudgetAction)
+
+	opts = New("alpine:latest").WithEgressBudgetKill(4096).Options()
+	assert.Equal(t, int64(4096), opts.MaxEgressBytes)
+	assert.Equal(t, "kill", opts.EgressBudgetAction)
+}
+
+func TestBuilderPinCertificate(t *testing.T) {
+	opts := New("alpine:latest").
+		PinCertificate("api.example.com", "sha256/a").
+		PinCertificate("api.example.com", "sha256/b").
+		PinCertificate("*.cdn.example.com", "sha256/c").
+		Options()
+
+	assert.Equal(t, map[string][]string{
+		"api.example.com":   {"sha256/a", "sha256/b"},
+		"*.cdn.example.com": {"sha256/c"},
+	}, opts.CertPins)
+}
+
+func TestBuilderWithUpstreamTLS(t *testing.T) {
+	opts := New("alpine:latest").
+		WithUpstreamTLS("lab.internal", UpstreamTLS{RootCAFiles: []string{"/etc/lab.pem"}}).
+		WithUpstreamTLS("10.0.0.5", UpstreamTLS{InsecureSkipVerify: true}).
+		Options()
+
+	require.Len(t, opts.UpstreamTLS, 2)
+	assert.Equal(t, []string{"/etc/lab.pem"}, opts.UpstreamTLS["lab.internal"].RootCAFiles)
+	assert.True(t, opts.UpstreamTLS["10.0.0.5"].InsecureSkipVerify)
+}
+
+func TestBuilderWithoutInterception(t *testing.T) {
+	opts := New("alpine:latest").
+		WithoutInterception("*.apple.com").
+		WithoutInterception("bank.example.com").
+		Options()
+
+	assert.Equal(t, []string{"*.apple.com", "bank.example.com"}, opts.NoInterceptHosts)
+}
+
+func TestBuilderWithUpstreamProxy(t *testing.T) {
+	opts := New("alpine:latest").
+		WithUpstreamProxy("system").
+		WithProxyAutoConfig("http://wpad/wpad.dat").
+		Options()
+
+	assert.Equal(t, "system", opts.UpstreamProxy)
+	assert.Equal(t, "http://wpad/wpad.dat", opts.ProxyAutoConfigURL)
+}
+
 func TestBuilderAddSecret(t *testing.T) {
 	opts := New("alpine:latest").
 		AddSecret("API_KEY", "sk-123", "api.openai.com").
@@ -57,6 +162,116 @@ func TestBuilderAddSecret(t *testing.T) {
 	require.Len(t, s.Hosts, 2)
 }
 
+func TestBuilderAddSecretIn(t *testing.T) {
+	opts := New("alpine:latest").
+		AddSecretIn("API_KEY", "sk-123", []string{api.SecretInBody, api.SecretInQuery}, "api.example.com").
+		Options()
+
+	require.Len(t, opts.Secrets, 1)
+	assert.Equal(t, []string{api.SecretInBody, api.SecretInQuery}, opts.Secrets[0].In)
+	assert.Equal(t, []string{"api.example.com"}, opts.Secrets[0].Hosts)
+}
+
+func TestBuilderScopeSecret(t *testing.T) {
+	opts := New("alpine:latest").
+		AddSecret("API_KEY", "sk-123", "api.anthropic.com").
+		AddSecret("OTHER", "v", "example.com").
+		ScopeSecret("API_KEY", []string{"POST"}, "/v1/messages").
+		Options()
+
+	require.Len(t, opts.Secrets, 2)
+	assert.Equal(t, []string{"POST"}, opts.Secrets[0].Methods)
+	assert.Equal(t, []string{"/v1/messages"}, opts.Secrets[0].Paths)
+	assert.Empty(t, opts.Secrets[1].Methods)
+	assert.Empty(t, opts.Secrets[1].Paths)
+}
+
+func TestBuilderWithSecretHeader(t *testing.T) {
+	opts := New("alpine:latest").
+		AddSecret("DD_API_KEY", "dd-123", "api.datadoghq.com").
+		WithSecretHeader("DD_API_KEY", "DD-API-KEY: {value}").
+		Options()
+
+	require.Len(t, opts.Secrets, 1)
+	assert.Equal(t, "DD-API-KEY: {value}", opts.Secrets[0].Header)
+}
+
+func TestBuilderAddOAuth2Secret(t *testing.T) {
+	opts := New("alpine:latest").
+		AddOAuth2Secret("GRAPH", api.OAuth2{TokenURL: "https://login.example.com/token", ClientID: "client"}, "graph.example.com").
+		ScopeSecret("GRAPH", []string{"GET"}).
+		Options()
+
+	require.Len(t, opts.Secrets, 1)
+	require.NotNil(t, opts.Secrets[0].OAuth2)
+	assert.Equal(t, "client", opts.Secrets[0].OAuth2.ClientID)
+	assert.Equal(t, []string{"graph.example.com"}, opts.Secrets[0].Hosts)
+	assert.Equal(t, []string{"GET"}, opts.Secrets[0].Methods)
+}
+
+func TestBuilderKillOnSecretLeak(t *testing.T) {
+	opts := New("alpine:latest").KillOnSecretLeak().Options()
+	assert.Equal(t, api.LeakActionKill, opts.SecretLeakAction)
+}
+
+func TestBuilderSignRequests(t *testing.T) {
+	opts := New("alpine:latest").
+		AddSecret("HOOK_KEY", "k", "hooks.example.com").
+		SignRequests("hooks.example.com", api.RequestSigning{Secret: "HOOK_KEY", Header: "X-Signature"}).
+		Options()
+
+	assert.Equal(t, map[string]api.RequestSigning{
+		"hooks.example.com": {Secret: "HOOK_KEY", Header: "X-Signature"},
+	}, opts.RequestSigning)
+}
+
+func TestBuilderWithSecretTTL(t *testing.T) {
+	opts := New("alpine:latest").
+		AddSecret("API_KEY", "sk-123", "api.example.com").
+		WithSecretTTL("API_KEY", time.Hour).
+		Options()
+
+	require.Len(t, opts.Secrets, 1)
+	require.NotNil(t, opts.Secrets[0].ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *opts.Secrets[0].ExpiresAt, time.Minute)
+}
+
+func TestBuilderAddGCPSecret(t *testing.T) {
+	opts := New("alpine:latest").
+		AddGCPSecret("VERTEX", []byte(`{"type":"service_account"}`), "").
+		AddGCPSecret("RUN", []byte(`{"type":"service_account"}`), "https://svc.a.run.app", "svc.a.run.app").
+		Options()
+
+	require.Len(t, opts.Secrets, 2)
+	assert.Equal(t, []string{api.DefaultGCPHost}, opts.Secrets[0].Hosts)
+	require.NotNil(t, opts.Secrets[0].OAuth2)
+	assert.Equal(t, `{"type":"service_account"}`, opts.Secrets[0].OAuth2.ServiceAccount)
+	assert.Equal(t, []string{"svc.a.run.app"}, opts.Secrets[1].Hosts)
+	assert.Equal(t, "https://svc.a.run.app", opts.Secrets[1].OAuth2.Audience)
+}
+
+func TestBuilderAddGitHubAppSecret(t *testing.T) {
+	opts := New("alpine:latest").
+		AddGitHubAppSecret("GH", api.GitHubApp{AppID: 7, InstallationID: 42, PrivateKey: "aws-sm:app"}).
+		AddGitHubAppSecret("GHE", api.GitHubApp{AppID: 8, InstallationID: 43, PrivateKey: "aws-sm:ghe", APIURL: "https://ghe.example.com/api/v3"}, "ghe.example.com").
+		Options()
+
+	require.Len(t, opts.Secrets, 2)
+	assert.Equal(t, api.DefaultGitHubAppHosts, opts.Secrets[0].Hosts)
+	require.NotNil(t, opts.Secrets[0].GitHubApp)
+	assert.Equal(t, int64(42), opts.Secrets[0].GitHubApp.InstallationID)
+	assert.Equal(t, []string{"ghe.example.com"}, opts.Secrets[1].Hosts)
+	assert.Equal(t, "https://ghe.example.com/api/v3", opts.Secrets[1].GitHubApp.APIURL)
+}
+
+func TestBuilderWithSecretProfile(t *testing.T) {
+	opts := New("alpine:latest").
+		WithSecretProfile("anthropic").
+		WithSecretProfile("github-readonly").
+		Options()
+	assert.Equal(t, []string{"anthropic", "github-readonly"}, opts.SecretProfiles)
+}
+
 func TestBuilderBlockPrivateIPs(t *testing.T) {
 	opts := New("alpine:latest").BlockPrivateIPs().Options()
 	require.True(t, opts.BlockPrivateIPs)
@@ -67,6 +282,11 @@ func TestBuilderWorkspace(t *testing.T) {
 	require.Equal(t, "/home/user/code", opts.Workspace)
 }
 
+func TestBuilderWorkspaceFrom(t *testing.T) {
+	opts := New("alpine:latest").WithWorkspaceFrom("agent-run-1").Options()
+	require.Equal(t, "agent-run-1", opts.WorkspaceFrom)
+}
+
 func TestBuilderDNSServers(t *testing.T) {
 	opts := New("alpine:latest").
 		WithDNSServers("1.1.1.1", "1.0.0.1").
@@ -139,3 +359,148 @@ func TestBuilderFullChain(t *testing.T) {
 	require.Len(t, opts.Mounts, 1)
 	require.Equal(t, 120, opts.TimeoutSeconds)
 }
+
+func TestBuilderFromSnapshot(t *testing.T) {
+	opts := New("alpine:latest").
+		FromSnapshot("matchlock-fixture:0123456789abcdef").
+		WithCPUs(2).
+		Options()
+
+	require.Equal(t, "matchlock-fixture:0123456789abcdef", opts.Image)
+	require.Equal(t, 2, opts.CPUs)
+}
+
+func TestBuilderFromConfig(t *testing.T) {
+	cfg := &api.Config{
+		Image:      "python:3.12-alpine",
+		Privileged: true,
+		Resources:  &api.Resources{CPUs: 2, MemoryMB: 1024, DiskSizeMB: 2048, TimeoutSeconds: 60},
+		Network: &api.NetworkConfig{
+			AllowedHosts:    []string{"api.openai.com"},
+			BlockPrivateIPs: true,
+			Secrets: map[string]api.Secret{
+				"B_KEY": {Value: "b", Hosts: []string{"b.example.com"}},
+				"A_KEY": {Value: "a", Hosts: []string{"a.example.com"}, Methods: []string{"POST"}},
+			},
+			Shape:       &api.NetworkShape{LatencyMS: 100},
+			UpstreamTLS: map[string]api.UpstreamTLS{"lab.internal": {MinVersion: "1.2"}},
+		},
+		VFS: &api.VFSConfig{
+			Workspace: "/code",
+			Mounts:    map[string]api.MountConfig{"/code/src": {Type: "real_fs", HostPath: "/src", Readonly: true}},
+		},
+		ImageCfg: &api.ImageConfig{User: "nobody", Cmd: []string{"python3"}},
+	}
+
+	opts := FromConfig(cfg).WithMemory(4096).AllowHost("pypi.org").Options()
+	assert.Equal(t, "python:3.12-alpine", opts.Image)
+	assert.True(t, opts.Privileged)
+	assert.Equal(t, 2, opts.CPUs)
+	assert.Equal(t, 4096, opts.MemoryMB)
+	assert.Equal(t, 60, opts.TimeoutSeconds)
+	assert.Equal(t, []string{"api.openai.com", "pypi.org"}, opts.AllowedHosts)
+	assert.True(t, opts.BlockPrivateIPs)
+	require.Len(t, opts.Secrets, 2)
+	assert.Equal(t, "A_KEY", opts.Secrets[0].Name)
+	assert.Equal(t, []string{"POST"}, opts.Secrets[0].Methods)
+	assert.Equal(t, "b", opts.Secrets[1].Value)
+	assert.Equal(t, 100, opts.NetworkShape.LatencyMS)
+	assert.Equal(t, "1.2", opts.UpstreamTLS["lab.internal"].MinVersion)
+	assert.Equal(t, "/code", opts.Workspace)
+	assert.Equal(t, MountConfig{Type: "real_fs", HostPath: "/src", Readonly: true}, opts.Mounts["/code/src"])
+	assert.Equal(t, "nobody", opts.ImageConfig.User)
+	assert.Equal(t, []string{"python3"}, opts.ImageConfig.Cmd)
+}
+
+func TestBuilderWithSize(t *testing.T) {
+	opts := New("alpine:latest").WithSize("large").WithMemory(16384).Options()
+	assert.Equal(t, "large", opts.Size)
+	assert.Equal(t, 16384, opts.MemoryMB)
+	assert.Zero(t, opts.CPUs, "left to the preset")
+}
+
+func TestBuilderWithRedaction(t *testing.T) {
+	assert.False(t, New("alpine:latest").Options().Redact)
+	assert.True(t, New("alpine:latest").WithRedaction().Options().Redact)
+}
+
+func TestBuilderWithEnvAndLabels(t *testing.T) {
+	opts := New("alpine:latest").
+		WithLabel("task", "review").
+		WithEnv("AGENT_ID", "{{.SandboxID}}").
+		WithEnv("TASK", `{{.Label "task"}}`).
+		Options()
+
+	assert.Equal(t, map[string]string{"task": "review"}, opts.Labels)
+	assert.Equal(t, map[string]string{"AGENT_ID": "{{.SandboxID}}", "TASK": `{{.Label "task"}}`}, opts.Env)
+}
+
+func TestLoadSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+secrets:
+  B_KEY: {value: b, hosts: [b.example.com], header: "X-Api-Key: {value}"}
+  A_KEY: {value: a, hosts: [a.example.com/v1], methods: [POST]}
+`), 0600))
+
+	secrets, err := LoadSecretFile(path)
+	require.NoError(t, err)
+
+	opts := New("alpine:latest").AddSecrets(secrets...).Options()
+	assert.Equal(t, []Secret{
+		{Name: "A_KEY", Value: "a", Hosts: []string{"a.example.com"}, Paths: []string{"/v1"}, Methods: []string{"POST"}},
+		{Name: "B_KEY", Value: "b", Hosts: []string{"b.example.com"}, Header: "X-Api-Key: {value}"},
+	}, opts.Secrets)
+}
+
+func TestBuilderMountS3(t *testing.T) {
+	opts := New("alpine:latest").
+		MountS3("/workspace/data", "datasets", "raw/2024").
+		MountS3Readonly("/workspace/ref", "reference", "").
+		Options()
+
+	m := opts.Mounts["/workspace/data"]
+	assert.Equal(t, "s3", m.Type)
+	assert.Equal(t, &api.S3Mount{Bucket: "datasets", Prefix: "raw/2024"}, m.S3)
+	assert.False(t, m.Readonly)
+
+	m = opts.Mounts["/workspace/ref"]
+	assert.Equal(t, "reference", m.S3.Bucket)
+	assert.True(t, m.Readonly)
+}
+
+func TestBuilderMountGit(t *testing.T) {
+	opts := New("alpine:latest").
+		MountGit("/workspace/repo", api.GitMount{URL: "git@github.com:acme/app.git", PushBranch: "agent/fix"}).
+		Options()
+
+	m := opts.Mounts["/workspace/repo"]
+	assert.Equal(t, "git", m.Type)
+	assert.Equal(t, &api.GitMount{URL: "git@github.com:acme/app.git", PushBranch: "agent/fix"}, m.Git)
+}
+
+func TestBuilderMountCache(t *testing.T) {
+	opts := New("alpine:latest").
+		MountCache("/workspace/.cache/pip", "pip").
+		Options()
+
+	m := opts.Mounts["/workspace/.cache/pip"]
+	assert.Equal(t, "cache", m.Type)
+	assert.Equal(t, &api.CacheMount{Name: "pip"}, m.Cache)
+}
+
+func TestBuilderMountEncrypted(t *testing.T) {
+	opts := New("alpine:latest").MountEncrypted("/workspace").Options()
+	assert.Equal(t, MountConfig{Type: "encrypted"}, opts.Mounts["/workspace"])
+}
+
+func TestBuilderMountHostDirWithAccess(t *testing.T) {
+	opts := New("alpine:latest").
+		MountHostDirWithAccess("/workspace", "/host/src", api.MountAccess{DenyRead: []string{".env"}, DenyWrite: []string{"*.pem"}}).
+		Options()
+
+	m := opts.Mounts["/workspace"]
+	assert.Equal(t, "real_fs", m.Type)
+	assert.Equal(t, "/host/src", m.HostPath)
+	assert.Equal(t, &api.MountAccess{DenyRead: []string{".env"}, DenyWrite: []string{"*.pem"}}, m.Access)
+}
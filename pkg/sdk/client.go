@@ -22,11 +22,14 @@ package sdk
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"sync"
@@ -35,6 +38,8 @@ import (
 
 	"github.com/jingkaihe/matchlock/internal/errx"
 	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/transfer"
+	"github.com/jingkaihe/matchlock/pkg/workspaces"
 )
 
 // Client is a Matchlock JSON-RPC client.
@@ -46,14 +51,25 @@ type Client struct {
 	stderr    io.ReadCloser
 	requestID atomic.Uint64
 	vmID      string
-	mu        sync.Mutex // legacy — kept for Close()
-	closed    bool
+	// transferSocket is where the sandbox serves bulk file transfers, if
+	// anywhere; see transfer.go.
+	transferSocket string
+	mu             sync.Mutex // legacy — kept for Close()
+	closed         bool
+	// pooled is set when the client is attached to a pool daemon rather
+	// than to a matchlock rpc process of its own.
+	pooled bool
+	// expiry closes a pooled sandbox once its timeout has run out.
+	expiry *time.Timer
 
 	// Concurrent request handling
 	writeMu    sync.Mutex                 // serializes writes to stdin
 	pendingMu  sync.Mutex                 // protects pending map
 	pending    map[uint64]*pendingRequest // in-flight requests by ID
 	readerOnce sync.Once                  // ensures reader goroutine starts once
+
+	watchMu     sync.Mutex              // protects fileWatches
+	fileWatches map[*fileWatch]struct{} // active WatchFiles subscriptions
 }
 
 // Config holds client configuration
@@ -62,6 +78,11 @@ type Config struct {
 	BinaryPath string
 	// UseSudo runs matchlock with sudo (required for TAP devices)
 	UseSudo bool
+	// PoolSocket is the socket of a 'matchlock pool serve' daemon. When
+	// set, the client is attached to the daemon, which boots sandboxes
+	// ahead of use, instead of starting a matchlock rpc process of its
+	// own; see LaunchFromPool. UseSudo is then left to the daemon.
+	PoolSocket string
 }
 
 // DefaultConfig returns the default client configuration
@@ -78,7 +99,9 @@ func DefaultConfig() Config {
 // NewClient creates a new Matchlock client and starts the RPC process
 func NewClient(cfg Config) (*Client, error) {
 	var cmd *exec.Cmd
-	if cfg.UseSudo {
+	if cfg.PoolSocket != "" {
+		cmd = exec.Command(cfg.BinaryPath, "pool", "attach", "--socket", cfg.PoolSocket)
+	} else if cfg.UseSudo {
 		cmd = exec.Command("sudo", cfg.BinaryPath, "rpc")
 	} else {
 		cmd = exec.Command(cfg.BinaryPath, "rpc")
@@ -112,6 +135,7 @@ func NewClient(cfg Config) (*Client, error) {
 		stdout:  bufio.NewReader(stdout),
 		stderr:  stderr,
 		pending: make(map[uint64]*pendingRequest),
+		pooled:  cfg.PoolSocket != "",
 	}, nil
 }
 
@@ -134,6 +158,9 @@ func (c *Client) Close(timeout time.Duration) error {
 		return nil
 	}
 	c.closed = true
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
 	c.mu.Unlock()
 
 	params := map[string]interface{}{
@@ -190,12 +217,34 @@ type CreateOptions struct {
 	Image string
 	// Privileged skips in-guest security restrictions (seccomp, cap drop, no_new_privs)
 	Privileged bool
+	// Redact masks secret values and placeholders in exec output, events
+	// and VM logs
+	Redact bool
+	// Size names a resource preset ("small", "medium", "large" or one from
+	// the host's presets file). CPUs, MemoryMB, DiskSizeMB and
+	// TimeoutSeconds that are set override it.
+	Size string
+	// Env is set for every command run in the sandbox. Values may use
+	// templates such as "{{.SandboxID}}", rendered when it is created.
+	Env map[string]string
+	// Labels annotate the sandbox and are available to templates as
+	// {{.Label "KEY"}}
+	Labels map[string]string
 	// CPUs is the number of vCPUs
 	CPUs int
 	// MemoryMB is the memory in megabytes
 	MemoryMB int
-	// DiskSizeMB is the disk size in megabytes (default: 5120)
+	// DiskSizeMB is the minimum disk size in megabytes (default: the
+	// image plus RootfsFreeSpaceMB)
 	DiskSizeMB int
+	// RootfsFreeSpaceMB is the free space in megabytes left on the root
+	// disk beyond the image contents (default: 4096)
+	RootfsFreeSpaceMB int
+	// SwapMB is the guest swap size in megabytes (default: none)
+	SwapMB int
+	// SwapType is "zram" (compressed RAM, the default) or "file" (a sparse
+	// disk image deleted with the sandbox)
+	SwapType string
 	// TimeoutSeconds is the maximum execution time
 	TimeoutSeconds int
 	// AllowedHosts is a list of allowed network hosts (supports wildcards)
@@ -208,8 +257,57 @@ type CreateOptions struct {
 	Secrets []Secret
 	// Workspace is the mount point for VFS in the guest (default: /workspace)
 	Workspace string
+	// WorkspaceFrom seeds the workspace with a saved workspace snapshot
+	WorkspaceFrom string
+	// VFSSlowOp logs guest filesystem operations taking at least this long
+	// to vfs_slow.log in the sandbox state directory (0 = off).
+	VFSSlowOp time.Duration
+	// DataDisks are persistent ext4 disks attached as block devices, kept
+	// on the host by name across sandboxes
+	DataDisks []api.DataDisk
 	// DNSServers overrides the default DNS servers (8.8.8.8, 8.8.4.4)
 	DNSServers []string
+	// HostPorts lists host loopback ports reachable from the guest via
+	// host.matchlock.internal
+	HostPorts []int
+	// NetworkShape emulates latency, jitter, and bandwidth limits on the
+	// sandbox data path
+	NetworkShape *NetworkShape
+	// MaxConnections caps simultaneously open guest connections (0 = unlimited)
+	MaxConnections int
+	// MaxConnectionsPerMinute caps new guest connections per minute (0 = unlimited)
+	MaxConnectionsPerMinute int
+	// MaxEgressBytes caps the total bytes the guest may send out (0 = unlimited)
+	MaxEgressBytes int64
+	// EgressBudgetAction is what happens once MaxEgressBytes is spent:
+	// api.EgressActionBlock (default) or api.EgressActionKill
+	EgressBudgetAction string
+	// CertPins maps host patterns to SPKI pins ("sha256/<base64>") that the
+	// host's upstream certificate chain must match
+	CertPins map[string][]string
+	// UpstreamTLS maps host patterns to options for verifying intercepted
+	// upstream TLS servers
+	UpstreamTLS map[string]UpstreamTLS
+	// NoInterceptHosts are allowed host patterns whose TLS traffic is relayed
+	// without interception; secrets are never injected into them
+	NoInterceptHosts []string
+	// UpstreamProxy chains sandbox egress through an HTTP proxy: an
+	// http://HOST:PORT URL, or "system" for the host's proxy settings
+	UpstreamProxy string
+	// ProxyAutoConfigURL chains sandbox egress through the proxy named in a
+	// PAC file
+	ProxyAutoConfigURL string
+	// RequestSigning maps host patterns to the HMAC the proxy signs their
+	// request bodies with, keyed by one of Secrets
+	RequestSigning map[string]api.RequestSigning
+	// SecretLeakAction is what happens when the guest sends a secret
+	// placeholder to a host the secret is not bound to, besides blocking
+	// the request: api.LeakActionBlock (default) or api.LeakActionKill
+	SecretLeakAction string
+	// SecretProfiles name bundles of secrets in the host's secret profiles
+	// file (~/.config/matchlock/secret-profiles.yaml), added to Secrets by
+	// matchlock. Secrets of the same name take precedence.
+	SecretProfiles []string
 	// ImageConfig holds OCI image metadata (USER, ENTRYPOINT, CMD, WORKDIR, ENV)
 	ImageConfig *ImageConfig
 }
@@ -223,6 +321,26 @@ type ImageConfig struct {
 	Env        map[string]string `json:"env,omitempty"`
 }
 
+// NetworkShape describes emulated link conditions. Latency (± jitter) is
+// added once per request/response turn; bandwidth caps each direction.
+// A non-zero JitterSeed makes the jitter reproducible.
+type NetworkShape struct {
+	LatencyMS    int    `json:"latency_ms,omitempty"`
+	JitterMS     int    `json:"jitter_ms,omitempty"`
+	JitterSeed   uint64 `json:"jitter_seed,omitempty"`
+	BandwidthBps int64  `json:"bandwidth_bps,omitempty"`
+}
+
+// UpstreamTLS customizes how the proxy verifies an intercepted host's TLS
+// server. RootCAFiles are PEM files on the host that replace the system roots;
+// MinVersion is "1.0" to "1.3". InsecureSkipVerify is for lab endpoints with
+// self-signed certificates only.
+type UpstreamTLS struct {
+	RootCAFiles        []string `json:"root_ca_files,omitempty"`
+	MinVersion         string   `json:"min_version,omitempty"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify,omitempty"`
+}
+
 // Secret defines a secret that will be injected as a placeholder env var
 // and replaced with the real value in HTTP requests to allowed hosts
 type Secret struct {
@@ -232,13 +350,61 @@ type Secret struct {
 	Value string
 	// Hosts is a list of hosts where this secret can be used (supports wildcards)
 	Hosts []string
+	// In lists where the placeholder is replaced: api.SecretInHeader,
+	// api.SecretInQuery and/or api.SecretInBody. Empty means header and query.
+	In []string
+	// Paths restricts the secret to URL path prefixes (e.g. "/v1/messages").
+	// Empty means any path.
+	Paths []string
+	// Methods restricts the secret to HTTP methods. Empty means any method.
+	Methods []string
+	// Header is sent on every request to Hosts with "{value}" replaced by
+	// the real value, e.g. "Authorization: Bearer {value}", so the guest
+	// need not format it.
+	Header string
+	// OAuth2 makes the secret an OAuth 2.0 client whose access tokens the
+	// proxy mints and sends as "Authorization: Bearer". Value is unused.
+	OAuth2 *api.OAuth2
+	// GitHubApp makes the secret a GitHub App installation whose access
+	// tokens the proxy mints and sends as "Authorization: Bearer". Value is
+	// unused.
+	GitHubApp *api.GitHubApp
+	// ExpiresAt stops the secret from being injected after this time;
+	// requests that would have used it are refused.
+	ExpiresAt *time.Time
 }
 
 // MountConfig defines a VFS mount
 type MountConfig struct {
-	Type     string `json:"type"` // memory, real_fs, overlay
+	Type     string `json:"type"` // memory, real_fs, overlay, s3, git
 	HostPath string `json:"host_path,omitempty"`
 	Readonly bool   `json:"readonly,omitempty"`
+	// Backend is "fuse" (default) or "virtiofs" for real_fs mounts.
+	Backend string `json:"backend,omitempty"`
+	// S3 names the bucket of an "s3" mount.
+	S3 *api.S3Mount `json:"s3,omitempty"`
+	// Git names the repository of a "git" mount.
+	Git *api.GitMount `json:"git,omitempty"`
+	// Cache names the shared cache of a "cache" mount.
+	Cache *api.CacheMount `json:"cache,omitempty"`
+	// SizeMB caps the data a "memory" mount holds; writes past it fail
+	// with ENOSPC.
+	SizeMB int `json:"size_mb,omitempty"`
+	// Access restricts the paths in the mount the guest may read and write;
+	// see api.MountAccess.
+	Access *api.MountAccess `json:"access,omitempty"`
+	// Exclude hides the paths of a real_fs or overlay host directory
+	// matching these globs, on top of its .matchlockignore.
+	Exclude []string `json:"exclude,omitempty"`
+	// Case is api.MountCaseRejectCollisions or api.MountCaseFold, for host
+	// directories on case-insensitive volumes.
+	Case string `json:"case,omitempty"`
+	// IDMap shows the host files of a real_fs or overlay mount as owned by
+	// a guest user; see api.MountIDMap.
+	IDMap *api.MountIDMap `json:"idmap,omitempty"`
+	// Unconfined lets a real_fs or overlay mount follow symlinks out of its
+	// host directory, which are refused by default.
+	Unconfined bool `json:"unconfined,omitempty"`
 }
 
 // Create creates and starts a new sandbox VM
@@ -246,34 +412,68 @@ func (c *Client) Create(opts CreateOptions) (string, error) {
 	if opts.Image == "" {
 		return "", ErrImageRequired
 	}
-	if opts.CPUs == 0 {
-		opts.CPUs = api.DefaultCPUs
+	// A preset is resolved by matchlock, so only explicit values are sent.
+	if opts.Size == "" {
+		if opts.CPUs == 0 {
+			opts.CPUs = api.DefaultCPUs
+		}
+		if opts.MemoryMB == 0 {
+			opts.MemoryMB = api.DefaultMemoryMB
+		}
+		if opts.TimeoutSeconds == 0 {
+			opts.TimeoutSeconds = api.DefaultTimeoutSeconds
+		}
+	}
+
+	resources := map[string]interface{}{}
+	if opts.Size != "" {
+		resources["size"] = opts.Size
 	}
-	if opts.MemoryMB == 0 {
-		opts.MemoryMB = api.DefaultMemoryMB
+	if opts.CPUs > 0 {
+		resources["cpus"] = opts.CPUs
 	}
-	if opts.DiskSizeMB == 0 {
-		opts.DiskSizeMB = api.DefaultDiskSizeMB
+	if opts.MemoryMB > 0 {
+		resources["memory_mb"] = opts.MemoryMB
 	}
-	if opts.TimeoutSeconds == 0 {
-		opts.TimeoutSeconds = api.DefaultTimeoutSeconds
+	if opts.DiskSizeMB > 0 {
+		resources["disk_size_mb"] = opts.DiskSizeMB
+	}
+	if opts.RootfsFreeSpaceMB > 0 {
+		resources["rootfs_free_space_mb"] = opts.RootfsFreeSpaceMB
+	}
+	if opts.TimeoutSeconds > 0 {
+		resources["timeout_seconds"] = opts.TimeoutSeconds
+	}
+	if opts.SwapMB > 0 {
+		resources["swap_mb"] = opts.SwapMB
+	}
+	if opts.SwapType != "" {
+		resources["swap_type"] = opts.SwapType
 	}
-
 	params := map[string]interface{}{
-		"image": opts.Image,
-		"resources": map[string]interface{}{
-			"cpus":            opts.CPUs,
-			"memory_mb":       opts.MemoryMB,
-			"disk_size_mb":    opts.DiskSizeMB,
-			"timeout_seconds": opts.TimeoutSeconds,
-		},
+		"image":     opts.Image,
+		"resources": resources,
 	}
 
 	if opts.Privileged {
 		params["privileged"] = true
 	}
+	if opts.Redact {
+		params["redact"] = true
+	}
+	if len(opts.Env) > 0 {
+		params["env"] = opts.Env
+	}
+	if len(opts.Labels) > 0 {
+		params["labels"] = opts.Labels
+	}
+	if len(opts.DataDisks) > 0 {
+		params["data_disks"] = opts.DataDisks
+	}
 
-	if len(opts.AllowedHosts) > 0 || opts.BlockPrivateIPs || len(opts.Secrets) > 0 || len(opts.DNSServers) > 0 {
+	if len(opts.AllowedHosts) > 0 || opts.BlockPrivateIPs || len(opts.Secrets) > 0 || len(opts.DNSServers) > 0 || len(opts.HostPorts) > 0 || opts.NetworkShape != nil ||
+		opts.MaxConnections > 0 || opts.MaxConnectionsPerMinute > 0 || opts.MaxEgressBytes > 0 || len(opts.CertPins) > 0 || len(opts.UpstreamTLS) > 0 ||
+		len(opts.NoInterceptHosts) > 0 || opts.UpstreamProxy != "" || opts.ProxyAutoConfigURL != "" || len(opts.RequestSigning) > 0 || opts.SecretLeakAction != "" || len(opts.SecretProfiles) > 0 {
 		network := map[string]interface{}{
 			"allowed_hosts":     opts.AllowedHosts,
 			"block_private_ips": opts.BlockPrivateIPs,
@@ -281,20 +481,84 @@ func (c *Client) Create(opts CreateOptions) (string, error) {
 		if len(opts.Secrets) > 0 {
 			secrets := make(map[string]interface{})
 			for _, s := range opts.Secrets {
-				secrets[s.Name] = map[string]interface{}{
+				secret := map[string]interface{}{
 					"value": s.Value,
 					"hosts": s.Hosts,
 				}
+				if len(s.In) > 0 {
+					secret["in"] = s.In
+				}
+				if len(s.Paths) > 0 {
+					secret["paths"] = s.Paths
+				}
+				if len(s.Methods) > 0 {
+					secret["methods"] = s.Methods
+				}
+				if s.Header != "" {
+					secret["header"] = s.Header
+				}
+				if s.OAuth2 != nil {
+					secret["oauth2"] = s.OAuth2
+				}
+				if s.GitHubApp != nil {
+					secret["github_app"] = s.GitHubApp
+				}
+				if s.ExpiresAt != nil {
+					secret["expires_at"] = s.ExpiresAt
+				}
+				secrets[s.Name] = secret
 			}
 			network["secrets"] = secrets
 		}
 		if len(opts.DNSServers) > 0 {
 			network["dns_servers"] = opts.DNSServers
 		}
+		if len(opts.HostPorts) > 0 {
+			network["host_ports"] = opts.HostPorts
+		}
+		if opts.NetworkShape != nil {
+			network["shape"] = opts.NetworkShape
+		}
+		if len(opts.CertPins) > 0 {
+			network["cert_pins"] = opts.CertPins
+		}
+		if len(opts.UpstreamTLS) > 0 {
+			network["upstream_tls"] = opts.UpstreamTLS
+		}
+		if len(opts.RequestSigning) > 0 {
+			network["request_signing"] = opts.RequestSigning
+		}
+		if opts.SecretLeakAction != "" {
+			network["secret_leak_action"] = opts.SecretLeakAction
+		}
+		if len(opts.SecretProfiles) > 0 {
+			network["secret_profiles"] = opts.SecretProfiles
+		}
+		if len(opts.NoInterceptHosts) > 0 {
+			network["no_intercept_hosts"] = opts.NoInterceptHosts
+		}
+		if opts.UpstreamProxy != "" {
+			network["upstream_proxy"] = opts.UpstreamProxy
+		}
+		if opts.ProxyAutoConfigURL != "" {
+			network["proxy_auto_config_url"] = opts.ProxyAutoConfigURL
+		}
+		if opts.MaxConnections > 0 {
+			network["max_connections"] = opts.MaxConnections
+		}
+		if opts.MaxConnectionsPerMinute > 0 {
+			network["max_connections_per_minute"] = opts.MaxConnectionsPerMinute
+		}
+		if opts.MaxEgressBytes > 0 {
+			network["max_egress_bytes"] = opts.MaxEgressBytes
+		}
+		if opts.EgressBudgetAction != "" {
+			network["egress_budget_action"] = opts.EgressBudgetAction
+		}
 		params["network"] = network
 	}
 
-	if len(opts.Mounts) > 0 || opts.Workspace != "" {
+	if len(opts.Mounts) > 0 || opts.Workspace != "" || opts.WorkspaceFrom != "" || opts.VFSSlowOp > 0 {
 		vfs := make(map[string]interface{})
 		if len(opts.Mounts) > 0 {
 			vfs["mounts"] = opts.Mounts
@@ -302,6 +566,12 @@ func (c *Client) Create(opts CreateOptions) (string, error) {
 		if opts.Workspace != "" {
 			vfs["workspace"] = opts.Workspace
 		}
+		if opts.WorkspaceFrom != "" {
+			vfs["workspace_from"] = opts.WorkspaceFrom
+		}
+		if opts.VFSSlowOp > 0 {
+			vfs["slow_op_ms"] = max(opts.VFSSlowOp.Milliseconds(), 1)
+		}
 		params["vfs"] = vfs
 	}
 
@@ -315,13 +585,15 @@ func (c *Client) Create(opts CreateOptions) (string, error) {
 	}
 
 	var createResult struct {
-		ID string `json:"id"`
+		ID             string `json:"id"`
+		TransferSocket string `json:"transfer_socket"`
 	}
 	if err := json.Unmarshal(result, &createResult); err != nil {
 		return "", errx.Wrap(ErrParseCreateResult, err)
 	}
 
 	c.vmID = createResult.ID
+	c.transferSocket = createResult.TransferSocket
 	return c.vmID, nil
 }
 
@@ -337,6 +609,34 @@ type ExecResult struct {
 	DurationMS int64
 }
 
+// ExecOptions configures a single command execution.
+type ExecOptions struct {
+	// WorkingDir is the guest directory to run in (default: the workspace)
+	WorkingDir string
+	// CreateWorkingDir creates WorkingDir if it does not exist. Without it,
+	// a missing WorkingDir fails with an RPCError whose IsWorkingDirError
+	// returns true.
+	CreateWorkingDir bool
+	// User runs the command as "uid", "uid:gid" or a username
+	User string
+}
+
+func (o ExecOptions) params(command string) map[string]interface{} {
+	params := map[string]interface{}{
+		"command": command,
+	}
+	if o.WorkingDir != "" {
+		params["working_dir"] = o.WorkingDir
+	}
+	if o.CreateWorkingDir {
+		params["create_working_dir"] = true
+	}
+	if o.User != "" {
+		params["user"] = o.User
+	}
+	return params
+}
+
 // Exec executes a command in the sandbox and returns the buffered result.
 // The context controls the lifetime of the request — if cancelled, a cancel
 // RPC is sent to abort the in-flight execution.
@@ -346,13 +646,22 @@ func (c *Client) Exec(ctx context.Context, command string) (*ExecResult, error)
 
 // ExecWithDir executes a command in the sandbox with a working directory.
 func (c *Client) ExecWithDir(ctx context.Context, command, workingDir string) (*ExecResult, error) {
-	params := map[string]string{
-		"command": command,
-	}
-	if workingDir != "" {
-		params["working_dir"] = workingDir
-	}
+	return c.ExecWithOptions(ctx, command, ExecOptions{WorkingDir: workingDir})
+}
+
+// ExecWithOptions executes a command in the sandbox with the given options.
+func (c *Client) ExecWithOptions(ctx context.Context, command string, opts ExecOptions) (*ExecResult, error) {
+	return c.exec(ctx, opts.params(command))
+}
 
+// ExecArgv executes argv directly in the sandbox without a shell, so
+// arguments reach the program verbatim: no globbing, expansion or word
+// splitting. argv[0] is resolved against the guest PATH.
+func (c *Client) ExecArgv(ctx context.Context, argv ...string) (*ExecResult, error) {
+	return c.exec(ctx, map[string]interface{}{"argv": argv})
+}
+
+func (c *Client) exec(ctx context.Context, params map[string]interface{}) (*ExecResult, error) {
 	result, err := c.sendRequestCtx(ctx, "exec", params, nil)
 	if err != nil {
 		return nil, err
@@ -396,13 +705,20 @@ func (c *Client) ExecStream(ctx context.Context, command string, stdout, stderr
 // ExecStreamWithDir executes a command with a working directory and streams
 // stdout/stderr to the provided writers in real-time.
 func (c *Client) ExecStreamWithDir(ctx context.Context, command, workingDir string, stdout, stderr io.Writer) (*ExecStreamResult, error) {
-	params := map[string]string{
-		"command": command,
-	}
-	if workingDir != "" {
-		params["working_dir"] = workingDir
-	}
+	return c.ExecStreamWithOptions(ctx, command, ExecOptions{WorkingDir: workingDir}, stdout, stderr)
+}
+
+// ExecStreamWithOptions is the streaming counterpart of ExecWithOptions.
+func (c *Client) ExecStreamWithOptions(ctx context.Context, command string, opts ExecOptions, stdout, stderr io.Writer) (*ExecStreamResult, error) {
+	return c.execStream(ctx, opts.params(command), stdout, stderr)
+}
+
+// ExecStreamArgv is the streaming counterpart of ExecArgv.
+func (c *Client) ExecStreamArgv(ctx context.Context, argv []string, stdout, stderr io.Writer) (*ExecStreamResult, error) {
+	return c.execStream(ctx, map[string]interface{}{"argv": argv}, stdout, stderr)
+}
 
+func (c *Client) execStream(ctx context.Context, params map[string]interface{}, stdout, stderr io.Writer) (*ExecStreamResult, error) {
 	onNotification := func(method string, params json.RawMessage) {
 		var chunk struct {
 			Data string `json:"data"`
@@ -452,6 +768,13 @@ func (c *Client) WriteFile(ctx context.Context, path string, content []byte) err
 
 // WriteFileMode writes content to a file with specific permissions.
 func (c *Client) WriteFileMode(ctx context.Context, path string, content []byte, mode uint32) error {
+	if c.useTransfer(int64(len(content))) {
+		_, err := transfer.WriteFile(ctx, c.transferSocket, path, bytes.NewReader(content), mode)
+		if !errors.Is(err, transfer.ErrConnect) {
+			return err
+		}
+	}
+
 	params := map[string]interface{}{
 		"path":    path,
 		"content": base64.StdEncoding.EncodeToString(content),
@@ -464,6 +787,15 @@ func (c *Client) WriteFileMode(ctx context.Context, path string, content []byte,
 
 // ReadFile reads a file from the sandbox.
 func (c *Client) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	if size := c.transferReadSize(ctx, path); size >= 0 {
+		var buf bytes.Buffer
+		buf.Grow(int(size))
+		_, err := transfer.ReadFile(ctx, c.transferSocket, path, &buf)
+		if !errors.Is(err, transfer.ErrConnect) {
+			return buf.Bytes(), err
+		}
+	}
+
 	params := map[string]string{
 		"path": path,
 	}
@@ -485,10 +817,14 @@ func (c *Client) ReadFile(ctx context.Context, path string) ([]byte, error) {
 
 // FileInfo holds file metadata
 type FileInfo struct {
-	Name  string `json:"name"`
-	Size  int64  `json:"size"`
-	Mode  uint32 `json:"mode"`
-	IsDir bool   `json:"is_dir"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    uint32    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+	// UID and GID are the owner the guest sees.
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
 }
 
 // ListFiles lists files in a directory.
@@ -511,3 +847,396 @@ func (c *Client) ListFiles(ctx context.Context, path string) ([]FileInfo, error)
 
 	return listResult.Files, nil
 }
+
+// ListDir lists the entries of a directory in the sandbox; it is
+// ListFiles under the name the other file methods suggest.
+func (c *Client) ListDir(ctx context.Context, path string) ([]FileInfo, error) {
+	return c.ListFiles(ctx, path)
+}
+
+// Stat returns the metadata of a file or directory in the sandbox. A
+// missing path yields an error matching os.ErrNotExist.
+func (c *Client) Stat(ctx context.Context, path string) (*FileInfo, error) {
+	params := map[string]string{
+		"path": path,
+	}
+
+	result, err := c.sendRequestCtx(ctx, "stat", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var statResult struct {
+		Exists bool      `json:"exists"`
+		Info   *FileInfo `json:"info"`
+	}
+	if err := json.Unmarshal(result, &statResult); err != nil {
+		return nil, errx.Wrap(ErrParseStatResult, err)
+	}
+	if !statResult.Exists || statResult.Info == nil {
+		return nil, errx.With(os.ErrNotExist, ": %s", path)
+	}
+	return statResult.Info, nil
+}
+
+// RemoveFile removes a file or empty directory in the sandbox.
+func (c *Client) RemoveFile(ctx context.Context, path string) error {
+	params := map[string]interface{}{
+		"path": path,
+	}
+
+	_, err := c.sendRequestCtx(ctx, "remove", params, nil)
+	return err
+}
+
+// RemoveAll removes a file or directory tree in the sandbox. A missing
+// path is not an error.
+func (c *Client) RemoveAll(ctx context.Context, path string) error {
+	params := map[string]interface{}{
+		"path":      path,
+		"recursive": true,
+	}
+
+	_, err := c.sendRequestCtx(ctx, "remove", params, nil)
+	return err
+}
+
+// Chmod changes the permission bits of a file or directory in the sandbox.
+func (c *Client) Chmod(ctx context.Context, path string, mode uint32) error {
+	params := map[string]interface{}{
+		"path": path,
+		"mode": mode,
+	}
+
+	_, err := c.sendRequestCtx(ctx, "chmod", params, nil)
+	return err
+}
+
+// Chown changes the owner of a file or directory in the sandbox as the
+// guest sees it. Only a mount with an idmap has files that can change
+// owner, and only to the mount's guest uid and gid, which it maps to its
+// host owner; other mounts show every file owned by root. -1 leaves an id
+// unchanged.
+func (c *Client) Chown(ctx context.Context, path string, uid, gid int) error {
+	params := map[string]interface{}{
+		"path": path,
+	}
+	if uid >= 0 {
+		params["uid"] = uid
+	}
+	if gid >= 0 {
+		params["gid"] = gid
+	}
+
+	_, err := c.sendRequestCtx(ctx, "chown", params, nil)
+	return err
+}
+
+// Rename moves a file or directory within the sandbox, replacing any file
+// at newPath. Both paths must be on the same mount.
+func (c *Client) Rename(ctx context.Context, oldPath, newPath string) error {
+	params := map[string]string{
+		"old_path": oldPath,
+		"new_path": newPath,
+	}
+
+	_, err := c.sendRequestCtx(ctx, "rename", params, nil)
+	return err
+}
+
+// HostMetrics holds aggregated network activity towards a single host.
+type HostMetrics struct {
+	Host          string `json:"host"`
+	Requests      int64  `json:"requests"`
+	Blocked       int64  `json:"blocked"`
+	Errors        int64  `json:"errors"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+}
+
+// NetworkMetrics returns per-host network counters accumulated over the
+// sandbox lifetime. The result is empty when network interception is off.
+func (c *Client) NetworkMetrics(ctx context.Context) ([]HostMetrics, error) {
+	result, err := c.sendRequestCtx(ctx, "network_metrics", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var metricsResult struct {
+		Hosts []HostMetrics `json:"hosts"`
+	}
+	if err := json.Unmarshal(result, &metricsResult); err != nil {
+		return nil, errx.Wrap(ErrParseMetricsResult, err)
+	}
+
+	return metricsResult.Hosts, nil
+}
+
+// EgressUsage returns how much of its egress byte budget the sandbox has
+// used, or nil when no budget is configured.
+func (c *Client) EgressUsage(ctx context.Context) (*api.EgressUsage, error) {
+	result, err := c.sendRequestCtx(ctx, "network_metrics", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var metricsResult struct {
+		Egress *api.EgressUsage `json:"egress"`
+	}
+	if err := json.Unmarshal(result, &metricsResult); err != nil {
+		return nil, errx.Wrap(ErrParseMetricsResult, err)
+	}
+
+	return metricsResult.Egress, nil
+}
+
+// NetworkViolations returns the network denials recorded over the sandbox
+// lifetime, one entry per host and rule. Use the api.Rule* constants to tell
+// denials apart, e.g. api.RuleAllowlist for hosts missing from the allowlist.
+// The result is empty when network interception is off.
+func (c *Client) NetworkViolations(ctx context.Context) ([]api.NetworkViolation, error) {
+	result, err := c.sendRequestCtx(ctx, "network_violations", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var violationsResult struct {
+		Violations []api.NetworkViolation `json:"violations"`
+	}
+	if err := json.Unmarshal(result, &violationsResult); err != nil {
+		return nil, errx.Wrap(ErrParseViolationsResult, err)
+	}
+
+	return violationsResult.Violations, nil
+}
+
+// SecretUsage reports, per secret, how many times it has been injected,
+// into which hosts and paths, and when it was last used. Secrets that were
+// never injected are included with zero injections, which makes them
+// candidates for removal in least-privilege reviews.
+func (c *Client) SecretUsage(ctx context.Context) ([]api.SecretUsage, error) {
+	result, err := c.sendRequestCtx(ctx, "secret_usage", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var usageResult struct {
+		Secrets []api.SecretUsage `json:"secrets"`
+	}
+	if err := json.Unmarshal(result, &usageResult); err != nil {
+		return nil, errx.Wrap(ErrParseSecretUsage, err)
+	}
+
+	return usageResult.Secrets, nil
+}
+
+// MountUsage reports the space held by each mount that accounts for it,
+// such as memory mounts, against its size limit (0 when unbounded).
+func (c *Client) MountUsage(ctx context.Context) ([]api.MountUsage, error) {
+	result, err := c.sendRequestCtx(ctx, "mount_usage", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var usageResult struct {
+		Mounts []api.MountUsage `json:"mounts"`
+	}
+	if err := json.Unmarshal(result, &usageResult); err != nil {
+		return nil, errx.Wrap(ErrParseMountUsage, err)
+	}
+
+	return usageResult.Mounts, nil
+}
+
+// VFSMetrics reports the filesystem operations the guest made on each
+// mount: counts, errors, bytes moved and latency histograms (bucketed by
+// api.VFSLatencyBounds), to tell whether a workload is filesystem-bound
+// and on which mount.
+func (c *Client) VFSMetrics(ctx context.Context) ([]api.MountMetrics, error) {
+	result, err := c.sendRequestCtx(ctx, "vfs_metrics", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var metricsResult struct {
+		Mounts []api.MountMetrics `json:"mounts"`
+	}
+	if err := json.Unmarshal(result, &metricsResult); err != nil {
+		return nil, errx.Wrap(ErrParseVFSMetrics, err)
+	}
+
+	return metricsResult.Mounts, nil
+}
+
+// DeniedHosts returns the distinct hosts, without port, that were refused
+// because they are not on the allowlist: the candidates to offer the user
+// as additional allowed hosts.
+func DeniedHosts(violations []api.NetworkViolation) []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, v := range violations {
+		if v.Rule != api.RuleAllowlist {
+			continue
+		}
+		host := v.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Snapshot saves the sandbox root filesystem into the local image store under
+// tag. Restore it by creating a sandbox with tag as the image, or with
+// SandboxBuilder.FromSnapshot. Workspace (VFS) contents are not included.
+func (c *Client) Snapshot(ctx context.Context, tag string) error {
+	params := map[string]string{
+		"tag": tag,
+	}
+
+	_, err := c.sendRequestCtx(ctx, "snapshot", params, nil)
+	return err
+}
+
+// SnapshotWorkspace saves the files currently in the workspace, including
+// mounts nested in it, as a named workspace snapshot on the host. A later
+// sandbox created with SandboxBuilder.WithWorkspaceFrom starts with those
+// files, without the VM state a Snapshot would carry.
+func (c *Client) SnapshotWorkspace(ctx context.Context, name string) (*workspaces.Snapshot, error) {
+	params := map[string]string{
+		"name": name,
+	}
+
+	result, err := c.sendRequestCtx(ctx, "snapshot_workspace", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	var snap workspaces.Snapshot
+	if err := json.Unmarshal(result, &snap); err != nil {
+		return nil, errx.Wrap(ErrParseSnapshotResult, err)
+	}
+	return &snap, nil
+}
+
+// FreezeNetwork cuts off all of the sandbox's network egress, including
+// connections already open, while leaving the VM running for inspection.
+// It is meant for incident response and lasts until the sandbox is closed.
+func (c *Client) FreezeNetwork(ctx context.Context) error {
+	_, err := c.sendRequestCtx(ctx, "freeze_network", nil, nil)
+	return err
+}
+
+// UpdateSecret rotates the real value of a secret while the sandbox runs.
+// The guest keeps the same placeholder, so long-lived sessions survive key
+// rotations; requests made from now on carry the new value.
+func (c *Client) UpdateSecret(ctx context.Context, name, value string) error {
+	params := map[string]string{
+		"name":  name,
+		"value": value,
+	}
+	_, err := c.sendRequestCtx(ctx, "update_secret", params, nil)
+	return err
+}
+
+// AddMount mounts a volume at guestPath in the workspace of the running
+// sandbox, without a restart, so long-lived sessions can be given new
+// inputs. git mounts and virtio-fs shares are set up at create only.
+func (c *Client) AddMount(ctx context.Context, guestPath string, mount MountConfig) error {
+	params := map[string]interface{}{
+		"guest_path": guestPath,
+		"mount":      mount,
+	}
+	_, err := c.sendRequestCtx(ctx, "mount", params, nil)
+	return err
+}
+
+// RemoveMount unmounts the volume at guestPath from the running sandbox.
+func (c *Client) RemoveMount(ctx context.Context, guestPath string) error {
+	params := map[string]string{
+		"guest_path": guestPath,
+	}
+	_, err := c.sendRequestCtx(ctx, "unmount", params, nil)
+	return err
+}
+
+// SnapshotExists reports whether a snapshot with the given tag is present in
+// the local image store. It can be called before a sandbox is created.
+func (c *Client) SnapshotExists(ctx context.Context, tag string) (bool, error) {
+	params := map[string]string{
+		"tag": tag,
+	}
+
+	result, err := c.sendRequestCtx(ctx, "snapshot_exists", params, nil)
+	if err != nil {
+		return false, err
+	}
+
+	var existsResult struct {
+		Exists bool `json:"exists"`
+	}
+	if err := json.Unmarshal(result, &existsResult); err != nil {
+		return false, errx.Wrap(ErrParseSnapshotResult, err)
+	}
+
+	return existsResult.Exists, nil
+}
+
+// PrefetchImage is an image to warm with Prefetch. Higher priorities are
+// fetched first.
+type PrefetchImage struct {
+	Image    string `json:"image"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+// PrefetchResult reports the outcome of warming one image. Error is set when
+// the image could not be pulled or converted.
+type PrefetchResult struct {
+	Image      string `json:"image"`
+	Digest     string `json:"digest,omitempty"`
+	Cached     bool   `json:"cached"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Prefetch pulls and converts images into the local cache so sandboxes
+// created later start without waiting on a registry. It does not need a
+// sandbox, and a Create issued meanwhile does not wait for it. At most
+// concurrency images are fetched at once (0 means the server default).
+// onProgress, if not nil, is called as each image finishes.
+func (c *Client) Prefetch(ctx context.Context, images []PrefetchImage, concurrency int, onProgress func(PrefetchResult)) ([]PrefetchResult, error) {
+	params := map[string]interface{}{
+		"images":      images,
+		"concurrency": concurrency,
+	}
+
+	var onNotification func(string, json.RawMessage)
+	if onProgress != nil {
+		onNotification = func(method string, params json.RawMessage) {
+			if method != "prefetch.progress" {
+				return
+			}
+			var r PrefetchResult
+			if err := json.Unmarshal(params, &r); err == nil {
+				onProgress(r)
+			}
+		}
+	}
+
+	result, err := c.sendRequestCtx(ctx, "prefetch", params, onNotification)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefetchResult struct {
+		Images []PrefetchResult `json:"images"`
+	}
+	if err := json.Unmarshal(result, &prefetchResult); err != nil {
+		return nil, errx.Wrap(ErrParsePrefetchResult, err)
+	}
+
+	return prefetchResult.Images, nil
+}
@@ -0,0 +1,172 @@
+package sdk
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/transfer"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+// copyChunkSize is the size of the tar stream chunks CopyIn sends.
+const copyChunkSize = 256 * 1024
+
+// CopyIn copies the host directory localDir into guestPath in the sandbox,
+// creating guestPath if needed; a file is copied into guestPath. The tree
+// goes over as one streamed tar rather than file by file, so large inputs
+// are not held in memory; a large one goes over the sandbox's transfer
+// socket where the client can reach it. Symlinks are copied as links.
+func (c *Client) CopyIn(ctx context.Context, localDir, guestPath string) error {
+	src, err := filepath.Abs(localDir)
+	if err != nil {
+		return errx.Wrap(ErrCopyIn, err)
+	}
+
+	tarReader, tarWriter := io.Pipe()
+	go func() {
+		p := vfs.NewRealFSProvider(filepath.Dir(src))
+		tarWriter.CloseWithError(vfs.WriteTar(p, "/"+filepath.Base(src), tarWriter))
+	}()
+	defer tarReader.Close()
+
+	if c.useTransfer(treeSize(src, transferMinSize)) {
+		err := transfer.CopyIn(ctx, c.transferSocket, guestPath, tarReader)
+		if !errors.Is(err, transfer.ErrConnect) {
+			if err != nil {
+				return errx.With(ErrCopyIn, " %s: %w", localDir, err)
+			}
+			return nil
+		}
+	}
+
+	// A local failure is recorded before the stream is ended, and the
+	// sandbox cannot respond to a stream before its end, so the failure is
+	// there to report instead of the sandbox's view of the cut-off stream.
+	sendErr := make(chan error, 1)
+	params := map[string]interface{}{"path": guestPath}
+	_, err = c.sendRequestStream(ctx, "copy_in", params, nil, func(id uint64) {
+		sendErr <- c.sendStreamData("copy_in.data", id, tarReader, nil)
+		c.sendNotification("copy_in.data", map[string]interface{}{"id": id, "eof": true})
+	})
+	select {
+	case localErr := <-sendErr:
+		if localErr != nil {
+			return errx.With(ErrCopyIn, " %s: %w", localDir, localErr)
+		}
+	default:
+	}
+	return err
+}
+
+// sendStreamData sends r as the method notifications of request id, such
+// as copy_in.data, calling progress, if set, with the bytes sent after each.
+// A chunk of only zeros is sent as a hole, its length without the data.
+func (c *Client) sendStreamData(method string, id uint64, r io.Reader, progress FileProgress) error {
+	buf := make([]byte, copyChunkSize)
+	var sent int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			params := map[string]interface{}{"id": id}
+			if vfs.IsZero(buf[:n]) {
+				params["hole"] = n
+			} else {
+				params["data"] = base64.StdEncoding.EncodeToString(buf[:n])
+			}
+			if err := c.sendNotification(method, params); err != nil {
+				return err
+			}
+			sent += int64(n)
+			if progress != nil {
+				progress(sent)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decodeStreamData returns the bytes carried by a stream data notification,
+// expanding a hole into its zeros.
+func decodeStreamData(raw json.RawMessage) ([]byte, error) {
+	var p struct {
+		Data string `json:"data"`
+		Hole int    `json:"hole"`
+	}
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+	if p.Hole < 0 || p.Hole > copyChunkSize {
+		return nil, errx.With(ErrStreamHole, ": %d bytes", p.Hole)
+	}
+	if p.Hole > 0 {
+		return make([]byte, p.Hole), nil
+	}
+	return base64.StdEncoding.DecodeString(p.Data)
+}
+
+// CopyOut copies guestPath in the sandbox into the host directory
+// localDir, creating localDir if needed: the contents of a directory, or
+// a file under its own name. It streams a tar like CopyIn, over the
+// transfer socket whenever the client can reach it, as the size of the
+// tree is not known up front.
+func (c *Client) CopyOut(ctx context.Context, guestPath, localDir string) error {
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return errx.Wrap(ErrCopyOut, err)
+	}
+
+	tarReader, tarWriter := io.Pipe()
+	extracted := make(chan error, 1)
+	go func() {
+		err := vfs.ExtractTar(vfs.NewRealFSProvider(localDir), "/", tarReader)
+		// Chunks after a failure, or the tar's end, are dropped.
+		tarReader.CloseWithError(err)
+		extracted <- err
+	}()
+
+	if c.useTransfer(-1) {
+		err := transfer.CopyOut(ctx, c.transferSocket, guestPath, tarWriter)
+		if !errors.Is(err, transfer.ErrConnect) {
+			tarWriter.CloseWithError(err)
+			if extractErr := <-extracted; err == nil {
+				err = extractErr
+			}
+			if err != nil {
+				return errx.With(ErrCopyOut, " %s: %w", guestPath, err)
+			}
+			return nil
+		}
+	}
+
+	params := map[string]interface{}{"path": guestPath}
+	onNotification := func(method string, raw json.RawMessage) {
+		data, err := decodeStreamData(raw)
+		if err != nil {
+			tarWriter.CloseWithError(err)
+			return
+		}
+		tarWriter.Write(data)
+	}
+
+	_, err := c.sendRequestStream(ctx, "copy_out", params, onNotification, nil)
+	if err != nil {
+		tarWriter.CloseWithError(err)
+		<-extracted
+		return err
+	}
+	tarWriter.Close()
+	if err := <-extracted; err != nil {
+		return errx.With(ErrCopyOut, " %s: %w", guestPath, err)
+	}
+	return nil
+}
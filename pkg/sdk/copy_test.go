@@ -0,0 +1,77 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+// copyVM is an rpc.VM whose workspace is an in-memory VFS that trees are
+// copied in and out of.
+type copyVM struct {
+	memVM
+	root *vfs.MountRouter
+}
+
+func (v *copyVM) CopyIn(ctx context.Context, path string, r io.Reader) error {
+	return vfs.ExtractTar(v.root, path, r)
+}
+
+func (v *copyVM) CopyOut(ctx context.Context, path string, w io.Writer) error {
+	return vfs.WriteTar(v.root, path, w)
+}
+
+func TestCopyInAndOut(t *testing.T) {
+	workspace := vfs.NewMemoryProvider()
+	vm := &copyVM{root: vfs.NewMountRouter(map[string]vfs.Provider{"/workspace": workspace})}
+	c := newInProcessClient(t, vm)
+	ctx := context.Background()
+
+	src := t.TempDir()
+	big := bytes.Repeat([]byte("0123456789"), copyChunkSize/2)
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "inputs/nested"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "inputs/nested/big.bin"), big, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "inputs/run.sh"), []byte("#!/bin/sh\n"), 0755))
+
+	require.NoError(t, c.CopyIn(ctx, filepath.Join(src, "inputs"), "/workspace/job"))
+	got, err := workspace.ReadFile("/job/nested/big.bin")
+	require.NoError(t, err)
+	assert.Equal(t, big, got)
+
+	dest := filepath.Join(t.TempDir(), "outputs")
+	require.NoError(t, c.CopyOut(ctx, "/workspace/job", dest))
+	got, err = os.ReadFile(filepath.Join(dest, "nested/big.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, big, got)
+	info, err := os.Stat(filepath.Join(dest, "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	require.NoError(t, c.CopyOut(ctx, "/workspace/job/run.sh", dest))
+	require.FileExists(t, filepath.Join(dest, "run.sh"), "a file lands under its own name")
+}
+
+func TestCopyErrors(t *testing.T) {
+	vm := &copyVM{root: vfs.NewMountRouter(map[string]vfs.Provider{"/workspace": vfs.NewMemoryProvider()})}
+	c := newInProcessClient(t, vm)
+	ctx := context.Background()
+
+	err := c.CopyIn(ctx, filepath.Join(t.TempDir(), "missing"), "/workspace/job")
+	require.ErrorIs(t, err, ErrCopyIn)
+
+	err = c.CopyOut(ctx, "/workspace/missing", t.TempDir())
+	var rpcErr *RPCError
+	require.ErrorAs(t, err, &rpcErr)
+	assert.True(t, rpcErr.IsFileError())
+
+	// The client stays usable after failed copies.
+	require.NoError(t, c.CopyIn(ctx, t.TempDir(), "/workspace/empty"))
+}
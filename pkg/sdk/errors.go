@@ -1,6 +1,10 @@
 package sdk
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/jingkaihe/matchlock/internal/warm"
+)
 
 // Process / pipe errors (NewClient)
 var (
@@ -34,6 +38,43 @@ var (
 var (
 	ErrParseReadResult = errors.New("parse read result")
 	ErrParseListResult = errors.New("parse list result")
+	ErrParseStatResult = errors.New("parse stat result")
+	ErrParseSignature  = errors.New("parse file signature result")
+	ErrUploadDir       = errors.New("upload directory")
+	ErrCopyIn          = errors.New("copy into sandbox")
+	ErrCopyOut         = errors.New("copy out of sandbox")
+	ErrReadFileStream  = errors.New("stream file out of sandbox")
+	ErrWriteFileStream = errors.New("stream file into sandbox")
+	ErrFileChecksum    = errors.New("streamed file checksum mismatch")
+	ErrStreamHole      = errors.New("stream hole out of range")
+)
+
+// Network errors
+var (
+	ErrParseMetricsResult    = errors.New("parse network metrics result")
+	ErrParseViolationsResult = errors.New("parse network violations result")
+	ErrParseSecretUsage      = errors.New("parse secret usage result")
+	ErrParseMountUsage       = errors.New("parse mount usage result")
+	ErrParseVFSMetrics       = errors.New("parse VFS metrics result")
+	ErrParseWatchResult      = errors.New("parse watch result")
+)
+
+// Snapshot errors
+var (
+	ErrParseSnapshotResult = errors.New("parse snapshot result")
+	ErrFixtureSetup        = errors.New("fixture setup command failed")
+)
+
+// Prefetch errors
+var (
+	ErrParsePrefetchResult = errors.New("parse prefetch result")
+)
+
+// Pool errors
+var (
+	ErrPoolClosed   = warm.ErrClosed
+	ErrPoolTemplate = errors.New("encode pool template")
+	ErrNotPooled    = errors.New("client is not attached to a pool daemon (set Config.PoolSocket)")
 )
 
 // Close / Remove errors
@@ -0,0 +1,68 @@
+package sdk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+type argvVM struct {
+	memVM
+	command string
+	argv    []string
+	opts    *api.ExecOptions
+}
+
+func (v *argvVM) Exec(_ context.Context, command string, opts *api.ExecOptions) (*api.ExecResult, error) {
+	v.command = command
+	v.argv = opts.RawArgv
+	v.opts = opts
+	if opts.WorkingDir == "/missing" && !opts.CreateWorkingDir {
+		return nil, api.ErrWorkingDir
+	}
+	return &api.ExecResult{Stdout: []byte("ok")}, nil
+}
+
+func TestExecArgv(t *testing.T) {
+	vm := &argvVM{}
+	c := newInProcessClient(t, vm)
+
+	result, err := c.ExecArgv(context.Background(), "echo", "$HOME", "*")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", result.Stdout)
+	assert.Equal(t, []string{"echo", "$HOME", "*"}, vm.argv)
+	assert.Equal(t, `echo \$HOME \*`, vm.command)
+}
+
+func TestExecUsesShell(t *testing.T) {
+	vm := &argvVM{}
+	c := newInProcessClient(t, vm)
+
+	_, err := c.Exec(context.Background(), "echo $HOME")
+	require.NoError(t, err)
+	assert.Nil(t, vm.argv)
+	assert.Equal(t, "echo $HOME", vm.command)
+}
+
+func TestExecWithOptions(t *testing.T) {
+	vm := &argvVM{}
+	c := newInProcessClient(t, vm)
+
+	_, err := c.ExecWithOptions(context.Background(), "pwd", ExecOptions{WorkingDir: "/missing"})
+	var rpcErr *RPCError
+	require.ErrorAs(t, err, &rpcErr)
+	assert.True(t, rpcErr.IsWorkingDirError())
+
+	_, err = c.ExecWithOptions(context.Background(), "pwd", ExecOptions{
+		WorkingDir:       "/missing",
+		CreateWorkingDir: true,
+		User:             "1000",
+	})
+	require.NoError(t, err)
+	assert.True(t, vm.opts.CreateWorkingDir)
+	assert.Equal(t, "1000", vm.opts.User)
+}
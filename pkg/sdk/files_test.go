@@ -0,0 +1,96 @@
+package sdk
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+// fileManageVM is an rpc.VM whose files live in an in-memory VFS.
+type fileManageVM struct {
+	memVM
+	fs *vfs.MemoryProvider
+}
+
+func (v *fileManageVM) Stat(ctx context.Context, path string) (*api.FileInfo, error) {
+	info, err := v.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FileInfo{Name: info.Name(), Size: info.Size(), Mode: uint32(info.Mode()), ModTime: info.ModTime(), IsDir: info.IsDir()}, nil
+}
+
+func (v *fileManageVM) ListFiles(ctx context.Context, path string) ([]api.FileInfo, error) {
+	entries, err := v.fs.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]api.FileInfo, len(entries))
+	for i, e := range entries {
+		files[i] = api.FileInfo{Name: e.Name(), IsDir: e.IsDir()}
+	}
+	return files, nil
+}
+
+func (v *fileManageVM) Remove(ctx context.Context, path string) error {
+	return v.fs.Remove(path)
+}
+
+func (v *fileManageVM) RemoveAll(ctx context.Context, path string) error {
+	return v.fs.RemoveAll(path)
+}
+
+func (v *fileManageVM) Chmod(ctx context.Context, path string, mode uint32) error {
+	return v.fs.Chmod(path, os.FileMode(mode))
+}
+
+func (v *fileManageVM) Chown(ctx context.Context, path string, uid, gid int) error {
+	return vfs.Chown(v.fs, path, uid, gid)
+}
+
+func (v *fileManageVM) Rename(ctx context.Context, oldPath, newPath string) error {
+	return v.fs.Rename(oldPath, newPath)
+}
+
+func TestFileManagement(t *testing.T) {
+	fs := vfs.NewMemoryProvider()
+	require.NoError(t, fs.MkdirAll("/build/tmp", 0755))
+	require.NoError(t, fs.WriteFile("/build/app", []byte("binary"), 0644))
+	require.NoError(t, fs.WriteFile("/build/tmp/obj.o", []byte("obj"), 0644))
+	c := newInProcessClient(t, &fileManageVM{fs: fs})
+	ctx := context.Background()
+
+	files, err := c.ListDir(ctx, "/build")
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.ElementsMatch(t, []string{"app", "tmp"}, []string{files[0].Name, files[1].Name})
+
+	require.NoError(t, c.Chmod(ctx, "/build/app", 0755))
+	require.NoError(t, c.Chown(ctx, "/build/app", 0, -1))
+	require.ErrorContains(t, c.Chown(ctx, "/build/app", 1000, 1000), "not permitted")
+	require.NoError(t, c.Rename(ctx, "/build/app", "/build/app-linux"))
+
+	info, err := c.Stat(ctx, "/build/app-linux")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), info.Size)
+	assert.Equal(t, uint32(0755), info.Mode&0777)
+	assert.False(t, info.IsDir)
+	assert.False(t, info.ModTime.IsZero())
+
+	_, err = c.Stat(ctx, "/build/app")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.Error(t, c.RemoveFile(ctx, "/build/tmp"))
+	require.NoError(t, c.RemoveAll(ctx, "/build/tmp"))
+	require.NoError(t, c.RemoveFile(ctx, "/build/app-linux"))
+
+	entries, err := fs.ReadDir("/build")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
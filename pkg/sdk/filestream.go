@@ -0,0 +1,130 @@
+package sdk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/transfer"
+)
+
+// FileProgress is called as a streamed file transfer advances, with the
+// number of bytes moved so far.
+type FileProgress func(done int64)
+
+type fileStreamResult struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ReadFileTo streams a file from the sandbox into w in chunks, so files of
+// any size can be read without holding them in memory, and returns the
+// number of bytes read. Large files go over the sandbox's transfer socket
+// where the client can reach it; otherwise the data is checked against the
+// SHA-256 the sandbox computed while sending it. progress may be nil.
+func (c *Client) ReadFileTo(ctx context.Context, path string, w io.Writer, progress FileProgress) (int64, error) {
+	if c.transferReadSize(ctx, path) >= 0 {
+		pw := &progressWriter{w: w, progress: progress}
+		_, err := transfer.ReadFile(ctx, c.transferSocket, path, pw)
+		if !errors.Is(err, transfer.ErrConnect) {
+			if err != nil {
+				return pw.done, errx.With(ErrReadFileStream, " %s: %w", path, err)
+			}
+			return pw.done, nil
+		}
+	}
+
+	hash := sha256.New()
+	var (
+		written  int64
+		writeErr error
+	)
+	onNotification := func(method string, raw json.RawMessage) {
+		if writeErr != nil {
+			return
+		}
+		data, err := decodeStreamData(raw)
+		if err != nil {
+			writeErr = err
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			writeErr = err
+			return
+		}
+		hash.Write(data)
+		written += int64(len(data))
+		if progress != nil {
+			progress(written)
+		}
+	}
+
+	params := map[string]interface{}{"path": path}
+	raw, err := c.sendRequestStream(ctx, "read_file_stream", params, onNotification, nil)
+	if err != nil {
+		return written, err
+	}
+	if writeErr != nil {
+		return written, errx.With(ErrReadFileStream, " %s: %w", path, writeErr)
+	}
+	var result fileStreamResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return written, errx.Wrap(ErrParseReadResult, err)
+	}
+	if result.Size != written || result.SHA256 != hex.EncodeToString(hash.Sum(nil)) {
+		return written, errx.With(ErrFileChecksum, ": %s", path)
+	}
+	return written, nil
+}
+
+// WriteFileFrom streams r into a file in the sandbox in chunks and returns
+// the number of bytes written. The file is replaced only once all of r has
+// arrived and matches its SHA-256, so a failed transfer leaves any previous
+// file in place. mode defaults to 0644; progress may be nil.
+func (c *Client) WriteFileFrom(ctx context.Context, path string, r io.Reader, mode uint32, progress FileProgress) (int64, error) {
+	if c.useTransfer(readerSize(r)) {
+		n, err := transfer.WriteFile(ctx, c.transferSocket, path, &progressReader{r: r, progress: progress}, mode)
+		if !errors.Is(err, transfer.ErrConnect) {
+			if err != nil {
+				return 0, errx.With(ErrWriteFileStream, " %s: %w", path, err)
+			}
+			return n, nil
+		}
+	}
+
+	hash := sha256.New()
+	src := io.TeeReader(r, hash)
+
+	// As with CopyIn, a local failure is reported in place of the sandbox's
+	// view of the cut-off stream.
+	sendErr := make(chan error, 1)
+	params := map[string]interface{}{"path": path, "mode": mode}
+	raw, err := c.sendRequestStream(ctx, "write_file_stream", params, nil, func(id uint64) {
+		err := c.sendStreamData("write_file_stream.data", id, src, progress)
+		sendErr <- err
+		eof := map[string]interface{}{"id": id, "eof": true}
+		if err == nil {
+			eof["sha256"] = hex.EncodeToString(hash.Sum(nil))
+		}
+		c.sendNotification("write_file_stream.data", eof)
+	})
+	select {
+	case localErr := <-sendErr:
+		if localErr != nil {
+			return 0, errx.With(ErrWriteFileStream, " %s: %w", path, localErr)
+		}
+	default:
+	}
+	if err != nil {
+		return 0, err
+	}
+	var result fileStreamResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return 0, errx.Wrap(ErrWriteFileStream, err)
+	}
+	return result.Size, nil
+}
@@ -0,0 +1,99 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fileStreamVM is an rpc.VM that streams the files of a memVM.
+type fileStreamVM struct {
+	memVM
+}
+
+func (v *fileStreamVM) ReadFileTo(ctx context.Context, path string, w io.Writer) (int64, error) {
+	content, err := v.ReadFile(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(content)
+	return int64(n), err
+}
+
+func (v *fileStreamVM) WriteFileFrom(ctx context.Context, path string, r io.Reader, mode uint32) (int64, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(content)), v.WriteFile(ctx, path, content, mode)
+}
+
+func TestFileStreamRoundTrip(t *testing.T) {
+	vm := &fileStreamVM{memVM{files: map[string][]byte{}, dirs: map[string]bool{}}}
+	c := newInProcessClient(t, vm)
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("0123456789"), copyChunkSize/5+100)
+	var sent []int64
+	n, err := c.WriteFileFrom(ctx, "/workspace/model.bin", bytes.NewReader(content), 0600, func(done int64) {
+		sent = append(sent, done)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.Equal(t, []int64{copyChunkSize, 2 * copyChunkSize, int64(len(content))}, sent)
+	assert.Equal(t, content, vm.files["/workspace/model.bin"])
+
+	var out bytes.Buffer
+	var received int64
+	n, err = c.ReadFileTo(ctx, "/workspace/model.bin", &out, func(done int64) { received = done })
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.Equal(t, int64(len(content)), received)
+	assert.Equal(t, content, out.Bytes())
+
+	_, err = c.ReadFileTo(ctx, "/workspace/missing", io.Discard, nil)
+	require.Error(t, err)
+}
+
+func TestFileStreamSparseRoundTrip(t *testing.T) {
+	vm := &fileStreamVM{memVM{files: map[string][]byte{}, dirs: map[string]bool{}}}
+	c := newInProcessClient(t, vm)
+	ctx := context.Background()
+
+	content := make([]byte, 3*copyChunkSize+10)
+	copy(content[copyChunkSize:], "page")
+
+	_, err := c.WriteFileFrom(ctx, "/workspace/disk.img", bytes.NewReader(content), 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, content, vm.files["/workspace/disk.img"])
+
+	var out bytes.Buffer
+	_, err = c.ReadFileTo(ctx, "/workspace/disk.img", &out, nil)
+	require.NoError(t, err)
+	assert.Equal(t, content, out.Bytes())
+}
+
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("disk read failed")
+	}
+	n := min(len(p), r.n)
+	r.n -= n
+	return n, nil
+}
+
+func TestWriteFileFromLocalFailureKeepsOldFile(t *testing.T) {
+	vm := &fileStreamVM{memVM{files: map[string][]byte{"/workspace/out.bin": []byte("old")}, dirs: map[string]bool{}}}
+	c := newInProcessClient(t, vm)
+
+	_, err := c.WriteFileFrom(context.Background(), "/workspace/out.bin", &failingReader{n: 1000}, 0, nil)
+	require.ErrorIs(t, err, ErrWriteFileStream)
+	assert.Equal(t, []byte("old"), vm.files["/workspace/out.bin"])
+}
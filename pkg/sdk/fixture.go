@@ -0,0 +1,65 @@
+package sdk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// fixtureTagPrefix namespaces memoized fixture snapshots in the image store.
+const fixtureTagPrefix = "matchlock-fixture:"
+
+// FixtureTag returns the snapshot tag used to memoize an image together with
+// the setup commands run on top of it. Changing either yields a new tag.
+func FixtureTag(image string, setup []string) string {
+	h := sha256.New()
+	h.Write([]byte(image))
+	for _, cmd := range setup {
+		h.Write([]byte{0})
+		h.Write([]byte(cmd))
+	}
+	return fixtureTagPrefix + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// LaunchFixture starts a sandbox that has the setup commands applied on top
+// of the builder's image. The first call runs the commands and snapshots the
+// result; later calls with the same image and commands boot straight from the
+// snapshot, which keeps test suites that share expensive setup fast.
+//
+// A setup command exiting non-zero aborts the launch without saving a
+// snapshot. The sandbox is left running so the caller can inspect or Close it.
+func (c *Client) LaunchFixture(ctx context.Context, b *SandboxBuilder, setup ...string) (string, error) {
+	opts := b.Options()
+	tag := FixtureTag(opts.Image, setup)
+
+	exists, err := c.SnapshotExists(ctx, tag)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		opts.Image = tag
+		return c.Create(opts)
+	}
+
+	vmID, err := c.Create(opts)
+	if err != nil {
+		return "", err
+	}
+
+	for _, cmd := range setup {
+		result, err := c.Exec(ctx, cmd)
+		if err != nil {
+			return vmID, err
+		}
+		if result.ExitCode != 0 {
+			return vmID, errx.With(ErrFixtureSetup, ": %q exited with %d: %s", cmd, result.ExitCode, result.Stderr)
+		}
+	}
+
+	if err := c.Snapshot(ctx, tag); err != nil {
+		return vmID, err
+	}
+	return vmID, nil
+}
@@ -0,0 +1,20 @@
+package sdk
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFixtureTag(t *testing.T) {
+	tag := FixtureTag("alpine:latest", []string{"apk add git", "git --version"})
+	require.True(t, strings.HasPrefix(tag, fixtureTagPrefix))
+	assert.Len(t, strings.TrimPrefix(tag, fixtureTagPrefix), 16)
+
+	assert.Equal(t, tag, FixtureTag("alpine:latest", []string{"apk add git", "git --version"}))
+	assert.NotEqual(t, tag, FixtureTag("alpine:3.20", []string{"apk add git", "git --version"}))
+	assert.NotEqual(t, tag, FixtureTag("alpine:latest", []string{"git --version", "apk add git"}))
+	assert.NotEqual(t, tag, FixtureTag("alpine:latest", []string{"apk add gitgit --version"}))
+}
@@ -0,0 +1,49 @@
+package sdk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// hotMountVM is an rpc.VM that records the mounts added while it runs.
+type hotMountVM struct {
+	memVM
+	mounts map[string]api.MountConfig
+}
+
+func (v *hotMountVM) AddMount(guestPath string, mount api.MountConfig) error {
+	v.mounts[guestPath] = mount
+	return nil
+}
+
+func (v *hotMountVM) RemoveMount(guestPath string) error {
+	delete(v.mounts, guestPath)
+	return nil
+}
+
+func TestAddRemoveMount(t *testing.T) {
+	vm := &hotMountVM{mounts: map[string]api.MountConfig{}}
+	c := newInProcessClient(t, vm)
+	ctx := context.Background()
+
+	require.NoError(t, c.AddMount(ctx, "/workspace/inputs", MountConfig{
+		Type:     "real_fs",
+		HostPath: "/srv/inputs",
+		Readonly: true,
+		Access:   &api.MountAccess{DenyRead: []string{".env"}},
+	}))
+	assert.Equal(t, api.MountConfig{
+		Type:     "real_fs",
+		HostPath: "/srv/inputs",
+		Readonly: true,
+		Access:   &api.MountAccess{DenyRead: []string{".env"}},
+	}, vm.mounts["/workspace/inputs"])
+
+	require.NoError(t, c.RemoveMount(ctx, "/workspace/inputs"))
+	assert.Empty(t, vm.mounts)
+}
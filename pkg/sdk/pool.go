@@ -0,0 +1,155 @@
+package sdk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/warm"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// Pool keeps sandboxes booted ahead of use, so launching one takes as long
+// as handing it over rather than as booting a VM. Every sandbox runs under
+// its own matchlock rpc process, as one created through NewClient does, so
+// the pool is kept by the calling process. To share one between processes,
+// run 'matchlock pool serve' and use Client.LaunchFromPool instead.
+//
+// Sandboxes are pooled per template, the CreateOptions of a builder.
+// Launch hands over a booted sandbox of the builder's template and boots a
+// replacement in the background:
+//
+//	pool := sdk.NewPool(sdk.DefaultConfig(), 4)
+//	defer pool.Close(0)
+//
+//	client, err := pool.Launch(sdk.New("python:3.12-alpine"))
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer client.Close(0)
+//
+// A pooled sandbox is created when it is booted, so the templates of its
+// Env are rendered then, but its timeout runs from Launch: the pool closes
+// it once TimeoutSeconds (api.DefaultTimeoutSeconds unless set) have passed
+// since it was handed over. One that has stopped while waiting in the pool
+// is not handed over.
+type Pool struct {
+	cfg Config
+	// boot creates a sandbox of a template; a test replaces it.
+	boot func(opts CreateOptions) (*Client, error)
+
+	warm *warm.Pool[*Client]
+}
+
+// NewPool returns a pool keeping size booted sandboxes of each template it
+// is asked for, started with cfg. Sandboxes are only booted once a
+// template is warmed or launched.
+func NewPool(cfg Config, size int) *Pool {
+	p := &Pool{cfg: cfg}
+	p.boot = p.bootSandbox
+	p.warm = warm.New(size, (*Client).alive, func(c *Client) { c.Close(0) })
+	return p
+}
+
+// Warm starts booting sandboxes of the builder's template, so the first
+// Launch of it need not boot one.
+func (p *Pool) Warm(b *SandboxBuilder) error {
+	opts := b.Options()
+	key, err := templateKey(opts)
+	if err != nil {
+		return err
+	}
+	return p.warm.Warm(key, func() (*Client, error) { return p.boot(opts) })
+}
+
+// Launch returns a client of a booted sandbox of the builder's template,
+// booting a replacement in the background. If none is ready it waits for
+// one being booted. The caller owns the client and closes it as any other.
+func (p *Pool) Launch(b *SandboxBuilder) (*Client, error) {
+	opts := b.Options()
+	if opts.Image == "" {
+		return nil, ErrImageRequired
+	}
+	key, err := templateKey(opts)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.warm.Take(key, func() (*Client, error) { return p.boot(opts) })
+	if err != nil {
+		return nil, err
+	}
+	if timeout := launchTimeout(opts); timeout > 0 {
+		c.expireAfter(timeout)
+	}
+	return c, nil
+}
+
+// LaunchFromPool creates a sandbox from the builder as Launch does, taking
+// one the pool daemon the client is attached to has booted ahead of use,
+// and returns its VM ID. The daemon boots a replacement in the background
+// and closes the sandbox once its timeout has passed since it was handed
+// over. Unlike Launch, it refuses a client not attached to a daemon, which
+// would boot the sandbox itself.
+func (c *Client) LaunchFromPool(b *SandboxBuilder) (string, error) {
+	if !c.pooled {
+		return "", ErrNotPooled
+	}
+	return c.Launch(b)
+}
+
+// Close stops booting sandboxes and closes the ones not launched, waiting
+// for boots in progress to close them too. timeout is passed to
+// Client.Close. Launched sandboxes are left to their callers.
+func (p *Pool) Close(timeout time.Duration) error {
+	var errs []error
+	for _, c := range p.warm.Close() {
+		if err := c.Close(timeout); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// templateKey identifies the template opts by their JSON encoding.
+func templateKey(opts CreateOptions) (string, error) {
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return "", errx.Wrap(ErrPoolTemplate, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// launchTimeout is how long a sandbox of opts may run once launched, as
+// Create would send it, or zero if a size preset decides it.
+func launchTimeout(opts CreateOptions) time.Duration {
+	seconds := opts.TimeoutSeconds
+	if seconds == 0 && opts.Size == "" {
+		seconds = api.DefaultTimeoutSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// expireAfter closes c once timeout has passed, unless it is closed first.
+func (c *Client) expireAfter(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expiry = time.AfterFunc(timeout, func() { c.Close(0) })
+}
+
+// bootSandbox starts a matchlock rpc process and creates a sandbox of opts
+// in it.
+func (p *Pool) bootSandbox(opts CreateOptions) (*Client, error) {
+	c, err := NewClient(p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Create(opts); err != nil {
+		c.Close(0)
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,159 @@
+package sdk
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/rpc"
+)
+
+// testBoots records the sandboxes a test pool boots.
+type testBoots struct {
+	mu      sync.Mutex
+	clients []*Client
+}
+
+func (b *testBoots) Load() int32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int32(len(b.clients))
+}
+
+func (b *testBoots) first() *Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.clients[0]
+}
+
+// newTestPool returns a pool booting in-process sandboxes, each with a
+// sleeping process standing in for matchlock so it can be closed, and the
+// sandboxes booted.
+func newTestPool(t *testing.T, size int) (*Pool, *testBoots) {
+	t.Helper()
+	boots := &testBoots{}
+	p := NewPool(Config{}, size)
+	p.boot = func(opts CreateOptions) (*Client, error) {
+		stdinR, stdinW := io.Pipe()
+		stdoutR, stdoutW := io.Pipe()
+		vm := &memVM{files: map[string][]byte{}, dirs: map[string]bool{}}
+		h := rpc.NewHandler(func(ctx context.Context, config *api.Config) (rpc.VM, error) {
+			return vm, nil
+		}, stdinR, stdoutW)
+		go h.Run(context.Background())
+
+		cmd := exec.Command("sleep", "60")
+		require.NoError(t, cmd.Start())
+		c := &Client{
+			cmd:     cmd,
+			stdin:   stdinW,
+			stdout:  bufio.NewReader(stdoutR),
+			pending: make(map[uint64]*pendingRequest),
+		}
+		_, err := c.Create(opts)
+		boots.mu.Lock()
+		boots.clients = append(boots.clients, c)
+		boots.mu.Unlock()
+		return c, err
+	}
+	t.Cleanup(func() { p.Close(0) })
+	return p, boots
+}
+
+func idle(p *Pool, b *SandboxBuilder) int {
+	key, _ := templateKey(b.Options())
+	return p.warm.Idle(key)
+}
+
+func TestPoolLaunchesWarmSandboxes(t *testing.T) {
+	p, boots := newTestPool(t, 2)
+	b := New("alpine:latest")
+
+	require.NoError(t, p.Warm(b))
+	require.Eventually(t, func() bool { return idle(p, b) == 2 }, 5*time.Second, time.Millisecond)
+
+	c, err := p.Launch(b)
+	require.NoError(t, err)
+	assert.Equal(t, "vm-test", c.VMID())
+	result, err := c.Exec(context.Background(), "true")
+	require.NoError(t, err)
+	assert.Zero(t, result.ExitCode)
+	c.Close(0)
+
+	require.Eventually(t, func() bool { return idle(p, b) == 2 }, 5*time.Second, time.Millisecond, "a replacement is booted")
+	assert.Equal(t, int32(3), boots.Load())
+
+	other := New("alpine:latest").WithCPUs(4)
+	c, err = p.Launch(other)
+	require.NoError(t, err, "a cold template boots a sandbox")
+	c.Close(0)
+	require.Eventually(t, func() bool { return idle(p, other) == 2 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 2, idle(p, b), "templates are pooled apart")
+	assert.Equal(t, int32(6), boots.Load(), "a cold launch is handed a sandbox the pool boots, not one more")
+}
+
+func TestPoolTimeoutRunsFromLaunch(t *testing.T) {
+	p, _ := newTestPool(t, 1)
+	b := New("alpine:latest").WithTimeout(1)
+	require.NoError(t, p.Warm(b))
+	require.Eventually(t, func() bool { return idle(p, b) == 1 }, 5*time.Second, time.Millisecond)
+	time.Sleep(1500 * time.Millisecond)
+
+	c, err := p.Launch(b)
+	require.NoError(t, err)
+	assert.True(t, c.alive(), "the timeout does not run while the sandbox is idle")
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.closed
+	}, 5*time.Second, 10*time.Millisecond, "the timeout runs from launch")
+}
+
+func TestPoolSkipsStoppedSandboxes(t *testing.T) {
+	p, boots := newTestPool(t, 1)
+	b := New("alpine:latest")
+	require.NoError(t, p.Warm(b))
+	require.Eventually(t, func() bool { return idle(p, b) == 1 }, 5*time.Second, time.Millisecond)
+
+	stopped := boots.first()
+	stopped.pendingMu.Lock()
+	stopped.pending = nil
+	stopped.pendingMu.Unlock()
+
+	c, err := p.Launch(b)
+	require.NoError(t, err)
+	defer c.Close(0)
+	assert.NotSame(t, stopped, c)
+	assert.True(t, c.alive())
+	require.Eventually(t, func() bool { return idle(p, b) == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, int32(3), boots.Load())
+}
+
+func TestPoolClose(t *testing.T) {
+	p, _ := newTestPool(t, 2)
+	b := New("alpine:latest")
+	require.NoError(t, p.Warm(b))
+
+	require.NoError(t, p.Close(0))
+	assert.Zero(t, idle(p, b), "boots in progress are waited for and closed")
+
+	_, err := p.Launch(b)
+	assert.ErrorIs(t, err, ErrPoolClosed)
+	assert.ErrorIs(t, p.Warm(b), ErrPoolClosed)
+	_, err = p.Launch(New(""))
+	assert.ErrorIs(t, err, ErrImageRequired)
+}
+
+func TestLaunchFromPoolNeedsDaemon(t *testing.T) {
+	c := &Client{}
+	_, err := c.LaunchFromPool(New("alpine:latest"))
+	assert.ErrorIs(t, err, ErrNotPooled)
+}
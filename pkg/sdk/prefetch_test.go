@@ -0,0 +1,20 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetchRejectsEmptyList(t *testing.T) {
+	c := newInProcessClient(t, &memVM{})
+
+	_, err := c.Prefetch(context.Background(), nil, 0, nil)
+	require.Error(t, err)
+	var rpcErr *RPCError
+	require.True(t, errors.As(err, &rpcErr))
+	assert.Equal(t, ErrCodeInvalidParams, rpcErr.Code)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
 )
 
 // JSON-RPC request/response types
@@ -45,6 +46,7 @@ const (
 	ErrCodeExecFailed     = -32001
 	ErrCodeFileFailed     = -32002
 	ErrCodeCancelled      = -32003
+	ErrCodeWorkingDir     = -32004
 )
 
 // RPCError represents an error from the Matchlock RPC
@@ -67,6 +69,12 @@ func (e *RPCError) IsExecError() bool {
 	return e.Code == ErrCodeExecFailed
 }
 
+// IsWorkingDirError returns true if the exec's working directory does not
+// exist in the guest or could not be created
+func (e *RPCError) IsWorkingDirError() bool {
+	return e.Code == ErrCodeWorkingDir
+}
+
 // IsFileError returns true if the error is a file operation error
 func (e *RPCError) IsFileError() bool {
 	return e.Code == ErrCodeFileFailed
@@ -76,7 +84,7 @@ func (e *RPCError) IsFileError() bool {
 type pendingRequest struct {
 	ch chan pendingResult
 	// onNotification is called for streaming notifications matching this request ID.
-	// It is only set for exec_stream requests.
+	// It is only set for exec_stream and copy_out requests.
 	onNotification func(method string, params json.RawMessage)
 }
 
@@ -97,6 +105,13 @@ func (c *Client) sendRequest(method string, params interface{}) (json.RawMessage
 // If onNotification is non-nil, it is called for each streaming notification
 // matching this request's ID before the final response arrives.
 func (c *Client) sendRequestCtx(ctx context.Context, method string, params interface{}, onNotification func(string, json.RawMessage)) (json.RawMessage, error) {
+	return c.sendRequestStream(ctx, method, params, onNotification, nil)
+}
+
+// sendRequestStream is sendRequestCtx for requests whose payload follows
+// them: once the request is written, onSent is started in a goroutine with
+// its ID to send the payload as notifications.
+func (c *Client) sendRequestStream(ctx context.Context, method string, params interface{}, onNotification func(string, json.RawMessage), onSent func(id uint64)) (json.RawMessage, error) {
 	c.readerOnce.Do(c.startReader)
 
 	id := c.requestID.Add(1)
@@ -138,6 +153,9 @@ func (c *Client) sendRequestCtx(ctx context.Context, method string, params inter
 	if writeErr != nil {
 		return nil, errx.Wrap(ErrWriteRequest, writeErr)
 	}
+	if onSent != nil {
+		go onSent(id)
+	}
 
 	select {
 	case result := <-pending.ch:
@@ -148,6 +166,26 @@ func (c *Client) sendRequestCtx(ctx context.Context, method string, params inter
 	}
 }
 
+// sendNotification sends a JSON-RPC notification, which has no response.
+func (c *Client) sendNotification(method string, params interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return errx.Wrap(ErrMarshalRequest, err)
+	}
+
+	c.writeMu.Lock()
+	_, err = fmt.Fprintln(c.stdin, string(data))
+	c.writeMu.Unlock()
+	if err != nil {
+		return errx.Wrap(ErrWriteRequest, err)
+	}
+	return nil
+}
+
 // sendCancelRequest sends a fire-and-forget "cancel" RPC to abort an in-flight request.
 func (c *Client) sendCancelRequest(targetID uint64) {
 	cancelID := c.requestID.Add(1)
@@ -164,6 +202,15 @@ func (c *Client) sendCancelRequest(targetID uint64) {
 	c.writeMu.Unlock()
 }
 
+// alive reports whether the matchlock process still answers the client:
+// once it exits, the reader fails the pending requests and takes new ones
+// no more.
+func (c *Client) alive() bool {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	return c.pending != nil
+}
+
 // startReader launches the background goroutine that reads JSON-RPC responses
 // from stdout and dispatches them to the appropriate pending request.
 func (c *Client) startReader() {
@@ -216,11 +263,19 @@ func (c *Client) startReader() {
 }
 
 // handleNotification routes JSON-RPC notifications. Stream notifications
-// (exec_stream.stdout, exec_stream.stderr) include a request ID in params
-// and are forwarded to the matching pending request's callback.
+// (exec_stream.stdout, exec_stream.stderr, copy_out.data,
+// read_file_stream.data) include a request
+// ID in params and are forwarded to the matching pending request's callback;
+// file events go to the WatchFiles subscriptions.
 func (c *Client) handleNotification(notif notification) {
 	switch notif.Method {
-	case "exec_stream.stdout", "exec_stream.stderr":
+	case "event":
+		var ev api.Event
+		if err := json.Unmarshal(notif.Params, &ev); err != nil || ev.File == nil {
+			return
+		}
+		c.dispatchFileEvent(ev.File)
+	case "exec_stream.stdout", "exec_stream.stderr", "copy_out.data", "read_file_stream.data":
 		var p struct {
 			ID *uint64 `json:"id"`
 		}
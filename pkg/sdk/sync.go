@@ -0,0 +1,167 @@
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/delta"
+)
+
+// SyncStats summarises an incremental upload.
+type SyncStats struct {
+	// Files is the number of files whose contents were sent, in full or as a delta.
+	Files int
+	// Unchanged is the number of files already up to date in the sandbox.
+	Unchanged int
+	// BytesSent is the number of file content bytes transferred.
+	BytesSent int64
+	// BytesTotal is the combined size of all synced files.
+	BytesTotal int64
+}
+
+func (s *SyncStats) add(o *SyncStats) {
+	s.Files += o.Files
+	s.Unchanged += o.Unchanged
+	s.BytesSent += o.BytesSent
+	s.BytesTotal += o.BytesTotal
+}
+
+// MkdirAll creates a directory in the sandbox along with any missing parents.
+func (c *Client) MkdirAll(ctx context.Context, path string, mode uint32) error {
+	params := map[string]interface{}{
+		"path": path,
+		"mode": mode,
+	}
+
+	_, err := c.sendRequestCtx(ctx, "mkdir", params, nil)
+	return err
+}
+
+// fileSignature fetches the delta signature of a sandbox file. It returns
+// nil if the file does not exist.
+func (c *Client) fileSignature(ctx context.Context, path string) (*delta.Signature, error) {
+	params := map[string]interface{}{
+		"path":       path,
+		"block_size": delta.DefaultBlockSize,
+	}
+
+	result, err := c.sendRequestCtx(ctx, "file_signature", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var sigResult struct {
+		Exists    bool             `json:"exists"`
+		Signature *delta.Signature `json:"signature"`
+	}
+	if err := json.Unmarshal(result, &sigResult); err != nil {
+		return nil, errx.Wrap(ErrParseSignature, err)
+	}
+	if !sigResult.Exists {
+		return nil, nil
+	}
+	return sigResult.Signature, nil
+}
+
+// SyncFile uploads content to path, sending only the blocks that differ from
+// the copy already in the sandbox. Files that are already identical are left
+// untouched. If the sandbox copy changes between the signature and the
+// patch, the whole file is written instead.
+func (c *Client) SyncFile(ctx context.Context, path string, content []byte, mode uint32) (*SyncStats, error) {
+	stats := &SyncStats{BytesTotal: int64(len(content))}
+
+	sig, err := c.fileSignature(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if sig == nil {
+		if err := c.WriteFileMode(ctx, path, content, mode); err != nil {
+			return nil, err
+		}
+		stats.Files = 1
+		stats.BytesSent = int64(len(content))
+		return stats, nil
+	}
+
+	ops := delta.Diff(sig, content)
+	if delta.Unchanged(sig, ops) {
+		stats.Unchanged = 1
+		return stats, nil
+	}
+
+	params := map[string]interface{}{
+		"path":       path,
+		"block_size": sig.BlockSize,
+		"ops":        ops,
+		"mode":       mode,
+		"checksum":   delta.Checksum(content),
+	}
+	if _, err := c.sendRequestCtx(ctx, "patch_file", params, nil); err != nil {
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) || !rpcErr.IsFileError() {
+			return nil, err
+		}
+		if err := c.WriteFileMode(ctx, path, content, mode); err != nil {
+			return nil, err
+		}
+		stats.Files = 1
+		stats.BytesSent = int64(len(content))
+		return stats, nil
+	}
+
+	stats.Files = 1
+	for _, op := range ops {
+		stats.BytesSent += int64(len(op.Data))
+	}
+	return stats, nil
+}
+
+// UploadDir mirrors a host directory into the sandbox at guestDir using
+// SyncFile, so repeated uploads of a mostly unchanged tree only transfer the
+// differences. Symlinks and special files are skipped, and files removed on
+// the host are not deleted from the sandbox.
+func (c *Client) UploadDir(ctx context.Context, hostDir, guestDir string) (*SyncStats, error) {
+	total := &SyncStats{}
+	err := filepath.WalkDir(hostDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(hostDir, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(guestDir, filepath.ToSlash(rel))
+
+		if d.IsDir() {
+			return c.MkdirAll(ctx, target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		stats, err := c.SyncFile(ctx, target, content, uint32(info.Mode().Perm()))
+		if err != nil {
+			return err
+		}
+		total.add(stats)
+		return nil
+	})
+	if err != nil {
+		return total, errx.With(ErrUploadDir, " %s: %w", hostDir, err)
+	}
+	return total, nil
+}
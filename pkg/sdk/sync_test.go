@@ -0,0 +1,159 @@
+package sdk
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/delta"
+	"github.com/jingkaihe/matchlock/pkg/rpc"
+)
+
+// memVM is an in-memory rpc.VM that supports incremental file sync.
+type memVM struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+func (m *memVM) ID() string                                                { return "vm-test" }
+func (m *memVM) Config() *api.Config                                       { return api.DefaultConfig() }
+func (m *memVM) Start(context.Context) error                               { return nil }
+func (m *memVM) Stop(context.Context) error                                { return nil }
+func (m *memVM) ListFiles(context.Context, string) ([]api.FileInfo, error) { return nil, nil }
+func (m *memVM) Events() <-chan api.Event                                  { return make(chan api.Event) }
+func (m *memVM) Close(context.Context) error                               { return nil }
+
+func (m *memVM) Exec(context.Context, string, *api.ExecOptions) (*api.ExecResult, error) {
+	return &api.ExecResult{}, nil
+}
+
+func (m *memVM) WriteFile(ctx context.Context, path string, content []byte, mode uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[path] = append([]byte(nil), content...)
+	return nil
+}
+
+func (m *memVM) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	content, ok := m.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return content, nil
+}
+
+func (m *memVM) FileSignature(ctx context.Context, path string, blockSize int) (*delta.Signature, error) {
+	content, err := m.ReadFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return delta.Sign(content, blockSize)
+}
+
+func (m *memVM) PatchFile(ctx context.Context, path string, blockSize int, ops []delta.Op, mode uint32, checksum string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	content, err := delta.Apply(m.files[path], blockSize, ops)
+	if err != nil {
+		return err
+	}
+	if delta.Checksum(content) != checksum {
+		return io.ErrUnexpectedEOF
+	}
+	m.files[path] = content
+	return nil
+}
+
+func (m *memVM) MkdirAll(ctx context.Context, path string, mode uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dirs[path] = true
+	return nil
+}
+
+// newInProcessClient returns a Client talking to an in-process RPC handler.
+func newInProcessClient(t *testing.T, vm rpc.VM) *Client {
+	t.Helper()
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+
+	h := rpc.NewHandler(func(ctx context.Context, config *api.Config) (rpc.VM, error) {
+		return vm, nil
+	}, stdinR, stdoutW)
+	go h.Run(context.Background())
+
+	t.Cleanup(func() {
+		stdinW.Close()
+		stdoutR.Close()
+	})
+
+	c := &Client{
+		stdin:   stdinW,
+		stdout:  bufio.NewReader(stdoutR),
+		pending: make(map[uint64]*pendingRequest),
+	}
+	_, err := c.Create(CreateOptions{Image: "alpine:latest"})
+	require.NoError(t, err)
+	return c
+}
+
+func TestSyncFile(t *testing.T) {
+	vm := &memVM{files: map[string][]byte{}, dirs: map[string]bool{}}
+	c := newInProcessClient(t, vm)
+	ctx := context.Background()
+
+	content := []byte(strings.Repeat("func handler() error { return nil }\n", 500))
+
+	stats, err := c.SyncFile(ctx, "/workspace/main.go", content, 0644)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Files)
+	assert.Equal(t, int64(len(content)), stats.BytesSent, "new files are sent in full")
+
+	stats, err = c.SyncFile(ctx, "/workspace/main.go", content, 0644)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Unchanged)
+	assert.Zero(t, stats.BytesSent)
+
+	edited := append([]byte("// edited\n"), content...)
+	stats, err = c.SyncFile(ctx, "/workspace/main.go", edited, 0644)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Files)
+	assert.Less(t, stats.BytesSent, int64(delta.DefaultBlockSize))
+	assert.Equal(t, string(edited), string(vm.files["/workspace/main.go"]))
+}
+
+func TestUploadDir(t *testing.T) {
+	vm := &memVM{files: map[string][]byte{}, dirs: map[string]bool{}}
+	c := newInProcessClient(t, vm)
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "pkg", "util"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pkg", "util", "util.go"), []byte("package util\n"), 0644))
+
+	stats, err := c.UploadDir(ctx, dir, "/workspace/src")
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Files)
+	assert.True(t, vm.dirs["/workspace/src/pkg/util"])
+	assert.Equal(t, "package util\n", string(vm.files["/workspace/src/pkg/util/util.go"]))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example\n\ngo 1.25\n"), 0644))
+	stats, err = c.UploadDir(ctx, dir, "/workspace/src")
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Files)
+	assert.Equal(t, 1, stats.Unchanged)
+	assert.Equal(t, "module example\n\ngo 1.25\n", string(vm.files["/workspace/src/go.mod"]))
+}
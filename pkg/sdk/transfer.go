@@ -0,0 +1,112 @@
+package sdk
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// transferMinSize is the size from which files and trees move over the
+// sandbox's transfer socket rather than as base64 in JSON-RPC
+// notifications. The socket is only reachable by the user running the
+// sandbox, so a client of a matchlock run with sudo keeps to JSON-RPC.
+const transferMinSize = 4 << 20
+
+// useTransfer reports whether size bytes, or an unknown amount if size is
+// negative, go over the transfer socket. A caller falls back to JSON-RPC
+// if the socket cannot be connected to.
+func (c *Client) useTransfer(size int64) bool {
+	return c.transferSocket != "" && (size < 0 || size >= transferMinSize)
+}
+
+// transferReadSize returns the size of the sandbox file at path if it is
+// to be read over the transfer socket, or -1.
+func (c *Client) transferReadSize(ctx context.Context, path string) int64 {
+	if c.transferSocket == "" {
+		return -1
+	}
+	info, err := c.Stat(ctx, path)
+	if err != nil || info.IsDir || !c.useTransfer(info.Size) {
+		return -1
+	}
+	return info.Size
+}
+
+// readerSize returns how many bytes are left in r if it can tell without
+// reading them, or -1.
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case *os.File:
+		info, err := v.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		off, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return info.Size() - off
+	}
+	return -1
+}
+
+// treeSize returns the size of the files under the host path root,
+// counting no further than limit.
+func treeSize(root string, limit int64) int64 {
+	var size int64
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		if size >= limit {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return size
+}
+
+// progressReader calls progress with the bytes read from r so far.
+type progressReader struct {
+	r        io.Reader
+	done     int64
+	progress FileProgress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.done += int64(n)
+		if p.progress != nil {
+			p.progress(p.done)
+		}
+	}
+	return n, err
+}
+
+// progressWriter calls progress with the bytes written to w so far.
+type progressWriter struct {
+	w        io.Writer
+	done     int64
+	progress FileProgress
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if n > 0 {
+		p.done += int64(n)
+		if p.progress != nil {
+			p.progress(p.done)
+		}
+	}
+	return n, err
+}
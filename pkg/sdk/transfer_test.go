@@ -0,0 +1,128 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+// transferVM streams and copies the files of a fileManageVM, so the
+// handler serves it a transfer socket.
+type transferVM struct {
+	fileManageVM
+}
+
+func (v *transferVM) ReadFileTo(ctx context.Context, path string, w io.Writer) (int64, error) {
+	content, err := v.fs.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(content)
+	return int64(n), err
+}
+
+func (v *transferVM) WriteFileFrom(ctx context.Context, path string, r io.Reader, mode uint32) (int64, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(content)), v.fs.WriteFile(path, content, os.FileMode(mode))
+}
+
+func (v *transferVM) CopyIn(ctx context.Context, path string, r io.Reader) error {
+	return vfs.ExtractTar(v.fs, path, r)
+}
+
+func (v *transferVM) CopyOut(ctx context.Context, path string, w io.Writer) error {
+	return vfs.WriteTar(v.fs, path, w)
+}
+
+// newTransferClient returns a client of a transferVM with its state dir,
+// and so its transfer socket, under a temporary home.
+func newTransferClient(t *testing.T) (*Client, *vfs.MemoryProvider) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	require.NoError(t, os.MkdirAll(filepath.Join(home, ".matchlock", "vms", "vm-test"), 0700))
+	fs := vfs.NewMemoryProvider()
+	c := newInProcessClient(t, &transferVM{fileManageVM{fs: fs}})
+	require.NotEmpty(t, c.transferSocket)
+	return c, fs
+}
+
+func TestTransferLargeFiles(t *testing.T) {
+	c, fs := newTransferClient(t)
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("0123456789abcdef"), transferMinSize/8)
+	assert.True(t, c.useTransfer(int64(len(content))))
+	assert.False(t, c.useTransfer(1024), "small files keep to JSON-RPC")
+
+	var done int64
+	n, err := c.WriteFileFrom(ctx, "/model.bin", bytes.NewReader(content), 0644, func(d int64) { done = d })
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.Equal(t, int64(len(content)), done)
+	got, err := fs.ReadFile("/model.bin")
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	var out bytes.Buffer
+	n, err = c.ReadFileTo(ctx, "/model.bin", &out, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.Equal(t, content, out.Bytes())
+
+	require.NoError(t, c.WriteFile(ctx, "/copy.bin", content))
+	got, err = c.ReadFile(ctx, "/copy.bin")
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	_, err = c.ReadFileTo(ctx, "/missing", io.Discard, nil)
+	assert.Error(t, err)
+}
+
+func TestTransferCopyInAndOut(t *testing.T) {
+	c, fs := newTransferClient(t)
+	ctx := context.Background()
+
+	src := t.TempDir()
+	big := bytes.Repeat([]byte("0123456789"), transferMinSize/5)
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "nested"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "nested/big.bin"), big, 0644))
+	assert.Equal(t, int64(len(big)), treeSize(src, 1<<40))
+
+	require.NoError(t, c.CopyIn(ctx, src, "/job"))
+	got, err := fs.ReadFile("/job/nested/big.bin")
+	require.NoError(t, err)
+	assert.Equal(t, big, got)
+
+	dest := t.TempDir()
+	require.NoError(t, c.CopyOut(ctx, "/job", dest))
+	got, err = os.ReadFile(filepath.Join(dest, "nested/big.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, big, got)
+
+	err = c.CopyOut(ctx, "/missing", t.TempDir())
+	require.ErrorIs(t, err, ErrCopyOut)
+}
+
+func TestTransferFallsBackToRPC(t *testing.T) {
+	c, fs := newTransferClient(t)
+	c.transferSocket = filepath.Join(t.TempDir(), "gone.sock")
+	ctx := context.Background()
+	content := bytes.Repeat([]byte{1}, transferMinSize)
+
+	_, err := c.WriteFileFrom(ctx, "/f", bytes.NewReader(content), 0644, nil)
+	require.NoError(t, err)
+	got, err := fs.ReadFile("/f")
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+}
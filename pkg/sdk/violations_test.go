@@ -0,0 +1,63 @@
+package sdk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+type violationsVM struct {
+	memVM
+	violations []api.NetworkViolation
+}
+
+func (v *violationsVM) NetworkViolations() []api.NetworkViolation { return v.violations }
+
+func TestNetworkViolations(t *testing.T) {
+	seen := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	vm := &violationsVM{violations: []api.NetworkViolation{
+		{Host: "evil.com", Rule: api.RuleAllowlist, Reason: "host not in allowlist", Count: 2, FirstSeen: seen, LastSeen: seen},
+		{Host: "api.example.com", Rule: api.RuleSecretLeak, Reason: "secret placeholder sent to unauthorized host", Count: 1, FirstSeen: seen, LastSeen: seen},
+	}}
+	c := newInProcessClient(t, vm)
+
+	violations, err := c.NetworkViolations(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, vm.violations, violations)
+}
+
+func TestDeniedHosts(t *testing.T) {
+	hosts := DeniedHosts([]api.NetworkViolation{
+		{Host: "pypi.org", Rule: api.RuleAllowlist},
+		{Host: "api.example.com", Rule: api.RuleSecretLeak},
+		{Host: "files.pythonhosted.org:443", Rule: api.RuleAllowlist},
+		{Host: "pypi.org:8443", Rule: api.RuleAllowlist},
+		{Host: "10.0.0.1:5432", Rule: api.RuleConnLimit},
+	})
+	assert.Equal(t, []string{"pypi.org", "files.pythonhosted.org"}, hosts)
+	assert.Nil(t, DeniedHosts(nil))
+}
+
+type egressVM struct {
+	memVM
+	usage *api.EgressUsage
+}
+
+func (v *egressVM) EgressUsage() *api.EgressUsage { return v.usage }
+
+func TestEgressUsage(t *testing.T) {
+	c := newInProcessClient(t, &egressVM{usage: &api.EgressUsage{UsedBytes: 2048, LimitBytes: 2048, Exhausted: true}})
+	usage, err := c.EgressUsage(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &api.EgressUsage{UsedBytes: 2048, LimitBytes: 2048, Exhausted: true}, usage)
+
+	c = newInProcessClient(t, &memVM{})
+	usage, err = c.EgressUsage(context.Background())
+	require.NoError(t, err)
+	assert.Nil(t, usage)
+}
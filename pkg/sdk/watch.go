@@ -0,0 +1,73 @@
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// fileWatchBuffer is how many file events a watch holds for a slow reader
+// before dropping them.
+const fileWatchBuffer = 256
+
+type fileWatch struct {
+	path string
+	ch   chan api.FileEvent
+}
+
+// WatchFiles streams the files created, modified and deleted under
+// guestPath (the workspace if empty) until ctx is done, when the channel is
+// closed. A file written through an open handle is reported as one "modify"
+// when it is closed, so a results file is complete once its modify arrives.
+// Events are dropped if the channel is not drained.
+func (c *Client) WatchFiles(ctx context.Context, guestPath string) (<-chan api.FileEvent, error) {
+	params := map[string]interface{}{}
+	if guestPath != "" {
+		params["path"] = guestPath
+	}
+	result, err := c.sendRequestCtx(ctx, "watch_files", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	var watchResult struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(result, &watchResult); err != nil {
+		return nil, errx.Wrap(ErrParseWatchResult, err)
+	}
+
+	w := &fileWatch{path: strings.TrimSuffix(watchResult.Path, "/"), ch: make(chan api.FileEvent, fileWatchBuffer)}
+	c.watchMu.Lock()
+	if c.fileWatches == nil {
+		c.fileWatches = make(map[*fileWatch]struct{})
+	}
+	c.fileWatches[w] = struct{}{}
+	c.watchMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		c.watchMu.Lock()
+		delete(c.fileWatches, w)
+		close(w.ch)
+		c.watchMu.Unlock()
+	}()
+	return w.ch, nil
+}
+
+// dispatchFileEvent hands a file event to every watch covering its path.
+func (c *Client) dispatchFileEvent(ev *api.FileEvent) {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+	for w := range c.fileWatches {
+		if w.path != "" && ev.Path != w.path && !strings.HasPrefix(ev.Path, w.path+"/") {
+			continue
+		}
+		select {
+		case w.ch <- *ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package sdk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+type watchVM struct {
+	memVM
+	events chan api.Event
+}
+
+func (v *watchVM) Events() <-chan api.Event     { return v.events }
+func (v *watchVM) WatchFiles(path string) error { return nil }
+
+func TestWatchFiles(t *testing.T) {
+	vm := &watchVM{events: make(chan api.Event, 10)}
+	c := newInProcessClient(t, vm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	all, err := c.WatchFiles(ctx, "")
+	require.NoError(t, err)
+	out, err := c.WatchFiles(ctx, "/workspace/out")
+	require.NoError(t, err)
+
+	vm.events <- api.Event{Type: "network", Network: &api.NetworkEvent{Host: "example.com"}}
+	vm.events <- api.Event{Type: "file", File: &api.FileEvent{Op: "create", Path: "/workspace/notes.txt"}}
+	vm.events <- api.Event{Type: "file", File: &api.FileEvent{Op: "modify", Path: "/workspace/out/results.json", Size: 2}}
+
+	assert.Equal(t, api.FileEvent{Op: "create", Path: "/workspace/notes.txt"}, <-all)
+	assert.Equal(t, api.FileEvent{Op: "modify", Path: "/workspace/out/results.json", Size: 2}, <-all)
+	assert.Equal(t, api.FileEvent{Op: "modify", Path: "/workspace/out/results.json", Size: 2}, <-out)
+
+	cancel()
+	for range all {
+	}
+	for range out {
+	}
+}
+
+func TestWatchFilesUnsupported(t *testing.T) {
+	c := newInProcessClient(t, &memVM{})
+	_, err := c.WatchFiles(context.Background(), "")
+	require.Error(t, err)
+}
@@ -0,0 +1,10 @@
+package secrets
+
+import "errors"
+
+var (
+	ErrAWSConfig           = errors.New("load AWS config")
+	ErrFetchSecret         = errors.New("fetch secret")
+	ErrSecretField         = errors.New("secret field")
+	ErrProviderUnavailable = errors.New("secret provider unavailable")
+)
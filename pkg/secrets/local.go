@@ -0,0 +1,89 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// commandRunner runs a helper CLI and returns its stdout.
+type commandRunner func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+func execCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errx.With(err, ": %s", msg)
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, errx.With(ErrProviderUnavailable, ": %s is not installed", name)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *Resolver) command(ctx context.Context, name string, args ...string) ([]byte, error) {
+	if r.run != nil {
+		return r.run(ctx, name, args...)
+	}
+	return execCommand(ctx, name, args...)
+}
+
+// fetchOnePassword reads a secret reference with the 1Password CLI, which
+// handles sign-in (including desktop app and biometric unlock) itself.
+func (r *Resolver) fetchOnePassword(ctx context.Context, ref string) (string, error) {
+	out, err := r.command(ctx, "op", "read", "--no-newline", ref)
+	if err != nil {
+		return "", errx.With(ErrFetchSecret, " %s: %w", ref, err)
+	}
+	return string(out), nil
+}
+
+// fetchKeychain reads a generic password from the macOS Keychain, or from
+// the freedesktop secret service (GNOME Keyring, KWallet) on Linux. The
+// reference is "service" or "service/account".
+func (r *Resolver) fetchKeychain(ctx context.Context, ref string) (string, error) {
+	service, account := ref, ""
+	if i := strings.LastIndex(ref, "/"); i != -1 {
+		service, account = ref[:i], ref[i+1:]
+	}
+	if service == "" {
+		return "", errx.With(ErrFetchSecret, " %s%s: service is required", PrefixKeychain, ref)
+	}
+
+	var (
+		out []byte
+		err error
+	)
+	if runtime.GOOS == "darwin" {
+		args := []string{"find-generic-password", "-s", service, "-w"}
+		if account != "" {
+			args = append(args, "-a", account)
+		}
+		out, err = r.command(ctx, "security", args...)
+	} else {
+		args := []string{"lookup", "service", service}
+		if account != "" {
+			args = append(args, "account", account)
+		}
+		out, err = r.command(ctx, "secret-tool", args...)
+	}
+	if err != nil {
+		return "", errx.With(ErrFetchSecret, " %s%s: %w", PrefixKeychain, ref, err)
+	}
+
+	value := strings.TrimSuffix(string(out), "\n")
+	if value == "" {
+		return "", errx.With(ErrFetchSecret, " %s%s: no matching item", PrefixKeychain, ref)
+	}
+	return value, nil
+}
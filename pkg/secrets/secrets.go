@@ -0,0 +1,234 @@
+// Package secrets resolves secret values that reference an external secret
+// store, so real values never pass through shell history or environment
+// variables. References are resolved once, on the host, when a sandbox is
+// launched:
+//
+//	aws-sm:prod/openai           AWS Secrets Manager secret string
+//	aws-sm:prod/keys#openai      one field of a JSON secret string
+//	aws-ssm:/prod/openai/key     SSM Parameter Store (SecureString decrypted)
+//	op://dev/openai/credential   1Password, via the op CLI
+//	keychain:openai              macOS Keychain or Linux secret service
+//	keychain:openai/alice        ... restricted to one account
+//
+// AWS credentials and region come from the default AWS credential chain. A
+// Secrets Manager ARN selects its own region. 1Password and keychain lookups
+// shell out to op, security (macOS) or secret-tool (Linux), which handle
+// unlocking themselves.
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+// Reference prefixes.
+const (
+	PrefixAWSSecretsManager = "aws-sm:"
+	PrefixAWSParameterStore = "aws-ssm:"
+	PrefixOnePassword       = "op://"
+	PrefixKeychain          = "keychain:"
+)
+
+var prefixes = []string{
+	PrefixAWSSecretsManager,
+	PrefixAWSParameterStore,
+	PrefixOnePassword,
+	PrefixKeychain,
+}
+
+type secretsManagerAPI interface {
+	GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+type parameterStoreAPI interface {
+	GetParameter(ctx context.Context, in *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// Resolver fetches referenced secrets. AWS clients are created on first use,
+// so launching without references never touches the credential chain.
+type Resolver struct {
+	once      sync.Once
+	initErr   error
+	smClient  secretsManagerAPI
+	ssmClient parameterStoreAPI
+	run       commandRunner
+}
+
+// NewResolver returns a resolver using the default AWS credential chain and
+// the locally installed 1Password and keychain CLIs.
+func NewResolver() *Resolver {
+	return &Resolver{}
+}
+
+// IsReference reports whether value names a secret in an external store.
+func IsReference(value string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveAll replaces every referenced secret value in secrets, including
+// OAuth2 client secrets, refresh tokens and GitHub App private keys, with the
+// value fetched from its store. Other values are left as they are.
+func (r *Resolver) ResolveAll(ctx context.Context, secrets map[string]api.Secret) error {
+	for name, secret := range secrets {
+		fields := []*string{&secret.Value}
+		if secret.OAuth2 != nil {
+			oauth2 := *secret.OAuth2
+			secret.OAuth2 = &oauth2
+			fields = append(fields, &oauth2.ClientSecret, &oauth2.RefreshToken)
+		}
+		if secret.GitHubApp != nil {
+			app := *secret.GitHubApp
+			secret.GitHubApp = &app
+			fields = append(fields, &app.PrivateKey)
+		}
+		for _, field := range fields {
+			value, err := r.Resolve(ctx, *field)
+			if err != nil {
+				return errx.With(err, " for secret %s", name)
+			}
+			*field = value
+		}
+		secrets[name] = secret
+	}
+	return nil
+}
+
+// Resolve returns the value a reference points to, or value itself if it is
+// not a reference. A "#field" suffix selects a field of a JSON object;
+// 1Password references name their field in the path instead.
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	if !IsReference(value) {
+		return value, nil
+	}
+	if strings.HasPrefix(value, PrefixOnePassword) {
+		return r.fetchOnePassword(ctx, value)
+	}
+
+	ref, field, hasField := strings.Cut(value, "#")
+
+	var (
+		resolved string
+		err      error
+	)
+	switch {
+	case strings.HasPrefix(ref, PrefixAWSSecretsManager):
+		resolved, err = r.fetchSecretsManager(ctx, strings.TrimPrefix(ref, PrefixAWSSecretsManager))
+	case strings.HasPrefix(ref, PrefixKeychain):
+		resolved, err = r.fetchKeychain(ctx, strings.TrimPrefix(ref, PrefixKeychain))
+	default:
+		resolved, err = r.fetchParameter(ctx, strings.TrimPrefix(ref, PrefixAWSParameterStore))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !hasField {
+		return resolved, nil
+	}
+	return jsonField(resolved, field)
+}
+
+func (r *Resolver) init(ctx context.Context) error {
+	r.once.Do(func() {
+		if r.smClient != nil && r.ssmClient != nil {
+			return
+		}
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			r.initErr = errx.Wrap(ErrAWSConfig, err)
+			return
+		}
+		if r.smClient == nil {
+			r.smClient = secretsmanager.NewFromConfig(cfg)
+		}
+		if r.ssmClient == nil {
+			r.ssmClient = ssm.NewFromConfig(cfg)
+		}
+	})
+	return r.initErr
+}
+
+func (r *Resolver) fetchSecretsManager(ctx context.Context, id string) (string, error) {
+	if err := r.init(ctx); err != nil {
+		return "", err
+	}
+
+	var opts []func(*secretsmanager.Options)
+	if region := arnRegion(id); region != "" {
+		opts = append(opts, func(o *secretsmanager.Options) { o.Region = region })
+	}
+	out, err := r.smClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)}, opts...)
+	if err != nil {
+		return "", errx.With(ErrFetchSecret, " %s%s: %w", PrefixAWSSecretsManager, id, err)
+	}
+	if out.SecretString == nil {
+		return "", errx.With(ErrFetchSecret, " %s%s: secret has no string value", PrefixAWSSecretsManager, id)
+	}
+	return *out.SecretString, nil
+}
+
+func (r *Resolver) fetchParameter(ctx context.Context, name string) (string, error) {
+	if err := r.init(ctx); err != nil {
+		return "", err
+	}
+
+	var opts []func(*ssm.Options)
+	if region := arnRegion(name); region != "" {
+		opts = append(opts, func(o *ssm.Options) { o.Region = region })
+	}
+	out, err := r.ssmClient.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	}, opts...)
+	if err != nil {
+		return "", errx.With(ErrFetchSecret, " %s%s: %w", PrefixAWSParameterStore, name, err)
+	}
+	if out.Parameter == nil || out.Parameter.Value == nil {
+		return "", errx.With(ErrFetchSecret, " %s%s: parameter has no value", PrefixAWSParameterStore, name)
+	}
+	return *out.Parameter.Value, nil
+}
+
+// arnRegion returns the region of an ARN ("arn:aws:service:region:..."), or
+// "" for plain names.
+func arnRegion(id string) string {
+	parts := strings.SplitN(id, ":", 5)
+	if len(parts) < 5 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[3]
+}
+
+func jsonField(value, field string) (string, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &obj); err != nil {
+		return "", errx.With(ErrSecretField, " %q: secret is not a JSON object", field)
+	}
+	v, ok := obj[field]
+	if !ok {
+		return "", errx.With(ErrSecretField, " %q not found", field)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return "", errx.With(ErrSecretField, " %q: %w", field, err)
+	}
+	return string(encoded), nil
+}
@@ -0,0 +1,218 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+)
+
+type fakeSecretsManager struct {
+	values map[string]string
+	region string
+}
+
+func (f *fakeSecretsManager) GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	opts := secretsmanager.Options{}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	f.region = opts.Region
+
+	v, ok := f.values[*in.SecretId]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(v)}, nil
+}
+
+type fakeParameterStore struct {
+	values    map[string]string
+	decrypted bool
+}
+
+func (f *fakeParameterStore) GetParameter(ctx context.Context, in *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	f.decrypted = aws.ToBool(in.WithDecryption)
+	v, ok := f.values[*in.Name]
+	if !ok {
+		return nil, errors.New("ParameterNotFound")
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Value: aws.String(v)}}, nil
+}
+
+func newTestResolver() (*Resolver, *fakeSecretsManager, *fakeParameterStore) {
+	sm := &fakeSecretsManager{values: map[string]string{
+		"prod/openai": "sk-openai",
+		"prod/keys":   `{"anthropic":"sk-ant","port":5432}`,
+		"arn:aws:secretsmanager:eu-west-1:123456789012:secret:prod/db": "db-pass",
+	}}
+	ps := &fakeParameterStore{values: map[string]string{
+		"/prod/github/token": "ghp_123",
+	}}
+	return &Resolver{smClient: sm, ssmClient: ps}, sm, ps
+}
+
+func TestResolve(t *testing.T) {
+	r, sm, ps := newTestResolver()
+	ctx := context.Background()
+
+	v, err := r.Resolve(ctx, "plain-value")
+	require.NoError(t, err)
+	assert.Equal(t, "plain-value", v)
+
+	v, err = r.Resolve(ctx, "aws-sm:prod/openai")
+	require.NoError(t, err)
+	assert.Equal(t, "sk-openai", v)
+	assert.Empty(t, sm.region)
+
+	v, err = r.Resolve(ctx, "aws-sm:prod/keys#anthropic")
+	require.NoError(t, err)
+	assert.Equal(t, "sk-ant", v)
+
+	v, err = r.Resolve(ctx, "aws-sm:prod/keys#port")
+	require.NoError(t, err)
+	assert.Equal(t, "5432", v)
+
+	v, err = r.Resolve(ctx, "aws-sm:arn:aws:secretsmanager:eu-west-1:123456789012:secret:prod/db")
+	require.NoError(t, err)
+	assert.Equal(t, "db-pass", v)
+	assert.Equal(t, "eu-west-1", sm.region)
+
+	v, err = r.Resolve(ctx, "aws-ssm:/prod/github/token")
+	require.NoError(t, err)
+	assert.Equal(t, "ghp_123", v)
+	assert.True(t, ps.decrypted)
+}
+
+func TestResolveErrors(t *testing.T) {
+	r, _, _ := newTestResolver()
+	ctx := context.Background()
+
+	_, err := r.Resolve(ctx, "aws-sm:missing")
+	assert.ErrorIs(t, err, ErrFetchSecret)
+
+	_, err = r.Resolve(ctx, "aws-ssm:/missing")
+	assert.ErrorIs(t, err, ErrFetchSecret)
+
+	_, err = r.Resolve(ctx, "aws-sm:prod/keys#nope")
+	assert.ErrorIs(t, err, ErrSecretField)
+
+	_, err = r.Resolve(ctx, "aws-sm:prod/openai#field")
+	assert.ErrorIs(t, err, ErrSecretField)
+}
+
+func TestResolveAll(t *testing.T) {
+	r, _, _ := newTestResolver()
+	secrets := map[string]api.Secret{
+		"OPENAI_API_KEY": {Value: "aws-sm:prod/openai", Hosts: []string{"api.openai.com"}},
+		"GITHUB_TOKEN":   {Value: "aws-ssm:/prod/github/token", Hosts: []string{"api.github.com"}, In: []string{api.SecretInHeader}},
+		"INLINE":         {Value: "inline", Hosts: []string{"example.com"}},
+	}
+
+	require.NoError(t, r.ResolveAll(context.Background(), secrets))
+	assert.Equal(t, "sk-openai", secrets["OPENAI_API_KEY"].Value)
+	assert.Equal(t, "ghp_123", secrets["GITHUB_TOKEN"].Value)
+	assert.Equal(t, []string{api.SecretInHeader}, secrets["GITHUB_TOKEN"].In)
+	assert.Equal(t, "inline", secrets["INLINE"].Value)
+
+	secrets["BROKEN"] = api.Secret{Value: "aws-sm:missing"}
+	err := r.ResolveAll(context.Background(), secrets)
+	assert.ErrorIs(t, err, ErrFetchSecret)
+	assert.Contains(t, err.Error(), "secret BROKEN")
+}
+
+func TestResolveAllOAuth2(t *testing.T) {
+	r, _, _ := newTestResolver()
+	oauth2 := &api.OAuth2{
+		TokenURL:     "https://auth.example.com/token",
+		ClientID:     "client",
+		ClientSecret: "aws-sm:prod/openai",
+		RefreshToken: "aws-ssm:/prod/github/token",
+	}
+	secrets := map[string]api.Secret{"API": {Hosts: []string{"api.example.com"}, OAuth2: oauth2}}
+
+	require.NoError(t, r.ResolveAll(context.Background(), secrets))
+	assert.Equal(t, "sk-openai", secrets["API"].OAuth2.ClientSecret)
+	assert.Equal(t, "ghp_123", secrets["API"].OAuth2.RefreshToken)
+	assert.Equal(t, "client", secrets["API"].OAuth2.ClientID)
+	assert.Equal(t, "aws-sm:prod/openai", oauth2.ClientSecret, "caller's config is not modified")
+}
+
+func TestIsReference(t *testing.T) {
+	assert.True(t, IsReference("aws-sm:x"))
+	assert.True(t, IsReference("aws-ssm:/x"))
+	assert.True(t, IsReference("op://vault/item/field"))
+	assert.True(t, IsReference("keychain:openai"))
+	assert.False(t, IsReference("sk-123"))
+	assert.False(t, IsReference("aws-secret"))
+}
+
+type fakeCommands struct {
+	calls   [][]string
+	outputs map[string]string
+}
+
+func (f *fakeCommands) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	call := append([]string{name}, args...)
+	f.calls = append(f.calls, call)
+	key := strings.Join(call, " ")
+	out, ok := f.outputs[key]
+	if !ok {
+		return nil, errors.New("exit status 1")
+	}
+	return []byte(out), nil
+}
+
+func TestResolveOnePassword(t *testing.T) {
+	cmds := &fakeCommands{outputs: map[string]string{
+		"op read --no-newline op://dev/openai/credential": "sk-op",
+	}}
+	r := &Resolver{run: cmds.run}
+
+	v, err := r.Resolve(context.Background(), "op://dev/openai/credential")
+	require.NoError(t, err)
+	assert.Equal(t, "sk-op", v)
+
+	_, err = r.Resolve(context.Background(), "op://dev/missing/credential")
+	assert.ErrorIs(t, err, ErrFetchSecret)
+}
+
+func TestResolveKeychain(t *testing.T) {
+	var service, serviceAccount string
+	if runtime.GOOS == "darwin" {
+		service = "security find-generic-password -s openai -w"
+		serviceAccount = "security find-generic-password -s api.example.com -w -a alice@example.com"
+	} else {
+		service = "secret-tool lookup service openai"
+		serviceAccount = "secret-tool lookup service api.example.com account alice@example.com"
+	}
+	cmds := &fakeCommands{outputs: map[string]string{
+		service:        "sk-keychain\n",
+		serviceAccount: `{"token":"tok-123"}` + "\n",
+	}}
+	r := &Resolver{run: cmds.run}
+
+	v, err := r.Resolve(context.Background(), "keychain:openai")
+	require.NoError(t, err)
+	assert.Equal(t, "sk-keychain", v)
+
+	v, err = r.Resolve(context.Background(), "keychain:api.example.com/alice@example.com#token")
+	require.NoError(t, err)
+	assert.Equal(t, "tok-123", v)
+
+	_, err = r.Resolve(context.Background(), "keychain:missing")
+	assert.ErrorIs(t, err, ErrFetchSecret)
+
+	_, err = r.Resolve(context.Background(), "keychain:/alice")
+	assert.ErrorIs(t, err, ErrFetchSecret)
+}
@@ -5,4 +5,5 @@ import "errors"
 var (
 	ErrNoAvailableSubnets   = errors.New("no available subnets")
 	ErrSaveSubnetAllocation = errors.New("failed to save subnet allocation")
+	ErrLoadConfig           = errors.New("failed to load sandbox config")
 )
@@ -3,20 +3,44 @@ package state
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
 )
 
 type VMState struct {
-	ID        string          `json:"id"`
-	PID       int             `json:"pid"`
-	Status    string          `json:"status"`
-	Image     string          `json:"image"`
-	CreatedAt time.Time       `json:"created_at"`
-	Config    json.RawMessage `json:"config,omitempty"`
+	ID          string          `json:"id"`
+	PID         int             `json:"pid"`
+	Status      string          `json:"status"`
+	Image       string          `json:"image"`
+	ImageDigest string          `json:"image_digest,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Config      json.RawMessage `json:"config,omitempty"`
+
+	NetworkMetrics json.RawMessage `json:"network_metrics,omitempty"`
+	Egress         json.RawMessage `json:"egress,omitempty"`
+	SecretUsage    json.RawMessage `json:"secret_usage,omitempty"`
+	MountUsage     json.RawMessage `json:"mount_usage,omitempty"`
+	VFSMetrics     json.RawMessage `json:"vfs_metrics,omitempty"`
+	Exit           *ExitStatus     `json:"exit,omitempty"`
+
+	// Overlays maps the guest path of each overlay mount to the host
+	// directory holding its upper layer: the files the guest wrote, with
+	// deletions recorded as .wh.NAME whiteouts.
+	Overlays map[string]string `json:"overlays,omitempty"`
+}
+
+// ExitStatus records how a sandbox's primary command finished.
+type ExitStatus struct {
+	ExitCode   int       `json:"exit_code"`
+	OOMKilled  bool      `json:"oom_killed,omitempty"`
+	FinishedAt time.Time `json:"finished_at"`
 }
 
 type Manager struct {
@@ -71,6 +95,9 @@ func (m *Manager) Unregister(id string) error {
 	dir := filepath.Join(m.baseDir, id)
 	os.WriteFile(filepath.Join(dir, "status"), []byte("stopped"), 0644)
 	os.Remove(filepath.Join(dir, "pid"))
+	// Swap may hold guest memory; never keep it past the VM. An open
+	// backing file stays usable by the hypervisor until it exits.
+	os.Remove(m.SwapPath(id))
 	return nil
 }
 
@@ -127,19 +154,189 @@ func (m *Manager) Get(id string) (VMState, error) {
 		state.Config = configBytes
 
 		var cfg struct {
-			Image string `json:"image"`
+			Image       string `json:"image"`
+			ImageDigest string `json:"image_digest"`
 		}
 		json.Unmarshal(configBytes, &cfg)
 		state.Image = cfg.Image
+		state.ImageDigest = cfg.ImageDigest
 	}
 
 	if createdBytes, err := os.ReadFile(filepath.Join(dir, "created_at")); err == nil {
 		state.CreatedAt, _ = time.Parse(time.RFC3339, string(createdBytes))
 	}
 
+	if metricsBytes, err := os.ReadFile(filepath.Join(dir, "network_metrics.json")); err == nil {
+		state.NetworkMetrics = metricsBytes
+	}
+
+	if egressBytes, err := os.ReadFile(filepath.Join(dir, "egress.json")); err == nil {
+		state.Egress = egressBytes
+	}
+
+	if usageBytes, err := os.ReadFile(filepath.Join(dir, "secret_usage.json")); err == nil {
+		state.SecretUsage = usageBytes
+	}
+
+	if usageBytes, err := os.ReadFile(filepath.Join(dir, "mount_usage.json")); err == nil {
+		state.MountUsage = usageBytes
+	}
+
+	if vfsBytes, err := os.ReadFile(filepath.Join(dir, "vfs_metrics.json")); err == nil {
+		state.VFSMetrics = vfsBytes
+	}
+
+	if exitBytes, err := os.ReadFile(filepath.Join(dir, "exit.json")); err == nil {
+		var exit ExitStatus
+		if json.Unmarshal(exitBytes, &exit) == nil {
+			state.Exit = &exit
+		}
+	}
+
+	if entries, err := os.ReadDir(filepath.Join(dir, "overlays")); err == nil {
+		for _, e := range entries {
+			guestPath, err := url.PathUnescape(e.Name())
+			if err != nil || !e.IsDir() {
+				continue
+			}
+			if state.Overlays == nil {
+				state.Overlays = make(map[string]string)
+			}
+			state.Overlays["/"+guestPath] = filepath.Join(dir, "overlays", e.Name())
+		}
+	}
+
 	return state, nil
 }
 
+// LoadConfig decodes the config a VM was registered with into config, so a
+// new sandbox can be created from it (e.g. `matchlock run --from`). The VM
+// may have stopped.
+func (m *Manager) LoadConfig(id string, config interface{}) error {
+	data, err := os.ReadFile(filepath.Join(m.baseDir, id, "config.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errx.With(ErrLoadConfig, ": VM %s not found", id)
+		}
+		return errx.Wrap(ErrLoadConfig, err)
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return errx.With(ErrLoadConfig, " for %s: %w", id, err)
+	}
+	return nil
+}
+
+// SaveConfig replaces the config a VM was registered with, for changes made
+// while it runs such as mounts added to it.
+func (m *Manager) SaveConfig(id string, config interface{}) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(m.baseDir, id)
+	tmp := filepath.Join(dir, "config.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "config.json"))
+}
+
+// SaveNetworkMetrics persists the per-host network metrics of a VM so they
+// can be inspected from other processes (e.g. `matchlock get`).
+func (m *Manager) SaveNetworkMetrics(id string, metrics interface{}) error {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(m.baseDir, id)
+	tmp := filepath.Join(dir, "network_metrics.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "network_metrics.json"))
+}
+
+// SaveEgressUsage persists a VM's egress byte budget consumption so it can
+// be inspected from other processes (e.g. `matchlock get`).
+func (m *Manager) SaveEgressUsage(id string, usage interface{}) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(m.baseDir, id)
+	tmp := filepath.Join(dir, "egress.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "egress.json"))
+}
+
+// SaveSecretUsage persists where and when each of a VM's secrets was
+// injected so it can be inspected from other processes (e.g. `matchlock get`).
+func (m *Manager) SaveSecretUsage(id string, usage interface{}) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(m.baseDir, id)
+	tmp := filepath.Join(dir, "secret_usage.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "secret_usage.json"))
+}
+
+// SaveMountUsage persists how much space each size-accounted mount of a VM
+// holds so it can be inspected from other processes (e.g. `matchlock get`).
+func (m *Manager) SaveMountUsage(id string, usage interface{}) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(m.baseDir, id)
+	tmp := filepath.Join(dir, "mount_usage.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "mount_usage.json"))
+}
+
+// SaveVFSMetrics persists the counts and latencies of the filesystem
+// operations the guest made on each mount of a VM, for `matchlock get`.
+func (m *Manager) SaveVFSMetrics(id string, metrics interface{}) error {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(m.baseDir, id)
+	tmp := filepath.Join(dir, "vfs_metrics.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "vfs_metrics.json"))
+}
+
+// VFSSlowLogPath returns the file the slow filesystem operations of a VM
+// are logged to.
+func (m *Manager) VFSSlowLogPath(id string) string {
+	return filepath.Join(m.baseDir, id, "vfs_slow.log")
+}
+
+// SaveExitStatus records the outcome of a VM's primary command so that
+// `matchlock list` and `matchlock get` can show why a sandbox stopped.
+func (m *Manager) SaveExitStatus(id string, exit ExitStatus) error {
+	data, err := json.Marshal(exit)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(m.baseDir, id)
+	tmp := filepath.Join(dir, "exit.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "exit.json"))
+}
+
 func (m *Manager) Kill(id string) error {
 	state, err := m.Get(id)
 	if err != nil {
@@ -219,6 +416,33 @@ func (m *Manager) ExecSocketPath(id string) string {
 	return filepath.Join(m.baseDir, id, "exec.sock")
 }
 
+// TransferSocketPath is where the process running a VM serves bulk file
+// transfers to and from it.
+func (m *Manager) TransferSocketPath(id string) string {
+	return filepath.Join(m.baseDir, id, "transfer.sock")
+}
+
+// SwapPath is the backing image for a VM's file swap. It is removed when the
+// VM is unregistered.
+func (m *Manager) SwapPath(id string) string {
+	return filepath.Join(m.baseDir, id, "swap.img")
+}
+
+// OverlayDir is the host directory holding the upper layer of the overlay
+// mount at guestPath. It outlives the VM so the guest's changes can be
+// collected after the run, and is removed with the VM's state.
+func (m *Manager) OverlayDir(id, guestPath string) string {
+	name := url.PathEscape(strings.TrimPrefix(filepath.Clean(guestPath), "/"))
+	return filepath.Join(m.baseDir, id, "overlays", name)
+}
+
+// GitDir is the host directory holding the clone behind the git mount at
+// guestPath. It is removed with the VM's state.
+func (m *Manager) GitDir(id, guestPath string) string {
+	name := url.PathEscape(strings.TrimPrefix(filepath.Clean(guestPath), "/"))
+	return filepath.Join(m.baseDir, id, "git", name)
+}
+
 func (m *Manager) Dir(id string) string {
 	return filepath.Join(m.baseDir, id)
 }
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -62,6 +63,18 @@ func TestRemoveRunningVMWithDeadProcess(t *testing.T) {
 	require.True(t, os.IsNotExist(err), "expected VM directory to be removed")
 }
 
+func TestUnregisterRemovesSwap(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerWithDir(dir)
+
+	id := "vm-swap"
+	require.NoError(t, mgr.Register(id, map[string]string{"image": "alpine:latest"}))
+	require.NoError(t, os.WriteFile(mgr.SwapPath(id), nil, 0600))
+
+	require.NoError(t, mgr.Unregister(id))
+	assert.NoFileExists(t, mgr.SwapPath(id))
+}
+
 // TestUnregisterThenRemove_RmFlag is a regression test for
 // https://github.com/jingkaihe/matchlock/issues/12
 // When --rm is set, the VM state directory must be fully removed after Close().
@@ -143,3 +156,150 @@ func TestUnregisterWithoutRemove_NoRmFlag(t *testing.T) {
 	_, err = os.Stat(vmDir)
 	require.False(t, os.IsNotExist(err), "expected VM directory to persist after Unregister without Remove")
 }
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerWithDir(dir)
+	require.NoError(t, mgr.Register("vm-config", map[string]interface{}{"image": "alpine:latest", "privileged": true}))
+	require.NoError(t, mgr.Unregister("vm-config"))
+
+	var cfg struct {
+		Image      string `json:"image"`
+		Privileged bool   `json:"privileged"`
+	}
+	require.NoError(t, mgr.LoadConfig("vm-config", &cfg))
+	assert.Equal(t, "alpine:latest", cfg.Image)
+	assert.True(t, cfg.Privileged)
+
+	err := mgr.LoadConfig("vm-missing", &cfg)
+	require.ErrorIs(t, err, ErrLoadConfig)
+	assert.Contains(t, err.Error(), "vm-missing")
+}
+
+func TestGetImageDigest(t *testing.T) {
+	mgr := NewManagerWithDir(t.TempDir())
+	digest := "sha256:41157f177893a0c890606ffcbfb1d9d97341adcda731936ceabd2bcf79a86830"
+	require.NoError(t, mgr.Register("vm-pinned", map[string]interface{}{"image": "alpine@" + digest, "image_digest": digest}))
+
+	s, err := mgr.Get("vm-pinned")
+	require.NoError(t, err)
+	assert.Equal(t, "alpine@"+digest, s.Image)
+	assert.Equal(t, digest, s.ImageDigest)
+}
+
+func TestSaveNetworkMetrics(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerWithDir(dir)
+	require.NoError(t, mgr.Register("vm-metrics", map[string]string{"image": "alpine:latest"}))
+
+	s, err := mgr.Get("vm-metrics")
+	require.NoError(t, err)
+	assert.Nil(t, s.NetworkMetrics)
+
+	metrics := []map[string]interface{}{{"host": "api.example.com", "requests": 3}}
+	require.NoError(t, mgr.SaveNetworkMetrics("vm-metrics", metrics))
+
+	s, err = mgr.Get("vm-metrics")
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"host":"api.example.com","requests":3}]`, string(s.NetworkMetrics))
+}
+
+func TestSaveEgressUsage(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerWithDir(dir)
+	require.NoError(t, mgr.Register("vm-egress", map[string]string{"image": "alpine:latest"}))
+
+	s, err := mgr.Get("vm-egress")
+	require.NoError(t, err)
+	assert.Nil(t, s.Egress)
+
+	usage := map[string]interface{}{"used_bytes": 512, "limit_bytes": 1024, "exhausted": false}
+	require.NoError(t, mgr.SaveEgressUsage("vm-egress", usage))
+
+	s, err = mgr.Get("vm-egress")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"used_bytes":512,"limit_bytes":1024,"exhausted":false}`, string(s.Egress))
+}
+
+func TestSaveSecretUsage(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerWithDir(dir)
+	require.NoError(t, mgr.Register("vm-secrets", map[string]string{"image": "alpine:latest"}))
+
+	s, err := mgr.Get("vm-secrets")
+	require.NoError(t, err)
+	assert.Nil(t, s.SecretUsage)
+
+	usage := []map[string]interface{}{{"name": "API_KEY", "injections": 2}}
+	require.NoError(t, mgr.SaveSecretUsage("vm-secrets", usage))
+
+	s, err = mgr.Get("vm-secrets")
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"name":"API_KEY","injections":2}]`, string(s.SecretUsage))
+}
+
+func TestSaveMountUsage(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerWithDir(dir)
+	require.NoError(t, mgr.Register("vm-mounts", map[string]string{"image": "alpine:latest"}))
+
+	usage := []map[string]interface{}{{"path": "/workspace", "used_bytes": 10, "limit_bytes": 1024}}
+	require.NoError(t, mgr.SaveMountUsage("vm-mounts", usage))
+
+	s, err := mgr.Get("vm-mounts")
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"path":"/workspace","used_bytes":10,"limit_bytes":1024}]`, string(s.MountUsage))
+}
+
+func TestSaveVFSMetrics(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerWithDir(dir)
+	require.NoError(t, mgr.Register("vm-vfs", map[string]string{"image": "alpine:latest"}))
+
+	metrics := []map[string]interface{}{{"path": "/workspace", "ops": []map[string]interface{}{{"op": "write", "count": 3}}}}
+	require.NoError(t, mgr.SaveVFSMetrics("vm-vfs", metrics))
+
+	s, err := mgr.Get("vm-vfs")
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"path":"/workspace","ops":[{"op":"write","count":3}]}]`, string(s.VFSMetrics))
+	assert.Equal(t, filepath.Join(dir, "vm-vfs", "vfs_slow.log"), mgr.VFSSlowLogPath("vm-vfs"))
+}
+
+func TestSaveExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerWithDir(dir)
+	require.NoError(t, mgr.Register("vm-exit", map[string]string{"image": "alpine:latest"}))
+
+	s, err := mgr.Get("vm-exit")
+	require.NoError(t, err)
+	assert.Nil(t, s.Exit)
+
+	finished := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, mgr.SaveExitStatus("vm-exit", ExitStatus{ExitCode: 137, OOMKilled: true, FinishedAt: finished}))
+
+	s, err = mgr.Get("vm-exit")
+	require.NoError(t, err)
+	require.NotNil(t, s.Exit)
+	assert.Equal(t, 137, s.Exit.ExitCode)
+	assert.True(t, s.Exit.OOMKilled)
+	assert.True(t, finished.Equal(s.Exit.FinishedAt))
+
+	states, err := mgr.List()
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	require.NotNil(t, states[0].Exit)
+	assert.Equal(t, 137, states[0].Exit.ExitCode)
+}
+
+func TestGetOverlays(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerWithDir(dir)
+	require.NoError(t, mgr.Register("vm-overlay", map[string]string{"image": "alpine"}))
+
+	upper := mgr.OverlayDir("vm-overlay", "/workspace/repo/")
+	require.NoError(t, os.MkdirAll(upper, 0700))
+
+	state, err := mgr.Get("vm-overlay")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"/workspace/repo": upper}, state.Overlays)
+}
@@ -0,0 +1,13 @@
+package transfer
+
+import "errors"
+
+var (
+	ErrListen   = errors.New("listen on transfer socket")
+	ErrConnect  = errors.New("connect to transfer socket")
+	ErrSend     = errors.New("send transfer data")
+	ErrRead     = errors.New("read transfer data")
+	ErrProtocol = errors.New("transfer protocol error")
+	ErrUnknown  = errors.New("unknown transfer op")
+	ErrFailed   = errors.New("transfer failed")
+)
@@ -0,0 +1,113 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// Target is what a Server moves files to and from, such as a sandbox.
+type Target interface {
+	ReadFileTo(ctx context.Context, path string, w io.Writer) (int64, error)
+	WriteFileFrom(ctx context.Context, path string, r io.Reader, mode uint32) (int64, error)
+	CopyIn(ctx context.Context, path string, r io.Reader) error
+	CopyOut(ctx context.Context, path string, w io.Writer) error
+}
+
+// Server serves transfers to and from a Target on a unix socket.
+type Server struct {
+	target   Target
+	listener net.Listener
+}
+
+func NewServer(target Target) *Server {
+	return &Server{target: target}
+}
+
+// Start listens on socketPath, which only the current user may connect
+// to, and serves transfers until Stop.
+func (s *Server) Start(socketPath string) error {
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return errx.With(ErrListen, " %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return errx.With(ErrListen, " %s: %w", socketPath, err)
+	}
+	s.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				continue
+			}
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Stop stops serving and removes the socket. Transfers under way finish.
+func (s *Server) Stop() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var req request
+	if err := readJSONFrame(conn, frameRequest, &req); err != nil {
+		return
+	}
+
+	// A client going away fails the transfer's reads or writes.
+	ctx := context.Background()
+	var (
+		size int64
+		err  error
+	)
+	switch req.Op {
+	case opReadFile, opCopyOut:
+		w := bufio.NewWriterSize(&frameWriter{conn: conn}, ChunkSize)
+		if req.Op == opReadFile {
+			size, err = s.target.ReadFileTo(ctx, req.Path, w)
+		} else {
+			err = s.target.CopyOut(ctx, req.Path, w)
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+	case opWriteFile, opCopyIn:
+		r := &frameReader{conn: conn}
+		if req.Op == opWriteFile {
+			size, err = s.target.WriteFileFrom(ctx, req.Path, r, req.Mode)
+		} else {
+			err = s.target.CopyIn(ctx, req.Path, r)
+		}
+		// The rest of the upload, such as the padding after a tar's end
+		// or all of it after a failure, is drained so the client is not
+		// blocked before it reads the result.
+		io.Copy(io.Discard, r)
+	default:
+		err = errx.With(ErrUnknown, ": %q", req.Op)
+	}
+
+	res := result{Size: size}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	writeJSONFrame(conn, frameResult, res)
+}
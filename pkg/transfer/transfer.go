@@ -0,0 +1,276 @@
+// Package transfer moves bulk file data between a host process and a
+// sandbox over a unix socket of the process running it. Data goes as raw
+// binary frames of up to ChunkSize bytes, rather than as the base64 chunks
+// of JSON-RPC notifications, so large files and trees move at close to
+// disk speed.
+//
+// Each connection carries one transfer. The client sends a request frame;
+// for an upload it follows with data frames and an end frame, and for a
+// download it reads data frames. Either way the server answers with a
+// result frame. A client that fails midway closes the connection, which
+// fails the transfer in the sandbox: an upload never replaces a file with
+// part of it.
+package transfer
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// ChunkSize is the largest data frame.
+const ChunkSize = 1 << 20
+
+// Every frame is a type byte and a big-endian 32-bit length, followed by
+// that many bytes.
+const (
+	frameRequest uint8 = 1 // JSON request, the first frame of a connection
+	frameData    uint8 = 2 // file or tar stream bytes
+	frameEnd     uint8 = 3 // end of an upload
+	frameResult  uint8 = 4 // JSON result, the last frame of a connection
+
+	frameHeaderSize = 5
+)
+
+// Transfer ops.
+const (
+	opReadFile  = "read_file"
+	opWriteFile = "write_file"
+	opCopyIn    = "copy_in"
+	opCopyOut   = "copy_out"
+)
+
+type request struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Mode uint32 `json:"mode,omitempty"`
+}
+
+type result struct {
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+func writeFrame(conn net.Conn, typ uint8, payload []byte) error {
+	var header [frameHeaderSize]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	bufs := net.Buffers{header[:], payload}
+	_, err := bufs.WriteTo(conn)
+	return err
+}
+
+func writeJSONFrame(conn net.Conn, typ uint8, v any) error {
+	data, _ := json.Marshal(v)
+	return writeFrame(conn, typ, data)
+}
+
+func readHeader(r io.Reader) (uint8, int, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > ChunkSize {
+		return 0, 0, errx.With(ErrProtocol, ": %d byte frame", n)
+	}
+	return header[0], int(n), nil
+}
+
+// readJSONFrame reads a frame of type typ into v.
+func readJSONFrame(r io.Reader, typ uint8, v any) error {
+	got, n, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+	if got != typ {
+		return errx.With(ErrProtocol, ": frame %d, want %d", got, typ)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// frameWriter sends what is written to it as data frames.
+type frameWriter struct {
+	conn net.Conn
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), ChunkSize)
+		if err := writeFrame(w.conn, frameData, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// frameReader reads the data frames of an upload until its end frame,
+// straight from the connection.
+type frameReader struct {
+	conn      net.Conn
+	remaining int // bytes left of the current data frame
+	done      bool
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for r.remaining == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		typ, n, err := readHeader(r.conn)
+		if errors.Is(err, io.EOF) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case frameData:
+			r.remaining = n
+		case frameEnd:
+			r.done = true
+		default:
+			return 0, errx.With(ErrProtocol, ": frame %d in upload", typ)
+		}
+	}
+	n, err := r.conn.Read(p[:min(len(p), r.remaining)])
+	r.remaining -= n
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// ReadFile copies the file at path in the sandbox behind socketPath to w
+// and returns its size.
+func ReadFile(ctx context.Context, socketPath, path string, w io.Writer) (int64, error) {
+	res, err := do(ctx, socketPath, request{Op: opReadFile, Path: path}, nil, w)
+	return res.Size, err
+}
+
+// WriteFile replaces the file at path in the sandbox behind socketPath
+// with the contents of r, once all of r has arrived, and returns its size.
+func WriteFile(ctx context.Context, socketPath, path string, r io.Reader, mode uint32) (int64, error) {
+	res, err := do(ctx, socketPath, request{Op: opWriteFile, Path: path, Mode: mode}, r, nil)
+	return res.Size, err
+}
+
+// CopyIn extracts the tar stream r into the directory path in the sandbox
+// behind socketPath.
+func CopyIn(ctx context.Context, socketPath, path string, r io.Reader) error {
+	_, err := do(ctx, socketPath, request{Op: opCopyIn, Path: path}, r, nil)
+	return err
+}
+
+// CopyOut writes the tree at path in the sandbox behind socketPath to w as
+// a tar stream.
+func CopyOut(ctx context.Context, socketPath, path string, w io.Writer) error {
+	_, err := do(ctx, socketPath, request{Op: opCopyOut, Path: path}, nil, w)
+	return err
+}
+
+// do runs one transfer, sending upload or receiving into download. Only a
+// failure to connect is wrapped in ErrConnect, so callers can fall back to
+// another channel knowing nothing was sent or read.
+func do(ctx context.Context, socketPath string, req request, upload io.Reader, download io.Writer) (result, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return result{}, errx.Wrap(ErrConnect, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	res, err := exchange(conn, req, upload, download)
+	if err != nil && ctx.Err() != nil {
+		return res, ctx.Err()
+	}
+	return res, err
+}
+
+// sendUpload sends r as data frames and an end frame. It returns only a
+// failure to read r: the server stops reading once the transfer has
+// failed, and its result, still to be read, says why.
+func sendUpload(conn net.Conn, r io.Reader) error {
+	buf := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if writeFrame(conn, frameData, buf[:n]) != nil {
+				return nil
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			writeFrame(conn, frameEnd, nil)
+			return nil
+		}
+		if err != nil {
+			// Closing without an end frame fails the transfer.
+			return err
+		}
+	}
+}
+
+func exchange(conn net.Conn, req request, upload io.Reader, download io.Writer) (result, error) {
+	if err := writeJSONFrame(conn, frameRequest, req); err != nil {
+		return result{}, errx.Wrap(ErrSend, err)
+	}
+
+	if upload != nil {
+		if err := sendUpload(conn, upload); err != nil {
+			return result{}, err
+		}
+	}
+
+	var buf []byte
+	for {
+		typ, n, err := readHeader(conn)
+		if err != nil {
+			return result{}, errx.Wrap(ErrRead, err)
+		}
+		switch typ {
+		case frameData:
+			if download == nil {
+				return result{}, errx.With(ErrProtocol, ": data in an upload's answer")
+			}
+			if buf == nil {
+				buf = make([]byte, ChunkSize)
+			}
+			copied, err := io.CopyBuffer(download, io.LimitReader(conn, int64(n)), buf)
+			if err != nil {
+				return result{}, err
+			}
+			if copied < int64(n) {
+				return result{}, errx.Wrap(ErrRead, io.ErrUnexpectedEOF)
+			}
+		case frameResult:
+			data := make([]byte, n)
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return result{}, errx.Wrap(ErrRead, err)
+			}
+			var res result
+			if err := json.Unmarshal(data, &res); err != nil {
+				return result{}, errx.Wrap(ErrProtocol, err)
+			}
+			if res.Error != "" {
+				return res, errx.With(ErrFailed, ": %s", res.Error)
+			}
+			return res, nil
+		default:
+			return result{}, errx.With(ErrProtocol, ": frame %d", typ)
+		}
+	}
+}
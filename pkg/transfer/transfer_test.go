@@ -0,0 +1,177 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+// dirTarget serves the files of a host directory, replacing written files
+// only once they have arrived whole, as a sandbox does.
+type dirTarget struct {
+	dir string
+}
+
+func (t *dirTarget) ReadFileTo(ctx context.Context, path string, w io.Writer) (int64, error) {
+	f, err := os.Open(filepath.Join(t.dir, path))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+func (t *dirTarget) WriteFileFrom(ctx context.Context, path string, r io.Reader, mode uint32) (int64, error) {
+	tmp := filepath.Join(t.dir, path+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return n, os.Rename(tmp, filepath.Join(t.dir, path))
+}
+
+func (t *dirTarget) CopyIn(ctx context.Context, path string, r io.Reader) error {
+	return vfs.ExtractTar(vfs.NewRealFSProvider(t.dir), path, r)
+}
+
+func (t *dirTarget) CopyOut(ctx context.Context, path string, w io.Writer) error {
+	return vfs.WriteTar(vfs.NewRealFSProvider(t.dir), path, w)
+}
+
+func startServer(t testing.TB) (dir, socket string) {
+	t.Helper()
+	dir = t.TempDir()
+	socket = filepath.Join(t.TempDir(), "transfer.sock")
+	s := NewServer(&dirTarget{dir: dir})
+	require.NoError(t, s.Start(socket))
+	t.Cleanup(s.Stop)
+	return dir, socket
+}
+
+func randomBytes(t testing.TB, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	return data
+}
+
+func TestWriteAndReadFile(t *testing.T) {
+	dir, socket := startServer(t)
+	ctx := context.Background()
+	data := randomBytes(t, 5*ChunkSize+123)
+
+	n, err := WriteFile(ctx, socket, "/big.bin", bytes.NewReader(data), 0644)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	written, err := os.ReadFile(filepath.Join(dir, "big.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, written))
+
+	var out bytes.Buffer
+	n, err = ReadFile(ctx, socket, "/big.bin", &out)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.True(t, bytes.Equal(data, out.Bytes()))
+
+	n, err = WriteFile(ctx, socket, "/empty", bytes.NewReader(nil), 0644)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestTransferFailures(t *testing.T) {
+	dir, socket := startServer(t)
+	ctx := context.Background()
+
+	_, err := ReadFile(ctx, socket, "/missing", io.Discard)
+	assert.ErrorIs(t, err, ErrFailed)
+
+	_, err = WriteFile(ctx, socket, "/nodir/file", bytes.NewReader(randomBytes(t, 3*ChunkSize)), 0644)
+	assert.ErrorIs(t, err, ErrFailed, "a failed upload is drained and its result read")
+
+	readErr := errors.New("disk on fire")
+	r := io.MultiReader(bytes.NewReader(randomBytes(t, 2*ChunkSize)), iotestErrReader{readErr})
+	_, err = WriteFile(ctx, socket, "/partial", r, 0644)
+	assert.ErrorIs(t, err, readErr)
+	_, statErr := os.Stat(filepath.Join(dir, "partial"))
+	assert.True(t, os.IsNotExist(statErr), "part of an upload never replaces a file")
+
+	_, err = ReadFile(ctx, filepath.Join(t.TempDir(), "none.sock"), "/x", io.Discard)
+	assert.ErrorIs(t, err, ErrConnect)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = ReadFile(cancelled, socket, "/x", io.Discard)
+	assert.Error(t, err)
+}
+
+type iotestErrReader struct{ err error }
+
+func (r iotestErrReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestCopyInAndOut(t *testing.T) {
+	dir, socket := startServer(t)
+	ctx := context.Background()
+
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "tree", "sub"), 0755))
+	data := randomBytes(t, 2*ChunkSize)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "tree", "sub", "data.bin"), data, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "tree", "a.txt"), []byte("a"), 0644))
+
+	var tarball bytes.Buffer
+	require.NoError(t, vfs.WriteTar(vfs.NewRealFSProvider(src), "/tree", &tarball))
+	require.NoError(t, CopyIn(ctx, socket, "/in", bytes.NewReader(tarball.Bytes())))
+	got, err := os.ReadFile(filepath.Join(dir, "in", "sub", "data.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+
+	var out bytes.Buffer
+	require.NoError(t, CopyOut(ctx, socket, "/in", &out))
+	dst := t.TempDir()
+	require.NoError(t, vfs.ExtractTar(vfs.NewRealFSProvider(dst), "/", &out))
+	got, err = os.ReadFile(filepath.Join(dst, "sub", "data.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+}
+
+func BenchmarkWriteFile(b *testing.B) {
+	_, socket := startServer(b)
+	data := randomBytes(b, 64<<20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := WriteFile(context.Background(), socket, "/bench.bin", bytes.NewReader(data), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadFile(b *testing.B) {
+	dir, socket := startServer(b)
+	data := randomBytes(b, 64<<20)
+	require.NoError(b, os.WriteFile(filepath.Join(dir, "bench.bin"), data, 0644))
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadFile(context.Background(), socket, "/bench.bin", io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
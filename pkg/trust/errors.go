@@ -0,0 +1,16 @@
+package trust
+
+import "errors"
+
+var (
+	ErrReadPolicy       = errors.New("read trust policy")
+	ErrParsePolicy      = errors.New("parse trust policy")
+	ErrInvalidKey       = errors.New("invalid signing key")
+	ErrInvalidPin       = errors.New("invalid asset pin")
+	ErrHashAsset        = errors.New("hash asset")
+	ErrDigestMismatch   = errors.New("asset digest does not match pin")
+	ErrMissingSignature = errors.New("asset signature missing")
+	ErrBadSignature     = errors.New("asset signature does not verify")
+	ErrWriteSignature   = errors.New("write asset signature")
+	ErrInvalidIdentity  = errors.New("invalid signing identity")
+)
@@ -0,0 +1,315 @@
+// Package trust verifies the host-side assets every sandbox boots from: the
+// guest kernel, the initramfs and the guest-agent/guest-fused binaries.
+//
+// Each asset may carry a detached ed25519 signature next to it
+// ("kernel.sig") over the SHA-256 digest of its contents. A trust policy
+// file adds signing keys, can require signatures, and can pin assets to
+// exact digests:
+//
+//	{
+//	  "keys": ["<base64 ed25519 public key>"],
+//	  "require_signatures": true,
+//	  "pins": {"kernel": "sha256:3b1f..."}
+//	}
+//
+// Without a policy file only signatures that are present are checked, so a
+// tampered asset with an intact signature is still rejected, but a deleted
+// signature is not. Set require_signatures or pin digests to close that gap.
+//
+// The "images" section lists who may sign the container images sandboxes
+// are created from, as cosign public keys or keyless signing identities:
+//
+//	"images": {
+//	  "require_signatures": true,
+//	  "keys": ["/etc/matchlock/cosign.pub"],
+//	  "identities": [{"issuer": "https://token.actions.githubusercontent.com",
+//	                  "subject_regexp": "^https://github.com/acme/"}]
+//	}
+package trust
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/storename"
+)
+
+// Asset names used as pin keys.
+const (
+	AssetKernel     = "kernel"
+	AssetInitramfs  = "initramfs"
+	AssetGuestAgent = "guest-agent"
+	AssetGuestFused = "guest-fused"
+)
+
+// SignatureSuffix is appended to an asset path to locate its signature.
+const SignatureSuffix = ".sig"
+
+// releaseKey is the base64 ed25519 public key release assets are signed
+// with. It is set at build time:
+//
+//	-ldflags "-X github.com/jingkaihe/matchlock/pkg/trust.releaseKey=..."
+var releaseKey = ""
+
+// Policy decides whether an asset may be used.
+type Policy struct {
+	// Keys are additional base64 ed25519 public keys trusted to sign assets.
+	Keys []string `json:"keys,omitempty"`
+	// RequireSignatures rejects assets that have no signature file.
+	RequireSignatures bool `json:"require_signatures,omitempty"`
+	// Pins maps asset names to the only digest ("sha256:<hex>") accepted.
+	Pins map[string]string `json:"pins,omitempty"`
+	// Images decides which container images may be used.
+	Images ImagePolicy `json:"images,omitempty"`
+
+	keys []ed25519.PublicKey
+}
+
+// ImagePolicy lists the signers trusted for container images pulled from
+// registries. Images built or imported on this host are not signed and are
+// not checked.
+type ImagePolicy struct {
+	// RequireSignatures verifies every image, as if --verify-signature were
+	// always given.
+	RequireSignatures bool `json:"require_signatures,omitempty"`
+	// Keys are PEM public keys, inline or as paths such as cosign.pub.
+	Keys []string `json:"keys,omitempty"`
+	// Identities are trusted keyless signers, checked with the cosign CLI.
+	Identities []ImageIdentity `json:"identities,omitempty"`
+}
+
+// ImageIdentity is a keyless signer: the OIDC issuer of its Fulcio
+// certificate, and its subject as an exact value or a regular expression.
+type ImageIdentity struct {
+	Issuer        string `json:"issuer"`
+	Subject       string `json:"subject,omitempty"`
+	SubjectRegexp string `json:"subject_regexp,omitempty"`
+}
+
+// DefaultPolicyPath returns $MATCHLOCK_TRUST_POLICY, or
+// ~/.config/matchlock/trust.json.
+func DefaultPolicyPath() string {
+	if p := os.Getenv("MATCHLOCK_TRUST_POLICY"); p != "" {
+		return p
+	}
+	return storename.ConfigPath("trust.json")
+}
+
+// LoadDefaultPolicy loads the policy at DefaultPolicyPath.
+func LoadDefaultPolicy() (*Policy, error) {
+	return LoadPolicy(DefaultPolicyPath())
+}
+
+// LoadPolicy reads a policy file. A missing file yields the default policy,
+// which trusts only the release key and does not require signatures.
+func LoadPolicy(path string) (*Policy, error) {
+	p := &Policy{}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errx.Wrap(ErrReadPolicy, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, errx.With(ErrParsePolicy, " %s: %w", path, err)
+		}
+	}
+	if err := p.init(); err != nil {
+		return nil, errx.With(err, " in %s", path)
+	}
+	return p, nil
+}
+
+func (p *Policy) init() error {
+	p.keys = nil
+	keys := p.Keys
+	if releaseKey != "" {
+		keys = append([]string{releaseKey}, keys...)
+	}
+	for _, k := range keys {
+		pub, err := ParsePublicKey(k)
+		if err != nil {
+			return err
+		}
+		p.keys = append(p.keys, pub)
+	}
+	if p.RequireSignatures && len(p.keys) == 0 {
+		return errx.With(ErrInvalidKey, ": require_signatures is set but no keys are trusted")
+	}
+	for name, pin := range p.Pins {
+		if _, err := parseDigest(pin); err != nil {
+			return errx.With(err, " for %s", name)
+		}
+	}
+	return p.Images.validate()
+}
+
+// HasSigners reports whether any key or identity is trusted.
+func (p *ImagePolicy) HasSigners() bool {
+	return len(p.Keys) > 0 || len(p.Identities) > 0
+}
+
+// PublicKeys parses Keys.
+func (p *ImagePolicy) PublicKeys() ([]crypto.PublicKey, error) {
+	keys := make([]crypto.PublicKey, 0, len(p.Keys))
+	for _, k := range p.Keys {
+		data := []byte(k)
+		if !strings.Contains(k, "-----BEGIN") {
+			var err error
+			if data, err = os.ReadFile(k); err != nil {
+				return nil, errx.With(ErrInvalidKey, ": image key: %w", err)
+			}
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errx.With(ErrInvalidKey, ": image key is not PEM encoded")
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errx.With(ErrInvalidKey, ": image key: %w", err)
+		}
+		keys = append(keys, pub)
+	}
+	return keys, nil
+}
+
+func (p *ImagePolicy) validate() error {
+	if p.RequireSignatures && !p.HasSigners() {
+		return errx.With(ErrInvalidKey, ": images.require_signatures is set but no keys or identities are trusted")
+	}
+	if _, err := p.PublicKeys(); err != nil {
+		return err
+	}
+	for _, id := range p.Identities {
+		if id.Issuer == "" || (id.Subject == "") == (id.SubjectRegexp == "") {
+			return errx.With(ErrInvalidIdentity, ": %+v needs an issuer and one of subject or subject_regexp", id)
+		}
+		if id.SubjectRegexp != "" {
+			if _, err := regexp.Compile(id.SubjectRegexp); err != nil {
+				return errx.With(ErrInvalidIdentity, ": %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Verify checks the asset at path against its pin and signature.
+func (p *Policy) Verify(name, path string) error {
+	digest, err := Digest(path)
+	if err != nil {
+		return err
+	}
+
+	if pin, ok := p.Pins[name]; ok && !strings.EqualFold(pin, digest) {
+		return errx.With(ErrDigestMismatch, " %s (%s): got %s, pinned %s", name, path, digest, pin)
+	}
+
+	sig, err := readSignature(path + SignatureSuffix)
+	if os.IsNotExist(err) {
+		if p.RequireSignatures {
+			return errx.With(ErrMissingSignature, " %s: %s", name, path+SignatureSuffix)
+		}
+		return nil
+	}
+	if err != nil {
+		return errx.With(ErrBadSignature, " %s: %w", name, err)
+	}
+	if len(p.keys) == 0 {
+		return nil
+	}
+
+	sum, _ := parseDigest(digest)
+	for _, key := range p.keys {
+		if ed25519.Verify(key, sum, sig) {
+			return nil
+		}
+	}
+	return errx.With(ErrBadSignature, " %s (%s)", name, path)
+}
+
+// Digest returns the "sha256:<hex>" digest of the file at path.
+func Digest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errx.Wrap(ErrHashAsset, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errx.Wrap(ErrHashAsset, err)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Sign writes the signature for the asset at path to path+SignatureSuffix.
+func Sign(key ed25519.PrivateKey, path string) error {
+	digest, err := Digest(path)
+	if err != nil {
+		return err
+	}
+	sum, _ := parseDigest(digest)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, sum))
+	if err := os.WriteFile(path+SignatureSuffix, []byte(sig+"\n"), 0644); err != nil {
+		return errx.Wrap(ErrWriteSignature, err)
+	}
+	return nil
+}
+
+// GenerateKey returns a new base64-encoded ed25519 key pair.
+func GenerateKey() (public, private string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(priv), nil
+}
+
+// ParsePublicKey decodes a base64 ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, errx.With(ErrInvalidKey, ": expected base64 ed25519 public key")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// ParsePrivateKey decodes a base64 ed25519 private key.
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != ed25519.PrivateKeySize {
+		return nil, errx.With(ErrInvalidKey, ": expected base64 ed25519 private key")
+	}
+	return ed25519.PrivateKey(b), nil
+}
+
+func readSignature(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+}
+
+func parseDigest(digest string) ([]byte, error) {
+	hexSum, ok := strings.CutPrefix(strings.ToLower(digest), "sha256:")
+	if !ok {
+		return nil, errx.With(ErrInvalidPin, ": %q must start with sha256:", digest)
+	}
+	sum, err := hex.DecodeString(hexSum)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errx.With(ErrInvalidPin, ": %q is not a sha256 digest", digest)
+	}
+	return sum, nil
+}
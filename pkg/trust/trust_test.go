@@ -0,0 +1,148 @@
+package trust
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeAsset(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kernel")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func signedPolicy(t *testing.T, path string) *Policy {
+	t.Helper()
+	pub, priv, err := GenerateKey()
+	require.NoError(t, err)
+	key, err := ParsePrivateKey(priv)
+	require.NoError(t, err)
+	require.NoError(t, Sign(key, path))
+
+	p := &Policy{Keys: []string{pub}}
+	require.NoError(t, p.init())
+	return p
+}
+
+func TestVerifySignature(t *testing.T) {
+	path := writeAsset(t, "vmlinux")
+	p := signedPolicy(t, path)
+
+	require.NoError(t, p.Verify(AssetKernel, path))
+
+	require.NoError(t, os.WriteFile(path, []byte("tampered"), 0644))
+	assert.ErrorIs(t, p.Verify(AssetKernel, path), ErrBadSignature)
+}
+
+func TestVerifyUntrustedKey(t *testing.T) {
+	path := writeAsset(t, "vmlinux")
+	signedPolicy(t, path)
+
+	other, _, err := GenerateKey()
+	require.NoError(t, err)
+	p := &Policy{Keys: []string{other}}
+	require.NoError(t, p.init())
+	assert.ErrorIs(t, p.Verify(AssetKernel, path), ErrBadSignature)
+}
+
+func TestVerifyRequireSignatures(t *testing.T) {
+	path := writeAsset(t, "vmlinux")
+	pub, _, err := GenerateKey()
+	require.NoError(t, err)
+
+	lenient := &Policy{Keys: []string{pub}}
+	require.NoError(t, lenient.init())
+	assert.NoError(t, lenient.Verify(AssetKernel, path))
+
+	strict := &Policy{Keys: []string{pub}, RequireSignatures: true}
+	require.NoError(t, strict.init())
+	assert.ErrorIs(t, strict.Verify(AssetKernel, path), ErrMissingSignature)
+}
+
+func TestVerifyPin(t *testing.T) {
+	path := writeAsset(t, "vmlinux")
+	digest, err := Digest(path)
+	require.NoError(t, err)
+
+	p := &Policy{Pins: map[string]string{AssetKernel: digest}}
+	require.NoError(t, p.init())
+	require.NoError(t, p.Verify(AssetKernel, path))
+	require.NoError(t, p.Verify(AssetGuestAgent, writeAsset(t, "unpinned")))
+
+	require.NoError(t, os.WriteFile(path, []byte("tampered"), 0644))
+	assert.ErrorIs(t, p.Verify(AssetKernel, path), ErrDigestMismatch)
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := LoadPolicy(filepath.Join(dir, "missing.json"))
+	require.NoError(t, err)
+	assert.False(t, p.RequireSignatures)
+
+	pub, _, err := GenerateKey()
+	require.NoError(t, err)
+	path := filepath.Join(dir, "trust.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"keys":["`+pub+`"],"require_signatures":true}`), 0644))
+	p, err = LoadPolicy(path)
+	require.NoError(t, err)
+	assert.True(t, p.RequireSignatures)
+	assert.Len(t, p.keys, 1)
+
+	for content, want := range map[string]error{
+		`not json`:                                   ErrParsePolicy,
+		`{"keys":["short"]}`:                         ErrInvalidKey,
+		`{"require_signatures":true}`:                ErrInvalidKey,
+		`{"pins":{"kernel":"md5:abc"}}`:              ErrInvalidPin,
+		`{"pins":{"kernel":"sha256:not-hex-value"}}`: ErrInvalidPin,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		_, err := LoadPolicy(path)
+		assert.ErrorIs(t, err, want, content)
+	}
+}
+
+func TestLoadPolicyImages(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(dir, "cosign.pub")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	path := filepath.Join(dir, "trust.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"images":{"require_signatures":true,"keys":["`+keyPath+`"],
+		"identities":[{"issuer":"https://token.actions.githubusercontent.com","subject_regexp":"^https://github.com/acme/"}]}}`), 0644))
+	p, err := LoadPolicy(path)
+	require.NoError(t, err)
+	assert.True(t, p.Images.RequireSignatures)
+	assert.True(t, p.Images.HasSigners())
+	keys, err := p.Images.PublicKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.True(t, key.PublicKey.Equal(keys[0]))
+
+	for content, want := range map[string]error{
+		`{"images":{"require_signatures":true}}`:                                        ErrInvalidKey,
+		`{"images":{"keys":["not a key"]}}`:                                             ErrInvalidKey,
+		`{"images":{"identities":[{"subject":"ci@example.com"}]}}`:                      ErrInvalidIdentity,
+		`{"images":{"identities":[{"issuer":"https://issuer"}]}}`:                       ErrInvalidIdentity,
+		`{"images":{"identities":[{"issuer":"i","subject":"s","subject_regexp":"s"}]}}`: ErrInvalidIdentity,
+		`{"images":{"identities":[{"issuer":"i","subject_regexp":"("}]}}`:               ErrInvalidIdentity,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		_, err := LoadPolicy(path)
+		assert.ErrorIs(t, err, want, content)
+	}
+}
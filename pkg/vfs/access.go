@@ -0,0 +1,229 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// AccessRules restrict the paths of a provider the guest may read and write,
+// by globs matched with MatchGlob against the path relative to the provider
+// root. A path is covered by a pattern if it or one of its parent
+// directories matches. It may be read (or written) if it is covered by an
+// allow pattern, when there are any, and by no deny pattern.
+type AccessRules struct {
+	AllowRead  []string
+	DenyRead   []string
+	AllowWrite []string
+	DenyWrite  []string
+}
+
+func (r AccessRules) canRead(p string) bool {
+	return permitted(p, r.AllowRead, r.DenyRead)
+}
+
+func (r AccessRules) canWrite(p string) bool {
+	return permitted(p, r.AllowWrite, r.DenyWrite)
+}
+
+func permitted(p string, allow, deny []string) bool {
+	if len(allow) > 0 && !covered(p, allow) {
+		return false
+	}
+	return !covered(p, deny)
+}
+
+func covered(p string, patterns []string) bool {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	for cur := p; cur != ""; {
+		for _, pattern := range patterns {
+			if MatchGlob(pattern, cur) {
+				return true
+			}
+		}
+		i := strings.LastIndex(cur, "/")
+		if i < 0 {
+			break
+		}
+		cur = cur[:i]
+	}
+	return false
+}
+
+// MatchGlob reports whether the slash-separated name matches pattern. Each
+// segment matches as in path.Match, "**" matches any number of segments, and
+// a pattern without "/" matches the last segment at any depth, so ".env"
+// means "**/.env". Leading and trailing slashes are ignored.
+func MatchGlob(pattern, name string) bool {
+	pattern = strings.Trim(pattern, "/")
+	name = strings.Trim(name, "/")
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	var names []string
+	if name != "" {
+		names = strings.Split(name, "/")
+	}
+	return matchSegments(strings.Split(pattern, "/"), names)
+}
+
+func matchSegments(pattern, names []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(pattern[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], names[0]); !ok {
+			return false
+		}
+		pattern, names = pattern[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// AccessProvider enforces AccessRules on an inner provider. Paths stay
+// visible to Stat and ReadDir; opening a file for a denied read or write,
+// and changing a denied path, fail with EACCES. Removing or renaming a
+// directory fails if anything under it may not be written.
+type AccessProvider struct {
+	inner Provider
+	rules AccessRules
+}
+
+func NewAccessProvider(inner Provider, rules AccessRules) *AccessProvider {
+	return &AccessProvider{inner: inner, rules: rules}
+}
+
+func (p *AccessProvider) Readonly() bool                          { return p.inner.Readonly() }
+func (p *AccessProvider) Stat(path string) (FileInfo, error)      { return p.inner.Stat(path) }
+func (p *AccessProvider) ReadDir(path string) ([]DirEntry, error) { return p.inner.ReadDir(path) }
+func (p *AccessProvider) Readlink(path string) (string, error)    { return p.inner.Readlink(path) }
+
+func (p *AccessProvider) Open(path string, flags int, mode os.FileMode) (Handle, error) {
+	write := flags&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	read := flags&os.O_WRONLY == 0
+	if write && !p.rules.canWrite(path) {
+		return nil, syscall.EACCES
+	}
+	if read && !p.rules.canRead(path) {
+		return nil, syscall.EACCES
+	}
+	return p.inner.Open(path, flags, mode)
+}
+
+func (p *AccessProvider) Create(path string, mode os.FileMode) (Handle, error) {
+	if !p.rules.canWrite(path) {
+		return nil, syscall.EACCES
+	}
+	return p.inner.Create(path, mode)
+}
+
+func (p *AccessProvider) Mkdir(path string, mode os.FileMode) error {
+	if !p.rules.canWrite(path) {
+		return syscall.EACCES
+	}
+	return p.inner.Mkdir(path, mode)
+}
+
+func (p *AccessProvider) Chmod(path string, mode os.FileMode) error {
+	if !p.rules.canWrite(path) {
+		return syscall.EACCES
+	}
+	return p.inner.Chmod(path, mode)
+}
+
+func (p *AccessProvider) chownHost(path string, uid, gid int) error {
+	if !p.rules.canWrite(path) {
+		return syscall.EACCES
+	}
+	return chownHost(p.inner, path, uid, gid)
+}
+
+func (p *AccessProvider) Remove(path string) error {
+	if !p.rules.canWrite(path) {
+		return syscall.EACCES
+	}
+	return p.inner.Remove(path)
+}
+
+func (p *AccessProvider) RemoveAll(path string) error {
+	if !p.treeWritable(path) {
+		return syscall.EACCES
+	}
+	return p.inner.RemoveAll(path)
+}
+
+func (p *AccessProvider) Rename(oldPath, newPath string) error {
+	if !p.treeWritable(oldPath) || !p.rules.canWrite(newPath) {
+		return syscall.EACCES
+	}
+	return p.inner.Rename(oldPath, newPath)
+}
+
+func (p *AccessProvider) Symlink(target, link string) error {
+	if !p.rules.canWrite(link) {
+		return syscall.EACCES
+	}
+	return p.inner.Symlink(target, link)
+}
+
+// Attributes are read as the file's contents are, and changed as they are
+// written.
+func (p *AccessProvider) Getxattr(path, name string) ([]byte, error) {
+	if !p.rules.canRead(path) {
+		return nil, syscall.EACCES
+	}
+	return Getxattr(p.inner, path, name)
+}
+
+func (p *AccessProvider) Setxattr(path, name string, value []byte, flags int) error {
+	if !p.rules.canWrite(path) {
+		return syscall.EACCES
+	}
+	return Setxattr(p.inner, path, name, value, flags)
+}
+
+func (p *AccessProvider) Listxattr(path string) ([]string, error) {
+	if !p.rules.canRead(path) {
+		return nil, syscall.EACCES
+	}
+	return Listxattr(p.inner, path)
+}
+
+func (p *AccessProvider) Removexattr(path, name string) error {
+	if !p.rules.canWrite(path) {
+		return syscall.EACCES
+	}
+	return Removexattr(p.inner, path, name)
+}
+
+// treeWritable reports whether dir and, for a directory, everything under it
+// may be written.
+func (p *AccessProvider) treeWritable(dir string) bool {
+	if !p.rules.canWrite(dir) {
+		return false
+	}
+	entries, err := p.inner.ReadDir(dir)
+	if err != nil {
+		return true
+	}
+	for _, e := range entries {
+		child := path.Join(dir, e.Name())
+		if e.IsDir() && e.Type()&os.ModeSymlink == 0 {
+			if !p.treeWritable(child) {
+				return false
+			}
+		} else if !p.rules.canWrite(child) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{".env", ".env", true},
+		{".env", "app/config/.env", true},
+		{"**/.env", "app/.env", true},
+		{"**/*.pem", "certs/server.pem", true},
+		{"**/*.pem", "server.pem", true},
+		{"*.pem", "certs/deep/server.pem", true},
+		{"certs/*.pem", "certs/deep/server.pem", false},
+		{"certs/**", "certs/deep/server.pem", true},
+		{"certs/**", "certs", true},
+		{"/src/*.go", "src/main.go", true},
+		{"src/*.go", "lib/src/main.go", false},
+		{".env", ".envrc", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, MatchGlob(tt.pattern, tt.name), "%s ~ %s", tt.pattern, tt.name)
+	}
+}
+
+func TestAccessProvider(t *testing.T) {
+	inner := NewMemoryProvider()
+	require.NoError(t, inner.MkdirAll("/app/secrets", 0755))
+	require.NoError(t, inner.WriteFile("/app/.env", []byte("KEY=1"), 0644))
+	require.NoError(t, inner.WriteFile("/app/main.go", []byte("package main"), 0644))
+	require.NoError(t, inner.WriteFile("/app/secrets/tls.pem", []byte("pem"), 0644))
+
+	p := NewAccessProvider(inner, AccessRules{
+		DenyRead:  []string{"**/.env"},
+		DenyWrite: []string{"**/*.pem"},
+	})
+
+	_, err := p.Open("/app/.env", os.O_RDONLY, 0)
+	assert.ErrorIs(t, err, syscall.EACCES)
+	_, err = p.Open("/app/.env", os.O_RDWR, 0)
+	assert.ErrorIs(t, err, syscall.EACCES)
+	// Denied files stay visible.
+	_, err = p.Stat("/app/.env")
+	assert.NoError(t, err)
+
+	h, err := p.Open("/app/secrets/tls.pem", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	h.Close()
+	_, err = p.Open("/app/secrets/tls.pem", os.O_WRONLY|os.O_TRUNC, 0)
+	assert.ErrorIs(t, err, syscall.EACCES)
+	_, err = p.Create("/app/new.pem", 0644)
+	assert.ErrorIs(t, err, syscall.EACCES)
+	assert.ErrorIs(t, p.Remove("/app/secrets/tls.pem"), syscall.EACCES)
+	assert.ErrorIs(t, p.Rename("/app/main.go", "/app/main.pem"), syscall.EACCES)
+
+	// Removing or moving the directory would take the protected file with it.
+	assert.ErrorIs(t, p.RemoveAll("/app/secrets"), syscall.EACCES)
+	assert.ErrorIs(t, p.Rename("/app/secrets", "/app/moved"), syscall.EACCES)
+
+	h, err = p.Open("/app/main.go", os.O_RDWR, 0)
+	require.NoError(t, err)
+	h.Close()
+	require.NoError(t, p.Rename("/app/main.go", "/app/cmd.go"))
+}
+
+func TestAccessProviderAllowList(t *testing.T) {
+	inner := NewMemoryProvider()
+	require.NoError(t, inner.MkdirAll("/src", 0755))
+	require.NoError(t, inner.WriteFile("/src/main.go", []byte("package main"), 0644))
+
+	p := NewAccessProvider(inner, AccessRules{AllowWrite: []string{"out"}})
+
+	require.NoError(t, p.Mkdir("/out", 0755))
+	h, err := p.Create("/out/report.txt", 0644)
+	require.NoError(t, err)
+	h.Close()
+
+	_, err = p.Create("/src/new.go", 0644)
+	assert.ErrorIs(t, err, syscall.EACCES)
+	h, err = p.Open("/src/main.go", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	h.Close()
+}
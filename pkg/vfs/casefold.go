@@ -0,0 +1,219 @@
+package vfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unicode"
+)
+
+// CaseMode is how a CaseProvider treats names that differ only in case.
+type CaseMode int
+
+const (
+	// CaseRejectCollisions fails creating a name that differs only in case
+	// from one already in its directory, which a case-insensitive host
+	// volume would silently merge into the existing file.
+	CaseRejectCollisions CaseMode = iota + 1
+	// CaseFold emulates a case-insensitive filesystem: each path element
+	// resolves to an existing name that matches it ignoring case, so the
+	// guest sees the same behaviour whatever the host volume does.
+	CaseFold
+)
+
+// CaseProvider applies a CaseMode to an inner provider. onCollision, if
+// set, is called with the name asked for and the existing name it
+// collides with whenever one is found.
+type CaseProvider struct {
+	inner       Provider
+	mode        CaseMode
+	onCollision func(name, existing string)
+}
+
+func NewCaseProvider(inner Provider, mode CaseMode, onCollision func(name, existing string)) *CaseProvider {
+	return &CaseProvider{inner: inner, mode: mode, onCollision: onCollision}
+}
+
+func (p *CaseProvider) Readonly() bool { return p.inner.Readonly() }
+
+func (p *CaseProvider) Stat(path string) (FileInfo, error) {
+	return p.inner.Stat(p.resolve(path))
+}
+
+func (p *CaseProvider) ReadDir(path string) ([]DirEntry, error) {
+	return p.inner.ReadDir(p.resolve(path))
+}
+
+func (p *CaseProvider) Readlink(path string) (string, error) {
+	return p.inner.Readlink(p.resolve(path))
+}
+
+func (p *CaseProvider) Open(path string, flags int, mode os.FileMode) (Handle, error) {
+	path = p.resolve(path)
+	if flags&os.O_CREATE != 0 {
+		if err := p.checkNew(path); err != nil {
+			return nil, err
+		}
+	}
+	return p.inner.Open(path, flags, mode)
+}
+
+func (p *CaseProvider) Create(path string, mode os.FileMode) (Handle, error) {
+	path = p.resolve(path)
+	if err := p.checkNew(path); err != nil {
+		return nil, err
+	}
+	return p.inner.Create(path, mode)
+}
+
+func (p *CaseProvider) Mkdir(path string, mode os.FileMode) error {
+	path = p.resolve(path)
+	if err := p.checkNew(path); err != nil {
+		return err
+	}
+	return p.inner.Mkdir(path, mode)
+}
+
+func (p *CaseProvider) Chmod(path string, mode os.FileMode) error {
+	return p.inner.Chmod(p.resolve(path), mode)
+}
+
+func (p *CaseProvider) chownHost(path string, uid, gid int) error {
+	return chownHost(p.inner, p.resolve(path), uid, gid)
+}
+
+func (p *CaseProvider) Remove(path string) error {
+	return p.inner.Remove(p.resolve(path))
+}
+
+func (p *CaseProvider) RemoveAll(path string) error {
+	return p.inner.RemoveAll(p.resolve(path))
+}
+
+func (p *CaseProvider) Rename(oldPath, newPath string) error {
+	oldPath = p.resolve(oldPath)
+	newPath = p.resolve(newPath)
+	// Renaming a file to another case of its own name is allowed.
+	if !strings.EqualFold(oldPath, newPath) {
+		if err := p.checkNew(newPath); err != nil {
+			return err
+		}
+	}
+	return p.inner.Rename(oldPath, newPath)
+}
+
+func (p *CaseProvider) Symlink(target, link string) error {
+	link = p.resolve(link)
+	if err := p.checkNew(link); err != nil {
+		return err
+	}
+	return p.inner.Symlink(target, link)
+}
+
+func (p *CaseProvider) Getxattr(path, name string) ([]byte, error) {
+	return Getxattr(p.inner, p.resolve(path), name)
+}
+
+func (p *CaseProvider) Setxattr(path, name string, value []byte, flags int) error {
+	return Setxattr(p.inner, p.resolve(path), name, value, flags)
+}
+
+func (p *CaseProvider) Listxattr(path string) ([]string, error) {
+	return Listxattr(p.inner, p.resolve(path))
+}
+
+func (p *CaseProvider) Removexattr(path, name string) error {
+	return Removexattr(p.inner, p.resolve(path), name)
+}
+
+// resolve maps each element of path to the existing name that matches it
+// ignoring case, under CaseFold. Elements with an exact match, or none at
+// all, are kept as given.
+func (p *CaseProvider) resolve(path string) string {
+	path = filepath.Clean("/" + path)
+	if p.mode != CaseFold || path == "/" {
+		return path
+	}
+	resolved := "/"
+	for _, elem := range strings.Split(path[1:], "/") {
+		if match, ok := p.foldMatch(resolved, elem); ok && match != elem {
+			elem = match
+		}
+		resolved = filepath.Join(resolved, elem)
+	}
+	return resolved
+}
+
+// checkNew fails, under CaseRejectCollisions, if path would be created
+// beside a name that differs from it only in case.
+func (p *CaseProvider) checkNew(path string) error {
+	if p.mode != CaseRejectCollisions {
+		return nil
+	}
+	dir, name := filepath.Split(path)
+	existing, ok := p.foldMatch(dir, name)
+	if !ok || existing == name {
+		return nil
+	}
+	if p.onCollision != nil {
+		p.onCollision(path, filepath.Join(dir, existing))
+	}
+	return syscall.EEXIST
+}
+
+// foldMatch returns the entry of dir that equals name ignoring case,
+// preferring an exact match. A name without letters can only match itself,
+// so dir is not listed for it.
+func (p *CaseProvider) foldMatch(dir, name string) (string, bool) {
+	if !hasCase(name) {
+		return name, false
+	}
+	entries, err := p.inner.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	match, found := "", false
+	for _, e := range entries {
+		if e.Name() == name {
+			return name, true
+		}
+		if !found && strings.EqualFold(e.Name(), name) {
+			match, found = e.Name(), true
+		}
+	}
+	return match, found
+}
+
+func hasCase(name string) bool {
+	for _, r := range name {
+		if unicode.IsUpper(r) || unicode.IsLower(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostCaseInsensitive reports whether the host directory dir is on a
+// case-insensitive volume, as macOS's default APFS is, by looking it up
+// under another case of its own name. It reports false when dir's name
+// has no letters to change.
+func HostCaseInsensitive(dir string) bool {
+	dir = filepath.Clean(dir)
+	parent, name := filepath.Split(dir)
+	swapped := strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, name)
+	if swapped == name {
+		return false
+	}
+	want, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	got, err := os.Stat(filepath.Join(parent, swapped))
+	return err == nil && os.SameFile(want, got)
+}
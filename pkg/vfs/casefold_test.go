@@ -0,0 +1,91 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaseProviderRejectCollisions(t *testing.T) {
+	inner := NewMemoryProvider()
+	require.NoError(t, inner.MkdirAll("/src", 0755))
+	require.NoError(t, inner.WriteFile("/src/Makefile", []byte("all:"), 0644))
+
+	var collisions [][2]string
+	p := NewCaseProvider(inner, CaseRejectCollisions, func(name, existing string) {
+		collisions = append(collisions, [2]string{name, existing})
+	})
+
+	_, err := p.Create("/src/makefile", 0644)
+	require.True(t, errors.Is(err, syscall.EEXIST))
+	require.True(t, errors.Is(p.Mkdir("/SRC", 0755), syscall.EEXIST))
+	require.True(t, errors.Is(p.Symlink("Makefile", "/src/MAKEFILE"), syscall.EEXIST))
+	_, err = p.Open("/src/MakeFile", os.O_CREATE|os.O_WRONLY, 0644)
+	require.True(t, errors.Is(err, syscall.EEXIST))
+	assert.Equal(t, [2]string{"/src/makefile", "/src/Makefile"}, collisions[0])
+	assert.Len(t, collisions, 4)
+
+	// Exact names and names without a case twin are fine.
+	h, err := p.Create("/src/Makefile", 0644)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+	h, err = p.Create("/src/main.go", 0644)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	// A rename may change only the case of a name.
+	require.NoError(t, p.Rename("/src/main.go", "/src/Main.go"))
+	require.True(t, errors.Is(p.Rename("/src/Main.go", "/src/makefile"), syscall.EEXIST))
+}
+
+func TestCaseProviderFold(t *testing.T) {
+	inner := NewMemoryProvider()
+	require.NoError(t, inner.MkdirAll("/Include", 0755))
+	require.NoError(t, inner.WriteFile("/Include/Config.h", []byte("#define X 1"), 0644))
+	p := NewCaseProvider(inner, CaseFold, nil)
+
+	info, err := p.Stat("/include/config.H")
+	require.NoError(t, err)
+	assert.Equal(t, "Config.h", info.Name())
+
+	// Writing another case of a name writes the existing file.
+	h, err := p.Create("/INCLUDE/CONFIG.H", 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("#define X 2"))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	entries, err := inner.ReadDir("/Include")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "Config.h", entries[0].Name())
+
+	h, err = p.Create("/include/new.h", 0644)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+	_, err = inner.Stat("/Include/new.h")
+	require.NoError(t, err)
+}
+
+func TestHostCaseInsensitive(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Repo")
+	require.NoError(t, os.Mkdir(dir, 0755))
+
+	// The answer depends on the volume; it must agree with a direct lookup.
+	want := false
+	if swapped, err := os.Stat(filepath.Join(filepath.Dir(dir), "rEPO")); err == nil {
+		orig, err := os.Stat(dir)
+		require.NoError(t, err)
+		want = os.SameFile(orig, swapped)
+	}
+	assert.Equal(t, want, HostCaseInsensitive(dir))
+
+	digits := filepath.Join(t.TempDir(), "123")
+	require.NoError(t, os.Mkdir(digits, 0755))
+	assert.False(t, HostCaseInsensitive(digits))
+}
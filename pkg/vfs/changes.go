@@ -0,0 +1,141 @@
+package vfs
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChangeManifestName is the tar entry in which WriteChanges lists what the
+// change set does. It is the first entry, so a consumer reading the stream
+// learns about deletions before it sees any files.
+const ChangeManifestName = ".matchlock-changes.json"
+
+// ChangeManifest lists the paths of a change set, relative to its root.
+// Created and Modified name the files carried in the change set; Deleted
+// names the paths to remove before extracting them. A directory that was
+// deleted and recreated appears in Deleted and is carried as well.
+type ChangeManifest struct {
+	Created  []string `json:"created"`
+	Modified []string `json:"modified"`
+	Deleted  []string `json:"deleted"`
+}
+
+// ChangeLayer is the upper layer of an overlay mounted at Path, relative to
+// the root of the change set. Lower, if set, tells created files from
+// modified ones; without it every file counts as created.
+type ChangeLayer struct {
+	Path  string
+	Upper Provider
+	Lower Provider
+}
+
+type changeEntry struct {
+	src   string
+	name  string
+	info  fs.FileInfo
+	layer *ChangeLayer
+}
+
+// WriteChanges writes the files the guest created or modified in each layer
+// to w as a tar stream, preceded by a ChangeManifestName entry, and returns
+// the manifest. Whiteouts are not carried; they become Deleted paths.
+func WriteChanges(w io.Writer, layers []ChangeLayer) (*ChangeManifest, error) {
+	manifest := &ChangeManifest{Created: []string{}, Modified: []string{}, Deleted: []string{}}
+	var entries []changeEntry
+	for i := range layers {
+		layer := &layers[i]
+		if err := collectChanges(layer, "/", manifest, &entries); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(manifest.Deleted)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     ChangeManifestName,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if err := writeTarEntry(tw, e.layer.Upper, e.src, e.name, e.info); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func collectChanges(layer *ChangeLayer, dir string, manifest *ChangeManifest, entries *[]changeEntry) error {
+	list, err := layer.Upper.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+
+	for _, e := range list {
+		src := path.Join(dir, e.Name())
+		if e.Name() == WhiteoutOpaque {
+			manifest.Deleted = append(manifest.Deleted, changeName(layer, dir))
+			continue
+		}
+		if name, ok := strings.CutPrefix(e.Name(), WhiteoutPrefix); ok {
+			manifest.Deleted = append(manifest.Deleted, changeName(layer, path.Join(dir, name)))
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		*entries = append(*entries, changeEntry{src: src, name: changeName(layer, src), info: info, layer: layer})
+		if e.IsDir() && e.Type()&fs.ModeSymlink == 0 {
+			if err := collectChanges(layer, src, manifest, entries); err != nil {
+				return err
+			}
+			continue
+		}
+		if layer.Lower != nil && existsBelow(layer, src) {
+			manifest.Modified = append(manifest.Modified, changeName(layer, src))
+		} else {
+			manifest.Created = append(manifest.Created, changeName(layer, src))
+		}
+	}
+	return nil
+}
+
+// existsBelow reports whether the lower layer shows src through the upper
+// layer's whiteouts, i.e. whether the upper copy replaced it.
+func existsBelow(layer *ChangeLayer, src string) bool {
+	if NewOverlayProvider(layer.Upper, layer.Lower).hidden(src) {
+		return false
+	}
+	_, err := layer.Lower.Stat(src)
+	return err == nil
+}
+
+func changeName(layer *ChangeLayer, p string) string {
+	name := strings.TrimPrefix(path.Join(layer.Path, p), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
@@ -0,0 +1,86 @@
+package vfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteChanges(t *testing.T) {
+	lower := NewMemoryProvider()
+	require.NoError(t, lower.MkdirAll("/src/old", 0755))
+	require.NoError(t, lower.WriteFile("/src/main.go", []byte("package main"), 0644))
+	require.NoError(t, lower.WriteFile("/src/old/a.txt", []byte("a"), 0644))
+	require.NoError(t, lower.WriteFile("/README", []byte("readme"), 0644))
+
+	upper := NewMemoryProvider()
+	overlay := NewOverlayProvider(upper, lower)
+
+	h, err := overlay.Open("/src/main.go", os.O_WRONLY|os.O_TRUNC, 0)
+	require.NoError(t, err)
+	require.NoError(t, h.Truncate(0))
+	_, err = h.Write([]byte("package main // edited"))
+	require.NoError(t, err)
+	h.Close()
+
+	h, err = overlay.Create("/results.json", 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("{}"))
+	require.NoError(t, err)
+	h.Close()
+
+	require.NoError(t, overlay.Remove("/README"))
+	require.NoError(t, overlay.RemoveAll("/src/old"))
+	require.NoError(t, overlay.Mkdir("/src/old", 0755))
+
+	var buf bytes.Buffer
+	manifest, err := WriteChanges(&buf, []ChangeLayer{{Path: "/", Upper: upper, Lower: lower}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"results.json"}, manifest.Created)
+	assert.Equal(t, []string{"src/main.go"}, manifest.Modified)
+	assert.Equal(t, []string{"README", "src/old"}, manifest.Deleted)
+
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, ChangeManifestName, hdr.Name)
+	var decoded ChangeManifest
+	require.NoError(t, json.NewDecoder(tr).Decode(&decoded))
+	assert.Equal(t, *manifest, decoded)
+
+	files := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(data)
+	}
+	assert.Equal(t, map[string]string{
+		"results.json": "{}",
+		"src/":         "",
+		"src/main.go":  "package main // edited",
+		"src/old/":     "",
+	}, files)
+}
+
+func TestWriteChangesPrefixesLayerPath(t *testing.T) {
+	upper := NewMemoryProvider()
+	require.NoError(t, upper.WriteFile("/out.csv", []byte("1,2"), 0644))
+	require.NoError(t, upper.WriteFile("/.wh.in.csv", nil, 0644))
+
+	var buf bytes.Buffer
+	manifest, err := WriteChanges(&buf, []ChangeLayer{{Path: "data", Upper: upper}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data/out.csv"}, manifest.Created)
+	assert.Equal(t, []string{"data/in.csv"}, manifest.Deleted)
+}
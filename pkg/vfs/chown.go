@@ -0,0 +1,45 @@
+package vfs
+
+import "syscall"
+
+// Chowner is implemented by providers whose files can change owner as the
+// guest sees it, such as IDMapProvider. The files of other providers are
+// all shown owned by root, which cannot change.
+type Chowner interface {
+	// Chown changes the owner of path to uid and gid, as the guest sees
+	// them; -1 leaves either unchanged.
+	Chown(path string, uid, gid int) error
+}
+
+// Chown changes the owner of path in p as the guest sees it. A provider
+// that is not a Chowner accepts only its fixed owner, root, and fails any
+// other with EPERM.
+func Chown(p Provider, path string, uid, gid int) error {
+	if c, ok := p.(Chowner); ok {
+		return c.Chown(path, uid, gid)
+	}
+	if _, err := p.Stat(path); err != nil {
+		return err
+	}
+	if uid > 0 || gid > 0 {
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// hostChowner is implemented by providers of host files, and by those
+// wrapping them, that change the owner of the files on the host. It takes
+// host ids, so only an IDMapProvider, which maps guest ids to them, calls
+// it.
+type hostChowner interface {
+	chownHost(path string, uid, gid int) error
+}
+
+// chownHost changes the host owner of path in p, failing with EPERM if p
+// has no host files.
+func chownHost(p Provider, path string, uid, gid int) error {
+	if c, ok := p.(hostChowner); ok {
+		return c.chownHost(path, uid, gid)
+	}
+	return syscall.EPERM
+}
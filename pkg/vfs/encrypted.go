@@ -0,0 +1,286 @@
+package vfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// encChunk is the size of the blocks file data is encrypted in. Each is
+// stored in a slot of the backing file holding its nonce, ciphertext and tag.
+const (
+	encChunk    = 64 << 10
+	encNonce    = 12
+	encSlotSize = encNonce + encChunk + 16
+)
+
+// EncryptedProvider is a scratch filesystem, a MemoryProvider whose file
+// data is kept in a host file encrypted with AES-256-GCM under a random key
+// held only in memory. The backing file is created in dir on first write and
+// unlinked at once, so neither the key nor the file outlives the process;
+// Close destroys both earlier. Names, modes and sizes stay in memory.
+type EncryptedProvider struct {
+	*MemoryProvider
+	store *encStore
+}
+
+// NewEncryptedProvider returns an empty EncryptedProvider keeping its data
+// in dir, or the system temporary directory if dir is empty.
+func NewEncryptedProvider(dir string) *EncryptedProvider {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	store := newEncStore(dir)
+	return &EncryptedProvider{MemoryProvider: newMemoryProvider(store), store: store}
+}
+
+// Close destroys the key and the backing file. Reads and writes of file data
+// fail with EIO afterwards.
+func (p *EncryptedProvider) Close() error {
+	return p.store.close()
+}
+
+// encData is the contents of a file of an EncryptedProvider: the slots of
+// its chunks, by chunk index. Missing chunks read as zeros.
+type encData struct {
+	store  *encStore
+	length int64
+	chunks map[int64]int64
+}
+
+func (d *encData) size() int64 { return d.length }
+
+func (d *encData) readAt(b []byte, off int64) (int, error) {
+	buf := make([]byte, encChunk)
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		idx, within := pos/encChunk, int(pos%encChunk)
+		if slot, ok := d.chunks[idx]; ok {
+			if err := d.store.read(slot, buf); err != nil {
+				return n, err
+			}
+		} else {
+			clear(buf)
+		}
+		n += copy(b[n:], buf[within:])
+	}
+	return n, nil
+}
+
+func (d *encData) writeAt(b []byte, off int64) (int, error) {
+	buf := make([]byte, encChunk)
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		idx, within := pos/encChunk, int(pos%encChunk)
+		step := min(len(b)-n, encChunk-within)
+		if err := d.writeChunk(idx, buf, within, b[n:n+step]); err != nil {
+			return n, err
+		}
+		n += step
+		if end := off + int64(n); end > d.length {
+			d.length = end
+		}
+	}
+	return n, nil
+}
+
+// writeChunk writes data at offset within chunk idx, reading the rest of the
+// chunk into buf first unless data covers all of it.
+func (d *encData) writeChunk(idx int64, buf []byte, within int, data []byte) error {
+	slot, ok := d.chunks[idx]
+	switch {
+	case !ok:
+		clear(buf)
+	case len(data) < encChunk:
+		if err := d.store.read(slot, buf); err != nil {
+			return err
+		}
+	}
+	copy(buf[within:], data)
+	if !ok {
+		var err error
+		if slot, err = d.store.alloc(); err != nil {
+			return err
+		}
+	}
+	if err := d.store.write(slot, buf); err != nil {
+		if !ok {
+			d.store.free(slot)
+		}
+		return err
+	}
+	d.chunks[idx] = slot
+	return nil
+}
+
+// truncate frees the chunks past size and zeroes the tail of the last one,
+// so growing the file again reads zeros there.
+func (d *encData) truncate(size int64) error {
+	if size < d.length {
+		keep := (size + encChunk - 1) / encChunk
+		for idx, slot := range d.chunks {
+			if idx >= keep {
+				d.store.free(slot)
+				delete(d.chunks, idx)
+			}
+		}
+		if within := int(size % encChunk); within != 0 {
+			if _, ok := d.chunks[size/encChunk]; ok {
+				if err := d.writeChunk(size/encChunk, make([]byte, encChunk), within, make([]byte, encChunk-within)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	d.length = size
+	return nil
+}
+
+// encStore is the encrypted backing file of an EncryptedProvider, divided
+// into slots of one chunk each. It is the provider's dataStore.
+type encStore struct {
+	dir string
+
+	mu     sync.Mutex
+	aead   cipher.AEAD
+	file   *os.File
+	nonce  uint64 // counter; a nonce is never reused under the key
+	slots  int64
+	freed  []int64
+	closed bool
+}
+
+func newEncStore(dir string) *encStore {
+	key := make([]byte, 32)
+	rand.Read(key)
+	block, err := aes.NewCipher(key)
+	clear(key)
+	if err != nil {
+		panic(err) // a 32-byte key is always valid
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &encStore{dir: dir, aead: aead}
+}
+
+// alloc returns a free slot, creating the backing file on first use.
+func (s *encStore) alloc() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, syscall.EIO
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp(s.dir, ".matchlock-encrypted-*")
+		if err != nil {
+			return 0, err
+		}
+		// Only the open file keeps the data; nothing is left behind when
+		// the process exits, however it exits.
+		os.Remove(f.Name())
+		s.file = f
+	}
+	if n := len(s.freed); n > 0 {
+		slot := s.freed[n-1]
+		s.freed = s.freed[:n-1]
+		return slot, nil
+	}
+	s.slots++
+	return s.slots - 1, nil
+}
+
+func (s *encStore) free(slot int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.freed = append(s.freed, slot)
+	}
+}
+
+func (s *encStore) newData() fileData {
+	return &encData{store: s, chunks: make(map[int64]int64)}
+}
+
+// usage returns the bytes of the backing file holding file data.
+func (s *encStore) usage() (used, limit int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return (s.slots - int64(len(s.freed))) * encChunk, 0
+}
+
+// begin returns the AEAD and backing file for a read or write of a slot,
+// with a fresh nonce for a write.
+func (s *encStore) begin(write bool) (cipher.AEAD, *os.File, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.file == nil {
+		return nil, nil, nil, syscall.EIO
+	}
+	var nonce []byte
+	if write {
+		s.nonce++
+		nonce = make([]byte, encNonce)
+		binary.BigEndian.PutUint64(nonce[encNonce-8:], s.nonce)
+	}
+	return s.aead, s.file, nonce, nil
+}
+
+// write encrypts a chunk into slot. The slot number is authenticated with
+// it, so a chunk cannot be moved to another slot unnoticed.
+func (s *encStore) write(slot int64, chunk []byte) error {
+	aead, f, nonce, err := s.begin(true)
+	if err != nil {
+		return err
+	}
+	out := make([]byte, encNonce, encSlotSize)
+	copy(out, nonce)
+	out = aead.Seal(out, nonce, chunk, slotAD(slot))
+	if _, err := f.WriteAt(out, slot*encSlotSize); err != nil {
+		return err
+	}
+	return nil
+}
+
+// read decrypts slot into chunk.
+func (s *encStore) read(slot int64, chunk []byte) error {
+	aead, f, _, err := s.begin(false)
+	if err != nil {
+		return err
+	}
+	in := make([]byte, encSlotSize)
+	if _, err := f.ReadAt(in, slot*encSlotSize); err != nil {
+		return syscall.EIO
+	}
+	if _, err := aead.Open(chunk[:0], in[:encNonce], in[encNonce:], slotAD(slot)); err != nil {
+		return syscall.EIO
+	}
+	return nil
+}
+
+func (s *encStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.aead = nil
+	s.freed = nil
+	if s.file == nil {
+		return nil
+	}
+	s.file.Truncate(0)
+	return s.file.Close()
+}
+
+func slotAD(slot int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(slot))
+}
@@ -0,0 +1,156 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAllAt(t *testing.T, p Provider, path string) []byte {
+	t.Helper()
+	h, err := p.Open(path, os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer h.Close()
+	data, err := io.ReadAll(h)
+	require.NoError(t, err)
+	return data
+}
+
+func TestEncryptedProvider_ReadWriteAcrossChunks(t *testing.T) {
+	ep := NewEncryptedProvider(t.TempDir())
+	defer ep.Close()
+
+	require.NoError(t, ep.Mkdir("/out", 0755))
+	h, err := ep.Create("/out/data.bin", 0600)
+	require.NoError(t, err)
+	head := bytes.Repeat([]byte("a"), encChunk+10)
+	_, err = h.Write(head)
+	require.NoError(t, err)
+	// A write past the end leaves a hole that reads as zeros.
+	_, err = h.WriteAt([]byte("tail"), 3*encChunk)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	want := make([]byte, 3*encChunk+4)
+	copy(want, head)
+	copy(want[3*encChunk:], "tail")
+	assert.Equal(t, want, readAllAt(t, ep, "/out/data.bin"))
+
+	info, err := ep.Stat("/out/data.bin")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(want)), info.Size())
+	used, _ := ep.Usage()
+	assert.Equal(t, int64(3*encChunk), used, "holes take no space")
+}
+
+func TestEncryptedProvider_NothingReadableOnHost(t *testing.T) {
+	dir := t.TempDir()
+	ep := NewEncryptedProvider(dir)
+
+	h, err := ep.Create("/secret.txt", 0600)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("hunter2 hunter2 hunter2"))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "the backing file is unlinked as soon as it is created")
+
+	data, err := io.ReadAll(io.NewSectionReader(ep.store.file, 0, encSlotSize))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter2")
+
+	require.NoError(t, ep.Close())
+	h, err = ep.Open("/secret.txt", os.O_RDONLY, 0)
+	require.NoError(t, err, "names stay, data does not")
+	_, err = h.Read(make([]byte, 8))
+	assert.ErrorIs(t, err, syscall.EIO)
+}
+
+func TestEncryptedProvider_TamperedChunkFailsToRead(t *testing.T) {
+	ep := NewEncryptedProvider(t.TempDir())
+	defer ep.Close()
+	h, err := ep.Create("/f", 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	_, err = ep.store.file.WriteAt([]byte{0xff}, encNonce)
+	require.NoError(t, err)
+	h, err = ep.Open("/f", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer h.Close()
+	_, err = h.Read(make([]byte, 4))
+	assert.ErrorIs(t, err, syscall.EIO)
+}
+
+func TestEncryptedProvider_TruncateZeroesTail(t *testing.T) {
+	ep := NewEncryptedProvider(t.TempDir())
+	defer ep.Close()
+
+	h, err := ep.Create("/f", 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	require.NoError(t, h.Truncate(4))
+	require.NoError(t, h.Truncate(8))
+	require.NoError(t, h.Close())
+
+	assert.Equal(t, []byte("0123\x00\x00\x00\x00"), readAllAt(t, ep, "/f"))
+}
+
+func TestEncryptedProvider_RemovedFileStaysReadableWhileOpen(t *testing.T) {
+	ep := NewEncryptedProvider(t.TempDir())
+	defer ep.Close()
+
+	h, err := ep.Create("/old", 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("old contents"))
+	require.NoError(t, err)
+	require.NoError(t, ep.Remove("/old"))
+
+	// A new file must not be given the removed file's slots while it is open.
+	n, err := ep.Create("/new", 0644)
+	require.NoError(t, err)
+	_, err = n.Write([]byte("new contents"))
+	require.NoError(t, err)
+	require.NoError(t, n.Close())
+
+	got := make([]byte, 12)
+	_, err = h.ReadAt(got, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "old contents", string(got))
+	require.NoError(t, h.Close())
+
+	used, _ := ep.Usage()
+	assert.Equal(t, int64(encChunk), used)
+}
+
+func TestEncryptedProvider_RenameDirectory(t *testing.T) {
+	ep := NewEncryptedProvider(t.TempDir())
+	defer ep.Close()
+
+	require.NoError(t, ep.Mkdir("/a", 0755))
+	require.NoError(t, ep.Mkdir("/a/b", 0700))
+	h, err := ep.Create("/a/b/f", 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("x"))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	require.NoError(t, ep.Rename("/a", "/c"))
+	assert.Equal(t, []byte("x"), readAllAt(t, ep, "/c/b/f"))
+	info, err := ep.Stat("/c/b")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	_, err = ep.Stat("/a")
+	assert.ErrorIs(t, err, syscall.ENOENT)
+	assert.ErrorIs(t, ep.Remove("/c"), syscall.ENOTEMPTY)
+}
@@ -0,0 +1,10 @@
+package vfs
+
+import "errors"
+
+// Sentinel errors for the vfs package.
+var (
+	ErrTarEntry    = errors.New("tar entry outside the destination")
+	ErrMountExists = errors.New("path is already mounted")
+	ErrNotMounted  = errors.New("path is not mounted")
+)
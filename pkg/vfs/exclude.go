@@ -0,0 +1,227 @@
+package vfs
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// IgnoreFileName is the file at the root of a host directory listing the
+// paths its mounts hide from the guest.
+const IgnoreFileName = ".matchlockignore"
+
+// ReadIgnoreFile returns the patterns of the IgnoreFileName in dir, one per
+// line with blank lines and # comments skipped, or none if there is no such
+// file. Patterns use the MatchGlob syntax.
+func ReadIgnoreFile(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// ExcludeProvider hides the paths of an inner provider covered by glob
+// patterns, matched as AccessRules patterns are, as if they did not exist:
+// they are left out of listings and fail lookups with ENOENT. Creating one
+// fails with EACCES, so the guest cannot overwrite a file it cannot see,
+// and removing a directory keeps the hidden entries in it.
+type ExcludeProvider struct {
+	inner    Provider
+	patterns []string
+}
+
+func NewExcludeProvider(inner Provider, patterns []string) *ExcludeProvider {
+	return &ExcludeProvider{inner: inner, patterns: patterns}
+}
+
+func (p *ExcludeProvider) hidden(path string) bool {
+	return covered(path, p.patterns)
+}
+
+func (p *ExcludeProvider) Readonly() bool { return p.inner.Readonly() }
+
+func (p *ExcludeProvider) Stat(path string) (FileInfo, error) {
+	if p.hidden(path) {
+		return FileInfo{}, syscall.ENOENT
+	}
+	return p.inner.Stat(path)
+}
+
+func (p *ExcludeProvider) ReadDir(dir string) ([]DirEntry, error) {
+	if p.hidden(dir) {
+		return nil, syscall.ENOENT
+	}
+	entries, err := p.inner.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]DirEntry, 0, len(entries))
+	for _, e := range entries {
+		if !p.hidden(path.Join(dir, e.Name())) {
+			visible = append(visible, e)
+		}
+	}
+	return visible, nil
+}
+
+func (p *ExcludeProvider) Open(path string, flags int, mode os.FileMode) (Handle, error) {
+	if p.hidden(path) {
+		if flags&os.O_CREATE != 0 {
+			return nil, syscall.EACCES
+		}
+		return nil, syscall.ENOENT
+	}
+	return p.inner.Open(path, flags, mode)
+}
+
+func (p *ExcludeProvider) Create(path string, mode os.FileMode) (Handle, error) {
+	if p.hidden(path) {
+		return nil, syscall.EACCES
+	}
+	return p.inner.Create(path, mode)
+}
+
+func (p *ExcludeProvider) Mkdir(path string, mode os.FileMode) error {
+	if p.hidden(path) {
+		return syscall.EACCES
+	}
+	return p.inner.Mkdir(path, mode)
+}
+
+func (p *ExcludeProvider) Chmod(path string, mode os.FileMode) error {
+	if p.hidden(path) {
+		return syscall.ENOENT
+	}
+	return p.inner.Chmod(path, mode)
+}
+
+func (p *ExcludeProvider) chownHost(path string, uid, gid int) error {
+	if p.hidden(path) {
+		return syscall.ENOENT
+	}
+	return chownHost(p.inner, path, uid, gid)
+}
+
+func (p *ExcludeProvider) Remove(path string) error {
+	if p.hidden(path) {
+		return syscall.ENOENT
+	}
+	return p.inner.Remove(path)
+}
+
+// RemoveAll removes the visible tree at dir. A directory holding hidden
+// entries is emptied of the rest and kept.
+func (p *ExcludeProvider) RemoveAll(dir string) error {
+	if p.hidden(dir) {
+		return nil
+	}
+	// A symlink is removed, not followed.
+	if _, err := p.inner.Readlink(dir); err == nil {
+		return p.inner.Remove(dir)
+	}
+	info, err := p.inner.Stat(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return p.inner.Remove(dir)
+	}
+	return p.removeTree(dir)
+}
+
+func (p *ExcludeProvider) removeTree(dir string) error {
+	entries, err := p.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		child := path.Join(dir, e.Name())
+		if e.IsDir() && e.Type()&os.ModeSymlink == 0 {
+			err = p.removeTree(child)
+		} else {
+			err = p.inner.Remove(child)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := p.inner.Remove(dir); err != nil && !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+	return nil
+}
+
+func (p *ExcludeProvider) Rename(oldPath, newPath string) error {
+	if p.hidden(oldPath) {
+		return syscall.ENOENT
+	}
+	if p.hidden(newPath) {
+		return syscall.EACCES
+	}
+	return p.inner.Rename(oldPath, newPath)
+}
+
+func (p *ExcludeProvider) Symlink(target, link string) error {
+	if p.hidden(link) {
+		return syscall.EACCES
+	}
+	return p.inner.Symlink(target, link)
+}
+
+func (p *ExcludeProvider) Readlink(path string) (string, error) {
+	if p.hidden(path) {
+		return "", syscall.ENOENT
+	}
+	return p.inner.Readlink(path)
+}
+
+func (p *ExcludeProvider) Getxattr(path, name string) ([]byte, error) {
+	if p.hidden(path) {
+		return nil, syscall.ENOENT
+	}
+	return Getxattr(p.inner, path, name)
+}
+
+func (p *ExcludeProvider) Setxattr(path, name string, value []byte, flags int) error {
+	if p.hidden(path) {
+		return syscall.ENOENT
+	}
+	return Setxattr(p.inner, path, name, value, flags)
+}
+
+func (p *ExcludeProvider) Listxattr(path string) ([]string, error) {
+	if p.hidden(path) {
+		return nil, syscall.ENOENT
+	}
+	return Listxattr(p.inner, path)
+}
+
+func (p *ExcludeProvider) Removexattr(path, name string) error {
+	if p.hidden(path) {
+		return syscall.ENOENT
+	}
+	return Removexattr(p.inner, path, name)
+}
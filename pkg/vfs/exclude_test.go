@@ -0,0 +1,73 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadIgnoreFile(t *testing.T) {
+	dir := t.TempDir()
+	patterns, err := ReadIgnoreFile(dir)
+	require.NoError(t, err)
+	assert.Nil(t, patterns)
+
+	content := "# dependencies\nnode_modules\n\n  .venv  \n**/*.pyc\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, IgnoreFileName), []byte(content), 0644))
+	patterns, err = ReadIgnoreFile(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"node_modules", ".venv", "**/*.pyc"}, patterns)
+}
+
+func TestExcludeProviderHidesPaths(t *testing.T) {
+	inner := NewMemoryProvider()
+	require.NoError(t, inner.MkdirAll("/node_modules/left-pad", 0755))
+	require.NoError(t, inner.WriteFile("/node_modules/left-pad/index.js", []byte("x"), 0644))
+	require.NoError(t, inner.WriteFile("/main.go", []byte("package main"), 0644))
+	p := NewExcludeProvider(inner, []string{"node_modules"})
+
+	_, err := p.Stat("/node_modules")
+	require.True(t, errors.Is(err, syscall.ENOENT))
+	_, err = p.Stat("/node_modules/left-pad/index.js")
+	require.True(t, errors.Is(err, syscall.ENOENT))
+	_, err = p.Open("/node_modules/left-pad/index.js", os.O_RDONLY, 0)
+	require.True(t, errors.Is(err, syscall.ENOENT))
+
+	entries, err := p.ReadDir("/")
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{"main.go"}, names)
+
+	// The guest cannot put anything where a hidden path is.
+	_, err = p.Create("/node_modules/evil.js", 0644)
+	require.True(t, errors.Is(err, syscall.EACCES))
+	require.True(t, errors.Is(p.Mkdir("/node_modules/x", 0755), syscall.EACCES))
+	require.True(t, errors.Is(p.Rename("/main.go", "/node_modules/main.go"), syscall.EACCES))
+	require.True(t, errors.Is(p.Symlink("main.go", "/node_modules"), syscall.EACCES))
+}
+
+func TestExcludeProviderRemoveAllKeepsHiddenEntries(t *testing.T) {
+	inner := NewMemoryProvider()
+	require.NoError(t, inner.MkdirAll("/pkg/sub", 0755))
+	require.NoError(t, inner.WriteFile("/pkg/a.go", []byte("a"), 0644))
+	require.NoError(t, inner.WriteFile("/pkg/sub/b.go", []byte("b"), 0644))
+	require.NoError(t, inner.WriteFile("/pkg/secret.key", []byte("k"), 0600))
+	p := NewExcludeProvider(inner, []string{"*.key"})
+
+	require.NoError(t, p.RemoveAll("/pkg"))
+
+	_, err := inner.Stat("/pkg/secret.key")
+	require.NoError(t, err)
+	_, err = inner.Stat("/pkg/a.go")
+	require.True(t, errors.Is(err, syscall.ENOENT) || errors.Is(err, os.ErrNotExist))
+	_, err = inner.Stat("/pkg/sub")
+	require.True(t, errors.Is(err, syscall.ENOENT) || errors.Is(err, os.ErrNotExist))
+}
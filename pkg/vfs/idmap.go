@@ -0,0 +1,193 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// OverflowID is the owner shown for host files an IDMap does not cover, as
+// the kernel shows unmapped ids ("nobody").
+const OverflowID = 65534
+
+// IDMap maps the owner of host files to a guest owner. Files owned by
+// HostUID show as GuestUID, and files in group HostGID as GuestGID; any
+// other owner shows as OverflowID.
+type IDMap struct {
+	HostUID, HostGID   uint32
+	GuestUID, GuestGID uint32
+}
+
+// IDMapProvider shows the files of an inner provider with the owners an
+// IDMap gives their host owners. Files without host stat data, such as
+// those of a memory provider, show as owned by the guest owner. Ownership
+// is only presented: files the guest creates are owned on the host by the
+// user running matchlock.
+type IDMapProvider struct {
+	inner Provider
+	ids   IDMap
+}
+
+func NewIDMapProvider(inner Provider, ids IDMap) *IDMapProvider {
+	return &IDMapProvider{inner: inner, ids: ids}
+}
+
+// mapInfo returns info owned by the guest owner of its host owner.
+func (p *IDMapProvider) mapInfo(info FileInfo) FileInfo {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.WithOwner(p.ids.GuestUID, p.ids.GuestGID)
+	}
+	uid, gid := uint32(OverflowID), uint32(OverflowID)
+	if st.Uid == p.ids.HostUID {
+		uid = p.ids.GuestUID
+	}
+	if st.Gid == p.ids.HostGID {
+		gid = p.ids.GuestGID
+	}
+	return info.WithOwner(uid, gid)
+}
+
+func (p *IDMapProvider) Readonly() bool { return p.inner.Readonly() }
+
+func (p *IDMapProvider) Stat(path string) (FileInfo, error) {
+	info, err := p.inner.Stat(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return p.mapInfo(info), nil
+}
+
+func (p *IDMapProvider) ReadDir(path string) ([]DirEntry, error) {
+	entries, err := p.inner.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	mapped := make([]DirEntry, len(entries))
+	for i, e := range entries {
+		e.info = p.mapInfo(e.info)
+		mapped[i] = e
+	}
+	return mapped, nil
+}
+
+func (p *IDMapProvider) Open(path string, flags int, mode os.FileMode) (Handle, error) {
+	h, err := p.inner.Open(path, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &idmapHandle{Handle: h, p: p}, nil
+}
+
+func (p *IDMapProvider) Create(path string, mode os.FileMode) (Handle, error) {
+	h, err := p.inner.Create(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &idmapHandle{Handle: h, p: p}, nil
+}
+
+func (p *IDMapProvider) Mkdir(path string, mode os.FileMode) error {
+	return p.inner.Mkdir(path, mode)
+}
+
+func (p *IDMapProvider) Chmod(path string, mode os.FileMode) error {
+	return p.inner.Chmod(path, mode)
+}
+
+// Chown changes the host owner of path to the host owner of the guest uid
+// and gid. Only the guest owner has one: any other id fails with EINVAL,
+// as chown fails for an id with no mapping in a user namespace.
+func (p *IDMapProvider) Chown(path string, uid, gid int) error {
+	hostUID, hostGID := -1, -1
+	if uid >= 0 {
+		if uint32(uid) != p.ids.GuestUID {
+			return syscall.EINVAL
+		}
+		hostUID = int(p.ids.HostUID)
+	}
+	if gid >= 0 {
+		if uint32(gid) != p.ids.GuestGID {
+			return syscall.EINVAL
+		}
+		hostGID = int(p.ids.HostGID)
+	}
+	return chownHost(p.inner, path, hostUID, hostGID)
+}
+
+func (p *IDMapProvider) Remove(path string) error {
+	return p.inner.Remove(path)
+}
+
+func (p *IDMapProvider) RemoveAll(path string) error {
+	return p.inner.RemoveAll(path)
+}
+
+func (p *IDMapProvider) Rename(oldPath, newPath string) error {
+	return p.inner.Rename(oldPath, newPath)
+}
+
+func (p *IDMapProvider) Symlink(target, link string) error {
+	return p.inner.Symlink(target, link)
+}
+
+func (p *IDMapProvider) Readlink(path string) (string, error) {
+	return p.inner.Readlink(path)
+}
+
+// Getxattr shows the ids named in a POSIX ACL as the file's owner is shown.
+func (p *IDMapProvider) Getxattr(path, name string) ([]byte, error) {
+	value, err := Getxattr(p.inner, path, name)
+	if err != nil || !isACL(name) {
+		return value, err
+	}
+	return mapACL(value, func(uid uint32) (uint32, bool) {
+		if uid == p.ids.HostUID {
+			return p.ids.GuestUID, true
+		}
+		return OverflowID, true
+	}, func(gid uint32) (uint32, bool) {
+		if gid == p.ids.HostGID {
+			return p.ids.GuestGID, true
+		}
+		return OverflowID, true
+	})
+}
+
+// Setxattr stores a POSIX ACL with the host ids of the guest ids it names.
+// An ACL naming any other id fails with EINVAL, as the kernel fails one
+// naming an id with no mapping.
+func (p *IDMapProvider) Setxattr(path, name string, value []byte, flags int) error {
+	if isACL(name) {
+		var err error
+		value, err = mapACL(value, func(uid uint32) (uint32, bool) {
+			return p.ids.HostUID, uid == p.ids.GuestUID
+		}, func(gid uint32) (uint32, bool) {
+			return p.ids.HostGID, gid == p.ids.GuestGID
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return Setxattr(p.inner, path, name, value, flags)
+}
+
+func (p *IDMapProvider) Listxattr(path string) ([]string, error) {
+	return Listxattr(p.inner, path)
+}
+
+func (p *IDMapProvider) Removexattr(path, name string) error {
+	return Removexattr(p.inner, path, name)
+}
+
+type idmapHandle struct {
+	Handle
+	p *IDMapProvider
+}
+
+func (h *idmapHandle) Stat() (FileInfo, error) {
+	info, err := h.Handle.Stat()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return h.p.mapInfo(info), nil
+}
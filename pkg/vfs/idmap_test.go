@@ -0,0 +1,109 @@
+package vfs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDMapProviderMapsHostOwner(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main"), 0644))
+	host := uint32(os.Getuid())
+	hostGroup := uint32(os.Getgid())
+
+	p := NewIDMapProvider(NewRealFSProvider(dir), IDMap{HostUID: host, HostGID: hostGroup, GuestUID: 1000, GuestGID: 1001})
+	info, err := p.Stat("/main.go")
+	require.NoError(t, err)
+	uid, gid := info.Owner()
+	assert.Equal(t, uint32(1000), uid)
+	assert.Equal(t, uint32(1001), gid)
+
+	entries, err := p.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	entryInfo, err := entries[0].Info()
+	require.NoError(t, err)
+	uid, gid = entryInfo.(FileInfo).Owner()
+	assert.Equal(t, uint32(1000), uid)
+	assert.Equal(t, uint32(1001), gid)
+
+	h, err := p.Create("/new.txt", 0644)
+	require.NoError(t, err)
+	info, err = h.Stat()
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+	uid, _ = info.Owner()
+	assert.Equal(t, uint32(1000), uid)
+
+	// Files of other host users show as nobody.
+	other := NewIDMapProvider(NewRealFSProvider(dir), IDMap{HostUID: host + 1, HostGID: hostGroup + 1, GuestUID: 1000, GuestGID: 1000})
+	info, err = other.Stat("/main.go")
+	require.NoError(t, err)
+	uid, gid = info.Owner()
+	assert.Equal(t, uint32(OverflowID), uid)
+	assert.Equal(t, uint32(OverflowID), gid)
+}
+
+func TestIDMapProviderOwnsFilesWithoutHostOwner(t *testing.T) {
+	inner := NewMemoryProvider()
+	require.NoError(t, inner.WriteFile("/a.txt", []byte("a"), 0644))
+
+	unmapped, err := inner.Stat("/a.txt")
+	require.NoError(t, err)
+	uid, gid := unmapped.Owner()
+	assert.Zero(t, uid)
+	assert.Zero(t, gid)
+
+	info, err := NewIDMapProvider(inner, IDMap{GuestUID: 1000, GuestGID: 1000}).Stat("/a.txt")
+	require.NoError(t, err)
+	uid, gid = info.Owner()
+	assert.Equal(t, uint32(1000), uid)
+	assert.Equal(t, uint32(1000), gid)
+}
+
+func TestIDMapProviderChown(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main"), 0644))
+	hostUID, hostGID := os.Getuid(), os.Getgid()
+	if hostUID == 0 {
+		// Root can hand the file to another host owner first, so the
+		// chown is seen to take effect.
+		hostUID, hostGID = 4000, 4001
+	}
+
+	p := NewIDMapProvider(NewRealFSProvider(dir), IDMap{HostUID: uint32(hostUID), HostGID: uint32(hostGID), GuestUID: 1000, GuestGID: 1001})
+	require.NoError(t, Chown(p, "/main.go", 1000, 1001))
+	host, err := os.Stat(filepath.Join(dir, "main.go"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(hostUID), host.Sys().(*syscall.Stat_t).Uid, "the guest owner is stored as the host owner")
+	assert.Equal(t, uint32(hostGID), host.Sys().(*syscall.Stat_t).Gid)
+	info, err := p.Stat("/main.go")
+	require.NoError(t, err)
+	uid, gid := info.Owner()
+	assert.Equal(t, uint32(1000), uid)
+	assert.Equal(t, uint32(1001), gid)
+
+	assert.ErrorIs(t, Chown(p, "/main.go", 0, -1), syscall.EINVAL, "ids without a mapping are refused")
+	assert.ErrorIs(t, Chown(p, "/main.go", -1, 7), syscall.EINVAL)
+
+	ro := NewIDMapProvider(NewReadonlyProvider(NewRealFSProvider(dir)), IDMap{GuestUID: 1000, GuestGID: 1001})
+	assert.ErrorIs(t, Chown(ro, "/main.go", 1000, -1), syscall.EROFS)
+}
+
+func TestChownFixedOwner(t *testing.T) {
+	m := NewMemoryProvider()
+	require.NoError(t, m.WriteFile("/a.txt", []byte("a"), 0644))
+
+	assert.NoError(t, Chown(m, "/a.txt", 0, 0), "files without an idmap stay owned by root")
+	assert.NoError(t, Chown(m, "/a.txt", -1, -1))
+	assert.ErrorIs(t, Chown(m, "/a.txt", 1000, -1), syscall.EPERM)
+	assert.True(t, os.IsNotExist(Chown(m, "/missing", 0, 0)))
+
+	r := NewMountRouter(map[string]Provider{"/workspace": m})
+	assert.ErrorIs(t, r.Chown("/workspace/a.txt", -1, 1000), syscall.EPERM)
+}
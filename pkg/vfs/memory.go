@@ -1,7 +1,6 @@
 package vfs
 
 import (
-	"bytes"
 	"io"
 	"os"
 	"path/filepath"
@@ -11,30 +10,89 @@ import (
 	"time"
 )
 
+// MemoryProvider is a scratch filesystem whose names, modes and sizes live
+// in memory. Its file data is kept by a dataStore: in memory, or encrypted
+// in a host file for an EncryptedProvider.
 type MemoryProvider struct {
 	mu       sync.RWMutex
 	files    map[string]*memFile
 	dirs     map[string]bool
 	dirModes map[string]os.FileMode
+
+	store dataStore
+}
+
+// dataStore keeps the file data of a MemoryProvider.
+type dataStore interface {
+	// newData returns the contents of a new, empty file.
+	newData() fileData
+	// usage returns the bytes of file data held and the limit (0 if
+	// unbounded).
+	usage() (used, limit int64)
+}
+
+// fileData is the contents of one file. The file's lock is held around
+// every call.
+type fileData interface {
+	size() int64
+	// readAt fills b from off, which the caller keeps within the size.
+	readAt(b []byte, off int64) (int, error)
+	// writeAt writes b at off, growing the file as needed.
+	writeAt(b []byte, off int64) (int, error)
+	// truncate changes the size; growing the file reads as zeros.
+	truncate(size int64) error
 }
 
 type memFile struct {
 	mu      sync.RWMutex
-	data    []byte
+	data    fileData
 	mode    os.FileMode
 	modTime time.Time
+
+	// open counts the handles on the file. Its data is freed once it is
+	// removed and the last handle is closed, as an unlinked file's data
+	// stays readable through the handles open on it.
+	open    int
+	removed bool
 }
 
 func NewMemoryProvider() *MemoryProvider {
+	return newMemoryProvider(&memStore{})
+}
+
+// NewMemoryProviderWithLimit returns a MemoryProvider that holds at most
+// limit bytes of file data, like a size-bounded tmpfs.
+func NewMemoryProviderWithLimit(limit int64) *MemoryProvider {
+	return newMemoryProvider(&memStore{limit: limit})
+}
+
+func newMemoryProvider(store dataStore) *MemoryProvider {
 	return &MemoryProvider{
 		files:    make(map[string]*memFile),
 		dirs:     map[string]bool{"/": true},
 		dirModes: map[string]os.FileMode{"/": 0755},
+		store:    store,
 	}
 }
 
 func (p *MemoryProvider) Readonly() bool { return false }
 
+// Usage returns the bytes of file data held and the limit (0 if unbounded).
+func (p *MemoryProvider) Usage() (used, limit int64) {
+	return p.store.usage()
+}
+
+// release frees the data of f, which must no longer be reachable, once no
+// handle has it open.
+func (p *MemoryProvider) release(f *memFile) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removed = true
+	if f.open == 0 {
+		f.data.truncate(0)
+	}
+}
+
 func (p *MemoryProvider) normPath(path string) string {
 	path = filepath.Clean(path)
 	if !strings.HasPrefix(path, "/") {
@@ -63,7 +121,7 @@ func (p *MemoryProvider) Stat(path string) (FileInfo, error) {
 
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	return NewFileInfo(filepath.Base(path), int64(len(f.data)), f.mode, f.modTime, false), nil
+	return NewFileInfo(filepath.Base(path), f.data.size(), f.mode, f.modTime, false), nil
 }
 
 func (p *MemoryProvider) ReadDir(path string) ([]DirEntry, error) {
@@ -99,7 +157,7 @@ func (p *MemoryProvider) ReadDir(path string) ([]DirEntry, error) {
 			entries = append(entries, NewDirEntry(name, true, os.ModeDir|0755, NewFileInfo(name, 0, os.ModeDir|0755, time.Now(), true)))
 		} else {
 			f.mu.RLock()
-			info := NewFileInfo(name, int64(len(f.data)), f.mode, f.modTime, false)
+			info := NewFileInfo(name, f.data.size(), f.mode, f.modTime, false)
 			f.mu.RUnlock()
 			entries = append(entries, NewDirEntry(name, false, f.mode, info))
 		}
@@ -116,7 +174,11 @@ func (p *MemoryProvider) ReadDir(path string) ([]DirEntry, error) {
 			continue
 		}
 		seen[name] = true
-		entries = append(entries, NewDirEntry(name, true, os.ModeDir|0755, NewFileInfo(name, 0, os.ModeDir|0755, time.Now(), true)))
+		mode := p.dirModes[prefix+name]
+		if mode == 0 {
+			mode = 0755
+		}
+		entries = append(entries, NewDirEntry(name, true, os.ModeDir|mode, NewFileInfo(name, 0, os.ModeDir|mode, time.Now(), true)))
 	}
 
 	return entries, nil
@@ -125,35 +187,39 @@ func (p *MemoryProvider) ReadDir(path string) ([]DirEntry, error) {
 func (p *MemoryProvider) Open(path string, flags int, mode os.FileMode) (Handle, error) {
 	path = p.normPath(path)
 
-	if flags&os.O_CREATE != 0 {
-		p.mu.Lock()
-		if _, exists := p.files[path]; !exists {
-			dir := filepath.Dir(path)
-			if !p.dirs[dir] {
-				p.mu.Unlock()
-				return nil, syscall.ENOENT
-			}
-			p.files[path] = &memFile{
-				data:    []byte{},
-				mode:    mode,
-				modTime: time.Now(),
-			}
-		}
+	p.mu.Lock()
+	if p.dirs[path] && flags&(os.O_WRONLY|os.O_RDWR) != 0 {
 		p.mu.Unlock()
+		return nil, syscall.EISDIR
 	}
-
-	p.mu.RLock()
 	f, ok := p.files[path]
-	p.mu.RUnlock()
+	if !ok && flags&os.O_CREATE != 0 {
+		if !p.dirs[filepath.Dir(path)] {
+			p.mu.Unlock()
+			return nil, syscall.ENOENT
+		}
+		f = &memFile{data: p.store.newData(), mode: mode, modTime: time.Now()}
+		p.files[path] = f
+		ok = true
+	}
+	if ok {
+		f.mu.Lock()
+		f.open++
+		f.mu.Unlock()
+	}
+	p.mu.Unlock()
 	if !ok {
 		return nil, syscall.ENOENT
 	}
 
-	return &memHandle{
-		file:   f,
-		flags:  flags,
-		offset: 0,
-	}, nil
+	h := &memHandle{p: p, file: f, flags: flags}
+	if flags&os.O_TRUNC != 0 && flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := h.Truncate(0); err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
+	return h, nil
 }
 
 func (p *MemoryProvider) Create(path string, mode os.FileMode) (Handle, error) {
@@ -165,12 +231,10 @@ func (p *MemoryProvider) Mkdir(path string, mode os.FileMode) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	parent := filepath.Dir(path)
-	if !p.dirs[parent] {
+	if !p.dirs[filepath.Dir(path)] {
 		return syscall.ENOENT
 	}
-
-	if p.dirs[path] {
+	if p.dirs[path] || p.files[path] != nil {
 		return syscall.EEXIST
 	}
 
@@ -211,15 +275,22 @@ func (p *MemoryProvider) Remove(path string) error {
 				return syscall.ENOTEMPTY
 			}
 		}
+		for k := range p.dirs {
+			if strings.HasPrefix(k, path+"/") {
+				return syscall.ENOTEMPTY
+			}
+		}
 		delete(p.dirs, path)
 		delete(p.dirModes, path)
 		return nil
 	}
 
-	if _, ok := p.files[path]; !ok {
+	f, ok := p.files[path]
+	if !ok {
 		return syscall.ENOENT
 	}
 	delete(p.files, path)
+	p.release(f)
 	return nil
 }
 
@@ -233,14 +304,15 @@ func (p *MemoryProvider) RemoveAll(path string) error {
 		prefix += "/"
 	}
 
-	for k := range p.files {
+	for k, f := range p.files {
 		if k == path || strings.HasPrefix(k, prefix) {
 			delete(p.files, k)
+			p.release(f)
 		}
 	}
 
 	for k := range p.dirs {
-		if k == path || strings.HasPrefix(k, prefix) {
+		if k != "/" && (k == path || strings.HasPrefix(k, prefix)) {
 			delete(p.dirs, k)
 			delete(p.dirModes, k)
 		}
@@ -255,21 +327,39 @@ func (p *MemoryProvider) Rename(oldPath, newPath string) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	if !p.dirs[filepath.Dir(newPath)] {
+		return syscall.ENOENT
+	}
+
 	f, ok := p.files[oldPath]
 	if !ok {
 		if !p.dirs[oldPath] {
 			return syscall.ENOENT
 		}
-		mode := p.dirModes[oldPath]
-		delete(p.dirs, oldPath)
-		delete(p.dirModes, oldPath)
-		p.dirs[newPath] = true
-		if mode != 0 {
-			p.dirModes[newPath] = mode
+		// A directory moves with everything under it.
+		oldPrefix, newPrefix := oldPath+"/", newPath+"/"
+		for k, f := range p.files {
+			if strings.HasPrefix(k, oldPrefix) {
+				delete(p.files, k)
+				p.files[newPrefix+strings.TrimPrefix(k, oldPrefix)] = f
+			}
+		}
+		for k := range p.dirs {
+			if k == oldPath || strings.HasPrefix(k, oldPrefix) {
+				moved := newPath + strings.TrimPrefix(k, oldPath)
+				mode := p.dirModes[k]
+				delete(p.dirs, k)
+				delete(p.dirModes, k)
+				p.dirs[moved] = true
+				p.dirModes[moved] = mode
+			}
 		}
 		return nil
 	}
 
+	if old, ok := p.files[newPath]; ok && old != f {
+		p.release(old)
+	}
 	delete(p.files, oldPath)
 	p.files[newPath] = f
 	return nil
@@ -284,9 +374,11 @@ func (p *MemoryProvider) Readlink(path string) (string, error) {
 }
 
 type memHandle struct {
+	p      *MemoryProvider
 	file   *memFile
 	flags  int
 	offset int64
+	closed bool
 }
 
 func (h *memHandle) Read(p []byte) (int, error) {
@@ -299,11 +391,18 @@ func (h *memHandle) ReadAt(p []byte, off int64) (int, error) {
 	h.file.mu.RLock()
 	defer h.file.mu.RUnlock()
 
-	if off >= int64(len(h.file.data)) {
+	size := h.file.data.size()
+	if off >= size {
 		return 0, io.EOF
 	}
-
-	n := copy(p, h.file.data[off:])
+	want := p
+	if rest := size - off; int64(len(want)) > rest {
+		want = want[:rest]
+	}
+	n, err := h.file.data.readAt(want, off)
+	if err != nil {
+		return n, err
+	}
 	if n < len(p) {
 		return n, io.EOF
 	}
@@ -311,6 +410,11 @@ func (h *memHandle) ReadAt(p []byte, off int64) (int, error) {
 }
 
 func (h *memHandle) Write(p []byte) (int, error) {
+	if h.flags&os.O_APPEND != 0 {
+		h.file.mu.RLock()
+		h.offset = h.file.data.size()
+		h.file.mu.RUnlock()
+	}
 	n, err := h.WriteAt(p, h.offset)
 	h.offset += int64(n)
 	return n, err
@@ -320,21 +424,16 @@ func (h *memHandle) WriteAt(p []byte, off int64) (int, error) {
 	h.file.mu.Lock()
 	defer h.file.mu.Unlock()
 
-	end := off + int64(len(p))
-	if end > int64(len(h.file.data)) {
-		newData := make([]byte, end)
-		copy(newData, h.file.data)
-		h.file.data = newData
+	n, err := h.file.data.writeAt(p, off)
+	if n > 0 {
+		h.file.modTime = time.Now()
 	}
-
-	n := copy(h.file.data[off:], p)
-	h.file.modTime = time.Now()
-	return n, nil
+	return n, err
 }
 
 func (h *memHandle) Seek(offset int64, whence int) (int64, error) {
 	h.file.mu.RLock()
-	size := int64(len(h.file.data))
+	size := h.file.data.size()
 	h.file.mu.RUnlock()
 
 	switch whence {
@@ -355,7 +454,7 @@ func (h *memHandle) Seek(offset int64, whence int) (int64, error) {
 func (h *memHandle) Stat() (FileInfo, error) {
 	h.file.mu.RLock()
 	defer h.file.mu.RUnlock()
-	return NewFileInfo("", int64(len(h.file.data)), h.file.mode, h.file.modTime, false), nil
+	return NewFileInfo("", h.file.data.size(), h.file.mode, h.file.modTime, false), nil
 }
 
 func (h *memHandle) Sync() error {
@@ -366,37 +465,38 @@ func (h *memHandle) Truncate(size int64) error {
 	h.file.mu.Lock()
 	defer h.file.mu.Unlock()
 
-	if size < int64(len(h.file.data)) {
-		h.file.data = h.file.data[:size]
-	} else if size > int64(len(h.file.data)) {
-		newData := make([]byte, size)
-		copy(newData, h.file.data)
-		h.file.data = newData
+	if err := h.file.data.truncate(size); err != nil {
+		return err
 	}
 	h.file.modTime = time.Now()
 	return nil
 }
 
 func (h *memHandle) Close() error {
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+	h.file.open--
+	if h.file.removed && h.file.open == 0 {
+		h.file.data.truncate(0)
+	}
 	return nil
 }
 
 func (p *MemoryProvider) WriteFile(path string, data []byte, mode os.FileMode) error {
-	path = p.normPath(path)
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	dir := filepath.Dir(path)
-	if !p.dirs[dir] {
-		return syscall.ENOENT
+	h, err := p.Open(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
 	}
-
-	p.files[path] = &memFile{
-		data:    bytes.Clone(data),
-		mode:    mode,
-		modTime: time.Now(),
+	defer h.Close()
+	if err := p.Chmod(path, mode); err != nil {
+		return err
 	}
-	return nil
+	_, err = h.WriteAt(data, 0)
+	return err
 }
 
 func (p *MemoryProvider) ReadFile(path string) ([]byte, error) {
@@ -411,7 +511,11 @@ func (p *MemoryProvider) ReadFile(path string) ([]byte, error) {
 
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	return bytes.Clone(f.data), nil
+	data := make([]byte, f.data.size())
+	if _, err := f.data.readAt(data, 0); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 func (p *MemoryProvider) MkdirAll(path string, mode os.FileMode) error {
@@ -432,3 +536,64 @@ func (p *MemoryProvider) MkdirAll(path string, mode os.FileMode) error {
 	}
 	return nil
 }
+
+// memStore keeps file data in memory. used is the file data held, in
+// bytes; writes that would take it past limit (when > 0) fail with ENOSPC.
+type memStore struct {
+	mu    sync.Mutex
+	used  int64
+	limit int64
+}
+
+func (s *memStore) newData() fileData { return &memData{store: s} }
+
+func (s *memStore) usage() (used, limit int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used, s.limit
+}
+
+// reserve accounts for n more bytes of file data, or n fewer if negative.
+func (s *memStore) reserve(n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > 0 && s.limit > 0 && s.used+n > s.limit {
+		return syscall.ENOSPC
+	}
+	s.used += n
+	return nil
+}
+
+type memData struct {
+	store *memStore
+	data  []byte
+}
+
+func (d *memData) size() int64 { return int64(len(d.data)) }
+
+func (d *memData) readAt(b []byte, off int64) (int, error) {
+	return copy(b, d.data[off:]), nil
+}
+
+func (d *memData) writeAt(b []byte, off int64) (int, error) {
+	if end := off + int64(len(b)); end > int64(len(d.data)) {
+		if err := d.truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	return copy(d.data[off:], b), nil
+}
+
+func (d *memData) truncate(size int64) error {
+	if err := d.store.reserve(size - int64(len(d.data))); err != nil {
+		return err
+	}
+	if size < int64(len(d.data)) {
+		d.data = d.data[:size]
+	} else if size > int64(len(d.data)) {
+		newData := make([]byte, size)
+		copy(newData, d.data)
+		d.data = newData
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package vfs
 import (
 	"io"
 	"os"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -158,3 +159,68 @@ func TestMemoryProvider_Truncate(t *testing.T) {
 	content, _ := mp.ReadFile("/trunc.txt")
 	assert.Equal(t, "01234", string(content))
 }
+
+func TestMemoryProvider_Limit(t *testing.T) {
+	mp := NewMemoryProviderWithLimit(10)
+
+	h, err := mp.Create("/a", 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("0123456789"))
+	require.NoError(t, err)
+
+	_, err = h.Write([]byte("x"))
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.ErrorIs(t, h.Truncate(11), syscall.ENOSPC)
+	assert.ErrorIs(t, mp.WriteFile("/b", []byte("x"), 0644), syscall.ENOSPC)
+
+	// Overwriting in place needs no more space.
+	_, err = h.WriteAt([]byte("abc"), 0)
+	require.NoError(t, err)
+
+	used, limit := mp.Usage()
+	assert.Equal(t, int64(10), used)
+	assert.Equal(t, int64(10), limit)
+
+	require.NoError(t, h.Truncate(4))
+	used, _ = mp.Usage()
+	assert.Equal(t, int64(4), used)
+	h.Close()
+
+	require.NoError(t, mp.WriteFile("/b", []byte("123456"), 0644))
+	require.NoError(t, mp.Rename("/b", "/a"))
+	used, _ = mp.Usage()
+	assert.Equal(t, int64(6), used)
+
+	require.NoError(t, mp.Remove("/a"))
+	used, _ = mp.Usage()
+	assert.Equal(t, int64(0), used)
+}
+
+func TestMemoryProvider_RemoveAllReleasesSpace(t *testing.T) {
+	mp := NewMemoryProviderWithLimit(8)
+	require.NoError(t, mp.MkdirAll("/d/e", 0755))
+	require.NoError(t, mp.WriteFile("/d/one", []byte("1234"), 0644))
+	require.NoError(t, mp.WriteFile("/d/e/two", []byte("5678"), 0644))
+
+	require.NoError(t, mp.RemoveAll("/d"))
+	used, _ := mp.Usage()
+	assert.Equal(t, int64(0), used)
+	require.NoError(t, mp.WriteFile("/c", []byte("12345678"), 0644))
+}
+
+func TestMemoryProvider_CreateTruncates(t *testing.T) {
+	mp := NewMemoryProviderWithLimit(10)
+	require.NoError(t, mp.WriteFile("/f", []byte("0123456789"), 0644))
+
+	h, err := mp.Create("/f", 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("ab"))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	content, err := mp.ReadFile("/f")
+	require.NoError(t, err)
+	assert.Equal(t, "ab", string(content))
+	used, _ := mp.Usage()
+	assert.Equal(t, int64(2), used)
+}
@@ -0,0 +1,136 @@
+package vfs
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+var opNames = map[OpCode]string{
+	OpLookup:      "lookup",
+	OpGetattr:     "getattr",
+	OpSetattr:     "setattr",
+	OpRead:        "read",
+	OpWrite:       "write",
+	OpCreate:      "create",
+	OpMkdir:       "mkdir",
+	OpUnlink:      "unlink",
+	OpRmdir:       "rmdir",
+	OpRename:      "rename",
+	OpOpen:        "open",
+	OpRelease:     "release",
+	OpReaddir:     "readdir",
+	OpFsync:       "fsync",
+	OpMkdirAll:    "mkdirall",
+	OpTruncate:    "truncate",
+	OpSymlink:     "symlink",
+	OpReadlink:    "readlink",
+	OpLink:        "link",
+	OpGetxattr:    "getxattr",
+	OpSetxattr:    "setxattr",
+	OpListxattr:   "listxattr",
+	OpRemovexattr: "removexattr",
+}
+
+func (op OpCode) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// OpStats counts the operations of one kind served for a mount.
+type OpStats struct {
+	Count  int64
+	Errors int64 // operations answered with an error, including ENOENT
+	Bytes  int64 // data read or written
+	Total  time.Duration
+	Max    time.Duration
+	// Latency counts operations by duration: Latency[i] those that took at
+	// most the i-th bound of the Metrics, and the last entry the rest.
+	Latency []int64
+}
+
+// SlowOp is an operation that took at least the slow-operation threshold.
+type SlowOp struct {
+	Time     time.Time
+	Mount    string
+	Op       OpCode
+	Path     string
+	Duration time.Duration
+	Bytes    int64
+	Errno    int32 // negated errno the guest was answered with, or 0
+}
+
+// Metrics records the operations a VFSServer serves, per mount and kind,
+// so a slow workload can be traced to the mount behind it.
+type Metrics struct {
+	bounds []time.Duration
+
+	mu     sync.Mutex
+	mounts map[string]map[OpCode]*OpStats
+	slow   time.Duration
+	onSlow func(SlowOp)
+}
+
+// NewMetrics returns empty Metrics bucketing latencies by bounds, which must
+// be increasing.
+func NewMetrics(bounds []time.Duration) *Metrics {
+	return &Metrics{bounds: bounds, mounts: make(map[string]map[OpCode]*OpStats)}
+}
+
+// OnSlow calls fn for every operation taking threshold or longer. fn is
+// called on the serving goroutine and must not block.
+func (m *Metrics) OnSlow(threshold time.Duration, fn func(SlowOp)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.slow, m.onSlow = threshold, fn
+}
+
+func (m *Metrics) record(mount string, op OpCode, path string, bytes int64, d time.Duration, errno int32) {
+	m.mu.Lock()
+	ops := m.mounts[mount]
+	if ops == nil {
+		ops = make(map[OpCode]*OpStats)
+		m.mounts[mount] = ops
+	}
+	st := ops[op]
+	if st == nil {
+		st = &OpStats{Latency: make([]int64, len(m.bounds)+1)}
+		ops[op] = st
+	}
+	st.Count++
+	if errno != 0 {
+		st.Errors++
+	}
+	st.Bytes += bytes
+	st.Total += d
+	st.Max = max(st.Max, d)
+	st.Latency[sort.Search(len(m.bounds), func(i int) bool { return d <= m.bounds[i] })]++
+	onSlow := m.onSlow
+	if m.slow <= 0 || d < m.slow {
+		onSlow = nil
+	}
+	m.mu.Unlock()
+
+	if onSlow != nil {
+		onSlow(SlowOp{Time: time.Now(), Mount: mount, Op: op, Path: path, Duration: d, Bytes: bytes, Errno: errno})
+	}
+}
+
+// Snapshot returns a copy of the counters, keyed by mount path and
+// operation.
+func (m *Metrics) Snapshot() map[string]map[OpCode]OpStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := make(map[string]map[OpCode]OpStats, len(m.mounts))
+	for mount, ops := range m.mounts {
+		snap[mount] = make(map[OpCode]OpStats, len(ops))
+		for op, st := range ops {
+			c := *st
+			c.Latency = append([]int64(nil), st.Latency...)
+			snap[mount][op] = c
+		}
+	}
+	return snap
+}
@@ -0,0 +1,57 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_RecordsPerMount(t *testing.T) {
+	router := NewMountRouter(map[string]Provider{
+		"/workspace": NewMemoryProvider(),
+		"/data":      NewMemoryProvider(),
+	})
+	m := NewMetrics([]time.Duration{time.Millisecond, time.Second})
+	var slow []SlowOp
+	m.OnSlow(time.Nanosecond, func(op SlowOp) { slow = append(slow, op) })
+	s := NewVFSServer(router)
+	s.SetMetrics(m)
+
+	resp := s.dispatch(&VFSRequest{Op: OpCreate, Path: "/workspace/out.txt", Flags: uint32(os.O_RDWR), Mode: 0644})
+	require.Zero(t, resp.Err)
+	fh := resp.Handle
+	require.Zero(t, s.dispatch(&VFSRequest{Op: OpWrite, Handle: fh, Data: []byte("hello")}).Err)
+	require.Zero(t, s.dispatch(&VFSRequest{Op: OpRelease, Handle: fh}).Err)
+	assert.Equal(t, -int32(syscall.ENOENT), s.dispatch(&VFSRequest{Op: OpLookup, Path: "/data/missing"}).Err)
+
+	snap := m.Snapshot()
+	write := snap["/workspace"][OpWrite]
+	assert.Equal(t, int64(1), write.Count)
+	assert.Equal(t, int64(5), write.Bytes)
+	assert.Len(t, write.Latency, 3)
+	assert.Equal(t, int64(1), snap["/workspace"][OpRelease].Count, "handle ops are charged to the mount they were opened on")
+	lookup := snap["/data"][OpLookup]
+	assert.Equal(t, int64(1), lookup.Count)
+	assert.Equal(t, int64(1), lookup.Errors)
+
+	require.Len(t, slow, 4)
+	assert.Equal(t, "/workspace/out.txt", slow[1].Path)
+	assert.Equal(t, OpWrite, slow[1].Op)
+	assert.Equal(t, "write", slow[1].Op.String())
+}
+
+func TestMetrics_NoSlowOpsBelowThreshold(t *testing.T) {
+	m := NewMetrics(nil)
+	called := false
+	m.OnSlow(time.Hour, func(SlowOp) { called = true })
+	s := NewVFSServer(NewMemoryProvider())
+	s.SetMetrics(m)
+
+	s.dispatch(&VFSRequest{Op: OpGetattr, Path: "/"})
+	assert.False(t, called)
+	assert.Equal(t, []int64{1}, m.Snapshot()["/"][OpGetattr].Latency)
+}
@@ -0,0 +1,103 @@
+package vfs
+
+import (
+	"os"
+	"sync"
+)
+
+// Ops of a Change.
+const (
+	ChangeCreate = "create"
+	ChangeModify = "modify"
+	ChangeDelete = "delete"
+)
+
+// Change is a change made through a MountRouter. A file written through an
+// open handle is reported as modified once, when the handle is closed, with
+// its size then; a rename is a delete of the old path and a create of the
+// new one.
+type Change struct {
+	Op   string
+	Path string
+	Size int64
+}
+
+// OnChange sets fn to be called after every change made through the router.
+// It must be set before the router is in use. Changes made to a mount's
+// backing store directly, such as through a virtio-fs share, are not seen.
+func (r *MountRouter) OnChange(fn func(Change)) {
+	r.onChange = fn
+}
+
+func (r *MountRouter) notify(op, path string, size int64) {
+	if r.onChange != nil {
+		r.onChange(Change{Op: op, Path: path, Size: size})
+	}
+}
+
+// exists reports whether path exists, for telling creates from overwrites.
+// Without a change hook nothing asks.
+func (r *MountRouter) exists(path string) bool {
+	if r.onChange == nil {
+		return true
+	}
+	_, err := r.Stat(path)
+	return err == nil
+}
+
+func (r *MountRouter) watchHandle(h Handle, path string, flags int) Handle {
+	if r.onChange == nil || flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND) == 0 {
+		return h
+	}
+	return &changeHandle{Handle: h, router: r, path: path}
+}
+
+// changeHandle reports a modify when a handle that was written to closes.
+type changeHandle struct {
+	Handle
+	router *MountRouter
+	path   string
+
+	mu      sync.Mutex
+	written bool
+}
+
+func (h *changeHandle) markWritten() {
+	h.mu.Lock()
+	h.written = true
+	h.mu.Unlock()
+}
+
+func (h *changeHandle) Write(p []byte) (int, error) {
+	h.markWritten()
+	return h.Handle.Write(p)
+}
+
+func (h *changeHandle) WriteAt(p []byte, off int64) (int, error) {
+	h.markWritten()
+	return h.Handle.WriteAt(p, off)
+}
+
+func (h *changeHandle) Truncate(size int64) error {
+	h.markWritten()
+	return h.Handle.Truncate(size)
+}
+
+func (h *changeHandle) Close() error {
+	h.mu.Lock()
+	written := h.written
+	h.written = false
+	h.mu.Unlock()
+
+	var size int64
+	if written {
+		if info, err := h.Handle.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	err := h.Handle.Close()
+	if written {
+		h.router.notify(ChangeModify, h.path, size)
+	}
+	return err
+}
@@ -0,0 +1,380 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ObjectInfo describes an object in an ObjectStore.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// ObjectStore is a flat key/value object store such as an S3 bucket. Errors
+// for missing keys must match fs.ErrNotExist.
+type ObjectStore interface {
+	// List returns the objects directly under prefix and the common
+	// prefixes (each ending in "/") one level below it, stopping after
+	// limit results when limit > 0.
+	List(ctx context.Context, prefix string, limit int) (objects []ObjectInfo, prefixes []string, err error)
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	Get(ctx context.Context, key string, w io.Writer) error
+	Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error
+	Delete(ctx context.Context, key string) error
+}
+
+// ObjectStoreProvider exposes the keys of an ObjectStore under a prefix as a
+// filesystem. Directories are the "/"-separated key prefixes, plus empty
+// "dir/" marker objects left by Mkdir. Files are staged in an unlinked temp
+// file while open and uploaded whole on Sync or Close, so it suits the
+// read-mostly, whole-file access of data analysis rather than random writes
+// to large objects. Objects have no modes or links: Chmod is a no-op and
+// symlinks are unsupported.
+type ObjectStoreProvider struct {
+	store  ObjectStore
+	prefix string
+}
+
+// NewObjectStoreProvider returns a provider rooted at prefix in store.
+func NewObjectStoreProvider(store ObjectStore, prefix string) *ObjectStoreProvider {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &ObjectStoreProvider{store: store, prefix: prefix}
+}
+
+func (p *ObjectStoreProvider) Readonly() bool { return false }
+
+func (p *ObjectStoreProvider) key(path string) string {
+	return p.prefix + strings.TrimPrefix(filepath.Clean("/"+path), "/")
+}
+
+// dirKey is the key prefix of the objects under the directory path.
+func (p *ObjectStoreProvider) dirKey(path string) string {
+	key := p.key(path)
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+func isRoot(path string) bool {
+	return filepath.Clean("/"+path) == "/"
+}
+
+func dirInfo(name string) FileInfo {
+	return NewFileInfo(name, 0, os.ModeDir|0755, time.Time{}, true)
+}
+
+func (p *ObjectStoreProvider) Stat(path string) (FileInfo, error) {
+	name := filepath.Base(path)
+	if isRoot(path) {
+		return dirInfo(name), nil
+	}
+	ctx := context.Background()
+
+	obj, err := p.store.Head(ctx, p.key(path))
+	if err == nil {
+		return NewFileInfo(name, obj.Size, 0644, obj.ModTime, false), nil
+	}
+	if !isNotExist(err) {
+		return FileInfo{}, objectStoreErr(err)
+	}
+
+	objects, prefixes, err := p.store.List(ctx, p.dirKey(path), 1)
+	if err != nil {
+		return FileInfo{}, objectStoreErr(err)
+	}
+	if len(objects) == 0 && len(prefixes) == 0 {
+		return FileInfo{}, syscall.ENOENT
+	}
+	return dirInfo(name), nil
+}
+
+func (p *ObjectStoreProvider) ReadDir(path string) ([]DirEntry, error) {
+	dirKey := p.dirKey(path)
+	objects, prefixes, err := p.store.List(context.Background(), dirKey, 0)
+	if err != nil {
+		return nil, objectStoreErr(err)
+	}
+	if len(objects) == 0 && len(prefixes) == 0 && !isRoot(path) {
+		if _, err := p.Stat(path); err != nil {
+			return nil, err
+		}
+		return nil, syscall.ENOTDIR
+	}
+
+	entries := make([]DirEntry, 0, len(objects)+len(prefixes))
+	for _, prefix := range prefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(prefix, dirKey), "/")
+		entries = append(entries, NewDirEntry(name, true, os.ModeDir|0755, dirInfo(name)))
+	}
+	for _, obj := range objects {
+		name := strings.TrimPrefix(obj.Key, dirKey)
+		if name == "" {
+			continue // the directory's own marker
+		}
+		entries = append(entries, NewDirEntry(name, false, 0644, NewFileInfo(name, obj.Size, 0644, obj.ModTime, false)))
+	}
+	return entries, nil
+}
+
+func (p *ObjectStoreProvider) Open(path string, flags int, mode os.FileMode) (Handle, error) {
+	if isRoot(path) {
+		return nil, syscall.EISDIR
+	}
+	ctx := context.Background()
+	key := p.key(path)
+
+	_, err := p.store.Head(ctx, key)
+	exists := err == nil
+	if err != nil && !isNotExist(err) {
+		return nil, objectStoreErr(err)
+	}
+	if !exists {
+		if info, err := p.Stat(path); err == nil && info.IsDir() {
+			return nil, syscall.EISDIR
+		}
+		if flags&os.O_CREATE == 0 {
+			return nil, syscall.ENOENT
+		}
+	} else if flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0 {
+		return nil, syscall.EEXIST
+	}
+
+	f, err := os.CreateTemp("", "matchlock-object-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+
+	if exists && flags&os.O_TRUNC == 0 {
+		if err := p.store.Get(ctx, key, f); err != nil {
+			f.Close()
+			return nil, objectStoreErr(err)
+		}
+	}
+	whence := io.SeekStart
+	if flags&os.O_APPEND != 0 {
+		whence = io.SeekEnd
+	}
+	if _, err := f.Seek(0, whence); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &objectHandle{
+		store: p.store,
+		key:   key,
+		name:  filepath.Base(path),
+		file:  f,
+		dirty: !exists || flags&os.O_TRUNC != 0,
+	}, nil
+}
+
+func (p *ObjectStoreProvider) Create(path string, mode os.FileMode) (Handle, error) {
+	return p.Open(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode)
+}
+
+func (p *ObjectStoreProvider) Mkdir(path string, mode os.FileMode) error {
+	if _, err := p.Stat(path); err == nil {
+		return syscall.EEXIST
+	}
+	return objectStoreErr(p.store.Put(context.Background(), p.dirKey(path), strings.NewReader(""), 0))
+}
+
+func (p *ObjectStoreProvider) Chmod(path string, mode os.FileMode) error {
+	_, err := p.Stat(path)
+	return err
+}
+
+func (p *ObjectStoreProvider) Remove(path string) error {
+	info, err := p.Stat(path)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if !info.IsDir() {
+		return objectStoreErr(p.store.Delete(ctx, p.key(path)))
+	}
+
+	entries, err := p.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	if err := p.store.Delete(ctx, p.dirKey(path)); err != nil && !isNotExist(err) {
+		return objectStoreErr(err)
+	}
+	return nil
+}
+
+func (p *ObjectStoreProvider) RemoveAll(path string) error {
+	info, err := p.Stat(path)
+	if err != nil {
+		if isNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir() {
+		entries, err := p.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := p.RemoveAll(filepath.Join(path, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if isRoot(path) {
+		return nil
+	}
+	return p.Remove(path)
+}
+
+// Rename copies a file to its new key and deletes the old one. Renaming a
+// directory would mean rewriting every key under it, so it fails with EXDEV
+// and tools like mv fall back to copying.
+func (p *ObjectStoreProvider) Rename(oldPath, newPath string) error {
+	info, err := p.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return syscall.EXDEV
+	}
+
+	ctx := context.Background()
+	f, err := os.CreateTemp("", "matchlock-object-*")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	os.Remove(f.Name())
+
+	if err := p.store.Get(ctx, p.key(oldPath), f); err != nil {
+		return objectStoreErr(err)
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := p.store.Put(ctx, p.key(newPath), f, size); err != nil {
+		return objectStoreErr(err)
+	}
+	return objectStoreErr(p.store.Delete(ctx, p.key(oldPath)))
+}
+
+func (p *ObjectStoreProvider) Symlink(target, link string) error {
+	return syscall.ENOSYS
+}
+
+func (p *ObjectStoreProvider) Readlink(path string) (string, error) {
+	return "", syscall.EINVAL
+}
+
+// objectStoreErr maps store errors onto the errnos the guest understands;
+// anything but a missing key is an I/O error.
+func objectStoreErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if isNotExist(err) {
+		return syscall.ENOENT
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	return syscall.EIO
+}
+
+type objectHandle struct {
+	store ObjectStore
+	key   string
+	name  string
+
+	mu    sync.Mutex
+	file  *os.File
+	dirty bool
+}
+
+func (h *objectHandle) Read(p []byte) (int, error)              { return h.file.Read(p) }
+func (h *objectHandle) ReadAt(p []byte, off int64) (int, error) { return h.file.ReadAt(p, off) }
+func (h *objectHandle) Seek(off int64, whence int) (int64, error) {
+	return h.file.Seek(off, whence)
+}
+
+func (h *objectHandle) Write(p []byte) (int, error) {
+	h.markDirty()
+	return h.file.Write(p)
+}
+
+func (h *objectHandle) WriteAt(p []byte, off int64) (int, error) {
+	h.markDirty()
+	return h.file.WriteAt(p, off)
+}
+
+func (h *objectHandle) Truncate(size int64) error {
+	h.markDirty()
+	return h.file.Truncate(size)
+}
+
+func (h *objectHandle) Stat() (FileInfo, error) {
+	info, err := h.file.Stat()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return NewFileInfo(h.name, info.Size(), 0644, info.ModTime(), false), nil
+}
+
+func (h *objectHandle) markDirty() {
+	h.mu.Lock()
+	h.dirty = true
+	h.mu.Unlock()
+}
+
+// Sync uploads the staged file if it changed since it was opened or last
+// synced.
+func (h *objectHandle) Sync() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty {
+		return nil
+	}
+
+	info, err := h.file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := h.store.Put(context.Background(), h.key, io.NewSectionReader(h.file, 0, info.Size()), info.Size()); err != nil {
+		return objectStoreErr(err)
+	}
+	h.dirty = false
+	return nil
+}
+
+func (h *objectHandle) Close() error {
+	err := h.Sync()
+	if cerr := h.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+package vfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeObjectStore(objects map[string]string) *fakeObjectStore {
+	s := &fakeObjectStore{objects: make(map[string][]byte)}
+	for k, v := range objects {
+		s.objects[k] = []byte(v)
+	}
+	return s
+}
+
+func (s *fakeObjectStore) List(_ context.Context, prefix string, limit int) ([]ObjectInfo, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var objects []ObjectInfo
+	seen := make(map[string]bool)
+	var prefixes []string
+	for key, data := range s.objects {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if dir, _, nested := strings.Cut(rest, "/"); nested {
+			if !seen[dir] {
+				seen[dir] = true
+				prefixes = append(prefixes, prefix+dir+"/")
+			}
+			continue
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: int64(len(data))})
+	}
+	sort.Strings(prefixes)
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, prefixes, nil
+}
+
+func (s *fakeObjectStore) Head(_ context.Context, key string) (ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return ObjectInfo{}, fs.ErrNotExist
+	}
+	return ObjectInfo{Key: key, Size: int64(len(data)), ModTime: time.Now()}, nil
+}
+
+func (s *fakeObjectStore) Get(_ context.Context, key string, w io.Writer) error {
+	s.mu.Lock()
+	data, ok := s.objects[key]
+	s.mu.Unlock()
+	if !ok {
+		return fs.ErrNotExist
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (s *fakeObjectStore) Put(_ context.Context, key string, r io.ReadSeeker, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	return nil
+}
+
+func (s *fakeObjectStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func TestObjectStoreProvider_ReadDirAndStat(t *testing.T) {
+	store := newFakeObjectStore(map[string]string{
+		"data/a.csv":         "a,b\n",
+		"data/raw/2024.json": "{}",
+		"other/skip.txt":     "no",
+	})
+	p := NewObjectStoreProvider(store, "/data/")
+
+	entries, err := p.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "raw", entries[0].Name())
+	assert.True(t, entries[0].IsDir())
+	assert.Equal(t, "a.csv", entries[1].Name())
+
+	info, err := p.Stat("/a.csv")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), info.Size())
+
+	info, err = p.Stat("/raw")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	_, err = p.Stat("/missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestObjectStoreProvider_WriteUploadsOnClose(t *testing.T) {
+	store := newFakeObjectStore(map[string]string{"data/log.txt": "one\n"})
+	p := NewObjectStoreProvider(store, "data")
+
+	h, err := p.Open("/log.txt", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("two\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "one\n", string(store.objects["data/log.txt"]), "upload waits for close")
+	require.NoError(t, h.Close())
+	assert.Equal(t, "one\ntwo\n", string(store.objects["data/log.txt"]))
+
+	h, err = p.Create("/out/result.txt", 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("done"))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+	assert.Equal(t, "done", string(store.objects["data/out/result.txt"]))
+
+	h, err = p.Open("/out/result.txt", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	got, err := io.ReadAll(h)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+	assert.Equal(t, "done", string(got))
+}
+
+func TestObjectStoreProvider_MkdirRenameRemove(t *testing.T) {
+	store := newFakeObjectStore(map[string]string{"src.txt": "x"})
+	p := NewObjectStoreProvider(store, "")
+
+	require.NoError(t, p.Mkdir("/empty", 0755))
+	info, err := p.Stat("/empty")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	entries, err := p.ReadDir("/empty")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	require.NoError(t, p.Rename("/src.txt", "/empty/dst.txt"))
+	assert.Equal(t, map[string][]byte{"empty/": {}, "empty/dst.txt": []byte("x")}, store.objects)
+	require.ErrorIs(t, p.Rename("/empty", "/moved"), syscall.EXDEV)
+
+	require.ErrorIs(t, p.Remove("/empty"), syscall.ENOTEMPTY)
+	require.NoError(t, p.RemoveAll("/empty"))
+	assert.Empty(t, store.objects)
+}
+
+func TestObjectStoreProvider_ReadonlyWrapper(t *testing.T) {
+	p := NewReadonlyProvider(NewObjectStoreProvider(newFakeObjectStore(nil), ""))
+	_, err := p.Create("/x", 0644)
+	require.Error(t, err)
+}
@@ -1,10 +1,26 @@
 package vfs
 
 import (
+	"errors"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 )
 
+// Whiteouts follow the OCI image layer convention, so an upper layer kept on
+// the host reads like a layer diff: a deleted lower entry NAME is recorded as
+// an empty .wh.NAME file next to it, and a directory that replaced a deleted
+// lower directory holds a .wh..wh..opq marker hiding the lower contents.
+const (
+	WhiteoutPrefix = ".wh."
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// OverlayProvider layers a writable upper provider over a lower one. Reads
+// fall through to the lower layer; writes copy files up first, and removals
+// of lower entries leave whiteouts in the upper layer.
 type OverlayProvider struct {
 	upper Provider
 	lower Provider
@@ -21,12 +37,19 @@ func (p *OverlayProvider) Stat(path string) (FileInfo, error) {
 	if err == nil {
 		return info, nil
 	}
+	if p.hidden(path) {
+		return FileInfo{}, syscall.ENOENT
+	}
 	return p.lower.Stat(path)
 }
 
 func (p *OverlayProvider) ReadDir(path string) ([]DirEntry, error) {
 	upperEntries, upperErr := p.upper.ReadDir(path)
-	lowerEntries, lowerErr := p.lower.ReadDir(path)
+	var lowerEntries []DirEntry
+	lowerErr := error(syscall.ENOENT)
+	if !p.hidden(path) && !p.opaque(path) {
+		lowerEntries, lowerErr = p.lower.ReadDir(path)
+	}
 
 	if upperErr != nil && lowerErr != nil {
 		return nil, upperErr
@@ -36,6 +59,10 @@ func (p *OverlayProvider) ReadDir(path string) ([]DirEntry, error) {
 	var result []DirEntry
 
 	for _, e := range upperEntries {
+		if name, ok := strings.CutPrefix(e.Name(), WhiteoutPrefix); ok {
+			seen[name] = true
+			continue
+		}
 		seen[e.Name()] = true
 		result = append(result, e)
 	}
@@ -51,13 +78,16 @@ func (p *OverlayProvider) ReadDir(path string) ([]DirEntry, error) {
 
 func (p *OverlayProvider) Open(path string, flags int, mode os.FileMode) (Handle, error) {
 	if flags&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
-		if flags&os.O_CREATE == 0 {
-			_, err := p.upper.Stat(path)
-			if err != nil {
-				if !os.IsNotExist(err) && err != syscall.ENOENT {
+		_, err := p.upper.Stat(path)
+		if err != nil {
+			if !isNotExist(err) {
+				return nil, err
+			}
+			if err := p.copyUp(path); err != nil {
+				if !isNotExist(err) || flags&os.O_CREATE == 0 {
 					return nil, err
 				}
-				if err := p.copyUp(path); err != nil {
+				if err := p.prepareUpper(path); err != nil {
 					return nil, err
 				}
 			}
@@ -69,21 +99,40 @@ func (p *OverlayProvider) Open(path string, flags int, mode os.FileMode) (Handle
 	if err == nil {
 		return h, nil
 	}
+	if p.hidden(path) {
+		return nil, syscall.ENOENT
+	}
 	return p.lower.Open(path, flags, mode)
 }
 
 func (p *OverlayProvider) Create(path string, mode os.FileMode) (Handle, error) {
+	if err := p.prepareUpper(path); err != nil {
+		return nil, err
+	}
 	return p.upper.Create(path, mode)
 }
 
 func (p *OverlayProvider) Mkdir(path string, mode os.FileMode) error {
-	return p.upper.Mkdir(path, mode)
+	if _, err := p.Stat(path); err == nil {
+		return syscall.EEXIST
+	}
+	replacesLower := p.whitedOut(path)
+	if err := p.prepareUpper(path); err != nil {
+		return err
+	}
+	if err := p.upper.Mkdir(path, mode); err != nil {
+		return err
+	}
+	if replacesLower {
+		return p.writeMarker(filepath.Join(path, WhiteoutOpaque))
+	}
+	return nil
 }
 
 func (p *OverlayProvider) Chmod(path string, mode os.FileMode) error {
 	_, err := p.upper.Stat(path)
 	if err != nil {
-		if !os.IsNotExist(err) && err != syscall.ENOENT {
+		if !isNotExist(err) {
 			return err
 		}
 		if err := p.copyUp(path); err != nil {
@@ -93,28 +142,72 @@ func (p *OverlayProvider) Chmod(path string, mode os.FileMode) error {
 	return p.upper.Chmod(path, mode)
 }
 
+func (p *OverlayProvider) chownHost(path string, uid, gid int) error {
+	_, err := p.upper.Stat(path)
+	if err != nil {
+		if !isNotExist(err) {
+			return err
+		}
+		if err := p.copyUp(path); err != nil {
+			return err
+		}
+	}
+	return chownHost(p.upper, path, uid, gid)
+}
+
 func (p *OverlayProvider) Remove(path string) error {
-	return p.upper.Remove(path)
+	info, err := p.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := p.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return syscall.ENOTEMPTY
+		}
+		// Only whiteouts can remain in the upper directory.
+		if err := p.upper.RemoveAll(path); err != nil && !isNotExist(err) {
+			return err
+		}
+	} else if err := p.upper.Remove(path); err != nil && !isNotExist(err) {
+		return err
+	}
+	return p.whiteoutLower(path)
 }
 
 func (p *OverlayProvider) RemoveAll(path string) error {
-	return p.upper.RemoveAll(path)
+	if err := p.upper.RemoveAll(path); err != nil && !isNotExist(err) {
+		return err
+	}
+	return p.whiteoutLower(path)
 }
 
 func (p *OverlayProvider) Rename(oldPath, newPath string) error {
 	_, err := p.upper.Stat(oldPath)
 	if err != nil {
-		if !os.IsNotExist(err) && err != syscall.ENOENT {
+		if !isNotExist(err) {
 			return err
 		}
-		if err := p.copyUp(oldPath); err != nil {
+		if err := p.copyUpTree(oldPath); err != nil {
 			return err
 		}
 	}
-	return p.upper.Rename(oldPath, newPath)
+	if err := p.prepareUpper(newPath); err != nil {
+		return err
+	}
+	if err := p.upper.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	return p.whiteoutLower(oldPath)
 }
 
 func (p *OverlayProvider) Symlink(target, link string) error {
+	if err := p.prepareUpper(link); err != nil {
+		return err
+	}
 	return p.upper.Symlink(target, link)
 }
 
@@ -123,17 +216,69 @@ func (p *OverlayProvider) Readlink(path string) (string, error) {
 	if err == nil {
 		return link, nil
 	}
+	if p.hidden(path) {
+		return "", syscall.ENOENT
+	}
 	return p.lower.Readlink(path)
 }
 
+// WhiteoutPath hides path in the lower layer.
+func (p *OverlayProvider) WhiteoutPath(path string) error {
+	if err := p.ensureUpperDir(filepath.Dir(filepath.Clean(path))); err != nil {
+		return err
+	}
+	return p.writeMarker(whiteoutFor(path))
+}
+
+// prepareUpper readies the upper layer for a new entry at path: its parent
+// directories exist and any whiteout left by an earlier removal is gone.
+func (p *OverlayProvider) prepareUpper(path string) error {
+	if err := p.ensureUpperDir(filepath.Dir(filepath.Clean(path))); err != nil {
+		return err
+	}
+	if err := p.upper.Remove(whiteoutFor(path)); err != nil && !isNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ensureUpperDir creates dir and its parents in the upper layer, copying
+// their modes from the lower layer where they exist.
+func (p *OverlayProvider) ensureUpperDir(dir string) error {
+	dir = filepath.Clean(dir)
+	if _, err := p.upper.Stat(dir); err == nil {
+		return nil
+	}
+	if dir == "/" || dir == "." {
+		return nil
+	}
+	if err := p.ensureUpperDir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	mode := os.FileMode(0755)
+	if info, err := p.lower.Stat(dir); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := p.upper.Mkdir(dir, mode); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return nil
+}
+
 func (p *OverlayProvider) copyUp(path string) error {
+	if p.hidden(path) {
+		return syscall.ENOENT
+	}
 	info, err := p.lower.Stat(path)
 	if err != nil {
 		return err
 	}
+	if err := p.ensureUpperDir(filepath.Dir(filepath.Clean(path))); err != nil {
+		return err
+	}
 
 	if info.IsDir() {
-		return p.upper.Mkdir(path, info.Mode())
+		return p.upper.Mkdir(path, info.Mode().Perm())
 	}
 
 	src, err := p.lower.Open(path, os.O_RDONLY, 0)
@@ -142,35 +287,89 @@ func (p *OverlayProvider) copyUp(path string) error {
 	}
 	defer src.Close()
 
-	dst, err := p.upper.Create(path, info.Mode())
+	dst, err := p.upper.Create(path, info.Mode().Perm())
 	if err != nil {
 		return err
 	}
 	defer dst.Close()
 
-	buf := make([]byte, 32*1024)
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			if _, werr := dst.Write(buf[:n]); werr != nil {
-				return werr
-			}
+	_, err = CopySparse(dst, src)
+	return err
+}
+
+// copyUpTree copies path and, for a directory, everything visible under it
+// into the upper layer, so the whole tree can be renamed there.
+func (p *OverlayProvider) copyUpTree(path string) error {
+	if _, err := p.upper.Stat(path); err != nil {
+		if err := p.copyUp(path); err != nil {
+			return err
 		}
-		if err != nil {
-			if err.Error() == "EOF" {
-				break
-			}
+	}
+	info, err := p.upper.Stat(path)
+	if err != nil || !info.IsDir() {
+		return err
+	}
+	entries, err := p.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := p.copyUpTree(filepath.Join(path, e.Name())); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
-func (p *OverlayProvider) WhiteoutPath(path string) error {
-	memUpper, ok := p.upper.(*MemoryProvider)
-	if !ok {
-		return syscall.ENOSYS
+// whiteoutLower records a whiteout for path if the lower layer still shows it.
+func (p *OverlayProvider) whiteoutLower(path string) error {
+	if p.hidden(path) {
+		return nil
+	}
+	if _, err := p.lower.Stat(path); err != nil {
+		return nil
+	}
+	return p.WhiteoutPath(path)
+}
+
+// hidden reports whether path or one of its ancestors was removed from the
+// lower layer, or sits under a directory that replaced a removed one.
+func (p *OverlayProvider) hidden(path string) bool {
+	path = filepath.Clean(path)
+	for cur := path; cur != "/" && cur != "."; cur = filepath.Dir(cur) {
+		if p.whitedOut(cur) {
+			return true
+		}
+		if cur != path && p.opaque(cur) {
+			return true
+		}
 	}
-	return memUpper.WriteFile(path+".whiteout", []byte{}, 0)
+	return false
+}
+
+func (p *OverlayProvider) whitedOut(path string) bool {
+	_, err := p.upper.Stat(whiteoutFor(path))
+	return err == nil
+}
+
+func (p *OverlayProvider) opaque(dir string) bool {
+	_, err := p.upper.Stat(filepath.Join(dir, WhiteoutOpaque))
+	return err == nil
+}
+
+func (p *OverlayProvider) writeMarker(path string) error {
+	h, err := p.upper.Create(path, 0644)
+	if err != nil {
+		return err
+	}
+	return h.Close()
+}
+
+func whiteoutFor(path string) string {
+	path = filepath.Clean(path)
+	return filepath.Join(filepath.Dir(path), WhiteoutPrefix+filepath.Base(path))
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
 }
@@ -112,3 +112,87 @@ func TestOverlayProvider_NotReadonly(t *testing.T) {
 
 	assert.False(t, overlay.Readonly())
 }
+
+func TestOverlayProvider_RemoveLowerLeavesWhiteout(t *testing.T) {
+	lowerDir, upperDir := t.TempDir(), t.TempDir()
+	require.NoError(t, os.MkdirAll(lowerDir+"/src", 0755))
+	require.NoError(t, os.WriteFile(lowerDir+"/src/keep.go", []byte("keep"), 0644))
+	require.NoError(t, os.WriteFile(lowerDir+"/src/drop.go", []byte("drop"), 0644))
+
+	overlay := NewOverlayProvider(NewRealFSProvider(upperDir), NewReadonlyProvider(NewRealFSProvider(lowerDir)))
+
+	require.NoError(t, overlay.Remove("/src/drop.go"))
+	_, err := overlay.Stat("/src/drop.go")
+	require.Error(t, err)
+
+	entries, err := overlay.ReadDir("/src")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "keep.go", entries[0].Name())
+
+	_, err = os.Stat(upperDir + "/src/.wh.drop.go")
+	require.NoError(t, err, "whiteout should be recorded in the upper dir")
+	_, err = os.Stat(lowerDir + "/src/drop.go")
+	require.NoError(t, err, "lower layer should stay pristine")
+
+	h, err := overlay.Create("/src/drop.go", 0644)
+	require.NoError(t, err)
+	h.Close()
+	_, err = os.Stat(upperDir + "/src/.wh.drop.go")
+	require.True(t, os.IsNotExist(err), "recreating should clear the whiteout")
+}
+
+func TestOverlayProvider_WriteNestedLowerFile(t *testing.T) {
+	lowerDir, upperDir := t.TempDir(), t.TempDir()
+	require.NoError(t, os.MkdirAll(lowerDir+"/a/b", 0755))
+	require.NoError(t, os.WriteFile(lowerDir+"/a/b/file.txt", []byte("lower"), 0644))
+
+	overlay := NewOverlayProvider(NewRealFSProvider(upperDir), NewReadonlyProvider(NewRealFSProvider(lowerDir)))
+
+	h, err := overlay.Open("/a/b/file.txt", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = h.Write([]byte("+upper"))
+	require.NoError(t, err)
+	h.Close()
+
+	got, err := os.ReadFile(upperDir + "/a/b/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "lower+upper", string(got))
+	got, err = os.ReadFile(lowerDir + "/a/b/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "lower", string(got))
+}
+
+func TestOverlayProvider_MkdirOverRemovedDirIsOpaque(t *testing.T) {
+	lower := NewMemoryProvider()
+	upper := NewMemoryProvider()
+	require.NoError(t, lower.Mkdir("/dir", 0755))
+	h, _ := lower.Create("/dir/old.txt", 0644)
+	h.Close()
+
+	overlay := NewOverlayProvider(upper, lower)
+
+	require.NoError(t, overlay.RemoveAll("/dir"))
+	require.NoError(t, overlay.Mkdir("/dir", 0755))
+
+	entries, err := overlay.ReadDir("/dir")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = overlay.Stat("/dir/old.txt")
+	require.Error(t, err)
+}
+
+func TestOverlayProvider_RenameLowerDir(t *testing.T) {
+	lowerDir, upperDir := t.TempDir(), t.TempDir()
+	require.NoError(t, os.MkdirAll(lowerDir+"/old", 0755))
+	require.NoError(t, os.WriteFile(lowerDir+"/old/file.txt", []byte("data"), 0644))
+
+	overlay := NewOverlayProvider(NewRealFSProvider(upperDir), NewReadonlyProvider(NewRealFSProvider(lowerDir)))
+
+	require.NoError(t, overlay.Rename("/old", "/new"))
+	_, err := overlay.Stat("/old")
+	require.Error(t, err)
+	info, err := overlay.Stat("/new/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), info.Size())
+}
@@ -22,6 +22,13 @@ type Provider interface {
 	Readlink(path string) (string, error)
 }
 
+// UsageReporter is implemented by providers that account for the space
+// their files hold, such as MemoryProvider.
+type UsageReporter interface {
+	// Usage returns the bytes held and the limit on them (0 if unbounded).
+	Usage() (used, limit int64)
+}
+
 type Handle interface {
 	io.Reader
 	io.Writer
@@ -40,6 +47,9 @@ type FileInfo struct {
 	mode    os.FileMode
 	modTime time.Time
 	isDir   bool
+	uid     uint32
+	gid     uint32
+	sys     any
 }
 
 func (fi FileInfo) Name() string       { return fi.name }
@@ -47,7 +57,20 @@ func (fi FileInfo) Size() int64        { return fi.size }
 func (fi FileInfo) Mode() os.FileMode  { return fi.mode }
 func (fi FileInfo) ModTime() time.Time { return fi.modTime }
 func (fi FileInfo) IsDir() bool        { return fi.isDir }
-func (fi FileInfo) Sys() any           { return nil }
+
+// Sys returns the host's stat data for a file on a host directory, as
+// os.FileInfo does, and nil otherwise.
+func (fi FileInfo) Sys() any { return fi.sys }
+
+// Owner returns the uid and gid the guest sees the file owned by, root
+// unless an IDMapProvider has mapped it.
+func (fi FileInfo) Owner() (uid, gid uint32) { return fi.uid, fi.gid }
+
+// WithOwner returns a copy of fi owned by uid and gid.
+func (fi FileInfo) WithOwner(uid, gid uint32) FileInfo {
+	fi.uid, fi.gid = uid, gid
+	return fi
+}
 
 func NewFileInfo(name string, size int64, mode os.FileMode, modTime time.Time, isDir bool) FileInfo {
 	return FileInfo{
@@ -39,6 +39,21 @@ func (p *ReadonlyProvider) RemoveAll(path string) error               { return s
 func (p *ReadonlyProvider) Rename(oldPath, newPath string) error      { return syscall.EROFS }
 func (p *ReadonlyProvider) Symlink(target, link string) error         { return syscall.EROFS }
 func (p *ReadonlyProvider) Readlink(path string) (string, error)      { return p.inner.Readlink(path) }
+func (p *ReadonlyProvider) chownHost(path string, uid, gid int) error { return syscall.EROFS }
+
+func (p *ReadonlyProvider) Getxattr(path, name string) ([]byte, error) {
+	return Getxattr(p.inner, path, name)
+}
+
+func (p *ReadonlyProvider) Listxattr(path string) ([]string, error) {
+	return Listxattr(p.inner, path)
+}
+
+func (p *ReadonlyProvider) Setxattr(path, name string, value []byte, flags int) error {
+	return syscall.EROFS
+}
+
+func (p *ReadonlyProvider) Removexattr(path, name string) error { return syscall.EROFS }
 
 type readonlyHandle struct {
 	inner Handle
@@ -1,56 +1,175 @@
 package vfs
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
+// RealFSProvider serves a host directory. Unless it is unconfined, every
+// path is resolved within the directory, one element at a time from it:
+// symlinks may point anywhere inside it, but one leading out of it, or any
+// absolute one, is not followed and the call fails with EACCES. As no
+// element is looked up through a name that could since have been swapped
+// for a symlink, a host or guest process racing renames against a lookup
+// cannot make it escape either.
 type RealFSProvider struct {
-	root string
+	dir        string
+	unconfined bool
+}
+
+func NewRealFSProvider(dir string) *RealFSProvider {
+	return &RealFSProvider{dir: dir}
 }
 
-func NewRealFSProvider(root string) *RealFSProvider {
-	return &RealFSProvider{root: root}
+// NewUnconfinedRealFSProvider returns a RealFSProvider that follows
+// symlinks out of dir, for trees the host user chose and trusts, such as
+// the source of a copy in.
+func NewUnconfinedRealFSProvider(dir string) *RealFSProvider {
+	return &RealFSProvider{dir: dir, unconfined: true}
 }
 
 func (p *RealFSProvider) Readonly() bool { return false }
 
-func (p *RealFSProvider) realPath(path string) string {
-	return filepath.Join(p.root, filepath.Clean(path))
+// hostFS is the part of *os.Root a RealFSProvider calls, so an unconfined
+// provider can serve the same calls by plain paths.
+type hostFS interface {
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	OpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
+	OpenRoot(name string) (*os.Root, error)
+	Mkdir(name string, perm os.FileMode) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+	Close() error
 }
 
-func (p *RealFSProvider) Stat(path string) (FileInfo, error) {
-	info, err := os.Stat(p.realPath(path))
+// open returns the provider's directory to resolve paths in. The
+// directory is opened per call rather than held, so a provider keeps
+// following the directory at its path as a plain path would.
+func (p *RealFSProvider) open() (hostFS, error) {
+	if p.unconfined {
+		return hostDir(p.dir), nil
+	}
+	root, err := os.OpenRoot(p.dir)
 	if err != nil {
-		return FileInfo{}, err
+		// A file mount has no paths under it to escape through.
+		if info, statErr := os.Stat(p.dir); statErr == nil && !info.IsDir() {
+			return hostDir(p.dir), nil
+		}
+		return nil, err
 	}
-	return NewFileInfo(info.Name(), info.Size(), info.Mode(), info.ModTime(), info.IsDir()), nil
+	return root, nil
 }
 
-func (p *RealFSProvider) ReadDir(path string) ([]DirEntry, error) {
-	entries, err := os.ReadDir(p.realPath(path))
+// do runs fn on the provider's directory.
+func (p *RealFSProvider) do(fn func(fsys hostFS) error) error {
+	fsys, err := p.open()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer fsys.Close()
+	return escapeError(fn(fsys))
+}
+
+// rel returns path relative to the provider's directory, as os.Root takes
+// names.
+func rel(path string) string {
+	path = filepath.Clean("/" + path)
+	if path == "/" {
+		return "."
+	}
+	return path[1:]
+}
+
+// escapeError gives the errors os.Root returns for a path leading out of
+// it, which carry no errno, EACCES, so the guest sees a permission error.
+func escapeError(err error) error {
+	var errno syscall.Errno
+	if err == nil || errors.As(err, &errno) {
+		return err
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return &os.PathError{Op: pathErr.Op, Path: pathErr.Path, Err: syscall.EACCES}
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return &os.LinkError{Op: linkErr.Op, Old: linkErr.Old, New: linkErr.New, Err: syscall.EACCES}
+	}
+	return err
+}
+
+func (p *RealFSProvider) Stat(path string) (FileInfo, error) {
+	var info os.FileInfo
+	err := p.do(func(fsys hostFS) (err error) {
+		info, err = fsys.Stat(rel(path))
+		return err
+	})
+	if err != nil {
+		return FileInfo{}, err
 	}
+	return hostFileInfo(info), nil
+}
 
-	result := make([]DirEntry, 0, len(entries))
-	for _, e := range entries {
-		info, err := e.Info()
+// hostFileInfo converts the os.FileInfo of a host file, keeping its stat
+// data for IDMapProvider.
+func hostFileInfo(info os.FileInfo) FileInfo {
+	fi := NewFileInfo(info.Name(), info.Size(), info.Mode(), info.ModTime(), info.IsDir())
+	fi.sys = info.Sys()
+	return fi
+}
+
+// ReadDir lists path by name. Entries are not followed: a symlink is
+// listed as one.
+func (p *RealFSProvider) ReadDir(path string) ([]DirEntry, error) {
+	var result []DirEntry
+	err := p.do(func(fsys hostFS) error {
+		dir, err := fsys.OpenRoot(rel(path))
 		if err != nil {
-			continue
+			return err
 		}
-		result = append(result, NewDirEntry(
-			e.Name(),
-			e.IsDir(),
-			info.Mode(),
-			NewFileInfo(e.Name(), info.Size(), info.Mode(), info.ModTime(), e.IsDir()),
-		))
-	}
-	return result, nil
+		defer dir.Close()
+		f, err := dir.Open(".")
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		slices.Sort(names)
+
+		result = make([]DirEntry, 0, len(names))
+		for _, name := range names {
+			info, err := dir.Lstat(name)
+			if err != nil {
+				continue
+			}
+			result = append(result, NewDirEntry(name, info.IsDir(), info.Mode(), hostFileInfo(info)))
+		}
+		return nil
+	})
+	return result, err
 }
 
 func (p *RealFSProvider) Open(path string, flags int, mode os.FileMode) (Handle, error) {
-	f, err := os.OpenFile(p.realPath(path), flags, mode)
+	var f *os.File
+	err := p.do(func(fsys hostFS) (err error) {
+		f, err = fsys.OpenFile(rel(path), flags, mode)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -58,39 +177,152 @@ func (p *RealFSProvider) Open(path string, flags int, mode os.FileMode) (Handle,
 }
 
 func (p *RealFSProvider) Create(path string, mode os.FileMode) (Handle, error) {
-	f, err := os.OpenFile(p.realPath(path), os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode)
-	if err != nil {
-		return nil, err
-	}
-	return &realHandle{file: f}, nil
+	return p.Open(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode)
 }
 
 func (p *RealFSProvider) Mkdir(path string, mode os.FileMode) error {
-	return os.Mkdir(p.realPath(path), mode)
+	return p.do(func(fsys hostFS) error { return fsys.Mkdir(rel(path), mode) })
 }
 
 func (p *RealFSProvider) Chmod(path string, mode os.FileMode) error {
-	return os.Chmod(p.realPath(path), mode)
+	return p.do(func(fsys hostFS) error { return fsys.Chmod(rel(path), mode) })
+}
+
+func (p *RealFSProvider) chownHost(path string, uid, gid int) error {
+	return p.do(func(fsys hostFS) error { return fsys.Chown(rel(path), uid, gid) })
 }
 
 func (p *RealFSProvider) Remove(path string) error {
-	return os.Remove(p.realPath(path))
+	return p.do(func(fsys hostFS) error { return fsys.Remove(rel(path)) })
 }
 
 func (p *RealFSProvider) RemoveAll(path string) error {
-	return os.RemoveAll(p.realPath(path))
+	return p.do(func(fsys hostFS) error { return fsys.RemoveAll(rel(path)) })
 }
 
 func (p *RealFSProvider) Rename(oldPath, newPath string) error {
-	return os.Rename(p.realPath(oldPath), p.realPath(newPath))
+	return p.do(func(fsys hostFS) error { return fsys.Rename(rel(oldPath), rel(newPath)) })
 }
 
 func (p *RealFSProvider) Symlink(target, link string) error {
-	return os.Symlink(target, p.realPath(link))
+	return p.do(func(fsys hostFS) error { return fsys.Symlink(target, rel(link)) })
 }
 
 func (p *RealFSProvider) Readlink(path string) (string, error) {
-	return os.Readlink(p.realPath(path))
+	var target string
+	err := p.do(func(fsys hostFS) (err error) {
+		target, err = fsys.Readlink(rel(path))
+		return err
+	})
+	return target, err
+}
+
+// xattrDo runs fn on a descriptor of path, so attributes are read and
+// changed on the file resolved within the directory as other calls
+// resolve it. A file the host user may not read cannot be opened and
+// fails with EACCES.
+func (p *RealFSProvider) xattrDo(path string, fn func(fd int) error) error {
+	return p.do(func(fsys hostFS) error {
+		f, err := fsys.OpenFile(rel(path), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return fn(int(f.Fd()))
+	})
+}
+
+// readSized calls read, which fills a buffer as getxattr(2) does, with a
+// buffer of the size it asks for, retrying if the value grew meanwhile.
+func readSized(read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := read(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func (p *RealFSProvider) Getxattr(path, name string) ([]byte, error) {
+	var value []byte
+	err := p.xattrDo(path, func(fd int) (err error) {
+		value, err = readSized(func(dest []byte) (int, error) { return unix.Fgetxattr(fd, name, dest) })
+		return err
+	})
+	return value, err
+}
+
+func (p *RealFSProvider) Setxattr(path, name string, value []byte, flags int) error {
+	var hostFlags int
+	if flags&XattrCreate != 0 {
+		hostFlags |= unix.XATTR_CREATE
+	}
+	if flags&XattrReplace != 0 {
+		hostFlags |= unix.XATTR_REPLACE
+	}
+	return p.xattrDo(path, func(fd int) error { return unix.Fsetxattr(fd, name, value, hostFlags) })
+}
+
+func (p *RealFSProvider) Listxattr(path string) ([]string, error) {
+	var list []byte
+	err := p.xattrDo(path, func(fd int) (err error) {
+		list, err = readSized(func(dest []byte) (int, error) { return unix.Flistxattr(fd, dest) })
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(list), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (p *RealFSProvider) Removexattr(path, name string) error {
+	return p.xattrDo(path, func(fd int) error { return unix.Fremovexattr(fd, name) })
+}
+
+// hostDir serves hostFS calls by paths under a directory, following
+// symlinks wherever they lead.
+type hostDir string
+
+func (d hostDir) path(name string) string { return filepath.Join(string(d), name) }
+
+func (d hostDir) Stat(name string) (os.FileInfo, error)  { return os.Stat(d.path(name)) }
+func (d hostDir) Lstat(name string) (os.FileInfo, error) { return os.Lstat(d.path(name)) }
+func (d hostDir) OpenRoot(name string) (*os.Root, error) { return os.OpenRoot(d.path(name)) }
+func (d hostDir) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(d.path(name), perm)
+}
+func (d hostDir) Chmod(name string, mode os.FileMode) error { return os.Chmod(d.path(name), mode) }
+func (d hostDir) Chown(name string, uid, gid int) error     { return os.Chown(d.path(name), uid, gid) }
+func (d hostDir) Remove(name string) error                  { return os.Remove(d.path(name)) }
+func (d hostDir) RemoveAll(name string) error               { return os.RemoveAll(d.path(name)) }
+func (d hostDir) Readlink(name string) (string, error)      { return os.Readlink(d.path(name)) }
+func (d hostDir) Close() error                              { return nil }
+
+func (d hostDir) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(d.path(name), flag, perm)
+}
+
+func (d hostDir) Rename(oldname, newname string) error {
+	return os.Rename(d.path(oldname), d.path(newname))
+}
+
+func (d hostDir) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, d.path(newname))
 }
 
 type realHandle struct {
@@ -111,5 +343,5 @@ func (h *realHandle) Stat() (FileInfo, error) {
 	if err != nil {
 		return FileInfo{}, err
 	}
-	return NewFileInfo(info.Name(), info.Size(), info.Mode(), info.ModTime(), info.IsDir()), nil
+	return hostFileInfo(info), nil
 }
@@ -0,0 +1,146 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// escapeTree returns a mount dir holding symlinks out of it and the
+// directory outside they lead to, which holds a "secret" file.
+func escapeTree(t *testing.T) (dir, outside string) {
+	t.Helper()
+	dir, outside = t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("host secret"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dir, "abs-link")))
+	require.NoError(t, os.Symlink("../"+filepath.Base(outside)+"/secret", filepath.Join(dir, "rel-link")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "outdir")))
+	require.NoError(t, os.Symlink("notes.txt", filepath.Join(dir, "inside-link")))
+	return dir, outside
+}
+
+func TestRealFSProviderRefusesSymlinkEscape(t *testing.T) {
+	dir, outside := escapeTree(t)
+	p := NewRealFSProvider(dir)
+
+	for _, path := range []string{"/abs-link", "/rel-link", "/outdir/secret", "/../" + filepath.Base(outside) + "/secret"} {
+		_, err := p.Open(path, os.O_RDONLY, 0)
+		require.True(t, errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.ENOENT), "%s: %v", path, err)
+		_, err = p.Stat(path)
+		require.Error(t, err, path)
+	}
+	_, err := p.Create("/outdir/planted", 0644)
+	require.True(t, errors.Is(err, syscall.EACCES), "%v", err)
+	require.Error(t, p.Mkdir("/outdir/planted-dir", 0755))
+	require.Error(t, p.Rename("/notes.txt", "/outdir/notes.txt"))
+	require.Error(t, p.Chmod("/abs-link", 0777))
+	_, err = p.ReadDir("/outdir")
+	require.Error(t, err)
+
+	entries, err := os.ReadDir(outside)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "nothing may be written outside the mount")
+	info, err := os.Stat(filepath.Join(outside, "secret"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The links themselves can still be listed, read and removed.
+	target, err := p.Readlink("/abs-link")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(outside, "secret"), target)
+	entries2, err := p.ReadDir("/")
+	require.NoError(t, err)
+	for _, e := range entries2 {
+		if e.Name() == "outdir" {
+			assert.Equal(t, os.ModeSymlink, e.Type())
+		}
+	}
+	require.NoError(t, p.Remove("/abs-link"))
+	_, err = os.Stat(filepath.Join(outside, "secret"))
+	require.NoError(t, err)
+}
+
+func TestRealFSProviderFollowsSymlinksInside(t *testing.T) {
+	dir, _ := escapeTree(t)
+	p := NewRealFSProvider(dir)
+
+	h, err := p.Open("/inside-link", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	data, err := io.ReadAll(h)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+	assert.Equal(t, "notes", string(data))
+
+	// A link the guest creates may name anything, but is only followed
+	// within the mount.
+	require.NoError(t, p.Symlink("/etc/passwd", "/passwd"))
+	_, err = p.Open("/passwd", os.O_RDONLY, 0)
+	require.Error(t, err)
+}
+
+func TestUnconfinedRealFSProviderFollowsSymlinks(t *testing.T) {
+	dir, _ := escapeTree(t)
+	p := NewUnconfinedRealFSProvider(dir)
+
+	h, err := p.Open("/outdir/secret", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	data, err := io.ReadAll(h)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+	assert.Equal(t, "host secret", string(data))
+}
+
+func TestRealFSProviderSymlinkSwapRace(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("host secret"), 0600))
+	sub := filepath.Join(dir, "sub")
+	require.NoError(t, os.Mkdir(sub, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(sub, "secret"), []byte("inside"), 0644))
+	p := NewRealFSProvider(dir)
+
+	// Keep swapping sub between the real directory and a symlink out of
+	// the mount while the provider reads and writes through it.
+	link, parked := filepath.Join(dir, "link"), filepath.Join(dir, "parked")
+	require.NoError(t, os.Symlink(outside, link))
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for !stop.Load() {
+			os.Rename(sub, parked)
+			os.Rename(link, sub)
+			runtime.Gosched()
+			os.Rename(sub, link)
+			os.Rename(parked, sub)
+			runtime.Gosched()
+		}
+	}()
+
+	for i := 0; i < 2000; i++ {
+		if h, err := p.Open("/sub/secret", os.O_RDONLY, 0); err == nil {
+			data, err := io.ReadAll(h)
+			h.Close()
+			require.NoError(t, err)
+			require.Equal(t, "inside", string(data), "read through the swapped symlink")
+		}
+		if h, err := p.Create("/sub/planted", 0644); err == nil {
+			h.Close()
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	_, err := os.Stat(filepath.Join(outside, "planted"))
+	require.True(t, os.IsNotExist(err), "wrote through the swapped symlink")
+}
@@ -3,13 +3,21 @@ package vfs
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"syscall"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
 )
 
 type MountRouter struct {
-	mounts []mount
+	// mu guards mounts, which AddMount and RemoveMount change while the
+	// guest is using the router.
+	mu       sync.RWMutex
+	mounts   []mount
+	onChange func(Change)
 }
 
 type mount struct {
@@ -32,6 +40,8 @@ func (r *MountRouter) Readonly() bool { return false }
 
 func (r *MountRouter) resolve(path string) (Provider, string, error) {
 	path = filepath.Clean(path)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	for _, m := range r.mounts {
 		if path == m.path || strings.HasPrefix(path, m.path+"/") {
 			rel := strings.TrimPrefix(path, m.path)
@@ -78,7 +88,10 @@ func (r *MountRouter) ReadDir(path string) ([]DirEntry, error) {
 	}
 
 	var mountOnlyNames []string
-	for _, m := range r.mounts {
+	r.mu.RLock()
+	mounts := slices.Clone(r.mounts)
+	r.mu.RUnlock()
+	for _, m := range mounts {
 		if m.path == path || filepath.Dir(m.path) != path {
 			continue
 		}
@@ -89,8 +102,8 @@ func (r *MountRouter) ReadDir(path string) ([]DirEntry, error) {
 			continue
 		}
 
-		entryInfo := NewFileInfo(name, info.Size(), info.Mode(), info.ModTime(), info.IsDir())
-		byName[name] = NewDirEntry(name, info.IsDir(), info.Mode(), entryInfo)
+		info.name = name
+		byName[name] = NewDirEntry(name, info.IsDir(), info.Mode(), info)
 		if !seen[name] {
 			mountOnlyNames = append(mountOnlyNames, name)
 			seen[name] = true
@@ -112,7 +125,15 @@ func (r *MountRouter) Open(path string, flags int, mode os.FileMode) (Handle, er
 	if err != nil {
 		return nil, err
 	}
-	return p.Open(rel, flags, mode)
+	created := flags&os.O_CREATE != 0 && !r.exists(path)
+	h, err := p.Open(rel, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		r.notify(ChangeCreate, filepath.Clean(path), 0)
+	}
+	return r.watchHandle(h, filepath.Clean(path), flags), nil
 }
 
 func (r *MountRouter) Create(path string, mode os.FileMode) (Handle, error) {
@@ -120,7 +141,15 @@ func (r *MountRouter) Create(path string, mode os.FileMode) (Handle, error) {
 	if err != nil {
 		return nil, err
 	}
-	return p.Create(rel, mode)
+	created := !r.exists(path)
+	h, err := p.Create(rel, mode)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		r.notify(ChangeCreate, filepath.Clean(path), 0)
+	}
+	return r.watchHandle(h, filepath.Clean(path), os.O_RDWR), nil
 }
 
 func (r *MountRouter) Mkdir(path string, mode os.FileMode) error {
@@ -128,7 +157,11 @@ func (r *MountRouter) Mkdir(path string, mode os.FileMode) error {
 	if err != nil {
 		return err
 	}
-	return p.Mkdir(rel, mode)
+	if err := p.Mkdir(rel, mode); err != nil {
+		return err
+	}
+	r.notify(ChangeCreate, filepath.Clean(path), 0)
+	return nil
 }
 
 func (r *MountRouter) Chmod(path string, mode os.FileMode) error {
@@ -139,12 +172,25 @@ func (r *MountRouter) Chmod(path string, mode os.FileMode) error {
 	return p.Chmod(rel, mode)
 }
 
+// Chown changes the owner of path as the guest sees it; see Chown.
+func (r *MountRouter) Chown(path string, uid, gid int) error {
+	p, rel, err := r.resolve(path)
+	if err != nil {
+		return err
+	}
+	return Chown(p, rel, uid, gid)
+}
+
 func (r *MountRouter) Remove(path string) error {
 	p, rel, err := r.resolve(path)
 	if err != nil {
 		return err
 	}
-	return p.Remove(rel)
+	if err := p.Remove(rel); err != nil {
+		return err
+	}
+	r.notify(ChangeDelete, filepath.Clean(path), 0)
+	return nil
 }
 
 func (r *MountRouter) RemoveAll(path string) error {
@@ -152,7 +198,14 @@ func (r *MountRouter) RemoveAll(path string) error {
 	if err != nil {
 		return err
 	}
-	return p.RemoveAll(rel)
+	existed := r.onChange != nil && r.exists(path)
+	if err := p.RemoveAll(rel); err != nil {
+		return err
+	}
+	if existed {
+		r.notify(ChangeDelete, filepath.Clean(path), 0)
+	}
+	return nil
 }
 
 func (r *MountRouter) Rename(oldPath, newPath string) error {
@@ -167,7 +220,18 @@ func (r *MountRouter) Rename(oldPath, newPath string) error {
 	if oldP != newP {
 		return syscall.EXDEV
 	}
-	return oldP.Rename(oldRel, newRel)
+	if err := oldP.Rename(oldRel, newRel); err != nil {
+		return err
+	}
+	if r.onChange != nil {
+		var size int64
+		if info, err := r.Stat(newPath); err == nil && !info.IsDir() {
+			size = info.Size()
+		}
+		r.notify(ChangeDelete, filepath.Clean(oldPath), 0)
+		r.notify(ChangeCreate, filepath.Clean(newPath), size)
+	}
+	return nil
 }
 
 func (r *MountRouter) Symlink(target, link string) error {
@@ -175,7 +239,11 @@ func (r *MountRouter) Symlink(target, link string) error {
 	if err != nil {
 		return err
 	}
-	return p.Symlink(target, rel)
+	if err := p.Symlink(target, rel); err != nil {
+		return err
+	}
+	r.notify(ChangeCreate, filepath.Clean(link), 0)
+	return nil
 }
 
 func (r *MountRouter) Readlink(path string) (string, error) {
@@ -186,20 +254,92 @@ func (r *MountRouter) Readlink(path string) (string, error) {
 	return p.Readlink(rel)
 }
 
-func (r *MountRouter) AddMount(path string, provider Provider) {
+func (r *MountRouter) Getxattr(path, name string) ([]byte, error) {
+	p, rel, err := r.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	return Getxattr(p, rel, name)
+}
+
+func (r *MountRouter) Setxattr(path, name string, value []byte, flags int) error {
+	p, rel, err := r.resolve(path)
+	if err != nil {
+		return err
+	}
+	return Setxattr(p, rel, name, value, flags)
+}
+
+func (r *MountRouter) Listxattr(path string) ([]string, error) {
+	p, rel, err := r.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	return Listxattr(p, rel)
+}
+
+func (r *MountRouter) Removexattr(path, name string) error {
+	p, rel, err := r.resolve(path)
+	if err != nil {
+		return err
+	}
+	return Removexattr(p, rel, name)
+}
+
+// MountOf returns the path of the mount serving path, or "" if none does.
+func (r *MountRouter) MountOf(path string) string {
 	path = filepath.Clean(path)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, m := range r.mounts {
+		if path == m.path || strings.HasPrefix(path, m.path+"/") {
+			return m.path
+		}
+	}
+	return ""
+}
+
+// Mounts returns the mounted providers keyed by guest path.
+func (r *MountRouter) Mounts() map[string]Provider {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	mounts := make(map[string]Provider, len(r.mounts))
+	for _, m := range r.mounts {
+		mounts[m.path] = m.provider
+	}
+	return mounts
+}
+
+// AddMount mounts provider at path, which must not be mounted already. It
+// is safe to call while the router is in use; handles opened through a
+// mount it shadows keep working.
+func (r *MountRouter) AddMount(path string, provider Provider) error {
+	path = filepath.Clean(path)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.mounts {
+		if m.path == path {
+			return errx.With(ErrMountExists, ": %s", path)
+		}
+	}
 	r.mounts = append(r.mounts, mount{path: path, provider: provider})
 	sort.Slice(r.mounts, func(i, j int) bool {
 		return len(r.mounts[i].path) > len(r.mounts[j].path)
 	})
+	return nil
 }
 
-func (r *MountRouter) RemoveMount(path string) {
+// RemoveMount unmounts the provider at path. Handles already open on it
+// keep working until closed.
+func (r *MountRouter) RemoveMount(path string) error {
 	path = filepath.Clean(path)
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	for i, m := range r.mounts {
 		if m.path == path {
 			r.mounts = append(r.mounts[:i], r.mounts[i+1:]...)
-			return
+			return nil
 		}
 	}
+	return errx.With(ErrNotMounted, ": %s", path)
 }
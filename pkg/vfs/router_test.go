@@ -216,3 +216,34 @@ func TestMountRouter_ReadDirIncludesNestedDirMount(t *testing.T) {
 	}
 	require.True(t, found, "expected nested in /workspace listing, got %v entries", len(entries))
 }
+
+func TestMountRouter_OnChange(t *testing.T) {
+	router := NewMountRouter(map[string]Provider{"/workspace": NewMemoryProvider()})
+	var changes []Change
+	router.OnChange(func(c Change) { changes = append(changes, c) })
+
+	h, err := router.Create("/workspace/results.json", 0644)
+	require.NoError(t, err)
+	_, err = h.Write([]byte(`{"ok":true}`))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	// Reading does not count as a change.
+	h, err = router.Open("/workspace/results.json", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	require.NoError(t, router.Mkdir("/workspace/out", 0755))
+	require.NoError(t, router.Rename("/workspace/results.json", "/workspace/out/results.json"))
+	require.NoError(t, router.RemoveAll("/workspace/out"))
+	require.NoError(t, router.RemoveAll("/workspace/missing"))
+
+	assert.Equal(t, []Change{
+		{Op: ChangeCreate, Path: "/workspace/results.json"},
+		{Op: ChangeModify, Path: "/workspace/results.json", Size: 11},
+		{Op: ChangeCreate, Path: "/workspace/out"},
+		{Op: ChangeDelete, Path: "/workspace/results.json"},
+		{Op: ChangeCreate, Path: "/workspace/out/results.json", Size: 11},
+		{Op: ChangeDelete, Path: "/workspace/out"},
+	}, changes)
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/fxamacker/cbor/v2"
 )
@@ -34,6 +35,10 @@ const (
 	OpSymlink
 	OpReadlink
 	OpLink
+	OpGetxattr
+	OpSetxattr
+	OpListxattr
+	OpRemovexattr
 )
 
 type VFSRequest struct {
@@ -46,6 +51,7 @@ type VFSRequest struct {
 	Data    []byte `cbor:"data,omitempty"`
 	Flags   uint32 `cbor:"flags,omitempty"`
 	Mode    uint32 `cbor:"mode,omitempty"`
+	Name    string `cbor:"name,omitempty"`
 }
 
 type VFSResponse struct {
@@ -62,6 +68,8 @@ type VFSStat struct {
 	Mode    uint32 `cbor:"mode"`
 	ModTime int64  `cbor:"mtime"`
 	IsDir   bool   `cbor:"is_dir"`
+	UID     uint32 `cbor:"uid,omitempty"`
+	GID     uint32 `cbor:"gid,omitempty"`
 }
 
 type VFSDirEntry struct {
@@ -75,12 +83,26 @@ type VFSServer struct {
 	provider Provider
 	handles  sync.Map
 	nextFH   uint64
+	metrics  *Metrics
+}
+
+// openHandle is an open handle of the server, with the path it was opened
+// at for the metrics of operations on it.
+type openHandle struct {
+	Handle
+	path string
 }
 
 func NewVFSServer(provider Provider) *VFSServer {
 	return &VFSServer{provider: provider}
 }
 
+// SetMetrics makes the server record the operations it serves in m. Call
+// it before serving.
+func (s *VFSServer) SetMetrics(m *Metrics) {
+	s.metrics = m
+}
+
 func (s *VFSServer) Serve(listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
@@ -130,6 +152,26 @@ func (s *VFSServer) HandleConnection(conn net.Conn) {
 }
 
 func (s *VFSServer) dispatch(req *VFSRequest) *VFSResponse {
+	if s.metrics == nil {
+		return s.serve(req)
+	}
+	path := req.Path
+	if hi, ok := s.handles.Load(req.Handle); ok && req.Handle != 0 {
+		path = hi.(*openHandle).path
+	}
+	start := time.Now()
+	resp := s.serve(req)
+	d := time.Since(start)
+
+	mount := "/"
+	if r, ok := s.provider.(*MountRouter); ok {
+		mount = r.MountOf(path)
+	}
+	s.metrics.record(mount, req.Op, path, int64(len(resp.Data))+int64(resp.Written), d, resp.Err)
+	return resp
+}
+
+func (s *VFSServer) serve(req *VFSRequest) *VFSResponse {
 	switch req.Op {
 	case OpLookup, OpGetattr:
 		info, err := s.provider.Stat(req.Path)
@@ -154,7 +196,7 @@ func (s *VFSServer) dispatch(req *VFSRequest) *VFSResponse {
 			return &VFSResponse{Err: errnoFromError(err)}
 		}
 		fh := atomic.AddUint64(&s.nextFH, 1)
-		s.handles.Store(fh, h)
+		s.handles.Store(fh, &openHandle{Handle: h, path: req.Path})
 		return &VFSResponse{Handle: fh}
 
 	case OpCreate:
@@ -163,7 +205,7 @@ func (s *VFSServer) dispatch(req *VFSRequest) *VFSResponse {
 			return &VFSResponse{Err: errnoFromError(err)}
 		}
 		fh := atomic.AddUint64(&s.nextFH, 1)
-		s.handles.Store(fh, h)
+		s.handles.Store(fh, &openHandle{Handle: h, path: req.Path})
 		return &VFSResponse{Handle: fh}
 
 	case OpRead:
@@ -244,6 +286,36 @@ func (s *VFSServer) dispatch(req *VFSRequest) *VFSResponse {
 		}
 		return &VFSResponse{}
 
+	case OpGetxattr:
+		value, err := Getxattr(s.provider, req.Path, req.Name)
+		if err != nil {
+			return &VFSResponse{Err: xattrErrno(err)}
+		}
+		return &VFSResponse{Data: value}
+
+	case OpSetxattr:
+		if err := Setxattr(s.provider, req.Path, req.Name, req.Data, int(req.Flags)); err != nil {
+			return &VFSResponse{Err: xattrErrno(err)}
+		}
+		return &VFSResponse{}
+
+	case OpListxattr:
+		names, err := Listxattr(s.provider, req.Path)
+		if err != nil {
+			return &VFSResponse{Err: xattrErrno(err)}
+		}
+		var list []byte
+		for _, name := range names {
+			list = append(append(list, name...), 0)
+		}
+		return &VFSResponse{Data: list}
+
+	case OpRemovexattr:
+		if err := Removexattr(s.provider, req.Path, req.Name); err != nil {
+			return &VFSResponse{Err: xattrErrno(err)}
+		}
+		return &VFSResponse{}
+
 	default:
 		return &VFSResponse{Err: -int32(syscall.ENOSYS)}
 	}
@@ -269,11 +341,14 @@ func errnoFromError(err error) int32 {
 }
 
 func statFromInfo(info FileInfo) *VFSStat {
+	uid, gid := info.Owner()
 	return &VFSStat{
 		Size:    info.Size(),
 		Mode:    uint32(info.Mode()),
 		ModTime: info.ModTime().Unix(),
 		IsDir:   info.IsDir(),
+		UID:     uid,
+		GID:     gid,
 	}
 }
 
@@ -0,0 +1,70 @@
+package vfs
+
+import (
+	"io"
+)
+
+// sparseBlockSize is the granularity at which CopySparse looks for zeros;
+// it matches the block size of the filesystems holes are made in.
+const sparseBlockSize = 4096
+
+// SparseWriter is a destination CopySparse can leave holes in, such as a
+// Handle or an *os.File.
+type SparseWriter interface {
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// CopySparse copies src into dst from offset 0 and returns the bytes
+// copied. Blocks of src that are all zeros are skipped rather than
+// written, so a filesystem that supports holes leaves them unallocated;
+// dst is truncated to the full length at the end so trailing zeros still
+// count toward its size. dst should be empty, as skipped blocks are not
+// cleared.
+func CopySparse(dst SparseWriter, src io.Reader) (int64, error) {
+	buf := make([]byte, 64*sparseBlockSize)
+	var off int64
+	for {
+		n, err := io.ReadFull(src, buf)
+		for start := 0; start < n; {
+			end := min(start+sparseBlockSize, n)
+			if IsZero(buf[start:end]) {
+				start = end
+				continue
+			}
+			// Coalesce a run of data blocks into one write.
+			for end < n {
+				next := min(end+sparseBlockSize, n)
+				if IsZero(buf[end:next]) {
+					break
+				}
+				end = next
+			}
+			if _, werr := dst.WriteAt(buf[start:end], off+int64(start)); werr != nil {
+				return off + int64(start), werr
+			}
+			start = end
+		}
+		off += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return off, err
+		}
+	}
+	if err := dst.Truncate(off); err != nil {
+		return off, err
+	}
+	return off, nil
+}
+
+// IsZero reports whether b holds only zero bytes, as a hole reads.
+func IsZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package vfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sparseContent() []byte {
+	content := make([]byte, 1<<20)
+	copy(content, "header")
+	copy(content[300*1024:], "middle")
+	return content
+}
+
+func TestCopySparse(t *testing.T) {
+	content := sparseContent()
+	dir := t.TempDir()
+	p := NewRealFSProvider(dir)
+
+	h, err := p.Create("/disk.img", 0644)
+	require.NoError(t, err)
+	n, err := CopySparse(h, bytes.NewReader(content))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+	assert.Equal(t, int64(len(content)), n)
+
+	got, err := os.ReadFile(filepath.Join(dir, "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	info, err := os.Stat(filepath.Join(dir, "disk.img"))
+	require.NoError(t, err)
+	allocated := info.Sys().(*syscall.Stat_t).Blocks * 512
+	assert.Less(t, allocated, int64(len(content))/2, "zero blocks should be left as holes")
+}
+
+func TestCopySparseTrailingHole(t *testing.T) {
+	p := NewMemoryProvider()
+	content := append([]byte("data"), make([]byte, 3*sparseBlockSize)...)
+
+	h, err := p.Create("/f", 0644)
+	require.NoError(t, err)
+	_, err = CopySparse(h, bytes.NewReader(content))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	info, err := p.Stat("/f")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size())
+}
+
+func TestOverlayCopyUpKeepsHoles(t *testing.T) {
+	content := sparseContent()
+	lowerDir, upperDir := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(lowerDir, "db.sqlite"), content, 0644))
+	p := NewOverlayProvider(NewRealFSProvider(upperDir), NewRealFSProvider(lowerDir))
+
+	h, err := p.Open("/db.sqlite", os.O_RDWR, 0)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	info, err := os.Stat(filepath.Join(upperDir, "db.sqlite"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size())
+	allocated := info.Sys().(*syscall.Stat_t).Blocks * 512
+	assert.Less(t, allocated, int64(len(content))/2)
+}
@@ -0,0 +1,213 @@
+package vfs
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+// MkdirAll creates the directory path in p along with any missing parents.
+func MkdirAll(p Provider, dir string, mode os.FileMode) error {
+	dir = path.Clean(dir)
+	if info, err := p.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return syscall.ENOTDIR
+		}
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := MkdirAll(p, parent, mode); err != nil {
+			return err
+		}
+	}
+	if err := p.Mkdir(dir, mode); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+	return nil
+}
+
+// WriteTar writes the tree at root in p to w as a tar stream, with entries
+// named relative to root. A regular file at root is a single entry named
+// after it. Symlinks are written as links, not followed.
+func WriteTar(p Provider, root string, w io.Writer) error {
+	root = path.Clean(root)
+	info, err := p.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if info.IsDir() {
+		err = writeTarDir(tw, p, root, "")
+	} else {
+		err = writeTarEntry(tw, p, root, path.Base(root), info)
+	}
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeTarDir(tw *tar.Writer, p Provider, dir, name string) error {
+	entries, err := p.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		entryName := path.Join(name, e.Name())
+		if err := writeTarEntry(tw, p, path.Join(dir, e.Name()), entryName, info); err != nil {
+			return err
+		}
+		if e.IsDir() && e.Type()&fs.ModeSymlink == 0 {
+			if err := writeTarDir(tw, p, path.Join(dir, e.Name()), entryName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeTarEntry(tw *tar.Writer, p Provider, src, name string, info fs.FileInfo) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(info.Mode().Perm()),
+		ModTime: info.ModTime(),
+	}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := p.Readlink(src)
+		if err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = target
+		return tw.WriteHeader(hdr)
+	case info.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		return tw.WriteHeader(hdr)
+	case info.Mode().IsRegular():
+		h, err := p.Open(src, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer h.Close()
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.CopyN(tw, h, info.Size())
+		return err
+	}
+	// Devices, sockets and pipes have no content to copy.
+	return nil
+}
+
+// ExtractTar extracts the tar stream r into the directory root in p,
+// creating it and any missing parents. Regular files, directories and
+// symlinks are extracted; other entries are skipped. An entry that would
+// land outside root, by its name or through a symlink extracted before it,
+// fails the extraction.
+func ExtractTar(p Provider, root string, r io.Reader) error {
+	root = path.Clean(root)
+	if err := MkdirAll(p, root, 0755); err != nil {
+		return err
+	}
+
+	links := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		if !safeTarName(hdr.Name, name, links) {
+			return errx.With(ErrTarEntry, ": %q", hdr.Name)
+		}
+		dest := path.Join(root, name)
+		mode := os.FileMode(hdr.Mode).Perm()
+		// Replace a symlink extracted earlier rather than write through it.
+		if links[name] {
+			if err := p.Remove(dest); err != nil {
+				return err
+			}
+			delete(links, name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := MkdirAll(p, dest, mode); err != nil {
+				return err
+			}
+			if err := p.Chmod(dest, mode); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := MkdirAll(p, path.Dir(dest), 0755); err != nil {
+				return err
+			}
+			h, err := p.Create(dest, mode)
+			if err != nil {
+				return err
+			}
+			_, err = CopySparse(h, tr)
+			if cerr := h.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			if err := p.Chmod(dest, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := MkdirAll(p, path.Dir(dest), 0755); err != nil {
+				return err
+			}
+			if err := p.Remove(dest); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			if err := p.Symlink(hdr.Linkname, dest); err != nil {
+				return err
+			}
+			links[name] = true
+		}
+	}
+}
+
+// safeTarName reports whether the tar entry raw, cleaned to name, stays
+// within the extraction root: it has no ".." element and no parent that
+// is one of the symlinks extracted so far.
+func safeTarName(raw, name string, links map[string]bool) bool {
+	for _, elem := range strings.Split(raw, "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		if links[dir] {
+			return false
+		}
+	}
+	return true
+}
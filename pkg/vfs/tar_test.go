@@ -0,0 +1,110 @@
+package vfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub/deep"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a.txt"), []byte("alpha"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "sub/deep/run.sh"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.Symlink("../a.txt", filepath.Join(src, "sub/link")))
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteTar(NewRealFSProvider(src), "/", &buf))
+
+	dest := t.TempDir()
+	require.NoError(t, ExtractTar(NewRealFSProvider(dest), "/out", &buf))
+
+	data, err := os.ReadFile(filepath.Join(dest, "out/a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "alpha", string(data))
+	info, err := os.Stat(filepath.Join(dest, "out/sub/deep/run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	target, err := os.Readlink(filepath.Join(dest, "out/sub/link"))
+	require.NoError(t, err)
+	assert.Equal(t, "../a.txt", target)
+}
+
+func TestTarRoundTripThroughMemory(t *testing.T) {
+	mp := NewMemoryProvider()
+	router := NewMountRouter(map[string]Provider{"/workspace": mp})
+
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "pkg"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "pkg/main.go"), []byte("package main"), 0600))
+
+	var in bytes.Buffer
+	require.NoError(t, WriteTar(NewRealFSProvider(src), "/", &in))
+	require.NoError(t, ExtractTar(router, "/workspace/project", &in))
+
+	data, err := mp.ReadFile("/project/pkg/main.go")
+	require.NoError(t, err)
+	assert.Equal(t, "package main", string(data))
+
+	var out bytes.Buffer
+	require.NoError(t, WriteTar(router, "/workspace/project/pkg/main.go", &out))
+	dest := t.TempDir()
+	require.NoError(t, ExtractTar(NewRealFSProvider(dest), "/", &out))
+	data, err = os.ReadFile(filepath.Join(dest, "main.go"))
+	require.NoError(t, err, "a file is copied into the destination directory")
+	assert.Equal(t, "package main", string(data))
+}
+
+func TestExtractTarRejectsEscapes(t *testing.T) {
+	tests := map[string][]tar.Header{
+		"dot-dot": {
+			{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"through symlink": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/tmp"},
+			{Name: "link/evil", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	}
+	for name, hdrs := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, hdr := range hdrs {
+				require.NoError(t, tw.WriteHeader(&hdr))
+			}
+			require.NoError(t, tw.Close())
+
+			root := t.TempDir()
+			err := ExtractTar(NewRealFSProvider(root), "/dest", &buf)
+			require.ErrorIs(t, err, ErrTarEntry)
+		})
+	}
+}
+
+func TestExtractTarReplacesSymlink(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "target")
+	require.NoError(t, os.WriteFile(outside, []byte("keep"), 0644))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "f", Typeflag: tar.TypeSymlink, Linkname: outside}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "f", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}))
+	_, err := tw.Write([]byte("new"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	root := t.TempDir()
+	require.NoError(t, ExtractTar(NewRealFSProvider(root), "/", &buf))
+
+	data, err := os.ReadFile(outside)
+	require.NoError(t, err)
+	assert.Equal(t, "keep", string(data), "the symlink's target is untouched")
+	data, err = os.ReadFile(filepath.Join(root, "f"))
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+}
@@ -0,0 +1,121 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+)
+
+// Flags of a Setxattr, with the values the guest passes them as.
+const (
+	XattrCreate  = 0x1 // fail with EEXIST if the attribute exists
+	XattrReplace = 0x2 // fail with ENODATA if it does not
+)
+
+// XattrProvider is implemented by providers that keep extended attributes
+// on their files, such as RealFSProvider on a host filesystem that supports
+// them. POSIX ACLs are the system.posix_acl_access and
+// system.posix_acl_default attributes. The attribute calls of a provider
+// that does not implement it fail with ENOTSUP.
+type XattrProvider interface {
+	Getxattr(path, name string) ([]byte, error)
+	// Setxattr sets the attribute name to value; flags is a combination
+	// of XattrCreate and XattrReplace.
+	Setxattr(path, name string, value []byte, flags int) error
+	Listxattr(path string) ([]string, error)
+	Removexattr(path, name string) error
+}
+
+// Getxattr returns the attribute name of path in p.
+func Getxattr(p Provider, path, name string) ([]byte, error) {
+	if x, ok := p.(XattrProvider); ok {
+		return x.Getxattr(path, name)
+	}
+	return nil, syscall.ENOTSUP
+}
+
+// Setxattr sets the attribute name of path in p.
+func Setxattr(p Provider, path, name string, value []byte, flags int) error {
+	if x, ok := p.(XattrProvider); ok {
+		return x.Setxattr(path, name, value, flags)
+	}
+	return syscall.ENOTSUP
+}
+
+// Listxattr returns the names of the attributes of path in p.
+func Listxattr(p Provider, path string) ([]string, error) {
+	if x, ok := p.(XattrProvider); ok {
+		return x.Listxattr(path)
+	}
+	return nil, syscall.ENOTSUP
+}
+
+// Removexattr removes the attribute name of path in p.
+func Removexattr(p Provider, path, name string) error {
+	if x, ok := p.(XattrProvider); ok {
+		return x.Removexattr(path, name)
+	}
+	return syscall.ENOTSUP
+}
+
+// Errnos the guest expects for a missing attribute and for a file without
+// attribute support, which differ on macOS hosts (ENOATTR and ENOTSUP).
+const (
+	guestENODATA    = 61
+	guestEOPNOTSUPP = 95
+)
+
+// xattrErrno is errnoFromError for attribute calls, answering the guest
+// with its own errnos for a missing attribute and missing support.
+func xattrErrno(err error) int32 {
+	switch {
+	case errors.Is(err, errNoAttr):
+		return -guestENODATA
+	case errors.Is(err, syscall.ENOTSUP), errors.Is(err, syscall.EOPNOTSUPP):
+		return -guestEOPNOTSUPP
+	}
+	return errnoFromError(err)
+}
+
+// POSIX ACL attributes hold a 4-byte version followed by 8-byte entries of
+// a 16-bit tag, 16-bit permissions and a 32-bit id, all little-endian. Only
+// named user and group entries carry an id.
+const (
+	aclAccess     = "system.posix_acl_access"
+	aclDefault    = "system.posix_acl_default"
+	aclHeaderSize = 4
+	aclEntrySize  = 8
+	aclUser       = 0x02
+	aclGroup      = 0x08
+)
+
+func isACL(name string) bool {
+	return name == aclAccess || name == aclDefault
+}
+
+// mapACL returns a copy of the ACL value with the ids of its named user and
+// group entries mapped by uid and gid. It fails with EINVAL if the value is
+// malformed or an id has no mapping.
+func mapACL(value []byte, uid, gid func(uint32) (uint32, bool)) ([]byte, error) {
+	if len(value) < aclHeaderSize || (len(value)-aclHeaderSize)%aclEntrySize != 0 {
+		return nil, syscall.EINVAL
+	}
+	mapped := append([]byte(nil), value...)
+	for off := aclHeaderSize; off < len(mapped); off += aclEntrySize {
+		var fn func(uint32) (uint32, bool)
+		switch binary.LittleEndian.Uint16(mapped[off:]) {
+		case aclUser:
+			fn = uid
+		case aclGroup:
+			fn = gid
+		default:
+			continue
+		}
+		id, ok := fn(binary.LittleEndian.Uint32(mapped[off+4:]))
+		if !ok {
+			return nil, syscall.EINVAL
+		}
+		binary.LittleEndian.PutUint32(mapped[off+4:], id)
+	}
+	return mapped, nil
+}
@@ -0,0 +1,6 @@
+package vfs
+
+import "golang.org/x/sys/unix"
+
+// errNoAttr is the errno the host answers a missing attribute with.
+const errNoAttr = unix.ENODATA
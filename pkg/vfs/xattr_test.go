@@ -0,0 +1,153 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// xattrDir returns a host directory holding main.go, skipping the test if
+// its filesystem keeps no user attributes.
+func xattrDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main"), 0644))
+	err := NewRealFSProvider(dir).Setxattr("/main.go", "user.probe", []byte("1"), 0)
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("host filesystem has no user xattrs")
+	}
+	require.NoError(t, err)
+	return dir
+}
+
+func TestRealFSProviderXattrs(t *testing.T) {
+	p := NewRealFSProvider(xattrDir(t))
+
+	require.NoError(t, p.Setxattr("/main.go", "user.origin", []byte("https://example.com"), XattrCreate))
+	assert.ErrorIs(t, p.Setxattr("/main.go", "user.origin", []byte("again"), XattrCreate), syscall.EEXIST)
+
+	value, err := p.Getxattr("/main.go", "user.origin")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com", string(value))
+
+	names, err := p.Listxattr("/main.go")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"user.probe", "user.origin"}, names)
+
+	require.NoError(t, p.Removexattr("/main.go", "user.origin"))
+	_, err = p.Getxattr("/main.go", "user.origin")
+	assert.ErrorIs(t, err, errNoAttr)
+}
+
+func TestRealFSProviderXattrsStayConfined(t *testing.T) {
+	dir := xattrDir(t)
+	outside := filepath.Join(t.TempDir(), "outside")
+	require.NoError(t, os.WriteFile(outside, nil, 0644))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "escape")))
+
+	err := NewRealFSProvider(dir).Setxattr("/escape", "user.x", []byte("1"), 0)
+	assert.ErrorIs(t, err, syscall.EACCES)
+}
+
+func TestVFSServerXattrs(t *testing.T) {
+	router := NewMountRouter(map[string]Provider{
+		"/workspace": NewRealFSProvider(xattrDir(t)),
+		"/scratch":   NewMemoryProvider(),
+		"/ro":        NewReadonlyProvider(NewRealFSProvider(xattrDir(t))),
+	})
+	s := NewVFSServer(router)
+
+	resp := s.dispatch(&VFSRequest{Op: OpSetxattr, Path: "/workspace/main.go", Name: "user.tag", Data: []byte("v1")})
+	require.Zero(t, resp.Err)
+	resp = s.dispatch(&VFSRequest{Op: OpGetxattr, Path: "/workspace/main.go", Name: "user.tag"})
+	require.Zero(t, resp.Err)
+	assert.Equal(t, "v1", string(resp.Data))
+	resp = s.dispatch(&VFSRequest{Op: OpListxattr, Path: "/workspace/main.go"})
+	require.Zero(t, resp.Err)
+	assert.ElementsMatch(t, []string{"user.probe", "user.tag"}, splitNames(resp.Data))
+
+	assert.Equal(t, int32(-guestENODATA), s.dispatch(&VFSRequest{Op: OpGetxattr, Path: "/workspace/main.go", Name: "user.missing"}).Err)
+	assert.Equal(t, int32(-guestEOPNOTSUPP), s.dispatch(&VFSRequest{Op: OpGetxattr, Path: "/scratch", Name: "user.tag"}).Err)
+	assert.Equal(t, -int32(syscall.EROFS), s.dispatch(&VFSRequest{Op: OpSetxattr, Path: "/ro/main.go", Name: "user.tag", Data: []byte("v")}).Err)
+}
+
+func splitNames(list []byte) []string {
+	var names []string
+	start := 0
+	for i, b := range list {
+		if b == 0 {
+			names = append(names, string(list[start:i]))
+			start = i + 1
+		}
+	}
+	return names
+}
+
+func TestExcludeProviderHidesXattrs(t *testing.T) {
+	dir := xattrDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".env"), nil, 0600))
+	p := NewExcludeProvider(NewRealFSProvider(dir), []string{".env"})
+
+	_, err := p.Listxattr("/.env")
+	assert.ErrorIs(t, err, syscall.ENOENT)
+	assert.ErrorIs(t, p.Setxattr("/.env", "user.x", nil, 0), syscall.ENOENT)
+}
+
+// xattrStub keeps attributes in memory, for checking what wrappers pass on.
+type xattrStub struct {
+	*MemoryProvider
+	attrs map[string][]byte
+}
+
+func (p *xattrStub) Getxattr(path, name string) ([]byte, error) {
+	if v, ok := p.attrs[name]; ok {
+		return v, nil
+	}
+	return nil, errNoAttr
+}
+
+func (p *xattrStub) Setxattr(path, name string, value []byte, flags int) error {
+	p.attrs[name] = value
+	return nil
+}
+
+func (p *xattrStub) Listxattr(path string) ([]string, error) { return nil, nil }
+func (p *xattrStub) Removexattr(path, name string) error     { return nil }
+
+func acl(entries ...[3]uint32) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, 2)
+	for _, e := range entries {
+		b = binary.LittleEndian.AppendUint16(b, uint16(e[0]))
+		b = binary.LittleEndian.AppendUint16(b, uint16(e[1]))
+		b = binary.LittleEndian.AppendUint32(b, e[2])
+	}
+	return b
+}
+
+func TestIDMapProviderMapsACLIDs(t *testing.T) {
+	const undefined = 0xffffffff
+	stub := &xattrStub{MemoryProvider: NewMemoryProvider(), attrs: map[string][]byte{}}
+	p := NewIDMapProvider(stub, IDMap{HostUID: 501, HostGID: 20, GuestUID: 1000, GuestGID: 1000})
+
+	require.NoError(t, p.Setxattr("/f", aclAccess, acl([3]uint32{0x01, 6, undefined}, [3]uint32{aclUser, 4, 1000}, [3]uint32{aclGroup, 4, 1000}), 0))
+	assert.Equal(t, acl([3]uint32{0x01, 6, undefined}, [3]uint32{aclUser, 4, 501}, [3]uint32{aclGroup, 4, 20}), stub.attrs[aclAccess])
+
+	assert.ErrorIs(t, p.Setxattr("/f", aclAccess, acl([3]uint32{aclUser, 4, 0}), 0), syscall.EINVAL)
+	assert.ErrorIs(t, p.Setxattr("/f", aclDefault, []byte{2, 0, 0}, 0), syscall.EINVAL)
+
+	stub.attrs[aclDefault] = acl([3]uint32{aclUser, 7, 501}, [3]uint32{aclUser, 7, 0})
+	value, err := p.Getxattr("/f", aclDefault)
+	require.NoError(t, err)
+	assert.Equal(t, acl([3]uint32{aclUser, 7, 1000}, [3]uint32{aclUser, 7, OverflowID}), value)
+
+	stub.attrs["user.note"] = []byte{1, 2, 3}
+	value, err = p.Getxattr("/f", "user.note")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, value, "other attributes are passed as they are")
+}
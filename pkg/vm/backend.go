@@ -2,6 +2,7 @@ package vm
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"strings"
 
@@ -13,6 +14,16 @@ type DiskConfig struct {
 	HostPath   string // Path to the ext4 image on the host
 	GuestMount string // Mount point inside the guest (e.g., "/var/lib/buildkit")
 	ReadOnly   bool
+	Swap       bool // Enable as guest swap instead of mounting
+	Upper      bool // Overlay upper disk of a read-only rootfs
+}
+
+// SharedDir is a host directory shared with the guest over virtio-fs.
+type SharedDir struct {
+	Tag        string // virtio-fs tag the guest mounts it by
+	HostPath   string
+	GuestMount string // Mount point inside the guest, over its VFS mount
+	ReadOnly   bool
 }
 
 type VMConfig struct {
@@ -20,6 +31,7 @@ type VMConfig struct {
 	KernelPath      string
 	InitramfsPath   string // Optional initramfs/initrd path
 	RootfsPath      string
+	RootfsReadOnly  bool // Attach the rootfs read-only (erofs/squashfs images)
 	CPUs            int
 	MemoryMB        int
 	NetworkFD       int
@@ -38,6 +50,12 @@ type VMConfig struct {
 	DNSServers      []string     // DNS servers for the guest (default: 8.8.8.8, 8.8.4.4)
 	PrebuiltRootfs  string       // Pre-prepared rootfs path (skips internal copy if set)
 	ExtraDisks      []DiskConfig // Additional block devices to attach
+	SharedDirs      []SharedDir  // virtio-fs shares; only for a SharedDirBackend
+	ZramSwapMB      int          // Size of the guest's zram swap device (0 = none)
+
+	// LogFilter, if set, wraps the VM log writer (e.g. to redact secrets).
+	// The returned writer is closed once the VM has exited.
+	LogFilter func(io.Writer) io.WriteCloser
 }
 
 type Backend interface {
@@ -45,6 +63,13 @@ type Backend interface {
 	Name() string
 }
 
+// SharedDirBackend is implemented by backends that can attach
+// VMConfig.SharedDirs. Other backends serve every mount over FUSE.
+type SharedDirBackend interface {
+	Backend
+	SupportsSharedDirs() bool
+}
+
 type Machine interface {
 	Start(ctx context.Context) error
 	Stop(ctx context.Context) error
@@ -57,6 +82,15 @@ type Machine interface {
 	RootfsPath() string // Returns the path to the VM's rootfs (may be a temp copy)
 }
 
+// FreezingMachine is implemented by machines whose guest filesystems can be
+// frozen, so that their disks can be copied whole while they run.
+type FreezingMachine interface {
+	Machine
+	// FreezeFS flushes the guest filesystem mounted at path to its disk and
+	// holds back writes to it until thaw is called.
+	FreezeFS(ctx context.Context, path string) (thaw func(), err error)
+}
+
 type InteractiveMachine interface {
 	Machine
 	ExecInteractive(ctx context.Context, command string, opts *api.ExecOptions, rows, cols uint16, stdin io.Reader, stdout io.Writer, resizeCh <-chan [2]uint16) (int, error)
@@ -76,6 +110,41 @@ func KernelIPDNSSuffix(dnsServers []string) string {
 	return sb.String()
 }
 
+// KernelDiskParams returns the cmdline params for the extra disks, which are
+// attached as vdb, vdc, ... in order: matchlock.disk.vdX=<mount> for mounted
+// disks, matchlock.swap=/dev/vdX for a swap disk and matchlock.upper=/dev/vdX
+// for the overlay upper disk of a read-only rootfs. A positive zramMB adds
+// matchlock.swap=zram:<MB> instead.
+func KernelDiskParams(disks []DiskConfig, zramMB int) string {
+	var sb strings.Builder
+	for i, disk := range disks {
+		dev := "vd" + string(rune('b'+i))
+		if disk.Swap {
+			fmt.Fprintf(&sb, " matchlock.swap=/dev/%s", dev)
+			continue
+		}
+		if disk.Upper {
+			fmt.Fprintf(&sb, " matchlock.upper=/dev/%s", dev)
+			continue
+		}
+		fmt.Fprintf(&sb, " matchlock.disk.%s=%s", dev, disk.GuestMount)
+	}
+	if zramMB > 0 {
+		fmt.Fprintf(&sb, " matchlock.swap=zram:%d", zramMB)
+	}
+	return sb.String()
+}
+
+// KernelSharedDirParams returns the cmdline params that have the guest mount
+// the virtio-fs shares: matchlock.virtiofs.<tag>=<mount>.
+func KernelSharedDirParams(dirs []SharedDir) string {
+	var sb strings.Builder
+	for _, dir := range dirs {
+		fmt.Fprintf(&sb, " matchlock.virtiofs.%s=%s", dir.Tag, dir.GuestMount)
+	}
+	return sb.String()
+}
+
 // KernelDNSParam returns a comma-separated DNS list for the matchlock.dns= cmdline param.
 func KernelDNSParam(dnsServers []string) string {
 	return strings.Join(dnsServers, ",")
@@ -0,0 +1,29 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKernelDiskParams(t *testing.T) {
+	disks := []DiskConfig{
+		{HostPath: "/data.ext4", GuestMount: "/var/lib/data"},
+		{HostPath: "/swap.img", Swap: true},
+	}
+	assert.Equal(t, " matchlock.disk.vdb=/var/lib/data matchlock.swap=/dev/vdc", KernelDiskParams(disks, 0))
+	assert.Equal(t, " matchlock.swap=zram:256", KernelDiskParams(nil, 256))
+	assert.Empty(t, KernelDiskParams(nil, 0))
+
+	upper := []DiskConfig{{HostPath: "/upper.ext4", Upper: true}, {HostPath: "/data.ext4", GuestMount: "/data"}}
+	assert.Equal(t, " matchlock.upper=/dev/vdb matchlock.disk.vdc=/data", KernelDiskParams(upper, 0))
+}
+
+func TestKernelSharedDirParams(t *testing.T) {
+	dirs := []SharedDir{
+		{Tag: "share0", HostPath: "/src", GuestMount: "/workspace/src"},
+		{Tag: "share1", HostPath: "/cache", GuestMount: "/workspace/cache", ReadOnly: true},
+	}
+	assert.Equal(t, " matchlock.virtiofs.share0=/workspace/src matchlock.virtiofs.share1=/workspace/cache", KernelSharedDirParams(dirs))
+	assert.Empty(t, KernelSharedDirParams(nil))
+}
@@ -30,6 +30,12 @@ func (b *DarwinBackend) Name() string {
 	return "virtualization.framework"
 }
 
+// SupportsSharedDirs reports that Virtualization.framework can attach
+// VMConfig.SharedDirs as virtio-fs devices.
+func (b *DarwinBackend) SupportsSharedDirs() bool {
+	return true
+}
+
 func (b *DarwinBackend) Create(ctx context.Context, config *vm.VMConfig) (vm.Machine, error) {
 	// Verify files exist
 	if _, err := os.Stat(config.KernelPath); err != nil {
@@ -100,6 +106,12 @@ func (b *DarwinBackend) Create(ctx context.Context, config *vm.VMConfig) (vm.Mac
 		return nil, errx.Wrap(ErrStorageConfig, err)
 	}
 
+	if err := b.configureSharedDirs(vzConfig, config.SharedDirs); err != nil {
+		os.Remove(tempRootfs)
+		socketPair.Close()
+		return nil, err
+	}
+
 	if err := b.configureNetwork(vzConfig, socketPair, config.UseInterception); err != nil {
 		os.Remove(tempRootfs)
 		socketPair.Close()
@@ -168,11 +180,7 @@ func (b *DarwinBackend) buildKernelArgs(config *vm.VMConfig) string {
 		privilegedArg = " matchlock.privileged=1"
 	}
 
-	diskArgs := ""
-	for i, disk := range config.ExtraDisks {
-		dev := string(rune('b' + i))
-		diskArgs += fmt.Sprintf(" matchlock.disk.vd%s=%s", dev, disk.GuestMount)
-	}
+	diskArgs := vm.KernelDiskParams(config.ExtraDisks, config.ZramSwapMB) + vm.KernelSharedDirParams(config.SharedDirs)
 
 	if config.UseInterception {
 		guestIP := config.GuestIP
@@ -236,6 +244,33 @@ func (b *DarwinBackend) configureStorage(vzConfig *vz.VirtualMachineConfiguratio
 	return nil
 }
 
+func (b *DarwinBackend) configureSharedDirs(vzConfig *vz.VirtualMachineConfiguration, dirs []vm.SharedDir) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	devices := make([]vz.DirectorySharingDeviceConfiguration, 0, len(dirs))
+	for _, dir := range dirs {
+		shared, err := vz.NewSharedDirectory(dir.HostPath, dir.ReadOnly)
+		if err != nil {
+			return errx.With(ErrSharedDir, ": %s: %w", dir.HostPath, err)
+		}
+		share, err := vz.NewSingleDirectoryShare(shared)
+		if err != nil {
+			return errx.With(ErrSharedDir, ": %s: %w", dir.HostPath, err)
+		}
+		fsConfig, err := vz.NewVirtioFileSystemDeviceConfiguration(dir.Tag)
+		if err != nil {
+			return errx.With(ErrSharedDirConfig, ": %s: %w", dir.Tag, err)
+		}
+		fsConfig.SetDirectoryShare(share)
+		devices = append(devices, fsConfig)
+	}
+
+	vzConfig.SetDirectorySharingDevicesVirtualMachineConfiguration(devices)
+	return nil
+}
+
 // CopyRootfsToTemp copies the rootfs image to a temp file so each VM gets a clean copy
 func CopyRootfsToTemp(srcPath string) (string, error) {
 	src, err := os.Open(srcPath)
@@ -319,10 +354,29 @@ func (b *DarwinBackend) configureConsole(vzConfig *vz.VirtualMachineConfiguratio
 		return errx.Wrap(ErrDevNull, err)
 	}
 
-	serialAttachment, err := vz.NewFileHandleSerialPortAttachment(nullRead, logFile)
+	consoleOut := logFile
+	if config.LogFilter != nil {
+		// The console needs a file handle, so filter through a pipe.
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			nullRead.Close()
+			logFile.Close()
+			return errx.Wrap(ErrConsoleLog, err)
+		}
+		go func() {
+			out := config.LogFilter(logFile)
+			io.Copy(out, pr)
+			out.Close()
+			pr.Close()
+			logFile.Close()
+		}()
+		consoleOut = pw
+	}
+
+	serialAttachment, err := vz.NewFileHandleSerialPortAttachment(nullRead, consoleOut)
 	if err != nil {
 		nullRead.Close()
-		logFile.Close()
+		consoleOut.Close()
 		return errx.Wrap(ErrSerialAttach, err)
 	}
 
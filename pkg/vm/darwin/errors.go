@@ -27,6 +27,8 @@ var (
 	ErrStorageConfig   = errors.New("failed to create storage config")
 	ErrExtraDiskAttach = errors.New("failed to create extra disk attachment")
 	ErrExtraDiskConfig = errors.New("failed to create extra disk config")
+	ErrSharedDir       = errors.New("failed to create shared directory")
+	ErrSharedDirConfig = errors.New("failed to create virtio-fs config")
 )
 
 // Network errors
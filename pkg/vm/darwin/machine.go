@@ -164,6 +164,15 @@ func (m *DarwinMachine) Wait(ctx context.Context) error {
 	}
 }
 
+// FreezeFS freezes a guest filesystem through the guest agent.
+func (m *DarwinMachine) FreezeFS(ctx context.Context, path string) (func(), error) {
+	conn, err := m.dialVsock(VsockPortExec)
+	if err != nil {
+		return nil, errx.Wrap(ErrExecConnect, err)
+	}
+	return vsock.Freeze(ctx, conn, path)
+}
+
 func (m *DarwinMachine) Exec(ctx context.Context, command string, opts *api.ExecOptions) (*api.ExecResult, error) {
 	if opts != nil && opts.Stdin != nil {
 		conn, err := m.dialVsock(VsockPortExec)
@@ -192,7 +201,9 @@ func (m *DarwinMachine) Exec(ctx context.Context, command string, opts *api.Exec
 		Command: command,
 	}
 	if opts != nil {
+		req.Args = opts.RawArgv
 		req.WorkingDir = opts.WorkingDir
+		req.CreateWorkingDir = opts.CreateWorkingDir
 		req.Env = opts.Env
 		req.User = opts.User
 	}
@@ -286,6 +297,9 @@ func (m *DarwinMachine) Exec(ctx context.Context, command string, opts *api.Exec
 				DurationMS: duration.Milliseconds(),
 			}
 
+			if err := resp.StartError(); err != nil {
+				return result, err
+			}
 			if resp.Error != "" {
 				return result, errx.With(ErrExecRemote, ": %s", resp.Error)
 			}
@@ -308,7 +322,9 @@ func (m *DarwinMachine) ExecInteractive(ctx context.Context, command string, opt
 		Cols:    cols,
 	}
 	if opts != nil {
+		req.Args = opts.RawArgv
 		req.WorkingDir = opts.WorkingDir
+		req.CreateWorkingDir = opts.CreateWorkingDir
 		req.Env = opts.Env
 		req.User = opts.User
 	}
@@ -354,6 +370,14 @@ func (m *DarwinMachine) ExecInteractive(ctx context.Context, command string, opt
 			switch msgType {
 			case vsock.MsgTypeStdout:
 				stdout.Write(data)
+			case vsock.MsgTypeExecResult:
+				var resp vsock.ExecResponse
+				if json.Unmarshal(data, &resp) == nil {
+					if err := resp.StartError(); err != nil {
+						errCh <- err
+						return
+					}
+				}
 			case vsock.MsgTypeExit:
 				if len(data) >= 4 {
 					done <- int(binary.BigEndian.Uint32(data))
@@ -43,10 +43,6 @@ func (b *LinuxBackend) Name() string {
 
 func (b *LinuxBackend) Create(ctx context.Context, config *vm.VMConfig) (vm.Machine, error) {
 	tapName := fmt.Sprintf("fc-%s", config.ID[:8])
-	tapFD, err := CreateTAP(tapName)
-	if err != nil {
-		return nil, errx.Wrap(ErrTAPCreate, err)
-	}
 
 	// Use configured subnet or default to 192.168.100.0/24
 	subnetCIDR := config.SubnetCIDR
@@ -54,6 +50,28 @@ func (b *LinuxBackend) Create(ctx context.Context, config *vm.VMConfig) (vm.Mach
 		subnetCIDR = "192.168.100.1/24"
 	}
 
+	tapFD, err := CreateTAP(tapName)
+	if err != nil {
+		if !isPermissionError(err) {
+			return nil, errx.Wrap(ErrTAPCreate, err)
+		}
+		// Not allowed to create host TAP devices: fall back to user-mode
+		// networking inside a user namespace.
+		userNet, err := startUserNetwork(tapName, subnetCIDR, config.LogPath, config.LogFilter)
+		if err != nil {
+			return nil, err
+		}
+		return &LinuxMachine{
+			id:         config.ID,
+			config:     config,
+			tapName:    tapName,
+			tapFD:      -1,
+			macAddress: GenerateMAC(config.ID),
+			cmd:        userNet.cmd,
+			userNet:    userNet,
+		}, nil
+	}
+
 	// Initial TAP configuration (will be refreshed after Firecracker starts)
 	if err := ConfigureInterface(tapName, subnetCIDR); err != nil {
 		syscall.Close(tapFD)
@@ -87,7 +105,9 @@ type LinuxMachine struct {
 	tapName    string
 	tapFD      int
 	macAddress string
+	userNet    *userNetwork // nil when using a host TAP device
 	cmd        *exec.Cmd
+	log        io.Closer // VM log, closed after the process exits
 	pid        int
 	started    bool
 }
@@ -104,38 +124,51 @@ func (m *LinuxMachine) Start(ctx context.Context) error {
 		return errx.Wrap(ErrWriteConfig, err)
 	}
 
-	m.cmd = exec.CommandContext(ctx, "firecracker",
+	argv := []string{"firecracker",
 		"--api-sock", m.config.SocketPath,
 		"--config-file", configPath,
-	)
+	}
 
-	if m.config.LogPath != "" {
-		logFile, err := os.Create(m.config.LogPath)
-		if err != nil {
-			return errx.Wrap(ErrCreateLogFile, err)
+	if m.userNet != nil {
+		// The helper started in Create is waiting to exec Firecracker
+		// inside its namespaces, where it has already set up the TAP.
+		if err := m.userNet.start(argv); err != nil {
+			return errx.Wrap(ErrStartFirecracker, err)
 		}
-		m.cmd.Stdout = logFile
-		m.cmd.Stderr = logFile
-	}
+		m.pid = m.cmd.Process.Pid
+		m.started = true
+	} else {
+		m.cmd = exec.CommandContext(ctx, argv[0], argv[1:]...)
 
-	if err := m.cmd.Start(); err != nil {
-		return errx.Wrap(ErrStartFirecracker, err)
-	}
+		if m.config.LogPath != "" {
+			out, closer, err := openLog(m.config.LogPath, m.config.LogFilter)
+			if err != nil {
+				return err
+			}
+			m.cmd.Stdout = out
+			m.cmd.Stderr = out
+			m.log = closer
+		}
 
-	m.pid = m.cmd.Process.Pid
-	m.started = true
+		if err := m.cmd.Start(); err != nil {
+			return errx.Wrap(ErrStartFirecracker, err)
+		}
 
-	// Give Firecracker a moment to open the TAP device, then configure it
-	time.Sleep(100 * time.Millisecond)
+		m.pid = m.cmd.Process.Pid
+		m.started = true
 
-	// Re-configure the TAP interface (Firecracker resets it when opening)
-	// Use configured subnet or default
-	subnetCIDR := m.config.SubnetCIDR
-	if subnetCIDR == "" {
-		subnetCIDR = "192.168.100.1/24"
+		// Give Firecracker a moment to open the TAP device, then configure it
+		time.Sleep(100 * time.Millisecond)
+
+		// Re-configure the TAP interface (Firecracker resets it when opening)
+		// Use configured subnet or default
+		subnetCIDR := m.config.SubnetCIDR
+		if subnetCIDR == "" {
+			subnetCIDR = "192.168.100.1/24"
+		}
+		ConfigureInterface(m.tapName, subnetCIDR)
+		SetMTU(m.tapName, 1500)
 	}
-	ConfigureInterface(m.tapName, subnetCIDR)
-	SetMTU(m.tapName, 1500)
 
 	// Wait for VM to be ready
 	if m.config.VsockCID > 0 {
@@ -253,10 +286,7 @@ func (m *LinuxMachine) generateFirecrackerConfig() []byte {
 		if m.config.Privileged {
 			kernelArgs += " matchlock.privileged=1"
 		}
-		for i, disk := range m.config.ExtraDisks {
-			dev := string(rune('b' + i)) // vdb, vdc, ...
-			kernelArgs += fmt.Sprintf(" matchlock.disk.vd%s=%s", dev, disk.GuestMount)
-		}
+		kernelArgs += vm.KernelDiskParams(m.config.ExtraDisks, m.config.ZramSwapMB)
 	}
 
 	type fcDrive struct {
@@ -267,7 +297,7 @@ func (m *LinuxMachine) generateFirecrackerConfig() []byte {
 	}
 
 	drives := []fcDrive{
-		{DriveID: "rootfs", PathOnHost: m.config.RootfsPath, IsRootDevice: true, IsReadOnly: false},
+		{DriveID: "rootfs", PathOnHost: m.config.RootfsPath, IsRootDevice: true, IsReadOnly: m.config.RootfsReadOnly},
 	}
 	for i, disk := range m.config.ExtraDisks {
 		drives = append(drives, fcDrive{
@@ -378,6 +408,18 @@ func (m *LinuxMachine) Exec(ctx context.Context, command string, opts *api.ExecO
 	return m.execVsock(ctx, command, opts)
 }
 
+// FreezeFS freezes a guest filesystem through the guest agent.
+func (m *LinuxMachine) FreezeFS(ctx context.Context, path string) (func(), error) {
+	if m.config.VsockCID == 0 || m.config.VsockPath == "" {
+		return nil, ErrVsockNotConfigured
+	}
+	conn, err := m.dialVsock(VsockPortExec)
+	if err != nil {
+		return nil, errx.Wrap(ErrExecConnect, err)
+	}
+	return vsock.Freeze(ctx, conn, path)
+}
+
 // execVsock executes a command via vsock.
 // When opts.Stdout/Stderr are set, uses streaming mode (MsgTypeExecStream) and
 // forwards output chunks to the writers in real-time.
@@ -411,7 +453,9 @@ func (m *LinuxMachine) execVsock(ctx context.Context, command string, opts *api.
 		Command: command,
 	}
 	if opts != nil {
+		req.Args = opts.RawArgv
 		req.WorkingDir = opts.WorkingDir
+		req.CreateWorkingDir = opts.CreateWorkingDir
 		req.Env = opts.Env
 		req.User = opts.User
 	}
@@ -505,6 +549,9 @@ func (m *LinuxMachine) execVsock(ctx context.Context, command string, opts *api.
 				DurationMS: duration.Milliseconds(),
 			}
 
+			if err := resp.StartError(); err != nil {
+				return result, err
+			}
 			if resp.Error != "" {
 				return result, errx.With(ErrExecRemote, ": %s", resp.Error)
 			}
@@ -533,7 +580,9 @@ func (m *LinuxMachine) ExecInteractive(ctx context.Context, command string, opts
 		Cols:    cols,
 	}
 	if opts != nil {
+		req.Args = opts.RawArgv
 		req.WorkingDir = opts.WorkingDir
+		req.CreateWorkingDir = opts.CreateWorkingDir
 		req.Env = opts.Env
 		req.User = opts.User
 	}
@@ -581,6 +630,14 @@ func (m *LinuxMachine) ExecInteractive(ctx context.Context, command string, opts
 			switch msgType {
 			case vsock.MsgTypeStdout:
 				stdout.Write(data)
+			case vsock.MsgTypeExecResult:
+				var resp vsock.ExecResponse
+				if json.Unmarshal(data, &resp) == nil {
+					if err := resp.StartError(); err != nil {
+						errCh <- err
+						return
+					}
+				}
 			case vsock.MsgTypeExit:
 				if len(data) >= 4 {
 					done <- int(binary.BigEndian.Uint32(data))
@@ -628,9 +685,27 @@ func (m *LinuxMachine) ExecInteractive(ctx context.Context, command string, opts
 }
 
 func (m *LinuxMachine) NetworkFD() (int, error) {
+	if m.userNet != nil {
+		return int(m.userNet.uplink.Fd()), nil
+	}
 	return m.tapFD, nil
 }
 
+// UserNetwork reports whether the VM uses user-mode networking, in which
+// case NetworkFile carries the guest's Ethernet frames and the host needs a
+// userspace network stack instead of NAT and firewall rules.
+func (m *LinuxMachine) UserNetwork() bool {
+	return m.userNet != nil
+}
+
+// NetworkFile returns the uplink TAP of a user-mode network, or nil.
+func (m *LinuxMachine) NetworkFile() *os.File {
+	if m.userNet == nil {
+		return nil
+	}
+	return m.userNet.uplink
+}
+
 func (m *LinuxMachine) VsockFD() (int, error) {
 	return -1, ErrVsockNoDirectFD
 }
@@ -668,6 +743,9 @@ func (m *LinuxMachine) Close(ctx context.Context) error {
 		// Wait for process to fully exit
 		m.cmd.Wait()
 	}
+	if m.log != nil {
+		m.log.Close()
+	}
 
 	if m.tapFD > 0 {
 		if err := syscall.Close(m.tapFD); err != nil {
@@ -675,7 +753,9 @@ func (m *LinuxMachine) Close(ctx context.Context) error {
 		}
 	}
 
-	if m.tapName != "" {
+	if m.userNet != nil {
+		m.userNet.Close()
+	} else if m.tapName != "" {
 		if err := DeleteInterface(m.tapName); err != nil {
 			errs = append(errs, errx.Wrap(ErrTAPDelete, err))
 		}
@@ -686,3 +766,25 @@ func (m *LinuxMachine) Close(ctx context.Context) error {
 	}
 	return nil
 }
+
+// openLog creates the VM log at path. With a filter the process output is
+// copied through it, so the returned closer, which flushes the filter and
+// closes the file, must only be called once the process has exited.
+func openLog(path string, filter func(io.Writer) io.WriteCloser) (io.Writer, io.Closer, error) {
+	logFile, err := os.Create(path)
+	if err != nil {
+		return nil, nil, errx.Wrap(ErrCreateLogFile, err)
+	}
+	if filter == nil {
+		return logFile, logFile, nil
+	}
+	out := filter(logFile)
+	return out, closerFunc(func() error {
+		out.Close()
+		return logFile.Close()
+	}), nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
@@ -21,6 +21,14 @@ var (
 	ErrSIOCSIFNETMASK    = errors.New("SIOCSIFNETMASK")
 	ErrSIOCGIFFLAGS      = errors.New("SIOCGIFFLAGS")
 	ErrSIOCSIFFLAGS      = errors.New("SIOCSIFFLAGS")
+	ErrSIOCADDRT         = errors.New("SIOCADDRT")
+)
+
+// User-mode networking errors
+var (
+	ErrUserNetHelper = errors.New("user network helper")
+	ErrUserNetUplink = errors.New("receive user network uplink")
+	ErrUserNetSysctl = errors.New("write namespace sysctl")
 )
 
 // Firecracker lifecycle errors
@@ -25,6 +25,12 @@ type ifreq struct {
 }
 
 func CreateTAP(name string) (int, error) {
+	return openTAP(name, true)
+}
+
+// openTAP creates (or attaches to) the named TAP device. A persistent device
+// outlives the returned FD; otherwise it is removed when the FD is closed.
+func openTAP(name string, persist bool) (int, error) {
 	fd, err := syscall.Open(tunDevice, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
 	if err != nil {
 		return 0, errx.Wrap(ErrTUNOpen, err)
@@ -41,6 +47,10 @@ func CreateTAP(name string) (int, error) {
 		return 0, errx.Wrap(ErrTUNSETIFF, errno)
 	}
 
+	if !persist {
+		return fd, nil
+	}
+
 	// Make the TAP device persistent so it survives FD close
 	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
 		uintptr(TUNSETPERSIST), 1)
@@ -97,6 +107,21 @@ func ConfigureInterface(name, cidr string) error {
 		return errx.Wrap(ErrSIOCSIFNETMASK, errno)
 	}
 
+	_ = iface
+	return setLinkUp(fd, name)
+}
+
+// LinkUp brings the named interface up without assigning an address.
+func LinkUp(name string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return errx.Wrap(ErrCreateSocket, err)
+	}
+	defer syscall.Close(fd)
+	return setLinkUp(fd, name)
+}
+
+func setLinkUp(fd int, name string) error {
 	var flagReq struct {
 		name  [ifnameLen]byte
 		flags int16
@@ -115,8 +140,64 @@ func ConfigureInterface(name, cidr string) error {
 		syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&flagReq))); errno != 0 {
 		return errx.Wrap(ErrSIOCSIFFLAGS, errno)
 	}
+	return nil
+}
 
-	_ = iface
+// rtentry mirrors struct rtentry from <net/route.h>.
+type rtentry struct {
+	_       uintptr
+	dst     syscall.RawSockaddrInet4
+	gateway syscall.RawSockaddrInet4
+	genmask syscall.RawSockaddrInet4
+	flags   uint16
+	_       int16
+	_       uintptr
+	_       uintptr
+	metric  int16
+	dev     *byte
+	mtu     uintptr
+	window  uintptr
+	irtt    uint16
+}
+
+// AddRoute adds an IPv4 route for cidr through dev, via gateway if it is
+// not empty.
+func AddRoute(cidr, gateway, dev string) error {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return errx.With(ErrInvalidCIDR, " %s: %w", cidr, err)
+	}
+
+	var rt rtentry
+	rt.dst.Family = syscall.AF_INET
+	copy(rt.dst.Addr[:], ipNet.IP.To4())
+	rt.genmask.Family = syscall.AF_INET
+	copy(rt.genmask.Addr[:], ipNet.Mask)
+	rt.flags = syscall.RTF_UP
+	if ones, _ := ipNet.Mask.Size(); ones == 32 {
+		rt.flags |= syscall.RTF_HOST
+	}
+	if gateway != "" {
+		rt.gateway.Family = syscall.AF_INET
+		copy(rt.gateway.Addr[:], net.ParseIP(gateway).To4())
+		rt.flags |= syscall.RTF_GATEWAY
+	}
+	devName, err := syscall.BytePtrFromString(dev)
+	if err != nil {
+		return errx.Wrap(ErrSIOCADDRT, err)
+	}
+	rt.dev = devName
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return errx.Wrap(ErrCreateSocket, err)
+	}
+	defer syscall.Close(fd)
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		syscall.SIOCADDRT, uintptr(unsafe.Pointer(&rt))); errno != 0 {
+		return errx.With(ErrSIOCADDRT, " %s dev %s: %w", cidr, dev, errno)
+	}
 	return nil
 }
 
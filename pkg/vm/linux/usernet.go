@@ -0,0 +1,304 @@
+//go:build linux
+
+package linux
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"golang.org/x/sys/unix"
+)
+
+// User-mode networking lets users without CAP_NET_ADMIN run sandboxes.
+// Firecracker is started inside a new user and network namespace in which
+// matchlock is root, so TAP devices can be created there without touching
+// the host. A helper process sets the namespace up before exec'ing
+// Firecracker:
+//
+//	guest eth0 ── fc-xxxxxxxx ─(namespace routing)─ ml0 ══ uplink FD ══ host
+//
+// Firecracker attaches to the first TAP. The namespace kernel routes
+// everything the guest sends (including traffic for the gateway IP) to the
+// second TAP, whose FD is passed back to the host process. There a
+// userspace TCP/IP stack (pkg/net) terminates the guest's connections and
+// dials out with ordinary sockets, so no host routes, NAT or firewall rules
+// are needed. Proxy ARP on both TAPs answers the guest's ARP requests for
+// the gateway and the stack's ARP requests for the guest.
+const (
+	// userNetHelper is argv[0] of the re-exec'd namespace helper.
+	userNetHelper = "matchlock-usernet"
+
+	// userNetEnv carries "<tap name>,<gateway CIDR>" to the helper.
+	userNetEnv = "MATCHLOCK_USERNET"
+
+	userNetUplink     = "ml0"
+	userNetUplinkCIDR = "169.254.1.1/30"
+)
+
+func init() {
+	if len(os.Args) > 0 && os.Args[0] == userNetHelper {
+		runUserNetHelper()
+	}
+}
+
+// userNetwork is the host side of a user-mode network: the helper that
+// becomes Firecracker, its control socket, and the uplink TAP.
+type userNetwork struct {
+	cmd    *exec.Cmd
+	ctrl   *os.File
+	uplink *os.File
+	log    io.Closer // filtered VM log, closed after the process exits
+}
+
+// isPermissionError reports whether err means the caller may not create
+// TAP devices in the host network namespace.
+func isPermissionError(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES)
+}
+
+// startUserNetwork launches the namespace helper and waits for the uplink.
+// The helper then blocks until start is called with the Firecracker argv.
+func startUserNetwork(tapName, subnetCIDR, logPath string, logFilter func(io.Writer) io.WriteCloser) (*userNetwork, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, errx.Wrap(ErrUserNetHelper, err)
+	}
+	ctrl := os.NewFile(uintptr(fds[0]), "usernet")
+	helperEnd := os.NewFile(uintptr(fds[1]), "usernet-helper")
+
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       []string{userNetHelper},
+		Env:        append(os.Environ(), userNetEnv+"="+tapName+","+subnetCIDR),
+		ExtraFiles: []*os.File{helperEnd},
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags:                 syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+			UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+			GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+			GidMappingsEnableSetgroups: false,
+		},
+	}
+
+	var log io.Closer
+	if logPath != "" {
+		out, closer, err := openLog(logPath, logFilter)
+		if err != nil {
+			ctrl.Close()
+			helperEnd.Close()
+			return nil, err
+		}
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if logFilter == nil {
+			// The helper holds its own copy of the file.
+			defer closer.Close()
+		} else {
+			log = closer
+		}
+	}
+
+	err = cmd.Start()
+	helperEnd.Close()
+	if err != nil {
+		ctrl.Close()
+		if log != nil {
+			log.Close()
+		}
+		return nil, errx.With(ErrUserNetHelper, ": %w (are unprivileged user namespaces enabled?)", err)
+	}
+
+	uplink, err := receiveUplink(ctrl)
+	if err != nil {
+		ctrl.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		if log != nil {
+			log.Close()
+		}
+		return nil, err
+	}
+
+	return &userNetwork{cmd: cmd, ctrl: ctrl, uplink: uplink, log: log}, nil
+}
+
+// receiveUplink reads the uplink TAP FD sent by the helper. A message
+// without an FD carries the helper's error instead.
+func receiveUplink(ctrl *os.File) (*os.File, error) {
+	buf := make([]byte, 1024)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := unix.Recvmsg(int(ctrl.Fd()), buf, oob, 0)
+	if err != nil {
+		return nil, errx.Wrap(ErrUserNetUplink, err)
+	}
+	if oobn == 0 {
+		if n == 0 {
+			return nil, errx.Wrap(ErrUserNetUplink, io.ErrUnexpectedEOF)
+		}
+		return nil, errx.With(ErrUserNetHelper, ": %s", buf[:n])
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, errx.With(ErrUserNetUplink, ": malformed control message")
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return nil, errx.With(ErrUserNetUplink, ": malformed control message")
+	}
+
+	// Non-blocking so reads go through the runtime poller and Close
+	// interrupts them.
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		unix.Close(fds[0])
+		return nil, errx.Wrap(ErrUserNetUplink, err)
+	}
+	return os.NewFile(uintptr(fds[0]), "usernet-uplink"), nil
+}
+
+// start tells the helper to exec Firecracker with argv.
+func (u *userNetwork) start(argv []string) error {
+	data, err := json.Marshal(argv)
+	if err != nil {
+		return err
+	}
+	if _, err := u.ctrl.Write(data); err != nil {
+		return err
+	}
+	return u.ctrl.Close()
+}
+
+// Close releases the host's ends. The namespace, and the TAPs in it, go
+// away with the helper or Firecracker process.
+func (u *userNetwork) Close() {
+	u.ctrl.Close()
+	u.uplink.Close()
+	if u.log != nil {
+		u.log.Close()
+	}
+}
+
+// runUserNetHelper runs in the new namespaces instead of main. It never
+// returns.
+func runUserNetHelper() {
+	ctrl := os.NewFile(3, "usernet")
+
+	params := strings.Split(os.Getenv(userNetEnv), ",")
+	if len(params) != 2 {
+		ctrl.Write([]byte(fmt.Sprintf("invalid %s=%q", userNetEnv, os.Getenv(userNetEnv))))
+		os.Exit(1)
+	}
+	uplink, err := setupUserNetNamespace(params[0], params[1])
+	if err != nil {
+		ctrl.Write([]byte(err.Error()))
+		os.Exit(1)
+	}
+	if err := unix.Sendmsg(int(ctrl.Fd()), []byte{0}, unix.UnixRights(uplink), nil, 0); err != nil {
+		os.Exit(1)
+	}
+	unix.Close(uplink)
+
+	buf := make([]byte, 64*1024)
+	n, err := ctrl.Read(buf)
+	if err != nil {
+		// The host gave up before starting the VM.
+		os.Exit(0)
+	}
+	ctrl.Close()
+
+	var argv []string
+	if err := json.Unmarshal(buf[:n], &argv); err != nil || len(argv) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: invalid command\n", userNetHelper)
+		os.Exit(1)
+	}
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", userNetHelper, err)
+		os.Exit(1)
+	}
+
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, userNetEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	err = syscall.Exec(path, argv, env)
+	fmt.Fprintf(os.Stderr, "%s: exec %s: %v\n", userNetHelper, path, err)
+	os.Exit(1)
+}
+
+// setupUserNetNamespace creates and wires both TAPs in the current network
+// namespace and returns the uplink FD.
+func setupUserNetNamespace(tapName, subnetCIDR string) (int, error) {
+	gatewayIP, subnet, err := net.ParseCIDR(subnetCIDR)
+	if err != nil {
+		return -1, errx.With(ErrInvalidCIDR, " %s: %w", subnetCIDR, err)
+	}
+
+	if err := LinkUp("lo"); err != nil {
+		return -1, err
+	}
+
+	// Firecracker re-opens the guest TAP by name, so it must persist.
+	tapFD, err := CreateTAP(tapName)
+	if err != nil {
+		return -1, errx.Wrap(ErrTAPCreate, err)
+	}
+	syscall.Close(tapFD)
+	if err := SetMTU(tapName, 1500); err != nil {
+		return -1, errx.Wrap(ErrTAPSetMTU, err)
+	}
+	if err := LinkUp(tapName); err != nil {
+		return -1, errx.Wrap(ErrTAPConfigure, err)
+	}
+
+	uplink, err := openTAP(userNetUplink, false)
+	if err != nil {
+		return -1, errx.Wrap(ErrTAPCreate, err)
+	}
+	fail := func(err error) (int, error) {
+		syscall.Close(uplink)
+		return -1, err
+	}
+	if err := ConfigureInterface(userNetUplink, userNetUplinkCIDR); err != nil {
+		return fail(errx.Wrap(ErrTAPConfigure, err))
+	}
+	if err := SetMTU(userNetUplink, 1500); err != nil {
+		return fail(errx.Wrap(ErrTAPSetMTU, err))
+	}
+
+	sysctls := map[string]string{
+		"net/ipv4/ip_forward": "1",
+	}
+	for _, dev := range []string{tapName, userNetUplink} {
+		sysctls["net/ipv4/conf/"+dev+"/proxy_arp"] = "1"
+		sysctls["net/ipv4/neigh/"+dev+"/proxy_delay"] = "0"
+	}
+	for key, value := range sysctls {
+		if err := os.WriteFile("/proc/sys/"+key, []byte(value), 0644); err != nil {
+			return fail(errx.With(ErrUserNetSysctl, " %s: %w", key, err))
+		}
+	}
+
+	// The guest subnet lives behind the guest TAP; the gateway and
+	// everything else is reached through the uplink.
+	if err := AddRoute(subnet.String(), "", tapName); err != nil {
+		return fail(err)
+	}
+	if err := AddRoute(gatewayIP.String()+"/32", "", userNetUplink); err != nil {
+		return fail(err)
+	}
+	if err := AddRoute("0.0.0.0/0", gatewayIP.String(), userNetUplink); err != nil {
+		return fail(err)
+	}
+
+	return uplink, nil
+}
@@ -24,4 +24,5 @@ var (
 	ErrWriteRequest       = errors.New("write request")
 	ErrReadResponseHeader = errors.New("read response header")
 	ErrReadResponseData   = errors.New("read response data")
+	ErrFreeze             = errors.New("freeze guest filesystem")
 )
@@ -9,6 +9,7 @@ import (
 	"unsafe"
 
 	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/pkg/api"
 )
 
 const (
@@ -230,27 +231,36 @@ const (
 	MsgTypeExit       uint8 = 10 // TTY: process exited
 	MsgTypeExecStream uint8 = 11 // Streaming batch: stdout/stderr sent as chunks, then ExecResult
 	MsgTypeExecPipe   uint8 = 12 // Pipe mode: like ExecStream but also accepts MsgTypeStdin, sends MsgTypeExit
+	MsgTypeFreeze     uint8 = 13 // Freeze a filesystem until the connection closes; replies with ExecResult once frozen
 )
 
 // ExecRequest is sent from host to guest to execute a command
 type ExecRequest struct {
-	Command    string            `json:"command"`
-	Args       []string          `json:"args,omitempty"`
-	WorkingDir string            `json:"working_dir,omitempty"`
-	Env        map[string]string `json:"env,omitempty"`
-	Stdin      []byte            `json:"stdin,omitempty"`
-	User       string            `json:"user,omitempty"` // "uid", "uid:gid", or username
+	Command          string            `json:"command"`
+	Args             []string          `json:"args,omitempty"`
+	WorkingDir       string            `json:"working_dir,omitempty"`
+	CreateWorkingDir bool              `json:"create_working_dir,omitempty"`
+	Env              map[string]string `json:"env,omitempty"`
+	Stdin            []byte            `json:"stdin,omitempty"`
+	User             string            `json:"user,omitempty"` // "uid", "uid:gid", or username
 }
 
 // ExecTTYRequest is sent from host to guest for interactive execution
 type ExecTTYRequest struct {
-	Command    string            `json:"command"`
-	Args       []string          `json:"args,omitempty"`
-	WorkingDir string            `json:"working_dir,omitempty"`
-	Env        map[string]string `json:"env,omitempty"`
-	Rows       uint16            `json:"rows"`
-	Cols       uint16            `json:"cols"`
-	User       string            `json:"user,omitempty"` // "uid", "uid:gid", or username
+	Command          string            `json:"command"`
+	Args             []string          `json:"args,omitempty"`
+	WorkingDir       string            `json:"working_dir,omitempty"`
+	CreateWorkingDir bool              `json:"create_working_dir,omitempty"`
+	Env              map[string]string `json:"env,omitempty"`
+	Rows             uint16            `json:"rows"`
+	Cols             uint16            `json:"cols"`
+	User             string            `json:"user,omitempty"` // "uid", "uid:gid", or username
+}
+
+// FreezeRequest is sent from host to guest to freeze the filesystem mounted
+// at Path
+type FreezeRequest struct {
+	Path string `json:"path"`
 }
 
 // WindowSize represents terminal dimensions
@@ -265,6 +275,21 @@ type ExecResponse struct {
 	Stdout   []byte `json:"stdout,omitempty"`
 	Stderr   []byte `json:"stderr,omitempty"`
 	Error    string `json:"error,omitempty"`
+	// ErrorCode classifies Error when the command could not be started
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// ExecErrorWorkingDir is the ExecResponse.ErrorCode for a working directory
+// that does not exist or could not be created.
+const ExecErrorWorkingDir = "working_dir"
+
+// StartError returns the typed error for a failure the guest classified with
+// ErrorCode, or nil if there is none.
+func (r *ExecResponse) StartError() error {
+	if r.ErrorCode == ExecErrorWorkingDir {
+		return errx.With(api.ErrWorkingDir, ": %s", r.Error)
+	}
+	return nil
 }
 
 // WriteMessage writes a length-prefixed message to the connection
@@ -64,7 +64,9 @@ func ExecPipe(ctx context.Context, conn net.Conn, command string, opts *api.Exec
 
 	req := ExecRequest{Command: command}
 	if opts != nil {
+		req.Args = opts.RawArgv
 		req.WorkingDir = opts.WorkingDir
+		req.CreateWorkingDir = opts.CreateWorkingDir
 		req.Env = opts.Env
 		req.User = opts.User
 	}
@@ -165,6 +167,14 @@ func ExecPipe(ctx context.Context, conn net.Conn, command string, opts *api.Exec
 				if opts != nil && opts.Stderr != nil {
 					opts.Stderr.Write(data)
 				}
+			case MsgTypeExecResult:
+				var resp ExecResponse
+				if json.Unmarshal(data, &resp) == nil {
+					if err := resp.StartError(); err != nil {
+						errCh <- err
+						return
+					}
+				}
 			case MsgTypeExit:
 				exitCode := 0
 				if len(data) >= 4 {
@@ -189,3 +199,42 @@ func ExecPipe(ctx context.Context, conn net.Conn, command string, opts *api.Exec
 		return nil, ctx.Err()
 	}
 }
+
+// Freeze freezes the guest filesystem mounted at path over conn, flushing
+// it to its disk and holding back writes to it, and returns a func that
+// thaws it by closing conn. The guest also thaws it if conn is lost. Freeze
+// takes ownership of conn.
+func Freeze(ctx context.Context, conn net.Conn, path string) (thaw func(), err error) {
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	data, err := json.Marshal(FreezeRequest{Path: path})
+	if err != nil {
+		return nil, errx.Wrap(ErrFreeze, err)
+	}
+	if err := SendMessage(conn, MsgTypeFreeze, data); err != nil {
+		return nil, errx.Wrap(ErrWriteRequest, err)
+	}
+
+	hdr := make([]byte, 5)
+	if _, err := ReadFull(conn, hdr); err != nil {
+		return nil, errx.Wrap(ErrReadResponseHeader, err)
+	}
+	data = make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	if _, err := ReadFull(conn, data); err != nil {
+		return nil, errx.Wrap(ErrReadResponseData, err)
+	}
+	var resp ExecResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, errx.Wrap(ErrFreeze, err)
+	}
+	if hdr[0] != MsgTypeExecResult || resp.Error != "" {
+		return nil, errx.With(ErrFreeze, ": %s", resp.Error)
+	}
+	return func() { conn.Close() }, nil
+}
@@ -0,0 +1,8 @@
+package watch
+
+import "errors"
+
+var (
+	ErrScan    = errors.New("scan directory")
+	ErrNotADir = errors.New("watch root is not a directory")
+)
@@ -0,0 +1,261 @@
+// Package watch detects file changes under a host directory by periodic
+// polling. Polling keeps the implementation portable across Linux and macOS
+// and needs no per-directory watch handles on large trees.
+package watch
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+)
+
+const (
+	DefaultInterval = 500 * time.Millisecond
+	DefaultDebounce = 300 * time.Millisecond
+)
+
+// DefaultIgnore lists path components skipped unless overridden.
+var DefaultIgnore = []string{".git"}
+
+// FileState is the metadata used to decide whether an entry changed.
+type FileState struct {
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	IsDir   bool
+}
+
+// Snapshot maps slash-separated paths relative to the root to their state.
+type Snapshot map[string]FileState
+
+// Changes describes the difference between two snapshots. All paths are
+// slash-separated, relative to the root and sorted so parents come first.
+type Changes struct {
+	Dirs     []string // directories that appeared
+	Modified []string // regular files that were created or changed
+	Removed  []string // files or directories that disappeared
+}
+
+func (c Changes) Empty() bool {
+	return len(c.Dirs) == 0 && len(c.Modified) == 0 && len(c.Removed) == 0
+}
+
+// Count returns the total number of changed paths.
+func (c Changes) Count() int {
+	return len(c.Dirs) + len(c.Modified) + len(c.Removed)
+}
+
+// Scan walks root and records every regular file and directory, skipping
+// entries whose name matches one of the ignore glob patterns. Symlinks and
+// special files are not tracked.
+func Scan(root string, ignore []string) (Snapshot, error) {
+	snap := make(Snapshot)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p != root && os.IsNotExist(err) {
+				// Removed between ReadDir and Lstat; the next scan catches it.
+				return nil
+			}
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		if ignored(d.Name(), ignore) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		snap[filepath.ToSlash(rel)] = FileState{
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Mode:    info.Mode(),
+			IsDir:   d.IsDir(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errx.With(ErrScan, " %s: %w", root, err)
+	}
+	return snap, nil
+}
+
+func ignored(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff reports what changed going from old to cur. A path that switches
+// between file and directory is reported as removed and then re-added.
+func Diff(old, cur Snapshot) Changes {
+	var c Changes
+	for p, st := range cur {
+		prev, ok := old[p]
+		if ok && prev.IsDir != st.IsDir {
+			c.Removed = append(c.Removed, p)
+			ok = false
+		}
+		switch {
+		case st.IsDir && !ok:
+			c.Dirs = append(c.Dirs, p)
+		case !st.IsDir && (!ok || prev.Size != st.Size || !prev.ModTime.Equal(st.ModTime) || prev.Mode != st.Mode):
+			c.Modified = append(c.Modified, p)
+		}
+	}
+	for p := range old {
+		if _, ok := cur[p]; !ok && !parentRemoved(p, old, cur) {
+			c.Removed = append(c.Removed, p)
+		}
+	}
+	sort.Strings(c.Dirs)
+	sort.Strings(c.Modified)
+	sort.Strings(c.Removed)
+	return c
+}
+
+// parentRemoved reports whether an ancestor directory of p is also gone (or
+// replaced by a file), in which case removing the ancestor already covers p.
+func parentRemoved(p string, old, cur Snapshot) bool {
+	for dir := parentOf(p); dir != ""; dir = parentOf(dir) {
+		if st, ok := old[dir]; !ok || !st.IsDir {
+			continue
+		}
+		if st, ok := cur[dir]; !ok || !st.IsDir {
+			return true
+		}
+	}
+	return false
+}
+
+func parentOf(p string) string {
+	i := strings.LastIndexByte(p, '/')
+	if i < 0 {
+		return ""
+	}
+	return p[:i]
+}
+
+// Options configures a Watcher.
+type Options struct {
+	// Ignore holds glob patterns matched against each path component.
+	// Defaults to DefaultIgnore when nil.
+	Ignore []string
+	// Interval is how often the tree is rescanned.
+	Interval time.Duration
+	// Debounce is how long the tree must stay unchanged before a batch of
+	// changes is reported, so editors saving several files trigger one run.
+	Debounce time.Duration
+}
+
+// Watcher polls a directory tree and reports batches of changes.
+type Watcher struct {
+	root     string
+	ignore   []string
+	interval time.Duration
+	debounce time.Duration
+	snap     Snapshot
+}
+
+// New scans root once to establish the baseline for later Wait calls.
+func New(root string, opts Options) (*Watcher, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, errx.With(ErrScan, " %s: %w", root, err)
+	}
+	if !info.IsDir() {
+		return nil, errx.With(ErrNotADir, ": %s", root)
+	}
+
+	w := &Watcher{
+		root:     root,
+		ignore:   opts.Ignore,
+		interval: opts.Interval,
+		debounce: opts.Debounce,
+	}
+	if w.ignore == nil {
+		w.ignore = DefaultIgnore
+	}
+	if w.interval <= 0 {
+		w.interval = DefaultInterval
+	}
+	if w.debounce < 0 {
+		w.debounce = 0
+	}
+
+	w.snap, err = Scan(root, w.ignore)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Root returns the watched directory.
+func (w *Watcher) Root() string { return w.root }
+
+// Snapshot returns the state as of the last reported batch.
+func (w *Watcher) Snapshot() Snapshot { return w.snap }
+
+// Wait blocks until the tree differs from the last reported snapshot and has
+// been quiet for the debounce period, then returns the accumulated changes.
+func (w *Watcher) Wait(ctx context.Context) (Changes, error) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	last := w.snap
+	var changedAt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return Changes{}, ctx.Err()
+		case <-ticker.C:
+		}
+
+		cur, err := Scan(w.root, w.ignore)
+		if err != nil {
+			return Changes{}, err
+		}
+
+		if !Diff(last, cur).Empty() {
+			last = cur
+			changedAt = time.Now()
+			if w.debounce > 0 {
+				continue
+			}
+		}
+		if changedAt.IsZero() || time.Since(changedAt) < w.debounce {
+			continue
+		}
+
+		changes := Diff(w.snap, cur)
+		w.snap = cur
+		changedAt = time.Time{}
+		if !changes.Empty() {
+			return changes, nil
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, root, rel, content string) {
+	t.Helper()
+	p := filepath.Join(root, filepath.FromSlash(rel))
+	require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+	require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+}
+
+func TestScan(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "main.go", "package main")
+	writeFile(t, root, "pkg/util/util.go", "package util")
+	writeFile(t, root, ".git/HEAD", "ref: refs/heads/main")
+	writeFile(t, root, "build/out.o", "binary")
+	require.NoError(t, os.Symlink("main.go", filepath.Join(root, "link.go")))
+
+	snap, err := Scan(root, []string{".git", "build"})
+	require.NoError(t, err)
+
+	assert.Contains(t, snap, "main.go")
+	assert.Contains(t, snap, "pkg")
+	assert.Contains(t, snap, "pkg/util")
+	assert.Contains(t, snap, "pkg/util/util.go")
+	assert.True(t, snap["pkg"].IsDir)
+	assert.Equal(t, int64(len("package main")), snap["main.go"].Size)
+	assert.NotContains(t, snap, ".git")
+	assert.NotContains(t, snap, ".git/HEAD")
+	assert.NotContains(t, snap, "build/out.o")
+	assert.NotContains(t, snap, "link.go")
+}
+
+func TestScanMissingRoot(t *testing.T) {
+	_, err := Scan(filepath.Join(t.TempDir(), "missing"), nil)
+	require.ErrorIs(t, err, ErrScan)
+}
+
+func TestDiff(t *testing.T) {
+	now := time.Now()
+	old := Snapshot{
+		"a.go":       {Size: 1, ModTime: now},
+		"b.go":       {Size: 1, ModTime: now},
+		"old":        {IsDir: true},
+		"old/x.go":   {Size: 1, ModTime: now},
+		"old/y/z.go": {Size: 1, ModTime: now},
+		"old/y":      {IsDir: true},
+		"swap":       {Size: 1, ModTime: now},
+	}
+	cur := Snapshot{
+		"a.go":     {Size: 1, ModTime: now},
+		"b.go":     {Size: 2, ModTime: now.Add(time.Second)},
+		"c.go":     {Size: 1, ModTime: now},
+		"new":      {IsDir: true},
+		"new/d.go": {Size: 1, ModTime: now},
+		"swap":     {IsDir: true},
+	}
+
+	c := Diff(old, cur)
+	assert.Equal(t, []string{"new", "swap"}, c.Dirs)
+	assert.Equal(t, []string{"b.go", "c.go", "new/d.go"}, c.Modified)
+	assert.Equal(t, []string{"old", "swap"}, c.Removed)
+	assert.Equal(t, 7, c.Count())
+	assert.False(t, c.Empty())
+
+	assert.True(t, Diff(cur, cur).Empty())
+}
+
+func TestDiffModeChange(t *testing.T) {
+	now := time.Now()
+	old := Snapshot{"run.sh": {Size: 1, ModTime: now, Mode: 0644}}
+	cur := Snapshot{"run.sh": {Size: 1, ModTime: now, Mode: 0755}}
+	assert.Equal(t, []string{"run.sh"}, Diff(old, cur).Modified)
+}
+
+func TestNewRequiresDirectory(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "file", "x")
+
+	_, err := New(filepath.Join(root, "file"), Options{})
+	require.ErrorIs(t, err, ErrNotADir)
+}
+
+func TestWatcherWait(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "main.go", "package main")
+
+	w, err := New(root, Options{Interval: 10 * time.Millisecond, Debounce: 30 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Contains(t, w.Snapshot(), "main.go")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.MkdirAll(filepath.Join(root, "src"), 0755)
+		os.WriteFile(filepath.Join(root, "src", "lib.go"), []byte("package src"), 0644)
+		os.Remove(filepath.Join(root, "main.go"))
+	}()
+
+	changes, err := w.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"src"}, changes.Dirs)
+	assert.Equal(t, []string{"src/lib.go"}, changes.Modified)
+	assert.Equal(t, []string{"main.go"}, changes.Removed)
+	assert.NotContains(t, w.Snapshot(), "main.go")
+}
+
+func TestWatcherWaitCancelled(t *testing.T) {
+	w, err := New(t.TempDir(), Options{Interval: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = w.Wait(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,12 @@
+package workspaces
+
+import "errors"
+
+var (
+	ErrInvalidName    = errors.New("invalid workspace snapshot name")
+	ErrSnapshotExists = errors.New("workspace snapshot already exists")
+	ErrNotFound       = errors.New("workspace snapshot not found")
+	ErrSave           = errors.New("save workspace snapshot")
+	ErrRead           = errors.New("read workspace snapshot")
+	ErrRemove         = errors.New("remove workspace snapshot")
+)
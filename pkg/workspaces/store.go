@@ -0,0 +1,166 @@
+// Package workspaces stores named snapshots of sandbox workspace contents on
+// the host, so a later sandbox can start from the files an earlier one left
+// behind without checkpointing the VM.
+//
+// Each snapshot is a directory holding the extracted workspace tree and a
+// small metadata file:
+//
+//	~/.matchlock/workspaces/<name>/files/
+//	~/.matchlock/workspaces/<name>/snapshot.json
+//
+// Snapshots are never modified once saved. A sandbox seeded from one mounts
+// its files as the read-only lower layer of an overlay, so any number of
+// sandboxes can share it.
+package workspaces
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jingkaihe/matchlock/internal/errx"
+	"github.com/jingkaihe/matchlock/internal/storename"
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+const (
+	filesDir = "files"
+	metaFile = "snapshot.json"
+)
+
+// Snapshot describes a saved workspace.
+type Snapshot struct {
+	Name      string    `json:"name"`
+	SandboxID string    `json:"sandbox_id,omitempty"`
+	Workspace string    `json:"workspace,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Store is a directory of workspace snapshots.
+type Store struct {
+	dir string
+}
+
+// NewStore returns a store rooted at dir, defaulting to
+// ~/.matchlock/workspaces.
+func NewStore(dir string) *Store {
+	return &Store{dir: storename.Dir(dir, ".matchlock", "workspaces")}
+}
+
+// ValidateName checks that name can be used for a snapshot.
+func ValidateName(name string) error {
+	return storename.Validate(ErrInvalidName, name)
+}
+
+// FilesDir returns the directory holding the files of the named snapshot.
+func (s *Store) FilesDir(name string) string {
+	return filepath.Join(s.dir, name, filesDir)
+}
+
+// Save extracts the tar stream r as a new snapshot. The snapshot appears
+// only once it is complete; an existing snapshot of the same name is not
+// replaced.
+func (s *Store) Save(name string, snap Snapshot, r io.Reader) (*Snapshot, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	final := filepath.Join(s.dir, name)
+	if _, err := os.Stat(final); err == nil {
+		return nil, errx.With(ErrSnapshotExists, ": %s", name)
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, errx.Wrap(ErrSave, err)
+	}
+	tmp, err := os.MkdirTemp(s.dir, "."+name+"-")
+	if err != nil {
+		return nil, errx.Wrap(ErrSave, err)
+	}
+	defer os.RemoveAll(tmp)
+
+	files := filepath.Join(tmp, filesDir)
+	if err := os.Mkdir(files, 0755); err != nil {
+		return nil, errx.Wrap(ErrSave, err)
+	}
+	if err := vfs.ExtractTar(vfs.NewRealFSProvider(files), "/", r); err != nil {
+		return nil, errx.Wrap(ErrSave, err)
+	}
+
+	snap.Name = name
+	if snap.CreatedAt.IsZero() {
+		snap.CreatedAt = time.Now().UTC()
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return nil, errx.Wrap(ErrSave, err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, metaFile), data, 0644); err != nil {
+		return nil, errx.Wrap(ErrSave, err)
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		if _, statErr := os.Stat(final); statErr == nil {
+			return nil, errx.With(ErrSnapshotExists, ": %s", name)
+		}
+		return nil, errx.Wrap(ErrSave, err)
+	}
+	return &snap, nil
+}
+
+// Get returns the named snapshot.
+func (s *Store) Get(name string) (*Snapshot, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, name, metaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errx.With(ErrNotFound, ": %s", name)
+		}
+		return nil, errx.Wrap(ErrRead, err)
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, errx.With(ErrRead, " %s: %w", name, err)
+	}
+	return &snap, nil
+}
+
+// List returns every snapshot, oldest first.
+func (s *Store) List() ([]Snapshot, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errx.Wrap(ErrRead, err)
+	}
+	var snaps []Snapshot
+	for _, e := range entries {
+		if !e.IsDir() || ValidateName(e.Name()) != nil {
+			continue
+		}
+		snap, err := s.Get(e.Name())
+		if err != nil {
+			continue
+		}
+		snaps = append(snaps, *snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].CreatedAt.Before(snaps[j].CreatedAt)
+	})
+	return snaps, nil
+}
+
+// Remove deletes the named snapshot. Sandboxes seeded from it read its files
+// as their lower layer, so stop them first.
+func (s *Store) Remove(name string) error {
+	if _, err := s.Get(name); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(s.dir, name)); err != nil {
+		return errx.Wrap(ErrRemove, err)
+	}
+	return nil
+}
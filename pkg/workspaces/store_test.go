@@ -0,0 +1,100 @@
+package workspaces
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jingkaihe/matchlock/pkg/vfs"
+)
+
+func workspaceTar(t *testing.T, files map[string]string) *bytes.Buffer {
+	t.Helper()
+	src := vfs.NewMemoryProvider()
+	for name, content := range files {
+		require.NoError(t, vfs.MkdirAll(src, filepath.Dir(name), 0755))
+		require.NoError(t, src.WriteFile(name, []byte(content), 0644))
+	}
+	var buf bytes.Buffer
+	require.NoError(t, vfs.WriteTar(src, "/", &buf))
+	return &buf
+}
+
+func TestStoreSaveAndGet(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	snap, err := store.Save("agent-run-1", Snapshot{SandboxID: "vm-abc12345", Workspace: "/workspace"},
+		workspaceTar(t, map[string]string{"/notes.md": "step 3", "/src/main.go": "package main"}))
+	require.NoError(t, err)
+	assert.Equal(t, "agent-run-1", snap.Name)
+	assert.False(t, snap.CreatedAt.IsZero())
+
+	got, err := store.Get("agent-run-1")
+	require.NoError(t, err)
+	assert.Equal(t, "vm-abc12345", got.SandboxID)
+	assert.Equal(t, "/workspace", got.Workspace)
+
+	data, err := os.ReadFile(filepath.Join(store.FilesDir("agent-run-1"), "src", "main.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package main", string(data))
+}
+
+func TestStoreSaveRefusesExisting(t *testing.T) {
+	store := NewStore(t.TempDir())
+	_, err := store.Save("snap", Snapshot{}, workspaceTar(t, map[string]string{"/a": "1"}))
+	require.NoError(t, err)
+
+	_, err = store.Save("snap", Snapshot{}, workspaceTar(t, map[string]string{"/a": "2"}))
+	require.ErrorIs(t, err, ErrSnapshotExists)
+
+	data, err := os.ReadFile(filepath.Join(store.FilesDir("snap"), "a"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(data))
+}
+
+func TestStoreSaveLeavesNothingOnError(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStore(dir)
+
+	_, err := store.Save("broken", Snapshot{}, bytes.NewReader([]byte("not a tar")))
+	require.ErrorIs(t, err, ErrSave)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestStoreListAndRemove(t *testing.T) {
+	store := NewStore(t.TempDir())
+	snaps, err := store.List()
+	require.NoError(t, err)
+	assert.Empty(t, snaps)
+
+	for _, name := range []string{"first", "second"} {
+		_, err := store.Save(name, Snapshot{}, workspaceTar(t, map[string]string{"/f": name}))
+		require.NoError(t, err)
+	}
+	snaps, err = store.List()
+	require.NoError(t, err)
+	require.Len(t, snaps, 2)
+	assert.Equal(t, "first", snaps[0].Name)
+	assert.Equal(t, "second", snaps[1].Name)
+
+	require.NoError(t, store.Remove("first"))
+	_, err = store.Get("first")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.ErrorIs(t, store.Remove("first"), ErrNotFound)
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"snap", "agent-run.2", "A_1"} {
+		assert.NoError(t, ValidateName(name), name)
+	}
+	for _, name := range []string{"", ".hidden", "a/b", "../up", "-flag", "has space"} {
+		assert.ErrorIs(t, ValidateName(name), ErrInvalidName, name)
+	}
+}
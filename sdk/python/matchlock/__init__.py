@@ -20,15 +20,20 @@ Builder API:
 from .builder import Sandbox
 from .client import Client
 from .types import (
+    CacheMount,
     Config,
     CreateOptions,
     ExecResult,
     ExecStreamResult,
     FileInfo,
+    GitMount,
     ImageConfig,
     MatchlockError,
+    MountAccess,
     MountConfig,
+    MountIDMap,
     RPCError,
+    S3Mount,
     Secret,
 )
 
@@ -37,16 +42,21 @@ from importlib.metadata import version as _version
 __version__ = _version("matchlock")
 
 __all__ = [
+    "CacheMount",
     "Client",
     "Config",
     "CreateOptions",
     "ExecResult",
     "ExecStreamResult",
     "FileInfo",
+    "GitMount",
     "ImageConfig",
     "MatchlockError",
+    "MountAccess",
     "MountConfig",
+    "MountIDMap",
     "RPCError",
+    "S3Mount",
     "Sandbox",
     "Secret",
 ]
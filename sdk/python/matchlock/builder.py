@@ -10,7 +10,15 @@ Usage:
 
 from __future__ import annotations
 
-from .types import CreateOptions, ImageConfig, MountConfig, Secret
+from .types import (
+    CacheMount,
+    CreateOptions,
+    GitMount,
+    ImageConfig,
+    MountConfig,
+    S3Mount,
+    Secret,
+)
 
 
 class Sandbox:
@@ -31,6 +39,10 @@ class Sandbox:
         self._opts.disk_size_mb = mb
         return self
 
+    def with_rootfs_free_space(self, mb: int) -> Sandbox:
+        self._opts.rootfs_free_space_mb = mb
+        return self
+
     def with_timeout(self, seconds: int) -> Sandbox:
         self._opts.timeout_seconds = seconds
         return self
@@ -39,6 +51,11 @@ class Sandbox:
         self._opts.workspace = path
         return self
 
+    def with_workspace_from(self, name: str) -> Sandbox:
+        """Seed the workspace with a saved workspace snapshot."""
+        self._opts.workspace_from = name
+        return self
+
     def allow_host(self, *hosts: str) -> Sandbox:
         self._opts.allowed_hosts.extend(hosts)
         return self
@@ -67,8 +84,35 @@ class Sandbox:
             guest_path, MountConfig(type="real_fs", host_path=host_path, readonly=True)
         )
 
-    def mount_memory(self, guest_path: str) -> Sandbox:
-        return self.mount(guest_path, MountConfig(type="memory"))
+    def mount_host_dir_virtiofs(self, guest_path: str, host_path: str) -> Sandbox:
+        return self.mount(
+            guest_path,
+            MountConfig(type="real_fs", host_path=host_path, backend="virtiofs"),
+        )
+
+    def mount_s3(
+        self, guest_path: str, bucket: str, prefix: str = "", readonly: bool = False
+    ) -> Sandbox:
+        return self.mount(
+            guest_path,
+            MountConfig(
+                type="s3", s3=S3Mount(bucket=bucket, prefix=prefix), readonly=readonly
+            ),
+        )
+
+    def mount_cache(self, guest_path: str, name: str) -> Sandbox:
+        return self.mount(guest_path, MountConfig(type="cache", cache=CacheMount(name=name)))
+
+    def mount_git(self, guest_path: str, repo: GitMount) -> Sandbox:
+        return self.mount(guest_path, MountConfig(type="git", git=repo))
+
+    def mount_memory(self, guest_path: str, size_mb: int = 0) -> Sandbox:
+        return self.mount(guest_path, MountConfig(type="memory", size_mb=size_mb))
+
+    def mount_encrypted(self, guest_path: str) -> Sandbox:
+        """Scratch mount whose file data is encrypted on the host with a key
+        held only in memory."""
+        return self.mount(guest_path, MountConfig(type="encrypted"))
 
     def mount_overlay(self, guest_path: str, host_path: str) -> Sandbox:
         return self.mount(guest_path, MountConfig(type="overlay", host_path=host_path))
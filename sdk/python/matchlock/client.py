@@ -326,6 +326,8 @@ class Client:
             resources["memory_mb"] = opts.memory_mb
         if opts.disk_size_mb:
             resources["disk_size_mb"] = opts.disk_size_mb
+        if opts.rootfs_free_space_mb:
+            resources["rootfs_free_space_mb"] = opts.rootfs_free_space_mb
         if opts.timeout_seconds:
             resources["timeout_seconds"] = opts.timeout_seconds
         if resources:
@@ -349,12 +351,14 @@ class Client:
                 network["dns_servers"] = opts.dns_servers
             params["network"] = network
 
-        if opts.mounts or opts.workspace:
+        if opts.mounts or opts.workspace or opts.workspace_from:
             vfs: dict[str, Any] = {}
             if opts.mounts:
                 vfs["mounts"] = {k: v.to_dict() for k, v in opts.mounts.items()}
             if opts.workspace:
                 vfs["workspace"] = opts.workspace
+            if opts.workspace_from:
+                vfs["workspace_from"] = opts.workspace_from
             params["vfs"] = vfs
 
         if opts.image_config is not None:
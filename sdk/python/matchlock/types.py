@@ -15,12 +15,123 @@ class Config:
     """Whether to run matchlock with sudo (required for TAP devices on Linux)."""
 
 
+@dataclass
+class S3Mount:
+    """S3 bucket for an s3 mount. Credentials stay on the host."""
+
+    bucket: str
+    """Bucket name."""
+
+    prefix: str = ""
+    """Key prefix exposed as the mount root."""
+
+    region: str = ""
+    """Bucket region (default: from the host's AWS config)."""
+
+    endpoint: str = ""
+    """Endpoint of an S3-compatible store such as MinIO."""
+
+    def to_dict(self) -> dict[str, Any]:
+        d: dict[str, Any] = {"bucket": self.bucket}
+        if self.prefix:
+            d["prefix"] = self.prefix
+        if self.region:
+            d["region"] = self.region
+        if self.endpoint:
+            d["endpoint"] = self.endpoint
+        return d
+
+
+@dataclass
+class CacheMount:
+    """Shared cache for a cache mount, kept on the host for every sandbox
+    mounting the same name."""
+
+    name: str
+    """Cache name (letters, digits, '.', '_' and '-')."""
+
+    def to_dict(self) -> dict[str, Any]:
+        return {"name": self.name}
+
+
+@dataclass
+class GitMount:
+    """Repository for a git mount, cloned on the host with its credentials."""
+
+    url: str
+    """Repository URL."""
+
+    ref: str = ""
+    """Branch or tag to check out (default: the remote HEAD)."""
+
+    depth: int = 0
+    """Shallow clone depth (0 = full history)."""
+
+    push_branch: str = ""
+    """Branch the guest's commits are pushed to when the sandbox closes."""
+
+    def to_dict(self) -> dict[str, Any]:
+        d: dict[str, Any] = {"url": self.url}
+        if self.ref:
+            d["ref"] = self.ref
+        if self.depth:
+            d["depth"] = self.depth
+        if self.push_branch:
+            d["push_branch"] = self.push_branch
+        return d
+
+
+@dataclass
+class MountAccess:
+    """Glob patterns restricting the paths of a mount the guest may read and write.
+
+    Patterns match the path relative to the mount root; ``**`` matches any
+    number of directories and a pattern without ``/`` matches a name at any
+    depth. A path may be read (or written) if an allow pattern covers it, when
+    there are any, and no deny pattern does.
+    """
+
+    allow_read: list[str] = field(default_factory=list)
+    deny_read: list[str] = field(default_factory=list)
+    allow_write: list[str] = field(default_factory=list)
+    deny_write: list[str] = field(default_factory=list)
+
+    def to_dict(self) -> dict[str, Any]:
+        d: dict[str, Any] = {}
+        for key in ("allow_read", "deny_read", "allow_write", "deny_write"):
+            if getattr(self, key):
+                d[key] = list(getattr(self, key))
+        return d
+
+
+@dataclass
+class MountIDMap:
+    """Guest owner shown for the files of a mount's host directory.
+
+    Files owned by the host user and group (by default the ones running
+    matchlock) show as ``uid`` and ``gid``; any others show as 65534 (nobody).
+    """
+
+    uid: int
+    gid: int
+    host_uid: int | None = None
+    host_gid: int | None = None
+
+    def to_dict(self) -> dict[str, Any]:
+        d: dict[str, Any] = {"uid": self.uid, "gid": self.gid}
+        if self.host_uid is not None:
+            d["host_uid"] = self.host_uid
+        if self.host_gid is not None:
+            d["host_gid"] = self.host_gid
+        return d
+
+
 @dataclass
 class MountConfig:
     """VFS mount configuration."""
 
     type: str = "memory"
-    """Mount type: memory, real_fs, or overlay."""
+    """Mount type: memory, encrypted, real_fs, overlay, s3, git, or cache."""
 
     host_path: str = ""
     """Host path for real_fs mounts."""
@@ -28,12 +139,62 @@ class MountConfig:
     readonly: bool = False
     """Whether the mount is read-only."""
 
+    backend: str = ""
+    """How a real_fs mount reaches the guest: fuse (default) or virtiofs."""
+
+    s3: S3Mount | None = None
+    """Bucket of an s3 mount."""
+
+    git: GitMount | None = None
+    """Repository of a git mount."""
+
+    cache: CacheMount | None = None
+    """Shared cache of a cache mount."""
+
+    size_mb: int = 0
+    """Cap on the data a memory mount holds (0 = unbounded)."""
+
+    access: MountAccess | None = None
+    """Paths of the mount the guest may read and write."""
+
+    exclude: list[str] = field(default_factory=list)
+    """Globs of host paths hidden from the guest, on top of .matchlockignore."""
+
+    case: str = ""
+    """Handling of names differing only in case: reject-collisions or fold."""
+
+    idmap: MountIDMap | None = None
+    """Guest owner of the host files of a real_fs or overlay mount."""
+
+    unconfined: bool = False
+    """Follow symlinks out of the host directory, which are refused by default."""
+
     def to_dict(self) -> dict[str, Any]:
         d: dict[str, Any] = {"type": self.type}
         if self.host_path:
             d["host_path"] = self.host_path
         if self.readonly:
             d["readonly"] = self.readonly
+        if self.backend:
+            d["backend"] = self.backend
+        if self.s3 is not None:
+            d["s3"] = self.s3.to_dict()
+        if self.git is not None:
+            d["git"] = self.git.to_dict()
+        if self.cache is not None:
+            d["cache"] = self.cache.to_dict()
+        if self.size_mb:
+            d["size_mb"] = self.size_mb
+        if self.access is not None:
+            d["access"] = self.access.to_dict()
+        if self.exclude:
+            d["exclude"] = list(self.exclude)
+        if self.case:
+            d["case"] = self.case
+        if self.idmap is not None:
+            d["idmap"] = self.idmap.to_dict()
+        if self.unconfined:
+            d["unconfined"] = self.unconfined
         return d
 
 
@@ -104,7 +265,10 @@ class CreateOptions:
     """Memory in megabytes (0 = use default)."""
 
     disk_size_mb: int = 0
-    """Disk size in megabytes (0 = use default)."""
+    """Minimum disk size in megabytes (0 = fit the image plus free space)."""
+
+    rootfs_free_space_mb: int = 0
+    """Free space in megabytes beyond the image contents (0 = use default)."""
 
     timeout_seconds: int = 0
     """Maximum execution time in seconds (0 = use default)."""
@@ -124,6 +288,9 @@ class CreateOptions:
     workspace: str = ""
     """Guest mount point for VFS (default: /workspace)."""
 
+    workspace_from: str = ""
+    """Workspace snapshot to seed the workspace with."""
+
     dns_servers: list[str] = field(default_factory=list)
     """DNS servers to use (default: 8.8.8.8, 8.8.4.4)."""
 
@@ -157,6 +157,19 @@ class TestSandboxMounts:
         opts = Sandbox("img").mount_memory("/tmp").options()
         m = opts.mounts["/tmp"]
         assert m.type == "memory"
+        assert m.size_mb == 0
+
+    def test_mount_memory_size(self):
+        opts = Sandbox("img").mount_memory("/tmp", size_mb=64).options()
+        assert opts.mounts["/tmp"].to_dict() == {"type": "memory", "size_mb": 64}
+
+    def test_mount_cache(self):
+        opts = Sandbox("img").mount_cache("/workspace/.cache/pip", "pip").options()
+        assert opts.mounts["/workspace/.cache/pip"].to_dict() == {"type": "cache", "cache": {"name": "pip"}}
+
+    def test_mount_encrypted(self):
+        opts = Sandbox("img").mount_encrypted("/workspace").options()
+        assert opts.mounts["/workspace"].to_dict() == {"type": "encrypted"}
 
     def test_mount_overlay(self):
         opts = Sandbox("img").mount_overlay("/data", "/host/data").options()
@@ -13,7 +13,7 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func matchlockConfig(t *testing.T) sdk.Config {
+func matchlockConfig(t testing.TB) sdk.Config {
 	t.Helper()
 	cfg := sdk.DefaultConfig()
 	if os.Getenv("MATCHLOCK_BIN") == "" {
@@ -27,7 +27,7 @@ func launchAlpine(t *testing.T) *sdk.Client {
 	return launchWithBuilder(t, sdk.New("alpine:latest"))
 }
 
-func launchWithBuilder(t *testing.T, builder *sdk.SandboxBuilder) *sdk.Client {
+func launchWithBuilder(t testing.TB, builder *sdk.SandboxBuilder) *sdk.Client {
 	t.Helper()
 	client, err := sdk.NewClient(matchlockConfig(t))
 	require.NoError(t, err, "NewClient")
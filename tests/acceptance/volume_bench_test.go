@@ -0,0 +1,34 @@
+//go:build acceptance
+
+package acceptance
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jingkaihe/matchlock/pkg/api"
+	"github.com/jingkaihe/matchlock/pkg/sdk"
+	"github.com/stretchr/testify/require"
+)
+
+// BenchmarkVolumeSmallFiles writes and stats a few thousand small files on a
+// host volume, the access pattern of npm install, over each mount backend.
+// Run with: go test -tags acceptance -bench VolumeSmallFiles ./tests/acceptance
+func BenchmarkVolumeSmallFiles(b *testing.B) {
+	for _, backend := range []string{api.MountBackendFUSE, api.MountBackendVirtioFS} {
+		b.Run(backend, func(b *testing.B) {
+			hostDir := b.TempDir()
+			client := launchWithBuilder(b, sdk.New("alpine:latest").
+				Mount("/workspace/vol", sdk.MountConfig{Type: "real_fs", HostPath: hostDir, Backend: backend}))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				script := fmt.Sprintf(`d=/workspace/vol/run%d; mkdir -p $d && for i in $(seq 1 2000); do echo $i > $d/f$i; done && ls -l $d > /dev/null`, i)
+				result, err := client.Exec(context.Background(), script)
+				require.NoError(b, err, "Exec")
+				require.Equal(b, 0, result.ExitCode, result.Stderr)
+			}
+		})
+	}
+}